@@ -24,29 +24,60 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
 )
 
 type SocketError struct {
 	Msg string `json:"msg" cbor:"0,keyasint"`
+	// Range of the protocol versions the server speaks, only set if the
+	// version of the request is not supported
+	MinVersion Version `json:"minVersion,omitempty" cbor:"1,keyasint,omitempty"`
+	MaxVersion Version `json:"maxVersion,omitempty" cbor:"2,keyasint,omitempty"`
 }
 
 type AttestationRequest struct {
 	Id    string `json:"id" cbor:"0,keyasint"`
 	Nonce []byte `json:"nonce" nonce:"1,keyasint"`
+	// Only summarize the report without signing it
+	DryRun bool `json:"dryRun,omitempty" cbor:"2,keyasint,omitempty"`
+	// Digests of the metadata items the verifier holds, which are omitted from the report
+	Cached []string `json:"cached,omitempty" cbor:"3,keyasint,omitempty"`
+	// Return the report and a detached signature over its digest separately
+	Detached bool `json:"detached,omitempty" cbor:"4,keyasint,omitempty"`
+	// Compression algorithms the client accepts for the response in the order of
+	// preference. Without algorithms, the response is not compressed
+	Compression []Compression `json:"compression,omitempty" cbor:"5,keyasint,omitempty"`
 }
 
 type AttestationResponse struct {
 	AttestationReport []byte `json:"attestationReport" cbor:"0,keyasint"`
+	// JSON encoded summary, only in dry-run mode
+	DryRunSummary []byte `json:"dryRunSummary,omitempty" cbor:"1,keyasint,omitempty"`
+	// Serialized unsigned report and the detached signature, only in detached mode
+	Payload   []byte `json:"payload,omitempty" cbor:"2,keyasint,omitempty"`
+	Signature []byte `json:"signature,omitempty" cbor:"3,keyasint,omitempty"`
 }
 
 type VerificationRequest struct {
 	Nonce             []byte `json:"nonce" cbor:"0,keyasint"`
 	AttestationReport []byte `json:"attestationReport" cbor:"1,keyasint"`
-	Ca                []byte `json:"ca" cbor:"2,keyasint"`
-	Policies          []byte `json:"policies" cbor:"3,keyasint"`
+	// Ca is the trusted root CA or a PEM bundle of root CAs. Deprecated, kept
+	// for compatibility with verifiers and callers only specifying Ca
+	Ca       []byte `json:"ca" cbor:"2,keyasint"`
+	Policies []byte `json:"policies" cbor:"3,keyasint"`
+	// Cas are the trusted root CAs, each PEM or DER encoded. Chains ending in
+	// any of the roots in Ca or Cas are accepted
+	Cas [][]byte `json:"cas,omitempty" cbor:"4,keyasint,omitempty"`
+	// IssuedNonce requires the nonce to be issued via a nonce request to the
+	// daemon. The nonce is consumed, so that replayed reports are rejected
+	IssuedNonce bool `json:"issuedNonce,omitempty" cbor:"5,keyasint,omitempty"`
 }
 
 type VerificationResponse struct {
@@ -57,10 +88,20 @@ type MeasureRequest struct {
 	Name         string `json:"name,omitempty" cbor:"0,keyasint,omitempty"`
 	ConfigSha256 []byte `json:"configSha256,omitempty" cbor:"1,keyasint,omitempty"`
 	RootfsSha256 []byte `json:"rootfsSha256,omitempty" cbor:"2,keyasint,omitempty"`
+	// Removed marks the measurements of the container as removed, so that they
+	// are not restored from the journal after a restart
+	Removed bool `json:"removed,omitempty" cbor:"3,keyasint,omitempty"`
+	// If the digest is set, the request is a runtime measurement, which is
+	// recorded into the runtime measurement list instead of the container log
+	Hashtype  HashFunction `json:"hashType,omitempty" cbor:"4,keyasint,omitempty"`
+	Digest    []byte       `json:"digest,omitempty" cbor:"5,keyasint,omitempty"`
+	EventData []byte       `json:"eventData,omitempty" cbor:"6,keyasint,omitempty"`
 }
 
 type MeasureResponse struct {
 	Success bool `json:"success" cbor:"0,keyasint"`
+	// Length of the runtime measurement list after recording
+	Length int `json:"length,omitempty" cbor:"1,keyasint,omitempty"`
 }
 
 type TLSSignRequest struct {
@@ -82,9 +123,72 @@ type TLSCertResponse struct {
 	Certificate [][]byte `json:"certificate" cbor:"0,keyasint"`
 }
 
+type StatusRequest struct {
+	Id string `json:"id" cbor:"0,keyasint"`
+}
+
+type StatusResponse struct {
+	Drivers      []ar.DriverStatus    `json:"drivers" cbor:"0,keyasint"`
+	Enrollment   *ar.EnrollmentStatus `json:"enrollment,omitempty" cbor:"1,keyasint,omitempty"`
+	Metadata     []ar.MetadataStatus  `json:"metadata,omitempty" cbor:"2,keyasint,omitempty"`
+	ConfigDigest string               `json:"configDigest,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+// MetadataRequest requests the status of all loaded metadata items or, if the
+// digest is set, additionally the signed metadata item with the digest
+type MetadataRequest struct {
+	Id     string `json:"id" cbor:"0,keyasint"`
+	Digest string `json:"digest,omitempty" cbor:"1,keyasint,omitempty"`
+}
+
+type MetadataResponse struct {
+	Metadata []ar.MetadataStatus `json:"metadata" cbor:"0,keyasint"`
+	Item     []byte              `json:"item,omitempty" cbor:"1,keyasint,omitempty"`
+}
+
+// CacheRequest requests the statistics of the in-memory caches. If flush is
+// set to the name of a cache or to "all", the cache or all caches are flushed
+// before the statistics are collected
+type CacheRequest struct {
+	Id    string `json:"id" cbor:"0,keyasint"`
+	Flush string `json:"flush,omitempty" cbor:"1,keyasint,omitempty"`
+}
+
+type CacheResponse struct {
+	Caches []cache.Stats `json:"caches" cbor:"0,keyasint"`
+}
+
+// PeerCacheRequest requests which of the metadata items with the hex encoded
+// SHA-256 digests the verifier holds from previously verified reports, so that
+// a prover can omit them from its report
+type PeerCacheRequest struct {
+	Id      string   `json:"id" cbor:"0,keyasint"`
+	Digests []string `json:"digests" cbor:"1,keyasint"`
+}
+
+type PeerCacheResponse struct {
+	Cached []string `json:"cached" cbor:"0,keyasint"`
+}
+
+// NonceRequest requests a random nonce, which the daemon records until it is
+// consumed by a verification request with IssuedNonce set or expires
+type NonceRequest struct {
+	Id string `json:"id" cbor:"0,keyasint"`
+}
+
+type NonceResponse struct {
+	Nonce   []byte    `json:"nonce" cbor:"0,keyasint"`
+	Expires time.Time `json:"expires" cbor:"1,keyasint"`
+}
+
 const (
 	// Set maximum message length to 10 MB
 	MaxMsgLen = 1024 * 1024 * 10
+	// Set maximum length of messages reassembled from chunks to 256 MB
+	MaxChunkedMsgLen = 1024 * 1024 * 256
+	// FlagMoreChunks is set in the type field of the header of all but the
+	// last chunk of a message split into chunks
+	FlagMoreChunks uint32 = 1 << 31
 )
 
 type HashFunction int32
@@ -116,12 +220,23 @@ type PSSOptions struct {
 }
 
 const (
-	TypeError   uint32 = 0
-	TypeAttest  uint32 = 1
-	TypeVerify  uint32 = 2
-	TypeMeasure uint32 = 3
-	TypeTLSSign uint32 = 4
-	TypeTLSCert uint32 = 5
+	TypeError     uint32 = 0
+	TypeAttest    uint32 = 1
+	TypeVerify    uint32 = 2
+	TypeMeasure   uint32 = 3
+	TypeTLSSign   uint32 = 4
+	TypeTLSCert   uint32 = 5
+	TypeStatus    uint32 = 6
+	TypeMetadata  uint32 = 7
+	TypeCache     uint32 = 8
+	TypePeerCache uint32 = 9
+	TypeNonce     uint32 = 10
+
+	// Plugin protocol types, see plugin.go
+	TypePluginInfo      uint32 = 16
+	TypePluginMeasure   uint32 = 17
+	TypePluginSign      uint32 = 18
+	TypePluginCertChain uint32 = 19
 )
 
 func TypeToString(t uint32) string {
@@ -138,6 +253,24 @@ func TypeToString(t uint32) string {
 		return "TLSSign"
 	case TypeTLSCert:
 		return "TLSCert"
+	case TypeStatus:
+		return "Status"
+	case TypeMetadata:
+		return "Metadata"
+	case TypeCache:
+		return "Cache"
+	case TypePeerCache:
+		return "PeerCache"
+	case TypeNonce:
+		return "Nonce"
+	case TypePluginInfo:
+		return "PluginInfo"
+	case TypePluginMeasure:
+		return "PluginMeasure"
+	case TypePluginSign:
+		return "PluginSign"
+	case TypePluginCertChain:
+		return "PluginCertChain"
 	default:
 		return "Unknown"
 	}
@@ -222,63 +355,117 @@ func SignerOptsToHash(opts crypto.SignerOpts) (HashFunction, error) {
 //	Len uint32 -> Length of the payload to be sent
 //	Type uint32 -> Type of the payload
 //	payload []byte -> encoded payload
+//
+// Messages split into chunks by a ChunkWriter are reassembled and compressed
+// messages are decompressed transparently. The protocol version is discarded,
+// ReceiveVersion returns it
 func Receive(conn net.Conn) ([]byte, uint32, error) {
+	return ReceiveLimited(conn, MaxChunkedMsgLen)
+}
+
+// ReceiveLimited receives data from a socket in the same format as Receive,
+// but refuses payloads exceeding the specified maximum length. For messages
+// split into chunks, the maximum length applies to the reassembled payload,
+// whereas each chunk is limited to MaxMsgLen
+func ReceiveLimited(conn net.Conn, maxLen int) ([]byte, uint32, error) {
+	payload, t, _, err := ReceiveVersion(conn, maxLen)
+	return payload, t, err
+}
+
+// ReceiveVersion receives data like ReceiveLimited and additionally returns
+// the protocol version of the message. The version is not checked, so that
+// the receiver can reject unsupported versions with a structured error
+func ReceiveVersion(conn net.Conn, maxLen int) ([]byte, uint32, Version, error) {
 
 	// If unix domain sockets are used, set the write buffer size
 	_, ok := conn.(*net.UnixConn)
 	if ok {
 		err := conn.(*net.UnixConn).SetReadBuffer(MaxMsgLen)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to socket write buffer size %v", err)
+			return nil, 0, 0, fmt.Errorf("failed to socket write buffer size %v", err)
 		}
 	}
 
-	// Read header
+	maxChunkLen := maxLen
+	if maxChunkLen > MaxMsgLen {
+		maxChunkLen = MaxMsgLen
+	}
+
+	// The buffer grows with the received data instead of being allocated based
+	// on the unauthenticated length from the header
+	payload := bytes.NewBuffer(nil)
 	buf := make([]byte, 8)
+	var msgType uint32
 
-	log.Tracef("Reading header length %v", len(buf))
+	for chunk := 0; ; chunk++ {
 
-	n, err := conn.Read(buf)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to read header: %w", err)
-	}
-	if n != 8 {
-		return nil, 0, fmt.Errorf("read %v bytes (expected 8)", n)
-	}
+		log.Tracef("Reading header length %v", len(buf))
 
-	// Decode header to get length and type
-	payloadLen := int(binary.BigEndian.Uint32(buf[0:4]))
-	msgType := binary.BigEndian.Uint32(buf[4:8])
+		// A header split across several reads is valid, e.g., on TCP connections
+		_, err := io.ReadFull(conn, buf)
+		if err != nil && chunk > 0 {
+			return nil, 0, 0, fmt.Errorf("transfer interrupted after %v chunks: %w", chunk, err)
+		}
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to read header: %w", err)
+		}
 
-	if payloadLen > MaxMsgLen {
-		return nil, 0, fmt.Errorf("cannot receive: payload size %v exceeds maximum size %v",
-			payloadLen, MaxMsgLen)
-	}
+		// Decode header to get length, type and whether more chunks follow
+		payloadLen := int(binary.BigEndian.Uint32(buf[0:4]))
+		t := binary.BigEndian.Uint32(buf[4:8])
+		more := t&FlagMoreChunks != 0
+		t &^= FlagMoreChunks
+
+		if chunk == 0 {
+			msgType = t
+		} else if t != msgType {
+			return nil, 0, 0, fmt.Errorf("chunk %v of type %v within message of type %v", chunk,
+				TypeToString(t), TypeToString(msgType))
+		}
+		if payloadLen > maxChunkLen {
+			return nil, 0, 0, fmt.Errorf("cannot receive: payload size %v exceeds maximum size %v",
+				payloadLen, maxChunkLen)
+		}
+		if payload.Len()+payloadLen > maxLen {
+			return nil, 0, 0, fmt.Errorf("cannot receive: message size exceeds maximum size %v",
+				maxLen)
+		}
+		if more && payloadLen == 0 {
+			return nil, 0, 0, fmt.Errorf("cannot receive: empty chunk %v", chunk)
+		}
 
-	log.Tracef("Decoded header. Type %v, length %v", TypeToString(msgType), payloadLen)
+		log.Tracef("Decoded header. Type %v, length %v, more chunks %v", TypeToString(t),
+			payloadLen, more)
 
-	// Read payload
-	payload := bytes.NewBuffer(nil)
-	received := 0
-	for {
-		chunk := make([]byte, 128*1024)
-		n, err = conn.Read(chunk)
+		// Read payload
+		n, err := io.CopyN(payload, conn, int64(payloadLen))
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to read payload: %w", err)
+			return nil, 0, 0, fmt.Errorf("failed to read payload after %v of %v bytes: %w", n,
+				payloadLen, err)
 		}
-		received += n
-		payload.Write(chunk[:n])
-
-		log.Tracef("Received chunk of %v bytes\n", n)
 
-		if received == payloadLen {
+		if !more {
 			break
 		}
 	}
 
-	log.Tracef("Received payload length %v", payloadLen)
+	log.Tracef("Received payload length %v", payload.Len())
 
-	return payload.Bytes(), msgType, nil
+	// Compressed payloads are decompressed transparently, the decompressed
+	// payload is subject to the same maximum length
+	msgType, v := splitVersion(msgType)
+	msgType, c := splitCompression(msgType)
+	if c == CompressionNone {
+		return payload.Bytes(), msgType, v, nil
+	}
+	data, err := Decompress(payload.Bytes(), c, maxLen)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("cannot receive %v message: %w", TypeToString(msgType), err)
+	}
+	log.Debugf("Received %v message compressed with %v: %v bytes, %v bytes decompressed",
+		TypeToString(msgType), c, payload.Len(), len(data))
+
+	return data, msgType, v, nil
 }
 
 // Send sends data to a socket with the following format
@@ -286,6 +473,9 @@ func Receive(conn net.Conn) ([]byte, uint32, error) {
 //	Len uint32 -> Length of the payload to be sent
 //	Type uint32 -> Type of the payload
 //	payload []byte -> encoded payload
+//
+// The message is sent with protocol version 1, unless the type field has the
+// version bits set, e.g. by SendVersion
 func Send(conn net.Conn, payload []byte, t uint32) error {
 
 	if len(payload) > MaxMsgLen {
@@ -293,6 +483,104 @@ func Send(conn net.Conn, payload []byte, t uint32) error {
 			len(payload), MaxMsgLen)
 	}
 
+	return sendFrame(conn, payload, t)
+}
+
+// SendChunked sends data in the same format as Send, but splits payloads
+// exceeding the chunk size into several chunks, which Receive reassembles.
+// Payloads fitting into a single chunk are sent like with Send
+func SendChunked(conn net.Conn, payload []byte, t uint32, chunkSize int) error {
+	w := NewChunkWriter(conn, t, chunkSize)
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ChunkWriter sends the data written to it as message of the specified type
+// split into chunks of at most the chunk size. All but the last chunk have
+// the FlagMoreChunks flag set in the type field of their header. Data
+// fitting into a single chunk is sent as a single message without the flag,
+// which is compatible with receivers not supporting chunks. The last chunk is
+// sent on Close
+type ChunkWriter struct {
+	conn      net.Conn
+	t         uint32
+	chunkSize int
+	buf       []byte
+	chunks    int
+	err       error
+}
+
+// NewChunkWriter returns a ChunkWriter for the message type. Chunk sizes
+// outside the range from 1 to MaxMsgLen select MaxMsgLen
+func NewChunkWriter(conn net.Conn, t uint32, chunkSize int) *ChunkWriter {
+	if chunkSize <= 0 || chunkSize > MaxMsgLen {
+		chunkSize = MaxMsgLen
+	}
+	return &ChunkWriter{
+		conn:      conn,
+		t:         t,
+		chunkSize: chunkSize,
+	}
+}
+
+// Write buffers the data and sends the full chunks. A chunk is only sent once
+// further data is written, as the last chunk must not have the flag set
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(true); err != nil {
+				return n, err
+			}
+		}
+		k := w.chunkSize - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close sends the last chunk
+func (w *ChunkWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flush(false); err != nil {
+		return err
+	}
+	if w.chunks > 1 {
+		log.Tracef("Sent payload type %v in %v chunks", TypeToString(w.t), w.chunks)
+	}
+	w.err = errors.New("chunk writer closed")
+	return nil
+}
+
+func (w *ChunkWriter) flush(more bool) error {
+	t := w.t
+	if more {
+		t |= FlagMoreChunks
+	}
+	if err := sendFrame(w.conn, w.buf, t); err != nil {
+		w.err = fmt.Errorf("failed to send chunk %v: %w", w.chunks, err)
+		return w.err
+	}
+	w.chunks++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// sendFrame sends the header and the payload of a single message or chunk
+func sendFrame(conn net.Conn, payload []byte, t uint32) error {
+
 	// If unix domain sockets are used, set the write buffer size
 	_, ok := conn.(*net.UnixConn)
 	if ok {
@@ -316,7 +604,8 @@ func Send(conn net.Conn, payload []byte, t uint32) error {
 		return fmt.Errorf("could only send %v of %v bytes", n, len(buf))
 	}
 
-	log.Tracef("Sending payload type %v length %v", TypeToString(t), uint32(len(payload)))
+	log.Tracef("Sending payload type %v length %v", TypeToString(t&^FlagMoreChunks),
+		uint32(len(payload)))
 
 	n, err = conn.Write(payload)
 	if err != nil {
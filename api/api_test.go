@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+// readConn is a connection, which reads from the reader
+type readConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// writeConn is a connection, which writes to the buffer
+type writeConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *writeConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func frame(payload []byte, t uint32) []byte {
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], t)
+	return append(buf, payload...)
+}
+
+func TestReceiveLimited(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xaa}, 300*1024)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxLen  int
+		oneByte bool
+		want    []byte
+		wantErr bool
+	}{
+		{"Valid", frame(payload, TypeAttest), MaxMsgLen, false, payload, false},
+		{"Split Reads", frame(payload[:16], TypeAttest), MaxMsgLen, true, payload[:16], false},
+		{"Empty Payload", frame(nil, TypeAttest), MaxMsgLen, false, []byte{}, false},
+		{"Trailing Data", append(frame(payload[:16], TypeAttest), 0x01), MaxMsgLen,
+			false, payload[:16], false},
+		{"Short Header", []byte{0, 0, 0}, MaxMsgLen, false, nil, true},
+		{"Short Payload", frame(payload, TypeAttest)[:1024], MaxMsgLen, false, nil, true},
+		{"Exceeds Maximum", frame(make([]byte, 1025), TypeAttest), 1024, false, nil, true},
+		{"Chunks", chunks(payload, TypeAttest, 100*1024), MaxMsgLen, false, payload, false},
+		{"Chunks Split Reads", chunks(payload[:64], TypeAttest, 16), MaxMsgLen, true,
+			payload[:64], false},
+		{"Chunks Exceed Maximum", chunks(payload[:2048], TypeAttest, 512), 1024, false, nil, true},
+		{"Chunks Interrupted", chunks(payload, TypeAttest, 100*1024)[:200*1024], MaxMsgLen,
+			false, nil, true},
+		{"Chunks Missing Last", frame(payload, TypeAttest|FlagMoreChunks), MaxMsgLen, false,
+			nil, true},
+		{"Chunks Type Changed", append(frame(payload[:16], TypeAttest|FlagMoreChunks),
+			frame(payload[:16], TypeVerify)...), MaxMsgLen, false, nil, true},
+		{"Empty Chunk", append(frame(nil, TypeAttest|FlagMoreChunks),
+			frame(payload[:16], TypeAttest)...), MaxMsgLen, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.data)
+			if tt.oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			got, msgType, err := ReceiveLimited(&readConn{r: r}, tt.maxLen)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReceiveLimited() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msgType != TypeAttest {
+				t.Errorf("ReceiveLimited() type = %v, want %v", msgType, TypeAttest)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ReceiveLimited() payload length = %v, want %v", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+// chunks returns the payload split into chunks of the specified size
+func chunks(payload []byte, t uint32, size int) []byte {
+	var data []byte
+	for len(payload) > size {
+		data = append(data, frame(payload[:size], t|FlagMoreChunks)...)
+		payload = payload[size:]
+	}
+	return append(data, frame(payload, t)...)
+}
+
+func TestSendChunked(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xaa}, 300*1024)
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		chunkSize int
+		want      []byte
+	}{
+		{"Single Chunk", payload, MaxMsgLen, frame(payload, TypeAttest)},
+		{"Default Chunk Size", payload, 0, frame(payload, TypeAttest)},
+		{"Exact Chunk Size", payload, len(payload), frame(payload, TypeAttest)},
+		{"Chunks", payload, 100 * 1024, chunks(payload, TypeAttest, 100*1024)},
+		{"Partial Last Chunk", payload, 128 * 1024, chunks(payload, TypeAttest, 128*1024)},
+		{"Empty Payload", nil, 1024, frame(nil, TypeAttest)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &writeConn{}
+			if err := SendChunked(conn, tt.payload, TypeAttest, tt.chunkSize); err != nil {
+				t.Fatalf("SendChunked() error = %v", err)
+			}
+			if !bytes.Equal(conn.buf.Bytes(), tt.want) {
+				t.Fatalf("SendChunked() sent %v bytes, want %v", conn.buf.Len(), len(tt.want))
+			}
+
+			got, msgType, err := Receive(&readConn{r: bytes.NewReader(conn.buf.Bytes())})
+			if err != nil {
+				t.Fatalf("Receive() error = %v", err)
+			}
+			if msgType != TypeAttest || !bytes.Equal(got, tt.payload) {
+				t.Errorf("Receive() type = %v, payload length = %v, want %v", msgType,
+					len(got), len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestChunkWriter(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xaa}, 1000)
+
+	// Writes of arbitrary size produce the same chunks
+	conn := &writeConn{}
+	w := NewChunkWriter(conn, TypeVerify, 256)
+	for i := 0; i < len(payload); i += 7 {
+		end := i + 7
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if _, err := w.Write(payload[i:end]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if want := chunks(payload, TypeVerify, 256); !bytes.Equal(conn.buf.Bytes(), want) {
+		t.Fatalf("ChunkWriter sent %v bytes, want %v", conn.buf.Len(), len(want))
+	}
+
+	if _, err := w.Write(payload); err == nil {
+		t.Errorf("Write() after Close() succeeded")
+	}
+}
+
+func FuzzReceiveLimited(f *testing.F) {
+	f.Add(frame([]byte("payload"), TypeAttest))
+	f.Add(frame(nil, TypeMeasure))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1})
+	f.Add([]byte{})
+	f.Add(chunks([]byte("payload"), TypeAttest, 3))
+	gzipped, _ := Compress([]byte("payload"), CompressionGzip)
+	f.Add(frame(gzipped, WithCompression(TypeAttest, CompressionGzip)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		payload, _, err := ReceiveLimited(&readConn{r: bytes.NewReader(data)}, 1024)
+		if err != nil {
+			return
+		}
+		// Decompressed payloads may exceed the received bytes, but not the maximum
+		_, c := splitCompression(binary.BigEndian.Uint32(data[4:8]))
+		if len(payload) > 1024 || (c == CompressionNone && len(payload) > len(data)-8) {
+			t.Errorf("received payload of %v bytes from %v bytes", len(payload), len(data))
+		}
+	})
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Compression is the algorithm the payload of a socket API message is
+// compressed with. It is signalled in the compression bits of the type field
+// of the message header, which are zero for uncompressed messages
+type Compression uint32
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+	CompressionZstd Compression = 2
+)
+
+const (
+	compressionShift = 24
+	// CompressionMask covers the compression bits in the type field of the header
+	CompressionMask uint32 = 0xf << compressionShift
+)
+
+// compressor creates the writers compressing and the readers decompressing
+// the payloads with an algorithm
+type compressor struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader, maxLen int) (io.ReadCloser, error)
+}
+
+// compressors contains the supported algorithms. Algorithms depending on
+// external libraries register themselves if compiled in
+var compressors = map[Compression]compressor{
+	CompressionGzip: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader, maxLen int) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown (%v)", uint32(c))
+	}
+}
+
+// ParseCompression returns the compression algorithm with the name, e.g. "zstd"
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %v (possible: none, gzip, zstd)",
+		name)
+}
+
+// SupportedCompressions returns the compression algorithms compiled in
+func SupportedCompressions() []Compression {
+	supported := make([]Compression, 0, len(compressors))
+	for c := range compressors {
+		supported = append(supported, c)
+	}
+	sort.Slice(supported, func(i, j int) bool { return supported[i] < supported[j] })
+	return supported
+}
+
+// SelectCompression returns the first of the algorithms accepted by the client
+// which is supported. Clients not accepting any supported algorithm, e.g.
+// clients not aware of compression, receive uncompressed payloads
+func SelectCompression(accepted []Compression) Compression {
+	for _, c := range accepted {
+		if _, ok := compressors[c]; ok {
+			return c
+		}
+	}
+	return CompressionNone
+}
+
+// WithCompression returns the message type with the compression bits set
+func WithCompression(t uint32, c Compression) uint32 {
+	return t&^CompressionMask | uint32(c)<<compressionShift&CompressionMask
+}
+
+// splitCompression returns the message type without the compression bits and
+// the compression signalled by them
+func splitCompression(t uint32) (uint32, Compression) {
+	return t &^ CompressionMask, Compression((t & CompressionMask) >> compressionShift)
+}
+
+// CompressWriter compresses the data written to it with the specified algorithm
+// before writing it to the underlying writer, e.g. a ChunkWriter for a
+// message type with the compression bits set
+type CompressWriter struct {
+	w      *countWriter
+	zw     io.WriteCloser
+	c      Compression
+	read   int64
+	closed bool
+}
+
+// countWriter counts the bytes written to the underlying writer
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// NewCompressWriter returns a CompressWriter for the algorithm. With
+// CompressionNone, the data is written to the underlying writer as is
+func NewCompressWriter(w io.Writer, c Compression) (*CompressWriter, error) {
+	cw := &countWriter{w: w}
+	if c == CompressionNone {
+		return &CompressWriter{w: cw, c: c}, nil
+	}
+	comp, ok := compressors[c]
+	if !ok {
+		return nil, fmt.Errorf("compression %v not supported", c)
+	}
+	zw, err := comp.newWriter(cw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %v writer: %w", c, err)
+	}
+	return &CompressWriter{w: cw, zw: zw, c: c}, nil
+}
+
+func (w *CompressWriter) Write(p []byte) (int, error) {
+	w.read += int64(len(p))
+	if w.zw == nil {
+		return w.w.Write(p)
+	}
+	return w.zw.Write(p)
+}
+
+// Close flushes the compressed data. It does not close the underlying writer
+func (w *CompressWriter) Close() error {
+	if w.zw == nil || w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.zw.Close(); err != nil {
+		return fmt.Errorf("failed to finish %v compression: %w", w.c, err)
+	}
+	return nil
+}
+
+// Sizes returns the number of bytes written to the CompressWriter and the
+// number of compressed bytes written to the underlying writer
+func (w *CompressWriter) Sizes() (int64, int64) {
+	return w.read, w.w.n
+}
+
+// Compress returns the data compressed with the algorithm
+func Compress(data []byte, c Compression) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := NewCompressWriter(buf, c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns the decompressed data, which must not exceed the maximum
+// length. As the data is untrusted, malformed input of the decoders is
+// reported as error
+func Decompress(data []byte, c Compression, maxLen int) (decompressed []byte, err error) {
+	if c == CompressionNone {
+		return data, nil
+	}
+	comp, ok := compressors[c]
+	if !ok {
+		return nil, fmt.Errorf("compression %v not supported", c)
+	}
+
+	// Decoders are not expected to panic on malformed input, but a panic must
+	// not take down the server handling an untrusted message
+	defer func() {
+		if r := recover(); r != nil {
+			decompressed = nil
+			err = fmt.Errorf("failed to decompress %v payload: %v", c, r)
+		}
+	}()
+
+	r, err := comp.newReader(bytes.NewReader(data), maxLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %v payload: %w", c, err)
+	}
+	defer r.Close()
+
+	buf := new(bytes.Buffer)
+	n, err := io.Copy(buf, io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %v payload: %w", c, err)
+	}
+	if n > int64(maxLen) {
+		return nil, fmt.Errorf("decompressed payload exceeds maximum size %v", maxLen)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("/usr/lib/x86_64-linux-gnu/libc.so.6 "), 10*1024)
+
+	for _, c := range append([]Compression{CompressionNone}, SupportedCompressions()...) {
+		t.Run(c.String(), func(t *testing.T) {
+			conn := &writeConn{}
+			w := NewChunkWriter(conn, WithCompression(TypeAttest, c), 4096)
+			cw, err := NewCompressWriter(w, c)
+			if err != nil {
+				t.Fatalf("NewCompressWriter() error = %v", err)
+			}
+			if _, err := cw.Write(payload); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			size, compressed := cw.Sizes()
+			if size != int64(len(payload)) {
+				t.Errorf("Sizes() = %v, want %v", size, len(payload))
+			}
+			if c != CompressionNone && compressed >= size {
+				t.Errorf("%v compressed %v bytes to %v bytes", c, size, compressed)
+			}
+
+			got, msgType, err := Receive(&readConn{r: bytes.NewReader(conn.buf.Bytes())})
+			if err != nil {
+				t.Fatalf("Receive() error = %v", err)
+			}
+			if msgType != TypeAttest || !bytes.Equal(got, payload) {
+				t.Errorf("Receive() type = %v, payload length = %v, want %v", msgType,
+					len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestReceiveCompressed(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xaa}, 64*1024)
+	gzipped, err := Compress(payload, CompressionGzip)
+	if err != nil {
+		t.Fatalf("Compress() error = %v", err)
+	}
+	corrupted := append([]byte{}, gzipped...)
+	corrupted[len(corrupted)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxLen  int
+		wantErr bool
+	}{
+		{"Gzip", frame(gzipped, WithCompression(TypeAttest, CompressionGzip)), MaxMsgLen,
+			false},
+		{"Gzip Chunks", chunks(gzipped, WithCompression(TypeAttest, CompressionGzip), 16),
+			MaxMsgLen, false},
+		{"Corrupted", frame(corrupted, WithCompression(TypeAttest, CompressionGzip)),
+			MaxMsgLen, true},
+		{"Truncated", frame(gzipped[:len(gzipped)-8], WithCompression(TypeAttest,
+			CompressionGzip)), MaxMsgLen, true},
+		{"Not Compressed", frame(payload, WithCompression(TypeAttest, CompressionGzip)),
+			MaxMsgLen, true},
+		{"Unknown Compression", frame(gzipped, WithCompression(TypeAttest, 0xf)), MaxMsgLen,
+			true},
+		{"Decompressed Exceeds Maximum", frame(gzipped, WithCompression(TypeAttest,
+			CompressionGzip)), len(payload) - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, msgType, err := ReceiveLimited(&readConn{r: bytes.NewReader(tt.data)}, tt.maxLen)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReceiveLimited() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msgType != TypeAttest || !bytes.Equal(got, payload) {
+				t.Errorf("ReceiveLimited() type = %v, payload length = %v, want %v", msgType,
+					len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestSelectCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []Compression
+		want     Compression
+	}{
+		{"Nothing Announced", nil, CompressionNone},
+		{"Gzip", []Compression{CompressionGzip}, CompressionGzip},
+		{"Unknown", []Compression{0xf}, CompressionNone},
+		{"Preference", []Compression{0xf, CompressionGzip}, CompressionGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SelectCompression(tt.accepted); got != tt.want {
+				t.Errorf("SelectCompression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without the zstd build tag, clients preferring zstd receive gzip
+	want := CompressionGzip
+	if _, ok := compressors[CompressionZstd]; ok {
+		want = CompressionZstd
+	}
+	if got := SelectCompression([]Compression{CompressionZstd, CompressionGzip}); got != want {
+		t.Errorf("SelectCompression() = %v, want %v", got, want)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		got, err := ParseCompression(c.String())
+		if err != nil || got != c {
+			t.Errorf("ParseCompression(%v) = %v, %v", c, got, err)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Errorf("ParseCompression() of unknown algorithm succeeded")
+	}
+}
+
+// BenchmarkCompression compares the transfer size of a report with a large
+// IMA-like runtime log for each supported algorithm
+func BenchmarkCompression(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
+
+	for _, s := range []ar.Serializer{ar.JsonSerializer{}, ar.CborSerializer{}} {
+		f, err := fixtures.Generate(fixtures.Options{Serializer: s, Apps: 50, AppEvents: 200})
+		if err != nil {
+			b.Fatalf("Generate() error = %v", err)
+		}
+		for _, c := range append([]Compression{CompressionNone}, SupportedCompressions()...) {
+			b.Run(fmt.Sprintf("%v %v", f.Name(), c), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(f.Report)))
+				var compressed []byte
+				for i := 0; i < b.N; i++ {
+					compressed, err = Compress(f.Report, c)
+					if err != nil {
+						b.Fatalf("Compress() error = %v", err)
+					}
+					if _, err := Decompress(compressed, c, MaxChunkedMsgLen); err != nil {
+						b.Fatalf("Decompress() error = %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(f.Report)), "raw-bytes")
+				b.ReportMetric(float64(len(compressed)), "transfer-bytes")
+			})
+		}
+	}
+}
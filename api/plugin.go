@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Definitions of the plugin protocol. External measurement and signer plugins
+// listen on a unix domain socket and handle one CBOR encoded request per
+// connection, using the same framing as the socket API (see Send and Receive).
+// Errors are returned as SocketError with type TypeError
+
+// PluginInfoRequest requests the vendor and the capabilities of a plugin
+type PluginInfoRequest struct {
+	Version int `json:"version" cbor:"0,keyasint"`
+}
+
+// PluginInfoResponse contains the vendor namespace, e.g. "com.example", the
+// protocol version and whether the plugin provides a signing key
+type PluginInfoResponse struct {
+	Version int    `json:"version" cbor:"0,keyasint"`
+	Vendor  string `json:"vendor" cbor:"1,keyasint"`
+	Name    string `json:"name,omitempty" cbor:"2,keyasint,omitempty"`
+	Signer  bool   `json:"signer,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+// PluginMeasureRequest requests evidence bound to the specified nonce
+type PluginMeasureRequest struct {
+	Nonce []byte `json:"nonce" cbor:"0,keyasint"`
+}
+
+// PluginMeasureResponse contains the evidence, the evidence type without the
+// vendor namespace and optional certificates in DER format
+type PluginMeasureResponse struct {
+	Type     string   `json:"type" cbor:"0,keyasint"`
+	Evidence []byte   `json:"evidence" cbor:"1,keyasint"`
+	Certs    [][]byte `json:"certs,omitempty" cbor:"2,keyasint,omitempty"`
+}
+
+// PluginSignRequest requests a signature over the digest with the plugin key
+type PluginSignRequest struct {
+	Digest   []byte       `json:"digest" cbor:"0,keyasint"`
+	Hashtype HashFunction `json:"hashType" cbor:"1,keyasint"`
+	PssOpts  *PSSOptions  `json:"pssOpts,omitempty" cbor:"2,keyasint,omitempty"`
+}
+
+type PluginSignResponse struct {
+	Signature []byte `json:"signature" cbor:"0,keyasint"`
+}
+
+type PluginCertChainRequest struct {
+	Version int `json:"version" cbor:"0,keyasint"`
+}
+
+// PluginCertChainResponse contains the certificate chain of the plugin key in
+// DER format, starting with the leaf certificate
+type PluginCertChainResponse struct {
+	Certs [][]byte `json:"certs" cbor:"0,keyasint"`
+}
+
+const (
+	// PluginVersion is the current version of the plugin protocol
+	PluginVersion = 1
+
+	// PluginMaxMsgLen is the maximum message length accepted from plugins
+	PluginMaxMsgLen = 1024 * 1024
+)
+
+// vendorRegex matches vendor namespaces in reverse domain name notation
+var vendorRegex = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+// VendorType returns the vendor namespaced type of plugin measurements and
+// reference values in the format <vendor>/<type>, e.g.
+// "com.example/Sensor Measurement"
+func VendorType(vendor, t string) (string, error) {
+	if !vendorRegex.MatchString(vendor) {
+		return "", fmt.Errorf("invalid vendor namespace %q", vendor)
+	}
+	if t == "" || len(t) > 64 || strings.Contains(t, "/") {
+		return "", fmt.Errorf("invalid type %q", t)
+	}
+	return vendor + "/" + t, nil
+}
+
+// SplitVendorType splits a vendor namespaced type into vendor and type
+func SplitVendorType(vt string) (string, string, error) {
+	i := strings.Index(vt, "/")
+	if i < 0 {
+		return "", "", fmt.Errorf("type %q is not vendor namespaced", vt)
+	}
+	if _, err := VendorType(vt[:i], vt[i+1:]); err != nil {
+		return "", "", err
+	}
+	return vt[:i], vt[i+1:], nil
+}
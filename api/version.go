@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net"
+)
+
+// Version is the version of the socket API protocol, i.e., of the framing and
+// the request and response structures. It is signalled in the version bits of
+// the type field of the message header. Messages of clients and servers
+// predating the version field have the bits cleared, which denotes Version1,
+// so that the headers of version 1 are identical to the original wire format
+type Version uint8
+
+const (
+	Version1 Version = 1
+
+	// MinVersion and MaxVersion are the range of versions this implementation
+	// speaks. Requests outside the range are rejected without decoding
+	MinVersion = Version1
+	MaxVersion = Version1
+)
+
+const (
+	versionShift = 16
+	// VersionMask covers the version bits in the type field of the header
+	VersionMask uint32 = 0xff << versionShift
+)
+
+// VersionError indicates that the peer speaks a protocol version outside the
+// supported range Min to Max
+type VersionError struct {
+	Version Version
+	Min     Version
+	Max     Version
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %v, supported versions %v..%v", e.Version,
+		e.Min, e.Max)
+}
+
+// CheckVersion returns a VersionError if this implementation does not speak
+// the version
+func CheckVersion(v Version) error {
+	if v < MinVersion || v > MaxVersion {
+		return &VersionError{Version: v, Min: MinVersion, Max: MaxVersion}
+	}
+	return nil
+}
+
+// NewVersionError returns the error response rejecting a request of the
+// unsupported version with the range of versions the server speaks
+func NewVersionError(v Version) *SocketError {
+	return &SocketError{
+		Msg:        (&VersionError{Version: v, Min: MinVersion, Max: MaxVersion}).Error(),
+		MinVersion: MinVersion,
+		MaxVersion: MaxVersion,
+	}
+}
+
+// ResponseError returns the error of an error response to a request of the
+// version. Responses rejecting the version are returned as VersionError.
+// Servers predating the version field reject requests of later versions as
+// invalid type without the supported range, which is reported as VersionError
+// with version 1 as the only supported version
+func ResponseError(e *SocketError, v Version) error {
+	if e.MaxVersion != 0 {
+		return &VersionError{Version: v, Min: e.MinVersion, Max: e.MaxVersion}
+	}
+	if v > Version1 {
+		return fmt.Errorf("%v: %w", e.Msg, &VersionError{Version: v, Min: Version1,
+			Max: Version1})
+	}
+	return fmt.Errorf("%v", e.Msg)
+}
+
+// WithVersion returns the type field of a message header with the version
+// bits set. Version 1 clears the bits, so that the header is compatible with
+// receivers predating the version field
+func WithVersion(t uint32, v Version) uint32 {
+	if v <= Version1 {
+		return t &^ VersionMask
+	}
+	return t&^VersionMask | uint32(v)<<versionShift
+}
+
+// splitVersion returns the message type and the version of the type field of
+// a message header
+func splitVersion(t uint32) (uint32, Version) {
+	v := Version((t & VersionMask) >> versionShift)
+	if v == 0 {
+		v = Version1
+	}
+	return t &^ VersionMask, v
+}
+
+// SendVersion sends data like Send, but with the version in the header
+func SendVersion(conn net.Conn, payload []byte, t uint32, v Version) error {
+	return Send(conn, payload, WithVersion(t, v))
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReceiveVersion(t *testing.T) {
+	payload := bytes.Repeat([]byte("payload "), 1024)
+	gzipped, _ := Compress(payload, CompressionGzip)
+	future := WithVersion(TypeAttest, MaxVersion+1)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantVersion Version
+		wantErr     bool
+	}{
+		// Messages without version bits, e.g. of clients predating the version field
+		{"Legacy", frame(payload, TypeAttest), Version1, false},
+		{"Version 1", frame(payload, WithVersion(TypeAttest, Version1)), Version1, false},
+		{"Future Version", frame(payload, future), MaxVersion + 1, false},
+		{"Future Version Chunked", chunks(payload, future, 1000), MaxVersion + 1, false},
+		{"Future Version Compressed", frame(gzipped, WithCompression(future, CompressionGzip)),
+			MaxVersion + 1, false},
+		{"Version Changed Between Chunks", append(frame(payload[:1000],
+			future|FlagMoreChunks), frame(payload[1000:], TypeAttest)...), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, msgType, v, err := ReceiveVersion(&readConn{r: bytes.NewReader(tt.data)},
+				MaxChunkedMsgLen)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReceiveVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msgType != TypeAttest || v != tt.wantVersion || !bytes.Equal(got, payload) {
+				t.Errorf("ReceiveVersion() type = %v, version = %v, payload length = %v, "+
+					"want %v, %v, %v", msgType, v, len(got), TypeAttest, tt.wantVersion,
+					len(payload))
+			}
+		})
+	}
+}
+
+func TestSendVersion(t *testing.T) {
+	// Version 1 is sent in the original wire format
+	conn := &writeConn{}
+	if err := SendVersion(conn, []byte("payload"), TypeVerify, Version1); err != nil {
+		t.Fatalf("SendVersion() error = %v", err)
+	}
+	if want := frame([]byte("payload"), TypeVerify); !bytes.Equal(conn.buf.Bytes(), want) {
+		t.Errorf("SendVersion() sent %x, want %x", conn.buf.Bytes(), want)
+	}
+
+	conn = &writeConn{}
+	if err := SendVersion(conn, []byte("payload"), TypeVerify, 7); err != nil {
+		t.Fatalf("SendVersion() error = %v", err)
+	}
+	_, msgType, v, err := ReceiveVersion(&readConn{r: &conn.buf}, MaxMsgLen)
+	if err != nil || msgType != TypeVerify || v != 7 {
+		t.Errorf("ReceiveVersion() type = %v, version = %v, error = %v, want %v, 7",
+			msgType, v, err, TypeVerify)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version Version
+		wantErr bool
+	}{
+		{"Minimum", MinVersion, false},
+		{"Maximum", MaxVersion, false},
+		{"Below Minimum", MinVersion - 1, true},
+		{"Above Maximum", MaxVersion + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckVersion(tt.version)
+			var verr *VersionError
+			if errors.As(err, &verr) != tt.wantErr {
+				t.Fatalf("CheckVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && (verr.Version != tt.version || verr.Min != MinVersion ||
+				verr.Max != MaxVersion) {
+				t.Errorf("CheckVersion() error = %v", verr)
+			}
+		})
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    *SocketError
+		version Version
+		want    *VersionError
+	}{
+		{"Plain Error", &SocketError{Msg: "failed"}, Version1, nil},
+		{"Version Rejected", NewVersionError(MaxVersion + 1), MaxVersion + 1,
+			&VersionError{Version: MaxVersion + 1, Min: MinVersion, Max: MaxVersion}},
+		// Servers predating the version field reject later versions as invalid type
+		{"Old Server", &SocketError{Msg: "Invalid Type: 65538"}, 2,
+			&VersionError{Version: 2, Min: Version1, Max: Version1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ResponseError(tt.resp, tt.version)
+			if err == nil {
+				t.Fatalf("ResponseError() returned nil")
+			}
+			var verr *VersionError
+			if errors.As(err, &verr) != (tt.want != nil) {
+				t.Fatalf("ResponseError() = %v, want version error %v", err, tt.want)
+			}
+			if tt.want != nil && *verr != *tt.want {
+				t.Errorf("ResponseError() = %v, want %v", verr, tt.want)
+			}
+		})
+	}
+}
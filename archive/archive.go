@@ -0,0 +1,256 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive stores the attestation reports verified by the cmcd
+// together with their nonces and results, so that auditors can retrieve the
+// original evidence of past verifications. Archiving never blocks or
+// influences the verification: entries which cannot be stored are dropped
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const (
+	// DefaultRetention is the time entries are kept if not configured
+	DefaultRetention = 90 * 24 * time.Hour
+	defaultQueueSize = 1024
+	defaultLimit     = 100
+	pruneInterval    = time.Hour
+)
+
+var log = internal.NewLogger(internal.SubsystemServer, "archive")
+
+// ErrNotFound is returned if no entry exists for a report ID
+var ErrNotFound = errors.New("report not found in archive")
+
+// Config is the configuration of the archive
+type Config struct {
+	// Dir is the folder the reports and the index are stored in
+	Dir string `json:"dir"`
+	// Optional time entries are kept (default 2160h, i.e., 90 days)
+	Retention string `json:"retention,omitempty"`
+	// Optional number of entries queued for storing (default 1024)
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+// Entry is the archived verification of an attestation report
+type Entry struct {
+	// Id is the hex encoded SHA-256 of the signed attestation report, as used
+	// by the result sinks
+	Id string `json:"id"`
+	// Peer is the identity of the peer which requested the verification,
+	// e.g. its remote address
+	Peer     string    `json:"peer,omitempty"`
+	Api      string    `json:"api"`
+	Received time.Time `json:"received"`
+	Success  bool      `json:"success"`
+	// Nonce is the hex encoded nonce the report was verified against
+	Nonce  string                 `json:"nonce,omitempty"`
+	Result *ar.VerificationResult `json:"result,omitempty"`
+	Report []byte                 `json:"report,omitempty"`
+}
+
+// NewEntry creates the entry of a verification of the report, which was
+// requested by the peer via the API at the received time
+func NewEntry(api, peer string, report, nonce []byte, received time.Time,
+	result *ar.VerificationResult,
+) *Entry {
+	hash := sha256.Sum256(report)
+	e := &Entry{
+		Id:       hex.EncodeToString(hash[:]),
+		Peer:     peer,
+		Api:      api,
+		Received: received.UTC(),
+		Nonce:    hex.EncodeToString(nonce),
+		Result:   result,
+		Report:   report,
+	}
+	if result != nil {
+		e.Success = result.Success
+	}
+	return e
+}
+
+// Query selects archived entries. Empty fields match all entries. From is
+// inclusive, To is exclusive
+type Query struct {
+	Id    string
+	Peer  string
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+// Store persists the entries. Stores must be safe for concurrent use
+type Store interface {
+	// Put stores the entry
+	Put(e *Entry) error
+	// Get returns all verifications of the report including the report and
+	// the results, or ErrNotFound
+	Get(id string) ([]Entry, error)
+	// Find returns the entries matching the query ordered by the time they
+	// were received, without the reports and results
+	Find(q Query) ([]Entry, error)
+	// Prune removes all entries received before the time and returns the
+	// number of removed entries
+	Prune(before time.Time) (int, error)
+	Close() error
+}
+
+// Archive stores the entries asynchronously in the store and prunes entries
+// older than the retention
+type Archive struct {
+	store     Store
+	retention time.Duration
+	now       func() time.Time
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *Entry
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates the archive with the filesystem store in the configured folder
+func New(c *Config) (*Archive, error) {
+	retention := DefaultRetention
+	if c.Retention != "" {
+		var err error
+		retention, err = time.ParseDuration(c.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse archive retention: %w", err)
+		}
+		if retention <= 0 {
+			return nil, fmt.Errorf("invalid archive retention %v", retention)
+		}
+	}
+	store, err := NewFsStore(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return newArchive(store, retention, c.QueueSize).start(), nil
+}
+
+func newArchive(store Store, retention time.Duration, queueSize int) *Archive {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	return &Archive{
+		store:     store,
+		retention: retention,
+		now:       time.Now,
+		queue:     make(chan *Entry, queueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (a *Archive) start() *Archive {
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// run stores the queued entries and periodically prunes the store
+func (a *Archive) run() {
+	defer a.wg.Done()
+
+	a.prune()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-a.queue:
+			if !ok {
+				return
+			}
+			if err := a.store.Put(e); err != nil {
+				log.Warnf("Failed to archive report %v: %v", e.Id, err)
+			}
+		case <-ticker.C:
+			a.prune()
+		}
+	}
+}
+
+func (a *Archive) prune() {
+	n, err := a.store.Prune(a.now().Add(-a.retention))
+	if err != nil {
+		log.Warnf("Failed to prune archive: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Debugf("Pruned %v archived verifications", n)
+	}
+}
+
+// Add queues the entry for storing. Add never blocks: if the queue is full,
+// the entry is dropped. A nil archive discards the entries
+func (a *Archive) Add(e *Entry) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- e:
+	default:
+		log.Warnf("Archive queue full, dropping report %v", e.Id)
+	}
+}
+
+// Get returns all archived verifications of the report
+func (a *Archive) Get(id string) ([]Entry, error) {
+	return a.store.Get(id)
+}
+
+// Find returns the archived verifications matching the query. At most 100
+// entries are returned if no limit is specified
+func (a *Archive) Find(q Query) ([]Entry, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+	return a.store.Find(q)
+}
+
+// Close stores the queued entries and closes the store
+func (a *Archive) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+
+	a.wg.Wait()
+	return a.store.Close()
+}
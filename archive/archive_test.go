@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+var t0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestEntry(report, peer string, received time.Time, success bool) *Entry {
+	return NewEntry("socket", peer, []byte(report), []byte{1, 2, 3}, received,
+		&ar.VerificationResult{Success: success})
+}
+
+// failingStore fails all operations and records the number of puts
+type failingStore struct {
+	mu    sync.Mutex
+	puts  int
+	block chan struct{}
+}
+
+func (s *failingStore) Put(e *Entry) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts++
+	return fmt.Errorf("disk full")
+}
+
+func (s *failingStore) Get(id string) ([]Entry, error) { return nil, fmt.Errorf("disk full") }
+func (s *failingStore) Find(q Query) ([]Entry, error)  { return nil, fmt.Errorf("disk full") }
+func (s *failingStore) Prune(time.Time) (int, error)   { return 0, fmt.Errorf("disk full") }
+func (s *failingStore) Close() error                   { return nil }
+
+func TestArchiveStoreFailure(t *testing.T) {
+	store := &failingStore{block: make(chan struct{})}
+	a := newArchive(store, DefaultRetention, 2).start()
+
+	// Add must neither block nor fail if the store is stuck and the queue full
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a.Add(newTestEntry("report", "peer", t0, true))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Add() blocked on stuck store")
+	}
+
+	close(store.block)
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// The worker may hold one entry in addition to the queued entries
+	if store.puts < 2 || store.puts > 3 {
+		t.Errorf("store received %v entries, want 2 or 3", store.puts)
+	}
+
+	// Adding to a closed or nil archive is discarded
+	a.Add(newTestEntry("report", "peer", t0, true))
+	var nilArchive *Archive
+	nilArchive.Add(newTestEntry("report", "peer", t0, true))
+	if err := nilArchive.Close(); err != nil {
+		t.Errorf("Close() of nil archive error = %v", err)
+	}
+}
+
+func TestArchiveRetention(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(&Config{Dir: dir, Retention: "24h"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Now()
+	a.Add(newTestEntry("old", "peer", now.Add(-48*time.Hour), true))
+	a.Add(newTestEntry("new", "peer", now, true))
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Pruning on start removes the expired entry
+	a, err = New(&Config{Dir: dir, Retention: "24h"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer a.Close()
+	want := NewEntry("socket", "peer", []byte("new"), nil, now, nil).Id
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := a.Find(Query{})
+		if err != nil {
+			t.Fatalf("Find() error = %v", err)
+		}
+		if len(got) == 1 && got[0].Id == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Find() = %+v, want only the new entry", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, c := range []Config{
+		{Dir: dir, Retention: "90"},
+		{Dir: dir, Retention: "-1h"},
+	} {
+		if _, err := New(&c); err == nil {
+			t.Errorf("New() accepted retention %q", c.Retention)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	indexFile  = "index.db"
+	reportFile = "report"
+	dateLayout = "2006-01-02"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS verifications (
+	report_id TEXT NOT NULL,
+	peer TEXT NOT NULL,
+	api TEXT NOT NULL,
+	received INTEGER NOT NULL,
+	success INTEGER NOT NULL,
+	path TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS verifications_report_id ON verifications (report_id);
+CREATE INDEX IF NOT EXISTS verifications_peer ON verifications (peer, received);
+CREATE INDEX IF NOT EXISTS verifications_received ON verifications (received);
+`
+
+// FsStore stores the reports in the filesystem in folders by the date they
+// were received and the report ID: <dir>/<YYYY-MM-DD>/<report ID>/. A folder
+// contains the report and one JSON file with the nonce and the result of each
+// verification of the report on that date. A SQLite index in <dir>/index.db
+// provides the queries by report ID, peer and time
+type FsStore struct {
+	mu  sync.Mutex
+	dir string
+	db  *sql.DB
+}
+
+// NewFsStore opens the filesystem store in the folder, which is created if
+// it does not exist
+func NewFsStore(dir string) (*FsStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive folder: %w", err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, indexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive index: %w", err)
+	}
+	// SQLite does not support concurrent writers, all access is serialized
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create archive index: %w", err)
+	}
+	return &FsStore{dir: dir, db: db}, nil
+}
+
+// Put stores the entry
+func (s *FsStore) Put(e *Entry) error {
+	if _, err := hex.DecodeString(e.Id); err != nil || e.Id == "" {
+		return fmt.Errorf("invalid report ID %q", e.Id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rel := filepath.Join(e.Received.UTC().Format(dateLayout), e.Id)
+	folder := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return fmt.Errorf("failed to create report folder: %w", err)
+	}
+
+	// Reports are content addressed and only stored once per day
+	report := filepath.Join(folder, reportFile)
+	if _, err := os.Stat(report); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(report, e.Report, 0600); err != nil {
+			return fmt.Errorf("failed to store report: %w", err)
+		}
+	}
+
+	verification := *e
+	verification.Report = nil
+	data, err := json.Marshal(verification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal verification: %w", err)
+	}
+	name := filepath.Join(rel, strconv.FormatInt(e.Received.UnixNano(), 10)+".json")
+	if err := os.WriteFile(filepath.Join(s.dir, name), data, 0600); err != nil {
+		return fmt.Errorf("failed to store verification: %w", err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO verifications VALUES (?, ?, ?, ?, ?, ?)",
+		e.Id, e.Peer, e.Api, e.Received.UnixNano(), e.Success, name)
+	if err != nil {
+		os.Remove(filepath.Join(s.dir, name))
+		return fmt.Errorf("failed to index verification: %w", err)
+	}
+	return nil
+}
+
+// Get returns all verifications of the report including the report and the
+// results
+func (s *FsStore) Get(id string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT path FROM verifications WHERE report_id = ? ORDER BY received",
+		id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query archive index: %w", err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read archive index: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	if len(paths) == 0 {
+		return nil, ErrNotFound
+	}
+
+	entries := make([]Entry, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(s.dir, path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read verification: %w", err)
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal verification %v: %w", path, err)
+		}
+		e.Report, err = os.ReadFile(filepath.Join(s.dir, filepath.Dir(path), reportFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read report: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Find returns the entries matching the query without the reports and results
+func (s *FsStore) Find(q Query) ([]Entry, error) {
+	var conds []string
+	var args []interface{}
+	if q.Id != "" {
+		conds = append(conds, "report_id = ?")
+		args = append(args, q.Id)
+	}
+	if q.Peer != "" {
+		conds = append(conds, "peer = ?")
+		args = append(args, q.Peer)
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, "received >= ?")
+		args = append(args, q.From.UnixNano())
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "received < ?")
+		args = append(args, q.To.UnixNano())
+	}
+	query := "SELECT report_id, peer, api, received, success FROM verifications"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY received"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query archive index: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var received int64
+		if err := rows.Scan(&e.Id, &e.Peer, &e.Api, &received, &e.Success); err != nil {
+			return nil, fmt.Errorf("failed to read archive index: %w", err)
+		}
+		e.Received = time.Unix(0, received).UTC()
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	return entries, nil
+}
+
+// Prune removes all verifications received before the time. Folders of
+// reports without remaining verifications are removed
+func (s *FsStore) Prune(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query("SELECT path FROM verifications WHERE received < ?",
+		before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to query archive index: %w", err)
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read archive index: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	res, err := s.db.Exec("DELETE FROM verifications WHERE received < ?", before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune archive index: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune archive index: %w", err)
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(filepath.Join(s.dir, path)); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Failed to remove archived verification: %v", err)
+		}
+		s.removeEmpty(filepath.Dir(path))
+	}
+	return int(n), nil
+}
+
+// removeEmpty removes the report folder if it only contains the report and
+// the date folder if it is empty afterwards
+func (s *FsStore) removeEmpty(rel string) {
+	folder := filepath.Join(s.dir, rel)
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.Name() != reportFile {
+			return
+		}
+	}
+	if err := os.RemoveAll(folder); err != nil {
+		log.Warnf("Failed to remove archived report: %v", err)
+		return
+	}
+	// Fails if the date folder still contains other reports
+	os.Remove(filepath.Dir(folder))
+}
+
+// Close closes the index
+func (s *FsStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
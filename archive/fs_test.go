@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFsStore(t *testing.T) {
+	s, err := NewFsStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFsStore() error = %v", err)
+	}
+	defer s.Close()
+
+	entries := []*Entry{
+		newTestEntry("report-a", "10.0.0.1:1000", t0, true),
+		newTestEntry("report-a", "10.0.0.2:1000", t0.Add(time.Minute), false),
+		newTestEntry("report-b", "10.0.0.1:1000", t0.Add(48*time.Hour), true),
+		newTestEntry("report-c", "10.0.0.3:1000", t0.Add(72*time.Hour), true),
+	}
+	for _, e := range entries {
+		if err := s.Put(e); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	got, err := s.Get(entries[0].Id)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Get() returned %v entries, want 2", len(got))
+	}
+	for i, e := range got {
+		if !bytes.Equal(e.Report, []byte("report-a")) || e.Nonce != "010203" ||
+			e.Result == nil || e.Peer != entries[i].Peer || !e.Received.Equal(entries[i].Received) {
+			t.Errorf("Get() entry %v = %+v, want %+v", i, e, entries[i])
+		}
+	}
+	if got[1].Result.Success {
+		t.Errorf("Get() entry 1 success = true, want false")
+	}
+	if _, err := s.Get("00ff"); err != ErrNotFound {
+		t.Errorf("Get() of unknown report error = %v, want %v", err, ErrNotFound)
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []*Entry
+	}{
+		{"All", Query{}, entries},
+		{"By Id", Query{Id: entries[0].Id}, entries[:2]},
+		{"By Peer", Query{Peer: "10.0.0.1:1000"}, []*Entry{entries[0], entries[2]}},
+		{"From", Query{From: t0.Add(time.Minute)}, entries[1:]},
+		{"Range", Query{From: t0.Add(time.Hour), To: t0.Add(72 * time.Hour)}, entries[2:3]},
+		{"Peer And Range", Query{Peer: "10.0.0.1:1000", To: t0.Add(time.Hour)}, entries[:1]},
+		{"Limit", Query{Limit: 3}, entries[:3]},
+		{"None", Query{Peer: "10.0.0.9:1000"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Find(tt.query)
+			if err != nil {
+				t.Fatalf("Find() error = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Find() returned %v entries, want %v", len(got), len(tt.want))
+			}
+			for i, e := range got {
+				w := tt.want[i]
+				if e.Id != w.Id || e.Peer != w.Peer || !e.Received.Equal(w.Received) ||
+					e.Success != w.Success || e.Report != nil {
+					t.Errorf("Find() entry %v = %+v, want %+v", i, e, w)
+				}
+			}
+		})
+	}
+
+	// Pruning removes the verifications and the folders of the first day
+	n, err := s.Prune(t0.Add(24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Prune() = %v, want 2", n)
+	}
+	if _, err := s.Get(entries[0].Id); err != ErrNotFound {
+		t.Errorf("Get() of pruned report error = %v, want %v", err, ErrNotFound)
+	}
+	if got, _ := s.Find(Query{}); len(got) != 2 {
+		t.Errorf("Find() after pruning returned %v entries, want 2", len(got))
+	}
+	if got, _ := s.Get(entries[2].Id); len(got) != 1 {
+		t.Errorf("Get() after pruning returned %v entries, want 1", len(got))
+	}
+
+	if err := s.Put(&Entry{Id: "../../etc", Received: t0}); err == nil {
+		t.Errorf("Put() accepted invalid report ID")
+	}
+}
+
+func TestFsStoreConcurrent(t *testing.T) {
+	s, err := NewFsStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFsStore() error = %v", err)
+	}
+	defer s.Close()
+
+	const writers, puts = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*puts)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				// All writers also store the same report concurrently
+				e := newTestEntry(fmt.Sprintf("report-%v", i%4), fmt.Sprintf("peer-%v", w),
+					t0.Add(time.Duration(w*puts+i)*time.Millisecond), true)
+				if err := s.Put(e); err != nil {
+					errs <- err
+				}
+				if _, err := s.Find(Query{Peer: e.Peer}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent access error = %v", err)
+	}
+
+	if got, _ := s.Find(Query{}); len(got) != writers*puts {
+		t.Errorf("Find() returned %v entries, want %v", len(got), writers*puts)
+	}
+}
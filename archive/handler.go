@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ReportsPath is the path of the query API, GET <ReportsPath>?peer=&from=&to=&limit=
+	// returns the matching entries, GET <ReportsPath>/<report ID> all
+	// verifications of the report including the report and the results
+	ReportsPath = "/archive/reports"
+)
+
+// Handler returns the HTTP handler serving the query API of the archive
+func Handler(a *Archive) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ReportsPath, func(w http.ResponseWriter, r *http.Request) {
+		handleFind(w, r, a)
+	})
+	mux.HandleFunc(ReportsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		handleGet(w, r, a)
+	})
+	return mux
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, a *Archive) {
+	if !allowGet(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, ReportsPath+"/")
+	entries, err := a.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warnf("Failed to get archived report %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, entries)
+}
+
+func handleFind(w http.ResponseWriter, r *http.Request, a *Archive) {
+	if !allowGet(w, r) {
+		return
+	}
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := a.Find(q)
+	if err != nil {
+		log.Warnf("Failed to query archive: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	writeJson(w, entries)
+}
+
+// parseQuery parses the query parameters peer, from and to (RFC 3339) and limit
+func parseQuery(r *http.Request) (Query, error) {
+	v := r.URL.Query()
+	q := Query{Peer: v.Get("peer")}
+	for _, t := range []struct {
+		name string
+		time *time.Time
+	}{
+		{"from", &q.From},
+		{"to", &q.To},
+	} {
+		s := v.Get(t.name)
+		if s == "" {
+			continue
+		}
+		var err error
+		*t.time, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, errors.New("invalid " + t.name + " time, expected RFC 3339")
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return q, errors.New("invalid limit " + s)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Failed to write archive response: %v", err)
+	}
+}
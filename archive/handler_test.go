@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	store, err := NewFsStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFsStore() error = %v", err)
+	}
+	a := newArchive(store, DefaultRetention, 0)
+	defer a.Close()
+
+	e := newTestEntry("report-a", "10.0.0.1:1000", t0, true)
+	for _, e := range []*Entry{e, newTestEntry("report-b", "10.0.0.2:1000", t0.Add(time.Hour), true)} {
+		if err := store.Put(e); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	h := Handler(a)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		want    int
+		entries int
+	}{
+		{"Get", http.MethodGet, ReportsPath + "/" + e.Id, http.StatusOK, 1},
+		{"Get Unknown", http.MethodGet, ReportsPath + "/00ff", http.StatusNotFound, 0},
+		{"Find All", http.MethodGet, ReportsPath, http.StatusOK, 2},
+		{"Find Peer", http.MethodGet, ReportsPath + "?peer=10.0.0.2:1000", http.StatusOK, 1},
+		{"Find Range", http.MethodGet, ReportsPath + "?from=2026-01-01T12:30:00Z&to=2026-01-02T00:00:00Z",
+			http.StatusOK, 1},
+		{"Find None", http.MethodGet, ReportsPath + "?to=2025-01-01T00:00:00Z", http.StatusOK, 0},
+		{"Find Limit", http.MethodGet, ReportsPath + "?limit=1", http.StatusOK, 1},
+		{"Invalid Time", http.MethodGet, ReportsPath + "?from=yesterday", http.StatusBadRequest, 0},
+		{"Invalid Limit", http.MethodGet, ReportsPath + "?limit=-1", http.StatusBadRequest, 0},
+		{"Post", http.MethodPost, ReportsPath, http.StatusMethodNotAllowed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %v, want %v: %v", w.Code, tt.want, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var entries []Entry
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if len(entries) != tt.entries {
+				t.Errorf("response contains %v entries, want %v", len(entries), tt.entries)
+			}
+		})
+	}
+}
@@ -16,6 +16,9 @@
 package jspolicies
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/robertkrimen/otto"
 	"github.com/sirupsen/logrus"
 )
@@ -36,7 +39,8 @@ type JsPolicyEngine struct {
 //	var obj = JSON.parse(json);
 //
 // The javascript code must return a single boolean to indicate the
-// success of the parsing. Logs can be output via: console.log()
+// success of the parsing. Logs can be output via: console.log(). Reasons
+// for a rejection can be reported via: violation("reason")
 // A very simple example of a custom Policy could look as follows:
 //
 //		var obj = JSON.parse(json);
@@ -52,33 +56,77 @@ func NewJsPolicyEngine(policies []byte) *JsPolicyEngine {
 	}
 }
 
+// Decision is the outcome of a policy evaluation with the violations reported
+// by the policies and the output of console.log()
+type Decision struct {
+	Success    bool
+	Violations []string
+	Trace      []string
+}
+
 // Validate uses a javascript engine to validate the JavaScriptValidator's
 // custom javascript policies against the verification result
 func (p *JsPolicyEngine) Validate(result []byte) bool {
+	d, err := p.Evaluate(result)
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return d.Success
+}
+
+// Evaluate runs the custom javascript policies against the verification
+// result and returns the decision together with the reported violations and
+// the log output of the policies
+func (p *JsPolicyEngine) Evaluate(result []byte) (*Decision, error) {
 
 	log.Debugf("Validating custom javascript policies")
 
+	d := new(Decision)
+
 	// Create new javascript engine
 	vm := otto.New()
 
 	// Set variable json = vr
 	vm.Set("json", string(result))
 
+	// Record the output of the policies
+	console, err := vm.Object("console")
+	if err != nil {
+		return d, fmt.Errorf("failed to get console: %w", err)
+	}
+	console.Set("log", func(call otto.FunctionCall) otto.Value {
+		msg := joinArgs(call)
+		log.Debugf("Policy: %v", msg)
+		d.Trace = append(d.Trace, msg)
+		return otto.UndefinedValue()
+	})
+	vm.Set("violation", func(call otto.FunctionCall) otto.Value {
+		d.Violations = append(d.Violations, joinArgs(call))
+		return otto.UndefinedValue()
+	})
+
 	// Run javascript validation
 	val, err := vm.Run(string(p.policies))
 	if err != nil {
-		log.Errorf("Failed run policy validation: %v", err)
-		return false
+		return d, fmt.Errorf("failed run policy validation: %w", err)
 	}
 
 	// Retrieve result
-	ok, err := val.ToBoolean()
+	d.Success, err = val.ToBoolean()
 	if err != nil {
-		log.Errorf("Failed convert policy validation result: %v", err)
-		return false
+		return d, fmt.Errorf("failed convert policy validation result: %w", err)
 	}
 
-	log.Debugf("Policy Validation: %v", ok)
+	log.Debugf("Policy Validation: %v", d.Success)
+
+	return d, nil
+}
 
-	return ok
+func joinArgs(call otto.FunctionCall) string {
+	args := make([]string, 0, len(call.ArgumentList))
+	for _, a := range call.ArgumentList {
+		args = append(args, a.String())
+	}
+	return strings.Join(args, " ")
 }
@@ -16,6 +16,9 @@
 package jspolicies
 
 import (
+	"fmt"
+	"os"
+	"reflect"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -67,6 +70,73 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestEvaluate(t *testing.T) {
+	policy := []byte(`
+		var obj = JSON.parse(json);
+		console.log("type", obj.type);
+		if (!obj.raSuccessful) {
+			violation("attestation failed");
+		}
+		obj.raSuccessful
+	`)
+	tests := []struct {
+		name           string
+		result         []byte
+		policies       []byte
+		wantSuccess    bool
+		wantViolations []string
+		wantErr        bool
+	}{
+		{"Success", vrSuccess, policy, true, nil, false},
+		{"Violation", vrFail, policy, false, []string{"attestation failed"}, false},
+		{"Syntax Error", vrSuccess, []byte("var x = ;"), false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewJsPolicyEngine(tt.policies).Evaluate(tt.result)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Evaluate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if d.Success != tt.wantSuccess || !reflect.DeepEqual(d.Violations, tt.wantViolations) {
+				t.Errorf("Evaluate() = %+v, want success %v, violations %v", d, tt.wantSuccess,
+					tt.wantViolations)
+			}
+			if !reflect.DeepEqual(d.Trace, []string{"type Verification Result"}) {
+				t.Errorf("Evaluate() trace = %v", d.Trace)
+			}
+		})
+	}
+}
+
+func TestSnpDebugPolicy(t *testing.T) {
+
+	// The example policies must reject SNP guests with debugging enabled
+	policies, err := os.ReadFile("../../example-setup/policies.js")
+	if err != nil {
+		t.Fatalf("failed to read example policies: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		debug bool
+		want  bool
+	}{
+		{"Debug Disabled", false, true},
+		{"Debug Enabled", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := []byte(fmt.Sprintf(vrSnpTemplate, tt.debug))
+			if got := NewJsPolicyEngine(policies).Validate(result); got != tt.want {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 var (
 	vrSuccess = []byte(`
 		{
@@ -135,4 +205,40 @@ var (
 
 		success
 	`)
+
+	vrSnpTemplate = `
+		{
+			"type": "Verification Result",
+			"raSuccessful": true,
+			"measurements": [
+				{
+					"type": "SNP Result",
+					"snpResult": {
+						"policyCheck": {
+							"debug": {
+								"success": true,
+								"claimed": %[1]v,
+								"measured": %[1]v
+							}
+						}
+					}
+				}
+			],
+			"rtmValidation": {
+				"signatureValidation": [
+					{
+						"validatedCerts": [
+							[
+								{
+									"subject": {
+										"commonName": "CMC Test Leaf Certificate"
+									}
+								}
+							]
+						]
+					}
+				]
+			}
+		}
+	`
 )
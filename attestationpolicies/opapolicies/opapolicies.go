@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build opapolicies
+
+package opapolicies
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/print"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("service", "opapolicies")
+
+// Query is the document the policies must define. Its rule allow is the
+// decision, its optional set deny contains the reasons for a rejection
+const Query = "data.cmc"
+
+var (
+	ErrCompile   = errors.New("failed to compile policies")
+	ErrTimeout   = errors.New("policy evaluation timed out")
+	ErrUndefined = errors.New("policy decision undefined")
+)
+
+// OpaPolicyEngine is an Open Policy Agent implementation of the attestation
+// report generic PolicyValidator interface
+type OpaPolicyEngine struct {
+	policies []byte
+	timeout  time.Duration
+}
+
+// NewOpaPolicyEngine creates a new OpaPolicyEngine with custom policies.
+// The policies are either a single Rego module or a gzipped tarball of an
+// OPA bundle. The policies are evaluated with the VerificationResult as input
+// and must define the package cmc with the boolean rule allow and optionally
+// the set deny with the reasons for a rejection, e.g.:
+//
+//	package cmc
+//
+//	default allow = false
+//
+//	allow {
+//		input.type == "Verification Result"
+//		count(deny) == 0
+//	}
+//
+//	deny[msg] {
+//		input.prover == "untrusted"
+//		msg := "untrusted prover"
+//	}
+//
+// The decision is only successful if allow is true and deny is empty. Output
+// of print() is returned as trace. The evaluation is aborted after the timeout
+func NewOpaPolicyEngine(policies []byte, timeout time.Duration) *OpaPolicyEngine {
+	return &OpaPolicyEngine{
+		policies: policies,
+		timeout:  timeout,
+	}
+}
+
+// Decision is the outcome of a policy evaluation with the deny reasons of the
+// policies and the output of print()
+type Decision struct {
+	Success    bool
+	Violations []string
+	Trace      []string
+}
+
+type printHook struct {
+	trace *[]string
+}
+
+func (h printHook) Print(_ print.Context, msg string) error {
+	log.Debugf("Policy: %v", msg)
+	*h.trace = append(*h.trace, msg)
+	return nil
+}
+
+// Validate evaluates the custom Rego policies against the verification result
+func (p *OpaPolicyEngine) Validate(result []byte) bool {
+	d, err := p.Evaluate(result)
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return d.Success
+}
+
+// Evaluate evaluates the custom Rego policies against the verification result
+// and returns the decision. Compilation errors, timeouts and undefined
+// decisions are distinguished via ErrCompile, ErrTimeout and ErrUndefined
+func (p *OpaPolicyEngine) Evaluate(result []byte) (*Decision, error) {
+
+	log.Debugf("Validating custom Rego policies")
+
+	d := new(Decision)
+
+	var input any
+	dec := json.NewDecoder(bytes.NewReader(result))
+	dec.UseNumber()
+	if err := dec.Decode(&input); err != nil {
+		return d, fmt.Errorf("failed to unmarshal verification result: %w", err)
+	}
+
+	opts := []func(*rego.Rego){
+		rego.Query(Query),
+		rego.EnablePrintStatements(true),
+		rego.PrintHook(printHook{trace: &d.Trace}),
+	}
+	if isBundle(p.policies) {
+		b, err := bundle.NewReader(bytes.NewReader(p.policies)).Read()
+		if err != nil {
+			return d, fmt.Errorf("%w: failed to read bundle: %v", ErrCompile, err)
+		}
+		opts = append(opts, rego.ParsedBundle("policies", &b))
+	} else {
+		opts = append(opts, rego.Module("policies.rego", string(p.policies)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	query, err := rego.New(opts...).PrepareForEval(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return d, fmt.Errorf("%w after %v", ErrTimeout, p.timeout)
+		}
+		return d, fmt.Errorf("%w: %v", ErrCompile, err)
+	}
+
+	rs, err := query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		if ctx.Err() != nil {
+			return d, fmt.Errorf("%w after %v", ErrTimeout, p.timeout)
+		}
+		return d, fmt.Errorf("failed to evaluate policies: %w", err)
+	}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return d, fmt.Errorf("%w: %v not defined", ErrUndefined, Query)
+	}
+	doc, ok := rs[0].Expressions[0].Value.(map[string]any)
+	if !ok {
+		return d, fmt.Errorf("%w: %v is not an object", ErrUndefined, Query)
+	}
+	allow, ok := doc["allow"].(bool)
+	if !ok {
+		return d, fmt.Errorf("%w: %v.allow is not a boolean", ErrUndefined, Query)
+	}
+
+	if deny, ok := doc["deny"].([]any); ok {
+		for _, reason := range deny {
+			if s, ok := reason.(string); ok {
+				d.Violations = append(d.Violations, s)
+			} else {
+				d.Violations = append(d.Violations, fmt.Sprintf("%v", reason))
+			}
+		}
+		sort.Strings(d.Violations)
+	}
+	d.Success = allow && len(d.Violations) == 0
+
+	log.Debugf("Policy Validation: %v", d.Success)
+
+	return d, nil
+}
+
+// isBundle returns whether the policies are a gzipped OPA bundle
+func isBundle(policies []byte) bool {
+	return len(policies) > 2 && policies[0] == 0x1f && policies[1] == 0x8b
+}
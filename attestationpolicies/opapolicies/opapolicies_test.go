@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build opapolicies
+
+package opapolicies
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const forbiddenPcr = "b6e6a5b0bdbbd0a1c921ba1a8e0a8f5e8b5cfae0c8c6e5a6b4e6c4e4fd6bd93b"
+
+var pcrPolicy = []byte(`
+package cmc
+
+default allow = false
+
+allow {
+	print("prover", input.prover)
+	input.type == "Verification Result"
+	count(deny) == 0
+}
+
+deny[msg] {
+	r := input.measurements[_].tpmResult.pcrMatch[_]
+	r.pcr == 7
+	r.digest == "` + forbiddenPcr + `"
+	msg := sprintf("PCR %v has forbidden value %v", [r.pcr, r.digest])
+}
+`)
+
+var slowPolicy = []byte(`
+package cmc
+
+allow {
+	count([1 | numbers.range(1, 10000)[_]; numbers.range(1, 10000)[_]]) > 0
+}
+`)
+
+func result(pcr7 string) []byte {
+	return []byte(`{
+		"type": "Verification Result",
+		"raSuccessful": true,
+		"prover": "device",
+		"measurements": [{
+			"type": "TPM Result",
+			"tpmResult": {
+				"pcrMatch": [
+					{"pcr": 0, "digest": "00", "success": true},
+					{"pcr": 7, "digest": "` + pcr7 + `", "success": true}
+				]
+			}
+		}]
+	}`)
+}
+
+// bundleOf creates a gzipped tarball of an OPA bundle containing the module
+func bundleOf(t *testing.T, module []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "/policies/cmc.rego", Mode: 0600,
+		Size: int64(len(module))}); err != nil {
+		t.Fatalf("failed to write tar header: %v", err)
+	}
+	if _, err := tw.Write(module); err != nil {
+		t.Fatalf("failed to write module: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []byte
+		result   []byte
+		timeout  time.Duration
+		want     *Decision
+		wantErr  error
+	}{
+		{"Allowed PCR", pcrPolicy, result("ff"), time.Second,
+			&Decision{Success: true, Trace: []string{"prover device"}}, nil},
+		{"Forbidden PCR", pcrPolicy, result(forbiddenPcr), time.Second,
+			&Decision{Violations: []string{"PCR 7 has forbidden value " + forbiddenPcr},
+				Trace: []string{"prover device"}}, nil},
+		{"Bundle", bundleOf(t, pcrPolicy), result(forbiddenPcr), time.Second,
+			&Decision{Violations: []string{"PCR 7 has forbidden value " + forbiddenPcr},
+				Trace: []string{"prover device"}}, nil},
+		{"Syntax Error", []byte("package cmc\n\nallow {\n\tinput.type ==\n"), result("ff"),
+			time.Second, nil, ErrCompile},
+		{"Invalid Bundle", []byte{0x1f, 0x8b, 0x00, 0x01}, result("ff"), time.Second, nil,
+			ErrCompile},
+		{"Undefined Allow", []byte("package cmc\n\nallow {\n\tinput.type == \"other\"\n}\n"),
+			result("ff"), time.Second, nil, ErrUndefined},
+		{"Undefined Package", []byte("package other\n\nallow = true\n"), result("ff"),
+			time.Second, nil, ErrUndefined},
+		{"Timeout", slowPolicy, result("ff"), time.Millisecond, nil, ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewOpaPolicyEngine(tt.policies, tt.timeout).Evaluate(tt.result)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Evaluate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build wasmpolicies
+
+package wasmpolicies
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+var log = logrus.WithField("service", "wasmpolicies")
+
+const (
+	pageSize = 65536
+	maxPages = 65536
+)
+
+var (
+	ErrCompile     = errors.New("failed to load policy module")
+	ErrTimeout     = errors.New("policy evaluation timed out")
+	ErrTrap        = errors.New("policy module trapped")
+	ErrMemoryLimit = errors.New("policy module exceeded memory limit")
+	ErrUndefined   = errors.New("policy decision undefined")
+)
+
+// WasmPolicyEngine is a WebAssembly implementation of the attestation report
+// generic PolicyValidator interface, which executes the policies sandboxed
+type WasmPolicyEngine struct {
+	policies    []byte
+	timeout     time.Duration
+	memoryLimit int64
+}
+
+// NewWasmPolicyEngine creates a new WasmPolicyEngine with custom policies.
+// The policies are a compiled WebAssembly module, which must export:
+//
+//	memory                          the linear memory of the module
+//	alloc(len i32) -> ptr i32       returns a buffer of len bytes, 0 on failure
+//	validate(ptr i32, len i32) -> i32
+//	                                validates the JSON encoded verification
+//	                                result in the buffer, returns 1 to allow
+//	                                and 0 to deny
+//
+// The module can import the functions reason(ptr i32, len i32) and
+// log(ptr i32, len i32) from the module env, to report the reasons for a
+// rejection and to log messages. The execution is aborted after the timeout
+// and the memory of the module is limited to memoryLimit bytes
+func NewWasmPolicyEngine(policies []byte, timeout time.Duration, memoryLimit int64,
+) *WasmPolicyEngine {
+	return &WasmPolicyEngine{
+		policies:    policies,
+		timeout:     timeout,
+		memoryLimit: memoryLimit,
+	}
+}
+
+// Decision is the outcome of a policy evaluation with the reasons reported
+// by the module and its log output
+type Decision struct {
+	Success    bool
+	Violations []string
+	Trace      []string
+}
+
+// Validate executes the policy module against the verification result
+func (p *WasmPolicyEngine) Validate(result []byte) bool {
+	d, err := p.Evaluate(result)
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return d.Success
+}
+
+// Evaluate executes the policy module against the verification result and
+// returns the decision. Invalid modules, timeouts, traps, exceeded memory
+// limits and undefined decisions are distinguished via ErrCompile,
+// ErrTimeout, ErrTrap, ErrMemoryLimit and ErrUndefined
+func (p *WasmPolicyEngine) Evaluate(result []byte) (*Decision, error) {
+
+	log.Debugf("Validating custom WebAssembly policies")
+
+	d := new(Decision)
+
+	pages := p.memoryLimit / pageSize
+	if pages < 1 {
+		pages = 1
+	} else if pages > maxPages {
+		pages = maxPages
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(pages)))
+	defer rt.Close(context.Background())
+
+	read := func(m api.Module, ptr, size uint32) string {
+		data, ok := m.Memory().Read(ptr, size)
+		if !ok {
+			panic(fmt.Sprintf("string at %v with length %v out of range", ptr, size))
+		}
+		return string(data)
+	}
+	_, err := rt.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+			d.Violations = append(d.Violations, read(m, ptr, size))
+		}).
+		Export("reason").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, size uint32) {
+			msg := read(m, ptr, size)
+			log.Debugf("Policy: %v", msg)
+			d.Trace = append(d.Trace, msg)
+		}).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		return d, fmt.Errorf("failed to instantiate host functions: %w", err)
+	}
+
+	compiled, err := rt.CompileModule(ctx, p.policies)
+	if err != nil {
+		return d, fmt.Errorf("%w: %v", ErrCompile, err)
+	}
+	mod, err := rt.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName("policy"))
+	if err != nil {
+		return d, p.classify(ctx, nil, fmt.Errorf("%w: %v", ErrCompile, err))
+	}
+
+	mem := mod.Memory()
+	alloc := mod.ExportedFunction("alloc")
+	validate := mod.ExportedFunction("validate")
+	if mem == nil || alloc == nil || validate == nil {
+		return d, fmt.Errorf("%w: module must export memory, alloc and validate", ErrUndefined)
+	}
+
+	ret, err := alloc.Call(ctx, uint64(len(result)))
+	if err != nil {
+		return d, p.classify(ctx, mem, fmt.Errorf("%w: alloc: %v", ErrTrap, err))
+	}
+	ptr := uint32(ret[0])
+	if ptr == 0 || !mem.Write(ptr, result) {
+		return d, fmt.Errorf("%w: failed to allocate %v bytes for the verification result",
+			ErrMemoryLimit, len(result))
+	}
+
+	ret, err = validate.Call(ctx, uint64(ptr), uint64(len(result)))
+	if err != nil {
+		return d, p.classify(ctx, mem, fmt.Errorf("%w: validate: %v", ErrTrap, err))
+	}
+	switch uint32(ret[0]) {
+	case 1:
+		d.Success = true
+	case 0:
+		d.Success = false
+	default:
+		return d, fmt.Errorf("%w: validate returned %v", ErrUndefined, uint32(ret[0]))
+	}
+
+	log.Debugf("Policy Validation: %v", d.Success)
+
+	return d, nil
+}
+
+// classify returns a timeout error if the execution was aborted due to the
+// timeout, and a memory limit error if the module trapped after its memory
+// was grown to the limit, as memory.grow fails beyond the limit
+func (p *WasmPolicyEngine) classify(ctx context.Context, mem api.Memory, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w after %v", ErrTimeout, p.timeout)
+	}
+	if mem != nil && int64(mem.Size())+pageSize > p.memoryLimit {
+		return fmt.Errorf("%w of %v bytes: %v", ErrMemoryLimit, p.memoryLimit, err)
+	}
+	return err
+}
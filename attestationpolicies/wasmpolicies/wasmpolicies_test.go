@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build wasmpolicies
+
+package wasmpolicies
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The policy modules share the imports env.reason and env.log, the memory of
+// one page and the export alloc, which returns the fixed buffer at 1024:
+//
+//	(func (export "alloc") (param i32) (result i32) (i32.const 1024))
+var (
+	// Logs "checked" and allows results starting with '{':
+	//	(data (i32.const 16) "checked")
+	//	(func (export "validate") (param i32 i32) (result i32)
+	//		(call $log (i32.const 16) (i32.const 7))
+	//		(i32.eq (i32.load8_u (local.get 0)) (i32.const 123)))
+	passModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a190205004180080b110041104107100120002d000041fb00460b0b0d010041100b07636865636b6564"
+	// Reports a reason and denies:
+	//	(data (i32.const 16) "untrusted firmware")
+	//	(func (export "validate") (param i32 i32) (result i32)
+	//		(call $reason (i32.const 16) (i32.const 18))
+	//		(i32.const 0))
+	denyModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a120205004180080b0a0041104112100041000b0b18010041100b12756e74727573746564206669726d77617265"
+	// Loops forever:
+	//	(func (export "validate") (param i32 i32) (result i32)
+	//		(loop $l (br $l)) (i32.const 1))
+	loopModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a110205004180080b090003400c000b41010b"
+	// Traps:
+	//	(func (export "validate") (param i32 i32) (result i32) (unreachable))
+	trapModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a0b0205004180080b0300000b"
+	// Grows the memory until memory.grow fails and traps:
+	//	(func (export "validate") (param i32 i32) (result i32)
+	//		(loop $l (br_if $l (i32.ne (memory.grow (i32.const 1)) (i32.const -1))))
+	//		(unreachable))
+	growModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a170205004180080b0f00034041014000417f470d000b000b"
+	// Returns neither 0 nor 1:
+	//	(func (export "validate") (param i32 i32) (result i32) (i32.const 7))
+	undefinedModule = "0061736d0100000001110360027f7f0060017f017f60027f7f017f02180203656e7606726561736f6e000003656e76036c6f67000003030201020503010001071d03066d656d6f7279020005616c6c6f6300020876616c696461746500030a0c0205004180080b040041070b"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("failed to decode module: %v", err)
+	}
+	return data
+}
+
+func TestEvaluate(t *testing.T) {
+	result := []byte(`{"type":"Verification Result","raSuccessful":true}`)
+
+	tests := []struct {
+		name    string
+		module  []byte
+		result  []byte
+		want    *Decision
+		wantErr error
+	}{
+		{"Allow", mustDecode(t, passModule), result,
+			&Decision{Success: true, Trace: []string{"checked"}}, nil},
+		{"Deny Invalid Result", mustDecode(t, passModule), []byte("[]"),
+			&Decision{Trace: []string{"checked"}}, nil},
+		{"Deny", mustDecode(t, denyModule), result,
+			&Decision{Violations: []string{"untrusted firmware"}}, nil},
+		{"Infinite Loop", mustDecode(t, loopModule), result, nil, ErrTimeout},
+		{"Trap", mustDecode(t, trapModule), result, nil, ErrTrap},
+		{"Memory Limit", mustDecode(t, growModule), result, nil, ErrMemoryLimit},
+		{"Undefined Decision", mustDecode(t, undefinedModule), result, nil, ErrUndefined},
+		{"Invalid Module", []byte("function validate() { return true }"), result, nil,
+			ErrCompile},
+		{"Result Exceeds Memory", mustDecode(t, passModule), make([]byte, 2*pageSize), nil,
+			ErrMemoryLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewWasmPolicyEngine(tt.module, 100*time.Millisecond, 4*pageSize).
+				Evaluate(tt.result)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Evaluate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
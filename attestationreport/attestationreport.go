@@ -19,11 +19,12 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/json"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
-var log = logrus.WithField("service", "ar")
+var log = internal.NewLogger(internal.SubsystemAttestationReport, "ar")
 
 // Driver is an interface representing a driver for a hardware trust anchor,
 // capable of providing attestation evidence and signing data. This can be
@@ -31,7 +32,8 @@ var log = logrus.WithField("service", "ar")
 // Initial Attestation Service (IAS). The driver must be capable of
 // performing measurements, i.e. retrieving attestation evidence such as
 // a TPM Quote or an SNP attestation report and providing handles to
-// signing keys and their certificate chains
+// signing keys and their certificate chains. After Init, all methods and the
+// returned signing keys must be safe for concurrent use
 type Driver interface {
 	Init(c *DriverConfig) error                                   // Initializes the driver
 	Measure(nonce []byte) (Measurement, error)                    // Retrieves measurements
@@ -41,20 +43,181 @@ type Driver interface {
 	GetCertChain() ([]*x509.Certificate, error)                   // Get cert chain for signing key
 }
 
+// MultiMeasurer is an optional interface for drivers which provide multiple
+// measurements per attestation report, e.g. a TPM driver quoting multiple
+// PCR banks. If implemented, MeasureAll is used instead of Measure
+type MultiMeasurer interface {
+	MeasureAll(nonce []byte) ([]Measurement, error)
+}
+
+// DryRunMeasurer is an optional interface for hardware drivers which can
+// collect their measurements without producing fresh evidence, e.g. without
+// a TPM quote. The evidence of the returned measurements is a cached or zero
+// quote and must not be verified. If implemented, MeasureDryRun is used
+// instead of Measure and MeasureAll for report generation dry-runs
+type DryRunMeasurer interface {
+	MeasureDryRun(nonce []byte) ([]Measurement, error)
+}
+
+// DriverRoles describes whether a driver can provide measurements and whether
+// it can provide the signing identity for attestation reports
+type DriverRoles struct {
+	Measurer bool
+	Signer   bool
+}
+
+// RoleProvider is an optional interface for drivers which cannot act in all
+// roles, e.g. a driver for an HSM which only provides a signing identity.
+// Drivers not implementing the interface are both measurers and signers
+type RoleProvider interface {
+	Roles() DriverRoles
+}
+
+// Renewer is an optional interface for drivers whose certificates can be
+// renewed during runtime without a restart
+type Renewer interface {
+	Expiry() (time.Time, error)  // Earliest expiry of the driver certificates
+	Renew(rotateKeys bool) error // Re-enroll and replace the driver certificates
+}
+
+// CertProfile is a certificate profile of the provisioning server a driver
+// enrolls an additional certificate for, e.g. a TLS client or signing-only
+// certificate. If SeparateKey is set, the certificate is issued for a
+// separate key instead of the signing key of the driver
+type CertProfile struct {
+	Name        string `json:"name"`
+	SeparateKey bool   `json:"separateKey,omitempty"`
+}
+
+// ProfileProvider is an optional interface for drivers holding certificates
+// of additional certificate profiles, which are selected by the profile name
+type ProfileProvider interface {
+	GetProfileSigningKeys(profile string) (crypto.PrivateKey, crypto.PublicKey, error)
+	GetProfileCertChain(profile string) ([]*x509.Certificate, error)
+}
+
+// CertStatus describes a certificate of a driver, e.g. the AK or IK certificate
+type CertStatus struct {
+	Name     string    `json:"name" cbor:"0,keyasint"`
+	Subject  string    `json:"subject" cbor:"1,keyasint"`
+	NotAfter time.Time `json:"notAfter" cbor:"2,keyasint"`
+}
+
+// DriverStatus describes the capabilities and the health of an initialized
+// driver, which can be queried without performing an attestation
+type DriverStatus struct {
+	Name             string       `json:"name" cbor:"0,keyasint"`
+	Version          string       `json:"version,omitempty" cbor:"1,keyasint,omitempty"`
+	Signer           bool         `json:"signer" cbor:"2,keyasint"`
+	KeyAlgorithms    []string     `json:"keyAlgorithms,omitempty" cbor:"3,keyasint,omitempty"`
+	Certificates     []CertStatus `json:"certificates,omitempty" cbor:"4,keyasint,omitempty"`
+	MeasurementTypes []string     `json:"measurementTypes,omitempty" cbor:"5,keyasint,omitempty"`
+	PcrBanks         []string     `json:"pcrBanks,omitempty" cbor:"6,keyasint,omitempty"`
+	Healthy          bool         `json:"healthy" cbor:"7,keyasint"`
+	HealthError      string       `json:"healthError,omitempty" cbor:"8,keyasint,omitempty"`
+	HealthChecked    time.Time    `json:"healthChecked" cbor:"9,keyasint"`
+	Warnings         []string     `json:"warnings,omitempty" cbor:"10,keyasint,omitempty"`
+}
+
+// MetadataStatus describes a metadata item loaded by the cmcd. The item is
+// identified by the hex encoded SHA-256 digest of the signed item
+type MetadataStatus struct {
+	Digest  string `json:"digest" cbor:"0,keyasint"`
+	Type    string `json:"type" cbor:"1,keyasint"`
+	Name    string `json:"name" cbor:"2,keyasint"`
+	Version string `json:"version" cbor:"3,keyasint"`
+	Size    int    `json:"size" cbor:"4,keyasint"`
+}
+
+// StatusProvider is an optional interface for drivers which report their
+// capabilities. Status must only return cached information and must not access
+// the hardware. Name, Signer and the health are set by the caller, key
+// algorithms and certificates are derived from the signing keys and the
+// certificate chain if not provided
+type StatusProvider interface {
+	Status() DriverStatus
+}
+
+// HealthChecker is an optional interface for drivers which can check whether
+// the underlying hardware or service is still responsive
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// EnrollmentState is the state of the certificate enrollment of the device
+type EnrollmentState string
+
+const (
+	EnrollmentUnenrolled EnrollmentState = "unenrolled"
+	EnrollmentCsrPending EnrollmentState = "csr-pending"
+	EnrollmentEnrolled   EnrollmentState = "enrolled"
+	EnrollmentRenewalDue EnrollmentState = "renewal-due"
+	EnrollmentFailed     EnrollmentState = "failed"
+)
+
+// EnrollmentStatus describes the enrollment state of the device. Attempts and
+// the last error refer to the failed attempts since the last successful
+// enrollment or renewal
+type EnrollmentStatus struct {
+	State       EnrollmentState `json:"state" cbor:"0,keyasint"`
+	Attempts    int             `json:"attempts,omitempty" cbor:"1,keyasint,omitempty"`
+	LastAttempt time.Time       `json:"lastAttempt" cbor:"2,keyasint"`
+	NextAttempt time.Time       `json:"nextAttempt" cbor:"3,keyasint"`
+	LastError   string          `json:"lastError,omitempty" cbor:"4,keyasint,omitempty"`
+}
+
 // DriverConfig contains all configuration values required for the different drivers
 type DriverConfig struct {
-	StoragePath    string
-	ServerAddr     string
-	KeyConfig      string
-	Metadata       [][]byte
-	UseIma         bool
-	ImaPcr         int
-	Serializer     Serializer
-	MeasurementLog bool
-	UseCtr         bool
-	CtrPcr         int
-	CtrLog         string
-	CtrDriver      string
+	StoragePath       string
+	ServerAddr        string
+	BootstrapToken    string
+	KeyConfig         string
+	AkKeyConfig       string
+	Metadata          [][]byte
+	UseIma            bool
+	ImaPcr            int
+	ImaWatchlist      []string
+	ImaPollInterval   string
+	ImaRedaction      *RedactionConfig
+	Serializer        Serializer
+	MeasurementLog    bool
+	RawEventLog       bool
+	UseCtr            bool
+	CtrPcr            int
+	CtrLog            string
+	CtrDriver         string
+	AkHandle          string
+	IkHandle          string
+	EvictHandles      bool
+	PcrSelection      map[string][]int
+	NvIndex           string
+	EncryptSessions   bool
+	AuditSessions     bool
+	OwnerAuth         string
+	EndorsementAuth   string
+	KeyAuth           string
+	IkPolicyPcrs      []int
+	IkPolicyAuthValue bool
+	SwKeyProtection   string
+	SwKeyPassphrase   string
+	SwKeyPcrs         []int
+	Pkcs11Module      string
+	Pkcs11Token       string
+	Pkcs11Slot        string
+	Pkcs11KeyLabel    string
+	Pkcs11KeyId       string
+	Pkcs11Pin         string
+	PsaCommand        string
+	PsaIakChain       string
+	TdxQgsAddr        string
+	DcapSocket        string
+	PluginSockets     []string
+	PluginTimeout     string
+	// Optional function returning a signed attestation report over the nonce,
+	// which drivers use for attested enrollments of their certificates
+	Attest func(nonce []byte) ([]byte, error)
+	// Optional additional certificate profiles the drivers enroll certificates for
+	CertProfiles []CertProfile
 }
 
 // Serializer is a generic interface providing methods for data serialization and
@@ -66,6 +229,24 @@ type Serializer interface {
 	Unmarshal(data []byte, v any) error
 	Sign(data []byte, signer Driver) ([]byte, error)
 	VerifyToken(data []byte, roots []*x509.Certificate) (TokenResult, []byte, bool)
+	// VerifyTokenAt verifies the token like VerifyToken, but checks the validity
+	// of the certificates at the given time. The zero time refers to the current time
+	VerifyTokenAt(data []byte, roots []*x509.Certificate, at time.Time) (TokenResult, []byte, bool)
+	// SignDetached signs the SHA-256 digest of the data without embedding it in
+	// the signature structure, so that the data can be stored separately
+	SignDetached(data []byte, signer Driver) ([]byte, error)
+	// VerifyDetached verifies the detached signature over the externally
+	// supplied data and returns the data, if the signature is valid. The zero
+	// time refers to the current time
+	VerifyDetached(sig, data []byte, roots []*x509.Certificate, at time.Time) (TokenResult, []byte, bool)
+}
+
+// MultiSigner is an optional interface of serializers which can sign data with
+// multiple signers in a single signature structure, such as COSE_Sign. The
+// signatures are verified with VerifyToken, which reports the result of each
+// signer separately
+type MultiSigner interface {
+	SignMulti(data []byte, signers []Driver) ([]byte, error)
 }
 
 // MetaInfo is a helper struct for generic info
@@ -94,6 +275,8 @@ type Artifact struct {
 	Pcr     *int           `json:"pcr,omitempty" cbor:"1,keyasint"`
 	Summary HexByte        `json:"summary,omitempty" cbor:"2,keyasint,omitempty"` // Either summary
 	Events  []MeasureEvent `json:"events,omitempty" cbor:"3,keyasint,omitempty"`  // Or Events
+	// Optional redaction of the event names
+	Redaction *Redaction `json:"redaction,omitempty" cbor:"4,keyasint,omitempty"`
 }
 
 type MeasureEvent struct {
@@ -101,11 +284,16 @@ type MeasureEvent struct {
 	EventName string     `json:"eventname,omitempty" cbor:"4,keyasint,omitempty"`
 	EventData *EventData `json:"eventdata,omitempty" cbor:"5,keyasint,omitempty"`
 	CtrData   *CtrData   `json:"ctrData,omitempty" cbor:"6,keyasint,omitempty"`
+	// Salted digest of the event name, if the name is redacted
+	NameSha256 HexByte `json:"nameSha256,omitempty" cbor:"7,keyasint,omitempty"`
 }
 
 type CtrData struct {
 	ConfigSha256 HexByte `json:"configSha256" cbor:"0,keyasint"`
 	RootfsSha256 HexByte `json:"rootfsSha256" cbor:"1,keyasint"`
+	// Restored indicates that the measurement was restored from the journal of
+	// the prover after a restart instead of being freshly collected
+	Restored bool `json:"restored,omitempty" cbor:"2,keyasint,omitempty"`
 }
 
 // Measurement represents the attestation report
@@ -117,6 +305,46 @@ type Measurement struct {
 	Certs     [][]byte   `json:"certs,omitempty" cbor:"3,keyasint"`
 	Signature []byte     `json:"signature,omitempty" cbor:"2,keyasint,omitempty"`
 	Artifacts []Artifact `json:"details,omitempty" cbor:"4,keyasint,omitempty"`
+	// Optional TPM session audit attestation and signature
+	AuditEvidence  []byte `json:"auditEvidence,omitempty" cbor:"5,keyasint,omitempty"`
+	AuditSignature []byte `json:"auditSignature,omitempty" cbor:"6,keyasint,omitempty"`
+	// Public area of the quote key, required to recalculate the session audit digest
+	AuditSigner []byte `json:"auditSigner,omitempty" cbor:"13,keyasint,omitempty"`
+	// Optional Azure CVM HCL report binding the vTPM AK to the SNP report
+	HclReport []byte `json:"hclReport,omitempty" cbor:"7,keyasint,omitempty"`
+	// Optional SNP launch configuration as reported by the SNP report, for information only
+	SnpLaunch *SnpLaunch `json:"snpLaunch,omitempty" cbor:"8,keyasint,omitempty"`
+	// Optional raw measured boot event log for verifiers replaying the log, for information only
+	EventLog []byte `json:"eventLog,omitempty" cbor:"9,keyasint,omitempty"`
+	// Measurements recorded at runtime via the measure API, only for runtime measurements
+	RuntimeEvents []RuntimeEvent `json:"runtimeEvents,omitempty" cbor:"10,keyasint,omitempty"`
+	// Optional PKCS#7 signed attested document of the Azure instance metadata service and the
+	// certificate chain of its signer, only for Azure vTPM measurements
+	AttestedDocument      []byte   `json:"attestedDocument,omitempty" cbor:"11,keyasint,omitempty"`
+	AttestedDocumentCerts [][]byte `json:"attestedDocumentCerts,omitempty" cbor:"12,keyasint,omitempty"`
+}
+
+// RuntimeEvent is a measurement recorded at runtime via the measure API of the
+// cmcd, e.g. by container engines or init systems. The events are not anchored
+// in hardware, their integrity is only protected by the report signature
+type RuntimeEvent struct {
+	Index     int     `json:"index" cbor:"0,keyasint"` // Position in the runtime measurement list
+	Name      string  `json:"name" cbor:"1,keyasint"`
+	HashAlg   string  `json:"hashAlg" cbor:"2,keyasint"` // e.g. SHA-256
+	Digest    HexByte `json:"digest" cbor:"3,keyasint"`
+	EventData []byte  `json:"eventData,omitempty" cbor:"4,keyasint,omitempty"`
+}
+
+// SnpLaunch contains the guest policy and the ID block and ID authentication
+// information structure digests the SNP guest was launched with
+type SnpLaunch struct {
+	Policy          uint64  `json:"policy" cbor:"0,keyasint"`
+	IdBlock         bool    `json:"idBlock" cbor:"1,keyasint"`
+	IdKeyDigest     HexByte `json:"idKeyDigest,omitempty" cbor:"2,keyasint,omitempty"`
+	AuthorKey       bool    `json:"authorKey" cbor:"3,keyasint"`
+	AuthorKeyDigest HexByte `json:"authorKeyDigest,omitempty" cbor:"4,keyasint,omitempty"`
+	FamilyId        HexByte `json:"familyId,omitempty" cbor:"5,keyasint,omitempty"`
+	ImageId         HexByte `json:"imageId,omitempty" cbor:"6,keyasint,omitempty"`
 }
 
 type SnpPolicy struct {
@@ -129,6 +357,16 @@ type SnpPolicy struct {
 	AbiMinor     uint8  `json:"abiMinor" cbor:"6,keyasint"`
 }
 
+// SnpIdBlock specifies the expected ID block of an SNP guest. The ID key
+// digest is mandatory, the author key digest, family ID and image ID are only
+// checked if specified
+type SnpIdBlock struct {
+	IdKeyDigest     HexByte `json:"idKeyDigest" cbor:"0,keyasint"`
+	AuthorKeyDigest HexByte `json:"authorKeyDigest,omitempty" cbor:"1,keyasint,omitempty"`
+	FamilyId        HexByte `json:"familyId,omitempty" cbor:"2,keyasint,omitempty"`
+	ImageId         HexByte `json:"imageId,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
 type SnpFw struct {
 	Build uint8 `json:"build" cbor:"0,keyasint"`
 	Major uint8 `json:"major" cbor:"1,keyasint"`
@@ -148,6 +386,8 @@ type SnpDetails struct {
 	Policy        SnpPolicy `json:"policy" cbor:"2,keyasint"`
 	Fw            SnpFw     `json:"fw" cbor:"3,keyasint"`
 	Tcb           SnpTcb    `json:"tcb" cbor:"4,keyasint"`
+	// Optional ID block, if not specified the ID block is not checked
+	IdBlock *SnpIdBlock `json:"idBlock,omitempty" cbor:"5,keyasint,omitempty"`
 }
 
 type IntelCollateral struct {
@@ -177,6 +417,33 @@ type TDXDetails struct {
 	TdAttributes  TDAttributes    `json:"tdAttributes" cbor:"6,keyasint"`
 }
 
+// NitroDetails optionally overrides the AWS Nitro root CA the attestation
+// document certificate chain is verified against
+type NitroDetails struct {
+	CaFingerprint string `json:"caFingerprint" cbor:"0,keyasint"` // AWS Nitro Root CA Certificate Fingerprint
+}
+
+// GceDetails contains the Google root CAs the GCE vTPM AK certificate
+// chain is verified against
+type GceDetails struct {
+	CaFingerprints []string `json:"caFingerprints" cbor:"0,keyasint"` // Google AK Root CA Certificate Fingerprints
+}
+
+// AzureVtpmDetails contains the Azure root CAs the vTPM AK certificate chain
+// and the signer of the attested document of the instance metadata service
+// are verified against
+type AzureVtpmDetails struct {
+	AkCaFingerprints   []string `json:"akCaFingerprints" cbor:"0,keyasint"`   // Azure Virtual TPM Root CA Certificate Fingerprints
+	ImdsCaFingerprints []string `json:"imdsCaFingerprints" cbor:"1,keyasint"` // Attested Document Signer Root CA Certificate Fingerprints
+}
+
+// PsaDetails contains the platform reference values of PSA devices. Reference
+// values with PSA details are not compared against software components
+type PsaDetails struct {
+	ImplementationId HexByte   `json:"implementationId,omitempty" cbor:"0,keyasint,omitempty"`
+	EndorsementKeys  []HexByte `json:"endorsementKeys,omitempty" cbor:"1,keyasint,omitempty"` // PKIX DER encoded initial attestation keys
+}
+
 type SGXDetails struct {
 	Version       uint16          `json:"version" cbor:"0,keyasint"`
 	Collateral    IntelCollateral `json:"collateral" cbor:"1,keyasint"`
@@ -228,17 +495,22 @@ type TDId struct {
 // element of types 'SNP Reference Value', 'TPM Reference Value', 'TDX Reference Value', 'SGX Reference Value'
 // and 'SW Reference Value'
 type ReferenceValue struct {
-	Type        string      `json:"type" cbor:"0,keyasint"`
-	Sha256      HexByte     `json:"sha256,omitempty" cbor:"1,keyasint,omitempty"`
-	Sha384      HexByte     `json:"sha384,omitempty" cbor:"2,keyasint,omitempty"`
-	Name        string      `json:"name,omitempty" cbor:"3,keyasint,omitempty"`
-	Optional    bool        `json:"optional,omitempty" cbor:"4,keyasint,omitempty"`
-	Pcr         *int        `json:"pcr,omitempty" cbor:"5,keyasint,omitempty"`
-	Snp         *SnpDetails `json:"snp,omitempty" cbor:"6,keyasint,omitempty"`
-	Tdx         *TDXDetails `json:"tdx,omitempty" cbor:"7,keyasint,omitempty"`
-	Sgx         *SGXDetails `json:"sgx,omitempty" cbor:"8,keyasint,omitempty"`
-	Description string      `json:"description,omitempty" cbor:"9,keyasint,omitempty"`
-	EventData   *EventData  `json:"eventdata,omitempty" cbor:"10,keyasint,omitempty"`
+	Type        string            `json:"type" cbor:"0,keyasint"`
+	Sha256      HexByte           `json:"sha256,omitempty" cbor:"1,keyasint,omitempty"`
+	Sha384      HexByte           `json:"sha384,omitempty" cbor:"2,keyasint,omitempty"`
+	Name        string            `json:"name,omitempty" cbor:"3,keyasint,omitempty"`
+	Optional    bool              `json:"optional,omitempty" cbor:"4,keyasint,omitempty"`
+	Pcr         *int              `json:"pcr,omitempty" cbor:"5,keyasint,omitempty"`
+	Snp         *SnpDetails       `json:"snp,omitempty" cbor:"6,keyasint,omitempty"`
+	Tdx         *TDXDetails       `json:"tdx,omitempty" cbor:"7,keyasint,omitempty"`
+	Sgx         *SGXDetails       `json:"sgx,omitempty" cbor:"8,keyasint,omitempty"`
+	Description string            `json:"description,omitempty" cbor:"9,keyasint,omitempty"`
+	EventData   *EventData        `json:"eventdata,omitempty" cbor:"10,keyasint,omitempty"`
+	Sha1        HexByte           `json:"sha1,omitempty" cbor:"11,keyasint,omitempty"`
+	Nitro       *NitroDetails     `json:"nitro,omitempty" cbor:"12,keyasint,omitempty"`
+	Psa         *PsaDetails       `json:"psa,omitempty" cbor:"13,keyasint,omitempty"`
+	Gce         *GceDetails       `json:"gce,omitempty" cbor:"14,keyasint,omitempty"`
+	AzureVtpm   *AzureVtpmDetails `json:"azureVtpm,omitempty" cbor:"15,keyasint,omitempty"`
 
 	manifest Manifest
 }
@@ -329,6 +601,7 @@ type DeviceDescription struct {
 	AppDescriptions []AppDescription     `json:"appDescriptions" cbor:"7,keyasint"`
 	Internal        []InternalConnection `json:"internalConnections" cbor:"8,keyasint"`
 	External        []ExternalInterface  `json:"externalEndpoints" cbor:"9,keyasint"`
+	Roles           []string             `json:"roles,omitempty" cbor:"10,keyasint,omitempty"`
 }
 
 // CompanyDescription represents the attestation report
@@ -391,6 +664,41 @@ type AttestationReport struct {
 	AppManifests       [][]byte      `json:"appManifests,omitempty" cbor:"4,keyasint,omitempty"`
 	CompanyDescription []byte        `json:"companyDescription,omitempty" cbor:"5,keyasint,omitempty"`
 	DeviceDescription  []byte        `json:"deviceDescription" cbor:"6,keyasint"`
+	// Hex encoded SHA-256 digests of the metadata items omitted from the report,
+	// as the verifier already holds them
+	CachedMetadata []string `json:"cachedMetadata,omitempty" cbor:"7,keyasint,omitempty"`
+}
+
+// IsReportMetadata returns whether metadata items of the type are part of
+// attestation reports
+func IsReportMetadata(typ string) bool {
+	switch typ {
+	case "App Manifest", "OS Manifest", "RTM Manifest", "Device Description",
+		"Company Description":
+		return true
+	default:
+		return false
+	}
+}
+
+// AddMetadata adds the signed metadata item of the type to the report. It
+// returns false if metadata items of the type are not part of reports
+func (r *AttestationReport) AddMetadata(typ string, item []byte) bool {
+	switch typ {
+	case "App Manifest":
+		r.AppManifests = append(r.AppManifests, item)
+	case "OS Manifest":
+		r.OsManifest = item
+	case "RTM Manifest":
+		r.RtmManifest = item
+	case "Device Description":
+		r.DeviceDescription = item
+	case "Company Description":
+		r.CompanyDescription = item
+	default:
+		return false
+	}
+	return true
 }
 
 func (r *ReferenceValue) GetManifest() Manifest {
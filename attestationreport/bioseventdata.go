@@ -340,7 +340,7 @@ func parseUefiVariableData(buf *bytes.Buffer) *UefiVariableData {
 
 		//read the amount of data into the []data fields
 
-		if buf.Len() < 2*int(unicodeNameLength) {
+		if uint64(buf.Len())/2 < unicodeNameLength {
 			// return output
 			log.Error("incomplete UEFI Variable Data field")
 			return uefiVariableData
@@ -350,7 +350,7 @@ func parseUefiVariableData(buf *bytes.Buffer) *UefiVariableData {
 		binary.Read(buf, binary.LittleEndian, &unicodeNameBuf)
 		unicodeName := string(utf16.Decode(unicodeNameBuf))
 
-		if buf.Len() < int(variableDataLength) {
+		if uint64(buf.Len()) < variableDataLength {
 			//just stop reading
 			log.Error("incomplete UEFI Variable Data field")
 			return uefiVariableData
@@ -371,11 +371,17 @@ func parseUefiVariableData(buf *bytes.Buffer) *UefiVariableData {
 		case "DriverOrder":
 			uefiVariableData.DriverOrder = parseEFIBootOrder(buf, int(variableDataLength))
 		case "BootNext":
-			uefiVariableData.BootNext = *parseSingleUint16(buf)
+			if v := parseSingleUint16(buf); v != nil {
+				uefiVariableData.BootNext = *v
+			}
 		case "BootCurrent":
-			uefiVariableData.BootCurrent = *parseSingleUint16(buf)
+			if v := parseSingleUint16(buf); v != nil {
+				uefiVariableData.BootCurrent = *v
+			}
 		case "BootOptionSupport":
-			uefiVariableData.BootOptionSupport = *parseSingleUint32(buf)
+			if v := parseSingleUint32(buf); v != nil {
+				uefiVariableData.BootOptionSupport = *v
+			}
 		case "SignatureSupport", "OsRecoveryOrder":
 			//parse an array of GUIDs
 			guidArray := make([]string, int(variableDataLength)/16)
@@ -422,7 +428,7 @@ func parseEFILoadOption(buf *bytes.Buffer, i int) *EFILoadOption {
 	// buffer needs to stop at sizeof(UINT32) + sizeof(UINT16) + StrSize(Description) + FilePathListLength of the EFI_LOAD_OPTION
 	bufferLengthPreParsing := buf.Len()
 	parsedBytes := 0
-	for parsedBytes < int(filePathListLength) {
+	for parsedBytes < int(filePathListLength) && buf.Len() > 0 {
 		fpl := parseFilePathList(buf, int(filePathListLength))
 		if fpl != nil {
 			efiloadoption.FilepathList = append(efiloadoption.FilepathList, *fpl)
@@ -474,10 +480,14 @@ func parseFilePathList(buf *bytes.Buffer, filepathlistlength int) *FilePathList
 		filepathlist.Type = "messaging device path"
 		switch fplSubtype {
 		case 0xa:
-			filepathlist.Subtype = "vendor-defined messaging device path"
-			//parsing the GUID
-			filepathlist.VendorGUID = readGUID(buf)
-			filepathlist.VendorDefinedData = (buf.Next(int(length) - 20))
+			if length >= 20 { //20 + n Bytes long
+				filepathlist.Subtype = "vendor-defined messaging device path"
+				//parsing the GUID
+				filepathlist.VendorGUID = readGUID(buf)
+				filepathlist.VendorDefinedData = (buf.Next(int(length) - 20))
+			} else {
+				log.Error("incompatible length of file path argument")
+			}
 		}
 	case 4: //(media device path)
 		filepathlist.Type = "media device path"
@@ -520,7 +530,10 @@ func parseFilePathList(buf *bytes.Buffer, filepathlistlength int) *FilePathList
 			bufferLengthPreParsing := buf.Len()
 			parsedBytes := 0
 			for parsedBytes < int(length)-4 {
-				str, _ := readUTF16UntilNull(buf)
+				str, err := readUTF16UntilNull(buf)
+				if err != nil {
+					break
+				}
 				filepathlist.PathName += str
 				parsedBytes = bufferLengthPreParsing - buf.Len()
 			}
@@ -583,7 +596,7 @@ func parseSingleUint16(buf *bytes.Buffer) *uint16 {
 }
 
 func parseSingleUint32(buf *bytes.Buffer) *uint32 {
-	if buf.Len() >= 2 {
+	if buf.Len() >= 4 {
 		var out uint32
 		binary.Read(buf, binary.LittleEndian, &out)
 		return &out
@@ -622,6 +635,12 @@ func parseEFISignaturedb(buf *bytes.Buffer, signatureDBSize int) []SignatureData
 		binary.Read(buf, binary.LittleEndian, &signatureHeaderSize)
 		binary.Read(buf, binary.LittleEndian, &signatureSize)
 
+		//each signature contains at least the owner GUID
+		if signatureSize < 16 {
+			log.Error("invalid signature size in signature list")
+			break
+		}
+
 		//parsing the Signature Header
 		sigdb.SignatureHeader = buf.Next(int(signatureHeaderSize))
 
@@ -682,7 +701,8 @@ func parseVariableDataX509_GUID(buf *bytes.Buffer, certsize int) X509CertExtract
 
 	cert, err := x509.ParseCertificate(certBuf)
 	if err != nil {
-		log.Error("Failed to parse certificate:")
+		log.Errorf("Failed to parse certificate: %v", err)
+		return X509CertExtracted{}
 	}
 
 	//extract the cert
@@ -724,7 +744,7 @@ func parseUefiGPTEvent(buf *bytes.Buffer) *GPTHeader {
 		gptPartitions := make([]GPTPartitionEntry, 0)
 
 		//reading the partitions
-		if buf.Len() >= int(numberOfPartitions)*128 { //128 Bytes: min size of a GPT Partition Entry
+		if uint64(buf.Len())/128 >= numberOfPartitions { //128 Bytes: min size of a GPT Partition Entry
 			{
 				for i := 0; i < int(numberOfPartitions); i++ {
 					partition := GPTPartitionEntry{}
@@ -796,7 +816,7 @@ func parseEFIHandoffTables(buf *bytes.Buffer) *UefiHandoffTablePointer {
 		binary.Read(buf, binary.LittleEndian, &numberOfTables)
 
 		//check possible length: len(GUID) = 16 + len(address) = 8  => 24 Bytes per table
-		if buf.Len() >= 24*int(numberOfTables) {
+		if uint64(buf.Len())/24 >= numberOfTables {
 			uefiConfigurationTable := make([]UefiConfigurationTable, 0)
 			for i := 0; i < int(numberOfTables); i++ {
 				//read GUID
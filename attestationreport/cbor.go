@@ -18,10 +18,14 @@ package attestationreport
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/fxamacker/cbor/v2"
@@ -31,6 +35,10 @@ import (
 type CborSerializer struct{}
 
 func (s CborSerializer) GetPayload(raw []byte) ([]byte, error) {
+	if err := CheckCbor(raw); err != nil {
+		return nil, fmt.Errorf("failed to get payload: %w", err)
+	}
+
 	// TODO better option to subdivide?
 	// Try unmarshalling as Sign1Message
 	var msg cose.SignMessage
@@ -51,20 +59,81 @@ func (s CborSerializer) Marshal(v any) ([]byte, error) {
 	return cbor.Marshal(v)
 }
 
+// Unmarshal unmarshals the CBOR data within the configured decoding limits
 func (s CborSerializer) Unmarshal(data []byte, v any) error {
-	return cbor.Unmarshal(data, v)
+	return DecodeCbor(data, v)
 }
 
 func (s CborSerializer) Sign(data []byte, signer Driver) ([]byte, error) {
+	return s.sign(data, []Driver{signer}, false)
+}
+
+// SignMulti signs the data with all signers in a single COSE_Sign structure,
+// which contains one signature with the respective certificate chain per signer
+func (s CborSerializer) SignMulti(data []byte, signers []Driver) ([]byte, error) {
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no signers specified")
+	}
+	return s.sign(data, signers, false)
+}
+
+// SignDetached signs the SHA-256 digest of the data like Sign, but with a
+// detached payload (RFC 9052 section 2): the payload of the message is nil
+func (s CborSerializer) SignDetached(data []byte, signer Driver) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return s.sign(digest[:], []Driver{signer}, true)
+}
+
+func (s CborSerializer) sign(data []byte, signers []Driver, detached bool) ([]byte, error) {
+
+	msgToSign := cose.NewSignMessage()
+	msgToSign.Payload = data
+
+	coseSigners := make([]cose.Signer, 0, len(signers))
+	for i, signer := range signers {
+		sigHolder, coseSigner, err := newSignature(signer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare signature %v: %w", i, err)
+		}
+		msgToSign.Signatures = append(msgToSign.Signatures, sigHolder)
+		coseSigners = append(coseSigners, coseSigner)
+	}
+
+	// This allows the signers to ensure mutual access for signing, if required
+	for _, signer := range signers {
+		signer.Lock()
+		defer signer.Unlock()
+	}
+
+	err := msgToSign.Sign(rand.Reader, nil, coseSigners...)
+	if err != nil {
+		return nil, fmt.Errorf("signing failed: %w. len(data): %v", err, len(data))
+	}
+	if detached {
+		msgToSign.Payload = nil
+	}
+
+	// sign and marshal message
+	coseRaw, err := msgToSign.MarshalCBOR()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cbor object: %w", err)
+	}
+
+	return coseRaw, nil
+}
+
+// newSignature creates the signature holder with the algorithm and the
+// certificate chain of the signer as well as the COSE signer for its key
+func newSignature(signer Driver) (*cose.Signature, cose.Signer, error) {
 
-	private, _, err := signer.GetSigningKeys()
+	private, public, err := signer.GetSigningKeys()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get signing keys: %w", err)
+		return nil, nil, fmt.Errorf("failed to get signing keys: %w", err)
 	}
 
 	certChain, err := signer.GetCertChain()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get cert chain: %w", err)
+		return nil, nil, fmt.Errorf("failed to get cert chain: %w", err)
 	}
 	certChainRaw := make([][]byte, 0)
 	for _, cert := range certChain {
@@ -73,45 +142,57 @@ func (s CborSerializer) Sign(data []byte, signer Driver) ([]byte, error) {
 
 	stmp, ok := private.(crypto.Signer)
 	if !ok {
-		return nil, fmt.Errorf("failed to convert signing key of type %T", private)
+		return nil, nil, fmt.Errorf("failed to convert signing key of type %T", private)
+	}
+	alg, err := coseAlgFromKeyType(public)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get alg from key type: %w", err)
 	}
-	coseSigner, err := cose.NewSigner(cose.AlgorithmES256, stmp)
+	coseSigner, err := cose.NewSigner(alg, stmp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create signer: %w", err)
+		return nil, nil, fmt.Errorf("failed to create signer: %w", err)
 	}
 
 	// create a signature holder
 	sigHolder := cose.NewSignature()
-	sigHolder.Headers.Protected.SetAlgorithm(cose.AlgorithmES256)
+	sigHolder.Headers.Protected.SetAlgorithm(alg)
 
 	// https://datatracker.ietf.org/doc/draft-ietf-cose-x509/08/ section 2
 	// If multiple certificates are conveyed, a CBOR array of byte strings is used,
 	// with each certificate being in its own byte string (DER Encoded)
 	sigHolder.Headers.Unprotected[cose.HeaderLabelX5Chain] = certChainRaw
 
-	msgToSign := cose.NewSignMessage()
-	msgToSign.Payload = data
-	msgToSign.Signatures = append(msgToSign.Signatures, sigHolder)
-
-	// This allows the signer to ensure mutual access for signing, if required
-	signer.Lock()
-	defer signer.Unlock()
+	return sigHolder, coseSigner, nil
+}
 
-	err = msgToSign.Sign(rand.Reader, nil, coseSigner)
-	if err != nil {
-		return nil, fmt.Errorf("signing failed: %w. len(data): %v", err, len(data))
+// VerifyDetached verifies the signatures and certificate chains of a COSE
+// message with detached payload over the SHA-256 digest of the data
+func (s CborSerializer) VerifyDetached(sig, data []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
+	digest := sha256.Sum256(data)
+	result, _, ok := s.verifyToken(sig, digest[:], roots, at)
+	if !ok {
+		return result, nil, false
 	}
+	return result, data, true
+}
 
-	// sign and marshal message
-	coseRaw, err := msgToSign.MarshalCBOR()
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal cbor object: %w", err)
-	}
+func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (TokenResult, []byte, bool) {
+	return s.VerifyTokenAt(data, roots, time.Time{})
+}
 
-	return coseRaw, nil
+// VerifyTokenAt verifies signatures and certificate chains for COSE tokens with
+// the certificates validity checked at the given time
+func (s CborSerializer) VerifyTokenAt(data []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
+	return s.verifyToken(data, nil, roots, at)
 }
 
-func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (TokenResult, []byte, bool) {
+// verifyToken verifies the COSE message. If the detached payload is specified,
+// the message must not contain a payload and the signatures are verified over
+// the detached payload
+func (s CborSerializer) verifyToken(data, detached []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
 
 	// TODO TokenResult (Naming)
 	result := TokenResult{}
@@ -123,6 +204,10 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 	}
 
 	// create a sign message from a raw COSE_Sign payload
+	if err := CheckCbor(data); err != nil {
+		log.Warnf("Data exceeds decoding limits: %v", err)
+		return result, nil, false
+	}
 	var msgToVerify cose.SignMessage
 	err := msgToVerify.UnmarshalCBOR(data)
 	if err != nil {
@@ -134,15 +219,30 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 		log.Tracef("Length: %v (0x%x)", len(data), len(data))
 		return result, nil, false
 	}
+	if detached != nil {
+		if msgToVerify.Payload != nil {
+			log.Warnf("COSE message with detached payload contains a payload")
+			return result, nil, false
+		}
+		msgToVerify.Payload = detached
+	}
 
-	// Extract leaf certificates, use its public keys for the verifiers and create verifiers
+	// Extract leaf certificates, use its public keys for the verifiers and verify
+	// each signature separately, so that the result of every signer is reported
 	if len(msgToVerify.Signatures) == 0 {
 		log.Warnf("failed to verify COSE: no signatures present")
 		return result, nil, false
 	}
-	verifiers := make([]cose.Verifier, 0)
+	protected, err := msgToVerify.Headers.MarshalProtected()
+	if err != nil {
+		log.Warnf("failed to marshal COSE protected header: %v", err)
+		return result, nil, false
+	}
 	for i, sig := range msgToVerify.Signatures {
 		result.SignatureCheck = append(result.SignatureCheck, SignatureResult{})
+		if alg, err := sig.Headers.Protected.Algorithm(); err == nil {
+			result.SignatureCheck[i].Algorithm = alg.String()
+		}
 
 		x5Chain, okConv := sig.Headers.Unprotected[cose.HeaderLabelX5Chain].([]interface{})
 		if !okConv {
@@ -174,7 +274,7 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 			certChain = append(certChain, x509Cert)
 		}
 
-		x509Chains, err := internal.VerifyCertChain(certChain, roots)
+		x509Chains, err := internal.VerifyCertChainAt(certChain, roots, at)
 		if err != nil {
 			log.Warnf("failed to verify certificate chain: %v", err)
 			result.SignatureCheck[i].CertChainCheck.Success = false
@@ -184,18 +284,13 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 		}
 
 		//Store details from (all) validated certificate chain(s)
-		for _, chain := range x509Chains {
-			chainExtracted := []X509CertExtracted{}
-			for _, cert := range chain {
-				chainExtracted = append(chainExtracted, ExtractX509Infos(cert))
-			}
-			result.SignatureCheck[i].ValidatedCerts = append(result.SignatureCheck[i].ValidatedCerts, chainExtracted)
-		}
+		result.SignatureCheck[i].AddValidatedChains(x509Chains)
 
 		result.SignatureCheck[i].CertChainCheck.Success = true
 
-		publicKey, okKey := certChain[0].PublicKey.(*ecdsa.PublicKey)
-		if !okKey {
+		publicKey := certChain[0].PublicKey
+		alg, err := coseAlgFromKeyType(publicKey)
+		if err != nil {
 			log.Warnf("Failed to extract public key from certificate: %v", err)
 			result.SignatureCheck[i].SignCheck.Success = false
 			result.SignatureCheck[i].SignCheck.ErrorCode = ExtractPubKey
@@ -204,7 +299,7 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 		}
 
 		// create a verifier from a trusted private key
-		verifier, err := cose.NewVerifier(cose.AlgorithmES256, publicKey)
+		verifier, err := cose.NewVerifier(alg, publicKey)
 		if err != nil {
 			log.Warnf("Failed to create verifier: %v", err)
 			result.SignatureCheck[i].SignCheck.Success = false
@@ -213,26 +308,44 @@ func (s CborSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 			continue
 		}
 
-		verifiers = append(verifiers, verifier)
-	}
-
-	err = msgToVerify.Verify(nil, verifiers...)
-	if err != nil {
-		log.Warnf("Error verifying cbor signature: %v", err)
-		// Can only be set for all signatures here
-		for i := range result.SignatureCheck {
+		err = sig.Verify(verifier, protected, msgToVerify.Payload, nil)
+		if err != nil {
+			log.Warnf("Error verifying cbor signature %v: %v", i, err)
 			result.SignatureCheck[i].SignCheck.Success = false
 			result.SignatureCheck[i].SignCheck.ErrorCode = VerifySignature
+			ok = false
+			continue
 		}
-		return result, nil, false
-	} else {
-		// Can only be set for all signatures here
-		for i := range result.SignatureCheck {
-			result.SignatureCheck[i].SignCheck.Success = true
-		}
+		result.SignatureCheck[i].SignCheck.Success = true
 	}
 
 	result.Summary.Success = ok
+	if !ok {
+		return result, nil, false
+	}
 
 	return result, msgToVerify.Payload, true
 }
+
+// coseAlgFromKeyType returns the COSE signature algorithm for the key type.
+// ECDSA keys are used with the hash algorithm matching the curve
+func coseAlgFromKeyType(pub crypto.PublicKey) (cose.Algorithm, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return cose.AlgorithmES256, nil
+		case elliptic.P384():
+			return cose.AlgorithmES384, nil
+		case elliptic.P521():
+			return cose.AlgorithmES512, nil
+		default:
+			return cose.AlgorithmES256, fmt.Errorf("unsupported elliptic curve %v",
+				key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return cose.AlgorithmEd25519, nil
+	default:
+		return cose.AlgorithmES256, fmt.Errorf("unsupported key type %T", pub)
+	}
+}
@@ -16,14 +16,23 @@
 package attestationreport
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
+	"github.com/veraison/go-cose"
+	"golang.org/x/exp/slices"
 )
 
 type SwSigner struct {
@@ -77,7 +86,7 @@ func TestVerifyCbor(t *testing.T) {
 	}
 
 	// Setup logger
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	// Setup certificate chain and keys
 	certChain, privateKey := testCreatePki(leafPem, leafKeyPem)
@@ -112,6 +121,246 @@ func TestVerifyCbor(t *testing.T) {
 	}
 }
 
+func TestSignDetached(t *testing.T) {
+	certChain, privateKey := testCreatePki(leafPem, leafKeyPem)
+	signer := &SwSigner{
+		certChain: certChain,
+		priv:      privateKey,
+	}
+	roots := []*x509.Certificate{certChain[len(certChain)-1]}
+
+	for _, s := range []Serializer{JsonSerializer{}, CborSerializer{}} {
+		report, err := s.Marshal(AttestationReport{Type: "Attestation Report"})
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		sig, err := s.SignDetached(report, signer)
+		if err != nil {
+			t.Fatalf("SignDetached() error = %v", err)
+		}
+		attached, err := s.Sign(report, signer)
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		tampered := append([]byte{}, report...)
+		tampered[len(tampered)-1] ^= 0xff
+
+		tests := []struct {
+			name    string
+			sig     []byte
+			payload []byte
+			want    bool
+		}{
+			{"Valid", sig, report, true},
+			{"Tampered Payload", sig, tampered, false},
+			{"Empty Payload", sig, []byte{}, false},
+			{"Attached Signature", attached, report, false},
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%T %v", s, tt.name), func(t *testing.T) {
+				_, payload, got := s.VerifyDetached(tt.sig, tt.payload, roots, time.Time{})
+				if got != tt.want {
+					t.Fatalf("VerifyDetached() = %v, want %v", got, tt.want)
+				}
+				if got && !bytes.Equal(payload, report) {
+					t.Errorf("VerifyDetached() payload = %x, want %x", payload, report)
+				}
+			})
+		}
+
+		// The detached signature does not contain the report and cannot be
+		// verified as attached signature
+		if bytes.Contains(sig, report) {
+			t.Errorf("%T detached signature contains the report", s)
+		}
+		if _, _, ok := s.VerifyToken(sig, roots); ok {
+			t.Errorf("%T VerifyToken() of detached signature succeeded", s)
+		}
+	}
+}
+
+func TestSignEcdsaCurves(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve elliptic.Curve
+	}{
+		{"P-256", elliptic.P256()},
+		{"P-384", elliptic.P384()},
+		{"P-521", elliptic.P521()},
+	}
+	for _, tt := range tests {
+		priv, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Test " + tt.name},
+			NotBefore:             time.Now().Add(-time.Minute),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatalf("failed to create certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %v", err)
+		}
+		signer := &SwSigner{certChain: []*x509.Certificate{cert}, priv: priv}
+
+		for _, s := range []Serializer{JsonSerializer{}, CborSerializer{}} {
+			t.Run(fmt.Sprintf("%T %v", s, tt.name), func(t *testing.T) {
+				report, err := s.Marshal(AttestationReport{Type: "Attestation Report"})
+				if err != nil {
+					t.Fatalf("Marshal() error = %v", err)
+				}
+				token, err := s.Sign(report, signer)
+				if err != nil {
+					t.Fatalf("Sign() error = %v", err)
+				}
+				result, payload, ok := s.VerifyToken(token, []*x509.Certificate{cert})
+				if !ok {
+					t.Fatalf("VerifyToken() failed: %v", result.Summary)
+				}
+				if !bytes.Equal(payload, report) {
+					t.Errorf("VerifyToken() payload = %x, want %x", payload, report)
+				}
+			})
+		}
+	}
+}
+
+func TestSignMulti(t *testing.T) {
+
+	// Create a root CA and three signers with leaf certificates issued by it
+	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ca := testCreateCert(t, "Test Root CA", &caPriv.PublicKey, nil, caPriv)
+	signers := make([]*SwSigner, 0, 3)
+	for i := 0; i < 3; i++ {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		leaf := testCreateCert(t, fmt.Sprintf("Test Signer %v", i), &priv.PublicKey, ca, caPriv)
+		signers = append(signers, &SwSigner{certChain: []*x509.Certificate{leaf, ca}, priv: priv})
+	}
+	// The invalid signer signs with a key not matching its certificate
+	invalid := &SwSigner{certChain: signers[0].certChain, priv: signers[1].priv}
+
+	tests := []struct {
+		name    string
+		signers []Driver
+		want    []bool
+	}{
+		{"One Signer", []Driver{signers[0]}, []bool{true}},
+		{"Two Signers", []Driver{signers[0], signers[1]}, []bool{true, true}},
+		{"Three Signers", []Driver{signers[0], signers[1], signers[2]}, []bool{true, true, true}},
+		{"Invalid Signature", []Driver{signers[0], invalid, signers[2]},
+			[]bool{true, false, true}},
+	}
+
+	s := CborSerializer{}
+	report, err := s.Marshal(AttestationReport{Type: "Attestation Report"})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := s.SignMulti(report, tt.signers)
+			if err != nil {
+				t.Fatalf("SignMulti() error = %v", err)
+			}
+
+			result, payload, ok := s.VerifyToken(token, []*x509.Certificate{ca})
+			wantOk := !slices.Contains(tt.want, false)
+			if ok != wantOk || result.Summary.Success != wantOk {
+				t.Fatalf("VerifyToken() = %v, summary %v, want %v", ok,
+					result.Summary.Success, wantOk)
+			}
+			if ok && !bytes.Equal(payload, report) {
+				t.Errorf("VerifyToken() payload = %x, want %x", payload, report)
+			}
+			if len(result.SignatureCheck) != len(tt.want) {
+				t.Fatalf("VerifyToken() returned %v signature results, want %v",
+					len(result.SignatureCheck), len(tt.want))
+			}
+			for i, want := range tt.want {
+				sc := result.SignatureCheck[i]
+				if !sc.CertChainCheck.Success {
+					t.Errorf("signature %v: cert chain check failed", i)
+				}
+				if sc.SignCheck.Success != want {
+					t.Errorf("signature %v: sign check = %v, want %v", i,
+						sc.SignCheck.Success, want)
+				}
+				if !want && sc.SignCheck.ErrorCode != VerifySignature {
+					t.Errorf("signature %v: error code = %v, want %v", i,
+						sc.SignCheck.ErrorCode, VerifySignature)
+				}
+				leaf := tt.signers[i].(*SwSigner).certChain[0]
+				if len(sc.ValidatedCerts) == 0 || len(sc.ValidatedCerts[0]) == 0 ||
+					sc.ValidatedCerts[0][0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+					t.Errorf("signature %v: cert chain does not match signer %v", i,
+						leaf.Subject.CommonName)
+				}
+			}
+		})
+	}
+
+	// A single signer produces the same structure as Sign
+	single, err := s.SignMulti(report, []Driver{signers[0]})
+	if err != nil {
+		t.Fatalf("SignMulti() error = %v", err)
+	}
+	var msg cose.SignMessage
+	if err := msg.UnmarshalCBOR(single); err != nil || len(msg.Signatures) != 1 {
+		t.Errorf("SignMulti() with one signer: %v signatures, error %v", len(msg.Signatures), err)
+	}
+
+	if _, err := s.SignMulti(report, nil); err == nil {
+		t.Errorf("SignMulti() without signers succeeded")
+	}
+	if _, ok := Serializer(JsonSerializer{}).(MultiSigner); ok {
+		t.Errorf("JsonSerializer must not support multiple signers")
+	}
+}
+
+// testCreateCert creates a certificate for the public key signed by the parent,
+// or a self-signed CA certificate if no parent is specified
+func testCreateCert(t *testing.T, cn string, pub *ecdsa.PublicKey, parent *x509.Certificate,
+	priv *ecdsa.PrivateKey) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.IsCA = true
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
 func testCreatePki(certPem, keyPem []byte) ([]*x509.Certificate, *ecdsa.PrivateKey) {
 
 	block, _ := pem.Decode(keyPem)
@@ -0,0 +1,411 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import "fmt"
+
+// ResultVersion is the version of the verification result format. Version 2
+// adds the flat list of checks, from which the success is derived. The version
+// must be increased on incompatible changes of the result format
+const ResultVersion = 2
+
+// CheckCategory is the kind of the checked artifact
+type CheckCategory string
+
+const (
+	CategoryReport      CheckCategory = "report"
+	CategorySignature   CheckCategory = "signature"
+	CategoryCertificate CheckCategory = "certificate"
+	CategoryMetadata    CheckCategory = "metadata"
+	CategoryMeasurement CheckCategory = "measurement"
+	CategoryPcr         CheckCategory = "pcr"
+	CategoryBaseline    CheckCategory = "baseline"
+	CategoryPolicy      CheckCategory = "policy"
+)
+
+// Check is the result of a single check of an artifact of the attestation
+// report. The path refers to the location of the detailed result, e.g.
+// "measurements[0].pcr[7]". Failed checks always contain an error code, whose
+// numeric value and name are stable, so that relying parties can switch on it
+type Check struct {
+	Path      string        `json:"path"`
+	Category  CheckCategory `json:"category"`
+	Success   bool          `json:"success"`
+	ErrorCode ErrorCode     `json:"errorCode,omitempty"`
+	Code      string        `json:"code,omitempty"` // Name of the error code
+	Expected  string        `json:"expected,omitempty"`
+	Got       string        `json:"got,omitempty"`
+}
+
+// errorCodeNames are the stable names of the error codes
+var errorCodeNames = map[ErrorCode]string{
+	NotSet:                      "NotSet",
+	CaFingerprint:               "CaFingerprint",
+	CRLCheckRoot:                "CRLCheckRoot",
+	CRLCheckPCK:                 "CRLCheckPCK",
+	CRLCheckSigningCert:         "CRLCheckSigningCert",
+	DecodeCertChain:             "DecodeCertChain",
+	UnknownSerialization:        "UnknownSerialization",
+	DownloadRootCRL:             "DownloadRootCRL",
+	DownloadPCKCRL:              "DownloadPCKCRL",
+	EvidenceLength:              "EvidenceLength",
+	EvidenceType:                "EvidenceType",
+	Expired:                     "Expired",
+	ExtractPubKey:               "ExtractPubKey",
+	Internal:                    "Internal",
+	InvalidCertificationLevel:   "InvalidCertificationLevel",
+	JWSNoSignatures:             "JWSNoSignatures",
+	JWSSignatureOrder:           "JWSSignatureOrder",
+	JWSPayload:                  "JWSPayload",
+	MeasurementNoMatch:          "MeasurementNoMatch",
+	MeasurementTypeNotSupported: "MeasurementTypeNotSupported",
+	NotPresent:                  "NotPresent",
+	NotYetValid:                 "NotYetValid",
+	OidLength:                   "OidLength",
+	OidNotPresent:               "OidNotPresent",
+	OidTag:                      "OidTag",
+	Parse:                       "Parse",
+	ParseAR:                     "ParseAR",
+	ParseX5C:                    "ParseX5C",
+	ParseCA:                     "ParseCA",
+	ParseCAFingerprint:          "ParseCAFingerprint",
+	ParseCert:                   "ParseCert",
+	ParseTcbInfo:                "ParseTcbInfo",
+	ParseJSON:                   "ParseJSON",
+	ParseOSManifest:             "ParseOSManifest",
+	ParseEvidence:               "ParseEvidence",
+	ParseExtensions:             "ParseExtensions",
+	ParseQEIdentity:             "ParseQEIdentity",
+	ParseRTMManifest:            "ParseRTMManifest",
+	ParseTime:                   "ParseTime",
+	PolicyEngineNotImplemented:  "PolicyEngineNotImplemented",
+	RefValTypeNotSupported:      "RefValTypeNotSupported",
+	SetupSystemCA:               "SetupSystemCA",
+	SgxFmpcMismatch:             "SgxFmpcMismatch",
+	SgxPceidMismatch:            "SgxPceidMismatch",
+	SignatureLength:             "SignatureLength",
+	DetailsNotPresent:           "DetailsNotPresent",
+	RefValMultiple:              "RefValMultiple",
+	RefValNotPresent:            "RefValNotPresent",
+	RefValType:                  "RefValType",
+	RefValNoMatch:               "RefValNoMatch",
+	TcbInfoExpired:              "TcbInfoExpired",
+	TcbLevelUnsupported:         "TcbLevelUnsupported",
+	TcbLevelRevoked:             "TcbLevelRevoked",
+	UnsupportedAlgorithm:        "UnsupportedAlgorithm",
+	VerifyAR:                    "VerifyAR",
+	VerifyCertChain:             "VerifyCertChain",
+	VerifyPCKChain:              "VerifyPCKChain",
+	VerifyOSManifest:            "VerifyOSManifest",
+	VerifyPolicies:              "VerifyPolicies",
+	VerifyQEIdentityErr:         "VerifyQEIdentityErr",
+	VerifyRTMManifest:           "VerifyRTMManifest",
+	VerifySignature:             "VerifySignature",
+	VerifyTCBChain:              "VerifyTCBChain",
+	VerifyTcbInfo:               "VerifyTcbInfo",
+	ExtensionsCheck:             "ExtensionsCheck",
+	PcrNotSpecified:             "PcrNotSpecified",
+	PcrSelectionMismatch:        "PcrSelectionMismatch",
+	SessionAuditMismatch:        "SessionAuditMismatch",
+	IdBlockNotPresent:           "IdBlockNotPresent",
+	GceInstanceInfo:             "GceInstanceInfo",
+	NonceUnknown:                "NonceUnknown",
+	NonceExpired:                "NonceExpired",
+	AlgorithmNotAllowed:         "AlgorithmNotAllowed",
+	KeySizeTooSmall:             "KeySizeTooSmall",
+	SerializerNotAllowed:        "SerializerNotAllowed",
+	MissingCacheEntry:           "MissingCacheEntry",
+	NonceMismatch:               "NonceMismatch",
+	AttestedDocument:            "AttestedDocument",
+	PcrNoMatch:                  "PcrNoMatch",
+	VerifyAppManifest:           "VerifyAppManifest",
+	VerifyDeviceDescription:     "VerifyDeviceDescription",
+	VerifyCompanyDescription:    "VerifyCompanyDescription",
+	VerificationFailed:          "VerificationFailed",
+	PolicyCompile:               "PolicyCompile",
+	PolicyTimeout:               "PolicyTimeout",
+	PolicyUndefined:             "PolicyUndefined",
+	PolicyTrap:                  "PolicyTrap",
+	PolicyMemoryLimit:           "PolicyMemoryLimit",
+}
+
+// Name returns the stable name of the error code, which equals the name of the
+// constant
+func (e ErrorCode) Name() string {
+	if n, ok := errorCodeNames[e]; ok {
+		return n
+	}
+	return fmt.Sprintf("Unknown%v", int(e))
+}
+
+// Summarize collects the checks of all verified artifacts and derives the
+// success of the verification from them. A global error code which is not
+// reflected by a failed check, e.g. for a report in an unknown serialization,
+// is added as check of the report
+func (r *VerificationResult) Summarize() {
+
+	c := &checkCollector{}
+
+	for i, s := range r.ReportSignature {
+		c.signature(fmt.Sprintf("reportSignature[%v]", i), s)
+	}
+	c.metadata(&r.MetadataResult)
+	for i, m := range r.Measurements {
+		c.measurement(fmt.Sprintf("measurements[%v]", i), &m)
+	}
+	for i, f := range r.Findings {
+		check := Check{
+			Path:     fmt.Sprintf("findings[%v]", i),
+			Category: CategoryBaseline,
+			Success:  f.Severity != SeverityError,
+			Expected: f.Expected,
+			Got:      f.Got,
+		}
+		check.setCode(f.ErrorCode)
+		c.checks = append(c.checks, check)
+	}
+
+	switch r.ErrorCode {
+	case NotSet:
+	case VerifyAR:
+		// Reflected by the failed checks of the report signature
+	case VerifyPolicies, PolicyEngineNotImplemented, PolicyCompile, PolicyTimeout,
+		PolicyUndefined, PolicyTrap, PolicyMemoryLimit:
+		c.add("policies", CategoryPolicy, Result{ErrorCode: r.ErrorCode}, r.ErrorCode)
+	default:
+		if !c.failed(r.ErrorCode) {
+			c.add("report", CategoryReport, Result{ErrorCode: r.ErrorCode}, r.ErrorCode)
+		}
+	}
+	if !r.Success && !c.failed(NotSet) {
+		c.add("report", CategoryReport, Result{ErrorCode: VerificationFailed}, VerificationFailed)
+	}
+
+	r.Version = ResultVersion
+	r.Checks = c.checks
+	r.Success = !c.failed(NotSet)
+}
+
+type checkCollector struct {
+	checks []Check
+}
+
+// add adds the result as check, if it was evaluated. Failed results without
+// error code get the specified default code
+func (c *checkCollector) add(path string, category CheckCategory, r Result, code ErrorCode) {
+	if !evaluated(r) {
+		return
+	}
+	check := Check{
+		Path:     path,
+		Category: category,
+		Success:  r.Success,
+		Expected: r.Expected,
+		Got:      r.Got,
+	}
+	switch {
+	case len(r.ExpectedOneOf) > 0:
+		check.Expected = fmt.Sprintf("%v", r.ExpectedOneOf)
+	case len(r.ExpectedBetween) == 2:
+		check.Expected = fmt.Sprintf("%v - %v", r.ExpectedBetween[0], r.ExpectedBetween[1])
+	}
+	if r.ErrorCode != NotSet {
+		check.setCode(r.ErrorCode)
+	} else if !r.Success {
+		check.setCode(code)
+	}
+	c.checks = append(c.checks, check)
+}
+
+// failed returns whether a check with the error code failed. NotSet matches
+// any failed check
+func (c *checkCollector) failed(code ErrorCode) bool {
+	for _, check := range c.checks {
+		if !check.Success && (code == NotSet || check.ErrorCode == code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checkCollector) signature(path string, s SignatureResult) {
+	c.add(path+".certChain", CategoryCertificate, s.CertChainCheck, VerifyCertChain)
+	if s.CertChainCheck.Success {
+		for i, chain := range s.ValidatedCerts {
+			for j, cert := range chain {
+				c.checks = append(c.checks, Check{
+					Path:     fmt.Sprintf("%v.certs[%v][%v]", path, i, j),
+					Category: CategoryCertificate,
+					Success:  true,
+					Got:      cert.Subject.CommonName,
+				})
+			}
+		}
+	}
+	c.add(path+".signature", CategorySignature, s.SignCheck, VerifySignature)
+}
+
+func (c *checkCollector) manifest(path string, m *ManifestResult, code ErrorCode) {
+	if m.Name == "" && !evaluated(m.Summary) {
+		return
+	}
+	c.add(path, CategoryMetadata, m.Summary, code)
+	for i, s := range m.SignatureCheck {
+		c.signature(fmt.Sprintf("%v.signature[%v]", path, i), s)
+	}
+	c.add(path+".validity", CategoryMetadata, m.ValidityCheck, Expired)
+}
+
+func (c *checkCollector) metadata(mr *MetadataResult) {
+	if d := mr.CompDescResult; d != nil {
+		c.add("companyDescription", CategoryMetadata, d.Summary, VerifyCompanyDescription)
+		for i, s := range d.SignatureCheck {
+			c.signature(fmt.Sprintf("companyDescription.signature[%v]", i), s)
+		}
+		c.add("companyDescription.validity", CategoryMetadata, d.ValidityCheck, Expired)
+	}
+	c.manifest("rtmManifest", &mr.RtmResult, VerifyRTMManifest)
+	c.manifest("osManifest", &mr.OsResult, VerifyOSManifest)
+	for i := range mr.AppResults {
+		c.manifest(fmt.Sprintf("appManifests[%v]", i), &mr.AppResults[i], VerifyAppManifest)
+	}
+
+	d := &mr.DevDescResult
+	if d.Name == "" && !evaluated(d.Summary) {
+		return
+	}
+	code := VerifyDeviceDescription
+	c.add("deviceDescription", CategoryMetadata, d.Summary, code)
+	for i, s := range d.SignatureCheck {
+		c.signature(fmt.Sprintf("deviceDescription.signature[%v]", i), s)
+	}
+	c.add("deviceDescription.correctRtm", CategoryMetadata, d.CorrectRtm, code)
+	c.add("deviceDescription.correctOs", CategoryMetadata, d.CorrectOs, code)
+	for i, r := range d.CorrectApps {
+		c.add(fmt.Sprintf("deviceDescription.correctApps[%v]", i), CategoryMetadata, r, code)
+	}
+	c.add("deviceDescription.rtmOsCompatibility", CategoryMetadata, d.RtmOsCompatibility, code)
+	for i, r := range d.OsAppsCompatibility {
+		c.add(fmt.Sprintf("deviceDescription.osAppCompatibility[%v]", i), CategoryMetadata, r,
+			code)
+	}
+}
+
+func (c *checkCollector) measurement(path string, m *MeasurementResult) {
+	c.add(path, CategoryMeasurement, m.Summary, MeasurementNoMatch)
+	c.add(path+".freshness", CategoryMeasurement, m.Freshness, NonceMismatch)
+	c.signature(path+".signature", m.Signature)
+
+	for i, a := range m.Artifacts {
+		check := Check{
+			Path:     fmt.Sprintf("%v.artifacts[%v]", path, i),
+			Category: CategoryMeasurement,
+			Success:  a.Success,
+		}
+		if a.Pcr != nil {
+			check.Path = fmt.Sprintf("%v.artifacts[pcr=%v][%v]", path, *a.Pcr, i)
+		}
+		// Failed reference values were not measured, failed measurements have
+		// no reference value
+		if a.Type == "Reference Value" {
+			check.Expected = a.Digest
+		} else {
+			check.Got = a.Digest
+		}
+		if !a.Success {
+			if a.Type == "Reference Value" {
+				check.setCode(RefValNoMatch)
+			} else {
+				check.setCode(MeasurementNoMatch)
+			}
+		}
+		c.checks = append(c.checks, check)
+	}
+
+	if t := m.TpmResult; t != nil {
+		for i, p := range t.PcrMatch {
+			check := Check{
+				Path:     fmt.Sprintf("%v.pcr[%v]", path, i),
+				Category: CategoryPcr,
+				Success:  p.Success,
+				Expected: p.Digest,
+				Got:      p.Description,
+			}
+			if p.Pcr != nil {
+				check.Path = fmt.Sprintf("%v.pcr[%v]", path, *p.Pcr)
+			}
+			if !p.Success {
+				check.setCode(PcrNoMatch)
+			}
+			c.checks = append(c.checks, check)
+		}
+		c.add(path+".aggPcrQuoteMatch", CategoryPcr, t.AggPcrQuoteMatch, PcrNoMatch)
+		if t.SessionAudit != nil {
+			c.add(path+".sessionAudit", CategoryMeasurement, *t.SessionAudit,
+				SessionAuditMismatch)
+		}
+	}
+	if s := m.SnpResult; s != nil {
+		c.add(path+".snp.version", CategoryMeasurement, s.VersionMatch, MeasurementNoMatch)
+		c.add(path+".snp.tcb", CategoryMeasurement, s.TcbCheck.Summary, MeasurementNoMatch)
+		c.add(path+".snp.policy", CategoryMeasurement, s.PolicyCheck.Summary, MeasurementNoMatch)
+		if s.IdBlockCheck != nil {
+			c.add(path+".snp.idBlock", CategoryMeasurement, s.IdBlockCheck.Summary,
+				MeasurementNoMatch)
+		}
+		for i, r := range s.ExtensionsCheck {
+			c.add(fmt.Sprintf("%v.snp.extensions[%v]", path, i), CategoryMeasurement, r,
+				ExtensionsCheck)
+		}
+	}
+	if s := m.SgxResult; s != nil {
+		c.add(path+".sgx.version", CategoryMeasurement, s.VersionMatch, MeasurementNoMatch)
+		c.add(path+".sgx.tcbInfo", CategoryMeasurement, s.TcbInfoCheck.Summary, VerifyTcbInfo)
+		c.add(path+".sgx.qeIdentity", CategoryMeasurement, s.QeIdentityCheck.Summary,
+			VerifyQEIdentityErr)
+	}
+	if s := m.TdxResult; s != nil {
+		c.add(path+".tdx.version", CategoryMeasurement, s.VersionMatch, MeasurementNoMatch)
+		c.add(path+".tdx.tcbInfo", CategoryMeasurement, s.TcbInfoCheck.Summary, VerifyTcbInfo)
+		c.add(path+".tdx.qeIdentity", CategoryMeasurement, s.QeIdentityCheck.Summary,
+			VerifyQEIdentityErr)
+	}
+	if s := m.AzureResult; s != nil {
+		c.add(path+".azure.runtimeData", CategoryMeasurement, s.RuntimeDataMatch,
+			MeasurementNoMatch)
+		c.add(path+".azure.akQuoteSignature", CategorySignature, s.AkQuoteSignature,
+			VerifySignature)
+	}
+	if s := m.GceResult; s != nil {
+		c.add(path+".gce.instanceInfo", CategoryMeasurement, s.InstanceInfoCheck, GceInstanceInfo)
+	}
+	if s := m.AzureVtpmResult; s != nil {
+		c.add(path+".azureVtpm.attestedDocument", CategoryMeasurement, s.AttestedDocumentCheck,
+			AttestedDocument)
+	}
+}
+
+func (c *Check) setCode(e ErrorCode) {
+	c.ErrorCode = e
+	c.Code = e.Name()
+}
+
+// evaluated returns whether the result was set during the verification. Results
+// of checks which were not performed, e.g. due to a previous error, are zero
+func evaluated(r Result) bool {
+	return r.Success || r.ErrorCode != NotSet || r.Got != "" || r.Expected != "" ||
+		len(r.ExpectedOneOf) > 0 || len(r.ExpectedBetween) > 0
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+// DryRunSummary describes the attestation report a report generation would
+// currently produce, without signing it
+type DryRunSummary struct {
+	Measurements []MeasurementSummary `json:"measurements"`
+	Metadata     []MetadataSummary    `json:"metadata"`
+	// Size of the unsigned report in bytes per serializer
+	Sizes    map[string]int `json:"sizes"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// MeasurementSummary describes a measurement of a dry-run. Substituted is set
+// if the driver substituted its evidence with a cached or zero quote
+type MeasurementSummary struct {
+	Type        string `json:"type"`
+	Size        int    `json:"size"`
+	Digest      string `json:"digest"`
+	Artifacts   int    `json:"artifacts"`
+	Certs       int    `json:"certs"`
+	Substituted bool   `json:"substituted,omitempty"`
+}
+
+// MetadataSummary describes a metadata item of a dry-run
+type MetadataSummary struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Size    int    `json:"size"`
+	Digest  string `json:"digest"`
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fuzzReport unmarshals and verifies the fuzzed token with the serializer.
+// Errors are expected, but without trusted roots the verification must fail
+func fuzzReport(t *testing.T, s Serializer, data []byte) {
+	payload, err := s.GetPayload(data)
+	if err == nil {
+		var report AttestationReport
+		_ = s.Unmarshal(payload, &report)
+	}
+	if _, _, ok := s.VerifyTokenAt(data, nil, time.Time{}); ok {
+		t.Errorf("VerifyTokenAt() succeeded without trusted roots")
+	}
+}
+
+// addReportSeeds adds the attestation reports of the fixtures, generated with
+// testtool fixtures, as seeds
+func addReportSeeds(f *testing.F, file string) {
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		f.Fatalf("failed to read seed: %v", err)
+	}
+	f.Add(data)
+	f.Add(data[:len(data)/2])
+	f.Add([]byte{})
+}
+
+func FuzzJsonReport(f *testing.F) {
+	addReportSeeds(f, "attestation-report.json")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReport(t, JsonSerializer{}, data)
+	})
+}
+
+func FuzzCborReport(f *testing.F) {
+	addReportSeeds(f, "attestation-report.cbor")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReport(t, CborSerializer{}, data)
+	})
+}
+
+func FuzzParseEventData(f *testing.F) {
+	names := []string{
+		"EV_EFI_VARIABLE_BOOT",
+		"EV_EFI_GPT_EVENT",
+		"EV_EFI_BOOT_SERVICES_APPLICATION",
+		"EV_EVENT_TAG",
+		"EV_EFI_PLATFORM_FIRMWARE_BLOB",
+		"EV_EFI_HANDOFF_TABLES",
+		"EV_IPL",
+	}
+	f.Add(uint8(0), []byte{})
+	f.Add(uint8(1), make([]byte, 92))
+	f.Add(uint8(2), make([]byte, 32))
+	f.Fuzz(func(t *testing.T, name uint8, data []byte) {
+		ParseEventData(data, names[int(name)%len(names)])
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"errors"
+	"strings"
+)
+
+// DeviceIdUriPrefix is the prefix of the URI SAN the provisioning server embeds
+// the verified device identifier with (see identitySan of the CSR policies).
+// For TPM attestation keys, the identifier is the serial number of the EK
+// certificate
+const DeviceIdUriPrefix = "urn:cmc:device:"
+
+// Identity is the identity of an attested peer extracted from its verification
+// result. Verified contains the fields backed by successfully validated
+// signatures and certificate chains, Asserted the fields the peer claimed in
+// evidence whose validation failed
+type Identity struct {
+	ReportId string         `json:"reportId,omitempty"`
+	Verified IdentityFields `json:"verified"`
+	Asserted IdentityFields `json:"asserted"`
+}
+
+// IdentityFields are the identifying fields of an attested peer
+type IdentityFields struct {
+	// Subject and SANs of the identity key (IK) certificate signing the report
+	Subject        *X509Name `json:"subject,omitempty"`
+	DnsNames       []string  `json:"dnsNames,omitempty"`
+	IpAddresses    []string  `json:"ipAddresses,omitempty"`
+	Uris           []string  `json:"uris,omitempty"`
+	EmailAddresses []string  `json:"emailAddresses,omitempty"`
+	// Name and roles of the device description
+	DeviceName string   `json:"deviceName,omitempty"`
+	Roles      []string `json:"roles,omitempty"`
+	// Hardware identifiers of the TPM and the SNP processor
+	EkSerial  string `json:"ekSerial,omitempty"`
+	SnpChipId string `json:"snpChipId,omitempty"`
+}
+
+// PeerIdentity extracts the identity of the peer from the verification result.
+// An error is returned if the result does not contain any identifying fields,
+// e.g. if the report could not be parsed
+func PeerIdentity(result *VerificationResult) (Identity, error) {
+	if result == nil {
+		return Identity{}, errors.New("no verification result")
+	}
+
+	id := Identity{ReportId: result.ReportId}
+
+	// The IK certificate signing the report
+	for _, s := range result.ReportSignature {
+		cert := leafCert(s)
+		if cert == nil {
+			continue
+		}
+		fields := id.fields(verified(s))
+		if fields.Subject == nil {
+			subject := cert.Subject
+			fields.Subject = &subject
+			fields.DnsNames = cert.DNSNames
+			fields.IpAddresses = cert.IPAddresses
+			fields.Uris = cert.URIs
+			fields.EmailAddresses = cert.EmailAddresses
+		}
+	}
+
+	// The device description is only verified if all its signatures are valid.
+	// Otherwise, the name the report was created for is asserted by the peer
+	dd := result.DevDescResult
+	switch {
+	case dd.Name != "":
+		ok := len(dd.SignatureCheck) > 0
+		for _, s := range dd.SignatureCheck {
+			ok = ok && verified(s)
+		}
+		fields := id.fields(ok)
+		fields.DeviceName = dd.Name
+		fields.Roles = dd.Roles
+	case result.Prover != "":
+		id.Asserted.DeviceName = result.Prover
+	}
+
+	// The hardware identifiers are certified by the hardware manufacturer or
+	// the provisioning server
+	for _, m := range result.Measurements {
+		fields := id.fields(verified(m.Signature))
+		if m.TpmResult != nil && fields.EkSerial == "" {
+			fields.EkSerial = deviceId(leafCert(m.Signature))
+		}
+		if m.SnpResult != nil && fields.SnpChipId == "" {
+			fields.SnpChipId = m.SnpResult.ChipId
+		}
+	}
+
+	if id.Verified.empty() && id.Asserted.empty() {
+		return id, errors.New("verification result does not contain an identity")
+	}
+	return id, nil
+}
+
+// fields returns the verified or the asserted fields
+func (id *Identity) fields(verified bool) *IdentityFields {
+	if verified {
+		return &id.Verified
+	}
+	return &id.Asserted
+}
+
+func (f *IdentityFields) empty() bool {
+	return f.Subject == nil && f.DeviceName == "" && f.EkSerial == "" && f.SnpChipId == ""
+}
+
+// verified returns whether the signature and the certificate chain are valid
+func verified(s SignatureResult) bool {
+	return s.SignCheck.Success && s.CertChainCheck.Success
+}
+
+// leafCert returns the leaf certificate of the first validated chain
+func leafCert(s SignatureResult) *X509CertExtracted {
+	if len(s.ValidatedCerts) == 0 || len(s.ValidatedCerts[0]) == 0 {
+		return nil
+	}
+	return &s.ValidatedCerts[0][0]
+}
+
+// deviceId returns the device identifier embedded into the certificate
+func deviceId(cert *X509CertExtracted) string {
+	if cert == nil {
+		return ""
+	}
+	for _, u := range cert.URIs {
+		if strings.HasPrefix(u, DeviceIdUriPrefix) {
+			return strings.TrimPrefix(u, DeviceIdUriPrefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPeerIdentity(t *testing.T) {
+
+	cert := func(cn string, uris ...string) X509CertExtracted {
+		return X509CertExtracted{
+			Subject:  X509Name{CommonName: cn, Organization: []string{"Test"}},
+			DNSNames: []string{"device.local"},
+			URIs:     uris,
+		}
+	}
+	sig := func(ok bool, c X509CertExtracted) SignatureResult {
+		return SignatureResult{
+			SignCheck:      Result{Success: true},
+			CertChainCheck: Result{Success: ok},
+			ValidatedCerts: [][]X509CertExtracted{{c}},
+		}
+	}
+	ik := cert("de.test.device IK")
+	ak := cert("de.test.device AK", DeviceIdUriPrefix+"4711")
+	devDesc := DevDescResult{
+		MetaInfo:       MetaInfo{Type: "Device Description", Name: "de.test.device"},
+		Roles:          []string{"gateway"},
+		SignatureCheck: []SignatureResult{sig(true, cert("Test Operator"))},
+	}
+	result := func(m ...MeasurementResult) *VerificationResult {
+		return &VerificationResult{
+			Prover:          "de.test.device",
+			ReportId:        "aabb",
+			Measurements:    m,
+			ReportSignature: []SignatureResult{sig(true, ik)},
+			MetadataResult:  MetadataResult{DevDescResult: devDesc},
+		}
+	}
+	verified := IdentityFields{
+		Subject:    &ik.Subject,
+		DnsNames:   []string{"device.local"},
+		DeviceName: "de.test.device",
+		Roles:      []string{"gateway"},
+	}
+	with := func(f IdentityFields, modify func(f *IdentityFields)) IdentityFields {
+		modify(&f)
+		return f
+	}
+
+	invalidIk := result(MeasurementResult{Type: "SW Result", Signature: sig(true, ik)})
+	invalidIk.ReportSignature = []SignatureResult{sig(false, ik)}
+	invalidDevDesc := result(MeasurementResult{Type: "SW Result", Signature: sig(true, ik)})
+	invalidDevDesc.DevDescResult.SignatureCheck = []SignatureResult{sig(false, cert("Test Operator"))}
+	noDevDesc := result(MeasurementResult{Type: "SW Result", Signature: sig(true, ik)})
+	noDevDesc.DevDescResult = DevDescResult{}
+
+	tests := []struct {
+		name         string
+		result       *VerificationResult
+		wantVerified IdentityFields
+		wantAsserted IdentityFields
+		wantErr      bool
+	}{
+		{"TPM", result(MeasurementResult{Type: "TPM Result", Signature: sig(true, ak),
+			TpmResult: &TpmResult{}}),
+			with(verified, func(f *IdentityFields) { f.EkSerial = "4711" }), IdentityFields{}, false},
+		{"TPM Invalid AK", result(MeasurementResult{Type: "TPM Result", Signature: sig(false, ak),
+			TpmResult: &TpmResult{}}),
+			verified, IdentityFields{EkSerial: "4711"}, false},
+		{"SNP", result(MeasurementResult{Type: "SNP Result", Signature: sig(true, cert("SEV-VCEK")),
+			SnpResult: &SnpResult{ChipId: "0a0b"}}),
+			with(verified, func(f *IdentityFields) { f.SnpChipId = "0a0b" }), IdentityFields{}, false},
+		{"Azure", result(
+			MeasurementResult{Type: "TPM Result", Signature: sig(true, cert("vTPM AK")),
+				TpmResult: &TpmResult{}},
+			MeasurementResult{Type: "Azure Result", Signature: sig(true, cert("SEV-VCEK")),
+				SnpResult: &SnpResult{ChipId: "0a0b"}, AzureResult: &AzureResult{}}),
+			with(verified, func(f *IdentityFields) { f.SnpChipId = "0a0b" }), IdentityFields{}, false},
+		{"SGX", result(MeasurementResult{Type: "SGX Result", Signature: sig(true, cert("PCK")),
+			SgxResult: &SgxResult{}}), verified, IdentityFields{}, false},
+		{"TDX", result(MeasurementResult{Type: "TDX Result", Signature: sig(true, cert("PCK")),
+			TdxResult: &TdxResult{}}), verified, IdentityFields{}, false},
+		{"SW", result(MeasurementResult{Type: "SW Result", Signature: sig(true, ik)}),
+			verified, IdentityFields{}, false},
+		{"EAT", &VerificationResult{
+			Measurements:   []MeasurementResult{{Type: "EAT Result", EatResult: &EatResult{}}},
+			MetadataResult: MetadataResult{DevDescResult: devDesc},
+		}, IdentityFields{DeviceName: "de.test.device", Roles: []string{"gateway"}},
+			IdentityFields{}, false},
+		{"Invalid IK", invalidIk,
+			IdentityFields{DeviceName: "de.test.device", Roles: []string{"gateway"}},
+			IdentityFields{Subject: &ik.Subject, DnsNames: []string{"device.local"}}, false},
+		{"Invalid Device Description", invalidDevDesc,
+			IdentityFields{Subject: &ik.Subject, DnsNames: []string{"device.local"}},
+			IdentityFields{DeviceName: "de.test.device", Roles: []string{"gateway"}}, false},
+		{"Unverified Device Description", noDevDesc,
+			IdentityFields{Subject: &ik.Subject, DnsNames: []string{"device.local"}},
+			IdentityFields{DeviceName: "de.test.device"}, false},
+		{"Parse Failure", &VerificationResult{ErrorCode: UnknownSerialization}, IdentityFields{},
+			IdentityFields{}, true},
+		{"Nil", nil, IdentityFields{}, IdentityFields{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PeerIdentity(tt.result)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PeerIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Verified, tt.wantVerified) {
+				t.Errorf("verified = %+v, want %+v", got.Verified, tt.wantVerified)
+			}
+			if !reflect.DeepEqual(got.Asserted, tt.wantAsserted) {
+				t.Errorf("asserted = %+v, want %+v", got.Asserted, tt.wantAsserted)
+			}
+			if got.ReportId != tt.result.ReportId {
+				t.Errorf("report ID = %v, want %v", got.ReportId, tt.result.ReportId)
+			}
+		})
+	}
+}
+
+// TestIdentityJson ensures that the JSON representation of the identity, which
+// is logged by the services, does not change unnoticed
+func TestIdentityJson(t *testing.T) {
+	id := Identity{
+		ReportId: "aabb",
+		Verified: IdentityFields{
+			Subject:    &X509Name{CommonName: "de.test.device IK"},
+			DnsNames:   []string{"device.local"},
+			DeviceName: "de.test.device",
+			Roles:      []string{"gateway"},
+			EkSerial:   "4711",
+		},
+		Asserted: IdentityFields{SnpChipId: "0a0b"},
+	}
+	want := `{"reportId":"aabb","verified":{"subject":{"commonName":"de.test.device IK"},` +
+		`"dnsNames":["device.local"],"deviceName":"de.test.device","roles":["gateway"],` +
+		`"ekSerial":"4711"},"asserted":{"snpChipId":"0a0b"}}`
+	got, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("Marshal() = %s, want %s", got, want)
+	}
+}
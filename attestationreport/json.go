@@ -19,9 +19,11 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
@@ -30,6 +32,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
 	"gopkg.in/square/go-jose.v2"
 )
@@ -66,6 +69,9 @@ type JsonSerializer struct{}
 
 func (s JsonSerializer) GetPayload(raw []byte) ([]byte, error) {
 	// Extract plain payload out of base64-encoded JSON Web Signature
+	if err := CheckJson(raw); err != nil {
+		return nil, fmt.Errorf("failed to parse jws object: %w", err)
+	}
 	jws, err := jose.ParseSigned(string(raw))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse jws object: %v", err)
@@ -79,8 +85,9 @@ func (s JsonSerializer) Marshal(v any) ([]byte, error) {
 	return json.Marshal(v)
 }
 
+// Unmarshal unmarshals the JSON data within the configured decoding limits
 func (s JsonSerializer) Unmarshal(data []byte, v any) error {
-	return json.Unmarshal(data, v)
+	return DecodeJson(data, v)
 }
 
 // Sign signs data with the specified driver 'signer' (to enale hardware-based signatures)
@@ -152,8 +159,53 @@ func (s JsonSerializer) Sign(data []byte, signer Driver) ([]byte, error) {
 	return []byte(msg), nil
 }
 
+// SignDetached signs the SHA-256 digest of the data like Sign, but with
+// detached content (RFC 7515 Appendix F): the payload of the JWS is empty
+func (s JsonSerializer) SignDetached(data []byte, signer Driver) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	signed, err := s.Sign(digest[:], signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var jws map[string]json.RawMessage
+	if err := json.Unmarshal(signed, &jws); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal jws object: %w", err)
+	}
+	jws["payload"] = json.RawMessage(`""`)
+
+	return json.Marshal(jws)
+}
+
+// VerifyDetached verifies the signatures and certificate chains of a JWS with
+// detached content over the SHA-256 digest of the data
+func (s JsonSerializer) VerifyDetached(sig, data []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
+	digest := sha256.Sum256(data)
+	result, _, ok := s.verifyToken(sig, digest[:], roots, at)
+	if !ok {
+		return result, nil, false
+	}
+	return result, data, true
+}
+
 // VerifyToken verifies signatures and certificate chains for JWS tokens
 func (s JsonSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (TokenResult, []byte, bool) {
+	return s.VerifyTokenAt(data, roots, time.Time{})
+}
+
+// VerifyTokenAt verifies signatures and certificate chains for JWS tokens with
+// the certificates validity checked at the given time
+func (s JsonSerializer) VerifyTokenAt(data []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
+	return s.verifyToken(data, nil, roots, at)
+}
+
+// verifyToken verifies the JWS token. If the detached content is specified, the
+// token must not contain a payload and the signatures are verified over the
+// detached content
+func (s JsonSerializer) verifyToken(data, detached []byte, roots []*x509.Certificate, at time.Time,
+) (TokenResult, []byte, bool) {
 
 	var rootpool *x509.CertPool
 	var err error
@@ -177,8 +229,16 @@ func (s JsonSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 	}
 
 	opts := x509.VerifyOptions{
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-		Roots:     rootpool,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		Roots:       rootpool,
+		CurrentTime: at,
+	}
+
+	if err := CheckJson(data); err != nil {
+		log.Warnf("Data exceeds decoding limits: %v", err)
+		result.Summary.Success = false
+		result.Summary.ErrorCode = ParseJSON
+		return result, nil, false
 	}
 
 	jwsData, err := jose.ParseSigned(string(data))
@@ -189,6 +249,13 @@ func (s JsonSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 		return result, nil, false
 	}
 
+	if detached != nil && len(jwsData.UnsafePayloadWithoutVerification()) > 0 {
+		log.Warnf("JWS with detached content contains a payload")
+		result.Summary.Success = false
+		result.Summary.ErrorCode = JWSPayload
+		return result, nil, false
+	}
+
 	if len(jwsData.Signatures) == 0 {
 		log.Warnf("JWS does not contain signatures")
 		result.Summary.Success = false
@@ -199,7 +266,9 @@ func (s JsonSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 	index := make([]int, len(jwsData.Signatures))
 	payloads := make([][]byte, len(jwsData.Signatures))
 	for i, sig := range jwsData.Signatures {
-		result.SignatureCheck = append(result.SignatureCheck, SignatureResult{})
+		result.SignatureCheck = append(result.SignatureCheck, SignatureResult{
+			Algorithm: sig.Protected.Algorithm,
+		})
 
 		certs, err := sig.Protected.Certificates(opts)
 		if err != nil {
@@ -211,17 +280,16 @@ func (s JsonSerializer) VerifyToken(data []byte, roots []*x509.Certificate) (Tok
 		}
 
 		//Store details from (all) validated certificate chain(s)
-		for _, chain := range certs {
-			chainExtracted := []X509CertExtracted{}
-			for _, cert := range chain {
-				chainExtracted = append(chainExtracted, ExtractX509Infos(cert))
-			}
-			result.SignatureCheck[i].ValidatedCerts = append(result.SignatureCheck[i].ValidatedCerts, chainExtracted)
-		}
+		result.SignatureCheck[i].AddValidatedChains(certs)
 
 		result.SignatureCheck[i].CertChainCheck.Success = true
 
-		index[i], _, payloads[i], err = jwsData.VerifyMulti(certs[0][0].PublicKey)
+		if detached != nil {
+			index[i], _, err = jwsData.DetachedVerifyMulti(detached, certs[0][0].PublicKey)
+			payloads[i] = detached
+		} else {
+			index[i], _, payloads[i], err = jwsData.VerifyMulti(certs[0][0].PublicKey)
+		}
 		if err == nil {
 			result.SignatureCheck[i].SignCheck.Success = true
 		} else {
@@ -277,6 +345,8 @@ func algFromKeyType(pub crypto.PublicKey) (jose.SignatureAlgorithm, error) {
 		default:
 			return jose.RS256, errors.New("failed to determine algorithm from key type: unknown elliptic curve")
 		}
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
 	default:
 		return jose.RS256, errors.New("failed to determine algorithm from key type: unknown key type")
 	}
@@ -305,6 +375,11 @@ func (hws *hwSigner) Algs() []jose.SignatureAlgorithm {
 // Implements the JOSE Opaque Signer Interface. This enables signing
 // with hardware-based keys (such as TPM-based keys)
 func (hws *hwSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	// Ed25519 signs the payload itself
+	if alg == jose.EdDSA {
+		return hws.signer.(crypto.Signer).Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
 	// EC-specific: key size in byte for later padding
 	var keySize int
 	// Determine hash / SignerOpts from algorithm
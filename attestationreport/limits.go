@@ -0,0 +1,199 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// DecodeLimits are the limits for decoding untrusted CBOR and JSON data, such
+// as attestation reports, metadata and API requests. Zero values select the
+// defaults. Verifiers processing huge IMA logs may have to raise the size and
+// the number of array elements
+type DecodeLimits struct {
+	MaxSize          int `json:"maxSize,omitempty"`
+	MaxArrayElements int `json:"maxArrayElements,omitempty"`
+	MaxMapPairs      int `json:"maxMapPairs,omitempty"`
+	MaxNestedLevels  int `json:"maxNestedLevels,omitempty"`
+}
+
+// DefaultDecodeLimits are the limits applied if no limits are configured
+var DefaultDecodeLimits = DecodeLimits{
+	MaxSize:          10 * 1024 * 1024,
+	MaxArrayElements: 131072,
+	MaxMapPairs:      16384,
+	MaxNestedLevels:  32,
+}
+
+var (
+	limitsMu    sync.RWMutex
+	limits      = DefaultDecodeLimits
+	cborDecMode = mustDecMode(DefaultDecodeLimits)
+)
+
+func mustDecMode(l DecodeLimits) cbor.DecMode {
+	dm, err := newDecMode(l)
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}
+
+func newDecMode(l DecodeLimits) (cbor.DecMode, error) {
+	return cbor.DecOptions{
+		MaxArrayElements: l.MaxArrayElements,
+		MaxMapPairs:      l.MaxMapPairs,
+		MaxNestedLevels:  l.MaxNestedLevels,
+	}.DecMode()
+}
+
+// SetDecodeLimits configures the limits for decoding CBOR and JSON data. Zero
+// values are replaced by the defaults
+func SetDecodeLimits(l DecodeLimits) error {
+	if l.MaxSize == 0 {
+		l.MaxSize = DefaultDecodeLimits.MaxSize
+	}
+	if l.MaxArrayElements == 0 {
+		l.MaxArrayElements = DefaultDecodeLimits.MaxArrayElements
+	}
+	if l.MaxMapPairs == 0 {
+		l.MaxMapPairs = DefaultDecodeLimits.MaxMapPairs
+	}
+	if l.MaxNestedLevels == 0 {
+		l.MaxNestedLevels = DefaultDecodeLimits.MaxNestedLevels
+	}
+	if l.MaxSize < 0 {
+		return fmt.Errorf("invalid maximum decoding size %v", l.MaxSize)
+	}
+	dm, err := newDecMode(l)
+	if err != nil {
+		return fmt.Errorf("invalid decoding limits: %w", err)
+	}
+
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limits = l
+	cborDecMode = dm
+	return nil
+}
+
+// GetDecodeLimits returns the configured decoding limits
+func GetDecodeLimits() DecodeLimits {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return limits
+}
+
+func getDecMode() (DecodeLimits, cbor.DecMode) {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return limits, cborDecMode
+}
+
+// CheckCbor checks that the CBOR data is well-formed and within the decoding
+// limits before it is handed to decoders without limits, e.g. for COSE
+func CheckCbor(data []byte) error {
+	l, dm := getDecMode()
+	if len(data) > l.MaxSize {
+		return fmt.Errorf("CBOR data size %v exceeds maximum size %v", len(data), l.MaxSize)
+	}
+	return dm.Valid(data)
+}
+
+// DecodeCbor unmarshals the CBOR data within the decoding limits
+func DecodeCbor(data []byte, v any) error {
+	l, dm := getDecMode()
+	if len(data) > l.MaxSize {
+		return fmt.Errorf("CBOR data size %v exceeds maximum size %v", len(data), l.MaxSize)
+	}
+	return dm.Unmarshal(data, v)
+}
+
+// CheckJson checks that the JSON data is within the decoding limits. The check
+// only scans the structure, the JSON syntax is checked by the decoder
+func CheckJson(data []byte) error {
+	return checkJson(data, GetDecodeLimits())
+}
+
+// DecodeJson unmarshals the JSON data within the decoding limits
+func DecodeJson(data []byte, v any) error {
+	if err := CheckJson(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func checkJson(data []byte, l DecodeLimits) error {
+	if len(data) > l.MaxSize {
+		return fmt.Errorf("JSON data size %v exceeds maximum size %v", len(data), l.MaxSize)
+	}
+
+	// The stack holds the open arrays and objects. Their elements are counted
+	// by the separators
+	type level struct {
+		object     bool
+		separators int
+	}
+	var stack []level
+	inString := false
+	escaped := false
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			if len(stack) >= l.MaxNestedLevels {
+				return fmt.Errorf("JSON data exceeds maximum nesting level %v", l.MaxNestedLevels)
+			}
+			stack = append(stack, level{object: c == '{'})
+		case '}', ']':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ',':
+			n := len(stack)
+			if n == 0 {
+				continue
+			}
+			stack[n-1].separators++
+			elements := stack[n-1].separators + 1
+			if stack[n-1].object && elements > l.MaxMapPairs {
+				return fmt.Errorf("JSON object exceeds maximum number of pairs %v", l.MaxMapPairs)
+			}
+			if !stack[n-1].object && elements > l.MaxArrayElements {
+				return fmt.Errorf("JSON array exceeds maximum number of elements %v",
+					l.MaxArrayElements)
+			}
+		}
+	}
+	return nil
+}
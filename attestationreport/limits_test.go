@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func Test_checkJson(t *testing.T) {
+	l := DecodeLimits{MaxSize: 1024, MaxArrayElements: 16, MaxMapPairs: 16, MaxNestedLevels: 4}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"Valid", `{"a":[1,2,3],"b":{"c":"d"}}`, false},
+		{"Max Nesting", `[[[[1]]]]`, false},
+		{"Nesting Exceeded", `[[[[[1]]]]]`, true},
+		{"Max Elements", "[" + strings.Repeat("1,", 15) + "1]", false},
+		{"Elements Exceeded", "[" + strings.Repeat("1,", 16) + "1]", true},
+		{"Pairs Exceeded", "{" + strings.Repeat(`"a":1,`, 16) + `"a":1}`, true},
+		{"Separators In Strings", `["` + strings.Repeat(",[{", 100) + `"]`, false},
+		{"Escaped Quote", `["\",[[[[[", 1]`, false},
+		{"Size Exceeded", `"` + strings.Repeat("a", 1024) + `"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkJson([]byte(tt.data), l); (err != nil) != tt.wantErr {
+				t.Errorf("checkJson() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetDecodeLimits(t *testing.T) {
+	t.Cleanup(func() {
+		if err := SetDecodeLimits(DefaultDecodeLimits); err != nil {
+			t.Errorf("failed to restore default decoding limits: %v", err)
+		}
+	})
+
+	// An event log exceeding the default number of array elements
+	events := make([]int, DefaultDecodeLimits.MaxArrayElements+1)
+	data, err := cbor.Marshal(events)
+	if err != nil {
+		t.Fatalf("failed to marshal events: %v", err)
+	}
+	var decoded []int
+	if err := DecodeCbor(data, &decoded); err == nil {
+		t.Fatalf("DecodeCbor() of %v elements succeeded with default limits", len(events))
+	}
+	if err := CheckCbor(data); err == nil {
+		t.Fatalf("CheckCbor() of %v elements succeeded with default limits", len(events))
+	}
+
+	err = SetDecodeLimits(DecodeLimits{MaxArrayElements: 2 * len(events)})
+	if err != nil {
+		t.Fatalf("SetDecodeLimits() error = %v", err)
+	}
+	if err := DecodeCbor(data, &decoded); err != nil {
+		t.Fatalf("DecodeCbor() with raised limits error = %v", err)
+	}
+	if l := GetDecodeLimits(); l.MaxSize != DefaultDecodeLimits.MaxSize ||
+		l.MaxNestedLevels != DefaultDecodeLimits.MaxNestedLevels {
+		t.Errorf("GetDecodeLimits() = %+v, want defaults for unset limits", l)
+	}
+
+	jsonData := []byte("[" + strings.Repeat("0,", len(events)-1) + "0]")
+	if err := DecodeJson(jsonData, &decoded); err != nil {
+		t.Fatalf("DecodeJson() with raised limits error = %v", err)
+	}
+
+	for _, l := range []DecodeLimits{{MaxNestedLevels: 1000}, {MaxArrayElements: 1}, {MaxSize: -1}} {
+		if err := SetDecodeLimits(l); err == nil {
+			t.Errorf("SetDecodeLimits(%+v) succeeded", l)
+		}
+	}
+}
+
+func fuzzSeeds(f *testing.F, s Serializer) {
+	report := AttestationReport{
+		Type:       "Attestation Report",
+		OsManifest: []byte("os"),
+		Measurements: []Measurement{{Type: "TPM Measurement", Evidence: []byte{1},
+			Artifacts: []Artifact{{Type: "PCR Eventlog", Pcr: new(int),
+				Events: []MeasureEvent{{Sha256: []byte{2}, EventName: "ev"}}}}}},
+	}
+	data, err := s.Marshal(report)
+	if err != nil {
+		f.Fatalf("failed to marshal report: %v", err)
+	}
+	f.Add(data)
+	f.Add(bytes.Repeat([]byte{0x81}, 100))
+	f.Add([]byte(strings.Repeat("[", 100)))
+	f.Add([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+}
+
+func FuzzJsonUnmarshal(f *testing.F) {
+	s := JsonSerializer{}
+	fuzzSeeds(f, s)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var report AttestationReport
+		s.Unmarshal(data, &report)
+		s.GetPayload(data)
+		s.VerifyToken(data, nil)
+	})
+}
+
+func FuzzCborUnmarshal(f *testing.F) {
+	s := CborSerializer{}
+	fuzzSeeds(f, s)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var report AttestationReport
+		s.Unmarshal(data, &report)
+		s.GetPayload(data)
+		s.VerifyToken(data, []*x509.Certificate{{}})
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ErrSerializerNotAllowed is returned for objects in another serialization
+// format than the pinned serializer
+var ErrSerializerNotAllowed = errors.New("serializer not allowed")
+
+var (
+	pinMu sync.RWMutex
+	pin   string
+)
+
+// SetSerializerPin pins the serializer ("json" or "cbor") all metadata and
+// attestation reports must be serialized with. An empty name disables pinning,
+// in which case the serialization is detected per object
+func SetSerializerPin(name string) error {
+	if err := ValidateSerializerPin(name); err != nil {
+		return err
+	}
+
+	pinMu.Lock()
+	defer pinMu.Unlock()
+	pin = name
+	return nil
+}
+
+// ValidateSerializerPin checks that the name is empty or a known serializer
+func ValidateSerializerPin(name string) error {
+	if name != "" && name != "json" && name != "cbor" {
+		return fmt.Errorf("unknown serializer %q (expected json or cbor)", name)
+	}
+	return nil
+}
+
+// GetSerializerPin returns the name of the pinned serializer or an empty
+// string if pinning is disabled
+func GetSerializerPin() string {
+	pinMu.RLock()
+	defer pinMu.RUnlock()
+	return pin
+}
+
+// PinnedSerializer returns the pinned serializer or nil if pinning is disabled
+func PinnedSerializer() Serializer {
+	switch GetSerializerPin() {
+	case "json":
+		return JsonSerializer{}
+	case "cbor":
+		return CborSerializer{}
+	default:
+		return nil
+	}
+}
+
+// CheckSerializer returns ErrSerializerNotAllowed if a serializer is pinned
+// and s is a different serializer
+func CheckSerializer(s Serializer) error {
+	p := GetSerializerPin()
+	if p == "" || SerializerName(s) == p {
+		return nil
+	}
+	return fmt.Errorf("%w: got %v, pinned %v", ErrSerializerNotAllowed, SerializerName(s), p)
+}
+
+// DetectSerializer returns the serializer of the object. JSON is checked
+// first, as some JSON texts are also well-formed CBOR
+func DetectSerializer(data []byte) (Serializer, error) {
+	if json.Valid(data) {
+		return JsonSerializer{}, nil
+	}
+	if err := cbor.Valid(data); err == nil {
+		return CborSerializer{}, nil
+	}
+	return nil, errors.New("unknown serialization format")
+}
+
+// SerializerName returns the configuration name of the serializer
+func SerializerName(s Serializer) string {
+	switch s.(type) {
+	case JsonSerializer, *JsonSerializer:
+		return "json"
+	case CborSerializer, *CborSerializer:
+		return "cbor"
+	default:
+		return fmt.Sprintf("%T", s)
+	}
+}
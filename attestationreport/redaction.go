@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"crypto/sha256"
+)
+
+// RedactionConfig configures the redaction of event names, e.g., of the file
+// paths of the IMA events. The names starting with one of the prefixes are
+// replaced by their salted sha256 digest
+type RedactionConfig struct {
+	Prefixes []string `json:"prefixes"`
+	// Optional source of the salt (env:<VARIABLE> or file:<PATH>). If not
+	// specified, a random salt is generated for each report
+	Salt string `json:"salt,omitempty"`
+	// Whether the salt is included in the report. Otherwise, the salt must be
+	// provided to authorized verifiers out of band
+	DiscloseSalt bool `json:"discloseSalt,omitempty"`
+}
+
+// Redaction describes the redaction of the event names of an artifact. The
+// salt is only present if it is disclosed, the salt ID identifies the salt
+// for verifiers holding it
+type Redaction struct {
+	Prefixes []string `json:"prefixes" cbor:"0,keyasint"`
+	Salt     HexByte  `json:"salt,omitempty" cbor:"1,keyasint,omitempty"`
+	SaltId   HexByte  `json:"saltId" cbor:"2,keyasint"`
+}
+
+// RedactName returns the salted sha256 digest of the event name
+func RedactName(salt []byte, name string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(name))
+	return h.Sum(nil)
+}
+
+// SaltId returns the identifier of a redaction salt, which does not disclose
+// the salt
+func SaltId(salt []byte) []byte {
+	h := sha256.Sum256(append([]byte("cmc redaction salt"), salt...))
+	return h[:]
+}
@@ -16,28 +16,61 @@
 package attestationreport
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"math/big"
 	"strings"
 	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"golang.org/x/exp/slices"
 )
 
 // VerificationResult represents the results of all steps taken during
 // the validation of an attestation report.
 type VerificationResult struct {
 	Type            string              `json:"type"`
+	Version         int                 `json:"version"` // Version of the result format, see ResultVersion
 	Success         bool                `json:"raSuccessful"`
 	ErrorCode       ErrorCode           `json:"errorCode,omitempty"` // Set in case of global errors
 	Prover          string              `json:"prover,omitempty"`    // Name of the proving device the report was created for
+	ReportId        string              `json:"reportId,omitempty"`  // Hex encoded SHA256 digest of the attestation report
 	Created         string              `json:"created,omitempty"`   // Timestamp the attestation verification was completed
 	SwCertLevel     int                 `json:"swCertLevel"`         // Overall certification level for the software stack
 	Measurements    []MeasurementResult `json:"measurements"`
 	ReportSignature []SignatureResult   `json:"reportSignatureCheck"` // Result for validation of the overall report signature
 	MetadataResult
-	PolicySuccess bool `json:"policySuccess,omitempty"` // Result of custom policy validation (if utilized)
+	PolicySuccess bool      `json:"policySuccess,omitempty"` // Result of custom policy validation (if utilized)
+	Findings      []Finding `json:"findings,omitempty"`      // Findings of the appraisal of the algorithms and key sizes
+	// Detailed result of the custom policy validation, only if policies were specified
+	PolicyResult *PolicyResult `json:"policyResult,omitempty"`
+	// Digests of the cached metadata items of the report the verifier does not hold
+	MissingMetadata []string `json:"missingMetadata,omitempty"`
+	// Flat list of the checks of all verified artifacts, the success of the
+	// verification is derived from these checks
+	Checks []Check `json:"checks,omitempty"`
+}
+
+// Severity is the severity of a finding. Findings with severity error fail
+// the verification, findings with severity warning are only reported
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Finding represents a violation of the appraisal baseline for the accepted
+// algorithms and key sizes of the evidence
+type Finding struct {
+	Severity    Severity  `json:"severity"`
+	ErrorCode   ErrorCode `json:"errorCode"`
+	Rule        string    `json:"rule"`               // The violated rule of the baseline
+	Description string    `json:"description"`        // The evidence element, e.g. the report signature
+	Got         string    `json:"got"`                // The algorithm or key size of the evidence
+	Expected    string    `json:"expected,omitempty"` // The allowed algorithms or minimum key size
 }
 
 type MetadataResult struct {
@@ -74,6 +107,7 @@ type DevDescResult struct {
 	MetaInfo
 	Description         string            `json:"description"`
 	Location            string            `json:"location"`
+	Roles               []string          `json:"roles,omitempty"`
 	Summary             Result            `json:"result"`
 	CorrectRtm          Result            `json:"correctRtm"`
 	CorrectOs           Result            `json:"correctOs"`
@@ -92,28 +126,106 @@ type AppDescResult struct {
 }
 
 type MeasurementResult struct {
-	Type      string          `json:"type"`
-	Summary   Result          `json:"summary"`
-	Freshness Result          `json:"freshness"`
-	Signature SignatureResult `json:"signature"`
-	Artifacts []DigestResult  `json:"artifacts"`
-	TpmResult *TpmResult      `json:"tpmResult,omitempty"`
-	SnpResult *SnpResult      `json:"snpResult,omitempty"`
-	SgxResult *SgxResult      `json:"sgxResult,omitempty"`
-	TdxResult *TdxResult      `json:"tdxResult,omitempty"`
+	Type            string           `json:"type"`
+	Summary         Result           `json:"summary"`
+	Freshness       Result           `json:"freshness"`
+	Signature       SignatureResult  `json:"signature"`
+	Artifacts       []DigestResult   `json:"artifacts"`
+	TpmResult       *TpmResult       `json:"tpmResult,omitempty"`
+	SnpResult       *SnpResult       `json:"snpResult,omitempty"`
+	SgxResult       *SgxResult       `json:"sgxResult,omitempty"`
+	TdxResult       *TdxResult       `json:"tdxResult,omitempty"`
+	AzureResult     *AzureResult     `json:"azureResult,omitempty"`
+	GceResult       *GceResult       `json:"gceResult,omitempty"`
+	AzureVtpmResult *AzureVtpmResult `json:"azureVtpmResult,omitempty"`
+	EatResult       *EatResult       `json:"eatResult,omitempty"`
+	// Runtime measurements recorded via the measure API for evaluation by the policies
+	RuntimeResult *RuntimeResult `json:"runtimeResult,omitempty"`
+}
+
+// RuntimeResult contains the runtime measurements of the report in the order
+// they were recorded
+type RuntimeResult struct {
+	Events []RuntimeEvent `json:"events"`
+}
+
+// EatResult contains the claims of an Entity Attestation Token (EAT) of an
+// attester other than the CMC. Claims which are not mapped to the measurement
+// results are passed through to the policies with their claim keys as names
+// and byte strings hex encoded
+type EatResult struct {
+	Profile string                 `json:"profile,omitempty"`
+	Ueid    string                 `json:"ueid,omitempty"`
+	Claims  map[string]interface{} `json:"claims,omitempty"`
 }
 
 type TpmResult struct {
-	PcrMatch         []DigestResult `json:"pcrMatch"`
-	AggPcrQuoteMatch Result         `json:"aggPcrQuoteMatch"`
+	PcrMatch         []DigestResult    `json:"pcrMatch"`
+	AggPcrQuoteMatch Result            `json:"aggPcrQuoteMatch"`
+	SessionAudit     *Result           `json:"sessionAudit,omitempty"`
+	Redactions       []RedactionResult `json:"redactions,omitempty"`
+}
+
+// RedactionResult contains the result of the resolution of the redacted event
+// names of a PCR. Without the salt, the verifier cannot resolve the names, so
+// that the names of the events cannot be reported (reduced assurance)
+type RedactionResult struct {
+	Pcr              int      `json:"pcr"`
+	Prefixes         []string `json:"prefixes"`
+	SaltDisclosed    bool     `json:"saltDisclosed"`
+	SaltKnown        bool     `json:"saltKnown"`
+	Redacted         int      `json:"redacted"` // Number of redacted events
+	Resolved         int      `json:"resolved"` // Number of redacted events matched to a name
+	ReducedAssurance bool     `json:"reducedAssurance"`
+}
+
+// AzureResult contains the results of the binding between the SNP report
+// and the vTPM quote of an Azure confidential VM
+type AzureResult struct {
+	RuntimeDataMatch Result `json:"runtimeDataMatch"`
+	AkQuoteSignature Result `json:"akQuoteSignature"`
+}
+
+// GceResult contains the identity of a GCE VM as certified by Google in the
+// vTPM AK certificate. Project number and instance ID are provided as strings,
+// as they might exceed the integer precision of policy engines
+type GceResult struct {
+	InstanceInfoCheck Result `json:"instanceInfoCheck"`
+	Zone              string `json:"zone,omitempty"`
+	ProjectNumber     string `json:"projectNumber,omitempty"`
+	ProjectId         string `json:"projectId,omitempty"`
+	InstanceId        string `json:"instanceId,omitempty"`
+	InstanceName      string `json:"instanceName,omitempty"`
+	SecurityVersion   int64  `json:"securityVersion"`
+	IsProduction      bool   `json:"isProduction"`
+}
+
+// AzureVtpmResult contains the result of the verification of the attested
+// document of the Azure instance metadata service and the VM identity it
+// contains. The document is valid between CreatedOn and ExpiresOn
+type AzureVtpmResult struct {
+	AttestedDocumentCheck Result                `json:"attestedDocumentCheck"`
+	DocumentCerts         [][]X509CertExtracted `json:"documentCerts,omitempty"`
+	VmId                  string                `json:"vmId,omitempty"`
+	SubscriptionId        string                `json:"subscriptionId,omitempty"`
+	Sku                   string                `json:"sku,omitempty"`
+	LicenseType           string                `json:"licenseType,omitempty"`
+	PlanName              string                `json:"planName,omitempty"`
+	PlanProduct           string                `json:"planProduct,omitempty"`
+	PlanPublisher         string                `json:"planPublisher,omitempty"`
+	CreatedOn             time.Time             `json:"createdOn"`
+	ExpiresOn             time.Time             `json:"expiresOn"`
 }
 
 type SnpResult struct {
-	VersionMatch    Result       `json:"reportVersionMatch"`
-	FwCheck         VersionCheck `json:"fwCheck"`
-	TcbCheck        TcbCheck     `json:"tcbCheck"`
-	PolicyCheck     PolicyCheck  `json:"policyCheck"`
-	ExtensionsCheck []Result     `json:"extensionsCheck"`
+	VersionMatch    Result        `json:"reportVersionMatch"`
+	FwCheck         VersionCheck  `json:"fwCheck"`
+	TcbCheck        TcbCheck      `json:"tcbCheck"`
+	PolicyCheck     PolicyCheck   `json:"policyCheck"`
+	IdBlockCheck    *IdBlockCheck `json:"idBlockCheck,omitempty"`
+	ExtensionsCheck []Result      `json:"extensionsCheck"`
+	CertSource      string        `json:"certSource,omitempty"`
+	ChipId          string        `json:"chipId,omitempty"`
 }
 
 type SgxResult struct {
@@ -143,6 +255,7 @@ type DigestResult struct {
 	Type        string     `json:"type,omitempty"`        // On fail, indicates whether digest is reference or measurement
 	EventData   *EventData `json:"eventData,omitempty"`   // data that was included from bioseventlog
 	CtrData     *CtrData   `json:"ctrData,omitempty"`     // data that was included from container log
+	Redacted    bool       `json:"redacted,omitempty"`    // Indicates that the name was redacted by the prover
 }
 
 type VersionCheck struct {
@@ -165,6 +278,17 @@ type TcbCheck struct {
 	Ucode   VersionCheck `json:"ucode"`
 }
 
+// PolicyResult contains the decision of the custom policies. If the policies
+// could not be evaluated, e.g. due to a compilation error or a timeout, the
+// error code and message state the reason
+type PolicyResult struct {
+	Engine    string    `json:"engine"`
+	Success   bool      `json:"success"`
+	Reasons   []string  `json:"reasons,omitempty"` // Reasons for the rejection reported by the policies
+	Error     string    `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"errorCode,omitempty"`
+}
+
 type PolicyCheck struct {
 	Summary      Result       `json:"result"`
 	Abi          VersionCheck `json:"abi"`
@@ -174,6 +298,17 @@ type PolicyCheck struct {
 	SingleSocket BooleanMatch `json:"singleSocket"`
 }
 
+// IdBlockCheck contains the results of comparing the ID block and ID
+// authentication information of an SNP guest to the reference values. Optional
+// checks are only present if the reference value is specified
+type IdBlockCheck struct {
+	Summary         Result  `json:"result"`
+	IdKeyDigest     Result  `json:"idKeyDigest"`
+	AuthorKeyDigest *Result `json:"authorKeyDigest,omitempty"`
+	FamilyId        *Result `json:"familyId,omitempty"`
+	ImageId         *Result `json:"imageId,omitempty"`
+}
+
 type AttributesCheck struct {
 	Success  bool    `json:"success"`
 	Claimed  HexByte `json:"claimed"`
@@ -211,9 +346,31 @@ type TdAttributesCheck struct {
 // SignatureResults represents the results for validation of
 // a provided signature and the used certificates.
 type SignatureResult struct {
+	Algorithm      string                `json:"algorithm,omitempty"`   // The JWS or COSE signature algorithm
 	SignCheck      Result                `json:"signatureVerification"` // Result from checking the signature has been calculated with this certificate
 	CertChainCheck Result                `json:"certChainValidation"`   // Result from validatint the certification chain back to a shared root of trust
 	ValidatedCerts [][]X509CertExtracted `json:"validatedCerts"`        //Stripped information from validated x509 cert chain(s) for additional checks from the policies module
+	Roots          []string              `json:"roots,omitempty"`       // Hex encoded SHA256 fingerprints of the root CAs anchoring the validated chains
+}
+
+// AddValidatedChains stores the details of the validated certificate chains
+// and the fingerprints of the root CAs they end in, so that the trust anchor
+// is known if multiple root CAs were accepted
+func (s *SignatureResult) AddValidatedChains(chains [][]*x509.Certificate) {
+	for _, chain := range chains {
+		chainExtracted := []X509CertExtracted{}
+		for _, cert := range chain {
+			chainExtracted = append(chainExtracted, ExtractX509Infos(cert))
+		}
+		s.ValidatedCerts = append(s.ValidatedCerts, chainExtracted)
+		if len(chain) > 0 {
+			fingerprint := sha256.Sum256(chain[len(chain)-1].Raw)
+			root := hex.EncodeToString(fingerprint[:])
+			if !slices.Contains(s.Roots, root) {
+				s.Roots = append(s.Roots, root)
+			}
+		}
+	}
 }
 
 // X509CertExtracted represents a x509 certificate with attributes
@@ -416,6 +573,28 @@ const (
 	VerifyTcbInfo
 	ExtensionsCheck
 	PcrNotSpecified
+	PcrSelectionMismatch
+	SessionAuditMismatch
+	IdBlockNotPresent
+	GceInstanceInfo
+	NonceUnknown
+	NonceExpired
+	AlgorithmNotAllowed
+	KeySizeTooSmall
+	SerializerNotAllowed
+	MissingCacheEntry
+	NonceMismatch
+	AttestedDocument
+	PcrNoMatch
+	VerifyAppManifest
+	VerifyDeviceDescription
+	VerifyCompanyDescription
+	VerificationFailed
+	PolicyCompile
+	PolicyTimeout
+	PolicyUndefined
+	PolicyTrap
+	PolicyMemoryLimit
 )
 
 type Result struct {
@@ -641,6 +820,52 @@ func (e ErrorCode) String() string {
 		return fmt.Sprintf("%v (Verify TCB info error)", int(e))
 	case ExtensionsCheck:
 		return fmt.Sprintf("%v (Extensions check error)", int(e))
+	case PcrNotSpecified:
+		return fmt.Sprintf("%v (PCR not specified error)", int(e))
+	case PcrSelectionMismatch:
+		return fmt.Sprintf("%v (PCR selection mismatch error)", int(e))
+	case SessionAuditMismatch:
+		return fmt.Sprintf("%v (Session audit mismatch error)", int(e))
+	case IdBlockNotPresent:
+		return fmt.Sprintf("%v (ID block not present error)", int(e))
+	case GceInstanceInfo:
+		return fmt.Sprintf("%v (GCE instance info error)", int(e))
+	case NonceUnknown:
+		return fmt.Sprintf("%v (Nonce not issued by verifier error)", int(e))
+	case NonceExpired:
+		return fmt.Sprintf("%v (Nonce expired error)", int(e))
+	case AlgorithmNotAllowed:
+		return fmt.Sprintf("%v (Algorithm not allowed error)", int(e))
+	case KeySizeTooSmall:
+		return fmt.Sprintf("%v (Key size too small error)", int(e))
+	case SerializerNotAllowed:
+		return fmt.Sprintf("%v (Serializer not allowed error)", int(e))
+	case MissingCacheEntry:
+		return fmt.Sprintf("%v (Missing cache entry error)", int(e))
+	case NonceMismatch:
+		return fmt.Sprintf("%v (Nonce mismatch error)", int(e))
+	case AttestedDocument:
+		return fmt.Sprintf("%v (Attested document error)", int(e))
+	case PcrNoMatch:
+		return fmt.Sprintf("%v (PCR no match error)", int(e))
+	case VerifyAppManifest:
+		return fmt.Sprintf("%v (Verify app manifest error)", int(e))
+	case VerifyDeviceDescription:
+		return fmt.Sprintf("%v (Verify device description error)", int(e))
+	case VerifyCompanyDescription:
+		return fmt.Sprintf("%v (Verify company description error)", int(e))
+	case VerificationFailed:
+		return fmt.Sprintf("%v (Verification failed error)", int(e))
+	case PolicyCompile:
+		return fmt.Sprintf("%v (Policy compilation error)", int(e))
+	case PolicyTimeout:
+		return fmt.Sprintf("%v (Policy evaluation timeout error)", int(e))
+	case PolicyUndefined:
+		return fmt.Sprintf("%v (Policy decision undefined error)", int(e))
+	case PolicyTrap:
+		return fmt.Sprintf("%v (Policy module trap error)", int(e))
+	case PolicyMemoryLimit:
+		return fmt.Sprintf("%v (Policy memory limit exceeded error)", int(e))
 	default:
 		return fmt.Sprintf("Unknown error code: %v", int(e))
 	}
@@ -713,6 +938,18 @@ func (r *VerificationResult) PrintErr() {
 			}
 			if m.SnpResult != nil {
 				m.SnpResult.VersionMatch.PrintErr("Version match")
+				if c := m.SnpResult.IdBlockCheck; c != nil {
+					c.IdKeyDigest.PrintErr("SNP ID key digest")
+					if c.AuthorKeyDigest != nil {
+						c.AuthorKeyDigest.PrintErr("SNP author key digest")
+					}
+					if c.FamilyId != nil {
+						c.FamilyId.PrintErr("SNP family ID")
+					}
+					if c.ImageId != nil {
+						c.ImageId.PrintErr("SNP image ID")
+					}
+				}
 				// TODO
 				log.Warnf("Detailed SNP evaluation not yet implemented")
 			}
@@ -776,6 +1013,14 @@ func (r *VerificationResult) PrintErr() {
 
 		if !r.PolicySuccess {
 			log.Warnf("Custom policy validation failed")
+			if r.PolicyResult != nil {
+				for _, reason := range r.PolicyResult.Reasons {
+					log.Warnf("\tPolicy: %v", reason)
+				}
+				if r.PolicyResult.Error != "" {
+					log.Warnf("\tPolicy error: %v", r.PolicyResult.Error)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,316 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestationreport
+
+import (
+	"bytes"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// goldenResult returns a verification result with all commonly used fields
+// set, whose serialization is fixed by the golden files
+func goldenResult() VerificationResult {
+	pcr := 10
+	cert := X509CertExtracted{
+		Version:      3,
+		SerialNumber: big.NewInt(4711),
+		Issuer:       X509Name{Country: []string{"DE"}, CommonName: "Test Device CA"},
+		Subject:      X509Name{Country: []string{"DE"}, CommonName: "Test AK"},
+		Validity: Validity{
+			NotBefore: "2026-01-01T00:00:00Z",
+			NotAfter:  "2027-01-01T00:00:00Z",
+		},
+		KeyUsage:           []string{"Digital Signature"},
+		SignatureAlgorithm: "ECDSA-SHA256",
+		PublicKeyAlgorithm: "ECDSA",
+		PublicKey:          "04aabbcc",
+		Extensions: []PkixExtension{
+			{Id: "2.5.29.15", Critical: true, Value: []byte{0x03, 0x02, 0x07, 0x80}},
+		},
+	}
+	sig := SignatureResult{
+		SignCheck:      Result{Success: true},
+		CertChainCheck: Result{Success: true},
+		ValidatedCerts: [][]X509CertExtracted{{cert}},
+	}
+	manifest := func(typ, name string) ManifestResult {
+		return ManifestResult{
+			MetaInfo:       MetaInfo{Type: typ, Name: name, Version: "2026-01-01T00:00:00Z"},
+			Summary:        Result{Success: true},
+			SignatureCheck: []SignatureResult{sig},
+			ValidityCheck: Result{Success: true,
+				ExpectedBetween: []string{"2026-01-01T00:00:00Z", "2027-01-01T00:00:00Z"}},
+		}
+	}
+
+	r := VerificationResult{
+		Type:        "Verification Result",
+		Success:     false,
+		ErrorCode:   VerifyPolicies,
+		Prover:      "de.test.device",
+		Created:     "2026-06-01T12:00:00Z",
+		SwCertLevel: 3,
+		Measurements: []MeasurementResult{{
+			Type:      "TPM Result",
+			Summary:   Result{Success: true},
+			Freshness: Result{Success: true, Got: "0102030405060708"},
+			Signature: sig,
+			Artifacts: []DigestResult{
+				{Pcr: &pcr, Name: "de.test.app1/bin/app", Digest: "aa01", Success: true},
+				{Pcr: &pcr, Digest: "bb02", Success: false, Type: "Measurement"},
+			},
+			TpmResult: &TpmResult{
+				PcrMatch:         []DigestResult{{Pcr: &pcr, Digest: "cc03", Success: true}},
+				AggPcrQuoteMatch: Result{Success: true},
+			},
+		}},
+		ReportSignature: []SignatureResult{sig},
+		MetadataResult: MetadataResult{
+			RtmResult:  manifest("RTM Manifest", "de.test.rtm"),
+			OsResult:   manifest("OS Manifest", "de.test.os"),
+			AppResults: []ManifestResult{manifest("App Manifest", "de.test.app1")},
+			DevDescResult: DevDescResult{
+				MetaInfo:    MetaInfo{Type: "Device Description", Name: "de.test.device"},
+				Description: "Test device",
+				Location:    "Munich",
+				Summary:     Result{Success: true},
+				CorrectRtm:  Result{Success: true, Got: "de.test.rtm"},
+				CorrectOs:   Result{Success: true, Got: "de.test.os"},
+				CorrectApps: []Result{{Success: true, Got: "de.test.app1"}},
+				RtmOsCompatibility: Result{Success: true,
+					ExpectedOneOf: []string{"de.test.rtm"}, Got: "de.test.rtm"},
+				OsAppsCompatibility: []Result{{Success: true,
+					ExpectedOneOf: []string{"de.test.os"}, Got: "de.test.os"}},
+				AppResults: []AppDescResult{{
+					MetaInfo:    MetaInfo{Type: "App Description", Name: "de.test.app1.desc"},
+					AppManifest: "de.test.app1",
+				}},
+				SignatureCheck: []SignatureResult{sig},
+			},
+		},
+		PolicySuccess: false,
+	}
+	r.MetadataResult.OsResult.Details = map[string]interface{}{"vendor": "test"}
+	r.Summarize()
+	return r
+}
+
+// TestVerificationResultGolden ensures that the external representation of
+// the verification result, which is consumed by policies and remote verifiers,
+// does not change unnoticed. Run with -update to regenerate the golden files
+// after an intended change, which requires increasing the ResultVersion
+func TestVerificationResultGolden(t *testing.T) {
+	if ResultVersion != 2 {
+		t.Fatalf("ResultVersion = %v, regenerate the golden files", ResultVersion)
+	}
+
+	tests := []struct {
+		name string
+		s    Serializer
+		file string
+	}{
+		{"JSON", JsonSerializer{}, "verificationresult.json"},
+		{"CBOR", CborSerializer{}, "verificationresult.cbor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.s.Marshal(goldenResult())
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			file := filepath.Join("testdata", tt.file)
+			if *update {
+				if err := os.WriteFile(file, got, 0644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read golden file: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Marshal() = %s, want %s", got, want)
+			}
+		})
+	}
+
+	// The golden JSON must decode to the same result
+	data, err := os.ReadFile(filepath.Join("testdata", "verificationresult.json"))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	var r VerificationResult
+	if err := DecodeJson(data, &r); err != nil {
+		t.Fatalf("DecodeJson() error = %v", err)
+	}
+	if want := goldenResult(); !reflect.DeepEqual(r, want) {
+		t.Errorf("DecodeJson() = %+v, want %+v", r, want)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	pcr := 7
+	sig := SignatureResult{
+		SignCheck:      Result{Success: true},
+		CertChainCheck: Result{Success: true},
+		ValidatedCerts: [][]X509CertExtracted{{
+			{Subject: X509Name{CommonName: "Test IK"}},
+			{Subject: X509Name{CommonName: "Test CA"}},
+		}},
+	}
+	valid := func() VerificationResult {
+		return VerificationResult{
+			Success:         true,
+			ReportSignature: []SignatureResult{sig},
+			MetadataResult: MetadataResult{
+				RtmResult: ManifestResult{
+					MetaInfo:       MetaInfo{Name: "de.test.rtm"},
+					Summary:        Result{Success: true},
+					SignatureCheck: []SignatureResult{sig},
+					ValidityCheck:  Result{Success: true},
+				},
+			},
+			Measurements: []MeasurementResult{{
+				Summary:   Result{Success: true},
+				Freshness: Result{Success: true},
+				Signature: sig,
+				TpmResult: &TpmResult{
+					PcrMatch:         []DigestResult{{Pcr: &pcr, Digest: "aa", Success: true}},
+					AggPcrQuoteMatch: Result{Success: true},
+				},
+			}},
+			PolicySuccess: true,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		modify    func(r *VerificationResult)
+		want      bool
+		wantPath  string
+		wantCode  ErrorCode
+		wantValue string
+	}{
+		{"Success", func(r *VerificationResult) {}, true, "", NotSet, ""},
+		{"Unknown Serialization", func(r *VerificationResult) {
+			*r = VerificationResult{Success: false, ErrorCode: UnknownSerialization}
+		}, false, "report", UnknownSerialization, ""},
+		{"Broken Cert Chain", func(r *VerificationResult) {
+			r.ReportSignature[0] = SignatureResult{CertChainCheck: Result{ErrorCode: VerifyCertChain}}
+			r.ErrorCode = VerifyAR
+			r.Success = false
+		}, false, "reportSignature[0].certChain", VerifyCertChain, ""},
+		{"Stale Metadata", func(r *VerificationResult) {
+			r.RtmResult.ValidityCheck = Result{ErrorCode: Expired,
+				ExpectedBetween: []string{"2025-01-01", "2025-06-01"}, Got: "2026-01-01"}
+			r.RtmResult.Summary.Success = false
+			r.Success = false
+		}, false, "rtmManifest.validity", Expired, "2026-01-01"},
+		{"PCR Mismatch", func(r *VerificationResult) {
+			r.Measurements[0].TpmResult.PcrMatch[0] = DigestResult{Pcr: &pcr, Digest: "aa",
+				Description: "bb"}
+			r.Success = false
+		}, false, "measurements[0].pcr[7]", PcrNoMatch, "bb"},
+		{"Unknown Measurement", func(r *VerificationResult) {
+			r.Measurements[0].Artifacts = []DigestResult{{Pcr: &pcr, Digest: "cc",
+				Type: "Measurement"}}
+			r.Success = false
+		}, false, "measurements[0].artifacts[pcr=7][0]", MeasurementNoMatch, "cc"},
+		{"Policy Failure", func(r *VerificationResult) {
+			r.ErrorCode = VerifyPolicies
+			r.PolicySuccess = false
+			r.Success = false
+		}, false, "policies", VerifyPolicies, ""},
+		{"Baseline Violation", func(r *VerificationResult) {
+			r.Findings = []Finding{
+				{Severity: SeverityWarning, ErrorCode: KeySizeTooSmall, Got: "2048"},
+				{Severity: SeverityError, ErrorCode: AlgorithmNotAllowed, Got: "RS256"},
+			}
+			r.ErrorCode = AlgorithmNotAllowed
+			r.Success = false
+		}, false, "findings[1]", AlgorithmNotAllowed, "RS256"},
+		{"Failure Without Check", func(r *VerificationResult) {
+			r.Success = false
+		}, false, "report", VerificationFailed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(&r)
+			r.Summarize()
+
+			if r.Success != tt.want {
+				t.Fatalf("Success = %v, want %v", r.Success, tt.want)
+			}
+			if r.Version != ResultVersion {
+				t.Errorf("Version = %v, want %v", r.Version, ResultVersion)
+			}
+
+			var failed []Check
+			for _, c := range r.Checks {
+				if !c.Success {
+					failed = append(failed, c)
+				}
+				if !c.Success && (c.ErrorCode == NotSet || c.Code != c.ErrorCode.Name()) {
+					t.Errorf("failed check %v has invalid code %v (%v)", c.Path, c.ErrorCode,
+						c.Code)
+				}
+			}
+			if tt.want {
+				// Report signature, chain and two certificates, RTM manifest with
+				// summary, signature, chain, certificates and validity, measurement
+				// with summary, freshness, signature, chain, certificates, PCR and
+				// aggregated PCR
+				if len(r.Checks) != 18 {
+					t.Errorf("Summarize() returned %v checks, want 18: %+v", len(r.Checks),
+						r.Checks)
+				}
+				return
+			}
+			if len(failed) != 1 {
+				t.Fatalf("Summarize() returned failed checks %+v, want one", failed)
+			}
+			c := failed[0]
+			if c.Path != tt.wantPath || c.ErrorCode != tt.wantCode {
+				t.Errorf("failed check = %v (%v), want %v (%v)", c.Path, c.Code, tt.wantPath,
+					tt.wantCode.Name())
+			}
+			if c.Got != tt.wantValue {
+				t.Errorf("failed check got = %v, want %v", c.Got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestErrorCodeName(t *testing.T) {
+	for e := NotSet; e <= VerificationFailed; e++ {
+		if _, ok := errorCodeNames[e]; !ok || strings.HasPrefix(e.String(), "Unknown error code") {
+			t.Errorf("error code %v has no name", int(e))
+		}
+	}
+	if VerificationFailed.Name() != "VerificationFailed" || int(VerificationFailed) != 82 {
+		t.Errorf("error code VerificationFailed changed to %v (%v)", int(VerificationFailed),
+			VerificationFailed.Name())
+	}
+}
@@ -26,14 +26,13 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/sirupsen/logrus"
-
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	atls "github.com/Fraunhofer-AISEC/cmc/attestedtls"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
-var log = logrus.WithField("service", "ahttps")
+var log = internal.NewLogger(internal.SubsystemAttestedTls, "ahttps")
 
 // Wrapper for net/http Transport
 type Transport struct {
@@ -17,180 +17,309 @@ package attestedtls
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/sink"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
 )
 
 var id = "0000"
 
-var log = logrus.WithField("service", "atls")
+var log = internal.NewLogger(internal.SubsystemAttestedTls, "atls")
 
-func attestDialer(conn *tls.Conn, chbindings []byte, cc CmcConfig) error {
-	ch := make(chan error)
+func attestDialer(conn *tls.Conn, chbindings []byte, cc CmcConfig,
+) (*QuorumResult, *ar.VerificationResult, error) {
+	// Buffered, so that the sending goroutine terminates even if this function
+	// returns early, e.g. if the verification fails
+	ch := make(chan error, 1)
+	nonces := newNonces(chbindings, cc)
+
+	// The message to the listener starts with the attestation mode, followed
+	// by the attestation report if the dialer attests
+	msg := []byte{byte(cc.Attest)}
+
+	// optional: exchange the metadata held by the peers
+	var peerCached []string
+	if cc.PeerCache != nil {
+		var err error
+		peerCached, err = exchangePeerCache(conn, cc,
+			cc.Attest == Attest_Mutual || cc.Attest == Attest_Server)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	//optional: attest Client
 	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Client {
 		log.Debug("Attesting the Client")
 		// Obtain attestation report from local cmcd
-		resp, err := cc.CmcApi.obtainAR(cc, chbindings)
+		resp, err := obtainAR(cc, chbindings, peerCached)
 		if err != nil {
-			return fmt.Errorf("could not obtain dialer AR: %w", err)
+			return nil, nil, fmt.Errorf("could not obtain dialer AR: %w", err)
 		}
+		msg = append(msg, resp...)
 
-		// Send created attestation report to listener
 		log.Tracef("Dialer: sending attestation report length %v to listener %v",
 			len(resp), conn.RemoteAddr().String())
-
-		go func() {
-			err = Write(append([]byte{byte(cc.Attest)}, resp...), conn)
-			if err != nil {
-				ch <- fmt.Errorf("failed to send AR to listener: %w", err)
-			}
-			log.Trace("Finished asynchronous sending of attestation report to listener")
-			ch <- nil
-		}()
 	} else {
-		//if not sending attestation report, send the attestation mode
-		err := Write([]byte{byte(cc.Attest)}, conn)
-		if err != nil {
-			return fmt.Errorf("failed to send skip client Attestation: %w", err)
-		}
 		log.Debug("Skipping client-side attestation: no attestation report generation required")
 	}
 
+	// Send the message asynchronously to avoid blocking if both sides send at
+	// the same time
+	go func() {
+		err := writeMsg(msg, conn, maxMessageSize(cc), ioTimeout)
+		if err != nil {
+			ch <- fmt.Errorf("failed to send attestation message to listener: %w", err)
+			return
+		}
+		log.Trace("Finished asynchronous sending of attestation message to listener")
+		ch <- nil
+	}()
+
 	// Fetch attestation report from listener
-	report, err := readValue(conn, cc.Attest)
+	report, err := readValue(conn, cc.Attest, maxMessageSize(cc))
 	if err != nil {
-		return err
+		waitMismatch(err, ch)
+		return nil, nil, err
 	}
+	var quorum *QuorumResult
+	var result *ar.VerificationResult
 
 	//optional: Wait for attestation report from Server
 	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Server {
 		// Verify AR from listener with own channel bindings
 		log.Trace("Verifying attestation report from listener")
-		err = cc.CmcApi.verifyAR(chbindings, report, cc)
+		if err := checkNonce(nonces, chbindings, cc); err != nil {
+			return nil, nil, err
+		}
+		quorum, result, err = verifyCached(conn, chbindings, report, cc)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	} else {
 		log.Debug("Skipping client-side verification")
 	}
 
 	// Finally check if asynchronous sending succeeded
-	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Client {
-		err = <-ch
-		if err != nil {
-			return fmt.Errorf("failed to write asynchronously: %w", err)
-		}
+	err = <-ch
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write asynchronously: %w", err)
 	}
 
 	log.Trace("Attestation successful")
 
-	return nil
+	return quorum, result, nil
 }
 
-func attestListener(conn *tls.Conn, chbindings []byte, cc CmcConfig) error {
-	ch := make(chan error)
+func attestListener(conn *tls.Conn, chbindings []byte, cc CmcConfig,
+) (*QuorumResult, *ar.VerificationResult, error) {
+	// Buffered, so that the sending goroutine terminates even if this function
+	// returns early, e.g. if the verification fails
+	ch := make(chan error, 1)
+	nonces := newNonces(chbindings, cc)
+
+	// The message to the dialer starts with the attestation mode, followed by
+	// the attestation report if the listener attests
+	msg := []byte{byte(cc.Attest)}
+
+	// optional: exchange the metadata held by the peers
+	var peerCached []string
+	if cc.PeerCache != nil {
+		var err error
+		peerCached, err = exchangePeerCache(conn, cc,
+			cc.Attest == Attest_Mutual || cc.Attest == Attest_Client)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// optional: attest server
 	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Server {
 		// Obtain own attestation report from local cmcd
 		log.Trace("Listener: Fetching attestation report from cmcd")
-		resp, err := cc.CmcApi.obtainAR(cc, chbindings)
+		resp, err := obtainAR(cc, chbindings, peerCached)
 		if err != nil {
-			return fmt.Errorf("could not obtain listener attestation report: %w", err)
+			return nil, nil, fmt.Errorf("could not obtain listener attestation report: %w", err)
 		}
+		msg = append(msg, resp...)
 
-		// Send own attestation report to dialer. This is done asynchronously to
-		// avoid blocking if each side sends a large report at the same time
 		log.Tracef("Listener: Sending attestation report length %v to dialer %v",
 			len(resp), conn.RemoteAddr().String())
-
-		go func() {
-			err = Write(append([]byte{byte(cc.Attest)}, resp...), conn)
-			if err != nil {
-				ch <- fmt.Errorf("failed to send AR to dialer: %w", err)
-			}
-			ch <- nil
-			log.Trace("Finished asynchronous sending of attestation report to dialer")
-		}()
 	} else {
-		//if not sending attestation report, send the attestation mode
-		err := Write([]byte{byte(cc.Attest)}, conn)
-		if err != nil {
-			return fmt.Errorf("failed to send skip client Attestation: %w", err)
-		}
 		log.Debug("Skipping server-side attestation")
 	}
 
-	report, err := readValue(conn, cc.Attest)
+	// Send the message to the dialer. This is done asynchronously to avoid
+	// blocking if each side sends a large report at the same time
+	go func() {
+		err := writeMsg(msg, conn, maxMessageSize(cc), ioTimeout)
+		if err != nil {
+			ch <- fmt.Errorf("failed to send attestation message to dialer: %w", err)
+			return
+		}
+		log.Trace("Finished asynchronous sending of attestation message to dialer")
+		ch <- nil
+	}()
+
+	report, err := readValue(conn, cc.Attest, maxMessageSize(cc))
 	if err != nil {
-		return err
+		waitMismatch(err, ch)
+		return nil, nil, err
 	}
+	var quorum *QuorumResult
+	var result *ar.VerificationResult
 
 	// optional: Wait for attestation report from client
 	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Client {
 		// Verify AR from dialer with own channel bindings
 		log.Trace("Listener: Verifying attestation report from dialer...")
-		err = cc.CmcApi.verifyAR(chbindings, report, cc)
+		cc.ResultCb = publishResult(conn, report, cc)
+		if err := checkNonce(nonces, chbindings, cc); err != nil {
+			return nil, nil, err
+		}
+		quorum, result, err = verifyCached(conn, chbindings, report, cc)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	} else {
 		log.Debug("Skipping server-side verification")
 	}
 
 	// Finally check if asynchronous sending succeeded
-	if cc.Attest == Attest_Mutual || cc.Attest == Attest_Server {
-		err = <-ch
-		if err != nil {
-			return fmt.Errorf("failed to write asynchronously: %w", err)
-		}
+	err = <-ch
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write asynchronously: %w", err)
 	}
 
 	log.Trace("Attestation successful")
 
-	return nil
+	return quorum, result, nil
 }
 
-func readValue(conn *tls.Conn, selection AttestSelect) ([]byte, error) {
-	readvalue, err := Read(conn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+// waitMismatch waits for the own message to be sent on a mismatch of the
+// attestation modes, so that the peer receives the local mode and fails with
+// the mismatch instead of a closed connection
+func waitMismatch(err error, ch chan error) {
+	var mismatch *AttestModeMismatchError
+	if errors.As(err, &mismatch) {
+		<-ch
+	}
+}
+
+// maxMessageSize returns the configured maximum size of the messages
+// exchanged with the peer
+func maxMessageSize(cc CmcConfig) int {
+	if cc.MaxMessageSize > 0 {
+		return cc.MaxMessageSize
+	}
+	return maxMessageSizeDefault
+}
+
+// newNonces records the channel bindings as the nonce the peer has to answer
+// within the nonce TTL, unless the check is disabled
+func newNonces(chbindings []byte, cc CmcConfig) *verify.NonceStore {
+	ttl := cc.NonceTtl
+	if ttl < 0 {
+		return nil
+	}
+	if ttl == 0 {
+		ttl = nonceTtlDefault
+	}
+	nonces := verify.NewNonceStore(ttl, 1)
+	if err := nonces.Add(chbindings); err != nil {
+		log.Warnf("Failed to record channel bindings: %v", err)
 	}
+	return nonces
+}
 
-	selectionStr, err := selectionString(byte(selection))
+// checkNonce rejects the attestation report of the peer if it was received
+// after the nonce TTL. The failed result is passed to the result callback
+func checkNonce(nonces *verify.NonceStore, chbindings []byte, cc CmcConfig) error {
+	if nonces == nil {
+		return nil
+	}
+	err := nonces.CheckNonce(chbindings)
+	if err == nil {
+		return nil
+	}
+	if cc.ResultCb != nil {
+		result := verify.NonceFailure(err)
+		cc.ResultCb(&result)
+	}
+	return fmt.Errorf("attestation report rejected: %w", err)
+}
+
+// publishResult returns the result callback, which additionally forwards the
+// results to the result sink, if configured
+func publishResult(conn *tls.Conn, report []byte, cc CmcConfig) func(*ar.VerificationResult) {
+	s := cc.ResultSink
+	if s == nil && cc.Cmc != nil && len(cc.Cmc.Sinks) > 0 {
+		s = cc.Cmc.Sinks
+	}
+	if s == nil {
+		return cc.ResultCb
+	}
+	received := time.Now()
+	cb := cc.ResultCb
+	return func(result *ar.VerificationResult) {
+		s.Publish(sink.NewRecord("atls", conn.RemoteAddr().String(), report, received, result))
+		if cb != nil {
+			cb(result)
+		}
+	}
+}
+
+// AttestModeMismatchError is returned if the attestation mode of the peer
+// differs from the local attestation mode, e.g., if a dialer expecting mutual
+// attestation connects to a listener configured for listener-only attestation
+type AttestModeMismatchError struct {
+	Local  AttestSelect
+	Remote AttestSelect
+}
+
+func (e *AttestModeMismatchError) Error() string {
+	return fmt.Sprintf("mismatching attestation mode, local set to: [%v], while remote is set to: [%v]",
+		e.Local, e.Remote)
+}
+
+// readValue reads the message of the peer, which starts with the attestation
+// mode of the peer, and returns the remaining attestation report, if any. The
+// connection fails if the peer is configured for a different attestation mode
+func readValue(conn *tls.Conn, selection AttestSelect, maxSize int) ([]byte, error) {
+	readvalue, err := readMsg(conn, maxSize, ioTimeout)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// the first byte should always be the attestation mode
-	if readvalue[0] == byte(selection) {
-		log.Debugf("Matching attestation mode: [%v]", selectionStr)
-	} else {
-		reportByte := readvalue[0]
-		reportStr, err := selectionString(reportByte)
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf("mismatching attestation mode, local set to: [%v], while remote is set to: [%v]", selectionStr, reportStr)
+	if len(readvalue) == 0 {
+		return nil, errors.New("missing attestation mode")
+	}
+	if readvalue[0]&flagPeerCache != 0 {
+		return nil, errors.New("peer uses the peer cache, which is not enabled")
 	}
+	if err := checkMode(readvalue[0], selection); err != nil {
+		return nil, err
+	}
+	log.Debugf("Matching attestation mode: [%v]", selection)
 
 	return readvalue[1:], nil
 }
 
-func selectionString(selection byte) (string, error) {
-	switch selection {
-	case 0:
-		return "mutual", nil
-	case 1:
-		return "client", nil
-	case 2:
-		return "server", nil
-	case 3:
-		return "none", nil
-	default:
-		return "", fmt.Errorf("unknown attestation mode")
+// checkMode checks that the attestation mode of the peer matches the local
+// attestation mode
+func checkMode(mode byte, selection AttestSelect) error {
+	remote := AttestSelect(mode)
+	if remote > Attest_None {
+		return fmt.Errorf("unknown attestation mode %v of remote", mode)
 	}
+	if remote != selection {
+		return &AttestModeMismatchError{Local: selection, Remote: remote}
+	}
+	return nil
 }
@@ -0,0 +1,424 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/sirupsen/logrus"
+)
+
+// pipeListener accepts the server ends of in-memory pipes
+type pipeListener chan net.Conn
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	return <-l, nil
+}
+
+func (l pipeListener) Close() error {
+	return nil
+}
+
+func (l pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// BenchmarkHandshake measures the TLS handshake with mutual attestation over
+// an in-memory connection, using the library API with the fixtures as driver
+func BenchmarkHandshake(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
+
+	for _, s := range fixtures.Serializers {
+		f, err := fixtures.Generate(fixtures.Options{Serializer: s})
+		if err != nil {
+			b.Fatalf("failed to generate fixtures: %v", err)
+		}
+		c := &cmc.Cmc{Drivers: []ar.Driver{f}, Serializer: f.Serializer}
+		c.SetMetadata(f.Metadata)
+		cc := CmcConfig{
+			CmcApi: CmcApis[CmcApi_Lib],
+			Ca:     f.CaPem(),
+			Attest: Attest_Mutual,
+			Cmc:    c,
+		}
+
+		// The identity key does not contain a DNS name, the peer is
+		// authenticated through the attestation bound to the connection
+		cert := tls.Certificate{
+			Certificate: [][]byte{f.Ik.Cert().Raw},
+			PrivateKey:  f.Ik.Priv,
+		}
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+		conns := make(pipeListener, 1)
+		ln := Listener{Listener: conns, CmcConfig: cc, Config: serverConfig}
+
+		b.Run(f.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				client, server := net.Pipe()
+				errs := make(chan error, 1)
+				go func() {
+					conns <- tls.Server(server, serverConfig)
+					conn, err := ln.Accept()
+					if err == nil {
+						conn.Close()
+					}
+					errs <- err
+				}()
+
+				if err := dialPipe(client, clientConfig, cc); err != nil {
+					b.Fatalf("dialer failed: %v", err)
+				}
+				if err := <-errs; err != nil {
+					b.Fatalf("listener failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// dialPipe performs the client side of Dial on an established connection
+func dialPipe(c net.Conn, config *tls.Config, cc CmcConfig) error {
+	defer c.Close()
+	conn := tls.Client(c, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	cs := conn.ConnectionState()
+	chbindings, err := cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	if err != nil {
+		return err
+	}
+	_, _, err = attestDialer(conn, chbindings, cc)
+	return err
+}
+
+func TestNonceTtl(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		wantErr  bool
+		wantCode ar.ErrorCode
+	}{
+		{"Default", 0, false, ar.NotSet},
+		{"Disabled", -1, false, ar.NotSet},
+		// The report of the listener cannot be received within a nanosecond
+		{"Expired", time.Nanosecond, true, ar.NonceExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []*ar.VerificationResult
+			cc := *newLibConfig(f)
+			cc.NonceTtl = tt.ttl
+			cc.ResultCb = func(result *ar.VerificationResult) { results = append(results, result) }
+
+			conns := make(pipeListener, 1)
+			ln := Listener{Listener: conns, CmcConfig: *newLibConfig(f), Config: serverConfig}
+			client, server := net.Pipe()
+			errs := make(chan error, 1)
+			go func() {
+				conns <- tls.Server(server, serverConfig)
+				conn, err := ln.Accept()
+				if err == nil {
+					conn.Close()
+				}
+				errs <- err
+			}()
+
+			err := dialPipe(client, clientConfig, cc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialer error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// The listener may have finished before the dialer rejected its report
+			if lerr := <-errs; lerr != nil && !tt.wantErr {
+				t.Errorf("listener error = %v", lerr)
+			}
+			if len(results) != 1 {
+				t.Fatalf("got %v results, want 1", len(results))
+			}
+			if results[0].ErrorCode != tt.wantCode || results[0].Success == tt.wantErr {
+				t.Errorf("result = %v (%v), want code %v", results[0].Success,
+					results[0].ErrorCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestConnPeerIdentity(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	checkIdentity := func(side string, conn *Conn) {
+		id, err := conn.PeerIdentity()
+		if err != nil {
+			t.Fatalf("%v PeerIdentity() error = %v", side, err)
+		}
+		if id.Verified.DeviceName != fixtures.DeviceDescriptionName || id.ReportId == "" {
+			t.Errorf("%v peer identity = %+v, want verified device %v", side, id,
+				fixtures.DeviceDescriptionName)
+		}
+		if r := conn.Result(); r == nil || !r.Success {
+			t.Errorf("%v Result() = %v, want successful result", side, r)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		attest AttestSelect
+	}{
+		{"Mutual", Attest_Mutual},
+		{"Server", Attest_Server},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := *newLibConfig(f)
+			cc.Attest = tt.attest
+			conns := make(pipeListener, 1)
+			ln := Listener{Listener: conns, CmcConfig: cc, Config: serverConfig}
+			client, server := net.Pipe()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conns <- tls.Server(server, serverConfig)
+				conn, err := ln.Accept()
+				if err != nil {
+					t.Errorf("Accept() error = %v", err)
+				}
+				accepted <- conn
+			}()
+
+			conn := tls.Client(client, clientConfig)
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			cs := conn.ConnectionState()
+			chbindings, err := cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+			if err != nil {
+				t.Fatalf("failed to export channel bindings: %v", err)
+			}
+			_, result, err := attestDialer(conn, chbindings, cc)
+			if err != nil {
+				t.Fatalf("attestDialer() error = %v", err)
+			}
+			defer conn.Close()
+			checkIdentity("dialer", &Conn{Conn: conn, result: result})
+
+			// Without verifying the dialer, the listener returns the TLS
+			// connection
+			lconn := <-accepted
+			if lconn == nil {
+				return
+			}
+			defer lconn.Close()
+			atlsConn, ok := lconn.(*Conn)
+			if tt.attest == Attest_Server {
+				if ok {
+					t.Errorf("Accept() returned %T without verification of dialer", lconn)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Accept() returned %T, want *Conn", lconn)
+			}
+			checkIdentity("listener", atlsConn)
+		})
+	}
+}
+
+func TestAttestModes(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	modes := []AttestSelect{Attest_Mutual, Attest_Client, Attest_Server, Attest_None}
+	for _, dialerMode := range modes {
+		for _, listenerMode := range modes {
+			t.Run(dialerMode.String()+"-"+listenerMode.String(), func(t *testing.T) {
+				var dialerResults, listenerResults int
+				dc := *newLibConfig(f)
+				WithAttestMode(dialerMode)(&dc)
+				dc.ResultCb = func(*ar.VerificationResult) { dialerResults++ }
+				lc := *newLibConfig(f)
+				WithAttestMode(listenerMode)(&lc)
+				lc.ResultCb = func(*ar.VerificationResult) { listenerResults++ }
+
+				conns := make(pipeListener, 1)
+				ln := Listener{Listener: conns, CmcConfig: lc, Config: serverConfig}
+				client, server := net.Pipe()
+				errs := make(chan error, 1)
+				go func() {
+					conns <- tls.Server(server, serverConfig)
+					conn, err := ln.Accept()
+					if err == nil {
+						conn.Close()
+					}
+					errs <- err
+				}()
+
+				derr := dialPipe(client, clientConfig, dc)
+				lerr := <-errs
+
+				// Both sides must detect a mismatch of the attestation modes
+				if dialerMode != listenerMode {
+					var mismatch *AttestModeMismatchError
+					if !errors.As(derr, &mismatch) || mismatch.Local != dialerMode ||
+						mismatch.Remote != listenerMode {
+						t.Errorf("dialer error = %v, want mode mismatch", derr)
+					}
+					if !errors.As(lerr, &mismatch) || mismatch.Local != listenerMode ||
+						mismatch.Remote != dialerMode {
+						t.Errorf("listener error = %v, want mode mismatch", lerr)
+					}
+					if dialerResults != 0 || listenerResults != 0 {
+						t.Errorf("verified %v reports on mismatch", dialerResults+listenerResults)
+					}
+					return
+				}
+				if derr != nil || lerr != nil {
+					t.Fatalf("dialer error = %v, listener error = %v", derr, lerr)
+				}
+
+				// Only the side expecting the report of the peer verifies it
+				wantDialer := dialerMode == Attest_Mutual || dialerMode == Attest_Server
+				wantListener := dialerMode == Attest_Mutual || dialerMode == Attest_Client
+				if (dialerResults == 1) != wantDialer || (listenerResults == 1) != wantListener {
+					t.Errorf("dialer verified %v, listener verified %v reports", dialerResults,
+						listenerResults)
+				}
+			})
+		}
+	}
+}
+
+func TestGetAttestMode(t *testing.T) {
+	for _, mode := range []AttestSelect{Attest_Mutual, Attest_Client, Attest_Server, Attest_None} {
+		if got := GetAttestMode(mode.String()); got != mode {
+			t.Errorf("GetAttestMode(%v) = %v", mode.String(), got)
+		}
+	}
+	if got := GetAttestMode("invalid"); got != attestDefault {
+		t.Errorf("GetAttestMode(invalid) = %v, want %v", got, attestDefault)
+	}
+}
+
+// testCmcApi performs an attested TLS handshake with mutual attestation, in
+// which both sides use the CMC API of the configuration, including the TLS
+// certificate and key of the listener. The stalled configuration points to a
+// cmcd which never answers and must fail with a CmcUnavailableError
+func testCmcApi(t *testing.T, cc, stalled CmcConfig) {
+	cert, err := GetCert(WithCmcConfig(&cc))
+	if err != nil {
+		t.Fatalf("GetCert() error = %v", err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	var results []*ar.VerificationResult
+	cc.ResultCb = func(r *ar.VerificationResult) { results = append(results, r) }
+	conns := make(pipeListener, 1)
+	ln := Listener{Listener: conns, CmcConfig: cc, Config: serverConfig}
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		conns <- tls.Server(server, serverConfig)
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		errs <- err
+	}()
+	if err := dialPipe(client, clientConfig, cc); err != nil {
+		t.Fatalf("dialer failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("listener failed: %v", err)
+	}
+	if len(results) != 2 || !results[0].Success || !results[1].Success {
+		t.Errorf("got %v results, want two successful results", len(results))
+	}
+
+	// A failed verification is reported with the result
+	results = nil
+	other, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	untrusted := cc
+	untrusted.Ca = other.CaPem()
+	report, err := obtainAR(cc, []byte("nonce"), nil)
+	if err != nil {
+		t.Fatalf("obtainAR() error = %v", err)
+	}
+	if err := verifyAR([]byte("nonce"), report, untrusted); err == nil {
+		t.Errorf("verifyAR() succeeded with untrusted CA")
+	}
+	if len(results) != 1 || results[0].Success {
+		t.Errorf("got %v results, want one failed result", len(results))
+	}
+
+	start := time.Now()
+	_, err = obtainAR(stalled, []byte("nonce"), nil)
+	if !errors.Is(err, ErrCmcUnavailable) {
+		t.Errorf("obtainAR() of stalled cmcd error = %v, want %v", err, ErrCmcUnavailable)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("obtainAR() of stalled cmcd returned after %v", d)
+	}
+}
@@ -16,87 +16,94 @@
 package attestedtls
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"time"
 )
 
+const (
+	// The default maximum size of the messages exchanged between the peers
+	maxMessageSizeDefault = 32 * 1024 * 1024
+	// The time the peer has to send or receive a message, which includes the
+	// generation of its attestation report
+	ioTimeout = 2 * time.Minute
+)
+
 // Writes byte array to provided channel by first sending length information, then data.
 // Used for transmitting the attestation reports between peers
 func Write(msg []byte, c net.Conn) error {
+	return writeMsg(msg, c, maxMessageSizeDefault, ioTimeout)
+}
 
-	length := len(msg)
-	lenbuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenbuf, uint32(length))
+// Receives byte array from provided channel by first receiving length information, then data.
+// Used for transmitting the attestation reports between peers
+func Read(c net.Conn) ([]byte, error) {
+	return readMsg(c, maxMessageSizeDefault, ioTimeout)
+}
 
-	n, err := c.Write(lenbuf)
-	if err != nil {
-		return fmt.Errorf("failed to write length to %v: %w", c.RemoteAddr().String(), err)
-	}
-	if n != len(lenbuf) {
-		return fmt.Errorf("could only send %v of %v bytes to %v", n, len(lenbuf),
-			c.RemoteAddr().String())
+func writeMsg(msg []byte, c net.Conn, maxSize int, timeout time.Duration) error {
+
+	if len(msg) > maxSize {
+		return fmt.Errorf("message size %v exceeds maximum %v", len(msg), maxSize)
 	}
 
-	n, err = c.Write(msg)
-	if err != nil {
-		return fmt.Errorf("failed to write payload to %v: %w", c.RemoteAddr().String(), err)
+	buf := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	buf = append(buf, msg...)
+
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
 	}
-	if n != len(msg) {
-		return fmt.Errorf("could only send %v of %v bytes to %v", n, len(msg),
-			c.RemoteAddr().String())
+	defer c.SetWriteDeadline(time.Time{})
+
+	// Write until all data is sent, as writers may return short writes
+	for written := 0; written < len(buf); {
+		n, err := c.Write(buf[written:])
+		written += n
+		if err != nil {
+			return fmt.Errorf("failed to write message to %v (%v of %v bytes sent): %w",
+				c.RemoteAddr().String(), written, len(buf), err)
+		}
+		if n == 0 {
+			return fmt.Errorf("failed to write message to %v: %w", c.RemoteAddr().String(),
+				io.ErrShortWrite)
+		}
 	}
 
-	return err
+	return nil
 }
 
-// Receives byte array from provided channel by first receiving length information, then data.
-// Used for transmitting the attestation reports between peers
-func Read(c net.Conn) ([]byte, error) {
-	start := time.Now()
+func readMsg(c net.Conn, maxSize int, timeout time.Duration) ([]byte, error) {
 
-	lenbuf := make([]byte, 4)
-	_, err := c.Read(lenbuf)
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	defer c.SetReadDeadline(time.Time{})
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive message: no length: %v", err)
+	lenbuf := make([]byte, 4)
+	if _, err := io.ReadFull(c, lenbuf); err != nil {
+		return nil, fmt.Errorf("failed to receive message length: %w", err)
 	}
 
-	len := int(binary.BigEndian.Uint32(lenbuf)) // Max size of 4GB
-	log.Tracef("TCP Message to be received: %v", len)
+	length := binary.BigEndian.Uint32(lenbuf)
+	log.Tracef("TCP Message to be received: %v", length)
 
-	if len == 0 {
+	if length == 0 {
 		return nil, errors.New("message length is zero")
 	}
+	if uint64(length) > uint64(maxSize) {
+		return nil, fmt.Errorf("announced message size %v exceeds maximum %v", length, maxSize)
+	}
 
-	// Receive data in chunks of 1024 bytes as the Read function receives a maxium of 64K bytes
-	// and the buffer must be longer, then append it to the final buffer
-	buf := bytes.NewBuffer(nil)
-	received := 0
-
-	for {
-		chunk := make([]byte, 64*1024)
-		n, err := c.Read(chunk)
-		received += n
-		if err != nil {
-			return nil, fmt.Errorf("failed to receive message: %w", err)
-		}
-		buf.Write(chunk[:n])
-
-		// Abort as soon as we have read the expected data as signaled in the first 4 bytes
-		// of the message
-		if received == len {
-			log.Trace("Received message")
-			break
-		}
-
-		if time.Since(start).Seconds() >= 10 {
-			log.Warn("Manual timeout during read")
-			break
-		}
+	buf := make([]byte, length)
+	n, err := io.ReadFull(c, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive message (%v of %v bytes): %w", n, length, err)
 	}
-	return buf.Bytes(), nil
+	log.Trace("Received message")
+
+	return buf, nil
 }
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func frame(length uint32, payload []byte) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, length)
+	return append(buf, payload...)
+}
+
+func TestReadMsg(t *testing.T) {
+	msg := []byte("attestation report")
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte // written separately by the peer, which then closes
+		stall   bool     // the peer keeps the connection open
+		want    []byte
+		wantErr bool
+	}{
+		{"Success", [][]byte{frame(uint32(len(msg)), msg)}, false, msg, false},
+		{"Fragmented Prefix", [][]byte{{0}, {0, 0}, {byte(len(msg))}, msg[:3], msg[3:]},
+			false, msg, false},
+		{"Trailing Garbage", [][]byte{append(frame(uint32(len(msg)), msg), 0xde, 0xad)},
+			false, msg, false},
+		{"Oversized Announcement", [][]byte{frame(1<<31, nil)}, false, nil, true},
+		{"Zero Length", [][]byte{frame(0, nil)}, false, nil, true},
+		{"Truncated Prefix", [][]byte{{0, 0}}, false, nil, true},
+		{"Truncated Payload", [][]byte{frame(uint32(len(msg)), msg[:5])}, false, nil, true},
+		{"Stalled Peer", [][]byte{frame(uint32(len(msg)), msg[:5])}, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				for _, c := range tt.chunks {
+					if _, err := client.Write(c); err != nil {
+						return
+					}
+				}
+				if !tt.stall {
+					client.Close()
+				}
+			}()
+
+			got, err := readMsg(server, 1024, 100*time.Millisecond)
+			server.Close()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMsg() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("readMsg() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// shortConn returns short writes of at most one byte
+type shortConn struct {
+	net.Conn
+}
+
+func (c shortConn) Write(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWriteMsg(t *testing.T) {
+	msg := []byte("attestation report")
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		short   bool
+		wantErr bool
+	}{
+		{"Success", msg, false, false},
+		{"Short Writes", msg, true, false},
+		{"Oversized", make([]byte, 1025), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+
+			var conn net.Conn = client
+			if tt.short {
+				conn = shortConn{client}
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- writeMsg(tt.msg, conn, 1024, time.Second)
+				client.Close()
+			}()
+
+			got, rerr := readMsg(server, 1024, time.Second)
+			if err := <-errs; (err != nil) != tt.wantErr {
+				t.Fatalf("writeMsg() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rerr != nil || !bytes.Equal(got, tt.msg) {
+				t.Errorf("readMsg() = %q, %v, want %q", got, rerr, tt.msg)
+			}
+		})
+	}
+}
+
+func TestWriteMsgStalledPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// The peer never reads, so that the write must time out
+	if err := writeMsg([]byte("report"), client, 1024, 100*time.Millisecond); err == nil {
+		t.Fatalf("writeMsg() to stalled peer succeeded")
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"context"
 	"crypto"
 	"crypto/rsa"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -44,7 +43,7 @@ func init() {
 }
 
 // Obtains attestation report from cmcd
-func (a CoapApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
+func (a CoapApi) obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
 
 	path := "/Attest"
 
@@ -52,14 +51,16 @@ func (a CoapApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 	log.Tracef("Contacting cmcd via coap on %v", cc.CmcAddr)
 	conn, err := udp.Dial(cc.CmcAddr)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
+		return nil, fmt.Errorf("error dialing: %w", &CmcUnavailableError{Op: "attest", Err: err})
 	}
+	defer conn.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	req := &api.AttestationRequest{
-		Id:    id,
-		Nonce: chbindings,
+		Id:     id,
+		Nonce:  chbindings,
+		Cached: cached,
 	}
 
 	// Marshal request
@@ -71,7 +72,8 @@ func (a CoapApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 	// Send CoAP POST request
 	coapResp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w",
+			&CmcUnavailableError{Op: "attest", Err: err})
 	}
 
 	// Read CoAP reply body
@@ -82,7 +84,7 @@ func (a CoapApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 
 	// Unmarshal response
 	resp := new(api.AttestationResponse)
-	err = cbor.Unmarshal(body, resp)
+	err = ar.DecodeCbor(body, resp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal body: %w", err)
 	}
@@ -99,16 +101,22 @@ func (a CoapApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 	log.Tracef("Contacting cmcd via coap on %v", cc.CmcAddr)
 	conn, err := udp.Dial(cc.CmcAddr)
 	if err != nil {
-		return fmt.Errorf("error dialing: %w", err)
+		return fmt.Errorf("error dialing: %w", &CmcUnavailableError{Op: "verify", Err: err})
 	}
+	defer conn.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	// Create Verification request
+	cas, err := cmcCas(cc)
+	if err != nil {
+		return err
+	}
 	req := &api.VerificationRequest{
 		Nonce:             chbindings,
 		AttestationReport: report,
 		Ca:                cc.Ca,
+		Cas:               cas,
 		Policies:          cc.Policies,
 	}
 	payload, err := cbor.Marshal(req)
@@ -119,7 +127,8 @@ func (a CoapApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 	// Perform Verify request
 	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send request: %w",
+			&CmcUnavailableError{Op: "verify", Err: err})
 	}
 	payload, err = resp.ReadBody()
 	if err != nil {
@@ -128,14 +137,14 @@ func (a CoapApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
 	// Unmarshal verify response
 	var verifyResp api.VerificationResponse
-	err = cbor.Unmarshal(payload, &verifyResp)
+	err = ar.DecodeCbor(payload, &verifyResp)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
 	// Parse VerificationResult
 	result := new(ar.VerificationResult)
-	err = json.Unmarshal(verifyResp.VerificationResult, result)
+	err = ar.DecodeJson(verifyResp.VerificationResult, result)
 	if err != nil {
 		return fmt.Errorf("could not parse verification result: %w", err)
 	}
@@ -163,8 +172,9 @@ func (a CoapApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 	log.Tracef("Contacting cmcd via coap on %v", cc.CmcAddr)
 	conn, err := udp.Dial(cc.CmcAddr)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
+		return nil, fmt.Errorf("error dialing: %w", &CmcUnavailableError{Op: "sign", Err: err})
 	}
+	defer conn.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
@@ -174,6 +184,7 @@ func (a CoapApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 	}
 
 	req := api.TLSSignRequest{
+		Id:       cc.CertProfile,
 		Content:  digest,
 		Hashtype: hash,
 	}
@@ -192,7 +203,8 @@ func (a CoapApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 	// Send sign request
 	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w",
+			&CmcUnavailableError{Op: "sign", Err: err})
 	}
 	payload, err = resp.ReadBody()
 	if err != nil {
@@ -201,7 +213,7 @@ func (a CoapApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 
 	// Unmarshal sign response
 	var signResp api.TLSSignResponse
-	err = cbor.Unmarshal(payload, &signResp)
+	err = ar.DecodeCbor(payload, &signResp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
@@ -217,15 +229,15 @@ func (a CoapApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
 	log.Tracef("Contacting cmcd via coap on %v", cc.CmcAddr)
 	conn, err := udp.Dial(cc.CmcAddr)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
+		return nil, fmt.Errorf("error dialing: %w", &CmcUnavailableError{Op: "fetch certificates", Err: err})
 	}
+	defer conn.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	// Create TLS certificate request
 	req := api.TLSCertRequest{
-		// TODO ID currently not used
-		Id: "",
+		Id: cc.CertProfile,
 	}
 
 	// Marshal payload
@@ -237,7 +249,8 @@ func (a CoapApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
 	// Send cert request
 	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w",
+			&CmcUnavailableError{Op: "fetch certificates", Err: err})
 	}
 	payload, err = resp.ReadBody()
 	if err != nil {
@@ -246,10 +259,58 @@ func (a CoapApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
 
 	// Unmarshal cert response
 	var certResp api.TLSCertResponse
-	err = cbor.Unmarshal(payload, &certResp)
+	err = ar.DecodeCbor(payload, &certResp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
 	return certResp.Certificate, nil
 }
+
+// Fetches which of the metadata items of the peer the cmcd holds
+func (a CoapApi) fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+
+	path := "/PeerCache"
+
+	// Establish connection
+	log.Tracef("Contacting cmcd via coap on %v", cc.CmcAddr)
+	conn, err := udp.Dial(cc.CmcAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing: %w", &CmcUnavailableError{Op: "fetch peer cache", Err: err})
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Create peer cache request
+	req := api.PeerCacheRequest{
+		Id:      id,
+		Digests: digests,
+	}
+
+	// Marshal payload
+	payload, err := cbor.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	// Send peer cache request
+	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w",
+			&CmcUnavailableError{Op: "fetch peer cache", Err: err})
+	}
+	payload, err = resp.ReadBody()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	// Unmarshal peer cache response
+	var cacheResp api.PeerCacheResponse
+	err = ar.DecodeCbor(payload, &cacheResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return cacheResp.Cached, nil
+}
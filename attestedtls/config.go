@@ -17,9 +17,13 @@ package attestedtls
 
 import (
 	"crypto"
+	"fmt"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/sink"
 )
 
 type CmcApiSelect uint32
@@ -31,6 +35,9 @@ const (
 	CmcApi_Socket CmcApiSelect = 2
 	CmcApi_Lib    CmcApiSelect = 3
 
+	// The attestation mode selects which side of the connection attests to its
+	// peer: both sides, only the dialer (client), only the listener (server),
+	// or none. A side only verifies the report of the peer if the peer attests
 	Attest_Mutual AttestSelect = 0
 	Attest_Client AttestSelect = 1
 	Attest_Server AttestSelect = 2
@@ -42,6 +49,11 @@ const (
 	cmcApiSelectDefault = CmcApi_GRPC
 	attestDefault       = Attest_Mutual
 	timeoutSec          = 10
+	// The time the peer has to answer the channel bindings of a connection
+	nonceTtlDefault = 2 * time.Minute
+	// The time the cmcd has to answer a request, which includes the generation
+	// of the attestation report
+	cmcTimeoutDefault = 2 * time.Minute
 )
 
 // Struct that holds information on cmc address and port
@@ -56,13 +68,40 @@ type CmcConfig struct {
 	Attest   AttestSelect
 	ResultCb func(result *ar.VerificationResult)
 	Cmc      *cmc.Cmc
+	// Optional check of the verification result of the peer by the
+	// application. An error aborts the connection even if the report was
+	// accepted by the verification
+	ResultCheck func(result ar.VerificationResult) error
+	// Optional certificate profile of the TLS certificate and key
+	CertProfile string
+	// Optional time the peer has to answer the channel bindings with its
+	// attestation report (default 2m). Negative values disable the check
+	NonceTtl time.Duration
+	// Optional sink the listener forwards the results of the verified dialers
+	// to. If not set, the sinks of the CMC are used for the Lib API
+	ResultSink sink.Sink
+	// Optional verifiers the report of the peer is submitted to instead of
+	// the CMC API, and the rule their results are combined with
+	Verifiers []Verifier
+	Quorum    QuorumRule
+	// Optional time the cmcd has to answer a request (default 2m)
+	CmcTimeout time.Duration
+	// Optional retry of the requests to the cmcd if it is unavailable
+	Retry CmcRetry
+	// Optional maximum size of the messages exchanged with the peer during the
+	// attestation (default 32 MiB)
+	MaxMessageSize int
+	// Optional cache of the metadata digests of the verified peers, so that
+	// peers omit unchanged metadata from their reports on repeat connections
+	PeerCache *PeerCache
 }
 
 type CmcApi interface {
-	obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error)
+	obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error)
 	verifyAR(chbindings, report []byte, cc CmcConfig) error
 	fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error)
 	fetchCerts(cc CmcConfig) ([][]byte, error)
+	fetchPeerCache(cc CmcConfig, digests []string) ([]string, error)
 }
 
 var CmcApis = map[CmcApiSelect]CmcApi{}
@@ -86,15 +125,26 @@ func WithCmcApi(api CmcApiSelect) ConnectionOption[CmcConfig] {
 }
 
 // WithCmcNetwork specifies the network type to be used to connect
-// to the cmcd in case the socket API is selected
+// to the cmcd in case the socket API is selected, i.e., unix, tcp or vsock.
+// For vsock, the address has the form vsock://<cid>:<port>
 func WithCmcNetwork(network string) ConnectionOption[CmcConfig] {
 	return func(c *CmcConfig) {
 		c.Network = network
 	}
 }
 
+// WithCmcTimeout specifies the time the cmcd has to answer a request of the
+// gRPC or socket API. Requests exceeding the timeout fail with a
+// CmcUnavailableError
+func WithCmcTimeout(timeout time.Duration) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.CmcTimeout = timeout
+	}
+}
+
 // WithCmcCa specifies the CA the attestation report should be verified against
-// in PEM format
+// in PEM format. A bundle of multiple concatenated PEM certificates accepts
+// reports with chains ending in any of the CAs, e.g. during a CA rotation
 func WithCmcCa(pem []byte) ConnectionOption[CmcConfig] {
 	return func(c *CmcConfig) {
 		c.Ca = pem
@@ -124,6 +174,15 @@ func WithAttest(mAttest string) ConnectionOption[CmcConfig] {
 	}
 }
 
+// WithAttestMode specifies the attestation mode. Both sides of the connection
+// must be configured for the same mode, otherwise the connection fails with an
+// AttestModeMismatchError
+func WithAttestMode(mode AttestSelect) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.Attest = mode
+	}
+}
+
 // WithResultCb is a callback for further processing of attestation results
 func WithResultCb(cb func(result *ar.VerificationResult)) ConnectionOption[CmcConfig] {
 	return func(c *CmcConfig) {
@@ -131,6 +190,18 @@ func WithResultCb(cb func(result *ar.VerificationResult)) ConnectionOption[CmcCo
 	}
 }
 
+// WithResultCheck specifies a check of the verification result of the peer,
+// e.g., to impose a stricter policy than the verification. The check is called
+// with the verification result of the peer, including failed results. With
+// multiple verifiers, it is only called with the result of the first accepting
+// verifier if the quorum was reached. An error aborts the connection, whereas
+// returning nil does not override a failed verification
+func WithResultCheck(check func(result ar.VerificationResult) error) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.ResultCheck = check
+	}
+}
+
 // WithCmc takes a CMC object. This is only required for the Lib API, where
 // the CMC is integrated directly into binary (instead of using the cmcd)
 func WithCmc(cmc *cmc.Cmc) ConnectionOption[CmcConfig] {
@@ -139,6 +210,50 @@ func WithCmc(cmc *cmc.Cmc) ConnectionOption[CmcConfig] {
 	}
 }
 
+// WithCertProfile selects the certificate profile of the TLS certificate and
+// key of the cmcd. If not set, the certificate of the signer is used
+func WithCertProfile(profile string) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.CertProfile = profile
+	}
+}
+
+// WithNonceTtl specifies the time the peer has to answer the channel bindings
+// of the connection with its attestation report. Later reports are rejected
+// with the error code NonceExpired. Negative values disable the check
+func WithNonceTtl(ttl time.Duration) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.NonceTtl = ttl
+	}
+}
+
+// WithMaxMessageSize specifies the maximum size of the messages exchanged with
+// the peer during the attestation. Larger messages abort the attestation
+func WithMaxMessageSize(size int) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.MaxMessageSize = size
+	}
+}
+
+// WithPeerCache enables the peer cache: the metadata digests of the verified
+// reports are remembered per peer, and on repeat connections, the digests the
+// cmcd still holds are sent to the peer, which omits the metadata items from
+// its report. Both peers must enable the peer cache. The cache can be shared
+// by multiple listeners and dialers
+func WithPeerCache(c *PeerCache) ConnectionOption[CmcConfig] {
+	return func(cc *CmcConfig) {
+		cc.PeerCache = c
+	}
+}
+
+// WithResultSink specifies the sink the listener forwards the verification
+// results of the dialers to
+func WithResultSink(s sink.Sink) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.ResultSink = s
+	}
+}
+
 // WithCmc specifies an entire CMC configuration
 func WithCmcConfig(cmcConfig *CmcConfig) ConnectionOption[CmcConfig] {
 	return func(c *CmcConfig) {
@@ -157,9 +272,47 @@ func GetAttestMode(mAttest string) AttestSelect {
 		selection = Attest_Client
 	case "none":
 		selection = Attest_None
-	default:
+	case "":
 		log.Info("No mattest flag set, running default mutual attestation")
 		selection = Attest_Mutual
+	default:
+		log.Warnf("Unknown attestation mode %v, running default mutual attestation", mAttest)
+		selection = Attest_Mutual
 	}
 	return selection
 }
+
+// String returns the name of the attestation mode as accepted by GetAttestMode
+func (a AttestSelect) String() string {
+	switch a {
+	case Attest_Mutual:
+		return "mutual"
+	case Attest_Client:
+		return "client"
+	case Attest_Server:
+		return "server"
+	case Attest_None:
+		return "none"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(a))
+	}
+}
+
+// cmcTimeout returns the configured time the cmcd has to answer a request
+func cmcTimeout(cc CmcConfig) time.Duration {
+	if cc.CmcTimeout > 0 {
+		return cc.CmcTimeout
+	}
+	return cmcTimeoutDefault
+}
+
+// cmcCas splits the configured CAs into single PEM certificates, so that a
+// bundle of multiple roots is accepted by the verifier. The CAs are also sent
+// as is for cmcd versions not supporting multiple CAs
+func cmcCas(cc CmcConfig) ([][]byte, error) {
+	roots, err := internal.ParseRoots(cc.Ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CAs: %w", err)
+	}
+	return internal.WriteCertsPem(roots), nil
+}
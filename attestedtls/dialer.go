@@ -27,6 +27,28 @@ import (
 // Additionally performs remote attestation
 // before returning the established connection.
 func Dial(network string, addr string, config *tls.Config, moreConfigs ...ConnectionOption[CmcConfig]) (*tls.Conn, error) {
+	conn, err := DialConn(network, addr, config, moreConfigs...)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Conn, nil
+}
+
+// DialConn is like Dial, but returns the attested connection, which
+// additionally exposes the identity of the peer and the results of the
+// verifiers if multiple verifiers are configured. If the listener omitted
+// metadata from its report, which the local cmcd no longer holds, the
+// connection is retried once with the full report
+func DialConn(network string, addr string, config *tls.Config, moreConfigs ...ConnectionOption[CmcConfig]) (*Conn, error) {
+	conn, err := dialConn(network, addr, config, moreConfigs...)
+	if errors.Is(err, ErrMissingCacheEntry) {
+		log.Debugf("Retrying connection without peer cache: %v", err)
+		conn, err = dialConn(network, addr, config, moreConfigs...)
+	}
+	return conn, err
+}
+
+func dialConn(network string, addr string, config *tls.Config, moreConfigs ...ConnectionOption[CmcConfig]) (*Conn, error) {
 
 	if config == nil {
 		return nil, errors.New("failed to dial. TLS configuration not provided")
@@ -45,6 +67,15 @@ func Dial(network string, addr string, config *tls.Config, moreConfigs ...Connec
 		return nil, fmt.Errorf("failed to establish tls connection: %w. %v", err, details)
 	}
 
+	// The connection is only returned after successful attestation and must
+	// be closed otherwise
+	success := false
+	defer func() {
+		if !success {
+			conn.Close()
+		}
+	}()
+
 	cs := conn.ConnectionState()
 	if !cs.HandshakeComplete {
 		return nil, errors.New("internal error: handshake not complete")
@@ -69,14 +100,18 @@ func Dial(network string, addr string, config *tls.Config, moreConfigs ...Connec
 	if cc.CmcApi == nil {
 		return nil, fmt.Errorf("selected CMC API is not implemented")
 	}
+	if err := checkVerifiers(cc); err != nil {
+		return nil, err
+	}
 
 	// Perform remote attestation with unique channel binding as specified in RFC5056,
 	// RFC5705, and RFC9266
-	err = attestDialer(conn, chbindings, cc)
+	quorum, result, err := attestDialer(conn, chbindings, cc)
 	if err != nil {
 		return nil, fmt.Errorf("remote attestation failed: %w", err)
 	}
 
 	log.Info("Client-side aTLS connection complete")
-	return conn, nil
+	success = true
+	return &Conn{Conn: conn, quorum: quorum, result: result}, nil
 }
@@ -22,15 +22,17 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type GrpcApi struct{}
@@ -40,30 +42,86 @@ func init() {
 	CmcApis[CmcApi_GRPC] = GrpcApi{}
 }
 
-// Creates connection with cmcd at specified address
-func getCMCServiceConn(cc CmcConfig) (api.CMCServiceClient, *grpc.ClientConn, context.CancelFunc) {
+// grpcConns holds the connections to the cmcd per address, which are shared
+// by all requests. A connection is reset if the cmcd becomes unavailable, e.g.
+// during a restart, so that the next request dials a fresh connection
+var grpcConns = struct {
+	sync.Mutex
+	conns map[string]*grpc.ClientConn
+}{conns: map[string]*grpc.ClientConn{}}
+
+// Returns the pooled connection with the cmcd at the specified address or
+// creates it
+func getCMCServiceConn(cc CmcConfig) (api.CMCServiceClient, *grpc.ClientConn, error) {
+	grpcConns.Lock()
+	conn, ok := grpcConns.conns[cc.CmcAddr]
+	grpcConns.Unlock()
+	if ok {
+		return api.NewCMCServiceClient(conn), conn, nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
+	defer cancel()
 	conn, err := grpc.DialContext(ctx, cc.CmcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		log.Errorf("failed to connect: %v", err)
-		cancel()
-		return nil, nil, nil
+		return nil, nil, &CmcUnavailableError{Op: "connect", Err: err}
+	}
+
+	// Another request might have connected concurrently
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	if existing, ok := grpcConns.conns[cc.CmcAddr]; ok {
+		conn.Close()
+		return api.NewCMCServiceClient(existing), existing, nil
+	}
+	grpcConns.conns[cc.CmcAddr] = conn
+
+	return api.NewCMCServiceClient(conn), conn, nil
+}
+
+// resetCMCServiceConn closes and removes the pooled connection, if it was not
+// already replaced by a concurrent request
+func resetCMCServiceConn(addr string, conn *grpc.ClientConn) {
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	if grpcConns.conns[addr] == conn {
+		delete(grpcConns.conns, addr)
+		conn.Close()
+	}
+}
+
+// CloseCmcConns closes the pooled gRPC connections to the cmcd
+func CloseCmcConns() {
+	grpcConns.Lock()
+	defer grpcConns.Unlock()
+	for addr, conn := range grpcConns.conns {
+		conn.Close()
+		delete(grpcConns.conns, addr)
 	}
+}
 
-	return api.NewCMCServiceClient(conn), conn, cancel
+// grpcError returns a CmcUnavailableError and resets the connection if the
+// request failed because the cmcd is not available or did not answer within
+// the CMC timeout, like with the socket API
+func grpcError(cc CmcConfig, conn *grpc.ClientConn, op string, err error) error {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded:
+		resetCMCServiceConn(cc.CmcAddr, conn)
+		return &CmcUnavailableError{Op: op, Err: err}
+	}
+	return err
 }
 
 // Obtains attestation report from CMCd
-func (a GrpcApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
+// The gRPC API does not support the peer cache, the cached items are not omitted
+func (a GrpcApi) obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
 
 	// Get backend connection
 	log.Tracef("Obtaining AR from local cmcd on %v", cc.CmcAddr)
-	cmcClient, cmcconn, cancel := getCMCServiceConn(cc)
-	if cmcClient == nil {
-		return nil, errors.New("failed to establish connection to obtain AR")
+	cmcClient, conn, err := getCMCServiceConn(cc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection to obtain AR: %w", err)
 	}
-	defer cmcconn.Close()
-	defer cancel()
 	log.Trace("Contacting backend to obtain AR.")
 
 	req := &api.AttestationRequest{
@@ -72,9 +130,11 @@ func (a GrpcApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 	}
 
 	// Call Attest request
-	resp, err := cmcClient.Attest(context.Background(), req)
+	ctx, cancel := context.WithTimeout(context.Background(), cmcTimeout(cc))
+	defer cancel()
+	resp, err := cmcClient.Attest(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to obtain AR: %w", err)
+		return nil, fmt.Errorf("failed to obtain AR: %w", grpcError(cc, conn, "attest", err))
 	}
 
 	// Return response
@@ -85,25 +145,31 @@ func (a GrpcApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 func (a GrpcApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 	// Get backend connection
 	log.Tracef("Verifying remote AR via local cmcd on %v", cc.CmcAddr)
-	cmcClient, conn, cancel := getCMCServiceConn(cc)
-	if cmcClient == nil {
-		return errors.New("failed to establish connection to obtain attestation result")
+	cmcClient, conn, err := getCMCServiceConn(cc)
+	if err != nil {
+		return fmt.Errorf("failed to establish connection to obtain attestation result: %w", err)
 	}
-	defer conn.Close()
-	defer cancel()
 	log.Trace("Contacting backend for AR verification")
 
 	// Create Verification request
+	cas, err := cmcCas(cc)
+	if err != nil {
+		return err
+	}
 	req := api.VerificationRequest{
 		Nonce:             chbindings,
 		AttestationReport: report,
 		Ca:                cc.Ca,
+		Cas:               cas,
 		Policies:          cc.Policies,
 	}
 	// Perform Verify request
-	resp, err := cmcClient.Verify(context.Background(), &req)
+	ctx, cancel := context.WithTimeout(context.Background(), cmcTimeout(cc))
+	defer cancel()
+	resp, err := cmcClient.Verify(ctx, &req)
 	if err != nil {
-		return fmt.Errorf("could not obtain verification result: %w", err)
+		return fmt.Errorf("could not obtain verification result: %w",
+			grpcError(cc, conn, "verify", err))
 	}
 	// Check Verify response
 	if resp.GetStatus() != api.Status_OK {
@@ -112,7 +178,7 @@ func (a GrpcApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
 	// Parse VerificationResult
 	result := new(ar.VerificationResult)
-	err = json.Unmarshal(resp.GetVerificationResult(), result)
+	err = ar.DecodeJson(resp.GetVerificationResult(), result)
 	if err != nil {
 		return fmt.Errorf("could not parse verification result: %w", err)
 	}
@@ -134,12 +200,10 @@ func (a GrpcApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 func (a GrpcApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 	// Get backend connection
 	log.Tracef("Fetching signature from local cmcd on %v", cc.CmcAddr)
-	cmcClient, conn, cancel := getCMCServiceConn(cc)
-	if cmcClient == nil {
-		return nil, errors.New("connection failed. No signing performed")
+	cmcClient, conn, err := getCMCServiceConn(cc)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed. No signing performed: %w", err)
 	}
-	defer conn.Close()
-	defer cancel()
 	log.Trace("contacting backend for Sign Operation")
 
 	// Create Sign request
@@ -148,7 +212,7 @@ func (a GrpcApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 		return nil, fmt.Errorf("sign request creation failed: %w", err)
 	}
 	req := api.TLSSignRequest{
-		Id:       id,
+		Id:       cc.CertProfile,
 		Digest:   digest,
 		Hashtype: hash,
 	}
@@ -159,9 +223,11 @@ func (a GrpcApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 	}
 
 	// Send Sign request
-	resp, err := cmcClient.TLSSign(context.Background(), &req)
+	ctx, cancel := context.WithTimeout(context.Background(), cmcTimeout(cc))
+	defer cancel()
+	resp, err := cmcClient.TLSSign(ctx, &req)
 	if err != nil {
-		return nil, fmt.Errorf("sign request failed: %w", err)
+		return nil, fmt.Errorf("sign request failed: %w", grpcError(cc, conn, "sign", err))
 	}
 
 	// Check Sign response
@@ -175,22 +241,23 @@ func (a GrpcApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerO
 func (a GrpcApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
 	// Get backend connection
 	log.Tracef("Fetching certificates from local cmcd on %v", cc.CmcAddr)
-	cmcClient, cmcconn, cancel := getCMCServiceConn(cc)
-	if cmcClient == nil {
-		return nil, errors.New("failed to establish connection to cmcd")
+	cmcClient, conn, err := getCMCServiceConn(cc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection to cmcd: %w", err)
 	}
-	defer cmcconn.Close()
-	defer cancel()
 
 	// Create TLSCert request
 	req := api.TLSCertRequest{
-		Id: id,
+		Id: cc.CertProfile,
 	}
 
 	// Call TLSCert request
-	resp, err := cmcClient.TLSCert(context.Background(), &req)
+	ctx, cancel := context.WithTimeout(context.Background(), cmcTimeout(cc))
+	defer cancel()
+	resp, err := cmcClient.TLSCert(ctx, &req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to request TLS certificate: %w", err)
+		return nil, fmt.Errorf("failed to request TLS certificate: %w",
+			grpcError(cc, conn, "fetch certificates", err))
 	}
 
 	// Check TLSCert response
@@ -249,3 +316,7 @@ func convertHash(opts crypto.SignerOpts) (api.HashFunction, error) {
 	}
 	return api.HashFunction_SHA512, errors.New("could not determine correct Hash function")
 }
+
+func (a GrpcApi) fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+	return nil, errors.New("peer cache not supported by the gRPC API")
+}
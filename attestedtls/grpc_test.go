@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || grpc
+
+package attestedtls
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	cmcapi "github.com/Fraunhofer-AISEC/cmc/api"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+func (s *fakeCmcd) TLSSign(ctx context.Context, req *api.TLSSignRequest,
+) (*api.TLSSignResponse, error) {
+	var pssOpts *cmcapi.PSSOptions
+	if req.PssOpts != nil {
+		pssOpts = &cmcapi.PSSOptions{SaltLength: req.PssOpts.SaltLength}
+	}
+	opts, err := cmcapi.HashToSignerOpts(cmcapi.HashFunction(req.Hashtype), pssOpts)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := LibApi{}.fetchSignature(s.cc, req.Digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TLSSignResponse{Status: api.Status_OK, SignedDigest: sig}, nil
+}
+
+func (s *fakeCmcd) TLSCert(ctx context.Context, req *api.TLSCertRequest,
+) (*api.TLSCertResponse, error) {
+	certs, err := LibApi{}.fetchCerts(s.cc)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TLSCertResponse{Status: api.Status_OK, Certificate: certs}, nil
+}
+
+// stalledCmcd serves the gRPC API of the cmcd, but never answers
+type stalledCmcd struct {
+	api.UnimplementedCMCServiceServer
+}
+
+func (s stalledCmcd) Attest(ctx context.Context, req *api.AttestationRequest,
+) (*api.AttestationResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGrpcApi(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+	t.Cleanup(CloseCmcConns)
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	serve := func(srv api.CMCServiceServer) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		s := grpc.NewServer()
+		api.RegisterCMCServiceServer(s, srv)
+		go s.Serve(l)
+		t.Cleanup(s.Stop)
+		return l.Addr().String()
+	}
+	fake := &fakeCmcd{cc: *newLibConfig(f)}
+	fake.kill.Do(func() {})
+
+	cc := CmcConfig{
+		CmcApi:  CmcApis[CmcApi_GRPC],
+		CmcAddr: serve(fake),
+		Ca:      f.CaPem(),
+		Attest:  Attest_Mutual,
+	}
+	stalled := cc
+	stalled.CmcAddr = serve(stalledCmcd{})
+	stalled.CmcTimeout = 100 * time.Millisecond
+
+	testCmcApi(t, cc, stalled)
+}
@@ -17,12 +17,16 @@ package attestedtls
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 // PrivateKey Wrapper Implementing crypto.Signer interface
@@ -38,13 +42,43 @@ func (priv PrivateKey) Sign(random io.Reader, digest []byte, opts crypto.SignerO
 	if priv.CmcConfig.CmcApi == nil {
 		return nil, errors.New("failed to get CMC API: nil")
 	}
-	return priv.CmcConfig.CmcApi.fetchSignature(priv.CmcConfig, digest, opts)
+	return fetchSignature(priv.CmcConfig, digest, opts)
 }
 
 func (priv PrivateKey) Public() crypto.PublicKey {
 	return priv.pubKey
 }
 
+// signatureSchemes returns the TLS signature schemes for the key type of the
+// certificate. The cipher suites are selected by crypto/tls based on the key
+// type. ECDSA keys are restricted to the hash algorithm matching the curve, as
+// TPM keys are created with a fixed signature scheme and cannot sign digests
+// of other hash algorithms, which TLS 1.2 would allow to negotiate
+func signatureSchemes(pub crypto.PublicKey) ([]tls.SignatureScheme, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return []tls.SignatureScheme{
+			tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512,
+			tls.PKCS1WithSHA256, tls.PKCS1WithSHA384, tls.PKCS1WithSHA512,
+		}, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}, nil
+		case elliptic.P384():
+			return []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}, nil
+		case elliptic.P521():
+			return []tls.SignatureScheme{tls.ECDSAWithP521AndSHA512}, nil
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %v", key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return []tls.SignatureScheme{tls.Ed25519}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
 // Obtains Certificate for the Identity Key (IK) used for the connection from cmcd
 func GetCert(moreConfigs ...ConnectionOption[CmcConfig]) (tls.Certificate, error) {
 	var tlsCert tls.Certificate
@@ -64,37 +98,23 @@ func GetCert(moreConfigs ...ConnectionOption[CmcConfig]) (tls.Certificate, error
 		return tls.Certificate{}, fmt.Errorf("selected CMC API is not implemented")
 	}
 
-	certs, err := cc.CmcApi.fetchCerts(cc)
+	certs, err := fetchCerts(cc)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("failed to fetch certificate from cmc: %w", err)
 	}
 
-	// Convert each certificate (assuming it has superfluous "---------[]BEGIN CERTIFICATE[]-----" still there)
-	for _, cert := range certs {
-		var currentBlock *pem.Block
-		var remain []byte
-		currentBlock, remain = pem.Decode(cert)
-		if currentBlock == nil {
-			return tls.Certificate{}, errors.New("certificate inside the certificate chain could not be decoded")
-		}
-		if newBlock, _ := pem.Decode(remain); newBlock != nil {
-			return tls.Certificate{}, errors.New("certificate inside certificate chain contain superfluous data. Expecting separate Certificates")
-		}
-		if currentBlock.Type == "CERTIFICATE" {
-			tlsCert.Certificate = append(tlsCert.Certificate, currentBlock.Bytes)
-		} else {
-			return tls.Certificate{}, errors.New("certificate inside the certificate chain not of correct type")
-		}
-	}
-	if len(tlsCert.Certificate) == 0 {
-		return tls.Certificate{}, errors.New("could not parse any certificate")
+	// Each element contains a single PEM encoded certificate. TLS requires the
+	// chain to be ordered leaf first
+	parsed, err := internal.ParseCertsPem(certs)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate chain: %w", err)
 	}
-
-	// Convert TLS cert (first cert)
-	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	chain, err := internal.OrderChain(parsed)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("could not parse certificate: %w", err)
+		return tls.Certificate{}, fmt.Errorf("invalid certificate chain: %w", err)
 	}
+	tlsCert.Certificate = internal.WriteCertsDer(chain)
+	x509Cert := chain[0]
 
 	// Create TLS Cert
 	tlsCert.Leaf = x509Cert
@@ -102,6 +122,10 @@ func GetCert(moreConfigs ...ConnectionOption[CmcConfig]) (tls.Certificate, error
 		pubKey:    x509Cert.PublicKey,
 		CmcConfig: cc,
 	}
+	tlsCert.SupportedSignatureAlgorithms, err = signatureSchemes(x509Cert.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
 
 	// Return cert
 	return tlsCert, nil
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// certApi is an API, which returns the certificates
+type certApi struct {
+	CmcApi
+	certs [][]byte
+}
+
+func (a certApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
+	return a.certs, nil
+}
+
+func TestGetCert(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	chain := f.Ik.Chain
+	if len(chain) != 3 {
+		t.Fatalf("unexpected identity key chain length %v", len(chain))
+	}
+	leaf, inter, ca := chain[0], chain[1], chain[2]
+	corrupt := internal.WriteCertPem(inter)
+	corrupt = append(corrupt[:100:100], corrupt[110:]...)
+
+	tests := []struct {
+		name    string
+		certs   [][]byte
+		wantErr bool
+	}{
+		{"Ordered", internal.WriteCertsPem([]*x509.Certificate{leaf, inter, ca}), false},
+		{"Shuffled", internal.WriteCertsPem([]*x509.Certificate{ca, leaf, inter}), false},
+		{"Missing Intermediate", internal.WriteCertsPem([]*x509.Certificate{leaf, ca}), true},
+		{"Corrupt Intermediate", [][]byte{internal.WriteCertPem(leaf), corrupt,
+			internal.WriteCertPem(ca)}, true},
+		{"Concatenated", [][]byte{internal.WriteCertChainPem(chain)}, true},
+		{"Empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := GetCert(func(c *CmcConfig) { c.CmcApi = certApi{certs: tt.certs} })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !cert.Leaf.Equal(leaf) {
+				t.Errorf("GetCert() leaf = %v, want %v", cert.Leaf.Subject.CommonName,
+					leaf.Subject.CommonName)
+			}
+			if len(cert.Certificate) != len(chain) {
+				t.Fatalf("GetCert() returned %v certificates, want %v", len(cert.Certificate),
+					len(chain))
+			}
+			for i, c := range chain {
+				if !bytes.Equal(cert.Certificate[i], c.Raw) {
+					t.Errorf("GetCert() certificate %v differs", i)
+				}
+			}
+		})
+	}
+}
+
+// signApi is an API, which returns the certificate and signs with the key. As
+// a TPM key with a fixed signature scheme, it only signs digests of the hash
+// algorithm matching the curve
+type signApi struct {
+	certApi
+	key  *ecdsa.PrivateKey
+	hash crypto.Hash
+}
+
+func (a signApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != a.hash {
+		return nil, fmt.Errorf("hash %v does not match the key scheme %v", opts.HashFunc(), a.hash)
+	}
+	return a.key.Sign(rand.Reader, digest, opts)
+}
+
+func TestGetCertEcdsa(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve elliptic.Curve
+		hash  crypto.Hash
+	}{
+		{"P-256", elliptic.P256(), crypto.SHA256},
+		{"P-384", elliptic.P384(), crypto.SHA384},
+	}
+	for _, tt := range tests {
+		key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf("failed to create certificate: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %v", err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		api := signApi{
+			certApi: certApi{certs: internal.WriteCertsPem([]*x509.Certificate{leaf})},
+			key:     key,
+			hash:    tt.hash,
+		}
+
+		for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+			t.Run(fmt.Sprintf("%v TLS 0x%x", tt.name, version), func(t *testing.T) {
+				cert, err := GetCert(func(c *CmcConfig) { c.CmcApi = api })
+				if err != nil {
+					t.Fatalf("GetCert() error = %v", err)
+				}
+
+				serverConn, clientConn := net.Pipe()
+				defer serverConn.Close()
+				defer clientConn.Close()
+
+				server := tls.Server(serverConn, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					MinVersion:   version,
+					MaxVersion:   version,
+				})
+				errs := make(chan error, 1)
+				go func() { errs <- server.Handshake() }()
+
+				client := tls.Client(clientConn, &tls.Config{
+					RootCAs:    roots,
+					ServerName: "localhost",
+					MinVersion: version,
+					MaxVersion: version,
+				})
+				if err := client.Handshake(); err != nil {
+					t.Fatalf("client handshake error = %v", err)
+				}
+				if err := <-errs; err != nil {
+					t.Fatalf("server handshake error = %v", err)
+				}
+			})
+		}
+	}
+}
@@ -18,6 +18,7 @@
 package attestedtls
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"encoding/hex"
@@ -37,7 +38,7 @@ func init() {
 }
 
 // Obtains attestation report from CMCd
-func (a LibApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
+func (a LibApi) obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
 
 	if cc.Cmc == nil {
 		return nil, errors.New("internal error: cmc is nil")
@@ -49,13 +50,15 @@ func (a LibApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 
 	log.Debug("Prover: Generating Attestation Report with nonce: ", hex.EncodeToString(chbindings))
 
-	report, err := generate.Generate(chbindings, cc.Cmc.Metadata, cc.Cmc.Drivers, cc.Cmc.Serializer)
+	report, err := generate.GenerateCached(chbindings, cc.Cmc.Metadata(), cc.Cmc.Measurers(),
+		cc.Cmc.Serializer, cached)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate attestation report: %w", err)
 	}
 
 	log.Debug("Prover: Signing Attestation Report")
-	signedReport, err := generate.Sign(report, cc.Cmc.Drivers[0], cc.Cmc.Serializer)
+	signedReport, err := generate.Sign(report, cc.Cmc.Drivers[0], cc.Cmc.Serializer,
+		cc.Cmc.AdditionalSigners...)
 	if err != nil {
 		return nil, fmt.Errorf("prover: failed to sign attestation reoprt: %w", err)
 	}
@@ -66,8 +69,16 @@ func (a LibApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 // Checks Attestation report by calling the CMC to Verify and checking its status response
 func (a LibApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
+	if cc.Cmc == nil {
+		return errors.New("internal error: cmc is nil")
+	}
+
 	log.Debug("Verifier: Verifying Attestation Report")
-	result := verify.Verify(report, chbindings, cc.Ca, nil, cc.Cmc.PolicyEngineSelect, cc.Cmc.IntelStorage)
+	result, err := cc.Cmc.VerifyBudget.Verify(context.Background(), report, chbindings, cc.Ca,
+		cc.Policies, cc.Cmc.PolicyEngineSelect, cc.Cmc.IntelStorage)
+	if err != nil {
+		return fmt.Errorf("failed to verify attestation report: %w", err)
+	}
 
 	// Return attestation result via callback if specified
 	if cc.ResultCb != nil {
@@ -84,12 +95,16 @@ func (a LibApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
 func (a LibApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 
+	if cc.Cmc == nil {
+		return nil, errors.New("internal error: cmc is nil")
+	}
+
 	if len(cc.Cmc.Drivers) == 0 {
 		return nil, errors.New("no drivers configured")
 	}
 
 	// Get key handle from (hardware) interface
-	tlsKeyPriv, _, err := cc.Cmc.Drivers[0].GetSigningKeys()
+	tlsKeyPriv, _, err := cc.Cmc.SigningKeys(cc.CertProfile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get IK: %w", err)
 	}
@@ -114,10 +129,14 @@ func (a LibApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
 		return nil, errors.New("no drivers configured")
 	}
 
-	certChain, err := cc.Cmc.Drivers[0].GetCertChain()
+	certChain, err := cc.Cmc.CertChain(cc.CertProfile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cert chain: %w", err)
 	}
 
 	return internal.WriteCertsPem(certChain), nil
 }
+
+func (a LibApi) fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+	return verify.CachedMetadata(digests), nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || libapi
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// TestLibApi establishes attested TLS connections, where both endpoints use
+// the CMC in-process, including the TLS certificate and key of the listener
+func TestLibApi(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cc := newLibConfig(f)
+
+	cert, err := GetCert(WithCmcApi(CmcApi_Lib), WithCmc(cc.Cmc))
+	if err != nil {
+		t.Fatalf("GetCert() error = %v", err)
+	}
+	if _, ok := cert.PrivateKey.(PrivateKey); !ok {
+		t.Fatalf("GetCert() returned key %T, want key signing with the CMC", cert.PrivateKey)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	ln, err := Listen("tcp", "127.0.0.1:0", serverConfig, WithCmcConfig(cc))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan error)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				if c, ok := conn.(*Conn); !ok || c.Result() == nil {
+					err = errors.New("dialer not verified")
+				}
+				conn.Close()
+			}
+			accepted <- err
+		}
+	}()
+
+	opts := []ConnectionOption[CmcConfig]{
+		WithCmcApi(CmcApi_Lib),
+		WithCmc(cc.Cmc),
+		WithCmcCa(f.CaPem()),
+	}
+	conn, err := DialConn("tcp", ln.Addr().String(), clientConfig, opts...)
+	if err != nil {
+		t.Fatalf("DialConn() error = %v", err)
+	}
+	if r := conn.Result(); r == nil || !r.Success {
+		t.Errorf("DialConn() result = %v, want successful result", r)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+
+	// The policies of the configuration are applied by the in-process CMC
+	if !verify.PolicyEngineAvailable(verify.PolicyEngineSelect_JS) {
+		return
+	}
+	cc.Cmc.PolicyEngineSelect = verify.PolicyEngineSelect_JS
+	reject := []byte(`var obj = JSON.parse(json); obj.type == "none"`)
+	_, err = DialConn("tcp", ln.Addr().String(), clientConfig,
+		append(opts, WithCmcPolicies(reject))...)
+	if err == nil {
+		t.Fatalf("DialConn() with rejecting policies succeeded")
+	}
+	<-accepted
+}
@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 )
 
 const timeout = 10 * time.Second
@@ -35,26 +37,49 @@ type Listener struct {
 
 // Implementation of Accept() in net.Listener iface
 // Calls Accept of the net.Listnener and additionally performs remote attestation
-// after connection establishment before returning the connection
+// after connection establishment before returning the connection. If the
+// attestation report of the dialer was verified, the connection is returned as
+// *Conn exposing the peer identity and, if multiple verifiers are configured,
+// their results. Otherwise, the *tls.Conn is returned
 func (ln Listener) Accept() (net.Conn, error) {
 	// Accept TLS connection
 	conn, err := ln.Listener.Accept()
 	if err != nil {
 		return nil, fmt.Errorf("failed to accept connection: %w", err)
 	}
-	err = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	// The connection is only returned after successful attestation and must
+	// be closed otherwise
+	quorum, result, err := ln.attest(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	log.Info("Server-side aTLS connection complete")
+
+	if quorum != nil || result != nil {
+		return &Conn{Conn: conn.(*tls.Conn), quorum: quorum, result: result}, nil
+	}
+	return conn, nil
+}
+
+// attest performs the TLS handshake and the remote attestation on the accepted
+// connection
+func (ln Listener) attest(conn net.Conn) (*QuorumResult, *ar.VerificationResult, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
 	if err != nil {
-		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+		return nil, nil, fmt.Errorf("failed to set read deadline: %w", err)
 	}
 	err = conn.SetWriteDeadline(time.Now().Add(timeout))
 	if err != nil {
-		return nil, fmt.Errorf("failed to set write deadline: %w", err)
+		return nil, nil, fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
 	log.Trace("TLS established. Providing attestation report..")
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok {
-		return nil, errors.New("internal error: failed to convert to tlsconn")
+		return nil, nil, errors.New("internal error: failed to convert to tlsconn")
 	}
 
 	// Usually, not required, as the the first Read or Write will call it
@@ -62,29 +87,26 @@ func (ln Listener) Accept() (net.Conn, error) {
 	// channel binding before sending the first message
 	err = tlsConn.Handshake()
 	if err != nil {
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		return nil, nil, fmt.Errorf("TLS handshake failed: %w", err)
 	}
 
 	cs := tlsConn.ConnectionState()
 	if !cs.HandshakeComplete {
-		return nil, errors.New("internal error: handshake not complete")
+		return nil, nil, errors.New("internal error: handshake not complete")
 	}
 	log.Trace("TLS handshake complete, generating channel bindings")
 	chbindings, err := cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
 	if err != nil {
-		return nil, fmt.Errorf("failed to export keying material for channel binding: %w", err)
+		return nil, nil, fmt.Errorf("failed to export keying material for channel binding: %w", err)
 	}
 
 	// Perform remote attestation with unique channel binding as specified in RFC5056,
 	// RFC5705, and RFC9266
-	err = attestListener(tlsConn, chbindings, ln.CmcConfig)
+	quorum, result, err := attestListener(tlsConn, chbindings, ln.CmcConfig)
 	if err != nil {
-		return nil, fmt.Errorf("remote attestation failed: %w", err)
+		return nil, nil, fmt.Errorf("remote attestation failed: %w", err)
 	}
-
-	log.Info("Server-side aTLS connection complete")
-
-	return conn, nil
+	return quorum, result, nil
 }
 
 // Implementation of Close in net.Listener iface
@@ -122,6 +144,9 @@ func Listen(network, laddr string, config *tls.Config, moreConfigs ...Connection
 	if listener.CmcConfig.CmcApi == nil {
 		return listener, fmt.Errorf("selected CMC API is not implemented")
 	}
+	if err := checkVerifiers(listener.CmcConfig); err != nil {
+		return listener, err
+	}
 
 	// Listen
 	ln, err := tls.Listen(network, laddr, config)
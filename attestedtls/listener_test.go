@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/goleak"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// newLibConfig returns the configuration for mutual attestation via the
+// library API with the fixtures as driver
+func newLibConfig(f *fixtures.Fixtures) *CmcConfig {
+	c := &cmc.Cmc{Drivers: []ar.Driver{f}, Serializer: f.Serializer}
+	c.SetMetadata(f.Metadata)
+	return &CmcConfig{
+		CmcApi: CmcApis[CmcApi_Lib],
+		Ca:     f.CaPem(),
+		Attest: Attest_Mutual,
+		Cmc:    c,
+	}
+}
+
+func countFds(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count file descriptors: %v", err)
+	}
+	return len(fds)
+}
+
+// TestListenerLeaks runs successful and failing connections against the
+// listener and checks that no goroutines or file descriptors are left behind
+func TestListenerLeaks(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	// The peer attests with a different PKI and fails verification
+	peer, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cc := newLibConfig(f)
+	peerCc := newLibConfig(peer)
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	ignore := goleak.IgnoreCurrent()
+	fds := countFds(t)
+
+	ln, err := Listen("tcp", "127.0.0.1:0", serverConfig, WithCmcConfig(cc))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+
+	accepted := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}
+	}()
+
+	const iterations = 50
+	for i := 0; i < iterations; i++ {
+		conn, err := Dial("tcp", addr, clientConfig, WithCmcConfig(cc))
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conn.Close()
+		if err := <-accepted; err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+
+		if _, err := Dial("tcp", addr, clientConfig, WithCmcConfig(peerCc)); err == nil {
+			t.Fatalf("Dial() with failing verification succeeded")
+		}
+		if err := <-accepted; err == nil {
+			t.Fatalf("Accept() with failing verification succeeded")
+		}
+
+		// Clients disconnecting during the TLS handshake
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		raw.Write([]byte{0x16, 0x03, 0x01, 0x02, 0x00})
+		raw.Close()
+		if err := <-accepted; err == nil {
+			t.Fatalf("Accept() of aborted handshake succeeded")
+		}
+
+		// Clients disconnecting while sending the attestation report
+		tlsConn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, 4096)
+		tlsConn.Write(append(length, byte(Attest_Mutual)))
+		tlsConn.Close()
+		if err := <-accepted; err == nil {
+			t.Fatalf("Accept() of aborted attestation succeeded")
+		}
+	}
+
+	ln.Close()
+	<-done
+
+	if err := goleak.Find(ignore); err != nil {
+		t.Errorf("leaked goroutines: %v", err)
+	}
+	if n := countFds(t); n > fds {
+		t.Errorf("leaked %v file descriptors", n-fds)
+	}
+}
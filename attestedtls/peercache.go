@@ -0,0 +1,205 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// flagPeerCache is set in the attestation mode of the peer cache message,
+// which precedes the attestation messages if the peer cache is enabled
+const flagPeerCache byte = 0x80
+
+// ErrMissingCacheEntry is matched by errors.Is if the peer omitted metadata
+// from its report, which the verifier no longer holds
+var ErrMissingCacheEntry = errors.New("missing cache entry")
+
+// MissingCacheEntryError is returned if the report of the peer references
+// metadata items by digest, which the verifier no longer holds. The peer is
+// removed from the peer cache, so that a new connection succeeds with the
+// full report. Dial retries the connection once on this error
+type MissingCacheEntryError struct {
+	Digests []string
+}
+
+func (e *MissingCacheEntryError) Error() string {
+	return fmt.Sprintf("missing cache entry for metadata %v", strings.Join(e.Digests, ", "))
+}
+
+func (e *MissingCacheEntryError) Is(target error) bool {
+	return target == ErrMissingCacheEntry
+}
+
+// PeerCache remembers the digests of the metadata items of the verified
+// reports per peer. Peers are identified by their TLS certificate or, if the
+// peer presents no certificate, by their host. It is safe for concurrent use
+type PeerCache struct {
+	mu    sync.Mutex
+	peers map[string][]string
+}
+
+// NewPeerCache returns an empty peer cache
+func NewPeerCache() *PeerCache {
+	return &PeerCache{peers: map[string][]string{}}
+}
+
+func (c *PeerCache) get(peer string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[peer]
+}
+
+func (c *PeerCache) set(peer string, digests []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[peer] = digests
+}
+
+func (c *PeerCache) forget(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, peer)
+}
+
+// peerKey identifies the peer by the digest of its leaf certificate, or by its
+// host if it did not present a certificate
+func peerKey(conn *tls.Conn) string {
+	cs := conn.ConnectionState()
+	if len(cs.PeerCertificates) > 0 {
+		digest := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		return hex.EncodeToString(digest[:])
+	}
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// exchangePeerCache sends the digests of the metadata items of the peer,
+// which the local cmcd holds, and returns the digests the peer holds of the
+// local metadata items. Both sides send the message asynchronously, as with
+// the attestation messages. Only the verifying side sends digests, the peer
+// cache is not used with multiple verifiers
+func exchangePeerCache(conn *tls.Conn, cc CmcConfig, verifies bool) ([]string, error) {
+	ch := make(chan error, 1)
+
+	var held []string
+	if verifies && len(cc.Verifiers) == 0 {
+		if known := cc.PeerCache.get(peerKey(conn)); len(known) > 0 {
+			var err error
+			held, err = fetchPeerCache(cc, known)
+			if err != nil {
+				log.Warnf("Failed to fetch peer cache, requesting full report: %v", err)
+				held = nil
+			}
+		}
+	}
+	data, err := json.Marshal(held)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal peer cache: %w", err)
+	}
+	msg := append([]byte{byte(cc.Attest) | flagPeerCache}, data...)
+
+	log.Tracef("Sending %v cached metadata digests to peer %v", len(held),
+		conn.RemoteAddr().String())
+	go func() {
+		err := writeMsg(msg, conn, maxMessageSize(cc), ioTimeout)
+		if err != nil {
+			ch <- fmt.Errorf("failed to send peer cache message: %w", err)
+			return
+		}
+		ch <- nil
+	}()
+
+	readvalue, err := readMsg(conn, maxMessageSize(cc), ioTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer cache message: %w", err)
+	}
+	if len(readvalue) == 0 {
+		return nil, errors.New("missing attestation mode")
+	}
+	if readvalue[0]&flagPeerCache == 0 {
+		<-ch
+		return nil, errors.New("peer does not use the peer cache")
+	}
+	if err := checkMode(readvalue[0]&^flagPeerCache, cc.Attest); err != nil {
+		waitMismatch(err, ch)
+		return nil, err
+	}
+	var peerHeld []string
+	if err := json.Unmarshal(readvalue[1:], &peerHeld); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal peer cache message: %w", err)
+	}
+
+	if err := <-ch; err != nil {
+		return nil, fmt.Errorf("failed to write asynchronously: %w", err)
+	}
+	log.Debugf("Peer holds %v of the local metadata items", len(peerHeld))
+
+	return peerHeld, nil
+}
+
+// verifyCached verifies the report of the peer and updates the peer cache: on
+// success, the digests of the metadata items of the report are remembered. If
+// metadata omitted by the peer is missing, the peer is forgotten and a
+// MissingCacheEntryError is returned
+func verifyCached(conn *tls.Conn, chbindings, report []byte, cc CmcConfig,
+) (*QuorumResult, *ar.VerificationResult, error) {
+	if cc.PeerCache == nil {
+		return verifyReport(chbindings, report, cc)
+	}
+
+	var missing []string
+	cb := cc.ResultCb
+	cc.ResultCb = func(r *ar.VerificationResult) {
+		missing = append(missing, r.MissingMetadata...)
+		if cb != nil {
+			cb(r)
+		}
+	}
+
+	peer := peerKey(conn)
+	quorum, result, err := verifyReport(chbindings, report, cc)
+	if len(missing) > 0 {
+		cc.PeerCache.forget(peer)
+		return nil, nil, &MissingCacheEntryError{Digests: missing}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digests, err := verify.MetadataDigests(report)
+	if err != nil {
+		log.Warnf("Failed to get metadata digests of peer: %v", err)
+		cc.PeerCache.forget(peer)
+	} else {
+		cc.PeerCache.set(peer, digests)
+	}
+
+	return quorum, result, nil
+}
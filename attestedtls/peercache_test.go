@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || libapi
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// cacheApi records the cached metadata digests passed for the generation of
+// the reports. If stale is set, the cmcd claims to hold all metadata items
+type cacheApi struct {
+	LibApi
+	mu     sync.Mutex
+	cached [][]string
+	stale  bool
+}
+
+func (a *cacheApi) obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
+	a.mu.Lock()
+	a.cached = append(a.cached, cached)
+	a.mu.Unlock()
+	return a.LibApi.obtainAR(cc, chbindings, cached)
+}
+
+func (a *cacheApi) fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+	if a.stale {
+		return digests, nil
+	}
+	return a.LibApi.fetchPeerCache(cc, digests)
+}
+
+func (a *cacheApi) omitted() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := make([]int, 0, len(a.cached))
+	for _, c := range a.cached {
+		n = append(n, len(c))
+	}
+	a.cached = nil
+	return n
+}
+
+// TestPeerCache establishes repeat connections with the peer cache, where the
+// listener omits the metadata the dialer holds. If the cache of the dialer is
+// stale, the connection is retried with the full report
+func TestPeerCache(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+	cache.Flush("peerMetadata")
+	t.Cleanup(func() { cache.Flush("peerMetadata") })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	listenerApi := &cacheApi{}
+	lcc := newLibConfig(f)
+	lcc.Attest = Attest_Server
+	lcc.CmcApi = listenerApi
+	lcc.PeerCache = NewPeerCache()
+
+	ln, err := Listen("tcp", "127.0.0.1:0", serverConfig, WithCmcConfig(lcc))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan error, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}
+	}()
+
+	dialerApi := &cacheApi{}
+	dcc := newLibConfig(f)
+	dcc.Attest = Attest_Server
+	dcc.CmcApi = dialerApi
+	dcc.PeerCache = NewPeerCache()
+	all := len(f.Metadata)
+
+	tests := []struct {
+		name        string
+		stale       bool
+		flush       bool
+		wantOmitted []int
+	}{
+		{"First Connection", false, false, []int{0}},
+		{"Cache Hit", false, false, []int{all}},
+		{"Cache Flushed", false, true, []int{0}},
+		{"Stale Cache", true, true, []int{all, 0}},
+		{"Cache Hit After Retry", false, false, []int{all}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialerApi.stale = tt.stale
+			if tt.flush {
+				cache.Flush("peerMetadata")
+			}
+
+			conn, err := DialConn("tcp", ln.Addr().String(), clientConfig, WithCmcConfig(dcc))
+			if err != nil {
+				t.Fatalf("DialConn() error = %v", err)
+			}
+			if r := conn.Result(); r == nil || !r.Success {
+				t.Errorf("DialConn() result = %v, want successful result", r)
+			}
+			conn.Close()
+
+			// On a stale cache, the listener may finish before the dialer
+			// rejects the report and retries, which is not an error
+			for range tt.wantOmitted {
+				<-accepted
+			}
+			got := listenerApi.omitted()
+			if len(got) != len(tt.wantOmitted) {
+				t.Fatalf("omitted metadata items = %v, want %v", got, tt.wantOmitted)
+			}
+			for i := range got {
+				if got[i] != tt.wantOmitted[i] {
+					t.Errorf("omitted metadata items = %v, want %v", got, tt.wantOmitted)
+				}
+			}
+		})
+	}
+
+	// Peers without the peer cache are rejected with a descriptive error
+	plain := newLibConfig(f)
+	plain.Attest = Attest_Server
+	_, err = DialConn("tcp", ln.Addr().String(), clientConfig, WithCmcConfig(plain))
+	if err == nil {
+		t.Fatalf("DialConn() without peer cache succeeded")
+	}
+	<-accepted
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// The time a verifier of a quorum has to verify the report if not specified
+const verifierTimeoutDefault = timeoutSec * time.Second
+
+// Verifier is one of several independent verification backends, e.g. the
+// local cmcd and a remote verification service, the attestation report of the
+// peer is submitted to
+type Verifier struct {
+	// Name identifying the verifier in the results
+	Name string
+	// Configuration of the verifier: API, address, network, CA, policies and
+	// optionally the CMC for the Lib API
+	Config CmcConfig
+	// Optional time the verifier has to verify the report (default 10s)
+	Timeout time.Duration
+}
+
+// QuorumRule specifies how the results of the verifiers are combined
+type QuorumRule struct {
+	// Number of verifiers that must accept the report. Zero requires all
+	// verifiers to accept the report
+	Required int
+	// Ignore timed out verifiers instead of counting them as failed. The
+	// number of required verifiers is limited to the verifiers that answered,
+	// at least one of which must accept the report
+	BestEffort bool
+}
+
+// VerifierResult is the outcome of an individual verifier of the quorum
+type VerifierResult struct {
+	Name string
+	// The verification result, nil if the verifier failed without result or
+	// timed out
+	Result   *ar.VerificationResult
+	Err      error
+	TimedOut bool
+}
+
+// QuorumResult is the combined outcome of the verifiers of the quorum
+type QuorumResult struct {
+	Success  bool
+	Passed   int
+	Required int
+	Results  []VerifierResult
+}
+
+// Conn is an attested TLS connection, which additionally exposes the
+// identity of the peer and the combined and individual results of the
+// verifiers, if multiple verifiers were configured
+type Conn struct {
+	*tls.Conn
+	quorum *QuorumResult
+	result *ar.VerificationResult
+}
+
+// Result returns the verification result of the peer's attestation report, or
+// nil if the report was not verified. If multiple verifiers were configured,
+// the result of the first accepting verifier is returned
+func (c *Conn) Result() *ar.VerificationResult {
+	return c.result
+}
+
+// Quorum returns the combined verification result of the peer's attestation
+// report, or nil if the report was not verified by multiple verifiers
+func (c *Conn) Quorum() *QuorumResult {
+	return c.quorum
+}
+
+// PeerIdentity returns the identity of the peer extracted from the result of
+// the verification of its attestation report. If multiple verifiers were
+// configured, the result of the first accepting verifier is used
+func (c *Conn) PeerIdentity() (ar.Identity, error) {
+	if c.result == nil {
+		return ar.Identity{}, errors.New("attestation report of peer was not verified")
+	}
+	return ar.PeerIdentity(c.result)
+}
+
+// WithVerifiers specifies multiple verifiers the attestation report of the
+// peer is submitted to concurrently instead of the CMC API. The connection is
+// only accepted if the results satisfy the rule
+func WithVerifiers(rule QuorumRule, verifiers ...Verifier) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.Quorum = rule
+		c.Verifiers = verifiers
+	}
+}
+
+// checkVerifiers checks that the rule can be satisfied by the verifiers
+func checkVerifiers(cc CmcConfig) error {
+	if len(cc.Verifiers) == 0 {
+		return nil
+	}
+	if cc.Quorum.Required < 0 || cc.Quorum.Required > len(cc.Verifiers) {
+		return fmt.Errorf("quorum of %v not possible with %v verifiers", cc.Quorum.Required,
+			len(cc.Verifiers))
+	}
+	for i, v := range cc.Verifiers {
+		if v.Config.CmcApi == nil {
+			return fmt.Errorf("selected CMC API of verifier %v (%v) is not implemented", i, v.Name)
+		}
+	}
+	return nil
+}
+
+// verifyReport verifies the attestation report of the peer with the CMC API
+// or, if configured, with all verifiers of the quorum, and applies the result
+// check of the application. The verification result the peer identity is
+// extracted from is returned as well
+func verifyReport(chbindings, report []byte, cc CmcConfig,
+) (*QuorumResult, *ar.VerificationResult, error) {
+	q, result, err := verifyReportResult(chbindings, report, cc)
+	if cc.ResultCheck == nil || result == nil {
+		return q, result, err
+	}
+	if cerr := cc.ResultCheck(*result); cerr != nil {
+		if err == nil {
+			err = fmt.Errorf("verification result rejected by application: %w", cerr)
+		}
+		return q, nil, err
+	}
+	return q, result, err
+}
+
+func verifyReportResult(chbindings, report []byte, cc CmcConfig,
+) (*QuorumResult, *ar.VerificationResult, error) {
+	if len(cc.Verifiers) == 0 {
+		var result *ar.VerificationResult
+		cb := cc.ResultCb
+		cc.ResultCb = func(r *ar.VerificationResult) {
+			result = r
+			if cb != nil {
+				cb(r)
+			}
+		}
+		err := verifyAR(chbindings, report, cc)
+		return nil, result, err
+	}
+
+	q := verifyQuorum(chbindings, report, cc)
+
+	// The results are passed to the callback sequentially after all verifiers
+	// finished, as the callback is not required to be safe for concurrent use
+	if cc.ResultCb != nil {
+		for _, r := range q.Results {
+			if r.Result != nil {
+				cc.ResultCb(r.Result)
+			}
+		}
+	}
+
+	if !q.Success {
+		return q, nil, fmt.Errorf("attestation report accepted by %v of %v required verifiers",
+			q.Passed, q.Required)
+	}
+	var result *ar.VerificationResult
+	for _, r := range q.Results {
+		if r.Err == nil && r.Result != nil {
+			result = r.Result
+			break
+		}
+	}
+	return q, result, nil
+}
+
+// verifyQuorum submits the attestation report to all verifiers concurrently
+// and combines their results according to the rule
+func verifyQuorum(chbindings, report []byte, cc CmcConfig) *QuorumResult {
+
+	type done struct {
+		result *ar.VerificationResult
+		err    error
+	}
+
+	// Buffered, so that the goroutines of timed out verifiers terminate
+	start := time.Now()
+	chans := make([]chan done, len(cc.Verifiers))
+	for i, v := range cc.Verifiers {
+		chans[i] = make(chan done, 1)
+		go func(v Verifier, ch chan done) {
+			var result *ar.VerificationResult
+			vc := v.Config
+			vc.ResultCb = func(r *ar.VerificationResult) { result = r }
+			err := verifyAR(chbindings, report, vc)
+			ch <- done{result, err}
+		}(v, chans[i])
+	}
+
+	q := &QuorumResult{
+		Results: make([]VerifierResult, len(cc.Verifiers)),
+	}
+	answered := 0
+	for i, v := range cc.Verifiers {
+		timeout := v.Timeout
+		if timeout <= 0 {
+			timeout = verifierTimeoutDefault
+		}
+		timer := time.NewTimer(time.Until(start.Add(timeout)))
+
+		r := VerifierResult{Name: v.Name}
+		select {
+		case d := <-chans[i]:
+			r.Result, r.Err = d.result, d.err
+			answered++
+			if r.Err == nil {
+				q.Passed++
+			}
+		case <-timer.C:
+			r.TimedOut = true
+			r.Err = errors.New("verifier timed out")
+		}
+		timer.Stop()
+
+		if r.Err != nil {
+			log.Warnf("Verifier %v rejected attestation report: %v", v.Name, r.Err)
+		}
+		q.Results[i] = r
+	}
+
+	q.Required = cc.Quorum.Required
+	if q.Required == 0 {
+		q.Required = len(cc.Verifiers)
+	}
+	if cc.Quorum.BestEffort && q.Required > answered {
+		q.Required = answered
+	}
+	q.Success = q.Required > 0 && q.Passed >= q.Required
+
+	log.Debugf("Attestation report accepted by %v of %v verifiers (%v required)", q.Passed,
+		len(cc.Verifiers), q.Required)
+
+	return q
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// slowApi delays the verification of the wrapped API
+type slowApi struct {
+	CmcApi
+	delay time.Duration
+}
+
+func (a slowApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
+	time.Sleep(a.delay)
+	return a.CmcApi.verifyAR(chbindings, report, cc)
+}
+
+func Test_verifyQuorum(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	// The second verification service trusts a different CA
+	other, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	local := Verifier{Name: "local", Config: *newLibConfig(f)}
+	remote := Verifier{Name: "remote", Config: *newLibConfig(f)}
+	untrusted := Verifier{Name: "untrusted", Config: *newLibConfig(other)}
+	slow := Verifier{Name: "slow", Config: *newLibConfig(f), Timeout: 10 * time.Millisecond}
+	slow.Config.CmcApi = slowApi{CmcApis[CmcApi_Lib], time.Second}
+
+	tests := []struct {
+		name         string
+		rule         QuorumRule
+		verifiers    []Verifier
+		wantSuccess  bool
+		wantPassed   int
+		wantRequired int
+	}{
+		{"All Agree", QuorumRule{}, []Verifier{local, remote}, true, 2, 2},
+		{"All Disagree", QuorumRule{}, []Verifier{local, untrusted}, false, 1, 2},
+		{"One Of Two", QuorumRule{Required: 1}, []Verifier{local, untrusted}, true, 1, 1},
+		{"Two Of Three", QuorumRule{Required: 2}, []Verifier{local, untrusted, remote}, true, 2, 2},
+		{"Timeout Fails", QuorumRule{}, []Verifier{local, slow}, false, 1, 2},
+		{"Timeout Ignored", QuorumRule{BestEffort: true}, []Verifier{local, slow}, true, 1, 1},
+		{"Timeout Ignored Two Of Three", QuorumRule{Required: 2, BestEffort: true},
+			[]Verifier{local, untrusted, slow}, false, 1, 2},
+		{"All Timed Out", QuorumRule{BestEffort: true}, []Verifier{slow}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := CmcConfig{Verifiers: tt.verifiers, Quorum: tt.rule}
+			if err := checkVerifiers(cc); err != nil {
+				t.Fatalf("checkVerifiers() error = %v", err)
+			}
+			var results []*ar.VerificationResult
+			cc.ResultCb = func(r *ar.VerificationResult) { results = append(results, r) }
+
+			q, _, err := verifyReport(f.Nonce, f.Report, cc)
+			if (err == nil) != tt.wantSuccess {
+				t.Errorf("verifyReport() error = %v, want success %v", err, tt.wantSuccess)
+			}
+			if q.Success != tt.wantSuccess || q.Passed != tt.wantPassed ||
+				q.Required != tt.wantRequired {
+				t.Errorf("quorum = %v (%v/%v), want %v (%v/%v)", q.Success, q.Passed,
+					q.Required, tt.wantSuccess, tt.wantPassed, tt.wantRequired)
+			}
+			if len(q.Results) != len(tt.verifiers) {
+				t.Fatalf("got %v verifier results, want %v", len(q.Results), len(tt.verifiers))
+			}
+			answered := 0
+			for i, r := range q.Results {
+				if r.Name != tt.verifiers[i].Name {
+					t.Errorf("result %v name = %v, want %v", i, r.Name, tt.verifiers[i].Name)
+				}
+				if r.TimedOut != (r.Name == "slow") {
+					t.Errorf("verifier %v timed out = %v", r.Name, r.TimedOut)
+				}
+				if r.Result != nil {
+					answered++
+				}
+			}
+			if len(results) != answered {
+				t.Errorf("got %v results via callback, want %v", len(results), answered)
+			}
+		})
+	}
+}
+
+func Test_verifyReportResultCheck(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	other, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	reject := errors.New("device not allowed")
+
+	tests := []struct {
+		name       string
+		config     *CmcConfig
+		checkErr   error
+		wantErr    bool
+		wantChecks int
+	}{
+		{"No Check", newLibConfig(f), nil, false, 0},
+		{"Accepted", newLibConfig(f), nil, false, 1},
+		{"Rejected", newLibConfig(f), reject, true, 1},
+		// Accepting a failed result does not override the failure
+		{"Failed Result Accepted", newLibConfig(other), nil, true, 1},
+		{"Quorum Rejected", &CmcConfig{Verifiers: []Verifier{{Name: "local",
+			Config: *newLibConfig(f)}}}, reject, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := *tt.config
+			checks := 0
+			if tt.name != "No Check" {
+				WithResultCheck(func(r ar.VerificationResult) error {
+					checks++
+					return tt.checkErr
+				})(&cc)
+			}
+
+			_, result, err := verifyReport(f.Nonce, f.Report, cc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.checkErr != nil && !errors.Is(err, tt.checkErr) {
+				t.Errorf("verifyReport() error = %v, want %v", err, tt.checkErr)
+			}
+			if checks != tt.wantChecks {
+				t.Errorf("result check called %v times, want %v", checks, tt.wantChecks)
+			}
+			if err == nil && result == nil {
+				t.Errorf("verifyReport() returned no result")
+			}
+		})
+	}
+}
+
+func Test_checkVerifiers(t *testing.T) {
+	v := Verifier{Name: "local", Config: CmcConfig{CmcApi: CmcApis[CmcApi_Lib]}}
+	tests := []struct {
+		name    string
+		cc      CmcConfig
+		wantErr bool
+	}{
+		{"No Verifiers", CmcConfig{}, false},
+		{"Valid", CmcConfig{Verifiers: []Verifier{v, v}, Quorum: QuorumRule{Required: 2}}, false},
+		{"Quorum Too Large", CmcConfig{Verifiers: []Verifier{v}, Quorum: QuorumRule{Required: 2}}, true},
+		{"Negative Quorum", CmcConfig{Verifiers: []Verifier{v}, Quorum: QuorumRule{Required: -1}}, true},
+		{"Missing API", CmcConfig{Verifiers: []Verifier{{Name: "remote"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkVerifiers(tt.cc); (err != nil) != tt.wantErr {
+				t.Errorf("checkVerifiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestQuorumConn checks that the listener exposes the results of the
+// verifiers on the accepted connection
+func TestQuorumConn(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	cc := *newLibConfig(f)
+	WithVerifiers(QuorumRule{},
+		Verifier{Name: "local", Config: *newLibConfig(f)},
+		Verifier{Name: "remote", Config: *newLibConfig(f)})(&cc)
+
+	conns := make(pipeListener, 1)
+	ln := Listener{Listener: conns, CmcConfig: cc, Config: serverConfig}
+	client, server := net.Pipe()
+	accepted := make(chan net.Conn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		conns <- tls.Server(server, serverConfig)
+		conn, err := ln.Accept()
+		accepted <- conn
+		errs <- err
+	}()
+
+	if err := dialPipe(client, clientConfig, *newLibConfig(f)); err != nil {
+		t.Fatalf("dialer error = %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("listener error = %v", err)
+	}
+	conn := <-accepted
+	defer conn.Close()
+
+	c, ok := conn.(*Conn)
+	if !ok {
+		t.Fatalf("accepted connection is %T, want *Conn", conn)
+	}
+	q := c.Quorum()
+	if q == nil || !q.Success || q.Passed != 2 || len(q.Results) != 2 {
+		t.Fatalf("quorum = %+v, want success of both verifiers", q)
+	}
+	for _, r := range q.Results {
+		if r.Result == nil || !r.Result.Success {
+			t.Errorf("verifier %v result = %+v, want success", r.Name, r.Result)
+		}
+	}
+}
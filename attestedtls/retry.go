@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	cmcRetryBackoffDefault = 100 * time.Millisecond
+	cmcRetryBackoffMax     = 5 * time.Second
+)
+
+// ErrCmcUnavailable indicates that the cmcd could not be reached or that the
+// connection to it was lost, e.g. because the cmcd was restarted during the
+// handshake. In contrast to failures of the peer, such errors are retryable
+var ErrCmcUnavailable = errors.New("cmcd unavailable")
+
+// CmcUnavailableError is returned if a request to the cmcd failed because the
+// cmcd was not available. It matches ErrCmcUnavailable
+type CmcUnavailableError struct {
+	Op  string
+	Err error
+}
+
+func (e *CmcUnavailableError) Error() string {
+	return fmt.Sprintf("cmcd unavailable during %v: %v", e.Op, e.Err)
+}
+
+func (e *CmcUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CmcUnavailableError) Is(target error) bool {
+	return target == ErrCmcUnavailable
+}
+
+// IsRetryable returns whether the error is caused by the temporary
+// unavailability of the cmcd, so that the connection can be retried
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrCmcUnavailable)
+}
+
+// CmcRetry configures the bounded retry of the requests to the cmcd, if the
+// cmcd is unavailable. The backoff is doubled after each attempt
+type CmcRetry struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// WithCmcRetry specifies the maximum number of attempts of the requests to the
+// cmcd and the backoff before the first retry, if the cmcd is unavailable. The
+// attestation exchange with the peer is never retried, as it must always use
+// fresh channel bindings. If not specified, the requests are not retried
+func WithCmcRetry(attempts int, backoff time.Duration) ConnectionOption[CmcConfig] {
+	return func(c *CmcConfig) {
+		c.Retry = CmcRetry{Attempts: attempts, Backoff: backoff}
+	}
+}
+
+// retryCmc performs the request to the cmcd and retries it with exponential
+// backoff as long as the cmcd is unavailable and attempts are left
+func retryCmc[T any](cc CmcConfig, op string, request func() (T, error)) (T, error) {
+	backoff := cc.Retry.Backoff
+	if backoff <= 0 {
+		backoff = cmcRetryBackoffDefault
+	}
+	for attempt := 1; ; attempt++ {
+		v, err := request()
+		if err == nil || !IsRetryable(err) || attempt >= cc.Retry.Attempts {
+			return v, err
+		}
+		log.Warnf("Failed to %v (attempt %v of %v), retrying in %v: %v", op, attempt,
+			cc.Retry.Attempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > cmcRetryBackoffMax {
+			backoff = cmcRetryBackoffMax
+		}
+	}
+}
+
+// obtainAR obtains the attestation report from the cmcd with retries
+func obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
+	return retryCmc(cc, "obtain attestation report", func() ([]byte, error) {
+		return cc.CmcApi.obtainAR(cc, chbindings, cached)
+	})
+}
+
+// verifyAR verifies the attestation report of the peer via the cmcd with retries
+func verifyAR(chbindings, report []byte, cc CmcConfig) error {
+	_, err := retryCmc(cc, "verify attestation report", func() (struct{}, error) {
+		return struct{}{}, cc.CmcApi.verifyAR(chbindings, report, cc)
+	})
+	return err
+}
+
+// fetchSignature fetches the TLS signature from the cmcd with retries
+func fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return retryCmc(cc, "fetch signature", func() ([]byte, error) {
+		return cc.CmcApi.fetchSignature(cc, digest, opts)
+	})
+}
+
+// fetchPeerCache fetches which of the metadata items the cmcd holds with retries
+func fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+	return retryCmc(cc, "fetch peer cache", func() ([]string, error) {
+		return cc.CmcApi.fetchPeerCache(cc, digests)
+	})
+}
+
+// fetchCerts fetches the TLS certificate chain from the cmcd with retries
+func fetchCerts(cc CmcConfig) ([][]byte, error) {
+	return retryCmc(cc, "fetch certificates", func() ([][]byte, error) {
+		return cc.CmcApi.fetchCerts(cc)
+	})
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attestedtls
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// fakeCmcd serves the gRPC API of the cmcd with the Lib API. If kill is
+// set, the first verification request stops the server mid-handshake
+type fakeCmcd struct {
+	api.UnimplementedCMCServiceServer
+	cc     CmcConfig
+	server *grpc.Server
+	kill   sync.Once
+	killed chan struct{}
+}
+
+func startFakeCmcd(t *testing.T, addr string, cc CmcConfig, kill bool) (*fakeCmcd, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeCmcd{cc: cc, server: grpc.NewServer(), killed: make(chan struct{})}
+	if !kill {
+		s.kill.Do(func() {})
+	}
+	api.RegisterCMCServiceServer(s.server, s)
+	go s.server.Serve(l)
+	t.Cleanup(s.server.Stop)
+	return s, nil
+}
+
+func (s *fakeCmcd) Attest(ctx context.Context, req *api.AttestationRequest,
+) (*api.AttestationResponse, error) {
+	report, err := LibApi{}.obtainAR(s.cc, req.Nonce, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AttestationResponse{Status: api.Status_OK, AttestationReport: report}, nil
+}
+
+func (s *fakeCmcd) Verify(ctx context.Context, req *api.VerificationRequest,
+) (*api.VerificationResponse, error) {
+	s.kill.Do(func() {
+		go func() {
+			s.server.Stop()
+			close(s.killed)
+		}()
+		<-ctx.Done()
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var result *ar.VerificationResult
+	cc := s.cc
+	cc.Ca = req.Ca
+	cc.ResultCb = func(r *ar.VerificationResult) { result = r }
+	if err := (LibApi{}).verifyAR(req.Nonce, req.AttestationReport, cc); result == nil {
+		return nil, err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &api.VerificationResponse{Status: api.Status_OK, VerificationResult: data}, nil
+}
+
+// handshake performs an attested handshake of a dialer with the specified
+// configuration and a listener using the Lib API
+func handshake(f *fixtures.Fixtures, cc CmcConfig) error {
+	cert := tls.Certificate{
+		Certificate: [][]byte{f.Ik.Cert().Raw},
+		PrivateKey:  f.Ik.Priv,
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	conns := make(pipeListener, 1)
+	ln := Listener{Listener: conns, CmcConfig: *newLibConfig(f), Config: serverConfig}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conns <- tls.Server(server, serverConfig)
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	err := dialPipe(client, &tls.Config{InsecureSkipVerify: true}, cc)
+	<-done
+	return err
+}
+
+func TestCmcdRestart(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+	t.Cleanup(CloseCmcConns)
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		retry CmcRetry
+	}{
+		{"No Retry", CmcRetry{}},
+		{"Retry", CmcRetry{Attempts: 10, Backoff: 20 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reserve an address the cmcd is restarted on
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			addr := l.Addr().String()
+			l.Close()
+
+			cc := CmcConfig{
+				CmcApi:  CmcApis[CmcApi_GRPC],
+				CmcAddr: addr,
+				Ca:      f.CaPem(),
+				Attest:  Attest_Mutual,
+				Retry:   tt.retry,
+			}
+			s, err := startFakeCmcd(t, addr, *newLibConfig(f), true)
+			if err != nil {
+				t.Fatalf("failed to start cmcd: %v", err)
+			}
+
+			if tt.retry.Attempts == 0 {
+				err = handshake(f, cc)
+				if !errors.Is(err, ErrCmcUnavailable) || !IsRetryable(err) {
+					t.Fatalf("handshake error = %v, want %v", err, ErrCmcUnavailable)
+				}
+				<-s.killed
+				if _, err := startFakeCmcd(t, addr, *newLibConfig(f), false); err != nil {
+					t.Fatalf("failed to restart cmcd: %v", err)
+				}
+			} else {
+				// The verification request is retried until the cmcd restarted
+				go func() {
+					<-s.killed
+					if _, err := startFakeCmcd(t, addr, *newLibConfig(f), false); err != nil {
+						t.Errorf("failed to restart cmcd: %v", err)
+					}
+				}()
+			}
+
+			// The next dial succeeds with the restarted cmcd
+			if err := handshake(f, cc); err != nil {
+				t.Fatalf("handshake after restart failed: %v", err)
+			}
+		})
+	}
+}
+
+func Test_retryCmc(t *testing.T) {
+	unavailable := &CmcUnavailableError{Op: "verify", Err: errors.New("connection refused")}
+	failed := errors.New("attestation report verification failed")
+
+	tests := []struct {
+		name         string
+		attempts     int
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"Success", 3, []error{nil}, 1, nil},
+		{"Retried", 3, []error{unavailable, unavailable, nil}, 3, nil},
+		{"Exhausted", 2, []error{unavailable, unavailable}, 2, ErrCmcUnavailable},
+		{"Not Retryable", 3, []error{failed}, 1, failed},
+		{"Disabled", 0, []error{unavailable}, 1, ErrCmcUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := CmcConfig{Retry: CmcRetry{Attempts: tt.attempts, Backoff: time.Millisecond}}
+			attempt := 0
+			_, err := retryCmc(cc, "verify", func() (struct{}, error) {
+				err := tt.errs[attempt]
+				attempt++
+				return struct{}{}, err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("retryCmc() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempt != tt.wantAttempts {
+				t.Errorf("attempts = %v, want %v", attempt, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -12,7 +12,6 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
-
 //go:build !nodefaults || socket
 
 package attestedtls
@@ -20,16 +19,16 @@ package attestedtls
 import (
 	"crypto"
 	"crypto/rsa"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 
 	// local modules
 	"github.com/Fraunhofer-AISEC/cmc/api"
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 type SocketApi struct{}
@@ -40,53 +39,18 @@ func init() {
 }
 
 // Obtains attestation report from cmcd
-func (a SocketApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
-
-	// Establish connection
-	log.Tracef("Sending attestation request to cmcd via %v on %v", cc.Network, cc.CmcAddr)
-	conn, err := net.Dial(cc.Network, cc.CmcAddr)
-	if err != nil {
-		return nil, fmt.Errorf("error dialing cmcd: %w", err)
-	}
+func (a SocketApi) obtainAR(cc CmcConfig, chbindings []byte, cached []string) ([]byte, error) {
 
 	req := &api.AttestationRequest{
-		Id:    id,
-		Nonce: chbindings,
-	}
-
-	// Marshal request
-	payload, err := cbor.Marshal(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %w", err)
-	}
-
-	// Send request
-	err = api.Send(conn, payload, api.TypeAttest)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request to cmcd: %w", err)
-	}
-
-	// Read reply
-	payload, mtype, err := api.Receive(conn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive from cmcd: %w", err)
-	}
-
-	if mtype == api.TypeError {
-		resp := new(api.SocketError)
-		err = cbor.Unmarshal(payload, resp)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal error response from cmcd: %w", err)
-		}
-		return nil, fmt.Errorf("received error from cmcd: %v", resp.Msg)
-	} else if mtype != api.TypeAttest {
-		return nil, fmt.Errorf("unexpected response type %v from cmcd", api.TypeToString(mtype))
+		Id:     id,
+		Nonce:  chbindings,
+		Cached: cached,
 	}
 
 	resp := new(api.AttestationResponse)
-	err = cbor.Unmarshal(payload, resp)
+	err := socketRequest(cc, "attest", api.TypeAttest, req, resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal cmcd attestation response body: %w", err)
+		return nil, fmt.Errorf("failed to obtain AR: %w", err)
 	}
 
 	return resp.AttestationReport, nil
@@ -95,58 +59,29 @@ func (a SocketApi) obtainAR(cc CmcConfig, chbindings []byte) ([]byte, error) {
 // Sends attestationreport to cmcd for verification
 func (a SocketApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
-	// Establish connection
-	log.Tracef("Sending verification request to cmcd via %v on %v", cc.Network, cc.CmcAddr)
-	conn, err := net.Dial(cc.Network, cc.CmcAddr)
+	// Create Verification request
+	cas, err := cmcCas(cc)
 	if err != nil {
-		return fmt.Errorf("error dialing: %w", err)
+		return err
 	}
-
-	// Create Verification request
 	req := &api.VerificationRequest{
 		Nonce:             chbindings,
 		AttestationReport: report,
 		Ca:                cc.Ca,
+		Cas:               cas,
 		Policies:          cc.Policies,
 	}
-	payload, err := cbor.Marshal(req)
-	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
-	}
 
 	// Perform Verify request
-	err = api.Send(conn, payload, api.TypeVerify)
-	if err != nil {
-		return fmt.Errorf("failed to send request to cmcd: %w", err)
-	}
-
-	// Read reply
-	payload, mtype, err := api.Receive(conn)
-	if err != nil {
-		return fmt.Errorf("failed to receive from cmcd: %v", err)
-	}
-
-	if mtype == api.TypeError {
-		resp := new(api.SocketError)
-		err = cbor.Unmarshal(payload, resp)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal error response from cmcd: %w", err)
-		}
-		return fmt.Errorf("received error from cmcd: %v", resp.Msg)
-	} else if mtype != api.TypeVerify {
-		return fmt.Errorf("unexpected response type %v from cmcd", api.TypeToString(mtype))
-	}
-
-	// Unmarshal verify response
 	var verifyResp api.VerificationResponse
-	err = cbor.Unmarshal(payload, &verifyResp)
+	err = socketRequest(cc, "verify", api.TypeVerify, req, &verifyResp)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal cmcd verify response: %w", err)
+		return fmt.Errorf("could not obtain verification result: %w", err)
 	}
 
 	// Parse VerificationResult
 	result := new(ar.VerificationResult)
-	err = json.Unmarshal(verifyResp.VerificationResult, result)
+	err = ar.DecodeJson(verifyResp.VerificationResult, result)
 	if err != nil {
 		return fmt.Errorf("could not parse verification result: %w", err)
 	}
@@ -167,19 +102,13 @@ func (a SocketApi) verifyAR(chbindings, report []byte, cc CmcConfig) error {
 
 func (a SocketApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 
-	// Establish connection
-	log.Tracef("Contacting cmcd via %v on %v", cc.Network, cc.CmcAddr)
-	conn, err := net.Dial(cc.Network, cc.CmcAddr)
-	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
-	}
-
 	hash, err := api.SignerOptsToHash(opts)
 	if err != nil {
 		return nil, fmt.Errorf("sign request creation failed: %w", err)
 	}
 
 	req := api.TLSSignRequest{
+		Id:       cc.CertProfile,
 		Content:  digest,
 		Hashtype: hash,
 	}
@@ -189,95 +118,108 @@ func (a SocketApi) fetchSignature(cc CmcConfig, digest []byte, opts crypto.Signe
 		req.PssOpts = &api.PSSOptions{SaltLength: int32(pssOpts.SaltLength)}
 	}
 
-	// Marshal payload
-	payload, err := cbor.Marshal(req)
+	// Send sign request
+	var signResp api.TLSSignResponse
+	err = socketRequest(cc, "sign", api.TypeTLSSign, &req, &signResp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to sign: %w", err)
 	}
 
-	// Send sign request
-	err = api.Send(conn, payload, api.TypeTLSSign)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+	return signResp.SignedContent, nil
+}
+
+// Fetches which of the metadata items of the peer the cmcd holds
+func (a SocketApi) fetchPeerCache(cc CmcConfig, digests []string) ([]string, error) {
+
+	req := &api.PeerCacheRequest{
+		Id:      id,
+		Digests: digests,
 	}
 
-	// Read reply
-	payload, mtype, err := api.Receive(conn)
+	resp := new(api.PeerCacheResponse)
+	err := socketRequest(cc, "peer cache", api.TypePeerCache, req, resp)
 	if err != nil {
-		log.Fatalf("failed to receive: %v", err)
+		return nil, fmt.Errorf("failed to fetch peer cache: %w", err)
 	}
 
-	if mtype == api.TypeError {
-		resp := new(api.SocketError)
-		err = cbor.Unmarshal(payload, resp)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal error response from cmcd: %w", err)
-		}
-		return nil, fmt.Errorf("received error from cmcd: %v", resp.Msg)
-	} else if mtype != api.TypeTLSSign {
-		return nil, fmt.Errorf("unexpected response type %v from cmcd", api.TypeToString(mtype))
+	return resp.Cached, nil
+}
+
+func (a SocketApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
+
+	// Create TLS certificate request
+	req := api.TLSCertRequest{
+		Id: cc.CertProfile,
 	}
 
-	// Unmarshal sign response
-	var signResp api.TLSSignResponse
-	err = cbor.Unmarshal(payload, &signResp)
+	// Send cert request
+	var certResp api.TLSCertResponse
+	err := socketRequest(cc, "fetch certificates", api.TypeTLSCert, &req, &certResp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		return nil, fmt.Errorf("failed to fetch certificates: %w", err)
 	}
 
-	return signResp.SignedContent, nil
+	return certResp.Certificate, nil
 }
 
-func (a SocketApi) fetchCerts(cc CmcConfig) ([][]byte, error) {
+// socketRequest sends the request to the cmcd and decodes the response of the
+// same type. Like with the gRPC API, the connection must be established within
+// the connection timeout and the cmcd must answer within the CMC timeout.
+// Failures to reach the cmcd are returned as CmcUnavailableError
+func socketRequest(cc CmcConfig, op string, t uint32, req, resp any) error {
 
 	// Establish connection
-	log.Tracef("Contacting cmcd via %v on %v", cc.Network, cc.CmcAddr)
-	conn, err := net.Dial(cc.Network, cc.CmcAddr)
+	log.Tracef("Sending %v request to cmcd via %v on %v", op, cc.Network, cc.CmcAddr)
+	conn, err := internal.Dial(cc.Network, cc.CmcAddr, timeoutSec*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %w", err)
+		return fmt.Errorf("error dialing cmcd: %w", &CmcUnavailableError{Op: op, Err: err})
 	}
+	defer conn.Close()
 
-	// Create TLS certificate request
-	req := api.TLSCertRequest{
-		// TODO ID currently not used
-		Id: "",
+	err = conn.SetDeadline(time.Now().Add(cmcTimeout(cc)))
+	if err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
 	}
 
-	// Marshal payload
+	// Marshal request
 	payload, err := cbor.Marshal(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	// Send cert request
-	err = api.Send(conn, payload, api.TypeTLSCert)
+	// Send request
+	err = api.Send(conn, payload, t)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send request to cmcd: %w",
+			&CmcUnavailableError{Op: op, Err: err})
 	}
 
-	// Read reply
-	payload, mtype, err := api.Receive(conn)
+	// Read reply. Responses of protocol versions this implementation does not
+	// speak are rejected before decoding them
+	payload, mtype, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
 	if err != nil {
-		log.Fatalf("failed to receive: %v", err)
+		return fmt.Errorf("failed to receive from cmcd: %w",
+			&CmcUnavailableError{Op: op, Err: err})
+	}
+	if err := api.CheckVersion(version); err != nil {
+		return fmt.Errorf("cannot decode cmcd %v response: %w", op, err)
 	}
 
 	if mtype == api.TypeError {
-		resp := new(api.SocketError)
-		err = cbor.Unmarshal(payload, resp)
+		errResp := new(api.SocketError)
+		err = ar.DecodeCbor(payload, errResp)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal error response from cmcd: %w", err)
+			return fmt.Errorf("failed to unmarshal error response from cmcd: %w", err)
 		}
-		return nil, fmt.Errorf("received error from cmcd: %v", resp.Msg)
-	} else if mtype != api.TypeTLSCert {
-		return nil, fmt.Errorf("unexpected response type %v from cmcd", api.TypeToString(mtype))
+		return fmt.Errorf("received error from cmcd: %w", api.ResponseError(errResp, api.Version1))
+	} else if mtype != t {
+		return fmt.Errorf("unexpected response type %v from cmcd", api.TypeToString(mtype))
 	}
 
-	// Unmarshal cert response
-	var certResp api.TLSCertResponse
-	err = cbor.Unmarshal(payload, &certResp)
+	err = ar.DecodeCbor(payload, resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		return fmt.Errorf("failed to unmarshal cmcd %v response: %w", op, err)
 	}
 
-	return certResp.Certificate, nil
+	return nil
 }
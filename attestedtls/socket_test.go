@@ -0,0 +1,207 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || socket
+
+package attestedtls
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// serveFakeSocketCmc serves the socket API on a unix domain socket and
+// answers the requests with the library API, or never answers if stalled
+func serveFakeSocketCmc(t *testing.T, lib CmcConfig, stalled bool) string {
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if stalled {
+				t.Cleanup(func() { conn.Close() })
+				continue
+			}
+			go handleFakeSocketRequest(conn, lib)
+		}
+	}()
+	return addr
+}
+
+func handleFakeSocketRequest(conn net.Conn, lib CmcConfig) {
+	defer conn.Close()
+	payload, t, err := api.Receive(conn)
+	if err != nil {
+		return
+	}
+
+	var resp any
+	switch t {
+	case api.TypeAttest:
+		var req api.AttestationRequest
+		if err = cbor.Unmarshal(payload, &req); err == nil {
+			var report []byte
+			report, err = LibApi{}.obtainAR(lib, req.Nonce, req.Cached)
+			resp = &api.AttestationResponse{AttestationReport: report}
+		}
+	case api.TypeVerify:
+		var req api.VerificationRequest
+		if err = cbor.Unmarshal(payload, &req); err == nil {
+			var result *ar.VerificationResult
+			vc := lib
+			// Verify against the split CAs like the cmcd
+			vc.Ca, vc.Policies = bytes.Join(req.Cas, nil), req.Policies
+			vc.ResultCb = func(r *ar.VerificationResult) { result = r }
+			LibApi{}.verifyAR(req.Nonce, req.AttestationReport, vc)
+			if result == nil {
+				err = errors.New("verification failed without result")
+			}
+			data, _ := json.Marshal(result)
+			resp = &api.VerificationResponse{VerificationResult: data}
+		}
+	case api.TypeTLSSign:
+		var req api.TLSSignRequest
+		if err = cbor.Unmarshal(payload, &req); err == nil {
+			opts, _ := api.HashToSignerOpts(req.Hashtype, req.PssOpts)
+			var sig []byte
+			sig, err = LibApi{}.fetchSignature(lib, req.Content, opts)
+			resp = &api.TLSSignResponse{SignedContent: sig}
+		}
+	case api.TypeTLSCert:
+		var certs [][]byte
+		certs, err = LibApi{}.fetchCerts(lib)
+		resp = &api.TLSCertResponse{Certificate: certs}
+	default:
+		err = errors.New("unsupported request type")
+	}
+	if err != nil {
+		data, _ := cbor.Marshal(&api.SocketError{Msg: err.Error()})
+		api.Send(conn, data, api.TypeError)
+		return
+	}
+	data, _ := cbor.Marshal(resp)
+	api.Send(conn, data, t)
+}
+
+func TestSocketApi(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	// The CA is specified as bundle of the root of another PKI and the root
+	// the reports chain up to
+	other, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	cc := CmcConfig{
+		CmcApi:  CmcApis[CmcApi_Socket],
+		CmcAddr: serveFakeSocketCmc(t, *newLibConfig(f), false),
+		Network: "unix",
+		Ca:      append(other.CaPem(), f.CaPem()...),
+		Attest:  Attest_Mutual,
+	}
+	stalled := cc
+	stalled.CmcAddr = serveFakeSocketCmc(t, *newLibConfig(f), true)
+	stalled.CmcTimeout = 100 * time.Millisecond
+
+	testCmcApi(t, cc, stalled)
+}
+
+func Test_socketRequestVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		respond     func(conn net.Conn)
+		wantErr     bool
+		wantVersion *api.VersionError
+	}{
+		{"Matching Version", func(conn net.Conn) {
+			data, _ := cbor.Marshal(&api.TLSCertResponse{Certificate: [][]byte{[]byte("cert")}})
+			api.SendVersion(conn, data, api.TypeTLSCert, api.Version1)
+		}, false, nil},
+		{"Newer Server Response", func(conn net.Conn) {
+			api.SendVersion(conn, []byte{0xff}, api.TypeTLSCert, api.MaxVersion+1)
+		}, true, &api.VersionError{Version: api.MaxVersion + 1, Min: api.MinVersion,
+			Max: api.MaxVersion}},
+		{"Request Version Rejected", func(conn net.Conn) {
+			data, _ := cbor.Marshal(&api.SocketError{Msg: "unsupported", MinVersion: 2,
+				MaxVersion: 3})
+			api.Send(conn, data, api.TypeError)
+		}, true, &api.VersionError{Version: api.Version1, Min: 2, Max: 3}},
+		{"Plain Error", func(conn net.Conn) {
+			data, _ := cbor.Marshal(&api.SocketError{Msg: "failed"})
+			api.Send(conn, data, api.TypeError)
+		}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := filepath.Join(t.TempDir(), "cmcd.sock")
+			l, err := net.Listen("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if _, _, err := api.Receive(conn); err == nil {
+					tt.respond(conn)
+				}
+			}()
+
+			var resp api.TLSCertResponse
+			err = socketRequest(CmcConfig{Network: "unix", CmcAddr: addr}, "fetch certificates",
+				api.TypeTLSCert, &api.TLSCertRequest{}, &resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socketRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var verr *api.VersionError
+			if ok := errors.As(err, &verr); ok != (tt.wantVersion != nil) {
+				t.Fatalf("socketRequest() error = %v, want version error %v", err,
+					tt.wantVersion)
+			}
+			if tt.wantVersion != nil && *verr != *tt.wantVersion {
+				t.Errorf("version error = %v, want %v", verr, tt.wantVersion)
+			}
+		})
+	}
+}
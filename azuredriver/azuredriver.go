@@ -0,0 +1,350 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azuredriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "azuredriver")
+
+const (
+	signingChainFile = "azure_ikchain.pem"
+	privFile         = "azure_ikpriv.key"
+
+	// Azure CVM vTPM NV index of the HCL report and persistent handle of the AK
+	hclReportIndex = tpmutil.Handle(0x01400001)
+	akHandle       = tpmutil.Handle(0x81000003)
+)
+
+var (
+	defaultPcrs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	openTpm = func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenTPM("/dev/tpmrm0")
+	}
+)
+
+// Azure is a driver for Azure confidential VMs based on AMD SEV-SNP. On Azure
+// CVMs, the SNP report is not directly accessible. Instead, the paravisor (HCL)
+// provides an SNP report via the vTPM, whose report data binds the vTPM AK.
+// Freshness is provided via a vTPM quote signed with the AK
+type Azure struct {
+	mu               sync.Mutex
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+	storage          string
+	pcrs             []int
+	vcekChain        []*x509.Certificate
+	vcekTcb          uint64
+}
+
+// Init initializes the Azure driver with the specified configuration
+func (a *Azure) Init(c *ar.DriverConfig) error {
+	var err error
+
+	if a == nil {
+		return errors.New("internal error: Azure object is nil")
+	}
+	switch c.Serializer.(type) {
+	case ar.JsonSerializer:
+	case ar.CborSerializer:
+	default:
+		return fmt.Errorf("serializer not initialized in driver config")
+	}
+
+	a.pcrs = defaultPcrs
+	if len(c.PcrSelection) > 0 {
+		pcrs, ok := c.PcrSelection["sha256"]
+		if !ok || len(c.PcrSelection) != 1 {
+			return errors.New("azure driver only supports the sha256 PCR bank")
+		}
+		a.pcrs = pcrs
+	}
+	a.storage = c.StoragePath
+
+	// Create storage folder for storage of internal data if not existing
+	if c.StoragePath != "" {
+		if err := os.MkdirAll(c.StoragePath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for internal data '%v': %w",
+				c.StoragePath, err)
+		}
+	}
+
+	// Check that the HCL report can be read to fail early on non-Azure platforms
+	rwc, err := openTpm()
+	if err != nil {
+		return fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	_, _, err = readHclReport(rwc)
+	rwc.Close()
+	if err != nil {
+		return err
+	}
+
+	if provisioningRequired(c.StoragePath) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		a.priv = priv
+
+		a.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+			c.ServerAddr, c.BootstrapToken)
+		if err != nil {
+			return fmt.Errorf("failed to get signing cert chain: %w", err)
+		}
+
+		if c.StoragePath != "" {
+			if err := saveCredentials(c.StoragePath, a.signingCertChain, a.priv); err != nil {
+				return fmt.Errorf("failed to save Azure credentials: %w", err)
+			}
+		}
+	} else {
+		a.signingCertChain, a.priv, err = loadCredentials(c.StoragePath)
+		if err != nil {
+			return fmt.Errorf("failed to load Azure credentials: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (a *Azure) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting Azure measurements")
+
+	if a == nil {
+		return ar.Measurement{}, errors.New("internal error: Azure object is nil")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rwc, err := openTpm()
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	defer rwc.Close()
+
+	hclRaw, hcl, err := readHclReport(rwc)
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: a.pcrs}
+	quote, sig, err := tpm2.QuoteRaw(rwc, akHandle, "", "", nonce, sel, tpm2.AlgNull)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get vTPM quote: %w", err)
+	}
+
+	artifacts := make([]ar.Artifact, 0, len(a.pcrs))
+	for _, pcr := range a.pcrs {
+		// Read PCRs one by one, as the TPM returns at most 8 PCRs per command
+		values, err := tpm2.ReadPCRs(rwc, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{pcr}})
+		if err != nil {
+			return ar.Measurement{}, fmt.Errorf("failed to read PCR%v: %w", pcr, err)
+		}
+		p := pcr
+		artifacts = append(artifacts, ar.Artifact{
+			Type:    "PCR Summary",
+			Pcr:     &p,
+			Summary: values[pcr],
+		})
+	}
+
+	certs, err := a.getVcekChain(hcl.SnpReport)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get VCEK chain: %w", err)
+	}
+
+	measurement := ar.Measurement{
+		Type:      "Azure Measurement",
+		Evidence:  quote,
+		Signature: sig,
+		Certs:     internal.WriteCertsDer(certs),
+		Artifacts: artifacts,
+		HclReport: hclRaw,
+	}
+
+	return measurement, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (a *Azure) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (a *Azure) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic
+// crypto interface
+func (a *Azure) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if a == nil {
+		return nil, nil, errors.New("internal error: Azure object is nil")
+	}
+	return a.priv, &a.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (a *Azure) GetCertChain() ([]*x509.Certificate, error) {
+	if a == nil {
+		return nil, errors.New("internal error: Azure object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(a.signingCertChain))
+	return a.signingCertChain, nil
+}
+
+// readHclReport reads the raw HCL report from the vTPM NV index and parses it
+func readHclReport(rwc io.ReadWriter) ([]byte, *verify.HclReport, error) {
+	data, err := tpm2.NVReadEx(rwc, hclReportIndex, hclReportIndex, "", 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read HCL report from NV index 0x%x: %w",
+			hclReportIndex, err)
+	}
+	hcl, err := verify.ParseHclReport(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse HCL report: %w", err)
+	}
+	return data, hcl, nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+func provisioningRequired(p string) bool {
+	// Stateless operation always requires provisioning
+	if p == "" {
+		log.Info("Azure Provisioning REQUIRED")
+		return true
+	}
+
+	// If any of the required files is not present, we need to provision
+	if _, err := os.Stat(path.Join(p, signingChainFile)); err != nil {
+		log.Info("Azure Provisioning REQUIRED")
+		return true
+	}
+	if _, err := os.Stat(path.Join(p, privFile)); err != nil {
+		log.Info("Azure Provisioning REQUIRED")
+		return true
+	}
+
+	log.Info("Azure Provisioning NOT REQUIRED")
+
+	return false
+}
+
+func loadCredentials(p string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := internal.LoadFile(path.Join(p, signingChainFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read IK chain from %v: %w", p, err)
+	}
+	ikchain, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IK certs: %w", err)
+	}
+	log.Tracef("Parsed stored IK chain of length %v", len(ikchain))
+
+	data, err = internal.LoadFile(path.Join(p, privFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key from %v: %w", p, err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return ikchain, priv, nil
+}
+
+func saveCredentials(p string, ikchain []*x509.Certificate, priv crypto.PrivateKey) error {
+	ikchainPem := internal.WriteCertChainPem(ikchain)
+	if err := internal.StoreFile(path.Join(p, signingChainFile), ikchainPem, 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, signingChainFile), err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed marshal private key: %w", err)
+	}
+	if err := internal.StoreFile(path.Join(p, privFile), key, 0600); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, privFile), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azuredriver
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+var (
+	// Azure Trusted Hardware Identity Management (THIM) endpoint of the
+	// instance metadata service (IMDS), which provides the AMD certificates
+	thimUrl = "http://169.254.169.254/metadata/THIM/amd/certification"
+)
+
+type thimCerts struct {
+	VcekCert         string `json:"vcekCert"`
+	Tcbm             string `json:"tcbm"`
+	CertificateChain string `json:"certificateChain"`
+}
+
+// getVcekChain returns the VCEK certificate chain (VCEK, ASK, ARK) for the
+// reported TCB of the SNP report. The chain is taken from memory or the
+// storage cache if present, otherwise it is fetched from the Azure THIM
+// endpoint and cached
+func (a *Azure) getVcekChain(snpReport []byte) ([]*x509.Certificate, error) {
+
+	s, err := verify.DecodeSnpReport(snpReport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SNP report: %w", err)
+	}
+
+	if a.vcekChain != nil && a.vcekTcb == s.ReportedTcb {
+		return a.vcekChain, nil
+	}
+
+	var cacheFile string
+	if a.storage != "" {
+		cacheFile = path.Join(a.storage, fmt.Sprintf("azure_vcek_%x.pem", s.ReportedTcb))
+	}
+
+	var certs []*x509.Certificate
+	if cacheFile != "" {
+		data, err := os.ReadFile(cacheFile)
+		if err == nil {
+			certs, err = parseVcekChain(data)
+		}
+		if err != nil {
+			log.Tracef("VCEK not present at %v, will be downloaded", cacheFile)
+			certs = nil
+		} else {
+			log.Tracef("Using cached VCEK %v", cacheFile)
+		}
+	}
+
+	if certs == nil {
+		data, err := fetchThimCerts(s.ReportedTcb)
+		if err != nil {
+			return nil, err
+		}
+		certs, err = parseVcekChain(data)
+		if err != nil {
+			return nil, err
+		}
+		if cacheFile != "" {
+			if err := os.WriteFile(cacheFile, data, 0644); err != nil {
+				log.Warnf("Failed to cache VCEK: %v", err)
+			}
+		}
+	}
+
+	a.vcekChain = certs
+	a.vcekTcb = s.ReportedTcb
+
+	return certs, nil
+}
+
+func parseVcekChain(data []byte) ([]*x509.Certificate, error) {
+	certs, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VCEK chain: %w", err)
+	}
+	if len(certs) != 3 {
+		return nil, fmt.Errorf("unexpected VCEK chain length %v, expected 3", len(certs))
+	}
+	return certs, nil
+}
+
+// fetchThimCerts fetches the VCEK and the AMD CA chain from the Azure THIM
+// endpoint and returns them PEM encoded
+func fetchThimCerts(tcb uint64) ([]byte, error) {
+
+	log.Tracef("Requesting VCEK from %v", thimUrl)
+
+	req, err := http.NewRequest(http.MethodGet, thimUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create THIM request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error HTTP GET: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Response Status: %v (%v)", resp.StatusCode, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP body: %w", err)
+	}
+
+	var c thimCerts
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal THIM response: %w", err)
+	}
+
+	// The TCB of the VCEK might differ from the reported TCB, e.g., after
+	// firmware updates. The verifier checks the VCEK against the reported TCB
+	if tcbm, err := strconv.ParseUint(c.Tcbm, 16, 64); err != nil || tcbm != tcb {
+		log.Warnf("THIM VCEK TCB %v does not match reported TCB %x", c.Tcbm, tcb)
+	}
+
+	return []byte(c.VcekCert + "\n" + c.CertificateChain), nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azuredriver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const (
+	testTcb = uint64(0x7308000000000003)
+)
+
+func createTestCertPem(t *testing.T, cn string) string {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return string(internal.WriteCertPem(cert))
+}
+
+func createTestSnpReport(tcb uint64) []byte {
+	report := make([]byte, 1184)
+	// Reported TCB offset, Table 21 @ https://www.amd.com/system/files/TechDocs/56860.pdf
+	binary.LittleEndian.PutUint64(report[0x180:], tcb)
+	return report
+}
+
+func Test_getVcekChain(t *testing.T) {
+
+	vcek := createTestCertPem(t, "SEV-VCEK")
+	chain := createTestCertPem(t, "SEV-Milan") + createTestCertPem(t, "ARK-Milan")
+
+	tests := []struct {
+		name     string
+		response *thimCerts
+		status   int
+		cached   bool
+		wantReqs int
+		wantErr  bool
+	}{
+		{
+			name: "Download",
+			response: &thimCerts{
+				VcekCert:         vcek,
+				Tcbm:             fmt.Sprintf("%016X", testTcb),
+				CertificateChain: chain,
+			},
+			status:   http.StatusOK,
+			wantReqs: 1,
+		},
+		{
+			name:     "Cached",
+			status:   http.StatusInternalServerError,
+			cached:   true,
+			wantReqs: 0,
+		},
+		{
+			name: "Incomplete Chain",
+			response: &thimCerts{
+				VcekCert: vcek,
+				Tcbm:     fmt.Sprintf("%016X", testTcb),
+			},
+			status:   http.StatusOK,
+			wantReqs: 1,
+			wantErr:  true,
+		},
+		{
+			name:     "Server Error",
+			status:   http.StatusNotFound,
+			wantReqs: 1,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			reqs := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reqs++
+				if r.Header.Get("Metadata") != "true" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(tt.status)
+				if tt.response != nil {
+					json.NewEncoder(w).Encode(tt.response)
+				}
+			}))
+			defer srv.Close()
+
+			oldUrl := thimUrl
+			thimUrl = srv.URL
+			defer func() { thimUrl = oldUrl }()
+
+			a := &Azure{storage: t.TempDir()}
+			if tt.cached {
+				file := path.Join(a.storage, fmt.Sprintf("azure_vcek_%x.pem", testTcb))
+				if err := os.WriteFile(file, []byte(vcek+chain), 0644); err != nil {
+					t.Fatalf("failed to write cache: %v", err)
+				}
+			}
+
+			certs, err := a.getVcekChain(createTestSnpReport(testTcb))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getVcekChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reqs != tt.wantReqs {
+				t.Errorf("getVcekChain() requests = %v, want %v", reqs, tt.wantReqs)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(certs) != 3 || certs[0].Subject.CommonName != "SEV-VCEK" {
+				t.Fatalf("getVcekChain() returned unexpected chain")
+			}
+
+			// Subsequent calls must be served from memory
+			if _, err := a.getVcekChain(createTestSnpReport(testTcb)); err != nil {
+				t.Fatalf("getVcekChain() error = %v", err)
+			}
+			if reqs != tt.wantReqs {
+				t.Errorf("getVcekChain() did not use memorized chain")
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azurevtpmdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/tpmdriver"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "azurevtpmdriver")
+
+const (
+	signingChainFile = "azure_vtpm_ikchain.pem"
+	privFile         = "azure_vtpm_ikpriv.key"
+	akChainFile      = "azure_vtpm_akchain.pem"
+
+	// Azure vTPM NV index of the AK certificate and persistent handle of the AK
+	akCertIndex = tpmutil.Handle(0x01c101d0)
+	akHandle    = tpmutil.Handle(0x81000003)
+)
+
+var (
+	defaultPcrs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	openTpm = func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenTPM("/dev/tpmrm0")
+	}
+)
+
+// AzureVtpm is a driver for Azure VMs with a platform vTPM, e.g., Trusted
+// Launch VMs. Azure provisions the attestation key (AK) and an AK certificate
+// issued by the Azure Virtual TPM CA into the vTPM. Freshness is provided via
+// a vTPM quote signed with the AK. Additionally, the attested document of the
+// instance metadata service (IMDS) provides the signed VM identity
+type AzureVtpm struct {
+	mu               sync.Mutex
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+	storage          string
+	banks            []tpmdriver.PcrBank
+	akCert           *x509.Certificate
+	akChain          *internal.ChainCache
+	imdsChain        *internal.ChainCache
+}
+
+// Init initializes the Azure vTPM driver with the specified configuration
+func (a *AzureVtpm) Init(c *ar.DriverConfig) error {
+	var err error
+
+	if a == nil {
+		return errors.New("internal error: AzureVtpm object is nil")
+	}
+	switch c.Serializer.(type) {
+	case ar.JsonSerializer:
+	case ar.CborSerializer:
+	default:
+		return fmt.Errorf("serializer not initialized in driver config")
+	}
+
+	a.storage = c.StoragePath
+
+	// Create storage folder for storage of internal data if not existing
+	if c.StoragePath != "" {
+		if err := os.MkdirAll(c.StoragePath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for internal data '%v': %w",
+				c.StoragePath, err)
+		}
+	}
+
+	// Check that the AK matches the AK certificate to fail early on non-Azure
+	// platforms
+	rwc, err := openTpm()
+	if err != nil {
+		return fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	a.akCert, err = readAkCert(rwc)
+	if err == nil {
+		err = checkAk(rwc, a.akCert)
+	}
+	if err == nil {
+		a.banks, err = tpmdriver.SelectPcrBanks(rwc, c.PcrSelection, defaultPcrs)
+		if err != nil {
+			err = fmt.Errorf("failed to determine vTPM quote PCRs: %w", err)
+		}
+	}
+	rwc.Close()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Using Azure AK certificate %v issued by %v", a.akCert.Subject.CommonName,
+		a.akCert.Issuer.CommonName)
+
+	// Fetch the AK certificate chain in advance, failures are retried during
+	// the measurements
+	a.akChain = &internal.ChainCache{Storage: a.storage, File: akChainFile}
+	a.akChain.Get(a.akCert)
+	a.imdsChain = &internal.ChainCache{}
+
+	if provisioningRequired(c.StoragePath) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		a.priv = priv
+
+		a.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+			c.ServerAddr, c.BootstrapToken)
+		if err != nil {
+			return fmt.Errorf("failed to get signing cert chain: %w", err)
+		}
+
+		if c.StoragePath != "" {
+			if err := saveCredentials(c.StoragePath, a.signingCertChain, a.priv); err != nil {
+				return fmt.Errorf("failed to save Azure vTPM credentials: %w", err)
+			}
+		}
+	} else {
+		a.signingCertChain, a.priv, err = loadCredentials(c.StoragePath)
+		if err != nil {
+			return fmt.Errorf("failed to load Azure vTPM credentials: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation. Only the first configured
+// PCR bank is quoted, MeasureAll provides quotes for all configured banks
+func (a *AzureVtpm) Measure(nonce []byte) (ar.Measurement, error) {
+
+	if a == nil {
+		return ar.Measurement{}, errors.New("internal error: AzureVtpm object is nil")
+	}
+	if len(a.banks) == 0 {
+		return ar.Measurement{}, errors.New("internal error: no PCR banks configured")
+	}
+
+	measurements, err := a.measure(nonce, a.banks[:1])
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+	return measurements[0], nil
+}
+
+// MeasureAll implements the attestation report MultiMeasurer interface and
+// returns one Azure vTPM measurement per configured PCR bank
+func (a *AzureVtpm) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+
+	if a == nil {
+		return nil, errors.New("internal error: AzureVtpm object is nil")
+	}
+
+	return a.measure(nonce, a.banks)
+}
+
+// measure quotes the PCR banks with the AK. The attested document is fetched
+// once and contained in the measurement of each bank
+func (a *AzureVtpm) measure(nonce []byte, banks []tpmdriver.PcrBank) ([]ar.Measurement, error) {
+
+	log.Trace("Collecting Azure vTPM measurements")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rwc, err := openTpm()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	defer rwc.Close()
+
+	doc, signer, err := fetchAttestedDocument(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attested document: %w", err)
+	}
+	// The attested document only contains the signer certificate, the issuers
+	// are provided separately
+	docCerts := a.imdsChain.Get(signer)
+	akCerts := a.akChain.Get(a.akCert)
+
+	measurements := make([]ar.Measurement, 0, len(banks))
+	for _, bank := range banks {
+		quote, sig, artifacts, err := tpmdriver.QuoteHandle(rwc, akHandle, a.akCert.PublicKey,
+			nonce, bank)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get vTPM quote of PCR bank %v: %w", bank, err)
+		}
+
+		measurements = append(measurements, ar.Measurement{
+			Type:                  "Azure vTPM Measurement",
+			Evidence:              quote,
+			Signature:             sig,
+			Certs:                 internal.WriteCertsDer(akCerts),
+			Artifacts:             artifacts,
+			AttestedDocument:      doc,
+			AttestedDocumentCerts: internal.WriteCertsDer(docCerts[1:]),
+		})
+	}
+
+	return measurements, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (a *AzureVtpm) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (a *AzureVtpm) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic
+// crypto interface
+func (a *AzureVtpm) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if a == nil {
+		return nil, nil, errors.New("internal error: AzureVtpm object is nil")
+	}
+	return a.priv, &a.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (a *AzureVtpm) GetCertChain() ([]*x509.Certificate, error) {
+	if a == nil {
+		return nil, errors.New("internal error: AzureVtpm object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(a.signingCertChain))
+	return a.signingCertChain, nil
+}
+
+// readAkCert reads the AK certificate from the vTPM NV index
+func readAkCert(rwc io.ReadWriter) (*x509.Certificate, error) {
+	cert, err := internal.ReadNvCert(rwc, akCertIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Azure AK certificate "+
+			"(not running on an Azure VM with vTPM?): %w", err)
+	}
+	return cert, nil
+}
+
+// checkAk checks that the persistent AK matches the public key of the AK
+// certificate
+func checkAk(rwc io.ReadWriter, akCert *x509.Certificate) error {
+	pub, _, _, err := tpm2.ReadPublic(rwc, akHandle)
+	if err != nil {
+		return fmt.Errorf("failed to read Azure AK 0x%x: %w", akHandle, err)
+	}
+	key, err := pub.Key()
+	if err != nil {
+		return fmt.Errorf("failed to get Azure AK public key: %w", err)
+	}
+	k, ok := key.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !k.Equal(akCert.PublicKey) {
+		return errors.New("azure AK does not match AK certificate")
+	}
+	return nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+func provisioningRequired(p string) bool {
+	// Stateless operation always requires provisioning
+	if p == "" {
+		log.Info("Azure vTPM Provisioning REQUIRED")
+		return true
+	}
+
+	// If any of the required files is not present, we need to provision
+	if _, err := os.Stat(path.Join(p, signingChainFile)); err != nil {
+		log.Info("Azure vTPM Provisioning REQUIRED")
+		return true
+	}
+	if _, err := os.Stat(path.Join(p, privFile)); err != nil {
+		log.Info("Azure vTPM Provisioning REQUIRED")
+		return true
+	}
+
+	log.Info("Azure vTPM Provisioning NOT REQUIRED")
+
+	return false
+}
+
+func loadCredentials(p string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := internal.LoadFile(path.Join(p, signingChainFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read IK chain from %v: %w", p, err)
+	}
+	ikchain, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IK certs: %w", err)
+	}
+	log.Tracef("Parsed stored IK chain of length %v", len(ikchain))
+
+	data, err = internal.LoadFile(path.Join(p, privFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key from %v: %w", p, err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return ikchain, priv, nil
+}
+
+func saveCredentials(p string, ikchain []*x509.Certificate, priv crypto.PrivateKey) error {
+	ikchainPem := internal.WriteCertChainPem(ikchain)
+	if err := internal.StoreFile(path.Join(p, signingChainFile), ikchainPem, 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, signingChainFile), err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed marshal private key: %w", err)
+	}
+	if err := internal.StoreFile(path.Join(p, privFile), key, 0600); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, privFile), err)
+	}
+
+	return nil
+}
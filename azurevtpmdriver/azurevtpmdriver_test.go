@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azurevtpmdriver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"go.mozilla.org/pkcs7"
+)
+
+func Test_fetchAttestedDocument(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := fixtures.LeafTemplate(1, "metadata.azure.com", time.Now(), time.Now().Add(time.Hour))
+	leaf, err := fixtures.CreateCert(tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	nonce := []byte{0x01, 0x02, 0x03}
+	sd, err := pkcs7.NewSignedData([]byte(`{"nonce":"` + verify.AzureImdsNonce(nonce) + `"}`))
+	if err != nil {
+		t.Fatalf("failed to create signed data: %v", err)
+	}
+	if err := sd.AddSigner(leaf, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("failed to add signer: %v", err)
+	}
+	doc, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("failed to sign document: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		response any
+		status   int
+		wantErr  bool
+	}{
+		{"Success", imdsResponse{Encoding: "pkcs7",
+			Signature: base64.StdEncoding.EncodeToString(doc)}, http.StatusOK, false},
+		{"Unsupported Encoding", imdsResponse{Encoding: "jwt",
+			Signature: base64.StdEncoding.EncodeToString(doc)}, http.StatusOK, true},
+		{"Invalid Document", imdsResponse{Encoding: "pkcs7",
+			Signature: base64.StdEncoding.EncodeToString([]byte{0x30, 0x00})}, http.StatusOK, true},
+		{"Invalid Response", "garbage", http.StatusOK, true},
+		{"Server Error", nil, http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Metadata") != "true" {
+					t.Errorf("missing Metadata header")
+				}
+				if got := r.URL.Query().Get("nonce"); got != verify.AzureImdsNonce(nonce) {
+					t.Errorf("nonce = %v, want %v", got, verify.AzureImdsNonce(nonce))
+				}
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(tt.response)
+			}))
+			defer srv.Close()
+			imdsUrl = srv.URL + "/metadata/attested/document?api-version=2020-09-01"
+
+			got, signer, err := fetchAttestedDocument(nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchAttestedDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(got, doc) {
+				t.Errorf("fetchAttestedDocument() returned unexpected document")
+			}
+			if !signer.Equal(leaf) {
+				t.Errorf("fetchAttestedDocument() returned signer %v", signer.Subject)
+			}
+		})
+	}
+}
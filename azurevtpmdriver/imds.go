@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azurevtpmdriver
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"go.mozilla.org/pkcs7"
+)
+
+const maxDocumentSize = 64 * 1024
+
+var (
+	// Attested document endpoint of the Azure instance metadata service (IMDS)
+	imdsUrl = "http://169.254.169.254/metadata/attested/document?api-version=2020-09-01"
+
+	imdsClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type imdsResponse struct {
+	Encoding  string `json:"encoding"`
+	Signature string `json:"signature"`
+}
+
+// fetchAttestedDocument fetches the attested document for the nonce from the
+// instance metadata service and returns the DER encoded PKCS#7 signed document
+// and its signer certificate
+func fetchAttestedDocument(nonce []byte) ([]byte, *x509.Certificate, error) {
+
+	u := imdsUrl + "&nonce=" + url.QueryEscape(verify.AzureImdsNonce(nonce))
+	log.Tracef("Requesting attested document from %v", u)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create IMDS request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error HTTP GET: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("HTTP Response Status: %v (%v)", resp.StatusCode, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read HTTP body: %w", err)
+	}
+
+	var r imdsResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal IMDS response: %w", err)
+	}
+	if r.Encoding != "pkcs7" {
+		return nil, nil, fmt.Errorf("unsupported attested document encoding %q", r.Encoding)
+	}
+	doc, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode attested document: %w", err)
+	}
+
+	p7, err := pkcs7.Parse(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse attested document: %w", err)
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, nil, errors.New("attested document does not contain exactly one signer")
+	}
+
+	return doc, signer, nil
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache provides in-memory caches with expiry and least recently used
+// eviction, limits in entries and bytes and deduplication of concurrent fills.
+// The caches are registered by name, so that their status can be queried and
+// they can be flushed, e.g. during incident response
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+)
+
+var log = internal.NewLogger(internal.SubsystemServer, "cache")
+
+// Config contains the limits of a cache. Zero values select the defaults of
+// the cache, negative limits disable the respective limit
+type Config struct {
+	MaxEntries int    `json:"maxEntries,omitempty"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+	Ttl        string `json:"ttl,omitempty"`
+}
+
+// Limits are the parsed limits of a cache. Zero values disable the
+// respective limit
+type Limits struct {
+	MaxEntries int
+	MaxBytes   int64
+	Ttl        time.Duration
+}
+
+// Stats contains the limits, the usage and the counters of a cache
+type Stats struct {
+	Name       string `json:"name" cbor:"0,keyasint"`
+	Entries    int    `json:"entries" cbor:"1,keyasint"`
+	Bytes      int64  `json:"bytes" cbor:"2,keyasint"`
+	MaxEntries int    `json:"maxEntries,omitempty" cbor:"3,keyasint,omitempty"`
+	MaxBytes   int64  `json:"maxBytes,omitempty" cbor:"4,keyasint,omitempty"`
+	Ttl        string `json:"ttl,omitempty" cbor:"5,keyasint,omitempty"`
+	Hits       uint64 `json:"hits" cbor:"6,keyasint"`
+	Misses     uint64 `json:"misses" cbor:"7,keyasint"`
+	Evictions  uint64 `json:"evictions" cbor:"8,keyasint"`
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	size    int64
+	expires time.Time
+}
+
+// call is a fill in progress, which concurrent requests for the same key wait
+// for instead of filling the entry themselves
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Cache is a concurrency-safe cache of values of type V
+type Cache[V any] struct {
+	name string
+	size func(V) int64
+	now  func() time.Time
+
+	mu        sync.Mutex
+	limits    Limits
+	lru       *list.List
+	items     map[string]*list.Element
+	calls     map[string]*call[V]
+	bytes     int64
+	flushes   uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// New creates a cache with the default limits and registers it under the
+// name. The size function returns the size in bytes of a value, without it
+// the byte limit is not enforced
+func New[V any](name string, def Limits, size func(V) int64) *Cache[V] {
+	c := newCache(name, def, size)
+	register(name, c, def)
+	return c
+}
+
+func newCache[V any](name string, l Limits, size func(V) int64) *Cache[V] {
+	if size == nil {
+		size = func(V) int64 { return 0 }
+	}
+	return &Cache[V]{
+		name:   name,
+		size:   size,
+		now:    time.Now,
+		limits: l,
+		lru:    list.New(),
+		items:  make(map[string]*list.Element),
+		calls:  make(map[string]*call[V]),
+	}
+}
+
+// Get returns the value of the key if it is present and not expired
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.get(key)
+	if ok {
+		c.hit()
+	} else {
+		c.miss()
+	}
+	return v, ok
+}
+
+// Set stores the value under the key, evicting the least recently used
+// entries if the limits are exceeded
+func (c *Cache[V]) Set(key string, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, v)
+}
+
+// GetOrFill returns the value of the key. If the key is not present, the value
+// is retrieved with fill and stored unless fill fails. Concurrent calls for a
+// key wait for the first fill and share its result
+func (c *Cache[V]) GetOrFill(key string, fill func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if v, ok := c.get(key); ok {
+		c.hit()
+		c.mu.Unlock()
+		return v, nil
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.hit()
+		c.mu.Unlock()
+		<-cl.done
+		return cl.value, cl.err
+	}
+	c.miss()
+	cl := &call[V]{done: make(chan struct{})}
+	c.calls[key] = cl
+	flushes := c.flushes
+	c.mu.Unlock()
+
+	filled := false
+	defer func() {
+		if !filled {
+			cl.err = fmt.Errorf("fill of %v in cache %v panicked", key, c.name)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		// Values filled before a flush completed are not stored, as they may
+		// originate from the flushed data
+		if cl.err == nil && flushes == c.flushes {
+			c.set(key, cl.value)
+		}
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+	cl.value, cl.err = fill()
+	filled = true
+	return cl.value, cl.err
+}
+
+// Remove removes the key from the cache
+func (c *Cache[V]) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Flush removes all entries from the cache
+func (c *Cache[V]) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log.Debugf("Flushing %v entries of cache %v", c.lru.Len(), c.name)
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.flushes++
+}
+
+// Configure sets the limits of the cache and evicts entries exceeding them
+func (c *Cache[V]) Configure(l Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = l
+	c.evict()
+}
+
+// Stats returns the limits, the usage and the counters of the cache
+func (c *Cache[V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Stats{
+		Name:       c.name,
+		Entries:    c.lru.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.limits.MaxEntries,
+		MaxBytes:   c.limits.MaxBytes,
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evictions:  c.evictions,
+	}
+	if c.limits.Ttl > 0 {
+		s.Ttl = c.limits.Ttl.String()
+	}
+	return s
+}
+
+// get returns the value of the key and marks it as recently used. Must be
+// called with the lock held
+func (c *Cache[V]) get(key string) (V, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		var v V
+		return v, false
+	}
+	ent := e.Value.(*entry[V])
+	if !ent.expires.IsZero() && !c.now().Before(ent.expires) {
+		c.remove(e)
+		c.evicted()
+		var v V
+		return v, false
+	}
+	c.lru.MoveToFront(e)
+	return ent.value, true
+}
+
+// set stores the value. Values exceeding the byte limit on their own are not
+// stored. Must be called with the lock held
+func (c *Cache[V]) set(key string, v V) {
+	size := c.size(v)
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	if c.limits.MaxBytes > 0 && size > c.limits.MaxBytes {
+		log.Tracef("Not caching %v in %v: size %v exceeds limit %v", key, c.name, size,
+			c.limits.MaxBytes)
+		return
+	}
+
+	ent := &entry[V]{key: key, value: v, size: size}
+	if c.limits.Ttl > 0 {
+		ent.expires = c.now().Add(c.limits.Ttl)
+	}
+	c.items[key] = c.lru.PushFront(ent)
+	c.bytes += size
+	c.evict()
+}
+
+// evict removes the least recently used entries until the limits are met.
+// Must be called with the lock held
+func (c *Cache[V]) evict() {
+	for c.lru.Len() > 0 &&
+		((c.limits.MaxEntries > 0 && c.lru.Len() > c.limits.MaxEntries) ||
+			(c.limits.MaxBytes > 0 && c.bytes > c.limits.MaxBytes)) {
+		c.remove(c.lru.Back())
+		c.evicted()
+	}
+}
+
+func (c *Cache[V]) remove(e *list.Element) {
+	ent := c.lru.Remove(e).(*entry[V])
+	delete(c.items, ent.key)
+	c.bytes -= ent.size
+}
+
+func (c *Cache[V]) hit() {
+	c.hits++
+	metrics.CacheHit(c.name)
+}
+
+func (c *Cache[V]) miss() {
+	c.misses++
+	metrics.CacheMiss(c.name)
+}
+
+func (c *Cache[V]) evicted() {
+	c.evictions++
+	metrics.CacheEvicted(c.name)
+}
+
+// Limits parses the configuration. Zero values are replaced by the defaults,
+// negative values disable the respective limit
+func (c Config) Limits(def Limits) (Limits, error) {
+	l := def
+	if c.MaxEntries != 0 {
+		l.MaxEntries = max(c.MaxEntries, 0)
+	}
+	if c.MaxBytes != 0 {
+		l.MaxBytes = max(c.MaxBytes, 0)
+	}
+	if c.Ttl != "" {
+		ttl, err := time.ParseDuration(c.Ttl)
+		if err != nil {
+			return l, fmt.Errorf("failed to parse ttl: %w", err)
+		}
+		if ttl < 0 {
+			return l, fmt.Errorf("negative ttl %v", ttl)
+		}
+		l.Ttl = ttl
+	}
+	return l, nil
+}
+
+func max[T int | int64](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
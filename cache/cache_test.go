@@ -0,0 +1,259 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func newTestCache(l Limits) (*Cache[string], *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newCache("test", l, func(v string) int64 { return int64(len(v)) })
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCache(t *testing.T) {
+	type op struct {
+		set     string
+		get     string
+		advance time.Duration
+	}
+	tests := []struct {
+		name          string
+		limits        Limits
+		ops           []op
+		wantKeys      []string
+		wantMisses    uint64
+		wantEvictions uint64
+	}{
+		{"No Limits", Limits{},
+			[]op{{set: "a"}, {set: "b"}, {set: "c"}, {advance: 1000 * time.Hour}},
+			[]string{"a", "b", "c"}, 0, 0},
+		{"Max Entries", Limits{MaxEntries: 2},
+			[]op{{set: "a"}, {set: "b"}, {set: "c"}},
+			[]string{"b", "c"}, 0, 1},
+		{"Least Recently Used", Limits{MaxEntries: 2},
+			[]op{{set: "a"}, {set: "b"}, {get: "a"}, {set: "c"}},
+			[]string{"a", "c"}, 0, 1},
+		{"Max Bytes", Limits{MaxBytes: 10},
+			[]op{{set: "aaaa"}, {set: "bbbb"}, {set: "cccc"}},
+			[]string{"bbbb", "cccc"}, 0, 1},
+		{"Value Exceeds Max Bytes", Limits{MaxBytes: 3},
+			[]op{{set: "a"}, {set: "bbbb"}},
+			[]string{"a"}, 0, 0},
+		{"Expired", Limits{Ttl: time.Minute},
+			[]op{{set: "a"}, {advance: 30 * time.Second}, {set: "b"}, {advance: 30 * time.Second},
+				{get: "a"}},
+			[]string{"b"}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, now := newTestCache(tt.limits)
+			for _, o := range tt.ops {
+				if o.set != "" {
+					c.Set(o.set, o.set)
+				}
+				if o.get != "" {
+					c.Get(o.get)
+				}
+				*now = now.Add(o.advance)
+			}
+
+			var keys []string
+			for e := c.lru.Front(); e != nil; e = e.Next() {
+				keys = append(keys, e.Value.(*entry[string]).key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			for _, k := range tt.wantKeys {
+				if v, ok := c.Get(k); !ok || v != k {
+					t.Errorf("Get(%v) = %v, %v, want %v", k, v, ok, k)
+				}
+			}
+
+			s := c.Stats()
+			if s.Misses != tt.wantMisses || s.Evictions != tt.wantEvictions {
+				t.Errorf("misses = %v, evictions = %v, want %v, %v", s.Misses, s.Evictions,
+					tt.wantMisses, tt.wantEvictions)
+			}
+			var bytes int64
+			for _, k := range keys {
+				bytes += int64(len(k))
+			}
+			if s.Entries != len(keys) || s.Bytes != bytes {
+				t.Errorf("entries = %v, bytes = %v, want %v, %v", s.Entries, s.Bytes, len(keys),
+					bytes)
+			}
+		})
+	}
+}
+
+func TestGetOrFill(t *testing.T) {
+	c, _ := newTestCache(Limits{})
+
+	// Concurrent requests for a key share a single fill
+	var fills int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrFill("key", func() (string, error) {
+				atomic.AddInt32(&fills, 1)
+				<-release
+				return "value", nil
+			})
+			if err != nil || v != "value" {
+				t.Errorf("GetOrFill() = %v, %v, want value", v, err)
+			}
+		}()
+	}
+	// Wait until the first fill is in progress
+	for atomic.LoadInt32(&fills) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if fills != 1 {
+		t.Errorf("fills = %v, want 1", fills)
+	}
+	if s := c.Stats(); s.Hits != 49 || s.Misses != 1 {
+		t.Errorf("hits = %v, misses = %v, want 49, 1", s.Hits, s.Misses)
+	}
+
+	// Failed fills are not cached
+	fail := errors.New("not available")
+	if _, err := c.GetOrFill("failing", func() (string, error) { return "", fail }); err != fail {
+		t.Errorf("GetOrFill() error = %v, want %v", err, fail)
+	}
+	if _, ok := c.Get("failing"); ok {
+		t.Errorf("failed fill was cached")
+	}
+
+	// Panicking fills release waiting requests with an error
+	func() {
+		defer func() { recover() }()
+		c.GetOrFill("panic", func() (string, error) { panic("fill failed") })
+	}()
+	if _, err := c.GetOrFill("panic", func() (string, error) { return "ok", nil }); err != nil {
+		t.Errorf("GetOrFill() after panic error = %v", err)
+	}
+
+	// Values filled while the cache is flushed are not stored
+	_, err := c.GetOrFill("flushed", func() (string, error) {
+		c.Flush()
+		return "stale", nil
+	})
+	if err != nil {
+		t.Fatalf("GetOrFill() error = %v", err)
+	}
+	if _, ok := c.Get("flushed"); ok {
+		t.Errorf("value filled during flush was cached")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c, _ := newTestCache(Limits{MaxEntries: 16, MaxBytes: 64})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("%v", (i*j)%32)
+				switch j % 5 {
+				case 0:
+					c.Set(key, key)
+				case 1:
+					c.Get(key)
+				case 2:
+					c.GetOrFill(key, func() (string, error) { return key, nil })
+				case 3:
+					c.Stats()
+				case 4:
+					if j%100 == 4 {
+						c.Flush()
+					} else {
+						c.Remove(key)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := c.Stats()
+	if s.Entries > 16 || s.Bytes > 64 {
+		t.Errorf("entries = %v, bytes = %v exceed limits", s.Entries, s.Bytes)
+	}
+}
+
+// registryTestCache is registered once, as registering a name twice panics
+var registryTestCache = New[int]("registry-test", Limits{MaxEntries: 10, Ttl: time.Hour}, nil)
+
+func TestRegistry(t *testing.T) {
+	c := registryTestCache
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	if !slices.Contains(Names(), "registry-test") {
+		t.Fatalf("Names() = %v, does not contain registry-test", Names())
+	}
+
+	// Zero values select the defaults, negative values disable the limit
+	if err := Configure("registry-test", Config{MaxEntries: 1}); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	if s := c.Stats(); s.Entries != 1 || s.MaxEntries != 1 || s.Ttl != "1h0m0s" {
+		t.Errorf("Stats() = %+v, want one entry and ttl 1h", s)
+	}
+	if err := Configure("registry-test", Config{MaxEntries: -1, Ttl: "10m"}); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	if s := c.Stats(); s.MaxEntries != 0 || s.Ttl != "10m0s" {
+		t.Errorf("Stats() = %+v, want no entry limit and ttl 10m", s)
+	}
+	if err := Configure("registry-test", Config{Ttl: "soon"}); err == nil {
+		t.Errorf("Configure() succeeded with invalid ttl")
+	}
+	if err := Configure("unknown", Config{}); err == nil {
+		t.Errorf("Configure() succeeded for unknown cache")
+	}
+
+	if err := Flush("registry-test"); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := Flush("unknown"); err == nil {
+		t.Errorf("Flush() succeeded for unknown cache")
+	}
+	for _, s := range Status() {
+		if s.Name == "registry-test" && s.Entries != 0 {
+			t.Errorf("entries after flush = %v, want 0", s.Entries)
+		}
+	}
+}
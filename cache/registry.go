@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// cache is the type independent interface of the registered caches
+type cache interface {
+	Flush()
+	Configure(l Limits)
+	Stats() Stats
+}
+
+type registration struct {
+	cache    cache
+	defaults Limits
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]registration{}
+)
+
+func register(name string, c cache, def Limits) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("cache %v already registered", name))
+	}
+	registry[name] = registration{cache: c, defaults: def}
+}
+
+func lookup(name string) (registration, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	r, ok := registry[name]
+	if !ok {
+		return r, fmt.Errorf("unknown cache %v (possible: %v)", name, names())
+	}
+	return r, nil
+}
+
+// names returns the sorted names of the registered caches. Must be called
+// with the lock held
+func names() []string {
+	n := make([]string, 0, len(registry))
+	for name := range registry {
+		n = append(n, name)
+	}
+	sort.Strings(n)
+	return n
+}
+
+// Names returns the sorted names of the registered caches
+func Names() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return names()
+}
+
+// Configure sets the limits of the registered cache. Zero values of the
+// configuration select the defaults of the cache
+func Configure(name string, c Config) error {
+	r, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	l, err := c.Limits(r.defaults)
+	if err != nil {
+		return fmt.Errorf("invalid configuration of cache %v: %w", name, err)
+	}
+	r.cache.Configure(l)
+	return nil
+}
+
+// Flush removes all entries of the registered cache
+func Flush(name string) error {
+	r, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	r.cache.Flush()
+	return nil
+}
+
+// FlushAll removes all entries of all registered caches
+func FlushAll() {
+	for _, name := range Names() {
+		Flush(name)
+	}
+}
+
+// Status returns the statistics of all registered caches sorted by name
+func Status() []Stats {
+	n := Names()
+	stats := make([]Stats, 0, len(n))
+	for _, name := range n {
+		if r, err := lookup(name); err == nil {
+			stats = append(stats, r.cache.Stats())
+		}
+	}
+	return stats
+}
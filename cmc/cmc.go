@@ -16,60 +16,233 @@
 package cmc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/sirupsen/logrus"
-
+	"github.com/Fraunhofer-AISEC/cmc/archive"
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/measure"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+	"github.com/Fraunhofer-AISEC/cmc/sink"
 	verify "github.com/Fraunhofer-AISEC/cmc/verify"
 )
 
 var (
-	log = logrus.WithField("service", "cmc")
+	log = internal.NewLogger(internal.SubsystemServer, "cmc")
 
 	policyEngines = map[string]verify.PolicyEngineSelect{
 		"js":      verify.PolicyEngineSelect_JS,
 		"duktape": verify.PolicyEngineSelect_DukTape,
+		"opa":     verify.PolicyEngineSelect_Opa,
+		"wasm":    verify.PolicyEngineSelect_Wasm,
 	}
 
 	drivers = map[string]ar.Driver{}
 )
 
+// defaultRequestQueueTimeout is the time a request waits for a free slot, if
+// the number of concurrent requests is limited
+const defaultRequestQueueTimeout = 10 * time.Second
+
 type Config struct {
-	Addr           string   `json:"addr"`
-	ProvServerAddr string   `json:"provServerAddr"`
+	Addr           string `json:"addr"`
+	ProvServerAddr string `json:"provServerAddr"`
+	// Optional bootstrap token source for the provisioning server (env:<VAR>, file:<PATH>)
+	BootstrapToken string   `json:"bootstrapToken,omitempty"`
 	Metadata       []string `json:"metadata"`
 	Drivers        []string `json:"drivers"`
+	Signer         string   `json:"signer,omitempty"`
 	UseIma         bool     `json:"useIma"`
 	ImaPcr         int      `json:"imaPcr"`
-	KeyConfig      string   `json:"keyConfig,omitempty"`
-	Api            string   `json:"api"`
-	Network        string   `json:"network,omitempty"`
-	PolicyEngine   string   `json:"policyEngine,omitempty"`
-	LogLevel       string   `json:"logLevel,omitempty"`
-	Storage        string   `json:"storage,omitempty"`
-	Cache          string   `json:"cache,omitempty"`
-	MeasurementLog bool     `json:"measurementLog,omitempty"`
+	// Optional IMA watcher poll interval and path patterns to report, e.g. "/usr/bin/*"
+	ImaPollInterval string   `json:"imaPollInterval,omitempty"`
+	ImaWatchlist    []string `json:"imaWatchlist,omitempty"`
+	KeyConfig       string   `json:"keyConfig,omitempty"`
+	// Optional algorithm of the TPM AK, RSA2048 (default), EC256 or EC384
+	AkKeyConfig string `json:"akKeyConfig,omitempty"`
+	Api         string `json:"api"`
+	Network     string `json:"network,omitempty"`
+	// Optional chunk size for socket API messages, larger reports are sent in chunks
+	SocketChunkSize int `json:"socketChunkSize,omitempty"`
+	// Optional file mode, e.g. "0660", and group of the unix domain socket, as well
+	// as the peers allowed to send the requests of the socket API
+	SocketMode   string        `json:"socketMode,omitempty"`
+	SocketGroup  string        `json:"socketGroup,omitempty"`
+	SocketAccess *SocketAccess `json:"socketAccess,omitempty"`
+	// Optional limit of the concurrently handled socket API requests and the time a
+	// request waits for a free slot, e.g. "5s" (default 10s)
+	MaxConcurrentRequests int    `json:"maxConcurrentRequests,omitempty"`
+	RequestQueueTimeout   string `json:"requestQueueTimeout,omitempty"`
+	PolicyEngine          string `json:"policyEngine,omitempty"`
+	LogLevel              string `json:"logLevel,omitempty"`
+	Storage               string `json:"storage,omitempty"`
+	Cache                 string `json:"cache,omitempty"`
+	MeasurementLog        bool   `json:"measurementLog,omitempty"`
+	RawEventLog           bool   `json:"rawEventLog,omitempty"`
+	// Optional redaction of the IMA file paths in the attestation reports
+	ImaRedaction *ar.RedactionConfig `json:"imaRedaction,omitempty"`
+	// Optional log format ("text" or "json") and log levels overriding the log level
+	// per subsystem, e.g. {"drivers": "trace"}
+	LogFormat string            `json:"logFormat,omitempty"`
+	LogLevels map[string]string `json:"logLevels,omitempty"`
 	// Only for container measurements
 	UseCtr    bool   `json:"useCtr,omitempty"`
 	CtrDriver string `json:"ctrDriver,omitempty"`
 	CtrPcr    int    `json:"ctrPcr,omitempty"`
 	CtrLog    string `json:"ctrLog"`
+	// Optional journal the container measurements are restored from after restarts
+	CtrJournal string `json:"ctrJournal,omitempty"`
+	// Only for the TPM driver: optional persistent key handles
+	AkHandle     string `json:"akHandle,omitempty"`
+	IkHandle     string `json:"ikHandle,omitempty"`
+	EvictHandles bool   `json:"evictHandles,omitempty"`
+	// Only for the TPM driver: optional base NV index for storing the credentials
+	NvIndex string `json:"nvIndex,omitempty"`
+	// Only for the TPM driver: use encrypted and optionally audited TPM sessions
+	EncryptSessions bool `json:"encryptSessions,omitempty"`
+	AuditSessions   bool `json:"auditSessions,omitempty"`
+	// Only for the TPM driver: optional hierarchy and key auth sources (env:<VAR>, file:<PATH>)
+	OwnerAuth       string `json:"ownerAuth,omitempty"`
+	EndorsementAuth string `json:"endorsementAuth,omitempty"`
+	KeyAuth         string `json:"keyAuth,omitempty"`
+	// Only for the TPM driver: optional IK authorization policy over the sha256 PCRs and the key auth
+	IkPolicyPcrs      []int `json:"ikPolicyPcrs,omitempty"`
+	IkPolicyAuthValue bool  `json:"ikPolicyAuthValue,omitempty"`
+	// Only for the SW driver: optional encrypted key storage ("passphrase" or "tpm")
+	SwKeyProtection string `json:"swKeyProtection,omitempty"`
+	SwKeyPassphrase string `json:"swKeyPassphrase,omitempty"`
+	SwKeyPcrs       []int  `json:"swKeyPcrs,omitempty"`
+	// Only for the PKCS#11 driver: module, token and key selection and PIN source
+	Pkcs11Module   string `json:"pkcs11Module,omitempty"`
+	Pkcs11Token    string `json:"pkcs11Token,omitempty"`
+	Pkcs11Slot     string `json:"pkcs11Slot,omitempty"`
+	Pkcs11KeyLabel string `json:"pkcs11KeyLabel,omitempty"`
+	Pkcs11KeyId    string `json:"pkcs11KeyId,omitempty"`
+	Pkcs11Pin      string `json:"pkcs11Pin,omitempty"`
+	// Only for the PSA driver: token provider command and optional IAK certificate chain
+	PsaCommand  string `json:"psaCommand,omitempty"`
+	PsaIakChain string `json:"psaIakChain,omitempty"`
+	// Only for the TDX driver: optional vsock address of the quote generation service
+	TdxQgsAddr string `json:"tdxQgsAddr,omitempty"`
+	// Only for the DCAP driver: unix domain socket of the enclave providing SGX DCAP quotes
+	DcapSocket string `json:"dcapSocket,omitempty"`
+	// Only for the plugin driver: unix domain sockets of the plugins and request timeout
+	PluginSockets []string `json:"pluginSockets,omitempty"`
+	PluginTimeout string   `json:"pluginTimeout,omitempty"`
+	// Only for the TPM driver: optional PCRs to quote per bank, e.g. {"sha256": [0, 1, 7]}
+	PcrSelection map[string][]int `json:"pcrSelection,omitempty"`
+	// Optional automatic certificate renewal, e.g. "720h" to renew 30 days before expiry
+	RenewThreshold string `json:"renewThreshold,omitempty"`
+	RenewInterval  string `json:"renewInterval,omitempty"`
+	RotateKeys     bool   `json:"rotateKeys,omitempty"`
+	// Optional interval of the driver health checks, e.g. "30s" (default 1m)
+	HealthInterval string `json:"healthInterval,omitempty"`
+	// Optional address to serve the metrics under, e.g. "localhost:9090"
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+	// Optional address of the diagnostics listener serving pprof and expvar, restricted
+	// to loopback addresses and unix sockets ("unix:<path>") unless remote is allowed
+	DiagnosticsAddr        string `json:"diagnosticsAddr,omitempty"`
+	DiagnosticsAllowRemote bool   `json:"diagnosticsAllowRemote,omitempty"`
+	// Optional time the server waits for active requests on shutdown, e.g. "10s" (default 30s)
+	ShutdownTimeout string `json:"shutdownTimeout,omitempty"`
+	// Optional enrollment of the certificates of all drivers except the signer with
+	// an attestation report of the already initialized drivers
+	AttestedEnrollment bool `json:"attestedEnrollment,omitempty"`
+	// Optional certificate profiles of the provisioning server the signer enrolls
+	// additional certificates for, selected via the ID of the TLS requests
+	CertProfiles []ar.CertProfile `json:"certProfiles,omitempty"`
+	// Optional drivers which co-sign the attestation reports with the signer. Only
+	// supported by the CBOR serialization, which then creates a COSE_Sign structure
+	// with one signature per signer
+	AdditionalSigners []string `json:"additionalSigners,omitempty"`
+	// Optional retry of failed enrollments with exponential backoff up to the
+	// maximum backoff (default 1h)
+	EnrollRetry      bool   `json:"enrollRetry,omitempty"`
+	EnrollMaxBackoff string `json:"enrollMaxBackoff,omitempty"`
+	// Optional time the evaluation of the custom policies may take, e.g. "2s"
+	// (default 10s), and memory in bytes the wasm policies may use (default
+	// 64 MiB). Only supported by the opa and wasm policy engines
+	PolicyTimeout     string `json:"policyTimeout,omitempty"`
+	PolicyMemoryLimit int64  `json:"policyMemoryLimit,omitempty"`
+	// Optional limits for decoding untrusted CBOR and JSON data, e.g. to verify
+	// reports with huge IMA logs
+	DecodeLimits *ar.DecodeLimits `json:"decodeLimits,omitempty"`
+	// Optional baseline for the accepted algorithms and key sizes of the evidence
+	Appraisal *verify.Appraisal `json:"appraisal,omitempty"`
+	// Optional sources (env:<VARIABLE> or file:<PATH>) of the salts of redacted
+	// event names withheld by the provers
+	RedactionSalts []string `json:"redactionSalts,omitempty"`
+	// Optional serializer ("json" or "cbor") all metadata, generated and
+	// verified reports must use. If not set, the serialization is detected
+	PinSerializer string `json:"pinSerializer,omitempty"`
+	// Optional limits of the in-memory caches by cache name
+	Caches map[string]cache.Config `json:"caches,omitempty"`
+	// Optional memory budget in bytes of concurrent verifications, beyond which
+	// verifications are queued, and the size beyond which reports are spooled to
+	// temporary files in the spool folder (default 16 MiB and the system folder)
+	VerifyMemoryBudget   int64  `json:"verifyMemoryBudget,omitempty"`
+	VerifySpoolThreshold int64  `json:"verifySpoolThreshold,omitempty"`
+	VerifySpoolDir       string `json:"verifySpoolDir,omitempty"`
+	// Optional sinks all verification results are forwarded to
+	ResultSinks []sink.Config `json:"resultSinks,omitempty"`
+	// Optional locations of the signed metadata with the reference values for
+	// verifying Entity Attestation Tokens of attesters other than the CMC
+	EatMetadata []string `json:"eatMetadata,omitempty"`
+	// Optional archive of the verified reports, nonces and results
+	Archive *archive.Config `json:"archive,omitempty"`
+	// Optional time a nonce issued via the nonce API is accepted, e.g. "1m"
+	// (default 5m), and maximum number of outstanding issued nonces (default 4096)
+	NonceTtl  string `json:"nonceTtl,omitempty"`
+	MaxNonces int    `json:"maxNonces,omitempty"`
 }
 
+// Cmc is shared by all request handlers. The exported fields are set by NewCmc
+// and must not be modified afterwards. The metadata is the only state replaced
+// at runtime: it is held as an immutable snapshot, which is swapped atomically
+// on reload, so that each request works on a consistent set of metadata
 type Cmc struct {
-	Metadata           [][]byte
 	PolicyEngineSelect verify.PolicyEngineSelect
-	Drivers            []ar.Driver
+	Drivers            []ar.Driver // The first driver is the designated signer
 	Serializer         ar.Serializer
 	Network            string
-	IntelStorage       string
-	UseCtr             bool
-	CtrDriver          string
-	CtrPcr             int
-	CtrLog             string
+	SocketChunkSize    int           // Chunk size of socket API responses, 0 selects api.MaxMsgLen
+	SocketMode         os.FileMode   // Mode of the unix domain socket, 0 keeps the default
+	SocketGroup        string        // Optional name or ID of the group of the unix domain socket
+	SocketAccess       *SocketAccess // Optional restriction of the socket API requests
+	// Optional limit of the concurrently handled socket API requests, 0 is unlimited
+	MaxConcurrentRequests int
+	RequestQueueTimeout   time.Duration
+	IntelStorage          string
+	UseCtr                bool
+	CtrDriver             string
+	CtrPcr                int
+	CtrLog                string
+	CtrJournal            *measure.Journal    // Optional journal of the container measurements
+	RuntimeLog            *measure.RuntimeLog // Measurements recorded at runtime via the measure API
+	VerifyBudget          *verify.Budget      // Optional, nil admits all verifications
+	Sinks                 sink.Sinks          // Optional sinks of the verification results
+	Archive               *archive.Archive    // Optional archive of the verified reports
+	AdditionalSigners     []ar.Driver         // Optional drivers co-signing with the signer
+	Nonces                *verify.NonceStore  // Nonces issued via the nonce API
+
+	metadata      atomic.Value // [][]byte
+	metadataPaths []string
+	cache         string
+	enrollment    *enrollment
+	renewal       *renewal
+	status        *statusMonitor
+	configDigest  string
 }
 
 func GetDrivers() map[string]ar.Driver {
@@ -81,6 +254,75 @@ func GetPolicyEngines() map[string]verify.PolicyEngineSelect {
 }
 
 func NewCmc(c *Config) (*Cmc, error) {
+	if c.DecodeLimits != nil {
+		if err := ar.SetDecodeLimits(*c.DecodeLimits); err != nil {
+			return nil, fmt.Errorf("failed to set decoding limits: %w", err)
+		}
+	}
+	if c.Appraisal != nil {
+		if err := verify.SetAppraisal(*c.Appraisal); err != nil {
+			return nil, fmt.Errorf("failed to set appraisal baseline: %w", err)
+		}
+	}
+	if c.PolicyTimeout != "" {
+		timeout, err := time.ParseDuration(c.PolicyTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse policy timeout: %w", err)
+		}
+		if err := verify.SetPolicyTimeout(timeout); err != nil {
+			return nil, fmt.Errorf("failed to set policy timeout: %w", err)
+		}
+	}
+	if c.PolicyMemoryLimit != 0 {
+		if err := verify.SetPolicyMemoryLimit(c.PolicyMemoryLimit); err != nil {
+			return nil, fmt.Errorf("failed to set policy memory limit: %w", err)
+		}
+	}
+	if err := ar.SetSerializerPin(c.PinSerializer); err != nil {
+		return nil, fmt.Errorf("failed to pin serializer: %w", err)
+	}
+	if len(c.RedactionSalts) > 0 {
+		salts := make([][]byte, 0, len(c.RedactionSalts))
+		for _, source := range c.RedactionSalts {
+			salt, err := internal.GetSecret(source, "redaction salt")
+			if err != nil {
+				return nil, fmt.Errorf("failed to read redaction salt: %w", err)
+			}
+			salts = append(salts, salt)
+		}
+		verify.SetRedactionSalts(salts)
+	}
+	for name, cc := range c.Caches {
+		if err := cache.Configure(name, cc); err != nil {
+			return nil, fmt.Errorf("failed to configure cache: %w", err)
+		}
+	}
+	if c.MetricsAddr != "" {
+		metrics.EnableCacheMetrics(metrics.Default)
+	}
+	if len(c.EatMetadata) > 0 {
+		eatMetadata, _, err := GetMetadata(c.EatMetadata, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get EAT metadata: %w", err)
+		}
+		if err := verify.SetEatMetadata(eatMetadata); err != nil {
+			return nil, fmt.Errorf("failed to set EAT metadata: %w", err)
+		}
+	}
+
+	var budget *verify.Budget
+	if c.VerifyMemoryBudget != 0 {
+		var err error
+		budget, err = verify.NewBudget(verify.BudgetConfig{
+			Memory:         c.VerifyMemoryBudget,
+			SpoolThreshold: c.VerifySpoolThreshold,
+			SpoolDir:       c.VerifySpoolDir,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure verification memory budget: %w", err)
+		}
+	}
+
 	metadata, s, err := GetMetadata(c.Metadata, c.Cache)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get metadata: %v", err)
@@ -88,18 +330,51 @@ func NewCmc(c *Config) (*Cmc, error) {
 
 	// Create driver configuration
 	driverConf := &ar.DriverConfig{
-		StoragePath:    c.Storage,
-		ServerAddr:     c.ProvServerAddr,
-		KeyConfig:      c.KeyConfig,
-		Metadata:       metadata,
-		UseIma:         c.UseIma,
-		ImaPcr:         c.ImaPcr,
-		MeasurementLog: c.MeasurementLog,
-		Serializer:     s,
-		CtrPcr:         c.CtrPcr,
-		CtrLog:         c.CtrLog,
-		CtrDriver:      c.CtrDriver,
-		UseCtr:         c.UseCtr,
+		StoragePath:       c.Storage,
+		ServerAddr:        c.ProvServerAddr,
+		BootstrapToken:    c.BootstrapToken,
+		KeyConfig:         c.KeyConfig,
+		AkKeyConfig:       c.AkKeyConfig,
+		Metadata:          metadata,
+		UseIma:            c.UseIma,
+		ImaPcr:            c.ImaPcr,
+		ImaWatchlist:      c.ImaWatchlist,
+		ImaPollInterval:   c.ImaPollInterval,
+		ImaRedaction:      c.ImaRedaction,
+		MeasurementLog:    c.MeasurementLog,
+		RawEventLog:       c.RawEventLog,
+		Serializer:        s,
+		CtrPcr:            c.CtrPcr,
+		CtrLog:            c.CtrLog,
+		CtrDriver:         c.CtrDriver,
+		UseCtr:            c.UseCtr,
+		AkHandle:          c.AkHandle,
+		IkHandle:          c.IkHandle,
+		EvictHandles:      c.EvictHandles,
+		PcrSelection:      c.PcrSelection,
+		NvIndex:           c.NvIndex,
+		EncryptSessions:   c.EncryptSessions,
+		AuditSessions:     c.AuditSessions,
+		OwnerAuth:         c.OwnerAuth,
+		EndorsementAuth:   c.EndorsementAuth,
+		KeyAuth:           c.KeyAuth,
+		IkPolicyPcrs:      c.IkPolicyPcrs,
+		IkPolicyAuthValue: c.IkPolicyAuthValue,
+		SwKeyProtection:   c.SwKeyProtection,
+		SwKeyPassphrase:   c.SwKeyPassphrase,
+		SwKeyPcrs:         c.SwKeyPcrs,
+		Pkcs11Module:      c.Pkcs11Module,
+		Pkcs11Token:       c.Pkcs11Token,
+		Pkcs11Slot:        c.Pkcs11Slot,
+		Pkcs11KeyLabel:    c.Pkcs11KeyLabel,
+		Pkcs11KeyId:       c.Pkcs11KeyId,
+		Pkcs11Pin:         c.Pkcs11Pin,
+		PsaCommand:        c.PsaCommand,
+		PsaIakChain:       c.PsaIakChain,
+		TdxQgsAddr:        c.TdxQgsAddr,
+		DcapSocket:        c.DcapSocket,
+		PluginSockets:     c.PluginSockets,
+		PluginTimeout:     c.PluginTimeout,
 	}
 
 	// Get policy engine
@@ -108,18 +383,74 @@ func NewCmc(c *Config) (*Cmc, error) {
 		log.Tracef("No optional policy engine selected or %v not implemented", c.PolicyEngine)
 	}
 
-	// Initialize drivers
-	usedDrivers := make([]ar.Driver, 0)
-	for _, driver := range c.Drivers {
-		d, ok := drivers[strings.ToLower(driver)]
-		if !ok {
-			return nil, fmt.Errorf("driver %v not implemented", driver)
+	// Check that the driver combination is coherent before initializing the
+	// drivers and order the drivers with the designated signer first
+	names, err := orderDrivers(c.Drivers, c.Signer, drivers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid driver configuration: %w", err)
+	}
+	additional, err := orderSigners(c.AdditionalSigners, names, drivers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer configuration: %w", err)
+	}
+	if _, ok := s.(ar.MultiSigner); len(additional) > 0 && !ok {
+		return nil, fmt.Errorf("additional signers not supported by serializer %T", s)
+	}
+
+	// The driver instrumentation must be enabled before the drivers are initialized
+	if c.MetricsAddr != "" {
+		metrics.EnableDriverMetrics(metrics.Default)
+	}
+
+	if len(c.CertProfiles) > 0 && len(names) > 0 {
+		if _, ok := drivers[names[0]].(ar.ProfileProvider); !ok {
+			return nil, fmt.Errorf("signer %v does not support certificate profiles", names[0])
 		}
-		err = d.Init(driverConf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize driver: %w", err)
+	}
+
+	// Initialize the drivers, which enroll their certificates. Failed
+	// initializations are retried with the failed driver, the drivers
+	// initialized before are kept
+	usedDrivers := make([]ar.Driver, 0)
+	renewers := make(map[string]ar.Renewer)
+	initDrivers := func() error {
+		for i := len(usedDrivers); i < len(names); i++ {
+			driver := names[i]
+			d := drivers[driver]
+			// Only the signer enrolls the certificates of the additional profiles
+			driverConf.CertProfiles = nil
+			if i == 0 {
+				driverConf.CertProfiles = c.CertProfiles
+			}
+			err := d.Init(driverConf)
+			if err != nil {
+				return fmt.Errorf("failed to initialize driver %v: %w", driver, err)
+			}
+			usedDrivers = append(usedDrivers, d)
+			if r, ok := d.(ar.Renewer); ok {
+				renewers[driver] = r
+			}
+			if c.AttestedEnrollment && driverConf.Attest == nil {
+				driverConf.Attest = attestFunc(metadata, usedDrivers, s)
+			}
 		}
-		usedDrivers = append(usedDrivers, d)
+		return nil
+	}
+	enrollment, err := newEnrollment(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure enrollment: %w", err)
+	}
+	err = enrollment.run(initDrivers)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		log.Debugf("Using driver %v as signer", names[0])
+	}
+	additionalSigners := make([]ar.Driver, 0, len(additional))
+	for _, name := range additional {
+		log.Debugf("Using driver %v as additional signer", name)
+		additionalSigners = append(additionalSigners, drivers[name])
 	}
 
 	// Check container driver
@@ -129,19 +460,295 @@ func NewCmc(c *Config) (*Cmc, error) {
 				c.CtrDriver)
 		}
 	}
+	journal, err := openCtrJournal(c, s)
+	if err != nil {
+		return nil, err
+	}
+	var mode uint32
+	if c.SocketMode != "" {
+		mode, err = parseSocketMode(c.SocketMode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse socket mode: %w", err)
+		}
+	}
+	queueTimeout := defaultRequestQueueTimeout
+	if c.RequestQueueTimeout != "" {
+		queueTimeout, err = time.ParseDuration(c.RequestQueueTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse request queue timeout: %w", err)
+		}
+	}
+
+	var nonceTtl time.Duration
+	if c.NonceTtl != "" {
+		nonceTtl, err = time.ParseDuration(c.NonceTtl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse nonce TTL: %w", err)
+		}
+	}
 
 	cmc := &Cmc{
-		Metadata:           metadata,
-		PolicyEngineSelect: sel,
-		Drivers:            usedDrivers,
-		Serializer:         s,
-		Network:            c.Network,
-		IntelStorage:       c.Storage,
-		UseCtr:             c.UseCtr,
-		CtrDriver:          c.CtrDriver,
-		CtrPcr:             c.CtrPcr,
-		CtrLog:             c.CtrLog,
+		PolicyEngineSelect:    sel,
+		Drivers:               usedDrivers,
+		AdditionalSigners:     additionalSigners,
+		Serializer:            s,
+		Network:               c.Network,
+		SocketChunkSize:       c.SocketChunkSize,
+		SocketMode:            os.FileMode(mode),
+		SocketGroup:           c.SocketGroup,
+		SocketAccess:          c.SocketAccess,
+		MaxConcurrentRequests: c.MaxConcurrentRequests,
+		RequestQueueTimeout:   queueTimeout,
+		IntelStorage:          c.Storage,
+		UseCtr:                c.UseCtr,
+		CtrDriver:             c.CtrDriver,
+		CtrPcr:                c.CtrPcr,
+		CtrLog:                c.CtrLog,
+		CtrJournal:            journal,
+		RuntimeLog:            measure.NewRuntimeLog(),
+		VerifyBudget:          budget,
+		Nonces:                verify.NewNonceStore(nonceTtl, c.MaxNonces),
+		metadataPaths:         c.Metadata,
+		cache:                 c.Cache,
+		enrollment:            enrollment,
+		configDigest:          configDigest(c),
+	}
+	cmc.SetMetadata(metadata)
+
+	// Check the certificate validity on startup and then periodically renew
+	// the certificates before they expire
+	if c.RenewThreshold != "" && len(renewers) > 0 {
+		cmc.renewal, err = newRenewal(c, renewers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure certificate renewal: %w", err)
+		}
+		cmc.renewal.enrollment = enrollment
+		go cmc.renewal.run()
+	}
+
+	// Collect the driver capabilities and periodically check the driver health
+	cmc.status, err = newStatusMonitor(c, names, usedDrivers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure driver health checks: %w", err)
+	}
+	cmc.status.check()
+	go cmc.status.run()
+
+	if len(c.ResultSinks) > 0 {
+		if c.MetricsAddr != "" {
+			metrics.EnableSinkMetrics(metrics.Default)
+		}
+		cmc.Sinks, err = sink.NewSinks(c.ResultSinks)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure result sinks: %w", err)
+		}
+	}
+
+	if c.Archive != nil {
+		cmc.Archive, err = archive.New(c.Archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure archive: %w", err)
+		}
 	}
 
 	return cmc, nil
 }
+
+// RenewalStatus returns the certificate renewal status of all drivers
+// supporting certificate renewal
+func (c *Cmc) RenewalStatus() []RenewalStatus {
+	if c == nil || c.renewal == nil {
+		return nil
+	}
+	return c.renewal.getStatus()
+}
+
+// EnrollmentStatus returns the enrollment state of the device
+func (c *Cmc) EnrollmentStatus() *ar.EnrollmentStatus {
+	if c == nil || c.enrollment == nil {
+		return nil
+	}
+	s := c.enrollment.getStatus()
+	return &s
+}
+
+// Status returns the capabilities and the health of all drivers with the
+// designated signer first
+func (c *Cmc) Status() []ar.DriverStatus {
+	if c == nil || c.status == nil {
+		return nil
+	}
+	return c.status.getStatus()
+}
+
+// Metadata returns the current snapshot of the signed metadata items. The
+// snapshot is shared and must not be modified
+func (c *Cmc) Metadata() [][]byte {
+	if c == nil {
+		return nil
+	}
+	metadata, _ := c.metadata.Load().([][]byte)
+	return metadata
+}
+
+// Measurers returns the drivers followed by the runtime measurement list, i.e.
+// the measurement interfaces included in the attestation reports
+func (c *Cmc) Measurers() []ar.Driver {
+	if c.RuntimeLog == nil {
+		return c.Drivers
+	}
+	measurers := make([]ar.Driver, 0, len(c.Drivers)+1)
+	measurers = append(measurers, c.Drivers...)
+	return append(measurers, c.RuntimeLog)
+}
+
+// SetMetadata atomically replaces the signed metadata items. The items must
+// not be modified afterwards
+func (c *Cmc) SetMetadata(metadata [][]byte) {
+	c.metadata.Store(metadata)
+}
+
+// ReloadMetadata fetches the metadata from the configured locations again and
+// replaces the current metadata. The current metadata is kept if no metadata
+// could be retrieved or if the serialization changed. The drivers keep the
+// metadata they were initialized with
+func (c *Cmc) ReloadMetadata() error {
+	if c == nil {
+		return errors.New("cmc not initialized")
+	}
+	if len(c.metadataPaths) == 0 {
+		return errors.New("no metadata locations configured")
+	}
+	metadata, s, err := GetMetadata(c.metadataPaths, c.cache)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if len(metadata) == 0 {
+		return errors.New("failed to retrieve any valid metadata")
+	}
+	if s != c.Serializer {
+		return fmt.Errorf("serialization of the metadata changed from %T to %T", c.Serializer, s)
+	}
+	c.SetMetadata(metadata)
+	log.Infof("Reloaded %v metadata objects", len(metadata))
+	return nil
+}
+
+// MetadataStatus returns the status of the loaded metadata items
+func (c *Cmc) MetadataStatus() []ar.MetadataStatus {
+	if c == nil {
+		return nil
+	}
+	return getMetadataStatus(c.Metadata(), c.Serializer)
+}
+
+// MetadataItem returns the signed metadata item with the hex encoded SHA-256
+// digest or a unique prefix of it
+func (c *Cmc) MetadataItem(digest string) ([]byte, error) {
+	if c == nil {
+		return nil, errors.New("cmc not initialized")
+	}
+	return findMetadata(c.Metadata(), digest)
+}
+
+// ConfigDigest returns the hex encoded SHA-256 digest of the configuration
+// the cmc was created with
+func (c *Cmc) ConfigDigest() string {
+	if c == nil {
+		return ""
+	}
+	return c.configDigest
+}
+
+// PublishResult forwards the result of the verification of the report against
+// the nonce, which was requested by the peer via the API at the received time,
+// to the sinks and the archive
+func (c *Cmc) PublishResult(api, peer string, report, nonce []byte, received time.Time,
+	result *ar.VerificationResult,
+) {
+	if c == nil {
+		return
+	}
+	if len(c.Sinks) > 0 {
+		c.Sinks.Publish(sink.NewRecord(api, peer, report, received, result))
+	}
+	c.Archive.Add(archive.NewEntry(api, peer, report, nonce, received, result))
+}
+
+// Close stops the certificate renewal, shuts down the background tasks of the
+// drivers implementing io.Closer and delivers the pending results of the sinks
+// and the archive
+func (c *Cmc) Close() {
+	if c == nil {
+		return
+	}
+	if c.renewal != nil {
+		c.renewal.close()
+	}
+	if err := c.Sinks.Close(); err != nil {
+		log.Warnf("Failed to close result sinks: %v", err)
+	}
+	if err := c.Archive.Close(); err != nil {
+		log.Warnf("Failed to close archive: %v", err)
+	}
+	for _, d := range c.Drivers {
+		if closer, ok := d.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Warnf("Failed to close driver: %v", err)
+			}
+		}
+	}
+}
+
+// openCtrJournal replays the optional container measurement journal and
+// restores the measurement list from it, if the list does not exist
+func openCtrJournal(c *Config, s ar.Serializer) (*measure.Journal, error) {
+	if !c.UseCtr || c.CtrJournal == "" {
+		return nil, nil
+	}
+	journal, err := measure.OpenJournal(c.CtrJournal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open container measurement journal: %w", err)
+	}
+	restored, err := measure.Restore(&measure.MeasureConfig{
+		Serializer: s,
+		LogFile:    c.CtrLog,
+		Journal:    journal,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore container measurements: %w", err)
+	}
+	if restored {
+		log.Infof("Restored container measurements from journal %v", c.CtrJournal)
+	}
+	return journal, nil
+}
+
+func configDigest(c *Config) string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.Warnf("Failed to marshal config: %v", err)
+		return ""
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// attestFunc returns a function creating attestation reports with the
+// measurements of the already initialized drivers, signed by the first driver,
+// which the subsequently initialized drivers use to enroll their certificates
+func attestFunc(metadata [][]byte, initialized []ar.Driver, s ar.Serializer,
+) func(nonce []byte) ([]byte, error) {
+	measurers := append([]ar.Driver{}, initialized...)
+	return func(nonce []byte) ([]byte, error) {
+		report, err := generate.Generate(nonce, metadata, measurers, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate attestation report: %w", err)
+		}
+		signed, err := generate.Sign(report, measurers[0], s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign attestation report: %w", err)
+		}
+		return signed, nil
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// newFixturesCmc returns a cmc with the fixtures as driver and the metadata
+// loaded from the written fixtures
+func newFixturesCmc(t *testing.T, f *fixtures.Fixtures) *Cmc {
+	dir := t.TempDir()
+	if err := f.Write(dir); err != nil {
+		t.Fatalf("failed to write fixtures: %v", err)
+	}
+
+	oldDrivers := drivers
+	drivers = map[string]ar.Driver{"tpm": f}
+	t.Cleanup(func() { drivers = oldDrivers })
+
+	c, err := NewCmc(&Config{
+		Drivers:  []string{"tpm"},
+		Metadata: []string{"file://" + filepath.Join(dir, "metadata")},
+	})
+	if err != nil {
+		t.Fatalf("NewCmc() error = %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// TestCmcConcurrentReload runs attestations, verifications and signatures
+// concurrently with metadata reloads and is meant to be run with -race
+func TestCmcConcurrentReload(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	c := newFixturesCmc(t, f)
+	nonce := f.Nonce
+	ca := f.CaPem()
+
+	const workers = 4
+	const iterations = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*workers*iterations+iterations)
+
+	for i := 0; i < workers; i++ {
+		// Attestation and verification
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				report, err := generate.Generate(nonce, c.Metadata(), c.Drivers, c.Serializer)
+				if err != nil {
+					errs <- fmt.Errorf("Generate() error = %w", err)
+					continue
+				}
+				signed, err := generate.Sign(report, c.Drivers[0], c.Serializer)
+				if err != nil {
+					errs <- fmt.Errorf("Sign() error = %w", err)
+					continue
+				}
+				result := verify.Verify(signed, nonce, ca, nil, c.PolicyEngineSelect,
+					c.IntelStorage)
+				if !result.Success {
+					errs <- fmt.Errorf("verification failed: %v", result.ErrorCode)
+				}
+			}
+		}()
+
+		// TLS signatures
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digest := sha256.Sum256([]byte("tls"))
+			for j := 0; j < iterations; j++ {
+				priv, _, err := c.SigningKeys("")
+				if err != nil {
+					errs <- fmt.Errorf("SigningKeys() error = %w", err)
+					continue
+				}
+				_, err = priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err != nil {
+					errs <- fmt.Errorf("Sign() error = %w", err)
+				}
+			}
+		}()
+
+		// Status requests
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if s := c.MetadataStatus(); len(s) != len(f.Metadata) {
+					errs <- fmt.Errorf("MetadataStatus() returned %v items, want %v", len(s),
+						len(f.Metadata))
+				}
+			}
+		}()
+	}
+
+	// Metadata reloads
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < iterations; j++ {
+			if err := c.ReloadMetadata(); err != nil {
+				errs <- fmt.Errorf("ReloadMetadata() error = %w", err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCmcReloadMetadata(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	c := newFixturesCmc(t, f)
+	if got := len(c.Metadata()); got != len(f.Metadata) {
+		t.Fatalf("Metadata() returned %v items, want %v", got, len(f.Metadata))
+	}
+
+	// Metadata with a different serialization must not replace the metadata
+	cf, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{}})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	dir := t.TempDir()
+	if err := cf.Write(dir); err != nil {
+		t.Fatalf("failed to write fixtures: %v", err)
+	}
+	before := c.Metadata()
+	c.metadataPaths = []string{"file://" + filepath.Join(dir, "metadata")}
+	if err := c.ReloadMetadata(); err == nil {
+		t.Errorf("ReloadMetadata() with changed serialization succeeded")
+	}
+	c.metadataPaths = []string{"file://" + filepath.Join(dir, "missing")}
+	if err := c.ReloadMetadata(); err == nil {
+		t.Errorf("ReloadMetadata() without metadata succeeded")
+	}
+	if got := c.Metadata(); len(got) != len(before) || &got[0] != &before[0] {
+		t.Errorf("metadata replaced by failed reload")
+	}
+
+	if err := (&Cmc{}).ReloadMetadata(); err == nil {
+		t.Errorf("ReloadMetadata() without metadata locations succeeded")
+	}
+	if got := (&Cmc{}).Metadata(); got != nil {
+		t.Errorf("Metadata() of empty cmc = %v, want nil", got)
+	}
+}
+
+// TestCmcLogsNoSecrets runs an attestation and a signature with trace logging
+// and checks that the emitted logs do not contain key material or the PIN
+func TestCmcLogsNoSecrets(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	var logs bytes.Buffer
+	if err := internal.ConfigureLogging("json", logrus.TraceLevel, nil, &logs); err != nil {
+		t.Fatalf("ConfigureLogging() error = %v", err)
+	}
+	t.Cleanup(func() {
+		internal.ConfigureLogging("text", logrus.InfoLevel, nil, os.Stderr)
+	})
+
+	// A PIN misconfigured as literal source must not be part of the error
+	const pin = "cmc-test-pin-4711"
+	c := newFixturesCmc(t, f)
+	if _, err := internal.GetSecret(pin, "PIN"); err == nil {
+		t.Fatalf("GetSecret() accepted literal PIN")
+	} else {
+		log.Debugf("Failed to get PIN: %v", err)
+	}
+
+	report, err := generate.Generate(f.Nonce, c.Metadata(), c.Drivers, c.Serializer)
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	signed, err := generate.Sign(report, c.Drivers[0], c.Serializer)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if result := verify.Verify(signed, f.Nonce, f.CaPem(), nil, c.PolicyEngineSelect,
+		c.IntelStorage); !result.Success {
+		t.Fatalf("verification failed: %v", result.ErrorCode)
+	}
+	priv, _, err := c.SigningKeys("")
+	if err != nil {
+		t.Fatalf("SigningKeys() error = %v", err)
+	}
+	digest := sha256.Sum256([]byte("tls"))
+	if _, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	if logs.Len() == 0 {
+		t.Fatalf("no logs emitted")
+	}
+	forbidden := []string{"PRIVATE KEY", pin}
+	for _, key := range []*fixtures.Key{f.Ik, f.Ak, f.Ca} {
+		der, err := x509.MarshalPKCS8PrivateKey(key.Priv)
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		forbidden = append(forbidden, hex.EncodeToString(der),
+			base64.StdEncoding.EncodeToString(der))
+	}
+	for _, s := range forbidden {
+		if bytes.Contains(logs.Bytes(), []byte(s)) {
+			t.Errorf("logs contain forbidden value %.32v...", s)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// driverConflicts contains drivers which access the same hardware interface
+// and therefore must not be combined
+var driverConflicts = map[string][]string{
+	"azure":     {"tpm", "snp"},
+	"gce":       {"tpm", "azure"},
+	"azurevtpm": {"tpm", "azure", "gce"},
+}
+
+// getRoles returns the roles of a driver. Drivers not implementing the
+// RoleProvider interface provide measurements and can be used as signer
+func getRoles(d ar.Driver) ar.DriverRoles {
+	if rp, ok := d.(ar.RoleProvider); ok {
+		return rp.Roles()
+	}
+	return ar.DriverRoles{Measurer: true, Signer: true}
+}
+
+// orderDrivers validates the configured driver combination and returns the
+// lowercase driver names ordered with the designated signer first. All drivers
+// acting as measurers contribute their measurements to the attestation report,
+// whereas exactly one driver provides the identity key the report is signed
+// with. If no signer is configured, the only driver which can exclusively be
+// used as signer is chosen if present, otherwise the first configured driver
+func orderDrivers(names []string, signer string, available map[string]ar.Driver,
+) ([]string, error) {
+
+	if len(names) == 0 {
+		if signer != "" {
+			return nil, fmt.Errorf("signer %v configured without drivers", signer)
+		}
+		return nil, nil
+	}
+
+	configured := make([]string, 0, len(names))
+	signerOnly := make([]string, 0)
+	measurers := 0
+	for _, name := range names {
+		name = strings.ToLower(name)
+		d, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("driver %v not implemented", name)
+		}
+		for _, c := range configured {
+			if c == name {
+				return nil, fmt.Errorf("driver %v configured more than once", name)
+			}
+		}
+		roles := getRoles(d)
+		if !roles.Measurer && !roles.Signer {
+			return nil, fmt.Errorf("driver %v provides neither measurements nor signing", name)
+		}
+		if roles.Measurer {
+			measurers++
+		} else {
+			signerOnly = append(signerOnly, name)
+		}
+		configured = append(configured, name)
+	}
+
+	for _, name := range configured {
+		for _, conflict := range driverConflicts[name] {
+			for _, c := range configured {
+				if c == conflict {
+					return nil, fmt.Errorf("driver %v cannot be combined with driver %v", name, c)
+				}
+			}
+		}
+	}
+
+	if measurers == 0 {
+		return nil, errors.New("none of the configured drivers provides measurements")
+	}
+
+	// Drivers which can only sign do not contribute to the attestation report
+	// and must therefore be the designated signer
+	if len(signerOnly) > 1 {
+		return nil, fmt.Errorf("multiple signers configured: %v",
+			strings.Join(signerOnly, ", "))
+	}
+
+	signer = strings.ToLower(signer)
+	if signer == "" {
+		if len(signerOnly) == 1 {
+			signer = signerOnly[0]
+		} else {
+			signer = configured[0]
+		}
+	}
+
+	idx := -1
+	for i, name := range configured {
+		if name == signer {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("signer %v is not a configured driver", signer)
+	}
+	if !getRoles(available[signer]).Signer {
+		return nil, fmt.Errorf("driver %v cannot be used as signer", signer)
+	}
+	if len(signerOnly) == 1 && signerOnly[0] != signer {
+		return nil, fmt.Errorf("driver %v can only be used as signer, but %v is configured as signer",
+			signerOnly[0], signer)
+	}
+
+	ordered := make([]string, 0, len(configured))
+	ordered = append(ordered, signer)
+	ordered = append(ordered, configured[:idx]...)
+	ordered = append(ordered, configured[idx+1:]...)
+
+	return ordered, nil
+}
+
+// orderSigners validates the drivers co-signing the attestation reports with the
+// designated signer and returns their lowercase names. The drivers must be
+// configured, able to sign and must not be the designated signer, which is the
+// first of the ordered drivers
+func orderSigners(names []string, ordered []string, available map[string]ar.Driver,
+) ([]string, error) {
+
+	signers := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		configured := false
+		for _, o := range ordered {
+			if o == name {
+				configured = true
+			}
+		}
+		if !configured {
+			return nil, fmt.Errorf("additional signer %v is not a configured driver", name)
+		}
+		if name == ordered[0] {
+			return nil, fmt.Errorf("additional signer %v is the designated signer", name)
+		}
+		for _, s := range signers {
+			if s == name {
+				return nil, fmt.Errorf("additional signer %v configured more than once", name)
+			}
+		}
+		if !getRoles(available[name]).Signer {
+			return nil, fmt.Errorf("driver %v cannot be used as signer", name)
+		}
+		signers = append(signers, name)
+	}
+
+	return signers, nil
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+)
+
+// testDriver is a driver returning its nonce as evidence and signing with a
+// self-signed test certificate
+type testDriver struct {
+	typ     string
+	roles   *ar.DriverRoles
+	priv    *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	inits   int
+	failing bool
+}
+
+func newTestDriver(t *testing.T, typ string, roles *ar.DriverRoles) *testDriver {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: typ},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testDriver{typ: typ, roles: roles, priv: priv, cert: cert}
+}
+
+func (d *testDriver) Init(c *ar.DriverConfig) error {
+	d.inits++
+	if d.failing {
+		return errors.New("device not available")
+	}
+	return nil
+}
+
+func (d *testDriver) Measure(nonce []byte) (ar.Measurement, error) {
+	if d.roles != nil && !d.roles.Measurer {
+		return ar.Measurement{}, errors.New("driver does not provide measurements")
+	}
+	m := ar.Measurement{
+		Type:     d.typ + " Measurement",
+		Evidence: append([]byte(nil), nonce...),
+	}
+	// Modify the nonce to check that drivers cannot influence each other
+	nonce[0] ^= 0xff
+	return m, nil
+}
+
+func (d *testDriver) Lock() error   { return nil }
+func (d *testDriver) Unlock() error { return nil }
+
+func (d *testDriver) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return d.priv, &d.priv.PublicKey, nil
+}
+
+func (d *testDriver) GetCertChain() ([]*x509.Certificate, error) {
+	return []*x509.Certificate{d.cert}, nil
+}
+
+type testSigner struct {
+	*testDriver
+}
+
+func (s *testSigner) Roles() ar.DriverRoles {
+	return *s.roles
+}
+
+func (s *testSigner) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+	return nil, nil
+}
+
+func createTestDrivers(t *testing.T) map[string]ar.Driver {
+	return map[string]ar.Driver{
+		"tpm":       newTestDriver(t, "TPM", nil),
+		"snp":       newTestDriver(t, "SNP", nil),
+		"azure":     newTestDriver(t, "Azure", nil),
+		"gce":       newTestDriver(t, "GCE", nil),
+		"azurevtpm": newTestDriver(t, "AzureVtpm", nil),
+		"pkcs11":    &testSigner{newTestDriver(t, "PKCS11", &ar.DriverRoles{Signer: true})},
+		"hsm":       &testSigner{newTestDriver(t, "HSM", &ar.DriverRoles{Signer: true})},
+		"sensor":    &testSigner{newTestDriver(t, "Sensor", &ar.DriverRoles{Measurer: true})},
+		"none":      &testSigner{newTestDriver(t, "None", &ar.DriverRoles{})},
+	}
+}
+
+func Test_orderDrivers(t *testing.T) {
+	tests := []struct {
+		name    string
+		drivers []string
+		signer  string
+		want    []string
+		wantErr bool
+	}{
+		{"No Drivers", nil, "", nil, false},
+		{"Single Driver", []string{"TPM"}, "", []string{"tpm"}, false},
+		{"Default Signer", []string{"tpm", "snp"}, "", []string{"tpm", "snp"}, false},
+		{"Explicit Signer", []string{"tpm", "snp"}, "SNP", []string{"snp", "tpm"}, false},
+		{"Signer Only Default", []string{"tpm", "snp", "pkcs11"}, "",
+			[]string{"pkcs11", "tpm", "snp"}, false},
+		{"Signer Only Explicit", []string{"tpm", "pkcs11"}, "pkcs11",
+			[]string{"pkcs11", "tpm"}, false},
+		{"Measurer Only Default Signer", []string{"sensor", "tpm"}, "", nil, true},
+		{"Measurer Only Signer", []string{"sensor", "tpm"}, "sensor", nil, true},
+		{"Measurer Only With Signer", []string{"sensor", "tpm"}, "tpm",
+			[]string{"tpm", "sensor"}, false},
+		{"Two Signers", []string{"tpm", "pkcs11", "hsm"}, "", nil, true},
+		{"Signer Only Not Signer", []string{"tpm", "pkcs11"}, "tpm", nil, true},
+		{"No Measurer", []string{"pkcs11"}, "", nil, true},
+		{"Duplicate Driver", []string{"tpm", "TPM"}, "", nil, true},
+		{"Unknown Driver", []string{"tpm", "foo"}, "", nil, true},
+		{"Unknown Signer", []string{"tpm", "snp"}, "sw", nil, true},
+		{"Signer Without Drivers", nil, "tpm", nil, true},
+		{"No Roles", []string{"tpm", "none"}, "", nil, true},
+		{"Conflicting Drivers", []string{"azure", "tpm"}, "", nil, true},
+		{"Conflicting GCE Drivers", []string{"tpm", "gce"}, "", nil, true},
+		{"Conflicting Azure vTPM Drivers", []string{"azurevtpm", "tpm"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderDrivers(tt.drivers, tt.signer, createTestDrivers(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("orderDrivers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderDrivers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_orderSigners(t *testing.T) {
+	ordered := []string{"tpm", "snp", "sensor"}
+	tests := []struct {
+		name    string
+		signers []string
+		want    []string
+		wantErr bool
+	}{
+		{"No Additional Signers", nil, []string{}, false},
+		{"Additional Signer", []string{"SNP"}, []string{"snp"}, false},
+		{"Designated Signer", []string{"tpm"}, nil, true},
+		{"Not Configured", []string{"azure"}, nil, true},
+		{"Duplicate Signer", []string{"snp", "snp"}, nil, true},
+		{"Measurer Only", []string{"sensor"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderSigners(tt.signers, ordered, createTestDrivers(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("orderSigners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderSigners() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCmcComposite(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		drivers    []string
+		signer     string
+		wantTypes  []string
+		wantSigner string
+		failing    string
+		wantErr    bool
+	}{
+		{
+			name:       "TPM And SNP",
+			drivers:    []string{"tpm", "snp"},
+			wantTypes:  []string{"TPM Measurement", "SNP Measurement"},
+			wantSigner: "tpm",
+		},
+		{
+			name:       "TPM And SNP With SNP Signer",
+			drivers:    []string{"tpm", "snp"},
+			signer:     "snp",
+			wantTypes:  []string{"SNP Measurement", "TPM Measurement"},
+			wantSigner: "snp",
+		},
+		{
+			name:       "TPM And SNP With HSM Signer",
+			drivers:    []string{"tpm", "snp", "pkcs11"},
+			wantTypes:  []string{"TPM Measurement", "SNP Measurement"},
+			wantSigner: "pkcs11",
+		},
+		{
+			name:    "Two Signers",
+			drivers: []string{"tpm", "pkcs11", "hsm"},
+			wantErr: true,
+		},
+		{
+			name:    "Failing Driver",
+			drivers: []string{"tpm", "snp"},
+			failing: "snp",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			testDrivers := createTestDrivers(t)
+			if tt.failing != "" {
+				testDrivers[tt.failing].(*testDriver).failing = true
+			}
+			oldDrivers := drivers
+			drivers = testDrivers
+			defer func() { drivers = oldDrivers }()
+
+			c, err := NewCmc(&Config{Drivers: tt.drivers, Signer: tt.signer})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCmc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if tt.failing == "" {
+					for name, d := range testDrivers {
+						if getInits(d) != 0 {
+							t.Errorf("driver %v initialized despite invalid configuration", name)
+						}
+					}
+				}
+				return
+			}
+
+			nonce := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+			report, err := generate.Generate(nonce, c.Metadata(), c.Drivers, c.Serializer)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			signed, err := generate.Sign(report, c.Drivers[0], c.Serializer)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			// The report must be signed with the key of the designated signer only
+			signer := testDrivers[tt.wantSigner]
+			chain, _ := signer.GetCertChain()
+			_, payload, ok := c.Serializer.VerifyToken(signed, chain)
+			if !ok {
+				t.Fatalf("report not signed by designated signer %v", tt.wantSigner)
+			}
+			for name, d := range testDrivers {
+				if name == tt.wantSigner {
+					continue
+				}
+				other, _ := d.GetCertChain()
+				if _, _, ok := c.Serializer.VerifyToken(signed, other); ok {
+					t.Errorf("report unexpectedly signed by %v", name)
+				}
+			}
+
+			// All measurements must be included and bound to the same nonce
+			var r ar.AttestationReport
+			if err := c.Serializer.Unmarshal(payload, &r); err != nil {
+				t.Fatalf("failed to unmarshal report: %v", err)
+			}
+			types := make([]string, 0, len(r.Measurements))
+			for _, m := range r.Measurements {
+				types = append(types, m.Type)
+				if !bytes.Equal(m.Evidence, nonce) {
+					t.Errorf("%v nonce = %x, want %x", m.Type, m.Evidence, nonce)
+				}
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("measurements = %v, want %v", types, tt.wantTypes)
+			}
+			for _, name := range tt.drivers {
+				if getInits(testDrivers[name]) != 1 {
+					t.Errorf("driver %v initialized %v times", name, getInits(testDrivers[name]))
+				}
+			}
+		})
+	}
+}
+
+func getInits(d ar.Driver) int {
+	switch v := d.(type) {
+	case *testDriver:
+		return v.inits
+	case *testSigner:
+		return v.inits
+	}
+	return 0
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const (
+	enrollmentFile          = "enrollment.json"
+	defaultEnrollMaxBackoff = time.Hour
+)
+
+// enrollment is the persistent enrollment state machine of the device. The
+// drivers enroll their certificates on initialization, which is retried with
+// exponential backoff and jitter until it succeeds. The state is persisted, so
+// that the backoff is resumed after a reboot instead of flooding the server
+type enrollment struct {
+	mu         sync.Mutex
+	file       string
+	retry      bool
+	maxBackoff time.Duration
+	status     ar.EnrollmentStatus
+	now        func() time.Time
+	sleep      func(time.Duration)
+	jitter     func(time.Duration) time.Duration
+}
+
+func newEnrollment(c *Config) (*enrollment, error) {
+
+	maxBackoff := defaultEnrollMaxBackoff
+	if c.EnrollMaxBackoff != "" {
+		var err error
+		maxBackoff, err = time.ParseDuration(c.EnrollMaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse maximum enrollment backoff: %w", err)
+		}
+		if maxBackoff < minRetryInterval {
+			return nil, fmt.Errorf("maximum enrollment backoff %v below minimum %v", maxBackoff,
+				minRetryInterval)
+		}
+	}
+
+	e := &enrollment{
+		retry:      c.EnrollRetry,
+		maxBackoff: maxBackoff,
+		status:     ar.EnrollmentStatus{State: ar.EnrollmentUnenrolled},
+		now:        time.Now,
+		sleep:      time.Sleep,
+		jitter:     jitter,
+	}
+	if c.Storage == "" {
+		return e, nil
+	}
+
+	e.file = filepath.Join(c.Storage, enrollmentFile)
+	data, err := internal.LoadFile(e.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment state: %w", err)
+	}
+	if err := json.Unmarshal(data, &e.status); err != nil {
+		log.Warnf("Failed to unmarshal enrollment state, starting unenrolled: %v", err)
+		e.status = ar.EnrollmentStatus{State: ar.EnrollmentUnenrolled}
+	}
+	log.Debugf("Resuming enrollment in state %v after %v failed attempts", e.status.State,
+		e.status.Attempts)
+
+	return e, nil
+}
+
+// run performs the enrollment until it succeeds. If retries are disabled, the
+// error of the first failed attempt is returned
+func (e *enrollment) run(enroll func() error) error {
+	for {
+		if wait := e.wait(); wait > 0 {
+			log.Infof("Retrying enrollment in %v", wait.Round(time.Second))
+			e.sleep(wait)
+		}
+
+		e.update(func(s *ar.EnrollmentStatus) {
+			s.State = ar.EnrollmentCsrPending
+			s.LastAttempt = e.now()
+		})
+
+		err := enroll()
+		if err == nil {
+			log.Debug("Enrollment succeeded")
+			e.update(func(s *ar.EnrollmentStatus) {
+				*s = ar.EnrollmentStatus{
+					State:       ar.EnrollmentEnrolled,
+					LastAttempt: s.LastAttempt,
+				}
+			})
+			return nil
+		}
+
+		var attempts int
+		e.update(func(s *ar.EnrollmentStatus) {
+			s.Attempts++
+			s.LastError = err.Error()
+			attempts = s.Attempts
+		})
+		state, delay := e.classify(err, attempts)
+		e.update(func(s *ar.EnrollmentStatus) {
+			s.State = state
+			s.NextAttempt = e.now().Add(delay)
+		})
+
+		if !e.retry {
+			return err
+		}
+		log.Errorf("Enrollment failed (attempt %v, %v): %v", attempts, state, err)
+	}
+}
+
+// wait returns the duration until the next attempt. A next attempt further in
+// the future than the maximum backoff indicates that the clock was set back,
+// e.g. after a reboot without real-time clock, and is limited to the maximum
+func (e *enrollment) wait() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.retry || e.status.NextAttempt.IsZero() {
+		return 0
+	}
+	wait := e.status.NextAttempt.Sub(e.now())
+	if wait > e.maxBackoff {
+		log.Warnf("Next enrollment attempt %v exceeds maximum backoff, clock changed?",
+			e.status.NextAttempt)
+		wait = e.maxBackoff
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// classify returns the state after the failed attempt and the delay until the
+// next attempt. Refused requests, e.g. due to an expired bootstrap token, put
+// the enrollment into the failed state, in which it is only retried after the
+// maximum backoff, as the token source may be replaced in the meantime. A
+// Retry-After of the server is honored if it exceeds the backoff
+func (e *enrollment) classify(err error, attempts int) (ar.EnrollmentState, time.Duration) {
+
+	var httpErr *est.HttpError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ar.EnrollmentFailed, e.maxBackoff
+		}
+	}
+
+	delay := e.jitter(backoff(attempts, e.maxBackoff))
+	if httpErr != nil && httpErr.RetryAfter > delay {
+		delay = httpErr.RetryAfter
+	}
+	return ar.EnrollmentUnenrolled, delay
+}
+
+// renewalFailed records that the renewal of the certificates failed with the
+// error message
+func (e *enrollment) renewalFailed(msg string) {
+	e.update(func(s *ar.EnrollmentStatus) {
+		s.State = ar.EnrollmentRenewalDue
+		s.Attempts++
+		s.LastAttempt = e.now()
+		s.LastError = msg
+	})
+}
+
+// renewed records that the certificates are valid beyond the renewal threshold
+func (e *enrollment) renewed() {
+	if e == nil {
+		return
+	}
+	if s := e.getStatus(); s.State == ar.EnrollmentEnrolled && s.Attempts == 0 {
+		return
+	}
+	e.update(func(s *ar.EnrollmentStatus) {
+		*s = ar.EnrollmentStatus{
+			State:       ar.EnrollmentEnrolled,
+			LastAttempt: s.LastAttempt,
+		}
+	})
+}
+
+// update modifies and persists the status
+func (e *enrollment) update(f func(s *ar.EnrollmentStatus)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f(&e.status)
+	if err := e.save(); err != nil {
+		log.Warnf("Failed to persist enrollment state: %v", err)
+	}
+}
+
+// save persists the status. Must be called with the lock held
+func (e *enrollment) save() error {
+	if e.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(e.status, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal enrollment state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(e.file), 0755); err != nil {
+		return fmt.Errorf("failed to create storage folder: %w", err)
+	}
+	if err := internal.StoreFile(e.file, data, 0600); err != nil {
+		return fmt.Errorf("failed to store enrollment state: %w", err)
+	}
+	return nil
+}
+
+// getStatus returns the current enrollment status
+func (e *enrollment) getStatus() ar.EnrollmentStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+// jitter returns a random duration between half of d and d, so that devices
+// failing at the same time do not retry simultaneously
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
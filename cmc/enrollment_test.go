@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// newTestEnrollment returns an enrollment with a fake clock, which is advanced
+// by the recorded waits, and without jitter
+func newTestEnrollment(t *testing.T, c *Config, now time.Time) (*enrollment, *[]time.Duration,
+	*[]ar.EnrollmentState) {
+	e, err := newEnrollment(c)
+	if err != nil {
+		t.Fatalf("newEnrollment() error = %v", err)
+	}
+	var waits []time.Duration
+	var states []ar.EnrollmentState
+	e.now = func() time.Time { return now }
+	e.jitter = func(d time.Duration) time.Duration { return d }
+	e.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		states = append(states, e.getStatus().State)
+		now = now.Add(d)
+	}
+	return e, &waits, &states
+}
+
+func TestEnrollmentRun(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	unavailable := errors.New("provisioning server not reachable")
+	expired := fmt.Errorf("failed to enroll cert: %w", &est.HttpError{
+		StatusCode: http.StatusUnauthorized, Message: "bootstrap token expired"})
+	limited := fmt.Errorf("failed to enroll cert: %w", &est.HttpError{
+		StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute})
+
+	tests := []struct {
+		name       string
+		errs       []error
+		retry      bool
+		wantWaits  []time.Duration
+		wantStates []ar.EnrollmentState
+		wantErr    bool
+	}{
+		{"Success", []error{nil}, true, nil, nil, false},
+		{"Backoff", []error{unavailable, unavailable, unavailable, nil}, true,
+			[]time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute},
+			[]ar.EnrollmentState{ar.EnrollmentUnenrolled, ar.EnrollmentUnenrolled,
+				ar.EnrollmentUnenrolled}, false},
+		{"Retry After", []error{limited, nil}, true, []time.Duration{10 * time.Minute},
+			[]ar.EnrollmentState{ar.EnrollmentUnenrolled}, false},
+		{"Token Expired Mid-Retry", []error{unavailable, expired, nil}, true,
+			[]time.Duration{time.Minute, time.Hour},
+			[]ar.EnrollmentState{ar.EnrollmentUnenrolled, ar.EnrollmentFailed}, false},
+		{"No Retry", []error{unavailable}, false, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			e, waits, states := newTestEnrollment(t,
+				&Config{Storage: dir, EnrollRetry: tt.retry}, now)
+
+			attempt := 0
+			err := e.run(func() error {
+				if s := e.getStatus().State; s != ar.EnrollmentCsrPending {
+					t.Errorf("state during attempt = %v, want %v", s, ar.EnrollmentCsrPending)
+				}
+				err := tt.errs[attempt]
+				attempt++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(*waits, tt.wantWaits) {
+				t.Errorf("waits = %v, want %v", *waits, tt.wantWaits)
+			}
+			if !reflect.DeepEqual(*states, tt.wantStates) {
+				t.Errorf("states = %v, want %v", *states, tt.wantStates)
+			}
+
+			// The persisted state must match the reported state
+			data, err := internal.LoadFile(filepath.Join(dir, enrollmentFile))
+			if err != nil {
+				t.Fatalf("failed to read enrollment state: %v", err)
+			}
+			var persisted ar.EnrollmentStatus
+			if err := json.Unmarshal(data, &persisted); err != nil {
+				t.Fatalf("failed to unmarshal enrollment state: %v", err)
+			}
+			status := e.getStatus()
+			if persisted.State != status.State || persisted.Attempts != status.Attempts {
+				t.Errorf("persisted state %v, reported %v", persisted, status)
+			}
+			if tt.wantErr {
+				if status.Attempts != 1 || status.LastError == "" {
+					t.Errorf("status = %v, want one failed attempt", status)
+				}
+			} else if status.State != ar.EnrollmentEnrolled || status.Attempts != 0 {
+				t.Errorf("status = %v, want enrolled", status)
+			}
+		})
+	}
+}
+
+func TestEnrollmentResume(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		next      time.Time
+		wantWaits []time.Duration
+	}{
+		{"Pending Backoff", now.Add(5 * time.Minute), []time.Duration{5 * time.Minute}},
+		{"Backoff Elapsed", now.Add(-time.Minute), nil},
+		{"Clock Set Back", now.Add(48 * time.Hour), []time.Duration{time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data, _ := json.Marshal(ar.EnrollmentStatus{
+				State:       ar.EnrollmentUnenrolled,
+				Attempts:    3,
+				LastError:   "provisioning server not reachable",
+				NextAttempt: tt.next,
+			})
+			if err := os.WriteFile(filepath.Join(dir, enrollmentFile), data, 0600); err != nil {
+				t.Fatalf("failed to write enrollment state: %v", err)
+			}
+
+			e, waits, _ := newTestEnrollment(t, &Config{Storage: dir, EnrollRetry: true}, now)
+			if s := e.getStatus(); s.Attempts != 3 {
+				t.Fatalf("resumed attempts = %v, want 3", s.Attempts)
+			}
+			if err := e.run(func() error { return nil }); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if !reflect.DeepEqual(*waits, tt.wantWaits) {
+				t.Errorf("waits = %v, want %v", *waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func Test_jitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Minute); d < 30*time.Second || d > time.Minute {
+			t.Fatalf("jitter() = %v, want between 30s and 1m", d)
+		}
+	}
+}
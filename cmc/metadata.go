@@ -31,14 +31,15 @@ import (
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/fxamacker/cbor/v2"
 )
 
 func GetMetadata(paths []string, cache string) ([][]byte, ar.Serializer, error) {
 
 	if len(paths) == 0 {
-		log.Info("No metadata specified via config. Using default serializer (JSON)")
-		return nil, ar.JsonSerializer{}, nil
+		log.Info("No metadata specified via config. Using default serializer")
+		return nil, defaultSerializer(), nil
 	}
 
 	metadata := make([][]byte, 0)
@@ -86,15 +87,17 @@ func GetMetadata(paths []string, cache string) ([][]byte, ar.Serializer, error)
 	}
 
 	if len(metadata) == 0 {
-		return nil, ar.JsonSerializer{}, errors.New("failed to retrieve any metadata. Using default serializer (JSON)")
+		return nil, defaultSerializer(), errors.New("failed to retrieve any metadata. Using default serializer")
 	}
 
 	// Filter metadata: remove any duplicates through always choosing the
 	// newest version of duplicate metadata
 	metadata, s, err := filterMetadata(metadata)
-	if err != nil {
+	if errors.Is(err, ar.ErrSerializerNotAllowed) {
+		return nil, defaultSerializer(), fmt.Errorf("failed to filter metadata: %w", err)
+	} else if err != nil {
 		log.Warnf("Failed to filter metadata: %v", err)
-		return nil, ar.JsonSerializer{}, nil
+		return nil, defaultSerializer(), nil
 	}
 
 	// Cache metadata if cache is available
@@ -109,6 +112,15 @@ func GetMetadata(paths []string, cache string) ([][]byte, ar.Serializer, error)
 	return metadata, s, nil
 }
 
+// defaultSerializer returns the pinned serializer or JSON if no serializer is
+// pinned
+func defaultSerializer() ar.Serializer {
+	if s := ar.PinnedSerializer(); s != nil {
+		return s
+	}
+	return ar.JsonSerializer{}
+}
+
 // loadMetadata loads the metadata (manifests and descriptions) from the file system
 func loadMetadata(dir string) ([][]byte, error) {
 
@@ -168,7 +180,7 @@ func cacheMetadata(data [][]byte, localPath string) error {
 		digest := sha256.Sum256(d)
 		filename := path.Join(localPath, hex.EncodeToString(digest[:]))
 		log.Debug("Caching metadata object: ", filename)
-		err := os.WriteFile(filename, d, 0644)
+		err := internal.WriteFileAtomic(filename, d, 0644)
 		if err != nil {
 			return fmt.Errorf("failed to write file: %v", err)
 		}
@@ -201,6 +213,12 @@ func filterMetadata(inlist [][]byte) ([][]byte, ar.Serializer, error) {
 			continue
 		}
 
+		// With a pinned serializer, objects in the other format are not
+		// ignored but fail the retrieval, as the source is not trustworthy
+		if err := ar.CheckSerializer(s); err != nil {
+			return nil, s, fmt.Errorf("metadata object: %w", err)
+		}
+
 		// Extract plain payload (i.e. the manifest/description itself)
 		data, err := s.GetPayload(elem)
 		if err != nil {
@@ -311,3 +329,55 @@ func isNewer(t, ref string) (bool, error) {
 
 	return checktime.After(reftime), nil
 }
+
+// getMetadataStatus returns the status of the signed metadata items, each
+// identified by the SHA-256 digest of the signed item. Items which cannot be
+// parsed are reported with the digest and size only
+func getMetadataStatus(metadata [][]byte, s ar.Serializer) []ar.MetadataStatus {
+	status := make([]ar.MetadataStatus, 0, len(metadata))
+	for _, m := range metadata {
+		digest := sha256.Sum256(m)
+		st := ar.MetadataStatus{
+			Digest: hex.EncodeToString(digest[:]),
+			Size:   len(m),
+		}
+		if s != nil {
+			info := new(ar.MetaInfo)
+			if data, err := s.GetPayload(m); err != nil {
+				log.Warnf("Failed to parse metadata object %v: %v", st.Digest, err)
+			} else if err := s.Unmarshal(data, info); err != nil {
+				log.Warnf("Failed to unmarshal metadata object %v: %v", st.Digest, err)
+			} else {
+				st.Type = info.Type
+				st.Name = info.Name
+				st.Version = info.Version
+			}
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// findMetadata returns the signed metadata item with the hex encoded SHA-256
+// digest. A unique prefix of the digest is sufficient
+func findMetadata(metadata [][]byte, digest string) ([]byte, error) {
+	digest = strings.ToLower(digest)
+	if digest == "" {
+		return nil, errors.New("no digest specified")
+	}
+	var found []byte
+	for _, m := range metadata {
+		d := sha256.Sum256(m)
+		if !strings.HasPrefix(hex.EncodeToString(d[:]), digest) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("digest %v is ambiguous", digest)
+		}
+		found = m
+	}
+	if found == nil {
+		return nil, fmt.Errorf("metadata item %v not found", digest)
+	}
+	return found, nil
+}
@@ -16,9 +16,19 @@
 package cmc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 func Test_isNewer(t *testing.T) {
@@ -36,7 +46,7 @@ func Test_isNewer(t *testing.T) {
 		{"Older", args{"2022-12-11T15:19:00Z", "2023-03-15T23:59:14Z"}, false, false},
 		{"Error", args{"xxxxxxxxxxxxxxxxxxx", "2022-12-11T15:19:00Z"}, false, true},
 	}
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := isNewer(tt.args.t, tt.args.ref)
@@ -50,3 +60,139 @@ func Test_isNewer(t *testing.T) {
 		})
 	}
 }
+
+func Test_getMetadataStatus(t *testing.T) {
+	d := newTestDriver(t, "sw", nil)
+
+	for _, s := range []ar.Serializer{ar.JsonSerializer{}, ar.CborSerializer{}} {
+		var metadata [][]byte
+		var want []ar.MetadataStatus
+		for _, info := range []ar.MetaInfo{
+			{Type: "RTM Manifest", Name: "de.test.rtm", Version: "2023-04-10T20:00:00Z"},
+			{Type: "Device Description", Name: "de.test.device", Version: "2023-04-11T20:00:00Z"},
+		} {
+			data, err := s.Marshal(ar.RtmManifest{MetaInfo: info})
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			signed, err := s.Sign(data, d)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			metadata = append(metadata, signed)
+			digest := sha256.Sum256(signed)
+			want = append(want, ar.MetadataStatus{
+				Digest:  hex.EncodeToString(digest[:]),
+				Type:    info.Type,
+				Name:    info.Name,
+				Version: info.Version,
+				Size:    len(signed),
+			})
+		}
+		// Invalid items are reported with digest and size only
+		invalid := []byte("invalid")
+		digest := sha256.Sum256(invalid)
+		metadata = append(metadata, invalid)
+		want = append(want, ar.MetadataStatus{Digest: hex.EncodeToString(digest[:]), Size: 7})
+
+		if got := getMetadataStatus(metadata, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("getMetadataStatus() = %v, want %v", got, want)
+		}
+
+		// Items can be selected by their digest or a unique prefix
+		for i, w := range want {
+			item, err := findMetadata(metadata, w.Digest[:12])
+			if err != nil {
+				t.Fatalf("findMetadata() error = %v", err)
+			}
+			if !reflect.DeepEqual(item, metadata[i]) {
+				t.Errorf("findMetadata() returned item %v, want %v", string(item), i)
+			}
+		}
+		for _, digest := range []string{"", "00000000", want[0].Digest + "00"} {
+			if _, err := findMetadata(metadata, digest); err == nil {
+				t.Errorf("findMetadata(%q) succeeded, want error", digest)
+			}
+		}
+	}
+}
+
+func TestGetMetadataPinned(t *testing.T) {
+	d := newTestDriver(t, "sw", nil)
+	t.Cleanup(func() { ar.SetSerializerPin("") })
+
+	// Create a metadata folder with an RTM manifest in each serialization
+	// format and a folder with both
+	sign := func(s ar.Serializer, name string) []byte {
+		data, err := s.Marshal(ar.RtmManifest{MetaInfo: ar.MetaInfo{Type: "RTM Manifest",
+			Name: name, Version: "2023-04-10T20:00:00Z"}})
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		signed, err := s.Sign(data, d)
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		return signed
+	}
+	dirs := map[string][][]byte{
+		"json":  {sign(ar.JsonSerializer{}, "de.test.rtm")},
+		"cbor":  {sign(ar.CborSerializer{}, "de.test.rtm")},
+		"mixed": {sign(ar.JsonSerializer{}, "de.test.rtm"), sign(ar.CborSerializer{}, "de.test.os")},
+	}
+	root := t.TempDir()
+	for name, objs := range dirs {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, obj := range objs {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%v", i)), obj, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pin     string
+		dir     string
+		want    ar.Serializer
+		wantErr bool
+	}{
+		{"No Pin JSON", "", "json", ar.JsonSerializer{}, false},
+		{"No Pin CBOR", "", "cbor", ar.CborSerializer{}, false},
+		{"Pinned JSON", "json", "json", ar.JsonSerializer{}, false},
+		{"Pinned CBOR", "cbor", "cbor", ar.CborSerializer{}, false},
+		{"JSON Pinned CBOR", "cbor", "json", nil, true},
+		{"CBOR Pinned JSON", "json", "cbor", nil, true},
+		{"Mixed Pinned JSON", "json", "mixed", nil, true},
+		{"No Metadata Pinned CBOR", "cbor", "", ar.CborSerializer{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ar.SetSerializerPin(tt.pin); err != nil {
+				t.Fatalf("SetSerializerPin() error = %v", err)
+			}
+			defer ar.SetSerializerPin("")
+
+			var paths []string
+			if tt.dir != "" {
+				paths = []string{"file://" + filepath.Join(root, tt.dir)}
+			}
+			_, s, err := GetMetadata(paths, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ar.ErrSerializerNotAllowed) {
+					t.Errorf("GetMetadata() error = %v, want %v", err, ar.ErrSerializerNotAllowed)
+				}
+				return
+			}
+			if !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("GetMetadata() serializer = %T, want %T", s, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// SigningKeys returns the keys of the certificate profile of the signer. An
+// empty profile selects the signing keys of the signer
+func (c *Cmc) SigningKeys(profile string) (crypto.PrivateKey, crypto.PublicKey, error) {
+	if len(c.Drivers) == 0 {
+		return nil, nil, errors.New("no valid signers configured")
+	}
+	if profile == "" {
+		return c.Drivers[0].GetSigningKeys()
+	}
+	p, err := c.profileProvider(profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.GetProfileSigningKeys(profile)
+}
+
+// CertChain returns the certificate chain of the certificate profile of the
+// signer. An empty profile selects the certificate chain of the signer
+func (c *Cmc) CertChain(profile string) ([]*x509.Certificate, error) {
+	if len(c.Drivers) == 0 {
+		return nil, errors.New("no valid signers configured")
+	}
+	if profile == "" {
+		return c.Drivers[0].GetCertChain()
+	}
+	p, err := c.profileProvider(profile)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetProfileCertChain(profile)
+}
+
+func (c *Cmc) profileProvider(profile string) (ar.ProfileProvider, error) {
+	p, ok := c.Drivers[0].(ar.ProfileProvider)
+	if !ok {
+		return nil, fmt.Errorf("signer does not support certificate profile %v", profile)
+	}
+	return p, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// testProfileDriver is a test driver with a separate test driver per profile
+type testProfileDriver struct {
+	*testDriver
+	profiles map[string]*testDriver
+}
+
+func (d *testProfileDriver) GetProfileSigningKeys(profile string,
+) (crypto.PrivateKey, crypto.PublicKey, error) {
+	p, ok := d.profiles[profile]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown profile %v", profile)
+	}
+	return p.GetSigningKeys()
+}
+
+func (d *testProfileDriver) GetProfileCertChain(profile string) ([]*x509.Certificate, error) {
+	p, ok := d.profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %v", profile)
+	}
+	return p.GetCertChain()
+}
+
+func TestCmcProfiles(t *testing.T) {
+
+	signer := newTestDriver(t, "signer", nil)
+	tlsClient := newTestDriver(t, "tls-client", nil)
+	signing := newTestDriver(t, "signing", nil)
+	withProfiles := &testProfileDriver{
+		testDriver: signer,
+		profiles:   map[string]*testDriver{"tls-client": tlsClient, "signing": signing},
+	}
+
+	tests := []struct {
+		name    string
+		driver  ar.Driver
+		profile string
+		want    *testDriver
+		wantErr bool
+	}{
+		{"Default", withProfiles, "", signer, false},
+		{"TLS Client", withProfiles, "tls-client", tlsClient, false},
+		{"Signing", withProfiles, "signing", signing, false},
+		{"Unknown Profile", withProfiles, "tls-server", nil, true},
+		{"Default Without Profiles", signer, "", signer, false},
+		{"Unsupported", signer, "tls-client", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cmc{Drivers: []ar.Driver{tt.driver}}
+
+			priv, _, err := c.SigningKeys(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SigningKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			chain, err := c.CertChain(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CertChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if priv != tt.want.priv {
+				t.Errorf("SigningKeys() returned key of wrong driver")
+			}
+			if len(chain) != 1 || chain[0] != tt.want.cert {
+				t.Errorf("CertChain() returned chain of wrong driver")
+			}
+		})
+	}
+
+	if _, _, err := (&Cmc{}).SigningKeys(""); err == nil {
+		t.Errorf("SigningKeys() succeeded without drivers")
+	}
+}
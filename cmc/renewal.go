@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	defaultRenewInterval = 24 * time.Hour
+	minRetryInterval     = time.Minute
+)
+
+// RenewalStatus is the certificate renewal status of a driver
+type RenewalStatus struct {
+	Driver      string    `json:"driver"`
+	Expiry      time.Time `json:"expiry"`
+	LastRenewal time.Time `json:"lastRenewal,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	Failures    int       `json:"failures,omitempty"`
+}
+
+// renewal periodically checks the remaining validity of the driver certificates
+// and renews them if they expire within the configured threshold
+type renewal struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	interval  time.Duration
+	rotate    bool
+	drivers   map[string]ar.Renewer
+	status    map[string]*RenewalStatus
+	// Optional enrollment state machine, which reports due renewals
+	enrollment *enrollment
+	now        func() time.Time
+	// stop is closed by close to end the checks, done is closed once run returned
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newRenewal(c *Config, drivers map[string]ar.Renewer) (*renewal, error) {
+
+	threshold, err := time.ParseDuration(c.RenewThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse renewal threshold: %w", err)
+	}
+
+	interval := defaultRenewInterval
+	if c.RenewInterval != "" {
+		interval, err = time.ParseDuration(c.RenewInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse renewal interval: %w", err)
+		}
+		if interval < minRetryInterval {
+			return nil, fmt.Errorf("renewal interval %v below minimum %v", interval, minRetryInterval)
+		}
+	}
+
+	r := &renewal{
+		threshold: threshold,
+		interval:  interval,
+		rotate:    c.RotateKeys,
+		drivers:   drivers,
+		status:    make(map[string]*RenewalStatus),
+		now:       time.Now,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for name := range drivers {
+		r.status[name] = &RenewalStatus{Driver: name}
+	}
+
+	return r, nil
+}
+
+// run performs renewal checks until the renewal is closed
+func (r *renewal) run() {
+	defer close(r.done)
+	for {
+		next := r.check()
+		log.Tracef("Next certificate renewal check in %v", next)
+		timer := time.NewTimer(next)
+		select {
+		case <-timer.C:
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// close stops the renewal checks and waits for a running check to finish, so
+// that the drivers are not renewed once they are closed. It must only be
+// called once the checks were started with run
+func (r *renewal) close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+// check checks all drivers and renews the certificates if required. It returns
+// the duration until the next check, which is shorter if a renewal failed
+func (r *renewal) check() time.Duration {
+
+	next := r.interval
+	failed := ""
+	for name, d := range r.drivers {
+		retry, ok := r.checkDriver(name, d)
+		if !ok {
+			failed = r.getDriverStatus(name).LastError
+			if retry < next {
+				next = retry
+			}
+		}
+	}
+
+	if failed != "" {
+		r.enrollment.renewalFailed(failed)
+	} else {
+		r.enrollment.renewed()
+	}
+
+	return next
+}
+
+// checkDriver renews the driver certificates if required. If the renewal failed,
+// it returns false and the duration after which the renewal shall be retried
+func (r *renewal) checkDriver(name string, d ar.Renewer) (time.Duration, bool) {
+
+	expiry, err := d.Expiry()
+	if err != nil {
+		log.Warnf("Failed to get %v certificate expiry: %v", name, err)
+		r.update(name, func(s *RenewalStatus) { s.LastError = err.Error() })
+		return 0, true
+	}
+	r.update(name, func(s *RenewalStatus) { s.Expiry = expiry })
+
+	remaining := expiry.Sub(r.now())
+	if remaining > r.threshold {
+		log.Debugf("%v certificates valid for %v, no renewal required", name,
+			remaining.Round(time.Second))
+		r.update(name, func(s *RenewalStatus) {
+			s.Failures = 0
+			s.LastError = ""
+		})
+		return 0, true
+	}
+
+	log.Infof("%v certificates expire in %v, renewing", name, remaining.Round(time.Second))
+	err = d.Renew(r.rotate)
+	if err != nil {
+		var failures int
+		r.update(name, func(s *RenewalStatus) {
+			s.Failures++
+			s.LastError = err.Error()
+			failures = s.Failures
+		})
+		retry := backoff(failures, r.interval)
+		log.Errorf("Failed to renew %v certificates (attempt %v, expiry %v, retry in %v): %v",
+			name, failures, expiry, retry, err)
+		return retry, false
+	}
+
+	newExpiry, err := d.Expiry()
+	if err != nil {
+		newExpiry = expiry
+	}
+	r.update(name, func(s *RenewalStatus) {
+		s.Failures = 0
+		s.LastError = ""
+		s.LastRenewal = r.now()
+		s.Expiry = newExpiry
+	})
+
+	return 0, true
+}
+
+func (r *renewal) update(name string, f func(s *RenewalStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(r.status[name])
+}
+
+func (r *renewal) getDriverStatus(name string) RenewalStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.status[name]
+}
+
+// getStatus returns the renewal status of all drivers sorted by driver name
+func (r *renewal) getStatus() []RenewalStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := make([]RenewalStatus, 0, len(r.status))
+	for _, s := range r.status {
+		status = append(status, *s)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Driver < status[j].Driver
+	})
+	return status
+}
+
+// backoff returns the exponential backoff for the number of failures,
+// limited by max
+func backoff(failures int, max time.Duration) time.Duration {
+	d := minRetryInterval
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+type testRenewer struct {
+	expiry   time.Time
+	fail     int
+	renewals int
+	rotated  bool
+}
+
+func (r *testRenewer) Expiry() (time.Time, error) {
+	return r.expiry, nil
+}
+
+func (r *testRenewer) Renew(rotateKeys bool) error {
+	if r.fail > 0 {
+		r.fail--
+		return errors.New("provisioning server not reachable")
+	}
+	r.renewals++
+	r.rotated = rotateKeys
+	r.expiry = r.expiry.Add(90 * 24 * time.Hour)
+	return nil
+}
+
+func Test_renewal(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		expiry       time.Time
+		fail         int
+		wantRenewals int
+		wantFailures int
+		wantNexts    []time.Duration
+		wantState    ar.EnrollmentState
+	}{
+		{"Valid", now.Add(60 * 24 * time.Hour), 0, 0, 0, []time.Duration{24 * time.Hour},
+			ar.EnrollmentEnrolled},
+		{"Renew", now.Add(10 * 24 * time.Hour), 0, 1, 0, []time.Duration{24 * time.Hour},
+			ar.EnrollmentEnrolled},
+		{"Retry", now.Add(10 * 24 * time.Hour), 3, 1, 0,
+			[]time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 24 * time.Hour},
+			ar.EnrollmentEnrolled},
+		{"Failing", now.Add(10 * 24 * time.Hour), 2, 0, 2,
+			[]time.Duration{time.Minute, 2 * time.Minute}, ar.EnrollmentRenewalDue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &testRenewer{expiry: tt.expiry, fail: tt.fail}
+			r, err := newRenewal(&Config{RenewThreshold: "720h", RotateKeys: true},
+				map[string]ar.Renewer{"test": d})
+			if err != nil {
+				t.Fatalf("newRenewal() error = %v", err)
+			}
+			r.now = func() time.Time { return now }
+			r.enrollment = &enrollment{
+				status: ar.EnrollmentStatus{State: ar.EnrollmentEnrolled},
+				now:    r.now,
+			}
+
+			for i, want := range tt.wantNexts {
+				next := r.check()
+				if next != want {
+					t.Errorf("check() %v = %v, want %v", i, next, want)
+				}
+			}
+
+			if d.renewals != tt.wantRenewals {
+				t.Errorf("renewals = %v, want %v", d.renewals, tt.wantRenewals)
+			}
+			if d.renewals > 0 && !d.rotated {
+				t.Errorf("key rotation not requested")
+			}
+			status := r.getStatus()
+			if len(status) != 1 {
+				t.Fatalf("status length = %v, want 1", len(status))
+			}
+			if status[0].Failures != tt.wantFailures {
+				t.Errorf("failures = %v, want %v", status[0].Failures, tt.wantFailures)
+			}
+			if (status[0].LastError != "") != (tt.wantFailures > 0) {
+				t.Errorf("unexpected last error %q", status[0].LastError)
+			}
+			if !status[0].Expiry.Equal(d.expiry) {
+				t.Errorf("expiry = %v, want %v", status[0].Expiry, d.expiry)
+			}
+			if e := r.enrollment.getStatus(); e.State != tt.wantState {
+				t.Errorf("enrollment state = %v, want %v", e.State, tt.wantState)
+			}
+		})
+	}
+}
+
+// closingRenewer blocks the renewal until it is released and records whether
+// it was renewed after the driver was closed
+type closingRenewer struct {
+	ar.Driver
+	testRenewer
+	entered chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	late    bool
+}
+
+func (r *closingRenewer) Renew(rotateKeys bool) error {
+	r.entered <- struct{}{}
+	<-r.release
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.late = r.closed
+	return r.testRenewer.Renew(rotateKeys)
+}
+
+func (r *closingRenewer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func Test_renewalClose(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+
+	d := &closingRenewer{
+		testRenewer: testRenewer{expiry: time.Now().Add(time.Hour)},
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	r, err := newRenewal(&Config{RenewThreshold: "720h"}, map[string]ar.Renewer{"test": d})
+	if err != nil {
+		t.Fatalf("newRenewal() error = %v", err)
+	}
+	r.enrollment = &enrollment{
+		status: ar.EnrollmentStatus{State: ar.EnrollmentEnrolled},
+		now:    time.Now,
+	}
+	c := &Cmc{Drivers: []ar.Driver{d}, renewal: r}
+	go r.run()
+
+	// Close must wait for the running renewal before closing the drivers
+	<-d.entered
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close() returned during a running renewal")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(d.release)
+	<-closed
+
+	if d.late {
+		t.Error("driver renewed after it was closed")
+	}
+	if err := goleak.Find(ignore); err != nil {
+		t.Errorf("leaked goroutines: %v", err)
+	}
+}
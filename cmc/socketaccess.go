@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+)
+
+// socketRequestTypes are the request types served by the socket API, which can
+// be restricted via the socket access rules
+var socketRequestTypes = []uint32{
+	api.TypeAttest,
+	api.TypeVerify,
+	api.TypeMeasure,
+	api.TypeTLSSign,
+	api.TypeTLSCert,
+	api.TypeStatus,
+	api.TypeMetadata,
+	api.TypeCache,
+	api.TypePeerCache,
+	api.TypeNonce,
+}
+
+// SocketAccess restricts the requests of the unix domain socket API to the
+// peers matching the rule of the request type, e.g. "TLSSign". Request types
+// without a rule are checked against the default rule, if configured, and are
+// allowed to all peers otherwise
+type SocketAccess struct {
+	Default  *PeerRule           `json:"default,omitempty"`
+	Requests map[string]PeerRule `json:"requests,omitempty"`
+}
+
+// PeerRule allows the peers with one of the user IDs or primary group IDs
+type PeerRule struct {
+	Uids []uint32 `json:"uids,omitempty"`
+	Gids []uint32 `json:"gids,omitempty"`
+}
+
+// Rule returns the rule of the request type with the case-insensitive name or
+// nil, if the request type is not restricted
+func (a *SocketAccess) Rule(reqType string) *PeerRule {
+	if a == nil {
+		return nil
+	}
+	for name, r := range a.Requests {
+		if strings.EqualFold(name, reqType) {
+			r := r
+			return &r
+		}
+	}
+	return a.Default
+}
+
+// Allows returns whether the peer with the user ID and group ID is allowed
+func (r *PeerRule) Allows(uid, gid uint32) bool {
+	return slices.Contains(r.Uids, uid) || slices.Contains(r.Gids, gid)
+}
+
+func (a *SocketAccess) validate(errs *ConfigErrors) {
+	names := make([]string, 0, len(socketRequestTypes))
+	for _, t := range socketRequestTypes {
+		names = append(names, api.TypeToString(t))
+	}
+	requests := maps.Keys(a.Requests)
+	slices.Sort(requests)
+	for _, r := range requests {
+		if !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, r) }) {
+			errs.add("socketAccess.requests."+r, "unknown request type (possible: %v)",
+				strings.Join(names, ","))
+		}
+	}
+}
+
+// parseSocketMode parses the octal permission bits of the unix domain socket
+func parseSocketMode(s string) (uint32, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid octal mode %v", s)
+	}
+	if mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("mode %v out of range (possible: 0001 to 0777)", s)
+	}
+	return uint32(mode), nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	defaultHealthInterval = time.Minute
+	minHealthInterval     = time.Second
+	defaultHealthTimeout  = 10 * time.Second
+)
+
+// statusMonitor holds the capabilities of the drivers and periodically checks
+// the health of the drivers implementing the HealthChecker interface
+type statusMonitor struct {
+	mu       sync.Mutex
+	interval time.Duration
+	timeout  time.Duration
+	names    []string
+	drivers  []ar.Driver
+	status   []ar.DriverStatus
+	pending  []bool
+	now      func() time.Time
+}
+
+func newStatusMonitor(c *Config, names []string, drivers []ar.Driver) (*statusMonitor, error) {
+
+	interval := defaultHealthInterval
+	if c.HealthInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.HealthInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse health check interval: %w", err)
+		}
+		if interval < minHealthInterval {
+			return nil, fmt.Errorf("health check interval %v below minimum %v", interval,
+				minHealthInterval)
+		}
+	}
+
+	return &statusMonitor{
+		interval: interval,
+		timeout:  defaultHealthTimeout,
+		names:    names,
+		drivers:  drivers,
+		status:   make([]ar.DriverStatus, len(drivers)),
+		pending:  make([]bool, len(drivers)),
+		now:      time.Now,
+	}, nil
+}
+
+// run performs health checks until the process terminates
+func (m *statusMonitor) run() {
+	for {
+		time.Sleep(m.interval)
+		m.check()
+	}
+}
+
+// check refreshes the status of all drivers. The drivers are checked
+// concurrently, so that a hanging driver does not delay the others
+func (m *statusMonitor) check() {
+	var wg sync.WaitGroup
+	for i := range m.drivers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.checkDriver(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (m *statusMonitor) checkDriver(i int) {
+
+	// Refresh the capabilities, as e.g. the certificates might have been renewed
+	s := getDriverStatus(m.drivers[i])
+	s.Name = m.names[i]
+	s.Signer = i == 0
+
+	err := m.checkHealth(i)
+	if err != nil {
+		log.Warnf("Driver %v health check failed: %v", m.names[i], err)
+		s.HealthError = err.Error()
+	}
+	s.Healthy = err == nil
+	s.HealthChecked = m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status[i] = s
+}
+
+// checkHealth runs the health check of the driver, if implemented, limited by
+// the timeout. A timed out check stays pending until the driver returns,
+// further checks of the driver fail in the meantime
+func (m *statusMonitor) checkHealth(i int) error {
+
+	hc, ok := m.drivers[i].(ar.HealthChecker)
+	if !ok {
+		return nil
+	}
+
+	m.mu.Lock()
+	if m.pending[i] {
+		m.mu.Unlock()
+		return errors.New("previous health check did not return")
+	}
+	m.pending[i] = true
+	m.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := hc.CheckHealth()
+		m.mu.Lock()
+		m.pending[i] = false
+		m.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(m.timeout):
+		return fmt.Errorf("health check timed out after %v", m.timeout)
+	}
+}
+
+// getStatus returns a copy of the status of all drivers with the designated
+// signer first
+func (m *statusMonitor) getStatus() []ar.DriverStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make([]ar.DriverStatus, 0, len(m.status))
+	for _, s := range m.status {
+		s.KeyAlgorithms = append([]string(nil), s.KeyAlgorithms...)
+		s.Certificates = append([]ar.CertStatus(nil), s.Certificates...)
+		s.MeasurementTypes = append([]string(nil), s.MeasurementTypes...)
+		s.PcrBanks = append([]string(nil), s.PcrBanks...)
+		s.Warnings = append([]string(nil), s.Warnings...)
+		status = append(status, s)
+	}
+	return status
+}
+
+// getDriverStatus returns the capabilities reported by the driver. Key
+// algorithm and certificates are derived from the signing key and the
+// certificate chain if not reported by the driver
+func getDriverStatus(d ar.Driver) ar.DriverStatus {
+
+	var s ar.DriverStatus
+	if sp, ok := d.(ar.StatusProvider); ok {
+		s = sp.Status()
+	}
+
+	if len(s.KeyAlgorithms) == 0 && getRoles(d).Signer {
+		if _, pub, err := d.GetSigningKeys(); err == nil {
+			s.KeyAlgorithms = []string{keyAlgorithm(pub)}
+		}
+	}
+
+	if len(s.Certificates) == 0 && getRoles(d).Signer {
+		if chain, err := d.GetCertChain(); err == nil && len(chain) > 0 {
+			s.Certificates = []ar.CertStatus{{
+				Name:     "Signing",
+				Subject:  chain[0].Subject.CommonName,
+				NotAfter: chain[0].NotAfter,
+			}}
+		}
+	}
+
+	return s
+}
+
+// keyAlgorithm returns a human readable description of the key algorithm
+func keyAlgorithm(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %v", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// testHealthDriver is a driver reporting its status and health. If hang is
+// set, the health check blocks until the channel is closed
+type testHealthDriver struct {
+	*testDriver
+	err  error
+	hang chan struct{}
+}
+
+func (d *testHealthDriver) Status() ar.DriverStatus {
+	return ar.DriverStatus{
+		Version:          "1.0",
+		MeasurementTypes: []string{d.typ + " Measurement"},
+		PcrBanks:         []string{"sha256"},
+	}
+}
+
+func (d *testHealthDriver) CheckHealth() error {
+	if d.hang != nil {
+		<-d.hang
+	}
+	return d.err
+}
+
+func Test_statusMonitor(t *testing.T) {
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	signer := newTestDriver(t, "Signer", nil)
+	healthy := &testHealthDriver{testDriver: newTestDriver(t, "Healthy", nil)}
+	failing := &testHealthDriver{testDriver: newTestDriver(t, "Failing", nil),
+		err: errors.New("device not responding")}
+	hanging := &testHealthDriver{testDriver: newTestDriver(t, "Hanging", nil), hang: hang}
+	sensor := &testSigner{newTestDriver(t, "Sensor", &ar.DriverRoles{Measurer: true})}
+
+	names := []string{"signer", "healthy", "failing", "hanging", "sensor"}
+	m, err := newStatusMonitor(&Config{}, names,
+		[]ar.Driver{signer, healthy, failing, hanging, sensor})
+	if err != nil {
+		t.Fatalf("newStatusMonitor() error = %v", err)
+	}
+	m.timeout = 50 * time.Millisecond
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	tests := []struct {
+		name        string
+		want        ar.DriverStatus
+		wantHealthy []bool
+	}{
+		{
+			name: "signer",
+			want: ar.DriverStatus{
+				Name:          "signer",
+				Signer:        true,
+				KeyAlgorithms: []string{"ECDSA P-256"},
+				Certificates: []ar.CertStatus{{Name: "Signing", Subject: "Signer",
+					NotAfter: signer.cert.NotAfter}},
+			},
+			wantHealthy: []bool{true, true},
+		},
+		{
+			name: "healthy",
+			want: ar.DriverStatus{
+				Name:          "healthy",
+				Version:       "1.0",
+				KeyAlgorithms: []string{"ECDSA P-256"},
+				Certificates: []ar.CertStatus{{Name: "Signing", Subject: "Healthy",
+					NotAfter: healthy.cert.NotAfter}},
+				MeasurementTypes: []string{"Healthy Measurement"},
+				PcrBanks:         []string{"sha256"},
+			},
+			wantHealthy: []bool{true, true},
+		},
+		{
+			name: "failing",
+			want: ar.DriverStatus{
+				Name:          "failing",
+				Version:       "1.0",
+				KeyAlgorithms: []string{"ECDSA P-256"},
+				Certificates: []ar.CertStatus{{Name: "Signing", Subject: "Failing",
+					NotAfter: failing.cert.NotAfter}},
+				MeasurementTypes: []string{"Failing Measurement"},
+				PcrBanks:         []string{"sha256"},
+			},
+			wantHealthy: []bool{false, false},
+		},
+		{
+			name: "hanging",
+			want: ar.DriverStatus{
+				Name:          "hanging",
+				Version:       "1.0",
+				KeyAlgorithms: []string{"ECDSA P-256"},
+				Certificates: []ar.CertStatus{{Name: "Signing", Subject: "Hanging",
+					NotAfter: hanging.cert.NotAfter}},
+				MeasurementTypes: []string{"Hanging Measurement"},
+				PcrBanks:         []string{"sha256"},
+			},
+			wantHealthy: []bool{false, false},
+		},
+		{
+			name: "sensor",
+			want: ar.DriverStatus{
+				Name: "sensor",
+			},
+			wantHealthy: []bool{true, true},
+		},
+	}
+
+	// The second check must not block on the still pending check of the
+	// hanging driver
+	for run := 0; run < 2; run++ {
+		start := time.Now()
+		m.check()
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("check() took %v", d)
+		}
+
+		status := m.getStatus()
+		if len(status) != len(tests) {
+			t.Fatalf("getStatus() returned %v drivers, want %v", len(status), len(tests))
+		}
+		for i, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got := status[i]
+				if got.Healthy != tt.wantHealthy[run] {
+					t.Errorf("run %v: Healthy = %v, want %v (%v)", run, got.Healthy,
+						tt.wantHealthy[run], got.HealthError)
+				}
+				if !got.Healthy && got.HealthError == "" {
+					t.Errorf("run %v: unhealthy driver without health error", run)
+				}
+				if !got.HealthChecked.Equal(now) {
+					t.Errorf("run %v: HealthChecked = %v, want %v", run, got.HealthChecked, now)
+				}
+				got.Healthy = false
+				got.HealthError = ""
+				got.HealthChecked = time.Time{}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("run %v: status = %+v, want %+v", run, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func Test_newStatusMonitor(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"Default", "", defaultHealthInterval, false},
+		{"Configured", "30s", 30 * time.Second, false},
+		{"Below Minimum", "10ms", 0, true},
+		{"Invalid", "often", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newStatusMonitor(&Config{HealthInterval: tt.interval}, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newStatusMonitor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.interval != tt.want {
+				t.Errorf("interval = %v, want %v", m.interval, tt.want)
+			}
+		})
+	}
+}
+
+func TestCmcStatusNil(t *testing.T) {
+	var c *Cmc
+	if s := c.Status(); s != nil {
+		t.Errorf("Status() = %v, want nil", s)
+	}
+}
@@ -0,0 +1,614 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/sink"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+var (
+	keyConfigs    = []string{"EC256", "EC384", "EC521", "RSA2048", "RSA4096"}
+	akKeyConfigs  = []string{"EC256", "EC384", "RSA2048"}
+	pcrBanks      = []string{"sha1", "sha256"}
+	keyProtection = []string{"passphrase", "tpm"}
+)
+
+const (
+	numPcrs            = 24
+	minSocketChunkSize = 1024
+)
+
+// driverRequirements contains the checks of the configuration fields required
+// by single drivers
+var driverRequirements = map[string]func(c *Config, errs *ConfigErrors){
+	"dcap": func(c *Config, errs *ConfigErrors) {
+		if c.DcapSocket == "" {
+			errs.add("dcapSocket", "required by driver dcap")
+		}
+	},
+	"pkcs11": func(c *Config, errs *ConfigErrors) {
+		if c.Pkcs11Module == "" {
+			errs.add("pkcs11Module", "required by driver pkcs11")
+		} else if _, err := os.Stat(c.Pkcs11Module); err != nil {
+			errs.add("pkcs11Module", "%v", err)
+		}
+		if c.Pkcs11KeyLabel == "" && c.Pkcs11KeyId == "" {
+			errs.add("pkcs11KeyLabel", "key label or ID required by driver pkcs11")
+		}
+		if c.Pkcs11KeyId != "" {
+			if _, err := hex.DecodeString(strings.TrimPrefix(c.Pkcs11KeyId, "0x")); err != nil {
+				errs.add("pkcs11KeyId", "invalid hex key ID: %v", err)
+			}
+		}
+		if c.Pkcs11Slot != "" {
+			if _, err := strconv.ParseUint(c.Pkcs11Slot, 0, 32); err != nil {
+				errs.add("pkcs11Slot", "invalid slot: %v", err)
+			}
+		}
+		if c.Pkcs11Pin == "" {
+			errs.add("pkcs11Pin", "required by driver pkcs11")
+		}
+	},
+	"plugin": func(c *Config, errs *ConfigErrors) {
+		if len(c.PluginSockets) == 0 {
+			errs.add("pluginSockets", "required by driver plugin")
+		}
+	},
+	"psa": func(c *Config, errs *ConfigErrors) {
+		if c.PsaCommand == "" {
+			errs.add("psaCommand", "required by driver psa")
+		}
+	},
+	"sw": func(c *Config, errs *ConfigErrors) {
+		if strings.EqualFold(c.SwKeyProtection, "passphrase") && c.SwKeyPassphrase == "" {
+			errs.add("swKeyPassphrase", "required by key protection passphrase")
+		}
+	},
+	"tdx": func(c *Config, errs *ConfigErrors) {
+		if c.TdxQgsAddr != "" {
+			if _, err := internal.ParseVsockAddr(c.TdxQgsAddr); err != nil {
+				errs.Add("tdxQgsAddr", err)
+			}
+		}
+	},
+}
+
+// ConfigError is a problem of a single configuration field, which is
+// referenced by its JSON path, e.g. drivers[1]
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all problems found in a configuration
+type ConfigErrors []*ConfigError
+
+func (errs *ConfigErrors) add(path, format string, args ...any) {
+	*errs = append(*errs, &ConfigError{Path: path, Err: fmt.Errorf(format, args...)})
+}
+
+// Add appends a problem of the configuration field with the path
+func (errs *ConfigErrors) Add(path string, err error) {
+	*errs = append(*errs, &ConfigError{Path: path, Err: err})
+}
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration without initializing the drivers or
+// fetching remote metadata. The local files the configuration references must
+// exist and be parseable. All problems found are returned
+func (c *Config) Validate() ConfigErrors {
+
+	var errs ConfigErrors
+
+	c.validateDrivers(&errs)
+	c.validateMetadata(&errs)
+	c.validateLogging(&errs)
+
+	if c.KeyConfig != "" && !slices.Contains(keyConfigs, c.KeyConfig) {
+		errs.add("keyConfig", "unknown key configuration %v (possible: %v)", c.KeyConfig,
+			strings.Join(keyConfigs, ","))
+	}
+	if c.AkKeyConfig != "" && !slices.Contains(akKeyConfigs, c.AkKeyConfig) {
+		errs.add("akKeyConfig", "unknown AK key configuration %v (possible: %v)", c.AkKeyConfig,
+			strings.Join(akKeyConfigs, ","))
+	}
+
+	if c.PolicyEngine != "" {
+		sel, ok := policyEngines[strings.ToLower(c.PolicyEngine)]
+		if !ok {
+			errs.add("policyEngine", "unknown policy engine %v (possible: %v)", c.PolicyEngine,
+				sortedKeys(policyEngines))
+		} else if !verify.PolicyEngineAvailable(sel) {
+			errs.add("policyEngine", "policy engine %v not compiled in", c.PolicyEngine)
+		}
+	}
+
+	if c.ProvServerAddr != "" {
+		checkUrl(&errs, "provServerAddr", c.ProvServerAddr)
+	}
+
+	for _, d := range []struct {
+		path  string
+		value string
+	}{
+		{"storage", c.Storage},
+		{"cache", c.Cache},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if info, err := os.Stat(d.value); err == nil && !info.IsDir() {
+			errs.add(d.path, "%v is not a directory", d.value)
+		}
+	}
+
+	for _, s := range []struct {
+		path   string
+		source string
+	}{
+		{"bootstrapToken", c.BootstrapToken},
+		{"ownerAuth", c.OwnerAuth},
+		{"endorsementAuth", c.EndorsementAuth},
+		{"keyAuth", c.KeyAuth},
+		{"swKeyPassphrase", c.SwKeyPassphrase},
+		{"pkcs11Pin", c.Pkcs11Pin},
+	} {
+		if s.source == "" {
+			continue
+		}
+		if err := internal.CheckSecretSource(s.source); err != nil {
+			errs.Add(s.path, err)
+		}
+	}
+
+	for _, d := range []struct {
+		path  string
+		value string
+	}{
+		{"imaPollInterval", c.ImaPollInterval},
+		{"pluginTimeout", c.PluginTimeout},
+		{"renewThreshold", c.RenewThreshold},
+		{"renewInterval", c.RenewInterval},
+		{"healthInterval", c.HealthInterval},
+		{"enrollMaxBackoff", c.EnrollMaxBackoff},
+		{"shutdownTimeout", c.ShutdownTimeout},
+		{"requestQueueTimeout", c.RequestQueueTimeout},
+		{"policyTimeout", c.PolicyTimeout},
+		{"nonceTtl", c.NonceTtl},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil {
+			errs.Add(d.path, err)
+		} else if v <= 0 {
+			errs.add(d.path, "duration %v must be positive", d.value)
+		}
+	}
+	if c.RenewInterval != "" && c.RenewThreshold == "" {
+		errs.add("renewInterval", "requires renewThreshold")
+	}
+
+	if c.SocketChunkSize != 0 &&
+		(c.SocketChunkSize < minSocketChunkSize || c.SocketChunkSize > api.MaxMsgLen) {
+		errs.add("socketChunkSize", "chunk size %v out of range (possible: %v to %v)",
+			c.SocketChunkSize, minSocketChunkSize, api.MaxMsgLen)
+	}
+	if c.MaxConcurrentRequests < 0 {
+		errs.add("maxConcurrentRequests", "limit %v must not be negative", c.MaxConcurrentRequests)
+	}
+	if c.SocketMode != "" {
+		if _, err := parseSocketMode(c.SocketMode); err != nil {
+			errs.Add("socketMode", err)
+		}
+	}
+	if c.SocketAccess != nil {
+		c.SocketAccess.validate(&errs)
+	}
+
+	// PCRs and TPM handles
+	if c.UseIma {
+		checkPcr(&errs, "imaPcr", c.ImaPcr)
+	}
+	if r := c.ImaRedaction; r != nil {
+		if !c.UseIma {
+			errs.add("imaRedaction", "requires useIma")
+		}
+		if len(r.Prefixes) == 0 {
+			errs.add("imaRedaction.prefixes", "at least one prefix required")
+		}
+		if r.Salt != "" {
+			if err := internal.CheckSecretSource(r.Salt); err != nil {
+				errs.Add("imaRedaction.salt", err)
+			}
+		} else if !r.DiscloseSalt {
+			errs.add("imaRedaction.salt", "required if the salt is not disclosed")
+		}
+	}
+	for i, source := range c.RedactionSalts {
+		if err := internal.CheckSecretSource(source); err != nil {
+			errs.Add(fmt.Sprintf("redactionSalts[%v]", i), err)
+		}
+	}
+	if c.UseCtr {
+		checkPcr(&errs, "ctrPcr", c.CtrPcr)
+		if c.CtrDriver == "" {
+			errs.add("ctrDriver", "required by container measurements")
+		} else if !internal.Contains(c.CtrDriver, c.Drivers) {
+			errs.add("ctrDriver", "driver %v not configured", c.CtrDriver)
+		}
+		if c.CtrLog == "" {
+			errs.add("ctrLog", "required by container measurements")
+		}
+		if c.CtrJournal != "" && c.CtrJournal == c.CtrLog {
+			errs.add("ctrJournal", "must differ from ctrLog")
+		}
+	} else if c.CtrJournal != "" {
+		errs.add("ctrJournal", "requires useCtr")
+	}
+	banks := maps.Keys(c.PcrSelection)
+	slices.Sort(banks)
+	for _, bank := range banks {
+		if !slices.Contains(pcrBanks, strings.ToLower(bank)) {
+			errs.add("pcrSelection."+bank, "unsupported PCR bank (possible: %v)",
+				strings.Join(pcrBanks, ","))
+		}
+		for i, pcr := range c.PcrSelection[bank] {
+			checkPcr(&errs, fmt.Sprintf("pcrSelection.%v[%v]", bank, i), pcr)
+		}
+	}
+	for i, pcr := range c.IkPolicyPcrs {
+		checkPcr(&errs, fmt.Sprintf("ikPolicyPcrs[%v]", i), pcr)
+	}
+	for i, pcr := range c.SwKeyPcrs {
+		checkPcr(&errs, fmt.Sprintf("swKeyPcrs[%v]", i), pcr)
+	}
+	for _, h := range []struct {
+		path  string
+		value string
+	}{
+		{"akHandle", c.AkHandle},
+		{"ikHandle", c.IkHandle},
+		{"nvIndex", c.NvIndex},
+	} {
+		if h.value == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(h.value, 0, 32); err != nil {
+			errs.add(h.path, "invalid handle %v", h.value)
+		}
+	}
+
+	if c.SwKeyProtection != "" &&
+		!slices.Contains(keyProtection, strings.ToLower(c.SwKeyProtection)) {
+		errs.add("swKeyProtection", "unknown key protection %v (possible: %v)",
+			c.SwKeyProtection, strings.Join(keyProtection, ","))
+	}
+
+	if c.PsaIakChain != "" {
+		if data, err := os.ReadFile(c.PsaIakChain); err != nil {
+			errs.Add("psaIakChain", err)
+		} else if _, err := internal.ParseCertsPem(data); err != nil {
+			errs.add("psaIakChain", "failed to parse certificates: %v", err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, p := range c.CertProfiles {
+		path := fmt.Sprintf("certProfiles[%v].name", i)
+		if p.Name == "" {
+			errs.add(path, "missing profile name")
+		} else if names[p.Name] {
+			errs.add(path, "profile %v configured more than once", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	if l := c.DecodeLimits; l != nil {
+		if l.MaxSize < 0 || l.MaxArrayElements < 0 || l.MaxMapPairs < 0 ||
+			l.MaxNestedLevels < 0 {
+			errs.add("decodeLimits", "limits must not be negative")
+		}
+	}
+
+	if c.Appraisal != nil {
+		if err := c.Appraisal.Validate(); err != nil {
+			errs.Add("appraisal", err)
+		}
+	}
+
+	if err := ar.ValidateSerializerPin(c.PinSerializer); err != nil {
+		errs.Add("pinSerializer", err)
+	}
+
+	caches := maps.Keys(c.Caches)
+	slices.Sort(caches)
+	for _, name := range caches {
+		if !slices.Contains(cache.Names(), name) {
+			errs.add("caches."+name, "unknown cache (possible: %v)",
+				strings.Join(cache.Names(), ","))
+		} else if _, err := c.Caches[name].Limits(cache.Limits{}); err != nil {
+			errs.Add("caches."+name, err)
+		}
+	}
+
+	if c.VerifyMemoryBudget < 0 {
+		errs.add("verifyMemoryBudget", "budget must not be negative")
+	}
+	if c.MaxNonces < 0 {
+		errs.add("maxNonces", "maximum must not be negative")
+	}
+	if c.PolicyMemoryLimit < 0 {
+		errs.add("policyMemoryLimit", "limit must not be negative")
+	}
+	if c.VerifySpoolThreshold < 0 {
+		errs.add("verifySpoolThreshold", "threshold must not be negative")
+	} else if c.VerifySpoolThreshold != 0 && c.VerifyMemoryBudget == 0 {
+		errs.add("verifySpoolThreshold", "requires verifyMemoryBudget")
+	}
+	if c.VerifySpoolDir != "" {
+		if c.VerifyMemoryBudget == 0 {
+			errs.add("verifySpoolDir", "requires verifyMemoryBudget")
+		} else if info, err := os.Stat(c.VerifySpoolDir); err != nil {
+			errs.add("verifySpoolDir", "%v", err)
+		} else if !info.IsDir() {
+			errs.add("verifySpoolDir", "%v is not a directory", c.VerifySpoolDir)
+		}
+	}
+
+	for i := range c.ResultSinks {
+		checkSink(&errs, fmt.Sprintf("resultSinks[%v]", i), &c.ResultSinks[i])
+	}
+	if c.Archive != nil {
+		if c.Archive.Dir == "" {
+			errs.add("archive.dir", "archive requires a folder")
+		}
+		if c.Archive.Retention != "" {
+			if v, err := time.ParseDuration(c.Archive.Retention); err != nil {
+				errs.Add("archive.retention", err)
+			} else if v <= 0 {
+				errs.add("archive.retention", "duration %v must be positive", c.Archive.Retention)
+			}
+		}
+		if c.Archive.QueueSize < 0 {
+			errs.add("archive.queueSize", "queue size must not be negative")
+		}
+	}
+
+	return errs
+}
+
+// validateDrivers checks that the drivers are compiled in, form a coherent
+// combination and that the fields required by the drivers are set
+func (c *Config) validateDrivers(errs *ConfigErrors) {
+
+	known := true
+	for i, name := range c.Drivers {
+		if _, ok := drivers[strings.ToLower(name)]; !ok {
+			errs.add(fmt.Sprintf("drivers[%v]", i), "driver %v not compiled in (possible: %v)",
+				name, sortedKeys(drivers))
+			known = false
+		}
+	}
+	if !known {
+		return
+	}
+	names, err := orderDrivers(c.Drivers, c.Signer, drivers)
+	if err != nil {
+		errs.Add("drivers", err)
+	} else if _, err := orderSigners(c.AdditionalSigners, names, drivers); err != nil {
+		errs.Add("additionalSigners", err)
+	}
+
+	for _, name := range c.Drivers {
+		if check, ok := driverRequirements[strings.ToLower(name)]; ok {
+			check(c, errs)
+		}
+	}
+
+	// Without stored credentials, the drivers enroll their certificates on startup
+	if c.ProvServerAddr == "" && c.Storage == "" {
+		for _, name := range c.Drivers {
+			if !strings.EqualFold(name, "plugin") {
+				errs.add("provServerAddr", "required by driver %v without storage", name)
+				break
+			}
+		}
+	}
+}
+
+// validateMetadata checks the syntax of the metadata locations of the prover
+// and of the EAT metadata. Local metadata must exist and consist of signed JSON
+// or CBOR objects, which must match the pinned serializer if configured
+func (c *Config) validateMetadata(errs *ConfigErrors) {
+	pin := c.PinSerializer
+	if ar.ValidateSerializerPin(pin) != nil {
+		pin = ""
+	}
+	checkMetadataLocations(errs, "metadata", c.Metadata, pin)
+	checkMetadataLocations(errs, "eatMetadata", c.EatMetadata, pin)
+}
+
+func checkMetadataLocations(errs *ConfigErrors, name string, locations []string, pin string) {
+	for i, p := range locations {
+		path := fmt.Sprintf("%v[%v]", name, i)
+		if !strings.HasPrefix(p, "file://") {
+			checkUrl(errs, path, p)
+			continue
+		}
+		data, err := loadMetadata(strings.TrimPrefix(p, "file://"))
+		if err != nil {
+			errs.Add(path, err)
+			continue
+		}
+		for j, elem := range data {
+			if err := checkMetadata(elem, pin); err != nil {
+				errs.add(path, "metadata object %v: %v", j, err)
+			}
+		}
+	}
+}
+
+// validateLogging checks the log format and levels
+func (c *Config) validateLogging(errs *ConfigErrors) {
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			errs.add("logLevel", "unknown log level %v", c.LogLevel)
+		}
+	}
+	if c.LogFormat != "" && !slices.Contains(internal.LogFormats, strings.ToLower(c.LogFormat)) {
+		errs.add("logFormat", "unknown log format %v (possible: %v)", c.LogFormat,
+			strings.Join(internal.LogFormats, ","))
+	}
+	subsystems := maps.Keys(c.LogLevels)
+	slices.Sort(subsystems)
+	for _, s := range subsystems {
+		if !slices.Contains(internal.Subsystems(), s) {
+			errs.add("logLevels."+s, "unknown log subsystem (possible: %v)",
+				strings.Join(internal.Subsystems(), ","))
+		} else if _, err := logrus.ParseLevel(c.LogLevels[s]); err != nil {
+			errs.add("logLevels."+s, "unknown log level %v", c.LogLevels[s])
+		}
+	}
+}
+
+// checkMetadata checks that the metadata object is serialized as JSON or CBOR,
+// or with the pinned serializer if set, and contains a version in RFC3339 format
+func checkMetadata(data []byte, pin string) error {
+	s, err := ar.DetectSerializer(data)
+	if err != nil {
+		return errors.New("neither JSON nor CBOR")
+	}
+	if name := ar.SerializerName(s); pin != "" && name != pin {
+		return fmt.Errorf("%w: got %v, pinned %v", ar.ErrSerializerNotAllowed, name, pin)
+	}
+	payload, err := s.GetPayload(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse: %w", err)
+	}
+	info := new(ar.MetaInfo)
+	if err := s.Unmarshal(payload, info); err != nil {
+		return fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	if _, err := time.Parse(time.RFC3339, info.Version); err != nil {
+		return fmt.Errorf("incorrect version %v (must be RFC3339 format)", info.Version)
+	}
+	return nil
+}
+
+func checkUrl(errs *ConfigErrors, path, addr string) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		errs.Add(path, err)
+		return
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		errs.add(path, "unsupported URL scheme in %v", addr)
+	} else if u.Host == "" {
+		errs.add(path, "missing host in %v", addr)
+	}
+}
+
+func checkSink(errs *ConfigErrors, path string, c *sink.Config) {
+	switch strings.ToLower(c.Type) {
+	case sink.TypeWebhook:
+		if u, err := url.Parse(c.Url); err != nil {
+			errs.Add(path+".url", err)
+		} else if u.Scheme != "https" || u.Host == "" {
+			errs.add(path+".url", "webhook URL %v must be an https URL with host", c.Url)
+		}
+		if c.Ca != "" {
+			if data, err := os.ReadFile(c.Ca); err != nil {
+				errs.Add(path+".ca", err)
+			} else if _, err := internal.ParseCertsPem(data); err != nil {
+				errs.add(path+".ca", "failed to parse certificates: %v", err)
+			}
+		}
+		if c.HmacKey != "" {
+			if err := internal.CheckSecretSource(c.HmacKey); err != nil {
+				errs.Add(path+".hmacKey", err)
+			}
+		}
+		if c.QueueSize < 0 {
+			errs.add(path+".queueSize", "queue size must not be negative")
+		}
+		if c.Retries != nil && *c.Retries < 0 {
+			errs.add(path+".retries", "retries must not be negative")
+		}
+		if c.Timeout != "" {
+			if v, err := time.ParseDuration(c.Timeout); err != nil {
+				errs.Add(path+".timeout", err)
+			} else if v <= 0 {
+				errs.add(path+".timeout", "duration %v must be positive", c.Timeout)
+			}
+		}
+	case sink.TypeFile:
+		if c.File == "" {
+			errs.add(path+".file", "missing result file")
+		} else if info, err := os.Stat(filepath.Dir(c.File)); err != nil || !info.IsDir() {
+			errs.add(path+".file", "folder of %v does not exist", c.File)
+		}
+	default:
+		errs.add(path+".type", "unknown sink type %v (must be one of %v)", c.Type,
+			strings.Join(sink.Types(), ", "))
+	}
+}
+
+func checkPcr(errs *ConfigErrors, path string, pcr int) {
+	if pcr < 0 || pcr >= numPcrs {
+		errs.add(path, "invalid PCR %v (must be 0-%v)", pcr, numPcrs-1)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) string {
+	keys := maps.Keys(m)
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
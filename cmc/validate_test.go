@@ -0,0 +1,252 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/cmc/archive"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/sink"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"golang.org/x/exp/slices"
+)
+
+func TestConfigValidate(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	dir := t.TempDir()
+	if err := f.Write(dir); err != nil {
+		t.Fatalf("failed to write fixtures: %v", err)
+	}
+	invalid := filepath.Join(dir, "invalid")
+	if err := os.MkdirAll(invalid, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(invalid, "manifest.json"), []byte("{\"type\":"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CMC_TEST_PIN", "1234")
+	repeat := func(path string, n int) []string {
+		paths := make([]string, n)
+		for i := range paths {
+			paths[i] = path
+		}
+		return paths
+	}
+
+	valid := func() *Config {
+		return &Config{
+			Addr:           "localhost:9955",
+			ProvServerAddr: "https://localhost:9000/",
+			Metadata:       []string{"file://" + filepath.Join(dir, "metadata")},
+			Drivers:        []string{"tpm"},
+			KeyConfig:      "EC256",
+			Api:            "grpc",
+			PolicyEngine:   "js",
+			LogLevel:       "trace",
+			Storage:        t.TempDir(),
+		}
+	}
+
+	tests := []struct {
+		name      string
+		modify    func(c *Config)
+		wantPaths []string
+	}{
+		{"Valid", func(c *Config) {}, nil},
+		{"Unknown Driver", func(c *Config) { c.Drivers = []string{"tpm", "foo"} },
+			[]string{"drivers[1]"}},
+		{"Conflicting Drivers", func(c *Config) { c.Drivers = []string{"gce", "tpm"} },
+			[]string{"drivers"}},
+		{"Signer Not Configured", func(c *Config) { c.Signer = "sw" }, []string{"drivers"}},
+		{"Additional Signer", func(c *Config) { c.AdditionalSigners = []string{"tpm"} },
+			[]string{"additionalSigners"}},
+		{"Missing Metadata", func(c *Config) {
+			c.Metadata = []string{"file://" + filepath.Join(dir, "missing")}
+		}, []string{"metadata[0]"}},
+		{"Invalid Metadata", func(c *Config) {
+			c.Metadata = append(c.Metadata, "file://"+invalid)
+		}, []string{"metadata[1]"}},
+		{"Metadata Scheme", func(c *Config) { c.Metadata = []string{"ftp://localhost/"} },
+			[]string{"metadata[0]"}},
+		{"Key Config", func(c *Config) { c.KeyConfig = "EC25519" }, []string{"keyConfig"}},
+		{"AK Key Config", func(c *Config) { c.AkKeyConfig = "EC521" }, []string{"akKeyConfig"}},
+		{"Policy Engine", func(c *Config) { c.PolicyEngine = "opa" }, []string{"policyEngine"}},
+		{"Policy Limits", func(c *Config) {
+			c.PolicyTimeout = "0s"
+			c.PolicyMemoryLimit = -1
+		}, []string{"policyTimeout", "policyMemoryLimit"}},
+		{"Nonce Limits", func(c *Config) {
+			c.NonceTtl = "soon"
+			c.MaxNonces = -1
+		}, []string{"nonceTtl", "maxNonces"}},
+		{"Log Levels", func(c *Config) {
+			c.LogLevel = "loud"
+			c.LogLevels = map[string]string{"drivers": "debug", "tpm": "trace"}
+		}, []string{"logLevel", "logLevels.tpm"}},
+		{"Log Format", func(c *Config) { c.LogFormat = "xml" }, []string{"logFormat"}},
+		{"Durations", func(c *Config) {
+			c.RenewThreshold = "30 days"
+			c.HealthInterval = "-1m"
+			c.ShutdownTimeout = "0s"
+		}, []string{"renewThreshold", "healthInterval", "shutdownTimeout"}},
+		{"Renew Interval Without Threshold", func(c *Config) { c.RenewInterval = "1h" },
+			[]string{"renewInterval"}},
+		{"Socket Chunk Size", func(c *Config) { c.SocketChunkSize = 512 },
+			[]string{"socketChunkSize"}},
+		{"Socket Mode", func(c *Config) { c.SocketMode = "0o660" }, []string{"socketMode"}},
+		{"Concurrency Limit", func(c *Config) {
+			c.MaxConcurrentRequests = -1
+			c.RequestQueueTimeout = "0s"
+		}, []string{"requestQueueTimeout", "maxConcurrentRequests"}},
+		{"Socket Access", func(c *Config) {
+			c.SocketAccess = &SocketAccess{Requests: map[string]PeerRule{
+				"tlssign": {Gids: []uint32{100}}, "sign": {Gids: []uint32{100}}}}
+		}, []string{"socketAccess.requests.sign"}},
+		{"Missing Provisioning Server", func(c *Config) {
+			c.ProvServerAddr = ""
+			c.Storage = ""
+		}, []string{"provServerAddr"}},
+		{"Provisioning Server Url", func(c *Config) { c.ProvServerAddr = "localhost:9000" },
+			[]string{"provServerAddr"}},
+		{"PKCS11 Fields", func(c *Config) {
+			c.Drivers = []string{"tpm", "pkcs11"}
+			c.Signer = "pkcs11"
+			c.Pkcs11Module = filepath.Join(dir, "missing.so")
+			c.Pkcs11KeyId = "xyz"
+			c.Pkcs11Pin = "1234"
+		}, []string{"pkcs11Module", "pkcs11KeyId", "pkcs11Pin"}},
+		{"PKCS11 Pin Env", func(c *Config) {
+			c.Drivers = []string{"tpm", "pkcs11"}
+			c.Signer = "pkcs11"
+			c.Pkcs11Module = filepath.Join(dir, "ca.pem")
+			c.Pkcs11KeyLabel = "ik"
+			c.Pkcs11Pin = "env:CMC_TEST_PIN"
+		}, nil},
+		{"Plugin Sockets", func(c *Config) { c.Drivers = []string{"plugin"} },
+			[]string{"pluginSockets"}},
+		{"PSA Command", func(c *Config) {
+			c.Drivers = []string{"psa"}
+			c.PsaIakChain = filepath.Join(dir, "metadata")
+		}, []string{"psaCommand", "psaIakChain"}},
+		{"SW Key Protection", func(c *Config) {
+			c.Drivers = []string{"sw"}
+			c.SwKeyProtection = "passphrase"
+		}, []string{"swKeyPassphrase"}},
+		{"DCAP Socket", func(c *Config) { c.Drivers = []string{"tpm", "dcap"} },
+			[]string{"dcapSocket"}},
+		{"TDX QGS Address", func(c *Config) {
+			c.Drivers = []string{"tdx"}
+			c.TdxQgsAddr = "host:qgs"
+		}, []string{"tdxQgsAddr"}},
+		{"Secret Source", func(c *Config) { c.BootstrapToken = "env:CMC_TEST_UNSET" },
+			[]string{"bootstrapToken"}},
+		{"PCRs", func(c *Config) {
+			c.UseIma = true
+			c.ImaPcr = 24
+			c.PcrSelection = map[string][]int{"sha256": {0, -1}, "sha3": {0}}
+		}, []string{"imaPcr", "pcrSelection.sha256[1]", "pcrSelection.sha3"}},
+		{"Handles", func(c *Config) { c.AkHandle = "ak" }, []string{"akHandle"}},
+		{"IMA Redaction", func(c *Config) {
+			c.ImaRedaction = &ar.RedactionConfig{}
+			c.RedactionSalts = []string{"env:CMC_TEST_UNSET"}
+		}, []string{"imaRedaction", "imaRedaction.prefixes", "imaRedaction.salt",
+			"redactionSalts[0]"}},
+		{"Container Driver", func(c *Config) {
+			c.UseCtr = true
+			c.CtrDriver = "sw"
+			c.CtrPcr = 11
+		}, []string{"ctrDriver", "ctrLog"}},
+		{"Container Journal", func(c *Config) {
+			c.UseCtr = true
+			c.CtrDriver = "tpm"
+			c.CtrLog = filepath.Join(dir, "ctr.json")
+			c.CtrJournal = c.CtrLog
+		}, []string{"ctrJournal"}},
+		{"Journal Without Containers", func(c *Config) { c.CtrJournal = dir },
+			[]string{"ctrJournal"}},
+		{"Storage File", func(c *Config) { c.Storage = filepath.Join(dir, "ca.pem") },
+			[]string{"storage"}},
+		{"Cert Profiles", func(c *Config) {
+			c.CertProfiles = []ar.CertProfile{{Name: "tls"}, {Name: "tls"}, {}}
+		}, []string{"certProfiles[1].name", "certProfiles[2].name"}},
+		{"Verification Budget", func(c *Config) {
+			c.VerifyMemoryBudget = 1 << 30
+			c.VerifySpoolThreshold = -1
+			c.VerifySpoolDir = filepath.Join(dir, "missing")
+		}, []string{"verifySpoolDir", "verifySpoolThreshold"}},
+		{"Spool Without Budget", func(c *Config) { c.VerifySpoolDir = dir },
+			[]string{"verifySpoolDir"}},
+		{"Result Sinks", func(c *Config) {
+			retries := -1
+			c.ResultSinks = []sink.Config{
+				{Type: "webhook", Url: "https://siem.example.com/results"},
+				{Type: "file", File: filepath.Join(dir, "results.jsonl")},
+				{Type: "webhook", Url: "http://siem.example.com", Retries: &retries,
+					Timeout: "10"},
+				{Type: "file", File: filepath.Join(dir, "missing", "results.jsonl")},
+				{Type: "syslog"},
+			}
+		}, []string{"resultSinks[2].retries", "resultSinks[2].timeout", "resultSinks[2].url",
+			"resultSinks[3].file", "resultSinks[4].type"}},
+		{"Appraisal", func(c *Config) {
+			c.Appraisal = &verify.Appraisal{QuoteHashes: verify.AlgorithmRule{Mode: "ignore"}}
+		}, []string{"appraisal"}},
+		{"EAT Metadata", func(c *Config) {
+			c.EatMetadata = []string{"file://" + filepath.Join(dir, "missing")}
+		}, []string{"eatMetadata[0]"}},
+		{"Pinned Serializer", func(c *Config) { c.PinSerializer = "json" }, nil},
+		{"Unknown Pinned Serializer", func(c *Config) { c.PinSerializer = "xml" },
+			[]string{"pinSerializer"}},
+		{"Pinned Serializer Mismatch", func(c *Config) { c.PinSerializer = "cbor" },
+			repeat("metadata[0]", len(f.Metadata))},
+		{"Caches", func(c *Config) {
+			c.Caches = map[string]cache.Config{
+				"collateral": {MaxEntries: 16, Ttl: "1h"},
+				"crl":        {Ttl: "1d"},
+				"foo":        {},
+			}
+		}, []string{"caches.crl", "caches.foo"}},
+		{"Archive", func(c *Config) {
+			c.Archive = &archive.Config{Retention: "90d", QueueSize: -1}
+		}, []string{"archive.dir", "archive.queueSize", "archive.retention"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			errs := c.Validate()
+			paths := make([]string, 0, len(errs))
+			for _, e := range errs {
+				paths = append(paths, e.Path)
+			}
+			slices.Sort(paths)
+			want := slices.Clone(tt.wantPaths)
+			slices.Sort(want)
+			if !slices.Equal(paths, want) {
+				t.Errorf("Validate() = %v, want problems of %v", errs, want)
+			}
+		})
+	}
+}
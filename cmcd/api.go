@@ -13,16 +13,399 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Contains the API definitions for the CoAP and unix domain socket API
+// Contains the API definitions for the CoAP, unix domain socket and HTTP API
 // The gRPC API is in a separate file
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	m "github.com/Fraunhofer-AISEC/cmc/measure"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
 )
 
-var servers = map[string]Server{}
+// servers is the registry of the compiled-in APIs. It is only written by the
+// init functions of the APIs via registerServer and read-only afterwards
+var (
+	servers       = map[string]Server{}
+	serversSealed bool
+)
 
+// Server is an API of the cmcd. Serve blocks until the server fails or is shut
+// down. Shutdown stops accepting requests and waits for the active requests
+// until the context is done, after which they are aborted. Serve returns nil
+// once the server was shut down, while Shutdown may still be draining
 type Server interface {
 	Serve(addr string, cmc *cmc.Cmc) error
+	Shutdown(ctx context.Context) error
+}
+
+// registerServer adds an API to the registry. It must only be called from
+// init functions
+func registerServer(name string, s Server) {
+	if serversSealed {
+		panic(fmt.Sprintf("API %v registered after initialization", name))
+	}
+	if _, ok := servers[name]; ok {
+		panic(fmt.Sprintf("API %v registered twice", name))
+	}
+	servers[name] = s
+}
+
+// getServer returns the API with the case-insensitive name. The registry is
+// read-only from the first lookup on
+func getServer(name string) (Server, bool) {
+	serversSealed = true
+	s, ok := servers[strings.ToLower(name)]
+	return s, ok
+}
+
+// handleSignals reloads the metadata on SIGHUP and calls shutdown on the first
+// SIGINT or SIGTERM. A second SIGINT or SIGTERM, e.g. while the server is
+// draining, exits immediately. The returned function stops the handling
+func handleSignals(c *cmc.Cmc, shutdown func()) func() {
+	sig := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		shuttingDown := false
+		for {
+			var s os.Signal
+			select {
+			case s = <-sig:
+			case <-stop:
+				return
+			}
+			switch {
+			case s == syscall.SIGHUP:
+				log.Info("Reloading metadata")
+				if err := c.ReloadMetadata(); err != nil {
+					log.Errorf("Failed to reload metadata: %v", err)
+				}
+			case !shuttingDown:
+				log.Infof("Received %v, shutting down", s)
+				shuttingDown = true
+				go shutdown()
+			default:
+				log.Warnf("Received %v during shutdown, exiting immediately", s)
+				os.Exit(1)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(stop)
+	}
+}
+
+// drain waits for the handlers of the wait group until the context is done.
+// If the context is done first, abort is called and the handlers are joined
+func drain(ctx context.Context, wg *sync.WaitGroup, abort func()) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		abort()
+		<-done
+		return fmt.Errorf("aborted active requests: %w", ctx.Err())
+	}
+}
+
+// dryRun summarizes the attestation report the CMC would generate for the
+// nonce without signing it and returns the JSON encoded summary
+func dryRun(nonce []byte, c *cmc.Cmc) ([]byte, error) {
+	log.Infof("Prover: Performing report generation dry-run with nonce: %x", nonce)
+	summary, err := generate.DryRun(nonce, c.Metadata(), c.Measurers(), c.Serializer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform dry-run: %w", err)
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dry-run summary: %w", err)
+	}
+	return data, nil
+}
+
+// The following handlers implement the requests independent of the transport,
+// so that the behavior of the socket and HTTP API cannot drift apart. The
+// transports unmarshal the requests and marshal the responses themselves
+
+// attestRequest generates and signs an attestation report or, for dry-runs,
+// the summary of the report
+func attestRequest(c *cmc.Cmc, req *api.AttestationRequest) (*api.AttestationResponse, error) {
+
+	if len(c.Drivers) == 0 {
+		return nil, errors.New("no valid signers configured")
+	}
+
+	metadata := c.Metadata()
+	if metadata == nil {
+		log.Warn("Generating AR without any metadata")
+	}
+
+	resp := &api.AttestationResponse{}
+	if req.DryRun {
+		summary, err := dryRun(req.Nonce, c)
+		if err != nil {
+			return nil, err
+		}
+		resp.DryRunSummary = summary
+		return resp, nil
+	}
+
+	log.Debugf("Prover: Generating Attestation Report with nonce: %v", hex.EncodeToString(req.Nonce))
+
+	if len(req.Cached) > 0 {
+		log.Debugf("Prover: Omitting %v metadata items cached by the verifier", len(req.Cached))
+	}
+	report, err := generate.GenerateCached(req.Nonce, metadata, c.Measurers(), c.Serializer,
+		req.Cached)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate attestation report: %w", err)
+	}
+
+	if req.Detached {
+		log.Debug("Prover: Creating detached signature of Attestation Report")
+		resp.Signature, err = generate.SignDetached(report, c.Drivers[0], c.Serializer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign attestation report: %w", err)
+		}
+		resp.Payload = report
+		return resp, nil
+	}
+
+	log.Debug("Prover: Signing Attestation Report")
+	resp.AttestationReport, err = generate.Sign(report, c.Drivers[0], c.Serializer,
+		c.AdditionalSigners...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign attestation report: %w", err)
+	}
+
+	return resp, nil
+}
+
+// peerCacheRequest returns which of the requested metadata items the verifier
+// holds from previously verified reports
+func peerCacheRequest(req *api.PeerCacheRequest) *api.PeerCacheResponse {
+	log.Tracef("Received peer cache request with ID %v for %v items", req.Id, len(req.Digests))
+	return &api.PeerCacheResponse{Cached: verify.CachedMetadata(req.Digests)}
+}
+
+// requestCas returns the deprecated single CA or PEM bundle and the list of
+// CAs of a verification request as a single PEM bundle. If the CAs cannot be
+// parsed, the verification fails with a ParseCA error code
+func requestCas(ca []byte, cas [][]byte) []byte {
+	roots, err := internal.ParseRoots(append([][]byte{ca}, cas...)...)
+	if err != nil {
+		log.Debugf("Verifier: Failed to parse CAs of verification request: %v", err)
+		return nil
+	}
+	return internal.WriteCertChainPem(roots)
+}
+
+// nonceRequest issues a random nonce, which is accepted once by verification
+// requests with IssuedNonce set until it expires
+func nonceRequest(c *cmc.Cmc, req *api.NonceRequest) (*api.NonceResponse, error) {
+
+	log.Tracef("Received nonce request with ID %v", req.Id)
+	if c.Nonces == nil {
+		return nil, errors.New("nonce issuance not configured")
+	}
+	nonce, err := c.Nonces.Issue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue nonce: %w", err)
+	}
+
+	return &api.NonceResponse{Nonce: nonce, Expires: time.Now().Add(c.Nonces.Ttl())}, nil
+}
+
+// verifyRequest verifies the attestation report and publishes the result for
+// the API and peer the request was received from. If the request requires an
+// issued nonce, the nonce is consumed first and reports answering unknown,
+// used or expired nonces are rejected without verification
+func verifyRequest(ctx context.Context, c *cmc.Cmc, req *api.VerificationRequest,
+	apiName, peer string, received time.Time,
+) (*api.VerificationResponse, error) {
+
+	var result ar.VerificationResult
+	if err := checkIssuedNonce(c, req); err != nil {
+		log.Debugf("Verifier: Rejecting Attestation Report: %v", err)
+		result = verify.NonceFailure(err)
+	} else {
+		log.Debug("Verifier: Verifying Attestation Report")
+		result, err = c.VerifyBudget.Verify(ctx, req.AttestationReport, req.Nonce,
+			requestCas(req.Ca, req.Cas), req.Policies, c.PolicyEngineSelect, c.IntelStorage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify Attestation Report: %w", err)
+		}
+	}
+	c.PublishResult(apiName, peer, req.AttestationReport, req.Nonce, received, &result)
+
+	log.Debug("Verifier: Marshaling Attestation Result")
+	r, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Attestation Result: %w", err)
+	}
+
+	return &api.VerificationResponse{VerificationResult: r}, nil
+}
+
+// checkIssuedNonce consumes the nonce of the request, if the request requires
+// a nonce issued via a nonce request
+func checkIssuedNonce(c *cmc.Cmc, req *api.VerificationRequest) error {
+	if !req.IssuedNonce {
+		return nil
+	}
+	if c.Nonces == nil {
+		return fmt.Errorf("%w: nonce issuance not configured", verify.ErrNonceUnknown)
+	}
+	return c.Nonces.CheckNonce(req.Nonce)
+}
+
+// tlsSignRequest signs the content with the key of the requested certificate
+// profile
+func tlsSignRequest(c *cmc.Cmc, req *api.TLSSignRequest) (*api.TLSSignResponse, error) {
+
+	if len(c.Drivers) == 0 {
+		return nil, errors.New("no valid signers configured")
+	}
+
+	// Get signing options from request
+	opts, err := api.HashToSignerOpts(req.Hashtype, req.PssOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to choose requested hash function: %w", err)
+	}
+
+	// Get key handle of the requested certificate profile from (hardware) interface
+	tlsKeyPriv, _, err := c.SigningKeys(req.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IK: %w", err)
+	}
+	signer, ok := tlsKeyPriv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("failed to get IK: key is not a signer")
+	}
+	err = checkSignerOpts(signer.Public(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign
+	log.Trace("TLSSign using opts: ", opts)
+	signature, err := signer.Sign(rand.Reader, req.Content, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	return &api.TLSSignResponse{SignedContent: signature}, nil
+}
+
+// checkSignerOpts rejects PSS options for non-RSA keys. Some signers ignore
+// the options for ECDSA keys, so that the peer would otherwise receive a
+// signature of a different scheme than it requested
+func checkSignerOpts(pub crypto.PublicKey, opts crypto.SignerOpts) error {
+	if _, ok := opts.(*rsa.PSSOptions); !ok {
+		return nil
+	}
+	if _, ok := pub.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("PSS options are not supported for keys of type %T", pub)
+	}
+	return nil
+}
+
+// tlsCertRequest returns the PEM encoded certificate chain of the requested
+// certificate profile
+func tlsCertRequest(c *cmc.Cmc, req *api.TLSCertRequest) (*api.TLSCertResponse, error) {
+
+	if len(c.Drivers) == 0 {
+		return nil, errors.New("no valid signers configured")
+	}
+	log.Tracef("Received TLS cert request with ID %v", req.Id)
+
+	// Retrieve certificates of the requested certificate profile
+	certChain, err := c.CertChain(req.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certchain: %w", err)
+	}
+
+	return &api.TLSCertResponse{Certificate: internal.WriteCertsPem(certChain)}, nil
+}
+
+// measureRequest records the container measurement or, if the request
+// contains a digest, the runtime measurement. Failures of container
+// measurements are reported via the success flag of the response, invalid
+// runtime measurements are rejected with an error
+func measureRequest(c *cmc.Cmc, req *api.MeasureRequest) (*api.MeasureResponse, error) {
+
+	if len(req.Digest) > 0 {
+		n, err := recordRuntimeMeasurement(c, req.Name, req.Hashtype, req.Digest, req.EventData)
+		if err != nil {
+			return nil, err
+		}
+		return &api.MeasureResponse{Success: true, Length: n}, nil
+	}
+
+	log.Debug("Measurer: Recording measurement")
+	mc := &m.MeasureConfig{
+		Serializer: c.Serializer,
+		Pcr:        c.CtrPcr,
+		LogFile:    c.CtrLog,
+		Driver:     c.CtrDriver,
+		Journal:    c.CtrJournal,
+	}
+	var err error
+	if req.Removed {
+		err = m.Remove(req.Name, mc)
+	} else {
+		err = m.Measure(req.Name, req.ConfigSha256, req.RootfsSha256, mc)
+	}
+	if err != nil {
+		log.Warnf("Failed to record measurement: %v", err)
+	}
+
+	return &api.MeasureResponse{Success: err == nil}, nil
+}
+
+// recordRuntimeMeasurement appends the measurement to the runtime measurement
+// list, which is included in subsequent attestation reports, and returns the
+// length of the list
+func recordRuntimeMeasurement(c *cmc.Cmc, name string, hashtype api.HashFunction,
+	digest, eventData []byte,
+) (int, error) {
+
+	if c.RuntimeLog == nil {
+		return 0, errors.New("runtime measurements not supported")
+	}
+	opts, err := api.HashToSignerOpts(hashtype, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to choose requested hash function: %w", err)
+	}
+	n, err := c.RuntimeLog.Record(name, opts.HashFunc(), digest, eventData)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record runtime measurement: %w", err)
+	}
+	return n, nil
 }
@@ -0,0 +1,281 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"golang.org/x/exp/maps"
+)
+
+type testServer struct{}
+
+func (testServer) Serve(addr string, c *cmc.Cmc) error {
+	return nil
+}
+
+func (testServer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func Test_registerServer(t *testing.T) {
+	oldServers, oldSealed := maps.Clone(servers), serversSealed
+	defer func() { servers, serversSealed = oldServers, oldSealed }()
+	servers, serversSealed = map[string]Server{}, false
+
+	mustPanic := func(name string) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("registerServer(%v) did not panic", name)
+			}
+		}()
+		registerServer(name, testServer{})
+	}
+
+	registerServer("test", testServer{})
+	mustPanic("test")
+
+	if _, ok := getServer("TEST"); !ok {
+		t.Errorf("getServer() did not return registered API")
+	}
+	if _, ok := getServer("other"); ok {
+		t.Errorf("getServer() returned unregistered API")
+	}
+	mustPanic("other")
+}
+
+func Test_attestRequestDetached(t *testing.T) {
+	c, f := newLeakCmc(t)
+
+	resp, err := attestRequest(c, &api.AttestationRequest{Nonce: f.Nonce, Detached: true})
+	if err != nil {
+		t.Fatalf("attestRequest() error = %v", err)
+	}
+	if resp.AttestationReport != nil || resp.Payload == nil || resp.Signature == nil {
+		t.Fatalf("attestRequest() = %v, want payload and detached signature", resp)
+	}
+
+	roots := []*x509.Certificate{f.Ca.Chain[0]}
+	if _, _, ok := c.Serializer.VerifyDetached(resp.Signature, resp.Payload, roots,
+		time.Time{}); !ok {
+		t.Errorf("VerifyDetached() failed")
+	}
+	tampered := append([]byte{}, resp.Payload...)
+	tampered[0] ^= 0xff
+	if _, _, ok := c.Serializer.VerifyDetached(resp.Signature, tampered, roots,
+		time.Time{}); ok {
+		t.Errorf("VerifyDetached() of tampered payload succeeded")
+	}
+}
+
+func Test_tlsSignRequest(t *testing.T) {
+	c, _ := newLeakCmc(t)
+	digest := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name    string
+		pssOpts *api.PSSOptions
+		wantErr bool
+	}{
+		{"ECDSA", nil, false},
+		{"ECDSA With PSS", &api.PSSOptions{SaltLength: 32}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tlsSignRequest(c, &api.TLSSignRequest{
+				Content:  digest[:],
+				Hashtype: api.HashFunction_SHA256,
+				PssOpts:  tt.pssOpts,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tlsSignRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, pub, err := c.SigningKeys("")
+			if err != nil {
+				t.Fatalf("SigningKeys() error = %v", err)
+			}
+			if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], resp.SignedContent) {
+				t.Errorf("failed to verify signature")
+			}
+		})
+	}
+}
+
+func Test_requestCas(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	root := f.Ca.Cert()
+	second := f.DeviceCa.Cert()
+	bundle := append(internal.WriteCertPem(root), internal.WriteCertPem(second)...)
+
+	tests := []struct {
+		name string
+		ca   []byte
+		cas  [][]byte
+		want []*x509.Certificate
+	}{
+		{"Single CA", internal.WriteCertPem(root), nil, []*x509.Certificate{root}},
+		{"CA Bundle", bundle, nil, []*x509.Certificate{root, second}},
+		{"CA List", nil, [][]byte{root.Raw, internal.WriteCertPem(second)},
+			[]*x509.Certificate{root, second}},
+		{"CA And List", bundle, [][]byte{internal.WriteCertPem(second)},
+			[]*x509.Certificate{root, second}},
+		{"No CA", nil, nil, nil},
+		{"Invalid CA", nil, [][]byte{[]byte("invalid")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestCas(tt.ca, tt.cas)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("requestCas() = %v, want nil", got)
+				}
+				return
+			}
+			certs, err := internal.ParseCertsPem(got)
+			if err != nil {
+				t.Fatalf("failed to parse CAs: %v", err)
+			}
+			if len(certs) != len(tt.want) {
+				t.Fatalf("requestCas() returned %v CAs, want %v", len(certs), len(tt.want))
+			}
+			for i := range certs {
+				if !certs[i].Equal(tt.want[i]) {
+					t.Errorf("CA %v = %v, want %v", i, certs[i].Subject, tt.want[i].Subject)
+				}
+			}
+		})
+	}
+}
+
+func Test_verifyRequestIssuedNonce(t *testing.T) {
+	c, f := newLeakCmc(t)
+	c.Nonces = verify.NewNonceStore(200*time.Millisecond, 0)
+
+	// verifyNonce verifies a report answering the nonce and returns the result
+	verifyNonce := func(nonce []byte, issued bool) ar.VerificationResult {
+		t.Helper()
+		report, err := attestRequest(c, &api.AttestationRequest{Nonce: nonce})
+		if err != nil {
+			t.Fatalf("attestRequest() error = %v", err)
+		}
+		resp, err := verifyRequest(context.Background(), c, &api.VerificationRequest{
+			Nonce:             nonce,
+			AttestationReport: report.AttestationReport,
+			Ca:                f.CaPem(),
+			IssuedNonce:       issued,
+		}, "socket", "test", time.Now())
+		if err != nil {
+			t.Fatalf("verifyRequest() error = %v", err)
+		}
+		var result ar.VerificationResult
+		if err := json.Unmarshal(resp.VerificationResult, &result); err != nil {
+			t.Fatalf("failed to unmarshal result: %v", err)
+		}
+		return result
+	}
+	issue := func() []byte {
+		t.Helper()
+		resp, err := nonceRequest(c, &api.NonceRequest{})
+		if err != nil {
+			t.Fatalf("nonceRequest() error = %v", err)
+		}
+		if len(resp.Nonce) != 32 || !resp.Expires.After(time.Now()) {
+			t.Fatalf("nonceRequest() = %v, want 32 byte nonce expiring in the future", resp)
+		}
+		return resp.Nonce
+	}
+
+	issued := issue()
+	if r := verifyNonce(issued, true); !r.Success {
+		t.Errorf("verification with issued nonce failed: %v", r.ErrorCode)
+	}
+	if r := verifyNonce(issued, true); r.Success || r.ErrorCode != ar.NonceUnknown {
+		t.Errorf("verification with reused nonce: success %v, error code %v, want %v",
+			r.Success, r.ErrorCode, ar.NonceUnknown)
+	}
+	if r := verifyNonce(f.Nonce, true); r.Success || r.ErrorCode != ar.NonceUnknown {
+		t.Errorf("verification with caller nonce: success %v, error code %v, want %v",
+			r.Success, r.ErrorCode, ar.NonceUnknown)
+	}
+
+	expired := issue()
+	time.Sleep(300 * time.Millisecond)
+	if r := verifyNonce(expired, true); r.Success || r.ErrorCode != ar.NonceExpired {
+		t.Errorf("verification with expired nonce: success %v, error code %v, want %v",
+			r.Success, r.ErrorCode, ar.NonceExpired)
+	}
+
+	// Caller-supplied nonces are not checked against the issued nonces
+	if r := verifyNonce(f.Nonce, false); !r.Success {
+		t.Errorf("verification with caller nonce failed: %v", r.ErrorCode)
+	}
+}
+
+func Test_nonceRequestLoad(t *testing.T) {
+	const max = 64
+	c := &cmc.Cmc{Nonces: verify.NewNonceStore(200*time.Millisecond, max)}
+
+	// Concurrent requests beyond the maximum are rejected until the issued
+	// nonces expire
+	var mu sync.Mutex
+	nonces := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4*max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := nonceRequest(c, &api.NonceRequest{})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			nonces[string(resp.Nonce)] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(nonces) != max {
+		t.Fatalf("issued %v distinct nonces, want %v", len(nonces), max)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := nonceRequest(c, &api.NonceRequest{}); err != nil {
+		t.Fatalf("nonceRequest() after expiry error = %v", err)
+	}
+	if n := c.Nonces.Pending(); n != 1 {
+		t.Errorf("%v pending nonces after expiry, want 1", n)
+	}
+}
@@ -19,54 +19,63 @@ package main
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rand"
+	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
-	"encoding/hex"
-	"encoding/json"
-
-	"github.com/fxamacker/cbor/v2"
-	coap "github.com/plgd-dev/go-coap/v3"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/mux"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpServer "github.com/plgd-dev/go-coap/v3/udp/server"
 
 	// local modules
 	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
-	"github.com/Fraunhofer-AISEC/cmc/generate"
-	"github.com/Fraunhofer-AISEC/cmc/internal"
-	m "github.com/Fraunhofer-AISEC/cmc/measure"
-	"github.com/Fraunhofer-AISEC/cmc/verify"
 )
 
-// CoapServer is the CoAP server structure
-type CoapServer struct{}
-
-var Cmc *cmc.Cmc
+// CoapServer serves the CoAP API. The active requests are tracked, so that
+// Shutdown can wait for them
+type CoapServer struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	server   *udpServer.Server
+	shutdown bool
+}
 
 func init() {
 	log.Info("Adding CoAP server to supported servers")
-	servers["coap"] = CoapServer{}
+	registerServer("coap", &CoapServer{})
 }
 
-func (s CoapServer) Serve(addr string, c *cmc.Cmc) error {
-
-	Cmc = c
+func (s *CoapServer) Serve(addr string, c *cmc.Cmc) error {
 
 	log.Infof("Starting CMC CoAP Server on %v", addr)
-	r := mux.NewRouter()
-	r.Use(loggingMiddleware)
-	r.Handle("/Attest", mux.HandlerFunc(Attest))
-	r.Handle("/Verify", mux.HandlerFunc(Verify))
-	r.Handle("/Measure", mux.HandlerFunc(Measure))
-	r.Handle("/TLSSign", mux.HandlerFunc(TlsSign))
-	r.Handle("/TLSCert", mux.HandlerFunc(TlsCert))
+	l, err := coapNet.NewListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+	defer l.Close()
+
+	r := newCoapRouter(c)
+	r.Use(s.trackRequests)
+	server := udp.NewServer(options.WithMux(r))
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.server = server
+	s.mu.Unlock()
 
 	log.Infof("Waiting for requests on %v", addr)
 
-	err := coap.ListenAndServe("udp", addr, r)
+	err = server.Serve(l)
 	if err != nil {
 		return fmt.Errorf("failed to serve: %v", err)
 	}
@@ -74,281 +83,157 @@ func (s CoapServer) Serve(addr string, c *cmc.Cmc) error {
 	return nil
 }
 
-func SendCoapResponse(w mux.ResponseWriter, r *mux.Message, payload []byte) {
-	customResp := w.Conn().AcquireMessage(r.Context())
-	defer w.Conn().ReleaseMessage(customResp)
-	customResp.SetCode(codes.Content)
-	customResp.SetToken(r.Token())
-	customResp.SetContentFormat(message.TextPlain)
-	customResp.SetBody(bytes.NewReader(payload))
-	err := w.Conn().WriteMessage(customResp)
-	if err != nil {
-		log.Errorf("cannot set response: %v", err)
-	}
+// Shutdown rejects new requests and waits for the active requests before the
+// server is stopped. If the context is done first, the server is stopped with
+// the requests still active
+func (s *CoapServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	err := drain(ctx, &s.wg, func() {})
+	server.Stop()
+	return err
 }
 
-func sendCoapError(w mux.ResponseWriter, r *mux.Message, code codes.Code,
-	format string, args ...interface{}) {
-	msg := fmt.Sprintf(format, args...)
-	customResp := w.Conn().AcquireMessage(r.Context())
-	defer w.Conn().ReleaseMessage(customResp)
-	customResp.SetCode(code)
-	customResp.SetToken(r.Token())
-	customResp.SetContentFormat(message.TextPlain)
-	customResp.SetBody(bytes.NewReader([]byte(msg)))
-	err := w.Conn().WriteMessage(customResp)
-	if err != nil {
-		log.Errorf("cannot set response: %v", err)
-	}
-}
-
-func Attest(w mux.ResponseWriter, r *mux.Message) {
-
-	log.Debug("Prover: Received CoAP attestation request")
-
-	if len(Cmc.Drivers) == 0 {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Failed to generate attestation report: No valid drivers specified in config")
-		return
-	}
-
-	var req api.AttestationRequest
-	err := unmarshalCoapPayload(r, &req)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to unmarshal CoAP payload: %v",
-			err)
-
-		return
-	}
-
-	if Cmc.Metadata == nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Metadata not specified. Can work only as verifier")
-		return
-	}
-
-	log.Debug("Prover: Generating Attestation Report with nonce: ", hex.EncodeToString(req.Nonce))
-
-	report, err := generate.Generate(req.Nonce, Cmc.Metadata, Cmc.Drivers, Cmc.Serializer)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to generate attestation report: %v", err)
-		return
-	}
-
-	log.Debug("Prover: Signing Attestation Report")
-	data, err := generate.Sign(report, Cmc.Drivers[0], Cmc.Serializer)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Failed to sign attestation report: %v", err)
-		return
-	}
-
-	// Serialize CoAP payload
-	resp := api.AttestationResponse{
-		AttestationReport: data,
-	}
-	payload, err := cbor.Marshal(&resp)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to marshal message: %v", err)
-		return
-	}
-
-	// CoAP response
-	SendCoapResponse(w, r, payload)
-
-	log.Debug("Prover: Finished")
+// trackRequests counts the active requests and rejects requests once the
+// server is shutting down
+func (s *CoapServer) trackRequests(next mux.Handler) mux.Handler {
+	return mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			sendCoapError(w, codes.ServiceUnavailable, "server is shutting down")
+			return
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		defer s.wg.Done()
+		next.ServeCOAP(w, r)
+	})
 }
 
-func Verify(w mux.ResponseWriter, r *mux.Message) {
-
-	log.Debug("Received Connection Request Type 'Verification Request'")
-
-	var req api.VerificationRequest
-	err := unmarshalCoapPayload(r, &req)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to unmarshal CoAP payload: %v", err)
-		return
-	}
-
-	log.Debug("Verifier: Verifying Attestation Report")
-	result := verify.Verify(req.AttestationReport, req.Nonce, req.Ca, req.Policies,
-		Cmc.PolicyEngineSelect, Cmc.IntelStorage)
-
-	log.Debug("Verifier: Marshaling Attestation Result")
-	data, err := json.Marshal(result)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Verifier: failed to marshal Attestation Result: %v", err)
-		return
-	}
-
-	// Serialize CoAP payload
-	resp := api.VerificationResponse{
-		VerificationResult: data,
-	}
-	payload, err := cbor.Marshal(&resp)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to marshal message: %v", err)
-		return
-	}
-
-	// CoAP response
-	SendCoapResponse(w, r, payload)
-
-	log.Debug("Verifier: Finished")
+// newCoapRouter returns the router serving the CoAP resources. The requests
+// and responses are CBOR encoded like for the socket API, with which the
+// request handling is shared. Responses exceeding the block size are
+// transferred block-wise (RFC 7959) by the go-coap connection
+func newCoapRouter(c *cmc.Cmc) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(loggingMiddleware)
+	r.Handle("/Attest", handleCoap(api.TypeAttest, codes.InternalServerError,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.AttestationRequest) (*api.AttestationResponse, error) {
+			return attestRequest(c, req)
+		}))
+	r.Handle("/Verify", handleCoap(api.TypeVerify, codes.ServiceUnavailable,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.VerificationRequest) (*api.VerificationResponse, error) {
+			return verifyRequest(r.Context(), c, req, "coap", w.Conn().RemoteAddr().String(),
+				time.Now())
+		}))
+	r.Handle("/Measure", handleCoap(api.TypeMeasure, codes.BadRequest,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.MeasureRequest) (*api.MeasureResponse, error) {
+			return measureRequest(c, req)
+		}))
+	r.Handle("/TLSSign", handleCoap(api.TypeTLSSign, codes.InternalServerError,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.TLSSignRequest) (*api.TLSSignResponse, error) {
+			return tlsSignRequest(c, req)
+		}))
+	r.Handle("/TLSCert", handleCoap(api.TypeTLSCert, codes.InternalServerError,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.TLSCertRequest) (*api.TLSCertResponse, error) {
+			return tlsCertRequest(c, req)
+		}))
+	r.Handle("/Status", handleCoap(api.TypeStatus, codes.InternalServerError,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.StatusRequest) (*api.StatusResponse, error) {
+			log.Tracef("Received CoAP status request with ID %v", req.Id)
+			return &api.StatusResponse{
+				Drivers:    c.Status(),
+				Enrollment: c.EnrollmentStatus(),
+			}, nil
+		}))
+	r.Handle("/PeerCache", handleCoap(api.TypePeerCache, codes.BadRequest,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.PeerCacheRequest) (*api.PeerCacheResponse, error) {
+			return peerCacheRequest(req), nil
+		}))
+	r.Handle("/Nonce", handleCoap(api.TypeNonce, codes.ServiceUnavailable,
+		func(w mux.ResponseWriter, r *mux.Message,
+			req *api.NonceRequest) (*api.NonceResponse, error) {
+			return nonceRequest(c, req)
+		}))
+	return r
 }
 
-func Measure(w mux.ResponseWriter, r *mux.Message) {
+// handleCoap returns the CoAP handler for a request type. It unmarshals the
+// CBOR encoded request and marshals the response of the handler. Malformed
+// requests are answered with 4.00 Bad Request, failures of the handler with
+// failCode
+func handleCoap[Req, Resp any](reqType uint32, failCode codes.Code,
+	handle func(w mux.ResponseWriter, r *mux.Message, req *Req) (*Resp, error),
+) mux.Handler {
+	return mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
 
-	log.Debug("Received Connection Request Type 'Measure Request'")
+		log.Debugf("Received CoAP %v request", api.TypeToString(reqType))
 
-	var req api.MeasureRequest
-	err := unmarshalCoapPayload(r, &req)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to unmarshal CoAP payload: %v", err)
-		return
-	}
+		req := new(Req)
+		err := unmarshalCoapPayload(r, req)
+		if err != nil {
+			sendCoapError(w, codes.BadRequest, "failed to unmarshal CoAP payload: %v", err)
+			return
+		}
 
-	log.Debug("Measurer: Recording measurement")
-	var success bool
-	err = m.Measure(req.Name, req.ConfigSha256, req.RootfsSha256,
-		&m.MeasureConfig{
-			Serializer: Cmc.Serializer,
-			Pcr:        Cmc.CtrPcr,
-			LogFile:    Cmc.CtrLog,
-			Driver:     Cmc.CtrDriver,
-		})
-	if err != nil {
-		success = false
-	} else {
-		success = true
-	}
+		resp, err := handle(w, r, req)
+		if err != nil {
+			sendCoapError(w, failCode, "%v", err)
+			return
+		}
 
-	// Serialize CoAP payload
-	resp := api.MeasureResponse{
-		Success: success,
-	}
-	payload, err := cbor.Marshal(&resp)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to marshal message: %v", err)
-		return
-	}
+		// Serialize CoAP payload
+		payload, err := ar.CborSerializer{}.Marshal(resp)
+		if err != nil {
+			sendCoapError(w, codes.InternalServerError, "failed to marshal message: %v", err)
+			return
+		}
 
-	// CoAP response
-	SendCoapResponse(w, r, payload)
+		// CoAP response
+		SendCoapResponse(w, payload)
 
-	log.Debug("Measurer: Finished")
+		log.Debugf("Finished CoAP %v request", api.TypeToString(reqType))
+	})
 }
 
-func TlsSign(w mux.ResponseWriter, r *mux.Message) {
-
-	log.Debug("Received CoAP TLS sign request")
-
-	if len(Cmc.Drivers) == 0 {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Failed to sign: No valid drivers specified in config")
-		return
-	}
-
-	// Parse the CoAP message and return the TLS signing request
-	var req api.TLSSignRequest
-	err := unmarshalCoapPayload(r, &req)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to unmarshal CoAP payload: %v", err)
-
-		return
-	}
-
-	// Get signing options from request
-	opts, err := api.HashToSignerOpts(req.Hashtype, req.PssOpts)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to choose requested hash function: %v", err)
-		return
-	}
-
-	// Get key handle from (hardware) interface
-	tlsKeyPriv, _, err := Cmc.Drivers[0].GetSigningKeys()
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to get IK: %v", err)
-		return
-	}
-
-	// Sign
-	log.Trace("TLSSign using opts: ", opts)
-	signature, err := tlsKeyPriv.(crypto.Signer).Sign(rand.Reader, req.Content, opts)
+// SendCoapResponse sets the CBOR encoded payload as response. The response
+// writer hands the response to the block-wise transfer, if required
+func SendCoapResponse(w mux.ResponseWriter, payload []byte) {
+	err := w.SetResponse(codes.Content, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to sign: %v", err)
-		return
-	}
-
-	// Create response
-	resp := &api.TLSSignResponse{
-		SignedContent: signature,
-	}
-	payload, err := cbor.Marshal(&resp)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to marshal message: %v", err)
-		return
+		log.Errorf("cannot set response: %v", err)
 	}
-
-	// CoAP response
-	SendCoapResponse(w, r, payload)
-
-	log.Debug("Performed signing")
 }
 
-func TlsCert(w mux.ResponseWriter, r *mux.Message) {
-
-	log.Debug("Received CoAP TLS cert request")
-
-	if len(Cmc.Drivers) == 0 {
-		sendCoapError(w, r, codes.InternalServerError,
-			"Failed to sign: No valid drivers specified in config")
-		return
-	}
-
-	// Parse the CoAP message and return the TLS signing request
-	var req api.TLSCertRequest
-	err := unmarshalCoapPayload(r, &req)
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError,
-			"failed to unmarshal CoAP payload: %v", err)
-		return
-	}
-	// TODO ID is currently not used
-	log.Tracef("Received COAP TLS cert request with ID %v", req.Id)
-
-	// Retrieve certificates
-	certChain, err := Cmc.Drivers[0].GetCertChain()
-	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to get cert chain: %v", err)
-		return
-	}
-
-	// Create response
-	resp := &api.TLSCertResponse{
-		Certificate: internal.WriteCertsPem(certChain),
-	}
-	payload, err := cbor.Marshal(&resp)
+func sendCoapError(w mux.ResponseWriter, code codes.Code, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warn(msg)
+	err := w.SetResponse(code, message.TextPlain, bytes.NewReader([]byte(msg)))
 	if err != nil {
-		sendCoapError(w, r, codes.InternalServerError, "failed to marshal message: %v", err)
-		return
+		log.Errorf("cannot set response: %v", err)
 	}
-
-	// CoAP response
-	SendCoapResponse(w, r, payload)
-
-	log.Debug("Obtained TLS cert")
 }
 
 func loggingMiddleware(next mux.Handler) mux.Handler {
 	return mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
 		log.Printf("ClientAddress %v, %v\n", w.Conn().RemoteAddr(), r.String())
+		if path, err := r.Path(); err == nil {
+			countRequest("coap", strings.TrimPrefix(path, "/"))
+		}
 		next.ServeCOAP(w, r)
 	})
 }
@@ -359,7 +244,7 @@ func unmarshalCoapPayload(r *mux.Message, payload interface{}) error {
 	if err != nil {
 		return fmt.Errorf("failed to read CoAP message body: %v", err)
 	}
-	err = cbor.Unmarshal(body, payload)
+	err = ar.DecodeCbor(body, payload)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal CoAP message body: %v", err)
 	}
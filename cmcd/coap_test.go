@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+	"github.com/plgd-dev/go-coap/v3/net/blockwise"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/plgd-dev/go-coap/v3/udp/client"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// startCoapServer serves the CoAP API of the CMC on a loopback UDP port and
+// returns its address
+func startCoapServer(t *testing.T, c *cmc.Cmc) string {
+	l, err := coapNet.NewListenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := udp.NewServer(options.WithMux(newCoapRouter(c)))
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Stop()
+		<-done
+		l.Close()
+	})
+	return l.LocalAddr().String()
+}
+
+// postCoap sends the CBOR encoded request to the CoAP resource
+func postCoap(t *testing.T, conn *client.Conn, path string, req any) *pool.Message {
+	t.Helper()
+	payload, err := cbor.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("failed to send request to %v: %v", path, err)
+	}
+	return resp
+}
+
+// decodeCoap checks the response code and unmarshals the response
+func decodeCoap(t *testing.T, resp *pool.Message, v any) {
+	t.Helper()
+	body, err := resp.ReadBody()
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.Code() != codes.Content {
+		t.Fatalf("code = %v, body = %s", resp.Code(), body)
+	}
+	if err := cbor.Unmarshal(body, v); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+}
+
+func TestCoapServer(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	// Enough app manifests for a report far exceeding the CoAP block size
+	f, err := fixtures.Generate(fixtures.Options{
+		Serializer: ar.CborSerializer{},
+		Apps:       16,
+		AppEvents:  16,
+	})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	c := &cmc.Cmc{Drivers: []ar.Driver{f}, Serializer: f.Serializer}
+	c.SetMetadata(f.Metadata)
+	addr := startCoapServer(t, c)
+
+	conn, err := udp.Dial(addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	var attestResp api.AttestationResponse
+	decodeCoap(t, postCoap(t, conn, "/Attest", &api.AttestationRequest{Nonce: f.Nonce}),
+		&attestResp)
+	if n := int64(len(attestResp.AttestationReport)); n < 4*blockwise.SZX1024.Size() {
+		t.Fatalf("report of %v bytes does not require multiple blocks", n)
+	}
+
+	var verifyResp api.VerificationResponse
+	decodeCoap(t, postCoap(t, conn, "/Verify", &api.VerificationRequest{
+		Nonce:             f.Nonce,
+		AttestationReport: attestResp.AttestationReport,
+		Ca:                f.CaPem(),
+	}), &verifyResp)
+	var result ar.VerificationResult
+	if err := json.Unmarshal(verifyResp.VerificationResult, &result); err != nil {
+		t.Fatalf("failed to unmarshal verification result: %v", err)
+	}
+	if !result.Success {
+		t.Errorf("verification of generated report failed")
+	}
+
+	var certResp api.TLSCertResponse
+	decodeCoap(t, postCoap(t, conn, "/TLSCert", &api.TLSCertRequest{}), &certResp)
+	if len(certResp.Certificate) != len(f.Ik.Chain) {
+		t.Errorf("got %v certificates, want %v", len(certResp.Certificate), len(f.Ik.Chain))
+	}
+
+	// Without block-wise transfer on the client, the first block is received
+	// with the indication that more blocks follow
+	raw, err := udp.Dial(addr, options.WithBlockwise(false, blockwise.SZX1024, time.Second))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer raw.Close()
+	resp := postCoap(t, raw, "/Attest", &api.AttestationRequest{Nonce: f.Nonce})
+	block, err := resp.Options().GetUint32(message.Block2)
+	if err != nil {
+		t.Fatalf("response does not contain block2 option: %v", err)
+	}
+	szx, num, more, err := blockwise.DecodeBlockOption(block)
+	if err != nil {
+		t.Fatalf("failed to decode block2 option: %v", err)
+	}
+	if num != 0 || !more || szx != blockwise.SZX1024 {
+		t.Errorf("block2 = (%v, %v, %v), want first of multiple blocks", szx, num, more)
+	}
+}
+
+func TestCoapServerErrors(t *testing.T) {
+	c, f := newLeakCmc(t)
+	addr := startCoapServer(t, c)
+	noSigner := startCoapServer(t, &cmc.Cmc{Serializer: f.Serializer})
+
+	tests := []struct {
+		name    string
+		addr    string
+		path    string
+		payload []byte
+		want    codes.Code
+	}{
+		{"Invalid CBOR", addr, "/Attest", []byte{0xa1}, codes.BadRequest},
+		{"Unknown Resource", addr, "/Unknown", []byte{0xa0}, codes.NotFound},
+		{"Unknown Profile", addr, "/TLSCert", []byte{0xa1, 0x00, 0x61, 0x78},
+			codes.InternalServerError},
+		{"No Signer Attest", noSigner, "/Attest", []byte{0xa0}, codes.InternalServerError},
+		{"No Signer TLS Sign", noSigner, "/TLSSign", []byte{0xa0}, codes.InternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := udp.Dial(tt.addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			resp, err := conn.Post(ctx, tt.path, message.AppCBOR, bytes.NewReader(tt.payload))
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			if resp.Code() != tt.want {
+				t.Errorf("code = %v, want %v", resp.Code(), tt.want)
+			}
+		})
+	}
+}
@@ -17,10 +17,14 @@ package main
 
 // Install github packages with "go get [url]"
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 
 	"encoding/json"
@@ -32,6 +36,7 @@ import (
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -45,7 +50,7 @@ var (
 		"trace": logrus.TraceLevel,
 	}
 
-	log = logrus.WithField("service", "cmcd")
+	log = internal.NewLogger(internal.SubsystemServer, "cmcd")
 )
 
 const (
@@ -54,6 +59,7 @@ const (
 	cmcAddrFlag        = "cmc"
 	provAddrFlag       = "prov"
 	driversFlag        = "drivers"
+	signerFlag         = "signer"
 	imaFlag            = "ima"
 	imaPcrFlag         = "pcr"
 	keyConfigFlag      = "algo"
@@ -61,6 +67,7 @@ const (
 	networkFlag        = "network"
 	policyEngineFlag   = "policies"
 	logFlag            = "log"
+	logFormatFlag      = "logformat"
 	storageFlag        = "storage"
 	cacheFlag          = "cache"
 	measurementLogFlag = "measurementLog"
@@ -68,9 +75,17 @@ const (
 	ctrDriverFlag      = "ctrdriver"
 	ctrPcrFlag         = "ctrpcr"
 	ctrLogFlag         = "ctrlog"
+	ctrJournalFlag     = "ctrjournal"
+	checkConfigFlag    = "check-config"
 )
 
-func getConfig() (*cmc.Config, error) {
+// errUsage indicates invalid command line arguments
+var errUsage = errors.New("invalid usage")
+
+// getConfig parses the command line arguments and returns the configuration
+// and whether it shall only be checked. If server is set, the configuration of
+// the API server is validated as well
+func getConfig(args []string, server bool) (*cmc.Config, bool, error) {
 
 	//
 	// Parse configuration from commandline flags and configuration file if
@@ -86,17 +101,21 @@ func getConfig() (*cmc.Config, error) {
 	driversList := flag.String(driversFlag, "",
 		fmt.Sprintf("Drivers (comma separated list). Possible: %v",
 			strings.Join(maps.Keys(cmc.GetDrivers()), ",")))
+	signer := flag.String(signerFlag, "",
+		"Driver providing the signing identity (default: first driver capable of signing)")
 	ima := flag.Bool(imaFlag, false,
 		"Specifies whether to use Integrity Measurement Architecture (IMA)")
 	pcr := flag.Int(imaPcrFlag, 0, "IMA PCR")
 	keyConfig := flag.String(keyConfigFlag, "", "Key configuration")
-	api := flag.String(apiFlag, "", "API to use. Possible: [coap grpc libapi socket]")
-	network := flag.String(networkFlag, "", "Network for socket API [unix tcp]")
+	api := flag.String(apiFlag, "", "API to use. Possible: [coap grpc http socket]")
+	network := flag.String(networkFlag, "", "Network for socket API [unix tcp vsock]")
 	policyEngine := flag.String(policyEngineFlag, "",
 		fmt.Sprintf("Possible policy engines: %v",
 			strings.Join(maps.Keys(cmc.GetPolicyEngines()), ",")))
 	logLevel := flag.String(logFlag, "",
 		fmt.Sprintf("Possible logging: %v", strings.Join(maps.Keys(logLevels), ",")))
+	logFormat := flag.String(logFormatFlag, "",
+		fmt.Sprintf("Log format: %v", strings.Join(internal.LogFormats, ",")))
 	storage := flag.String(storageFlag, "", "Optional folder to store internal CMC data in")
 	cache := flag.String(cacheFlag, "", "Optional folder to cache metadata for offline backup")
 	measurementLog := flag.Bool(measurementLogFlag, false,
@@ -106,7 +125,13 @@ func getConfig() (*cmc.Config, error) {
 		"Specifies which driver to use for container measurements")
 	ctrPcr := flag.Int(ctrPcrFlag, 0, "Container PCR")
 	ctrLog := flag.String(ctrLogFlag, "", "Container runtime measurements path")
-	flag.Parse()
+	ctrJournal := flag.String(ctrJournalFlag, "",
+		"Optional journal path to restore container runtime measurements after restarts")
+	checkConfig := flag.Bool(checkConfigFlag, false,
+		"Validate the configuration and exit without starting the CMC")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", errUsage, err)
+	}
 
 	// Create default configuration
 	c := &cmc.Config{
@@ -116,15 +141,21 @@ func getConfig() (*cmc.Config, error) {
 	}
 
 	// Obtain custom configuration from file if specified
+	var unknown []string
 	if internal.FlagPassed(configFlag) {
 		log.Infof("Loading config from file %v", *configFile)
 		data, err := os.ReadFile(*configFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read cmcd config file %v: %v", *configFile, err)
+			return nil, *checkConfig, fmt.Errorf("failed to read cmcd config file %v: %v",
+				*configFile, err)
 		}
 		err = json.Unmarshal(data, c)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse cmcd config: %v", err)
+			return nil, *checkConfig, fmt.Errorf("failed to parse cmcd config: %v", err)
+		}
+		unknown, err = internal.UnknownFields(data, c)
+		if err != nil {
+			return nil, *checkConfig, fmt.Errorf("failed to parse cmcd config: %v", err)
 		}
 	}
 
@@ -141,6 +172,9 @@ func getConfig() (*cmc.Config, error) {
 	if internal.FlagPassed(driversFlag) {
 		c.Drivers = strings.Split(*driversList, ",")
 	}
+	if internal.FlagPassed(signerFlag) {
+		c.Signer = *signer
+	}
 	if internal.FlagPassed(imaFlag) {
 		c.UseIma = *ima
 	}
@@ -162,6 +196,9 @@ func getConfig() (*cmc.Config, error) {
 	if internal.FlagPassed(logFlag) {
 		c.LogLevel = *logLevel
 	}
+	if internal.FlagPassed(logFormatFlag) {
+		c.LogFormat = *logFormat
+	}
 	if internal.FlagPassed(storageFlag) {
 		c.Storage = *storage
 	}
@@ -183,14 +220,45 @@ func getConfig() (*cmc.Config, error) {
 	if internal.FlagPassed(ctrLogFlag) {
 		c.CtrLog = *ctrLog
 	}
+	if internal.FlagPassed(ctrJournalFlag) {
+		c.CtrJournal = *ctrJournal
+	}
+
+	// Report all problems of the configuration at once instead of failing on
+	// the first one during initialization
+	errs := validateConfig(c, server)
+	for _, f := range unknown {
+		if *checkConfig {
+			errs.Add(f, errors.New("unknown field"))
+		} else {
+			log.Warnf("Ignoring unknown configuration field %v", f)
+		}
+	}
+	if *checkConfig {
+		if len(errs) > 0 {
+			return c, true, errs
+		}
+		return c, true, nil
+	}
+	if len(errs) > 0 {
+		return nil, false, fmt.Errorf("invalid configuration: %w", errs)
+	}
 
 	// Configure the logger
-	l, ok := logLevels[strings.ToLower(c.LogLevel)]
-	if !ok {
-		flag.Usage()
-		log.Fatalf("LogLevel %v does not exist", c.LogLevel)
+	l, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid log level: %w", err)
+	}
+	levels := make(map[string]logrus.Level, len(c.LogLevels))
+	for s, level := range c.LogLevels {
+		levels[s], err = logrus.ParseLevel(level)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid log level of subsystem %v: %w", s, err)
+		}
+	}
+	if err := internal.ConfigureLogging(c.LogFormat, l, levels, nil); err != nil {
+		return nil, false, fmt.Errorf("failed to configure logging: %w", err)
 	}
-	logrus.SetLevel(l)
 
 	// Convert all paths to absolute paths
 	pathsToAbs(c)
@@ -198,7 +266,104 @@ func getConfig() (*cmc.Config, error) {
 	// Print the parsed configuration
 	printConfig(c)
 
-	return c, nil
+	return c, *checkConfig, nil
+}
+
+// validateConfig checks the configuration of the CMC and, if server is set, of
+// the API
+func validateConfig(c *cmc.Config, server bool) cmc.ConfigErrors {
+
+	errs := c.Validate()
+	if !server {
+		return errs
+	}
+
+	if _, ok := getServer(c.Api); !ok {
+		names := maps.Keys(servers)
+		slices.Sort(names)
+		errs.Add("api", fmt.Errorf("API %v not compiled in (possible: %v)", c.Api,
+			strings.Join(names, ",")))
+	}
+	if strings.EqualFold(c.Api, "socket") {
+		if !strings.EqualFold(c.Network, "unix") && !strings.EqualFold(c.Network, "tcp") &&
+			!strings.EqualFold(c.Network, "vsock") {
+			errs.Add("network", fmt.Errorf("unknown network %q (possible: unix,tcp,vsock)",
+				c.Network))
+		}
+	}
+
+	unixSocket := strings.EqualFold(c.Api, "socket") && strings.EqualFold(c.Network, "unix")
+	for _, f := range []struct {
+		path string
+		set  bool
+	}{
+		{"socketMode", c.SocketMode != ""},
+		{"socketGroup", c.SocketGroup != ""},
+		{"socketAccess", c.SocketAccess != nil},
+	} {
+		if f.set && !unixSocket {
+			errs.Add(f.path, errors.New("requires the socket API with network unix"))
+		}
+	}
+	if c.SocketGroup != "" && unixSocket {
+		if _, err := lookupGroup(c.SocketGroup); err != nil {
+			errs.Add("socketGroup", err)
+		}
+	}
+
+	switch {
+	case c.Addr == "":
+		errs.Add("addr", errors.New("required"))
+	case strings.EqualFold(c.Api, "socket") && strings.EqualFold(c.Network, "unix"):
+		if _, err := os.Stat(filepath.Dir(c.Addr)); err != nil {
+			errs.Add("addr", fmt.Errorf("invalid unix socket path: %w", err))
+		}
+	case strings.EqualFold(c.Api, "socket") && strings.EqualFold(c.Network, "vsock"):
+		if _, err := internal.ParseVsockAddr(c.Addr); err != nil {
+			errs.Add("addr", err)
+		}
+	default:
+		if err := checkHostPort(c.Addr); err != nil {
+			errs.Add("addr", err)
+		}
+	}
+
+	if c.MetricsAddr != "" {
+		if err := checkHostPort(c.MetricsAddr); err != nil {
+			errs.Add("metricsAddr", err)
+		}
+	}
+	if c.DiagnosticsAddr != "" {
+		if _, _, err := diagnosticsListener(c.DiagnosticsAddr, c.DiagnosticsAllowRemote); err != nil {
+			errs.Add("diagnosticsAddr", err)
+		}
+	}
+
+	return errs
+}
+
+// checkHostPort checks that the address consists of an optional host and a port
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port %v", port)
+	}
+	return nil
+}
+
+// lookupGroup returns the ID of the group with the name or numeric ID
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.ParseUint(group, 10, 31); err == nil {
+		return int(gid), nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
 }
 
 func pathsToAbs(c *cmc.Config) {
@@ -221,6 +386,18 @@ func pathsToAbs(c *cmc.Config) {
 			log.Warnf("Failed to get absolute path for %v: %v", c.Cache, err)
 		}
 	}
+	if c.PsaIakChain != "" {
+		c.PsaIakChain, err = filepath.Abs(c.PsaIakChain)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.PsaIakChain, err)
+		}
+	}
+	for i := 0; i < len(c.PluginSockets); i++ {
+		c.PluginSockets[i], err = filepath.Abs(c.PluginSockets[i])
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.PluginSockets[i], err)
+		}
+	}
 	for i := 0; i < len(c.Metadata); i++ {
 		if strings.HasPrefix(c.Metadata[i], "file://") {
 			f := strings.TrimPrefix(c.Metadata[i], "file://")
@@ -245,23 +422,157 @@ func printConfig(c *cmc.Config) {
 	log.Debugf("Using the following configuration:")
 	log.Debugf("\tCMC Listen Address       : %v", c.Addr)
 	log.Debugf("\tProvisioning Server URL  : %v", c.ProvServerAddr)
+	if c.BootstrapToken != "" {
+		log.Debugf("\tBootstrap token source   : %v", c.BootstrapToken)
+	}
 	log.Debugf("\tMetadata Locations       : %v", strings.Join(c.Metadata, ","))
 	log.Debugf("\tUse IMA                  : %v", c.UseIma)
 	if c.UseIma {
 		log.Debugf("\tIMA PCR                  : %v", c.ImaPcr)
+		if c.ImaPollInterval != "" {
+			log.Debugf("\tIMA poll interval        : %v", c.ImaPollInterval)
+		}
+		if len(c.ImaWatchlist) > 0 {
+			log.Debugf("\tIMA watchlist            : %v", strings.Join(c.ImaWatchlist, ","))
+		}
 	}
 	log.Debugf("\tAPI                      : %v", c.Api)
 	log.Debugf("\tNetwork                  : %v", c.Network)
 	log.Debugf("\tPolicy Engine            : %v", c.PolicyEngine)
+	if c.PolicyTimeout != "" {
+		log.Debugf("\tPolicy timeout           : %v", c.PolicyTimeout)
+	}
+	if c.PolicyMemoryLimit != 0 {
+		log.Debugf("\tPolicy memory limit      : %v", c.PolicyMemoryLimit)
+	}
 	log.Debugf("\tKey Config               : %v", c.KeyConfig)
+	if c.AkKeyConfig != "" {
+		log.Debugf("\tAK Key Config            : %v", c.AkKeyConfig)
+	}
 	log.Debugf("\tLogging Level            : %v", c.LogLevel)
+	if c.LogFormat != "" {
+		log.Debugf("\tLogging Format           : %v", c.LogFormat)
+	}
+	for s, l := range c.LogLevels {
+		log.Debugf("\tLogging Level %v: %v", s, l)
+	}
 	log.Debugf("\tDrivers                  : %v", strings.Join(c.Drivers, ","))
+	if c.Signer != "" {
+		log.Debugf("\tSigner                   : %v", c.Signer)
+	}
+	if len(c.AdditionalSigners) > 0 {
+		log.Debugf("\tAdditional Signers       : %v", strings.Join(c.AdditionalSigners, ","))
+	}
 	log.Debugf("\tMeasurement Log          : %v", c.MeasurementLog)
+	log.Debugf("\tRaw Event Log            : %v", c.RawEventLog)
 	log.Debugf("\tMeasure containers       : %v", c.UseCtr)
 	if c.UseCtr {
 		log.Debugf("\tContainer Driver         : %v", c.CtrDriver)
 		log.Debugf("\tContainer Measurements   : %v", c.CtrLog)
 		log.Debugf("\tContainer PCR            : %v", c.CtrPcr)
+		if c.CtrJournal != "" {
+			log.Debugf("\tContainer Journal        : %v", c.CtrJournal)
+		}
+	}
+	if len(c.PcrSelection) > 0 {
+		log.Debugf("\tPCR Selection            : %v", c.PcrSelection)
+	}
+	if c.AkHandle != "" || c.IkHandle != "" {
+		log.Debugf("\tPersistent AK handle     : %v", c.AkHandle)
+		log.Debugf("\tPersistent IK handle     : %v", c.IkHandle)
+		log.Debugf("\tEvict occupied handles   : %v", c.EvictHandles)
+	}
+	if c.EncryptSessions {
+		log.Debugf("\tEncrypted TPM sessions   : %v", c.EncryptSessions)
+		log.Debugf("\tAudited TPM sessions     : %v", c.AuditSessions)
+	}
+	if c.OwnerAuth != "" {
+		log.Debugf("\tTPM owner auth source    : %v", c.OwnerAuth)
+	}
+	if c.EndorsementAuth != "" {
+		log.Debugf("\tTPM endorsement auth src : %v", c.EndorsementAuth)
+	}
+	if c.KeyAuth != "" {
+		log.Debugf("\tTPM key auth source      : %v", c.KeyAuth)
+	}
+	if len(c.IkPolicyPcrs) > 0 || c.IkPolicyAuthValue {
+		log.Debugf("\tIK policy PCRs           : %v", c.IkPolicyPcrs)
+		log.Debugf("\tIK policy auth value     : %v", c.IkPolicyAuthValue)
+	}
+	if c.NvIndex != "" {
+		log.Debugf("\tNV storage base index    : %v", c.NvIndex)
+	}
+	if c.SwKeyProtection != "" {
+		log.Debugf("\tSW key protection        : %v", c.SwKeyProtection)
+		if c.SwKeyPassphrase != "" {
+			log.Debugf("\tSW key passphrase source : %v", c.SwKeyPassphrase)
+		}
+		if len(c.SwKeyPcrs) > 0 {
+			log.Debugf("\tSW key sealing PCRs      : %v", c.SwKeyPcrs)
+		}
+	}
+	if c.Pkcs11Module != "" {
+		log.Debugf("\tPKCS#11 module           : %v", c.Pkcs11Module)
+		log.Debugf("\tPKCS#11 token            : %v", c.Pkcs11Token)
+		if c.Pkcs11Slot != "" {
+			log.Debugf("\tPKCS#11 slot             : %v", c.Pkcs11Slot)
+		}
+		log.Debugf("\tPKCS#11 key label        : %v", c.Pkcs11KeyLabel)
+		log.Debugf("\tPKCS#11 key ID           : %v", c.Pkcs11KeyId)
+		log.Debugf("\tPKCS#11 PIN source       : %v", c.Pkcs11Pin)
+	}
+	if c.PsaCommand != "" {
+		log.Debugf("\tPSA token command        : %v", c.PsaCommand)
+		if c.PsaIakChain != "" {
+			log.Debugf("\tPSA IAK chain            : %v", c.PsaIakChain)
+		}
+	}
+	if len(c.PluginSockets) > 0 {
+		log.Debugf("\tPlugin sockets           : %v", strings.Join(c.PluginSockets, ","))
+		if c.PluginTimeout != "" {
+			log.Debugf("\tPlugin timeout           : %v", c.PluginTimeout)
+		}
+	}
+	if c.RenewThreshold != "" {
+		log.Debugf("\tRenewal threshold        : %v", c.RenewThreshold)
+		log.Debugf("\tRenewal interval         : %v", c.RenewInterval)
+		log.Debugf("\tRotate keys              : %v", c.RotateKeys)
+	}
+	if c.EnrollRetry {
+		log.Debugf("\tEnrollment max. backoff  : %v", c.EnrollMaxBackoff)
+	}
+	if c.HealthInterval != "" {
+		log.Debugf("\tHealth check interval    : %v", c.HealthInterval)
+	}
+	if c.MetricsAddr != "" {
+		log.Debugf("\tMetrics address          : %v", c.MetricsAddr)
+	}
+	if c.DiagnosticsAddr != "" {
+		log.Debugf("\tDiagnostics address      : %v", c.DiagnosticsAddr)
+		log.Debugf("\tDiagnostics allow remote : %v", c.DiagnosticsAllowRemote)
+	}
+	if c.DecodeLimits != nil {
+		log.Debugf("\tDecoding limits          : %+v", *c.DecodeLimits)
+	}
+	if c.Appraisal != nil {
+		log.Debugf("\tAppraisal baseline       : %+v", *c.Appraisal)
+	}
+	if c.VerifyMemoryBudget != 0 {
+		log.Debugf("\tVerification budget      : %v", c.VerifyMemoryBudget)
+		log.Debugf("\tVerification spool size  : %v", c.VerifySpoolThreshold)
+		log.Debugf("\tVerification spool path  : %v", c.VerifySpoolDir)
+	}
+	if len(c.EatMetadata) > 0 {
+		log.Debugf("\tEAT metadata locations   : %v", strings.Join(c.EatMetadata, ", "))
+	}
+	if c.Archive != nil {
+		log.Debugf("\tReport archive           : %+v", *c.Archive)
+	}
+	if c.NonceTtl != "" {
+		log.Debugf("\tIssued nonce TTL         : %v", c.NonceTtl)
+	}
+	if c.MaxNonces != 0 {
+		log.Debugf("\tMax issued nonces        : %v", c.MaxNonces)
 	}
 	if c.Storage != "" {
 		log.Debugf("\tInternal storage path    : %v", c.Storage)
@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"golang.org/x/exp/slices"
+)
+
+func Test_validateConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name      string
+		config    cmc.Config
+		wantPaths []string
+	}{
+		{"Grpc", cmc.Config{Api: "grpc", Addr: "localhost:9955"}, nil},
+		{"Unix Socket", cmc.Config{Api: "socket", Network: "unix",
+			Addr: filepath.Join(dir, "cmc.sock")}, nil},
+		{"Unknown Api", cmc.Config{Api: "rest", Addr: "localhost:9955"}, []string{"api"}},
+		{"Missing Addr", cmc.Config{Api: "coap"}, []string{"addr"}},
+		{"Invalid Port", cmc.Config{Api: "grpc", Addr: "localhost:99550"}, []string{"addr"}},
+		{"Unknown Network", cmc.Config{Api: "socket", Network: "udp", Addr: "localhost:9955"},
+			[]string{"network"}},
+		{"Vsock", cmc.Config{Api: "socket", Network: "vsock", Addr: "vsock://any:9955"}, nil},
+		{"Invalid Vsock Addr", cmc.Config{Api: "socket", Network: "vsock",
+			Addr: "localhost:9955"}, []string{"addr"}},
+		{"Socket Folder Missing", cmc.Config{Api: "socket", Network: "unix",
+			Addr: filepath.Join(dir, "missing", "cmc.sock")}, []string{"addr"}},
+		{"Socket Permissions", cmc.Config{Api: "socket", Network: "unix",
+			Addr: filepath.Join(dir, "cmc.sock"), SocketMode: "0660",
+			SocketGroup: strconv.Itoa(os.Getgid()), SocketAccess: &cmc.SocketAccess{}}, nil},
+		{"Socket Permissions Over TCP", cmc.Config{Api: "socket", Network: "tcp",
+			Addr: "localhost:9955", SocketMode: "0660", SocketAccess: &cmc.SocketAccess{}},
+			[]string{"socketMode", "socketAccess"}},
+		{"Metrics And Diagnostics", cmc.Config{Api: "grpc", Addr: "localhost:9955",
+			MetricsAddr: "localhost", DiagnosticsAddr: "0.0.0.0:6060"},
+			[]string{"metricsAddr", "diagnosticsAddr"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateConfig(&tt.config, true)
+			paths := make([]string, 0, len(errs))
+			for _, e := range errs {
+				paths = append(paths, e.Path)
+			}
+			if !slices.Equal(paths, tt.wantPaths) {
+				t.Errorf("validateConfig() = %v, want problems of %v", errs, tt.wantPaths)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/archive"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+)
+
+const (
+	diagnosticsUnixPrefix = "unix:"
+	diagnosticsDumpFolder = "diagnostics"
+)
+
+// requests counts the requests per API and request type. The counters are
+// updated on the request path regardless of whether the diagnostics listener
+// is enabled, which costs a single atomic increment per request
+var requests = expvar.NewMap("cmcd.requests")
+
+// inFlight is the number of socket API requests currently handled
+var inFlight = expvar.NewInt("cmcd.socket.inflight")
+
+var publishOnce sync.Once
+
+// countRequest increments the request counter of the API and request type
+func countRequest(api, reqType string) {
+	requests.Add(api+"."+reqType, 1)
+}
+
+// diagnosticsListener returns the network and address to bind the diagnostics
+// listener to. Unless remote access is explicitly allowed, only loopback
+// addresses and unix domain sockets ("unix:<path>") are accepted, as the
+// listener exposes profiles and internals of the daemon without authentication
+func diagnosticsListener(addr string, allowRemote bool) (string, string, error) {
+	if strings.HasPrefix(addr, diagnosticsUnixPrefix) {
+		path := strings.TrimPrefix(strings.TrimPrefix(addr, diagnosticsUnixPrefix), "//")
+		if path == "" {
+			return "", "", fmt.Errorf("missing unix socket path in diagnostics address %v", addr)
+		}
+		return "unix", path, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid diagnostics address %v: %w", addr, err)
+	}
+	if allowRemote {
+		return "tcp", addr, nil
+	}
+	if host == "localhost" {
+		return "tcp", addr, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "tcp", addr, nil
+	}
+	return "", "", fmt.Errorf("diagnostics address %v is not a loopback address or unix socket "+
+		"(set diagnosticsAllowRemote to override)", addr)
+}
+
+// newDiagnosticsHandler returns the handler serving the pprof profiles, the
+// expvar variables, the dump trigger and, if configured, the query API of the
+// report archive
+func newDiagnosticsHandler(c *cmc.Cmc, storage string) http.Handler {
+
+	publishOnce.Do(func() {
+		expvar.Publish("cmcd.goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("cmcd.drivers", expvar.Func(func() any {
+			return c.Status()
+		}))
+		expvar.Publish("cmcd.enrollment", expvar.Func(func() any {
+			return c.EnrollmentStatus()
+		}))
+		expvar.Publish("cmcd.renewal", expvar.Func(func() any {
+			return c.RenewalStatus()
+		}))
+		expvar.Publish("cmcd.metadata", expvar.Func(func() any {
+			return len(c.MetadataStatus())
+		}))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/dump", func(w http.ResponseWriter, r *http.Request) {
+		handleDump(w, r, storage)
+	})
+	if c != nil && c.Archive != nil {
+		h := archive.Handler(c.Archive)
+		mux.Handle(archive.ReportsPath, h)
+		mux.Handle(archive.ReportsPath+"/", h)
+	}
+	return mux
+}
+
+// handleDump writes a goroutine and a heap dump into the diagnostics folder of
+// the internal storage, so that they can be collected later, and returns the
+// paths of the dumps
+func handleDump(w http.ResponseWriter, r *http.Request, storage string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir := filepath.Join(os.TempDir(), "cmcd-"+diagnosticsDumpFolder)
+	if storage != "" {
+		dir = filepath.Join(storage, diagnosticsDumpFolder)
+	}
+	files, err := writeDumps(dir, time.Now())
+	if err != nil {
+		log.Errorf("Failed to write diagnostics dumps: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Wrote diagnostics dumps %v", strings.Join(files, ", "))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// writeDumps writes the goroutine stacks and the heap profile into the folder
+func writeDumps(dir string, now time.Time) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create diagnostics folder: %w", err)
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	dumps := []struct {
+		profile string
+		file    string
+		debug   int
+	}{
+		{"goroutine", "goroutines-" + stamp + ".txt", 2},
+		{"heap", "heap-" + stamp + ".pprof", 0},
+	}
+
+	var files []string
+	for _, d := range dumps {
+		file := filepath.Join(dir, d.file)
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %v dump: %w", d.profile, err)
+		}
+		err = rpprof.Lookup(d.profile).WriteTo(f, d.debug)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %v dump: %w", d.profile, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// listenDiagnostics binds the diagnostics listener to the configured address
+func listenDiagnostics(addr string, allowRemote bool) (net.Listener, error) {
+	network, address, err := diagnosticsListener(addr, allowRemote)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// Remove stale sockets of previous runs
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to restrict diagnostics socket: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func serveDiagnostics(l net.Listener, c *cmc.Cmc, storage string) {
+	log.Warnf("Serving diagnostics on %v/debug/", l.Addr())
+	err := http.Serve(l, newDiagnosticsHandler(c, storage))
+	if err != nil {
+		log.Errorf("Failed to serve diagnostics: %v", err)
+	}
+}
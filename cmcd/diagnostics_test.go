@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// isProfile checks for the gzip compressed protocol buffer format of pprof
+func isProfile(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func Test_diagnosticsListener(t *testing.T) {
+	tests := []struct {
+		name        string
+		addr        string
+		allowRemote bool
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{"Localhost", "localhost:6060", false, "tcp", "localhost:6060", false},
+		{"IPv4 Loopback", "127.0.0.1:6060", false, "tcp", "127.0.0.1:6060", false},
+		{"IPv6 Loopback", "[::1]:6060", false, "tcp", "[::1]:6060", false},
+		{"Unix Socket", "unix:/run/cmcd/diag.sock", false, "unix", "/run/cmcd/diag.sock", false},
+		{"Unix Socket URL", "unix:///run/cmcd/diag.sock", false, "unix", "/run/cmcd/diag.sock", false},
+		{"All Interfaces", ":6060", false, "", "", true},
+		{"Remote Address", "192.168.0.10:6060", false, "", "", true},
+		{"Hostname", "example.com:6060", false, "", "", true},
+		{"Remote Allowed", "0.0.0.0:6060", true, "tcp", "0.0.0.0:6060", false},
+		{"Missing Port", "localhost", false, "", "", true},
+		{"Missing Socket Path", "unix:", false, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, addr, err := diagnosticsListener(tt.addr, tt.allowRemote)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("diagnosticsListener() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || addr != tt.wantAddr {
+				t.Errorf("diagnosticsListener() = %v %v, want %v %v", network, addr,
+					tt.wantNetwork, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestServeDiagnostics(t *testing.T) {
+	storage := t.TempDir()
+	l, err := listenDiagnostics("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("listenDiagnostics() error = %v", err)
+	}
+	defer l.Close()
+	go serveDiagnostics(l, nil, storage)
+	base := "http://" + l.Addr().String()
+
+	countRequest("socket", "Attest")
+
+	// Fetch a CPU profile
+	resp, err := http.Get(base + "/debug/pprof/profile?seconds=1")
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("profile status = %v", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read profile: %v", err)
+	}
+	if !isProfile(data) {
+		t.Errorf("profile is not in pprof format")
+	}
+
+	// Fetch the expvar variables
+	resp, err = http.Get(base + "/debug/vars")
+	if err != nil {
+		t.Fatalf("failed to fetch vars: %v", err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("failed to decode vars: %v", err)
+	}
+	for _, v := range []string{"memstats", "cmcd.goroutines", "cmcd.drivers", "cmcd.requests"} {
+		if _, ok := vars[v]; !ok {
+			t.Errorf("vars do not contain %v", v)
+		}
+	}
+	if !strings.Contains(string(vars["cmcd.requests"]), `"socket.Attest"`) {
+		t.Errorf("requests = %s, want socket.Attest counter", vars["cmcd.requests"])
+	}
+
+	// Trigger the goroutine and heap dumps
+	resp, err = http.Get(base + "/debug/dump")
+	if err != nil {
+		t.Fatalf("failed to trigger dump: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET dump status = %v, want %v", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	resp, err = http.Post(base+"/debug/dump", "", nil)
+	if err != nil {
+		t.Fatalf("failed to trigger dump: %v", err)
+	}
+	defer resp.Body.Close()
+	var files []string
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		t.Fatalf("failed to decode dump files: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("dump files = %v, want goroutine and heap dump", files)
+	}
+	for _, file := range files {
+		if filepath.Dir(file) != filepath.Join(storage, diagnosticsDumpFolder) {
+			t.Errorf("dump %v not in storage folder", file)
+		}
+	}
+	stacks, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("failed to read goroutine dump: %v", err)
+	}
+	if !strings.Contains(string(stacks), "goroutine") {
+		t.Errorf("goroutine dump does not contain stacks")
+	}
+	heap, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatalf("failed to read heap dump: %v", err)
+	}
+	if !isProfile(heap) {
+		t.Errorf("heap dump is not in pprof format")
+	}
+}
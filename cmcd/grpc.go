@@ -26,23 +26,33 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"path"
+	"sync"
+	"time"
 
 	"encoding/hex"
 	"encoding/json"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 
 	// local modules
 
+	cmcapi "github.com/Fraunhofer-AISEC/cmc/api"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
 	"github.com/Fraunhofer-AISEC/cmc/generate"
 	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
-	"github.com/Fraunhofer-AISEC/cmc/verify"
 )
 
-type GrpcServerWrapper struct{}
+// GrpcServerWrapper serves the gRPC API and holds the running gRPC server for
+// Shutdown
+type GrpcServerWrapper struct {
+	mu       sync.Mutex
+	server   *grpc.Server
+	shutdown bool
+}
 
 // GrpcServer is the gRPC server structure
 type GrpcServer struct {
@@ -52,13 +62,10 @@ type GrpcServer struct {
 
 func init() {
 	log.Info("Adding gRPC server to supported servers")
-	servers["grpc"] = GrpcServerWrapper{}
+	registerServer("grpc", &GrpcServerWrapper{})
 }
 
-func (wrapper GrpcServerWrapper) Serve(addr string, cmc *cmc.Cmc) error {
-	server := &GrpcServer{
-		cmc: cmc,
-	}
+func (wrapper *GrpcServerWrapper) Serve(addr string, cmc *cmc.Cmc) error {
 
 	// Create TCP server
 	log.Infof("Starting CMC gRPC Server on %v", addr)
@@ -68,8 +75,15 @@ func (wrapper GrpcServerWrapper) Serve(addr string, cmc *cmc.Cmc) error {
 	}
 
 	// Start gRPC server
-	s := grpc.NewServer()
-	api.RegisterCMCServiceServer(s, server)
+	s := newGrpcServer(cmc)
+	wrapper.mu.Lock()
+	if wrapper.shutdown {
+		wrapper.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	wrapper.server = s
+	wrapper.mu.Unlock()
 
 	log.Infof("Waiting for requests on %v", listener.Addr())
 	err = s.Serve(listener)
@@ -80,6 +94,33 @@ func (wrapper GrpcServerWrapper) Serve(addr string, cmc *cmc.Cmc) error {
 	return nil
 }
 
+// Shutdown stops accepting requests and waits for the active requests. If the
+// context is done first, the requests are aborted
+func (wrapper *GrpcServerWrapper) Shutdown(ctx context.Context) error {
+	wrapper.mu.Lock()
+	wrapper.shutdown = true
+	s := wrapper.server
+	wrapper.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.GracefulStop()
+	}()
+	return drain(ctx, &wg, s.Stop)
+}
+
+// newGrpcServer returns the gRPC server with the CMC service registered
+func newGrpcServer(cmc *cmc.Cmc) *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(countGrpcRequest))
+	api.RegisterCMCServiceServer(s, &GrpcServer{cmc: cmc})
+	return s
+}
+
 func (s *GrpcServer) Attest(ctx context.Context, in *api.AttestationRequest) (*api.AttestationResponse, error) {
 
 	log.Debug("Prover: Received gRPC attestation request")
@@ -90,15 +131,29 @@ func (s *GrpcServer) Attest(ctx context.Context, in *api.AttestationRequest) (*a
 		}, errors.New("no valid signers configured")
 	}
 
-	if s.cmc.Metadata == nil {
+	metadata := s.cmc.Metadata()
+	if metadata == nil {
 		return &api.AttestationResponse{
 			Status: api.Status_FAIL,
 		}, errors.New("metadata not specified. Can work only as verifier")
 	}
 
+	if in.DryRun {
+		summary, err := dryRun(in.Nonce, s.cmc)
+		if err != nil {
+			return &api.AttestationResponse{
+				Status: api.Status_FAIL,
+			}, err
+		}
+		return &api.AttestationResponse{
+			Status:        api.Status_OK,
+			DryRunSummary: summary,
+		}, nil
+	}
+
 	log.Info("Prover: Generating Attestation Report with nonce: ", hex.EncodeToString(in.Nonce))
 
-	report, err := generate.Generate(in.Nonce, s.cmc.Metadata, s.cmc.Drivers, s.cmc.Serializer)
+	report, err := generate.Generate(in.Nonce, metadata, s.cmc.Measurers(), s.cmc.Serializer)
 	if err != nil {
 		return &api.AttestationResponse{
 			Status: api.Status_FAIL,
@@ -106,7 +161,8 @@ func (s *GrpcServer) Attest(ctx context.Context, in *api.AttestationRequest) (*a
 	}
 
 	log.Info("Prover: Signing Attestation Report")
-	data, err := generate.Sign(report, s.cmc.Drivers[0], s.cmc.Serializer)
+	data, err := generate.Sign(report, s.cmc.Drivers[0], s.cmc.Serializer,
+		s.cmc.AdditionalSigners...)
 	if err != nil {
 		return &api.AttestationResponse{
 			Status: api.Status_FAIL,
@@ -128,10 +184,21 @@ func (s *GrpcServer) Verify(ctx context.Context, in *api.VerificationRequest) (*
 	var status api.Status
 
 	log.Info("Received Connection Request Type 'Verification Request'")
+	received := time.Now()
 
 	log.Info("Verifier: Verifying Attestation Report")
-	result := verify.Verify(in.AttestationReport, in.Nonce, in.Ca, in.Policies,
-		s.cmc.PolicyEngineSelect, s.cmc.IntelStorage)
+	result, err := s.cmc.VerifyBudget.Verify(ctx, in.AttestationReport, in.Nonce,
+		requestCas(in.Ca, in.Cas), in.Policies, s.cmc.PolicyEngineSelect, s.cmc.IntelStorage)
+	if err != nil {
+		log.Errorf("Verifier: failed to verify Attestation Report: %v", err)
+		return &api.VerificationResponse{Status: api.Status_FAIL}, nil
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	s.cmc.PublishResult("grpc", addr, in.AttestationReport, in.Nonce, received,
+		&result)
 
 	log.Info("Verifier: Marshaling Attestation Result")
 	data, err := json.Marshal(result)
@@ -159,14 +226,35 @@ func (s *GrpcServer) Measure(ctx context.Context, in *api.MeasureRequest) (*api.
 
 	log.Info("Received Connection Request Type 'Measure Request'")
 
+	if len(in.Digest) > 0 {
+		n, err := recordRuntimeMeasurement(s.cmc, in.Name, cmcapi.HashFunction(in.Hashtype),
+			in.Digest, in.EventData)
+		if err != nil {
+			return &api.MeasureResponse{
+				Status: api.Status_FAIL,
+			}, err
+		}
+		return &api.MeasureResponse{
+			Status:  api.Status_OK,
+			Success: true,
+			Length:  int32(n),
+		}, nil
+	}
+
 	log.Info("Measurer: Recording measurement")
-	err := m.Measure(in.Name, in.ConfigSha256, in.RootfsSha256,
-		&m.MeasureConfig{
-			Serializer: s.cmc.Serializer,
-			Pcr:        s.cmc.CtrPcr,
-			LogFile:    s.cmc.CtrLog,
-			Driver:     s.cmc.CtrDriver,
-		})
+	mc := &m.MeasureConfig{
+		Serializer: s.cmc.Serializer,
+		Pcr:        s.cmc.CtrPcr,
+		LogFile:    s.cmc.CtrLog,
+		Driver:     s.cmc.CtrDriver,
+		Journal:    s.cmc.CtrJournal,
+	}
+	var err error
+	if in.Removed {
+		err = m.Remove(in.Name, mc)
+	} else {
+		err = m.Measure(in.Name, in.ConfigSha256, in.RootfsSha256, mc)
+	}
 	if err != nil {
 		log.Errorf("Failed to record measurement: %v", err)
 		success = false
@@ -205,16 +293,24 @@ func (s *GrpcServer) TLSSign(ctx context.Context, in *api.TLSSignRequest) (*api.
 		return &api.TLSSignResponse{Status: api.Status_FAIL},
 			fmt.Errorf("failed to find appropriate hash function: %w", err)
 	}
-	// get key
-	tlsKeyPriv, _, err = s.cmc.Drivers[0].GetSigningKeys()
+	// get key of the requested certificate profile
+	tlsKeyPriv, _, err = s.cmc.SigningKeys(in.GetId())
 	if err != nil {
 		return &api.TLSSignResponse{Status: api.Status_FAIL},
 			fmt.Errorf("failed to get IK: %w", err)
 	}
+	signer, ok := tlsKeyPriv.(crypto.Signer)
+	if !ok {
+		return &api.TLSSignResponse{Status: api.Status_FAIL},
+			errors.New("failed to get IK: key is not a signer")
+	}
+	err = checkSignerOpts(signer.Public(), opts)
+	if err != nil {
+		return &api.TLSSignResponse{Status: api.Status_FAIL}, err
+	}
 	// Sign
-	// Convert crypto.PrivateKey to crypto.Signer
 	log.Trace("TLSSign using opts: ", opts)
-	signature, err = tlsKeyPriv.(crypto.Signer).Sign(rand.Reader, in.GetDigest(), opts)
+	signature, err = signer.Sign(rand.Reader, in.GetDigest(), opts)
 	if err != nil {
 		return &api.TLSSignResponse{Status: api.Status_FAIL},
 			fmt.Errorf("failed to perform Signing operation: %w", err)
@@ -239,8 +335,8 @@ func (s *GrpcServer) TLSCert(ctx context.Context, in *api.TLSCertRequest) (*api.
 		}, errors.New("no valid signers configured")
 	}
 
-	// provide TLS certificate chain
-	certChain, err := s.cmc.Drivers[0].GetCertChain()
+	// provide TLS certificate chain of the requested certificate profile
+	certChain, err := s.cmc.CertChain(in.GetId())
 	if err != nil {
 		return &api.TLSCertResponse{Status: api.Status_FAIL},
 			fmt.Errorf("failed to get cert chain: %w", err)
@@ -251,6 +347,57 @@ func (s *GrpcServer) TLSCert(ctx context.Context, in *api.TLSCertRequest) (*api.
 	return resp, nil
 }
 
+// Returns the capabilities and the health of the drivers
+func (s *GrpcServer) Capabilities(ctx context.Context, in *api.CapabilitiesRequest) (*api.CapabilitiesResponse, error) {
+
+	log.Debugf("Received capabilities request with ID %v", in.GetId())
+
+	resp := &api.CapabilitiesResponse{
+		Status: api.Status_OK,
+	}
+	for _, d := range s.cmc.Status() {
+		c := &api.DriverCapabilities{
+			Name:             d.Name,
+			Version:          d.Version,
+			Signer:           d.Signer,
+			KeyAlgorithms:    d.KeyAlgorithms,
+			MeasurementTypes: d.MeasurementTypes,
+			PcrBanks:         d.PcrBanks,
+			Healthy:          d.Healthy,
+			HealthError:      d.HealthError,
+			HealthChecked:    d.HealthChecked.Unix(),
+			Warnings:         d.Warnings,
+		}
+		for _, cert := range d.Certificates {
+			c.Certificates = append(c.Certificates, &api.CertificateStatus{
+				Name:     cert.Name,
+				Subject:  cert.Subject,
+				NotAfter: cert.NotAfter.Unix(),
+			})
+		}
+		resp.Drivers = append(resp.Drivers, c)
+	}
+	if e := s.cmc.EnrollmentStatus(); e != nil {
+		resp.Enrollment = &api.EnrollmentStatus{
+			State:       string(e.State),
+			Attempts:    int32(e.Attempts),
+			LastAttempt: unixTime(e.LastAttempt),
+			NextAttempt: unixTime(e.NextAttempt),
+			LastError:   e.LastError,
+		}
+	}
+
+	return resp, nil
+}
+
+// unixTime returns the Unix time in seconds or zero for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
 // Converts Protobuf hashtype to crypto.SignerOpts
 func convertHash(hashtype api.HashFunction, pssOpts *api.PSSOptions) (crypto.SignerOpts, error) {
 	var hash crypto.Hash
@@ -279,3 +426,10 @@ func convertHash(hashtype api.HashFunction, pssOpts *api.PSSOptions) (crypto.Sig
 	}
 	return hash, nil
 }
+
+// countGrpcRequest counts the requests per gRPC method
+func countGrpcRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	countRequest("grpc", path.Base(info.FullMethod))
+	return handler(ctx, req)
+}
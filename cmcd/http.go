@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || http
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// local modules
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+)
+
+// HTTP API paths
+const (
+	httpAttestPath    = "/attest"
+	httpVerifyPath    = "/verify"
+	httpTlsSignPath   = "/tlssign"
+	httpTlsCertPath   = "/tlscert"
+	httpPeerCachePath = "/peercache"
+	httpNoncePath     = "/nonce"
+)
+
+// MIME types of the HTTP API
+const (
+	mimeTypeJson = "application/json"
+	mimeTypeCbor = "application/cbor"
+	mimeTypeText = "text/plain; charset=utf-8"
+)
+
+// httpReadTimeout is the time a client has to send its request
+const httpReadTimeout = 30 * time.Second
+
+// HttpServer serves the API via HTTP with JSON or CBOR encoded payloads. It
+// holds the running HTTP server for Shutdown
+type HttpServer struct {
+	mu       sync.Mutex
+	server   *http.Server
+	shutdown bool
+}
+
+func init() {
+	log.Info("Adding HTTP server to supported servers")
+	registerServer("http", &HttpServer{})
+}
+
+func (s *HttpServer) Serve(addr string, cmc *cmc.Cmc) error {
+
+	log.Infof("Starting CMC HTTP Server on %v", addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start server on %v: %w", addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           newHttpHandler(cmc),
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+	}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.server = server
+	s.mu.Unlock()
+
+	log.Infof("Waiting for requests on %v", listener.Addr())
+	err = server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for the active requests. If the
+// context is done first, the connections are closed
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("aborted active requests: %w", err)
+	}
+	return nil
+}
+
+// newHttpHandler returns the handler serving the endpoints of the HTTP API.
+// The endpoints share the request handling with the socket API
+func newHttpHandler(c *cmc.Cmc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpAttestPath, handleHttp(api.TypeAttest, http.StatusInternalServerError,
+		func(r *http.Request, req *api.AttestationRequest) (*api.AttestationResponse, error) {
+			return attestRequest(c, req)
+		}))
+	mux.HandleFunc(httpVerifyPath, handleHttp(api.TypeVerify, http.StatusServiceUnavailable,
+		func(r *http.Request, req *api.VerificationRequest) (*api.VerificationResponse, error) {
+			return verifyRequest(r.Context(), c, req, "http", r.RemoteAddr, time.Now())
+		}))
+	mux.HandleFunc(httpTlsSignPath, handleHttp(api.TypeTLSSign, http.StatusInternalServerError,
+		func(r *http.Request, req *api.TLSSignRequest) (*api.TLSSignResponse, error) {
+			return tlsSignRequest(c, req)
+		}))
+	mux.HandleFunc(httpTlsCertPath, handleHttp(api.TypeTLSCert, http.StatusInternalServerError,
+		func(r *http.Request, req *api.TLSCertRequest) (*api.TLSCertResponse, error) {
+			return tlsCertRequest(c, req)
+		}))
+	mux.HandleFunc(httpPeerCachePath, handleHttp(api.TypePeerCache, http.StatusBadRequest,
+		func(r *http.Request, req *api.PeerCacheRequest) (*api.PeerCacheResponse, error) {
+			return peerCacheRequest(req), nil
+		}))
+	mux.HandleFunc(httpNoncePath, handleHttp(api.TypeNonce, http.StatusServiceUnavailable,
+		func(r *http.Request, req *api.NonceRequest) (*api.NonceResponse, error) {
+			return nonceRequest(c, req)
+		}))
+	return mux
+}
+
+// handleHttp returns the HTTP handler for a request type. It negotiates the
+// serialization, unmarshals the request and marshals the response of the
+// transport-agnostic handler. Malformed requests are answered with a client
+// error, failures of the handler with failStatus
+func handleHttp[Req, Resp any](reqType uint32, failStatus int,
+	handle func(r *http.Request, req *Req) (*Resp, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		log.Debugf("Received HTTP %v request from %v", api.TypeToString(reqType), r.RemoteAddr)
+		countRequest("http", api.TypeToString(reqType))
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			sendHttpError(w, http.StatusMethodNotAllowed, "method %v not allowed", r.Method)
+			return
+		}
+
+		reqSerializer, respSerializer, status, err := negotiateSerializers(r)
+		if err != nil {
+			sendHttpError(w, status, "%v", err)
+			return
+		}
+
+		payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, api.MaxMsgLen))
+		if err != nil {
+			sendHttpError(w, http.StatusRequestEntityTooLarge, "failed to read request: %v", err)
+			return
+		}
+
+		req := new(Req)
+		if err := reqSerializer.Unmarshal(payload, req); err != nil {
+			sendHttpError(w, http.StatusBadRequest, "failed to unmarshal %v request: %v",
+				api.TypeToString(reqType), err)
+			return
+		}
+
+		resp, err := handle(r, req)
+		if err != nil {
+			sendHttpError(w, failStatus, "%v", err)
+			return
+		}
+
+		data, err := respSerializer.Marshal(resp)
+		if err != nil {
+			sendHttpError(w, http.StatusInternalServerError, "failed to marshal message: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", mimeType(respSerializer))
+		if _, err := w.Write(data); err != nil {
+			log.Warnf("Failed to send HTTP response: %v", err)
+		}
+	}
+}
+
+// negotiateSerializers returns the serializer of the request according to its
+// content type and the serializer of the response according to the accepted
+// types of the client. If the client does not accept a specific type, the
+// response is serialized like the request. JSON is the default
+func negotiateSerializers(r *http.Request) (ar.Serializer, ar.Serializer, int, error) {
+
+	var reqSerializer ar.Serializer = ar.JsonSerializer{}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, nil, http.StatusUnsupportedMediaType,
+				fmt.Errorf("invalid content type %v: %w", ct, err)
+		}
+		s, ok := serializerFromMimeType(mt)
+		if !ok {
+			return nil, nil, http.StatusUnsupportedMediaType,
+				fmt.Errorf("unsupported content type %v (possible: %v, %v)", mt, mimeTypeJson,
+					mimeTypeCbor)
+		}
+		reqSerializer = s
+	}
+
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return reqSerializer, reqSerializer, 0, nil
+	}
+	for _, a := range strings.Split(strings.Join(accept, ","), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		if s, ok := serializerFromMimeType(mt); ok {
+			return reqSerializer, s, 0, nil
+		}
+		if mt == "*/*" || mt == "application/*" {
+			return reqSerializer, reqSerializer, 0, nil
+		}
+	}
+	return nil, nil, http.StatusNotAcceptable,
+		fmt.Errorf("none of the accepted types supported (possible: %v, %v)", mimeTypeJson,
+			mimeTypeCbor)
+}
+
+func serializerFromMimeType(mt string) (ar.Serializer, bool) {
+	switch mt {
+	case mimeTypeJson:
+		return ar.JsonSerializer{}, true
+	case mimeTypeCbor:
+		return ar.CborSerializer{}, true
+	default:
+		return nil, false
+	}
+}
+
+func mimeType(s ar.Serializer) string {
+	if _, ok := s.(ar.CborSerializer); ok {
+		return mimeTypeCbor
+	}
+	return mimeTypeJson
+}
+
+func sendHttpError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warn(msg)
+	w.Header().Set("Content-Type", mimeTypeText)
+	w.WriteHeader(status)
+	if _, err := io.WriteString(w, msg); err != nil {
+		log.Warnf("Failed to send HTTP error response: %v", err)
+	}
+}
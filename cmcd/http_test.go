@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// postHttp sends the request serialized with s to the HTTP API and returns the
+// recorded response
+func postHttp(t *testing.T, h http.Handler, path string, s ar.Serializer, req any,
+	accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := s.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	r.Header.Set("Content-Type", mimeType(s))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decodeHttp checks the status and content type of the response and unmarshals it
+func decodeHttp(t *testing.T, w *httptest.ResponseRecorder, s ar.Serializer, resp any) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, body = %v", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != mimeType(s) {
+		t.Fatalf("content type = %v, want %v", ct, mimeType(s))
+	}
+	if err := s.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+}
+
+func TestHttpServer(t *testing.T) {
+	c, f := newLeakCmc(t)
+	h := newHttpHandler(c)
+
+	tests := []struct {
+		name   string
+		s      ar.Serializer
+		accept string
+		resp   ar.Serializer
+	}{
+		{"JSON", ar.JsonSerializer{}, "", ar.JsonSerializer{}},
+		{"CBOR", ar.CborSerializer{}, "", ar.CborSerializer{}},
+		{"JSON Accept CBOR", ar.JsonSerializer{}, mimeTypeCbor, ar.CborSerializer{}},
+		{"CBOR Accept Any", ar.CborSerializer{}, "text/html, */*;q=0.8", ar.CborSerializer{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var attestResp api.AttestationResponse
+			decodeHttp(t, postHttp(t, h, httpAttestPath, tt.s,
+				&api.AttestationRequest{Nonce: f.Nonce}, tt.accept), tt.resp, &attestResp)
+			if len(attestResp.AttestationReport) == 0 {
+				t.Fatalf("attestation response does not contain a report")
+			}
+
+			var verifyResp api.VerificationResponse
+			decodeHttp(t, postHttp(t, h, httpVerifyPath, tt.s, &api.VerificationRequest{
+				Nonce:             f.Nonce,
+				AttestationReport: attestResp.AttestationReport,
+				Ca:                f.CaPem(),
+			}, tt.accept), tt.resp, &verifyResp)
+			var result ar.VerificationResult
+			if err := json.Unmarshal(verifyResp.VerificationResult, &result); err != nil {
+				t.Fatalf("failed to unmarshal verification result: %v", err)
+			}
+			if !result.Success {
+				t.Errorf("verification of generated report failed")
+			}
+
+			digest := sha256.Sum256([]byte("content"))
+			var signResp api.TLSSignResponse
+			decodeHttp(t, postHttp(t, h, httpTlsSignPath, tt.s, &api.TLSSignRequest{
+				Content:  digest[:],
+				Hashtype: api.HashFunction_SHA256,
+			}, tt.accept), tt.resp, &signResp)
+			_, pub, _ := f.GetSigningKeys()
+			if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], signResp.SignedContent) {
+				t.Errorf("invalid signature")
+			}
+
+			var certResp api.TLSCertResponse
+			decodeHttp(t, postHttp(t, h, httpTlsCertPath, tt.s, &api.TLSCertRequest{},
+				tt.accept), tt.resp, &certResp)
+			chain, err := internal.ParseCertsPem(certResp.Certificate)
+			if err != nil {
+				t.Fatalf("failed to parse certificates: %v", err)
+			}
+			if len(chain) == 0 || !chain[0].Equal(f.Ik.Chain[0]) {
+				t.Errorf("certificate chain does not match identity key chain")
+			}
+		})
+	}
+}
+
+func TestHttpServerErrors(t *testing.T) {
+	c, f := newLeakCmc(t)
+	h := newHttpHandler(c)
+	noSigner := newHttpHandler(&cmc.Cmc{Serializer: f.Serializer})
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		method      string
+		path        string
+		contentType string
+		accept      string
+		body        []byte
+		want        int
+	}{
+		{"Method", h, http.MethodGet, httpAttestPath, "", "", nil, http.StatusMethodNotAllowed},
+		{"Unknown Path", h, http.MethodPost, "/status", "", "", nil, http.StatusNotFound},
+		{"Invalid JSON", h, http.MethodPost, httpAttestPath, mimeTypeJson, "",
+			[]byte(`{"nonce":`), http.StatusBadRequest},
+		{"Invalid CBOR", h, http.MethodPost, httpTlsSignPath, mimeTypeCbor, "",
+			[]byte{0xa1}, http.StatusBadRequest},
+		{"Content Type", h, http.MethodPost, httpAttestPath, "text/plain", "",
+			[]byte(`{}`), http.StatusUnsupportedMediaType},
+		{"Not Acceptable", h, http.MethodPost, httpAttestPath, mimeTypeJson, "text/html",
+			[]byte(`{}`), http.StatusNotAcceptable},
+		{"No Signer Attest", noSigner, http.MethodPost, httpAttestPath, mimeTypeJson, "",
+			[]byte(`{}`), http.StatusInternalServerError},
+		{"No Signer TLS Sign", noSigner, http.MethodPost, httpTlsSignPath, "", "",
+			[]byte(`{"hashType":2}`), http.StatusInternalServerError},
+		{"No Signer TLS Cert", noSigner, http.MethodPost, httpTlsCertPath, mimeTypeJson, "",
+			[]byte(`{}`), http.StatusInternalServerError},
+		{"Invalid Hash", h, http.MethodPost, httpTlsSignPath, mimeTypeJson, "",
+			[]byte(`{"content":"AA==","hashType":99}`), http.StatusInternalServerError},
+		{"Unknown Profile", h, http.MethodPost, httpTlsCertPath, mimeTypeJson, "",
+			[]byte(`{"id":"unknown"}`), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v (body %v)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/grpcapi"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const leakIterations = 100
+
+// newLeakCmc returns a CMC with the fixtures as driver
+func newLeakCmc(t *testing.T) (*cmc.Cmc, *fixtures.Fixtures) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{}})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	c := &cmc.Cmc{Drivers: []ar.Driver{f}, Serializer: f.Serializer}
+	c.SetMetadata(f.Metadata)
+	return c, f
+}
+
+// countFds returns the number of open file descriptors of the process
+func countFds(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count file descriptors: %v", err)
+	}
+	return len(fds)
+}
+
+// checkLeaks fails the test if goroutines started or file descriptors opened
+// during the test are left behind
+func checkLeaks(t *testing.T, fds int, opts ...goleak.Option) {
+	t.Helper()
+	if err := goleak.Find(opts...); err != nil {
+		t.Errorf("leaked goroutines: %v", err)
+	}
+	if n := countFds(t); n > fds {
+		t.Errorf("leaked %v file descriptors", n-fds)
+	}
+}
+
+func TestSocketServerLeaks(t *testing.T) {
+	c, f := newLeakCmc(t)
+	ignore := goleak.IgnoreCurrent()
+	fds := countFds(t)
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+
+	request := func(reqType uint32, req any) error {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		payload, err := cbor.Marshal(req)
+		if err != nil {
+			return err
+		}
+		if err := api.Send(conn, payload, reqType); err != nil {
+			return err
+		}
+		_, _, err = api.Receive(conn)
+		return err
+	}
+
+	for i := 0; i < leakIterations; i++ {
+		if err := request(api.TypeAttest, &api.AttestationRequest{Nonce: f.Nonce}); err != nil {
+			t.Fatalf("attestation request failed: %v", err)
+		}
+		// The verification of an invalid report fails
+		if err := request(api.TypeVerify, &api.VerificationRequest{
+			Nonce: f.Nonce, AttestationReport: []byte{0x1}, Ca: f.CaPem()}); err != nil {
+			t.Fatalf("verification request failed: %v", err)
+		}
+		if err := request(0xff, &api.StatusRequest{}); err != nil {
+			t.Fatalf("invalid request failed: %v", err)
+		}
+
+		// Clients disconnecting mid-message
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], 1024)
+		binary.BigEndian.PutUint32(header[4:8], api.TypeAttest)
+		conn.Write(append(header, 0xa1, 0x00))
+		conn.Close()
+	}
+
+	// Clients idling until the shutdown
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	l.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("serveSocket() error = %v", err)
+	}
+	checkLeaks(t, fds+10, ignore)
+}
+
+func TestGrpcServerLeaks(t *testing.T) {
+	c, f := newLeakCmc(t)
+	ignore := goleak.IgnoreCurrent()
+	fds := countFds(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := newGrpcServer(c)
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	client := grpcapi.NewCMCServiceClient(conn)
+
+	for i := 0; i < leakIterations; i++ {
+		if _, err := client.Attest(ctx, &grpcapi.AttestationRequest{Nonce: f.Nonce}); err != nil {
+			t.Fatalf("Attest() error = %v", err)
+		}
+		if _, err := client.Verify(ctx, &grpcapi.VerificationRequest{
+			Nonce: f.Nonce, AttestationReport: []byte{0x1}, Ca: f.CaPem()}); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+
+		// Requests cancelled by the client
+		cctx, ccancel := context.WithCancel(ctx)
+		ccancel()
+		client.Attest(cctx, &grpcapi.AttestationRequest{Nonce: f.Nonce})
+
+		// Clients disconnecting mid-message
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		raw.Write([]byte("PRI * HTTP/2.0\r\n"))
+		raw.Close()
+	}
+	conn.Close()
+
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	checkLeaks(t, fds, ignore)
+}
@@ -16,33 +16,124 @@
 package main
 
 import (
-	"strings"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
 )
 
+// defaultShutdownTimeout is the time the server waits for active requests on
+// shutdown before they are aborted
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == oneshotCmd {
+		os.Exit(oneshot(os.Args[2:]))
+	}
+
 	log.Infof("Starting cmcd %v", getVersion())
 
-	c, err := getConfig()
+	c, cmc, err := setup(os.Args[1:], true)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Fatal(err)
 	}
 
-	cmc, err := cmc.NewCmc(c)
-	if err != nil {
-		log.Fatalf("Failed to init CMC: %v", err)
+	if c.MetricsAddr != "" {
+		go serveMetrics(c.MetricsAddr)
+	}
+
+	if c.DiagnosticsAddr != "" {
+		l, err := listenDiagnostics(c.DiagnosticsAddr, c.DiagnosticsAllowRemote)
+		if err != nil {
+			log.Fatalf("Failed to start diagnostics listener: %v", err)
+		}
+		go serveDiagnostics(l, cmc, c.Storage)
 	}
 
-	server, ok := servers[strings.ToLower(c.Api)]
+	server, ok := getServer(c.Api)
 	if !ok {
 		log.Fatalf("API '%v' is not implemented", c.Api)
 	}
 
+	timeout := defaultShutdownTimeout
+	if c.ShutdownTimeout != "" {
+		timeout, err = time.ParseDuration(c.ShutdownTimeout)
+		if err != nil {
+			log.Fatalf("Failed to parse shutdown timeout: %v", err)
+		}
+	}
+
+	stopped := make(chan struct{})
+	handleSignals(cmc, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Failed to shut down gracefully: %v", err)
+		}
+		close(stopped)
+	})
+
 	err = server.Serve(c.Addr, cmc)
 	if err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 
+	<-stopped
+	cmc.Close()
+	log.Info("Stopped cmcd")
+}
+
+// setup loads the configuration from the command line arguments and initializes
+// the CMC with the configured drivers and metadata. If the configuration shall
+// only be checked, the process exits with the result of the check
+func setup(args []string, server bool) (*cmc.Config, *cmc.Cmc, error) {
+
+	c, check, err := getConfig(args, server)
+	if check {
+		os.Exit(printCheck(err))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	cmc, err := cmc.NewCmc(c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to init CMC: %w", err)
+	}
+
+	return c, cmc, nil
+}
+
+// printCheck prints the result of the configuration check with one line per
+// problem and returns the exit code
+func printCheck(err error) int {
+	var errs cmc.ConfigErrors
+	switch {
+	case err == nil:
+		fmt.Println("Configuration is valid")
+		return 0
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+	default:
+		fmt.Println(err)
+	}
+	return 1
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	log.Infof("Serving metrics on %v/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Errorf("Failed to serve metrics: %v", err)
+	}
 }
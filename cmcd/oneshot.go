@@ -0,0 +1,236 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// oneshotCmd is the subcommand performing a single operation without serving
+// an API, e.g. from an initramfs or a container init
+const oneshotCmd = "oneshot"
+
+// Exit codes of the one-shot mode
+const (
+	exitSuccess      = 0
+	exitFailure      = 1
+	exitVerifyFailed = 2
+	exitUsage        = 4
+)
+
+const (
+	nonceFlag      = "nonce"
+	inFlag         = "in"
+	outFlag        = "out"
+	caFlag         = "ca"
+	policyFileFlag = "policy"
+)
+
+// oneshotParams are the parameters of the one-shot operation
+type oneshotParams struct {
+	nonce    []byte
+	in       string
+	out      string
+	ca       []byte
+	policies []byte
+}
+
+// oneshotOps are the one-shot operations, which return the exit code
+var oneshotOps = map[string]func(c *cmc.Cmc, p *oneshotParams) (int, error){
+	"attest": oneshotAttest,
+	"verify": oneshotVerify,
+}
+
+// oneshot initializes the configured drivers, performs the operation specified
+// by the first argument and returns the exit code. The drivers are closed
+// before returning, so that e.g. TPM handles are flushed
+func oneshot(args []string) int {
+
+	ops := maps.Keys(oneshotOps)
+	slices.Sort(ops)
+	if len(args) == 0 || oneshotOps[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "Usage: %v %v <%v> [flags]\n", os.Args[0], oneshotCmd,
+			strings.Join(ops, "|"))
+		return exitUsage
+	}
+	op := args[0]
+
+	flag.CommandLine.Init(os.Args[0]+" "+oneshotCmd+" "+op, flag.ContinueOnError)
+	nonce := flag.String(nonceFlag, "", "Hex encoded nonce of the attestation report")
+	in := flag.String(inFlag, "", "Attestation report to verify")
+	out := flag.String(outFlag, "",
+		"File to write the attestation report or verification result to (default: stdout)")
+	ca := flag.String(caFlag, "", "PEM encoded CA certificate(s) to verify the report against")
+	policies := flag.String(policyFileFlag, "", "Optional policies file for the verification")
+
+	c, cmc, err := setup(args[1:], false)
+	if errors.Is(err, errUsage) {
+		return exitUsage
+	}
+	if err != nil {
+		log.Errorf("%v", err)
+		return exitFailure
+	}
+	defer cmc.Close()
+	handleSignals(cmc, func() {
+		cmc.Close()
+		os.Exit(1)
+	})
+
+	p, err := getOneshotParams(op, *nonce, *in, *out, *ca, *policies)
+	if err != nil {
+		log.Errorf("Invalid %v parameters: %v", op, err)
+		return exitUsage
+	}
+
+	log.Debugf("Performing one-shot %v with drivers %v", op, strings.Join(c.Drivers, ","))
+
+	code, err := oneshotOps[op](cmc, p)
+	if err != nil {
+		log.Errorf("Failed to %v: %v", op, err)
+	}
+	return code
+}
+
+// getOneshotParams checks and loads the parameters of the operation
+func getOneshotParams(op, nonce, in, out, ca, policies string) (*oneshotParams, error) {
+
+	p := &oneshotParams{in: in, out: out}
+	var err error
+
+	if nonce == "" {
+		return nil, fmt.Errorf("-%v required", nonceFlag)
+	}
+	p.nonce, err = hex.DecodeString(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+
+	if op != "verify" {
+		return p, nil
+	}
+
+	if in == "" {
+		return nil, fmt.Errorf("-%v required", inFlag)
+	}
+	if ca == "" {
+		return nil, fmt.Errorf("-%v required", caFlag)
+	}
+	p.ca, err = os.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %w", err)
+	}
+	if policies != "" {
+		p.policies, err = os.ReadFile(policies)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policies: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// oneshotAttest generates and signs an attestation report with the configured
+// drivers and metadata
+func oneshotAttest(c *cmc.Cmc, p *oneshotParams) (int, error) {
+
+	if len(c.Drivers) == 0 {
+		return exitFailure, errors.New("no valid signers configured")
+	}
+
+	metadata := c.Metadata()
+	if metadata == nil {
+		log.Warn("Generating AR without any metadata")
+	}
+
+	report, err := generate.Generate(p.nonce, metadata, c.Measurers(), c.Serializer)
+	if err != nil {
+		return exitFailure, fmt.Errorf("failed to generate attestation report: %w", err)
+	}
+	signed, err := generate.Sign(report, c.Drivers[0], c.Serializer,
+		c.AdditionalSigners...)
+	if err != nil {
+		return exitFailure, fmt.Errorf("failed to sign attestation report: %w", err)
+	}
+
+	if err := writeOutput(p.out, signed); err != nil {
+		return exitFailure, err
+	}
+	return exitSuccess, nil
+}
+
+// oneshotVerify verifies the attestation report and writes the verification
+// result. Verification failures are indicated by the exit code
+func oneshotVerify(c *cmc.Cmc, p *oneshotParams) (int, error) {
+
+	received := time.Now()
+	result, err := c.VerifyBudget.VerifyFile(context.Background(), p.in, p.nonce, p.ca,
+		p.policies, c.PolicyEngineSelect, c.IntelStorage)
+	if err != nil {
+		return exitFailure, fmt.Errorf("failed to verify attestation report: %w", err)
+	}
+
+	// The report is only read for the sinks and the archive if configured
+	if len(c.Sinks) > 0 || c.Archive != nil {
+		report, err := os.ReadFile(p.in)
+		if err != nil {
+			return exitFailure, fmt.Errorf("failed to read attestation report: %w", err)
+		}
+		c.PublishResult(oneshotCmd, "", report, p.nonce, received, &result)
+	}
+
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return exitFailure, fmt.Errorf("failed to marshal verification result: %w", err)
+	}
+	if err := writeOutput(p.out, append(data, '\n')); err != nil {
+		return exitFailure, err
+	}
+
+	if !result.Success {
+		return exitVerifyFailed, nil
+	}
+	return exitSuccess, nil
+}
+
+// writeOutput writes the data to the file or to stdout if no file is specified
+func writeOutput(file string, data []byte) error {
+	if file == "" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		return nil
+	}
+	if err := internal.WriteFileAtomic(file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// newEstStub creates an EST server stub enrolling the CSRs with the device CA
+// of the fixtures
+func newEstStub(t *testing.T, f *fixtures.Fixtures) *httptest.Server {
+
+	serial := int64(100)
+	issue := func(tmpl *x509.Certificate, pub any) *x509.Certificate {
+		serial++
+		tmpl.SerialNumber = big.NewInt(serial)
+		tmpl.NotBefore = time.Now().Add(-time.Minute)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, f.DeviceCa.Cert(), pub,
+			f.DeviceCa.Priv)
+		if err != nil {
+			t.Fatalf("failed to create certificate: %v", err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(est.EndpointPrefix+est.CacertsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		p7, _ := est.EncodePkcs7CertsOnly(f.DeviceCa.Chain)
+		w.Write(est.EncodeBase64(p7))
+	})
+	mux.HandleFunc(est.EndpointPrefix+est.EnrollEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		csr, err := est.ParsePkcs10Csr(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := issue(&x509.Certificate{
+			RawSubject: csr.RawSubject,
+			KeyUsage:   x509.KeyUsageDigitalSignature,
+		}, csr.PublicKey)
+		p7, _ := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+		w.Write(est.EncodeBase64(p7))
+	})
+
+	srvKey := f.Ik.Priv
+	srvCert := issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "EST Server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, srvKey.Public())
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{srvCert.Raw, f.DeviceCa.Cert().Raw},
+			PrivateKey:  srvKey,
+		}},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// newOneshotCmc initializes a CMC with the software driver enrolled at the EST
+// server stub and the metadata of the fixtures
+func newOneshotCmc(t *testing.T, f *fixtures.Fixtures) *cmc.Cmc {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	// Without hardware trust anchor, only certification level 1 can be attested
+	// and the TPM reference values of the fixtures cannot be matched
+	f.RtmManifest.CertificationLevel, f.RtmManifest.ReferenceValues = 1, nil
+	f.OsManifest.CertificationLevel, f.OsManifest.ReferenceValues = 1, nil
+	for i := range f.AppManifests {
+		f.AppManifests[i].CertificationLevel, f.AppManifests[i].ReferenceValues = 1, nil
+	}
+	if err := f.SignMetadata(); err != nil {
+		t.Fatalf("failed to sign metadata: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := f.Write(dir); err != nil {
+		t.Fatalf("failed to write fixtures: %v", err)
+	}
+
+	// The software driver requires a device config for the CSR of its key
+	data, err := f.Serializer.Marshal(ar.DeviceConfig{
+		MetaInfo: ar.MetaInfo{Type: "Device Config", Name: "de.test.config",
+			Version: f.DeviceDescription.Version},
+		IkCsr: ar.CsrParams{Subject: ar.Name{CommonName: fixtures.DeviceDescriptionName + " IK",
+			Organization: "Test"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal device config: %v", err)
+	}
+	signed, err := generate.Sign(data, f.Operator, f.Serializer)
+	if err != nil {
+		t.Fatalf("failed to sign device config: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "metadata", "device.config.json"), signed, 0644)
+	if err != nil {
+		t.Fatalf("failed to write device config: %v", err)
+	}
+
+	c, err := cmc.NewCmc(&cmc.Config{
+		Metadata:       []string{"file://" + filepath.Join(dir, "metadata")},
+		ProvServerAddr: newEstStub(t, f).URL,
+		Drivers:        []string{"sw"},
+		KeyConfig:      "EC256",
+		UseCtr:         true,
+		CtrDriver:      "sw",
+		CtrLog:         filepath.Join(dir, "missing"),
+	})
+	if err != nil {
+		t.Fatalf("NewCmc() error = %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestOneshot(t *testing.T) {
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	c := newOneshotCmc(t, f)
+
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, f.CaPem(), 0644); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	nonce := hex.EncodeToString(f.Nonce)
+	report := filepath.Join(dir, "report.bin")
+	result := filepath.Join(dir, "result.json")
+
+	p, err := getOneshotParams("attest", nonce, "", report, "", "")
+	if err != nil {
+		t.Fatalf("getOneshotParams() error = %v", err)
+	}
+	code, err := oneshotAttest(c, p)
+	if code != exitSuccess {
+		t.Fatalf("oneshotAttest() = %v, error = %v", code, err)
+	}
+
+	tests := []struct {
+		name  string
+		nonce string
+		want  int
+	}{
+		{"Success", nonce, exitSuccess},
+		{"Wrong Nonce", "0102", exitVerifyFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := getOneshotParams("verify", tt.nonce, report, result, ca, "")
+			if err != nil {
+				t.Fatalf("getOneshotParams() error = %v", err)
+			}
+			code, err := oneshotVerify(c, p)
+			if code != tt.want {
+				t.Fatalf("oneshotVerify() = %v, error = %v, want %v", code, err, tt.want)
+			}
+			data, err := os.ReadFile(result)
+			if err != nil {
+				t.Fatalf("failed to read verification result: %v", err)
+			}
+			var r ar.VerificationResult
+			if err := json.Unmarshal(data, &r); err != nil {
+				t.Fatalf("failed to unmarshal verification result: %v", err)
+			}
+			if r.Success != (tt.want == exitSuccess) {
+				t.Errorf("verification result success = %v", r.Success)
+			}
+		})
+	}
+}
+
+func Test_getOneshotParams(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, []byte("ca"), 0644); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		op      string
+		nonce   string
+		in      string
+		ca      string
+		wantErr bool
+	}{
+		{"Attest", "attest", "0102", "", "", false},
+		{"Attest Missing Nonce", "attest", "", "", "", true},
+		{"Attest Invalid Nonce", "attest", "xyz", "", "", true},
+		{"Verify", "verify", "0102", "report.bin", ca, false},
+		{"Verify Missing Report", "verify", "0102", "", ca, true},
+		{"Verify Missing CA", "verify", "0102", "report.bin", "", true},
+		{"Verify Unreadable CA", "verify", "0102", "report.bin", ca + ".missing", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getOneshotParams(tt.op, tt.nonce, tt.in, "", tt.ca, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getOneshotParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
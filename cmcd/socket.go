@@ -18,71 +18,230 @@
 package main
 
 import (
-	"crypto"
-	"crypto/rand"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
+	"sync"
+	"time"
 
-	"encoding/hex"
 	"encoding/json"
 
 	// local modules
 	"github.com/Fraunhofer-AISEC/cmc/api"
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
-	"github.com/Fraunhofer-AISEC/cmc/generate"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
-	m "github.com/Fraunhofer-AISEC/cmc/measure"
-	"github.com/Fraunhofer-AISEC/cmc/verify"
 	"github.com/fxamacker/cbor/v2"
 )
 
-// Server is the server structure
-type SocketServer struct{}
+// socketReadTimeout is the time a client has to send its request. Clients
+// sending their request do not hold a request slot, the timeout only limits the
+// connections kept open by clients which do not send anything
+const socketReadTimeout = 10 * time.Second
+
+// SocketServer serves the socket API. The connections are tracked, so that
+// Shutdown can wait for their handlers
+type SocketServer struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	shutdown bool
+	// stop is closed by Shutdown to abort waiting for a request slot
+	stop chan struct{}
+}
 
 func init() {
 	log.Info("Adding unix domain socket server to supported servers")
-	servers["socket"] = SocketServer{}
+	registerServer("socket", &SocketServer{})
 }
 
-func (s SocketServer) Serve(addr string, cmc *cmc.Cmc) error {
+func (s *SocketServer) Serve(addr string, cmc *cmc.Cmc) error {
 
 	log.Infof("Waiting for requests on %v (%v)", addr, cmc.Network)
 
-	socket, err := net.Listen(cmc.Network, addr)
+	// Closing the listener also removes the unix domain socket file
+	socket, err := internal.Listen(cmc.Network, addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on unix domain soket: %w", err)
+		return fmt.Errorf("failed to listen on %v socket: %w", cmc.Network, err)
 	}
 	defer socket.Close()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		os.Remove(addr)
-		os.Exit(1)
-	}()
+	if strings.EqualFold(cmc.Network, "unix") {
+		if err := setSocketPermissions(addr, cmc.SocketMode, cmc.SocketGroup); err != nil {
+			return err
+		}
+	}
+
+	return s.serve(socket, cmc)
+}
+
+// Shutdown closes the listener and waits for the handlers of the accepted
+// connections. If the context is done first, the connections are closed
+func (s *SocketServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.shutdown && s.stop != nil {
+		close(s.stop)
+	}
+	s.shutdown = true
+	l := s.listener
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	return drain(ctx, &s.wg, s.closeConns)
+}
+
+// serveSocket handles the connections accepted by the listener until it is
+// closed. The open connections are then closed and their handlers joined
+func serveSocket(l net.Listener, cmc *cmc.Cmc) error {
+	return new(SocketServer).serve(l, cmc)
+}
+
+// serve handles the connections accepted by the listener. If the listener is
+// closed by Shutdown, the handlers are drained there. Otherwise, the open
+// connections are closed and their handlers joined
+func (s *SocketServer) serve(l net.Listener, cmc *cmc.Cmc) error {
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listener = l
+	s.conns = make(map[net.Conn]struct{})
+	s.stop = make(chan struct{})
+	s.mu.Unlock()
+
+	slots := newRequestSlots(cmc.MaxConcurrentRequests, cmc.RequestQueueTimeout)
 
 	for {
-		conn, err := socket.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if shutdown {
+				return nil
+			}
+			s.closeConns()
+			s.wg.Wait()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			return fmt.Errorf("failed to accept connection: %w", err)
 		}
 
-		go handleIncoming(conn, cmc)
+		// No handlers must be added once Shutdown waits for them
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			handleIncoming(conn, cmc, slots, s.stop)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// closeConns closes the open connections, which aborts their handlers
+func (s *SocketServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// requestSlots limits the number of concurrently handled requests. Requests
+// wait up to the queue timeout for a free slot
+type requestSlots struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// newRequestSlots returns the slots for max concurrent requests or nil, which
+// does not limit the requests, if max is 0
+func newRequestSlots(max int, timeout time.Duration) *requestSlots {
+	if max <= 0 {
+		return nil
 	}
+	return &requestSlots{slots: make(chan struct{}, max), timeout: timeout}
 }
 
-func handleIncoming(conn net.Conn, cmc *cmc.Cmc) {
+// acquire waits for a free slot and returns false, if none became free within
+// the queue timeout or stop was closed
+func (r *requestSlots) acquire(stop <-chan struct{}) bool {
+	if r == nil {
+		return true
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	log.Debugf("All %v request slots busy, queueing request", cap(r.slots))
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+func (r *requestSlots) release() {
+	if r != nil {
+		<-r.slots
+	}
+}
+
+// handleIncoming reads and authorizes the request and handles it once a
+// request slot is free. Clients which have not sent their request yet or are
+// not authorized do not hold a slot
+func handleIncoming(conn net.Conn, cmc *cmc.Cmc, slots *requestSlots, stop <-chan struct{}) {
 	defer conn.Close()
 
-	payload, reqType, err := api.Receive(conn)
+	// Clients which do not send their request in time, e.g. because they
+	// disconnected mid-message, must not block the handler forever
+	if err := conn.SetReadDeadline(time.Now().Add(socketReadTimeout)); err != nil {
+		log.Warnf("Failed to set read deadline: %v", err)
+		return
+	}
+	payload, reqType, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
 	if err != nil {
-		s, err := detectSerialization(payload)
-		sendError(conn, s, "Failed to receive: %v", err)
+		// Without a complete request, the serialization of the error response is unknown
+		log.Warnf("Failed to receive: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Requests of unsupported versions are rejected with the supported range
+	// instead of decoding the payload, which may have a different structure
+	if err := api.CheckVersion(version); err != nil {
+		countRequest("socket", "UnsupportedVersion")
+		sendVersionError(conn, payload, version)
 		return
 	}
 
@@ -92,6 +251,25 @@ func handleIncoming(conn net.Conn, cmc *cmc.Cmc) {
 		return
 	}
 
+	countRequest("socket", api.TypeToString(reqType))
+
+	if err := authorize(conn, reqType, cmc.SocketAccess); err != nil {
+		sendError(conn, s, "%v request denied: %v", api.TypeToString(reqType), err)
+		return
+	}
+
+	if !slots.acquire(stop) {
+		countRequest("socket", "Busy")
+		sendError(conn, s, "server busy: no request slot became free within %v", slots.timeout)
+		return
+	}
+	defer slots.release()
+
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+	log.Debugf("Handling %v request (%v requests in flight)", api.TypeToString(reqType),
+		inFlight.Value())
+
 	// Handle request
 	switch reqType {
 	case api.TypeAttest:
@@ -104,6 +282,16 @@ func handleIncoming(conn net.Conn, cmc *cmc.Cmc) {
 		tlscert(conn, payload, cmc, s)
 	case api.TypeTLSSign:
 		tlssign(conn, payload, cmc, s)
+	case api.TypeStatus:
+		status(conn, payload, cmc, s)
+	case api.TypeMetadata:
+		metadata(conn, payload, cmc, s)
+	case api.TypeCache:
+		caches(conn, payload, s)
+	case api.TypePeerCache:
+		peercache(conn, payload, s)
+	case api.TypeNonce:
+		nonce(conn, payload, cmc, s)
 	default:
 		sendError(conn, s, "Invalid Type: %v", reqType)
 	}
@@ -113,15 +301,6 @@ func attest(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 
 	log.Debug("Prover: Received socket attestation request")
 
-	if len(cmc.Drivers) == 0 {
-		sendError(conn, s, "no valid signers configured")
-		return
-	}
-
-	if cmc.Metadata == nil {
-		log.Warn("Generating AR without any metadata")
-	}
-
 	req := new(api.AttestationRequest)
 	err := s.Unmarshal(payload, req)
 	if err != nil {
@@ -129,42 +308,105 @@ func attest(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 		return
 	}
 
-	log.Debugf("Prover: Generating Attestation Report with nonce: %v", hex.EncodeToString(req.Nonce))
-
-	report, err := generate.Generate(req.Nonce, cmc.Metadata, cmc.Drivers, cmc.Serializer)
+	resp, err := attestRequest(cmc, req)
 	if err != nil {
-		sendError(conn, s, "failed to generate attestation report: %v", err)
+		sendError(conn, s, "%v", err)
 		return
 	}
 
-	log.Debug("Prover: Signing Attestation Report")
-	r, err := generate.Sign(report, cmc.Drivers[0], cmc.Serializer)
+	// Reports exceeding the chunk size are sent in chunks. If the client accepts
+	// a supported compression, the response is compressed before chunking
+	c := api.SelectCompression(req.Compression)
+	w := api.NewChunkWriter(conn, api.WithCompression(api.TypeAttest, c), cmc.SocketChunkSize)
+	cw, err := api.NewCompressWriter(w, c)
 	if err != nil {
-		sendError(conn, s, "Failed to sign attestation report: %v", err)
+		sendError(conn, s, "%v", err)
 		return
 	}
-
-	// Serialize payload
-	resp := &api.AttestationResponse{
-		AttestationReport: r,
+	err = writeAttestationResponse(cw, resp, s)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err == nil {
+		err = w.Close()
 	}
-	data, err := s.Marshal(resp)
 	if err != nil {
-		sendError(conn, s, "failed to marshal message: %v", err)
+		log.Warnf("Failed to send attestation response: %v", err)
 		return
 	}
+	if c != api.CompressionNone {
+		size, compressed := cw.Sizes()
+		log.Debugf("Prover: Compressed attestation response with %v from %v to %v bytes", c,
+			size, compressed)
+	}
+
+	log.Debug("Prover: Finished")
+}
+
+// writeAttestationResponse writes the serialized attestation response. The
+// envelope of the response is encoded around the report, so that large reports
+// are not copied into a serialized response first. The encoding is identical to
+// the encoding of the serializer
+func writeAttestationResponse(w io.Writer, resp *api.AttestationResponse,
+	s ar.Serializer) error {
+
+	if resp.DryRunSummary == nil && resp.AttestationReport != nil {
+		switch s.(type) {
+		case ar.CborSerializer:
+			// Map with the key 0 and the report as byte string
+			header := append([]byte{0xa1, 0x00}, cborByteStringHeader(len(resp.AttestationReport))...)
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			_, err := w.Write(resp.AttestationReport)
+			return err
+		case ar.JsonSerializer:
+			if _, err := io.WriteString(w, `{"attestationReport":"`); err != nil {
+				return err
+			}
+			enc := base64.NewEncoder(base64.StdEncoding, w)
+			if _, err := enc.Write(resp.AttestationReport); err != nil {
+				return err
+			}
+			if err := enc.Close(); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, `"}`)
+			return err
+		}
+	}
 
-	err = api.Send(conn, data, api.TypeAttest)
+	data, err := s.Marshal(resp)
 	if err != nil {
-		sendError(conn, s, "failed to send: %v", err)
+		return fmt.Errorf("failed to marshal message: %w", err)
 	}
+	_, err = w.Write(data)
+	return err
+}
 
-	log.Debug("Prover: Finished")
+// cborByteStringHeader returns the CBOR header of a byte string of length n
+func cborByteStringHeader(n int) []byte {
+	const majorByteString = 0x40
+	switch {
+	case n < 24:
+		return []byte{majorByteString | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{majorByteString | 24, byte(n)}
+	case n <= math.MaxUint16:
+		header := []byte{majorByteString | 25, 0, 0}
+		binary.BigEndian.PutUint16(header[1:], uint16(n))
+		return header
+	default:
+		header := []byte{majorByteString | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], uint32(n))
+		return header
+	}
 }
 
 func validate(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 
 	log.Debug("Received Connection Request Type 'Verification Request'")
+	received := time.Now()
 
 	req := new(api.VerificationRequest)
 	err := s.Unmarshal(payload, req)
@@ -173,22 +415,15 @@ func validate(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 		return
 	}
 
-	log.Debug("Verifier: Verifying Attestation Report")
-	result := verify.Verify(req.AttestationReport, req.Nonce, req.Ca, req.Policies,
-		cmc.PolicyEngineSelect, cmc.IntelStorage)
-
-	log.Debug("Verifier: Marshaling Attestation Result")
-	r, err := json.Marshal(result)
+	resp, err := verifyRequest(context.Background(), cmc, req, "socket",
+		conn.RemoteAddr().String(), received)
 	if err != nil {
-		sendError(conn, s, "Verifier: failed to marshal Attestation Result: %v", err)
+		sendError(conn, s, "Verifier: %v", err)
 		return
 	}
 
 	// Serialize payload
-	resp := api.VerificationResponse{
-		VerificationResult: r,
-	}
-	data, err := s.Marshal(&resp)
+	data, err := s.Marshal(resp)
 	if err != nil {
 		sendError(conn, s, "failed to marshal message: %v", err)
 		return
@@ -213,26 +448,14 @@ func measure(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 		return
 	}
 
-	log.Debug("Measurer: recording measurement")
-	var success bool
-	err = m.Measure(req.Name, req.ConfigSha256, req.RootfsSha256,
-		&m.MeasureConfig{
-			Serializer: cmc.Serializer,
-			Pcr:        cmc.CtrPcr,
-			LogFile:    cmc.CtrLog,
-			Driver:     cmc.CtrDriver,
-		})
+	resp, err := measureRequest(cmc, req)
 	if err != nil {
-		success = false
-	} else {
-		success = true
+		sendError(conn, s, "%v", err)
+		return
 	}
 
 	// Serialize payload
-	resp := api.MeasureResponse{
-		Success: success,
-	}
-	data, err := s.Marshal(&resp)
+	data, err := s.Marshal(resp)
 	if err != nil {
 		sendError(conn, s, "failed to marshal message: %v", err)
 		return
@@ -250,101 +473,289 @@ func tlssign(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
 
 	log.Debug("Received TLS sign request")
 
-	if len(cmc.Drivers) == 0 {
-		sendError(conn, s, "no valid signers configured")
+	// Parse the message and return the TLS signing request
+	req := new(api.TLSSignRequest)
+	err := s.Unmarshal(payload, req)
+	if err != nil {
+		sendError(conn, s, "failed to unmarshal payload: %v", err)
+		return
+	}
+
+	resp, err := tlsSignRequest(cmc, req)
+	if err != nil {
+		sendError(conn, s, "%v", err)
 		return
 	}
 
-	// Parse the message and return the TLS signing request
-	req := new(api.TLSSignRequest)
+	data, err := s.Marshal(resp)
+	if err != nil {
+		sendError(conn, s, "failed to marshal message: %v", err)
+		return
+	}
+
+	err = api.Send(conn, data, api.TypeTLSSign)
+	if err != nil {
+		sendError(conn, s, "failed to send: %v", err)
+	}
+
+	log.Debug("Performed signing")
+}
+
+func tlscert(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
+
+	log.Debug("Received TLS cert request")
+
+	// Parse the message and return the TLS certificate request
+	req := new(api.TLSCertRequest)
 	err := s.Unmarshal(payload, req)
 	if err != nil {
 		sendError(conn, s, "failed to unmarshal payload: %v", err)
 		return
 	}
 
-	// Get signing options from request
-	opts, err := api.HashToSignerOpts(req.Hashtype, req.PssOpts)
+	resp, err := tlsCertRequest(cmc, req)
+	if err != nil {
+		sendError(conn, s, "%v", err)
+		return
+	}
+
+	data, err := s.Marshal(resp)
 	if err != nil {
-		sendError(conn, s, "failed to choose requested hash function: %v", err)
+		sendError(conn, s, "failed to marshal message: %v", err)
 		return
 	}
 
-	// Get key handle from (hardware) interface
-	tlsKeyPriv, _, err := cmc.Drivers[0].GetSigningKeys()
+	err = api.Send(conn, data, api.TypeTLSCert)
+	if err != nil {
+		sendError(conn, s, "failed to send: %v", err)
+	}
+
+	log.Debug("Obtained TLS cert")
+}
+
+func status(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
+
+	log.Debug("Received status request")
+
+	req := new(api.StatusRequest)
+	err := s.Unmarshal(payload, req)
 	if err != nil {
-		sendError(conn, s, "failed to get IK: %v", err)
+		sendError(conn, s, "failed to unmarshal payload: %v", err)
 		return
 	}
+	log.Tracef("Received status request with ID %v", req.Id)
 
-	// Sign
-	log.Trace("TLSSign using opts: ", opts)
-	signature, err := tlsKeyPriv.(crypto.Signer).Sign(rand.Reader, req.Content, opts)
+	resp := &api.StatusResponse{
+		Drivers:      cmc.Status(),
+		Enrollment:   cmc.EnrollmentStatus(),
+		Metadata:     cmc.MetadataStatus(),
+		ConfigDigest: cmc.ConfigDigest(),
+	}
+	data, err := s.Marshal(resp)
 	if err != nil {
-		sendError(conn, s, "failed to sign: %v", err)
+		sendError(conn, s, "failed to marshal message: %v", err)
 		return
 	}
 
-	// Create response
-	resp := &api.TLSSignResponse{
-		SignedContent: signature,
+	err = api.Send(conn, data, api.TypeStatus)
+	if err != nil {
+		sendError(conn, s, "failed to send: %v", err)
 	}
-	data, err := s.Marshal(&resp)
+
+	log.Debug("Sent driver status")
+}
+
+func metadata(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
+
+	log.Debug("Received metadata request")
+
+	req := new(api.MetadataRequest)
+	err := s.Unmarshal(payload, req)
+	if err != nil {
+		sendError(conn, s, "failed to unmarshal payload: %v", err)
+		return
+	}
+	log.Tracef("Received metadata request with ID %v", req.Id)
+
+	resp := &api.MetadataResponse{
+		Metadata: cmc.MetadataStatus(),
+	}
+	if req.Digest != "" {
+		resp.Item, err = cmc.MetadataItem(req.Digest)
+		if err != nil {
+			sendError(conn, s, "failed to get metadata item: %v", err)
+			return
+		}
+	}
+	data, err := s.Marshal(resp)
 	if err != nil {
 		sendError(conn, s, "failed to marshal message: %v", err)
 		return
 	}
 
-	err = api.Send(conn, data, api.TypeTLSSign)
+	err = api.Send(conn, data, api.TypeMetadata)
 	if err != nil {
 		sendError(conn, s, "failed to send: %v", err)
 	}
 
-	log.Debug("Performed signing")
+	log.Debug("Sent metadata")
 }
 
-func tlscert(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
+func caches(conn net.Conn, payload []byte, s ar.Serializer) {
 
-	log.Debug("Received TLS cert request")
+	log.Debug("Received cache request")
 
-	if len(cmc.Drivers) == 0 {
-		sendError(conn, s, "no valid signers configured")
+	req := new(api.CacheRequest)
+	err := s.Unmarshal(payload, req)
+	if err != nil {
+		sendError(conn, s, "failed to unmarshal payload: %v", err)
 		return
 	}
+	log.Tracef("Received cache request with ID %v", req.Id)
 
-	// Parse the message and return the TLS signing request
-	req := new(api.TLSSignRequest)
+	switch req.Flush {
+	case "":
+	case "all":
+		log.Infof("Flushing all caches on request %v", req.Id)
+		cache.FlushAll()
+	default:
+		log.Infof("Flushing cache %v on request %v", req.Flush, req.Id)
+		if err := cache.Flush(req.Flush); err != nil {
+			sendError(conn, s, "failed to flush cache: %v", err)
+			return
+		}
+	}
+
+	data, err := s.Marshal(&api.CacheResponse{Caches: cache.Status()})
+	if err != nil {
+		sendError(conn, s, "failed to marshal message: %v", err)
+		return
+	}
+
+	err = api.Send(conn, data, api.TypeCache)
+	if err != nil {
+		sendError(conn, s, "failed to send: %v", err)
+	}
+
+	log.Debug("Sent cache status")
+}
+
+// setSocketPermissions applies the mode and group to the unix domain socket
+// file. An empty mode or group keeps the default of the listener
+func setSocketPermissions(path string, mode os.FileMode, group string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("failed to look up socket group: %w", err)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("failed to set socket group: %w", err)
+		}
+	}
+	return nil
+}
+
+// authorize checks the peer credentials of unix domain socket connections
+// against the access rule of the request type. Other connections, e.g. TCP,
+// carry no credentials and are not checked
+func authorize(conn net.Conn, reqType uint32, access *cmc.SocketAccess) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	rule := access.Rule(api.TypeToString(reqType))
+	if rule == nil {
+		return nil
+	}
+	uid, gid, err := internal.PeerCredentials(uc)
+	if err != nil {
+		return fmt.Errorf("failed to get peer credentials: %w", err)
+	}
+	if !rule.Allows(uid, gid) {
+		return fmt.Errorf("peer with uid %v and gid %v not authorized", uid, gid)
+	}
+	return nil
+}
+
+func peercache(conn net.Conn, payload []byte, s ar.Serializer) {
+
+	log.Debug("Received peer cache request")
+
+	req := new(api.PeerCacheRequest)
 	err := s.Unmarshal(payload, req)
 	if err != nil {
 		sendError(conn, s, "failed to unmarshal payload: %v", err)
 		return
 	}
-	// TODO ID is currently not used
-	log.Tracef("Received TLS cert request with ID %v", req.Id)
 
-	// Retrieve certificates
-	certChain, err := cmc.Drivers[0].GetCertChain()
+	data, err := s.Marshal(peerCacheRequest(req))
+	if err != nil {
+		sendError(conn, s, "failed to marshal message: %v", err)
+		return
+	}
+
+	err = api.Send(conn, data, api.TypePeerCache)
+	if err != nil {
+		sendError(conn, s, "failed to send: %v", err)
+	}
+
+	log.Debug("Sent peer cache response")
+}
+
+func nonce(conn net.Conn, payload []byte, cmc *cmc.Cmc, s ar.Serializer) {
+
+	log.Debug("Received nonce request")
+
+	req := new(api.NonceRequest)
+	err := s.Unmarshal(payload, req)
 	if err != nil {
-		sendError(conn, s, "failed to get certchain: %v", err)
+		sendError(conn, s, "failed to unmarshal payload: %v", err)
 		return
 	}
 
-	// Create response
-	resp := &api.TLSCertResponse{
-		Certificate: internal.WriteCertsPem(certChain),
+	resp, err := nonceRequest(cmc, req)
+	if err != nil {
+		sendError(conn, s, "%v", err)
+		return
 	}
-	data, err := s.Marshal(&resp)
+
+	data, err := s.Marshal(resp)
 	if err != nil {
 		sendError(conn, s, "failed to marshal message: %v", err)
 		return
 	}
 
-	err = api.Send(conn, data, api.TypeTLSCert)
+	err = api.Send(conn, data, api.TypeNonce)
 	if err != nil {
 		sendError(conn, s, "failed to send: %v", err)
 	}
 
-	log.Debug("Obtained TLS cert")
+	log.Debug("Sent nonce")
+}
+
+// sendVersionError rejects a request of an unsupported protocol version. The
+// error response is sent with version 1, which all clients understand, and
+// with the serialization of the request if it can be detected
+func sendVersionError(conn net.Conn, payload []byte, v api.Version) {
+	s, err := detectSerialization(payload)
+	if err != nil {
+		s = ar.CborSerializer{}
+	}
+	resp := api.NewVersionError(v)
+	log.Warn(resp.Msg)
+	data, err := s.Marshal(resp)
+	if err != nil {
+		log.Warnf("Failed to marshal error response: %v", err)
+		return
+	}
+	if err := api.Send(conn, data, api.TypeError); err != nil {
+		log.Warnf("Failed to send error response: %v", err)
+	}
 }
 
 func sendError(conn net.Conn, s ar.Serializer, format string, args ...interface{}) error {
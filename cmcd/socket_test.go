@@ -0,0 +1,932 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	m "github.com/Fraunhofer-AISEC/cmc/measure"
+)
+
+func TestRuntimeMeasurements(t *testing.T) {
+	c, f := newLeakCmc(t)
+	c.RuntimeLog = m.NewRuntimeLog()
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	request := func(reqType uint32, req, resp any) uint32 {
+		t.Helper()
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+		payload, err := cbor.Marshal(req)
+		if err != nil {
+			t.Fatalf("failed to marshal request: %v", err)
+		}
+		if err := api.Send(conn, payload, reqType); err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		payload, respType, err := api.Receive(conn)
+		if err != nil {
+			t.Fatalf("failed to receive response: %v", err)
+		}
+		if respType == reqType {
+			if err := cbor.Unmarshal(payload, resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+		}
+		return respType
+	}
+
+	// Record two measurements, the response returns the length of the list
+	digest := sha256.Sum256([]byte("stage 1"))
+	events := []api.MeasureRequest{
+		{Name: "init", Hashtype: api.HashFunction_SHA256, Digest: digest[:],
+			EventData: []byte("stage 1")},
+		{Name: "engine", Hashtype: api.HashFunction_SHA384, Digest: make([]byte, 48)},
+	}
+	for i, e := range events {
+		var resp api.MeasureResponse
+		if typ := request(api.TypeMeasure, &e, &resp); typ != api.TypeMeasure {
+			t.Fatalf("measure request failed with response type %v", typ)
+		}
+		if !resp.Success || resp.Length != i+1 {
+			t.Fatalf("measure response = %+v, want length %v", resp, i+1)
+		}
+	}
+
+	// Digests not matching the declared algorithm are rejected
+	invalid := api.MeasureRequest{Name: "invalid", Hashtype: api.HashFunction_SHA512,
+		Digest: make([]byte, 32)}
+	if typ := request(api.TypeMeasure, &invalid, nil); typ != api.TypeError {
+		t.Fatalf("invalid measure request returned response type %v", typ)
+	}
+
+	var attestResp api.AttestationResponse
+	request(api.TypeAttest, &api.AttestationRequest{Nonce: f.Nonce}, &attestResp)
+	var verifyResp api.VerificationResponse
+	request(api.TypeVerify, &api.VerificationRequest{
+		Nonce:             f.Nonce,
+		AttestationReport: attestResp.AttestationReport,
+		Ca:                f.CaPem(),
+	}, &verifyResp)
+
+	var result ar.VerificationResult
+	if err := json.Unmarshal(verifyResp.VerificationResult, &result); err != nil {
+		t.Fatalf("failed to unmarshal verification result: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("verification failed")
+	}
+	var runtime *ar.RuntimeResult
+	for _, mr := range result.Measurements {
+		if mr.RuntimeResult != nil {
+			runtime = mr.RuntimeResult
+		}
+	}
+	if runtime == nil || len(runtime.Events) != len(events) {
+		t.Fatalf("verification result does not contain the runtime measurements")
+	}
+	for i, e := range runtime.Events {
+		if e.Index != i || e.Name != events[i].Name ||
+			string(e.EventData) != string(events[i].EventData) {
+			t.Errorf("runtime measurement %v = %+v", i, e)
+		}
+	}
+	if runtime.Events[1].HashAlg != "SHA-384" {
+		t.Errorf("hash algorithm = %v, want SHA-384", runtime.Events[1].HashAlg)
+	}
+}
+
+func Test_writeAttestationResponse(t *testing.T) {
+	for _, s := range []ar.Serializer{ar.CborSerializer{}, ar.JsonSerializer{}} {
+		for _, n := range []int{0, 23, 24, 255, 256, 65535, 65536, 300 * 1024} {
+			report := bytes.Repeat([]byte{0xaa}, n)
+			for _, resp := range []*api.AttestationResponse{
+				{AttestationReport: report},
+				{AttestationReport: report, DryRunSummary: []byte(`{"drivers":[]}`)},
+			} {
+				want, err := s.Marshal(resp)
+				if err != nil {
+					t.Fatalf("failed to marshal response: %v", err)
+				}
+				var buf bytes.Buffer
+				if err := writeAttestationResponse(&buf, resp, s); err != nil {
+					t.Fatalf("writeAttestationResponse() error = %v", err)
+				}
+				if !bytes.Equal(buf.Bytes(), want) {
+					t.Errorf("writeAttestationResponse() with %T and report length %v differs "+
+						"from serializer", s, n)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkedAttestation(t *testing.T) {
+	c, f := newLeakCmc(t)
+	c.SocketChunkSize = 1024
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+	if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	// The first chunk is announced to be followed by further chunks
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if n := binary.BigEndian.Uint32(header[0:4]); n != 1024 {
+		t.Fatalf("chunk length = %v, want 1024", n)
+	}
+	if typ := binary.BigEndian.Uint32(header[4:8]); typ != api.TypeAttest|api.FlagMoreChunks {
+		t.Fatalf("chunk type = %x, want %x", typ, api.TypeAttest|api.FlagMoreChunks)
+	}
+	first := make([]byte, 1024)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		t.Fatalf("failed to read chunk: %v", err)
+	}
+	rest, typ, err := api.Receive(conn)
+	if err != nil || typ != api.TypeAttest {
+		t.Fatalf("failed to receive remaining chunks: type %v, %v", typ, err)
+	}
+
+	var resp api.AttestationResponse
+	if err := cbor.Unmarshal(append(first, rest...), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	result, err := verifyRequest(context.Background(), c, &api.VerificationRequest{
+		Nonce:             f.Nonce,
+		AttestationReport: resp.AttestationReport,
+		Ca:                f.CaPem(),
+	}, "socket", "test", time.Now())
+	if err != nil {
+		t.Fatalf("verifyRequest() error = %v", err)
+	}
+	var r ar.VerificationResult
+	if err := json.Unmarshal(result.VerificationResult, &r); err != nil || !r.Success {
+		t.Fatalf("verification of the reassembled report failed: %v", err)
+	}
+}
+
+// teeConn is a connection recording the received data
+type teeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *teeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestCompressedAttestation(t *testing.T) {
+	c, f := newLeakCmc(t)
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	tests := []struct {
+		name     string
+		accepted []api.Compression
+	}{
+		{"Old Client", nil},
+		{"Gzip", []api.Compression{api.CompressionGzip}},
+		{"Zstd Preferred", []api.Compression{api.CompressionZstd, api.CompressionGzip}},
+		{"Unsupported", []api.Compression{0xf}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce,
+				Compression: tt.accepted})
+			if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+
+			var raw bytes.Buffer
+			data, typ, err := api.Receive(&teeConn{Conn: conn, r: io.TeeReader(conn, &raw)})
+			if err != nil || typ != api.TypeAttest {
+				t.Fatalf("failed to receive response: type %v, %v", typ, err)
+			}
+
+			// The header signals the selected compression, old clients and
+			// clients without supported algorithms receive uncompressed data
+			want := api.WithCompression(api.TypeAttest, api.SelectCompression(tt.accepted))
+			if got := binary.BigEndian.Uint32(raw.Bytes()[4:8]); got != want {
+				t.Errorf("response type = %x, want %x", got, want)
+			}
+			if tt.accepted == nil && raw.Len() != len(data)+8 {
+				t.Errorf("old client received %v bytes for %v byte response", raw.Len(),
+					len(data))
+			}
+
+			var resp api.AttestationResponse
+			if err := cbor.Unmarshal(data, &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			result, err := verifyRequest(context.Background(), c, &api.VerificationRequest{
+				Nonce:             f.Nonce,
+				AttestationReport: resp.AttestationReport,
+				Ca:                f.CaPem(),
+			}, "socket", "test", time.Now())
+			if err != nil {
+				t.Fatalf("verifyRequest() error = %v", err)
+			}
+			var r ar.VerificationResult
+			if err := json.Unmarshal(result.VerificationResult, &r); err != nil || !r.Success {
+				t.Fatalf("verification of the decompressed report failed: %v", err)
+			}
+		})
+	}
+}
+
+// waitConns waits until the server accepted n connections
+func waitConns(t *testing.T, s *SocketServer, n int) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		s.mu.Lock()
+		accepted := len(s.conns)
+		s.mu.Unlock()
+		if accepted == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not accept %v connections", n)
+}
+
+func TestSocketShutdown(t *testing.T) {
+	c, _ := newLeakCmc(t)
+	c.Network = "unix"
+	c.RuntimeLog = m.NewRuntimeLog()
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	s := &SocketServer{}
+	done := make(chan error)
+	go func() { done <- s.Serve(addr, c) }()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 500; i++ {
+		if conn, err = net.Dial("unix", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	waitConns(t, s, 1)
+
+	// Start a request, which is still in flight when the server is terminated
+	digest := sha256.Sum256([]byte("stage 1"))
+	payload, _ := cbor.Marshal(&api.MeasureRequest{Name: "init",
+		Hashtype: api.HashFunction_SHA256, Digest: digest[:]})
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], api.TypeMeasure)
+	frame = append(frame, payload...)
+	if _, err := conn.Write(frame[:10]); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	stopped := make(chan error, 1)
+	stop := handleSignals(c, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		stopped <- s.Shutdown(ctx)
+	})
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+
+	// New connections are refused once the listener is closed
+	for i := 0; ; i++ {
+		probe, err := net.Dial("unix", addr)
+		if err != nil {
+			break
+		}
+		probe.Close()
+		if i == 500 {
+			t.Fatalf("server still accepts connections after SIGTERM")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The request in flight is completed
+	if _, err := conn.Write(frame[10:]); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	resp, typ, err := api.Receive(conn)
+	if err != nil || typ != api.TypeMeasure {
+		t.Fatalf("failed to receive response: type %v, %v", typ, err)
+	}
+	var measureResp api.MeasureResponse
+	if err := cbor.Unmarshal(resp, &measureResp); err != nil || !measureResp.Success {
+		t.Fatalf("measure request failed: %+v, %v", measureResp, err)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := os.Stat(addr); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+}
+
+func TestSocketShutdownTimeout(t *testing.T) {
+	c, _ := newLeakCmc(t)
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "cmcd.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &SocketServer{}
+	done := make(chan error)
+	go func() { done <- s.serve(l, c) }()
+
+	// A client which never completes its request must not block the shutdown
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	waitConns(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection not closed after shutdown timeout")
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	c, _ := newLeakCmc(t)
+	c.Network = "unix"
+	c.SocketMode = 0600
+	c.SocketGroup = strconv.Itoa(os.Getgid())
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	s := &SocketServer{}
+	done := make(chan error)
+	go func() { done <- s.Serve(addr, c) }()
+	waitListener(t, s)
+	defer func() {
+		s.Shutdown(context.Background())
+		<-done
+	}()
+
+	info, err := os.Stat(addr)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if gid := info.Sys().(*syscall.Stat_t).Gid; int(gid) != os.Getgid() {
+		t.Errorf("socket group = %v, want %v", gid, os.Getgid())
+	}
+}
+
+func TestSocketAccess(t *testing.T) {
+	c, _ := newLeakCmc(t)
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	c.SocketAccess = &cmc.SocketAccess{
+		Default: &cmc.PeerRule{Uids: []uint32{uid + 1}},
+		Requests: map[string]cmc.PeerRule{
+			"attest":  {Uids: []uint32{uid + 1}, Gids: []uint32{gid}},
+			"TLSCert": {Uids: []uint32{uid}},
+			"TLSSign": {Uids: []uint32{uid + 1}, Gids: []uint32{gid + 1}},
+		},
+	}
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	tests := []struct {
+		name    string
+		reqType uint32
+		req     any
+		want    bool
+	}{
+		{"Allowed Group", api.TypeAttest, &api.AttestationRequest{Nonce: make([]byte, 8)}, true},
+		{"Allowed User", api.TypeTLSCert, &api.TLSCertRequest{}, true},
+		{"Denied", api.TypeTLSSign, &api.TLSSignRequest{Content: make([]byte, 32),
+			Hashtype: api.HashFunction_SHA256}, false},
+		{"Denied By Default", api.TypeStatus, &api.StatusRequest{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			payload, _ := cbor.Marshal(tt.req)
+			if err := api.Send(conn, payload, tt.reqType); err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp, typ, err := api.Receive(conn)
+			if err != nil {
+				t.Fatalf("failed to receive response: %v", err)
+			}
+			if tt.want {
+				if typ != tt.reqType {
+					t.Fatalf("response type = %v, want %v", typ, tt.reqType)
+				}
+				return
+			}
+			var socketErr api.SocketError
+			if typ != api.TypeError || cbor.Unmarshal(resp, &socketErr) != nil {
+				t.Fatalf("response type = %v, want error response", typ)
+			}
+			if !strings.Contains(socketErr.Msg, "request denied") {
+				t.Errorf("error message = %q, want denied request", socketErr.Msg)
+			}
+		})
+	}
+}
+
+func TestSocketVersion(t *testing.T) {
+	c, _ := newLeakCmc(t)
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	req, _ := cbor.Marshal(&api.TLSCertRequest{})
+	tests := []struct {
+		name    string
+		reqType uint32
+		payload []byte
+		want    uint32
+	}{
+		// Clients predating the version field send the type without version bits
+		{"Legacy Client", api.TypeTLSCert, req, api.TypeTLSCert},
+		{"Matching Version", api.WithVersion(api.TypeTLSCert, api.Version1), req,
+			api.TypeTLSCert},
+		// The payload of later versions must not be decoded
+		{"Newer Client", api.WithVersion(api.TypeTLSCert, api.MaxVersion+1),
+			[]byte("\xff\x00 structure of a later version"), api.TypeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			if err := api.Send(conn, tt.payload, tt.reqType); err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+
+			// Responses are sent in the original wire format, which clients
+			// predating the version field understand
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Fatalf("failed to read header: %v", err)
+			}
+			if typ := binary.BigEndian.Uint32(header[4:8]); typ != tt.want {
+				t.Fatalf("response type = %x, want %x", typ, tt.want)
+			}
+			resp := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatalf("failed to read payload: %v", err)
+			}
+			if tt.want != api.TypeError {
+				return
+			}
+
+			var socketErr api.SocketError
+			if err := cbor.Unmarshal(resp, &socketErr); err != nil {
+				t.Fatalf("failed to unmarshal error response: %v", err)
+			}
+			if socketErr.MinVersion != api.MinVersion || socketErr.MaxVersion != api.MaxVersion {
+				t.Errorf("supported versions %v..%v, want %v..%v", socketErr.MinVersion,
+					socketErr.MaxVersion, api.MinVersion, api.MaxVersion)
+			}
+			var verr *api.VersionError
+			if err := api.ResponseError(&socketErr, api.MaxVersion+1); !errors.As(err, &verr) {
+				t.Errorf("ResponseError() = %v, want version error", err)
+			}
+		})
+	}
+}
+
+// waitListener waits until the server listens
+func waitListener(t *testing.T, s *SocketServer) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		s.mu.Lock()
+		l := s.listener
+		s.mu.Unlock()
+		if l != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server does not listen")
+}
+
+// slowDriver blocks the measurements until they are released and records the
+// peak number of concurrent measurements
+type slowDriver struct {
+	ar.Driver
+	entered chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	active  int
+	peak    int
+}
+
+func (d *slowDriver) Measure(nonce []byte) (ar.Measurement, error) {
+	d.mu.Lock()
+	d.active++
+	if d.active > d.peak {
+		d.peak = d.active
+	}
+	d.mu.Unlock()
+	d.entered <- struct{}{}
+	<-d.release
+	d.mu.Lock()
+	d.active--
+	d.mu.Unlock()
+	return d.Driver.Measure(nonce)
+}
+
+func TestSocketConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		wantBusy int
+	}{
+		{"Rejected", 50 * time.Millisecond, 2},
+		{"Queued", 10 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, f := newLeakCmc(t)
+			d := &slowDriver{Driver: f, entered: make(chan struct{}, 4),
+				release: make(chan struct{})}
+			c.Drivers = []ar.Driver{d}
+			c.MaxConcurrentRequests = 1
+			c.RequestQueueTimeout = tt.timeout
+
+			addr := filepath.Join(t.TempDir(), "cmcd.sock")
+			l, err := net.Listen("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			done := make(chan error)
+			go func() { done <- serveSocket(l, c) }()
+			defer func() {
+				l.Close()
+				<-done
+			}()
+
+			// Fire more simultaneous requests than the limit
+			results := make(chan uint32, 3)
+			for i := 0; i < 3; i++ {
+				go func() {
+					conn, err := net.Dial("unix", addr)
+					if err != nil {
+						results <- 0
+						return
+					}
+					defer conn.Close()
+					payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+					if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+						results <- 0
+						return
+					}
+					_, typ, err := api.Receive(conn)
+					if err != nil {
+						results <- 0
+						return
+					}
+					results <- typ
+				}()
+			}
+
+			busy := 0
+			for served := 0; served+busy < 3; {
+				select {
+				case <-d.entered:
+					// Each measurement takes longer than the queue timeout of the
+					// rejected case
+					time.AfterFunc(200*time.Millisecond, func() { d.release <- struct{}{} })
+				case typ := <-results:
+					switch typ {
+					case api.TypeAttest:
+						served++
+					case api.TypeError:
+						busy++
+					default:
+						t.Fatalf("request failed with response type %v", typ)
+					}
+				case <-time.After(20 * time.Second):
+					t.Fatalf("requests did not complete")
+				}
+			}
+			if busy != tt.wantBusy {
+				t.Errorf("%v requests rejected as busy, want %v", busy, tt.wantBusy)
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.peak > 1 {
+				t.Errorf("%v concurrent measurements, want at most 1", d.peak)
+			}
+		})
+	}
+}
+
+func TestSocketBurstLimit(t *testing.T) {
+	const limit = 2
+	const clients = 8
+
+	c, f := newLeakCmc(t)
+	c.MaxConcurrentRequests = limit
+	c.RequestQueueTimeout = 10 * time.Second
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := new(SocketServer)
+	done := make(chan error)
+	go func() { done <- s.serve(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+	waitListener(t, s)
+
+	// Record the peak number of requests handled concurrently
+	stop := make(chan struct{})
+	peak := make(chan int64)
+	go func() {
+		max := int64(0)
+		for {
+			if n := inFlight.Value(); n > max {
+				max = n
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	// Half of the clients send their request late, while the others are queued
+	// for the slots
+	payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+	results := make(chan uint32, clients)
+	for i := 0; i < clients; i++ {
+		go func(slow bool) {
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				results <- 0
+				return
+			}
+			defer conn.Close()
+			if slow {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+				results <- 0
+				return
+			}
+			_, typ, err := api.Receive(conn)
+			if err != nil {
+				results <- 0
+				return
+			}
+			results <- typ
+		}(i%2 == 0)
+	}
+
+	for i := 0; i < clients; i++ {
+		select {
+		case typ := <-results:
+			if typ != api.TypeAttest {
+				t.Errorf("request failed with response type %v", typ)
+			}
+		case <-time.After(20 * time.Second):
+			t.Fatalf("requests did not complete")
+		}
+	}
+	close(stop)
+	if got := <-peak; got > limit {
+		t.Errorf("%v handlers in flight, want at most %v", got, limit)
+	}
+}
+
+func TestSocketIdleClientsDoNotStarve(t *testing.T) {
+	c, f := newLeakCmc(t)
+	c.MaxConcurrentRequests = 1
+	c.RequestQueueTimeout = 100 * time.Millisecond
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	// Clients which do not send their request must not occupy the slot
+	for i := 0; i < 4; i++ {
+		idle, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer idle.Close()
+	}
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+	if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	_, typ, err := api.Receive(conn)
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if typ != api.TypeAttest {
+		t.Fatalf("response type = %v, want %v", typ, api.TypeAttest)
+	}
+}
+
+func TestSocketBusyJson(t *testing.T) {
+	c, f := newLeakCmc(t)
+	d := &slowDriver{Driver: f, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	c.Drivers = []ar.Driver{d}
+	c.MaxConcurrentRequests = 1
+	c.RequestQueueTimeout = 50 * time.Millisecond
+
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- serveSocket(l, c) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	// The first request holds the only slot until it is released
+	first, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer first.Close()
+	payload, _ := cbor.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+	if err := api.Send(first, payload, api.TypeAttest); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	<-d.entered
+	defer close(d.release)
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	payload, _ = json.Marshal(&api.AttestationRequest{Nonce: f.Nonce})
+	if err := api.Send(conn, payload, api.TypeAttest); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	resp, typ, err := api.Receive(conn)
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if typ != api.TypeError {
+		t.Fatalf("response type = %v, want %v", typ, api.TypeError)
+	}
+
+	// The busy response is sent in the serialization of the request
+	var socketErr api.SocketError
+	if err := json.Unmarshal(resp, &socketErr); err != nil {
+		t.Fatalf("failed to unmarshal error response: %v", err)
+	}
+	if !strings.HasPrefix(socketErr.Msg, "server busy") {
+		t.Errorf("error = %q, want server busy", socketErr.Msg)
+	}
+}
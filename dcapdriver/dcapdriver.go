@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dcapdriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/plugindriver"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "dcapdriver")
+
+const (
+	defaultTimeout = 10 * time.Second
+)
+
+// Dcap is a driver for Intel SGX DCAP quotes of enclaves running on the
+// platform. The enclave, or its host application, serves the measure request
+// of the plugin protocol on a unix domain socket (see plugindriver.Serve) and
+// returns an ECDSA quote with the nonce as report data together with the TCB
+// info issuer chain. The driver only provides measurements
+type Dcap struct {
+	socket  string
+	timeout time.Duration
+}
+
+// Init initializes the DCAP driver with the specifified configuration
+func (d *Dcap) Init(c *ar.DriverConfig) error {
+
+	if d == nil {
+		return errors.New("internal error: DCAP object is nil")
+	}
+
+	if c.DcapSocket == "" {
+		return errors.New("no DCAP enclave socket configured")
+	}
+
+	d.socket = c.DcapSocket
+	d.timeout = defaultTimeout
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (d *Dcap) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting SGX DCAP measurements")
+
+	if d == nil {
+		return ar.Measurement{}, errors.New("internal error: DCAP object is nil")
+	}
+	if len(nonce) > 64 {
+		return ar.Measurement{}, errors.New("user Data must be at most 64 bytes")
+	}
+
+	resp, err := plugindriver.MeasureRequest(d.socket, d.timeout, nonce)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get SGX quote from enclave: %w", err)
+	}
+	if resp.Type != "SGX Measurement" {
+		return ar.Measurement{}, fmt.Errorf("enclave %v returned unexpected type %q",
+			d.socket, resp.Type)
+	}
+
+	if err := checkQuote(resp.Evidence, nonce); err != nil {
+		return ar.Measurement{}, fmt.Errorf("enclave %v returned invalid quote: %w",
+			d.socket, err)
+	}
+
+	// The verifier expects the TCB signing certificate and the Intel root CA,
+	// whereas the PCK certificate chain is contained in the quote
+	certs, err := internal.ParseCertsDer(resp.Certs)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to parse TCB info issuer chain: %w", err)
+	}
+
+	log.Debugf("Retrieved SGX quote from enclave %v", d.socket)
+
+	return ar.Measurement{
+		Type:     "SGX Measurement",
+		Evidence: resp.Evidence,
+		Certs:    internal.WriteCertsPem(certs),
+	}, nil
+}
+
+// Roles implements the attestation report RoleProvider interface, the driver
+// can only be used for measurements
+func (d *Dcap) Roles() ar.DriverRoles {
+	return ar.DriverRoles{Measurer: true}
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (d *Dcap) Lock() error {
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (d *Dcap) Unlock() error {
+	return nil
+}
+
+// GetSigningKeys is not supported, as the enclave does not provide a signing key
+func (d *Dcap) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return nil, nil, errors.New("DCAP driver does not provide signing keys")
+}
+
+// GetCertChain is not supported, as the enclave does not provide a signing key
+func (d *Dcap) GetCertChain() ([]*x509.Certificate, error) {
+	return nil, errors.New("DCAP driver does not provide signing keys")
+}
+
+// checkQuote checks that the quote is an SGX quote and that the enclave bound
+// the nonce into the report data, so that an enclave returning stale quotes
+// is detected on the prover already. The quote itself is verified by the verifier
+func checkQuote(quote, nonce []byte) error {
+
+	if len(quote) < verify.SGX_QUOTE_MIN_SIZE {
+		return fmt.Errorf("quote size %v below minimum size %v", len(quote),
+			verify.SGX_QUOTE_MIN_SIZE)
+	}
+
+	var header verify.QuoteHeader
+	var body verify.EnclaveReportBody
+	buf := bytes.NewReader(quote)
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("failed to decode quote header: %w", err)
+	}
+	if header.TeeType != verify.SGX_QUOTE_TYPE {
+		return fmt.Errorf("unexpected TEE type 0x%x", header.TeeType)
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &body); err != nil {
+		return fmt.Errorf("failed to decode enclave report: %w", err)
+	}
+
+	reportData := make([]byte, 64)
+	copy(reportData, nonce)
+	if !bytes.Equal(body.ReportData[:], reportData) {
+		return fmt.Errorf("report data %v does not match nonce %v",
+			hex.EncodeToString(body.ReportData[:]), hex.EncodeToString(nonce))
+	}
+
+	return nil
+}
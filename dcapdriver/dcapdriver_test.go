@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dcapdriver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/plugindriver"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// testEnclave returns a quote over the nonce, or over the configured report
+// data if set, along with the TCB info issuer chain
+type testEnclave struct {
+	typ        string
+	teeType    uint32
+	reportData []byte
+	size       int
+	certs      [][]byte
+}
+
+func (e *testEnclave) Measure(nonce []byte) (string, []byte, [][]byte, error) {
+	reportData := nonce
+	if e.reportData != nil {
+		reportData = e.reportData
+	}
+	return e.typ, createQuote(e.teeType, reportData, e.size), e.certs, nil
+}
+
+// createQuote creates an SGX quote consisting of the header and the enclave
+// report with the report data, padded with zeros to the size
+func createQuote(teeType uint32, reportData []byte, size int) []byte {
+	header := verify.QuoteHeader{Version: 3, AttestationKeyType: 2, TeeType: teeType}
+	var body verify.EnclaveReportBody
+	copy(body.ReportData[:], reportData)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, header)
+	binary.Write(buf, binary.LittleEndian, body)
+	quote := make([]byte, size)
+	copy(quote, buf.Bytes())
+	return quote
+}
+
+func createCert(t *testing.T, cn string) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestDcapMeasure(t *testing.T) {
+
+	chain := []*x509.Certificate{
+		createCert(t, "Intel SGX TCB Signing"),
+		createCert(t, "Intel SGX Root CA"),
+	}
+	certs := internal.WriteCertsDer(chain)
+	nonce := []byte{0x01, 0x02, 0x03, 0x04}
+
+	tests := []struct {
+		name    string
+		enclave *testEnclave
+		wantErr bool
+	}{
+		{"Valid Quote", &testEnclave{typ: "SGX Measurement", size: verify.SGX_QUOTE_MIN_SIZE,
+			certs: certs}, false},
+		{"Stale Quote", &testEnclave{typ: "SGX Measurement", reportData: []byte{0xff},
+			size: verify.SGX_QUOTE_MIN_SIZE, certs: certs}, true},
+		{"Wrong Type", &testEnclave{typ: "TDX Measurement", size: verify.SGX_QUOTE_MIN_SIZE,
+			certs: certs}, true},
+		{"Wrong TEE Type", &testEnclave{typ: "SGX Measurement", teeType: 0x81,
+			size: verify.SGX_QUOTE_MIN_SIZE, certs: certs}, true},
+		{"Short Quote", &testEnclave{typ: "SGX Measurement", size: 432, certs: certs}, true},
+		{"Missing Certs", &testEnclave{typ: "SGX Measurement",
+			size: verify.SGX_QUOTE_MIN_SIZE}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "enclave.sock")
+			l, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer l.Close()
+			go plugindriver.Serve(l, "com.example", "enclave", tt.enclave)
+
+			d := &Dcap{}
+			if err := d.Init(&ar.DriverConfig{DcapSocket: socket}); err != nil {
+				t.Fatalf("Init() error = %v", err)
+			}
+
+			got, err := d.Measure(nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Measure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Type != "SGX Measurement" {
+				t.Errorf("Measure() type = %v, want SGX Measurement", got.Type)
+			}
+			parsed, err := internal.ParseCertsPem(got.Certs)
+			if err != nil || len(parsed) != len(chain) {
+				t.Errorf("Measure() returned invalid certs: %v", err)
+			}
+		})
+	}
+}
+
+func TestDcapInit(t *testing.T) {
+	d := &Dcap{}
+	if err := d.Init(&ar.DriverConfig{}); err == nil {
+		t.Fatalf("Init() succeeded without socket")
+	}
+	if _, _, err := d.GetSigningKeys(); err == nil {
+		t.Errorf("GetSigningKeys() succeeded")
+	}
+	if r := d.Roles(); !r.Measurer || r.Signer {
+		t.Errorf("Roles() = %+v, want measurer only", r)
+	}
+}
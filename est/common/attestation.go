@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+)
+
+// Length of the server nonces for attested enrollments
+const AttestationNonceLength = 32
+
+// AttestationNonce returns the nonce the attestation report of an attested
+// enrollment must be created for. The nonce binds the report to the fresh
+// nonce of the server and to the public key of the CSR
+func AttestationNonce(serverNonce []byte, csr *x509.CertificateRequest) []byte {
+	h := sha256.New()
+	h.Write(serverNonce)
+	h.Write(csr.RawSubjectPublicKeyInfo)
+	return h.Sum(nil)
+}
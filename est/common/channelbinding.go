@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Channel binding types [RFC5929, RFC9266]. TLS 1.3 does not define tls-unique,
+// therefore the tls-exporter channel binding is used for TLS 1.3 connections
+const (
+	ChannelBindingTlsUnique   = "tls-unique"
+	ChannelBindingTlsExporter = "tls-exporter"
+
+	// Exporter label and length of the tls-exporter channel binding [RFC9266]
+	channelBindingExporterLabel  = "EXPORTER-Channel-Binding"
+	channelBindingExporterLength = 32
+)
+
+// OID of the PKCS#9 challengePassword attribute, which contains the channel
+// binding [RFC7030 3.5]
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// GetChannelBinding returns the channel binding of the TLS connection in the
+// format <type>:<base64 value>. For TLS 1.2, the tls-unique value is used [RFC7030
+// 3.5], for TLS 1.3 the tls-exporter value [RFC9266]
+func GetChannelBinding(cs *tls.ConnectionState) (string, error) {
+
+	if cs == nil {
+		return "", errors.New("no TLS connection")
+	}
+
+	var cbType string
+	var value []byte
+	switch cs.Version {
+	case tls.VersionTLS13:
+		var err error
+		cbType = ChannelBindingTlsExporter
+		value, err = cs.ExportKeyingMaterial(channelBindingExporterLabel, nil,
+			channelBindingExporterLength)
+		if err != nil {
+			return "", fmt.Errorf("failed to export keying material: %w", err)
+		}
+	case tls.VersionTLS12:
+		cbType = ChannelBindingTlsUnique
+		value = cs.TLSUnique
+		if len(value) == 0 {
+			return "", errors.New("tls-unique not available for TLS connection")
+		}
+	default:
+		return "", fmt.Errorf("channel binding not supported for TLS version %x", cs.Version)
+	}
+
+	return cbType + ":" + base64.StdEncoding.EncodeToString(value), nil
+}
+
+// AddChannelBinding adds the challengePassword attribute containing the specified
+// channel binding to the CSR and signs the CSR again with the key
+func AddChannelBinding(csr *x509.CertificateRequest, priv crypto.PrivateKey, binding string,
+) (*x509.CertificateRequest, error) {
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key does not implement crypto.Signer")
+	}
+
+	value, err := asn1.MarshalWithParams(binding, "utf8")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal challengePassword: %w", err)
+	}
+
+	der, err := addCsrAttribute(csr.Raw, signer, oidChallengePassword, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add challengePassword attribute: %w", err)
+	}
+
+	bound, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse created CSR: %w", err)
+	}
+
+	return bound, nil
+}
+
+// VerifyChannelBinding verifies that the channel binding contained in the CSR
+// matches the TLS connection the CSR was received over. CSRs without channel
+// binding are only accepted if required is false. A challengePassword without
+// type is interpreted as tls-unique value as specified in [RFC7030 3.5]
+func VerifyChannelBinding(csr *x509.CertificateRequest, cs *tls.ConnectionState, required bool,
+) error {
+
+	value, err := getCsrAttribute(csr, oidChallengePassword)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if required {
+			return errors.New("CSR does not contain channel binding")
+		}
+		return nil
+	}
+
+	var binding string
+	if rest, err := asn1.Unmarshal(value, &binding); err != nil || len(rest) > 0 {
+		return errors.New("failed to unmarshal challengePassword")
+	}
+	cbType, encoded, found := strings.Cut(binding, ":")
+	if !found {
+		cbType, encoded = ChannelBindingTlsUnique, binding
+	}
+	received, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to decode %v channel binding: %w", cbType, err)
+	}
+
+	expected, err := GetChannelBinding(cs)
+	if err != nil {
+		return fmt.Errorf("failed to get channel binding of TLS connection: %w", err)
+	}
+	expectedType, expectedEncoded, _ := strings.Cut(expected, ":")
+	if cbType != expectedType {
+		return fmt.Errorf("CSR contains %v channel binding, but TLS connection requires %v",
+			cbType, expectedType)
+	}
+	expectedValue, _ := base64.StdEncoding.DecodeString(expectedEncoded)
+	if subtle.ConstantTimeCompare(received, expectedValue) != 1 {
+		return fmt.Errorf("%v channel binding of CSR does not match TLS connection", cbType)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshake performs a TLS handshake with the specified version and returns the
+// connection states of the client and the server
+func handshake(t *testing.T, version uint16) (tls.ConnectionState, tls.ConnectionState) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	c, s := net.Pipe()
+	server := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   version,
+		MaxVersion:   version,
+	})
+	client := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	defer s.Close()
+	defer c.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+
+	return client.ConnectionState(), server.ConnectionState()
+}
+
+func TestChannelBinding(t *testing.T) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr := createTestCsr(t, "device", nil)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		RawSubject: csr.RawSubject,
+	}, key)
+	csr, _ = x509.ParseCertificateRequest(der)
+
+	client12, server12 := handshake(t, tls.VersionTLS12)
+	client13, server13 := handshake(t, tls.VersionTLS13)
+	other13, _ := handshake(t, tls.VersionTLS13)
+
+	binding := func(cs tls.ConnectionState) string {
+		b, err := GetChannelBinding(&cs)
+		if err != nil {
+			t.Fatalf("GetChannelBinding() error = %v", err)
+		}
+		return b
+	}
+	exporter := strings.TrimPrefix(binding(client13), ChannelBindingTlsExporter+":")
+
+	tests := []struct {
+		name     string
+		binding  string
+		server   tls.ConnectionState
+		required bool
+		wantErr  string
+	}{
+		{"TLS 1.2", binding(client12), server12, true, ""},
+		{"TLS 1.3", binding(client13), server13, true, ""},
+		{"TLS 1.2 Untyped", strings.TrimPrefix(binding(client12), ChannelBindingTlsUnique+":"),
+			server12, true, ""},
+		{"Not Required", "", server13, false, ""},
+		{"Missing", "", server13, true, "does not contain"},
+		{"Other Connection", binding(other13), server13, true, "does not match"},
+		{"Exporter Over TLS 1.2", ChannelBindingTlsExporter + ":" + exporter, server12, true,
+			"requires tls-unique"},
+		{"Unique Over TLS 1.3", ChannelBindingTlsUnique + ":" + exporter, server13, true,
+			"requires tls-exporter"},
+		{"Invalid Encoding", ChannelBindingTlsExporter + ":#", server13, true, "decode"},
+		{"Wrong Length", ChannelBindingTlsExporter + ":" +
+			base64.StdEncoding.EncodeToString([]byte{1}), server13, true, "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bound := csr
+			if tt.binding != "" {
+				var err error
+				bound, err = AddChannelBinding(csr, key, tt.binding)
+				if err != nil {
+					t.Fatalf("AddChannelBinding() error = %v", err)
+				}
+				if err := bound.CheckSignature(); err != nil {
+					t.Fatalf("CSR signature invalid: %v", err)
+				}
+			}
+
+			err := VerifyChannelBinding(bound, &tt.server, tt.required)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("VerifyChannelBinding() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("VerifyChannelBinding() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
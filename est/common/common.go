@@ -33,21 +33,30 @@ import (
 
 // URI constants
 const (
-	EndpointPrefix            = "/.well-known/est"
-	CacertsEndpoint           = "/cacerts"
-	CsrattrsEndpoint          = "/csrattrs"
-	EnrollEndpoint            = "/simpleenroll"
-	HealthCheckEndpoint       = "/healthcheck"
-	ReenrollEndpoint          = "/simplereenroll"
-	ServerkeygenEndpoint      = "/serverkeygen"
-	TpmActivateEnrollEndpoint = "/tpmactivateenroll"
-	TpmCertifyEnrollEndpoint  = "/tpmcertifyenroll"
-	SnpEnrollEndpoint         = "/snpenroll"
+	EndpointPrefix              = "/.well-known/est"
+	AuditLogSthEndpoint         = "/auditlog/sth"
+	AuditLogInclusionEndpoint   = "/auditlog/inclusion"
+	AuditLogConsistencyEndpoint = "/auditlog/consistency"
+	AttestNonceEndpoint         = "/attestnonce"
+	AttestEnrollEndpoint        = "/attestenroll"
+	CacertsEndpoint             = "/cacerts"
+	CrlEndpoint                 = "/crl"
+	CsrattrsEndpoint            = "/csrattrs"
+	EnrollEndpoint              = "/simpleenroll"
+	HealthCheckEndpoint         = "/healthcheck"
+	ReenrollEndpoint            = "/simplereenroll"
+	ServerkeygenEndpoint        = "/serverkeygen"
+	TpmActivateEndpoint         = "/tpmactivate"
+	TpmActivateEnrollEndpoint   = "/tpmactivateenroll"
+	TpmCertifyEnrollEndpoint    = "/tpmcertifyenroll"
+	SnpEnrollEndpoint           = "/snpenroll"
 )
 
 // HTTP header constants
 const (
 	AcceptHeader             = "Accept"
+	AuthorizationHeader      = "Authorization"
+	BearerPrefix             = "Bearer "
 	ContentTypeHeader        = "Content-Type"
 	ContentTypeOptionsHeader = "X-Content-Type-Options"
 	EncodingTypeBase64       = "base64"
@@ -76,6 +85,7 @@ const (
 	MimeTypePKCS7Enveloped = "application/pkcs7-mime; smime-type=enveloped-data"
 	MimeTypePKCS7GenKey    = "application/pkcs7-mime; smime-type=server-generated-key"
 	MimeTypePKCS8          = "application/pkcs8"
+	MimeTypePKIXCRL        = "application/pkix-crl"
 	MimeTypeProblemJSON    = "application/problem+json"
 	MimeTypeTextPlain      = "text/plain"
 	MimeTypeTextPlainUTF8  = "text/plain; charset=utf-8"
@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/exp/slices"
+)
+
+// StatusNewKeyRequired is the HTTP status the server responds with to a
+// simplereenroll request for the key of the current certificate, if the
+// server requires a new key
+const StatusNewKeyRequired = http.StatusConflict
+
+// OID of the ChangeSubjectName attribute [RFC6402]
+var oidChangeSubjectName = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 7, 36}
+
+// ChangeSubjectName contains the subject and the DNS names requested for a
+// renewed certificate which differ from the current certificate [RFC7030 4.2.2]
+type ChangeSubjectName struct {
+	RawSubject []byte
+	DNSNames   []string
+}
+
+type tbsCsr struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+type rawCsr struct {
+	TbsCsr    asn1.RawValue
+	SigAlg    pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+}
+
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// CreateReenrollCsr creates a CSR for renewing the current certificate with the
+// specified key. The subject and the DNS names of the CSR must be identical to
+// the current certificate [RFC7030 4.2.2]. If the desired CSR requests a
+// different subject or different DNS names, the ChangeSubjectName attribute is
+// added to the CSR
+func CreateReenrollCsr(priv crypto.PrivateKey, current *x509.Certificate,
+	desired *x509.CertificateRequest,
+) (*x509.CertificateRequest, error) {
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key does not implement crypto.Signer")
+	}
+
+	tmpl := x509.CertificateRequest{
+		RawSubject: current.RawSubject,
+		DNSNames:   current.DNSNames,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	if desired != nil && (!bytes.Equal(desired.RawSubject, current.RawSubject) ||
+		!slices.Equal(desired.DNSNames, current.DNSNames)) {
+		der, err = addChangeSubjectName(der, signer, desired)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add ChangeSubjectName attribute: %w", err)
+		}
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse created CSR: %w", err)
+	}
+
+	return csr, nil
+}
+
+// addChangeSubjectName adds the ChangeSubjectName attribute with the subject and
+// DNS names of the desired CSR to the DER encoded CSR and signs it again
+func addChangeSubjectName(der []byte, signer crypto.Signer, desired *x509.CertificateRequest,
+) ([]byte, error) {
+
+	// ChangeSubjectName ::= SEQUENCE { subject Name OPTIONAL, subjectAlt GeneralNames OPTIONAL }
+	elems := []asn1.RawValue{{FullBytes: desired.RawSubject}}
+	if len(desired.DNSNames) > 0 {
+		names := make([]asn1.RawValue, 0, len(desired.DNSNames))
+		for _, n := range desired.DNSNames {
+			names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2,
+				Bytes: []byte(n)})
+		}
+		generalNames, err := asn1.Marshal(names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal general names: %w", err)
+		}
+		elems = append(elems, asn1.RawValue{FullBytes: generalNames})
+	}
+	value, err := asn1.Marshal(elems)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ChangeSubjectName: %w", err)
+	}
+
+	return addCsrAttribute(der, signer, oidChangeSubjectName, value)
+}
+
+// addCsrAttribute adds the attribute with the specified DER encoded value to the
+// DER encoded CSR and signs it again. Go only supports extension requests as CSR
+// attributes, therefore the attribute is added to the encoded CSR info
+func addCsrAttribute(der []byte, signer crypto.Signer, oid asn1.ObjectIdentifier, value []byte,
+) ([]byte, error) {
+
+	var outer rawCsr
+	if _, err := asn1.Unmarshal(der, &outer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal CSR: %w", err)
+	}
+	var tbs tbsCsr
+	if _, err := asn1.Unmarshal(outer.TbsCsr.FullBytes, &tbs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal CSR info: %w", err)
+	}
+
+	attr, err := asn1.Marshal(csrAttribute{
+		Type:   oid,
+		Values: []asn1.RawValue{{FullBytes: value}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attribute: %w", err)
+	}
+	tbs.Attributes = append(tbs.Attributes, asn1.RawValue{FullBytes: attr})
+
+	tbsDer, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CSR info: %w", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+	hash, err := signatureHash(csr.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	var signed []byte
+	var opts crypto.SignerOpts = hash
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbsDer)
+		signed = h.Sum(nil)
+	} else {
+		// Ed25519 signs the message itself
+		signed = tbsDer
+	}
+	sig, err := signer.Sign(rand.Reader, signed, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CSR: %w", err)
+	}
+
+	return asn1.Marshal(rawCsr{
+		TbsCsr:    asn1.RawValue{FullBytes: tbsDer},
+		SigAlg:    outer.SigAlg,
+		Signature: asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+}
+
+// getCsrAttribute returns the DER encoded value of the single-valued attribute
+// with the specified OID or nil, if the CSR does not contain the attribute
+func getCsrAttribute(csr *x509.CertificateRequest, oid asn1.ObjectIdentifier) ([]byte, error) {
+
+	var tbs tbsCsr
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal CSR info: %w", err)
+	}
+
+	for _, a := range tbs.Attributes {
+		var attr csrAttribute
+		if _, err := asn1.Unmarshal(a.FullBytes, &attr); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal CSR attribute: %w", err)
+		}
+		if !attr.Type.Equal(oid) {
+			continue
+		}
+		if len(attr.Values) != 1 {
+			return nil, fmt.Errorf("CSR attribute %v contains %v values", oid, len(attr.Values))
+		}
+		return attr.Values[0].FullBytes, nil
+	}
+
+	return nil, nil
+}
+
+func signatureHash(alg x509.SignatureAlgorithm) (crypto.Hash, error) {
+	switch alg {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		return crypto.SHA256, nil
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		return crypto.SHA384, nil
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		return crypto.SHA512, nil
+	case x509.PureEd25519:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("unsupported CSR signature algorithm %v", alg)
+	}
+}
+
+// ParseChangeSubjectName returns the ChangeSubjectName attribute of the CSR
+// or nil, if the CSR does not contain the attribute
+func ParseChangeSubjectName(csr *x509.CertificateRequest) (*ChangeSubjectName, error) {
+	value, err := getCsrAttribute(csr, oidChangeSubjectName)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return parseChangeSubjectNameValue(value)
+}
+
+func parseChangeSubjectNameValue(data []byte) (*ChangeSubjectName, error) {
+
+	var elems []asn1.RawValue
+	if rest, err := asn1.Unmarshal(data, &elems); err != nil || len(rest) > 0 {
+		return nil, errors.New("failed to unmarshal ChangeSubjectName")
+	}
+	if len(elems) == 0 || len(elems) > 2 {
+		return nil, fmt.Errorf("ChangeSubjectName contains %v elements", len(elems))
+	}
+
+	c := &ChangeSubjectName{}
+	for _, e := range elems {
+		if e.Class != asn1.ClassUniversal || e.Tag != asn1.TagSequence {
+			return nil, errors.New("unexpected ChangeSubjectName element")
+		}
+
+		// Both the subject name and the general names are sequences. A name
+		// consists of sets of attributes, general names are context specific
+		var first asn1.RawValue
+		if len(e.Bytes) > 0 {
+			if _, err := asn1.Unmarshal(e.Bytes, &first); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal ChangeSubjectName element: %w", err)
+			}
+		}
+		if first.Class == asn1.ClassUniversal && first.Tag == asn1.TagSet && c.RawSubject == nil {
+			var rdn pkix.RDNSequence
+			if rest, err := asn1.Unmarshal(e.FullBytes, &rdn); err != nil || len(rest) > 0 {
+				return nil, errors.New("failed to unmarshal ChangeSubjectName subject")
+			}
+			c.RawSubject = e.FullBytes
+			continue
+		}
+
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(e.FullBytes, &names); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ChangeSubjectName general names: %w", err)
+		}
+		for _, n := range names {
+			if n.Class != asn1.ClassContextSpecific || n.Tag != 2 {
+				return nil, fmt.Errorf("unsupported general name type %v", n.Tag)
+			}
+			c.DNSNames = append(c.DNSNames, string(n.Bytes))
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func createTestCsr(t *testing.T, cn string, dnsNames []string) *x509.CertificateRequest {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn, Organization: []string{"Test"}},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to create CSR: %v", err)
+	}
+	csr, _ := x509.ParseCertificateRequest(der)
+	return csr
+}
+
+func TestCreateReenrollCsr(t *testing.T) {
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device", Organization: []string{"Test"}},
+		DNSNames:     []string{"device.local"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	current, _ := x509.ParseCertificate(der)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name       string
+		key        interface{}
+		desired    *x509.CertificateRequest
+		wantChange *ChangeSubjectName
+		wantErr    bool
+	}{
+		{"Unchanged", ecKey, createTestCsr(t, "device", []string{"device.local"}), nil, false},
+		{"No Desired CSR", ecKey, nil, nil, false},
+		{"Changed Subject", ecKey, createTestCsr(t, "renamed", []string{"device.local"}),
+			&ChangeSubjectName{DNSNames: []string{"device.local"}}, false},
+		{"Changed DNS Names", rsaKey, createTestCsr(t, "device", []string{"a.local", "b.local"}),
+			&ChangeSubjectName{DNSNames: []string{"a.local", "b.local"}}, false},
+		{"Removed DNS Names", edKey, createTestCsr(t, "device", nil),
+			&ChangeSubjectName{}, false},
+		{"Invalid Key", "key", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csr, err := CreateReenrollCsr(tt.key, current, tt.desired)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateReenrollCsr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// The CSR must carry the names of the current certificate
+			if err := csr.CheckSignature(); err != nil {
+				t.Errorf("CSR signature invalid: %v", err)
+			}
+			if !bytes.Equal(csr.RawSubject, current.RawSubject) ||
+				!reflect.DeepEqual(csr.DNSNames, current.DNSNames) {
+				t.Errorf("CSR names %v %v do not match current certificate", csr.Subject,
+					csr.DNSNames)
+			}
+
+			change, err := ParseChangeSubjectName(csr)
+			if err != nil {
+				t.Fatalf("ParseChangeSubjectName() error = %v", err)
+			}
+			if tt.wantChange == nil {
+				if change != nil {
+					t.Errorf("ParseChangeSubjectName() = %v, want nil", change)
+				}
+				return
+			}
+			if change == nil {
+				t.Fatalf("ParseChangeSubjectName() = nil, want %v", tt.wantChange)
+			}
+			if !bytes.Equal(change.RawSubject, tt.desired.RawSubject) {
+				t.Errorf("ChangeSubjectName subject does not match desired subject")
+			}
+			if !reflect.DeepEqual(change.DNSNames, tt.wantChange.DNSNames) {
+				t.Errorf("ChangeSubjectName DNS names = %v, want %v", change.DNSNames,
+					tt.wantChange.DNSNames)
+			}
+		})
+	}
+}
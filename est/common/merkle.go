@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The issuance log of the provisioning server is a Merkle tree as specified for
+// Certificate Transparency [RFC9162 2.1]. Leaves are the SHA256 hashes of the
+// log entries prefixed with 0x00, inner nodes the SHA256 hashes of their
+// children prefixed with 0x01
+
+// Domain separation prefix of the signed tree head signature input
+const treeHeadContext = "cmc issuance log tree head v1"
+
+// SignedTreeHead is the root hash of the issuance log at the specified size,
+// signed by the provisioning server CA
+type SignedTreeHead struct {
+	TreeSize uint64 `json:"treeSize"`
+	// Timestamp in milliseconds since the epoch
+	Timestamp int64  `json:"timestamp"`
+	RootHash  []byte `json:"rootHash"`
+	Signature []byte `json:"signature"`
+}
+
+// InclusionProof proves that the leaf is contained in the tree of the size
+type InclusionProof struct {
+	LeafIndex uint64 `json:"leafIndex"`
+	TreeSize  uint64 `json:"treeSize"`
+	LeafHash  []byte `json:"leafHash"`
+	// Optional log entry the leaf hash was computed from
+	Entry     []byte   `json:"entry,omitempty"`
+	AuditPath [][]byte `json:"auditPath"`
+}
+
+// ConsistencyProof proves that the tree of the second size is an append-only
+// extension of the tree of the first size
+type ConsistencyProof struct {
+	First  uint64   `json:"first"`
+	Second uint64   `json:"second"`
+	Path   [][]byte `json:"path"`
+}
+
+// LeafHash returns the Merkle tree leaf hash of the entry
+func LeafHash(entry []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(entry)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n
+func splitPoint(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash returns the Merkle tree hash of the leaf hashes
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(uint64(len(leaves)))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// ComputeInclusionProof returns the audit path of the leaf with the index
+// [RFC9162 2.1.3.1]
+func ComputeInclusionProof(leaves [][]byte, index uint64) ([][]byte, error) {
+	if index >= uint64(len(leaves)) {
+		return nil, fmt.Errorf("leaf index %v not in tree of size %v", index, len(leaves))
+	}
+	return inclusionPath(leaves, index), nil
+}
+
+func inclusionPath(leaves [][]byte, m uint64) [][]byte {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := splitPoint(n)
+	if m < k {
+		return append(inclusionPath(leaves[:k], m), RootHash(leaves[k:]))
+	}
+	return append(inclusionPath(leaves[k:], m-k), RootHash(leaves[:k]))
+}
+
+// ComputeConsistencyProof returns the consistency proof between the tree of the
+// first leaves and the tree of all leaves [RFC9162 2.1.4.1]
+func ComputeConsistencyProof(leaves [][]byte, first uint64) ([][]byte, error) {
+	n := uint64(len(leaves))
+	if first > n {
+		return nil, fmt.Errorf("tree size %v larger than tree size %v", first, n)
+	}
+	if first == 0 || first == n {
+		return [][]byte{}, nil
+	}
+	return subproof(leaves, first, true), nil
+}
+
+func subproof(leaves [][]byte, m uint64, complete bool) [][]byte {
+	n := uint64(len(leaves))
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(subproof(leaves[:k], m, complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(leaves[k:], m-k, false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion verifies the inclusion proof of the leaf hash against the
+// root hash of the tree of the proof size [RFC9162 2.1.3.2]. If the proof
+// contains the entry, the leaf hash must match the entry
+func VerifyInclusion(proof *InclusionProof, root []byte) error {
+
+	if proof.Entry != nil && !bytes.Equal(LeafHash(proof.Entry), proof.LeafHash) {
+		return errors.New("leaf hash does not match entry")
+	}
+	if proof.LeafIndex >= proof.TreeSize {
+		return fmt.Errorf("leaf index %v not in tree of size %v", proof.LeafIndex, proof.TreeSize)
+	}
+
+	fn := proof.LeafIndex
+	sn := proof.TreeSize - 1
+	r := proof.LeafHash
+	for _, p := range proof.AuditPath {
+		if sn == 0 {
+			return errors.New("inclusion proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("inclusion proof too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("inclusion proof does not match root hash")
+	}
+	return nil
+}
+
+// VerifyConsistency verifies that the tree with the second root hash is an
+// append-only extension of the tree with the first root hash [RFC9162 2.1.4.2]
+func VerifyConsistency(proof *ConsistencyProof, firstRoot, secondRoot []byte) error {
+
+	if proof.First > proof.Second {
+		return fmt.Errorf("first tree size %v larger than second tree size %v", proof.First,
+			proof.Second)
+	}
+	if proof.First == proof.Second || proof.First == 0 {
+		if len(proof.Path) != 0 {
+			return errors.New("consistency proof must be empty")
+		}
+		if proof.First != 0 && !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("root hashes of trees with equal size differ")
+		}
+		return nil
+	}
+	if len(proof.Path) == 0 {
+		return errors.New("consistency proof empty")
+	}
+
+	path := proof.Path
+	if proof.First&(proof.First-1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+
+	fn := proof.First - 1
+	sn := proof.Second - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr := path[0]
+	sr := path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("consistency proof too short")
+	}
+	if !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof does not match root hashes")
+	}
+	return nil
+}
+
+// SignedData returns the data covered by the tree head signature
+func (sth *SignedTreeHead) SignedData() []byte {
+	buf := make([]byte, len(treeHeadContext)+16, len(treeHeadContext)+16+len(sth.RootHash))
+	n := copy(buf, treeHeadContext)
+	binary.BigEndian.PutUint64(buf[n:], sth.TreeSize)
+	binary.BigEndian.PutUint64(buf[n+8:], uint64(sth.Timestamp))
+	return append(buf, sth.RootHash...)
+}
+
+// VerifyTreeHead verifies the signature of the tree head with the CA certificate
+// of the provisioning server
+func VerifyTreeHead(sth *SignedTreeHead, ca *x509.Certificate) error {
+	var alg x509.SignatureAlgorithm
+	switch ca.PublicKeyAlgorithm {
+	case x509.ECDSA:
+		alg = x509.ECDSAWithSHA256
+	case x509.RSA:
+		alg = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported CA key algorithm %v", ca.PublicKeyAlgorithm)
+	}
+	if err := ca.CheckSignature(alg, sth.SignedData(), sth.Signature); err != nil {
+		return fmt.Errorf("invalid tree head signature: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Leaves of the RFC6962 reference test vectors
+var testLeaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657",
+	"606162636465666768696a6b6c6d6e6f"}
+
+func testLeafHashes(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		var entry []byte
+		if i < len(testLeaves) {
+			entry, _ = hex.DecodeString(testLeaves[i])
+		} else {
+			entry = []byte(fmt.Sprintf("entry %v", i))
+		}
+		leaves = append(leaves, LeafHash(entry))
+	}
+	return leaves
+}
+
+func TestRootHash(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("Size %v", tt.size), func(t *testing.T) {
+			got := hex.EncodeToString(RootHash(testLeafHashes(tt.size)))
+			if got != tt.want {
+				t.Errorf("RootHash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	for size := 1; size <= 20; size++ {
+		leaves := testLeafHashes(size)
+		root := RootHash(leaves)
+		for i := 0; i < size; i++ {
+			path, err := ComputeInclusionProof(leaves, uint64(i))
+			if err != nil {
+				t.Fatalf("ComputeInclusionProof(%v, %v) error = %v", size, i, err)
+			}
+			proof := &InclusionProof{
+				LeafIndex: uint64(i),
+				TreeSize:  uint64(size),
+				LeafHash:  leaves[i],
+				AuditPath: path,
+			}
+			if err := VerifyInclusion(proof, root); err != nil {
+				t.Fatalf("VerifyInclusion(%v, %v) error = %v", size, i, err)
+			}
+
+			// A proof for a different leaf or tree must not verify
+			proof.LeafHash = leaves[(i+1)%size]
+			if size > 1 && VerifyInclusion(proof, root) == nil {
+				t.Fatalf("VerifyInclusion(%v, %v) succeeded for wrong leaf", size, i)
+			}
+			proof.LeafHash = leaves[i]
+			if VerifyInclusion(proof, RootHash(testLeafHashes(size+1))) == nil {
+				t.Fatalf("VerifyInclusion(%v, %v) succeeded for wrong tree", size, i)
+			}
+		}
+	}
+
+	t.Run("Entry Mismatch", func(t *testing.T) {
+		leaves := testLeafHashes(3)
+		path, _ := ComputeInclusionProof(leaves, 1)
+		proof := &InclusionProof{LeafIndex: 1, TreeSize: 3, LeafHash: leaves[1],
+			Entry: []byte("other"), AuditPath: path}
+		if VerifyInclusion(proof, RootHash(leaves)) == nil {
+			t.Fatalf("VerifyInclusion() succeeded for entry not matching the leaf hash")
+		}
+	})
+}
+
+func TestConsistencyProof(t *testing.T) {
+	for second := 1; second <= 20; second++ {
+		leaves := testLeafHashes(second)
+		secondRoot := RootHash(leaves)
+		for first := 0; first <= second; first++ {
+			firstRoot := RootHash(leaves[:first])
+			path, err := ComputeConsistencyProof(leaves, uint64(first))
+			if err != nil {
+				t.Fatalf("ComputeConsistencyProof(%v, %v) error = %v", first, second, err)
+			}
+			proof := &ConsistencyProof{First: uint64(first), Second: uint64(second), Path: path}
+			if err := VerifyConsistency(proof, firstRoot, secondRoot); err != nil {
+				t.Fatalf("VerifyConsistency(%v, %v) error = %v", first, second, err)
+			}
+
+			// A tree with a modified leaf must not verify
+			if first > 0 {
+				modified := append([][]byte{}, leaves...)
+				modified[first-1] = LeafHash([]byte("modified"))
+				if VerifyConsistency(proof, RootHash(modified[:first]), secondRoot) == nil {
+					t.Fatalf("VerifyConsistency(%v, %v) succeeded for modified tree",
+						first, second)
+				}
+			}
+		}
+	}
+}
+
+func TestVerifyTreeHead(t *testing.T) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "CA"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	ca, _ := x509.ParseCertificate(der)
+
+	sth := &SignedTreeHead{
+		TreeSize:  8,
+		Timestamp: time.Now().UnixMilli(),
+		RootHash:  RootHash(testLeafHashes(8)),
+	}
+	digest := sha256.Sum256(sth.SignedData())
+	sth.Signature, _ = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+	if err := VerifyTreeHead(sth, ca); err != nil {
+		t.Fatalf("VerifyTreeHead() error = %v", err)
+	}
+	sth.TreeSize = 7
+	if VerifyTreeHead(sth, ca) == nil {
+		t.Fatalf("VerifyTreeHead() succeeded for modified tree head")
+	}
+}
@@ -17,23 +17,52 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"go.mozilla.org/pkcs7"
 
 	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.WithField("service", "estclient")
 
+// ErrNewKeyRequired indicates that the EST server refused to re-enroll the key
+// of the current certificate and requires a re-enrollment with a new key
+var ErrNewKeyRequired = errors.New("EST server requires a new key")
+
+// HttpError is returned if the EST server responded with an HTTP error status
+type HttpError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	// RetryAfter is the duration the server asked to wait before retrying the
+	// request via the Retry-After header or zero, if not set
+	RetryAfter time.Duration
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("HTTP Server responded %v: %v", e.Status, e.Message)
+}
+
 type Client struct {
-	client *http.Client
+	client  *http.Client
+	token   string
+	profile string
 }
 
 func NewClient(roots []*x509.Certificate) *Client {
@@ -88,6 +117,142 @@ func (c *Client) SetCAs(roots []*x509.Certificate) error {
 	return nil
 }
 
+// SetClientCertificate configures the certificate chain and the private key
+// the client authenticates itself with via TLS, as required for re-enrollment
+func (c *Client) SetClientCertificate(chain []*x509.Certificate, key crypto.PrivateKey) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("no client certificate provided")
+	}
+	if _, ok := key.(crypto.Signer); !ok {
+		return fmt.Errorf("client key does not implement crypto.Signer")
+	}
+
+	tp, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("internal error: failed to get transport")
+	}
+
+	cert := tls.Certificate{
+		PrivateKey: key,
+		Leaf:       chain[0],
+	}
+	for _, cc := range chain {
+		cert.Certificate = append(cert.Certificate, cc.Raw)
+	}
+	tp.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	return nil
+}
+
+// SetToken sets the bootstrap token, which authorizes enrollment requests at
+// EST servers requiring token authentication
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// SetTokenSource reads the bootstrap token from the source (env:<VAR>,
+// file:<PATH> or prompt) and sets it. An empty source sets no token
+func (c *Client) SetTokenSource(source string) error {
+	if source == "" {
+		return nil
+	}
+	token, err := internal.GetSecret(source, "bootstrap token")
+	if err != nil {
+		return err
+	}
+	c.SetToken(strings.TrimSpace(string(token)))
+	return nil
+}
+
+// SetProfile sets the certificate profile of the EST server, which subsequent
+// enrollments request via the CA label [RFC7030 3.2.2]. An empty profile
+// requests the default profile
+func (c *Client) SetProfile(profile string) {
+	c.profile = profile
+}
+
+// enrollEndpoint returns the URL of the enrollment endpoint for the profile
+func (c *Client) enrollEndpoint(addr, endpoint string) string {
+	prefix := strings.TrimSuffix(addr, "/") + est.EndpointPrefix
+	if c.profile != "" {
+		prefix += "/" + c.profile
+	}
+	return prefix + endpoint
+}
+
+func (c *Client) hasClientCertificate() bool {
+	tp, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		return false
+	}
+	return len(tp.TLSClientConfig.Certificates) > 0
+}
+
+// BindChannel establishes a dedicated TLS connection to the EST server and
+// returns its channel binding, which must be included into CSRs. All subsequent
+// requests of the client are sent over this connection, so that the server can
+// verify that the CSR was created by the entity which established the connection
+func (c *Client) BindChannel(addr string) (string, error) {
+
+	if c.GetInsecureSkipVerify() {
+		return "", fmt.Errorf("channel binding requires server CAs to be configured")
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse EST server address: %w", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	tp, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		return "", fmt.Errorf("internal error: failed to get transport")
+	}
+	cfg := tp.TLSClientConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", host, cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to establish TLS connection: %w", err)
+	}
+	cs := conn.ConnectionState()
+	binding, err := est.GetChannelBinding(&cs)
+	if err != nil {
+		conn.Close()
+		return "", fmt.Errorf("failed to get channel binding: %w", err)
+	}
+
+	log.Tracef("Bound EST client to TLS %x connection to %v", cs.Version, host)
+
+	// The transport can only use the bound connection. If the connection was
+	// closed, e.g., by the server, subsequent requests fail
+	var mu sync.Mutex
+	bound := net.Conn(conn)
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: cfg,
+			DialTLSContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if bound == nil {
+					return nil, fmt.Errorf("bound TLS connection to %v closed", host)
+				}
+				next := bound
+				bound = nil
+				return next, nil
+			},
+			MaxConnsPerHost: 1,
+		},
+	}
+
+	return binding, nil
+}
+
 func (c *Client) GetInsecureSkipVerify() bool {
 	tp, ok := c.client.Transport.(*http.Transport)
 	if !ok {
@@ -106,7 +271,7 @@ func (c *Client) CaCerts(addr string) ([]*x509.Certificate, error) {
 	contentType := ""
 	transferEncoding := ""
 
-	resp, err := request(c.client, method, endpoint, accepts, contentType, transferEncoding, nil)
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
@@ -131,7 +296,12 @@ func (c *Client) CaCerts(addr string) ([]*x509.Certificate, error) {
 		return nil, err
 	}
 
-	certs := p7.Certificates
+	// The certificates of a PKCS#7 structure are an unordered set. Order them leaf
+	// first, so that the last certificate is the root CA
+	certs, err := internal.OrderChain(p7.Certificates)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificate chain: %w", err)
+	}
 
 	return certs, nil
 }
@@ -149,12 +319,12 @@ func (c *Client) SimpleEnroll(addr string, csr *x509.CertificateRequest,
 	body := io.NopCloser(bytes.NewBuffer(csrbase64))
 
 	method := http.MethodPost
-	endpoint := strings.TrimSuffix(addr, "/") + est.EndpointPrefix + est.EnrollEndpoint
+	endpoint := c.enrollEndpoint(addr, est.EnrollEndpoint)
 	accepts := est.MimeTypePKCS7
 	contentType := est.MimeTypePKCS10
 	transferEncoding := est.EncodingTypeBase64
 
-	resp, err := request(c.client, method, endpoint, accepts, contentType, transferEncoding, body)
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
@@ -173,16 +343,236 @@ func (c *Client) SimpleEnroll(addr string, csr *x509.CertificateRequest,
 	return certs[0], nil
 }
 
-func (c *Client) TpmActivateEnroll(
+// BoundSimpleEnroll enrolls the CSR via a TLS connection bound to the CSR. The
+// channel binding is added to the CSR, which is signed again with the key
+func (c *Client) BoundSimpleEnroll(addr string, csr *x509.CertificateRequest,
+	priv crypto.PrivateKey,
+) (*x509.Certificate, error) {
+
+	binding, err := c.BindChannel(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind channel: %w", err)
+	}
+
+	csr, err = est.AddChannelBinding(csr, priv, binding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add channel binding to CSR: %w", err)
+	}
+
+	return c.SimpleEnroll(addr, csr)
+}
+
+// AttestationNonce requests a fresh single-use nonce for an attested enrollment
+func (c *Client) AttestationNonce(addr string) ([]byte, error) {
+
+	method := http.MethodGet
+	endpoint := strings.TrimSuffix(addr, "/") + est.EndpointPrefix + est.AttestNonceEndpoint
+	accepts := est.MimeTypeOctetStream
+
+	resp, err := c.request(method, endpoint, accepts, "", "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	nonce, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+	if len(nonce) != est.AttestationNonceLength {
+		return nil, fmt.Errorf("unexpected nonce length %v", len(nonce))
+	}
+
+	return nonce, nil
+}
+
+// AttestEnroll enrolls the CSR with an attestation report instead of a token or
+// client certificate. The CSR is bound to the TLS connection and the attest
+// function must return a signed attestation report over the nonce, which
+// binds the server nonce to the public key of the CSR
+func (c *Client) AttestEnroll(addr string, csr *x509.CertificateRequest, priv crypto.PrivateKey,
+	attest func(nonce []byte) ([]byte, error),
+) (*x509.Certificate, error) {
+
+	binding, err := c.BindChannel(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind channel: %w", err)
+	}
+
+	csr, err = est.AddChannelBinding(csr, priv, binding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add channel binding to CSR: %w", err)
+	}
+
+	nonce, err := c.AttestationNonce(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attestation nonce: %w", err)
+	}
+
+	report, err := attest(est.AttestationNonce(nonce, csr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attestation report: %w", err)
+	}
+
+	buf, contentType, err := est.EncodeMultiPart(
+		[]est.MimeMultipart{
+			{ContentType: est.MimeTypeOctetStream, Data: nonce},
+			{ContentType: est.MimeTypePKCS10, Data: csr},
+			{ContentType: est.MimeTypeOctetStream, Data: report},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode multipart: %w", err)
+	}
+
+	body := io.NopCloser(buf)
+
+	method := http.MethodPost
+	endpoint := c.enrollEndpoint(addr, est.AttestEnrollEndpoint)
+	accepts := est.MimeTypePKCS7
+	transferEncoding := est.EncodingTypeBase64
+
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+
+	certs, err := parseSimplePkiResponse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse simple PKI response: %w", err)
+	}
+
+	return certs[0], nil
+}
+
+// SimpleReenroll renews the client certificate via the simplereenroll request
+// [RFC7030 4.2.2]. The client must authenticate with the current certificate,
+// the CSR must contain the subject and the DNS names of the current certificate.
+// If the server refuses to renew the current key, ErrNewKeyRequired is returned
+func (c *Client) SimpleReenroll(addr string, csr *x509.CertificateRequest,
+) (*x509.Certificate, error) {
+
+	if c.GetInsecureSkipVerify() {
+		return nil, fmt.Errorf("simple reenroll requires server CAs to be configured")
+	}
+	if !c.hasClientCertificate() {
+		return nil, fmt.Errorf("simple reenroll requires a client certificate to be configured")
+	}
+
+	body := io.NopCloser(bytes.NewBuffer(est.EncodeBase64(csr.Raw)))
+
+	method := http.MethodPost
+	endpoint := c.enrollEndpoint(addr, est.ReenrollEndpoint)
+	accepts := est.MimeTypePKCS7
+	contentType := est.MimeTypePKCS10
+	transferEncoding := est.EncodingTypeBase64
+
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, body)
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == est.StatusNewKeyRequired {
+		return nil, fmt.Errorf("%w: %v", ErrNewKeyRequired, httpErr.Message)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+
+	certs, err := parseSimplePkiResponse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse simple PKI response: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("simple PKI response does not contain a certificate")
+	}
+
+	return certs[0], nil
+}
+
+// Reenroll renews the current certificate chain for newKey, which can be the
+// current key or a new key. The EST server is authenticated with the root CA of
+// the current chain, the client authenticates with the current certificate and
+// key. The subject and the DNS names of the desired CSR are requested via the
+// ChangeSubjectName attribute if they differ from the current certificate. The
+// CSR is bound to the TLS connection. The renewed certificate chain is returned
+func Reenroll(addr string, chain []*x509.Certificate, key, newKey crypto.PrivateKey,
+	desired *x509.CertificateRequest,
+) ([]*x509.Certificate, error) {
+	return ReenrollProfile(addr, "", chain, key, newKey, desired)
+}
+
+// ReenrollProfile renews the current certificate chain of the certificate
+// profile like Reenroll. An empty profile renews a certificate of the default
+// profile
+func ReenrollProfile(addr, profile string, chain []*x509.Certificate,
+	key, newKey crypto.PrivateKey, desired *x509.CertificateRequest,
+) ([]*x509.Certificate, error) {
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no current certificate chain provided")
+	}
+
+	client := NewClient([]*x509.Certificate{chain[len(chain)-1]})
+	err := client.SetClientCertificate(chain, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set client certificate: %w", err)
+	}
+	client.SetProfile(profile)
+
+	binding, err := client.BindChannel(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind channel: %w", err)
+	}
+
+	csr, err := est.CreateReenrollCsr(newKey, chain[0], desired)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create re-enrollment CSR: %w", err)
+	}
+	csr, err = est.AddChannelBinding(csr, newKey, binding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add channel binding to CSR: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	cert, err := client.SimpleReenroll(addr, csr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+// TpmActivate sends the EK and AK parameters to the server and returns the ID
+// of the credential activation together with the credential and secret
+// encrypted to the EK
+func (c *Client) TpmActivate(
 	addr, tpmManufacturer, ekCertUrl string,
 	tpmMajor, tpmMinor int,
 	csr *x509.CertificateRequest,
 	akPublic, akCreateData, akCreateAttestation, akCreateSignature []byte,
 	ekPublic, ekCertDer []byte,
-) ([]byte, []byte, []byte, error) {
+) (string, []byte, []byte, error) {
 
 	if c.GetInsecureSkipVerify() {
-		return nil, nil, nil, fmt.Errorf("enroll requires server CAs to be configured")
+		return "", nil, nil, fmt.Errorf("enroll requires server CAs to be configured")
 	}
 
 	// Create string with TPM info required for the server to find the
@@ -203,36 +593,77 @@ func (c *Client) TpmActivateEnroll(
 		},
 	)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to encode multipart: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to encode multipart: %w", err)
 	}
 	body := io.NopCloser(buf)
 
-	endpoint := strings.TrimSuffix(addr, "/") + est.EndpointPrefix + est.TpmActivateEnrollEndpoint
+	endpoint := strings.TrimSuffix(addr, "/") + est.EndpointPrefix + est.TpmActivateEndpoint
 
-	resp, err := request(c.client, http.MethodPost, endpoint, est.MimeTypePKCS7, contentType, est.EncodingTypeBase64, body)
+	resp, err := c.request(http.MethodPost, endpoint, "", contentType, "", body)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to perform request: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to perform request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	var id string
 	var encryptedCredential []byte
 	var encryptedSecret []byte
-	var encryptedCert []byte
 
 	_, err = est.DecodeMultipart(
 		resp.Body,
 		[]est.MimeMultipart{
+			{ContentType: est.MimeTypeTextPlain, Data: &id},
 			{ContentType: est.MimeTypeOctetStream, Data: &encryptedCredential},
 			{ContentType: est.MimeTypeOctetStream, Data: &encryptedSecret},
-			{ContentType: est.MimeTypePKCS7Enveloped, Data: &encryptedCert},
 		},
 		resp.Header.Get(est.ContentTypeHeader),
 	)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to decode multipart response: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to decode multipart response: %w", err)
 	}
 
-	return encryptedCredential, encryptedSecret, encryptedCert, nil
+	return id, encryptedCredential, encryptedSecret, nil
+}
+
+// TpmActivateEnroll returns the secret of the credential activation with the
+// specified ID to the server, which then issues the AK certificate
+func (c *Client) TpmActivateEnroll(addr, id string, secret []byte) (*x509.Certificate, error) {
+
+	if c.GetInsecureSkipVerify() {
+		return nil, fmt.Errorf("enroll requires server CAs to be configured")
+	}
+
+	buf, contentType, err := est.EncodeMultiPart(
+		[]est.MimeMultipart{
+			{ContentType: est.MimeTypeTextPlain, Data: id},
+			{ContentType: est.MimeTypeOctetStream, Data: secret},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode multipart: %w", err)
+	}
+	body := io.NopCloser(buf)
+
+	endpoint := strings.TrimSuffix(addr, "/") + est.EndpointPrefix + est.TpmActivateEnrollEndpoint
+
+	resp, err := c.request(http.MethodPost, endpoint, est.MimeTypePKCS7, contentType,
+		est.EncodingTypeBase64, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
+	}
+
+	certs, err := parseSimplePkiResponse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse simple PKI response: %w", err)
+	}
+
+	return certs[0], nil
 }
 
 func (c *Client) TpmCertifyEnroll(
@@ -267,7 +698,7 @@ func (c *Client) TpmCertifyEnroll(
 	accepts := est.MimeTypePKCS7
 	transferEncoding := est.EncodingTypeBase64
 
-	resp, err := request(c.client, method, endpoint, accepts, contentType, transferEncoding, body)
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
@@ -308,7 +739,7 @@ func (c *Client) SnpEnroll(addr string, ChipId [64]byte, Tcb uint64,
 	accepts := est.MimeTypePKCS7
 	transferEncoding := est.EncodingTypeBase64
 
-	resp, err := request(c.client, method, endpoint, accepts, contentType, transferEncoding, body)
+	resp, err := c.request(method, endpoint, accepts, contentType, transferEncoding, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
@@ -327,8 +758,7 @@ func (c *Client) SnpEnroll(addr string, ChipId [64]byte, Tcb uint64,
 	return certs[0], nil
 }
 
-func request(
-	client *http.Client,
+func (c *Client) request(
 	method, endpoint, accepts string,
 	contentType, transferEncoding string,
 	body io.Reader,
@@ -350,8 +780,11 @@ func request(
 	if transferEncoding != "" {
 		req.Header.Set(est.TransferEncodingHeader, transferEncoding)
 	}
+	if c.token != "" {
+		req.Header.Set(est.AuthorizationHeader, est.BearerPrefix+c.token)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform HTTP request: %w", err)
 	}
@@ -364,12 +797,35 @@ func request(
 		if err != nil {
 			return nil, fmt.Errorf("failed to read HTTP response body: %w", err)
 		}
-		return nil, fmt.Errorf("HTTP Server responded %v: %v", resp.Status, string(payload))
+		return nil, &HttpError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(payload)),
+			RetryAfter: parseRetryAfter(resp.Header.Get(est.RetryAfterHeader), time.Now()),
+		}
 	}
 
 	return resp, nil
 }
 
+// parseRetryAfter parses the Retry-After header, which contains either the
+// seconds to wait or an HTTP date [RFC9110 10.2.3]
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
 // parseSimplePkiResponse extracts certs from certs-only CMC Simple PKI Response [RFC5272].
 func parseSimplePkiResponse(data []byte) ([]*x509.Certificate, error) {
 
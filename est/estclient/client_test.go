@@ -0,0 +1,439 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+)
+
+type testPki struct {
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	device  *x509.Certificate
+	devKey  *ecdsa.PrivateKey
+	newKey  bool
+	renamed bool
+}
+
+func createTestCert(t *testing.T, tmpl *x509.Certificate, pub *ecdsa.PublicKey,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) *x509.Certificate {
+	tmpl.NotBefore = time.Now()
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// createTestServer creates an EST server stub which requires channel binding
+// for the enrollment requests and client authentication for the simplereenroll
+// request. If newKey is set, the server refuses to re-enroll the key of the
+// client certificate
+func createTestServer(t *testing.T, newKey bool, tlsVersion uint16) (*testPki, *httptest.Server) {
+
+	p := &testPki{newKey: newKey}
+	p.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p.ca = createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &p.caKey.PublicKey, nil, p.caKey)
+
+	p.devKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p.device = createTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		DNSNames:     []string{"device.local"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &p.devKey.PublicKey, p.ca, p.caKey)
+
+	srvKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	srvCert := createTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "EST Server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &srvKey.PublicKey, p.ca, p.caKey)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(est.EndpointPrefix+est.CacertsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		p7, _ := est.EncodePkcs7CertsOnly([]*x509.Certificate{p.ca})
+		w.Write(est.EncodeBase64(p7))
+	})
+	mux.HandleFunc(est.EndpointPrefix+est.EnrollEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		csr, err := est.ParsePkcs10Csr(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := est.VerifyChannelBinding(csr, r.TLS, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := createTestCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(4),
+			RawSubject:   csr.RawSubject,
+		}, csr.PublicKey.(*ecdsa.PublicKey), p.ca, p.caKey)
+		p7, _ := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+		w.Write(est.EncodeBase64(p7))
+	})
+	mux.HandleFunc(est.EndpointPrefix+est.ReenrollEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		current := r.TLS.PeerCertificates[0]
+		csr, err := est.ParsePkcs10Csr(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := est.VerifyChannelBinding(csr, r.TLS, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(csr.RawSubject, current.RawSubject) {
+			http.Error(w, "subject mismatch", http.StatusBadRequest)
+			return
+		}
+		if p.newKey && current.PublicKey.(*ecdsa.PublicKey).Equal(csr.PublicKey) {
+			http.Error(w, "new key required", est.StatusNewKeyRequired)
+			return
+		}
+		change, err := est.ParseChangeSubjectName(csr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(4),
+			RawSubject:   csr.RawSubject,
+			DNSNames:     csr.DNSNames,
+		}
+		if change != nil {
+			p.renamed = true
+			tmpl.RawSubject = change.RawSubject
+			tmpl.DNSNames = change.DNSNames
+		}
+		cert := createTestCert(t, tmpl, csr.PublicKey.(*ecdsa.PublicKey), p.ca, p.caKey)
+		p7, _ := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+		w.Write(est.EncodeBase64(p7))
+	})
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(p.ca)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{srvCert.Raw, p.ca.Raw},
+			PrivateKey:  srvKey,
+		}},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  clientCAs,
+		MinVersion: tlsVersion,
+		MaxVersion: tlsVersion,
+	}
+	srv.StartTLS()
+
+	return p, srv
+}
+
+func TestReenroll(t *testing.T) {
+
+	rotatedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name        string
+		serverNew   bool
+		rotate      bool
+		desiredCn   string
+		wantErr     error
+		wantRenamed bool
+	}{
+		{"Success", false, false, "device", nil, false},
+		{"Success Rotated Key", false, true, "device", nil, false},
+		{"Success Changed Subject", false, false, "renamed", nil, true},
+		{"New Key Required", true, false, "device", ErrNewKeyRequired, false},
+		{"New Key Required Rotated Key", true, true, "device", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, srv := createTestServer(t, tt.serverNew, tls.VersionTLS13)
+			defer srv.Close()
+
+			newKey := p.devKey
+			if tt.rotate {
+				newKey = rotatedKey
+			}
+			der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: tt.desiredCn},
+				DNSNames: []string{"device.local"},
+			}, newKey)
+			desired, _ := x509.ParseCertificateRequest(der)
+
+			chain, err := Reenroll(srv.URL, []*x509.Certificate{p.device, p.ca}, p.devKey,
+				newKey, desired)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Reenroll() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Reenroll() error = %v", err)
+			}
+
+			if len(chain) != 2 || !bytes.Equal(chain[1].Raw, p.ca.Raw) {
+				t.Fatalf("Reenroll() returned unexpected chain of %v certificates", len(chain))
+			}
+			if err := chain[0].CheckSignatureFrom(p.ca); err != nil {
+				t.Errorf("renewed certificate not signed by CA: %v", err)
+			}
+			if !newKey.PublicKey.Equal(chain[0].PublicKey) {
+				t.Errorf("renewed certificate not issued for new key")
+			}
+			if p.renamed != tt.wantRenamed || chain[0].Subject.CommonName != tt.desiredCn {
+				t.Errorf("renewed certificate subject %v, want %v", chain[0].Subject.CommonName,
+					tt.desiredCn)
+			}
+		})
+	}
+}
+
+func TestSimpleReenrollAuthentication(t *testing.T) {
+
+	p, srv := createTestServer(t, false, tls.VersionTLS13)
+	defer srv.Close()
+
+	csr, err := est.CreateReenrollCsr(p.devKey, p.device, nil)
+	if err != nil {
+		t.Fatalf("CreateReenrollCsr() error = %v", err)
+	}
+
+	// Re-enrollment requires a client certificate
+	client := NewClient([]*x509.Certificate{p.ca})
+	if _, err := client.SimpleReenroll(srv.URL, csr); err == nil {
+		t.Errorf("SimpleReenroll() without client certificate succeeded")
+	}
+
+	// Re-enrollment requires server authentication
+	client = NewClient(nil)
+	if err := client.SetClientCertificate([]*x509.Certificate{p.device}, p.devKey); err != nil {
+		t.Fatalf("SetClientCertificate() error = %v", err)
+	}
+	if _, err := client.SimpleReenroll(srv.URL, csr); err == nil {
+		t.Errorf("SimpleReenroll() without server CAs succeeded")
+	}
+
+	// The server must be authenticated with the configured CA
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherCa := createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, &other.PublicKey, nil, other)
+	client.SetCAs([]*x509.Certificate{otherCa})
+	if _, err := client.BindChannel(srv.URL); err == nil {
+		t.Errorf("BindChannel() with untrusted server succeeded")
+	}
+
+	client.SetCAs([]*x509.Certificate{p.ca})
+	binding, err := client.BindChannel(srv.URL)
+	if err != nil {
+		t.Fatalf("BindChannel() error = %v", err)
+	}
+	csr, err = est.AddChannelBinding(csr, p.devKey, binding)
+	if err != nil {
+		t.Fatalf("AddChannelBinding() error = %v", err)
+	}
+	if _, err := client.SimpleReenroll(srv.URL, csr); err != nil {
+		t.Errorf("SimpleReenroll() error = %v", err)
+	}
+}
+
+func TestBoundSimpleEnroll(t *testing.T) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	csr, _ := x509.ParseCertificateRequest(der)
+
+	tests := []struct {
+		name    string
+		version uint16
+	}{
+		{"TLS 1.2", tls.VersionTLS12},
+		{"TLS 1.3", tls.VersionTLS13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, srv := createTestServer(t, false, tt.version)
+			defer srv.Close()
+
+			client := NewClient([]*x509.Certificate{p.ca})
+			cert, err := client.BoundSimpleEnroll(srv.URL, csr, key)
+			if err != nil {
+				t.Fatalf("BoundSimpleEnroll() error = %v", err)
+			}
+			if !key.PublicKey.Equal(cert.PublicKey) {
+				t.Errorf("enrolled certificate not issued for key")
+			}
+
+			// The server must refuse CSRs without channel binding
+			client = NewClient([]*x509.Certificate{p.ca})
+			if _, err := client.SimpleEnroll(srv.URL, csr); err == nil {
+				t.Errorf("SimpleEnroll() without channel binding succeeded")
+			}
+
+			// The server must refuse CSRs bound to another connection
+			other := NewClient([]*x509.Certificate{p.ca})
+			binding, err := other.BindChannel(srv.URL)
+			if err != nil {
+				t.Fatalf("BindChannel() error = %v", err)
+			}
+			bound, err := est.AddChannelBinding(csr, key, binding)
+			if err != nil {
+				t.Fatalf("AddChannelBinding() error = %v", err)
+			}
+			if _, err := client.BindChannel(srv.URL); err != nil {
+				t.Fatalf("BindChannel() error = %v", err)
+			}
+			if _, err := client.SimpleEnroll(srv.URL, bound); err == nil {
+				t.Errorf("SimpleEnroll() with channel binding of other connection succeeded")
+			}
+		})
+	}
+}
+
+func TestCaCerts(t *testing.T) {
+
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &rootKey.PublicKey, nil, rootKey)
+	interKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	inter := createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &interKey.PublicKey, root, rootKey)
+	signerKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Test Signing CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &signerKey.PublicKey, inter, interKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other := createTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(4),
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &otherKey.PublicKey, nil, otherKey)
+
+	tests := []struct {
+		name    string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{"Ordered", []*x509.Certificate{signer, inter, root}, false},
+		{"Shuffled", []*x509.Certificate{root, signer, inter}, false},
+		{"Root First", []*x509.Certificate{root, inter, signer}, false},
+		{"Unrelated CA", []*x509.Certificate{signer, other, inter, root}, true},
+		{"Missing Intermediate", []*x509.Certificate{root, signer}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p7, _ := est.EncodePkcs7CertsOnly(tt.certs)
+				w.Write(est.EncodeBase64(p7))
+			}))
+			defer srv.Close()
+
+			certs, err := NewClient(nil).CaCerts(srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CaCerts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want := []*x509.Certificate{signer, inter, root}
+			if len(certs) != len(want) {
+				t.Fatalf("CaCerts() returned %v certificates, want %v", len(certs), len(want))
+			}
+			for i := range certs {
+				if !certs[i].Equal(want[i]) {
+					t.Errorf("CaCerts() certificate %v = %v, want %v", i,
+						certs[i].Subject.CommonName, want[i].Subject.CommonName)
+				}
+			}
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{now.Add(time.Hour).Format(http.TimeFormat), time.Hour},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
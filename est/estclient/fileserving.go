@@ -41,7 +41,7 @@ func FetchMetadata(addr string) ([][]byte, error) {
 
 	client := NewClient(nil)
 
-	resp, err := request(client.client, http.MethodGet, addr, "", "", "", nil)
+	resp, err := client.request(http.MethodGet, addr, "", "", "", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform request: %w", err)
 	}
@@ -98,7 +98,7 @@ func fetchDataRecursively(client *Client, pre Pre, addr string) ([][]byte, error
 		}
 
 		log.Debug("Requesting ", subpath)
-		resp, err := request(client.client, http.MethodGet, subpath, "", "", "", nil)
+		resp, err := client.request(http.MethodGet, subpath, "", "", "", nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to perform request: %w", err)
 		}
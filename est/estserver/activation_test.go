@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	estclient "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/tpmdriver"
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+func createCa(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return priv, cert
+}
+
+func createEkCert(t *testing.T, pub crypto.PublicKey) []byte {
+	caPriv, ca := createCa(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, pub, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create EK certificate: %v", err)
+	}
+	return der
+}
+
+func marshalPkix(t *testing.T, pub crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return der
+}
+
+func Test_verifyEk(t *testing.T) {
+
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate EK: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ekCert := createEkCert(t, &ek.PublicKey)
+
+	tests := []struct {
+		name    string
+		pub     []byte
+		cert    []byte
+		wantErr bool
+	}{
+		{"Valid", marshalPkix(t, &ek.PublicKey), ekCert, false},
+		{"EK Mismatch", marshalPkix(t, &other.PublicKey), ekCert, true},
+		{"EK Missing", nil, ekCert, true},
+		{"EK Certificate Missing", marshalPkix(t, &ek.PublicKey), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyEk(tt.pub, tt.cert, "STM;1;2", "", &tpmConfig{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyEk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !ek.PublicKey.Equal(got) {
+				t.Errorf("verifyEk() did not return the certified EK")
+			}
+		})
+	}
+}
+
+func Test_completeActivation(t *testing.T) {
+
+	csr := &x509.CertificateRequest{}
+	secret := []byte("secret")
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		expired bool
+		wantErr bool
+	}{
+		{"Valid", secret, false, false},
+		{"Wrong Secret", []byte("wrong"), false, true},
+		{"Expired", secret, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &tpmConfig{}
+			id, err := c.addActivation(csr, secret, nil)
+			if err != nil {
+				t.Fatalf("addActivation() error = %v", err)
+			}
+			if tt.expired {
+				c.activations[id].expires = time.Now().Add(-time.Second)
+			}
+
+			got, _, err := c.completeActivation(id, tt.secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("completeActivation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != csr {
+				t.Errorf("completeActivation() returned wrong CSR")
+			}
+
+			// Each activation can only be completed once
+			if _, _, err := c.completeActivation(id, secret); err == nil {
+				t.Errorf("completeActivation() succeeded twice")
+			}
+		})
+	}
+}
+
+type simulatorChannel struct {
+	io.ReadWriteCloser
+}
+
+func (c *simulatorChannel) MeasurementLog() ([]byte, error) {
+	return nil, nil
+}
+
+// TestTpmActivation requires a TPM simulator such as swtpm, e.g.:
+// swtpm socket --tpm2 --server type=unixio,path=/tmp/swtpm --flags not-need-init,startup-clear
+// TPM_SIMULATOR=/tmp/swtpm go test -run TestTpmActivation
+func TestTpmActivation(t *testing.T) {
+
+	sock := os.Getenv("TPM_SIMULATOR")
+	if sock == "" {
+		t.Skip("TPM_SIMULATOR not set")
+	}
+	rwc, err := tpm2.OpenTPM(sock)
+	if err != nil {
+		t.Fatalf("failed to open TPM simulator: %v", err)
+	}
+	tpm, err := attest.OpenTPM(&attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &simulatorChannel{rwc},
+	})
+	if err != nil {
+		rwc.Close()
+		t.Fatalf("failed to open TPM: %v", err)
+	}
+	defer tpm.Close()
+
+	// Generate the EK and certify it with a test CA
+	eks, err := tpm.EKs()
+	if err != nil {
+		t.Fatalf("failed to get EK: %v", err)
+	}
+	ekCert := createEkCert(t, eks[0].Public)
+	ekPub := marshalPkix(t, eks[0].Public)
+
+	ak, err := tpm.NewAK(nil)
+	if err != nil {
+		t.Fatalf("failed to create AK: %v", err)
+	}
+	defer ak.Close(tpm)
+	der, err := tpmdriver.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{Subject: pkix.Name{CommonName: "Test AK"}}, ak.Private())
+	if err != nil {
+		t.Fatalf("failed to create AK CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse AK CSR: %v", err)
+	}
+
+	caPriv, ca := createCa(t)
+	s := &Server{signingKey: caPriv, signingCerts: []*x509.Certificate{ca}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(est.EndpointPrefix+est.TpmActivateEndpoint, s.handleTpmActivate)
+	mux.HandleFunc(est.EndpointPrefix+est.TpmActivateEnrollEndpoint, s.handleTpmActivateEnroll)
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	client := estclient.NewClient([]*x509.Certificate{srv.Certificate()})
+	params := ak.AttestationParameters()
+
+	// The device must not receive a certificate without activating the credential
+	id, encCredential, encSecret, err := client.TpmActivate(srv.URL, "STM", "", 1, 2, csr,
+		params.Public, params.CreateData, params.CreateAttestation, params.CreateSignature,
+		ekPub, ekCert)
+	if err != nil {
+		t.Fatalf("TpmActivate() error = %v", err)
+	}
+	if _, err := client.TpmActivateEnroll(srv.URL, id, make([]byte, 32)); err == nil {
+		t.Fatalf("TpmActivateEnroll() without activation succeeded")
+	}
+
+	id, encCredential, encSecret, err = client.TpmActivate(srv.URL, "STM", "", 1, 2, csr,
+		params.Public, params.CreateData, params.CreateAttestation, params.CreateSignature,
+		ekPub, ekCert)
+	if err != nil {
+		t.Fatalf("TpmActivate() error = %v", err)
+	}
+	secret, err := tpmdriver.ActivateCredential(tpm, ak, encCredential, encSecret)
+	if err != nil {
+		t.Fatalf("ActivateCredential() error = %v", err)
+	}
+	cert, err := client.TpmActivateEnroll(srv.URL, id, secret)
+	if err != nil {
+		t.Fatalf("TpmActivateEnroll() error = %v", err)
+	}
+	if !publicKeyEqual(cert.PublicKey, csr.PublicKey) {
+		t.Errorf("AK certificate does not certify the AK")
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("AK certificate not signed by CA: %v", err)
+	}
+
+	// Activations cannot be replayed
+	if _, err := client.TpmActivateEnroll(srv.URL, id, secret); err == nil {
+		t.Errorf("replayed TpmActivateEnroll() succeeded")
+	}
+}
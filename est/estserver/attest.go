@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Time the device has to return the attestation report for a nonce
+	nonceTimeout = time.Minute
+	// Maximum number of pending nonces
+	maxNonces = 1024
+)
+
+var policyEngines = map[string]verify.PolicyEngineSelect{
+	"js":      verify.PolicyEngineSelect_JS,
+	"duktape": verify.PolicyEngineSelect_DukTape,
+}
+
+// attestConfig contains the configuration for attested enrollments, which
+// require a fresh attestation report of the device. The report is verified
+// against the CAs of the device identities and metadata
+type attestConfig struct {
+	cas      []byte
+	policies []byte
+	polEng   verify.PolicyEngineSelect
+	cache    string
+	required bool
+
+	noncesMu sync.Mutex
+	nonces   map[string]time.Time
+}
+
+// addNonce creates a new single-use nonce for an attested enrollment
+func (c *attestConfig) addNonce() ([]byte, error) {
+	c.noncesMu.Lock()
+	defer c.noncesMu.Unlock()
+
+	now := time.Now()
+	for n, expires := range c.nonces {
+		if now.After(expires) {
+			delete(c.nonces, n)
+		}
+	}
+	if len(c.nonces) >= maxNonces {
+		return nil, errors.New("too many pending attestation nonces")
+	}
+
+	nonce := make([]byte, est.AttestationNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	if c.nonces == nil {
+		c.nonces = make(map[string]time.Time)
+	}
+	c.nonces[string(nonce)] = now.Add(nonceTimeout)
+
+	return nonce, nil
+}
+
+// consumeNonce removes the nonce and returns an error if it was not issued by
+// the server or has expired
+func (c *attestConfig) consumeNonce(nonce []byte) error {
+	c.noncesMu.Lock()
+	expires, ok := c.nonces[string(nonce)]
+	delete(c.nonces, string(nonce))
+	c.noncesMu.Unlock()
+
+	if !ok {
+		return errors.New("unknown nonce")
+	}
+	if time.Now().After(expires) {
+		return errors.New("nonce expired")
+	}
+	return nil
+}
+
+// verifyReport verifies the attestation report for the nonce bound to the CSR
+// and the optional policies and returns the identity of the prover
+func (c *attestConfig) verifyReport(report []byte, serverNonce []byte,
+	csr *x509.CertificateRequest,
+) (*deviceIdentity, error) {
+
+	result := verify.Verify(report, est.AttestationNonce(serverNonce, csr), c.cas, c.policies,
+		c.polEng, c.cache)
+	if !result.Success {
+		return nil, fmt.Errorf("verification of attestation report for prover %v failed (%v)",
+			result.Prover, describeFailure(&result))
+	}
+	// The nonce is only contained in the measurements, a report without
+	// measurements is not fresh and not bound to the CSR
+	if len(result.Measurements) == 0 {
+		return nil, fmt.Errorf("attestation report of prover %v does not contain measurements",
+			result.Prover)
+	}
+
+	log.Debugf("Verified attestation report of prover %v", result.Prover)
+
+	return &deviceIdentity{Id: result.Prover, Source: "attestation report"}, nil
+}
+
+func describeFailure(result *ar.VerificationResult) string {
+	if result.ErrorCode != ar.NotSet {
+		return fmt.Sprintf("error code %v", result.ErrorCode)
+	}
+	for _, m := range result.Measurements {
+		if !m.Summary.Success {
+			return fmt.Sprintf("%v failed", m.Type)
+		}
+	}
+	return "metadata verification failed"
+}
+
+// handleAttestNonce returns a fresh nonce the device must create the attestation
+// report of the subsequent attestenroll request for
+func (s *Server) handleAttestNonce(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'attestnonce' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodGet {
+		writeHttpErrorf(w, "Method %v not implemented for attestnonce request", req.Method)
+		return
+	}
+
+	nonce, err := s.attestConf.addNonce()
+	if err != nil {
+		writeProblem(w, http.StatusServiceUnavailable, nonceTimeout, "Failed to create nonce: %v", err)
+		return
+	}
+
+	err = sendResponse(w, est.MimeTypeOctetStream, "", nonce)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to send nonce: %v", err)
+	}
+}
+
+// handleAttestEnroll issues the certificate for the CSR if the attached
+// attestation report was created for the server nonce bound to the CSR and is
+// successfully verified. The attestation report authenticates the request,
+// the identity of the prover is the device identity
+func (s *Server) handleAttestEnroll(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'attestenroll' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodPost {
+		writeHttpErrorf(w, "Method %v not implemented for attestenroll request", req.Method)
+		return
+	}
+
+	var nonce []byte
+	var csr *x509.CertificateRequest
+	var report []byte
+
+	_, err := est.DecodeMultipart(
+		req.Body,
+		[]est.MimeMultipart{
+			{ContentType: est.MimeTypeOctetStream, Data: &nonce},
+			{ContentType: est.MimeTypePKCS10, Data: &csr},
+			{ContentType: est.MimeTypeOctetStream, Data: &report},
+		},
+		req.Header.Get(est.ContentTypeHeader),
+	)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to decode multipart: %v", err)
+		return
+	}
+
+	err = est.VerifyChannelBinding(csr, req.TLS, s.channelBinding)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to verify channel binding: %v", err)
+		return
+	}
+
+	if err := s.attestConf.consumeNonce(nonce); err != nil {
+		writeProblem(w, http.StatusUnauthorized, 0, "Invalid attestation nonce from %v: %v",
+			sourceIp(req), err)
+		return
+	}
+
+	device, err := s.attestConf.verifyReport(report, nonce, csr)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, 0, "Failed to verify attestation of %v: %v",
+			sourceIp(req), err)
+		return
+	}
+
+	cert := s.issueCert(w, req, csr, &requester{device: device, auth: authAttestation})
+	if cert == nil {
+		return
+	}
+
+	body, err := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+	if err != nil {
+		writeHttpErrorf(w, "Failed to encode PKCS7 certs-only: %v", err)
+		return
+	}
+	encoded := est.EncodeBase64(body)
+
+	err = sendResponse(w, est.MimeTypePKCS7, est.EncodingTypeBase64, encoded)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to send generated certificate: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	estclient "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// testProver is a software driver with a certificate of the attestation CA,
+// which measures the signed nonce like the SW driver
+type testProver struct {
+	priv  *ecdsa.PrivateKey
+	chain []*x509.Certificate
+	s     ar.Serializer
+}
+
+func (p *testProver) Init(c *ar.DriverConfig) error { return nil }
+func (p *testProver) Lock() error                   { return nil }
+func (p *testProver) Unlock() error                 { return nil }
+
+func (p *testProver) Measure(nonce []byte) (ar.Measurement, error) {
+	evidence, err := p.s.Sign(nonce, p)
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+	return ar.Measurement{
+		Type:     "SW Measurement",
+		Evidence: evidence,
+		Certs:    internal.WriteCertsDer(p.chain),
+	}, nil
+}
+
+func (p *testProver) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return p.priv, &p.priv.PublicKey, nil
+}
+
+func (p *testProver) GetCertChain() ([]*x509.Certificate, error) {
+	return p.chain, nil
+}
+
+func createProver(t *testing.T, caPriv *ecdsa.PrivateKey, ca *x509.Certificate) *testProver {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Prover"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create prover certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse prover certificate: %v", err)
+	}
+	return &testProver{priv: priv, chain: []*x509.Certificate{cert, ca}, s: ar.JsonSerializer{}}
+}
+
+// createMetadata returns the signed manifests and device description of the prover
+func createMetadata(t *testing.T, p *testProver, device string) [][]byte {
+	validity := ar.Validity{
+		NotBefore: time.Now().Add(-time.Hour).Format(time.RFC3339),
+		NotAfter:  time.Now().Add(time.Hour).Format(time.RFC3339),
+	}
+	objects := []interface{}{
+		ar.RtmManifest{
+			MetaInfo:           ar.MetaInfo{Type: "RTM Manifest", Name: "de.test.rtm"},
+			DevCommonName:      "Test Developer",
+			Validity:           validity,
+			CertificationLevel: 1,
+		},
+		ar.OsManifest{
+			MetaInfo:           ar.MetaInfo{Type: "OS Manifest", Name: "de.test.os"},
+			DevCommonName:      "Test Developer",
+			Validity:           validity,
+			CertificationLevel: 1,
+			Rtms:               []string{"de.test.rtm"},
+		},
+		ar.DeviceDescription{
+			MetaInfo:    ar.MetaInfo{Type: "Device Description", Name: device},
+			RtmManifest: "de.test.rtm",
+			OsManifest:  "de.test.os",
+		},
+	}
+	var metadata [][]byte
+	for _, o := range objects {
+		data, err := p.s.Marshal(o)
+		if err != nil {
+			t.Fatalf("failed to marshal metadata: %v", err)
+		}
+		signed, err := generate.Sign(data, p, p.s)
+		if err != nil {
+			t.Fatalf("failed to sign metadata: %v", err)
+		}
+		metadata = append(metadata, signed)
+	}
+	return metadata
+}
+
+func TestAttestEnroll(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	attPriv, attCa := createCa(t)
+	prover := createProver(t, attPriv, attCa)
+	metadata := createMetadata(t, prover, "test-device")
+
+	untrustedPriv, untrustedCa := createCa(t)
+	untrusted := createProver(t, untrustedPriv, untrustedCa)
+	untrustedMetadata := createMetadata(t, untrusted, "test-device")
+
+	attest := func(p *testProver, metadata [][]byte) func([]byte) ([]byte, error) {
+		return func(nonce []byte) ([]byte, error) {
+			report, err := generate.Generate(nonce, metadata, []ar.Driver{p}, p.s)
+			if err != nil {
+				return nil, err
+			}
+			return generate.Sign(report, p, p.s)
+		}
+	}
+
+	s := &Server{
+		signingKey:   caPriv,
+		signingCerts: []*x509.Certificate{ca},
+		attestConf:   &attestConfig{cas: internal.WriteCertPem(attCa), required: true},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(est.EndpointPrefix+est.AttestNonceEndpoint, s.handleAttestNonce)
+	mux.HandleFunc(est.EndpointPrefix+est.AttestEnrollEndpoint, s.handleAttestEnroll)
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		attest     func([]byte) ([]byte, error)
+		wantStatus int
+	}{
+		{"Success", attest(prover, metadata), http.StatusOK},
+		{"Wrong Nonce", func([]byte) ([]byte, error) {
+			return attest(prover, metadata)(make([]byte, est.AttestationNonceLength))
+		}, http.StatusForbidden},
+		{"Untrusted Prover", attest(untrusted, untrustedMetadata), http.StatusForbidden},
+		{"No Measurements", func(nonce []byte) ([]byte, error) {
+			report, err := generate.Generate(nonce, metadata, nil, prover.s)
+			if err != nil {
+				return nil, err
+			}
+			return generate.Sign(report, prover, prover.s)
+		}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			csr := createCsr(t, key)
+
+			client := estclient.NewClient([]*x509.Certificate{srv.Certificate()})
+			cert, err := client.AttestEnroll(srv.URL, csr, key, tt.attest)
+
+			if tt.wantStatus != http.StatusOK {
+				var httpErr *estclient.HttpError
+				if !errors.As(err, &httpErr) || httpErr.StatusCode != tt.wantStatus {
+					t.Fatalf("AttestEnroll() error = %v, want status %v", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AttestEnroll() error = %v", err)
+			}
+			if !publicKeyEqual(cert.PublicKey, &key.PublicKey) {
+				t.Errorf("certificate does not certify the CSR key")
+			}
+			if err := cert.CheckSignatureFrom(ca); err != nil {
+				t.Errorf("certificate not signed by CA: %v", err)
+			}
+		})
+	}
+
+	t.Run("Simpleenroll Refused", func(t *testing.T) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		req := httptest.NewRequest(http.MethodPost, est.EndpointPrefix+est.EnrollEndpoint,
+			bytes.NewReader(est.EncodeBase64(createCsr(t, key).Raw)))
+		req.Header.Set(est.ContentTypeHeader, est.MimeTypePKCS10)
+		req.TLS = &tls.ConnectionState{}
+		w := httptest.NewRecorder()
+
+		s.handleSimpleenroll(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("handleSimpleenroll() status = %v, want %v", w.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func Test_attestConfigNonces(t *testing.T) {
+
+	c := &attestConfig{}
+
+	nonce, err := c.addNonce()
+	if err != nil {
+		t.Fatalf("addNonce() error = %v", err)
+	}
+	if len(nonce) != est.AttestationNonceLength {
+		t.Fatalf("nonce length = %v, want %v", len(nonce), est.AttestationNonceLength)
+	}
+	if err := c.consumeNonce(nonce); err != nil {
+		t.Fatalf("consumeNonce() error = %v", err)
+	}
+	if err := c.consumeNonce(nonce); err == nil {
+		t.Fatalf("consumeNonce() succeeded twice")
+	}
+	if err := c.consumeNonce(make([]byte, est.AttestationNonceLength)); err == nil {
+		t.Fatalf("consumeNonce() succeeded for unknown nonce")
+	}
+
+	nonce, _ = c.addNonce()
+	c.nonces[string(nonce)] = time.Now().Add(-time.Second)
+	if err := c.consumeNonce(nonce); err == nil {
+		t.Fatalf("consumeNonce() succeeded for expired nonce")
+	}
+
+	for i := 0; i < maxNonces; i++ {
+		if _, err := c.addNonce(); err != nil {
+			t.Fatalf("addNonce() %v error = %v", i, err)
+		}
+	}
+	if _, err := c.addNonce(); err == nil {
+		t.Fatalf("addNonce() succeeded with %v pending nonces", maxNonces)
+	}
+}
+
+func createCsr(t *testing.T, key crypto.Signer) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatalf("failed to create CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse CSR: %v", err)
+	}
+	return csr
+}
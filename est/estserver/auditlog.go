@@ -0,0 +1,406 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// Authentication methods of the requester recorded in the issuance log
+const (
+	authNone        = "none"
+	authClientCert  = "client certificate"
+	authToken       = "bootstrap token"
+	authActivation  = "credential activation"
+	authActivatedAk = "activated AK"
+	authAttestation = "attestation report"
+)
+
+// requester is the authenticated origin of an enrollment request
+type requester struct {
+	device *deviceIdentity
+	auth   string
+}
+
+// auditEntry is an entry of the issuance log. The JSON encoding of the entry
+// is the Merkle tree leaf
+type auditEntry struct {
+	Timestamp      time.Time `json:"timestamp"`
+	Source         string    `json:"source"`
+	DeviceId       string    `json:"deviceId,omitempty"`
+	IdentitySource string    `json:"identitySource,omitempty"`
+	AuthMethod     string    `json:"authMethod"`
+	Profile        string    `json:"profile,omitempty"`
+	Subject        string    `json:"subject"`
+	Serial         string    `json:"serial"`
+	CsrSha256      string    `json:"csrSha256"`
+	CertSha256     string    `json:"certSha256"`
+}
+
+// issuanceLog is the append-only log of all issued certificates. Entries are
+// stored as JSON lines and synced to disk before the certificate is returned.
+// The root hash of the Merkle tree over all entries is periodically signed with
+// the CA key and published together with inclusion and consistency proofs
+type issuanceLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	entries [][]byte
+	leaves  [][]byte
+	certs   map[string]uint64
+	signer  crypto.Signer
+	sth     *est.SignedTreeHead
+	now     func() time.Time
+}
+
+// openIssuanceLog opens or creates the issuance log file. An incomplete last
+// entry, which results from a crash during the write, is discarded
+func openIssuanceLog(file string, signer crypto.Signer) (*issuanceLog, error) {
+
+	_, err := os.Stat(file)
+	created := errors.Is(err, os.ErrNotExist)
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open issuance log: %w", err)
+	}
+	if created {
+		if err := syncDir(filepath.Dir(file)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	l := &issuanceLog{
+		file:   f,
+		certs:  make(map[string]uint64),
+		signer: signer,
+		now:    time.Now,
+	}
+	if err := l.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	log.Infof("Loaded issuance log %v with %v entries", file, len(l.entries))
+
+	return l, nil
+}
+
+func (l *issuanceLog) load() error {
+
+	data, err := os.ReadFile(l.file.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read issuance log: %w", err)
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		log.Warnf("Discarding incomplete last entry of issuance log (%v bytes)",
+			len(data)-complete)
+		if err := l.file.Truncate(int64(complete)); err != nil {
+			return fmt.Errorf("failed to truncate issuance log: %w", err)
+		}
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync issuance log: %w", err)
+		}
+	}
+	l.size = int64(complete)
+
+	lines := bytes.Split(data[:complete], []byte{'\n'})
+	for i, line := range lines[:len(lines)-1] {
+		var e auditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("corrupt issuance log entry %v: %w", i, err)
+		}
+		l.add(line, e.CertSha256)
+	}
+
+	return nil
+}
+
+func (l *issuanceLog) add(entry []byte, certSha256 string) {
+	l.certs[certSha256] = uint64(len(l.entries))
+	l.entries = append(l.entries, entry)
+	l.leaves = append(l.leaves, est.LeafHash(entry))
+}
+
+// append durably appends the entry to the log. The entry is written with a
+// single write and synced, so that it is either completely stored or discarded
+// on the next start
+func (l *issuanceLog) append(e *auditEntry) error {
+
+	entry, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal issuance log entry: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.file.Write(append(entry, '\n'))
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		if terr := l.file.Truncate(l.size); terr != nil {
+			log.Errorf("Failed to remove partial issuance log entry: %v", terr)
+		}
+		return fmt.Errorf("failed to write issuance log entry: %w", err)
+	}
+	l.size += int64(len(entry)) + 1
+
+	l.add(entry, e.CertSha256)
+
+	return nil
+}
+
+// sign creates and publishes a new signed tree head of the current log
+func (l *issuanceLog) sign() error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sth := &est.SignedTreeHead{
+		TreeSize:  uint64(len(l.leaves)),
+		Timestamp: l.now().UnixMilli(),
+		RootHash:  est.RootHash(l.leaves),
+	}
+	digest := sha256.Sum256(sth.SignedData())
+	sig, err := l.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign tree head: %w", err)
+	}
+	sth.Signature = sig
+	l.sth = sth
+
+	log.Debugf("Published signed tree head of size %v", sth.TreeSize)
+
+	return nil
+}
+
+// publish signs the tree head immediately and then in the specified interval
+func (l *issuanceLog) publish(interval time.Duration) error {
+	if err := l.sign(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := l.sign(); err != nil {
+				log.Errorf("Failed to publish tree head: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func newAuditEntry(req *http.Request, csr *x509.CertificateRequest, cert *x509.Certificate,
+	r *requester, profile string,
+) *auditEntry {
+	csrHash := sha256.Sum256(csr.Raw)
+	certHash := sha256.Sum256(cert.Raw)
+	e := &auditEntry{
+		Timestamp:  time.Now().UTC(),
+		Source:     sourceIp(req),
+		AuthMethod: r.auth,
+		Profile:    profile,
+		Subject:    cert.Subject.String(),
+		Serial:     cert.SerialNumber.Text(16),
+		CsrSha256:  hex.EncodeToString(csrHash[:]),
+		CertSha256: hex.EncodeToString(certHash[:]),
+	}
+	if r.device != nil {
+		e.DeviceId = r.device.Id
+		e.IdentitySource = r.device.Source
+	}
+	return e
+}
+
+// handleSth returns the latest signed tree head
+func (l *issuanceLog) handleSth(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'sth' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodGet {
+		writeHttpErrorf(w, "Method %v not implemented for sth request", req.Method)
+		return
+	}
+
+	l.mu.Lock()
+	sth := l.sth
+	l.mu.Unlock()
+
+	sendJson(w, sth)
+}
+
+// handleInclusion returns the inclusion proof of the entry with the index or
+// the certificate with the SHA256 hash in the tree of the specified size. The
+// size of the latest signed tree head is used by default
+func (l *issuanceLog) handleInclusion(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'inclusion' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodGet {
+		writeHttpErrorf(w, "Method %v not implemented for inclusion request", req.Method)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q := req.URL.Query()
+	size, err := l.treeSize(q.Get("treeSize"))
+	if err != nil {
+		writeHttpErrorf(w, "Invalid tree size: %v", err)
+		return
+	}
+
+	var index uint64
+	if h := q.Get("certSha256"); h != "" {
+		i, ok := l.certs[h]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Certificate %v not found in issuance log", h),
+				http.StatusNotFound)
+			return
+		}
+		index = i
+	} else {
+		index, err = strconv.ParseUint(q.Get("index"), 10, 64)
+		if err != nil {
+			writeHttpErrorf(w, "Invalid leaf index: %v", err)
+			return
+		}
+	}
+	if index >= size {
+		http.Error(w, fmt.Sprintf("Entry %v not included in tree of size %v", index, size),
+			http.StatusNotFound)
+		return
+	}
+
+	path, err := est.ComputeInclusionProof(l.leaves[:size], index)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to compute inclusion proof: %v", err)
+		return
+	}
+
+	sendJson(w, &est.InclusionProof{
+		LeafIndex: index,
+		TreeSize:  size,
+		LeafHash:  l.leaves[index],
+		Entry:     l.entries[index],
+		AuditPath: path,
+	})
+}
+
+// handleConsistency returns the consistency proof between the trees of the
+// first and second size. The size of the latest signed tree head is used as
+// second size by default
+func (l *issuanceLog) handleConsistency(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'consistency' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodGet {
+		writeHttpErrorf(w, "Method %v not implemented for consistency request", req.Method)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q := req.URL.Query()
+	second, err := l.treeSize(q.Get("second"))
+	if err != nil {
+		writeHttpErrorf(w, "Invalid second tree size: %v", err)
+		return
+	}
+	first, err := strconv.ParseUint(q.Get("first"), 10, 64)
+	if err != nil {
+		writeHttpErrorf(w, "Invalid first tree size: %v", err)
+		return
+	}
+
+	path, err := est.ComputeConsistencyProof(l.leaves[:second], first)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to compute consistency proof: %v", err)
+		return
+	}
+
+	sendJson(w, &est.ConsistencyProof{
+		First:  first,
+		Second: second,
+		Path:   path,
+	})
+}
+
+// treeSize parses the requested tree size, which defaults to the size of the
+// latest signed tree head. The caller must hold the lock
+func (l *issuanceLog) treeSize(s string) (uint64, error) {
+	if s == "" {
+		if l.sth == nil {
+			return 0, errors.New("no tree head published")
+		}
+		return l.sth.TreeSize, nil
+	}
+	size, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size > uint64(len(l.leaves)) {
+		return 0, fmt.Errorf("tree size %v exceeds log size %v", size, len(l.leaves))
+	}
+	return size, nil
+}
+
+func sendJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to marshal response: %v", err)
+		return
+	}
+	if err := sendResponse(w, est.MimeTypeJSON, "", data); err != nil {
+		log.Warnf("Failed to send response: %v", err)
+	}
+}
+
+// syncDir syncs the directory, so that a newly created file survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %v: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %v: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+)
+
+func Test_issuanceLog(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	file := filepath.Join(t.TempDir(), "issuance.log")
+
+	auditLog, err := openIssuanceLog(file, caPriv)
+	if err != nil {
+		t.Fatalf("openIssuanceLog() error = %v", err)
+	}
+	s := &Server{
+		signingKey:   caPriv,
+		signingCerts: []*x509.Certificate{ca},
+		auditLog:     auditLog,
+	}
+
+	// Enroll certificates, which are recorded in the issuance log
+	var certs []*x509.Certificate
+	for i := 0; i < 3; i++ {
+		csr := createPolicyCsr(t, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: fmt.Sprintf("device-%v", i)},
+		})
+		req := httptest.NewRequest(http.MethodPost, est.EndpointPrefix+est.EnrollEndpoint,
+			bytes.NewReader(est.EncodeBase64(csr.Raw)))
+		req.Header.Set(est.ContentTypeHeader, est.MimeTypePKCS10)
+		req.TLS = &tls.ConnectionState{}
+		w := httptest.NewRecorder()
+
+		s.handleSimpleenroll(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("handleSimpleenroll() status = %v", w.Code)
+		}
+		certs = append(certs, decodeCertResponse(t, w.Result()))
+
+		if i == 0 {
+			if err := auditLog.sign(); err != nil {
+				t.Fatalf("sign() error = %v", err)
+			}
+		}
+	}
+	first := getJson[est.SignedTreeHead](t, auditLog.handleSth, "")
+	if err := auditLog.sign(); err != nil {
+		t.Fatalf("sign() error = %v", err)
+	}
+	sth := getJson[est.SignedTreeHead](t, auditLog.handleSth, "")
+	if err := est.VerifyTreeHead(sth, ca); err != nil {
+		t.Fatalf("VerifyTreeHead() error = %v", err)
+	}
+	if sth.TreeSize != 3 {
+		t.Fatalf("tree size = %v, want 3", sth.TreeSize)
+	}
+
+	// Verify the inclusion of each certificate via its hash
+	for i, cert := range certs {
+		h := sha256.Sum256(cert.Raw)
+		proof := getJson[est.InclusionProof](t, auditLog.handleInclusion,
+			"certSha256="+hex.EncodeToString(h[:]))
+		if err := est.VerifyInclusion(proof, sth.RootHash); err != nil {
+			t.Fatalf("VerifyInclusion() error = %v", err)
+		}
+		var e auditEntry
+		if err := json.Unmarshal(proof.Entry, &e); err != nil {
+			t.Fatalf("failed to unmarshal entry: %v", err)
+		}
+		if proof.LeafIndex != uint64(i) || e.AuthMethod != authNone ||
+			e.Subject != cert.Subject.String() {
+			t.Fatalf("unexpected entry %v: %+v", proof.LeafIndex, e)
+		}
+	}
+
+	// Verify the log only has been appended since the first tree head
+	proof := getJson[est.ConsistencyProof](t, auditLog.handleConsistency,
+		fmt.Sprintf("first=%v", first.TreeSize))
+	if err := est.VerifyConsistency(proof, first.RootHash, sth.RootHash); err != nil {
+		t.Fatalf("VerifyConsistency() error = %v", err)
+	}
+
+	// Simulate a crash during the write of an entry
+	auditLog.file.Close()
+	f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte(`{"timestamp":`))
+	f.Close()
+
+	reopened, err := openIssuanceLog(file, caPriv)
+	if err != nil {
+		t.Fatalf("openIssuanceLog() error = %v", err)
+	}
+	defer reopened.file.Close()
+	if len(reopened.entries) != 3 ||
+		!bytes.Equal(est.RootHash(reopened.leaves), sth.RootHash) {
+		t.Fatalf("reopened log with %v entries does not match tree head", len(reopened.entries))
+	}
+	if err := reopened.append(&auditEntry{CertSha256: "00"}); err != nil {
+		t.Fatalf("append() error = %v", err)
+	}
+	if _, err := openIssuanceLog(file, caPriv); err != nil {
+		t.Fatalf("openIssuanceLog() after recovery error = %v", err)
+	}
+}
+
+func getJson[T any](t *testing.T, h http.HandlerFunc, query string) *T {
+	req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request %v failed with status %v: %v", query, w.Code, w.Body.String())
+	}
+	v := new(T)
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	return v
+}
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
@@ -26,8 +27,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
 )
@@ -54,12 +57,50 @@ type config struct {
 	VerifyEkCert    bool     `json:"verifyEkCert"`
 	TpmEkCertDb     string   `json:"tpmEkCertDb,omitempty"`
 	VcekCacheFolder string   `json:"vcekCacheFolder,omitempty"`
-	LogLevel        string   `json:"logLevel"`
-
-	signingKey   *ecdsa.PrivateKey
-	signingCerts []*x509.Certificate
-	estKey       *ecdsa.PrivateKey
-	estCerts     []*x509.Certificate
+	ReenrollNewKey  bool     `json:"reenrollNewKey,omitempty"`
+	ChannelBinding  bool     `json:"channelBinding,omitempty"`
+	TokenAuth       bool     `json:"tokenAuth,omitempty"`
+	TokenFile       string   `json:"tokenFile,omitempty"`
+	AdminAddr       string   `json:"adminAddr,omitempty"`
+	IpRateLimit     int      `json:"ipRateLimit,omitempty"`
+	TokenRateLimit  int      `json:"tokenRateLimit,omitempty"`
+	// Optional PKCS#11 token containing the signing key instead of the signing key file
+	Pkcs11Module   string `json:"pkcs11Module,omitempty"`
+	Pkcs11Token    string `json:"pkcs11Token,omitempty"`
+	Pkcs11Slot     string `json:"pkcs11Slot,omitempty"`
+	Pkcs11KeyLabel string `json:"pkcs11KeyLabel,omitempty"`
+	Pkcs11KeyId    string `json:"pkcs11KeyId,omitempty"`
+	Pkcs11Pin      string `json:"pkcs11Pin,omitempty"`
+	// Optional policy for the identities requested in the CSRs
+	CsrPolicy *csrPolicy `json:"csrPolicy,omitempty"`
+	// Optional named certificate profiles, which can be requested via the CA label
+	CertProfiles map[string]*certProfile `json:"certProfiles,omitempty"`
+	// Optional append-only log of the issued certificates and the interval in
+	// which its signed tree head is published
+	AuditLog            string `json:"auditLog,omitempty"`
+	AuditLogSthInterval string `json:"auditLogSthInterval,omitempty"`
+	// Optional attested enrollment: CAs of the device identities and metadata the
+	// attestation reports are verified against, optional policies and engine
+	AttestationCas          []string `json:"attestationCas,omitempty"`
+	AttestationPolicies     string   `json:"attestationPolicies,omitempty"`
+	AttestationPolicyEngine string   `json:"attestationPolicyEngine,omitempty"`
+	RequireAttestation      bool     `json:"requireAttestation,omitempty"`
+	// Optional revocation state file, interval in which the CRL is regenerated
+	// and the CRL distribution point embedded into the issued certificates
+	RevocationFile string `json:"revocationFile,omitempty"`
+	CrlInterval    string `json:"crlInterval,omitempty"`
+	CrlUrl         string `json:"crlUrl,omitempty"`
+	LogLevel       string `json:"logLevel"`
+
+	attestationCas      []byte
+	attestationPolicies []byte
+	attestationPolEng   verify.PolicyEngineSelect
+	sthInterval         time.Duration
+	crlInterval         time.Duration
+	signingKey          crypto.Signer
+	signingCerts        []*x509.Certificate
+	estKey              *ecdsa.PrivateKey
+	estCerts            []*x509.Certificate
 }
 
 const (
@@ -73,6 +114,15 @@ const (
 	verifyEkCertFlag    = "verifyek"
 	tpmEkCertDbFlag     = "ekdb"
 	vcekCacheFolderFlag = "vcekfolder"
+	reenrollNewKeyFlag  = "reenrollnewkey"
+	channelBindingFlag  = "channelbinding"
+	tokenAuthFlag       = "tokenauth"
+	tokenFileFlag       = "tokenfile"
+	adminAddrFlag       = "adminaddr"
+	auditLogFlag        = "auditlog"
+	attestationCasFlag  = "attestationcas"
+	requireAttestFlag   = "requireattestation"
+	revocationFileFlag  = "revocationfile"
 	logFlag             = "log"
 )
 
@@ -92,15 +142,32 @@ func getConfig() (*config, error) {
 		"Indicates whether to verify TPM EK certificate chains")
 	tpmEkCertDb := flag.String(tpmEkCertDbFlag, "", "Database for EK cert chain verification")
 	vcekCacheFolder := flag.String(vcekCacheFolderFlag, "", "Folder to cache AMD SNP VCEKs")
+	reenrollNewKey := flag.Bool(reenrollNewKeyFlag, false,
+		"Indicates whether re-enrollments require a new key")
+	channelBinding := flag.Bool(channelBindingFlag, false,
+		"Indicates whether CSRs must be bound to the TLS connection")
+	tokenAuth := flag.Bool(tokenAuthFlag, false,
+		"Indicates whether enrollments require a bootstrap token or client certificate")
+	tokenFile := flag.String(tokenFileFlag, "", "File containing the bootstrap tokens")
+	adminAddr := flag.String(adminAddrFlag, "", "Local address of the admin API")
+	auditLog := flag.String(auditLogFlag, "", "Append-only log of the issued certificates")
+	attestationCas := flag.String(attestationCasFlag, "",
+		"CAs for verifying the attestation reports of attested enrollments")
+	requireAttestation := flag.Bool(requireAttestFlag, false,
+		"Indicates whether simpleenroll requests are refused in favor of attested enrollments")
+	revocationFile := flag.String(revocationFileFlag, "",
+		"File containing the revoked certificates")
 	logLevel := flag.String(logFlag, "",
 		fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
 	flag.Parse()
 
 	// Create default configuration
 	c := &config{
-		Port:         9000,
-		VerifyEkCert: true,
-		LogLevel:     "info",
+		Port:                9000,
+		VerifyEkCert:        true,
+		AuditLogSthInterval: "10m",
+		CrlInterval:         "1h",
+		LogLevel:            "info",
 	}
 
 	// Obtain custom configuration from file if specified
@@ -143,6 +210,33 @@ func getConfig() (*config, error) {
 	if internal.FlagPassed(vcekCacheFolderFlag) {
 		c.VcekCacheFolder = *vcekCacheFolder
 	}
+	if internal.FlagPassed(reenrollNewKeyFlag) {
+		c.ReenrollNewKey = *reenrollNewKey
+	}
+	if internal.FlagPassed(channelBindingFlag) {
+		c.ChannelBinding = *channelBinding
+	}
+	if internal.FlagPassed(tokenAuthFlag) {
+		c.TokenAuth = *tokenAuth
+	}
+	if internal.FlagPassed(tokenFileFlag) {
+		c.TokenFile = *tokenFile
+	}
+	if internal.FlagPassed(adminAddrFlag) {
+		c.AdminAddr = *adminAddr
+	}
+	if internal.FlagPassed(auditLogFlag) {
+		c.AuditLog = *auditLog
+	}
+	if internal.FlagPassed(attestationCasFlag) {
+		c.AttestationCas = strings.Split(*attestationCas, ",")
+	}
+	if internal.FlagPassed(requireAttestFlag) {
+		c.RequireAttestation = *requireAttestation
+	}
+	if internal.FlagPassed(revocationFileFlag) {
+		c.RevocationFile = *revocationFile
+	}
 	if internal.FlagPassed(logFlag) {
 		c.LogLevel = *logLevel
 	}
@@ -153,7 +247,7 @@ func getConfig() (*config, error) {
 		flag.Usage()
 		log.Fatalf("LogLevel %v does not exist", c.LogLevel)
 	}
-	log.SetLevel(l)
+	internal.SetLogLevel(l)
 
 	// Convert all paths to absolute paths
 	pathsToAbs(c)
@@ -162,14 +256,9 @@ func getConfig() (*config, error) {
 	printConfig(c)
 
 	// Load specified files
-	c.signingKey, err = loadPrivateKey(c.SigningKey)
+	c.signingKey, c.signingCerts, err = loadSigner(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load private key: %w", err)
-	}
-
-	c.signingCerts, err = loadCertChain(c.SigningCerts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate chain: %w", err)
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
 	}
 
 	c.estKey, err = loadPrivateKey(c.EstKey)
@@ -182,6 +271,51 @@ func getConfig() (*config, error) {
 		return nil, fmt.Errorf("failed to load certificate chain: %w", err)
 	}
 
+	if c.CsrPolicy != nil {
+		if err := c.CsrPolicy.init(); err != nil {
+			return nil, fmt.Errorf("invalid CSR policy: %w", err)
+		}
+	}
+
+	if err := initProfiles(c.CertProfiles); err != nil {
+		return nil, fmt.Errorf("invalid certificate profiles: %w", err)
+	}
+
+	for _, f := range c.AttestationCas {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attestation CA: %w", err)
+		}
+		c.attestationCas = append(c.attestationCas, data...)
+	}
+	if c.AttestationPolicies != "" {
+		c.attestationPolicies, err = os.ReadFile(c.AttestationPolicies)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attestation policies: %w", err)
+		}
+		if c.AttestationPolicyEngine == "" {
+			c.AttestationPolicyEngine = "js"
+		}
+		c.attestationPolEng, ok = policyEngines[strings.ToLower(c.AttestationPolicyEngine)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported attestation policy engine %q (supported: %v)",
+				c.AttestationPolicyEngine, strings.Join(maps.Keys(policyEngines), ","))
+		}
+	}
+
+	c.sthInterval, err = time.ParseDuration(c.AuditLogSthInterval)
+	if err != nil || c.sthInterval <= 0 {
+		return nil, fmt.Errorf("invalid tree head interval %q", c.AuditLogSthInterval)
+	}
+
+	c.crlInterval, err = time.ParseDuration(c.CrlInterval)
+	if err != nil || c.crlInterval <= 0 {
+		return nil, fmt.Errorf("invalid CRL interval %q", c.CrlInterval)
+	}
+	if c.CrlUrl != "" && c.RevocationFile == "" {
+		log.Warn("CRL distribution point configured, but revocation disabled")
+	}
+
 	if !c.VerifyEkCert {
 		log.Warn("UNSAFE: Verification of EK certificate chain turned off via config")
 	}
@@ -191,9 +325,11 @@ func getConfig() (*config, error) {
 
 func pathsToAbs(c *config) {
 	var err error
-	c.SigningKey, err = filepath.Abs(c.SigningKey)
-	if err != nil {
-		log.Warnf("Failed to get absolute path for %v: %v", c.signingKey, err)
+	if c.SigningKey != "" {
+		c.SigningKey, err = filepath.Abs(c.SigningKey)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.SigningKey, err)
+		}
 	}
 
 	for i := 0; i < len(c.SigningCerts); i++ {
@@ -225,6 +361,41 @@ func pathsToAbs(c *config) {
 		log.Warnf("Failed to get absolute path for %v: %v", c.HttpFolder, err)
 	}
 
+	if c.TokenFile != "" {
+		c.TokenFile, err = filepath.Abs(c.TokenFile)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.TokenFile, err)
+		}
+	}
+
+	if c.RevocationFile != "" {
+		c.RevocationFile, err = filepath.Abs(c.RevocationFile)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.RevocationFile, err)
+		}
+	}
+
+	for i := 0; i < len(c.AttestationCas); i++ {
+		c.AttestationCas[i], err = filepath.Abs(c.AttestationCas[i])
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.AttestationCas[i], err)
+		}
+	}
+
+	if c.AttestationPolicies != "" {
+		c.AttestationPolicies, err = filepath.Abs(c.AttestationPolicies)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.AttestationPolicies, err)
+		}
+	}
+
+	if c.AuditLog != "" {
+		c.AuditLog, err = filepath.Abs(c.AuditLog)
+		if err != nil {
+			log.Warnf("Failed to get absolute path for %v: %v", c.AuditLog, err)
+		}
+	}
+
 	if c.VcekCacheFolder != "" {
 		c.VcekCacheFolder, err = filepath.Abs(c.VcekCacheFolder)
 		if err != nil {
@@ -243,7 +414,13 @@ func printConfig(c *config) {
 
 	log.Debug("Using the following configuration:")
 	log.Debugf("\tPort                : %v", c.Port)
-	log.Debugf("\tSigning Key File    : %v", c.SigningKey)
+	if c.Pkcs11Module != "" {
+		log.Debugf("\tPKCS#11 Module      : %v", c.Pkcs11Module)
+		log.Debugf("\tPKCS#11 Token       : %v", c.Pkcs11Token)
+		log.Debugf("\tPKCS#11 Key         : %v%v", c.Pkcs11KeyLabel, c.Pkcs11KeyId)
+	} else {
+		log.Debugf("\tSigning Key File    : %v", c.SigningKey)
+	}
 	log.Debugf("\tSigning Certificates: %v", strings.Join(c.SigningCerts, ","))
 	log.Debugf("\tEST Key File        : %v", c.EstKey)
 	log.Debugf("\tEST Certificates    : %v", strings.Join(c.EstCerts, ","))
@@ -251,6 +428,23 @@ func printConfig(c *config) {
 	log.Debugf("\tVerify EK Cert      : %v", c.VerifyEkCert)
 	log.Debugf("\tTPM EK DB           : %v", c.TpmEkCertDb)
 	log.Debugf("\tVCEK Cache Folder   : %v", c.VcekCacheFolder)
+	log.Debugf("\tReenroll New Key    : %v", c.ReenrollNewKey)
+	log.Debugf("\tChannel Binding     : %v", c.ChannelBinding)
+	log.Debugf("\tToken Auth          : %v", c.TokenAuth)
+	log.Debugf("\tToken File          : %v", c.TokenFile)
+	log.Debugf("\tAdmin Address       : %v", c.AdminAddr)
+	log.Debugf("\tIP Rate Limit       : %v", c.IpRateLimit)
+	log.Debugf("\tToken Rate Limit    : %v", c.TokenRateLimit)
+	log.Debugf("\tCSR Policy          : %v", c.CsrPolicy != nil)
+	log.Debugf("\tCert Profiles       : %v", strings.Join(maps.Keys(c.CertProfiles), ","))
+	log.Debugf("\tAudit Log           : %v", c.AuditLog)
+	log.Debugf("\tTree Head Interval  : %v", c.AuditLogSthInterval)
+	log.Debugf("\tAttestation CAs     : %v", strings.Join(c.AttestationCas, ","))
+	log.Debugf("\tAttestation Policies: %v", c.AttestationPolicies)
+	log.Debugf("\tRequire Attestation : %v", c.RequireAttestation)
+	log.Debugf("\tRevocation File     : %v", c.RevocationFile)
+	log.Debugf("\tCRL Interval        : %v", c.CrlInterval)
+	log.Debugf("\tCRL URL             : %v", c.CrlUrl)
 	log.Debugf("\tLog Level           : %v", c.LogLevel)
 }
 
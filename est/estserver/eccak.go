@@ -0,0 +1,224 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/legacy/tpm2/credactivation"
+)
+
+const (
+	// Length of the credential activation secret and the symmetric block size
+	// of the EK as used by go-attestation
+	activationSecretLen = 32
+	symBlockSize        = 16
+
+	tpmGeneratedMagic = 0xff544347
+)
+
+// generateActivation generates the credential activation challenge for the AK.
+// go-attestation only supports RSA AKs, therefore the creation of ECC AKs is
+// verified here, performing the same checks
+func generateActivation(params attest.ActivationParameters) ([]byte, *attest.EncryptedCredential, error) {
+
+	pub, err := tpm2.DecodePublic(params.AK.Public)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode AK public: %w", err)
+	}
+	if pub.Type != tpm2.AlgECC {
+		return params.Generate()
+	}
+
+	att, err := checkEccAk(pub, params.AK)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params.EK == nil {
+		return nil, nil, errors.New("no EK provided")
+	}
+
+	secret := make([]byte, activationSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate activation secret: %w", err)
+	}
+	cred, encSecret, err := credactivation.Generate(att.AttestedCreationInfo.Name.Digest,
+		params.EK, symBlockSize, secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate credential: %w", err)
+	}
+
+	return secret, &attest.EncryptedCredential{Credential: cred, Secret: encSecret}, nil
+}
+
+// checkEccAk checks that the ECC AK is a restricted, fixedTPM, fixedParent key
+// created by the TPM and that the creation attestation is signed by the AK
+func checkEccAk(pub tpm2.Public, ak attest.AttestationParameters) (*tpm2.AttestationData, error) {
+
+	if !akCurve(pub) {
+		return nil, errors.New("AK uses unsupported curve")
+	}
+	att, err := tpm2.DecodeAttestationData(ak.CreateAttestation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode AK creation attestation: %w", err)
+	}
+	if att.Type != tpm2.TagAttestCreation || att.AttestedCreationInfo == nil {
+		return nil, fmt.Errorf("attestation does not apply to creation data, got tag %x", att.Type)
+	}
+	if att.Magic != tpmGeneratedMagic {
+		return nil, errors.New("creation attestation was not produced by a TPM")
+	}
+	if att.AttestedCreationInfo.Name.Digest == nil {
+		return nil, errors.New("creation attestation name has no digest")
+	}
+
+	nameHash, err := pub.NameAlg.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("unsupported AK name algorithm: %w", err)
+	}
+	h := nameHash.New()
+	h.Write(ak.CreateData)
+	if !bytes.Equal(att.AttestedCreationInfo.OpaqueDigest, h.Sum(nil)) {
+		return nil, errors.New("creation attestation refers to different creation data")
+	}
+
+	if pub.Attributes&tpm2.FlagFixedTPM == 0 {
+		return nil, errors.New("AK is exportable")
+	}
+	if pub.Attributes&tpm2.FlagRestricted == 0 || pub.Attributes&tpm2.FlagFixedParent == 0 ||
+		pub.Attributes&tpm2.FlagSensitiveDataOrigin == 0 {
+		return nil, errors.New("AK is not limited to attestation")
+	}
+	match, err := att.AttestedCreationInfo.Name.MatchesPublic(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match creation attestation name: %w", err)
+	}
+	if !match {
+		return nil, errors.New("creation attestation refers to a different key")
+	}
+
+	err = verifyEccSignature(pub, ak.CreateAttestation, ak.CreateSignature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify AK creation attestation: %w", err)
+	}
+
+	return att, nil
+}
+
+// verifyIkEcc verifies the certification of the IK with the ECC AK, as
+// go-attestation only verifies certifications of RSA AKs
+func verifyIkEcc(ikParams attest.CertificationParameters, akPub tpm2.Public) error {
+
+	pub, err := tpm2.DecodePublic(ikParams.Public)
+	if err != nil {
+		return fmt.Errorf("failed to decode IK public: %w", err)
+	}
+	att, err := tpm2.DecodeAttestationData(ikParams.CreateAttestation)
+	if err != nil {
+		return fmt.Errorf("failed to decode IK certification: %w", err)
+	}
+	if att.Type != tpm2.TagAttestCertify || att.AttestedCertifyInfo == nil {
+		return fmt.Errorf("attestation does not apply to certification data, got tag %x", att.Type)
+	}
+	if att.Magic != tpmGeneratedMagic {
+		return errors.New("certification was not produced by a TPM")
+	}
+
+	switch pub.Type {
+	case tpm2.AlgRSA:
+		if pub.RSAParameters.KeyBits < 2048 {
+			return fmt.Errorf("IK too small: %v bits", pub.RSAParameters.KeyBits)
+		}
+	case tpm2.AlgECC:
+		switch pub.ECCParameters.CurveID {
+		case tpm2.CurveNISTP256, tpm2.CurveNISTP384, tpm2.CurveNISTP521:
+		default:
+			return errors.New("IK uses unsupported curve")
+		}
+	default:
+		return fmt.Errorf("IK algorithm 0x%x not supported", pub.Type)
+	}
+	if pub.Attributes&tpm2.FlagFixedTPM == 0 {
+		return errors.New("IK is exportable")
+	}
+	if pub.Attributes&tpm2.FlagRestricted != 0 {
+		return errors.New("IK is restricted")
+	}
+	if pub.Attributes&tpm2.FlagFixedParent == 0 {
+		return errors.New("IK can be duplicated to a different parent")
+	}
+	if pub.Attributes&tpm2.FlagSensitiveDataOrigin == 0 {
+		return errors.New("IK is not created by TPM")
+	}
+	match, err := att.AttestedCertifyInfo.Name.MatchesPublic(pub)
+	if err != nil {
+		return fmt.Errorf("failed to match certification name: %w", err)
+	}
+	if !match {
+		return errors.New("certification refers to a different key")
+	}
+
+	return verifyEccSignature(akPub, ikParams.CreateAttestation, ikParams.CreateSignature)
+}
+
+// verifyEccSignature verifies the TPMT_SIGNATURE over the data with the ECC key
+func verifyEccSignature(pub tpm2.Public, data, signature []byte) error {
+
+	key, err := pub.Key()
+	if err != nil {
+		return fmt.Errorf("failed to get public key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("key of type %T is not an ECDSA key", key)
+	}
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(signature))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if sig.Alg != tpm2.AlgECDSA || sig.ECC == nil {
+		return fmt.Errorf("expected ECDSA signature, got algorithm 0x%x", sig.Alg)
+	}
+	hash, err := sig.ECC.HashAlg.Hash()
+	if err != nil {
+		return fmt.Errorf("unsupported signature hash algorithm: %w", err)
+	}
+	h := hash.New()
+	h.Write(data)
+	if !ecdsa.Verify(ecKey, h.Sum(nil), sig.ECC.R, sig.ECC.S) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// akCurve returns true for the curves supported for ECC AKs
+func akCurve(pub tpm2.Public) bool {
+	if pub.ECCParameters == nil {
+		return false
+	}
+	switch pub.ECCParameters.CurveID {
+	case tpm2.CurveNISTP256, tpm2.CurveNISTP384:
+		return true
+	default:
+		return false
+	}
+}
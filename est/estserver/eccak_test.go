@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// eccKey is a software ECC key in TPM format, which signs as a TPM key
+type eccKey struct {
+	priv *ecdsa.PrivateKey
+	pub  tpm2.Public
+	hash crypto.Hash
+}
+
+func newEccKey(t *testing.T, curve elliptic.Curve, hash crypto.Hash, attrs tpm2.KeyProp) *eccKey {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	curveId, hashAlg := tpm2.CurveNISTP256, tpm2.AlgSHA256
+	if curve == elliptic.P384() {
+		curveId, hashAlg = tpm2.CurveNISTP384, tpm2.AlgSHA384
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	return &eccKey{
+		priv: priv,
+		hash: hash,
+		pub: tpm2.Public{
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attrs,
+			ECCParameters: &tpm2.ECCParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: hashAlg},
+				CurveID: curveId,
+				Point: tpm2.ECPoint{
+					XRaw: priv.X.FillBytes(make([]byte, size)),
+					YRaw: priv.Y.FillBytes(make([]byte, size)),
+				},
+			},
+		},
+	}
+}
+
+func (k *eccKey) sign(t *testing.T, data []byte) []byte {
+	h := k.hash.New()
+	h.Write(data)
+	r, s, err := ecdsa.Sign(rand.Reader, k.priv, h.Sum(nil))
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	hashAlg, err := tpm2.HashToAlgorithm(k.hash)
+	if err != nil {
+		t.Fatalf("unsupported hash: %v", err)
+	}
+	sig, err := tpm2.Signature{
+		Alg: tpm2.AlgECDSA,
+		ECC: &tpm2.SignatureECC{HashAlg: hashAlg, R: r, S: s},
+	}.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode signature: %v", err)
+	}
+	return sig
+}
+
+func (k *eccKey) encode(t *testing.T) []byte {
+	pub, err := k.pub.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode public: %v", err)
+	}
+	return pub
+}
+
+func (k *eccKey) name(t *testing.T) tpm2.Name {
+	name, err := k.pub.Name()
+	if err != nil {
+		t.Fatalf("failed to get name: %v", err)
+	}
+	return name
+}
+
+// attestData encodes the attestation signed by the key
+func attestData(t *testing.T, att tpm2.AttestationData) []byte {
+	att.Magic = tpmGeneratedMagic
+	data, err := att.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode attestation: %v", err)
+	}
+	return data
+}
+
+func Test_generateActivation(t *testing.T) {
+
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate EK: %v", err)
+	}
+	akAttrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagNoDA | tpm2.FlagRestricted | tpm2.FlagSign
+	createData := []byte("TPMS_CREATION_DATA")
+	createDigest := sha256.Sum256(createData)
+
+	akParams := func(ak *eccKey, creationName *eccKey, data []byte, signer *eccKey,
+	) attest.AttestationParameters {
+		att := attestData(t, tpm2.AttestationData{
+			Type: tpm2.TagAttestCreation,
+			AttestedCreationInfo: &tpm2.CreationInfo{
+				Name:         creationName.name(t),
+				OpaqueDigest: createDigest[:],
+			},
+		})
+		return attest.AttestationParameters{
+			Public:            ak.encode(t),
+			CreateData:        data,
+			CreateAttestation: att,
+			CreateSignature:   signer.sign(t, att),
+		}
+	}
+
+	p256 := newEccKey(t, elliptic.P256(), crypto.SHA256, akAttrs)
+	p384 := newEccKey(t, elliptic.P384(), crypto.SHA384, akAttrs)
+	unrestricted := newEccKey(t, elliptic.P256(), crypto.SHA256, akAttrs&^tpm2.FlagRestricted)
+
+	tests := []struct {
+		name    string
+		params  attest.AttestationParameters
+		wantErr bool
+	}{
+		{"P-256", akParams(p256, p256, createData, p256), false},
+		{"P-384", akParams(p384, p384, createData, p384), false},
+		{"Unrestricted", akParams(unrestricted, unrestricted, createData, unrestricted), true},
+		{"Different Creation Data", akParams(p256, p256, []byte("other"), p256), true},
+		{"Different Key", akParams(p256, p384, createData, p256), true},
+		{"Wrong Signer", akParams(p256, p256, createData, p384), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, cred, err := generateActivation(attest.ActivationParameters{
+				TPMVersion: attest.TPMVersion20,
+				EK:         &ek.PublicKey,
+				AK:         tt.params,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("generateActivation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(secret) != activationSecretLen || len(cred.Credential) == 0 ||
+				len(cred.Secret) == 0 {
+				t.Errorf("generateActivation() returned incomplete challenge")
+			}
+		})
+	}
+}
+
+func Test_verifyIkEcc(t *testing.T) {
+
+	akAttrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagNoDA | tpm2.FlagRestricted | tpm2.FlagSign
+	ikAttrs := tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+		tpm2.FlagUserWithAuth | tpm2.FlagSign
+	ak := newEccKey(t, elliptic.P384(), crypto.SHA384, akAttrs)
+	otherAk := newEccKey(t, elliptic.P384(), crypto.SHA384, akAttrs)
+	ik := newEccKey(t, elliptic.P256(), crypto.SHA256, ikAttrs)
+	exportable := newEccKey(t, elliptic.P256(), crypto.SHA256, ikAttrs&^tpm2.FlagFixedTPM)
+
+	ikParams := func(ik, signer *eccKey) attest.CertificationParameters {
+		att := attestData(t, tpm2.AttestationData{
+			Type:                tpm2.TagAttestCertify,
+			AttestedCertifyInfo: &tpm2.CertifyInfo{Name: ik.name(t)},
+		})
+		return attest.CertificationParameters{
+			Public:            ik.encode(t),
+			CreateAttestation: att,
+			CreateSignature:   signer.sign(t, att),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		params  attest.CertificationParameters
+		wantErr bool
+	}{
+		{"Valid", ikParams(ik, ak), false},
+		{"Exportable", ikParams(exportable, ak), true},
+		{"Wrong Signer", ikParams(ik, otherAk), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyIk(tt.params, ak.encode(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyIk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
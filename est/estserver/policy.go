@@ -0,0 +1,275 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Placeholder for the device identifier in the CSR policy templates
+const idPlaceholder = "{id}"
+
+// Subject attributes which can be required or forbidden by the CSR policy
+var subjectAttributes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+}
+
+// deviceIdentity is the identity of the requesting device as verified by the
+// server, e.g., via the EK certificate or a device bound bootstrap token
+type deviceIdentity struct {
+	// Id is the device identifier, which is embedded into the issued certificates
+	Id string
+	// Source describes how the identity was verified
+	Source string
+}
+
+// ekIdentity returns the identity of the device with the verified EK. The serial
+// number of the EK certificate is used as identifier, or, if the EK certificate
+// was not sent by the device, the SHA256 hash of the EK public key
+func ekIdentity(ekCertDer, ekPubPkix []byte) *deviceIdentity {
+	if cert, err := x509.ParseCertificate(ekCertDer); err == nil {
+		return &deviceIdentity{Id: cert.SerialNumber.Text(16), Source: "EK certificate"}
+	}
+	h := sha256.Sum256(ekPubPkix)
+	return &deviceIdentity{Id: hex.EncodeToString(h[:]), Source: "EK public key"}
+}
+
+// csrPolicy restricts the identities the devices can request. Templates may
+// contain the placeholder {id}, which is replaced by the identifier of the
+// verified device identity. Templates with placeholder never match for devices
+// without verified identity
+type csrPolicy struct {
+	// Subject attributes, e.g., CN or O, which must or must not be requested
+	RequiredSubject  []string `json:"requiredSubject,omitempty"`
+	ForbiddenSubject []string `json:"forbiddenSubject,omitempty"`
+	// Optional template the requested common name must match, e.g., "device-{id}"
+	CommonName string `json:"commonName,omitempty"`
+	// Templates the requested DNS names must match, e.g., "{id}.devices.local". If
+	// empty, no DNS names can be requested. IP, email and URI SANs are refused
+	DnsNames []string `json:"dnsNames,omitempty"`
+	// Refuse requests without verified device identity
+	RequireIdentity bool `json:"requireIdentity,omitempty"`
+	// Optional URI SAN template and private extension OID for embedding the
+	// device identifier into the issued certificates
+	IdentitySan string `json:"identitySan,omitempty"`
+	IdentityOid string `json:"identityOid,omitempty"`
+
+	identityOid asn1.ObjectIdentifier
+}
+
+// certIdentity contains the identity SAN and extensions added to the issued
+// certificate
+type certIdentity struct {
+	uris       []*url.URL
+	extensions []pkix.Extension
+}
+
+// policyError is returned if a field of the CSR violates the CSR policy
+type policyError struct {
+	Field  string
+	Reason string
+}
+
+func (e *policyError) Error() string {
+	return fmt.Sprintf("CSR field %v refused: %v", e.Field, e.Reason)
+}
+
+// init validates the policy configuration
+func (p *csrPolicy) init() error {
+	for _, a := range append(slices.Clone(p.RequiredSubject), p.ForbiddenSubject...) {
+		if _, ok := subjectAttributes[strings.ToUpper(a)]; !ok {
+			supported := maps.Keys(subjectAttributes)
+			slices.Sort(supported)
+			return fmt.Errorf("unsupported subject attribute %v (supported: %v)", a,
+				strings.Join(supported, ","))
+		}
+	}
+	if p.IdentitySan != "" {
+		if _, err := url.Parse(strings.ReplaceAll(p.IdentitySan, idPlaceholder, "id")); err != nil {
+			return fmt.Errorf("invalid identity SAN template: %w", err)
+		}
+	}
+	if p.IdentityOid != "" {
+		for _, s := range strings.Split(p.IdentityOid, ".") {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid identity OID %v", p.IdentityOid)
+			}
+			p.identityOid = append(p.identityOid, n)
+		}
+		if len(p.identityOid) < 2 {
+			return fmt.Errorf("invalid identity OID %v", p.IdentityOid)
+		}
+	}
+	return nil
+}
+
+// render replaces the placeholder of the template with the device identifier.
+// It returns false if the template contains the placeholder but the identity
+// is unknown
+func render(template string, id *deviceIdentity) (string, bool) {
+	if !strings.Contains(template, idPlaceholder) {
+		return template, true
+	}
+	if id == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(template, idPlaceholder, id.Id), true
+}
+
+// check verifies that the CSR only requests identities the device is entitled
+// to and returns the identity SAN and extensions of the issued certificate.
+// Without policy, all CSRs are accepted
+func (p *csrPolicy) check(csr *x509.CertificateRequest, id *deviceIdentity,
+) (*certIdentity, error) {
+
+	if p == nil {
+		return nil, nil
+	}
+
+	if id == nil && p.RequireIdentity {
+		return nil, &policyError{Field: "identity", Reason: "no verified device identity"}
+	}
+
+	for _, a := range p.RequiredSubject {
+		if !hasSubjectAttribute(csr.Subject, a) {
+			return nil, &policyError{Field: strings.ToUpper(a), Reason: "required subject attribute missing"}
+		}
+	}
+	for _, a := range p.ForbiddenSubject {
+		if hasSubjectAttribute(csr.Subject, a) {
+			return nil, &policyError{Field: strings.ToUpper(a), Reason: "subject attribute not allowed"}
+		}
+	}
+
+	if p.CommonName != "" {
+		cn, ok := render(p.CommonName, id)
+		if !ok || csr.Subject.CommonName != cn {
+			return nil, &policyError{
+				Field:  "CN",
+				Reason: fmt.Sprintf("device not entitled to common name %q", csr.Subject.CommonName),
+			}
+		}
+	}
+
+	for _, name := range csr.DNSNames {
+		entitled := false
+		for _, t := range p.DnsNames {
+			if n, ok := render(t, id); ok && strings.EqualFold(n, name) {
+				entitled = true
+				break
+			}
+		}
+		if !entitled {
+			return nil, &policyError{
+				Field:  "dnsNames",
+				Reason: fmt.Sprintf("device not entitled to DNS name %q", name),
+			}
+		}
+	}
+	if len(csr.IPAddresses) > 0 {
+		return nil, &policyError{Field: "ipAddresses", Reason: "IP address SANs not allowed"}
+	}
+	if len(csr.EmailAddresses) > 0 {
+		return nil, &policyError{Field: "emailAddresses", Reason: "email SANs not allowed"}
+	}
+	if len(csr.URIs) > 0 {
+		return nil, &policyError{Field: "uris", Reason: "URI SANs not allowed"}
+	}
+
+	if id == nil {
+		return nil, nil
+	}
+
+	ci := &certIdentity{}
+	if p.IdentitySan != "" {
+		san, _ := render(p.IdentitySan, id)
+		u, err := url.Parse(san)
+		if err != nil {
+			return nil, &policyError{Field: "identity", Reason: fmt.Sprintf("invalid identity SAN %q", san)}
+		}
+		ci.uris = append(ci.uris, u)
+	}
+	if p.identityOid != nil {
+		value, err := asn1.MarshalWithParams(id.Id, "utf8")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal device identifier: %w", err)
+		}
+		ci.extensions = append(ci.extensions, pkix.Extension{Id: p.identityOid, Value: value})
+	}
+
+	return ci, nil
+}
+
+// certDeviceIdentity returns the device identity embedded into a certificate
+// issued by the server via the identity extension or nil, if the certificate
+// does not contain an identity
+func (p *csrPolicy) certDeviceIdentity(cert *x509.Certificate) *deviceIdentity {
+	if p == nil || p.identityOid == nil {
+		return nil
+	}
+	for _, e := range cert.Extensions {
+		if !e.Id.Equal(p.identityOid) {
+			continue
+		}
+		var id string
+		if rest, err := asn1.Unmarshal(e.Value, &id); err != nil || len(rest) > 0 {
+			return nil
+		}
+		return &deviceIdentity{Id: id, Source: "certificate"}
+	}
+	return nil
+}
+
+func hasSubjectAttribute(subject pkix.Name, attribute string) bool {
+	oid := subjectAttributes[strings.ToUpper(attribute)]
+	for _, n := range subject.Names {
+		if n.Type.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePolicyError sends a problem details response naming the offending field
+func writePolicyError(w http.ResponseWriter, e *policyError) {
+	sendProblem(w, problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusForbidden),
+		Status: http.StatusForbidden,
+		Detail: e.Error(),
+		Field:  e.Field,
+	}, 0)
+}
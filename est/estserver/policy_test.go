@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"go.mozilla.org/pkcs7"
+)
+
+func createPolicyCsr(t *testing.T, tmpl *x509.CertificateRequest) *x509.CertificateRequest {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatalf("failed to create CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("failed to parse CSR: %v", err)
+	}
+	return csr
+}
+
+func Test_csrPolicyCheck(t *testing.T) {
+
+	policy := &csrPolicy{
+		RequiredSubject:  []string{"CN", "O"},
+		ForbiddenSubject: []string{"OU"},
+		CommonName:       "device-{id}",
+		DnsNames:         []string{"{id}.devices.local"},
+		IdentitySan:      "urn:cmc:device:{id}",
+		IdentityOid:      "1.3.6.1.4.1.99999.1",
+	}
+	if err := policy.init(); err != nil {
+		t.Fatalf("init() error = %v", err)
+	}
+	device := &deviceIdentity{Id: "1234", Source: "test"}
+
+	subject := func(cn string) pkix.Name {
+		return pkix.Name{CommonName: cn, Organization: []string{"Test"}}
+	}
+	uri, _ := url.Parse("urn:other")
+
+	tests := []struct {
+		name      string
+		csr       *x509.CertificateRequest
+		device    *deviceIdentity
+		wantField string
+	}{
+		{"Success", &x509.CertificateRequest{Subject: subject("device-1234"),
+			DNSNames: []string{"1234.devices.local"}}, device, ""},
+		{"Required Missing", &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "device-1234"}}, device, "O"},
+		{"Forbidden Present", &x509.CertificateRequest{Subject: pkix.Name{
+			CommonName: "device-1234", Organization: []string{"Test"},
+			OrganizationalUnit: []string{"Unit"}}}, device, "OU"},
+		{"Common Name Not Entitled", &x509.CertificateRequest{Subject: subject("device-5678")},
+			device, "CN"},
+		{"No Identity", &x509.CertificateRequest{Subject: subject("device-1234")}, nil, "CN"},
+		{"DNS Name Not Entitled", &x509.CertificateRequest{Subject: subject("device-1234"),
+			DNSNames: []string{"5678.devices.local"}}, device, "dnsNames"},
+		{"IP Address", &x509.CertificateRequest{Subject: subject("device-1234"),
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}, device, "ipAddresses"},
+		{"URI", &x509.CertificateRequest{Subject: subject("device-1234"),
+			URIs: []*url.URL{uri}}, device, "uris"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ci, err := policy.check(createPolicyCsr(t, tt.csr), tt.device)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("check() error = %v", err)
+				}
+				if len(ci.uris) != 1 || ci.uris[0].String() != "urn:cmc:device:1234" ||
+					len(ci.extensions) != 1 {
+					t.Fatalf("check() returned unexpected certificate identity %v", ci)
+				}
+				return
+			}
+			var perr *policyError
+			if !errors.As(err, &perr) || perr.Field != tt.wantField {
+				t.Fatalf("check() error = %v, want policy error for field %v", err, tt.wantField)
+			}
+		})
+	}
+
+	t.Run("Require Identity", func(t *testing.T) {
+		p := &csrPolicy{RequireIdentity: true}
+		_, err := p.check(createPolicyCsr(t, &x509.CertificateRequest{}), nil)
+		var perr *policyError
+		if !errors.As(err, &perr) || perr.Field != "identity" {
+			t.Fatalf("check() error = %v, want policy error for field identity", err)
+		}
+	})
+
+	t.Run("No Policy", func(t *testing.T) {
+		var p *csrPolicy
+		ci, err := p.check(createPolicyCsr(t, &x509.CertificateRequest{
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}), nil)
+		if err != nil || ci != nil {
+			t.Fatalf("check() = %v, %v, want no restrictions", ci, err)
+		}
+	})
+}
+
+func Test_csrPolicyInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       csrPolicy
+		wantErr bool
+	}{
+		{"Valid", csrPolicy{RequiredSubject: []string{"cn"}, IdentityOid: "1.2.3"}, false},
+		{"Unsupported Attribute", csrPolicy{ForbiddenSubject: []string{"UID"}}, true},
+		{"Invalid OID", csrPolicy{IdentityOid: "1.x"}, true},
+		{"Short OID", csrPolicy{IdentityOid: "1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.init(); (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_handleSimpleenrollPolicy(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+
+	policy := &csrPolicy{
+		CommonName:  "device-{id}",
+		IdentitySan: "urn:cmc:device:{id}",
+		IdentityOid: "1.3.6.1.4.1.99999.1",
+	}
+	if err := policy.init(); err != nil {
+		t.Fatalf("init() error = %v", err)
+	}
+	tokens, _ := newTokenStore("")
+
+	s := &Server{
+		signingKey:   caPriv,
+		signingCerts: []*x509.Certificate{ca},
+		tokens:       tokens,
+		policy:       policy,
+	}
+
+	tests := []struct {
+		name       string
+		cn         string
+		wantStatus int
+	}{
+		{"Success", "device-1234", http.StatusOK},
+		{"Not Entitled", "device-5678", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := tokens.issue(1, 0, "", "1234")
+			if err != nil {
+				t.Fatalf("issue() error = %v", err)
+			}
+			csr := createPolicyCsr(t, &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: tt.cn},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, est.EndpointPrefix+est.EnrollEndpoint,
+				bytes.NewReader(est.EncodeBase64(csr.Raw)))
+			req.Header.Set(est.ContentTypeHeader, est.MimeTypePKCS10)
+			req.Header.Set(est.AuthorizationHeader, est.BearerPrefix+token)
+			req.TLS = &tls.ConnectionState{}
+			w := httptest.NewRecorder()
+
+			s.handleSimpleenroll(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("handleSimpleenroll() status = %v, want %v", resp.StatusCode,
+					tt.wantStatus)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				var p problem
+				if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+					t.Fatalf("failed to decode problem: %v", err)
+				}
+				if p.Field != "CN" {
+					t.Fatalf("problem field = %q, want CN", p.Field)
+				}
+				return
+			}
+
+			cert := decodeCertResponse(t, resp)
+			if len(cert.URIs) != 1 || cert.URIs[0].String() != "urn:cmc:device:1234" {
+				t.Fatalf("certificate URIs %v do not contain device identity", cert.URIs)
+			}
+			id := policy.certDeviceIdentity(cert)
+			if id == nil || id.Id != "1234" {
+				t.Fatalf("certificate does not contain device identity extension")
+			}
+		})
+	}
+}
+
+func decodeCertResponse(t *testing.T, resp *http.Response) *x509.Certificate {
+	body, _ := io.ReadAll(resp.Body)
+	decoded, err := est.DecodeBase64(body)
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	p7, err := pkcs7.Parse(decoded)
+	if err != nil || len(p7.Certificates) != 1 {
+		t.Fatalf("failed to decode certificate: %v", err)
+	}
+	return p7.Certificates[0]
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// defaultProfile is used for requests without CA label. Its certificates can
+// be used for TLS clients and servers
+var defaultProfile = &certProfile{
+	keyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	validity:    time.Hour * 24 * 180,
+}
+
+// certProfile is a named profile of the issued certificates. Devices request
+// a profile via the CA label of the EST endpoints [RFC7030 3.2.2], e.g.,
+// /.well-known/est/tls-client/simpleenroll
+type certProfile struct {
+	KeyUsage    []string `json:"keyUsage"`
+	ExtKeyUsage []string `json:"extKeyUsage,omitempty"`
+	// Optional validity of the certificates, e.g., "720h" (default 180 days)
+	Validity string `json:"validity,omitempty"`
+	// Optional template replacing the requested common name, e.g., "tls-{id}".
+	// Templates with placeholder are refused for devices without verified identity
+	CommonName string `json:"commonName,omitempty"`
+
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+	validity    time.Duration
+}
+
+// init validates the profile configuration
+func (p *certProfile) init() error {
+	if len(p.KeyUsage) == 0 {
+		return fmt.Errorf("no key usage specified")
+	}
+	for _, u := range p.KeyUsage {
+		ku, ok := keyUsages[u]
+		if !ok {
+			return fmt.Errorf("unsupported key usage %v (supported: %v)", u, supported(keyUsages))
+		}
+		p.keyUsage |= ku
+	}
+	for _, u := range p.ExtKeyUsage {
+		eku, ok := extKeyUsages[u]
+		if !ok {
+			return fmt.Errorf("unsupported extended key usage %v (supported: %v)", u,
+				supported(extKeyUsages))
+		}
+		p.extKeyUsage = append(p.extKeyUsage, eku)
+	}
+	p.validity = defaultProfile.validity
+	if p.Validity != "" {
+		var err error
+		p.validity, err = time.ParseDuration(p.Validity)
+		if err != nil || p.validity <= 0 {
+			return fmt.Errorf("invalid validity %q", p.Validity)
+		}
+	}
+	return nil
+}
+
+// apply sets the key usages, validity and subject of the profile in the
+// certificate template
+func (p *certProfile) apply(tmpl *x509.Certificate, csr *x509.CertificateRequest,
+	id *deviceIdentity,
+) error {
+	tmpl.KeyUsage = p.keyUsage
+	tmpl.ExtKeyUsage = p.extKeyUsage
+	tmpl.NotBefore = time.Now()
+	tmpl.NotAfter = tmpl.NotBefore.Add(p.validity)
+
+	if p.CommonName != "" {
+		cn, ok := render(p.CommonName, id)
+		if !ok {
+			return &policyError{Field: "identity", Reason: "no verified device identity"}
+		}
+		tmpl.RawSubject = nil
+		tmpl.Subject = csr.Subject
+		tmpl.Subject.CommonName = cn
+	}
+	return nil
+}
+
+// initProfiles validates the profile configurations
+func initProfiles(profiles map[string]*certProfile) error {
+	for name, p := range profiles {
+		if name == "" || strings.ContainsAny(name, "/?#") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+		if err := p.init(); err != nil {
+			return fmt.Errorf("invalid profile %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// requestedProfile returns the name of the profile requested via the CA label
+// of the endpoint path or an empty name, if the path does not contain a label
+func requestedProfile(path string) string {
+	label := strings.TrimPrefix(path, est.EndpointPrefix+"/")
+	if i := strings.Index(label, "/"); i >= 0 {
+		return label[:i]
+	}
+	return ""
+}
+
+// certProfile returns the profile of the request
+func (s *Server) certProfile(req *http.Request) (string, *certProfile, error) {
+	name := requestedProfile(req.URL.Path)
+	if name == "" {
+		return "", defaultProfile, nil
+	}
+	p, ok := s.profiles[name]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown certificate profile %v", name)
+	}
+	return name, p, nil
+}
+
+func supported[T any](m map[string]T) string {
+	keys := maps.Keys(m)
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
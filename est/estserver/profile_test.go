@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	estclient "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"golang.org/x/exp/slices"
+)
+
+func Test_initProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		p       certProfile
+		wantErr bool
+	}{
+		{"Success", "tls-client", certProfile{KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"clientAuth"}, Validity: "720h"}, false},
+		{"No Key Usage", "tls-client", certProfile{}, true},
+		{"Unknown Key Usage", "tls-client", certProfile{KeyUsage: []string{"certSign"}}, true},
+		{"Unknown Extended Key Usage", "tls-client", certProfile{
+			KeyUsage: []string{"digitalSignature"}, ExtKeyUsage: []string{"any"}}, true},
+		{"Invalid Validity", "tls-client", certProfile{KeyUsage: []string{"digitalSignature"},
+			Validity: "-1h"}, true},
+		{"Invalid Name", "tls/client", certProfile{KeyUsage: []string{"digitalSignature"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := initProfiles(map[string]*certProfile{tt.profile: &tt.p})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("initProfiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_requestedProfile(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{est.EndpointPrefix + est.EnrollEndpoint, ""},
+		{est.EndpointPrefix + "/tls-client" + est.EnrollEndpoint, "tls-client"},
+		{est.EndpointPrefix + "/signing" + est.ReenrollEndpoint, "signing"},
+	}
+	for _, tt := range tests {
+		if got := requestedProfile(tt.path); got != tt.want {
+			t.Errorf("requestedProfile(%v) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func Test_certProfileApply(t *testing.T) {
+
+	p := &certProfile{KeyUsage: []string{"digitalSignature"}, CommonName: "sign-{id}"}
+	if err := p.init(); err != nil {
+		t.Fatalf("init() error = %v", err)
+	}
+	csr := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device", Organization: []string{"Test"}},
+	}
+
+	tmpl := &x509.Certificate{}
+	if err := p.apply(tmpl, csr, &deviceIdentity{Id: "1234"}); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if tmpl.Subject.CommonName != "sign-1234" || len(tmpl.Subject.Organization) != 1 {
+		t.Errorf("apply() subject = %v", tmpl.Subject)
+	}
+
+	var perr *policyError
+	if err := p.apply(&x509.Certificate{}, csr, nil); !errors.As(err, &perr) {
+		t.Errorf("apply() without identity error = %v, want policy error", err)
+	}
+}
+
+func TestCertProfiles(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	profiles := map[string]*certProfile{
+		"tls-client": {
+			KeyUsage:    []string{"digitalSignature"},
+			ExtKeyUsage: []string{"clientAuth"},
+			Validity:    "1h",
+		},
+		"signing": {
+			KeyUsage: []string{"digitalSignature", "contentCommitment"},
+			Validity: "2h",
+		},
+	}
+	if err := initProfiles(profiles); err != nil {
+		t.Fatalf("initProfiles() error = %v", err)
+	}
+	s := &Server{
+		signingKey:   caPriv,
+		signingCerts: []*x509.Certificate{ca},
+		profiles:     profiles,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(est.EndpointPrefix+est.CacertsEndpoint, s.handleCacerts)
+	for _, label := range []string{"", "/tls-client", "/signing"} {
+		mux.HandleFunc(est.EndpointPrefix+label+est.EnrollEndpoint, s.handleSimpleenroll)
+		mux.HandleFunc(est.EndpointPrefix+label+est.ReenrollEndpoint, s.handleSimpleReenroll)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{createServerCert(t, caPriv, ca)},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    x509.NewCertPool(),
+	}
+	srv.TLS.ClientCAs.AddCert(ca)
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		profile     string
+		keyUsage    x509.KeyUsage
+		extKeyUsage []x509.ExtKeyUsage
+		validity    time.Duration
+	}{
+		{"", x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			time.Hour * 24 * 180},
+		{"tls-client", x509.KeyUsageDigitalSignature,
+			[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, time.Hour},
+		{"signing", x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment, nil,
+			2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run("Profile "+tt.profile, func(t *testing.T) {
+			check := func(cert *x509.Certificate) {
+				if cert.KeyUsage != tt.keyUsage || !slices.Equal(cert.ExtKeyUsage, tt.extKeyUsage) {
+					t.Errorf("key usage = %v %v, want %v %v", cert.KeyUsage, cert.ExtKeyUsage,
+						tt.keyUsage, tt.extKeyUsage)
+				}
+				if validity := cert.NotAfter.Sub(cert.NotBefore); validity != tt.validity {
+					t.Errorf("validity = %v, want %v", validity, tt.validity)
+				}
+			}
+
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			client := estclient.NewClient([]*x509.Certificate{ca})
+			client.SetProfile(tt.profile)
+			cert, err := client.BoundSimpleEnroll(srv.URL, createCsr(t, key), key)
+			if err != nil {
+				t.Fatalf("BoundSimpleEnroll() error = %v", err)
+			}
+			check(cert)
+
+			// The renewed certificate keeps the profile
+			chain, err := estclient.ReenrollProfile(srv.URL, tt.profile,
+				[]*x509.Certificate{cert, ca}, key, key, createCsr(t, key))
+			if err != nil {
+				t.Fatalf("ReenrollProfile() error = %v", err)
+			}
+			check(chain[0])
+		})
+	}
+}
+
+func createServerCert(t *testing.T, caPriv *ecdsa.PrivateKey, ca *x509.Certificate,
+) tls.Certificate {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "EST Server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create server certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: priv}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of tracked sources, full buckets are discarded beyond
+const maxBuckets = 10000
+
+// rateLimiter implements a token bucket per key, e.g., the source IP. Each
+// key may perform limit requests per minute with a burst of limit requests
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter for the specified number of requests per
+// minute or nil, if rate limiting is disabled
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		limit:   float64(perMinute),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// allow consumes a request of the key. If the limit is exceeded, it returns
+// false and the duration after which the next request is allowed
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	rate := l.limit / time.Minute.Seconds()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.cleanup(now, rate)
+		}
+		b = &bucket{tokens: l.limit, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.limit, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+
+	return true, 0
+}
+
+// cleanup removes the buckets which have been refilled completely
+func (l *rateLimiter) cleanup(now time.Time, rate float64) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= l.limit {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// problem is a problem details response [RFC7807]
+type problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+	Field      string `json:"field,omitempty"`
+}
+
+// writeProblem sends a problem details response with the specified status
+func writeProblem(w http.ResponseWriter, status int, retryAfter time.Duration,
+	format string, args ...interface{},
+) {
+	sendProblem(w, problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	}, retryAfter)
+}
+
+func sendProblem(w http.ResponseWriter, p problem, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		p.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set(est.RetryAfterHeader, strconv.Itoa(p.RetryAfter))
+	}
+	log.Warn(p.Detail)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+	w.Header().Set(est.ContentTypeHeader, est.MimeTypeProblemJSON)
+	w.WriteHeader(p.Status)
+	w.Write(data)
+}
+
+// sourceIp returns the IP address of the request source
+func sourceIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// limitSource wraps the handler with the per source IP rate limit
+func (s *Server) limitSource(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ip := sourceIp(req)
+		if ok, retry := s.ipLimiter.allow(ip); !ok {
+			writeProblem(w, http.StatusTooManyRequests, retry,
+				"Rate limit of source %v exceeded", ip)
+			return
+		}
+		h(w, req)
+	}
+}
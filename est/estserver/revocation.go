@@ -0,0 +1,306 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxRevocationRequest = 4096
+
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// revocationReasons are the CRL reason codes [RFC5280 5.3.1]. certificateHold
+// is not supported, as revocations are final
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+}
+
+var ErrAlreadyRevoked = errors.New("certificate already revoked")
+
+// revokedCert is a revoked certificate identified by its hex encoded serial number
+type revokedCert struct {
+	Serial string    `json:"serial"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// revocationState is the persisted revocation state. The CRL number is kept,
+// so that the numbers of the CRLs increase across restarts
+type revocationState struct {
+	CrlNumber int64         `json:"crlNumber"`
+	Revoked   []revokedCert `json:"revoked"`
+}
+
+// revocationStore contains the revoked certificates and the current CRL signed
+// by the CA key. The CRL is regenerated on every revocation and periodically
+// before it expires
+type revocationStore struct {
+	mu       sync.Mutex
+	file     string
+	state    revocationState
+	key      crypto.Signer
+	issuer   *x509.Certificate
+	interval time.Duration
+	crl      *x509.RevocationList
+	now      func() time.Time
+}
+
+func newRevocationStore(file string, key crypto.Signer, issuer *x509.Certificate,
+	interval time.Duration,
+) (*revocationStore, error) {
+	if issuer.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, errors.New("CA certificate does not allow CRL signing")
+	}
+
+	s := &revocationStore{
+		file:     file,
+		key:      key,
+		issuer:   issuer,
+		interval: interval,
+		now:      time.Now,
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Infof("Revocation file %v does not exist, starting without revocations", file)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read revocation file: %w", err)
+	} else if err := json.Unmarshal(data, &s.state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal revocation file: %w", err)
+	}
+	log.Debugf("Loaded %v revoked certificates from %v", len(s.state.Revoked), file)
+
+	return s, nil
+}
+
+// publish generates the CRL and regenerates it in the configured interval. The
+// next update of the CRL is set to twice the interval, so that verifiers never
+// see an expired CRL while it is regenerated
+func (s *revocationStore) publish() error {
+	s.mu.Lock()
+	err := s.generate()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(s.interval) {
+			s.mu.Lock()
+			err := s.generate()
+			s.mu.Unlock()
+			if err != nil {
+				log.Errorf("Failed to generate CRL: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// generate signs a new CRL with the next CRL number. Must be called with the
+// lock held
+func (s *revocationStore) generate() error {
+	entries := make([]pkix.RevokedCertificate, 0, len(s.state.Revoked))
+	for _, r := range s.state.Revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial number %v", r.Serial)
+		}
+		reason, err := asn1.Marshal(asn1.Enumerated(revocationReasons[r.Reason]))
+		if err != nil {
+			return fmt.Errorf("failed to marshal reason code: %w", err)
+		}
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: r.Time,
+			Extensions:     []pkix.Extension{{Id: oidReasonCode, Value: reason}},
+		})
+	}
+
+	s.state.CrlNumber++
+	if err := s.save(); err != nil {
+		s.state.CrlNumber--
+		return err
+	}
+
+	now := s.now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(s.state.CrlNumber),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(2 * s.interval),
+	}, s.issuer, s.key)
+	if err != nil {
+		return fmt.Errorf("failed to create CRL: %w", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse created CRL: %w", err)
+	}
+	s.crl = crl
+
+	log.Debugf("Generated CRL %v with %v revoked certificates", s.state.CrlNumber, len(entries))
+
+	return nil
+}
+
+// revoke adds the certificate with the serial number to the revoked certificates
+// and regenerates the CRL
+func (s *revocationStore) revoke(serial *big.Int, reason string) (revokedCert, error) {
+	if _, ok := revocationReasons[reason]; !ok {
+		return revokedCert{}, fmt.Errorf("unsupported revocation reason %v (supported: %v)",
+			reason, supported(revocationReasons))
+	}
+	if serial.Sign() <= 0 {
+		return revokedCert{}, fmt.Errorf("invalid serial number %v", serial)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := revokedCert{
+		Serial: serial.Text(16),
+		Reason: reason,
+		Time:   s.now().UTC(),
+	}
+	for _, revoked := range s.state.Revoked {
+		if revoked.Serial == r.Serial {
+			return revokedCert{}, ErrAlreadyRevoked
+		}
+	}
+
+	s.state.Revoked = append(s.state.Revoked, r)
+	if err := s.generate(); err != nil {
+		s.state.Revoked = s.state.Revoked[:len(s.state.Revoked)-1]
+		return revokedCert{}, err
+	}
+
+	return r, nil
+}
+
+// save persists the revocation state. Must be called with the lock held
+func (s *revocationStore) save() error {
+	data, err := json.MarshalIndent(s.state, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocations: %w", err)
+	}
+
+	if err := internal.WriteFileAtomic(s.file, data, 0600); err != nil {
+		return fmt.Errorf("failed to store revocations: %w", err)
+	}
+	return nil
+}
+
+// handleCrl returns the current DER encoded CRL. The response may be cached
+// until the next update of the CRL
+func (s *revocationStore) handleCrl(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'crl' request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodGet {
+		writeHttpErrorf(w, "Method %v not implemented for crl request", req.Method)
+		return
+	}
+
+	s.mu.Lock()
+	crl := s.crl
+	now := s.now()
+	s.mu.Unlock()
+
+	maxAge := int(crl.NextUpdate.Sub(now).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", maxAge))
+	w.Header().Set("Expires", crl.NextUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("Last-Modified", crl.ThisUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fmt.Sprintf("\"%v\"", crl.Number))
+
+	if err := sendResponse(w, est.MimeTypePKIXCRL, "", crl.Raw); err != nil {
+		log.Warnf("Failed to send CRL: %v", err)
+	}
+}
+
+type revocationRequest struct {
+	Serial string `json:"serial"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleRevoke implements the admin API for revoking certificates by their hex
+// encoded serial number
+func (s *revocationStore) handleRevoke(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received admin revocation request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("Method %v not implemented for revocation request", req.Method),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxRevocationRequest))
+	if err != nil {
+		writeHttpErrorf(w, "Failed to read revocation request: %v", err)
+		return
+	}
+	r := revocationRequest{Reason: "unspecified"}
+	if err := json.Unmarshal(data, &r); err != nil {
+		writeHttpErrorf(w, "Failed to unmarshal revocation request: %v", err)
+		return
+	}
+	serial, ok := new(big.Int).SetString(strings.TrimPrefix(r.Serial, "0x"), 16)
+	if !ok {
+		writeHttpErrorf(w, "Invalid serial number %v", r.Serial)
+		return
+	}
+
+	revoked, err := s.revoke(serial, r.Reason)
+	if errors.Is(err, ErrAlreadyRevoked) {
+		http.Error(w, fmt.Sprintf("Failed to revoke %v: %v", r.Serial, err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeHttpErrorf(w, "Failed to revoke %v: %v", r.Serial, err)
+		return
+	}
+	log.Infof("Revoked certificate %v (%v)", revoked.Serial, revoked.Reason)
+
+	sendJson(w, revoked)
+}
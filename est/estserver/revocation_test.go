@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"golang.org/x/exp/slices"
+)
+
+func getCrl(t *testing.T, s *revocationStore) (*x509.RevocationList, http.Header) {
+	w := httptest.NewRecorder()
+	s.handleCrl(w, httptest.NewRequest(http.MethodGet, est.EndpointPrefix+est.CrlEndpoint, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleCrl() status = %v", w.Code)
+	}
+	crl, err := x509.ParseRevocationList(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	return crl, w.Header()
+}
+
+func revoke(s *revocationStore, body string) int {
+	w := httptest.NewRecorder()
+	s.handleRevoke(w, httptest.NewRequest(http.MethodPost, "/revocations",
+		bytes.NewReader([]byte(body))))
+	return w.Code
+}
+
+func TestRevocation(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	file := filepath.Join(t.TempDir(), "revocations.json")
+	crlUrl := "https://localhost:9000" + est.EndpointPrefix + est.CrlEndpoint
+
+	s, err := newRevocationStore(file, caPriv, ca, time.Hour)
+	if err != nil {
+		t.Fatalf("newRevocationStore() error = %v", err)
+	}
+	if err := s.publish(); err != nil {
+		t.Fatalf("publish() error = %v", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ak, err := enrollCert(createCsr(t, key), caPriv, ca, nil, defaultProfile, nil, crlUrl)
+	if err != nil {
+		t.Fatalf("enrollCert() error = %v", err)
+	}
+	if !slices.Equal(ak.CRLDistributionPoints, []string{crlUrl}) {
+		t.Errorf("CRL distribution points = %v, want %v", ak.CRLDistributionPoints, crlUrl)
+	}
+
+	crl, header := getCrl(t, s)
+	if ok, err := verify.CrlCheck(crl, ak, ca); !ok {
+		t.Fatalf("CrlCheck() of valid certificate failed: %v", err)
+	}
+	if got := header.Get(est.ContentTypeHeader); got != est.MimeTypePKIXCRL {
+		t.Errorf("content type = %v, want %v", got, est.MimeTypePKIXCRL)
+	}
+	want := crl.NextUpdate.UTC().Format(http.TimeFormat)
+	if got := header.Get("Expires"); got != want {
+		t.Errorf("Expires = %v, want %v", got, want)
+	}
+	if got := header.Get("Cache-Control"); got != "public, max-age=7199" &&
+		got != "public, max-age=7200" {
+		t.Errorf("Cache-Control = %v, want max-age of two intervals", got)
+	}
+
+	// Revoke the AK, the regenerated CRL must list it
+	body := `{"serial":"` + ak.SerialNumber.Text(16) + `","reason":"keyCompromise"}`
+	if code := revoke(s, body); code != http.StatusOK {
+		t.Fatalf("handleRevoke() status = %v", code)
+	}
+	if code := revoke(s, body); code != http.StatusConflict {
+		t.Errorf("handleRevoke() of revoked certificate status = %v, want %v", code,
+			http.StatusConflict)
+	}
+
+	revoked, _ := getCrl(t, s)
+	if revoked.Number.Cmp(crl.Number) <= 0 {
+		t.Errorf("CRL number %v not increased from %v", revoked.Number, crl.Number)
+	}
+	if ok, _ := verify.CrlCheck(revoked, ak, ca); ok {
+		t.Fatalf("CrlCheck() accepted revoked certificate")
+	}
+
+	// The revocations and CRL number persist across restarts
+	s, err = newRevocationStore(file, caPriv, ca, time.Hour)
+	if err != nil {
+		t.Fatalf("newRevocationStore() error = %v", err)
+	}
+	if err := s.publish(); err != nil {
+		t.Fatalf("publish() error = %v", err)
+	}
+	reloaded, _ := getCrl(t, s)
+	if reloaded.Number.Cmp(revoked.Number) <= 0 {
+		t.Errorf("CRL number %v not increased from %v", reloaded.Number, revoked.Number)
+	}
+	if ok, _ := verify.CrlCheck(reloaded, ak, ca); ok {
+		t.Fatalf("CrlCheck() accepted revoked certificate after restart")
+	}
+}
+
+func Test_handleRevoke(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	s, err := newRevocationStore(filepath.Join(t.TempDir(), "revocations.json"),
+		caPriv, ca, time.Hour)
+	if err != nil {
+		t.Fatalf("newRevocationStore() error = %v", err)
+	}
+	if err := s.publish(); err != nil {
+		t.Fatalf("publish() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"Default Reason", `{"serial":"0x1a2b"}`, http.StatusOK},
+		{"Superseded", `{"serial":"3c4d","reason":"superseded"}`, http.StatusOK},
+		{"Certificate Hold", `{"serial":"5e6f","reason":"certificateHold"}`, http.StatusBadRequest},
+		{"Invalid Serial", `{"serial":"xyz"}`, http.StatusBadRequest},
+		{"Zero Serial", `{"serial":"0"}`, http.StatusBadRequest},
+		{"Invalid JSON", `{"serial":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := revoke(s, tt.body); got != tt.want {
+				t.Errorf("handleRevoke() status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	crl, _ := getCrl(t, s)
+	if len(crl.RevokedCertificates) != 2 {
+		t.Errorf("CRL contains %v revoked certificates, want 2", len(crl.RevokedCertificates))
+	}
+}
+
+func Test_newRevocationStoreNoCrlSign(t *testing.T) {
+	caPriv, ca := createCa(t)
+	ca.KeyUsage = x509.KeyUsageCertSign
+	_, err := newRevocationStore(filepath.Join(t.TempDir(), "revocations.json"), caPriv, ca,
+		time.Hour)
+	if err == nil {
+		t.Fatalf("newRevocationStore() succeeded for CA without CRL sign key usage")
+	}
+}
@@ -17,7 +17,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
+	"crypto"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/tls"
@@ -31,22 +31,32 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"time"
 
 	est "github.com/Fraunhofer-AISEC/cmc/est/common"
 	"github.com/google/go-attestation/attest"
 	log "github.com/sirupsen/logrus"
-	"go.mozilla.org/pkcs7"
+	"golang.org/x/exp/slices"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Server struct {
-	server       *http.Server
-	signingKey   *ecdsa.PrivateKey
-	signingCerts []*x509.Certificate
-	tpmConf      tpmConfig
-	snpConf      snpConfig
+	server         *http.Server
+	signingKey     crypto.Signer
+	signingCerts   []*x509.Certificate
+	reenrollNewKey bool
+	channelBinding bool
+	tokens         *tokenStore
+	policy         *csrPolicy
+	auditLog       *issuanceLog
+	revocations    *revocationStore
+	crlUrl         string
+	attestConf     *attestConfig
+	profiles       map[string]*certProfile
+	ipLimiter      *rateLimiter
+	tokenLimiter   *rateLimiter
+	tpmConf        tpmConfig
+	snpConf        snpConfig
 }
 
 func NewServer(c *config) (*Server, error) {
@@ -82,9 +92,16 @@ func NewServer(c *config) (*Server, error) {
 	}
 
 	server := &Server{
-		server:       s,
-		signingKey:   c.signingKey,
-		signingCerts: c.signingCerts,
+		server:         s,
+		signingKey:     c.signingKey,
+		signingCerts:   c.signingCerts,
+		reenrollNewKey: c.ReenrollNewKey,
+		channelBinding: c.ChannelBinding,
+		policy:         c.CsrPolicy,
+		profiles:       c.CertProfiles,
+		crlUrl:         c.CrlUrl,
+		ipLimiter:      newRateLimiter(c.IpRateLimit),
+		tokenLimiter:   newRateLimiter(c.TokenRateLimit),
 		tpmConf: tpmConfig{
 			verifyEkCert: c.VerifyEkCert,
 			dbPath:       c.TpmEkCertDb,
@@ -97,15 +114,98 @@ func NewServer(c *config) (*Server, error) {
 
 	cacertsEndpoint := est.EndpointPrefix + est.CacertsEndpoint
 	simpleenrollEndpoint := est.EndpointPrefix + est.EnrollEndpoint
+	simplereenrollEndpoint := est.EndpointPrefix + est.ReenrollEndpoint
+	tpmActivateEndpoint := est.EndpointPrefix + est.TpmActivateEndpoint
 	tpmActivateEnrollEndpoint := est.EndpointPrefix + est.TpmActivateEnrollEndpoint
 	tpmCertifyEnrollEndpoint := est.EndpointPrefix + est.TpmCertifyEnrollEndpoint
 	snpEnrollEndpoint := est.EndpointPrefix + est.SnpEnrollEndpoint
 
-	http.HandleFunc(cacertsEndpoint, server.handleCacerts)
-	http.HandleFunc(simpleenrollEndpoint, server.handleSimpleenroll)
-	http.HandleFunc(tpmActivateEnrollEndpoint, server.handleTpmActivateEnroll)
-	http.HandleFunc(tpmCertifyEnrollEndpoint, server.handleTpmCertifyEnroll)
-	http.HandleFunc(snpEnrollEndpoint, server.handleSnpEnroll)
+	adminHandlers := make(map[string]http.HandlerFunc)
+
+	if c.TokenAuth {
+		tokens, err := newTokenStore(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bootstrap tokens: %w", err)
+		}
+		server.tokens = tokens
+		adminHandlers["/tokens"] = tokens.handleIssueToken
+	} else {
+		log.Warn("Bootstrap token authentication disabled, all enrollment requests are accepted")
+	}
+
+	if c.RevocationFile != "" {
+		revocations, err := newRevocationStore(c.RevocationFile, c.signingKey,
+			c.signingCerts[0], c.crlInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load revocations: %w", err)
+		}
+		if err := revocations.publish(); err != nil {
+			return nil, fmt.Errorf("failed to publish CRL: %w", err)
+		}
+		server.revocations = revocations
+		adminHandlers["/revocations"] = revocations.handleRevoke
+		http.HandleFunc(est.EndpointPrefix+est.CrlEndpoint,
+			server.limitSource(revocations.handleCrl))
+	}
+
+	if c.AdminAddr != "" && len(adminHandlers) > 0 {
+		err := serveAdmin(c.AdminAddr, adminHandlers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serve admin API: %w", err)
+		}
+	}
+
+	if c.AuditLog != "" {
+		auditLog, err := openIssuanceLog(c.AuditLog, c.signingKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open issuance log: %w", err)
+		}
+		if err := auditLog.publish(c.sthInterval); err != nil {
+			return nil, fmt.Errorf("failed to publish tree head: %w", err)
+		}
+		server.auditLog = auditLog
+		http.HandleFunc(est.EndpointPrefix+est.AuditLogSthEndpoint,
+			server.limitSource(auditLog.handleSth))
+		http.HandleFunc(est.EndpointPrefix+est.AuditLogInclusionEndpoint,
+			server.limitSource(auditLog.handleInclusion))
+		http.HandleFunc(est.EndpointPrefix+est.AuditLogConsistencyEndpoint,
+			server.limitSource(auditLog.handleConsistency))
+	}
+
+	if len(c.attestationCas) > 0 {
+		server.attestConf = &attestConfig{
+			cas:      c.attestationCas,
+			policies: c.attestationPolicies,
+			polEng:   c.attestationPolEng,
+			cache:    c.VcekCacheFolder,
+			required: c.RequireAttestation,
+		}
+		http.HandleFunc(est.EndpointPrefix+est.AttestNonceEndpoint,
+			server.limitSource(server.handleAttestNonce))
+		http.HandleFunc(est.EndpointPrefix+est.AttestEnrollEndpoint,
+			server.limitSource(server.handleAttestEnroll))
+	} else if c.RequireAttestation {
+		return nil, errors.New("attested enrollment required but no attestation CAs configured")
+	}
+
+	http.HandleFunc(cacertsEndpoint, server.limitSource(server.handleCacerts))
+	http.HandleFunc(simpleenrollEndpoint, server.limitSource(server.handleSimpleenroll))
+	http.HandleFunc(simplereenrollEndpoint, server.limitSource(server.handleSimpleReenroll))
+	http.HandleFunc(tpmActivateEndpoint, server.limitSource(server.handleTpmActivate))
+	http.HandleFunc(tpmActivateEnrollEndpoint, server.limitSource(server.handleTpmActivateEnroll))
+	http.HandleFunc(tpmCertifyEnrollEndpoint, server.limitSource(server.handleTpmCertifyEnroll))
+	http.HandleFunc(snpEnrollEndpoint, server.limitSource(server.handleSnpEnroll))
+
+	// Enrollments for the certificate profiles are requested via the CA label
+	for name := range c.CertProfiles {
+		label := est.EndpointPrefix + "/" + name
+		http.HandleFunc(label+est.EnrollEndpoint, server.limitSource(server.handleSimpleenroll))
+		http.HandleFunc(label+est.ReenrollEndpoint, server.limitSource(server.handleSimpleReenroll))
+		if server.attestConf != nil {
+			http.HandleFunc(label+est.AttestEnrollEndpoint,
+				server.limitSource(server.handleAttestEnroll))
+		}
+	}
 
 	err := httpHandleMetadata(c.HttpFolder)
 	if err != nil {
@@ -177,9 +277,25 @@ func (s *Server) handleSimpleenroll(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	cert, err := enrollCert(csr, s.signingKey, s.signingCerts[0])
+	err = est.VerifyChannelBinding(csr, req.TLS, s.channelBinding)
 	if err != nil {
-		writeHttpErrorf(w, "Failed to enroll certificate: %v", err)
+		writeHttpErrorf(w, "Failed to verify channel binding: %v", err)
+		return
+	}
+
+	if s.attestConf != nil && s.attestConf.required {
+		writeProblem(w, http.StatusForbidden, 0,
+			"Enrollment of %v requires an attestation report via attestenroll", sourceIp(req))
+		return
+	}
+
+	r, ok := s.authorize(w, req, nil)
+	if !ok {
+		return
+	}
+
+	cert := s.issueCert(w, req, csr, r)
+	if cert == nil {
 		return
 	}
 
@@ -197,12 +313,111 @@ func (s *Server) handleSimpleenroll(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (s *Server) handleTpmActivateEnroll(w http.ResponseWriter, req *http.Request) {
+// handleSimpleReenroll renews the certificate the client authenticated with
+// via TLS [RFC7030 4.2.2]. The CSR must contain the subject and the DNS names
+// of the current certificate. Different names can be requested via the
+// ChangeSubjectName attribute
+func (s *Server) handleSimpleReenroll(w http.ResponseWriter, req *http.Request) {
 
-	log.Tracef("Received 'tpmactivateenroll' request from %v", req.RemoteAddr)
+	log.Tracef("Received 'simplereenroll' request from %v", req.RemoteAddr)
 
 	if strings.Compare(req.Method, "POST") != 0 {
-		writeHttpErrorf(w, "Method %v not implemented for tpmactivateenroll request", req.Method)
+		writeHttpErrorf(w, "Method %v not implemented for simplereenroll request", req.Method)
+		return
+	}
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		msg := "simplereenroll requires client authentication with the current certificate"
+		log.Warn(msg)
+		http.Error(w, msg, http.StatusUnauthorized)
+		return
+	}
+	current := req.TLS.VerifiedChains[0][0]
+
+	t, _, err := mime.ParseMediaType(req.Header.Get(est.ContentTypeHeader))
+	if err != nil {
+		writeHttpErrorf(w, "failed to parse media type %s: %v",
+			est.ContentTypeHeader, err)
+		return
+	}
+	if !strings.HasPrefix(t, est.MimeTypePKCS10) {
+		writeHttpErrorf(w, "invalid %s %s, must begin with %s", est.ContentTypeHeader,
+			t, est.MimeTypePKCS10)
+		return
+	}
+
+	csr, err := est.ParsePkcs10Csr(req.Body)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to parse CSR: %v", err)
+		return
+	}
+
+	err = est.VerifyChannelBinding(csr, req.TLS, s.channelBinding)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to verify channel binding: %v", err)
+		return
+	}
+
+	if !bytes.Equal(csr.RawSubject, current.RawSubject) ||
+		!slices.Equal(csr.DNSNames, current.DNSNames) {
+		writeHttpErrorf(w, "CSR subject %v %v does not match current certificate %v %v",
+			csr.Subject, csr.DNSNames, current.Subject, current.DNSNames)
+		return
+	}
+
+	if s.reenrollNewKey && publicKeyEqual(csr.PublicKey, current.PublicKey) {
+		msg := "simplereenroll requires a new key"
+		log.Debugf("Refusing to re-enroll key of %v: %v", current.Subject.CommonName, msg)
+		http.Error(w, msg, est.StatusNewKeyRequired)
+		return
+	}
+
+	change, err := est.ParseChangeSubjectName(csr)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to parse ChangeSubjectName: %v", err)
+		return
+	}
+	if change != nil {
+		log.Debugf("Changing subject of %v via ChangeSubjectName", current.Subject.CommonName)
+		if change.RawSubject != nil {
+			csr.RawSubject = change.RawSubject
+		}
+		csr.DNSNames = change.DNSNames
+	}
+
+	// The renewed certificate is issued for the identity of the current certificate
+	cert := s.issueCert(w, req, csr, &requester{
+		device: s.policy.certDeviceIdentity(current),
+		auth:   authClientCert,
+	})
+	if cert == nil {
+		return
+	}
+
+	body, err := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+	if err != nil {
+		writeHttpErrorf(w, "Failed to encode PKCS7 certs-only: %v", err)
+		return
+	}
+	encoded := est.EncodeBase64(body)
+
+	err = sendResponse(w, est.MimeTypePKCS7, est.EncodingTypeBase64, encoded)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to send generated certificate: %v", err)
+		return
+	}
+}
+
+// handleTpmActivate verifies the EK and the AK parameters and returns a
+// credential activation challenge encrypted to the EK. The AK certificate is
+// only issued after the device returned the activated secret via the
+// tpmactivateenroll request
+func (s *Server) handleTpmActivate(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'tpmactivate' request from %v", req.RemoteAddr)
+
+	if strings.Compare(req.Method, "POST") != 0 {
+		writeHttpErrorf(w, "Method %v not implemented for tpmactivate request", req.Method)
 		return
 	}
 
@@ -237,15 +452,21 @@ func (s *Server) handleTpmActivateEnroll(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	err = verifyEk(ekPubPkix, ekCertDer, tpmInfo, ekCertUrl, &s.tpmConf)
+	ekPub, err := verifyEk(ekPubPkix, ekCertDer, tpmInfo, ekCertUrl, &s.tpmConf)
 	if err != nil {
 		writeHttpErrorf(w, "Failed to verify EK: %v", err)
 		return
 	}
 
-	ekPub, err := x509.ParsePKIXPublicKey(ekPubPkix)
+	// Verify that activated AK is actually the certificate's public key
+	err = verifyTpmCsr(akPublic, csr)
 	if err != nil {
-		writeHttpErrorf(w, "failed to parse PKIX public key: %v", err)
+		writeHttpErrorf(w, "failed to verify AK: %v", err)
+		return
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		writeHttpErrorf(w, "failed to verify CSR signature: %v", err)
 		return
 	}
 
@@ -261,48 +482,89 @@ func (s *Server) handleTpmActivateEnroll(w http.ResponseWriter, req *http.Reques
 		},
 	}
 
+	if _, ok := s.authorize(w, req, ekCertDer); !ok {
+		return
+	}
+
 	// Generate the credential activation challenge. This includes verifying, that the
 	// AK is a restricted, fixedTPM, fixedParent key
-	secret, encryptedCredentials, err := params.Generate()
+	secret, encryptedCredentials, err := generateActivation(params)
 	if err != nil {
 		writeHttpErrorf(w, "failed to generate AK credentials: '%v'", err)
 		return
 	}
 
-	// Verify that activated AK is actually the certificate's public key
-	err = verifyTpmCsr(akPublic, csr)
+	id, err := s.tpmConf.addActivation(csr, secret, ekIdentity(ekCertDer, ekPubPkix))
 	if err != nil {
-		writeHttpErrorf(w, "failed to verify AK: %v", err)
+		writeHttpErrorf(w, "Failed to store credential activation: %v", err)
 		return
 	}
 
-	cert, err := enrollCert(csr, s.signingKey, s.signingCerts[0])
+	payload, contentType, err := est.EncodeMultiPart(
+		[]est.MimeMultipart{
+			{ContentType: est.MimeTypeTextPlain, Data: id},
+			{ContentType: est.MimeTypeOctetStream, Data: encryptedCredentials.Credential},
+			{ContentType: est.MimeTypeOctetStream, Data: encryptedCredentials.Secret},
+		},
+	)
 	if err != nil {
-		writeHttpErrorf(w, "Failed to enroll certificate: %v", err)
+		writeHttpErrorf(w, "Failed to encode multipart: %v", err)
 		return
 	}
 
-	// TODO Discuss if this is secure
-	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256GCM
-	encryptedCert, err := pkcs7.EncryptUsingPSK(cert.Raw, secret)
+	err = sendResponse(w, contentType, "", payload.Bytes())
 	if err != nil {
-		writeHttpErrorf(w, "Failed to encrypt using PSK: %v", err)
+		writeHttpErrorf(w, "Failed to send credential activation challenge: %v", err)
+	}
+}
+
+// handleTpmActivateEnroll issues the AK certificate if the device returned the
+// secret of the credential activation challenge
+func (s *Server) handleTpmActivateEnroll(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received 'tpmactivateenroll' request from %v", req.RemoteAddr)
+
+	if strings.Compare(req.Method, "POST") != 0 {
+		writeHttpErrorf(w, "Method %v not implemented for tpmactivateenroll request", req.Method)
 		return
 	}
 
-	payload, contentType, err := est.EncodeMultiPart(
+	var id string
+	var secret []byte
+
+	_, err := est.DecodeMultipart(
+		req.Body,
 		[]est.MimeMultipart{
-			{ContentType: est.MimeTypeOctetStream, Data: encryptedCredentials.Credential},
-			{ContentType: est.MimeTypeOctetStream, Data: encryptedCredentials.Secret},
-			{ContentType: est.MimeTypePKCS7Enveloped, Data: encryptedCert},
+			{ContentType: est.MimeTypeTextPlain, Data: &id},
+			{ContentType: est.MimeTypeOctetStream, Data: &secret},
 		},
+		req.Header.Get(est.ContentTypeHeader),
 	)
 	if err != nil {
-		writeHttpErrorf(w, "Failed to encode multipart: %v", err)
+		writeHttpErrorf(w, "Failed to decode multipart: %v", err)
 		return
 	}
 
-	err = sendResponse(w, contentType, "", payload.Bytes())
+	csr, device, err := s.tpmConf.completeActivation(id, secret)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to verify credential activation: %v", err)
+		return
+	}
+
+	cert := s.issueCert(w, req, csr, &requester{device: device, auth: authActivation})
+	if cert == nil {
+		return
+	}
+	s.tpmConf.addActivatedAk(csr.PublicKey, device)
+
+	body, err := est.EncodePkcs7CertsOnly([]*x509.Certificate{cert})
+	if err != nil {
+		writeHttpErrorf(w, "Failed to encode PKCS7 certs-only: %v", err)
+		return
+	}
+	encoded := est.EncodeBase64(body)
+
+	err = sendResponse(w, est.MimeTypePKCS7, est.EncodingTypeBase64, encoded)
 	if err != nil {
 		writeHttpErrorf(w, "Failed to send generated certificate: %v", err)
 	}
@@ -352,6 +614,7 @@ func (s *Server) handleTpmCertifyEnroll(w http.ResponseWriter, req *http.Request
 	err = verifyIk(ikParams, akPublic)
 	if err != nil {
 		writeHttpErrorf(w, "failed to verify IK: %v", err)
+		return
 	}
 
 	// Verify that certified IK is actually the CSR's public key
@@ -361,9 +624,18 @@ func (s *Server) handleTpmCertifyEnroll(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	cert, err := enrollCert(csr, s.signingKey, s.signingCerts[0])
-	if err != nil {
-		writeHttpErrorf(w, "Failed to enroll certificate: %v", err)
+	// The IK certificate is issued for the device identity without further
+	// authorization if the certifying AK was activated through an authorized
+	// credential activation
+	var r *requester
+	if device, ok := s.tpmConf.activatedAk(akPublic); ok {
+		r = &requester{device: device, auth: authActivatedAk}
+	} else if r, ok = s.authorize(w, req, nil); !ok {
+		return
+	}
+
+	cert := s.issueCert(w, req, csr, r)
+	if cert == nil {
 		return
 	}
 
@@ -482,8 +754,64 @@ func sendResponse(w http.ResponseWriter, contentType, transferEncoding string, p
 	return nil
 }
 
-// enrollCert generates a new certificate signed by the CA
-func enrollCert(csr *x509.CertificateRequest, key *ecdsa.PrivateKey, parent *x509.Certificate,
+// issueCert checks the CSR against the CSR policy for the device identity of the
+// requester and issues the certificate. If configured, the issuance is recorded
+// in the issuance log before the certificate is returned. If the CSR is refused
+// or the issuance cannot be recorded, an error response is sent and nil is
+// returned
+func (s *Server) issueCert(w http.ResponseWriter, req *http.Request,
+	csr *x509.CertificateRequest, r *requester,
+) *x509.Certificate {
+
+	name, profile, err := s.certProfile(req)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to get certificate profile: %v", err)
+		return nil
+	}
+
+	device := r.device
+	ci, err := s.policy.check(csr, device)
+	if err != nil {
+		var perr *policyError
+		if errors.As(err, &perr) {
+			writePolicyError(w, perr)
+		} else {
+			writeHttpErrorf(w, "Failed to check CSR policy: %v", err)
+		}
+		return nil
+	}
+
+	cert, err := enrollCert(csr, s.signingKey, s.signingCerts[0], ci, profile, device, s.crlUrl)
+	if err != nil {
+		var perr *policyError
+		if errors.As(err, &perr) {
+			writePolicyError(w, perr)
+		} else {
+			writeHttpErrorf(w, "Failed to enroll certificate: %v", err)
+		}
+		return nil
+	}
+	if s.auditLog != nil {
+		err = s.auditLog.append(newAuditEntry(req, csr, cert, r, name))
+		if err != nil {
+			log.Errorf("Failed to record issuance of %v: %v", cert.Subject.CommonName, err)
+			http.Error(w, "Failed to record certificate issuance", http.StatusInternalServerError)
+			return nil
+		}
+	}
+	if device != nil {
+		log.Debugf("Issued certificate %v for device %v (%v)", cert.Subject.CommonName,
+			device.Id, device.Source)
+	}
+
+	return cert
+}
+
+// enrollCert issues the certificate for the CSR with the profile. If ci is not
+// nil, its identity SANs and extensions are added to the certificate. If crlUrl
+// is set, it is embedded as CRL distribution point
+func enrollCert(csr *x509.CertificateRequest, key crypto.Signer, parent *x509.Certificate,
+	ci *certIdentity, profile *certProfile, id *deviceIdentity, crlUrl string,
 ) (*x509.Certificate, error) {
 
 	// Check that CSR is self-signed
@@ -509,13 +837,19 @@ func enrollCert(csr *x509.CertificateRequest, key *ecdsa.PrivateKey, parent *x50
 		SerialNumber:          serial,
 		RawSubject:            csr.RawSubject,
 		SubjectKeyId:          ski[:],
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 180),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		DNSNames:              csr.DNSNames,
 	}
+	if err := profile.apply(&tmpl, csr, id); err != nil {
+		return nil, err
+	}
+	if ci != nil {
+		tmpl.URIs = ci.uris
+		tmpl.ExtraExtensions = ci.extensions
+	}
+	if crlUrl != "" {
+		tmpl.CRLDistributionPoints = []string{crlUrl}
+	}
 
 	certDer, err := x509.CreateCertificate(rand.Reader, &tmpl, parent, csr.PublicKey, key)
 	if err != nil {
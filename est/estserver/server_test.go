@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"go.mozilla.org/pkcs7"
+)
+
+func Test_handleSimpleReenroll(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	devKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		DNSNames:     []string{"device.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, ca, &devKey.PublicKey, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create device certificate: %v", err)
+	}
+	device, _ := x509.ParseCertificate(der)
+
+	desired := func(cn string) *x509.CertificateRequest {
+		der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: []string{"device.local"},
+		}, devKey)
+		csr, _ := x509.ParseCertificateRequest(der)
+		return csr
+	}
+	csrOther, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "other"},
+	}, devKey)
+
+	reenrollCsr := func(key *ecdsa.PrivateKey, d *x509.CertificateRequest) []byte {
+		csr, err := est.CreateReenrollCsr(key, device, d)
+		if err != nil {
+			t.Fatalf("failed to create CSR: %v", err)
+		}
+		return csr.Raw
+	}
+
+	tests := []struct {
+		name       string
+		csr        []byte
+		clientAuth bool
+		newKey     bool
+		wantStatus int
+		wantCn     string
+	}{
+		{"Success", reenrollCsr(devKey, nil), true, false, http.StatusOK, "device"},
+		{"Success Changed Subject", reenrollCsr(devKey, desired("renamed")), true, false,
+			http.StatusOK, "renamed"},
+		{"Success New Key", reenrollCsr(newKey, nil), true, true, http.StatusOK, "device"},
+		{"New Key Required", reenrollCsr(devKey, nil), true, true, est.StatusNewKeyRequired, ""},
+		{"Subject Mismatch", csrOther, true, false, http.StatusBadRequest, ""},
+		{"No Client Certificate", reenrollCsr(devKey, nil), false, false,
+			http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				signingKey:     caPriv,
+				signingCerts:   []*x509.Certificate{ca},
+				reenrollNewKey: tt.newKey,
+			}
+
+			req := httptest.NewRequest(http.MethodPost, est.EndpointPrefix+est.ReenrollEndpoint,
+				bytes.NewReader(est.EncodeBase64(tt.csr)))
+			req.Header.Set(est.ContentTypeHeader, est.MimeTypePKCS10)
+			req.TLS = &tls.ConnectionState{}
+			if tt.clientAuth {
+				req.TLS.PeerCertificates = []*x509.Certificate{device}
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{device, ca}}
+			}
+			w := httptest.NewRecorder()
+
+			s.handleSimpleReenroll(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("handleSimpleReenroll() status = %v, want %v", resp.StatusCode,
+					tt.wantStatus)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			decoded, err := est.DecodeBase64(body)
+			if err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			p7, err := pkcs7.Parse(decoded)
+			if err != nil || len(p7.Certificates) != 1 {
+				t.Fatalf("failed to decode certificate: %v", err)
+			}
+			certs := p7.Certificates
+			if certs[0].Subject.CommonName != tt.wantCn {
+				t.Errorf("renewed certificate subject %v, want %v", certs[0].Subject.CommonName,
+					tt.wantCn)
+			}
+		})
+	}
+}
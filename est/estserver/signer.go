@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/Fraunhofer-AISEC/cmc/pkcs11driver"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadSigner loads the key for signing the issued certificates and the
+// corresponding certificate chain. The key is either read from the signing key
+// file or, if a PKCS#11 module is configured, used on the PKCS#11 token. For
+// PKCS#11, the CA certificate is read from the token if no signing certificates
+// are configured. The key is verified to match the CA certificate
+func loadSigner(c *config) (crypto.Signer, []*x509.Certificate, error) {
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	var err error
+
+	if c.Pkcs11Module != "" {
+		signer, err := pkcs11driver.OpenSigner(pkcs11driver.SignerConfig{
+			Module:   c.Pkcs11Module,
+			Token:    c.Pkcs11Token,
+			Slot:     c.Pkcs11Slot,
+			KeyLabel: c.Pkcs11KeyLabel,
+			KeyId:    c.Pkcs11KeyId,
+			Pin:      c.Pkcs11Pin,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		key = signer
+
+		if len(c.SigningCerts) == 0 {
+			log.Debug("Reading CA certificate from PKCS#11 token")
+			cert, err := signer.Certificate()
+			if err != nil {
+				signer.Close()
+				return nil, nil, err
+			}
+			certs = []*x509.Certificate{cert}
+		}
+	} else {
+		if c.SigningKey == "" {
+			return nil, nil, errors.New("neither signing key file nor PKCS#11 module specified")
+		}
+		key, err = loadPrivateKey(c.SigningKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load private key: %w", err)
+		}
+	}
+
+	if certs == nil {
+		certs, err = loadCertChain(c.SigningCerts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load certificate chain: %w", err)
+		}
+	}
+
+	if err := verifySigner(key, certs[0]); err != nil {
+		if s, ok := key.(*pkcs11driver.Signer); ok {
+			s.Close()
+		}
+		return nil, nil, err
+	}
+
+	return key, certs, nil
+}
+
+// verifySigner verifies that the key matches the CA certificate by creating a
+// signature with the key, which is verified with the certificate
+func verifySigner(key crypto.Signer, cert *x509.Certificate) error {
+
+	if !publicKeyEqual(key.Public(), cert.PublicKey) {
+		return fmt.Errorf("signing key does not match CA certificate %v", cert.Subject.CommonName)
+	}
+
+	var alg x509.SignatureAlgorithm
+	switch cert.PublicKeyAlgorithm {
+	case x509.ECDSA:
+		alg = x509.ECDSAWithSHA256
+	case x509.RSA:
+		alg = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("unsupported CA key algorithm %v", cert.PublicKeyAlgorithm)
+	}
+
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return fmt.Errorf("failed to create test data: %w", err)
+	}
+	digest := sha256.Sum256(data)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign with signing key: %w", err)
+	}
+	if err := cert.CheckSignature(alg, data, sig); err != nil {
+		return fmt.Errorf("failed to verify signature of signing key: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/pkcs11driver"
+	"github.com/miekg/pkcs11"
+)
+
+func TestLoadSigner(t *testing.T) {
+
+	dir := t.TempDir()
+	caPriv, ca := createCa(t)
+	_, other := createCa(t)
+
+	writePem := func(name, typ string, der []byte) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+		return f
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(caPriv)
+	keyFile := writePem("ca-key.pem", "EC PRIVATE KEY", keyDer)
+	caFile := writePem("ca.pem", "CERTIFICATE", ca.Raw)
+	otherFile := writePem("other.pem", "CERTIFICATE", other.Raw)
+
+	tests := []struct {
+		name    string
+		c       config
+		wantErr bool
+	}{
+		{"Success", config{SigningKey: keyFile, SigningCerts: []string{caFile}}, false},
+		{"Key Mismatch", config{SigningKey: keyFile, SigningCerts: []string{otherFile}}, true},
+		{"No Key", config{SigningCerts: []string{caFile}}, true},
+		{"No Certificates", config{SigningKey: keyFile}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, certs, err := loadSigner(&tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (!publicKeyEqual(key.Public(), ca.PublicKey) || len(certs) != 1) {
+				t.Fatalf("loadSigner() returned unexpected key or certificates")
+			}
+		})
+	}
+}
+
+// TestSoftHsmSigner issues a certificate with a CA key and certificate stored on
+// a SoftHSM2 token. The module is taken from SOFTHSM2_MODULE or the default
+// installation path, otherwise the test is skipped
+func TestSoftHsmSigner(t *testing.T) {
+
+	module := softHsmModule(t)
+	const pin = "1234"
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tokens"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %v\n",
+		filepath.Join(dir, "tokens"))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+	t.Setenv("CMC_TEST_PIN", pin)
+
+	c := &config{
+		Pkcs11Module:   module,
+		Pkcs11Token:    "cmc-ca",
+		Pkcs11KeyLabel: "ca",
+		Pkcs11Pin:      "env:CMC_TEST_PIN",
+	}
+
+	// Generate the CA key on the token and store the self-signed CA certificate
+	createSoftHsmCa(t, module, pin)
+	signer, err := pkcs11driver.OpenSigner(pkcs11driver.SignerConfig{
+		Module:   c.Pkcs11Module,
+		Token:    c.Pkcs11Token,
+		KeyLabel: c.Pkcs11KeyLabel,
+		Pin:      c.Pkcs11Pin,
+	})
+	if err != nil {
+		t.Fatalf("OpenSigner() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "HSM CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	signer.Close()
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	withSoftHsmSession(t, module, pin, func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle) {
+		_, err := ctx.CreateObject(sh, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "ca"),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, der),
+		})
+		if err != nil {
+			t.Fatalf("failed to store CA certificate: %v", err)
+		}
+	})
+
+	key, certs, err := loadSigner(c)
+	if err != nil {
+		t.Fatalf("loadSigner() error = %v", err)
+	}
+	defer key.(*pkcs11driver.Signer).Close()
+	if certs[0].Subject.CommonName != "HSM CA" {
+		t.Fatalf("CA certificate %v read from token, want HSM CA", certs[0].Subject.CommonName)
+	}
+
+	devKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDer, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, devKey)
+	csr, _ := x509.ParseCertificateRequest(csrDer)
+
+	cert, err := enrollCert(csr, key, certs[0], nil, defaultProfile, nil, "")
+	if err != nil {
+		t.Fatalf("enrollCert() error = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certs[0])
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		t.Fatalf("failed to verify issued certificate: %v", err)
+	}
+}
+
+func softHsmModule(t *testing.T) string {
+	if m := os.Getenv("SOFTHSM2_MODULE"); m != "" {
+		return m
+	}
+	for _, m := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+	} {
+		if _, err := os.Stat(m); err == nil {
+			return m
+		}
+	}
+	t.Skip("SoftHSM2 not available")
+	return ""
+}
+
+// createSoftHsmCa initializes the token cmc-ca and generates the EC P-256 CA key
+func createSoftHsmCa(t *testing.T, module, pin string) {
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("failed to load %v", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("failed to get slots: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], "so-pin", "cmc-ca"); err != nil {
+		t.Fatalf("failed to initialize token: %v", err)
+	}
+	sh, err := ctx.OpenSession(softHsmSlot(t, ctx), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Login(sh, pkcs11.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(sh, pin); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(sh)
+	ctx.CloseSession(sh)
+	ctx.Finalize()
+
+	withSoftHsmSession(t, module, pin, func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle) {
+		params, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+		_, _, err := ctx.GenerateKeyPair(sh,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, "ca"),
+			},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, "ca"),
+			})
+		if err != nil {
+			t.Fatalf("failed to generate CA key: %v", err)
+		}
+	})
+}
+
+// withSoftHsmSession calls f with a read-write user session of the token cmc-ca
+func withSoftHsmSession(t *testing.T, module, pin string,
+	f func(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle),
+) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("failed to load %v", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	defer ctx.Finalize()
+
+	sh, err := ctx.OpenSession(softHsmSlot(t, ctx), pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(sh)
+	if err := ctx.Login(sh, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatal(err)
+	}
+	f(ctx, sh)
+}
+
+// softHsmSlot returns the slot of the token cmc-ca. SoftHSM re-assigns the
+// slot of an initialized token
+func softHsmSlot(t *testing.T, ctx *pkcs11.Ctx) uint {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err == nil && info.Label == "cmc-ca" {
+			return s
+		}
+	}
+	t.Fatalf("token cmc-ca not found")
+	return 0
+}
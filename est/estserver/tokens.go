@@ -0,0 +1,366 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tokenLength     = 32
+	maxTokenRequest = 4096
+)
+
+var (
+	ErrTokenMissing  = errors.New("bootstrap token missing")
+	ErrTokenInvalid  = errors.New("bootstrap token invalid")
+	ErrTokenExpired  = errors.New("bootstrap token expired")
+	ErrTokenConsumed = errors.New("bootstrap token already consumed")
+	ErrTokenBinding  = errors.New("bootstrap token bound to different device")
+)
+
+// bootstrapToken is a token issued out-of-band, which authorizes a limited number
+// of enrollments. Tokens are only stored as SHA256 hash. Tokens can optionally
+// be bound to a device via the SHA256 hash of the TPM EK certificate and can
+// entitle the device to the identity of the specified device ID
+type bootstrapToken struct {
+	Token       string    `json:"token,omitempty"`
+	TokenSha256 string    `json:"tokenSha256,omitempty"`
+	Uses        int       `json:"uses"`
+	Expiry      time.Time `json:"expiry,omitempty"`
+	EkCertHash  string    `json:"ekCertHash,omitempty"`
+	DeviceId    string    `json:"deviceId,omitempty"`
+}
+
+// tokenStore contains the bootstrap tokens. If a file is configured, the tokens
+// are loaded from and the remaining uses persisted to the file, so that consumed
+// tokens cannot be reused after a restart
+type tokenStore struct {
+	mu     sync.Mutex
+	file   string
+	tokens map[string]*bootstrapToken
+	now    func() time.Time
+}
+
+func newTokenStore(file string) (*tokenStore, error) {
+	s := &tokenStore{
+		file:   file,
+		tokens: make(map[string]*bootstrapToken),
+		now:    time.Now,
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Infof("Token file %v does not exist, starting without tokens", file)
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	var tokens []bootstrapToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token file: %w", err)
+	}
+	for i := range tokens {
+		t := tokens[i]
+		if t.Token != "" {
+			t.TokenSha256 = hashToken(t.Token)
+			t.Token = ""
+		}
+		t.EkCertHash = strings.ToLower(t.EkCertHash)
+		if len(t.TokenSha256) != 2*sha256.Size {
+			return nil, fmt.Errorf("token %v of token file does not contain a valid token", i)
+		}
+		s.tokens[strings.ToLower(t.TokenSha256)] = &t
+	}
+	log.Debugf("Loaded %v bootstrap tokens from %v", len(s.tokens), file)
+
+	return s, nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// issue creates a new token with the specified number of uses and validity and
+// returns the token
+func (s *tokenStore) issue(uses int, validity time.Duration, ekCertHash, deviceId string,
+) (string, *bootstrapToken, error) {
+	if uses <= 0 {
+		return "", nil, fmt.Errorf("invalid number of token uses %v", uses)
+	}
+
+	raw := make([]byte, tokenLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to create token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	t := &bootstrapToken{
+		TokenSha256: hashToken(token),
+		Uses:        uses,
+		EkCertHash:  strings.ToLower(ekCertHash),
+		DeviceId:    deviceId,
+	}
+	if validity > 0 {
+		t.Expiry = s.now().Add(validity)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.TokenSha256] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.TokenSha256)
+		return "", nil, err
+	}
+
+	return token, t, nil
+}
+
+// consume checks the token and decrements its remaining uses. If the token is
+// bound to an EK certificate, the hash of the EK certificate of the request
+// must match. The consumed token is returned
+func (s *tokenStore) consume(token string, ekCert []byte) (bootstrapToken, error) {
+	if token == "" {
+		return bootstrapToken{}, ErrTokenMissing
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hashToken(token)]
+	if !ok {
+		return bootstrapToken{}, ErrTokenInvalid
+	}
+	if !t.Expiry.IsZero() && s.now().After(t.Expiry) {
+		return bootstrapToken{}, ErrTokenExpired
+	}
+	if t.Uses <= 0 {
+		return bootstrapToken{}, ErrTokenConsumed
+	}
+	if t.EkCertHash != "" {
+		if ekCert == nil {
+			return bootstrapToken{}, fmt.Errorf("%w: request does not contain EK certificate",
+				ErrTokenBinding)
+		}
+		h := sha256.Sum256(ekCert)
+		if hex.EncodeToString(h[:]) != t.EkCertHash {
+			return bootstrapToken{}, ErrTokenBinding
+		}
+	}
+
+	t.Uses--
+	if err := s.save(); err != nil {
+		t.Uses++
+		return bootstrapToken{}, err
+	}
+
+	return *t, nil
+}
+
+// save persists the tokens. Consumed tokens are kept, so that reuse is reported
+func (s *tokenStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	tokens := make([]bootstrapToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, *t)
+	}
+	data, err := json.MarshalIndent(tokens, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal tokens: %w", err)
+	}
+
+	// The file remains plain JSON, as it may be provided by the administrator
+	if err := internal.WriteFileAtomic(s.file, data, 0600); err != nil {
+		return fmt.Errorf("failed to store tokens: %w", err)
+	}
+	return nil
+}
+
+// getToken returns the bootstrap token of the request
+func getToken(req *http.Request) string {
+	header := req.Header.Get(est.AuthorizationHeader)
+	if !strings.HasPrefix(header, est.BearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, est.BearerPrefix))
+}
+
+type tokenRequest struct {
+	Uses       int    `json:"uses"`
+	Validity   string `json:"validity,omitempty"`
+	EkCertHash string `json:"ekCertHash,omitempty"`
+	DeviceId   string `json:"deviceId,omitempty"`
+}
+
+type tokenResponse struct {
+	Token      string    `json:"token"`
+	Uses       int       `json:"uses"`
+	Expiry     time.Time `json:"expiry,omitempty"`
+	EkCertHash string    `json:"ekCertHash,omitempty"`
+	DeviceId   string    `json:"deviceId,omitempty"`
+}
+
+// handleIssueToken implements the admin API for issuing bootstrap tokens
+func (s *tokenStore) handleIssueToken(w http.ResponseWriter, req *http.Request) {
+
+	log.Tracef("Received admin token request from %v", req.RemoteAddr)
+
+	if req.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("Method %v not implemented for token request", req.Method),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxTokenRequest))
+	if err != nil {
+		writeHttpErrorf(w, "Failed to read token request: %v", err)
+		return
+	}
+	r := tokenRequest{Uses: 1}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &r); err != nil {
+			writeHttpErrorf(w, "Failed to unmarshal token request: %v", err)
+			return
+		}
+	}
+	var validity time.Duration
+	if r.Validity != "" {
+		validity, err = time.ParseDuration(r.Validity)
+		if err != nil {
+			writeHttpErrorf(w, "Failed to parse token validity: %v", err)
+			return
+		}
+	}
+	if r.EkCertHash != "" {
+		if h, err := hex.DecodeString(r.EkCertHash); err != nil || len(h) != sha256.Size {
+			writeHttpErrorf(w, "Invalid EK certificate hash %v", r.EkCertHash)
+			return
+		}
+	}
+
+	token, t, err := s.issue(r.Uses, validity, r.EkCertHash, r.DeviceId)
+	if err != nil {
+		writeHttpErrorf(w, "Failed to issue token: %v", err)
+		return
+	}
+	log.Infof("Issued bootstrap token with %v uses", t.Uses)
+
+	resp, err := json.Marshal(tokenResponse{
+		Token:      token,
+		Uses:       t.Uses,
+		Expiry:     t.Expiry,
+		EkCertHash: t.EkCertHash,
+		DeviceId:   t.DeviceId,
+	})
+	if err != nil {
+		writeHttpErrorf(w, "Failed to marshal token response: %v", err)
+		return
+	}
+	if err := sendResponse(w, est.MimeTypeJSON, "", resp); err != nil {
+		log.Warnf("Failed to send token response: %v", err)
+	}
+}
+
+// authorize checks that the enrollment request is authorized. Requests are
+// authorized via a verified TLS client certificate or a valid bootstrap token,
+// which is consumed. If the token is bound to a device, the EK certificate of
+// the request must match. If token authentication is disabled, all requests
+// are authorized. The returned requester contains the authentication method and
+// the identity of the device embedded into the client certificate or the device
+// ID of the token. If the request is not authorized, an error response is sent
+// and false is returned
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, ekCert []byte,
+) (*requester, bool) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		log.Debugf("Authorized request of %v via client certificate", cert.Subject.CommonName)
+		return &requester{device: s.policy.certDeviceIdentity(cert), auth: authClientCert}, true
+	}
+	if s.tokens == nil {
+		return &requester{auth: authNone}, true
+	}
+
+	token := getToken(req)
+	if token != "" {
+		if ok, retry := s.tokenLimiter.allow(hashToken(token)); !ok {
+			writeProblem(w, http.StatusTooManyRequests, retry, "Rate limit of token exceeded")
+			return nil, false
+		}
+	}
+	t, err := s.tokens.consume(token, ekCert)
+	if err != nil {
+		writeProblem(w, http.StatusUnauthorized, 0, "Failed to authorize request from %v: %v",
+			sourceIp(req), err)
+		return nil, false
+	}
+
+	r := &requester{auth: authToken}
+	if t.DeviceId != "" {
+		r.device = &deviceIdentity{Id: t.DeviceId, Source: "bootstrap token"}
+	}
+	return r, true
+}
+
+// serveAdmin serves the admin API with the handlers for the paths, which must
+// only be reachable locally
+func serveAdmin(addr string, handlers map[string]http.HandlerFunc) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("failed to parse admin address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin address %v is not a loopback address", addr)
+	}
+
+	mux := http.NewServeMux()
+	for path, h := range handlers {
+		mux.HandleFunc(path, h)
+	}
+
+	log.Infof("Serving admin API on %v", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Errorf("Admin API failed: %v", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	est "github.com/Fraunhofer-AISEC/cmc/est/common"
+)
+
+func TestTokenStore(t *testing.T) {
+
+	ekCert := []byte("ek certificate")
+	ekHash := sha256.Sum256(ekCert)
+
+	tests := []struct {
+		name       string
+		uses       int
+		validity   time.Duration
+		ekCertHash string
+		ekCert     []byte
+		elapsed    time.Duration
+		want       []error
+	}{
+		{"Single Use", 1, 0, "", nil, 0, []error{nil, ErrTokenConsumed}},
+		{"Limited Use", 2, 0, "", nil, 0, []error{nil, nil, ErrTokenConsumed}},
+		{"Not Expired", 1, time.Hour, "", nil, time.Minute, []error{nil}},
+		{"Expired", 1, time.Hour, "", nil, 2 * time.Hour, []error{ErrTokenExpired}},
+		{"EK Bound", 1, 0, hex.EncodeToString(ekHash[:]), ekCert, 0,
+			[]error{nil, ErrTokenConsumed}},
+		{"EK Mismatch", 1, 0, hex.EncodeToString(ekHash[:]), []byte("other"), 0,
+			[]error{ErrTokenBinding}},
+		{"EK Missing", 1, 0, hex.EncodeToString(ekHash[:]), nil, 0, []error{ErrTokenBinding}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newTokenStore("")
+			if err != nil {
+				t.Fatalf("newTokenStore() error = %v", err)
+			}
+			now := time.Now()
+			s.now = func() time.Time { return now }
+
+			token, _, err := s.issue(tt.uses, tt.validity, tt.ekCertHash, "")
+			if err != nil {
+				t.Fatalf("issue() error = %v", err)
+			}
+			now = now.Add(tt.elapsed)
+
+			for i, want := range tt.want {
+				_, err := s.consume(token, tt.ekCert)
+				if !errors.Is(err, want) {
+					t.Fatalf("consume() %v error = %v, want %v", i, err, want)
+				}
+			}
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		s, _ := newTokenStore("")
+		if _, err := s.consume("unknown", nil); !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("consume() error = %v, want %v", err, ErrTokenInvalid)
+		}
+		if _, err := s.consume("", nil); !errors.Is(err, ErrTokenMissing) {
+			t.Fatalf("consume() error = %v, want %v", err, ErrTokenMissing)
+		}
+	})
+}
+
+func TestTokenStorePersistence(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "tokens.json")
+
+	s, err := newTokenStore(file)
+	if err != nil {
+		t.Fatalf("newTokenStore() error = %v", err)
+	}
+	token, _, err := s.issue(1, 0, "", "")
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	if bytes.Contains(mustReadFile(t, file), []byte(token)) {
+		t.Fatalf("token file contains plaintext token")
+	}
+	if _, err := s.consume(token, nil); err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+
+	// A consumed token must not be usable after a restart of the server
+	reloaded, err := newTokenStore(file)
+	if err != nil {
+		t.Fatalf("newTokenStore() error = %v", err)
+	}
+	if _, err := reloaded.consume(token, nil); !errors.Is(err, ErrTokenConsumed) {
+		t.Fatalf("consume() after reload error = %v, want %v", err, ErrTokenConsumed)
+	}
+}
+
+func Test_handleSimpleenrollToken(t *testing.T) {
+
+	caPriv, ca := createCa(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+
+	tokens, _ := newTokenStore("")
+	token, _, err := tokens.issue(1, 0, "", "")
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	limited, _, err := tokens.issue(5, 0, "", "")
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+
+	s := &Server{
+		signingKey:   caPriv,
+		signingCerts: []*x509.Certificate{ca},
+		tokens:       tokens,
+		tokenLimiter: newRateLimiter(2),
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		clientAuth bool
+		wantStatus int
+	}{
+		{"Success", token, false, http.StatusOK},
+		{"Consumed Token Reuse", token, false, http.StatusUnauthorized},
+		{"Missing Token", "", false, http.StatusUnauthorized},
+		{"Invalid Token", "invalid", false, http.StatusUnauthorized},
+		{"Client Certificate", "", true, http.StatusOK},
+		{"Rate Limit", limited, false, http.StatusOK},
+		{"Rate Limit Burst", limited, false, http.StatusOK},
+		{"Rate Limit Exceeded", limited, false, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, est.EndpointPrefix+est.EnrollEndpoint,
+				bytes.NewReader(est.EncodeBase64(csr)))
+			req.Header.Set(est.ContentTypeHeader, est.MimeTypePKCS10)
+			if tt.token != "" {
+				req.Header.Set(est.AuthorizationHeader, est.BearerPrefix+tt.token)
+			}
+			req.TLS = &tls.ConnectionState{}
+			if tt.clientAuth {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{ca}}
+			}
+			w := httptest.NewRecorder()
+
+			s.handleSimpleenroll(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("handleSimpleenroll() status = %v, want %v", resp.StatusCode,
+					tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+
+			if ct := resp.Header.Get(est.ContentTypeHeader); ct != est.MimeTypeProblemJSON {
+				t.Fatalf("content type = %v, want %v", ct, est.MimeTypeProblemJSON)
+			}
+			var p problem
+			if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+				t.Fatalf("failed to decode problem: %v", err)
+			}
+			if p.Status != tt.wantStatus {
+				t.Fatalf("problem status = %v, want %v", p.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests &&
+				(p.RetryAfter <= 0 || resp.Header.Get(est.RetryAfterHeader) == "") {
+				t.Fatalf("rate limit response does not contain Retry-After")
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	l := newRateLimiter(60)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 60; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("allow() request %v denied", i)
+		}
+	}
+	ok, retry := l.allow("a")
+	if ok || retry <= 0 || retry > time.Second {
+		t.Fatalf("allow() = %v, %v, want denied with retry of at most 1s", ok, retry)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Fatalf("allow() denied independent key")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatalf("allow() denied after refill")
+	}
+
+	if ok, _ := newRateLimiter(0).allow("a"); !ok {
+		t.Fatalf("allow() of disabled rate limiter denied")
+	}
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", file, err)
+	}
+	return data
+}
@@ -16,10 +16,14 @@
 package main
 
 import (
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
 	"crypto/x509"
 	"database/sql"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,8 +31,11 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/cmc/est/common"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/google/go-attestation/attest"
 	"github.com/google/go-tpm/legacy/tpm2"
 
@@ -40,71 +47,221 @@ const (
 	intelEKCertServiceURL = "https://ekop.intel.com/ekcertservice/"
 )
 
+const (
+	// Time the device has to activate the credential and return the secret
+	activationTimeout = 5 * time.Minute
+	// Maximum number of pending credential activations
+	maxActivations = 1024
+)
+
 type tpmConfig struct {
-	verifyEkCert bool
-	dbPath       string
+	verifyEkCert  bool
+	dbPath        string
+	activationsMu sync.Mutex
+	activations   map[string]*activation
+	activatedAks  map[string]activatedAk
+}
+
+// activation is a pending credential activation. The AK certificate is only
+// issued once the device has proven that the AK resides in the same TPM as the
+// EK by returning the decrypted secret
+type activation struct {
+	csr     *x509.CertificateRequest
+	secret  []byte
+	device  *deviceIdentity
+	expires time.Time
+}
+
+// activatedAk is the AK of a completed credential activation and the identity
+// of the device verified via the EK
+type activatedAk struct {
+	device  *deviceIdentity
+	expires time.Time
 }
 
-func verifyEk(pub, cert []byte, tpmInfo, certUrl string, conf *tpmConfig) error {
+// addActivation stores the pending activation of the device and returns its ID
+func (c *tpmConfig) addActivation(csr *x509.CertificateRequest, secret []byte,
+	device *deviceIdentity,
+) (string, error) {
+	c.activationsMu.Lock()
+	defer c.activationsMu.Unlock()
+
+	now := time.Now()
+	for id, a := range c.activations {
+		if now.After(a.expires) {
+			delete(c.activations, id)
+		}
+	}
+	if len(c.activations) >= maxActivations {
+		return "", errors.New("too many pending credential activations")
+	}
+
+	idRaw := make([]byte, 16)
+	if _, err := rand.Read(idRaw); err != nil {
+		return "", fmt.Errorf("failed to create activation ID: %w", err)
+	}
+	id := hex.EncodeToString(idRaw)
+
+	if c.activations == nil {
+		c.activations = make(map[string]*activation)
+	}
+	c.activations[id] = &activation{
+		csr:     csr,
+		secret:  secret,
+		device:  device,
+		expires: now.Add(activationTimeout),
+	}
+
+	return id, nil
+}
+
+// completeActivation removes the pending activation and returns the CSR of the
+// AK and the device identity, if the secret matches. Each activation can only be
+// completed once
+func (c *tpmConfig) completeActivation(id string, secret []byte,
+) (*x509.CertificateRequest, *deviceIdentity, error) {
+	c.activationsMu.Lock()
+	a, ok := c.activations[id]
+	delete(c.activations, id)
+	c.activationsMu.Unlock()
+
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown credential activation %v", id)
+	}
+	if time.Now().After(a.expires) {
+		return nil, nil, fmt.Errorf("credential activation %v expired", id)
+	}
+	if subtle.ConstantTimeCompare(a.secret, secret) != 1 {
+		return nil, nil, errors.New("activated secret does not match")
+	}
+
+	return a.csr, a.device, nil
+}
+
+// addActivatedAk records the AK of a completed credential activation. IKs
+// certified by the AK can be enrolled within the activation timeout
+func (c *tpmConfig) addActivatedAk(pub crypto.PublicKey, device *deviceIdentity) {
+	pkix, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Warnf("Failed to marshal activated AK: %v", err)
+		return
+	}
+
+	c.activationsMu.Lock()
+	defer c.activationsMu.Unlock()
+
+	now := time.Now()
+	for k, a := range c.activatedAks {
+		if now.After(a.expires) {
+			delete(c.activatedAks, k)
+		}
+	}
+	if c.activatedAks == nil {
+		c.activatedAks = make(map[string]activatedAk)
+	}
+	c.activatedAks[string(pkix)] = activatedAk{
+		device:  device,
+		expires: now.Add(activationTimeout),
+	}
+}
+
+// activatedAk returns the device identity and true if the TPM public key is the
+// AK of a recently completed credential activation
+func (c *tpmConfig) activatedAk(tpmPub []byte) (*deviceIdentity, bool) {
+	pub, err := attest.ParseAKPublic(attest.TPMVersion20, tpmPub)
+	if err != nil {
+		return nil, false
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(pub.Public)
+	if err != nil {
+		return nil, false
+	}
+
+	c.activationsMu.Lock()
+	defer c.activationsMu.Unlock()
+	a, ok := c.activatedAks[string(pkix)]
+	if !ok || time.Now().After(a.expires) {
+		return nil, false
+	}
+	return a.device, true
+}
+
+// verifyEk verifies the EK certificate and returns the EK public key of the
+// certificate, which must match the EK public key reported by the device
+func verifyEk(pub, cert []byte, tpmInfo, certUrl string, conf *tpmConfig) (crypto.PublicKey, error) {
 
 	// Check that public key was part of the request
 	if pub == nil {
-		return fmt.Errorf("ek public key from device not present")
+		return nil, fmt.Errorf("ek public key from device not present")
+	}
+	ekPub, err := x509.ParsePKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EK public key: %w", err)
 	}
 
 	// Parse TPM Info string
 	info := strings.Split(tpmInfo, ";")
 	if len(info) != 3 {
-		return fmt.Errorf("invalid TPM Info format, contains %v parts, expected 3", len(info))
+		return nil, fmt.Errorf("invalid TPM Info format, contains %v parts, expected 3", len(info))
 	}
 	manufacturer := info[0]
 	major, err := strconv.Atoi(info[1])
 	if err != nil {
-		return fmt.Errorf("invalid TPM info format, %v is not a valid major: %w", info[1], err)
+		return nil, fmt.Errorf("invalid TPM info format, %v is not a valid major: %w", info[1], err)
 	}
 	minor, err := strconv.Atoi(info[2])
 	if err != nil {
-		return fmt.Errorf("invalid TPM info format, %v is not a valid minor: %w", info[2], err)
+		return nil, fmt.Errorf("invalid TPM info format, %v is not a valid minor: %w", info[2], err)
 	}
 
 	// Retrieve the EK cert (varies between manufacturers)
 	var ekCert *x509.Certificate
 	if (cert == nil) || (len(cert) == 0) {
 		if certUrl == "" {
-			return fmt.Errorf("neither EK Certificate nor Certificate URL present")
+			return nil, fmt.Errorf("neither EK Certificate nor Certificate URL present")
 		}
 		// Intel TPMs do not provide their EK certificate but instead a certificate URL from where the certificate can be retrieved via its public key
 		if manufacturer != manufacturerIntel {
-			return fmt.Errorf("ek certificate not present and Certificate URL not supported for manufacturer %v", manufacturer)
+			return nil, fmt.Errorf("ek certificate not present and Certificate URL not supported for manufacturer %v", manufacturer)
 		}
 		resp, err := getIntelEkCert(certUrl)
 		if err != nil {
-			return fmt.Errorf("failed to retrieve Intel TPM EK certificate from Intel server: %w", err)
+			return nil, fmt.Errorf("failed to retrieve Intel TPM EK certificate from Intel server: %w", err)
 		}
 		ekCert, err = parseIntelEkCert(resp)
 		if err != nil {
-			return fmt.Errorf("failed to parse Intel EK cert: %w", err)
+			return nil, fmt.Errorf("failed to parse Intel EK cert: %w", err)
 		}
 	} else {
 		// Other manufacturers simply provde their cert in an NV index
 		ekCert, err = x509.ParseCertificate(cert)
 		if err != nil {
-			return fmt.Errorf("failed to parse EK certificate: %w", err)
+			return nil, fmt.Errorf("failed to parse EK certificate: %w", err)
 		}
 	}
 
+	// The credential is encrypted to the certified EK
+	if !publicKeyEqual(ekCert.PublicKey, ekPub) {
+		return nil, errors.New("EK public key does not match the EK certificate")
+	}
+
 	// Verify the EK certificate chain
 	if conf.verifyEkCert {
 		err := verifyEkCert(conf.dbPath, ekCert, manufacturer, major, minor)
 		if err != nil {
-			return fmt.Errorf("verify EK certificate chain: error = %w", err)
+			return nil, fmt.Errorf("verify EK certificate chain: error = %w", err)
 		}
 		log.Debug("verification of EK certificate chain successful")
 	} else {
 		log.Warn("skipping EK certificate chain validation (turned off via config)")
 	}
 
-	return nil
+	return ekCert.PublicKey, nil
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
 }
 
 func getIntelEkCert(certificateUrl string) ([]byte, error) {
@@ -164,39 +321,37 @@ func verifyEkCert(dbpath string, ek *x509.Certificate, manufacturer string, majo
 	}
 	defer db.Close()
 
-	// Add TPM EK intermediate certs from database to certificate pool
-	var intermediates []byte
-	var intermediatesPool *x509.CertPool = nil
-	err = db.QueryRow("SELECT Certs FROM trustanchors WHERE Manufacturer LIKE ? AND FwMajor=? AND CA=0", manufacturer, major).Scan(&intermediates)
+	// Load TPM EK intermediate certs from database
+	var intermediatesPem []byte
+	var intermediates []*x509.Certificate
+	err = db.QueryRow("SELECT Certs FROM trustanchors WHERE Manufacturer LIKE ? AND FwMajor=? AND CA=0", manufacturer, major).Scan(&intermediatesPem)
 	if err == sql.ErrNoRows {
 		log.Debug("TPM EK cert chain does not contain intermediate certificates")
 	} else if err != nil {
 		return fmt.Errorf("failed to load EK intermediate certs from database: %w", err)
 	} else {
-		log.Trace("Found Intermediate Certs in DB: ", string(intermediates))
+		log.Trace("Found Intermediate Certs in DB: ", string(intermediatesPem))
 
-		intermediatesPool = x509.NewCertPool()
-		ok := intermediatesPool.AppendCertsFromPEM(intermediates)
-		if !ok {
-			return errors.New("failed to append intermediate certificates from database")
+		intermediates, err = internal.ParseCertsPem(intermediatesPem)
+		if err != nil {
+			return fmt.Errorf("failed to parse intermediate certificates from database: %w", err)
 		}
-		log.Debug("Added certificates to intermediates certificate pool")
+		log.Debug("Loaded intermediate certificates")
 	}
 
-	// Add TPM EK CA cert from database to certificate pool
-	var roots []byte
-	err = db.QueryRow("SELECT Certs FROM trustanchors WHERE Manufacturer LIKE ? AND CA=1", manufacturer).Scan(&roots)
+	// Load TPM EK CA certs from database
+	var rootsPem []byte
+	err = db.QueryRow("SELECT Certs FROM trustanchors WHERE Manufacturer LIKE ? AND CA=1", manufacturer).Scan(&rootsPem)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve CA certificate for TPM from %v (Major: %v, Minor: %v): %w", manufacturer, major, minor, err)
 	}
-	log.Trace("Found Root Certs in DB: ", string(roots))
+	log.Trace("Found Root Certs in DB: ", string(rootsPem))
 
-	rootsPool := x509.NewCertPool()
-	ok := rootsPool.AppendCertsFromPEM(roots)
-	if !ok {
-		return errors.New("failed to append root certificate from database")
+	roots, err := internal.ParseCertsPem(rootsPem)
+	if err != nil {
+		return fmt.Errorf("failed to parse root certificates from database: %w", err)
 	}
-	log.Debug("Added certificates to root certificate pool")
+	log.Debug("Loaded root certificates")
 
 	// TODO the ST certificates contain the x509 v3 extension with OID 2.5.29.17
 	// which is not handled by default. Check for other certs and decide how to handle
@@ -207,14 +362,14 @@ func verifyEkCert(dbpath string, ek *x509.Certificate, manufacturer string, majo
 		}
 	}
 
-	chain, err := ek.Verify(x509.VerifyOptions{Roots: rootsPool, Intermediates: intermediatesPool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	chain, err := internal.BuildChain(ek, intermediates, roots, time.Time{})
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Successfully verified chain of %v elements", len(chain[0]))
-	for i := range chain[0] {
-		log.Tracef("\tCertificate CN='%v', Issuer CN='%v'", chain[0][i].Subject.CommonName, chain[0][i].Issuer.CommonName)
+	log.Debugf("Successfully verified chain of %v elements", len(chain))
+	for i := range chain {
+		log.Tracef("\tCertificate CN='%v', Issuer CN='%v'", chain[i].Subject.CommonName, chain[i].Issuer.CommonName)
 	}
 
 	return nil
@@ -225,6 +380,14 @@ func verifyIk(ikParams attest.CertificationParameters, akPub []byte) error {
 	if err != nil {
 		return fmt.Errorf("decode public failed: %w", err)
 	}
+	if pub.Type == tpm2.AlgECC {
+		err = verifyIkEcc(ikParams, pub)
+		if err != nil {
+			return fmt.Errorf("failed to certify IK with AK: %w", err)
+		}
+		log.Debug("Successfully verified IK with AK")
+		return nil
+	}
 	akPubVerify := &rsa.PublicKey{E: int(pub.RSAParameters.Exponent()),
 		N: pub.RSAParameters.Modulus()}
 	hash, err := pub.RSAParameters.Sign.Hash.Hash()
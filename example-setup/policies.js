@@ -29,4 +29,15 @@ if (!found) {
     success = false;
 }
 
+// Reject SNP guests launched with debugging enabled, as the hypervisor can then
+// read and modify the guest memory
+var measurements = obj.measurements || [];
+for (var i = 0; i < measurements.length; i++) {
+    var snp = measurements[i].snpResult;
+    if (snp && snp.policyCheck.debug.measured) {
+        console.log("SNP guest policy allows debugging");
+        success = false;
+    }
+}
+
 success
\ No newline at end of file
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// CaTemplate returns the template of a CA certificate valid in the given
+// period, as used for the test certificate chains of the cloud providers
+func CaTemplate(serial int64, cn string, notBefore, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+}
+
+// LeafTemplate returns the template of a signing certificate valid in the
+// given period
+func LeafTemplate(serial int64, cn string, notBefore, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// CreateCert creates the certificate from the template with the public key,
+// signed by the parent. For self-signed certificates, the parent is the
+// template itself
+func CreateCert(tmpl, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.PrivateKey,
+) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate %v: %w", tmpl.Subject.CommonName, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %v: %w", tmpl.Subject.CommonName, err)
+	}
+	return cert, nil
+}
+
+// VtpmQuote is the quote of a cloud provider vTPM over PCR0 (firmware) and
+// PCR1 (config), each containing a single event, together with the PCR
+// summary artifacts and the matching TPM reference values
+type VtpmQuote struct {
+	Quote           []byte
+	Signature       []byte
+	Artifacts       []ar.Artifact
+	ReferenceValues []ar.ReferenceValue
+}
+
+// NewVtpmQuote creates the vTPM quote for the nonce, signed with the AK
+func NewVtpmQuote(ak *rsa.PrivateKey, nonce []byte) (*VtpmQuote, error) {
+
+	names := []string{"firmware", "config"}
+	pcrs := make(map[int][]byte, len(names))
+	q := &VtpmQuote{}
+	for pcr, name := range names {
+		digest := sha256.Sum256([]byte(name))
+		value := sha256.Sum256(append(make([]byte, 32), digest[:]...))
+		pcrs[pcr] = value[:]
+
+		q.Artifacts = append(q.Artifacts, ar.Artifact{
+			Type:    "PCR Summary",
+			Pcr:     ptr(pcr),
+			Summary: value[:],
+		})
+		q.ReferenceValues = append(q.ReferenceValues, ar.ReferenceValue{
+			Type:   "TPM Reference Value",
+			Name:   name,
+			Pcr:    ptr(pcr),
+			Sha256: digest[:],
+		})
+	}
+
+	var err error
+	q.Quote, q.Signature, err = Quote(ak, nonce, pcrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
@@ -0,0 +1,560 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fixtures generates a complete, self-consistent set of test data
+// without hardware: a PKI, signed metadata with reference values, a fake
+// TPM measurement matching the reference values and a signed attestation
+// report. The generated fixtures verify successfully with the verify package
+package fixtures
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	gen "github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// KeyType is the type of the keys of the PKI, the identity key and the
+// metadata signing keys. The attestation key is always an RSA key, as the
+// verifier only supports RSASSA TPM quote signatures
+type KeyType string
+
+const (
+	KeyTypeEcdsa   KeyType = "ecdsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+// KeyTypes are all supported key types
+var KeyTypes = []KeyType{KeyTypeEcdsa, KeyTypeEd25519}
+
+const (
+	RtmManifestName       = "de.test.rtm"
+	OsManifestName        = "de.test.os"
+	DeviceDescriptionName = "test-device.test.de"
+	DeveloperCommonName   = "Test Developer"
+	OperatorCommonName    = "Test Operator"
+)
+
+// AppManifestNames are the names of the app manifests generated by default
+var AppManifestNames = []string{"de.test.app1", "de.test.app2"}
+
+// appManifestName returns the name of the i-th app manifest
+func appManifestName(i int) string {
+	return fmt.Sprintf("de.test.app%v", i+1)
+}
+
+// Options configure the generated fixtures. The zero value generates JSON
+// fixtures with ECDSA keys valid from one hour ago for one year
+type Options struct {
+	Serializer ar.Serializer
+	KeyType    KeyType
+	// Nonce of the generated attestation report
+	Nonce []byte
+	// Validity of the certificates and metadata
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Number of app manifests (default 2) and of the runtime events measured
+	// per app into PCR10 (default 1), e.g. to generate large IMA-like logs
+	Apps      int
+	AppEvents int
+}
+
+// Key is a private key together with its certificate chain up to the root CA.
+// Key implements ar.Driver for signing, but does not provide measurements
+type Key struct {
+	Priv  crypto.Signer
+	Chain []*x509.Certificate
+}
+
+// Fixtures contains the generated keys, certificates, metadata and report
+type Fixtures struct {
+	Serializer ar.Serializer
+	KeyType    KeyType
+	Nonce      []byte
+	NotBefore  time.Time
+	NotAfter   time.Time
+
+	Ca       *Key
+	DeviceCa *Key
+	UserCa   *Key
+	// Ik is the identity key signing the attestation report
+	Ik *Key
+	// Ak is the attestation key signing the TPM quote
+	Ak        *Key
+	Developer *Key
+	Operator  *Key
+
+	// Events are the measured boot and runtime events per PCR, which are
+	// reflected by the reference values of the manifests
+	Events map[int][]ar.MeasureEvent
+	// Pcrs are the PCR values resulting from the events
+	Pcrs map[int][]byte
+
+	RtmManifest       ar.RtmManifest
+	OsManifest        ar.OsManifest
+	AppManifests      []ar.AppManifest
+	DeviceDescription ar.DeviceDescription
+
+	// Metadata are the signed RTM manifest, OS manifest, app manifests and
+	// device description in this order
+	Metadata [][]byte
+	// Report is the signed attestation report for the nonce
+	Report []byte
+}
+
+// Generate generates the fixtures with the specified options
+func Generate(o Options) (*Fixtures, error) {
+
+	f := &Fixtures{
+		Serializer: o.Serializer,
+		KeyType:    o.KeyType,
+		Nonce:      o.Nonce,
+		NotBefore:  o.NotBefore,
+		NotAfter:   o.NotAfter,
+	}
+	if f.Serializer == nil {
+		f.Serializer = ar.JsonSerializer{}
+	}
+	if f.KeyType == "" {
+		f.KeyType = KeyTypeEcdsa
+	}
+	if f.Nonce == nil {
+		f.Nonce = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	}
+	if f.NotBefore.IsZero() {
+		f.NotBefore = time.Now().Add(-time.Hour).Truncate(time.Second)
+	}
+	if f.NotAfter.IsZero() {
+		f.NotAfter = f.NotBefore.AddDate(1, 0, 0)
+	}
+	apps, appEvents := o.Apps, o.AppEvents
+	if apps == 0 {
+		apps = len(AppManifestNames)
+	}
+	if appEvents == 0 {
+		appEvents = 1
+	}
+
+	if err := f.createPki(); err != nil {
+		return nil, fmt.Errorf("failed to create PKI: %w", err)
+	}
+	f.createEvents(apps, appEvents)
+	if err := f.createMetadata(apps, appEvents); err != nil {
+		return nil, fmt.Errorf("failed to create metadata: %w", err)
+	}
+
+	var err error
+	f.Report, err = f.NewReport(f.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attestation report: %w", err)
+	}
+
+	return f, nil
+}
+
+// NewReport generates and signs an attestation report for the nonce
+func (f *Fixtures) NewReport(nonce []byte) ([]byte, error) {
+	report, err := gen.Generate(nonce, f.Metadata, []ar.Driver{f}, f.Serializer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate report: %w", err)
+	}
+	signed, err := gen.Sign(report, f, f.Serializer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign report: %w", err)
+	}
+	return signed, nil
+}
+
+// CaPem returns the PEM encoded root CA certificate, which is the trust
+// anchor for the verification of the fixtures
+func (f *Fixtures) CaPem() []byte {
+	return internal.WriteCertPem(f.Ca.Chain[0])
+}
+
+// Init implements ar.Driver
+func (f *Fixtures) Init(c *ar.DriverConfig) error {
+	return nil
+}
+
+// Measure implements ar.Driver and returns a fake TPM measurement with a
+// quote over the PCRs for the nonce, signed with the attestation key
+func (f *Fixtures) Measure(nonce []byte) (ar.Measurement, error) {
+
+	pcrs := make([]int, 0, len(f.Pcrs))
+	for pcr := range f.Pcrs {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+
+	artifacts := make([]ar.Artifact, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		artifacts = append(artifacts, ar.Artifact{
+			Type:   "PCR Eventlog",
+			Pcr:    ptr(pcr),
+			Events: f.Events[pcr],
+		})
+	}
+
+	quote, signature, err := Quote(f.Ak.Priv.(*rsa.PrivateKey), nonce, f.Pcrs)
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+
+	return ar.Measurement{
+		Type:      "TPM Measurement",
+		Evidence:  quote,
+		Signature: signature,
+		Certs:     internal.WriteCertsDer(f.Ak.Chain),
+		Artifacts: artifacts,
+	}, nil
+}
+
+// Quote creates a TPM quote over the SHA256 PCR values for the nonce as
+// returned by the TPM, signed with the RSA attestation key
+func Quote(key *rsa.PrivateKey, nonce []byte, pcrs map[int][]byte) ([]byte, []byte, error) {
+
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256}
+	for pcr := range pcrs {
+		sel.PCRs = append(sel.PCRs, pcr)
+	}
+	sort.Ints(sel.PCRs)
+	digest := sha256.New()
+	for _, pcr := range sel.PCRs {
+		digest.Write(pcrs[pcr])
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	name := sha256.Sum256(pub)
+
+	quote, err := tpm2.AttestationData{
+		Magic: 0xff544347,
+		Type:  tpm2.TagAttestQuote,
+		QualifiedSigner: tpm2.Name{
+			Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: name[:]},
+		},
+		ExtraData: nonce,
+		AttestedQuoteInfo: &tpm2.QuoteInfo{
+			PCRSelection: sel,
+			PCRDigest:    digest.Sum(nil),
+		},
+	}.Encode()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode quote: %w", err)
+	}
+
+	hash := sha256.Sum256(quote)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign quote: %w", err)
+	}
+	signature, err := tpm2.Signature{
+		Alg: tpm2.AlgRSASSA,
+		RSA: &tpm2.SignatureRSA{HashAlg: tpm2.AlgSHA256, Signature: sig},
+	}.Encode()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode quote signature: %w", err)
+	}
+
+	return quote, signature, nil
+}
+
+// Lock implements ar.Driver
+func (f *Fixtures) Lock() error {
+	return nil
+}
+
+// Unlock implements ar.Driver
+func (f *Fixtures) Unlock() error {
+	return nil
+}
+
+// GetSigningKeys implements ar.Driver and returns the identity key
+func (f *Fixtures) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return f.Ik.GetSigningKeys()
+}
+
+// GetCertChain implements ar.Driver and returns the identity key chain
+func (f *Fixtures) GetCertChain() ([]*x509.Certificate, error) {
+	return f.Ik.GetCertChain()
+}
+
+func (k *Key) Init(c *ar.DriverConfig) error {
+	return nil
+}
+
+func (k *Key) Measure(nonce []byte) (ar.Measurement, error) {
+	return ar.Measurement{}, errors.New("key does not provide measurements")
+}
+
+func (k *Key) Lock() error {
+	return nil
+}
+
+func (k *Key) Unlock() error {
+	return nil
+}
+
+func (k *Key) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return k.Priv, k.Priv.Public(), nil
+}
+
+func (k *Key) GetCertChain() ([]*x509.Certificate, error) {
+	return k.Chain, nil
+}
+
+// Cert returns the certificate of the key
+func (k *Key) Cert() *x509.Certificate {
+	return k.Chain[0]
+}
+
+// createPki creates the root CA with a device sub CA issuing the identity
+// and attestation key certificates and a user sub CA issuing the metadata
+// signing certificates
+func (f *Fixtures) createPki() error {
+	var err error
+	serial := int64(0)
+	create := func(cn string, parent *Key, isCa bool, priv crypto.Signer) (*Key, error) {
+		if priv == nil {
+			priv, err = f.newKey()
+			if err != nil {
+				return nil, err
+			}
+		}
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject: pkix.Name{
+				CommonName:   cn,
+				Organization: []string{"Test"},
+			},
+			NotBefore:             f.NotBefore,
+			NotAfter:              f.NotAfter,
+			KeyUsage:              x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+		}
+		if isCa {
+			tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+			tmpl.IsCA = true
+		}
+		issuer, issuerPriv, chain := tmpl, priv, []*x509.Certificate(nil)
+		if parent != nil {
+			issuer, issuerPriv, chain = parent.Cert(), parent.Priv, parent.Chain
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, priv.Public(), issuerPriv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate %v: %w", cn, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %v: %w", cn, err)
+		}
+		return &Key{Priv: priv, Chain: append([]*x509.Certificate{cert}, chain...)}, nil
+	}
+
+	if f.Ca, err = create("Test Root CA", nil, true, nil); err != nil {
+		return err
+	}
+	if f.DeviceCa, err = create("Test Device Sub CA", f.Ca, true, nil); err != nil {
+		return err
+	}
+	if f.UserCa, err = create("Test User Sub CA", f.Ca, true, nil); err != nil {
+		return err
+	}
+	if f.Ik, err = create(DeviceDescriptionName+" IK", f.DeviceCa, false, nil); err != nil {
+		return err
+	}
+	ak, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("failed to generate AK: %w", err)
+	}
+	if f.Ak, err = create(DeviceDescriptionName+" AK", f.DeviceCa, false, ak); err != nil {
+		return err
+	}
+	if f.Developer, err = create(DeveloperCommonName, f.UserCa, false, nil); err != nil {
+		return err
+	}
+	if f.Operator, err = create(OperatorCommonName, f.UserCa, false, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *Fixtures) newKey() (crypto.Signer, error) {
+	switch f.KeyType {
+	case KeyTypeEcdsa:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", f.KeyType)
+	}
+}
+
+// createEvents creates the measured boot events of the firmware (PCR0) and
+// the bootloader and kernel (PCR4) and the runtime events of the apps (PCR10)
+func (f *Fixtures) createEvents(apps, appEvents int) {
+	event := func(name string) ar.MeasureEvent {
+		digest := sha256.Sum256([]byte(name))
+		return ar.MeasureEvent{Sha256: digest[:], EventName: name}
+	}
+	runtime := make([]ar.MeasureEvent, 0, apps*appEvents)
+	for i := 0; i < apps; i++ {
+		runtime = append(runtime, event(appManifestName(i)+"/bin/app"))
+		for j := 1; j < appEvents; j++ {
+			runtime = append(runtime, event(fmt.Sprintf("%v/lib/lib%v.so", appManifestName(i), j)))
+		}
+	}
+	f.Events = map[int][]ar.MeasureEvent{
+		0:  {event("EV_S_CRTM_VERSION"), event("EV_EFI_PLATFORM_FIRMWARE_BLOB")},
+		4:  {event("shimx64.efi"), event("vmlinuz")},
+		10: runtime,
+	}
+	f.Pcrs = map[int][]byte{}
+	for pcr, events := range f.Events {
+		value := make([]byte, 32)
+		for _, e := range events {
+			h := sha256.Sum256(append(value, e.Sha256...))
+			value = h[:]
+		}
+		f.Pcrs[pcr] = value
+	}
+}
+
+// referenceValues returns the TPM reference values for the events of the PCR
+func (f *Fixtures) referenceValues(pcr int, events []ar.MeasureEvent) []ar.ReferenceValue {
+	refs := make([]ar.ReferenceValue, 0, len(events))
+	for _, e := range events {
+		refs = append(refs, ar.ReferenceValue{
+			Type:   "TPM Reference Value",
+			Sha256: e.Sha256,
+			Name:   e.EventName,
+			Pcr:    ptr(pcr),
+		})
+	}
+	return refs
+}
+
+// createMetadata creates and signs the manifests and the device description.
+// The manifests are signed by the developer, the device description by the
+// operator
+func (f *Fixtures) createMetadata(apps, appEvents int) error {
+
+	version := f.NotBefore.UTC().Format(time.RFC3339)
+	validity := ar.Validity{
+		NotBefore: f.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:  f.NotAfter.UTC().Format(time.RFC3339),
+	}
+
+	f.RtmManifest = ar.RtmManifest{
+		MetaInfo:           ar.MetaInfo{Type: "RTM Manifest", Name: RtmManifestName, Version: version},
+		DevCommonName:      DeveloperCommonName,
+		Description:        "Test RTM",
+		CertificationLevel: 3,
+		Validity:           validity,
+		ReferenceValues:    f.referenceValues(0, f.Events[0]),
+	}
+	f.OsManifest = ar.OsManifest{
+		MetaInfo:           ar.MetaInfo{Type: "OS Manifest", Name: OsManifestName, Version: version},
+		DevCommonName:      DeveloperCommonName,
+		Rtms:               []string{RtmManifestName},
+		Description:        "Test OS",
+		CertificationLevel: 3,
+		Validity:           validity,
+		ReferenceValues:    f.referenceValues(4, f.Events[4]),
+	}
+	f.DeviceDescription = ar.DeviceDescription{
+		MetaInfo: ar.MetaInfo{Type: "Device Description", Name: DeviceDescriptionName,
+			Version: version},
+		Description: "Test Device",
+		Location:    "Test Lab",
+		RtmManifest: RtmManifestName,
+		OsManifest:  OsManifestName,
+	}
+	f.AppManifests = nil
+	for i := 0; i < apps; i++ {
+		name := appManifestName(i)
+		f.AppManifests = append(f.AppManifests, ar.AppManifest{
+			MetaInfo:           ar.MetaInfo{Type: "App Manifest", Name: name, Version: version},
+			DevCommonName:      DeveloperCommonName,
+			Oss:                []string{OsManifestName},
+			Description:        fmt.Sprintf("Test App %v", i+1),
+			CertificationLevel: 3,
+			Validity:           validity,
+			ReferenceValues: f.referenceValues(10,
+				f.Events[10][i*appEvents:(i+1)*appEvents]),
+		})
+		f.DeviceDescription.AppDescriptions = append(f.DeviceDescription.AppDescriptions,
+			ar.AppDescription{
+				MetaInfo: ar.MetaInfo{Type: "App Description",
+					Name: name + "." + DeviceDescriptionName, Version: version},
+				AppManifest: name,
+			})
+	}
+
+	return f.SignMetadata()
+}
+
+// SignMetadata signs the manifests and the device description and stores them
+// in Metadata. This allows modifying the metadata, e.g. to create invalid
+// fixtures, before generating new reports
+func (f *Fixtures) SignMetadata() error {
+	type item struct {
+		v      any
+		signer *Key
+	}
+	items := []item{{f.RtmManifest, f.Developer}, {f.OsManifest, f.Developer}}
+	for _, a := range f.AppManifests {
+		items = append(items, item{a, f.Developer})
+	}
+	items = append(items, item{f.DeviceDescription, f.Operator})
+
+	f.Metadata = nil
+	for _, i := range items {
+		data, err := f.Serializer.Marshal(i.v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+		signed, err := gen.Sign(data, i.signer, f.Serializer)
+		if err != nil {
+			return fmt.Errorf("failed to sign metadata: %w", err)
+		}
+		f.Metadata = append(f.Metadata, signed)
+	}
+
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	gen "github.com/Fraunhofer-AISEC/cmc/generate"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, s := range Serializers {
+		for _, k := range KeyTypes {
+			f, err := Generate(Options{Serializer: s, KeyType: k})
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			t.Run(f.Name(), func(t *testing.T) {
+				r := verify.Verify(f.Report, f.Nonce, f.CaPem(), nil, 0, "")
+				if !r.Success {
+					t.Fatalf("verification of fixtures failed: %+v", r)
+				}
+				if r.SwCertLevel != 3 || len(r.Measurements) != 1 ||
+					r.Measurements[0].Type != "TPM Result" {
+					t.Errorf("verification result = %+v, want TPM result with level 3", r)
+				}
+				if len(r.MetadataResult.AppResults) != len(AppManifestNames) {
+					t.Errorf("%v app results, want %v", len(r.MetadataResult.AppResults),
+						len(AppManifestNames))
+				}
+
+				// Reports for other nonces must verify only against these
+				report, err := f.NewReport([]byte{0xaa, 0xbb})
+				if err != nil {
+					t.Fatalf("NewReport() error = %v", err)
+				}
+				if r := verify.Verify(report, []byte{0xaa, 0xbb}, f.CaPem(), nil, 0, ""); !r.Success {
+					t.Errorf("verification of report for other nonce failed")
+				}
+				if r := verify.Verify(report, f.Nonce, f.CaPem(), nil, 0, ""); r.Success {
+					t.Errorf("verification of report with wrong nonce succeeded")
+				}
+			})
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	f, err := Generate(Options{Serializer: Serializers[1], KeyType: KeyTypeEd25519})
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	dir := t.TempDir()
+	if err := f.Write(dir); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for _, file := range []string{"ca.pem", "ik-key.pem", "nonce", "attestation-report.cbor",
+		"metadata/rtm.manifest.cbor", "metadata/app2.manifest.cbor",
+		"metadata/device.description.cbor"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("fixture %v missing: %v", file, err)
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
+
+	for _, s := range Serializers {
+		for _, apps := range []int{2, 10, 50} {
+			f, err := Generate(Options{Serializer: s, Apps: apps})
+			if err != nil {
+				b.Fatalf("Generate() error = %v", err)
+			}
+			b.Run(fmt.Sprintf("%v %v Apps", f.Name(), apps), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := gen.Generate(f.Nonce, f.Metadata, []ar.Driver{f}, f.Serializer); err != nil {
+						b.Fatalf("Generate() error = %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSign(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
+
+	for _, s := range Serializers {
+		for _, k := range KeyTypes {
+			f, err := Generate(Options{Serializer: s, KeyType: k})
+			if err != nil {
+				b.Fatalf("Generate() error = %v", err)
+			}
+			report, err := gen.Generate(f.Nonce, f.Metadata, []ar.Driver{f}, f.Serializer)
+			if err != nil {
+				b.Fatalf("Generate() error = %v", err)
+			}
+			b.Run(f.Name(), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := gen.Sign(report, f, f.Serializer); err != nil {
+						b.Fatalf("Sign() error = %v", err)
+					}
+				}
+			})
+		}
+	}
+}
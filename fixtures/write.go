@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Serializers are all supported serializers
+var Serializers = []ar.Serializer{ar.JsonSerializer{}, ar.CborSerializer{}}
+
+// Name returns the name of the fixtures variant, e.g. json-ecdsa
+func (f *Fixtures) Name() string {
+	return fmt.Sprintf("%v-%v", f.extension(), f.KeyType)
+}
+
+func (f *Fixtures) extension() string {
+	if _, ok := f.Serializer.(ar.CborSerializer); ok {
+		return "cbor"
+	}
+	return "json"
+}
+
+// Write stores the fixtures in the folder: the PEM encoded certificates and
+// keys, the signed metadata in the metadata subfolder, the signed attestation
+// report and the hex encoded nonce
+func (f *Fixtures) Write(dir string) error {
+
+	if err := os.MkdirAll(filepath.Join(dir, "metadata"), 0755); err != nil {
+		return fmt.Errorf("failed to create fixtures folder: %w", err)
+	}
+
+	keys := []struct {
+		name string
+		key  *Key
+	}{
+		{"ca", f.Ca},
+		{"device-ca", f.DeviceCa},
+		{"user-ca", f.UserCa},
+		{"ik", f.Ik},
+		{"ak", f.Ak},
+		{"developer", f.Developer},
+		{"operator", f.Operator},
+	}
+	for _, k := range keys {
+		if err := writeFile(dir, k.name+".pem", internal.WriteCertPem(k.key.Cert()), 0644); err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(k.key.Priv)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %v key: %w", k.name, err)
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := writeFile(dir, k.name+"-key.pem", data, 0600); err != nil {
+			return err
+		}
+	}
+
+	names := []string{"rtm.manifest", "os.manifest"}
+	for i := range f.AppManifests {
+		names = append(names, fmt.Sprintf("app%v.manifest", i+1))
+	}
+	names = append(names, "device.description")
+	for i, m := range f.Metadata {
+		file := filepath.Join("metadata", names[i]+"."+f.extension())
+		if err := writeFile(dir, file, m, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFile(dir, "attestation-report."+f.extension(), f.Report, 0644); err != nil {
+		return err
+	}
+	return writeFile(dir, "nonce", []byte(hex.EncodeToString(f.Nonce)+"\n"), 0644)
+}
+
+func writeFile(dir, name string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(filepath.Join(dir, name), data, perm); err != nil {
+		return fmt.Errorf("failed to write %v: %w", name, err)
+	}
+	return nil
+}
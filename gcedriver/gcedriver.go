@@ -0,0 +1,379 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcedriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "gcedriver")
+
+const (
+	signingChainFile = "gce_ikchain.pem"
+	privFile         = "gce_ikpriv.key"
+	akChainFile      = "gce_akchain.pem"
+
+	// GCE vTPM NV indices of the RSA AK certificate and the RSA AK template
+	akCertIndex     = tpmutil.Handle(0x01c10000)
+	akTemplateIndex = tpmutil.Handle(0x01c10001)
+)
+
+var (
+	defaultPcrs = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	openTpm = func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenTPM("/dev/tpmrm0")
+	}
+)
+
+// Gce is a driver for GCE Shielded and Confidential VMs. Google provisions
+// the attestation key (AK) template and an AK certificate into the vTPM NV
+// storage. The AK certificate is issued by Google's EK/AK CA and contains the
+// instance identity. Freshness is provided via a vTPM quote signed with the AK
+type Gce struct {
+	mu               sync.Mutex
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+	storage          string
+	pcrs             []int
+	akCert           *x509.Certificate
+	akChain          *internal.ChainCache
+}
+
+// Init initializes the GCE driver with the specified configuration
+func (g *Gce) Init(c *ar.DriverConfig) error {
+	var err error
+
+	if g == nil {
+		return errors.New("internal error: GCE object is nil")
+	}
+	switch c.Serializer.(type) {
+	case ar.JsonSerializer:
+	case ar.CborSerializer:
+	default:
+		return fmt.Errorf("serializer not initialized in driver config")
+	}
+
+	g.pcrs = defaultPcrs
+	if len(c.PcrSelection) > 0 {
+		pcrs, ok := c.PcrSelection["sha256"]
+		if !ok || len(c.PcrSelection) != 1 {
+			return errors.New("gce driver only supports the sha256 PCR bank")
+		}
+		g.pcrs = pcrs
+	}
+	g.storage = c.StoragePath
+
+	// Create storage folder for storage of internal data if not existing
+	if c.StoragePath != "" {
+		if err := os.MkdirAll(c.StoragePath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for internal data '%v': %w",
+				c.StoragePath, err)
+		}
+	}
+
+	// Check that the AK can be created and matches the AK certificate to fail
+	// early on non-GCE platforms
+	rwc, err := openTpm()
+	if err != nil {
+		return fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	g.akCert, err = readAkCert(rwc)
+	if err == nil {
+		var ak tpmutil.Handle
+		ak, err = createAk(rwc, g.akCert)
+		if err == nil {
+			tpm2.FlushContext(rwc, ak)
+		}
+	}
+	rwc.Close()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Using GCE AK certificate %v issued by %v", g.akCert.Subject.CommonName,
+		g.akCert.Issuer.CommonName)
+
+	// Fetch the AK certificate chain in advance, failures are retried during
+	// the measurements
+	g.akChain = &internal.ChainCache{Storage: g.storage, File: akChainFile}
+	g.akChain.Get(g.akCert)
+
+	if provisioningRequired(c.StoragePath) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		g.priv = priv
+
+		g.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+			c.ServerAddr, c.BootstrapToken)
+		if err != nil {
+			return fmt.Errorf("failed to get signing cert chain: %w", err)
+		}
+
+		if c.StoragePath != "" {
+			if err := saveCredentials(c.StoragePath, g.signingCertChain, g.priv); err != nil {
+				return fmt.Errorf("failed to save GCE credentials: %w", err)
+			}
+		}
+	} else {
+		g.signingCertChain, g.priv, err = loadCredentials(c.StoragePath)
+		if err != nil {
+			return fmt.Errorf("failed to load GCE credentials: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (g *Gce) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting GCE measurements")
+
+	if g == nil {
+		return ar.Measurement{}, errors.New("internal error: GCE object is nil")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rwc, err := openTpm()
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to open vTPM: %w", err)
+	}
+	defer rwc.Close()
+
+	ak, err := createAk(rwc, g.akCert)
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+	defer tpm2.FlushContext(rwc, ak)
+
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: g.pcrs}
+	quote, sig, err := tpm2.QuoteRaw(rwc, ak, "", "", nonce, sel, tpm2.AlgNull)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get vTPM quote: %w", err)
+	}
+
+	artifacts := make([]ar.Artifact, 0, len(g.pcrs))
+	for _, pcr := range g.pcrs {
+		// Read PCRs one by one, as the TPM returns at most 8 PCRs per command
+		values, err := tpm2.ReadPCRs(rwc, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{pcr}})
+		if err != nil {
+			return ar.Measurement{}, fmt.Errorf("failed to read PCR%v: %w", pcr, err)
+		}
+		p := pcr
+		artifacts = append(artifacts, ar.Artifact{
+			Type:    "PCR Summary",
+			Pcr:     &p,
+			Summary: values[pcr],
+		})
+	}
+
+	measurement := ar.Measurement{
+		Type:      "GCE Measurement",
+		Evidence:  quote,
+		Signature: sig,
+		Certs:     internal.WriteCertsDer(g.akChain.Get(g.akCert)),
+		Artifacts: artifacts,
+	}
+
+	return measurement, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (g *Gce) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (g *Gce) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic
+// crypto interface
+func (g *Gce) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if g == nil {
+		return nil, nil, errors.New("internal error: GCE object is nil")
+	}
+	return g.priv, &g.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (g *Gce) GetCertChain() ([]*x509.Certificate, error) {
+	if g == nil {
+		return nil, errors.New("internal error: GCE object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(g.signingCertChain))
+	return g.signingCertChain, nil
+}
+
+// readAkCert reads the AK certificate from the vTPM NV index
+func readAkCert(rwc io.ReadWriter) (*x509.Certificate, error) {
+	cert, err := internal.ReadNvCert(rwc, akCertIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCE AK certificate "+
+			"(not running on a GCE Shielded VM?): %w", err)
+	}
+	return cert, nil
+}
+
+// createAk creates the AK from the template in the vTPM NV index. As the AK
+// is a primary key of the endorsement hierarchy, it is identical each time it
+// is created and must match the public key of the AK certificate
+func createAk(rwc io.ReadWriter, akCert *x509.Certificate) (tpmutil.Handle, error) {
+	tmpl, err := tpm2.NVReadEx(rwc, akTemplateIndex, tpm2.HandleOwner, "", 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read GCE AK template from NV index 0x%x: %w",
+			akTemplateIndex, err)
+	}
+	handle, pub, err := tpm2.CreatePrimaryRawTemplate(rwc, tpm2.HandleEndorsement,
+		tpm2.PCRSelection{}, "", "", tmpl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create GCE AK: %w", err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok || !rsaPub.Equal(akCert.PublicKey) {
+		tpm2.FlushContext(rwc, handle)
+		return 0, errors.New("GCE AK does not match AK certificate")
+	}
+	return handle, nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
+
+func provisioningRequired(p string) bool {
+	// Stateless operation always requires provisioning
+	if p == "" {
+		log.Info("GCE Provisioning REQUIRED")
+		return true
+	}
+
+	// If any of the required files is not present, we need to provision
+	if _, err := os.Stat(path.Join(p, signingChainFile)); err != nil {
+		log.Info("GCE Provisioning REQUIRED")
+		return true
+	}
+	if _, err := os.Stat(path.Join(p, privFile)); err != nil {
+		log.Info("GCE Provisioning REQUIRED")
+		return true
+	}
+
+	log.Info("GCE Provisioning NOT REQUIRED")
+
+	return false
+}
+
+func loadCredentials(p string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	data, err := internal.LoadFile(path.Join(p, signingChainFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read IK chain from %v: %w", p, err)
+	}
+	ikchain, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IK certs: %w", err)
+	}
+	log.Tracef("Parsed stored IK chain of length %v", len(ikchain))
+
+	data, err = internal.LoadFile(path.Join(p, privFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key from %v: %w", p, err)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return ikchain, priv, nil
+}
+
+func saveCredentials(p string, ikchain []*x509.Certificate, priv crypto.PrivateKey) error {
+	ikchainPem := internal.WriteCertChainPem(ikchain)
+	if err := internal.StoreFile(path.Join(p, signingChainFile), ikchainPem, 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, signingChainFile), err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed marshal private key: %w", err)
+	}
+	if err := internal.StoreFile(path.Join(p, privFile), key, 0600); err != nil {
+		return fmt.Errorf("failed to write %v: %w", path.Join(p, privFile), err)
+	}
+
+	return nil
+}
@@ -16,14 +16,19 @@
 package generate
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
-	"github.com/sirupsen/logrus"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
-var log = logrus.WithField("service", "ar")
+var log = internal.NewLogger(internal.SubsystemAttestationReport, "ar")
 
 // Generate generates an attestation report with the provided
 // nonce and manifests and descriptions metadata. The manifests and descriptions
@@ -31,19 +36,98 @@ var log = logrus.WithField("service", "ar")
 // format or CBOR COSE tokens. Takes a list of measurers providing a method
 // for collecting  the measurements from a hardware or software interface
 func Generate(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Serializer) ([]byte, error) {
+	return GenerateCached(nonce, metadata, measurers, s, nil)
+}
+
+// GenerateCached generates an attestation report like Generate, but omits the
+// metadata items with the hex encoded SHA-256 digests, which the verifier
+// already holds. The omitted items are referenced by their digests
+func GenerateCached(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Serializer,
+	cached []string,
+) ([]byte, error) {
+
+	if s == nil {
+		return nil, errors.New("serializer not specified")
+	}
+
+	report, _, err := collect(nonce, metadata, measurers, s, cached, false)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Trace("Finished attestation report generation")
+
+	// Marshal data to bytes
+	data, err := s.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the Attestation Report: %v", err)
+	}
+
+	return data, nil
+}
+
+// DryRun runs the collection and assembly of the attestation report like
+// Generate, but does not sign the report. Instead, it returns a summary of the
+// measurements and metadata the report would include. Drivers implementing the
+// DryRunMeasurer interface substitute their evidence, failing measurements are
+// reported as warnings
+func DryRun(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Serializer,
+) (*ar.DryRunSummary, error) {
 
 	if s == nil {
 		return nil, errors.New("serializer not specified")
 	}
 
+	report, summary, err := collect(nonce, metadata, measurers, s, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, serializer := range dryRunSerializers {
+		data, err := serializer.Marshal(report)
+		if err != nil {
+			summary.Warnings = append(summary.Warnings,
+				fmt.Sprintf("failed to marshal report with serializer %v: %v", name, err))
+			continue
+		}
+		summary.Sizes[name] = len(data)
+	}
+
+	return summary, nil
+}
+
+var dryRunSerializers = map[string]ar.Serializer{
+	"json": ar.JsonSerializer{},
+	"cbor": ar.CborSerializer{},
+}
+
+// collect assembles the unsigned attestation report. In dry-run mode, the
+// summary of the report is returned as well
+func collect(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Serializer,
+	cached []string, dryRun bool,
+) (ar.AttestationReport, *ar.DryRunSummary, error) {
+
 	// Create attestation report object which will be filled with the attestation
 	// data or sent back incomplete in case errors occur
 	report := ar.AttestationReport{
 		Type: "Attestation Report",
 	}
+	summary := &ar.DryRunSummary{
+		Measurements: []ar.MeasurementSummary{},
+		Metadata:     []ar.MetadataSummary{},
+		Sizes:        map[string]int{},
+	}
+	warn := func(format string, args ...any) {
+		if dryRun {
+			summary.Warnings = append(summary.Warnings, fmt.Sprintf(format, args...))
+		}
+	}
 
 	if len(nonce) > 32 {
-		return nil, fmt.Errorf("nonce exceeds maximum length of 32 bytes")
+		return report, nil, fmt.Errorf("nonce exceeds maximum length of 32 bytes")
+	}
+	if err := ar.CheckSerializer(s); err != nil {
+		return report, nil, fmt.Errorf("failed to generate report: %w", err)
 	}
 
 	log.Debug("Adding manifests and descriptions to Attestation Report..")
@@ -53,10 +137,21 @@ func Generate(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Seria
 	numManifests := 0
 	for i := 0; i < len(metadata); i++ {
 
+		// With a pinned serializer, metadata in the other format fail the
+		// generation instead of being skipped
+		if ar.GetSerializerPin() != "" {
+			if ms, err := ar.DetectSerializer(metadata[i]); err == nil {
+				if err := ar.CheckSerializer(ms); err != nil {
+					return report, nil, fmt.Errorf("metadata object %v: %w", i, err)
+				}
+			}
+		}
+
 		// Extract plain payload (i.e. the manifest/description itself)
 		data, err := s.GetPayload(metadata[i])
 		if err != nil {
 			log.Tracef("Failed to parse metadata object %v: %v", i, err)
+			warn("failed to parse metadata object %v: %v", i, err)
 			continue
 		}
 
@@ -66,33 +161,40 @@ func Generate(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Seria
 		err = s.Unmarshal(data, elem)
 		if err != nil {
 			log.Tracef("Failed to unmarshal data from metadata object %v: %v", i, err)
+			warn("failed to unmarshal metadata object %v: %v", i, err)
 			continue
 		}
 
-		switch elem.Type {
-		case "App Manifest":
-			log.Debug("Adding App Manifest")
-			report.AppManifests = append(report.AppManifests, metadata[i])
-			numManifests++
-		case "OS Manifest":
-			log.Debug("Adding OS Manifest")
-			report.OsManifest = metadata[i]
-			numManifests++
-		case "RTM Manifest":
-			log.Debug("Adding RTM Manifest")
-			report.RtmManifest = metadata[i]
+		if !ar.IsReportMetadata(elem.Type) {
+			warn("metadata object %v of type %q is not included", elem.Name, elem.Type)
+			continue
+		}
+		if strings.HasSuffix(elem.Type, "Manifest") {
 			numManifests++
-		case "Device Description":
-			log.Debug("Adding Device Description")
-			report.DeviceDescription = metadata[i]
-		case "Company Description":
-			log.Debug("Adding Company Description")
-			report.CompanyDescription = metadata[i]
+		}
+
+		// Items the verifier already holds are only referenced by their digest
+		if d := digest(metadata[i]); slices.Contains(cached, d) {
+			log.Debugf("Omitting cached %v %v", elem.Type, elem.Name)
+			report.CachedMetadata = append(report.CachedMetadata, d)
+			continue
+		}
+		log.Debugf("Adding %v", elem.Type)
+		report.AddMetadata(elem.Type, metadata[i])
+		if dryRun {
+			summary.Metadata = append(summary.Metadata, ar.MetadataSummary{
+				Type:    elem.Type,
+				Name:    elem.Name,
+				Version: elem.Version,
+				Size:    len(metadata[i]),
+				Digest:  digest(metadata[i]),
+			})
 		}
 	}
 
 	if numManifests == 0 {
 		log.Warn("Did not find any manifests for the attestation report")
+		warn("did not find any manifests for the attestation report")
 	} else {
 		log.Debug("Added ", numManifests, " manifests to attestation report")
 	}
@@ -101,29 +203,86 @@ func Generate(nonce []byte, metadata [][]byte, measurers []ar.Driver, s ar.Seria
 	for _, measurer := range measurers {
 
 		// Collect the measurements/evidence with the specified nonce from hardware/software.
-		// The methods are implemented in the respective driver (TPM, SNP, ...)
+		// The methods are implemented in the respective driver (TPM, SNP, ...). Every
+		// driver receives its own copy of the nonce, so that all measurements are bound
+		// to the same nonce even if a driver modifies its input
 		log.Debugf("Getting measurements from measurement interface..")
-		measurement, err := measurer.Measure(nonce)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get measurements: %v", err)
+		n := append([]byte(nil), nonce...)
+		var measurements []ar.Measurement
+		var err error
+		substituted := false
+		if dm, ok := measurer.(ar.DryRunMeasurer); ok && dryRun {
+			measurements, err = dm.MeasureDryRun(n)
+			substituted = true
+		} else if mm, ok := measurer.(ar.MultiMeasurer); ok {
+			measurements, err = mm.MeasureAll(n)
+		} else {
+			var measurement ar.Measurement
+			measurement, err = measurer.Measure(n)
+			measurements = []ar.Measurement{measurement}
 		}
+		if err != nil && dryRun {
+			warn("failed to get measurements from %T: %v", measurer, err)
+			continue
+		} else if err != nil {
+			return report, nil, fmt.Errorf("failed to get measurements: %v", err)
+		}
+
+		for _, measurement := range measurements {
+			report.Measurements = append(report.Measurements, measurement)
+			log.Debugf("Added %v to attestation report", measurement.Type)
 
-		report.Measurements = append(report.Measurements, measurement)
-		log.Debugf("Added %v to attestation report", measurement.Type)
+			if dryRun {
+				summary.Measurements = append(summary.Measurements,
+					summarize(measurement, substituted, s))
+			}
+		}
 	}
 
-	log.Trace("Finished attestation report generation")
+	return report, summary, nil
+}
 
-	// Marshal data to bytes
-	data, err := s.Marshal(report)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal the Attestation Report: %v", err)
+// summarize returns the summary of the measurement with the size of the
+// serialized measurement
+func summarize(m ar.Measurement, substituted bool, s ar.Serializer) ar.MeasurementSummary {
+	size := 0
+	if data, err := s.Marshal(m); err == nil {
+		size = len(data)
+	}
+	return ar.MeasurementSummary{
+		Type:        m.Type,
+		Size:        size,
+		Digest:      digest(m.Evidence),
+		Artifacts:   len(m.Artifacts),
+		Certs:       len(m.Certs),
+		Substituted: substituted,
 	}
+}
 
-	return data, nil
+// digest returns the hex encoded SHA-256 digest of the data
+func digest(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Sign signs the attestation report with the specified signer 'signer'. If
+// additional signers are specified, the report is signed by all signers, which
+// requires a serializer supporting multiple signatures
+func Sign(report []byte, signer ar.Driver, s ar.Serializer, additional ...ar.Driver,
+) ([]byte, error) {
+	if len(additional) == 0 {
+		return s.Sign(report, signer)
+	}
+	ms, ok := s.(ar.MultiSigner)
+	if !ok {
+		return nil, fmt.Errorf("serializer %T does not support multiple signers", s)
+	}
+	return ms.SignMulti(report, append([]ar.Driver{signer}, additional...))
 }
 
-// Sign signs the attestation report with the specified signer 'signer'
-func Sign(report []byte, signer ar.Driver, s ar.Serializer) ([]byte, error) {
-	return s.Sign(report, signer)
+// SignDetached creates a detached signature over the digest of the attestation
+// report with the specified signer 'signer', so that the report can be stored
+// separately
+func SignDetached(report []byte, signer ar.Driver, s ar.Serializer) ([]byte, error) {
+	return s.SignDetached(report, signer)
 }
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generate
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// testDriver is a driver returning its nonce as evidence and counting the
+// accesses to its signing key
+type testDriver struct {
+	typ     string
+	priv    *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	signs   int
+	failing bool
+}
+
+func newTestDriver(t *testing.T, typ string) *testDriver {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: typ},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testDriver{typ: typ, priv: priv, cert: cert}
+}
+
+func (d *testDriver) Init(c *ar.DriverConfig) error { return nil }
+
+func (d *testDriver) Measure(nonce []byte) (ar.Measurement, error) {
+	if d.failing {
+		return ar.Measurement{}, errors.New("device not available")
+	}
+	return ar.Measurement{
+		Type:     d.typ + " Measurement",
+		Evidence: append([]byte(nil), nonce...),
+		Certs:    [][]byte{d.cert.Raw},
+	}, nil
+}
+
+func (d *testDriver) Lock() error   { return nil }
+func (d *testDriver) Unlock() error { return nil }
+
+func (d *testDriver) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	d.signs++
+	return d.priv, &d.priv.PublicKey, nil
+}
+
+func (d *testDriver) GetCertChain() ([]*x509.Certificate, error) {
+	return []*x509.Certificate{d.cert}, nil
+}
+
+// dryRunDriver substitutes its evidence with a zero quote in dry-run mode
+type dryRunDriver struct {
+	*testDriver
+}
+
+func (d *dryRunDriver) MeasureDryRun(nonce []byte) ([]ar.Measurement, error) {
+	return []ar.Measurement{{
+		Type:     d.typ + " Measurement",
+		Evidence: make([]byte, 64),
+	}}, nil
+}
+
+func TestDryRun(t *testing.T) {
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	zero := digest(make([]byte, 64))
+
+	for name, s := range dryRunSerializers {
+		t.Run(name, func(t *testing.T) {
+			tpm := &dryRunDriver{newTestDriver(t, "TPM")}
+			sw := newTestDriver(t, "SW")
+			failing := newTestDriver(t, "SNP")
+			failing.failing = true
+
+			var metadata [][]byte
+			for _, m := range []ar.MetaInfo{
+				{Type: "RTM Manifest", Name: "de.test.rtm", Version: "2026-01-01T00:00:00Z"},
+				{Type: "Device Description", Name: "de.test.device"},
+				{Type: "Device Config", Name: "de.test.config"},
+			} {
+				data, err := s.Marshal(m)
+				if err != nil {
+					t.Fatalf("failed to marshal metadata: %v", err)
+				}
+				signed, err := s.Sign(data, sw)
+				if err != nil {
+					t.Fatalf("failed to sign metadata: %v", err)
+				}
+				metadata = append(metadata, signed)
+			}
+			sw.signs = 0
+
+			summary, err := DryRun(nonce, metadata, []ar.Driver{sw, tpm, failing}, s)
+			if err != nil {
+				t.Fatalf("DryRun() error = %v", err)
+			}
+			if sw.signs != 0 || tpm.signs != 0 {
+				t.Errorf("DryRun() accessed the signing key")
+			}
+
+			if len(summary.Measurements) != 2 {
+				t.Fatalf("got %v measurements, want 2", len(summary.Measurements))
+			}
+			if m := summary.Measurements[0]; m.Type != "SW Measurement" || m.Substituted ||
+				m.Digest != digest(nonce) || m.Certs != 1 || m.Size == 0 {
+				t.Errorf("SW measurement summary = %+v", m)
+			}
+			if m := summary.Measurements[1]; m.Type != "TPM Measurement" || !m.Substituted ||
+				m.Digest != zero {
+				t.Errorf("TPM measurement summary = %+v", m)
+			}
+
+			if len(summary.Metadata) != 2 {
+				t.Fatalf("got %v metadata items, want 2", len(summary.Metadata))
+			}
+			if m := summary.Metadata[0]; m.Type != "RTM Manifest" || m.Name != "de.test.rtm" ||
+				m.Version != "2026-01-01T00:00:00Z" || m.Size != len(metadata[0]) ||
+				m.Digest != digest(metadata[0]) {
+				t.Errorf("RTM manifest summary = %+v", m)
+			}
+
+			for name := range dryRunSerializers {
+				if summary.Sizes[name] == 0 {
+					t.Errorf("missing report size for serializer %v", name)
+				}
+			}
+
+			// The device config is not included and the SNP driver failed
+			if len(summary.Warnings) != 2 {
+				t.Errorf("warnings = %v, want 2", summary.Warnings)
+			}
+		})
+	}
+}
+
+func TestDryRunInvalidNonce(t *testing.T) {
+	_, err := DryRun(make([]byte, 33), nil, nil, ar.JsonSerializer{})
+	if err == nil {
+		t.Fatalf("DryRun() succeeded with nonce exceeding 32 bytes")
+	}
+}
+
+func TestGeneratePinned(t *testing.T) {
+	d := newTestDriver(t, "Test")
+	t.Cleanup(func() { ar.SetSerializerPin("") })
+
+	metadata := func(s ar.Serializer) []byte {
+		data, err := s.Marshal(ar.RtmManifest{MetaInfo: ar.MetaInfo{Type: "RTM Manifest",
+			Name: "de.test.rtm", Version: "2023-04-10T20:00:00Z"}})
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		signed, err := Sign(data, d, s)
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		return signed
+	}
+	jsonRtm := metadata(ar.JsonSerializer{})
+	cborRtm := metadata(ar.CborSerializer{})
+
+	tests := []struct {
+		name       string
+		pin        string
+		serializer ar.Serializer
+		metadata   [][]byte
+		wantErr    bool
+	}{
+		{"No Pin Ignores Other Format", "", ar.JsonSerializer{}, [][]byte{jsonRtm, cborRtm}, false},
+		{"Pinned CBOR", "cbor", ar.CborSerializer{}, [][]byte{cborRtm}, false},
+		{"Report Not Pinned", "cbor", ar.JsonSerializer{}, [][]byte{jsonRtm}, true},
+		{"Metadata Not Pinned", "json", ar.JsonSerializer{}, [][]byte{jsonRtm, cborRtm}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ar.SetSerializerPin(tt.pin); err != nil {
+				t.Fatalf("SetSerializerPin() error = %v", err)
+			}
+			defer ar.SetSerializerPin("")
+
+			_, err := Generate([]byte{0x01}, tt.metadata, []ar.Driver{d}, tt.serializer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Generate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ar.ErrSerializerNotAllowed) {
+				t.Errorf("Generate() error = %v, want %v", err, ar.ErrSerializerNotAllowed)
+			}
+		})
+	}
+}
@@ -28,6 +28,8 @@ type CMCServiceClient interface {
 	Attest(ctx context.Context, in *AttestationRequest, opts ...grpc.CallOption) (*AttestationResponse, error)
 	Verify(ctx context.Context, in *VerificationRequest, opts ...grpc.CallOption) (*VerificationResponse, error)
 	Measure(ctx context.Context, in *MeasureRequest, opts ...grpc.CallOption) (*MeasureResponse, error)
+	// Returns the capabilities and health of the drivers without attesting
+	Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error)
 }
 
 type cMCServiceClient struct {
@@ -83,6 +85,15 @@ func (c *cMCServiceClient) Measure(ctx context.Context, in *MeasureRequest, opts
 	return out, nil
 }
 
+func (c *cMCServiceClient) Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error) {
+	out := new(CapabilitiesResponse)
+	err := c.cc.Invoke(ctx, "/grpcapi.CMCService/Capabilities", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CMCServiceServer is the server API for CMCService service.
 // All implementations must embed UnimplementedCMCServiceServer
 // for forward compatibility
@@ -93,6 +104,8 @@ type CMCServiceServer interface {
 	Attest(context.Context, *AttestationRequest) (*AttestationResponse, error)
 	Verify(context.Context, *VerificationRequest) (*VerificationResponse, error)
 	Measure(context.Context, *MeasureRequest) (*MeasureResponse, error)
+	// Returns the capabilities and health of the drivers without attesting
+	Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error)
 	mustEmbedUnimplementedCMCServiceServer()
 }
 
@@ -115,6 +128,9 @@ func (UnimplementedCMCServiceServer) Verify(context.Context, *VerificationReques
 func (UnimplementedCMCServiceServer) Measure(context.Context, *MeasureRequest) (*MeasureResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Measure not implemented")
 }
+func (UnimplementedCMCServiceServer) Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capabilities not implemented")
+}
 func (UnimplementedCMCServiceServer) mustEmbedUnimplementedCMCServiceServer() {}
 
 // UnsafeCMCServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -218,6 +234,24 @@ func _CMCService_Measure_Handler(srv interface{}, ctx context.Context, dec func(
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CMCService_Capabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CMCServiceServer).Capabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpcapi.CMCService/Capabilities",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CMCServiceServer).Capabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CMCService_ServiceDesc is the grpc.ServiceDesc for CMCService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -245,6 +279,10 @@ var CMCService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Measure",
 			Handler:    _CMCService_Measure_Handler,
 		},
+		{
+			MethodName: "Capabilities",
+			Handler:    _CMCService_Capabilities_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "grpcapi.proto",
@@ -19,16 +19,17 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
-	"github.com/sirupsen/logrus"
-
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
-var log = logrus.WithField("service", "ima")
+var log = internal.NewLogger(internal.SubsystemDrivers, "ima")
 
 // Constants for digests and TCG Events
 const (
@@ -69,77 +70,113 @@ func GetImaRuntimeDigests() ([]ar.MeasureEvent, error) {
 }
 
 func parseImaRuntimeDigests(data []byte) ([]ar.MeasureEvent, error) {
+	events, n, err := parseImaEvents(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("error reading binary data: %v trailing bytes", len(data)-n)
+	}
+	return events, nil
+}
+
+// parseImaEvents parses all complete entries of the IMA binary runtime
+// measurement list and returns the events and the number of bytes consumed.
+// An incomplete entry at the end of the data is not consumed
+func parseImaEvents(data []byte) ([]ar.MeasureEvent, int, error) {
 
 	buf := bytes.NewBuffer(data)
 	events := make([]ar.MeasureEvent, 0)
+	consumed := 0
 
 	for buf.Len() > 0 {
-		header := header{}
-		err := binary.Read(buf, binary.LittleEndian, &header)
-		if err != nil {
-			return nil, fmt.Errorf("error reading binary data: %w", err)
+		event, err := parseImaEvent(buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return nil, 0, err
 		}
+		consumed = len(data) - buf.Len()
+		events = append(events, event)
+	}
 
-		name := make([]byte, header.NameLen)
-		err = binary.Read(buf, binary.LittleEndian, name)
-		if err != nil {
-			return nil, fmt.Errorf("error reading binary data: %w", err)
-		}
+	return events, consumed, nil
+}
 
-		var template imaTemplate
-		template.header = header
-		copy(template.Name[:], name)
-
-		var length uint32
-		if strings.Compare(string(template.Name[:]), "ima") == 0 {
-			template.DataLen = SHA1_DIGEST_LEN + MAX_TCG_EVENT_LEN + 1
-			length = SHA1_DIGEST_LEN
-		} else {
-			err = binary.Read(buf, binary.LittleEndian, &template.DataLen)
-			if err != nil {
-				return nil, fmt.Errorf("error reading binary data: %w", err)
-			}
-			length = template.DataLen
-		}
+func parseImaEvent(buf *bytes.Buffer) (ar.MeasureEvent, error) {
 
-		template.Data = make([]byte, length)
-		err = binary.Read(buf, binary.LittleEndian, template.Data)
-		if err != nil {
-			return nil, fmt.Errorf("error reading binary data: %w", err)
-		}
+	header := header{}
+	err := binary.Read(buf, binary.LittleEndian, &header)
+	if err != nil {
+		return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w", err)
+	}
+	if header.NameLen > MAX_TCG_EVENT_LEN {
+		return ar.MeasureEvent{}, fmt.Errorf("invalid template name length %v", header.NameLen)
+	}
 
-		if strings.Compare(string(template.Name[:]), "ima") == 0 {
-			var fieldLen uint32
-			binary.Read(buf, binary.LittleEndian, &fieldLen)
+	name := make([]byte, header.NameLen)
+	err = binary.Read(buf, binary.LittleEndian, name)
+	if err != nil {
+		return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w", err)
+	}
 
-			addData := make([]byte, fieldLen)
-			binary.Read(buf, binary.LittleEndian, addData)
-			template.Data = append(template.Data, addData...)
+	var template imaTemplate
+	template.header = header
+	copy(template.Name[:], name)
+
+	var length uint32
+	if strings.Compare(string(template.Name[:]), "ima") == 0 {
+		template.DataLen = SHA1_DIGEST_LEN + MAX_TCG_EVENT_LEN + 1
+		length = SHA1_DIGEST_LEN
+	} else {
+		err = binary.Read(buf, binary.LittleEndian, &template.DataLen)
+		if err != nil {
+			return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w", err)
 		}
+		length = template.DataLen
+	}
+	if int(length) > buf.Len() {
+		return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w",
+			io.ErrUnexpectedEOF)
+	}
 
-		// Even in case of SHA256 PCRs, the template hash from IMA is a
-		// SHA1 hash and cannot be used. Instead, the SHA256 hash of the
-		// template must be calculated manually
-		digest := sha256.Sum256(template.Data)
+	template.Data = make([]byte, length)
+	err = binary.Read(buf, binary.LittleEndian, template.Data)
+	if err != nil {
+		return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w", err)
+	}
 
-		// Parse the template data to retrieve additional information
-		_, eventName, err := parseTemplateData(&template)
+	if strings.Compare(string(template.Name[:]), "ima") == 0 {
+		var fieldLen uint32
+		err = binary.Read(buf, binary.LittleEndian, &fieldLen)
 		if err != nil {
-			log.Tracef("Failed to parse additional template data: %v", err)
+			return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w", err)
 		}
-
-		event := ar.MeasureEvent{
-			Sha256:    digest[:],
-			EventName: eventName,
+		if int(fieldLen) > buf.Len() {
+			return ar.MeasureEvent{}, fmt.Errorf("error reading binary data: %w",
+				io.ErrUnexpectedEOF)
 		}
+		template.Data = append(template.Data, buf.Next(int(fieldLen))...)
+	}
 
-		log.Tracef("Parsed IMA PCR%v %v event %v", header.Pcr,
-			string(template.Name[:template.header.NameLen]), eventName)
+	// Even in case of SHA256 PCRs, the template hash from IMA is a
+	// SHA1 hash and cannot be used. Instead, the SHA256 hash of the
+	// template must be calculated manually
+	digest := sha256.Sum256(template.Data)
 
-		events = append(events, event)
+	// Parse the template data to retrieve additional information
+	_, eventName, err := parseTemplateData(&template)
+	if err != nil {
+		log.Tracef("Failed to parse additional template data: %v", err)
 	}
 
-	return events, nil
+	log.Tracef("Parsed IMA PCR%v %v event %v", header.Pcr,
+		string(template.Name[:template.header.NameLen]), eventName)
+
+	return ar.MeasureEvent{
+		Sha256:    digest[:],
+		EventName: eventName,
+	}, nil
 }
 
 func parseTemplateData(tmpl *imaTemplate) ([]byte, string, error) {
@@ -156,6 +193,9 @@ func parseTemplateData(tmpl *imaTemplate) ([]byte, string, error) {
 		return nil, "", fmt.Errorf("failed to read digest length from template: %w", err)
 	}
 
+	if int(tmplDigestLen) > buf.Len() {
+		return nil, "", fmt.Errorf("invalid template digest length %v", tmplDigestLen)
+	}
 	tmplDigest := make([]byte, tmplDigestLen)
 	err = binary.Read(buf, binary.LittleEndian, tmplDigest)
 	if err != nil {
@@ -168,6 +208,9 @@ func parseTemplateData(tmpl *imaTemplate) ([]byte, string, error) {
 		return nil, "", fmt.Errorf("failed to read digest length from template: %w", err)
 	}
 
+	if tmplPathLen == 0 || int(tmplPathLen) > buf.Len() {
+		return nil, "", fmt.Errorf("invalid template path length %v", tmplPathLen)
+	}
 	tmplPath := make([]byte, tmplPathLen)
 	err = binary.Read(buf, binary.LittleEndian, tmplPath)
 	if err != nil {
@@ -0,0 +1,38 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ima
+
+import (
+	"testing"
+)
+
+func FuzzParseImaRuntimeDigests(f *testing.F) {
+	entry := imaNgEntry("/usr/bin/cmcd")
+	f.Add(entry)
+	f.Add(append(entry, imaNgEntry("/usr/lib/libc.so.6")...))
+	f.Add(entry[:len(entry)-1])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		events, err := parseImaRuntimeDigests(data)
+		if err != nil {
+			return
+		}
+		// Each event consists of at least the header and the template length
+		if len(events) > len(data)/32 {
+			t.Errorf("parsed %v events from %v bytes", len(events), len(data))
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ima
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const saltLen = 32
+
+// Redactor replaces the file paths of IMA events by their salted digests. The
+// template hashes are not modified, so that the PCR can still be replayed
+type Redactor struct {
+	prefixes []string
+	salt     []byte
+	disclose bool
+}
+
+// NewRedactor creates a redactor with the salt read from the configured
+// source. Without source, a random salt is generated for each report
+func NewRedactor(c *ar.RedactionConfig) (*Redactor, error) {
+	if c == nil || len(c.Prefixes) == 0 {
+		return nil, errors.New("no redaction prefixes configured")
+	}
+	r := &Redactor{
+		prefixes: c.Prefixes,
+		disclose: c.DiscloseSalt,
+	}
+	if c.Salt != "" {
+		salt, err := internal.GetSecret(c.Salt, "IMA redaction salt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redaction salt: %w", err)
+		}
+		if len(salt) == 0 {
+			return nil, errors.New("redaction salt is empty")
+		}
+		r.salt = salt
+	} else if !c.DiscloseSalt {
+		return nil, errors.New("withheld redaction salt must be configured")
+	}
+	return r, nil
+}
+
+// Redact returns a copy of the events with the redacted file paths and the
+// redaction to be recorded in the artifact
+func (r *Redactor) Redact(events []ar.MeasureEvent) ([]ar.MeasureEvent, *ar.Redaction, error) {
+	salt := r.salt
+	if salt == nil {
+		salt = make([]byte, saltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate redaction salt: %w", err)
+		}
+	}
+
+	redacted := make([]ar.MeasureEvent, len(events))
+	num := 0
+	for i, e := range events {
+		redacted[i] = e
+		if r.match(e.EventName) {
+			redacted[i].NameSha256 = ar.RedactName(salt, e.EventName)
+			redacted[i].EventName = ""
+			num++
+		}
+	}
+	log.Tracef("Redacted %v of %v IMA event names", num, len(events))
+
+	redaction := &ar.Redaction{
+		Prefixes: r.prefixes,
+		SaltId:   ar.SaltId(salt),
+	}
+	if r.disclose {
+		redaction.Salt = salt
+	}
+	return redacted, redaction, nil
+}
+
+func (r *Redactor) match(name string) bool {
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
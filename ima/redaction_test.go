@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ima
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func TestRedact(t *testing.T) {
+	saltFile := filepath.Join(t.TempDir(), "salt")
+	if err := os.WriteFile(saltFile, []byte("0123456789abcdef"), 0600); err != nil {
+		t.Fatalf("failed to write salt: %v", err)
+	}
+	events := []ar.MeasureEvent{
+		{Sha256: []byte{1}, EventName: "/usr/bin/bash"},
+		{Sha256: []byte{2}, EventName: "/home/user/secret"},
+	}
+
+	tests := []struct {
+		name     string
+		conf     *ar.RedactionConfig
+		disclose bool
+		wantErr  bool
+	}{
+		{"Withheld Salt", &ar.RedactionConfig{Prefixes: []string{"/home/"}, Salt: "file:" + saltFile},
+			false, false},
+		{"Disclosed Random Salt", &ar.RedactionConfig{Prefixes: []string{"/home/"},
+			DiscloseSalt: true}, true, false},
+		{"Withheld Random Salt", &ar.RedactionConfig{Prefixes: []string{"/home/"}}, false, true},
+		{"No Prefixes", &ar.RedactionConfig{DiscloseSalt: true}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRedactor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got, redaction, err := r.Redact(events)
+			if err != nil {
+				t.Fatalf("Redact() error = %v", err)
+			}
+			if events[1].EventName != "/home/user/secret" {
+				t.Fatalf("Redact() modified the original events")
+			}
+			if got[0].EventName != "/usr/bin/bash" || got[0].NameSha256 != nil {
+				t.Errorf("Redact() redacted path outside prefixes: %v", got[0])
+			}
+			if got[1].EventName != "" || !bytes.Equal(got[1].Sha256, events[1].Sha256) {
+				t.Errorf("Redact() = %v, want redacted name and unmodified template hash", got[1])
+			}
+			if (redaction.Salt != nil) != tt.disclose {
+				t.Errorf("salt disclosed = %v, want %v", redaction.Salt != nil, tt.disclose)
+			}
+
+			salt := redaction.Salt
+			if !tt.disclose {
+				salt = []byte("0123456789abcdef")
+			}
+			if !bytes.Equal(redaction.SaltId, ar.SaltId(salt)) {
+				t.Errorf("salt ID does not match salt")
+			}
+			if !bytes.Equal(got[1].NameSha256, ar.RedactName(salt, "/home/user/secret")) {
+				t.Errorf("redacted name does not match salted path digest")
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ima
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	runtimeMeasurementsFile = "/sys/kernel/security/ima/binary_runtime_measurements"
+	measurementsCountFile   = "/sys/kernel/security/ima/runtime_measurements_count"
+
+	defaultPollInterval = time.Second
+	// The first entry is the boot aggregate, which is much shorter
+	firstEventMaxLen = 4096
+)
+
+// WatcherConfig configures the IMA watcher. Path and CountPath default to the
+// securityfs files and are only set for testing
+type WatcherConfig struct {
+	Path         string
+	CountPath    string
+	PollInterval time.Duration
+	// Watchlist contains path patterns as supported by path.Match, e.g.
+	// "/usr/bin/*". OnMatch is called for every new entry matching a pattern
+	Watchlist []string
+	OnMatch   func(ar.MeasureEvent)
+}
+
+// Watcher monitors the IMA runtime measurement list and incrementally parses
+// new entries, so that the runtime of attestations does not grow with the
+// size of the measurement list
+type Watcher struct {
+	mu        sync.Mutex
+	path      string
+	countPath string
+	interval  time.Duration
+	watchlist []string
+	onMatch   func(ar.MeasureEvent)
+	events    []ar.MeasureEvent
+	offset    int64
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewWatcher creates a new IMA watcher. The watcher must be started with Start
+func NewWatcher(c WatcherConfig) (*Watcher, error) {
+
+	for _, pattern := range c.Watchlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid IMA watchlist pattern %q: %w", pattern, err)
+		}
+	}
+
+	w := &Watcher{
+		path:      c.Path,
+		countPath: c.CountPath,
+		interval:  c.PollInterval,
+		watchlist: c.Watchlist,
+		onMatch:   c.OnMatch,
+		events:    make([]ar.MeasureEvent, 0),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if w.path == "" {
+		w.path = runtimeMeasurementsFile
+	}
+	if w.countPath == "" {
+		w.countPath = measurementsCountFile
+	}
+	if w.interval <= 0 {
+		w.interval = defaultPollInterval
+	}
+	if w.onMatch == nil {
+		w.onMatch = func(e ar.MeasureEvent) {
+			log.Infof("IMA measured watched file %v", e.EventName)
+		}
+	}
+
+	return w, nil
+}
+
+// Start reads the current measurement list and starts polling for new entries
+func (w *Watcher) Start() {
+	if err := w.update(); err != nil {
+		log.Warnf("Failed to read IMA measurement list: %v", err)
+	}
+	go w.run()
+}
+
+// Stop stops the watcher and waits until polling has finished
+func (w *Watcher) Stop() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			log.Debug("Stopped IMA watcher")
+			return
+		case <-ticker.C:
+			if err := w.update(); err != nil {
+				log.Debugf("Failed to update IMA measurements: %v", err)
+			}
+		}
+	}
+}
+
+// Events ingests entries added since the last poll and returns all IMA events.
+// The returned slice must not be modified
+func (w *Watcher) Events() ([]ar.MeasureEvent, error) {
+	if err := w.update(); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.events[:len(w.events):len(w.events)], nil
+}
+
+// update parses the entries appended since the last update. If the measurement
+// list was reset, i.e. it is shorter than the already parsed list or starts with
+// a different entry, e.g. after a reboot or kexec, the state is reset and the
+// list is parsed from the beginning
+func (w *Watcher) update() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	count, cerr := readCount(w.countPath)
+	if cerr == nil && count == len(w.events) {
+		return nil
+	}
+
+	if len(w.events) > 0 {
+		reset := cerr == nil && count < len(w.events)
+		if !reset {
+			first, err := readFirstEvent(w.path)
+			if err != nil {
+				return err
+			}
+			reset = !bytes.Equal(first.Sha256, w.events[0].Sha256)
+		}
+		if reset {
+			log.Infof("IMA measurement list was reset, re-reading")
+			w.reset()
+		}
+	}
+
+	events, err := w.read()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		if w.watched(e.EventName) {
+			w.onMatch(e)
+		}
+	}
+	w.events = append(w.events, events...)
+
+	return nil
+}
+
+// read parses the complete entries after the current offset
+func (w *Watcher) read() ([]ar.MeasureEvent, error) {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", w.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek %v: %w", w.path, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", w.path, err)
+	}
+
+	events, n, err := parseImaEvents(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IMA runtime digests: %w", err)
+	}
+	w.offset += int64(n)
+
+	return events, nil
+}
+
+func (w *Watcher) reset() {
+	// Do not truncate the slice, as it might still be used by callers of Events
+	w.events = make([]ar.MeasureEvent, 0)
+	w.offset = 0
+}
+
+func (w *Watcher) watched(name string) bool {
+	for _, pattern := range w.watchlist {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readFirstEvent parses the first entry of the measurement list
+func readFirstEvent(file string) (ar.MeasureEvent, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ar.MeasureEvent{}, fmt.Errorf("failed to open %v: %w", file, err)
+	}
+	defer f.Close()
+
+	data := make([]byte, firstEventMaxLen)
+	n, err := io.ReadFull(f, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return ar.MeasureEvent{}, fmt.Errorf("failed to read %v: %w", file, err)
+	}
+	e, err := parseImaEvent(bytes.NewBuffer(data[:n]))
+	if err != nil {
+		return ar.MeasureEvent{}, fmt.Errorf("failed to parse first IMA entry: %w", err)
+	}
+	return e, nil
+}
+
+func readCount(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %v: %w", file, err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %v: %w", file, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ima
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// imaNgEntry creates an ima-ng entry of the binary runtime measurement list
+func imaNgEntry(path string) []byte {
+	fileDigest := sha256.Sum256([]byte(path))
+
+	data := new(bytes.Buffer)
+	digest := append([]byte("sha256:\x00"), fileDigest[:]...)
+	binary.Write(data, binary.LittleEndian, uint32(len(digest)))
+	data.Write(digest)
+	binary.Write(data, binary.LittleEndian, uint32(len(path)+1))
+	data.WriteString(path + "\x00")
+
+	entry := new(bytes.Buffer)
+	binary.Write(entry, binary.LittleEndian, header{Pcr: 10, NameLen: 6})
+	entry.WriteString("ima-ng")
+	binary.Write(entry, binary.LittleEndian, uint32(data.Len()))
+	entry.Write(data.Bytes())
+
+	return entry.Bytes()
+}
+
+type testLog struct {
+	t         *testing.T
+	path      string
+	countPath string
+}
+
+func newTestLog(t *testing.T) *testLog {
+	dir := t.TempDir()
+	return &testLog{
+		t:         t,
+		path:      filepath.Join(dir, "binary_runtime_measurements"),
+		countPath: filepath.Join(dir, "runtime_measurements_count"),
+	}
+}
+
+// write writes the complete entries and optionally a partial entry
+func (l *testLog) write(paths []string, partial string) {
+	data := new(bytes.Buffer)
+	for _, p := range paths {
+		data.Write(imaNgEntry(p))
+	}
+	if partial != "" {
+		e := imaNgEntry(partial)
+		data.Write(e[:len(e)/2])
+	}
+	if err := os.WriteFile(l.path, data.Bytes(), 0644); err != nil {
+		l.t.Fatalf("failed to write measurement list: %v", err)
+	}
+	err := os.WriteFile(l.countPath, []byte(fmt.Sprintf("%v\n", len(paths))), 0644)
+	if err != nil {
+		l.t.Fatalf("failed to write measurement count: %v", err)
+	}
+}
+
+func eventNames(events []ar.MeasureEvent) []string {
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, e.EventName)
+	}
+	return names
+}
+
+func TestWatcher(t *testing.T) {
+
+	l := newTestLog(t)
+	var matches []string
+	w, err := NewWatcher(WatcherConfig{
+		Path:      l.path,
+		CountPath: l.countPath,
+		Watchlist: []string{"/usr/bin/*"},
+		OnMatch:   func(e ar.MeasureEvent) { matches = append(matches, e.EventName) },
+	})
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		paths       []string
+		partial     string
+		wantMatches []string
+	}{
+		{"Initial", []string{"boot_aggregate", "/usr/lib/init"}, "", nil},
+		{"Appended", []string{"boot_aggregate", "/usr/lib/init", "/usr/bin/ls", "/etc/passwd"},
+			"/usr/bin/cat", []string{"/usr/bin/ls"}},
+		{"Completed", []string{"boot_aggregate", "/usr/lib/init", "/usr/bin/ls", "/etc/passwd",
+			"/usr/bin/cat"}, "", []string{"/usr/bin/cat"}},
+		{"Unchanged", []string{"boot_aggregate", "/usr/lib/init", "/usr/bin/ls", "/etc/passwd",
+			"/usr/bin/cat"}, "", nil},
+		{"Shrunk", []string{"boot_aggregate", "/usr/bin/sh"}, "", []string{"/usr/bin/sh"}},
+		{"Replaced", []string{"new_boot_aggregate", "/usr/bin/sh", "/usr/bin/ls"}, "",
+			[]string{"/usr/bin/sh", "/usr/bin/ls"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l.write(tt.paths, tt.partial)
+			matches = nil
+
+			events, err := w.Events()
+			if err != nil {
+				t.Fatalf("Events() error = %v", err)
+			}
+			if got := eventNames(events); !reflect.DeepEqual(got, tt.paths) {
+				t.Errorf("Events() = %v, want %v", got, tt.paths)
+			}
+			if !reflect.DeepEqual(matches, tt.wantMatches) {
+				t.Errorf("matches = %v, want %v", matches, tt.wantMatches)
+			}
+
+			// The incrementally parsed events must match a complete parse
+			data, _ := os.ReadFile(l.path)
+			full, _, err := parseImaEvents(data)
+			if err != nil {
+				t.Fatalf("parseImaEvents() error = %v", err)
+			}
+			if !reflect.DeepEqual(events, full) {
+				t.Errorf("incrementally parsed events differ from complete parse")
+			}
+		})
+	}
+}
+
+func TestWatcherPolling(t *testing.T) {
+
+	l := newTestLog(t)
+	l.write([]string{"boot_aggregate"}, "")
+
+	matched := make(chan string, 1)
+	w, err := NewWatcher(WatcherConfig{
+		Path:         l.path,
+		CountPath:    l.countPath,
+		PollInterval: 10 * time.Millisecond,
+		Watchlist:    []string{"/usr/bin/*"},
+		OnMatch:      func(e ar.MeasureEvent) { matched <- e.EventName },
+	})
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+	w.Start()
+
+	l.write([]string{"boot_aggregate", "/usr/bin/ls"}, "")
+
+	select {
+	case name := <-matched:
+		if name != "/usr/bin/ls" {
+			t.Errorf("matched %v, want /usr/bin/ls", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("watcher did not detect new entry")
+	}
+
+	w.Stop()
+	w.Stop()
+}
+
+func TestNewWatcherInvalidPattern(t *testing.T) {
+	_, err := NewWatcher(WatcherConfig{Watchlist: []string{"/usr/bin/["}})
+	if err == nil {
+		t.Errorf("NewWatcher() with invalid pattern succeeded")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// Maximum number of certificates including the leaf certificate and root CA
+	maxChainLen = 5
+	maxCertSize = 64 * 1024
+)
+
+var (
+	// Client for fetching the CA certificates referenced in the authority
+	// information access extension of the certificates
+	chainClient = &http.Client{Timeout: 10 * time.Second}
+
+	chainRetryInterval = time.Minute
+)
+
+// ChainCache provides the certificate chain of a leaf certificate issued by a
+// cloud provider CA, e.g., a vTPM AK certificate, whose issuers are referenced
+// via the authority information access extension. If Storage and File are set,
+// the chain is cached in this file. A ChainCache is not safe for concurrent use
+type ChainCache struct {
+	Storage string
+	File    string
+	chain   []*x509.Certificate
+	retry   time.Time
+}
+
+// Get returns the certificate chain (leaf certificate, intermediate CAs, root
+// CA). The chain is taken from memory or the storage cache if present,
+// otherwise it is fetched from the CA URLs and cached. If the chain cannot be
+// fetched, e.g., due to missing network access, only the leaf certificate is
+// returned and fetching is retried after the retry interval. The verifier then
+// fails the certificate chain validation
+func (c *ChainCache) Get(leaf *x509.Certificate) []*x509.Certificate {
+
+	if c.chain != nil && bytes.Equal(c.chain[0].Raw, leaf.Raw) {
+		return c.chain
+	}
+
+	var cacheFile string
+	if c.Storage != "" && c.File != "" {
+		cacheFile = path.Join(c.Storage, c.File)
+		data, err := os.ReadFile(cacheFile)
+		if err == nil {
+			var certs []*x509.Certificate
+			certs, err = ParseCertsPem(data)
+			if err == nil && (len(certs) == 0 || !bytes.Equal(certs[0].Raw, leaf.Raw)) {
+				err = errors.New("cached chain does not belong to certificate")
+			}
+			if err == nil {
+				log.Tracef("Using cached certificate chain %v", cacheFile)
+				c.chain = certs
+				return certs
+			}
+		}
+		log.Tracef("Certificate chain not present at %v, will be downloaded: %v", cacheFile, err)
+	}
+
+	if c.chain != nil && !bytes.Equal(c.chain[0].Raw, leaf.Raw) {
+		// The certificate was renewed, fetch the chain of the new certificate
+		c.chain = nil
+		c.retry = time.Time{}
+	}
+	if time.Now().Before(c.retry) {
+		return []*x509.Certificate{leaf}
+	}
+
+	certs, err := FetchChain(leaf)
+	if err != nil {
+		log.Warnf("Failed to fetch certificate chain of %v, providing certificate only: %v",
+			leaf.Subject.CommonName, err)
+		c.retry = time.Now().Add(chainRetryInterval)
+		return []*x509.Certificate{leaf}
+	}
+
+	if cacheFile != "" {
+		if err := os.WriteFile(cacheFile, WriteCertChainPem(certs), 0644); err != nil {
+			log.Warnf("Failed to cache certificate chain: %v", err)
+		}
+	}
+	c.chain = certs
+
+	return certs
+}
+
+// FetchChain follows the issuer URLs of the certificate up to the self-signed
+// root CA
+func FetchChain(leaf *x509.Certificate) ([]*x509.Certificate, error) {
+
+	chain := []*x509.Certificate{leaf}
+	for len(chain) < maxChainLen {
+		cert := chain[len(chain)-1]
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			return chain, nil
+		}
+		if len(cert.IssuingCertificateURL) == 0 {
+			return nil, fmt.Errorf("certificate %v does not contain issuer URL",
+				cert.Subject.CommonName)
+		}
+
+		issuer, err := fetchCert(cert.IssuingCertificateURL[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("certificate %v not signed by %v: %w",
+				cert.Subject.CommonName, issuer.Subject.CommonName, err)
+		}
+		chain = append(chain, issuer)
+	}
+
+	return nil, fmt.Errorf("certificate chain exceeds maximum length %v", maxChainLen)
+}
+
+// fetchCert fetches a DER or PEM encoded certificate
+func fetchCert(url string) (*x509.Certificate, error) {
+
+	log.Tracef("Requesting CA certificate from %v", url)
+
+	resp, err := chainClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error HTTP GET: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Response Status: %v (%v)", resp.StatusCode, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP body: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(data)
+	if err == nil {
+		return cert, nil
+	}
+	certs, err := ParseCertsPem(data)
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("failed to parse certificate from %v", url)
+	}
+	return certs[0], nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testChainFile = "akchain.pem"
+
+type testChain struct {
+	leaf, ca, root *x509.Certificate
+	requests       int
+}
+
+func createChainCert(t *testing.T, cn string, isCa bool, issuerUrl string,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+	}
+	if issuerUrl != "" {
+		tmpl.IssuingCertificateURL = []string{issuerUrl}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// createTestChain creates a test chain and a server providing the CA
+// certificates, the root CA PEM encoded and the intermediate CA DER encoded
+func createTestChain(t *testing.T) (*testChain, *httptest.Server) {
+	c := &testChain{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.requests++
+		switch r.URL.Path {
+		case "/root.pem":
+			w.Write(WriteCertPem(c.root))
+		case "/ca.crt":
+			w.Write(c.ca.Raw)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	var rootKey, caKey *ecdsa.PrivateKey
+	c.root, rootKey = createChainCert(t, "Test Root", true, "", nil, nil)
+	c.ca, caKey = createChainCert(t, "Test Intermediate", true, srv.URL+"/root.pem", c.root,
+		rootKey)
+	c.leaf, _ = createChainCert(t, "test-instance", false, srv.URL+"/ca.crt", c.ca, caKey)
+
+	return c, srv
+}
+
+func TestChainCache(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		modify  func(c *testChain, srv *httptest.Server)
+		storage bool
+		wantLen int
+	}{
+		{"Success", func(c *testChain, srv *httptest.Server) {}, false, 3},
+		{"Success Cached", func(c *testChain, srv *httptest.Server) {}, true, 3},
+		{"Server Unavailable", func(c *testChain, srv *httptest.Server) { srv.Close() }, true, 1},
+		{"Missing Issuer URL", func(c *testChain, srv *httptest.Server) {
+			c.leaf.IssuingCertificateURL = nil
+		}, false, 1},
+		{"Wrong Issuer", func(c *testChain, srv *httptest.Server) {
+			c.leaf.IssuingCertificateURL = []string{srv.URL + "/root.pem"}
+		}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, srv := createTestChain(t)
+			defer srv.Close()
+			tt.modify(c, srv)
+
+			cache := &ChainCache{File: testChainFile}
+			if tt.storage {
+				cache.Storage = t.TempDir()
+			}
+
+			got := cache.Get(c.leaf)
+			if len(got) != tt.wantLen {
+				t.Fatalf("Get() returned %v certificates, want %v", len(got), tt.wantLen)
+			}
+			if !bytes.Equal(got[0].Raw, c.leaf.Raw) {
+				t.Errorf("Get() does not start with leaf certificate")
+			}
+
+			// Complete chains are kept, failures are not retried before the retry interval
+			requests := c.requests
+			if len(cache.Get(c.leaf)) != tt.wantLen || c.requests != requests {
+				t.Errorf("Get() unexpectedly fetched certificates again")
+			}
+
+			if tt.storage && tt.wantLen > 1 {
+				// A new cache must use the stored chain
+				cache = &ChainCache{Storage: cache.Storage, File: testChainFile}
+				if len(cache.Get(c.leaf)) != tt.wantLen || c.requests != requests {
+					t.Errorf("Get() did not use stored chain")
+				}
+
+				// A stored chain of another certificate must not be used
+				err := os.WriteFile(path.Join(cache.Storage, testChainFile),
+					WriteCertPem(c.root), 0644)
+				if err != nil {
+					t.Fatalf("failed to write cache: %v", err)
+				}
+				cache = &ChainCache{Storage: cache.Storage, File: testChainFile}
+				if len(cache.Get(c.leaf)) != tt.wantLen || c.requests == requests {
+					t.Errorf("Get() used stored chain of other certificate")
+				}
+			}
+
+			// A renewed certificate requires fetching its chain
+			if tt.wantLen > 1 {
+				if len(cache.Get(c.ca)) != 2 {
+					t.Errorf("Get() of renewed certificate returned chain of previous certificate")
+				}
+			}
+		})
+	}
+}
@@ -17,8 +17,11 @@ package internal
 
 // Install github packages with "go get [url]"
 import (
+	"encoding/json"
 	"flag"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -51,3 +54,40 @@ func FlagPassed(name string) bool {
 	})
 	return found
 }
+
+// UnknownFields returns the top-level fields of the JSON object which do not
+// match a field of the struct v and are therefore silently ignored when
+// unmarshalling, e.g. misspelled configuration options
+func UnknownFields(data []byte, v any) ([]string, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		// Field names are matched case-insensitively by json.Unmarshal
+		known[strings.ToLower(name)] = true
+	}
+
+	unknown := make([]string, 0)
+	for name := range obj {
+		if !known[strings.ToLower(name)] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
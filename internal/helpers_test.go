@@ -0,0 +1,55 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestUnknownFields(t *testing.T) {
+	type config struct {
+		Addr     string   `json:"addr"`
+		Drivers  []string `json:"drivers,omitempty"`
+		Internal string   `json:"-"`
+		Untagged bool
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{"Known", `{"addr":"localhost","drivers":["tpm"],"Untagged":true}`, []string{}, false},
+		{"Case Insensitive", `{"ADDR":"localhost","untagged":true}`, []string{}, false},
+		{"Misspelled", `{"adr":"localhost","driver":["tpm"]}`, []string{"adr", "driver"}, false},
+		{"Ignored", `{"Internal":"x"}`, []string{"Internal"}, false},
+		{"Invalid", `["addr"]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnknownFields([]byte(tt.data), &config{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnknownFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("UnknownFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Subsystems with their own logger, whose level can be configured separately
+const (
+	SubsystemServer            = "server"
+	SubsystemDrivers           = "drivers"
+	SubsystemAttestationReport = "attestationreport"
+	SubsystemAttestedTls       = "attestedtls"
+)
+
+// LogFormats are the supported log formats
+var LogFormats = []string{"text", "json"}
+
+var (
+	logMu      sync.Mutex
+	subsystems = map[string]*logrus.Logger{
+		SubsystemServer:            newSubsystemLogger(),
+		SubsystemDrivers:           newSubsystemLogger(),
+		SubsystemAttestationReport: newSubsystemLogger(),
+		SubsystemAttestedTls:       newSubsystemLogger(),
+	}
+)
+
+func newSubsystemLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetLevel(logrus.GetLevel())
+	return l
+}
+
+// Subsystems returns the names of the subsystems
+func Subsystems() []string {
+	names := maps.Keys(subsystems)
+	slices.Sort(names)
+	return names
+}
+
+// NewLogger returns the logger of a package belonging to the subsystem. The
+// entries contain the subsystem and the service, i.e. the package
+func NewLogger(subsystem, service string) *logrus.Entry {
+	l, ok := subsystems[subsystem]
+	if !ok {
+		panic(fmt.Sprintf("internal error: unknown log subsystem %v", subsystem))
+	}
+	return l.WithFields(logrus.Fields{"subsystem": subsystem, "service": service})
+}
+
+// ConfigureLogging sets the format, the output and the global level of all
+// loggers. The levels override the global level for single subsystems. If
+// out is nil, the output is not changed
+func ConfigureLogging(format string, level logrus.Level, levels map[string]logrus.Level,
+	out io.Writer,
+) error {
+	var formatter logrus.Formatter
+	switch strings.ToLower(format) {
+	case "", "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %v (possible: %v)", format,
+			strings.Join(LogFormats, ","))
+	}
+	for s := range levels {
+		if _, ok := subsystems[s]; !ok {
+			return fmt.Errorf("unknown log subsystem %v (possible: %v)", s,
+				strings.Join(Subsystems(), ","))
+		}
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	configure := func(l *logrus.Logger, lvl logrus.Level) {
+		l.SetFormatter(formatter)
+		l.SetLevel(lvl)
+		if out != nil {
+			l.SetOutput(out)
+		}
+	}
+	configure(logrus.StandardLogger(), level)
+	for s, l := range subsystems {
+		lvl, ok := levels[s]
+		if !ok {
+			lvl = level
+		}
+		configure(l, lvl)
+	}
+	return nil
+}
+
+// SetLogLevel sets the level of all loggers
+func SetLogLevel(level logrus.Level) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logrus.SetLevel(level)
+	for _, l := range subsystems {
+		l.SetLevel(level)
+	}
+}
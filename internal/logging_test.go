@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	t.Cleanup(func() {
+		ConfigureLogging("text", logrus.InfoLevel, nil, os.Stderr)
+	})
+
+	tests := []struct {
+		name     string
+		format   string
+		levels   map[string]logrus.Level
+		wantLogs []string
+		wantErr  bool
+	}{
+		{"Text", "text", nil, []string{"server"}, false},
+		{"Json", "json", nil, []string{"server"}, false},
+		{"Override", "json", map[string]logrus.Level{SubsystemDrivers: logrus.DebugLevel},
+			[]string{"server", "drivers"}, false},
+		{"Unknown Format", "xml", nil, nil, true},
+		{"Unknown Subsystem", "json", map[string]logrus.Level{"tpm": logrus.DebugLevel},
+			nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ConfigureLogging(tt.format, logrus.InfoLevel, tt.levels, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigureLogging() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			NewLogger(SubsystemServer, "cmc").Info("info")
+			NewLogger(SubsystemDrivers, "tpm").Debug("debug")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != len(tt.wantLogs) {
+				t.Fatalf("got %v log lines, want %v: %v", len(lines), len(tt.wantLogs), lines)
+			}
+			for i, line := range lines {
+				if tt.format == "text" {
+					if !strings.Contains(line, "subsystem="+tt.wantLogs[i]) {
+						t.Errorf("log line %q misses subsystem %v", line, tt.wantLogs[i])
+					}
+					continue
+				}
+				var entry map[string]string
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("failed to unmarshal log line %q: %v", line, err)
+				}
+				if entry["subsystem"] != tt.wantLogs[i] || entry["service"] == "" {
+					t.Errorf("log entry %v, want subsystem %v", entry, tt.wantLogs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// ReadNvCert reads a DER encoded certificate from the TPM NV index, e.g., the
+// AK certificate provisioned by a cloud provider into its vTPM. The NV index
+// might be larger than the certificate, therefore trailing padding is removed
+func ReadNvCert(rwc io.ReadWriter, index tpmutil.Handle) (*x509.Certificate, error) {
+	data, err := tpm2.NVReadEx(rwc, index, tpm2.HandleOwner, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NV index 0x%x: %w", uint32(index), err)
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(raw.FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package internal
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCredentials returns the user ID and the primary group ID of the process
+// connected to the unix domain socket via SO_PEERCRED. The credentials are the
+// ones of the peer at the time it connected
+func PeerCredentials(conn *net.UnixConn) (uint32, uint32, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get raw connection: %w", err)
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to access socket: %w", err)
+	}
+	if credErr != nil {
+		return 0, 0, fmt.Errorf("failed to get SO_PEERCRED: %w", credErr)
+	}
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GetSecret reads a secret such as a passphrase or PIN from the specified
+// source, which is either env:<VARIABLE>, file:<PATH> or prompt. For prompt,
+// the secret is read from the controlling terminal with the given description
+func GetSecret(source, description string) ([]byte, error) {
+	var secret []byte
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		secret = []byte(os.Getenv(name))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("environment variable %v not set", name)
+		}
+	case strings.HasPrefix(source, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v file: %w", description, err)
+		}
+		secret = bytes.TrimRight(data, "\r\n")
+	case source == "prompt":
+		var err error
+		secret, err = readSecret(fmt.Sprintf("Enter %v: ", description))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		// The source is not printed, as it might be the secret itself
+		return nil, fmt.Errorf("invalid %v source (must be env:<VAR>, file:<PATH> or prompt)",
+			description)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty %v", description)
+	}
+	return secret, nil
+}
+
+// CheckSecretSource checks that the secret source is valid and the secret is
+// available, i.e., the environment variable is set or the file exists, without
+// reading the secret or prompting for it
+func CheckSecretSource(source string) error {
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		if os.Getenv(name) == "" {
+			return fmt.Errorf("environment variable %v not set", name)
+		}
+	case strings.HasPrefix(source, "file:"):
+		if _, err := os.Stat(strings.TrimPrefix(source, "file:")); err != nil {
+			return err
+		}
+	case source == "prompt":
+	default:
+		return fmt.Errorf("invalid source (must be env:<VAR>, file:<PATH> or prompt)")
+	}
+	return nil
+}
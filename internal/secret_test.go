@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestGetSecret(t *testing.T) {
+
+	dir := t.TempDir()
+	file := path.Join(dir, "passphrase")
+	if err := os.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := path.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CMC_TEST_PASSPHRASE", "secret")
+
+	tests := []struct {
+		name    string
+		source  string
+		want    string
+		wantErr bool
+	}{
+		{"Env", "env:CMC_TEST_PASSPHRASE", "secret", false},
+		{"File", "file:" + file, "secret", false},
+		{"Env Unset", "env:CMC_TEST_UNSET", "", true},
+		{"File Empty", "file:" + empty, "", true},
+		{"File Missing", "file:" + path.Join(dir, "missing"), "", true},
+		{"Invalid", "secret", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetSecret(tt.source, "passphrase")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("GetSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSecretSource(t *testing.T) {
+
+	file := path.Join(t.TempDir(), "pin")
+	if err := os.WriteFile(file, []byte("1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CMC_TEST_PIN", "1234")
+
+	tests := []struct {
+		name    string
+		source  string
+		wantErr bool
+	}{
+		{"Env", "env:CMC_TEST_PIN", false},
+		{"File", "file:" + file, false},
+		{"Prompt", "prompt", false},
+		{"Env Unset", "env:CMC_TEST_UNSET", true},
+		{"File Missing", "file:" + file + ".missing", true},
+		{"Literal", "1234", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckSecretSource(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckSecretSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "1234") {
+				t.Errorf("CheckSecretSource() error %q contains the secret", err)
+			}
+		})
+	}
+}
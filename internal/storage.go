@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The envelope of the files written by StoreFile consists of the magic, the
+// version and the SHA-256 digest of the data, followed by the data
+const (
+	storageMagic   = "cmcstate"
+	storageVersion = 1
+	storageHeader  = len(storageMagic) + 1 + sha256.Size
+)
+
+// ErrCorrupted is returned if a stored file and its backup are corrupted
+var ErrCorrupted = errors.New("stored file corrupted")
+
+// WriteFileAtomic writes the data to a temporary file in the same directory,
+// flushes it to disk and renames it, so that the file is never left in a
+// partially written state, even on power loss
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := os.CreateTemp(dir, filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	// Persist the rename. Not all platforms support syncing directories, in
+	// which case the file is still written, but might not survive a power loss
+	if err := syncDir(dir); err != nil {
+		log.Debugf("Failed to sync %v: %v", dir, err)
+	}
+	return nil
+}
+
+// StoreFile atomically writes the data within a versioned envelope containing
+// a checksum. The previous version of the file is kept as backup with the
+// suffix .bak, which is loaded by LoadFile if the file is corrupted
+func StoreFile(name string, data []byte, perm os.FileMode) error {
+	if err := backup(name); err != nil {
+		log.Warnf("Failed to back up %v: %v", name, err)
+	}
+
+	digest := sha256.Sum256(data)
+	buf := make([]byte, 0, storageHeader+len(data))
+	buf = append(buf, storageMagic...)
+	buf = append(buf, storageVersion)
+	buf = append(buf, digest[:]...)
+	buf = append(buf, data...)
+
+	return WriteFileAtomic(name, buf, perm)
+}
+
+// LoadFile reads a file written by StoreFile and returns the data. If the file
+// is corrupted, e.g. truncated, the backup is returned instead. Files without
+// envelope written by previous versions are returned unchanged
+func LoadFile(name string) ([]byte, error) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openEnvelope(raw)
+	if err == nil {
+		return data, nil
+	}
+
+	log.Warnf("File %v is corrupted (%v), loading backup", name, err)
+	raw, berr := os.ReadFile(name + ".bak")
+	if berr != nil {
+		return nil, fmt.Errorf("%w: %v: %v, no backup available: %v", ErrCorrupted, name, err, berr)
+	}
+	data, berr = openEnvelope(raw)
+	if berr != nil {
+		return nil, fmt.Errorf("%w: %v: %v, backup: %v", ErrCorrupted, name, err, berr)
+	}
+	return data, nil
+}
+
+func openEnvelope(raw []byte) ([]byte, error) {
+	if len(raw) < len(storageMagic) {
+		// Files truncated within the magic cannot be distinguished from
+		// legacy files, but legacy state files are never that short
+		if bytes.HasPrefix([]byte(storageMagic), raw) {
+			return nil, errors.New("truncated header")
+		}
+		return raw, nil
+	}
+	if !bytes.HasPrefix(raw, []byte(storageMagic)) {
+		return raw, nil
+	}
+	if len(raw) < storageHeader {
+		return nil, errors.New("truncated header")
+	}
+	if v := raw[len(storageMagic)]; v != storageVersion {
+		return nil, fmt.Errorf("unsupported version %v", v)
+	}
+	digest := raw[len(storageMagic)+1 : storageHeader]
+	data := raw[storageHeader:]
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], digest) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
+
+// backup replaces the backup with a hard link to the current file if the
+// current file is intact, so that a file and its backup always exist
+func backup(name string) error {
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := openEnvelope(raw); err != nil {
+		// Keep the previous backup instead of a corrupted file
+		return nil
+	}
+	bak := name + ".bak"
+	if err := os.Remove(bak); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(name, bak); err == nil {
+		return nil
+	}
+	// Fall back to a copy on file systems without hard links
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(bak, raw, info.Mode().Perm())
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
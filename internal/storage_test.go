@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "state.json")
+	v1 := []byte(`{"state":"unenrolled","attempts":3}`)
+	v2 := []byte(`{"state":"enrolled"}`)
+
+	if err := StoreFile(name, v1, 0600); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	if err := StoreFile(name, v2, 0600); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	got, err := LoadFile(name)
+	if err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, v2) {
+		t.Fatalf("LoadFile() = %s, want %s", got, v2)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v (%v), want %v", info.Mode().Perm(), err, os.FileMode(0600))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
+
+// TestLoadFileTruncated simulates power losses during non-atomic writes by
+// truncating the file at every offset, the previous version must be recovered
+func TestLoadFileTruncated(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "ak_chain.pem")
+	v1 := []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")
+	v2 := []byte("-----BEGIN CERTIFICATE-----\nMIIC\n-----END CERTIFICATE-----\n")
+
+	if err := StoreFile(name, v1, 0644); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	if err := StoreFile(name, v2, 0644); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	full, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	for i := 0; i < len(full); i++ {
+		if err := os.WriteFile(name, full[:i], 0644); err != nil {
+			t.Fatalf("failed to truncate file: %v", err)
+		}
+		got, err := LoadFile(name)
+		if err != nil {
+			t.Fatalf("LoadFile() truncated at %v error = %v", i, err)
+		}
+		if !bytes.Equal(got, v1) {
+			t.Fatalf("LoadFile() truncated at %v = %q, want backup %q", i, got, v1)
+		}
+	}
+
+	// Storing over a corrupted file must not replace the good backup
+	if err := StoreFile(name, v2, 0644); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+	if got, err := LoadFile(name + ".bak"); err != nil || !bytes.Equal(got, v1) {
+		t.Errorf("backup = %q (%v), want %q", got, err, v1)
+	}
+}
+
+func TestLoadFileCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "ik_chain.pem")
+	if err := StoreFile(name, []byte("ik"), 0644); err != nil {
+		t.Fatalf("StoreFile() error = %v", err)
+	}
+
+	// Flip a bit of the data, without a backup the corruption is reported
+	raw, _ := os.ReadFile(name)
+	raw[len(raw)-1] ^= 0x01
+	if err := os.WriteFile(name, raw, 0644); err != nil {
+		t.Fatalf("failed to corrupt file: %v", err)
+	}
+	if _, err := LoadFile(name); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("LoadFile() error = %v, want %v", err, ErrCorrupted)
+	}
+}
+
+func TestLoadFileLegacy(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"PEM", []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")},
+		{"Binary", []byte{0x00, 0x4e, 0x00, 0x08, 0x00, 0x0b}},
+		{"Short", []byte{0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "legacy")
+			if err := os.WriteFile(name, tt.data, 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+			got, err := LoadFile(name)
+			if err != nil || !bytes.Equal(got, tt.data) {
+				t.Errorf("LoadFile() = %v, %v, want %v", got, err, tt.data)
+			}
+
+			// The legacy file is kept as backup when migrating
+			if err := StoreFile(name, []byte("new"), 0644); err != nil {
+				t.Fatalf("StoreFile() error = %v", err)
+			}
+			if got, err := LoadFile(name + ".bak"); err != nil || !bytes.Equal(got, tt.data) {
+				t.Errorf("backup = %v, %v, want %v", got, err, tt.data)
+			}
+		})
+	}
+
+	// A missing file is not replaced by a backup
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadFile() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
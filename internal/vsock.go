@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Well-known vsock context IDs (CIDs)
+const (
+	VsockCidHypervisor = 0
+	VsockCidLocal      = 1
+	VsockCidHost       = 2
+	VsockCidAny        = 0xffffffff
+	// VsockPortAny binds to a free port
+	VsockPortAny = 0xffffffff
+)
+
+const vsockScheme = "vsock://"
+
+var vsockCids = map[string]uint32{
+	"hypervisor": VsockCidHypervisor,
+	"local":      VsockCidLocal,
+	"host":       VsockCidHost,
+	"any":        VsockCidAny,
+}
+
+// VsockAddr is the address of an AF_VSOCK socket
+type VsockAddr struct {
+	Cid  uint32
+	Port uint32
+}
+
+func (a *VsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%v%v:%v", vsockScheme, a.Cid, a.Port)
+}
+
+// ParseVsockAddr parses a vsock address of the form [vsock://]<cid>:<port>.
+// The CID is either a number or one of hypervisor, local, host and any. The
+// guest listens with the CID any, whereas the host dials the CID of the guest
+func ParseVsockAddr(addr string) (*VsockAddr, error) {
+	cidStr, portStr, ok := strings.Cut(strings.TrimPrefix(addr, vsockScheme), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid vsock address %q (expected [vsock://]<cid>:<port>)", addr)
+	}
+
+	cid, ok := vsockCids[strings.ToLower(cidStr)]
+	if !ok {
+		c, err := strconv.ParseUint(cidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vsock CID %q", cidStr)
+		}
+		cid = uint32(c)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vsock port %q", portStr)
+	}
+
+	return &VsockAddr{Cid: cid, Port: uint32(port)}, nil
+}
+
+// Listen listens on the address of the network, which is either a network
+// supported by net.Listen or vsock
+func Listen(network, addr string) (net.Listener, error) {
+	if !strings.EqualFold(network, "vsock") {
+		return net.Listen(network, addr)
+	}
+	a, err := ParseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenVsock(a)
+}
+
+// Dial connects to the address of the network, which is either a network
+// supported by net.Dial or vsock
+func Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if !strings.EqualFold(network, "vsock") {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	a, err := ParseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialVsock(a, timeout)
+}
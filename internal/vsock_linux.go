@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener accepts AF_VSOCK connections. The sockets are non-blocking
+// and registered with the runtime poller, so that deadlines are supported
+type vsockListener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *VsockAddr
+}
+
+// vsockConn is an AF_VSOCK connection
+type vsockConn struct {
+	*os.File
+	local  *VsockAddr
+	remote *VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func vsockSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if errors.Is(err, unix.EAFNOSUPPORT) || errors.Is(err, unix.EPROTONOSUPPORT) {
+		return -1, fmt.Errorf("vsock not supported by the kernel (vsock module not loaded?): %w", err)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+	return fd, nil
+}
+
+func toVsockAddr(sa unix.Sockaddr) *VsockAddr {
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		return &VsockAddr{Cid: vm.CID, Port: vm.Port}
+	}
+	return &VsockAddr{}
+}
+
+func localVsockAddr(fd int) *VsockAddr {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return &VsockAddr{}
+	}
+	return toVsockAddr(sa)
+}
+
+func listenVsock(addr *VsockAddr) (net.Listener, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: addr.Cid, Port: addr.Port}); err != nil {
+		unix.Close(fd)
+		if errors.Is(err, unix.EADDRNOTAVAIL) {
+			return nil, fmt.Errorf("failed to bind %v: CID is not a local CID: %w", addr, err)
+		}
+		return nil, fmt.Errorf("failed to bind %v: %w", addr, err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to listen on %v: %w", addr, err)
+	}
+
+	l := &vsockListener{
+		f:    os.NewFile(uintptr(fd), addr.String()),
+		addr: localVsockAddr(fd),
+	}
+	l.rc, err = l.f.SyscallConn()
+	if err != nil {
+		l.f.Close()
+		return nil, fmt.Errorf("failed to access vsock socket: %w", err)
+	}
+	return l, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var fd int
+	var sa unix.Sockaddr
+	var aerr error
+	err := l.rc.Read(func(s uintptr) bool {
+		fd, sa, aerr = unix.Accept4(int(s), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return !errors.Is(aerr, unix.EAGAIN)
+	})
+	if errors.Is(err, os.ErrClosed) {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: net.ErrClosed}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if aerr != nil {
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: l.addr, Err: aerr}
+	}
+
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), "vsock"),
+		local:  localVsockAddr(fd),
+		remote: toVsockAddr(sa),
+	}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+func dialVsock(addr *VsockAddr, timeout time.Duration) (net.Conn, error) {
+	fd, err := vsockSocket()
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: addr.Cid, Port: addr.Port})
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to connect to %v: %w", addr, err)
+	}
+	f := os.NewFile(uintptr(fd), addr.String())
+
+	// Wait for the non-blocking connect to complete
+	if err != nil {
+		if timeout > 0 {
+			f.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		rc, err := f.SyscallConn()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to access vsock socket: %w", err)
+		}
+		var cerr error
+		wait := true
+		err = rc.Write(func(s uintptr) bool {
+			if wait {
+				wait = false
+				return false
+			}
+			errno, err := unix.GetsockoptInt(int(s), unix.SOL_SOCKET, unix.SO_ERROR)
+			if err != nil {
+				cerr = err
+			} else if errno != 0 {
+				cerr = syscall.Errno(errno)
+			}
+			return true
+		})
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to connect to %v: %w", addr, err)
+		}
+		f.SetWriteDeadline(time.Time{})
+	}
+
+	return &vsockConn{
+		File:   f,
+		local:  localVsockAddr(fd),
+		remote: addr,
+	}, nil
+}
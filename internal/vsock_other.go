@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errVsockUnsupported = errors.New("vsock not supported on this platform")
+
+func listenVsock(addr *VsockAddr) (net.Listener, error) {
+	return nil, errVsockUnsupported
+}
+
+func dialVsock(addr *VsockAddr, timeout time.Duration) (net.Conn, error) {
+	return nil, errVsockUnsupported
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseVsockAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    *VsockAddr
+		wantErr bool
+	}{
+		{"Scheme", "vsock://2:9955", &VsockAddr{Cid: VsockCidHost, Port: 9955}, false},
+		{"No Scheme", "3:9955", &VsockAddr{Cid: 3, Port: 9955}, false},
+		{"Guest Any", "vsock://any:9955", &VsockAddr{Cid: VsockCidAny, Port: 9955}, false},
+		{"Host Name", "Host:1", &VsockAddr{Cid: VsockCidHost, Port: 1}, false},
+		{"Loopback", "local:1", &VsockAddr{Cid: VsockCidLocal, Port: 1}, false},
+		{"Missing Port", "vsock://2", nil, true},
+		{"Invalid CID", "vsock://guest:9955", nil, true},
+		{"CID Overflow", "4294967296:9955", nil, true},
+		{"Invalid Port", "2:port", nil, true},
+		{"Negative Port", "2:-1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVsockAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVsockAddr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVsockAddr() = %v, want %v", got, tt.want)
+			}
+			if got != nil && got.String() != "vsock://"+strconv.Itoa(int(got.Cid))+":"+
+				strconv.Itoa(int(got.Port)) {
+				t.Errorf("String() = %v", got.String())
+			}
+		})
+	}
+}
+
+func TestListenInvalidVsock(t *testing.T) {
+	if _, err := Listen("vsock", "vsock://2"); err == nil {
+		t.Errorf("Listen() with invalid address succeeded")
+	}
+	// Listening is only possible on the local CIDs, i.e., not on the host CID
+	// within a guest or on the CID of another guest
+	if l, err := Listen("vsock", "vsock://4000000:9955"); err == nil {
+		l.Close()
+		t.Errorf("Listen() on foreign CID succeeded")
+	}
+	if _, err := Dial("vsock", "2", time.Second); err == nil {
+		t.Errorf("Dial() with invalid address succeeded")
+	}
+}
+
+// TestVsock performs a round trip over the vsock loopback, which requires the
+// vsock_loopback kernel module
+func TestVsock(t *testing.T) {
+	l, err := Listen("vsock", "vsock://any:"+strconv.Itoa(VsockPortAny))
+	if err != nil {
+		t.Skipf("vsock not available: %v", err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*VsockAddr).Port
+	conn, err := Dial("vsock", "vsock://local:"+strconv.Itoa(int(port)), time.Second)
+	if err != nil {
+		t.Skipf("vsock loopback not available: %v", err)
+	}
+	defer conn.Close()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer server.Close()
+	if server.RemoteAddr().Network() != "vsock" {
+		t.Errorf("remote address network = %v, want vsock", server.RemoteAddr().Network())
+	}
+
+	msg := []byte("attestation report")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != string(msg) {
+		t.Fatalf("ReadFull() = %q, %v, want %q", buf, err, msg)
+	}
+
+	// Deadlines are supported on the connections
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want deadline exceeded", err)
+	}
+
+	// Closing the listener unblocks Accept with net.ErrClosed
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"time"
 )
 
 // ParseCert parses a certificate from PEM or DER encoded data into an X.509 certificate
@@ -96,6 +97,45 @@ func ParseCertsPem(data any) ([]*x509.Certificate, error) {
 	}
 }
 
+// ParseRoots parses the root certificates of the entries, each of which is
+// either a PEM bundle or DER encoded certificates. Empty entries are skipped
+// and duplicates are removed, so that a bundle and its single certificates
+// can be specified together
+func ParseRoots(entries ...[]byte) ([]*x509.Certificate, error) {
+	roots := make([]*x509.Certificate, 0)
+	for i, e := range entries {
+		if len(bytes.TrimSpace(e)) == 0 {
+			continue
+		}
+		var certs []*x509.Certificate
+		var err error
+		if block, _ := pem.Decode(e); block != nil {
+			certs, err = parseCertBlobPem(e)
+		} else {
+			certs, err = parseCertsDer(e)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA %v: %w", i, err)
+		}
+		for _, c := range certs {
+			duplicate := false
+			for _, r := range roots {
+				if c.Equal(r) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				roots = append(roots, c)
+			}
+		}
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no CAs specified")
+	}
+	return roots, nil
+}
+
 func WriteCertPem(cert *x509.Certificate) []byte {
 	p := &bytes.Buffer{}
 	pem.Encode(p, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
@@ -110,6 +150,11 @@ func WriteCertsPem(certs []*x509.Certificate) [][]byte {
 	return pems
 }
 
+// WriteCertChainPem encodes the certificates into a single PEM blob
+func WriteCertChainPem(certs []*x509.Certificate) []byte {
+	return bytes.Join(WriteCertsPem(certs), nil)
+}
+
 func WriteCertsDer(certs []*x509.Certificate) [][]byte {
 	raw := make([][]byte, 0)
 	for _, c := range certs {
@@ -131,19 +176,48 @@ func WritePublicKeyPem(key crypto.PublicKey) ([]byte, error) {
 // verifyCertChain tries to verify the certificate chain certs with leaf
 // certificate first up to one of the root certificates in cas
 func VerifyCertChain(certs []*x509.Certificate, cas []*x509.Certificate) ([][]*x509.Certificate, error) {
+	return VerifyCertChainAt(certs, cas, time.Time{})
+}
+
+// VerifyCertChainAt verifies the certificate chain like VerifyCertChain, but
+// checks the validity of the certificates at the given time. The zero time
+// refers to the current time
+func VerifyCertChainAt(certs []*x509.Certificate, cas []*x509.Certificate, at time.Time,
+) ([][]*x509.Certificate, error) {
 
 	if len(certs) == 0 {
 		return nil, errors.New("no certificate chain provided")
 	}
+	return verifyChains(certs[0], certs[1:], cas, at)
+}
+
+// BuildChain builds the chain from the leaf certificate via the intermediate
+// certificates, which may be provided in any order, up to one of the roots. It
+// returns the verified path, leaf certificate first and root certificate last.
+// The zero time refers to the current time
+func BuildChain(leaf *x509.Certificate, intermediates, roots []*x509.Certificate, at time.Time,
+) ([]*x509.Certificate, error) {
+
+	if leaf == nil {
+		return nil, errors.New("no leaf certificate provided")
+	}
+	chains, err := verifyChains(leaf, intermediates, roots, at)
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+func verifyChains(leaf *x509.Certificate, intermediates, cas []*x509.Certificate, at time.Time,
+) ([][]*x509.Certificate, error) {
+
 	if len(cas) == 0 {
 		return nil, errors.New("no CA provided")
 	}
 
-	leafCert := certs[0]
-
-	intermediates := x509.NewCertPool()
-	for _, cert := range certs[1:] {
-		intermediates.AddCert(cert)
+	intermediatesPool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		intermediatesPool.AddCert(cert)
 	}
 
 	roots := x509.NewCertPool()
@@ -152,14 +226,13 @@ func VerifyCertChain(certs []*x509.Certificate, cas []*x509.Certificate) ([][]*x
 	}
 
 	opts := x509.VerifyOptions{
-		Intermediates: intermediates,
+		Intermediates: intermediatesPool,
 		Roots:         roots,
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime:   at,
 	}
 
-	chains, err := leafCert.Verify(opts)
-
-	return chains, err
+	return leaf.Verify(opts)
 }
 
 func PrintTlsConfig(conf *tls.Config, roots []byte) error {
@@ -188,10 +261,17 @@ func PrintTlsConfig(conf *tls.Config, roots []byte) error {
 
 func parseCertsListPem(data [][]byte) ([]*x509.Certificate, error) {
 	certs := make([]*x509.Certificate, 0)
-	for _, d := range data {
-		cert, err := ParseCert(d)
+	for i, d := range data {
+		block, rest := pem.Decode(d)
+		if block == nil {
+			return nil, fmt.Errorf("certificate %v is not PEM encoded", i)
+		}
+		if next, _ := pem.Decode(rest); next != nil {
+			return nil, fmt.Errorf("certificate %v contains more than one PEM block", i)
+		}
+		cert, err := parseCertBlock(block)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("certificate %v: %w", i, err)
 		}
 		certs = append(certs, cert)
 	}
@@ -206,10 +286,9 @@ func parseCertBlobPem(data []byte) ([]*x509.Certificate, error) {
 	input := data
 
 	for block, rest := pem.Decode(input); block != nil; block, rest = pem.Decode(rest) {
-
-		cert, err := x509.ParseCertificate(block.Bytes)
+		cert, err := parseCertBlock(block)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse x509 Certificate: %v", err)
+			return nil, fmt.Errorf("certificate %v: %w", len(certs), err)
 		}
 		certs = append(certs, cert)
 	}
@@ -218,3 +297,101 @@ func parseCertBlobPem(data []byte) ([]*x509.Certificate, error) {
 	}
 	return certs, nil
 }
+
+func parseCertBlock(block *pem.Block) (*x509.Certificate, error) {
+	if block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("unexpected PEM block type %v", block.Type)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse x509 Certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// OrderChain orders the certificates of a single certificate chain, which may be
+// provided in any order, leaf certificate first, so that each certificate is
+// followed by its issuer. Duplicates are removed. An error is returned if the
+// certificates do not form exactly one chain
+func OrderChain(certs []*x509.Certificate) ([]*x509.Certificate, error) {
+
+	unique := make([]*x509.Certificate, 0, len(certs))
+	for _, c := range certs {
+		if c == nil {
+			return nil, errors.New("certificate chain contains nil certificate")
+		}
+		duplicate := false
+		for _, u := range unique {
+			if c.Equal(u) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, c)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, errors.New("no certificate chain provided")
+	}
+
+	// Find the issuer of each certificate within the chain
+	issuers := make([]int, len(unique))
+	issued := make([]bool, len(unique))
+	for i, c := range unique {
+		issuers[i] = -1
+		for j, parent := range unique {
+			if i == j || !issuedBy(c, parent) {
+				continue
+			}
+			if issuers[i] >= 0 {
+				return nil, fmt.Errorf("certificate %v has multiple issuers in chain",
+					c.Subject.CommonName)
+			}
+			if issued[j] {
+				return nil, fmt.Errorf("certificate %v issued multiple certificates in chain",
+					parent.Subject.CommonName)
+			}
+			issuers[i] = j
+			issued[j] = true
+		}
+	}
+
+	leaf := -1
+	for i := range unique {
+		if issued[i] {
+			continue
+		}
+		if leaf >= 0 {
+			return nil, fmt.Errorf("certificates %v and %v are not part of the same chain",
+				unique[leaf].Subject.CommonName, unique[i].Subject.CommonName)
+		}
+		leaf = i
+	}
+	if leaf < 0 {
+		return nil, errors.New("certificate chain does not contain a leaf certificate")
+	}
+
+	chain := make([]*x509.Certificate, 0, len(unique))
+	for i := leaf; i >= 0 && len(chain) < len(unique); i = issuers[i] {
+		chain = append(chain, unique[i])
+	}
+	if len(chain) != len(unique) {
+		return nil, errors.New("certificates do not form a single chain")
+	}
+
+	return chain, nil
+}
+
+// issuedBy checks whether the certificate was issued by the parent certificate
+// based on the names, the key identifiers if present and the signature
+func issuedBy(c, parent *x509.Certificate) bool {
+	if !bytes.Equal(c.RawIssuer, parent.RawSubject) {
+		return false
+	}
+	if len(c.AuthorityKeyId) > 0 && len(parent.SubjectKeyId) > 0 &&
+		!bytes.Equal(c.AuthorityKeyId, parent.SubjectKeyId) {
+		return false
+	}
+	return parent.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
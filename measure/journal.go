@@ -0,0 +1,223 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Each journal record consists of the length of the payload, the sha256
+// digest of the payload and the JSON encoded payload
+const journalHeader = 4 + sha256.Size
+
+type journalRecord struct {
+	Entry   *MeasureEntry `json:"entry,omitempty"`
+	Removed string        `json:"removed,omitempty"`
+}
+
+// Journal is an append-only file of the accepted runtime measurements, which
+// survives restarts of the cmcd. Each record is checksummed and written with a
+// single synced write, so that a crash can only leave a truncated or corrupted
+// last record, which is discarded on replay. Subjects marked as removed are
+// dropped from the journal by the compaction on startup
+type Journal struct {
+	mu      sync.Mutex
+	file    string
+	entries []MeasureEntry
+}
+
+// OpenJournal replays the journal, creating it if it does not exist, and
+// compacts it if it contains removed subjects or a corrupted tail
+func OpenJournal(file string) (*Journal, error) {
+	j := &Journal{file: file}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read measurement journal: %w", err)
+	}
+
+	records, valid := parseJournal(data)
+	if valid < len(data) {
+		log.Warnf("Measurement journal %v corrupted at offset %v, discarding %v bytes", file,
+			valid, len(data)-valid)
+	}
+
+	compact := valid < len(data)
+	for _, r := range records {
+		if r.Removed != "" {
+			j.entries = removeEntries(j.entries, r.Removed)
+			compact = true
+		} else if !j.contains(r.Entry) {
+			j.entries = append(j.entries, *r.Entry)
+		}
+	}
+	log.Debugf("Replayed %v runtime measurements from journal %v", len(j.entries), file)
+
+	if compact {
+		if err := j.Compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+// Entries returns the runtime measurements of the journal
+func (j *Journal) Entries() []MeasureEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]MeasureEntry(nil), j.entries...)
+}
+
+// Append records the measurement in the journal if it is not already recorded
+func (j *Journal) Append(e MeasureEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.contains(&e) {
+		return nil
+	}
+	e.Restored = false
+	if err := j.write(journalRecord{Entry: &e}); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+// Remove marks the subject as removed, so that its measurements are no longer
+// replayed after the next restart
+func (j *Journal) Remove(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalRecord{Removed: name}); err != nil {
+		return err
+	}
+	j.entries = removeEntries(j.entries, name)
+	return nil
+}
+
+// Compact atomically rewrites the journal with the current measurements only
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var buf []byte
+	for i := range j.entries {
+		record, err := marshalRecord(journalRecord{Entry: &j.entries[i]})
+		if err != nil {
+			return err
+		}
+		buf = append(buf, record...)
+	}
+	if err := internal.WriteFileAtomic(j.file, buf, 0644); err != nil {
+		return fmt.Errorf("failed to compact measurement journal: %w", err)
+	}
+	log.Tracef("Compacted measurement journal %v to %v entries", j.file, len(j.entries))
+	return nil
+}
+
+// write appends the record to the journal. Must be called with the lock held
+func (j *Journal) write(r journalRecord) error {
+	record, err := marshalRecord(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open measurement journal: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(record); err != nil {
+		return fmt.Errorf("failed to write measurement journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync measurement journal: %w", err)
+	}
+	return nil
+}
+
+// contains returns whether the measurement is already recorded. Must be
+// called with the lock held
+func (j *Journal) contains(e *MeasureEntry) bool {
+	for _, entry := range j.entries {
+		if bytes.Equal(entry.TemplateSha256, e.TemplateSha256) {
+			return true
+		}
+	}
+	return false
+}
+
+func marshalRecord(r journalRecord) ([]byte, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal journal record: %w", err)
+	}
+	digest := sha256.Sum256(payload)
+	buf := make([]byte, journalHeader, journalHeader+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], digest[:])
+	return append(buf, payload...), nil
+}
+
+// parseJournal returns the records up to the first truncated or corrupted
+// record and the length of the valid part of the journal
+func parseJournal(data []byte) ([]journalRecord, int) {
+	var records []journalRecord
+	offset := 0
+	for len(data)-offset >= journalHeader {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if length > len(data)-offset-journalHeader {
+			break
+		}
+		payload := data[offset+journalHeader : offset+journalHeader+length]
+		digest := sha256.Sum256(payload)
+		if !bytes.Equal(digest[:], data[offset+4:offset+journalHeader]) {
+			break
+		}
+		var r journalRecord
+		if err := json.Unmarshal(payload, &r); err != nil ||
+			(r.Entry == nil) == (r.Removed == "") {
+			break
+		}
+		records = append(records, r)
+		offset += journalHeader + length
+	}
+	return records, offset
+}
+
+func removeEntries(entries []MeasureEntry, name string) []MeasureEntry {
+	var kept []MeasureEntry
+	for _, e := range entries {
+		if e.Name != name {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
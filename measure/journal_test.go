@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"golang.org/x/exp/slices"
+)
+
+func names(entries []MeasureEntry) []string {
+	var n []string
+	for _, e := range entries {
+		n = append(n, e.Name)
+	}
+	return n
+}
+
+func entry(name string) MeasureEntry {
+	return MeasureEntry{Name: name, TemplateSha256: []byte(name), ConfigSha256: []byte{1},
+		RootfsSha256: []byte{2}}
+}
+
+func TestJournal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+
+	j, err := OpenJournal(file)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+	for _, name := range []string{"a", "b", "a", "c"} {
+		if err := j.Append(entry(name)); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := j.Remove("b"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if got := names(j.Entries()); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("Entries() = %v, want [a c]", got)
+	}
+	before, _ := os.ReadFile(file)
+
+	// Replay compacts the journal, as it contains a removed subject
+	j, err = OpenJournal(file)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+	if got := names(j.Entries()); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("replayed entries = %v, want [a c]", got)
+	}
+	after, _ := os.ReadFile(file)
+	if len(after) >= len(before) {
+		t.Errorf("journal not compacted: %v bytes, before %v bytes", len(after), len(before))
+	}
+	if records, valid := parseJournal(after); len(records) != 2 || valid != len(after) {
+		t.Errorf("compacted journal contains %v records, valid %v of %v bytes", len(records),
+			valid, len(after))
+	}
+}
+
+func TestJournalCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "journal")
+
+	j, err := OpenJournal(file)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+	if err := j.Append(entry("a")); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	first, _ := os.ReadFile(file)
+	if err := j.Append(entry("b")); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	data, _ := os.ReadFile(file)
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-2] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"Complete", data, []string{"a", "b"}},
+		{"Truncated Payload", data[:len(data)-1], []string{"a"}},
+		{"Truncated Header", data[:len(first)+3], []string{"a"}},
+		{"Only Header", data[:len(first)+journalHeader], []string{"a"}},
+		{"Truncated First Record", data[:len(first)-1], nil},
+		{"Corrupted Checksum", corrupted, []string{"a"}},
+		{"Garbage", []byte("garbage"), nil},
+		{"Empty", []byte{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(file, tt.data, 0644); err != nil {
+				t.Fatalf("failed to write journal: %v", err)
+			}
+
+			j, err := OpenJournal(file)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			if got := names(j.Entries()); !slices.Equal(got, tt.want) {
+				t.Fatalf("replayed entries = %v, want %v", got, tt.want)
+			}
+
+			// The corrupted tail is discarded, so that new records can be replayed
+			if err := j.Append(entry("c")); err != nil {
+				t.Fatalf("Append() error = %v", err)
+			}
+			j, err = OpenJournal(file)
+			if err != nil {
+				t.Fatalf("OpenJournal() error = %v", err)
+			}
+			if got := names(j.Entries()); !slices.Equal(got, append(tt.want, "c")) {
+				t.Errorf("entries after append = %v, want %v", got, append(tt.want, "c"))
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	mc := &MeasureConfig{
+		Serializer: ar.JsonSerializer{},
+		LogFile:    filepath.Join(dir, "ctr.json"),
+		Driver:     "sw",
+	}
+	var err error
+	mc.Journal, err = OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+
+	if err := Measure("a", []byte{1}, []byte{2}, mc); err != nil {
+		t.Fatalf("Measure() error = %v", err)
+	}
+	if err := Measure("b", []byte{3}, []byte{4}, mc); err != nil {
+		t.Fatalf("Measure() error = %v", err)
+	}
+	if err := Remove("b", mc); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if restored, err := Restore(mc); err != nil || restored {
+		t.Fatalf("Restore() with existing list = %v, %v", restored, err)
+	}
+
+	// Simulate a restart, after which the measurement list does not exist
+	if err := os.Remove(mc.LogFile); err != nil {
+		t.Fatalf("failed to remove measurement list: %v", err)
+	}
+	mc.Journal, err = OpenJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %v", err)
+	}
+	restored, err := Restore(mc)
+	if err != nil || !restored {
+		t.Fatalf("Restore() = %v, %v", restored, err)
+	}
+
+	data, err := internal.LoadFile(mc.LogFile)
+	if err != nil {
+		t.Fatalf("failed to read measurement list: %v", err)
+	}
+	var measureList []MeasureEntry
+	if err := mc.Serializer.Unmarshal(data, &measureList); err != nil {
+		t.Fatalf("failed to unmarshal measurement list: %v", err)
+	}
+	if len(measureList) != 1 || measureList[0].Name != "a" || !measureList[0].Restored {
+		t.Fatalf("restored measurement list = %v, want restored a", measureList)
+	}
+
+	// Freshly collected measurements are not flagged as restored
+	if err := Measure("c", []byte{5}, []byte{6}, mc); err != nil {
+		t.Fatalf("Measure() error = %v", err)
+	}
+	data, _ = internal.LoadFile(mc.LogFile)
+	measureList = nil
+	if err := mc.Serializer.Unmarshal(data, &measureList); err != nil {
+		t.Fatalf("failed to unmarshal measurement list: %v", err)
+	}
+	if len(measureList) != 2 || measureList[1].Restored {
+		t.Errorf("measurement list = %v, want fresh measurement c", measureList)
+	}
+}
+
+func TestRemoveWithoutJournal(t *testing.T) {
+	if err := Remove("a", &MeasureConfig{}); err == nil {
+		t.Errorf("Remove() without journal succeeded")
+	}
+}
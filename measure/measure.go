@@ -25,6 +25,7 @@ import (
 	"strings"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/google/go-tpm/legacy/tpm2"
 	"github.com/google/go-tpm/tpmutil"
 
@@ -39,6 +40,8 @@ type MeasureEntry struct {
 	Name           string     `json:"name,omitempty" cbor:"2,keyasint,omitempty"`
 	ConfigSha256   ar.HexByte `json:"configSha256,omitempty" cbor:"3,keyasint,omitempty"`
 	RootfsSha256   ar.HexByte `json:"rootfsSha256,omitempty" cbor:"4,keyasint,omitempty"`
+	// Restored indicates that the measurement was replayed from the journal
+	Restored bool `json:"restored,omitempty" cbor:"5,keyasint,omitempty"`
 }
 
 type MeasureConfig struct {
@@ -46,6 +49,7 @@ type MeasureConfig struct {
 	Pcr        int
 	LogFile    string
 	Driver     string
+	Journal    *Journal // Optional journal of the runtime measurements
 }
 
 func Measure(name string, configSha256, rootfsSha256 []byte, mc *MeasureConfig) error {
@@ -79,7 +83,7 @@ func Measure(name string, configSha256, rootfsSha256 []byte, mc *MeasureConfig)
 	// Read the existing measurement list if it already exists
 	var measureList []MeasureEntry
 	if _, err := os.Stat(mc.LogFile); err == nil {
-		data, err := os.ReadFile(mc.LogFile)
+		data, err := internal.LoadFile(mc.LogFile)
 		if err != nil {
 			return fmt.Errorf("failed to read measurement list: %w", err)
 		}
@@ -102,7 +106,7 @@ func Measure(name string, configSha256, rootfsSha256 []byte, mc *MeasureConfig)
 	// ..if the container was already measured, exit
 	if found {
 		log.Tracef("Measurement %v already exists, nothing to do", name)
-		return nil
+		return journal(entry, mc)
 	}
 
 	// ..otherwise append it to the measurement list and record the measurement
@@ -114,7 +118,7 @@ func Measure(name string, configSha256, rootfsSha256 []byte, mc *MeasureConfig)
 		return fmt.Errorf("failed to marshal measurement list: %w", err)
 	}
 
-	err = os.WriteFile(mc.LogFile, data, 0644)
+	err = internal.StoreFile(mc.LogFile, data, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write measurement list: %w", err)
 	}
@@ -144,6 +148,66 @@ func Measure(name string, configSha256, rootfsSha256 []byte, mc *MeasureConfig)
 		return fmt.Errorf("unknown driver '%v'", mc.Driver)
 	}
 
+	return journal(entry, mc)
+}
+
+// Remove marks the subject as removed in the journal, so that its measurements
+// are not restored after a restart. The measurement list is not modified, as
+// the measurements were already recorded
+func Remove(name string, mc *MeasureConfig) error {
+	if mc == nil {
+		return errors.New("internal error: measure config is nil")
+	}
+	if mc.Journal == nil {
+		return errors.New("no measurement journal configured")
+	}
+	if err := mc.Journal.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove measurement %v: %w", name, err)
+	}
+	log.Tracef("Marked measurement %v as removed", name)
+	return nil
+}
+
+// Restore writes the measurements of the journal to the measurement list if the
+// list does not exist, e.g., after a restart with the list on a tmpfs. The
+// restored measurements are flagged, so that verifiers can distinguish them
+// from freshly collected measurements. Returns whether the list was restored
+func Restore(mc *MeasureConfig) (bool, error) {
+	if mc == nil || mc.Journal == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(mc.LogFile); err == nil {
+		return false, nil
+	}
+
+	measureList := mc.Journal.Entries()
+	if len(measureList) == 0 {
+		return false, nil
+	}
+	for i := range measureList {
+		measureList[i].Restored = true
+	}
+
+	data, err := mc.Serializer.Marshal(measureList)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal measurement list: %w", err)
+	}
+	err = internal.StoreFile(mc.LogFile, data, 0644)
+	if err != nil {
+		return false, fmt.Errorf("failed to write measurement list: %w", err)
+	}
+	log.Debugf("Restored %v measurements from journal", len(measureList))
+
+	return true, nil
+}
+
+func journal(entry MeasureEntry, mc *MeasureConfig) error {
+	if mc.Journal == nil {
+		return nil
+	}
+	if err := mc.Journal.Append(entry); err != nil {
+		return fmt.Errorf("failed to journal measurement: %w", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// MaxRuntimeEvents is the maximum number of runtime measurements, so that
+// clients cannot grow the list and thus the reports without bounds
+const MaxRuntimeEvents = 4096
+
+// RuntimeMeasurementType is the type of the measurement containing the
+// runtime measurements in the attestation report
+const RuntimeMeasurementType = "Runtime Measurement"
+
+// RuntimeLog is the in-memory list of the measurements recorded at runtime via
+// the measure API, e.g. by container engines or init systems, similar to the
+// kernel extending IMA. The list is included as an additional measurement in
+// the attestation reports. RuntimeLog implements ar.Driver, but cannot sign
+type RuntimeLog struct {
+	mu     sync.Mutex
+	events []ar.RuntimeEvent
+}
+
+// NewRuntimeLog returns an empty runtime measurement list
+func NewRuntimeLog() *RuntimeLog {
+	return &RuntimeLog{}
+}
+
+// Record appends the measurement to the list and returns the length of the
+// list, so that callers can detect the ordering of concurrent measurements
+func (l *RuntimeLog) Record(name string, hash crypto.Hash, digest, eventData []byte) (int, error) {
+
+	if name == "" {
+		return 0, errors.New("missing measurement name")
+	}
+	switch hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return 0, fmt.Errorf("hash algorithm %v not supported for runtime measurements", hash)
+	}
+	if len(digest) != hash.Size() {
+		return 0, fmt.Errorf("digest length %v does not match %v digest length %v", len(digest),
+			hash, hash.Size())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.events) >= MaxRuntimeEvents {
+		return 0, fmt.Errorf("runtime measurement list full (%v measurements)", MaxRuntimeEvents)
+	}
+	l.events = append(l.events, ar.RuntimeEvent{
+		Index:     len(l.events),
+		Name:      name,
+		HashAlg:   hash.String(),
+		Digest:    append([]byte(nil), digest...),
+		EventData: append([]byte(nil), eventData...),
+	})
+
+	log.Debugf("Recorded runtime measurement %v: %v (%v)", len(l.events)-1, name, hash)
+
+	return len(l.events), nil
+}
+
+// Len returns the number of recorded measurements
+func (l *RuntimeLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.events)
+}
+
+// Events returns a snapshot of the recorded measurements
+func (l *RuntimeLog) Events() []ar.RuntimeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ar.RuntimeEvent(nil), l.events...)
+}
+
+// Init implements ar.Driver
+func (l *RuntimeLog) Init(c *ar.DriverConfig) error {
+	return nil
+}
+
+// Measure implements ar.Driver and returns the runtime measurements bound to
+// the nonce
+func (l *RuntimeLog) Measure(nonce []byte) (ar.Measurement, error) {
+	return ar.Measurement{
+		Type:          RuntimeMeasurementType,
+		Evidence:      nonce,
+		RuntimeEvents: l.Events(),
+	}, nil
+}
+
+// MeasureAll implements ar.MultiMeasurer. As long as no measurements were
+// recorded, the reports do not contain a runtime measurement
+func (l *RuntimeLog) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+	m, err := l.Measure(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.RuntimeEvents) == 0 {
+		return nil, nil
+	}
+	return []ar.Measurement{m}, nil
+}
+
+// Lock implements ar.Driver
+func (l *RuntimeLog) Lock() error {
+	return nil
+}
+
+// Unlock implements ar.Driver
+func (l *RuntimeLog) Unlock() error {
+	return nil
+}
+
+// GetSigningKeys implements ar.Driver, the runtime measurement list cannot sign
+func (l *RuntimeLog) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return nil, nil, errors.New("runtime measurement list does not provide signing keys")
+}
+
+// GetCertChain implements ar.Driver, the runtime measurement list cannot sign
+func (l *RuntimeLog) GetCertChain() ([]*x509.Certificate, error) {
+	return nil, errors.New("runtime measurement list does not provide certificates")
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package measure
+
+import (
+	"bytes"
+	"crypto"
+	"sync"
+	"testing"
+)
+
+func TestRuntimeLogRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		mname   string
+		hash    crypto.Hash
+		digest  []byte
+		wantErr bool
+	}{
+		{"SHA-256", "app", crypto.SHA256, make([]byte, 32), false},
+		{"SHA-384", "app", crypto.SHA384, make([]byte, 48), false},
+		{"SHA-512", "app", crypto.SHA512, make([]byte, 64), false},
+		{"Digest Length Mismatch", "app", crypto.SHA256, make([]byte, 48), true},
+		{"Unsupported Hash", "app", crypto.SHA1, make([]byte, 20), true},
+		{"Missing Name", "", crypto.SHA256, make([]byte, 32), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRuntimeLog()
+			n, err := l.Record(tt.mname, tt.hash, tt.digest, []byte("data"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Record() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if l.Len() != 0 {
+					t.Errorf("rejected measurement was recorded")
+				}
+				return
+			}
+			if n != 1 {
+				t.Errorf("Record() = %v, want 1", n)
+			}
+			e := l.Events()[0]
+			if e.HashAlg != tt.hash.String() || !bytes.Equal(e.Digest, tt.digest) ||
+				string(e.EventData) != "data" {
+				t.Errorf("recorded event = %v", e)
+			}
+		})
+	}
+}
+
+func TestRuntimeLogConcurrent(t *testing.T) {
+	l := NewRuntimeLog()
+	nonce := []byte{0x1, 0x2}
+
+	var wg sync.WaitGroup
+	lengths := make([]int, 64)
+	for i := range lengths {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			n, err := l.Record("app", crypto.SHA256, make([]byte, 32), nil)
+			if err != nil {
+				t.Errorf("Record() error = %v", err)
+			}
+			lengths[i] = n
+		}(i)
+		go func() {
+			defer wg.Done()
+			m, err := l.Measure(nonce)
+			if err != nil {
+				t.Errorf("Measure() error = %v", err)
+			}
+			for j, e := range m.RuntimeEvents {
+				if e.Index != j {
+					t.Errorf("event %v has index %v", j, e.Index)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every caller observes a distinct position in the list
+	seen := make(map[int]bool)
+	for _, n := range lengths {
+		if n < 1 || n > len(lengths) || seen[n] {
+			t.Fatalf("Record() returned invalid or duplicate length %v", n)
+		}
+		seen[n] = true
+	}
+
+	ms, err := l.MeasureAll(nonce)
+	if err != nil || len(ms) != 1 {
+		t.Fatalf("MeasureAll() = %v, %v", ms, err)
+	}
+	if len(ms[0].RuntimeEvents) != len(lengths) || !bytes.Equal(ms[0].Evidence, nonce) {
+		t.Errorf("runtime measurement contains %v events", len(ms[0].RuntimeEvents))
+	}
+}
+
+func TestRuntimeLogEmpty(t *testing.T) {
+	ms, err := NewRuntimeLog().MeasureAll([]byte{0x1})
+	if err != nil || len(ms) != 0 {
+		t.Errorf("MeasureAll() of empty list = %v, %v, want no measurements", ms, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// CacheMetrics contains the instrumentation of the in-memory caches
+type CacheMetrics struct {
+	Hits      *CounterVec
+	Misses    *CounterVec
+	Evictions *CounterVec
+}
+
+// cacheMetrics is nil if metrics are disabled
+var cacheMetrics *CacheMetrics
+
+// EnableCacheMetrics registers the cache metrics in the registry. Without
+// calling this function, the instrumentation of the caches is a no-op
+func EnableCacheMetrics(r *Registry) *CacheMetrics {
+	if cacheMetrics != nil {
+		return cacheMetrics
+	}
+	cacheMetrics = &CacheMetrics{
+		Hits: r.NewCounterVec("cmc_cache_hits_total",
+			"Number of lookups served from the cache", "cache"),
+		Misses: r.NewCounterVec("cmc_cache_misses_total",
+			"Number of lookups not served from the cache", "cache"),
+		Evictions: r.NewCounterVec("cmc_cache_evictions_total",
+			"Number of entries evicted from the cache because they expired or exceeded the limits",
+			"cache"),
+	}
+	return cacheMetrics
+}
+
+// CacheHit counts a lookup served from the cache
+func CacheHit(cache string) {
+	if cacheMetrics != nil {
+		cacheMetrics.Hits.Inc(cache)
+	}
+}
+
+// CacheMiss counts a lookup not served from the cache
+func CacheMiss(cache string) {
+	if cacheMetrics != nil {
+		cacheMetrics.Misses.Inc(cache)
+	}
+}
+
+// CacheEvicted counts an entry evicted from the cache
+func CacheEvicted(cache string) {
+	if cacheMetrics != nil {
+		cacheMetrics.Evictions.Inc(cache)
+	}
+}
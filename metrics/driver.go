@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"time"
+)
+
+// Driver operations which are instrumented
+const (
+	OpQuote   = "quote"
+	OpSign    = "sign"
+	OpKeyLoad = "key_load"
+)
+
+// DriverMetrics contains the instrumentation of the drivers
+type DriverMetrics struct {
+	durations map[string]*HistogramVec
+	Errors    *CounterVec
+}
+
+// driverMetrics is nil if metrics are disabled
+var driverMetrics *DriverMetrics
+
+// EnableDriverMetrics registers the driver metrics in the registry. It must be
+// called before the drivers are initialized. Without calling this function,
+// the instrumentation of the drivers is a no-op
+func EnableDriverMetrics(r *Registry) *DriverMetrics {
+	if driverMetrics != nil {
+		return driverMetrics
+	}
+	driverMetrics = &DriverMetrics{
+		durations: map[string]*HistogramVec{
+			OpQuote: r.NewHistogramVec("cmc_driver_quote_duration_seconds",
+				"Duration of driver quote operations", nil, "driver"),
+			OpSign: r.NewHistogramVec("cmc_driver_sign_duration_seconds",
+				"Duration of driver signing operations", nil, "driver"),
+			OpKeyLoad: r.NewHistogramVec("cmc_driver_key_load_duration_seconds",
+				"Duration of driver key load operations", nil, "driver"),
+		},
+		Errors: r.NewCounterVec("cmc_driver_errors_total",
+			"Number of failed driver operations", "driver", "operation"),
+	}
+	return driverMetrics
+}
+
+// Duration returns the histogram of the specified operation
+func (m *DriverMetrics) Duration(op string) *HistogramVec {
+	return m.durations[op]
+}
+
+// Timer measures a single driver operation. The zero value, which is returned
+// if metrics are disabled, does nothing
+type Timer struct {
+	m      *DriverMetrics
+	driver string
+	op     string
+	start  time.Time
+}
+
+// Start starts measuring the operation op of the specified driver
+func Start(driver, op string) Timer {
+	if driverMetrics == nil {
+		return Timer{}
+	}
+	return Timer{m: driverMetrics, driver: driver, op: op, start: time.Now()}
+}
+
+// Done records the duration of the operation and counts the error if the
+// operation failed
+func (t Timer) Done(err error) {
+	if t.m == nil {
+		return
+	}
+	t.m.durations[t.op].Observe(time.Since(t.start).Seconds(), t.driver)
+	if err != nil {
+		t.m.Errors.Inc(t.driver, t.op)
+	}
+}
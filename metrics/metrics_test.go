@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+
+	r := NewRegistry()
+	c := r.NewCounterVec("test_errors_total", "Test errors", "driver", "operation")
+	h := r.NewHistogramVec("test_duration_seconds", "Test duration", []float64{1, 0.1}, "driver")
+
+	c.Inc("tpm", "quote")
+	c.Add(2, "sw", "sign")
+	h.Observe(0.05, "tpm")
+	h.Observe(0.5, "tpm")
+	h.Observe(5, "tpm")
+
+	want := `# HELP test_errors_total Test errors
+# TYPE test_errors_total counter
+test_errors_total{driver="sw",operation="sign"} 2
+test_errors_total{driver="tpm",operation="quote"} 1
+# HELP test_duration_seconds Test duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{driver="tpm",le="0.1"} 1
+test_duration_seconds_bucket{driver="tpm",le="1"} 2
+test_duration_seconds_bucket{driver="tpm",le="+Inf"} 3
+test_duration_seconds_sum{driver="tpm"} 5.55
+test_duration_seconds_count{driver="tpm"} 3
+`
+	buf := new(bytes.Buffer)
+	if err := r.WriteText(buf); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("WriteText() = \n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestTimer(t *testing.T) {
+
+	// The zero timer must not panic
+	Timer{}.Done(errors.New("error"))
+
+	m := EnableDriverMetrics(NewRegistry())
+	Start("test", OpQuote).Done(nil)
+	Start("test", OpQuote).Done(errors.New("error"))
+
+	if got := m.Duration(OpQuote).Count("test"); got != 2 {
+		t.Errorf("quote count = %v, want 2", got)
+	}
+	if got := m.Errors.Value("test", OpQuote); got != 1 {
+		t.Errorf("quote errors = %v, want 1", got)
+	}
+}
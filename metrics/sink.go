@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// SinkMetrics contains the instrumentation of the result sinks
+type SinkMetrics struct {
+	Delivered *CounterVec
+	Failures  *CounterVec
+	Dropped   *CounterVec
+}
+
+// sinkMetrics is nil if metrics are disabled
+var sinkMetrics *SinkMetrics
+
+// EnableSinkMetrics registers the result sink metrics in the registry. Without
+// calling this function, the instrumentation of the sinks is a no-op
+func EnableSinkMetrics(r *Registry) *SinkMetrics {
+	if sinkMetrics != nil {
+		return sinkMetrics
+	}
+	sinkMetrics = &SinkMetrics{
+		Delivered: r.NewCounterVec("cmc_sink_delivered_total",
+			"Number of verification results delivered to the sink", "sink"),
+		Failures: r.NewCounterVec("cmc_sink_failures_total",
+			"Number of failed delivery attempts to the sink", "sink"),
+		Dropped: r.NewCounterVec("cmc_sink_dropped_total",
+			"Number of verification results dropped by the sink", "sink"),
+	}
+	return sinkMetrics
+}
+
+// SinkDelivered counts a verification result delivered to the sink
+func SinkDelivered(sink string) {
+	if sinkMetrics != nil {
+		sinkMetrics.Delivered.Inc(sink)
+	}
+}
+
+// SinkFailed counts a failed delivery attempt to the sink
+func SinkFailed(sink string) {
+	if sinkMetrics != nil {
+		sinkMetrics.Failures.Inc(sink)
+	}
+}
+
+// SinkDropped counts a verification result, which the sink dropped because
+// its queue was full or all delivery attempts failed
+func SinkDropped(sink string) {
+	if sinkMetrics != nil {
+		sinkMetrics.Dropped.Inc(sink)
+	}
+}
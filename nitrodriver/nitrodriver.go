@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nitrodriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "nitrodriver")
+
+// Nitro is a driver for AWS Nitro Enclaves. It retrieves attestation documents
+// from the Nitro Security Module (NSM). As enclaves do not have persistent
+// storage, a new signing key is created and enrolled on every start
+type Nitro struct {
+	mu               sync.Mutex
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+}
+
+// Init initializes the Nitro driver with the specified configuration
+func (n *Nitro) Init(c *ar.DriverConfig) error {
+
+	if n == nil {
+		return errors.New("internal error: Nitro object is nil")
+	}
+
+	// Check that the NSM is available to fail early outside of enclaves
+	if err := checkNsm(); err != nil {
+		return fmt.Errorf("failed to open NSM: %w", err)
+	}
+
+	// Create new private key for signing
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	n.priv = priv
+
+	// Create IK CSR and fetch new certificate including its chain from EST server
+	n.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+		c.ServerAddr, c.BootstrapToken)
+	if err != nil {
+		return fmt.Errorf("failed to get signing cert chain: %w", err)
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (n *Nitro) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting Nitro measurements")
+
+	if n == nil {
+		return ar.Measurement{}, errors.New("internal error: Nitro object is nil")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Include the public signing key to bind it to the enclave
+	pub, err := x509.MarshalPKIXPublicKey(&n.priv.(*ecdsa.PrivateKey).PublicKey)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	doc, err := getAttestationDocument(nonce, pub)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get Nitro attestation document: %w", err)
+	}
+
+	measurement := ar.Measurement{
+		Type:     "Nitro Measurement",
+		Evidence: doc,
+	}
+
+	return measurement, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (n *Nitro) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (n *Nitro) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic crypto interface
+func (n *Nitro) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if n == nil {
+		return nil, nil, errors.New("internal error: Nitro object is nil")
+	}
+	return n.priv, &n.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (n *Nitro) GetCertChain() ([]*x509.Certificate, error) {
+	if n == nil {
+		return nil, errors.New("internal error: Nitro object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(n.signingCertChain))
+	return n.signingCertChain, nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
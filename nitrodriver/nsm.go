@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nitrodriver
+
+import (
+	"errors"
+	"fmt"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	nsmDevice = "/dev/nsm"
+
+	// Maximum sizes of NSM requests and responses as defined by the NSM driver
+	nsmRequestMaxSize  = 0x1000
+	nsmResponseMaxSize = 0x3000
+
+	// Maximum size of the user data field of the attestation document
+	nsmUserDataMaxSize = 512
+)
+
+// nsmAttestationRequest is the attestation request of the NSM API. Unset
+// fields are encoded as CBOR null
+type nsmAttestationRequest struct {
+	UserData  []byte `cbor:"user_data"`
+	Nonce     []byte `cbor:"nonce"`
+	PublicKey []byte `cbor:"public_key"`
+}
+
+type nsmAttestationResponse struct {
+	Document []byte `cbor:"document"`
+}
+
+type nsmResponse struct {
+	Attestation *nsmAttestationResponse `cbor:"Attestation"`
+	Error       string                  `cbor:"Error"`
+}
+
+// getAttestationDocument requests an attestation document from the NSM with
+// the nonce as user data and returns the COSE_Sign1 encoded document
+func getAttestationDocument(nonce, pub []byte) ([]byte, error) {
+
+	req, err := encodeAttestationRequest(nonce, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := nsmSend(req)
+	if err != nil {
+		return nil, fmt.Errorf("NSM request failed: %w", err)
+	}
+
+	return decodeAttestationResponse(resp)
+}
+
+func encodeAttestationRequest(nonce, pub []byte) ([]byte, error) {
+	if len(nonce) > nsmUserDataMaxSize {
+		return nil, fmt.Errorf("nonce size %v exceeds maximum user data size %v",
+			len(nonce), nsmUserDataMaxSize)
+	}
+
+	s := ar.CborSerializer{}
+	req, err := s.Marshal(map[string]nsmAttestationRequest{
+		"Attestation": {UserData: nonce, PublicKey: pub},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal NSM request: %w", err)
+	}
+	if len(req) > nsmRequestMaxSize {
+		return nil, fmt.Errorf("NSM request size %v exceeds maximum size %v", len(req),
+			nsmRequestMaxSize)
+	}
+
+	return req, nil
+}
+
+func decodeAttestationResponse(data []byte) ([]byte, error) {
+	var resp nsmResponse
+	s := ar.CborSerializer{}
+	if err := s.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal NSM response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("NSM returned error: %v", resp.Error)
+	}
+	if resp.Attestation == nil || len(resp.Attestation.Document) == 0 {
+		return nil, errors.New("NSM response does not contain attestation document")
+	}
+	return resp.Attestation.Document, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package nitrodriver
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// nsmMessage is the message passed to the NSM driver ioctl, see
+// include/uapi/linux/nsm.h
+type nsmMessage struct {
+	Request  unix.Iovec
+	Response unix.Iovec
+}
+
+// NSM_IOCTL_REQUEST: _IOWR(0x0A, 0, struct nsm_message)
+var nsmIoctlRequest = uintptr(3<<30 | unsafe.Sizeof(nsmMessage{})<<16 | 0x0A<<8)
+
+func checkNsm() error {
+	f, err := os.OpenFile(nsmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func nsmSend(req []byte) ([]byte, error) {
+
+	f, err := os.OpenFile(nsmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", nsmDevice, err)
+	}
+	defer f.Close()
+
+	resp := make([]byte, nsmResponseMaxSize)
+	msg := nsmMessage{}
+	msg.Request.Base = &req[0]
+	msg.Request.SetLen(len(req))
+	msg.Response.Base = &resp[0]
+	msg.Response.SetLen(len(resp))
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), nsmIoctlRequest,
+		uintptr(unsafe.Pointer(&msg)))
+	if errno != 0 {
+		return nil, fmt.Errorf("NSM ioctl failed: %w", errno)
+	}
+
+	// The driver updates the response length to the actual size
+	n := int(msg.Response.Len)
+	if n > len(resp) {
+		return nil, fmt.Errorf("invalid NSM response length %v", n)
+	}
+
+	return resp[:n], nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nitrodriver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func Test_encodeAttestationRequest(t *testing.T) {
+
+	nonce := []byte{0x01, 0x02, 0x03}
+	pub := []byte{0x04, 0x05}
+
+	req, err := encodeAttestationRequest(nonce, pub)
+	if err != nil {
+		t.Fatalf("encodeAttestationRequest() error = %v", err)
+	}
+
+	// Unset nonce must be encoded as CBOR null
+	var decoded map[string]map[string]interface{}
+	if err := (ar.CborSerializer{}).Unmarshal(req, &decoded); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	att, ok := decoded["Attestation"]
+	if !ok {
+		t.Fatalf("request does not contain attestation request: %v", hex.EncodeToString(req))
+	}
+	if v, ok := att["nonce"]; !ok || v != nil {
+		t.Errorf("nonce = %v, want null", v)
+	}
+	if v, _ := att["user_data"].([]byte); !bytes.Equal(v, nonce) {
+		t.Errorf("user_data = %v, want %v", v, nonce)
+	}
+	if v, _ := att["public_key"].([]byte); !bytes.Equal(v, pub) {
+		t.Errorf("public_key = %v, want %v", v, pub)
+	}
+
+	if _, err := encodeAttestationRequest(make([]byte, nsmUserDataMaxSize+1), nil); err == nil {
+		t.Errorf("encodeAttestationRequest() with oversized nonce succeeded")
+	}
+}
+
+func Test_decodeAttestationResponse(t *testing.T) {
+
+	s := ar.CborSerializer{}
+	encode := func(v any) []byte {
+		data, err := s.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to encode response: %v", err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		resp    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			resp: encode(map[string]any{
+				"Attestation": map[string]any{"document": []byte{0x84, 0x01}},
+			}),
+			want: []byte{0x84, 0x01},
+		},
+		{
+			name:    "Error",
+			resp:    encode(map[string]any{"Error": "InvalidArgument"}),
+			wantErr: true,
+		},
+		{
+			name:    "Missing Document",
+			resp:    encode(map[string]any{"Attestation": map[string]any{}}),
+			wantErr: true,
+		},
+		{
+			name:    "Invalid CBOR",
+			resp:    []byte{0xff},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAttestationResponse(tt.resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeAttestationResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decodeAttestationResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11driver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+var (
+	log = internal.NewLogger(internal.SubsystemDrivers, "pkcs11driver")
+)
+
+const (
+	certChainFile = "pkcs11chain.pem"
+)
+
+// Pkcs11 is a signer driver for device identity keys stored on an HSM or
+// secure element accessible via PKCS#11. The driver does not provide any
+// measurements. The key is enrolled at the provisioning server
+type Pkcs11 struct {
+	mu          sync.RWMutex
+	token       *token
+	certChain   []*x509.Certificate
+	serializer  ar.Serializer
+	metadata    [][]byte
+	serverAddr  string
+	tokenSource string
+	storage     string
+}
+
+// Init opens the PKCS#11 token and loads or enrolls the certificate chain
+// for the configured key
+func (p *Pkcs11) Init(c *ar.DriverConfig) error {
+
+	if p == nil {
+		return errors.New("internal error: PKCS11 object is nil")
+	}
+
+	switch c.Serializer.(type) {
+	case ar.JsonSerializer:
+	case ar.CborSerializer:
+	default:
+		return fmt.Errorf("serializer not initialized in driver config")
+	}
+
+	conf, err := getTokenConfig(c)
+	if err != nil {
+		return err
+	}
+
+	p.token, err = openToken(*conf)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 token: %w", err)
+	}
+
+	p.serializer = c.Serializer
+	p.metadata = c.Metadata
+	p.serverAddr = c.ServerAddr
+	p.tokenSource = c.BootstrapToken
+	p.storage = c.StoragePath
+
+	// Use the stored certificate chain if it matches the key on the token
+	if p.storage != "" {
+		p.certChain, err = loadCertChain(path.Join(p.storage, certChainFile))
+		if err != nil {
+			log.Debugf("No stored PKCS#11 certificate chain: %v", err)
+		} else if !publicKeysEqual(p.certChain[0].PublicKey, p.token.Public()) {
+			log.Warn("Stored PKCS#11 certificate does not match the key on the token")
+			p.certChain = nil
+		}
+	}
+
+	if p.certChain == nil {
+		p.certChain, err = getSigningCertChain(p.token, p.serializer, p.metadata, p.serverAddr,
+			p.tokenSource)
+		if err != nil {
+			p.token.close()
+			return fmt.Errorf("failed to get signing cert chain: %w", err)
+		}
+		if err := p.saveCertChain(p.certChain); err != nil {
+			p.token.close()
+			return err
+		}
+	}
+
+	log.Infof("Initialized PKCS#11 driver with key %q, certificate %v", conf.keyLabel,
+		p.certChain[0].Subject.CommonName)
+
+	return nil
+}
+
+// Measure implements the attestation report Measurer interface. The PKCS#11
+// driver is a pure signer and does not provide measurements
+func (p *Pkcs11) Measure(nonce []byte) (ar.Measurement, error) {
+	return ar.Measurement{}, errors.New("PKCS#11 driver does not provide measurements")
+}
+
+// MeasureAll implements the attestation report MultiMeasurer interface and
+// returns no measurements, so that the driver can be used as signer together
+// with other measuring drivers
+func (p *Pkcs11) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+	return nil, nil
+}
+
+// Roles implements the attestation report RoleProvider interface, the driver
+// can only be used as signer
+func (p *Pkcs11) Roles() ar.DriverRoles {
+	return ar.DriverRoles{Signer: true}
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (p *Pkcs11) Lock() error {
+	// Concurrent sessions are handled internally
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (p *Pkcs11) Unlock() error {
+	return nil
+}
+
+// GetSigningKeys returns a crypto.Signer for the key on the token and the
+// public key
+func (p *Pkcs11) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if p == nil || p.token == nil {
+		return nil, nil, errors.New("internal error: PKCS11 object is nil")
+	}
+	return p.token, p.token.Public(), nil
+}
+
+func (p *Pkcs11) GetCertChain() ([]*x509.Certificate, error) {
+	if p == nil {
+		return nil, errors.New("internal error: PKCS11 object is nil")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	log.Tracef("Returning %v certificates", len(p.certChain))
+	return p.certChain, nil
+}
+
+// Expiry implements the attestation report Renewer interface and returns the
+// expiry of the signing certificate
+func (p *Pkcs11) Expiry() (time.Time, error) {
+	if p == nil {
+		return time.Time{}, errors.New("internal error: PKCS11 object is nil")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.certChain) == 0 {
+		return time.Time{}, errors.New("no certificates present")
+	}
+	return p.certChain[0].NotAfter, nil
+}
+
+// Renew implements the attestation report Renewer interface. It re-enrolls the
+// key on the token, authenticated with the current certificate. Keys on the token
+// are managed externally, therefore key rotation is not supported
+func (p *Pkcs11) Renew(rotateKeys bool) error {
+	if p == nil {
+		return errors.New("internal error: PKCS11 object is nil")
+	}
+	if rotateKeys {
+		log.Warn("Key rotation not supported for PKCS#11 keys, re-enrolling existing key")
+	}
+
+	p.mu.RLock()
+	currentChain := p.certChain
+	p.mu.RUnlock()
+
+	desired, err := ar.CreateCsr(p.token, p.serializer, p.metadata)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	certChain, err := est.Reenroll(p.serverAddr, currentChain, p.token, p.token, desired)
+	if errors.Is(err, est.ErrNewKeyRequired) {
+		return fmt.Errorf("failed to re-enroll signing cert chain, the key on the token "+
+			"must be replaced externally: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to re-enroll signing cert chain: %w", err)
+	}
+	if err := p.saveCertChain(certChain); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.certChain = certChain
+	p.mu.Unlock()
+
+	log.Infof("Renewed PKCS#11 certificate, new expiry: %v", certChain[0].NotAfter)
+
+	return nil
+}
+
+// saveCertChain stores the certificate chain. The previous chain is replaced
+// atomically, so that an interrupted renewal does not corrupt the stored chain
+func (p *Pkcs11) saveCertChain(certChain []*x509.Certificate) error {
+	if p.storage == "" {
+		return nil
+	}
+	if err := os.MkdirAll(p.storage, 0755); err != nil {
+		return fmt.Errorf("failed to create storage path: %w", err)
+	}
+	data := internal.WriteCertChainPem(certChain)
+	if err := internal.StoreFile(path.Join(p.storage, certChainFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to store PKCS#11 certificate chain: %w", err)
+	}
+	return nil
+}
+
+func loadCertChain(file string) ([]*x509.Certificate, error) {
+	data, err := internal.LoadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate chain: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	return certs, nil
+}
+
+func getTokenConfig(c *ar.DriverConfig) (*tokenConfig, error) {
+	return newTokenConfig(SignerConfig{
+		Module:   c.Pkcs11Module,
+		Token:    c.Pkcs11Token,
+		Slot:     c.Pkcs11Slot,
+		KeyLabel: c.Pkcs11KeyLabel,
+		KeyId:    c.Pkcs11KeyId,
+		Pin:      c.Pkcs11Pin,
+	})
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
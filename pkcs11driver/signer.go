@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11driver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/miekg/pkcs11"
+)
+
+// SignerConfig selects a private key on a PKCS#11 token. The slot is only
+// required if the token label is not unique, the key ID is hex encoded and the
+// PIN is read from the source env:<VARIABLE>, file:<PATH> or prompt
+type SignerConfig struct {
+	Module   string
+	Token    string
+	Slot     string
+	KeyLabel string
+	KeyId    string
+	Pin      string
+}
+
+// Signer is a crypto.Signer for a private key on a PKCS#11 token, which can be
+// used outside of the driver, e.g., for the issuing CA key of the provisioning
+// server. The signer can be used concurrently
+type Signer struct {
+	token *token
+}
+
+// OpenSigner opens the PKCS#11 token and looks up the configured key
+func OpenSigner(c SignerConfig) (*Signer, error) {
+	conf, err := newTokenConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openToken(*conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PKCS#11 token: %w", err)
+	}
+	return &Signer{token: t}, nil
+}
+
+// Public implements the crypto.Signer interface
+func (s *Signer) Public() crypto.PublicKey {
+	return s.token.Public()
+}
+
+// Sign implements the crypto.Signer interface
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.token.Sign(rand, digest, opts)
+}
+
+// Certificate returns the certificate object stored on the token with the
+// label and ID of the key
+func (s *Signer) Certificate() (*x509.Certificate, error) {
+	return s.token.certificate()
+}
+
+// Close closes the sessions and unloads the PKCS#11 module
+func (s *Signer) Close() {
+	s.token.close()
+}
+
+// certificate reads the certificate object matching the key label and ID
+func (t *token) certificate() (*x509.Certificate, error) {
+	var der []byte
+	err := t.do(func(h pkcs11.SessionHandle, _ pkcs11.ObjectHandle) error {
+		obj, err := t.findObject(h, pkcs11.CKO_CERTIFICATE)
+		if err != nil {
+			return err
+		}
+		attrs, err := t.ctx.GetAttributeValue(h, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return err
+		}
+		der = attrs[0].Value
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate from token: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate from token: %w", err)
+	}
+	return cert, nil
+}
+
+func newTokenConfig(c SignerConfig) (*tokenConfig, error) {
+
+	if c.Module == "" {
+		return nil, errors.New("PKCS#11 module not specified")
+	}
+	if c.KeyLabel == "" && c.KeyId == "" {
+		return nil, errors.New("PKCS#11 key label or ID must be specified")
+	}
+
+	conf := &tokenConfig{
+		module:     c.Module,
+		tokenLabel: c.Token,
+		keyLabel:   c.KeyLabel,
+	}
+
+	if c.Slot != "" {
+		slot, err := strconv.ParseUint(c.Slot, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 slot %q: %w", c.Slot, err)
+		}
+		s := uint(slot)
+		conf.slot = &s
+	}
+
+	if c.KeyId != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(c.KeyId, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 key ID %q: %w", c.KeyId, err)
+		}
+		conf.keyId = id
+	}
+
+	pin, err := internal.GetSecret(c.Pin, "PKCS#11 PIN")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PKCS#11 PIN: %w", err)
+	}
+	conf.pin = string(pin)
+
+	return conf, nil
+}
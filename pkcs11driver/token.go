@@ -0,0 +1,543 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11driver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// maxSessions is the maximum number of concurrently open sessions, which
+	// limits the number of parallel signing operations
+	maxSessions = 4
+)
+
+var (
+	oidP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// DigestInfo prefixes for PKCS #1 v1.5 signatures (RFC 8017 section 9.2),
+// as CKM_RSA_PKCS expects the DER-encoded DigestInfo
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PKCS#11 hash and MGF mechanisms for RSA-PSS
+var pssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// tokenConfig selects the token and the key on the token
+type tokenConfig struct {
+	module     string
+	tokenLabel string
+	slot       *uint
+	keyLabel   string
+	keyId      []byte
+	pin        string
+}
+
+// token is a crypto.Signer for a private key on a PKCS#11 token. Signing
+// operations are distributed over a pool of sessions, so that the token can
+// be used concurrently. If a session becomes invalid, e.g., because the token
+// was reset or re-inserted, all sessions are re-established and the operation
+// is retried once
+type token struct {
+	conf tokenConfig
+	ctx  *pkcs11.Ctx
+	pub  crypto.PublicKey
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// idle sessions and the number of open sessions
+	idle []session
+	open int
+	// gen is incremented on every reconnect to invalidate the previous sessions
+	gen  int
+	slot uint
+	priv pkcs11.ObjectHandle
+}
+
+type session struct {
+	handle pkcs11.SessionHandle
+	gen    int
+}
+
+// openToken loads the PKCS#11 module, logs in to the token and looks up the key
+func openToken(conf tokenConfig) (*token, error) {
+
+	ctx := pkcs11.New(conf.module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %v", conf.module)
+	}
+	err := ctx.Initialize()
+	if err != nil && !isError(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+
+	t := &token{
+		conf: conf,
+		ctx:  ctx,
+	}
+	t.cond = sync.NewCond(&t.mu)
+
+	t.mu.Lock()
+	err = t.connect()
+	t.mu.Unlock()
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// close closes all sessions and unloads the module
+func (t *token) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ctx.CloseAllSessions(t.slot)
+	t.idle = nil
+	t.open = 0
+	t.gen++
+	t.ctx.Finalize()
+	t.ctx.Destroy()
+}
+
+// connect selects the slot, opens the first session, logs in and looks up the
+// key. Must be called with t.mu held
+func (t *token) connect() error {
+
+	slot, err := t.findSlot()
+	if err != nil {
+		return err
+	}
+	h, err := t.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open session: %w", err)
+	}
+	err = t.ctx.Login(h, pkcs11.CKU_USER, t.conf.pin)
+	if err != nil && !isError(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		t.ctx.CloseSession(h)
+		return fmt.Errorf("failed to login to token: %w", err)
+	}
+
+	priv, err := t.findObject(h, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		t.ctx.CloseSession(h)
+		return fmt.Errorf("failed to find private key: %w", err)
+	}
+	pub, err := t.publicKey(h, priv)
+	if err != nil {
+		t.ctx.CloseSession(h)
+		return err
+	}
+	// The public key is only set on the first connect and must not change on
+	// reconnects, so that it can be read without locking
+	if t.pub == nil {
+		t.pub = pub
+	} else if !publicKeysEqual(t.pub, pub) {
+		t.ctx.CloseSession(h)
+		return errors.New("key on token changed after reconnect")
+	}
+
+	t.slot = slot
+	t.priv = priv
+	t.idle = append(t.idle, session{handle: h, gen: t.gen})
+	t.open = 1
+
+	return nil
+}
+
+func (t *token) findSlot() (uint, error) {
+	if t.conf.slot != nil {
+		return *t.conf.slot, nil
+	}
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get slots: %w", err)
+	}
+	if t.conf.tokenLabel == "" {
+		if len(slots) != 1 {
+			return 0, fmt.Errorf("found %v tokens, token label or slot must be specified", len(slots))
+		}
+		return slots[0], nil
+	}
+	for _, slot := range slots {
+		info, err := t.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get token info for slot %v: %w", slot, err)
+		}
+		if info.Label == t.conf.tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("token %q not found", t.conf.tokenLabel)
+}
+
+// findObject returns the single object of the given class matching the
+// configured key label and ID
+func (t *token) findObject(h pkcs11.SessionHandle, class uint) (pkcs11.ObjectHandle, error) {
+
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if t.conf.keyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, t.conf.keyLabel))
+	}
+	if len(t.conf.keyId) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, t.conf.keyId))
+	}
+
+	if err := t.ctx.FindObjectsInit(h, template); err != nil {
+		return 0, err
+	}
+	objs, _, err := t.ctx.FindObjects(h, 2)
+	t.ctx.FindObjectsFinal(h)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) != 1 {
+		return 0, fmt.Errorf("found %v matching objects (label %q, ID %x)",
+			len(objs), t.conf.keyLabel, t.conf.keyId)
+	}
+	return objs[0], nil
+}
+
+// publicKey reads the public key from the public key object matching the key
+// label and ID or, for RSA keys, from the private key object
+func (t *token) publicKey(h pkcs11.SessionHandle, priv pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+
+	attrs, err := t.ctx.GetAttributeValue(h, priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key type: %w", err)
+	}
+	keyType := bytesToUint(attrs[0].Value)
+
+	switch keyType {
+	case pkcs11.CKK_EC:
+		pubObj, err := t.findObject(h, pkcs11.CKO_PUBLIC_KEY)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find public key: %w", err)
+		}
+		attrs, err := t.ctx.GetAttributeValue(h, pubObj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get EC public key: %w", err)
+		}
+		return parseEcPublicKey(attrs[0].Value, attrs[1].Value)
+	case pkcs11.CKK_RSA:
+		attrs, err := t.ctx.GetAttributeValue(h, priv, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get RSA public key: %w", err)
+		}
+		e := new(big.Int).SetBytes(attrs[1].Value)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA public exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(e.Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type 0x%x", keyType)
+	}
+}
+
+// Public implements the crypto.Signer interface
+func (t *token) Public() crypto.PublicKey {
+	return t.pub
+}
+
+// Sign implements the crypto.Signer interface. The digest must be hashed with
+// the hash function specified in opts, which is also used for the PKCS #1 v1.5
+// DigestInfo and the PSS parameters. ECDSA signatures are returned ASN.1 encoded
+func (t *token) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	mech, data, err := mechanism(t.pub, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	err = t.do(func(h pkcs11.SessionHandle, priv pkcs11.ObjectHandle) error {
+		if err := t.ctx.SignInit(h, []*pkcs11.Mechanism{mech}, priv); err != nil {
+			return err
+		}
+		sig, err = t.ctx.Sign(h, data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	if _, ok := t.pub.(*ecdsa.PublicKey); ok {
+		return ecdsaSignature(sig)
+	}
+	return sig, nil
+}
+
+// do executes f within a session from the pool. If the session is lost, all
+// sessions are re-established and f is retried once
+func (t *token) do(f func(h pkcs11.SessionHandle, priv pkcs11.ObjectHandle) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var s session
+		var priv pkcs11.ObjectHandle
+		s, priv, err = t.acquire()
+		if err == nil {
+			err = f(s.handle, priv)
+			if err == nil || !isSessionError(err) {
+				t.release(s, false)
+				return err
+			}
+			t.release(s, true)
+		} else if !isSessionError(err) {
+			return err
+		}
+
+		log.Warnf("PKCS#11 session lost, re-establishing sessions: %v", err)
+		if rerr := t.reconnect(s.gen); rerr != nil {
+			return fmt.Errorf("failed to re-establish session: %w (%v)", rerr, err)
+		}
+	}
+	return err
+}
+
+// acquire returns an idle session or opens a new one, waiting if the maximum
+// number of sessions is in use
+func (t *token) acquire() (session, pkcs11.ObjectHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.idle) == 0 && t.open >= maxSessions {
+		t.cond.Wait()
+	}
+	if n := len(t.idle); n > 0 {
+		s := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		return s, t.priv, nil
+	}
+
+	h, err := t.ctx.OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return session{gen: t.gen}, 0, err
+	}
+	t.open++
+
+	return session{handle: h, gen: t.gen}, t.priv, nil
+}
+
+// release returns the session to the pool or closes it if it is broken.
+// Sessions from before a reconnect are discarded
+func (t *token) release(s session, broken bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.cond.Signal()
+
+	if s.gen != t.gen {
+		return
+	}
+	if broken {
+		t.ctx.CloseSession(s.handle)
+		t.open--
+		return
+	}
+	t.idle = append(t.idle, s)
+}
+
+// reconnect closes all sessions and connects again, unless another operation
+// already reconnected since the session of generation gen was acquired
+func (t *token) reconnect(gen int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if gen != t.gen {
+		return nil
+	}
+
+	t.ctx.CloseAllSessions(t.slot)
+	t.idle = nil
+	t.open = 0
+	t.gen++
+	t.cond.Broadcast()
+
+	err := t.connect()
+	if isError(err, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED) {
+		if err := t.ctx.Initialize(); err != nil {
+			return fmt.Errorf("failed to re-initialize PKCS#11 module: %w", err)
+		}
+		err = t.connect()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("Re-established PKCS#11 sessions")
+
+	return nil
+}
+
+// mechanism returns the PKCS#11 mechanism and the data to be signed
+func mechanism(pub crypto.PublicKey, digest []byte, opts crypto.SignerOpts) (*pkcs11.Mechanism, []byte, error) {
+
+	hash := opts.HashFunc()
+	if hash == 0 || len(digest) != hash.Size() {
+		return nil, nil, fmt.Errorf("digest length %v does not match hash function %v",
+			len(digest), hash)
+	}
+
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest, nil
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			mechs, ok := pssHashes[hash]
+			if !ok {
+				return nil, nil, fmt.Errorf("unsupported hash function %v for RSA-PSS", hash)
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = hash.Size()
+			} else if saltLength < 0 {
+				return nil, nil, fmt.Errorf("invalid PSS salt length %v", saltLength)
+			}
+			params := pkcs11.NewPSSParams(mechs[0], mechs[1], uint(saltLength))
+			return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), digest, nil
+		}
+		prefix, ok := digestInfoPrefixes[hash]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported hash function %v for RSA PKCS #1 v1.5", hash)
+		}
+		data := append(append([]byte{}, prefix...), digest...)
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), data, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// ecdsaSignature converts the PKCS#11 raw r || s signature to ASN.1
+func ecdsaSignature(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature length %v", len(raw))
+	}
+	n := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(raw[:n]),
+		new(big.Int).SetBytes(raw[n:]),
+	})
+}
+
+// parseEcPublicKey parses the DER-encoded CKA_EC_PARAMS curve OID and the
+// CKA_EC_POINT, which is a DER-encoded OCTET STRING or, for some tokens, the
+// raw uncompressed point
+func parseEcPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("failed to parse EC parameters: %w", err)
+	}
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidP521):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %v", oid)
+	}
+
+	// CKA_EC_POINT should be a DER encoded octet string, but some modules return
+	// the raw point. As a raw point can also be valid DER, try both encodings
+	var x, y *big.Int
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err == nil && len(rest) == 0 {
+		x, y = elliptic.Unmarshal(curve, raw)
+	}
+	if x == nil {
+		x, y = elliptic.Unmarshal(curve, point)
+	}
+	if x == nil {
+		return nil, errors.New("failed to parse EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// isSessionError returns true for errors after which the sessions must be
+// re-established
+func isSessionError(err error) bool {
+	for _, rv := range []uint{
+		pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_SLOT_ID_INVALID,
+		pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_KEY_HANDLE_INVALID,
+		pkcs11.CKR_OBJECT_HANDLE_INVALID,
+		pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+	} {
+		if isError(err, rv) {
+			return true
+		}
+	}
+	return false
+}
+
+func isError(err error, rv uint) bool {
+	var e pkcs11.Error
+	return errors.As(err, &e) && uint(e) == rv
+}
+
+func bytesToUint(b []byte) uint {
+	// CK_ULONG attributes are returned in native byte order, which is little
+	// endian on all supported platforms
+	var v uint
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint(b[i])
+	}
+	return v
+}
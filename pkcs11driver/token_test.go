@@ -0,0 +1,413 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11driver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/miekg/pkcs11"
+)
+
+func TestMechanism(t *testing.T) {
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	d256 := sha256.Sum256([]byte("data"))
+	d384 := sha512.Sum384([]byte("data"))
+
+	tests := []struct {
+		name     string
+		pub      crypto.PublicKey
+		digest   []byte
+		opts     crypto.SignerOpts
+		wantMech uint
+		wantLen  int
+		wantErr  bool
+	}{
+		{"ECDSA", &ecKey.PublicKey, d256[:], crypto.SHA256, pkcs11.CKM_ECDSA, 32, false},
+		{"PKCS1v15 SHA256", &rsaKey.PublicKey, d256[:], crypto.SHA256, pkcs11.CKM_RSA_PKCS, 51, false},
+		{"PKCS1v15 SHA384", &rsaKey.PublicKey, d384[:], crypto.SHA384, pkcs11.CKM_RSA_PKCS, 67, false},
+		{"PSS", &rsaKey.PublicKey, d256[:],
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256},
+			pkcs11.CKM_RSA_PKCS_PSS, 32, false},
+		{"Digest Mismatch", &ecKey.PublicKey, d384[:], crypto.SHA256, 0, 0, true},
+		{"No Hash", &ecKey.PublicKey, d256[:], crypto.Hash(0), 0, 0, true},
+		{"Unsupported Hash", &rsaKey.PublicKey, make([]byte, 20), crypto.SHA1, 0, 0, true},
+		{"Invalid Salt", &rsaKey.PublicKey, d256[:],
+			&rsa.PSSOptions{SaltLength: -3, Hash: crypto.SHA256}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mech, data, err := mechanism(tt.pub, tt.digest, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mechanism() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if mech.Mechanism != tt.wantMech {
+				t.Errorf("mechanism() = 0x%x, want 0x%x", mech.Mechanism, tt.wantMech)
+			}
+			if len(data) != tt.wantLen {
+				t.Errorf("mechanism() data length = %v, want %v", len(data), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestEcdsaSignature(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digest := sha256.Sum256([]byte("data"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	s.FillBytes(raw[32:])
+
+	sig, err := ecdsaSignature(raw)
+	if err != nil {
+		t.Fatalf("ecdsaSignature() error = %v", err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Errorf("failed to verify converted signature")
+	}
+	if _, err := ecdsaSignature(raw[:63]); err == nil {
+		t.Errorf("ecdsaSignature() of odd length succeeded")
+	}
+}
+
+func TestParseEcPublicKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	params, _ := asn1.Marshal(oidP384)
+	raw := elliptic.Marshal(key.Curve, key.X, key.Y)
+	der, _ := asn1.Marshal(raw)
+	unknown, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 3})
+
+	tests := []struct {
+		name    string
+		params  []byte
+		point   []byte
+		wantErr bool
+	}{
+		{"DER Point", params, der, false},
+		{"Raw Point", params, raw, false},
+		{"Unknown Curve", unknown, der, true},
+		{"Invalid Point", params, []byte{0x04, 0x01}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := parseEcPublicKey(tt.params, tt.point)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEcPublicKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !pub.Equal(&key.PublicKey) {
+				t.Errorf("parseEcPublicKey() returned different key")
+			}
+		})
+	}
+}
+
+func TestGetTokenConfig(t *testing.T) {
+	t.Setenv("CMC_TEST_PIN", "1234")
+
+	tests := []struct {
+		name    string
+		c       ar.DriverConfig
+		wantErr bool
+	}{
+		{"Label", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11KeyLabel: "ik", Pkcs11Pin: "env:CMC_TEST_PIN"}, false},
+		{"ID And Slot", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11KeyId: "0x0a0b", Pkcs11Slot: "0x1",
+			Pkcs11Pin: "env:CMC_TEST_PIN"}, false},
+		{"No Module", ar.DriverConfig{Pkcs11KeyLabel: "ik", Pkcs11Pin: "env:CMC_TEST_PIN"}, true},
+		{"No Key", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11Pin: "env:CMC_TEST_PIN"}, true},
+		{"Invalid ID", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11KeyId: "xyz", Pkcs11Pin: "env:CMC_TEST_PIN"}, true},
+		{"Invalid Slot", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11KeyLabel: "ik", Pkcs11Slot: "a",
+			Pkcs11Pin: "env:CMC_TEST_PIN"}, true},
+		{"No PIN", ar.DriverConfig{Pkcs11Module: "lib.so", Pkcs11KeyLabel: "ik", Pkcs11Pin: "env:CMC_TEST_UNSET"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getTokenConfig(&tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getTokenConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSoftHsm requires SoftHSM2. The module is taken from SOFTHSM2_MODULE or
+// the default installation path, otherwise the test is skipped. A temporary
+// token is created for the test
+func TestSoftHsm(t *testing.T) {
+
+	module := softHsmModule(t)
+	const pin = "1234"
+
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "tokens"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := path.Join(dir, "softhsm2.conf")
+	err := os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %v\n", path.Join(dir, "tokens"))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	createSoftHsmKeys(t, module, pin)
+
+	for _, label := range []string{"ec", "rsa"} {
+		t.Run(label, func(t *testing.T) {
+			tok, err := openToken(tokenConfig{
+				module:     module,
+				tokenLabel: "cmc-test",
+				keyLabel:   label,
+				pin:        pin,
+			})
+			if err != nil {
+				t.Fatalf("openToken() error = %v", err)
+			}
+			defer tok.close()
+
+			digest := sha256.Sum256([]byte("data"))
+			opts := []crypto.SignerOpts{crypto.SHA256}
+			if label == "rsa" {
+				opts = append(opts, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+			}
+
+			for _, o := range opts {
+				sig, err := tok.Sign(rand.Reader, digest[:], o)
+				if err != nil {
+					t.Fatalf("Sign() error = %v", err)
+				}
+				if err := verify(tok.Public(), digest[:], sig, o); err != nil {
+					t.Fatalf("failed to verify signature: %v", err)
+				}
+			}
+
+			// Concurrent signing over the session pool
+			var wg sync.WaitGroup
+			errs := make(chan error, 16)
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						sig, err := tok.Sign(rand.Reader, digest[:], crypto.SHA256)
+						if err == nil {
+							err = verify(tok.Public(), digest[:], sig, crypto.SHA256)
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("concurrent Sign() error = %v", err)
+			}
+			if tok.open > maxSessions {
+				t.Errorf("open sessions = %v, want <= %v", tok.open, maxSessions)
+			}
+
+			// Reports signed via the driver must be verifiable with both serializers
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "cmc-test " + label},
+				NotBefore:    time.Now().Add(-time.Minute),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, tok.Public(), tok)
+			if err != nil {
+				t.Fatalf("failed to create certificate with token key: %v", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatalf("failed to parse certificate: %v", err)
+			}
+			driver := &Pkcs11{token: tok, certChain: []*x509.Certificate{cert}}
+			for _, s := range []ar.Serializer{ar.JsonSerializer{}, ar.CborSerializer{}} {
+				signed, err := s.Sign([]byte("report"), driver)
+				if err != nil {
+					t.Fatalf("%T Sign() error = %v", s, err)
+				}
+				_, payload, ok := s.VerifyToken(signed, []*x509.Certificate{cert})
+				if !ok || string(payload) != "report" {
+					t.Errorf("%T VerifyToken() = %v, %q", s, ok, payload)
+				}
+			}
+
+			// Closing all sessions as after a token reset must be recovered
+			tok.ctx.CloseAllSessions(tok.slot)
+			sig, err := tok.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("Sign() after session loss error = %v", err)
+			}
+			if err := verify(tok.Public(), digest[:], sig, crypto.SHA256); err != nil {
+				t.Fatalf("failed to verify signature: %v", err)
+			}
+		})
+	}
+
+	_, err = openToken(tokenConfig{module: module, tokenLabel: "cmc-test", keyLabel: "ec", pin: "0000"})
+	if err == nil {
+		t.Errorf("openToken() with wrong PIN succeeded")
+	}
+	_, err = openToken(tokenConfig{module: module, tokenLabel: "cmc-test", keyLabel: "missing", pin: pin})
+	if err == nil {
+		t.Errorf("openToken() with missing key succeeded")
+	}
+}
+
+func softHsmModule(t *testing.T) string {
+	if m := os.Getenv("SOFTHSM2_MODULE"); m != "" {
+		return m
+	}
+	for _, m := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+	} {
+		if _, err := os.Stat(m); err == nil {
+			return m
+		}
+	}
+	t.Skip("SoftHSM2 not available")
+	return ""
+}
+
+// createSoftHsmKeys initializes the token cmc-test and generates an EC P-256
+// and an RSA 2048 key pair
+func createSoftHsmKeys(t *testing.T, module, pin string) {
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("failed to load %v", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("failed to get slots: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], "so-pin", "cmc-test"); err != nil {
+		t.Fatalf("failed to initialize token: %v", err)
+	}
+
+	// SoftHSM re-assigns the slot of the initialized token
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slot uint
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err == nil && info.Label == "cmc-test" {
+			slot = s
+		}
+	}
+
+	sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(sh)
+	if err := ctx.Login(sh, pkcs11.CKU_SO, "so-pin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(sh, pin); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(sh)
+	if err := ctx.Login(sh, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatal(err)
+	}
+
+	params, _ := asn1.Marshal(oidP256)
+	keys := []struct {
+		label string
+		mech  uint
+		pub   []*pkcs11.Attribute
+	}{
+		{"ec", pkcs11.CKM_EC_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		}},
+		{"rsa", pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}},
+	}
+	for _, k := range keys {
+		pub := append(k.pub,
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label))
+		priv := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.label),
+		}
+		_, _, err := ctx.GenerateKeyPair(sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(k.mech, nil)}, pub, priv)
+		if err != nil {
+			t.Fatalf("failed to generate %v key: %v", k.label, err)
+		}
+	}
+}
+
+func verify(pub crypto.PublicKey, digest, sig []byte, opts crypto.SignerOpts) error {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, sig) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			return rsa.VerifyPSS(k, opts.HashFunc(), digest, sig, pss)
+		}
+		return rsa.VerifyPKCS1v15(k, opts.HashFunc(), digest, sig)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
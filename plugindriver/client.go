@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugindriver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// request sends a single request to the plugin listening on the unix domain
+// socket and unmarshals the response. The whole exchange must complete within
+// the timeout and the response must not exceed the plugin message size limit
+func request(socket string, timeout time.Duration, reqType uint32, req, resp any) error {
+
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to plugin %v: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set deadline: %w", err)
+	}
+
+	s := ar.CborSerializer{}
+	data, err := s.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %v request: %w", api.TypeToString(reqType), err)
+	}
+
+	if err := api.Send(conn, data, reqType); err != nil {
+		return fmt.Errorf("failed to send %v request: %w", api.TypeToString(reqType), err)
+	}
+
+	payload, respType, err := api.ReceiveLimited(conn, api.PluginMaxMsgLen)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("plugin %v did not respond within %v", socket, timeout)
+		}
+		return fmt.Errorf("failed to receive %v response: %w", api.TypeToString(reqType), err)
+	}
+
+	if respType == api.TypeError {
+		e := new(api.SocketError)
+		if err := s.Unmarshal(payload, e); err != nil {
+			return fmt.Errorf("failed to unmarshal plugin error: %w", err)
+		}
+		return fmt.Errorf("plugin %v returned error: %v", socket, e.Msg)
+	}
+	if respType != reqType {
+		return fmt.Errorf("unexpected plugin response type %v (expected %v)",
+			api.TypeToString(respType), api.TypeToString(reqType))
+	}
+
+	if err := s.Unmarshal(payload, resp); err != nil {
+		return fmt.Errorf("failed to unmarshal %v response: %w", api.TypeToString(reqType), err)
+	}
+
+	return nil
+}
+
+// MeasureRequest requests evidence bound to the nonce from the plugin listening
+// on the unix domain socket without retrieving its info. This allows drivers
+// to collect evidence of a specific type, e.g. quotes of SGX enclaves, from
+// providers implementing the plugin protocol
+func MeasureRequest(socket string, timeout time.Duration, nonce []byte,
+) (*api.PluginMeasureResponse, error) {
+	resp := new(api.PluginMeasureResponse)
+	err := request(socket, timeout, api.TypePluginMeasure,
+		&api.PluginMeasureRequest{Nonce: nonce}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugindriver
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+var (
+	log = internal.NewLogger(internal.SubsystemDrivers, "plugindriver")
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+)
+
+// Plugin is a driver for external measurement and signer plugins connected
+// via unix domain sockets. Every configured plugin contributes one measurement
+// with a vendor namespaced type to the attestation report. At most one plugin
+// may provide a signing key
+type Plugin struct {
+	mu        sync.Mutex
+	plugins   []*plugin
+	signer    *plugin
+	certChain []*x509.Certificate
+}
+
+type plugin struct {
+	socket  string
+	timeout time.Duration
+	vendor  string
+	name    string
+	signer  bool
+}
+
+// pluginKey is a crypto.Signer for the signing key of a plugin
+type pluginKey struct {
+	p   *plugin
+	pub crypto.PublicKey
+}
+
+// Init connects to all configured plugins and retrieves their capabilities
+// and, if provided by a plugin, the certificate chain of the signing key
+func (p *Plugin) Init(c *ar.DriverConfig) error {
+
+	if p == nil {
+		return errors.New("internal error: plugin object is nil")
+	}
+
+	if len(c.PluginSockets) == 0 {
+		return errors.New("no plugin sockets configured")
+	}
+
+	timeout := defaultTimeout
+	if c.PluginTimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.PluginTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse plugin timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid plugin timeout %v", timeout)
+		}
+	}
+
+	p.plugins = nil
+	p.signer = nil
+	p.certChain = nil
+
+	for _, socket := range c.PluginSockets {
+		pl := &plugin{
+			socket:  socket,
+			timeout: timeout,
+		}
+
+		info := new(api.PluginInfoResponse)
+		err := request(socket, timeout, api.TypePluginInfo,
+			&api.PluginInfoRequest{Version: api.PluginVersion}, info)
+		if err != nil {
+			return fmt.Errorf("failed to get plugin info: %w", err)
+		}
+		if info.Version != api.PluginVersion {
+			return fmt.Errorf("plugin %v uses unsupported protocol version %v", socket,
+				info.Version)
+		}
+		if _, err := api.VendorType(info.Vendor, "Measurement"); err != nil {
+			return fmt.Errorf("plugin %v: %w", socket, err)
+		}
+		pl.vendor = info.Vendor
+		pl.name = info.Name
+		pl.signer = info.Signer
+
+		if pl.signer {
+			if p.signer != nil {
+				return fmt.Errorf("plugins %v and %v both provide a signing key",
+					p.signer.socket, socket)
+			}
+			p.certChain, err = pl.getCertChain()
+			if err != nil {
+				return fmt.Errorf("failed to get certificate chain of plugin %v: %w",
+					socket, err)
+			}
+			p.signer = pl
+		}
+
+		log.Infof("Initialized plugin %v (%v) on %v, signer: %v", pl.name, pl.vendor,
+			socket, pl.signer)
+
+		p.plugins = append(p.plugins, pl)
+	}
+
+	return nil
+}
+
+// Measure implements the attestation report Measurer interface and returns
+// the measurement of the first configured plugin
+func (p *Plugin) Measure(nonce []byte) (ar.Measurement, error) {
+	if p == nil || len(p.plugins) == 0 {
+		return ar.Measurement{}, errors.New("internal error: plugin object is not initialized")
+	}
+	return p.plugins[0].measure(nonce)
+}
+
+// MeasureAll implements the attestation report MultiMeasurer interface and
+// returns the measurements of all configured plugins
+func (p *Plugin) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+	if p == nil {
+		return nil, errors.New("internal error: plugin object is nil")
+	}
+	measurements := make([]ar.Measurement, 0, len(p.plugins))
+	for _, pl := range p.plugins {
+		m, err := pl.measure(nonce)
+		if err != nil {
+			return nil, err
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (p *Plugin) Lock() error {
+	p.mu.Lock()
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (p *Plugin) Unlock() error {
+	p.mu.Unlock()
+	return nil
+}
+
+// GetSigningKeys returns a crypto.Signer for the key of the signer plugin
+func (p *Plugin) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if p == nil {
+		return nil, nil, errors.New("internal error: plugin object is nil")
+	}
+	if p.signer == nil || len(p.certChain) == 0 {
+		return nil, nil, errors.New("none of the configured plugins provides a signing key")
+	}
+	pub := p.certChain[0].PublicKey
+	return &pluginKey{p: p.signer, pub: pub}, pub, nil
+}
+
+func (p *Plugin) GetCertChain() ([]*x509.Certificate, error) {
+	if p == nil {
+		return nil, errors.New("internal error: plugin object is nil")
+	}
+	if p.signer == nil {
+		return nil, errors.New("none of the configured plugins provides a signing key")
+	}
+	log.Tracef("Returning %v certificates", len(p.certChain))
+	return p.certChain, nil
+}
+
+func (pl *plugin) measure(nonce []byte) (ar.Measurement, error) {
+
+	resp := new(api.PluginMeasureResponse)
+	err := request(pl.socket, pl.timeout, api.TypePluginMeasure,
+		&api.PluginMeasureRequest{Nonce: nonce}, resp)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get plugin measurement: %w", err)
+	}
+
+	t, err := api.VendorType(pl.vendor, resp.Type)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("plugin %v returned invalid measurement: %w",
+			pl.socket, err)
+	}
+	if len(resp.Evidence) == 0 {
+		return ar.Measurement{}, fmt.Errorf("plugin %v returned no evidence", pl.socket)
+	}
+
+	log.Debugf("Retrieved %v from plugin %v", t, pl.socket)
+
+	return ar.Measurement{
+		Type:     t,
+		Evidence: resp.Evidence,
+		Certs:    resp.Certs,
+	}, nil
+}
+
+func (pl *plugin) getCertChain() ([]*x509.Certificate, error) {
+	resp := new(api.PluginCertChainResponse)
+	err := request(pl.socket, pl.timeout, api.TypePluginCertChain,
+		&api.PluginCertChainRequest{Version: api.PluginVersion}, resp)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := internal.ParseCertsDer(resp.Certs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificates: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("plugin returned empty certificate chain")
+	}
+	return certs, nil
+}
+
+// Public implements the crypto.Signer interface
+func (k *pluginKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign implements the crypto.Signer interface. The digest is signed by the
+// plugin with the hash function and PSS options specified in opts
+func (k *pluginKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	hash, err := api.SignerOptsToHash(opts)
+	if err != nil {
+		return nil, fmt.Errorf("sign request creation failed: %w", err)
+	}
+	req := &api.PluginSignRequest{
+		Digest:   digest,
+		Hashtype: hash,
+	}
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		req.PssOpts = &api.PSSOptions{SaltLength: int32(pssOpts.SaltLength)}
+	}
+
+	resp := new(api.PluginSignResponse)
+	err = request(k.p.socket, k.p.timeout, api.TypePluginSign, req, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with plugin: %w", err)
+	}
+
+	return resp.Signature, nil
+}
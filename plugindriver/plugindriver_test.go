@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugindriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+type testMeasurer struct {
+	typ      string
+	evidence []byte
+	delay    time.Duration
+	fail     bool
+}
+
+func (m *testMeasurer) Measure(nonce []byte) (string, []byte, [][]byte, error) {
+	time.Sleep(m.delay)
+	if m.fail {
+		return "", nil, nil, errors.New("sensor not available")
+	}
+	if m.evidence != nil {
+		return m.typ, m.evidence, nil, nil
+	}
+	return m.typ, nonce, nil, nil
+}
+
+type testSigner struct {
+	testMeasurer
+	priv *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Plugin Key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testSigner{
+		testMeasurer: testMeasurer{typ: "Signer Measurement"},
+		priv:         priv,
+		cert:         cert,
+	}
+}
+
+func (s *testSigner) Sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.priv.Sign(rand.Reader, digest, opts)
+}
+
+func (s *testSigner) CertChain() ([]*x509.Certificate, error) {
+	return []*x509.Certificate{s.cert}, nil
+}
+
+// servePlugin serves the plugin on a temporary unix domain socket
+func servePlugin(t *testing.T, vendor string, m Measurer) string {
+	socket := filepath.Join(t.TempDir(), "plugin.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, vendor, "test", m)
+	return socket
+}
+
+func TestPlugin(t *testing.T) {
+
+	nonce := []byte{0x01, 0x02, 0x03, 0x04}
+
+	tests := []struct {
+		name      string
+		plugins   map[string]Measurer
+		timeout   string
+		wantTypes []string
+		wantSign  bool
+		wantInit  bool
+		wantErr   bool
+	}{
+		{
+			name:      "Measurer",
+			plugins:   map[string]Measurer{"com.example": &testMeasurer{typ: "Sensor Measurement"}},
+			wantInit:  true,
+			wantTypes: []string{"com.example/Sensor Measurement"},
+		},
+		{
+			name:      "Signer",
+			plugins:   map[string]Measurer{"com.example": newTestSigner(t)},
+			wantInit:  true,
+			wantSign:  true,
+			wantTypes: []string{"com.example/Signer Measurement"},
+		},
+		{
+			name: "Multiple Plugins",
+			plugins: map[string]Measurer{
+				"com.example": &testMeasurer{typ: "Sensor Measurement"},
+				"org.example": newTestSigner(t),
+			},
+			wantInit:  true,
+			wantSign:  true,
+			wantTypes: []string{"com.example/Sensor Measurement", "org.example/Signer Measurement"},
+		},
+		{
+			name: "Two Signers",
+			plugins: map[string]Measurer{
+				"com.example": newTestSigner(t),
+				"org.example": newTestSigner(t),
+			},
+		},
+		{
+			name:     "Timeout",
+			plugins:  map[string]Measurer{"com.example": &testMeasurer{typ: "Slow", delay: time.Second}},
+			timeout:  "100ms",
+			wantInit: true,
+			wantErr:  true,
+		},
+		{
+			name: "Size Limit",
+			plugins: map[string]Measurer{"com.example": &testMeasurer{typ: "Large Measurement",
+				evidence: make([]byte, api.PluginMaxMsgLen)}},
+			wantInit: true,
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid Type",
+			plugins:  map[string]Measurer{"com.example": &testMeasurer{typ: "other.vendor/Type"}},
+			wantInit: true,
+			wantErr:  true,
+		},
+		{
+			name:     "Plugin Error",
+			plugins:  map[string]Measurer{"com.example": &testMeasurer{typ: "Sensor", fail: true}},
+			wantInit: true,
+			wantErr:  true,
+		},
+		{
+			name:    "Invalid Timeout",
+			plugins: map[string]Measurer{"com.example": &testMeasurer{typ: "Sensor"}},
+			timeout: "-1s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Start plugins in order of their vendor for deterministic results
+			sockets := make([]string, 0, len(tt.plugins))
+			for _, v := range []string{"com.example", "org.example"} {
+				if m, ok := tt.plugins[v]; ok {
+					sockets = append(sockets, servePlugin(t, v, m))
+				}
+			}
+
+			p := &Plugin{}
+			err := p.Init(&ar.DriverConfig{PluginSockets: sockets, PluginTimeout: tt.timeout})
+			if (err == nil) != tt.wantInit {
+				t.Fatalf("Init() error = %v, wantInit %v", err, tt.wantInit)
+			}
+			if !tt.wantInit {
+				return
+			}
+
+			measurements, err := p.MeasureAll(nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MeasureAll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(measurements) != len(tt.wantTypes) {
+				t.Fatalf("MeasureAll() returned %v measurements, want %v", len(measurements),
+					len(tt.wantTypes))
+			}
+			for i, m := range measurements {
+				if m.Type != tt.wantTypes[i] {
+					t.Errorf("measurement type = %v, want %v", m.Type, tt.wantTypes[i])
+				}
+				if !bytes.Equal(m.Evidence, nonce) {
+					t.Errorf("measurement evidence = %x, want %x", m.Evidence, nonce)
+				}
+			}
+
+			priv, pub, err := p.GetSigningKeys()
+			if (err == nil) != tt.wantSign {
+				t.Fatalf("GetSigningKeys() error = %v, wantSign %v", err, tt.wantSign)
+			}
+			if !tt.wantSign {
+				return
+			}
+			digest := sha256.Sum256([]byte("data"))
+			sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+				t.Errorf("plugin signature verification failed")
+			}
+		})
+	}
+}
+
+func TestPluginNotRunning(t *testing.T) {
+	p := &Plugin{}
+	err := p.Init(&ar.DriverConfig{
+		PluginSockets: []string{filepath.Join(t.TempDir(), "missing.sock")},
+	})
+	if err == nil {
+		t.Fatalf("Init() with missing plugin succeeded")
+	}
+}
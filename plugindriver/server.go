@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugindriver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// Measurer must be implemented by plugins. Measure returns the evidence type
+// without vendor namespace, the evidence bound to the nonce and optional
+// certificates in DER format
+type Measurer interface {
+	Measure(nonce []byte) (string, []byte, [][]byte, error)
+}
+
+// Signer can optionally be implemented by plugins providing a signing key
+type Signer interface {
+	Sign(digest []byte, opts crypto.SignerOpts) ([]byte, error)
+	CertChain() ([]*x509.Certificate, error)
+}
+
+// Serve serves the plugin protocol on the listener for external plugins. The
+// plugin must be registered with a vendor namespace in reverse domain name
+// notation, e.g. "com.example". If m implements the Signer interface, the
+// plugin provides a signing key
+func Serve(l net.Listener, vendor, name string, m Measurer) error {
+
+	if _, err := api.VendorType(vendor, "Measurement"); err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("no plugin measurer specified")
+	}
+
+	info := &api.PluginInfoResponse{
+		Version: api.PluginVersion,
+		Vendor:  vendor,
+		Name:    name,
+	}
+	_, info.Signer = m.(Signer)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go handlePluginRequest(conn, info, m)
+	}
+}
+
+func handlePluginRequest(conn net.Conn, info *api.PluginInfoResponse, m Measurer) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(defaultTimeout))
+
+	s := ar.CborSerializer{}
+
+	payload, reqType, err := api.ReceiveLimited(conn, api.PluginMaxMsgLen)
+	if err != nil {
+		log.Warnf("Failed to receive plugin request: %v", err)
+		return
+	}
+
+	var resp any
+	switch reqType {
+	case api.TypePluginInfo:
+		resp = info
+
+	case api.TypePluginMeasure:
+		req := new(api.PluginMeasureRequest)
+		if err := s.Unmarshal(payload, req); err != nil {
+			sendPluginError(conn, "failed to unmarshal measure request: %v", err)
+			return
+		}
+		t, evidence, certs, err := m.Measure(req.Nonce)
+		if err != nil {
+			sendPluginError(conn, "failed to measure: %v", err)
+			return
+		}
+		resp = &api.PluginMeasureResponse{
+			Type:     t,
+			Evidence: evidence,
+			Certs:    certs,
+		}
+
+	case api.TypePluginSign:
+		signer, ok := m.(Signer)
+		if !ok {
+			sendPluginError(conn, "plugin does not provide a signing key")
+			return
+		}
+		req := new(api.PluginSignRequest)
+		if err := s.Unmarshal(payload, req); err != nil {
+			sendPluginError(conn, "failed to unmarshal sign request: %v", err)
+			return
+		}
+		opts, err := api.HashToSignerOpts(req.Hashtype, req.PssOpts)
+		if err != nil {
+			sendPluginError(conn, "failed to choose requested hash function: %v", err)
+			return
+		}
+		sig, err := signer.Sign(req.Digest, opts)
+		if err != nil {
+			sendPluginError(conn, "failed to sign: %v", err)
+			return
+		}
+		resp = &api.PluginSignResponse{Signature: sig}
+
+	case api.TypePluginCertChain:
+		signer, ok := m.(Signer)
+		if !ok {
+			sendPluginError(conn, "plugin does not provide a signing key")
+			return
+		}
+		certs, err := signer.CertChain()
+		if err != nil {
+			sendPluginError(conn, "failed to get certificate chain: %v", err)
+			return
+		}
+		r := &api.PluginCertChainResponse{}
+		for _, c := range certs {
+			r.Certs = append(r.Certs, c.Raw)
+		}
+		resp = r
+
+	default:
+		sendPluginError(conn, "invalid type: %v", reqType)
+		return
+	}
+
+	data, err := s.Marshal(resp)
+	if err != nil {
+		sendPluginError(conn, "failed to marshal response: %v", err)
+		return
+	}
+	if err := api.Send(conn, data, reqType); err != nil {
+		log.Warnf("Failed to send plugin response: %v", err)
+	}
+}
+
+func sendPluginError(conn net.Conn, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warn(msg)
+	data, err := ar.CborSerializer{}.Marshal(&api.SocketError{Msg: msg})
+	if err != nil {
+		log.Warnf("Failed to marshal plugin error: %v", err)
+		return
+	}
+	if err := api.Send(conn, data, api.TypeError); err != nil {
+		log.Warnf("Failed to send plugin error: %v", err)
+	}
+}
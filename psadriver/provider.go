@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package psadriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	commandTimeout = 30 * time.Second
+)
+
+func newProvider(c *ar.DriverConfig) (TokenProvider, error) {
+	if c.PsaCommand != "" {
+		return newCommandProvider(c.PsaCommand)
+	}
+	return nil, errors.New("no PSA token provider configured (psaCommand)")
+}
+
+// commandProvider retrieves PSA tokens via a platform specific command, which
+// is called with the hex encoded challenge as last argument and writes the
+// token raw or hex encoded to stdout
+type commandProvider struct {
+	name string
+	args []string
+}
+
+func newCommandProvider(command string) (*commandProvider, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("empty PSA token command")
+	}
+	return &commandProvider{
+		name: fields[0],
+		args: fields[1:],
+	}, nil
+}
+
+func (p *commandProvider) GetToken(challenge []byte) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, p.args...), hex.EncodeToString(challenge))
+	log.Tracef("Running PSA token command %v %v", p.name, strings.Join(args, " "))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("PSA token command failed: %w (%v)", err,
+			strings.TrimSpace(stderr.String()))
+	}
+
+	// COSE_Sign1 tokens are not valid hex, so hex output can be detected
+	out := stdout.Bytes()
+	if token, err := hex.DecodeString(string(bytes.TrimSpace(out))); err == nil && len(token) > 0 {
+		return token, nil
+	}
+	if len(out) == 0 {
+		return nil, errors.New("PSA token command returned no token")
+	}
+
+	return out, nil
+}
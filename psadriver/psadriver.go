@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package psadriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "psadriver")
+
+// TokenProvider abstracts the platform specific interface to the PSA initial
+// attestation service, which returns the COSE_Sign1 signed PSA token for the
+// given challenge
+type TokenProvider interface {
+	GetToken(challenge []byte) ([]byte, error)
+}
+
+// Psa is a driver for ARM PSA devices such as Cortex-M/Corstone based targets,
+// which provide PSA initial attestation tokens via their secure enclave
+type Psa struct {
+	mu               sync.Mutex
+	provider         TokenProvider
+	iakChain         []*x509.Certificate
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+}
+
+// Init initializes the PSA driver with the specified configuration
+func (p *Psa) Init(c *ar.DriverConfig) error {
+	var err error
+
+	if p == nil {
+		return errors.New("internal error: PSA object is nil")
+	}
+
+	if p.provider == nil {
+		p.provider, err = newProvider(c)
+		if err != nil {
+			return fmt.Errorf("failed to create PSA token provider: %w", err)
+		}
+	}
+
+	// The IAK certificate chain is optional, verifiers can alternatively use
+	// provisioned endorsement keys
+	if c.PsaIakChain != "" {
+		data, err := os.ReadFile(c.PsaIakChain)
+		if err != nil {
+			return fmt.Errorf("failed to read IAK chain: %w", err)
+		}
+		p.iakChain, err = internal.ParseCertsPem(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse IAK chain: %w", err)
+		}
+	}
+
+	// Create new private key for signing
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	p.priv = priv
+
+	// Create IK CSR and fetch new certificate including its chain from EST server
+	p.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+		c.ServerAddr, c.BootstrapToken)
+	if err != nil {
+		return fmt.Errorf("failed to get signing cert chain: %w", err)
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (p *Psa) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting PSA measurements")
+
+	if p == nil {
+		return ar.Measurement{}, errors.New("internal error: PSA object is nil")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	token, err := p.provider.GetToken(verify.PsaChallenge(nonce))
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get PSA token: %w", err)
+	}
+
+	measurement := ar.Measurement{
+		Type:     "IAS Measurement",
+		Evidence: token,
+		Certs:    internal.WriteCertsDer(p.iakChain),
+	}
+
+	return measurement, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (p *Psa) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Unlock implements the unlocking method for the attestation report signer interface
+func (p *Psa) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic crypto interface
+func (p *Psa) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if p == nil {
+		return nil, nil, errors.New("internal error: PSA object is nil")
+	}
+	return p.priv, &p.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (p *Psa) GetCertChain() ([]*x509.Certificate, error) {
+	if p == nil {
+		return nil, errors.New("internal error: PSA object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(p.signingCertChain))
+	return p.signingCertChain, nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package psadriver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+type testProvider struct {
+	challenge []byte
+	token     []byte
+	err       error
+}
+
+func (p *testProvider) GetToken(challenge []byte) ([]byte, error) {
+	p.challenge = challenge
+	return p.token, p.err
+}
+
+func Test_Measure(t *testing.T) {
+
+	nonce := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	token := []byte{0xd2, 0x84}
+
+	tests := []struct {
+		name     string
+		provider *testProvider
+		wantErr  bool
+	}{
+		{
+			name:     "Valid",
+			provider: &testProvider{token: token},
+		},
+		{
+			name:     "Provider Error",
+			provider: &testProvider{err: errors.New("token service unavailable")},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Psa{provider: tt.provider}
+			got, err := p.Measure(nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Measure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(tt.provider.challenge, verify.PsaChallenge(nonce)) {
+				t.Errorf("Measure() challenge = %x, want %x", tt.provider.challenge,
+					verify.PsaChallenge(nonce))
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Type != "IAS Measurement" || !bytes.Equal(got.Evidence, token) {
+				t.Errorf("Measure() = %+v, want IAS Measurement with token", got)
+			}
+		})
+	}
+}
+
+func Test_commandProvider(t *testing.T) {
+
+	challenge := bytes.Repeat([]byte{0xab}, 32)
+	token := []byte{0xd2, 0x84, 0x43, 0xa1, 0x01, 0x26}
+	dir := t.TempDir()
+
+	tokenFile := path.Join(dir, "token.cbor")
+	if err := os.WriteFile(tokenFile, token, 0644); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+
+	script := func(name, content string) string {
+		p := path.Join(dir, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"+content+"\n"), 0755); err != nil {
+			t.Fatalf("failed to write script: %v", err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "Raw Token",
+			command: script("raw.sh", `[ "$2" = "`+hex.EncodeToString(challenge)+`" ] || exit 1
+cat "$1"`) + " " + tokenFile,
+			want: token,
+		},
+		{
+			name:    "Hex Token",
+			command: script("hex.sh", `echo `+hex.EncodeToString(token)),
+			want:    token,
+		},
+		{
+			name:    "Command Fails",
+			command: script("fail.sh", `echo "no attestation service" >&2; exit 1`),
+			wantErr: true,
+		},
+		{
+			name:    "No Token",
+			command: script("empty.sh", `exit 0`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newCommandProvider(tt.command)
+			if err != nil {
+				t.Fatalf("newCommandProvider() error = %v", err)
+			}
+			got, err := p.GetToken(challenge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("GetToken() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
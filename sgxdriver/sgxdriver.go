@@ -23,7 +23,6 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -38,12 +37,11 @@ import (
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	verify "github.com/Fraunhofer-AISEC/cmc/verify"
 	"github.com/edgelesssys/ego/enclave"
-	"github.com/sirupsen/logrus"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var log = logrus.WithField("service", "sgxdriver")
+var log = internal.NewLogger(internal.SubsystemDrivers, "sgxdriver")
 
 var (
 	tcbInfoUrl             = "https://api.trustedservices.intel.com/sgx/certification/v4/tcb?fmspc=%s"
@@ -89,7 +87,7 @@ func (sgx *Sgx) Init(c *ar.DriverConfig) error {
 
 	// Create IK CSR and fetch new certificate including its chain from EST server
 	sgx.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
-		c.ServerAddr)
+		c.ServerAddr, c.BootstrapToken)
 	if err != nil {
 		return fmt.Errorf("failed to get signing cert chain: %w", err)
 	}
@@ -156,7 +154,7 @@ func (sgx *Sgx) GetCertChain() ([]*x509.Certificate, error) {
 }
 
 func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
-	addr string,
+	addr, tokenSource string,
 ) ([]*x509.Certificate, error) {
 
 	csr, err := ar.CreateCsr(priv, s, metadata)
@@ -170,6 +168,9 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 	// different CAs for metadata and the EST server authentication
 	log.Warn("Creating new EST client without server authentication")
 	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
 
 	log.Info("Retrieving CA certs")
 	caCerts, err := client.CaCerts(addr)
@@ -190,7 +191,7 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 		return nil, fmt.Errorf("failed to set EST CA: %w", err)
 	}
 
-	cert, err := client.SimpleEnroll(addr, csr)
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to enroll cert: %w", err)
 	}
@@ -266,7 +267,7 @@ func downloadAndCacheCertChain(c *ar.DriverConfig) ([]*x509.Certificate, error)
 	// Store certificates in cache
 	for _, cert := range certs {
 		fileName := fmt.Sprintf("%s/%s.pem", c.StoragePath, strings.ReplaceAll(cert.Subject.CommonName, " ", "_"))
-		err = os.WriteFile(fileName, cert.Raw, 0644)
+		err = internal.WriteFileAtomic(fileName, cert.Raw, 0644)
 		if err != nil {
 			return nil, err
 		}
@@ -312,47 +313,24 @@ func downloadSgxCertChain(c *ar.DriverConfig) ([]*x509.Certificate, error) {
 		return certificates, fmt.Errorf("error decoding URL-encoded string: %v", err)
 	}
 
-	// Split the PEM certificates
-	certs := strings.SplitAfter(decoded, "-----END CERTIFICATE-----\n")
-	for _, certPEM := range certs {
-		if certPEM != "" {
-
-			// Decode the PEM block
-			block, _ := pem.Decode([]byte(certPEM))
-			if block == nil {
-				return certificates, fmt.Errorf("error decoding PCK cert chain")
-			}
-
-			// Parse the certificate
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				return certificates, fmt.Errorf("error parsing certificate: %v", err)
-			}
-
-			certificates = append(certificates, cert)
-		}
+	issuerChain, err := internal.ParseCertsPem([]byte(decoded))
+	if err != nil {
+		return certificates, fmt.Errorf("error parsing PCK cert chain: %w", err)
 	}
+	certificates = append(certificates, issuerChain...)
 
 	// Read the PCK certificate
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return certificates, fmt.Errorf("error reading response body: %v", err)
 	}
+	resp.Body.Close()
 
-	// Decode the PEM block
-	block, _ := pem.Decode([]byte(body))
-	if block == nil {
-		return certificates, fmt.Errorf("error decoding PCK cert")
-	}
-
-	// Parse the certificate
-	pckCert, err := x509.ParseCertificate(block.Bytes)
+	pckCert, err := internal.ParseCert(body)
 	if err != nil {
-		return certificates, fmt.Errorf("error parsing certificate: %v", err)
-
+		return certificates, fmt.Errorf("error parsing PCK cert: %w", err)
 	}
 	certificates = append(certificates, pckCert)
-	resp.Body.Close()
 
 	// Extract FMSPC from PCK certificate SGX Extensions
 	sgxExtensions, err := verify.ParseSGXExtensions(pckCert.Extensions[verify.SGX_EXTENSION_INDEX].Value[4:])
@@ -381,24 +359,12 @@ func downloadSgxCertChain(c *ar.DriverConfig) ([]*x509.Certificate, error) {
 		return certificates, fmt.Errorf("error decoding URL-encoded string: %v", err)
 	}
 
-	// Split the PEM certificates
-	certs = strings.SplitAfter(decoded, "-----END CERTIFICATE-----\n")
-	tcbSigningCert := certs[0]
-	if tcbSigningCert != "" {
-		// Decode the PEM block
-		block, _ := pem.Decode([]byte(tcbSigningCert))
-		if block == nil {
-			return certificates, fmt.Errorf("error decoding TCB Signing Cert")
-		}
-
-		// Parse the certificate
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return certificates, fmt.Errorf("error parsing certificate: %v", err)
-		}
-
-		certificates = append(certificates, cert)
+	// The first certificate of the chain is the TCB signing certificate
+	tcbChain, err := internal.ParseCertsPem([]byte(decoded))
+	if err != nil {
+		return certificates, fmt.Errorf("error parsing TCB info issuer chain: %w", err)
 	}
+	certificates = append(certificates, tcbChain[0])
 
 	resp.Body.Close()
 
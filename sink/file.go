@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+)
+
+// file appends the records as JSON lines to a local file
+type file struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+}
+
+func newFile(path string) (*file, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing file of file sink")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result file: %w", err)
+	}
+	return &file{name: path, f: f}, nil
+}
+
+// Publish appends the record as a single line with a single write, so that
+// readers tailing the file see complete records
+func (s *file) Publish(r *Record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Warnf("Failed to marshal verification result: %v", err)
+		metrics.SinkDropped(s.name)
+		return
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		metrics.SinkDropped(s.name)
+		return
+	}
+	if _, err := s.f.Write(data); err != nil {
+		log.Warnf("Failed to write verification result to %v: %v", s.name, err)
+		metrics.SinkFailed(s.name)
+		metrics.SinkDropped(s.name)
+		return
+	}
+	metrics.SinkDelivered(s.name)
+}
+
+func (s *file) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
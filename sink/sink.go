@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sink forwards verification results to external systems such as a
+// SIEM. Sinks never block or influence the verification: results which cannot
+// be delivered are dropped and counted in the metrics
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const (
+	TypeWebhook = "webhook"
+	TypeFile    = "file"
+)
+
+var log = internal.NewLogger(internal.SubsystemServer, "sink")
+
+// Record is the payload published to the sinks for each verification
+type Record struct {
+	// ReportId is the hex encoded SHA-256 of the signed attestation report
+	ReportId string `json:"reportId,omitempty"`
+	// Peer is the identity of the peer which requested the verification or
+	// whose report was verified, e.g. its remote address
+	Peer string `json:"peer,omitempty"`
+	// Api is the interface via which the verification was requested
+	Api      string                 `json:"api"`
+	Received time.Time              `json:"received"`
+	Verified time.Time              `json:"verified"`
+	Result   *ar.VerificationResult `json:"result"`
+}
+
+// NewRecord creates the record of a verification of the report, which was
+// received at the given time and has just finished
+func NewRecord(api, peer string, report []byte, received time.Time,
+	result *ar.VerificationResult,
+) *Record {
+	r := &Record{
+		Peer:     peer,
+		Api:      api,
+		Received: received.UTC(),
+		Verified: time.Now().UTC(),
+		Result:   result,
+	}
+	if len(report) > 0 {
+		hash := sha256.Sum256(report)
+		r.ReportId = hex.EncodeToString(hash[:])
+	}
+	return r
+}
+
+// Sink receives the records of all verifications. Publish must not block
+type Sink interface {
+	Publish(r *Record)
+	Close() error
+}
+
+// Config is the configuration of a single sink
+type Config struct {
+	// Type is either webhook or file
+	Type string `json:"type"`
+	// Only for webhooks: the HTTPS URL, the optional PEM CA file to verify the
+	// server, the optional source of the key to sign the body with an HMAC,
+	// the size of the queue (default 1024), the number of retries (default 5)
+	// and the request timeout (default 10s)
+	Url       string `json:"url,omitempty"`
+	Ca        string `json:"ca,omitempty"`
+	HmacKey   string `json:"hmacKey,omitempty"`
+	QueueSize int    `json:"queueSize,omitempty"`
+	Retries   *int   `json:"retries,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+	// Only for files: the JSONL file the records are appended to
+	File string `json:"file,omitempty"`
+}
+
+// Types returns the supported sink types
+func Types() []string {
+	return []string{TypeWebhook, TypeFile}
+}
+
+// New creates the sink of the configuration
+func New(c *Config) (Sink, error) {
+	switch strings.ToLower(c.Type) {
+	case TypeWebhook:
+		w, err := newWebhook(c)
+		if err != nil {
+			return nil, err
+		}
+		return w.start(), nil
+	case TypeFile:
+		f, err := newFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %v (must be one of %v)", c.Type,
+			strings.Join(Types(), ", "))
+	}
+}
+
+// Sinks publishes the records to multiple sinks. A nil Sinks discards the
+// records
+type Sinks []Sink
+
+// NewSinks creates all configured sinks
+func NewSinks(configs []Config) (Sinks, error) {
+	sinks := make(Sinks, 0, len(configs))
+	for i := range configs {
+		s, err := New(&configs[i])
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("failed to create result sink %v: %w", i, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// Publish publishes the record to all sinks
+func (s Sinks) Publish(r *Record) {
+	for _, sink := range s {
+		sink.Publish(r)
+	}
+}
+
+// Close closes all sinks
+func (s Sinks) Close() error {
+	var err error
+	for _, sink := range s {
+		if e := sink.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
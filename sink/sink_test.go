@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+)
+
+var sinkMetrics = metrics.EnableSinkMetrics(metrics.NewRegistry())
+
+func newRecord() *Record {
+	return NewRecord("socket", "127.0.0.1:4242", []byte("report"), time.Now(),
+		&ar.VerificationResult{Type: "Verification Result", Success: true, Prover: "device"})
+}
+
+// newTestWebhook returns a webhook for the TLS test server, which signs the
+// body with the key and retries without backoff
+func newTestWebhook(t *testing.T, srv *httptest.Server, key string, retries, queue int,
+) *webhook {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, data, 0600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	t.Setenv("CMC_TEST_HMAC_KEY", key)
+	w, err := newWebhook(&Config{
+		Type:      TypeWebhook,
+		Url:       srv.URL + "/results",
+		Ca:        ca,
+		HmacKey:   "env:CMC_TEST_HMAC_KEY",
+		QueueSize: queue,
+		Retries:   &retries,
+		Timeout:   "2s",
+	})
+	if err != nil {
+		t.Fatalf("newWebhook() error = %v", err)
+	}
+	w.backoff = func(int) time.Duration { return time.Millisecond }
+	return w.start()
+}
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		retries       int
+		wantAttempts  int
+		wantDelivered float64
+		wantDropped   float64
+	}{
+		{"Delivered", []int{http.StatusOK}, 5, 1, 1, 0},
+		{"Retried", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests,
+			http.StatusAccepted}, 5, 3, 1, 0},
+		{"Rejected", []int{http.StatusBadRequest}, 5, 1, 0, 1},
+		{"Retries Exhausted", []int{500, 500, 500}, 2, 3, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var bodies [][]byte
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter,
+				r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if got, want := r.Header.Get(SignatureHeader),
+					Signature([]byte("secret"), body); got != want {
+					t.Errorf("signature = %v, want %v", got, want)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(tt.statuses[len(bodies)])
+				bodies = append(bodies, body)
+			}))
+			defer srv.Close()
+
+			w := newTestWebhook(t, srv, "secret", tt.retries, 0)
+			r := newRecord()
+			w.Publish(r)
+			// Wait until the record was delivered or dropped
+			for i := 0; sinkMetrics.Delivered.Value(w.name)+
+				sinkMetrics.Dropped.Value(w.name) == 0; i++ {
+				if i == 1000 {
+					t.Fatalf("record neither delivered nor dropped")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			w.Close()
+
+			if len(bodies) != tt.wantAttempts {
+				t.Fatalf("attempts = %v, want %v", len(bodies), tt.wantAttempts)
+			}
+			var got Record
+			if err := json.Unmarshal(bodies[0], &got); err != nil {
+				t.Fatalf("failed to unmarshal record: %v", err)
+			}
+			if got.ReportId != r.ReportId || got.Peer != r.Peer || got.Result.Prover != "device" ||
+				!got.Verified.Equal(r.Verified) {
+				t.Errorf("record = %+v, want %+v", got, r)
+			}
+
+			if v := sinkMetrics.Delivered.Value(w.name); v != tt.wantDelivered {
+				t.Errorf("delivered = %v, want %v", v, tt.wantDelivered)
+			}
+			if v := sinkMetrics.Failures.Value(w.name); v != float64(tt.wantAttempts)-
+				tt.wantDelivered {
+				t.Errorf("failures = %v, want %v", v, float64(tt.wantAttempts)-tt.wantDelivered)
+			}
+			if v := sinkMetrics.Dropped.Value(w.name); v != tt.wantDropped {
+				t.Errorf("dropped = %v, want %v", v, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestWebhookDeadEndpoint(t *testing.T) {
+	// The endpoint never responds, publishing must not block and drop the
+	// records exceeding the queue
+	block := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	w := newTestWebhook(t, srv, "secret", 0, 2)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		w.Publish(newRecord())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Publish() blocked for %v", d)
+	}
+	if v := sinkMetrics.Dropped.Value(w.name); v < 97 {
+		t.Errorf("dropped = %v, want at least 97", v)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	s, err := New(&Config{Type: TypeFile, File: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	records := []*Record{newRecord(), newRecord()}
+	for _, r := range records {
+		s.Publish(r)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// Records published after close are dropped
+	s.Publish(newRecord())
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open results: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for ; scanner.Scan(); n++ {
+		var got Record
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("failed to unmarshal line %v: %v", n, err)
+		}
+		if got.Api != "socket" || got.ReportId != records[n].ReportId {
+			t.Errorf("record %v = %+v", n, got)
+		}
+	}
+	if n != len(records) {
+		t.Errorf("got %v records, want %v", n, len(records))
+	}
+	if v := sinkMetrics.Dropped.Value(path); v != 1 {
+		t.Errorf("dropped = %v, want 1", v)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{"Plain HTTP", Config{Type: TypeWebhook, Url: "http://localhost:9000"}, true},
+		{"Missing Host", Config{Type: TypeWebhook, Url: "https:///results"}, true},
+		{"Invalid Timeout", Config{Type: TypeWebhook, Url: "https://localhost", Timeout: "1"},
+			true},
+		{"Missing File", Config{Type: TypeFile}, true},
+		{"Unknown Type", Config{Type: "syslog"}, true},
+		{"Webhook", Config{Type: "Webhook", Url: "https://localhost:9000"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(&tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	if d := backoff(0); d != minBackoff {
+		t.Errorf("backoff(0) = %v, want %v", d, minBackoff)
+	}
+	if d := backoff(3); d != 8*minBackoff {
+		t.Errorf("backoff(3) = %v, want %v", d, 8*minBackoff)
+	}
+	if d := backoff(100); d != maxBackoff {
+		t.Errorf("backoff(100) = %v, want %v", d, maxBackoff)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+)
+
+const (
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the body with the
+	// prefix "sha256="
+	SignatureHeader = "X-Cmc-Signature"
+
+	defaultQueueSize = 1024
+	defaultRetries   = 5
+	defaultTimeout   = 10 * time.Second
+	minBackoff       = time.Second
+	maxBackoff       = time.Minute
+	// Time to deliver the queued records on close
+	flushTimeout = 5 * time.Second
+)
+
+// webhook posts the records as JSON to an HTTPS endpoint. The records are
+// queued and delivered by a single worker, so that a slow or dead endpoint
+// cannot block the verification. Records are dropped if the queue is full or
+// all retries failed
+type webhook struct {
+	name    string
+	url     string
+	client  *http.Client
+	key     []byte
+	retries int
+	queue   chan []byte
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+	backoff func(attempt int) time.Duration
+}
+
+func newWebhook(c *Config) (*webhook, error) {
+	u, err := url.Parse(c.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("webhook URL must be an https URL with host")
+	}
+
+	w := &webhook{
+		name:    u.Host,
+		url:     c.Url,
+		retries: defaultRetries,
+		done:    make(chan struct{}),
+		backoff: backoff,
+	}
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return nil, fmt.Errorf("invalid number of retries %v", *c.Retries)
+		}
+		w.retries = *c.Retries
+	}
+	queueSize := defaultQueueSize
+	if c.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid queue size %v", c.QueueSize)
+	} else if c.QueueSize > 0 {
+		queueSize = c.QueueSize
+	}
+	w.queue = make(chan []byte, queueSize)
+
+	timeout := defaultTimeout
+	if c.Timeout != "" {
+		timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse webhook timeout: %w", err)
+		}
+	}
+
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.Ca != "" {
+		data, err := os.ReadFile(c.Ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook CA: %w", err)
+		}
+		cas, err := internal.ParseCertsPem(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse webhook CA: %w", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			tlsConf.RootCAs.AddCert(ca)
+		}
+	}
+	w.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConf},
+	}
+
+	if c.HmacKey != "" {
+		w.key, err = internal.GetSecret(c.HmacKey, "webhook HMAC key")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// start starts the worker delivering the queued records
+func (w *webhook) start() *webhook {
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Publish queues the record for delivery or drops it if the queue is full
+func (w *webhook) Publish(r *Record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Warnf("Failed to marshal verification result: %v", err)
+		metrics.SinkDropped(w.name)
+		return
+	}
+	select {
+	case <-w.done:
+		metrics.SinkDropped(w.name)
+		return
+	default:
+	}
+	select {
+	case w.queue <- data:
+	default:
+		log.Debugf("Dropping verification result for webhook %v: queue full", w.name)
+		metrics.SinkDropped(w.name)
+	}
+}
+
+// Close stops the worker after delivering the queued records without retries
+// within the flush timeout
+func (w *webhook) Close() error {
+	w.once.Do(func() { close(w.done) })
+	w.wg.Wait()
+	return nil
+}
+
+func (w *webhook) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case data := <-w.queue:
+			w.deliver(data)
+		case <-w.done:
+			w.flush()
+			return
+		}
+	}
+}
+
+func (w *webhook) flush() {
+	deadline := time.Now().Add(flushTimeout)
+	for {
+		select {
+		case data := <-w.queue:
+			if time.Now().After(deadline) {
+				metrics.SinkDropped(w.name)
+				continue
+			}
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			err := w.post(ctx, data)
+			cancel()
+			if err != nil {
+				metrics.SinkFailed(w.name)
+				metrics.SinkDropped(w.name)
+			} else {
+				metrics.SinkDelivered(w.name)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// deliver posts the record and retries failed attempts with exponential
+// backoff, unless the endpoint rejected the record
+func (w *webhook) deliver(data []byte) {
+	for attempt := 0; ; attempt++ {
+		err := w.post(context.Background(), data)
+		if err == nil {
+			metrics.SinkDelivered(w.name)
+			return
+		}
+		metrics.SinkFailed(w.name)
+
+		var perm *permanentError
+		if errors.As(err, &perm) || attempt >= w.retries {
+			log.Warnf("Dropping verification result for webhook %v after %v attempts: %v",
+				w.name, attempt+1, err)
+			metrics.SinkDropped(w.name)
+			return
+		}
+		log.Debugf("Failed to deliver verification result to webhook %v: %v", w.name, err)
+
+		select {
+		case <-time.After(w.backoff(attempt)):
+		case <-w.done:
+			metrics.SinkDropped(w.name)
+			return
+		}
+	}
+}
+
+// permanentError is returned for responses, which indicate that a retry of the
+// same request cannot succeed
+type permanentError struct {
+	status string
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("webhook rejected result: %v", e.status)
+}
+
+func (w *webhook) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return &permanentError{status: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.key != nil {
+		req.Header.Set(SignatureHeader, Signature(w.key, data))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return fmt.Errorf("webhook responded with %v", resp.Status)
+	default:
+		return &permanentError{status: resp.Status}
+	}
+}
+
+// Signature returns the value of the signature header for the body, which
+// receivers compare to the HMAC-SHA256 of the received body with the shared key
+func Signature(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// backoff returns the exponential backoff before the retry of the attempt
+func backoff(attempt int) time.Duration {
+	d := minBackoff << attempt
+	if d > maxBackoff || d <= 0 {
+		return maxBackoff
+	}
+	return d
+}
@@ -24,31 +24,20 @@ import (
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path"
-
-	"net/http"
+	"sync"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/Fraunhofer-AISEC/cmc/verify"
 	"github.com/google/go-sev-guest/client"
-	"github.com/sirupsen/logrus"
 )
 
-var log = logrus.WithField("service", "snpdriver")
-
-type certFormat int
-
-const (
-	PEM = iota
-	DER
-)
+var log = internal.NewLogger(internal.SubsystemDrivers, "snpdriver")
 
 const (
 	snpChainFile     = "akchain.pem"
@@ -57,18 +46,23 @@ const (
 )
 
 var (
-	milanUrlVcek = "https://kdsintf.amd.com/vcek/v1/Milan/cert_chain"
-	milanUrlVlek = "https://kdsintf.amd.com/vlek/v1/Milan/cert_chain"
-
+	// Table 9 @ https://www.amd.com/system/files/TechDocs/56421-guest-hypervisor-communication-block-standardization.pdf
+	arkUuid  = []byte{0xc0, 0xb4, 0x06, 0xa4, 0xa8, 0x03, 0x49, 0x52, 0x97, 0x43, 0x3f, 0xb6, 0x01, 0x4c, 0xd0, 0xae}
+	askUuid  = []byte{0x4a, 0xb7, 0xb3, 0x79, 0xbb, 0xac, 0x4f, 0xe4, 0xa0, 0x2f, 0x05, 0xae, 0xf3, 0x27, 0xc7, 0x82}
+	vcekUuid = []byte{0x63, 0xda, 0x75, 0x8d, 0xe6, 0x64, 0x45, 0x64, 0xad, 0xc5, 0xf4, 0xb9, 0x3b, 0xe8, 0xac, 0xcd}
 	vlekUuid = []byte{0xa8, 0x07, 0x4b, 0xc2, 0xa2, 0x5a, 0x48, 0x3e, 0xaa, 0xe6, 0x39, 0xc0, 0x45, 0xa0, 0xb8, 0xa1}
 )
 
 // Snp is a structure required for implementing the Measure method
 // of the attestation report Measurer interface
 type Snp struct {
+	mu               sync.Mutex
 	snpCertChain     []*x509.Certificate
+	snpChainKey      *snpChainKey
 	signingCertChain []*x509.Certificate
 	priv             crypto.PrivateKey
+	storage          string
+	serverAddr       string
 }
 
 type SnpCertTableEntry struct {
@@ -77,6 +71,23 @@ type SnpCertTableEntry struct {
 	Length uint32
 }
 
+// snpCerts contains the DER encoded certificates provided by the host
+// via the extended guest request
+type snpCerts struct {
+	ark  []byte
+	ask  []byte
+	vcek []byte
+	vlek []byte
+}
+
+// snpChainKey identifies the SNP certificate chain, as the VCEK
+// depends on the chip ID and the reported TCB
+type snpChainKey struct {
+	akType verify.AkType
+	chipId [64]byte
+	tcb    uint64
+}
+
 // Init initializaes the SNP driver with the specifified configuration
 func (snp *Snp) Init(c *ar.DriverConfig) error {
 	var err error
@@ -102,6 +113,9 @@ func (snp *Snp) Init(c *ar.DriverConfig) error {
 		}
 	}
 
+	snp.storage = c.StoragePath
+	snp.serverAddr = c.ServerAddr
+
 	if provisioningRequired(c.StoragePath) {
 		// Create new private key for signing
 		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -112,13 +126,17 @@ func (snp *Snp) Init(c *ar.DriverConfig) error {
 
 		// Create IK CSR and fetch new certificate including its chain from EST server
 		snp.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
-			c.ServerAddr)
+			c.ServerAddr, c.BootstrapToken)
 		if err != nil {
 			return fmt.Errorf("failed to get signing cert chain: %w", err)
 		}
 
 		// Fetch SNP certificate chain for VCEK/VLEK (SNP Attestation Key)
-		snp.snpCertChain, err = getSnpCertChain(c.ServerAddr)
+		report, certs, err := getMeasurement(make([]byte, 64))
+		if err != nil {
+			return fmt.Errorf("failed to get SNP report: %w", err)
+		}
+		snp.snpCertChain, err = snp.getSnpCertChain(report, certs)
 		if err != nil {
 			return fmt.Errorf("failed to get SNP cert chain: %w", err)
 		}
@@ -149,15 +167,36 @@ func (snp *Snp) Measure(nonce []byte) (ar.Measurement, error) {
 		return ar.Measurement{}, errors.New("internal error: SNP object is nil")
 	}
 
-	data, err := getMeasurement(nonce)
+	data, certs, err := getMeasurement(nonce)
 	if err != nil {
 		return ar.Measurement{}, fmt.Errorf("failed to get SNP Measurement: %w", err)
 	}
 
+	chain, err := snp.getSnpCertChain(data, certs)
+	if err != nil {
+		snp.mu.Lock()
+		chain = snp.snpCertChain
+		snp.mu.Unlock()
+		if chain == nil {
+			return ar.Measurement{}, fmt.Errorf("failed to get SNP cert chain: %w", err)
+		}
+		log.Warnf("Failed to get SNP cert chain, using stored chain: %v", err)
+	}
+
+	// Record the launch configuration for information. The verifier only uses
+	// the values of the signed report
+	launch, err := verify.GetSnpLaunch(data)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get SNP launch configuration: %w", err)
+	}
+	log.Tracef("SNP guest policy: 0x%x, ID block: %v, author key: %v", launch.Policy,
+		launch.IdBlock, launch.AuthorKey)
+
 	measurement := ar.Measurement{
-		Type:     "SNP Measurement",
-		Evidence: data,
-		Certs:    internal.WriteCertsDer(snp.snpCertChain),
+		Type:      "SNP Measurement",
+		Evidence:  data,
+		Certs:     internal.WriteCertsDer(chain),
+		SnpLaunch: launch,
 	}
 
 	return measurement, nil
@@ -192,56 +231,52 @@ func (snp *Snp) GetCertChain() ([]*x509.Certificate, error) {
 	return snp.signingCertChain, nil
 }
 
-func getMeasurement(nonce []byte) ([]byte, error) {
+// getMeasurement fetches an SNP attestation report via the extended guest
+// request, which additionally returns the certificate table provided by the
+// host. If the extended request is not supported, a plain report is fetched
+func getMeasurement(nonce []byte) ([]byte, []byte, error) {
 
 	if len(nonce) > 64 {
-		return nil, errors.New("user Data must be at most 64 bytes")
+		return nil, nil, errors.New("user Data must be at most 64 bytes")
 	}
 
 	log.Tracef("Generating SNP attestation report with nonce: %v", hex.EncodeToString(nonce))
 
 	d, err := client.OpenDevice()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /dev/sev-guest")
+		return nil, nil, fmt.Errorf("failed to open /dev/sev-guest")
 	}
 	defer d.Close()
 
 	var ud [64]byte
 	copy(ud[:], nonce)
 	//lint:ignore SA1019 will be updated later
-	buf, err := client.GetRawReport(d, ud)
+	buf, certs, err := client.GetRawExtendedReport(d, ud)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get SNP attestation report")
+		log.Debugf("Failed to get extended SNP attestation report, falling back to report: %v", err)
+		//lint:ignore SA1019 will be updated later
+		buf, err = client.GetRawReport(d, ud)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get SNP attestation report")
+		}
+		certs = nil
 	}
 
-	log.Trace("Generated SNP attestation report")
+	log.Tracef("Generated SNP attestation report with certs length %v", len(certs))
 
-	return buf, nil
+	return buf, certs, nil
 }
 
-func getVlek() ([]byte, error) {
-
-	log.Trace("Fetching VLEK via extended attestation report request")
-
-	d, err := client.OpenDevice()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open /dev/sev-guest")
-	}
-	defer d.Close()
-
-	//lint:ignore SA1019 will be updated later
-	_, certs, err := client.GetRawExtendedReport(d, [64]byte{0})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get SNP attestation report")
-	}
+// parseCertTable parses the certificate table returned by the extended
+// guest request
+func parseCertTable(certs []byte) (*snpCerts, error) {
 
-	log.Tracef("Fetched extended SNP attestation report with certs length %v", len(certs))
+	table := &snpCerts{}
 
 	b := bytes.NewBuffer(certs)
 	for {
-		log.Trace("Parsing cert table entry..")
 		var entry SnpCertTableEntry
-		err = binary.Read(b, binary.LittleEndian, &entry)
+		err := binary.Read(b, binary.LittleEndian, &entry)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode cert table entry: %w", err)
 		}
@@ -251,127 +286,172 @@ func getVlek() ([]byte, error) {
 			break
 		}
 
-		log.Tracef("Found cert table entry with UUID %v", hex.EncodeToString(entry.Uuid[:]))
+		log.Tracef("Found cert table entry with UUID %v offset %v length %v",
+			hex.EncodeToString(entry.Uuid[:]), entry.Offset, entry.Length)
 
-		if bytes.Equal(entry.Uuid[:], vlekUuid) {
-			log.Tracef("Found VLEK offset %v length %v", entry.Offset, entry.Length)
-			return certs[entry.Offset : entry.Offset+entry.Length], nil
+		end := uint64(entry.Offset) + uint64(entry.Length)
+		if end > uint64(len(certs)) {
+			return nil, fmt.Errorf("cert table entry %v exceeds table length %v",
+				hex.EncodeToString(entry.Uuid[:]), len(certs))
+		}
+		der := certs[entry.Offset:end]
+
+		switch {
+		case bytes.Equal(entry.Uuid[:], arkUuid):
+			table.ark = der
+		case bytes.Equal(entry.Uuid[:], askUuid):
+			table.ask = der
+		case bytes.Equal(entry.Uuid[:], vcekUuid):
+			table.vcek = der
+		case bytes.Equal(entry.Uuid[:], vlekUuid):
+			table.vlek = der
+		default:
+			log.Tracef("Ignoring unknown cert table entry %v", hex.EncodeToString(entry.Uuid[:]))
 		}
 	}
 
-	return nil, errors.New("could not find VLEK in certificates")
+	return table, nil
 }
 
-func getCerts(url string, format certFormat) ([]*x509.Certificate, int, error) {
-
-	log.Tracef("Requesting Cert from %v", url)
+// getSnpCertChain returns the VCEK or VLEK certificate chain for the report.
+// Certificates provided by the host via the extended guest request are
+// preferred. Otherwise, the VCEK chain is taken from the storage cache or
+// fetched from the AMD KDS and, as a last resort, enrolled via the
+// provisioning server
+func (snp *Snp) getSnpCertChain(report, certs []byte) ([]*x509.Certificate, error) {
 
-	resp, err := http.Get(url)
+	s, err := verify.DecodeSnpReport(report)
 	if err != nil {
-		return nil, 0, fmt.Errorf("error HTTP GET: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, resp.StatusCode, fmt.Errorf("HTTP Response Status: %v (%v)", resp.StatusCode, resp.Status)
+		return nil, fmt.Errorf("failed to decode SNP report: %w", err)
 	}
 
-	content, err := io.ReadAll(resp.Body)
+	// Usually, the VCEK is used to sign the report. However, in cloud environments,
+	// the CSP might disable VCEK usage, instead the VLEK is used.
+	akType, err := verify.GetAkType(s.KeySelection)
 	if err != nil {
-		return nil, resp.StatusCode, fmt.Errorf("failed to read HTTP body: %w", err)
+		return nil, fmt.Errorf("could not determine SNP attestation report attestation key")
+	}
+	key := snpChainKey{
+		akType: akType,
+		chipId: s.ChipId,
+		tcb:    s.ReportedTcb,
 	}
 
-	var data []byte
-	if format == PEM {
-		rest := content
-		var block *pem.Block
-		for {
-			block, rest = pem.Decode(rest)
-			if block == nil {
-				break
-			}
-			data = append(data, block.Bytes...)
+	snp.mu.Lock()
+	defer snp.mu.Unlock()
 
+	var chain []*x509.Certificate
+	if len(certs) > 0 {
+		chain, err = getHostCertChain(certs, akType, snp.storage)
+		if err != nil {
+			log.Warnf("Failed to use host provided SNP certificates: %v", err)
+		} else if chain != nil {
+			log.Trace("Using host provided SNP certificate chain")
 		}
-	} else if format == DER {
-		data = content
-	} else {
-		return nil, resp.StatusCode, fmt.Errorf("internal error: Unknown certificate format %v", format)
 	}
 
-	certs, err := x509.ParseCertificates(data)
-	if err != nil {
-		return nil, resp.StatusCode, fmt.Errorf("failed to parse x509 Certificate: %w", err)
+	if chain == nil && snp.snpChainKey != nil && *snp.snpChainKey == key {
+		return snp.snpCertChain, nil
 	}
-	return certs, resp.StatusCode, nil
+
+	if chain == nil {
+		if akType != verify.VCEK {
+			return nil, errors.New("VLEK not provided by host")
+		}
+		var source string
+		chain, source, err = verify.GetSnpVcekChain(s.ChipId, s.ReportedTcb, snp.storage)
+		if err != nil {
+			log.Warnf("Failed to fetch VCEK chain: %v", err)
+			chain, err = enrollVcek(snp.serverAddr, s.ChipId, s.ReportedTcb, snp.storage)
+			if err != nil {
+				return nil, err
+			}
+			source = "provisioning server"
+		}
+		log.Tracef("Using VCEK chain from %v", source)
+	}
+
+	snp.snpCertChain = chain
+	snp.snpChainKey = &key
+
+	return chain, nil
 }
 
-func getSnpCertChain(addr string) ([]*x509.Certificate, error) {
+// getHostCertChain returns the VCEK or VLEK certificate chain from the
+// certificate table provided by the host. If the table does not contain
+// the attestation key certificate, nil is returned
+func getHostCertChain(certs []byte, akType verify.AkType, cache string,
+) ([]*x509.Certificate, error) {
 
-	// Fetch the SNP attestation report signing key. Usually, this is the VCEK. However,
-	// in cloud environments, the CSP might disable VCEK usage, instead the VLEK is used.
-	// Fetch an initial attestation report to determine which key is used.
-	arRaw, err := getMeasurement(make([]byte, 64))
+	table, err := parseCertTable(certs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get SNP report: %w", err)
+		return nil, err
 	}
-	s, err := verify.DecodeSnpReport(arRaw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode SNP report: %w", err)
+
+	var leaf []byte
+	switch akType {
+	case verify.VCEK:
+		leaf = table.vcek
+	case verify.VLEK:
+		leaf = table.vlek
+	}
+	if leaf == nil {
+		log.Trace("Host did not provide SNP attestation key certificate")
+		return nil, nil
 	}
 
-	akType, err := verify.GetAkType(s.KeySelection)
+	cert, err := x509.ParseCertificate(leaf)
 	if err != nil {
-		return nil, fmt.Errorf("could not determine SNP attestation report attestation key")
+		return nil, fmt.Errorf("failed to parse SNP attestation key certificate: %w", err)
 	}
+	log.Tracef("Parsed host provided certificate CN=%v", cert.Subject.CommonName)
 
-	// TODO mandate server authentication in the future, otherwise
-	// this step has to happen in a secure environment
-	log.Warn("Creating new EST client without server authentication")
-	client := est.NewClient(nil)
-
-	var signingCert *x509.Certificate
-	var caUrl string
-	if akType == verify.VCEK {
-		// VCEK is used, simply request EST enrollment for SNP chip ID and TCB
-		log.Trace("Enrolling VCEK via EST")
-		signingCert, err = client.SnpEnroll(addr, s.ChipId, s.CurrentTcb)
-		if err != nil {
-			return nil, fmt.Errorf("failed to enroll SNP: %w", err)
-		}
-		caUrl = milanUrlVcek
-	} else if akType == verify.VLEK {
-		// VLEK is used, in this case we fetch the VLEK from the host
-		vlek, err := getVlek()
+	var ca []*x509.Certificate
+	if table.ask != nil && table.ark != nil {
+		ca, err = internal.ParseCertsDer([][]byte{table.ask, table.ark})
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch VLEK: %w", err)
+			return nil, fmt.Errorf("failed to parse host provided SNP CA certificates: %w", err)
 		}
-		log.Trace("Parsing VLEK")
-		signingCert, err = x509.ParseCertificate(vlek)
+	} else {
+		ca, err = verify.GetSnpCaChain(akType, cache)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse VLEK")
+			return nil, err
 		}
-		log.Tracef("Successfully parsed VLEK CN=%v", signingCert.Subject.CommonName)
-		caUrl = milanUrlVlek
-	} else {
-		return nil, fmt.Errorf("internal error: signing cert not initialized")
 	}
 
-	// Fetch intermediate CAs and CA depending on signing key (VLEK / VCEK)
-	ca, _, err := getCerts(caUrl, PEM)
+	return append([]*x509.Certificate{cert}, ca...), nil
+}
+
+// enrollVcek fetches the VCEK for the chip ID and TCB via the provisioning
+// server, which retrieves the VCEK from the AMD KDS
+func enrollVcek(addr string, chipId [64]byte, tcb uint64, cache string,
+) ([]*x509.Certificate, error) {
+
+	if addr == "" {
+		return nil, errors.New("provisioning server not configured")
+	}
+
+	// TODO mandate server authentication in the future, otherwise
+	// this step has to happen in a secure environment
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+
+	log.Trace("Enrolling VCEK via EST")
+	vcek, err := client.SnpEnroll(addr, chipId, tcb)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get SNP certificate chain: %w", err)
+		return nil, fmt.Errorf("failed to enroll SNP: %w", err)
 	}
-	if len(ca) != 2 {
-		return nil,
-			fmt.Errorf("failed to get SNP certificate chain. Expected 2 certificates, got %v",
-				len(ca))
+
+	ca, err := verify.GetSnpCaChain(verify.VCEK, cache)
+	if err != nil {
+		return nil, err
 	}
 
-	return append([]*x509.Certificate{signingCert}, ca...), nil
+	return append([]*x509.Certificate{vcek}, ca...), nil
 }
 
 func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
-	addr string,
+	addr, tokenSource string,
 ) ([]*x509.Certificate, error) {
 
 	csr, err := ar.CreateCsr(priv, s, metadata)
@@ -385,6 +465,9 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 	// different CAs for metadata and the EST server authentication
 	log.Warn("Creating new EST client without server authentication")
 	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
 
 	log.Info("Retrieving CA certs")
 	caCerts, err := client.CaCerts(addr)
@@ -405,7 +488,7 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 		return nil, fmt.Errorf("failed to set EST CA: %w", err)
 	}
 
-	cert, err := client.SimpleEnroll(addr, csr)
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to enroll cert: %w", err)
 	}
@@ -442,7 +525,7 @@ func provisioningRequired(p string) bool {
 func loadCredentials(p string) ([]*x509.Certificate, []*x509.Certificate,
 	crypto.PrivateKey, error,
 ) {
-	data, err := os.ReadFile(path.Join(p, snpChainFile))
+	data, err := internal.LoadFile(path.Join(p, snpChainFile))
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to read AK chain from %v: %w", p, err)
 	}
@@ -452,7 +535,7 @@ func loadCredentials(p string) ([]*x509.Certificate, []*x509.Certificate,
 	}
 	log.Tracef("Parsed stored AK chain of length %v", len(akchain))
 
-	data, err = os.ReadFile(path.Join(p, signingChainFile))
+	data, err = internal.LoadFile(path.Join(p, signingChainFile))
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to read IK chain from %v: %w", p, err)
 	}
@@ -462,7 +545,7 @@ func loadCredentials(p string) ([]*x509.Certificate, []*x509.Certificate,
 	}
 	log.Tracef("Parsed stored IK chain of length %v", len(akchain))
 
-	data, err = os.ReadFile(path.Join(p, snpPrivFile))
+	data, err = internal.LoadFile(path.Join(p, snpPrivFile))
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to read SNP private key from %v: %w", p, err)
 	}
@@ -475,21 +558,13 @@ func loadCredentials(p string) ([]*x509.Certificate, []*x509.Certificate,
 }
 
 func saveCredentials(p string, snp *Snp) error {
-	akchainPem := make([]byte, 0)
-	for _, cert := range snp.snpCertChain {
-		c := internal.WriteCertPem(cert)
-		akchainPem = append(akchainPem, c...)
-	}
-	if err := os.WriteFile(path.Join(p, snpChainFile), akchainPem, 0644); err != nil {
+	akchainPem := internal.WriteCertChainPem(snp.snpCertChain)
+	if err := internal.StoreFile(path.Join(p, snpChainFile), akchainPem, 0644); err != nil {
 		return fmt.Errorf("failed to write  %v: %w", path.Join(p, snpChainFile), err)
 	}
 
-	ikchainPem := make([]byte, 0)
-	for _, cert := range snp.signingCertChain {
-		c := internal.WriteCertPem(cert)
-		ikchainPem = append(ikchainPem, c...)
-	}
-	if err := os.WriteFile(path.Join(p, signingChainFile), ikchainPem, 0644); err != nil {
+	ikchainPem := internal.WriteCertChainPem(snp.signingCertChain)
+	if err := internal.StoreFile(path.Join(p, signingChainFile), ikchainPem, 0644); err != nil {
 		return fmt.Errorf("failed to write  %v: %w", path.Join(p, signingChainFile), err)
 	}
 
@@ -497,7 +572,7 @@ func saveCredentials(p string, snp *Snp) error {
 	if err != nil {
 		return fmt.Errorf("failed marshal private key: %w", err)
 	}
-	if err := os.WriteFile(path.Join(p, snpPrivFile), key, 0600); err != nil {
+	if err := internal.StoreFile(path.Join(p, snpPrivFile), key, 0600); err != nil {
 		return fmt.Errorf("failed to write %v: %w", path.Join(p, snpPrivFile), err)
 	}
 
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snpdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func createCertTable(entries map[*[]byte][]byte, offset uint32) []byte {
+	var header, data bytes.Buffer
+	// Header consists of the entries and the terminating zero entry
+	off := uint32(len(entries)+1) * 24
+	for uuid, cert := range entries {
+		entry := SnpCertTableEntry{
+			Offset: off + offset,
+			Length: uint32(len(cert)),
+		}
+		copy(entry.Uuid[:], *uuid)
+		binary.Write(&header, binary.LittleEndian, entry)
+		data.Write(cert)
+		off += uint32(len(cert))
+	}
+	binary.Write(&header, binary.LittleEndian, SnpCertTableEntry{})
+	return append(header.Bytes(), data.Bytes()...)
+}
+
+func Test_parseCertTable(t *testing.T) {
+
+	ark := []byte("ark")
+	ask := []byte("ask")
+	vcek := []byte("vcek")
+	vlek := []byte("vlek")
+
+	tests := []struct {
+		name    string
+		certs   []byte
+		want    snpCerts
+		wantErr bool
+	}{
+		{
+			name: "VCEK Chain",
+			certs: createCertTable(map[*[]byte][]byte{
+				&arkUuid: ark, &askUuid: ask, &vcekUuid: vcek,
+			}, 0),
+			want: snpCerts{ark: ark, ask: ask, vcek: vcek},
+		},
+		{
+			name: "VLEK Only",
+			certs: createCertTable(map[*[]byte][]byte{
+				&vlekUuid: vlek,
+			}, 0),
+			want: snpCerts{vlek: vlek},
+		},
+		{
+			name:  "Empty Table",
+			certs: createCertTable(map[*[]byte][]byte{}, 0),
+			want:  snpCerts{},
+		},
+		{
+			name: "Entry Out Of Bounds",
+			certs: createCertTable(map[*[]byte][]byte{
+				&vcekUuid: vcek,
+			}, 100),
+			wantErr: true,
+		},
+		{
+			name:    "Missing Terminator",
+			certs:   make([]byte, 10),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCertTable(tt.certs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCertTable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got.ark, tt.want.ark) || !bytes.Equal(got.ask, tt.want.ask) ||
+				!bytes.Equal(got.vcek, tt.want.vcek) || !bytes.Equal(got.vlek, tt.want.vlek) {
+				t.Errorf("parseCertTable() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
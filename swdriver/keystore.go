@@ -0,0 +1,370 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swdriver
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyFile         = "sw_key.json"
+	keyStoreVersion = 1
+
+	protectionPassphrase = "passphrase"
+	protectionTpm        = "tpm"
+
+	dataKeySize = 32
+	saltSize    = 32
+	maxScryptN  = 1 << 20
+)
+
+// Scrypt cost parameters for newly encrypted keys. The parameters are stored
+// with the key, so that they can be increased without breaking existing keys
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrWrongPassphrase is returned if the passphrase does not match the
+	// passphrase the key was encrypted with
+	ErrWrongPassphrase = errors.New("wrong passphrase for encrypted key")
+	// ErrKeyTampered is returned if the encrypted key or its parameters were
+	// modified or corrupted
+	ErrKeyTampered = errors.New("encrypted key has been tampered with")
+	// ErrPcrPolicy is returned if the current PCR values do not match the PCR
+	// policy the key was sealed to
+	ErrPcrPolicy = errors.New("PCR values do not match the policy of the sealed key")
+	// ErrPlaintextKey is returned if a plaintext PEM key is found instead of an
+	// encrypted key. Such keys must be converted with MigrateKey
+	ErrPlaintextKey = errors.New("key is stored in plaintext")
+)
+
+// encryptedKey is the at-rest format of the software signing key. The PKCS#8
+// encoded key is encrypted with AES-256-GCM, using all other fields as
+// additional authenticated data. The data encryption key is either derived
+// from a passphrase via scrypt or sealed to the TPM
+type encryptedKey struct {
+	Version    int           `json:"version"`
+	Protection string        `json:"protection"`
+	Scrypt     *scryptParams `json:"scrypt,omitempty"`
+	Tpm        *tpmSealed    `json:"tpm,omitempty"`
+	Nonce      []byte        `json:"nonce"`
+	Ciphertext []byte        `json:"ciphertext,omitempty"`
+}
+
+type scryptParams struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	// Verifier is a hash over the second half of the scrypt output, which
+	// allows distinguishing a wrong passphrase from a tampered ciphertext
+	Verifier []byte `json:"verifier"`
+}
+
+// keyProtector provides the data encryption key for the encrypted key
+type keyProtector interface {
+	// newDataKey creates a new data encryption key and stores the parameters
+	// required for recovering it in k
+	newDataKey(k *encryptedKey) ([]byte, error)
+	// dataKey recovers the data encryption key from the parameters in k
+	dataKey(k *encryptedKey) ([]byte, error)
+	protection() string
+}
+
+type passphraseProtector struct {
+	passphrase []byte
+}
+
+// newKeyProtector returns the key protector configured in the driver config,
+// or nil if the key shall only be kept in memory
+func newKeyProtector(c *ar.DriverConfig) (keyProtector, error) {
+	switch strings.ToLower(c.SwKeyProtection) {
+	case "":
+		return nil, nil
+	case protectionPassphrase:
+		passphrase, err := internal.GetSecret(c.SwKeyPassphrase, "SW driver key passphrase")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key passphrase: %w", err)
+		}
+		return &passphraseProtector{passphrase: passphrase}, nil
+	case protectionTpm:
+		pcrs := c.SwKeyPcrs
+		if len(pcrs) == 0 {
+			pcrs = defaultSealPcrs
+		}
+		return &tpmProtector{pcrs: pcrs}, nil
+	default:
+		return nil, fmt.Errorf("unknown key protection %q", c.SwKeyProtection)
+	}
+}
+
+func (p *passphraseProtector) protection() string {
+	return protectionPassphrase
+}
+
+func (p *passphraseProtector) newDataKey(k *encryptedKey) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to create salt: %w", err)
+	}
+	k.Scrypt = &scryptParams{
+		Salt: salt,
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}
+	key, verifier, err := p.derive(k.Scrypt)
+	if err != nil {
+		return nil, err
+	}
+	k.Scrypt.Verifier = verifier
+	return key, nil
+}
+
+func (p *passphraseProtector) dataKey(k *encryptedKey) ([]byte, error) {
+	if k.Scrypt == nil {
+		return nil, fmt.Errorf("%w: missing scrypt parameters", ErrKeyTampered)
+	}
+	if k.Scrypt.N > maxScryptN || k.Scrypt.R*k.Scrypt.P > 64 {
+		return nil, fmt.Errorf("%w: scrypt parameters exceed limits", ErrKeyTampered)
+	}
+	key, verifier, err := p.derive(k.Scrypt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyTampered, err)
+	}
+	if subtle.ConstantTimeCompare(verifier, k.Scrypt.Verifier) != 1 {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// derive returns the data encryption key and the passphrase verifier
+func (p *passphraseProtector) derive(params *scryptParams) ([]byte, []byte, error) {
+	dk, err := scrypt.Key(p.passphrase, params.Salt, params.N, params.R, params.P, 2*dataKeySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	verifier := sha256.Sum256(dk[dataKeySize:])
+	return dk[:dataKeySize], verifier[:], nil
+}
+
+// encryptKey encrypts the private key with a data encryption key provided by p
+func encryptKey(priv crypto.PrivateKey, p keyProtector) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+
+	k := &encryptedKey{
+		Version:    keyStoreVersion,
+		Protection: p.protection(),
+		Nonce:      make([]byte, 12),
+	}
+	if _, err := rand.Read(k.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	key, err := p.newDataKey(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, aad, err := newAead(key, k)
+	if err != nil {
+		return nil, err
+	}
+	k.Ciphertext = aead.Seal(nil, k.Nonce, der, aad)
+
+	data, err := json.MarshalIndent(k, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal encrypted key: %w", err)
+	}
+	return data, nil
+}
+
+// decryptKey decrypts the private key with the data encryption key
+// recovered by p
+func decryptKey(data []byte, p keyProtector) (crypto.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return nil, ErrPlaintextKey
+	}
+
+	k := new(encryptedKey)
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyTampered, err)
+	}
+	if k.Version != keyStoreVersion {
+		return nil, fmt.Errorf("unsupported key store version %v", k.Version)
+	}
+	if k.Protection != p.protection() {
+		return nil, fmt.Errorf("key is protected with %q, but %q is configured",
+			k.Protection, p.protection())
+	}
+
+	key, err := p.dataKey(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, aad, err := newAead(key, k)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce size", ErrKeyTampered)
+	}
+	der, err := aead.Open(nil, k.Nonce, k.Ciphertext, aad)
+	if err != nil {
+		return nil, ErrKeyTampered
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	if _, ok := priv.(*ecdsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+	return priv, nil
+}
+
+// newAead returns the AES-GCM cipher and the additional authenticated data,
+// which is the encrypted key without the ciphertext
+func newAead(key []byte, k *encryptedKey) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	header := *k
+	header.Ciphertext = nil
+	aad, err := json.Marshal(header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key header: %w", err)
+	}
+	return aead, aad, nil
+}
+
+// loadKey loads and decrypts the key from the storage path. If no key exists,
+// nil is returned
+func loadKey(storagePath string, p keyProtector) (crypto.PrivateKey, error) {
+	data, err := internal.LoadFile(path.Join(storagePath, keyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	return decryptKey(data, p)
+}
+
+// storeKey encrypts and atomically writes the key to the storage path
+func storeKey(storagePath string, priv crypto.PrivateKey, p keyProtector) error {
+	data, err := encryptKey(priv, p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(storagePath, 0755); err != nil {
+		return fmt.Errorf("failed to create storage path: %w", err)
+	}
+	if err := internal.StoreFile(path.Join(storagePath, keyFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	return nil
+}
+
+// MigrateKey converts an existing plaintext ECDSA PEM key (PKCS#8 or SEC 1)
+// into the encrypted format configured in c and stores it in the storage
+// path. The plaintext file is not removed
+func MigrateKey(pemFile string, c *ar.DriverConfig) error {
+	if c.StoragePath == "" {
+		return errors.New("storage path not specified")
+	}
+	p, err := newKeyProtector(c)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errors.New("key protection not specified")
+	}
+
+	if _, err := os.Stat(path.Join(c.StoragePath, keyFile)); err == nil {
+		return fmt.Errorf("encrypted key already exists in %v", c.StoragePath)
+	}
+
+	data, err := os.ReadFile(pemFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", pemFile, err)
+	}
+	priv, err := parsePemKey(data)
+	if err != nil {
+		return err
+	}
+
+	err = storeKey(c.StoragePath, priv, p)
+	if err != nil {
+		return fmt.Errorf("failed to store encrypted key: %w", err)
+	}
+
+	log.Infof("Migrated %v to encrypted key %v", pemFile, path.Join(c.StoragePath, keyFile))
+
+	return nil
+}
+
+func parsePemKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM key")
+	}
+	var priv crypto.PrivateKey
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %v", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PEM key: %w", err)
+	}
+	if _, ok := priv.(*ecdsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("unsupported key type %T (only ECDSA keys are supported)", priv)
+	}
+	return priv, nil
+}
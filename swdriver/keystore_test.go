@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swdriver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	legacy "github.com/google/go-tpm/legacy/tpm2"
+)
+
+func init() {
+	// Reduce the scrypt cost for the tests
+	scryptN = 1 << 10
+}
+
+func TestDecryptKey(t *testing.T) {
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p := &passphraseProtector{passphrase: []byte("correct horse battery staple")}
+	data, err := encryptKey(priv, p)
+	if err != nil {
+		t.Fatalf("encryptKey() error = %v", err)
+	}
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustPkcs8(t, priv)})
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		wantErr    error
+	}{
+		{"Valid", data, "correct horse battery staple", nil},
+		{"Wrong Passphrase", data, "Tr0ub4dor&3", ErrWrongPassphrase},
+		{"Tampered Ciphertext", tamper(t, data, func(k *encryptedKey) { k.Ciphertext[0] ^= 0x01 }),
+			"correct horse battery staple", ErrKeyTampered},
+		{"Tampered Nonce", tamper(t, data, func(k *encryptedKey) { k.Nonce[0] ^= 0x01 }),
+			"correct horse battery staple", ErrKeyTampered},
+		{"Truncated Ciphertext", tamper(t, data, func(k *encryptedKey) { k.Ciphertext = k.Ciphertext[:16] }),
+			"correct horse battery staple", ErrKeyTampered},
+		{"Missing Parameters", tamper(t, data, func(k *encryptedKey) { k.Scrypt = nil }),
+			"correct horse battery staple", ErrKeyTampered},
+		{"Excessive Cost", tamper(t, data, func(k *encryptedKey) { k.Scrypt.N = 1 << 30 }),
+			"correct horse battery staple", ErrKeyTampered},
+		{"Corrupted", data[:len(data)/2], "correct horse battery staple", ErrKeyTampered},
+		{"Plaintext", pemKey, "correct horse battery staple", ErrPlaintextKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptKey(tt.data, &passphraseProtector{passphrase: []byte(tt.passphrase)})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decryptKey() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !got.(*ecdsa.PrivateKey).Equal(priv) {
+				t.Errorf("decryptKey() returned different key")
+			}
+		})
+	}
+}
+
+func TestMigrateKey(t *testing.T) {
+
+	dir := t.TempDir()
+	t.Setenv("CMC_TEST_PASSPHRASE", "secret")
+	c := &ar.DriverConfig{
+		StoragePath:     path.Join(dir, "storage"),
+		SwKeyProtection: "passphrase",
+		SwKeyPassphrase: "env:CMC_TEST_PASSPHRASE",
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := path.Join(dir, "key.pem")
+	err = os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateKey(pemFile, c)
+	if err != nil {
+		t.Fatalf("MigrateKey() error = %v", err)
+	}
+	got, err := loadKey(c.StoragePath, &passphraseProtector{passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatalf("loadKey() error = %v", err)
+	}
+	if !got.(*ecdsa.PrivateKey).Equal(priv) {
+		t.Errorf("loadKey() returned different key")
+	}
+
+	// The migrated key must not be overwritten
+	if err := MigrateKey(pemFile, c); err == nil {
+		t.Errorf("MigrateKey() overwrote existing key")
+	}
+
+	// A plaintext key in the storage path must be reported as such
+	os.Rename(pemFile, path.Join(c.StoragePath, keyFile))
+	_, err = loadKey(c.StoragePath, &passphraseProtector{passphrase: []byte("secret")})
+	if !errors.Is(err, ErrPlaintextKey) {
+		t.Errorf("loadKey() error = %v, want %v", err, ErrPlaintextKey)
+	}
+}
+
+// TestTpmProtector requires a TPM simulator, e.g. swtpm started with
+// swtpm socket --tpm2 --server type=unixio,path=/tmp/swtpm --flags startup-clear
+// and TPM_SIMULATOR=/tmp/swtpm. Otherwise the test is skipped
+func TestTpmProtector(t *testing.T) {
+
+	sock := os.Getenv("TPM_SIMULATOR")
+	if sock == "" {
+		t.Skip("TPM_SIMULATOR not set")
+	}
+	orig := openTpm
+	openTpm = func() (io.ReadWriteCloser, error) { return legacy.OpenTPM(sock) }
+	defer func() { openTpm = orig }()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	const pcr = 16
+	p := &tpmProtector{pcrs: []int{pcr}}
+	data, err := encryptKey(priv, p)
+	if err != nil {
+		t.Fatalf("encryptKey() error = %v", err)
+	}
+
+	got, err := decryptKey(data, p)
+	if err != nil {
+		t.Fatalf("decryptKey() error = %v", err)
+	}
+	if !got.(*ecdsa.PrivateKey).Equal(priv) {
+		t.Errorf("decryptKey() returned different key")
+	}
+
+	tampered := tamper(t, data, func(k *encryptedKey) { k.Tpm.Private[len(k.Tpm.Private)-1] ^= 0x01 })
+	if _, err := decryptKey(tampered, p); !errors.Is(err, ErrKeyTampered) {
+		t.Errorf("decryptKey() of tampered key error = %v, want %v", err, ErrKeyTampered)
+	}
+
+	// Extending the PCR must prevent unsealing
+	rwc, err := openTpm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = legacy.PCRExtend(rwc, pcr, legacy.AlgSHA256, make([]byte, 32), "")
+	rwc.Close()
+	if err != nil {
+		t.Fatalf("failed to extend PCR: %v", err)
+	}
+	if _, err := decryptKey(data, p); !errors.Is(err, ErrPcrPolicy) {
+		t.Errorf("decryptKey() after PCR extend error = %v, want %v", err, ErrPcrPolicy)
+	}
+}
+
+func mustPkcs8(t *testing.T, priv *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func tamper(t *testing.T, data []byte, f func(k *encryptedKey)) []byte {
+	k := new(encryptedKey)
+	if err := json.Unmarshal(data, k); err != nil {
+		t.Fatal(err)
+	}
+	f(k)
+	tampered, err := json.Marshal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tampered
+}
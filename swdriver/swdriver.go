@@ -25,27 +25,43 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
-	"github.com/sirupsen/logrus"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+	"golang.org/x/exp/maps"
 )
 
 var (
-	log = logrus.WithField("service", "swdriver")
+	log = internal.NewLogger(internal.SubsystemDrivers, "swdriver")
 )
 
 // Sw is a struct required for implementing the signer and measurer interfaces
 // of the attestation report to perform software measurements and signing
 type Sw struct {
+	mu         sync.RWMutex
 	certChain  []*x509.Certificate
 	priv       crypto.PrivateKey
 	useCtr     bool
 	ctrPcr     int
 	ctrLog     string
 	serializer ar.Serializer
+	metadata   [][]byte
+	serverAddr string
+	storage    string
+	protector  keyProtector
+	profiles   map[string]*profileCreds
+}
+
+// profileCreds are the key and the certificate chain of a certificate profile
+type profileCreds struct {
+	separateKey bool
+	priv        crypto.PrivateKey
+	certChain   []*x509.Certificate
 }
 
 // Init a new object for software-based signing
@@ -54,6 +70,7 @@ func (s *Sw) Init(c *ar.DriverConfig) error {
 	if s == nil {
 		return errors.New("internal error: SW object is nil")
 	}
+	var err error
 
 	// Check if serializer is initialized
 	switch c.Serializer.(type) {
@@ -63,23 +80,77 @@ func (s *Sw) Init(c *ar.DriverConfig) error {
 		return fmt.Errorf("serializer not initialized in driver config")
 	}
 
-	// Create new private key for signing
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// If key protection is configured, the key is persisted encrypted in the
+	// storage path, otherwise it is only kept in memory
+	s.protector, err = newKeyProtector(c)
 	if err != nil {
-		return fmt.Errorf("failed to generate private key: %w", err)
+		return fmt.Errorf("failed to initialize key protection: %w", err)
+	}
+	if s.protector != nil && c.StoragePath == "" {
+		return errors.New("SW driver key protection requires a storage path")
+	}
+	s.storage = c.StoragePath
+
+	var priv crypto.PrivateKey
+	if s.protector != nil {
+		timer := metrics.Start("sw", metrics.OpKeyLoad)
+		priv, err = loadKey(s.storage, s.protector)
+		timer.Done(err)
+		if err != nil {
+			return fmt.Errorf("failed to load SW driver key: %w", err)
+		}
+	}
+	if priv == nil {
+		// Create new private key for signing
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		if s.protector != nil {
+			err = storeKey(s.storage, priv, s.protector)
+			if err != nil {
+				return fmt.Errorf("failed to store SW driver key: %w", err)
+			}
+			log.Infof("Created new %v-protected SW driver key", s.protector.protection())
+		}
+	} else {
+		log.Infof("Loaded %v-protected SW driver key", s.protector.protection())
 	}
 	s.priv = priv
 
 	// Create CSR and fetch new certificate including its chain from EST server
-	s.certChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata, c.ServerAddr)
+	s.certChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata, c.ServerAddr,
+		c.BootstrapToken, c.Attest)
 	if err != nil {
 		return fmt.Errorf("failed to get signing cert chain: %w", err)
 	}
 
+	// Enroll the certificates of the additional profiles authenticated with the
+	// signing certificate. Separate profile keys are only kept in memory
+	s.profiles = make(map[string]*profileCreds)
+	for _, p := range c.CertProfiles {
+		creds := &profileCreds{separateKey: p.SeparateKey, priv: priv}
+		if p.SeparateKey {
+			creds.priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return fmt.Errorf("failed to generate private key: %w", err)
+			}
+		}
+		creds.certChain, err = enrollProfile(c.ServerAddr, p.Name, s.certChain, priv, creds.priv,
+			c.Serializer, c.Metadata)
+		if err != nil {
+			return fmt.Errorf("failed to enroll certificate profile %v: %w", p.Name, err)
+		}
+		s.profiles[p.Name] = creds
+		log.Infof("Enrolled certificate profile %v", p.Name)
+	}
+
 	s.useCtr = c.UseCtr && strings.EqualFold(c.CtrDriver, "sw")
 	s.ctrLog = c.CtrLog
 	s.ctrPcr = c.CtrPcr
 	s.serializer = c.Serializer
+	s.metadata = c.Metadata
+	s.serverAddr = c.ServerAddr
 
 	return nil
 }
@@ -102,6 +173,8 @@ func (s *Sw) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
 	if s == nil {
 		return nil, nil, errors.New("internal error: SW object is nil")
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.priv, &s.priv.(*ecdsa.PrivateKey).PublicKey, nil
 }
 
@@ -109,10 +182,177 @@ func (s *Sw) GetCertChain() ([]*x509.Certificate, error) {
 	if s == nil {
 		return nil, errors.New("internal error: SW object is nil")
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	log.Tracef("Returning %v certificates", len(s.certChain))
 	return s.certChain, nil
 }
 
+// GetProfileSigningKeys implements the attestation report ProfileProvider
+// interface and returns the keys of the certificate profile
+func (s *Sw) GetProfileSigningKeys(profile string) (crypto.PrivateKey, crypto.PublicKey, error) {
+	if s == nil {
+		return nil, nil, errors.New("internal error: SW object is nil")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profiles[profile]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown certificate profile %v", profile)
+	}
+	return p.priv, &p.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+// GetProfileCertChain implements the attestation report ProfileProvider
+// interface and returns the certificate chain of the certificate profile
+func (s *Sw) GetProfileCertChain(profile string) ([]*x509.Certificate, error) {
+	if s == nil {
+		return nil, errors.New("internal error: SW object is nil")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown certificate profile %v", profile)
+	}
+	return p.certChain, nil
+}
+
+// Status implements the attestation report StatusProvider interface. Key
+// algorithm and certificate are derived from the signing key and chain
+func (s *Sw) Status() ar.DriverStatus {
+	return ar.DriverStatus{
+		MeasurementTypes: []string{"SW Measurement"},
+	}
+}
+
+// Expiry implements the attestation report Renewer interface and returns the
+// earliest expiry of the signing and the profile certificates
+func (s *Sw) Expiry() (time.Time, error) {
+	if s == nil {
+		return time.Time{}, errors.New("internal error: SW object is nil")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certChain) == 0 {
+		return time.Time{}, errors.New("no certificates present")
+	}
+	expiry := s.certChain[0].NotAfter
+	for _, p := range s.profiles {
+		if p.certChain[0].NotAfter.Before(expiry) {
+			expiry = p.certChain[0].NotAfter
+		}
+	}
+	return expiry, nil
+}
+
+// Renew implements the attestation report Renewer interface. It re-enrolls the
+// existing key or a newly created key, if rotateKeys is set, authenticated with
+// the current certificate. If the EST server requires a new key, the key is
+// rotated regardless of rotateKeys
+func (s *Sw) Renew(rotateKeys bool) error {
+	if s == nil {
+		return errors.New("internal error: SW object is nil")
+	}
+
+	s.mu.RLock()
+	priv := s.priv
+	currentChain := s.certChain
+	s.mu.RUnlock()
+
+	newKey := priv
+	if rotateKeys {
+		var err error
+		newKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+	}
+
+	certChain, err := s.reenroll(currentChain, priv, newKey)
+	if errors.Is(err, est.ErrNewKeyRequired) && !rotateKeys {
+		log.Info("EST server requires a new key, rotating SW driver key")
+		rotateKeys = true
+		newKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate private key: %w", err)
+		}
+		certChain, err = s.reenroll(currentChain, priv, newKey)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to re-enroll signing cert chain: %w", err)
+	}
+
+	// Only replace the stored key once the new key has been enrolled
+	if rotateKeys && s.protector != nil {
+		err = storeKey(s.storage, newKey, s.protector)
+		if err != nil {
+			return fmt.Errorf("failed to store rotated SW driver key: %w", err)
+		}
+	}
+
+	s.setCredentials(newKey, certChain)
+
+	log.Infof("Renewed SW certificate, new expiry: %v", certChain[0].NotAfter)
+
+	// Renew the profile certificates. Profiles without separate key use the
+	// rotated signing key
+	s.mu.RLock()
+	profiles := maps.Clone(s.profiles)
+	s.mu.RUnlock()
+	for name, p := range profiles {
+		profileKey := newKey
+		if p.separateKey {
+			profileKey = p.priv
+			if rotateKeys {
+				profileKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				if err != nil {
+					return fmt.Errorf("failed to generate private key: %w", err)
+				}
+			}
+		}
+		desired, err := ar.CreateCsr(profileKey, s.serializer, s.metadata)
+		if err != nil {
+			return fmt.Errorf("failed to create CSR: %w", err)
+		}
+		chain, err := est.ReenrollProfile(s.serverAddr, name, p.certChain, p.priv, profileKey,
+			desired)
+		if err != nil {
+			return fmt.Errorf("failed to re-enroll certificate profile %v: %w", name, err)
+		}
+		s.mu.Lock()
+		s.profiles[name] = &profileCreds{separateKey: p.separateKey, priv: profileKey,
+			certChain: chain}
+		s.mu.Unlock()
+
+		log.Infof("Renewed SW certificate profile %v, new expiry: %v", name, chain[0].NotAfter)
+	}
+
+	return nil
+}
+
+// reenroll renews the current certificate chain for the new key, which can be
+// the current key
+func (s *Sw) reenroll(currentChain []*x509.Certificate, priv, newKey crypto.PrivateKey,
+) ([]*x509.Certificate, error) {
+
+	desired, err := ar.CreateCsr(newKey, s.serializer, s.metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	return est.Reenroll(s.serverAddr, currentChain, priv, newKey, desired)
+}
+
+// setCredentials replaces the signing key and certificate chain. Signing
+// operations with the previous key which are in progress are not affected
+func (s *Sw) setCredentials(priv crypto.PrivateKey, certChain []*x509.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.priv = priv
+	s.certChain = certChain
+}
+
 func (s *Sw) Measure(nonce []byte) (ar.Measurement, error) {
 
 	log.Trace("Collecting SW measurements")
@@ -121,8 +361,15 @@ func (s *Sw) Measure(nonce []byte) (ar.Measurement, error) {
 		return ar.Measurement{}, errors.New("sw driver specified but use containers equals false")
 	}
 
+	certChain, err := s.GetCertChain()
+	if err != nil {
+		return ar.Measurement{}, err
+	}
+
 	// For the swdriver, the evidence is simply the signed nonce
+	timer := metrics.Start("sw", metrics.OpSign)
 	evidence, err := s.serializer.Sign(nonce, s)
+	timer.Done(err)
 	if err != nil {
 		return ar.Measurement{}, fmt.Errorf("failed to sign sw evidence: %w", err)
 	}
@@ -130,14 +377,14 @@ func (s *Sw) Measure(nonce []byte) (ar.Measurement, error) {
 	measurement := ar.Measurement{
 		Type:     "SW Measurement",
 		Evidence: evidence,
-		Certs:    internal.WriteCertsDer(s.certChain),
+		Certs:    internal.WriteCertsDer(certChain),
 	}
 
 	log.Tracef("Reading container measurements")
 	if _, err := os.Stat(s.ctrLog); err == nil {
 
 		// If CMC container measurements are used, add the list of executed containers
-		data, err := os.ReadFile(s.ctrLog)
+		data, err := internal.LoadFile(s.ctrLog)
 		if err != nil {
 			return ar.Measurement{}, fmt.Errorf("failed to read container measurements: %w", err)
 		}
@@ -160,6 +407,7 @@ func (s *Sw) Measure(nonce []byte) (ar.Measurement, error) {
 				CtrData: &ar.CtrData{
 					ConfigSha256: ml.ConfigSha256,
 					RootfsSha256: ml.RootfsSha256,
+					Restored:     ml.Restored,
 				},
 			}
 			artifact.Events = append(artifact.Events, event)
@@ -175,7 +423,7 @@ func (s *Sw) Measure(nonce []byte) (ar.Measurement, error) {
 }
 
 func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
-	addr string,
+	addr, tokenSource string, attest func(nonce []byte) ([]byte, error),
 ) ([]*x509.Certificate, error) {
 
 	csr, err := ar.CreateCsr(priv, s, metadata)
@@ -189,6 +437,9 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 	// different CAs for metadata and the EST server authentication
 	log.Warn("Creating new EST client without server authentication")
 	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
 
 	log.Info("Retrieving CA certs")
 	caCerts, err := client.CaCerts(addr)
@@ -209,10 +460,42 @@ func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]b
 		return nil, fmt.Errorf("failed to set EST CA: %w", err)
 	}
 
-	cert, err := client.SimpleEnroll(addr, csr)
+	var cert *x509.Certificate
+	if attest != nil {
+		log.Info("Enrolling cert with attestation report")
+		cert, err = client.AttestEnroll(addr, csr, priv, attest)
+	} else {
+		cert, err = client.BoundSimpleEnroll(addr, csr, priv)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to enroll cert: %w", err)
 	}
 
 	return append([]*x509.Certificate{cert}, caCerts...), nil
 }
+
+// enrollProfile enrolls a certificate of the profile for the key, authenticated
+// with the signing certificate chain and key
+func enrollProfile(addr, profile string, chain []*x509.Certificate, priv, key crypto.PrivateKey,
+	s ar.Serializer, metadata [][]byte,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(key, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	client := est.NewClient([]*x509.Certificate{chain[len(chain)-1]})
+	err = client.SetClientCertificate(chain, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set client certificate: %w", err)
+	}
+	client.SetProfile(profile)
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, chain[1:]...), nil
+}
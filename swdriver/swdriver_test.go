@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+)
+
+func createCredentials(t *testing.T) (*ecdsa.PrivateKey, []*x509.Certificate) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SW Signing Key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return priv, []*x509.Certificate{cert}
+}
+
+// TestConcurrentSigning must be run with -race. It signs from many goroutines
+// while the credentials are replaced as during certificate renewal
+func TestConcurrentSigning(t *testing.T) {
+
+	const goroutines = 32
+	const iterations = 50
+
+	priv, chain := createCredentials(t)
+	s := &Sw{priv: priv, certChain: chain}
+
+	digest := sha256.Sum256([]byte("data"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				key, pub, err := s.GetSigningKeys()
+				if err != nil {
+					errs <- err
+					return
+				}
+				sig, err := key.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+					t.Errorf("signature does not match the returned public key")
+					return
+				}
+				if _, err := s.GetCertChain(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		s.setCredentials(createCredentials(t))
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent signing failed: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	m := metrics.EnableDriverMetrics(metrics.NewRegistry())
+	signs := m.Duration(metrics.OpSign).Count("sw")
+	loads := m.Duration(metrics.OpKeyLoad).Count("sw")
+	loadErrs := m.Errors.Value("sw", metrics.OpKeyLoad)
+
+	// Signing the evidence is recorded as sign operation
+	priv, chain := createCredentials(t)
+	s := &Sw{priv: priv, certChain: chain, useCtr: true, serializer: ar.JsonSerializer{},
+		ctrLog: path.Join(t.TempDir(), "missing")}
+	if _, err := s.Measure([]byte("nonce")); err != nil {
+		t.Fatalf("Measure() error = %v", err)
+	}
+	if got := m.Duration(metrics.OpSign).Count("sw"); got != signs+1 {
+		t.Errorf("sign count = %v, want %v", got, signs+1)
+	}
+	if got := m.Errors.Value("sw", metrics.OpSign); got != 0 {
+		t.Errorf("sign errors = %v, want 0", got)
+	}
+
+	// Loading a corrupted key is recorded as failed key load
+	storage := t.TempDir()
+	if err := os.WriteFile(path.Join(storage, keyFile), []byte("invalid"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	t.Setenv("CMC_TEST_SW_PASSPHRASE", "passphrase")
+	err := (&Sw{}).Init(&ar.DriverConfig{
+		Serializer:      ar.JsonSerializer{},
+		StoragePath:     storage,
+		SwKeyProtection: protectionPassphrase,
+		SwKeyPassphrase: "env:CMC_TEST_SW_PASSPHRASE",
+	})
+	if err == nil {
+		t.Fatalf("Init() with corrupted key succeeded")
+	}
+	if got := m.Duration(metrics.OpKeyLoad).Count("sw"); got != loads+1 {
+		t.Errorf("key load count = %v, want %v", got, loads+1)
+	}
+	if got := m.Errors.Value("sw", metrics.OpKeyLoad); got != loadErrs+1 {
+		t.Errorf("key load errors = %v, want %v", got, loadErrs+1)
+	}
+}
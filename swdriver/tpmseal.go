@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swdriver
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	legacy "github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	sessionNonceSize = 16
+	sessionKeyBits   = 128
+)
+
+// defaultSealPcrs are the PCRs the key is sealed to if not configured otherwise
+var defaultSealPcrs = []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+// openTpm opens the TPM used for sealing. Can be replaced for testing
+var openTpm = func() (io.ReadWriteCloser, error) {
+	for _, addr := range []string{"/dev/tpmrm0", "/dev/tpm0"} {
+		if _, err := os.Stat(addr); err == nil {
+			return legacy.OpenTPM(addr)
+		}
+	}
+	return nil, errors.New("failed to find TPM device in /dev")
+}
+
+// tpmSealed contains the data encryption key sealed to the TPM SRK with a
+// policy over the current values of the PCRs
+type tpmSealed struct {
+	Pcrs    []int  `json:"pcrs"`
+	Public  []byte `json:"public"`
+	Private []byte `json:"private"`
+}
+
+// tpmProtector seals the data encryption key to the TPM. The sealed object can
+// only be unsealed on the same TPM with the same PCR values. Sealing and
+// unsealing is performed within salted sessions, so that the data encryption
+// key is never transmitted in plaintext over the TPM bus
+type tpmProtector struct {
+	pcrs []int
+}
+
+func (p *tpmProtector) protection() string {
+	return protectionTpm
+}
+
+func (p *tpmProtector) newDataKey(k *encryptedKey) ([]byte, error) {
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to create data key: %w", err)
+	}
+
+	t, srk, srkPub, closer, err := openSrk()
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	sel, err := pcrSelection(p.pcrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Calculate the policy over the current PCR values with a trial session
+	trial, closeTrial, err := tpm2.PolicySession(t, tpm2.TPMAlgSHA256, sessionNonceSize, tpm2.Trial())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start trial session: %w", err)
+	}
+	defer closeTrial()
+	_, err = tpm2.PolicyPCR{PolicySession: trial.Handle(), Pcrs: sel}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate PCR policy: %w", err)
+	}
+	policy, err := tpm2.PolicyGetDigest{PolicySession: trial.Handle()}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy digest: %w", err)
+	}
+
+	rsp, err := tpm2.Create{
+		ParentHandle: tpm2.AuthHandle{
+			Handle: srk.Handle,
+			Name:   srk.Name,
+			Auth: tpm2.HMAC(tpm2.TPMAlgSHA256, sessionNonceSize,
+				tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptIn),
+				tpm2.Salted(srk.Handle, *srkPub)),
+		},
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: key}),
+			},
+		},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:    true,
+				FixedParent: true,
+				NoDA:        true,
+			},
+			AuthPolicy: policy.PolicyDigest,
+		}),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal data key: %w", err)
+	}
+
+	k.Tpm = &tpmSealed{
+		Pcrs:    p.pcrs,
+		Public:  rsp.OutPublic.Bytes(),
+		Private: rsp.OutPrivate.Buffer,
+	}
+
+	log.Debugf("Sealed SW driver key to TPM PCRs %v", p.pcrs)
+
+	return key, nil
+}
+
+func (p *tpmProtector) dataKey(k *encryptedKey) ([]byte, error) {
+
+	if k.Tpm == nil {
+		return nil, fmt.Errorf("%w: missing sealed TPM object", ErrKeyTampered)
+	}
+
+	t, srk, srkPub, closer, err := openSrk()
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	sel, err := pcrSelection(k.Tpm.Pcrs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyTampered, err)
+	}
+
+	loaded, err := tpm2.Load{
+		ParentHandle: tpm2.AuthHandle{Handle: srk.Handle, Name: srk.Name, Auth: tpm2.PasswordAuth(nil)},
+		InPrivate:    tpm2.TPM2BPrivate{Buffer: k.Tpm.Private},
+		InPublic:     tpm2.BytesAs2B[tpm2.TPMTPublic](k.Tpm.Public),
+	}.Execute(t)
+	if errors.Is(err, tpm2.TPMRCIntegrity) || errors.Is(err, tpm2.TPMRCSize) ||
+		errors.Is(err, tpm2.TPMRCBinding) {
+		return nil, fmt.Errorf("%w: %v", ErrKeyTampered, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load sealed data key: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: loaded.ObjectHandle}.Execute(t)
+
+	sess, closeSess, err := tpm2.PolicySession(t, tpm2.TPMAlgSHA256, sessionNonceSize,
+		tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptOut),
+		tpm2.Salted(srk.Handle, *srkPub))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start policy session: %w", err)
+	}
+	defer closeSess()
+	_, err = tpm2.PolicyPCR{PolicySession: sess.Handle(), Pcrs: sel}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute PCR policy: %w", err)
+	}
+
+	rsp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{Handle: loaded.ObjectHandle, Name: loaded.Name, Auth: sess},
+	}.Execute(t)
+	if errors.Is(err, tpm2.TPMRCPolicyFail) {
+		return nil, ErrPcrPolicy
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to unseal data key: %w", err)
+	}
+	if len(rsp.OutData.Buffer) != dataKeySize {
+		return nil, fmt.Errorf("%w: invalid data key size", ErrKeyTampered)
+	}
+
+	return rsp.OutData.Buffer, nil
+}
+
+// openSrk opens the TPM and creates the transient ECC SRK from the TCG
+// reference template, which is also used as the salt key for the sessions
+func openSrk() (transport.TPM, tpm2.NamedHandle, *tpm2.TPMTPublic, func(), error) {
+
+	rwc, err := openTpm()
+	if err != nil {
+		return nil, tpm2.NamedHandle{}, nil, nil, fmt.Errorf("failed to open TPM: %w", err)
+	}
+	t := transport.FromReadWriter(rwc)
+
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(t)
+	if err != nil {
+		rwc.Close()
+		return nil, tpm2.NamedHandle{}, nil, nil, fmt.Errorf("failed to create SRK: %w", err)
+	}
+	closer := func() {
+		tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(t)
+		rwc.Close()
+	}
+
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		closer()
+		return nil, tpm2.NamedHandle{}, nil, nil, fmt.Errorf("failed to decode SRK public: %w", err)
+	}
+
+	return t, tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name}, pub, closer, nil
+}
+
+func pcrSelection(pcrs []int) (tpm2.TPMLPCRSelection, error) {
+	if len(pcrs) == 0 {
+		return tpm2.TPMLPCRSelection{}, errors.New("no PCRs specified")
+	}
+	bitmap := make([]byte, 3)
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= 8*len(bitmap) {
+			return tpm2.TPMLPCRSelection{}, fmt.Errorf("invalid PCR %v", pcr)
+		}
+		bitmap[pcr/8] |= 1 << (pcr % 8)
+	}
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{{
+			Hash:      tpm2.TPMAlgSHA256,
+			PCRSelect: bitmap,
+		}},
+	}, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tdxdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Message types and header of the quote generation service (QGS) protocol,
+// see qgs_msg_lib.h of the Intel SGX DCAP library
+const (
+	qgsMajorVersion  = 1
+	qgsMinorVersion  = 0
+	qgsGetQuoteReq   = 0
+	qgsGetQuoteResp  = 1
+	qgsHeaderSize    = 16
+	qgsMaxMsgSize    = 64 * 1024
+	qgsTimeout       = 30 * time.Second
+	tdReportSize     = 1024
+	qgsReqHeaderSize = qgsHeaderSize + 8
+)
+
+type qgsMsgHeader struct {
+	MajorVersion uint16
+	MinorVersion uint16
+	Type         uint32
+	Size         uint32
+	ErrorCode    uint32
+}
+
+// getQgsQuote converts the TDREPORT into a quote via the QGS on the host,
+// which is reachable via vsock
+func getQgsQuote(addr string, report []byte) ([]byte, error) {
+	conn, err := internal.Dial("vsock", addr, qgsTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QGS %v: %w", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(qgsTimeout))
+
+	return qgsQuote(conn, report)
+}
+
+// qgsQuote sends a get quote request with the TDREPORT over the connection
+// and returns the quote of the response. Each message is prefixed with its
+// size as 4 byte big endian integer
+func qgsQuote(conn io.ReadWriter, report []byte) ([]byte, error) {
+
+	if len(report) != tdReportSize {
+		return nil, fmt.Errorf("invalid TDREPORT size %v (expected %v)", len(report), tdReportSize)
+	}
+
+	req := new(bytes.Buffer)
+	binary.Write(req, binary.LittleEndian, qgsMsgHeader{
+		MajorVersion: qgsMajorVersion,
+		MinorVersion: qgsMinorVersion,
+		Type:         qgsGetQuoteReq,
+		Size:         uint32(qgsReqHeaderSize + len(report)),
+	})
+	binary.Write(req, binary.LittleEndian, uint32(len(report)))
+	binary.Write(req, binary.LittleEndian, uint32(0))
+	req.Write(report)
+
+	msg := make([]byte, 4, 4+req.Len())
+	binary.BigEndian.PutUint32(msg, uint32(req.Len()))
+	if _, err := conn.Write(append(msg, req.Bytes()...)); err != nil {
+		return nil, fmt.Errorf("failed to send QGS request: %w", err)
+	}
+
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("failed to read QGS response size: %w", err)
+	}
+	if size < qgsHeaderSize+8 || size > qgsMaxMsgSize {
+		return nil, fmt.Errorf("invalid QGS response size %v", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read QGS response: %w", err)
+	}
+
+	return parseQgsResponse(resp)
+}
+
+func parseQgsResponse(resp []byte) ([]byte, error) {
+
+	buf := bytes.NewReader(resp)
+	var header qgsMsgHeader
+	if err := binary.Read(buf, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse QGS response header: %w", err)
+	}
+	if header.MajorVersion != qgsMajorVersion {
+		return nil, fmt.Errorf("unsupported QGS version %v.%v", header.MajorVersion,
+			header.MinorVersion)
+	}
+	if header.Type != qgsGetQuoteResp {
+		return nil, fmt.Errorf("unexpected QGS message type %v", header.Type)
+	}
+	if header.Size != uint32(len(resp)) {
+		return nil, fmt.Errorf("QGS message size %v does not match response size %v",
+			header.Size, len(resp))
+	}
+	if header.ErrorCode != 0 {
+		return nil, fmt.Errorf("QGS returned error code 0x%x", header.ErrorCode)
+	}
+
+	var idSize, quoteSize uint32
+	if err := binary.Read(buf, binary.LittleEndian, &idSize); err != nil {
+		return nil, fmt.Errorf("failed to parse QGS selected ID size: %w", err)
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &quoteSize); err != nil {
+		return nil, fmt.Errorf("failed to parse QGS quote size: %w", err)
+	}
+	if uint64(idSize)+uint64(quoteSize) != uint64(buf.Len()) {
+		return nil, fmt.Errorf("QGS ID size %v and quote size %v do not match remaining %v bytes",
+			idSize, quoteSize, buf.Len())
+	}
+	if quoteSize == 0 {
+		return nil, errors.New("QGS returned empty quote")
+	}
+
+	return resp[len(resp)-int(quoteSize):], nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package tdxdriver
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tdxGuestDevice = "/dev/tdx_guest"
+	// _IOWR('T', 1, struct tdx_report_req)
+	tdxCmdGetReport0 = 0xc4405401
+)
+
+// tdxReportReq is the struct tdx_report_req of the TDX guest driver
+type tdxReportReq struct {
+	reportData [64]byte
+	tdReport   [tdReportSize]byte
+}
+
+// getTdReport fetches the TDREPORT with the report data from the TDX module
+// via the TDX guest driver
+func getTdReport(reportData []byte) ([]byte, error) {
+
+	f, err := os.Open(tdxGuestDevice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", tdxGuestDevice, err)
+	}
+	defer f.Close()
+
+	var req tdxReportReq
+	copy(req.reportData[:], reportData)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), tdxCmdGetReport0,
+		uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return nil, fmt.Errorf("TDX_CMD_GET_REPORT0 failed: %w", errno)
+	}
+
+	return req.tdReport[:], nil
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tdxdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	est "github.com/Fraunhofer-AISEC/cmc/est/estclient"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "tdxdriver")
+
+const (
+	tcbChainFile = "tcbchain.pem"
+)
+
+var (
+	tcbInfoUrl = "https://api.trustedservices.intel.com/tdx/certification/v4/tcb?fmspc=%s"
+)
+
+// Tdx is a structure required for implementing the Measure method
+// of the attestation report Measurer interface
+type Tdx struct {
+	tcbChain         []*x509.Certificate
+	signingCertChain []*x509.Certificate
+	priv             crypto.PrivateKey
+	storage          string
+	qgsAddr          string
+}
+
+// Init initializes the TDX driver with the specifified configuration
+func (tdx *Tdx) Init(c *ar.DriverConfig) error {
+
+	// Initial checks
+	if tdx == nil {
+		return errors.New("internal error: TDX object is nil")
+	}
+
+	// Create storage folder for storage of internal data if not existing
+	if c.StoragePath != "" {
+		if _, err := os.Stat(c.StoragePath); err != nil {
+			if err := os.MkdirAll(c.StoragePath, 0755); err != nil {
+				return fmt.Errorf("failed to create directory for internal data '%v': %w",
+					c.StoragePath, err)
+			}
+		}
+	}
+
+	tdx.storage = c.StoragePath
+	tdx.qgsAddr = c.TdxQgsAddr
+
+	// Create new private key for signing
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	tdx.priv = priv
+
+	// Create IK CSR and fetch new certificate including its chain from EST server
+	tdx.signingCertChain, err = getSigningCertChain(priv, c.Serializer, c.Metadata,
+		c.ServerAddr, c.BootstrapToken)
+	if err != nil {
+		return fmt.Errorf("failed to get signing cert chain: %w", err)
+	}
+
+	// Fetch the TCB signing certificate chain for the FMSPC of the platform
+	quote, err := getQuote(make([]byte, 64), tdx.qgsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to get TDX quote: %w", err)
+	}
+	tdx.tcbChain, err = getTcbChain(tdx.storage, quote)
+	if err != nil {
+		return fmt.Errorf("failed to get TCB signing cert chain: %w", err)
+	}
+
+	return nil
+}
+
+// Measure implements the attestation reports generic Measure interface to be called
+// as a plugin during attestation report generation
+func (tdx *Tdx) Measure(nonce []byte) (ar.Measurement, error) {
+
+	log.Trace("Collecting TDX measurements")
+
+	if tdx == nil {
+		return ar.Measurement{}, errors.New("internal error: TDX object is nil")
+	}
+
+	quote, err := getQuote(nonce, tdx.qgsAddr)
+	if err != nil {
+		return ar.Measurement{}, fmt.Errorf("failed to get TDX Measurement: %w", err)
+	}
+
+	// The verifier expects the TCB signing certificate and the Intel root CA,
+	// whereas the PCK certificate chain is contained in the quote
+	measurement := ar.Measurement{
+		Type:     "TDX Measurement",
+		Evidence: quote,
+		Certs:    internal.WriteCertsPem(tdx.tcbChain),
+	}
+
+	return measurement, nil
+}
+
+// Lock implements the locking method for the attestation report signer interface
+func (tdx *Tdx) Lock() error {
+	// No locking mechanism required for software key
+	return nil
+}
+
+// Lock implements the unlocking method for the attestation report signer interface
+func (tdx *Tdx) Unlock() error {
+	// No unlocking mechanism required for software key
+	return nil
+}
+
+// GetSigningKeys returns the TLS private and public key as a generic
+// crypto interface
+func (tdx *Tdx) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	if tdx == nil {
+		return nil, nil, errors.New("internal error: TDX object is nil")
+	}
+	return tdx.priv, &tdx.priv.(*ecdsa.PrivateKey).PublicKey, nil
+}
+
+func (tdx *Tdx) GetCertChain() ([]*x509.Certificate, error) {
+	if tdx == nil {
+		return nil, errors.New("internal error: TDX object is nil")
+	}
+	log.Tracef("Returning %v certificates", len(tdx.signingCertChain))
+	return tdx.signingCertChain, nil
+}
+
+// getQuote fetches a TDX quote with the nonce as report data. If the address
+// of a quote generation service (QGS) is configured, the TDREPORT is converted
+// into a quote via vsock, otherwise via the configfs-tsm interface of the kernel
+func getQuote(nonce []byte, qgsAddr string) ([]byte, error) {
+
+	if len(nonce) > 64 {
+		return nil, errors.New("user Data must be at most 64 bytes")
+	}
+
+	log.Tracef("Generating TDX quote with nonce: %v", hex.EncodeToString(nonce))
+
+	reportData := make([]byte, 64)
+	copy(reportData, nonce)
+
+	if qgsAddr == "" {
+		return getTsmQuote(reportData)
+	}
+
+	report, err := getTdReport(reportData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TDREPORT: %w", err)
+	}
+	return getQgsQuote(qgsAddr, report)
+}
+
+// getTcbChain returns the TCB info issuer chain consisting of the TCB signing
+// certificate and the Intel root CA. The chain is cached in the storage path
+// and downloaded from the Intel PCS if not present or expired
+func getTcbChain(storage string, quote []byte) ([]*x509.Certificate, error) {
+
+	if storage != "" {
+		chain, err := loadTcbChain(path.Join(storage, tcbChainFile))
+		if err == nil {
+			return chain, nil
+		}
+		log.Debugf("Failed to load cached TCB signing cert chain, downloading: %v", err)
+	}
+
+	// Extract FMSPC from PCK certificate SGX Extensions
+	pckCert, err := verify.GetTdxPckCert(quote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PCK cert: %w", err)
+	}
+	if len(pckCert.Extensions) <= verify.SGX_EXTENSION_INDEX {
+		return nil, errors.New("PCK cert does not contain SGX extensions")
+	}
+	sgxExtensions, err := verify.ParseSGXExtensions(pckCert.Extensions[verify.SGX_EXTENSION_INDEX].Value[4:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SGX extensions: %w", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	chain, err := downloadTcbChain(client,
+		fmt.Sprintf(tcbInfoUrl, hex.EncodeToString(sgxExtensions.Fmspc.Value)))
+	if err != nil {
+		return nil, err
+	}
+
+	if storage != "" {
+		err = internal.WriteFileAtomic(path.Join(storage, tcbChainFile),
+			internal.WriteCertChainPem(chain), 0644)
+		if err != nil {
+			log.Warnf("Failed to cache TCB signing cert chain: %v", err)
+		}
+	}
+
+	return chain, nil
+}
+
+// loadTcbChain loads the cached TCB signing certificate chain, which must
+// currently be valid
+func loadTcbChain(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", file, err)
+	}
+	chain, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", file, err)
+	}
+	now := time.Now()
+	for _, c := range chain {
+		if now.Before(c.NotBefore) || now.After(c.NotAfter) {
+			return nil, fmt.Errorf("certificate %v expired", c.Subject.CommonName)
+		}
+	}
+	return chain, nil
+}
+
+// downloadTcbChain retrieves the TCB info issuer chain, which the Intel PCS
+// returns along with the TCB info
+func downloadTcbChain(client *http.Client, tcbUrl string) ([]*x509.Certificate, error) {
+
+	log.Debugf("Downloading TCB info issuer chain from %v", tcbUrl)
+
+	resp, err := client.Get(tcbUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error performing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %v", resp.Status)
+	}
+
+	decoded, err := url.QueryUnescape(resp.Header.Get("TCB-Info-Issuer-Chain"))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding URL-encoded string: %w", err)
+	}
+
+	chain, err := internal.ParseCertsPem([]byte(decoded))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing TCB info issuer chain: %w", err)
+	}
+
+	return chain, nil
+}
+
+func getSigningCertChain(priv crypto.PrivateKey, s ar.Serializer, metadata [][]byte,
+	addr, tokenSource string,
+) ([]*x509.Certificate, error) {
+
+	csr, err := ar.CreateCsr(priv, s, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	// Get CA certificates and enroll newly created CSR
+	// TODO provision EST server certificate with a different mechanism,
+	// otherwise this step has to happen in a secure environment. Allow
+	// different CAs for metadata and the EST server authentication
+	log.Warn("Creating new EST client without server authentication")
+	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
+
+	log.Info("Retrieving CA certs")
+	caCerts, err := client.CaCerts(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve certs: %w", err)
+	}
+	log.Debug("Received certs:")
+	for _, c := range caCerts {
+		log.Debugf("\t%v", c.Subject.CommonName)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("no certs provided")
+	}
+
+	log.Warn("Setting retrieved cert for future authentication")
+	err = client.SetCAs([]*x509.Certificate{caCerts[len(caCerts)-1]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set EST CA: %w", err)
+	}
+
+	cert, err := client.BoundSimpleEnroll(addr, csr, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enroll cert: %w", err)
+	}
+
+	return append([]*x509.Certificate{cert}, caCerts...), nil
+}
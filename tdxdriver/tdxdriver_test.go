@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tdxdriver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+func createTsmEntry(t *testing.T, provider string, quote []byte) string {
+	entry := t.TempDir()
+	files := map[string][]byte{
+		"provider":   []byte(provider + "\n"),
+		"generation": []byte("1\n"),
+		"inblob":     nil,
+		"outblob":    quote,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(entry, name), data, 0600); err != nil {
+			t.Fatalf("failed to create configfs-tsm entry: %v", err)
+		}
+	}
+	return entry
+}
+
+func Test_readTsmReport(t *testing.T) {
+
+	quote := []byte("quote")
+	reportData := bytes.Repeat([]byte{0xaa}, 64)
+
+	tests := []struct {
+		name    string
+		entry   func(t *testing.T) string
+		wantErr bool
+	}{
+		{"Valid Report", func(t *testing.T) string {
+			return createTsmEntry(t, "tdx_guest", quote)
+		}, false},
+		{"Wrong Provider", func(t *testing.T) string {
+			return createTsmEntry(t, "sev_guest", quote)
+		}, true},
+		{"Empty Quote", func(t *testing.T) string {
+			return createTsmEntry(t, "tdx_guest", nil)
+		}, true},
+		{"Missing Entry", func(t *testing.T) string {
+			return filepath.Join(t.TempDir(), "missing")
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := tt.entry(t)
+			got, err := readTsmReport(entry, reportData)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTsmReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got, quote) {
+				t.Errorf("readTsmReport() = %v, want %v", got, quote)
+			}
+			inblob, _ := os.ReadFile(filepath.Join(entry, "inblob"))
+			if !bytes.Equal(inblob, reportData) {
+				t.Errorf("inblob = %v, want %v", inblob, reportData)
+			}
+		})
+	}
+}
+
+func createQgsResponse(msgType, errorCode uint32, quote []byte) []byte {
+	id := []byte{0x01, 0x02}
+	resp := new(bytes.Buffer)
+	binary.Write(resp, binary.LittleEndian, qgsMsgHeader{
+		MajorVersion: qgsMajorVersion,
+		Type:         msgType,
+		Size:         uint32(qgsHeaderSize + 8 + len(id) + len(quote)),
+		ErrorCode:    errorCode,
+	})
+	binary.Write(resp, binary.LittleEndian, uint32(len(id)))
+	binary.Write(resp, binary.LittleEndian, uint32(len(quote)))
+	resp.Write(id)
+	resp.Write(quote)
+	return resp.Bytes()
+}
+
+func Test_qgsQuote(t *testing.T) {
+
+	quote := []byte("quote")
+	report := bytes.Repeat([]byte{0xbb}, tdReportSize)
+
+	tests := []struct {
+		name    string
+		report  []byte
+		resp    []byte
+		wantErr bool
+	}{
+		{"Valid Quote", report, createQgsResponse(qgsGetQuoteResp, 0, quote), false},
+		{"Error Code", report, createQgsResponse(qgsGetQuoteResp, 0x12001, nil), true},
+		{"Wrong Type", report, createQgsResponse(qgsGetQuoteReq, 0, quote), true},
+		{"Empty Quote", report, createQgsResponse(qgsGetQuoteResp, 0, nil), true},
+		{"Truncated Response", report, createQgsResponse(qgsGetQuoteResp, 0, quote)[:20], true},
+		{"Invalid Report", report[:64], nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			// Fake QGS checking the request and sending the response
+			go func() {
+				defer server.Close()
+				var size uint32
+				if err := binary.Read(server, binary.BigEndian, &size); err != nil {
+					return
+				}
+				req := make([]byte, size)
+				if _, err := io.ReadFull(server, req); err != nil {
+					return
+				}
+				var header qgsMsgHeader
+				binary.Read(bytes.NewReader(req), binary.LittleEndian, &header)
+				if header.Type != qgsGetQuoteReq || header.Size != size ||
+					!bytes.Equal(req[qgsReqHeaderSize:], tt.report) {
+					t.Errorf("invalid QGS request %+v", header)
+					return
+				}
+				msg := make([]byte, 4)
+				binary.BigEndian.PutUint32(msg, uint32(len(tt.resp)))
+				server.Write(append(msg, tt.resp...))
+			}()
+
+			got, err := qgsQuote(client, tt.report)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("qgsQuote() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, quote) {
+				t.Errorf("qgsQuote() = %v, want %v", got, quote)
+			}
+		})
+	}
+}
+
+func createCert(t *testing.T, cn string, notAfter time.Time) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func Test_downloadTcbChain(t *testing.T) {
+
+	chain := []*x509.Certificate{
+		createCert(t, "Intel SGX TCB Signing", time.Now().Add(time.Hour)),
+		createCert(t, "Intel SGX Root CA", time.Now().Add(time.Hour)),
+	}
+	header := url.QueryEscape(string(internal.WriteCertChainPem(chain)))
+
+	tests := []struct {
+		name    string
+		header  string
+		status  int
+		wantErr bool
+	}{
+		{"Valid Chain", header, http.StatusOK, false},
+		{"Missing Header", "", http.StatusOK, true},
+		{"Invalid Header", "%zz", http.StatusOK, true},
+		{"Not Found", header, http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("TCB-Info-Issuer-Chain", tt.header)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer s.Close()
+
+			got, err := downloadTcbChain(s.Client(), s.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadTcbChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(chain) || !got[0].Equal(chain[0]) || !got[1].Equal(chain[1]) {
+				t.Errorf("downloadTcbChain() returned unexpected chain")
+			}
+		})
+	}
+}
+
+func Test_loadTcbChain(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		wantErr bool
+	}{
+		{"Valid Chain", []*x509.Certificate{
+			createCert(t, "Intel SGX TCB Signing", time.Now().Add(time.Hour)),
+		}, false},
+		{"Expired Chain", []*x509.Certificate{
+			createCert(t, "Intel SGX TCB Signing", time.Now().Add(-time.Minute)),
+		}, true},
+		{"Missing Chain", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tcbChainFile)
+			if tt.chain != nil {
+				if err := os.WriteFile(file, internal.WriteCertChainPem(tt.chain), 0644); err != nil {
+					t.Fatalf("failed to write chain: %v", err)
+				}
+			}
+			_, err := loadTcbChain(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadTcbChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
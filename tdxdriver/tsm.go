@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tdxdriver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tsmPath is the configfs-tsm report interface of the kernel
+var tsmPath = "/sys/kernel/config/tsm/report"
+
+// getTsmQuote fetches a quote via a temporary configfs-tsm report entry
+func getTsmQuote(reportData []byte) ([]byte, error) {
+	entry, err := os.MkdirTemp(tsmPath, "cmc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create configfs-tsm report entry: %w", err)
+	}
+	defer os.Remove(entry)
+
+	return readTsmReport(entry, reportData)
+}
+
+// readTsmReport writes the report data to the configfs-tsm report entry and
+// reads the generated quote. The generation is incremented on each write, so
+// that a changed generation indicates a concurrent write of another process
+func readTsmReport(entry string, reportData []byte) ([]byte, error) {
+
+	provider, err := os.ReadFile(filepath.Join(entry, "provider"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configfs-tsm provider: %w", err)
+	}
+	if p := strings.TrimSpace(string(provider)); p != "tdx_guest" {
+		return nil, fmt.Errorf("unsupported configfs-tsm provider %v", p)
+	}
+
+	if err := os.WriteFile(filepath.Join(entry, "inblob"), reportData, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write configfs-tsm report data: %w", err)
+	}
+	gen, err := readTsmGeneration(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	quote, err := os.ReadFile(filepath.Join(entry, "outblob"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configfs-tsm quote: %w", err)
+	}
+	if len(quote) == 0 {
+		return nil, fmt.Errorf("configfs-tsm returned empty quote")
+	}
+
+	if g, err := readTsmGeneration(entry); err != nil {
+		return nil, err
+	} else if g != gen {
+		return nil, fmt.Errorf("configfs-tsm report entry modified concurrently (generation %v, expected %v)",
+			g, gen)
+	}
+
+	return quote, nil
+}
+
+func readTsmGeneration(entry string) (string, error) {
+	gen, err := os.ReadFile(filepath.Join(entry, "generation"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read configfs-tsm generation: %w", err)
+	}
+	return strings.TrimSpace(string(gen)), nil
+}
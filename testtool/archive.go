@@ -0,0 +1,213 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	// local modules
+	"github.com/Fraunhofer-AISEC/cmc/archive"
+)
+
+const archiveUnixPrefix = "unix:"
+
+// archiveCmds are the subcommands of the archive command, which retrieves
+// archived verifications from the diagnostics listener of a verifying cmcd
+var archiveCmds = map[string]func([]string) error{
+	"get":   archiveGet,
+	"query": archiveQuery,
+}
+
+// archiveCmd runs the archive subcommand specified as first argument
+func archiveCmd(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("archive subcommand missing. Possible: %v", maps.Keys(archiveCmds))
+	}
+	cmd, ok := archiveCmds[strings.ToLower(args[0])]
+	if !ok {
+		return usageErrorf("archive subcommand %v does not exist. Possible: %v", args[0],
+			maps.Keys(archiveCmds))
+	}
+	return cmd(args[1:])
+}
+
+// archiveGet retrieves all verifications of a report and optionally stores the
+// report of the latest verification to a file
+func archiveGet(args []string) error {
+
+	fs := flag.NewFlagSet("archive get", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:6060", "Diagnostics address of the cmcd, or unix:<path>")
+	id := fs.String("id", "", "Report ID (hex encoded SHA-256 of the attestation report)")
+	out := fs.String("out", "", "Optional file to store the attestation report to")
+	logLevel := fs.String(logFlag, "warn", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse archive get flags: %w", err)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	if *id == "" {
+		return usageErrorf("report ID must be specified")
+	}
+
+	var entries []archive.Entry
+	if err := archiveRequest(*addr, archive.ReportsPath+"/"+url.PathEscape(*id), &entries); err != nil {
+		return err
+	}
+	if *out != "" && len(entries) > 0 {
+		if err := os.WriteFile(*out, entries[len(entries)-1].Report, 0644); err != nil {
+			return fmt.Errorf("failed to store report: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal archived verifications: %w", err)
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+	return nil
+}
+
+// archiveQuery lists the archived verifications by peer and time range
+func archiveQuery(args []string) error {
+
+	fs := flag.NewFlagSet("archive query", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:6060", "Diagnostics address of the cmcd, or unix:<path>")
+	peer := fs.String("peer", "", "Optional peer address")
+	from := fs.String("from", "", "Optional start of the time range (RFC 3339 or duration before now)")
+	to := fs.String("to", "", "Optional end of the time range (RFC 3339 or duration before now)")
+	limit := fs.Int("limit", 0, "Optional maximum number of verifications (default 100)")
+	format := fs.String(formatFlag, formatText, "Output format: text or json")
+	logLevel := fs.String(logFlag, "warn", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse archive query flags: %w", err)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	if *format != formatText && *format != formatJson {
+		return usageErrorf("unknown output format %v", *format)
+	}
+
+	q := url.Values{}
+	if *peer != "" {
+		q.Set("peer", *peer)
+	}
+	now := time.Now()
+	for name, value := range map[string]string{"from": *from, "to": *to} {
+		if value == "" {
+			continue
+		}
+		t, err := parseArchiveTime(value, now)
+		if err != nil {
+			return usageErrorf("invalid %v time: %w", name, err)
+		}
+		q.Set(name, t.Format(time.RFC3339))
+	}
+	if *limit < 0 {
+		return usageErrorf("limit must not be negative")
+	} else if *limit > 0 {
+		q.Set("limit", strconv.Itoa(*limit))
+	}
+
+	path := archive.ReportsPath
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var entries []archive.Entry
+	if err := archiveRequest(*addr, path, &entries); err != nil {
+		return err
+	}
+
+	if *format == formatJson {
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return fmt.Errorf("failed to marshal archived verifications: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+		return nil
+	}
+	printArchiveEntries(os.Stdout, entries)
+	return nil
+}
+
+// parseArchiveTime parses an RFC 3339 time or a duration before now, e.g. 24h
+func parseArchiveTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func printArchiveEntries(w io.Writer, entries []archive.Entry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECEIVED\tAPI\tPEER\tSUCCESS\tREPORT ID")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", e.Received.Format(time.RFC3339), e.Api, e.Peer,
+			e.Success, e.Id)
+	}
+	tw.Flush()
+}
+
+// archiveRequest retrieves the path from the diagnostics listener of the cmcd
+// and unmarshals the JSON response
+func archiveRequest(addr, path string, v interface{}) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	host := addr
+	if strings.HasPrefix(addr, archiveUnixPrefix) {
+		socket := strings.TrimPrefix(strings.TrimPrefix(addr, archiveUnixPrefix), "//")
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		host = "cmcd"
+	}
+
+	resp, err := client.Get("http://" + host + path)
+	if err != nil {
+		return unreachableErrorf("failed to query archive: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return unreachableErrorf("failed to read archive response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("archive request failed with status %v: %v", resp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to unmarshal archive response: %w", err)
+	}
+	return nil
+}
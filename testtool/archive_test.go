@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/archive"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func TestArchiveCmd(t *testing.T) {
+	dir := t.TempDir()
+	a, err := archive.New(&archive.Config{Dir: filepath.Join(dir, "archive")})
+	if err != nil {
+		t.Fatalf("archive.New() error = %v", err)
+	}
+	e := archive.NewEntry("socket", "10.0.0.1:1000", []byte("report"), []byte{1}, time.Now(),
+		&ar.VerificationResult{Success: true})
+	a.Add(e)
+	// Closing stores the queued entry
+	a.Close()
+	a, err = archive.New(&archive.Config{Dir: filepath.Join(dir, "archive")})
+	if err != nil {
+		t.Fatalf("archive.New() error = %v", err)
+	}
+	defer a.Close()
+	srv := httptest.NewServer(archive.Handler(a))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	out := filepath.Join(dir, "report.bin")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Get", []string{"get", "-addr", addr, "-id", e.Id, "-out", out}, exitSuccess},
+		{"Get Unknown", []string{"get", "-addr", addr, "-id", "00ff"}, exitFailure},
+		{"Get Without Id", []string{"get", "-addr", addr}, exitUsage},
+		{"Query", []string{"query", "-addr", addr, "-peer", "10.0.0.1:1000", "-from", "1h"},
+			exitSuccess},
+		{"Query Json", []string{"query", "-addr", addr, "-format", "json"}, exitSuccess},
+		{"Query Invalid Time", []string{"query", "-addr", addr, "-to", "yesterday"}, exitUsage},
+		{"Unreachable", []string{"query", "-addr", "unix:" + filepath.Join(dir, "none")},
+			exitCmcUnreachable},
+		{"Unknown Subcommand", []string{"delete"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(archiveCmd(tt.args)); got != tt.want {
+				t.Errorf("archive %v exit code = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	if data, err := os.ReadFile(out); err != nil || !bytes.Equal(data, []byte("report")) {
+		t.Errorf("stored report = %q (%v), want %q", data, err, "report")
+	}
+}
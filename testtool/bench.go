@@ -0,0 +1,541 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	atls "github.com/Fraunhofer-AISEC/cmc/attestedtls"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	benchAttest = "attest"
+	benchVerify = "verify"
+	benchDial   = "dial"
+	benchTotal  = "total"
+
+	defaultBenchOps = 100
+)
+
+// Error categories of failed benchmark operations
+const (
+	errUnreachable  = "unreachable"
+	errTimeout      = "timeout"
+	errVerification = "verification"
+	errOther        = "other"
+)
+
+// benchClient performs the attest and verify operations of a benchmark.
+// Implementations must be safe for concurrent use if connections are reused
+type benchClient interface {
+	attest(nonce []byte) ([]byte, error)
+	verify(report, nonce []byte) (*ar.VerificationResult, error)
+	close()
+}
+
+// benchApi is implemented by the APIs supporting the bench mode
+type benchApi interface {
+	benchClient(c *config) (benchClient, error)
+	cmcApi() atls.CmcApiSelect
+}
+
+type benchConfig struct {
+	concurrency int
+	ops         int64
+	duration    time.Duration
+	rampUp      time.Duration
+	schedule    []string
+	reuseConn   bool
+}
+
+// benchStats are the statistics of a single worker
+type benchStats struct {
+	latencies map[string]*histogram
+	counts    map[string]uint64
+	errors    map[string]map[string]uint64
+}
+
+type benchOpSummary struct {
+	Operation       string            `json:"operation"`
+	Count           uint64            `json:"count"`
+	Errors          uint64            `json:"errors"`
+	ErrorRate       float64           `json:"errorRate"`
+	ErrorCategories map[string]uint64 `json:"errorCategories,omitempty"`
+	OpsPerSecond    float64           `json:"opsPerSecond"`
+	MinMs           float64           `json:"minMs"`
+	MeanMs          float64           `json:"meanMs"`
+	P50Ms           float64           `json:"p50Ms"`
+	P90Ms           float64           `json:"p90Ms"`
+	P99Ms           float64           `json:"p99Ms"`
+	P999Ms          float64           `json:"p999Ms"`
+	MaxMs           float64           `json:"maxMs"`
+}
+
+// benchSummary is the result of a benchmark. Latencies are recorded for
+// successful operations only
+type benchSummary struct {
+	Api         string           `json:"api"`
+	Concurrency int              `json:"concurrency"`
+	ReuseConn   bool             `json:"reuseConn"`
+	Started     time.Time        `json:"started"`
+	DurationMs  int64            `json:"durationMs"`
+	Operations  []benchOpSummary `json:"operations"`
+}
+
+// bench drives load against the cmcd or attested TLS servers and prints a
+// summary of the throughput, latencies and errors
+func bench(c *config) error {
+
+	b, err := getBenchConfig(c)
+	if err != nil {
+		return err
+	}
+
+	s, err := runBench(c, b)
+	if err != nil {
+		return err
+	}
+
+	err = printBenchSummary(os.Stdout, c.Format, s)
+	if err != nil {
+		return err
+	}
+
+	total := s.Operations[len(s.Operations)-1]
+	if total.Count > 0 && total.Errors == total.Count {
+		return fmt.Errorf("all %v operations failed", total.Count)
+	}
+
+	return nil
+}
+
+func getBenchConfig(c *config) (*benchConfig, error) {
+
+	b := &benchConfig{
+		concurrency: c.BenchConcurrency,
+		ops:         int64(c.BenchOps),
+		reuseConn:   c.ReuseConn,
+	}
+	if b.concurrency <= 0 {
+		return nil, usageErrorf("invalid benchmark concurrency %v", c.BenchConcurrency)
+	}
+	if b.ops < 0 {
+		return nil, usageErrorf("invalid number of benchmark operations %v", c.BenchOps)
+	}
+
+	var err error
+	if c.BenchDuration != "" {
+		b.duration, err = time.ParseDuration(c.BenchDuration)
+		if err != nil || b.duration < 0 {
+			return nil, usageErrorf("invalid benchmark duration %v", c.BenchDuration)
+		}
+	}
+	if b.ops == 0 && b.duration == 0 {
+		b.ops = defaultBenchOps
+	}
+	if c.BenchRampUp != "" {
+		b.rampUp, err = time.ParseDuration(c.BenchRampUp)
+		if err != nil || b.rampUp < 0 {
+			return nil, usageErrorf("invalid benchmark ramp-up %v", c.BenchRampUp)
+		}
+	}
+
+	b.schedule, err = parseMix(c.BenchMix)
+	if err != nil {
+		return nil, usageErrorf("invalid benchmark operation mix: %w", err)
+	}
+
+	return b, nil
+}
+
+// parseMix parses the operation mix, a comma-separated list of operations with
+// optional weights, e.g. attest=3,verify=1, into the schedule of operations
+func parseMix(mix string) ([]string, error) {
+	var schedule []string
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(mix, ",") {
+		op, w, found := strings.Cut(strings.TrimSpace(entry), "=")
+		op = strings.ToLower(op)
+		if op != benchAttest && op != benchVerify && op != benchDial {
+			return nil, fmt.Errorf("unknown operation %q (supported: %v, %v, %v)", op,
+				benchAttest, benchVerify, benchDial)
+		}
+		if seen[op] {
+			return nil, fmt.Errorf("duplicate operation %v", op)
+		}
+		seen[op] = true
+		weight := 1
+		if found {
+			var err error
+			weight, err = strconv.Atoi(w)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight %q of operation %v", w, op)
+			}
+		}
+		for i := 0; i < weight; i++ {
+			schedule = append(schedule, op)
+		}
+	}
+	if len(schedule) == 0 {
+		return nil, errors.New("no operations")
+	}
+	return schedule, nil
+}
+
+type benchRun struct {
+	c       *config
+	b       *benchConfig
+	api     benchApi
+	tlsConf *tls.Config
+	report  []byte
+	nonce   []byte
+	started time.Time
+	next    int64
+}
+
+func runBench(c *config, b *benchConfig) (*benchSummary, error) {
+
+	api, ok := c.api.(benchApi)
+	if !ok {
+		return nil, usageErrorf("API %v does not support the bench mode", c.Api)
+	}
+
+	r := &benchRun{
+		c:   c,
+		b:   b,
+		api: api,
+	}
+
+	// Connections are reused by all workers only if requested
+	var shared benchClient
+	if b.reuseConn {
+		var err error
+		shared, err = api.benchClient(c)
+		if err != nil {
+			return nil, err
+		}
+		defer shared.close()
+	}
+
+	// Attestation reports are verified against a report generated upfront
+	if slices.Contains(b.schedule, benchVerify) {
+		client := shared
+		if client == nil {
+			var err error
+			client, err = api.benchClient(c)
+			if err != nil {
+				return nil, err
+			}
+			defer client.close()
+		}
+		r.nonce = make([]byte, 8)
+		if _, err := rand.Read(r.nonce); err != nil {
+			return nil, fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		report, err := client.attest(r.nonce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate attestation report to verify: %w", err)
+		}
+		r.report = report
+	}
+
+	if slices.Contains(b.schedule, benchDial) {
+		if len(c.Addr) == 0 {
+			return nil, usageErrorf("no addresses to dial specified")
+		}
+		var err error
+		r.tlsConf, err = dialTlsConfig(c, api.cmcApi(), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof("Starting benchmark: %v workers, %v operations, duration %v, ramp-up %v, mix %v",
+		b.concurrency, b.ops, b.duration, b.rampUp, c.BenchMix)
+
+	r.started = time.Now()
+	stats := make([]*benchStats, b.concurrency)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < b.concurrency; i++ {
+		stats[i] = &benchStats{
+			latencies: map[string]*histogram{},
+			counts:    map[string]uint64{},
+			errors:    map[string]map[string]uint64{},
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.worker(i, shared, stats[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return r.summarize(stats, time.Since(r.started)), nil
+}
+
+// worker performs operations until the number of operations or the duration
+// of the benchmark is reached. Workers are started evenly distributed over the
+// ramp-up period, so that the load increases gently
+func (r *benchRun) worker(id int, client benchClient, stats *benchStats) {
+
+	if r.b.rampUp > 0 {
+		time.Sleep(r.b.rampUp * time.Duration(id) / time.Duration(r.b.concurrency))
+	}
+
+	if client == nil {
+		var err error
+		client, err = r.api.benchClient(r.c)
+		if err != nil {
+			log.Warnf("Worker %v failed to create client: %v", id, err)
+			return
+		}
+		defer client.close()
+	}
+
+	for {
+		n := atomic.AddInt64(&r.next, 1) - 1
+		if r.b.ops > 0 && n >= r.b.ops {
+			return
+		}
+		if r.b.duration > 0 && time.Since(r.started) >= r.b.duration {
+			return
+		}
+
+		op := r.schedule(n)
+		start := time.Now()
+		err := r.run(op, client, n)
+		stats.add(op, time.Since(start), err)
+		if err != nil {
+			log.Debugf("Operation %v failed: %v", op, err)
+		}
+	}
+}
+
+func (r *benchRun) schedule(n int64) string {
+	return r.b.schedule[n%int64(len(r.b.schedule))]
+}
+
+func (r *benchRun) run(op string, client benchClient, n int64) error {
+	switch op {
+	case benchAttest:
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		_, err := client.attest(nonce)
+		return err
+	case benchVerify:
+		result, err := client.verify(r.report, r.nonce)
+		if err != nil {
+			return err
+		}
+		if !result.Success {
+			return &opError{code: exitVerifyFailed, err: errors.New("verification failed")}
+		}
+		return nil
+	case benchDial:
+		addr := r.c.Addr[n%int64(len(r.c.Addr))]
+		o := newOutput(benchDial, addr)
+		err := dialAddr(r.c, r.api.cmcApi(), addr, r.tlsConf, nil, o)
+		if o.Result != nil && !o.Result.Success {
+			return &opError{code: exitVerifyFailed, err: fmt.Errorf("verification failed: %v", err)}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown operation %v", op)
+}
+
+func (s *benchStats) add(op string, d time.Duration, err error) {
+	s.counts[op]++
+	if err != nil {
+		if s.errors[op] == nil {
+			s.errors[op] = map[string]uint64{}
+		}
+		s.errors[op][errorCategory(err)]++
+		return
+	}
+	h, ok := s.latencies[op]
+	if !ok {
+		h = new(histogram)
+		s.latencies[op] = h
+	}
+	h.record(d)
+}
+
+// errorCategory returns the category of the error of a failed operation
+func errorCategory(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errTimeout
+	}
+	switch exitCode(err) {
+	case exitCmcUnreachable:
+		return errUnreachable
+	case exitVerifyFailed:
+		return errVerification
+	}
+	return errOther
+}
+
+func (r *benchRun) summarize(stats []*benchStats, elapsed time.Duration) *benchSummary {
+
+	s := &benchSummary{
+		Api:         r.c.Api,
+		Concurrency: r.b.concurrency,
+		ReuseConn:   r.b.reuseConn,
+		Started:     r.started.UTC(),
+		DurationMs:  elapsed.Milliseconds(),
+	}
+
+	ops := []string{}
+	for _, op := range []string{benchAttest, benchVerify, benchDial} {
+		if slices.Contains(r.b.schedule, op) {
+			ops = append(ops, op)
+		}
+	}
+
+	total := benchOpSummary{Operation: benchTotal}
+	totalHist := new(histogram)
+	totalErrors := map[string]uint64{}
+	for _, op := range ops {
+		h := new(histogram)
+		errs := map[string]uint64{}
+		var count uint64
+		for _, st := range stats {
+			if l, ok := st.latencies[op]; ok {
+				h.merge(l)
+			}
+			count += st.counts[op]
+			for category, n := range st.errors[op] {
+				errs[category] += n
+				totalErrors[category] += n
+			}
+		}
+		totalHist.merge(h)
+		total.Count += count
+		s.Operations = append(s.Operations, opSummary(op, count, h, errs, elapsed))
+	}
+	s.Operations = append(s.Operations, opSummary(benchTotal, total.Count, totalHist, totalErrors,
+		elapsed))
+
+	return s
+}
+
+func opSummary(op string, count uint64, h *histogram, errs map[string]uint64,
+	elapsed time.Duration,
+) benchOpSummary {
+	o := benchOpSummary{
+		Operation: op,
+		Count:     count,
+		MinMs:     ms(h.min),
+		MeanMs:    ms(h.mean()),
+		P50Ms:     ms(h.quantile(0.5)),
+		P90Ms:     ms(h.quantile(0.9)),
+		P99Ms:     ms(h.quantile(0.99)),
+		P999Ms:    ms(h.quantile(0.999)),
+		MaxMs:     ms(h.max),
+	}
+	for _, n := range errs {
+		o.Errors += n
+	}
+	if len(errs) > 0 {
+		o.ErrorCategories = errs
+	}
+	if count > 0 {
+		o.ErrorRate = float64(o.Errors) / float64(count)
+	}
+	if elapsed > 0 {
+		o.OpsPerSecond = float64(count-o.Errors) / elapsed.Seconds()
+	}
+	return o
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func printBenchSummary(w io.Writer, format string, s *benchSummary) error {
+	switch format {
+	case formatJson:
+		data, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed to marshal benchmark summary: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case formatCsv:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"operation", "count", "errors", "errorRate", "opsPerSecond", "minMs",
+			"meanMs", "p50Ms", "p90Ms", "p99Ms", "p999Ms", "maxMs"})
+		for _, o := range s.Operations {
+			cw.Write([]string{o.Operation, strconv.FormatUint(o.Count, 10),
+				strconv.FormatUint(o.Errors, 10), f(o.ErrorRate), f(o.OpsPerSecond), f(o.MinMs),
+				f(o.MeanMs), f(o.P50Ms), f(o.P90Ms), f(o.P99Ms), f(o.P999Ms), f(o.MaxMs)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	fmt.Fprintf(w, "Benchmark: API %v, %v workers, reuse connections %v, duration %v\n",
+		s.Api, s.Concurrency, s.ReuseConn, time.Duration(s.DurationMs)*time.Millisecond)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tCOUNT\tERRORS\tOPS/S\tMIN\tMEAN\tP50\tP90\tP99\tP99.9\tMAX")
+	for _, o := range s.Operations {
+		fmt.Fprintf(tw, "%v\t%v\t%v (%.1f%%)\t%.1f\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\n",
+			o.Operation, o.Count, o.Errors, o.ErrorRate*100, o.OpsPerSecond, o.MinMs, o.MeanMs,
+			o.P50Ms, o.P90Ms, o.P99Ms, o.P999Ms, o.MaxMs)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, o := range s.Operations {
+		if o.Operation == benchTotal || len(o.ErrorCategories) == 0 {
+			continue
+		}
+		categories := maps.Keys(o.ErrorCategories)
+		slices.Sort(categories)
+		var parts []string
+		for _, category := range categories {
+			parts = append(parts, fmt.Sprintf("%v %v", category, o.ErrorCategories[category]))
+		}
+		fmt.Fprintf(w, "Errors %v: %v\n", o.Operation, strings.Join(parts, ", "))
+	}
+	return nil
+}
+
+func f(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
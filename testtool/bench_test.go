@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || grpc
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
+)
+
+// benchServer is a fake cmcd counting the gRPC connections. Every third
+// verification fails
+type benchServer struct {
+	api.UnimplementedCMCServiceServer
+	verified int64
+}
+
+func (s *benchServer) Attest(ctx context.Context, req *api.AttestationRequest,
+) (*api.AttestationResponse, error) {
+	return &api.AttestationResponse{
+		Status:            api.Status_OK,
+		AttestationReport: append([]byte("report-"), req.Nonce...),
+	}, nil
+}
+
+func (s *benchServer) Verify(ctx context.Context, req *api.VerificationRequest,
+) (*api.VerificationResponse, error) {
+	n := atomic.AddInt64(&s.verified, 1)
+	data, _ := json.Marshal(ar.VerificationResult{Success: n%3 != 0})
+	return &api.VerificationResponse{
+		Status:             api.Status_OK,
+		VerificationResult: data,
+	}, nil
+}
+
+type countingListener struct {
+	net.Listener
+	conns int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.conns, 1)
+	}
+	return conn, err
+}
+
+func startBenchServer(t *testing.T) (string, *countingListener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	cl := &countingListener{Listener: ln}
+	s := grpc.NewServer()
+	api.RegisterCMCServiceServer(s, &benchServer{})
+	go s.Serve(cl)
+	t.Cleanup(s.Stop)
+	return ln.Addr().String(), cl
+}
+
+func Test_parseMix(t *testing.T) {
+	tests := []struct {
+		name    string
+		mix     string
+		want    []string
+		wantErr bool
+	}{
+		{"Single", "attest", []string{"attest"}, false},
+		{"Weighted", "attest=2, Verify=1", []string{"attest", "attest", "verify"}, false},
+		{"Zero Weight", "attest,dial=0", []string{"attest"}, false},
+		{"Unknown", "measure", nil, true},
+		{"Duplicate", "attest,attest=2", nil, true},
+		{"Invalid Weight", "verify=x", nil, true},
+		{"Empty", "attest=0", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMix(tt.mix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBench(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		reuseConn   bool
+		unreachable bool
+		wantConns   int64
+	}{
+		// One connection for the upfront attestation and one per worker
+		{"Connection Per Worker", false, false, 5},
+		{"Reuse Connection", true, false, 1},
+		{"Unreachable", false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, ln := startBenchServer(t)
+			if tt.unreachable {
+				addr = closedAddr(t)
+			}
+			c := &config{
+				Api:              "grpc",
+				CmcAddr:          addr,
+				BenchConcurrency: 4,
+				BenchOps:         60,
+				BenchMix:         "attest=1,verify=2",
+				ReuseConn:        tt.reuseConn,
+				api:              GrpcApi{},
+			}
+			b, err := getBenchConfig(c)
+			if err != nil {
+				t.Fatalf("getBenchConfig() error = %v", err)
+			}
+			if tt.unreachable {
+				b.schedule = []string{benchAttest}
+			}
+
+			s, err := runBench(c, b)
+			if err != nil {
+				t.Fatalf("runBench() error = %v", err)
+			}
+			if got := atomic.LoadInt64(&ln.conns); got != tt.wantConns {
+				t.Errorf("connections = %v, want %v", got, tt.wantConns)
+			}
+
+			total := s.Operations[len(s.Operations)-1]
+			if total.Operation != benchTotal || total.Count != 60 {
+				t.Fatalf("total = %+v, want 60 operations", total)
+			}
+			if tt.unreachable {
+				// All operations are performed despite the errors
+				if total.ErrorCategories[errUnreachable] != 60 {
+					t.Errorf("errors = %v, want 60 unreachable", total.ErrorCategories)
+				}
+				return
+			}
+
+			attest, verify := s.Operations[0], s.Operations[1]
+			if attest.Count != 20 || attest.Errors != 0 || attest.P99Ms <= 0 {
+				t.Errorf("attest = %+v, want 20 successful operations", attest)
+			}
+			if verify.Count != 40 || verify.ErrorCategories[errVerification] != 13 {
+				t.Errorf("verify = %+v, want 40 operations with 13 failed verifications", verify)
+			}
+
+			var out bytes.Buffer
+			if err := printBenchSummary(&out, formatCsv, s); err != nil {
+				t.Fatalf("printBenchSummary() error = %v", err)
+			}
+			records, err := csv.NewReader(&out).ReadAll()
+			if err != nil || len(records) != 4 || records[3][0] != benchTotal {
+				t.Errorf("CSV summary = %v (%v), want header, attest, verify and total", records,
+					err)
+			}
+
+			out.Reset()
+			if err := printBenchSummary(&out, formatText, s); err != nil {
+				t.Fatalf("printBenchSummary() error = %v", err)
+			}
+			if !strings.Contains(out.String(), "Errors verify: verification 13") {
+				t.Errorf("text summary misses error categories: %v", out.String())
+			}
+		})
+	}
+}
@@ -21,7 +21,6 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
 	"fmt"
 	"os"
 	"time"
@@ -33,6 +32,7 @@ import (
 	// local modules
 
 	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/attestedtls"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
 )
@@ -43,25 +43,24 @@ func init() {
 	apis["coap"] = CoapApi{}
 }
 
-func (a CoapApi) generate(c *config) {
+func (a CoapApi) generate(c *config) ([]byte, error) {
 
 	log.Tracef("Connecting via CoAP to %v", c.CmcAddr)
 
 	// Establish connection
 	conn, err := udp.Dial(c.CmcAddr)
 	if err != nil {
-		log.Fatalf("Error dialing: %v", err)
+		return nil, unreachableErrorf("error dialing: %w", err)
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	path := "/Attest"
 
-	// Generate random nonce
-	nonce := make([]byte, 8)
-	_, err = rand.Read(nonce)
+	// Use the configured nonce or generate a random nonce
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Failed to read random bytes: %v", err)
+		return nil, err
 	}
 
 	// Generate attestation request
@@ -72,55 +71,103 @@ func (a CoapApi) generate(c *config) {
 	// Marshal CoAP payload
 	payload, err := cbor.Marshal(req)
 	if err != nil {
-		log.Fatalf("failed to marshal payload: %v", err)
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	// Send CoAP POST request
+	// Send CoAP POST request. CoAP is connectionless, an unreachable cmcd
+	// only becomes apparent when the request times out
 	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		log.Fatalf("failed to send request: %v", err)
+		return nil, unreachableErrorf("failed to send request: %w", err)
 	}
 
 	// Read CoAP reply body
 	payload, err = resp.ReadBody()
 	if err != nil {
-		log.Fatalf("failed to read body: %v", err)
+		return nil, fmt.Errorf("failed to read body: %w", err)
 	}
 
 	// Unmarshal attestation response
 	var attestationResp api.AttestationResponse
 	err = cbor.Unmarshal(payload, &attestationResp)
 	if err != nil {
-		log.Fatalf("failed to unmarshal response")
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
 	// Save the attestation report for the verifier
 	err = os.WriteFile(c.ReportFile, attestationResp.AttestationReport, 0644)
 	if err != nil {
-		log.Fatalf("Failed to save attestation report as %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to save attestation report as %v: %w", c.ReportFile, err)
 	}
 	log.Infof("Wrote attestation report: %v", c.ReportFile)
 
 	// Save the nonce for the verifier
-	os.WriteFile(c.NonceFile, nonce, 0644)
+	if c.NonceFile != "" {
+		err = os.WriteFile(c.NonceFile, nonce, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save nonce as %v: %w", c.NonceFile, err)
+		}
+		log.Infof("Wrote nonce: %v", c.NonceFile)
+	}
+
+	return attestationResp.AttestationReport, nil
+}
+
+func (a CoapApi) dryrun(c *config) (*ar.DryRunSummary, error) {
+
+	log.Tracef("Connecting via CoAP to %v", c.CmcAddr)
+
+	// Establish connection
+	conn, err := udp.Dial(c.CmcAddr)
+	if err != nil {
+		return nil, unreachableErrorf("error dialing: %w", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	nonce, err := getNonce(c)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := cbor.Marshal(&api.AttestationRequest{Nonce: nonce, DryRun: true})
 	if err != nil {
-		log.Fatalf("Failed to save nonce as %v: %v", c.NonceFile, err)
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
-	log.Infof("Wrote nonce: %v", c.NonceFile)
 
+	// Send CoAP POST request. CoAP is connectionless, an unreachable cmcd
+	// only becomes apparent when the request times out
+	resp, err := conn.Post(ctx, "/Attest", message.AppCBOR, bytes.NewReader(payload))
+	if err != nil {
+		return nil, unreachableErrorf("failed to send request: %w", err)
+	}
+
+	payload, err = resp.ReadBody()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	var attestationResp api.AttestationResponse
+	err = cbor.Unmarshal(payload, &attestationResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return decodeDryRun(attestationResp.DryRunSummary)
 }
 
-func (a CoapApi) verify(c *config) {
+func (a CoapApi) verify(c *config) (*ar.VerificationResult, error) {
 
 	// Read the attestation report, CA and the nonce previously stored
 	data, err := os.ReadFile(c.ReportFile)
 	if err != nil {
-		log.Fatalf("Failed to read file %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to read file %v: %w", c.ReportFile, err)
 	}
 
 	nonce, err := os.ReadFile(c.NonceFile)
 	if err != nil {
-		log.Fatalf("Failed to read nonce: %v", err)
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
 	}
 
 	req := &api.VerificationRequest{
@@ -132,13 +179,10 @@ func (a CoapApi) verify(c *config) {
 
 	resp, err := verifyInternal(c.CmcAddr, req)
 	if err != nil {
-		log.Fatalf("Failed to verify: %v", err)
+		return nil, fmt.Errorf("failed to verify: %w", err)
 	}
 
-	err = saveResult(c.ResultFile, c.Publish, resp.VerificationResult)
-	if err != nil {
-		log.Fatalf("Failed to save result: %v", err)
-	}
+	return parseResult(resp.VerificationResult)
 }
 
 func (a CoapApi) measure(c *config) {
@@ -172,12 +216,12 @@ func (a CoapApi) measure(c *config) {
 	log.Infof("Measure Result: %v", resp.Success)
 }
 
-func (a CoapApi) dial(c *config) {
-	dialInternal(c, attestedtls.CmcApi_COAP, nil)
+func (a CoapApi) dial(c *config) error {
+	return dialInternal(c, attestedtls.CmcApi_COAP, nil)
 }
 
-func (a CoapApi) listen(c *config) {
-	listenInternal(c, attestedtls.CmcApi_COAP, nil)
+func (a CoapApi) listen(c *config) error {
+	return listenInternal(c, attestedtls.CmcApi_COAP, nil)
 }
 
 func (a CoapApi) request(c *config) {
@@ -208,7 +252,7 @@ func verifyInternal(addr string, req *api.VerificationRequest,
 	// Establish connection
 	conn, err := udp.Dial(addr)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %v", err)
+		return nil, unreachableErrorf("error dialing: %w", err)
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -224,7 +268,7 @@ func verifyInternal(addr string, req *api.VerificationRequest,
 	// Send CoAP POST request
 	resp, err := conn.Post(ctx, path, message.AppCBOR, bytes.NewReader(payload))
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return nil, unreachableErrorf("failed to send request: %w", err)
 	}
 
 	// Read CoAP reply body
@@ -16,41 +16,74 @@
 package main
 
 // Install github packages with "go get [url]"
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+)
 
-// local modules
-
-func generate(c *config) {
-	c.api.generate(c)
+func generate(c *config) error {
+	o := newOutput("generate", "")
+	report, err := c.api.generate(c)
+	o.ReportId = reportId(report)
+	return o.finish(c, err)
 }
 
-func verify(c *config) {
-	c.api.verify(c)
+func verify(c *config) error {
+	o := newOutput("verify", "")
+	result, err := c.api.verify(c)
+	if err == nil {
+		o.Result = result
+		err = saveResult(c.ResultFile, c.Publish, result)
+	}
+	if report, rerr := os.ReadFile(c.ReportFile); rerr == nil {
+		o.ReportId = reportId(report)
+	}
+	return o.finish(c, err)
 }
 
-func measure(c *config) {
+func measure(c *config) error {
 	c.api.measure(c)
+	return nil
 }
 
-func dial(c *config) {
-	c.api.dial(c)
+func dial(c *config) error {
+	return c.api.dial(c)
 }
 
-func listen(c *config) {
-	c.api.listen(c)
+func listen(c *config) error {
+	return c.api.listen(c)
 }
 
-func request(c *config) {
+func request(c *config) error {
 	c.api.request(c)
+	return nil
 }
 
-func serve(c *config) {
+func serve(c *config) error {
 	c.api.serve(c)
+	return nil
 }
 
-func getCaCerts(c *config) {
+func getCaCerts(c *config) error {
 	c.api.cacerts(c)
+	return nil
 }
 
-func iothub(c *config) {
+func iothub(c *config) error {
 	c.api.iothub(c)
+	return nil
+}
+
+// getNonce returns the nonce specified for the operation or a random nonce
+func getNonce(c *config) ([]byte, error) {
+	if len(c.nonce) > 0 {
+		return c.nonce, nil
+	}
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return nonce, nil
 }
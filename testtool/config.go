@@ -25,9 +25,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Fraunhofer-AISEC/cmc/api"
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
+	v "github.com/Fraunhofer-AISEC/cmc/verify"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/maps"
 )
@@ -59,11 +61,12 @@ var (
 
 type Api interface {
 	cacerts(c *config)
-	generate(c *config)
-	verify(c *config)
+	generate(c *config) ([]byte, error)
+	dryrun(c *config) (*ar.DryRunSummary, error)
+	verify(c *config) (*ar.VerificationResult, error)
 	measure(c *config)
-	dial(c *config)
-	listen(c *config)
+	dial(c *config) error
+	listen(c *config) error
 	request(c *config)
 	serve(c *config)
 	iothub(c *config)
@@ -90,6 +93,23 @@ type config struct {
 	Method       string   `json:"method"`
 	Data         string   `json:"data"`
 	Serializer   string   `json:"socketApiSerializer"`
+	Format       string   `json:"format"`
+	// Optional compression algorithms accepted for socket API attestation
+	// responses in the order of preference, e.g. ["zstd", "gzip"]
+	Compression []string `json:"socketApiCompression,omitempty"`
+	// Optional certificate profile of the cmcd TLS certificate
+	CertProfile string `json:"certProfile,omitempty"`
+	// Optional limits for decoding reports and responses, e.g. for huge IMA logs
+	DecodeLimits *ar.DecodeLimits `json:"decodeLimits,omitempty"`
+	// Optional baseline for the accepted algorithms and key sizes of reports
+	Appraisal *v.Appraisal `json:"appraisal,omitempty"`
+	// Optional serializer all verified reports and their metadata must use
+	PinSerializer string `json:"pinSerializer,omitempty"`
+	// Optional sources of the salts of redacted event names withheld by the provers
+	RedactionSalts []string `json:"redactionSalts,omitempty"`
+	// Optional metadata locations with the reference values for verifying
+	// Entity Attestation Tokens of attesters other than the CMC
+	EatMetadata []string `json:"eatMetadata,omitempty"`
 	// Only Lib API
 	ProvAddr       string   `json:"provServerAddr"`
 	Metadata       []string `json:"metadata"`
@@ -99,6 +119,18 @@ type config struct {
 	MeasurementLog bool     `json:"measurementLog"`
 	UseIma         bool     `json:"useIma"`
 	ImaPcr         int      `json:"imaPcr"`
+	// Only bench mode
+	BenchConcurrency int    `json:"benchConcurrency"`
+	BenchOps         int    `json:"benchOps"`
+	BenchDuration    string `json:"benchDuration"`
+	BenchMix         string `json:"benchMix"`
+	BenchRampUp      string `json:"benchRampUp"`
+	ReuseConn        bool   `json:"reuseConn"`
+	// Only perf modes
+	PerfBytes    int64  `json:"perfBytes"`
+	PerfMsgSize  int    `json:"perfMsgSize"`
+	PerfMode     string `json:"perfMode"`
+	PerfBaseline string `json:"perfBaseline"`
 	// Only container measurements
 	CtrAlgo   string `json:"ctrAlgo"`
 	CtrName   string `json:"ctrName"`
@@ -107,9 +139,12 @@ type config struct {
 
 	ca         []byte
 	policies   []byte
+	nonce      []byte
 	api        Api
 	interval   time.Duration
 	serializer ar.Serializer
+	// Compression algorithms accepted for socket API attestation responses
+	compression []api.Compression
 }
 
 const (
@@ -131,6 +166,7 @@ const (
 	publishFlag    = "publish"
 	intervalFlag   = "interval"
 	serializerFlag = "serializer"
+	formatFlag     = "format"
 	// Only lib API
 	provAddrFlag       = "prov"
 	metadataFlag       = "metadata"
@@ -143,13 +179,25 @@ const (
 	dataFlag           = "data"
 	imaFlag            = "ima"
 	imaPcrFlag         = "pcr"
+	// Only bench mode flags
+	concurrencyFlag = "concurrency"
+	opsFlag         = "ops"
+	durationFlag    = "duration"
+	mixFlag         = "mix"
+	rampUpFlag      = "rampup"
+	reuseConnFlag   = "reuse-conn"
+	// Only perf mode flags
+	bytesFlag    = "bytes"
+	msgSizeFlag  = "msgsize"
+	perfModeFlag = "perfmode"
+	baselineFlag = "baseline"
 	// Only container image measure flags
 	ctrNameFlag   = "ctrname"
 	ctrRootfsFlag = "ctrrootfs"
 	ctrConfigFlag = "ctrconfig"
 )
 
-func getConfig() *config {
+func getConfig() (*config, error) {
 	var err error
 	var ok bool
 
@@ -164,7 +212,7 @@ func getConfig() *config {
 	caFile := flag.String(caFlag, "", "Certificate Authorities to be trusted in PEM format")
 	policiesFile := flag.String(policiesFlag, "", "JSON policies file for custom verification")
 	api := flag.String(apiFlag, "", fmt.Sprintf("APIs for cmcd. Possible: %v", maps.Keys(apis)))
-	network := flag.String(networkFlag, "", "Network for socket API [unix tcp]")
+	network := flag.String(networkFlag, "", "Network for socket API [unix tcp vsock]")
 	mtls := flag.Bool(mtlsFlag, false, "Performs mutual TLS")
 	attest := flag.String(attestFlag, "", "Peforms performs remote attestation: mutual, server only,"+
 		"client only, or none [mutual, server, client, none]")
@@ -175,6 +223,7 @@ func getConfig() *config {
 		"Interval at which connectors will be attested. If set to <=0, attestation will only be"+
 			" done once")
 	serializer := flag.String(serializerFlag, "", "Serializer to be used for socket API (JSON or CBOR)")
+	format := flag.String(formatFlag, "", "Output format: text (logs only) or json (one JSON document per operation on stdout)")
 	// Lib API flags
 	provAddr := flag.String(provAddrFlag, "",
 		"Address of the provisioning server (only for libapi)")
@@ -196,6 +245,16 @@ func getConfig() *config {
 		"Indicates whether to use Integrity Measurement Architecture (IMA)")
 	pcr := flag.Int(imaPcrFlag, 0, "IMA PCR")
 	// Container measurement flags
+	concurrency := flag.Int(concurrencyFlag, 0, "Number of parallel workers in mode bench")
+	ops := flag.Int(opsFlag, 0, "Total number of operations in mode bench")
+	duration := flag.String(durationFlag, "", "Duration of the benchmark in mode bench, e.g. 30s")
+	mix := flag.String(mixFlag, "", "Operation mix in mode bench with optional weights, e.g. attest=3,verify=1,dial=1")
+	rampUp := flag.String(rampUpFlag, "", "Period over which the workers are started in mode bench")
+	reuseConn := flag.Bool(reuseConnFlag, false, "Share connections to the cmcd between the workers in mode bench")
+	perfBytes := flag.Int64(bytesFlag, 0, "Volume in bytes the dialer sends in mode perf")
+	msgSize := flag.Int(msgSizeFlag, 0, "Message size in bytes in mode perf")
+	perfMode := flag.String(perfModeFlag, "", "Whether the listener echoes or discards the data in mode perf [echo discard]")
+	baseline := flag.String(baselineFlag, "", "Address of the plain TLS baseline to dial in mode perf / to listen on in mode perfserver")
 	ctrName := flag.String(ctrNameFlag, "", "Specifies name of container to be measured")
 	ctrRootfs := flag.String(ctrRootfsFlag, "", "Specifies rootfs path of the container to be measured")
 	ctrConfig := flag.String(ctrConfigFlag, "", "Specifies config path of the container to be measured")
@@ -216,6 +275,15 @@ func getConfig() *config {
 		Attest:      "mutual",
 		Method:      "GET",
 		Serializer:  "cbor",
+		Format:      formatText,
+		// Bench mode
+		BenchConcurrency: 1,
+		BenchMix:         benchAttest,
+		BenchRampUp:      "1s",
+		// Perf modes
+		PerfBytes:   defaultPerfBytes,
+		PerfMsgSize: defaultPerfMsgSize,
+		PerfMode:    perfEcho,
 	}
 
 	// Obtain custom configuration from file if specified
@@ -223,11 +291,11 @@ func getConfig() *config {
 		log.Infof("Loading config from file %v", *configFile)
 		data, err := os.ReadFile(*configFile)
 		if err != nil {
-			log.Fatalf("Failed to read testtool config file %v: %v", *configFile, err)
+			return nil, usageErrorf("failed to read testtool config file %v: %w", *configFile, err)
 		}
 		err = json.Unmarshal(data, c)
 		if err != nil {
-			log.Fatalf("Failed to parse testtool config: %v", err)
+			return nil, usageErrorf("failed to parse testtool config: %w", err)
 		}
 	}
 
@@ -280,6 +348,9 @@ func getConfig() *config {
 	if internal.FlagPassed(serializerFlag) {
 		c.Serializer = *serializer
 	}
+	if internal.FlagPassed(formatFlag) {
+		c.Format = *format
+	}
 	// Lib API flags
 	if internal.FlagPassed(provAddrFlag) {
 		c.ProvAddr = *provAddr
@@ -314,6 +385,38 @@ func getConfig() *config {
 	if internal.FlagPassed(imaPcrFlag) {
 		c.ImaPcr = *pcr
 	}
+	// Bench mode
+	if internal.FlagPassed(concurrencyFlag) {
+		c.BenchConcurrency = *concurrency
+	}
+	if internal.FlagPassed(opsFlag) {
+		c.BenchOps = *ops
+	}
+	if internal.FlagPassed(durationFlag) {
+		c.BenchDuration = *duration
+	}
+	if internal.FlagPassed(mixFlag) {
+		c.BenchMix = *mix
+	}
+	if internal.FlagPassed(rampUpFlag) {
+		c.BenchRampUp = *rampUp
+	}
+	if internal.FlagPassed(reuseConnFlag) {
+		c.ReuseConn = *reuseConn
+	}
+	// Perf modes
+	if internal.FlagPassed(bytesFlag) {
+		c.PerfBytes = *perfBytes
+	}
+	if internal.FlagPassed(msgSizeFlag) {
+		c.PerfMsgSize = *msgSize
+	}
+	if internal.FlagPassed(perfModeFlag) {
+		c.PerfMode = *perfMode
+	}
+	if internal.FlagPassed(baselineFlag) {
+		c.PerfBaseline = *baseline
+	}
 	// Container measurements
 	if internal.FlagPassed(ctrNameFlag) {
 		c.CtrName = *ctrName
@@ -327,7 +430,7 @@ func getConfig() *config {
 
 	intervalDuration, err := time.ParseDuration(c.IntervalStr)
 	if err != nil {
-		log.Fatalf("Failed to parse monitoring interval: %v", err)
+		return nil, usageErrorf("failed to parse monitoring interval: %w", err)
 	}
 	c.interval = intervalDuration
 
@@ -335,9 +438,9 @@ func getConfig() *config {
 	l, ok := logLevels[strings.ToLower(c.LogLevel)]
 	if !ok {
 		flag.Usage()
-		log.Fatalf("LogLevel %v does not exist", c.LogLevel)
+		return nil, usageErrorf("log level %v does not exist", c.LogLevel)
 	}
-	logrus.SetLevel(l)
+	internal.SetLogLevel(l)
 
 	// Convert all paths to absolute paths
 	pathsToAbs(c)
@@ -346,19 +449,19 @@ func getConfig() *config {
 	printConfig(c)
 
 	// Get root CA certificate in PEM format if specified
-	if c.Mode != "generate" && c.Mode != "cacerts" && c.Mode != "measure" {
+	if c.Mode != "generate" && c.Mode != "dryrun" && c.Mode != "cacerts" && c.Mode != "measure" {
 		if c.CaFile != "" {
 			c.ca, err = os.ReadFile(c.CaFile)
 			if err != nil {
-				log.Fatalf("Failed to read certificate file %v: %v", *caFile, err)
+				return nil, usageErrorf("failed to read certificate file %v: %w", c.CaFile, err)
 			}
 		} else {
-			log.Fatal("Path to read CA certificate file must be specified either via config file or commandline")
+			return nil, usageErrorf("path to read CA certificate file must be specified either via config file or commandline")
 		}
 	}
 
 	if c.Mode == "cacerts" && c.CaFile == "" {
-		log.Fatal("Path to store CA file must be specified either via config file or commandline")
+		return nil, usageErrorf("path to store CA file must be specified either via config file or commandline")
 	}
 
 	// Add optional policies if specified
@@ -366,7 +469,7 @@ func getConfig() *config {
 		log.Debug("Adding specified policies")
 		c.policies, err = os.ReadFile(c.PoliciesFile)
 		if err != nil {
-			log.Fatalf("Failed to read policies file: %v", err)
+			return nil, usageErrorf("failed to read policies file: %w", err)
 		}
 	}
 
@@ -375,17 +478,72 @@ func getConfig() *config {
 	c.serializer, ok = serializers[strings.ToLower(c.Serializer)]
 	if !ok {
 		flag.Usage()
-		log.Fatalf("Serializer %v is not implemented", c.Serializer)
+		return nil, usageErrorf("serializer %v is not implemented", c.Serializer)
+	}
+
+	// Get the accepted compression algorithms, which the cmcd only uses if
+	// compiled in
+	compression, err := parseCompressions(c.Compression)
+	if err != nil {
+		return nil, usageErrorf("invalid socket API compression: %w", err)
+	}
+	c.compression = compression
+
+	// Set the decoding limits for reports and responses
+	if c.DecodeLimits != nil {
+		if err := ar.SetDecodeLimits(*c.DecodeLimits); err != nil {
+			return nil, usageErrorf("failed to set decoding limits: %w", err)
+		}
+	}
+	if c.Appraisal != nil {
+		if err := v.SetAppraisal(*c.Appraisal); err != nil {
+			return nil, usageErrorf("failed to set appraisal baseline: %w", err)
+		}
+	}
+	if err := ar.SetSerializerPin(c.PinSerializer); err != nil {
+		return nil, usageErrorf("failed to pin serializer: %w", err)
+	}
+	if len(c.RedactionSalts) > 0 {
+		salts := make([][]byte, 0, len(c.RedactionSalts))
+		for _, source := range c.RedactionSalts {
+			salt, err := internal.GetSecret(source, "redaction salt")
+			if err != nil {
+				return nil, fmt.Errorf("failed to read redaction salt: %w", err)
+			}
+			salts = append(salts, salt)
+		}
+		v.SetRedactionSalts(salts)
+	}
+	if len(c.EatMetadata) > 0 {
+		metadata, _, err := cmc.GetMetadata(c.EatMetadata, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get EAT metadata: %w", err)
+		}
+		if err := v.SetEatMetadata(metadata); err != nil {
+			return nil, usageErrorf("failed to set EAT metadata: %w", err)
+		}
 	}
 
 	// Get API
 	c.api, ok = apis[strings.ToLower(c.Api)]
 	if !ok {
 		flag.Usage()
-		log.Fatalf("API %v is not implemented", c.Api)
+		return nil, usageErrorf("API %v is not implemented", c.Api)
+	}
+
+	// Check the output format
+	c.Format = strings.ToLower(c.Format)
+	if c.Format == formatCsv && !strings.EqualFold(c.Mode, "bench") {
+		flag.Usage()
+		return nil, usageErrorf("output format %v is only supported in mode bench", c.Format)
+	}
+	if c.Format != formatText && c.Format != formatJson && c.Format != formatCsv {
+		flag.Usage()
+		return nil, usageErrorf("output format %v is not supported (%v, %v, %v)", c.Format,
+			formatText, formatJson, formatCsv)
 	}
 
-	return c
+	return c, nil
 }
 
 func pathsToAbs(c *config) {
@@ -446,6 +604,7 @@ func printConfig(c *config) {
 	log.Debugf("\tLogLevel     : %v", c.LogLevel)
 	log.Debugf("\tAttest       : %v", c.Attest)
 	log.Debugf("\tPublish      : %v", c.Publish)
+	log.Debugf("\tFormat       : %v", c.Format)
 	if strings.EqualFold(c.Mode, "request") {
 		log.Debugf("\tHTTP Data    : %v", c.Data)
 		log.Debugf("\tHTTP Header  : %v", c.Header)
@@ -454,6 +613,20 @@ func printConfig(c *config) {
 	if c.PoliciesFile != "" {
 		log.Debugf("\tPoliciesFile: %v", c.PoliciesFile)
 	}
+	if strings.EqualFold(c.Mode, "bench") {
+		log.Debugf("\tConcurrency  : %v", c.BenchConcurrency)
+		log.Debugf("\tOperations   : %v", c.BenchOps)
+		log.Debugf("\tDuration     : %v", c.BenchDuration)
+		log.Debugf("\tMix          : %v", c.BenchMix)
+		log.Debugf("\tRamp-Up      : %v", c.BenchRampUp)
+		log.Debugf("\tReuse Conn   : %v", c.ReuseConn)
+	}
+	if strings.EqualFold(c.Mode, "perf") || strings.EqualFold(c.Mode, "perfserver") {
+		log.Debugf("\tBytes        : %v", c.PerfBytes)
+		log.Debugf("\tMessage Size : %v", c.PerfMsgSize)
+		log.Debugf("\tPerf Mode    : %v", c.PerfMode)
+		log.Debugf("\tBaseline     : %v", c.PerfBaseline)
+	}
 	if strings.EqualFold(c.Api, "socket") {
 		log.Debugf("\tApi (Network): %v (%v, %v)", c.Api, c.Network, c.Serializer)
 	} else {
@@ -470,3 +643,16 @@ func printConfig(c *config) {
 		log.Debugf("\tIMA PCR      : %v", c.ImaPcr)
 	}
 }
+
+// parseCompressions returns the compression algorithms with the names
+func parseCompressions(names []string) ([]api.Compression, error) {
+	compression := make([]api.Compression, 0, len(names))
+	for _, name := range names {
+		c, err := api.ParseCompression(name)
+		if err != nil {
+			return nil, err
+		}
+		compression = append(compression, c)
+	}
+	return compression, nil
+}
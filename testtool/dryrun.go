@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func dryRun(c *config) error {
+	o := newOutput("dryrun", "")
+	summary, err := c.api.dryrun(c)
+	if err == nil {
+		o.DryRun = summary
+		if c.Format != formatJson {
+			logDryRun(summary)
+		}
+	}
+	return o.finish(c, err)
+}
+
+// decodeDryRun decodes the JSON encoded dry-run summary of the cmcd
+func decodeDryRun(data []byte) (*ar.DryRunSummary, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("cmcd did not return a dry-run summary")
+	}
+	summary := new(ar.DryRunSummary)
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dry-run summary: %w", err)
+	}
+	return summary, nil
+}
+
+// logDryRun prints the contents of the next attestation report
+func logDryRun(s *ar.DryRunSummary) {
+	for _, m := range s.Measurements {
+		substituted := ""
+		if m.Substituted {
+			substituted = " (substituted evidence)"
+		}
+		log.Infof("Measurement %v: %v bytes, %v artifacts, %v certificates, evidence %v%v",
+			m.Type, m.Size, m.Artifacts, m.Certs, m.Digest, substituted)
+	}
+	for _, m := range s.Metadata {
+		log.Infof("Metadata %v %v %v: %v bytes, %v", m.Type, m.Name, m.Version, m.Size, m.Digest)
+	}
+	names := maps.Keys(s.Sizes)
+	slices.Sort(names)
+	for _, name := range names {
+		log.Infof("Unsigned report size (%v): %v bytes", name, s.Sizes[name])
+	}
+	for _, w := range s.Warnings {
+		log.Warnf("Warning: %v", w)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	// local modules
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	v "github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// fixturesCmd generates a self-consistent set of test data for all
+// serializers and key types, each of which is written into a subfolder of the
+// output folder together with the verification result of the report
+func fixturesCmd(args []string) error {
+
+	fs := flag.NewFlagSet("fixtures", flag.ContinueOnError)
+	out := fs.String("out", "fixtures", "Output folder for the fixtures")
+	nonceHex := fs.String(nonceFlag, "0102030405060708", "Hex encoded nonce of the attestation reports")
+	validity := fs.Duration("validity", 365*24*time.Hour, "Validity of the certificates and metadata")
+	logLevel := fs.String(logFlag, "warn", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse fixtures flags: %w", err)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	nonce, err := hex.DecodeString(*nonceHex)
+	if err != nil || len(nonce) == 0 || len(nonce) > 32 {
+		return usageErrorf("invalid nonce %v", *nonceHex)
+	}
+	if *validity <= 0 {
+		return usageErrorf("invalid validity %v", *validity)
+	}
+
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, s := range fixtures.Serializers {
+		for _, k := range fixtures.KeyTypes {
+			f, err := fixtures.Generate(fixtures.Options{
+				Serializer: s,
+				KeyType:    k,
+				Nonce:      nonce,
+				NotBefore:  notBefore,
+				NotAfter:   notBefore.Add(*validity),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to generate fixtures: %w", err)
+			}
+			dir := filepath.Join(*out, f.Name())
+			if err := f.Write(dir); err != nil {
+				return fmt.Errorf("failed to write fixtures %v: %w", f.Name(), err)
+			}
+
+			result := v.Verify(f.Report, f.Nonce, f.CaPem(), nil, 0, "")
+			if !result.Success {
+				return fmt.Errorf("verification of fixtures %v failed", f.Name())
+			}
+			data, err := json.MarshalIndent(result, "", "    ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal verification result: %w", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "result.json"), data, 0644); err != nil {
+				return fmt.Errorf("failed to write verification result: %w", err)
+			}
+			log.Infof("Generated fixtures %v", dir)
+		}
+	}
+
+	return nil
+}
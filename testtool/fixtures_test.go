@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixtures(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "fixtures")
+	if err := fixturesCmd([]string{"-out", out, "-nonce", "aabbccdd"}); err != nil {
+		t.Fatalf("fixtures error = %v", err)
+	}
+	for _, name := range []string{"json-ecdsa", "json-ed25519", "cbor-ecdsa", "cbor-ed25519"} {
+		for _, file := range []string{"ca.pem", "result.json", "metadata/os.manifest"} {
+			matches, _ := filepath.Glob(filepath.Join(out, name, file+"*"))
+			if len(matches) == 0 {
+				t.Errorf("fixtures %v missing %v", name, file)
+			}
+		}
+		nonce, err := os.ReadFile(filepath.Join(out, name, "nonce"))
+		if err != nil || string(nonce) != "aabbccdd\n" {
+			t.Errorf("fixtures %v nonce = %q, want aabbccdd", name, nonce)
+		}
+	}
+
+	for _, args := range [][]string{{"-nonce", "xyz"}, {"-validity", "-1h"}, {"-foo"}} {
+		if got := exitCode(fixturesCmd(args)); got != exitUsage {
+			t.Errorf("fixtures %v exit code = %v, want %v", args, got, exitUsage)
+		}
+	}
+}
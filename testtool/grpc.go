@@ -20,15 +20,18 @@ package main
 // Install github packages with "go get [url]"
 import (
 	"context"
-	"crypto/rand"
+	"fmt"
 	"os"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	// local modules
 
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/attestedtls"
 	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
@@ -40,7 +43,7 @@ func init() {
 	apis["grpc"] = GrpcApi{}
 }
 
-func (a GrpcApi) generate(c *config) {
+func (a GrpcApi) generate(c *config) ([]byte, error) {
 
 	// Establish connection
 	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
@@ -50,16 +53,15 @@ func (a GrpcApi) generate(c *config) {
 
 	conn, err := grpc.DialContext(ctx, c.CmcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("Failed to connect to cmcd: %v", err)
+		return nil, unreachableErrorf("failed to connect to cmcd: %w", err)
 	}
 	defer conn.Close()
 	client := api.NewCMCServiceClient(conn)
 
-	// Generate random nonce
-	nonce := make([]byte, 8)
-	_, err = rand.Read(nonce)
+	// Use the configured nonce or generate a random nonce
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Failed to read random bytes: %v", err)
+		return nil, err
 	}
 
 	request := api.AttestationRequest{
@@ -67,29 +69,63 @@ func (a GrpcApi) generate(c *config) {
 	}
 	response, err := client.Attest(ctx, &request)
 	if err != nil {
-		log.Fatalf("GRPC Attest Call failed: %v", err)
+		return nil, fmt.Errorf("gRPC Attest call failed: %w", err)
 	}
 	if response.GetStatus() != api.Status_OK {
-		log.Fatalf("Failed to generate attestation report. Status %v", response.GetStatus())
+		return nil, fmt.Errorf("failed to generate attestation report. Status %v", response.GetStatus())
 	}
 
 	// Save the Attestation Report for the verifier
 	err = os.WriteFile(c.ReportFile, response.GetAttestationReport(), 0644)
 	if err != nil {
-		log.Fatalf("Failed to save attestation report as %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to save attestation report as %v: %w", c.ReportFile, err)
 	}
 	log.Infof("Wrote attestation report: %v", c.ReportFile)
 
 	// Save the nonce for the verifier
-	os.WriteFile(c.NonceFile, nonce, 0644)
+	if c.NonceFile != "" {
+		err = os.WriteFile(c.NonceFile, nonce, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save nonce as %v: %w", c.NonceFile, err)
+		}
+		log.Infof("Wrote nonce: %v", c.NonceFile)
+	}
+
+	return response.GetAttestationReport(), nil
+}
+
+func (a GrpcApi) dryrun(c *config) (*ar.DryRunSummary, error) {
+
+	// Establish connection
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
+	defer cancel()
+
+	log.Tracef("Connecting via gRPC to %v", c.CmcAddr)
+
+	conn, err := grpc.DialContext(ctx, c.CmcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("Failed to save nonce as %v: %v", c.NonceFile, err)
+		return nil, unreachableErrorf("failed to connect to cmcd: %w", err)
 	}
-	log.Infof("Wrote nonce: %v", c.NonceFile)
+	defer conn.Close()
+	client := api.NewCMCServiceClient(conn)
 
+	nonce, err := getNonce(c)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Attest(ctx, &api.AttestationRequest{Nonce: nonce, DryRun: true})
+	if err != nil {
+		return nil, fmt.Errorf("gRPC Attest call failed: %w", err)
+	}
+	if response.GetStatus() != api.Status_OK {
+		return nil, fmt.Errorf("failed to perform dry-run. Status %v", response.GetStatus())
+	}
+
+	return decodeDryRun(response.GetDryRunSummary())
 }
 
-func (a GrpcApi) verify(c *config) {
+func (a GrpcApi) verify(c *config) (*ar.VerificationResult, error) {
 
 	// Establish connection
 	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
@@ -99,7 +135,7 @@ func (a GrpcApi) verify(c *config) {
 
 	conn, err := grpc.DialContext(ctx, c.CmcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("Failed to connect to cmcd: %v", err)
+		return nil, unreachableErrorf("failed to connect to cmcd: %w", err)
 	}
 	defer conn.Close()
 	client := api.NewCMCServiceClient(conn)
@@ -107,12 +143,12 @@ func (a GrpcApi) verify(c *config) {
 	// Read the attestation report, CA and the nonce previously stored
 	data, err := os.ReadFile(c.ReportFile)
 	if err != nil {
-		log.Fatalf("Failed to read file %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to read file %v: %w", c.ReportFile, err)
 	}
 
 	nonce, err := os.ReadFile(c.NonceFile)
 	if err != nil {
-		log.Fatalf("Failed to read nonce: %v", err)
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
 	}
 
 	request := api.VerificationRequest{
@@ -124,18 +160,15 @@ func (a GrpcApi) verify(c *config) {
 
 	response, err := client.Verify(ctx, &request)
 	if err != nil {
-		log.Fatalf("GRPC Verify Call failed: %v", err)
+		return nil, fmt.Errorf("gRPC Verify call failed: %w", err)
 	}
 	if response.GetStatus() != api.Status_OK {
 		log.Warnf("Failed to verify attestation report. Status %v", response.GetStatus())
 	}
 
-	err = saveResult(c.ResultFile, c.Publish, response.GetVerificationResult())
-	if err != nil {
-		log.Fatalf("Failed to save result: %v", err)
-	}
-
 	log.Debug("Finished verify")
+
+	return parseResult(response.GetVerificationResult())
 }
 
 func (a GrpcApi) measure(c *config) {
@@ -185,12 +218,12 @@ func (a GrpcApi) measure(c *config) {
 	log.Debug("Finished measure")
 }
 
-func (a GrpcApi) dial(c *config) {
-	dialInternal(c, attestedtls.CmcApi_GRPC, nil)
+func (a GrpcApi) dial(c *config) error {
+	return dialInternal(c, attestedtls.CmcApi_GRPC, nil)
 }
 
-func (a GrpcApi) listen(c *config) {
-	listenInternal(c, attestedtls.CmcApi_GRPC, nil)
+func (a GrpcApi) listen(c *config) error {
+	return listenInternal(c, attestedtls.CmcApi_GRPC, nil)
 }
 
 func (a GrpcApi) request(c *config) {
@@ -208,3 +241,74 @@ func (a GrpcApi) cacerts(c *config) {
 func (a GrpcApi) iothub(c *config) {
 	log.Fatalf("IoT hub not implemented for gRPC")
 }
+
+func (a GrpcApi) cmcApi() attestedtls.CmcApiSelect {
+	return attestedtls.CmcApi_GRPC
+}
+
+// grpcBenchClient performs the benchmark operations via a gRPC connection,
+// which is established on the first request
+type grpcBenchClient struct {
+	conn     *grpc.ClientConn
+	client   api.CMCServiceClient
+	ca       []byte
+	policies []byte
+}
+
+func (a GrpcApi) benchClient(c *config) (benchClient, error) {
+	conn, err := grpc.Dial(c.CmcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
+	}
+	return &grpcBenchClient{
+		conn:     conn,
+		client:   api.NewCMCServiceClient(conn),
+		ca:       c.ca,
+		policies: c.policies,
+	}, nil
+}
+
+func (b *grpcBenchClient) attest(nonce []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
+	defer cancel()
+
+	response, err := b.client.Attest(ctx, &api.AttestationRequest{Nonce: nonce})
+	if err != nil {
+		return nil, grpcError("Attest", err)
+	}
+	if response.GetStatus() != api.Status_OK {
+		return nil, fmt.Errorf("failed to generate attestation report. Status %v", response.GetStatus())
+	}
+	return response.GetAttestationReport(), nil
+}
+
+func (b *grpcBenchClient) verify(report, nonce []byte) (*ar.VerificationResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutSec*time.Second)
+	defer cancel()
+
+	response, err := b.client.Verify(ctx, &api.VerificationRequest{
+		Nonce:             nonce,
+		AttestationReport: report,
+		Ca:                b.ca,
+		Policies:          b.policies,
+	})
+	if err != nil {
+		return nil, grpcError("Verify", err)
+	}
+	return parseResult(response.GetVerificationResult())
+}
+
+func (b *grpcBenchClient) close() {
+	b.conn.Close()
+}
+
+// grpcError classifies the error of a gRPC call
+func grpcError(method string, err error) error {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return unreachableErrorf("gRPC %v call failed: %w", method, err)
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("gRPC %v call failed: %w", method, context.DeadlineExceeded)
+	}
+	return fmt.Errorf("gRPC %v call failed: %w", method, err)
+}
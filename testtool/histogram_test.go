@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_bucketIndex(t *testing.T) {
+	// Bucket indices must be contiguous and the values must be within their bucket
+	prev := -1
+	for v := uint64(0); v < 1<<16; v++ {
+		idx := bucketIndex(v)
+		if idx != prev && idx != prev+1 {
+			t.Fatalf("bucketIndex(%v) = %v, previous %v", v, idx, prev)
+		}
+		if upper := bucketUpper(idx); v > upper || float64(upper-v) > 0.04*float64(v)+1 {
+			t.Fatalf("bucketUpper(%v) = %v for value %v", idx, upper, v)
+		}
+		prev = idx
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := new(histogram)
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	tests := []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"Min", h.min, time.Millisecond},
+		{"Max", h.max, time.Second},
+		{"Mean", h.mean(), 500500 * time.Microsecond},
+		{"P50", h.quantile(0.5), 500 * time.Millisecond},
+		{"P99", h.quantile(0.99), 990 * time.Millisecond},
+		{"P100", h.quantile(1), time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Quantiles are bucket upper bounds with a relative error of about 3%
+			if tt.got < tt.want || float64(tt.got-tt.want) > 0.04*float64(tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+
+	merged := new(histogram)
+	merged.merge(h)
+	merged.merge(new(histogram))
+	merged.record(2 * time.Second)
+	if merged.count != 1001 || merged.max != 2*time.Second || merged.min != time.Millisecond {
+		t.Errorf("merged histogram count %v, min %v, max %v", merged.count, merged.min,
+			merged.max)
+	}
+}
@@ -70,6 +70,7 @@ func requestInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) error {
 			atls.WithCmcAddr(c.CmcAddr),
 			atls.WithCmcApi(api),
 			atls.WithCmcNetwork(c.Network),
+			atls.WithCertProfile(c.CertProfile),
 			atls.WithCmc(cmc))
 		if err != nil {
 			log.Fatalf("failed to get TLS Certificate: %v", err)
@@ -179,6 +180,7 @@ func serveInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 		atls.WithCmcAddr(c.CmcAddr),
 		atls.WithCmcApi(api),
 		atls.WithCmcNetwork(c.Network),
+		atls.WithCertProfile(c.CertProfile),
 		atls.WithCmc(cmc))
 	if err != nil {
 		log.Fatalf("failed to get TLS Certificate: %v", err)
@@ -0,0 +1,615 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	coseSignTag  = 98
+	coseSign1Tag = 18
+	digestLen    = 16
+)
+
+// inspection is the structure of a signed attestation report or metadata item
+// as far as it could be decoded. Malformed parts are listed as errors
+type inspection struct {
+	Serializer   string            `json:"serializer"`
+	Size         int               `json:"size"`
+	Signatures   []signatureInfo   `json:"signatures,omitempty"`
+	PayloadType  string            `json:"payloadType,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Version      string            `json:"version,omitempty"`
+	Measurements []measurementInfo `json:"measurements,omitempty"`
+	Metadata     []metadataInfo    `json:"metadata,omitempty"`
+	Errors       []string          `json:"errors,omitempty"`
+}
+
+type signatureInfo struct {
+	Algorithm    string     `json:"algorithm,omitempty"`
+	KeyId        string     `json:"kid,omitempty"`
+	Certificates []certInfo `json:"certificates,omitempty"`
+}
+
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Expired   bool      `json:"expired,omitempty"`
+}
+
+type measurementInfo struct {
+	Type         string         `json:"type"`
+	EvidenceSize int            `json:"evidenceSize"`
+	Certificates []certInfo     `json:"certificates,omitempty"`
+	Artifacts    []artifactInfo `json:"artifacts,omitempty"`
+}
+
+type artifactInfo struct {
+	Type    string      `json:"type"`
+	Pcr     *int        `json:"pcr,omitempty"`
+	Summary string      `json:"summary,omitempty"`
+	Events  []eventInfo `json:"events,omitempty"`
+}
+
+type eventInfo struct {
+	Name   string `json:"name,omitempty"`
+	Sha256 string `json:"sha256"`
+}
+
+type metadataInfo struct {
+	Item string `json:"item"`
+	*inspection
+}
+
+// jwsSignature is a signature of a JWS in JSON serialization
+type jwsSignature struct {
+	Protected string         `json:"protected"`
+	Header    map[string]any `json:"header"`
+	Signature string         `json:"signature"`
+}
+
+// inspectCmd pretty-prints the structure of an attestation report or metadata
+// file without verifying it
+func inspectCmd(args []string) error {
+
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "Print the structure as JSON document")
+	full := fs.Bool("full", false, "Print full instead of truncated digests")
+	logLevel := fs.String(logFlag, "warn", "Logging level")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: testtool inspect [-json] [-full] <report or metadata file>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse inspect flags: %w", err)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageErrorf("exactly one file must be specified")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", fs.Arg(0), err)
+	}
+
+	i := inspect(data, *full, time.Now())
+
+	if *asJson {
+		out, err := json.MarshalIndent(i, "", "    ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal inspection: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	} else {
+		i.print(os.Stdout, "")
+	}
+
+	if n := i.numErrors(); n > 0 {
+		return fmt.Errorf("%v found %v malformed parts", fs.Arg(0), n)
+	}
+	return nil
+}
+
+// inspect decodes the signed data as far as possible. The serializer is
+// detected from the data, unsigned data is decoded as plain payload
+func inspect(data []byte, full bool, now time.Time) *inspection {
+	i := &inspection{Size: len(data)}
+
+	var payload []byte
+	var s ar.Serializer
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		i.Serializer = "json"
+		s = ar.JsonSerializer{}
+		payload = i.decodeJws(trimmed, now)
+	} else {
+		i.Serializer = "cbor"
+		s = ar.CborSerializer{}
+		payload = i.decodeCose(data, now)
+	}
+	if payload == nil {
+		return i
+	}
+
+	// The type is decoded separately, as the CBOR keys of the attestation
+	// report and the metadata differ
+	var typ struct {
+		Type string `json:"type" cbor:"0,keyasint"`
+	}
+	if err := s.Unmarshal(payload, &typ); err != nil {
+		i.errorf("failed to decode payload: %v", err)
+		return i
+	}
+	i.PayloadType = typ.Type
+	if typ.Type == "" {
+		i.errorf("payload type missing")
+	}
+	if typ.Type != "Attestation Report" {
+		var info ar.MetaInfo
+		if err := s.Unmarshal(payload, &info); err != nil {
+			i.errorf("failed to decode metadata: %v", err)
+		}
+		i.Name = info.Name
+		i.Version = info.Version
+		return i
+	}
+
+	var report ar.AttestationReport
+	if err := s.Unmarshal(payload, &report); err != nil {
+		i.errorf("failed to decode attestation report: %v", err)
+		return i
+	}
+	for _, m := range report.Measurements {
+		i.Measurements = append(i.Measurements, i.measurement(&m, full, now))
+	}
+	items := []struct {
+		name string
+		data []byte
+	}{
+		{"rtmManifest", report.RtmManifest},
+		{"osManifest", report.OsManifest},
+	}
+	for idx, m := range report.AppManifests {
+		items = append(items, struct {
+			name string
+			data []byte
+		}{fmt.Sprintf("appManifests[%v]", idx), m})
+	}
+	items = append(items, []struct {
+		name string
+		data []byte
+	}{
+		{"companyDescription", report.CompanyDescription},
+		{"deviceDescription", report.DeviceDescription},
+	}...)
+	for _, item := range items {
+		if len(item.data) == 0 {
+			continue
+		}
+		i.Metadata = append(i.Metadata, metadataInfo{
+			Item:       item.name,
+			inspection: inspect(item.data, full, now),
+		})
+	}
+
+	return i
+}
+
+// decodeJws decodes a JWS in flattened or general JSON serialization. The
+// JSON is decoded token by token, so that the parts preceding a truncation
+// are still returned
+func (i *inspection) decodeJws(data []byte, now time.Time) []byte {
+
+	var payload string
+	var hasPayload bool
+	var sigs []jwsSignature
+	var flat jwsSignature
+
+	err := func() error {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			switch tok {
+			case "payload":
+				err = dec.Decode(&payload)
+				hasPayload = err == nil
+			case "protected":
+				err = dec.Decode(&flat.Protected)
+			case "header":
+				err = dec.Decode(&flat.Header)
+			case "signature":
+				err = dec.Decode(&flat.Signature)
+			case "signatures":
+				if _, err = dec.Token(); err != nil {
+					return err
+				}
+				for dec.More() {
+					var sig jwsSignature
+					if err = dec.Decode(&sig); err != nil {
+						return err
+					}
+					sigs = append(sigs, sig)
+				}
+				_, err = dec.Token()
+			default:
+				var skip json.RawMessage
+				err = dec.Decode(&skip)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		i.errorf("malformed JWS, decoded partially: %v", err)
+	}
+	if flat.Protected != "" || flat.Signature != "" {
+		sigs = append([]jwsSignature{flat}, sigs...)
+	}
+
+	if !hasPayload && len(sigs) == 0 {
+		if err == nil {
+			// Plain JSON without signature
+			i.errorf("data is not signed")
+			return data
+		}
+		return nil
+	}
+
+	if len(sigs) == 0 && err == nil {
+		i.errorf("no signatures")
+	}
+	for idx, sig := range sigs {
+		i.Signatures = append(i.Signatures, i.jwsSignature(idx, &sig, now))
+	}
+
+	if !hasPayload {
+		i.errorf("payload missing")
+		return nil
+	}
+	decoded, derr := base64.RawURLEncoding.DecodeString(strings.TrimRight(payload, "="))
+	if derr != nil {
+		i.errorf("failed to decode payload: %v", derr)
+		return nil
+	}
+	return decoded
+}
+
+func (i *inspection) jwsSignature(idx int, sig *jwsSignature, now time.Time) signatureInfo {
+	info := signatureInfo{}
+	headers := map[string]any{}
+	for k, v := range sig.Header {
+		headers[k] = v
+	}
+	if sig.Protected == "" {
+		i.errorf("signature %v: protected header missing", idx)
+	} else if raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sig.Protected, "=")); err != nil {
+		i.errorf("signature %v: failed to decode protected header: %v", idx, err)
+	} else if err := json.Unmarshal(raw, &headers); err != nil {
+		i.errorf("signature %v: failed to unmarshal protected header: %v", idx, err)
+	}
+	if sig.Signature == "" {
+		i.errorf("signature %v: signature value missing", idx)
+	}
+
+	info.Algorithm, _ = headers["alg"].(string)
+	if info.Algorithm == "" {
+		i.errorf("signature %v: algorithm missing", idx)
+	}
+	info.KeyId, _ = headers["kid"].(string)
+	if x5c, ok := headers["x5c"].([]any); ok {
+		for cidx, c := range x5c {
+			str, _ := c.(string)
+			der, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				i.errorf("signature %v: failed to decode certificate %v: %v", idx, cidx, err)
+				continue
+			}
+			info.Certificates = append(info.Certificates, i.certificate(der, now))
+		}
+	}
+	return info
+}
+
+// decodeCose decodes a COSE_Sign or COSE_Sign1 message. The elements of the
+// message are decoded one by one, so that the elements preceding a truncation
+// are still returned
+func (i *inspection) decodeCose(data []byte, now time.Time) []byte {
+
+	var tag uint64
+	var rest []byte
+	switch {
+	case len(data) >= 2 && data[0] == 0xd8 && data[1] == coseSignTag:
+		tag, rest = coseSignTag, data[2:]
+	case len(data) >= 1 && data[0] == 0xc0+coseSign1Tag:
+		tag, rest = coseSign1Tag, data[1:]
+	default:
+		if cbor.Valid(data) == nil {
+			// Plain CBOR without signature
+			i.Serializer = "cbor"
+			i.errorf("data is not signed")
+			return data
+		}
+		i.Serializer = "unknown"
+		i.errorf("data is neither a JWS, a COSE message nor valid CBOR")
+		return nil
+	}
+	if len(rest) == 0 || rest[0] != 0x84 {
+		i.errorf("malformed COSE message: expected array of four elements")
+		return nil
+	}
+
+	dec := cbor.NewDecoder(bytes.NewReader(rest[1:]))
+	var protected []byte
+	var unprotected map[any]any
+	var payload []byte
+	if err := dec.Decode(&protected); err != nil {
+		i.errorf("malformed COSE message, failed to decode protected header: %v", err)
+		return nil
+	}
+	if err := dec.Decode(&unprotected); err != nil {
+		i.errorf("malformed COSE message, failed to decode unprotected header: %v", err)
+		return nil
+	}
+	if err := dec.Decode(&payload); err != nil {
+		i.errorf("malformed COSE message, failed to decode payload: %v", err)
+		return nil
+	}
+
+	if tag == coseSign1Tag {
+		var signature []byte
+		if err := dec.Decode(&signature); err != nil {
+			i.errorf("malformed COSE message, failed to decode signature: %v", err)
+		}
+		i.Signatures = append(i.Signatures, i.coseSignature(0, protected, unprotected, now))
+		return payload
+	}
+
+	var sigs []struct {
+		_           struct{} `cbor:",toarray"`
+		Protected   []byte
+		Unprotected map[any]any
+		Signature   []byte
+	}
+	if err := dec.Decode(&sigs); err != nil {
+		i.errorf("malformed COSE message, failed to decode signatures: %v", err)
+	} else if len(sigs) == 0 {
+		i.errorf("no signatures")
+	}
+	for idx, sig := range sigs {
+		if len(sig.Signature) == 0 {
+			i.errorf("signature %v: signature value missing", idx)
+		}
+		i.Signatures = append(i.Signatures, i.coseSignature(idx, sig.Protected, sig.Unprotected, now))
+	}
+
+	return payload
+}
+
+func (i *inspection) coseSignature(idx int, protected []byte, unprotected map[any]any,
+	now time.Time,
+) signatureInfo {
+	info := signatureInfo{}
+
+	headers := map[int64]any{}
+	if len(protected) > 0 {
+		var m map[any]any
+		if err := cbor.Unmarshal(protected, &m); err != nil {
+			i.errorf("signature %v: failed to decode protected header: %v", idx, err)
+		}
+		for k, v := range m {
+			if l, ok := coseLabel(k); ok {
+				headers[l] = v
+			}
+		}
+	}
+	for k, v := range unprotected {
+		if l, ok := coseLabel(k); ok {
+			headers[l] = v
+		}
+	}
+
+	if alg, ok := coseLabel(headers[cose.HeaderLabelAlgorithm]); ok {
+		info.Algorithm = cose.Algorithm(alg).String()
+	} else {
+		i.errorf("signature %v: algorithm missing", idx)
+	}
+	if kid, ok := headers[cose.HeaderLabelKeyID].([]byte); ok {
+		info.KeyId = hex.EncodeToString(kid)
+	}
+	var certs []any
+	switch x5c := headers[cose.HeaderLabelX5Chain].(type) {
+	case []byte:
+		certs = []any{x5c}
+	case []any:
+		certs = x5c
+	}
+	for cidx, c := range certs {
+		der, ok := c.([]byte)
+		if !ok {
+			i.errorf("signature %v: certificate %v is not a byte string", idx, cidx)
+			continue
+		}
+		info.Certificates = append(info.Certificates, i.certificate(der, now))
+	}
+	return info
+}
+
+func (i *inspection) measurement(m *ar.Measurement, full bool, now time.Time) measurementInfo {
+	info := measurementInfo{
+		Type:         m.Type,
+		EvidenceSize: len(m.Evidence),
+	}
+	if len(m.Evidence) == 0 {
+		i.errorf("%v: evidence missing", m.Type)
+	}
+	for _, c := range m.Certs {
+		info.Certificates = append(info.Certificates, i.certificate(c, now))
+	}
+	for _, a := range m.Artifacts {
+		ai := artifactInfo{
+			Type:    a.Type,
+			Pcr:     a.Pcr,
+			Summary: digest(a.Summary, full),
+		}
+		for _, e := range a.Events {
+			ai.Events = append(ai.Events, eventInfo{
+				Name:   e.EventName,
+				Sha256: digest(e.Sha256, full),
+			})
+		}
+		info.Artifacts = append(info.Artifacts, ai)
+	}
+	return info
+}
+
+func (i *inspection) certificate(der []byte, now time.Time) certInfo {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		i.errorf("failed to parse certificate: %v", err)
+		return certInfo{Subject: "<malformed>"}
+	}
+	return certInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		Expired:   now.After(cert.NotAfter),
+	}
+}
+
+func (i *inspection) errorf(format string, args ...interface{}) {
+	i.Errors = append(i.Errors, fmt.Sprintf(format, args...))
+}
+
+// numErrors returns the number of malformed parts including the metadata
+func (i *inspection) numErrors() int {
+	n := len(i.Errors)
+	for _, m := range i.Metadata {
+		n += m.numErrors()
+	}
+	return n
+}
+
+// print prints the inspection as indented text
+func (i *inspection) print(w io.Writer, indent string) {
+	fmt.Fprintf(w, "%vSerializer: %v (%v bytes)\n", indent, i.Serializer, i.Size)
+	for idx, s := range i.Signatures {
+		fmt.Fprintf(w, "%vSignature %v: alg %v", indent, idx, s.Algorithm)
+		if s.KeyId != "" {
+			fmt.Fprintf(w, ", kid %v", s.KeyId)
+		}
+		fmt.Fprintln(w)
+		printCerts(w, indent+"    ", s.Certificates)
+	}
+	if i.PayloadType != "" {
+		fmt.Fprintf(w, "%vPayload: %v", indent, i.PayloadType)
+		if i.Name != "" {
+			fmt.Fprintf(w, " %v", i.Name)
+		}
+		if i.Version != "" {
+			fmt.Fprintf(w, " (version %v)", i.Version)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, m := range i.Measurements {
+		fmt.Fprintf(w, "%vMeasurement: %v (evidence %v bytes)\n", indent, m.Type, m.EvidenceSize)
+		printCerts(w, indent+"    ", m.Certificates)
+		for _, a := range m.Artifacts {
+			fmt.Fprintf(w, "%v    Artifact: %v", indent, a.Type)
+			if a.Pcr != nil {
+				fmt.Fprintf(w, " PCR%v", *a.Pcr)
+			}
+			if a.Summary != "" {
+				fmt.Fprintf(w, " %v", a.Summary)
+			}
+			fmt.Fprintln(w)
+			for _, e := range a.Events {
+				fmt.Fprintf(w, "%v        %v %v\n", indent, e.Sha256, e.Name)
+			}
+		}
+	}
+	for _, m := range i.Metadata {
+		fmt.Fprintf(w, "%vMetadata %v:\n", indent, m.Item)
+		m.print(w, indent+"    ")
+	}
+	for _, e := range i.Errors {
+		fmt.Fprintf(w, "%vMALFORMED: %v\n", indent, e)
+	}
+}
+
+func printCerts(w io.Writer, indent string, certs []certInfo) {
+	for _, c := range certs {
+		expired := ""
+		if c.Expired {
+			expired = " EXPIRED"
+		}
+		fmt.Fprintf(w, "%vCertificate: %v (issuer %v, valid %v to %v%v)\n", indent, c.Subject,
+			c.Issuer, c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), expired)
+	}
+}
+
+// digest returns the hex encoded digest, truncated unless full is set
+func digest(d []byte, full bool) string {
+	s := hex.EncodeToString(d)
+	if !full && len(s) > digestLen {
+		return s[:digestLen] + "..."
+	}
+	return s
+}
+
+// coseLabel converts a decoded COSE header label or integer value
+func coseLabel(v any) (int64, bool) {
+	switch l := v.(type) {
+	case int64:
+		return l, true
+	case uint64:
+		return int64(l), true
+	case int:
+		return int64(l), true
+	}
+	return 0, false
+}
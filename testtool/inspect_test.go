@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+func createReport(t *testing.T, s ar.Serializer) ([]byte, [][]byte) {
+	t.Helper()
+	f, err := fixtures.Generate(fixtures.Options{Serializer: s})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	return f.Report, f.Metadata
+}
+
+func Test_inspect(t *testing.T) {
+
+	jsonReport, jsonMetadata := createReport(t, ar.JsonSerializer{})
+	cborReport, _ := createReport(t, ar.CborSerializer{})
+	unsigned, _ := ar.JsonSerializer{}.Marshal(ar.AttestationReport{Type: "Attestation Report"})
+
+	tests := []struct {
+		name        string
+		data        []byte
+		serializer  string
+		payloadType string
+		signatures  int
+		metadata    int
+		wantErr     bool
+	}{
+		{"JSON Report", jsonReport, "json", "Attestation Report", 1, 5, false},
+		{"CBOR Report", cborReport, "cbor", "Attestation Report", 1, 5, false},
+		{"JSON Metadata", jsonMetadata[0], "json", "RTM Manifest", 1, 0, false},
+		{"Truncated JSON", jsonReport[:len(jsonReport)-40], "json", "Attestation Report", 1, 5,
+			true},
+		{"Truncated CBOR", cborReport[:len(cborReport)-40], "cbor", "Attestation Report", 0, 5,
+			true},
+		{"Truncated CBOR Header", cborReport[:40], "cbor", "", 0, 0, true},
+		{"Unsigned", unsigned, "json", "Attestation Report", 0, 0, true},
+		{"Garbage", []byte{0xff, 0x00, 0x13}, "unknown", "", 0, 0, true},
+		{"Empty", nil, "unknown", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inspect(tt.data, false, time.Now())
+			if got.Serializer != tt.serializer {
+				t.Errorf("serializer = %v, want %v", got.Serializer, tt.serializer)
+			}
+			if got.PayloadType != tt.payloadType {
+				t.Errorf("payload type = %v, want %v", got.PayloadType, tt.payloadType)
+			}
+			if len(got.Signatures) != tt.signatures {
+				t.Errorf("%v signatures, want %v", len(got.Signatures), tt.signatures)
+			}
+			if len(got.Metadata) != tt.metadata {
+				t.Errorf("%v metadata items, want %v", len(got.Metadata), tt.metadata)
+			}
+			if (got.numErrors() > 0) != tt.wantErr {
+				t.Errorf("errors = %v, wantErr %v", got.Errors, tt.wantErr)
+			}
+			// Reports are signed with the IK, the manifests by the developer
+			signer := "CN=" + fixtures.DeveloperCommonName + ",O=Test"
+			if tt.payloadType == "Attestation Report" {
+				signer = "CN=" + fixtures.DeviceDescriptionName + " IK,O=Test"
+			}
+			for _, s := range got.Signatures {
+				if s.Algorithm != "ES256" || len(s.Certificates) != 3 ||
+					s.Certificates[0].Subject != signer {
+					t.Errorf("signature = %+v, want ES256 with %v certificate chain", s, signer)
+				}
+			}
+		})
+	}
+
+	// The report contains the TPM measurement and the named metadata
+	i := inspect(cborReport, false, time.Now())
+	if len(i.Measurements) != 1 || i.Measurements[0].Type != "TPM Measurement" ||
+		len(i.Measurements[0].Certificates) != 3 || len(i.Measurements[0].Artifacts) != 3 {
+		t.Errorf("measurements = %+v, want TPM measurement with certificate chain", i.Measurements)
+	}
+	names := []string{}
+	for _, m := range i.Metadata {
+		names = append(names, m.Item+":"+m.Name)
+	}
+	want := "rtmManifest:de.test.rtm osManifest:de.test.os appManifests[0]:de.test.app1 " +
+		"appManifests[1]:de.test.app2 deviceDescription:test-device.test.de"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("metadata = %v, want %v", got, want)
+	}
+}
+
+func Test_inspectCmd(t *testing.T) {
+	report, _ := createReport(t, ar.CborSerializer{})
+	file := filepath.Join(t.TempDir(), "report.cbor")
+	if err := os.WriteFile(file, report, 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.cbor")
+	if err := os.WriteFile(truncated, report[:len(report)/2], 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Text", []string{file}, exitSuccess},
+		{"JSON", []string{"-json", "-full", file}, exitSuccess},
+		{"Truncated", []string{truncated}, exitFailure},
+		{"Missing File", nil, exitUsage},
+		{"Not Existing", []string{filepath.Join(t.TempDir(), "none")}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(inspectCmd(tt.args)); got != tt.want {
+				t.Errorf("exit code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_digest(t *testing.T) {
+	d := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99}
+	if got := digest(d, false); got != "0011223344556677..." {
+		t.Errorf("digest() = %v", got)
+	}
+	if got := digest(d, true); got != "00112233445566778899" {
+		t.Errorf("digest() full = %v", got)
+	}
+	if got := digest(d[:2], false); got != "0011" {
+		t.Errorf("digest() short = %v", got)
+	}
+}
@@ -22,12 +22,11 @@ import (
 
 	// local modules
 
-	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/attestedtls"
 	"github.com/Fraunhofer-AISEC/cmc/cmc"
 	g "github.com/Fraunhofer-AISEC/cmc/generate"
@@ -43,64 +42,82 @@ func init() {
 	apis["libapi"] = LibApi{}
 }
 
-func (a LibApi) generate(c *config) {
+func (a LibApi) generate(c *config) ([]byte, error) {
 
 	if a.cmc == nil {
 		cmc, err := initialize(c)
 		if err != nil {
-			log.Errorf("failed to initialize CMC: %v", err)
-			return
+			return nil, fmt.Errorf("failed to initialize CMC: %w", err)
 		}
 		a.cmc = cmc
 	}
 
-	if a.cmc.Metadata == nil {
-		log.Fatalf("Metadata not specified. Can work only as verifier")
+	metadata := a.cmc.Metadata()
+	if metadata == nil {
+		return nil, usageErrorf("metadata not specified. Can work only as verifier")
 	}
 
-	// Generate random nonce
-	nonce := make([]byte, 8)
-	_, err := rand.Read(nonce)
+	// Use the configured nonce or generate a random nonce
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Failed to read random bytes: %v", err)
+		return nil, err
 	}
 
 	// Generate attestation report
-	report, err := g.Generate(nonce, a.cmc.Metadata, a.cmc.Drivers, a.cmc.Serializer)
+	report, err := g.Generate(nonce, metadata, a.cmc.Drivers, a.cmc.Serializer)
 	if err != nil {
-		log.Errorf("Failed to generate attestation report: %v", err)
-		return
+		return nil, fmt.Errorf("failed to generate attestation report: %w", err)
 	}
 
 	// Sign attestation report
 	log.Debug("Prover: Signing Attestation Report")
 	r, err := g.Sign(report, a.cmc.Drivers[0], a.cmc.Serializer)
 	if err != nil {
-		log.Errorf("Failed to sign attestation report: %v", err)
-		return
+		return nil, fmt.Errorf("failed to sign attestation report: %w", err)
 	}
 
 	// Save the attestation report for the verifier
 	err = os.WriteFile(c.ReportFile, r, 0644)
 	if err != nil {
-		log.Fatalf("Failed to save attestation report as %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to save attestation report as %v: %w", c.ReportFile, err)
 	}
-	fmt.Println("Wrote attestation report: ", c.ReportFile)
+	log.Infof("Wrote attestation report: %v", c.ReportFile)
 
 	// Save the nonce for the verifier
-	os.WriteFile(c.NonceFile, nonce, 0644)
+	if c.NonceFile != "" {
+		err = os.WriteFile(c.NonceFile, nonce, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save nonce as %v: %w", c.NonceFile, err)
+		}
+		log.Infof("Wrote nonce: %v", c.NonceFile)
+	}
+
+	return r, nil
+}
+
+func (a LibApi) dryrun(c *config) (*ar.DryRunSummary, error) {
+
+	if a.cmc == nil {
+		cmc, err := initialize(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize CMC: %w", err)
+		}
+		a.cmc = cmc
+	}
+
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Failed to save nonce as %v: %v", c.NonceFile, err)
+		return nil, err
 	}
-	fmt.Println("Wrote nonce: ", c.NonceFile)
+
+	return g.DryRun(nonce, a.cmc.Metadata(), a.cmc.Drivers, a.cmc.Serializer)
 }
 
-func (a LibApi) verify(c *config) {
+func (a LibApi) verify(c *config) (*ar.VerificationResult, error) {
 	if a.cmc == nil {
 		cmc, err := initialize(c)
 		if err != nil {
-			log.Errorf("failed to initialize CMC: %v", err)
-			return
+			return nil, fmt.Errorf("failed to initialize CMC: %w", err)
 		}
 		a.cmc = cmc
 	}
@@ -108,28 +125,18 @@ func (a LibApi) verify(c *config) {
 	// Read the attestation report, CA and the nonce previously stored
 	report, err := os.ReadFile(c.ReportFile)
 	if err != nil {
-		log.Fatalf("Failed to read file %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to read file %v: %w", c.ReportFile, err)
 	}
 
 	nonce, err := os.ReadFile(c.NonceFile)
 	if err != nil {
-		log.Fatalf("Failed to read nonce: %v", err)
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
 	}
 
 	// Verify the attestation report
 	result := v.Verify(report, nonce, c.ca, c.policies, a.cmc.PolicyEngineSelect, a.cmc.IntelStorage)
 
-	log.Debug("Verifier: Marshaling Attestation Result")
-	r, err := json.Marshal(result)
-	if err != nil {
-		log.Errorf("Verifier: failed to marshal Attestation Result: %v", err)
-		return
-	}
-
-	err = saveResult(c.ResultFile, c.Publish, r)
-	if err != nil {
-		log.Fatalf("Failed to save result: %v", err)
-	}
+	return &result, nil
 }
 
 func (a LibApi) measure(c *config) {
@@ -163,6 +170,7 @@ func (a LibApi) measure(c *config) {
 			Pcr:        a.cmc.CtrPcr,
 			LogFile:    a.cmc.CtrLog,
 			Driver:     a.cmc.CtrDriver,
+			Journal:    a.cmc.CtrJournal,
 		})
 	if err != nil {
 		log.Fatalf("Failed to record measurement: %v", err)
@@ -175,31 +183,29 @@ func (a LibApi) cacerts(c *config) {
 	getCaCertsInternal(c)
 }
 
-func (a LibApi) dial(c *config) {
+func (a LibApi) dial(c *config) error {
 	if a.cmc == nil {
 		cmc, err := initialize(c)
 		if err != nil {
-			log.Errorf("failed to initialize CMC: %v", err)
-			return
+			return fmt.Errorf("failed to initialize CMC: %w", err)
 		}
 		a.cmc = cmc
 	}
 
-	dialInternal(c, attestedtls.CmcApi_Lib, a.cmc)
+	return dialInternal(c, attestedtls.CmcApi_Lib, a.cmc)
 }
 
-func (a LibApi) listen(c *config) {
+func (a LibApi) listen(c *config) error {
 
 	if a.cmc == nil {
 		cmc, err := initialize(c)
 		if err != nil {
-			log.Errorf("failed to initialize CMC: %v", err)
-			return
+			return fmt.Errorf("failed to initialize CMC: %w", err)
 		}
 		a.cmc = cmc
 	}
 
-	listenInternal(c, attestedtls.CmcApi_Lib, a.cmc)
+	return listenInternal(c, attestedtls.CmcApi_Lib, a.cmc)
 }
 
 func (a LibApi) request(c *config) {
@@ -18,20 +18,35 @@ package main
 // Install github packages with "go get [url]"
 import (
 	"flag"
+	"os"
 	"strings"
 )
 
 var (
-	cmds = map[string]func(*config){
-		"cacerts":  getCaCerts, // Retrieve CA certs from EST server
-		"generate": generate,   // Generate an attestation report
-		"verify":   verify,     // Verify an attestation report
-		"measure":  measure,    // Record measurements
-		"dial":     dial,       // Act as client to establish an attested TLS connection
-		"listen":   listen,     // Act as server in etsblishing attested TLS connections
-		"request":  request,    // Perform an attested HTTPS request
-		"serve":    serve,      // Establish an attested HTTPS server
-		"iothub":   iothub,     // Simulate an IoT hub for Cortex-M IAS Attestation Demo
+	cmds = map[string]func(*config) error{
+		"cacerts":    getCaCerts, // Retrieve CA certs from EST server
+		"generate":   generate,   // Generate an attestation report
+		"dryrun":     dryRun,     // Summarize the next attestation report without signing it
+		"verify":     verify,     // Verify an attestation report
+		"measure":    measure,    // Record measurements
+		"dial":       dial,       // Act as client to establish an attested TLS connection
+		"listen":     listen,     // Act as server in etsblishing attested TLS connections
+		"request":    request,    // Perform an attested HTTPS request
+		"serve":      serve,      // Establish an attested HTTPS server
+		"iothub":     iothub,     // Simulate an IoT hub for Cortex-M IAS Attestation Demo
+		"bench":      bench,      // Drive load against the cmcd or attested TLS servers
+		"perf":       perf,       // Measure the throughput and latency of attested TLS connections
+		"perfserver": perfServer, // Echo or discard the data of perf connections
+	}
+
+	// Commands with their own subcommands and flags
+	subcmds = map[string]func([]string) error{
+		"report":   reportCmd,   // Generate and verify attestation report files offline
+		"inspect":  inspectCmd,  // Pretty-print attestation reports and metadata
+		"watch":    watchCmd,    // Periodically attest and verify and report changes
+		"policy":   policyCmd,   // Test custom policies against stored verification results
+		"fixtures": fixturesCmd, // Generate test reports and metadata without hardware
+		"archive":  archiveCmd,  // Retrieve archived verifications from a verifying cmcd
 	}
 )
 
@@ -39,14 +54,32 @@ func main() {
 
 	log.Info("Testtool v0.1")
 
-	c := getConfig()
+	if len(os.Args) > 1 {
+		if cmd, ok := subcmds[strings.ToLower(os.Args[1])]; ok {
+			err := cmd(os.Args[2:])
+			if err != nil {
+				log.Errorf("Failed to run %v command: %v", strings.ToLower(os.Args[1]), err)
+			}
+			os.Exit(exitCode(err))
+		}
+	}
+
+	c, err := getConfig()
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+		os.Exit(exitCode(err))
+	}
 
 	cmd, ok := cmds[strings.ToLower(c.Mode)]
 	if !ok {
 		log.Errorf("Undefined mode %v", c.Mode)
 		flag.Usage()
-		return
+		os.Exit(exitUsage)
 	}
 
-	cmd(c)
+	err = cmd(c)
+	if err != nil {
+		log.Errorf("Failed to %v: %v", strings.ToLower(c.Mode), err)
+		os.Exit(exitCode(err))
+	}
 }
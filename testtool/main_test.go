@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTesttool builds the testtool binary into a temporary folder, so that
+// it can be run as a subprocess to check the exit codes and the output
+func buildTesttool(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping testtool integration test in short mode")
+	}
+	bin := filepath.Join(t.TempDir(), "testtool")
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build testtool: %v: %v", err, string(out))
+	}
+	return bin
+}
+
+func createCaFile(t *testing.T, dir string) string {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	file := filepath.Join(dir, "ca.pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	return file
+}
+
+// closedAddr returns a local address no cmcd is listening on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestExitCodes(t *testing.T) {
+
+	bin := buildTesttool(t)
+	dir := t.TempDir()
+	ca := createCaFile(t, dir)
+	report := filepath.Join(dir, "attestation-report")
+	nonce := filepath.Join(dir, "nonce")
+	if err := os.WriteFile(report, []byte("invalid report"), 0644); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	if err := os.WriteFile(nonce, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0644); err != nil {
+		t.Fatalf("failed to write nonce: %v", err)
+	}
+	cmcAddr := closedAddr(t)
+
+	tests := []struct {
+		name          string
+		args          []string
+		wantCode      int
+		wantOperation string
+		wantReportId  bool
+		wantResult    bool
+	}{
+		{"Undefined Mode", []string{"-mode", "bogus"}, exitUsage, "", false, false},
+		{"Unsupported Format", []string{"-mode", "generate", "-format", "yaml"}, exitUsage, "",
+			false, false},
+		{"Unsupported API", []string{"-mode", "generate", "-api", "bogus", "-format", "json"},
+			exitUsage, "", false, false},
+		{"CSV Outside Bench", []string{"-mode", "verify", "-ca", ca, "-format", "csv"}, exitUsage,
+			"", false, false},
+		{"Bench Invalid Mix", []string{"-mode", "bench", "-ca", ca, "-mix", "measure"}, exitUsage,
+			"", false, false},
+		{"Generate Cmcd Unreachable", []string{"-mode", "generate", "-api", "socket",
+			"-network", "tcp", "-cmc", cmcAddr, "-report", filepath.Join(dir, "report"),
+			"-nonce", filepath.Join(dir, "generated-nonce"), "-format", "json"},
+			exitCmcUnreachable, "generate", false, false},
+		{"Dry-Run Cmcd Unreachable", []string{"-mode", "dryrun", "-api", "socket",
+			"-network", "tcp", "-cmc", cmcAddr, "-format", "json"},
+			exitCmcUnreachable, "dryrun", false, false},
+		{"Verify Cmcd Unreachable", []string{"-mode", "verify", "-api", "socket",
+			"-network", "tcp", "-cmc", cmcAddr, "-ca", ca, "-report", report, "-nonce", nonce,
+			"-result", filepath.Join(dir, "result.json"), "-format", "json"},
+			exitCmcUnreachable, "verify", true, false},
+		{"Verification Failed", []string{"-mode", "verify", "-api", "libapi", "-ca", ca,
+			"-report", report, "-nonce", nonce, "-result", filepath.Join(dir, "result.json"),
+			"-format", "json"},
+			exitVerifyFailed, "verify", true, true},
+		{"Verification Failed Text", []string{"-mode", "verify", "-api", "libapi", "-ca", ca,
+			"-report", report, "-nonce", nonce, "-result", filepath.Join(dir, "result.json")},
+			exitVerifyFailed, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(bin, tt.args...)
+			cmd.Dir = dir
+			var stdout bytes.Buffer
+			cmd.Stdout = &stdout
+			err := cmd.Run()
+
+			code := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("failed to run testtool: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %v, want %v", code, tt.wantCode)
+			}
+
+			// Usage errors and the text format must not write output documents
+			if tt.wantOperation == "" {
+				if stdout.Len() != 0 {
+					t.Errorf("unexpected output %q", stdout.String())
+				}
+				return
+			}
+
+			lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %v output documents, want 1: %q", len(lines), stdout.String())
+			}
+			var o map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(lines[0]), &o); err != nil {
+				t.Fatalf("failed to unmarshal output %q: %v", lines[0], err)
+			}
+			for _, key := range []string{"operation", "success", "exitCode", "error", "started",
+				"durationMs"} {
+				if _, ok := o[key]; !ok {
+					t.Errorf("output misses %v: %v", key, lines[0])
+				}
+			}
+			var doc output
+			if err := json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+				t.Fatalf("failed to unmarshal output %q: %v", lines[0], err)
+			}
+			if doc.Operation != tt.wantOperation || doc.ExitCode != tt.wantCode || doc.Success {
+				t.Errorf("output = %+v, want failed %v with exit code %v", doc,
+					tt.wantOperation, tt.wantCode)
+			}
+			if (doc.ReportId != "") != tt.wantReportId {
+				t.Errorf("report ID = %q, want present %v", doc.ReportId, tt.wantReportId)
+			}
+			if (doc.Result != nil) != tt.wantResult {
+				t.Errorf("result = %v, want present %v", doc.Result, tt.wantResult)
+			}
+		})
+	}
+}
+
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Success", nil, exitSuccess},
+		{"Generic", errors.New("failed"), exitFailure},
+		{"Usage", usageErrorf("invalid"), exitUsage},
+		{"Wrapped Unreachable", fmt.Errorf("failed to dial: %w", unreachableErrorf("refused")),
+			exitCmcUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
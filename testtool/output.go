@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// Exit codes of the testtool, so that scripts can distinguish failed
+// verifications from infrastructure and usage errors
+const (
+	exitSuccess        = 0
+	exitFailure        = 1
+	exitVerifyFailed   = 2
+	exitCmcUnreachable = 3
+	exitUsage          = 4
+)
+
+const (
+	formatText = "text"
+	formatJson = "json"
+	formatCsv  = "csv"
+)
+
+// opError is an error of an operation together with the exit code it results in
+type opError struct {
+	code int
+	err  error
+}
+
+func (e *opError) Error() string {
+	return e.err.Error()
+}
+
+func (e *opError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &opError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+func unreachableErrorf(format string, args ...interface{}) error {
+	return &opError{code: exitCmcUnreachable, err: fmt.Errorf(format, args...)}
+}
+
+// exitCode returns the exit code for the error of an operation
+func exitCode(err error) int {
+	if err == nil {
+		return exitSuccess
+	}
+	var e *opError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
+// output is the machine-readable outcome of a single operation, printed as one
+// JSON document per line if the output format is json
+type output struct {
+	Operation  string                 `json:"operation"`
+	Addr       string                 `json:"addr,omitempty"`
+	Success    bool                   `json:"success"`
+	ExitCode   int                    `json:"exitCode"`
+	Error      string                 `json:"error,omitempty"`
+	Started    time.Time              `json:"started"`
+	DurationMs int64                  `json:"durationMs"`
+	ReportId   string                 `json:"reportId,omitempty"`
+	Nonce      string                 `json:"nonce,omitempty"`
+	Result     *ar.VerificationResult `json:"result,omitempty"`
+	DryRun     *ar.DryRunSummary      `json:"dryRun,omitempty"`
+}
+
+func newOutput(operation, addr string) *output {
+	return &output{
+		Operation: operation,
+		Addr:      addr,
+		Started:   time.Now().UTC(),
+	}
+}
+
+// finish completes the output with the outcome of the operation, prints it
+// if the output format is json and returns the error
+func (o *output) finish(c *config, err error) error {
+	if o.Result != nil && !o.Result.Success {
+		if err == nil && o.Result.Prover != "" {
+			err = fmt.Errorf("verification of prover %v failed", o.Result.Prover)
+		} else if err == nil {
+			err = errors.New("verification failed")
+		}
+		err = &opError{code: exitVerifyFailed, err: err}
+	}
+	o.DurationMs = time.Since(o.Started).Milliseconds()
+	o.ExitCode = exitCode(err)
+	o.Success = err == nil
+	if err != nil {
+		o.Error = err.Error()
+	}
+
+	if c.Format == formatJson {
+		data, merr := json.Marshal(o)
+		if merr != nil {
+			log.Warnf("Failed to marshal output: %v", merr)
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+	}
+
+	return err
+}
+
+// reportId identifies an attestation report by the hex encoded SHA-256 hash
+// of the signed report
+func reportId(report []byte) string {
+	if len(report) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256(report)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	atls "github.com/Fraunhofer-AISEC/cmc/attestedtls"
+)
+
+const (
+	perfEcho    = "echo"
+	perfDiscard = "discard"
+
+	perfAtls = "atls"
+	perfTls  = "tls"
+
+	defaultPerfBytes   = 16 << 20
+	defaultPerfMsgSize = 16 << 10
+	maxPerfMsgSize     = 16 << 20
+)
+
+// perfModes are the modes the dialer requests in the first byte sent over a
+// perf connection
+var perfModes = map[byte]string{
+	0: perfDiscard,
+	1: perfEcho,
+}
+
+type perfConfig struct {
+	bytes    int64
+	msgSize  int
+	mode     string
+	interval time.Duration
+}
+
+// perfRun is the result of pumping the configured volume over one transport.
+// Latencies are the round-trip times of the messages in mode echo and the
+// write durations in mode discard. The latency of a message includes the
+// handshake if the connection was (re-)established before the message
+type perfRun struct {
+	Transport   string      `json:"transport"`
+	Addr        string      `json:"addr"`
+	Bytes       int64       `json:"bytes"`
+	Messages    uint64      `json:"messages"`
+	DurationMs  float64     `json:"durationMs"`
+	GoodputMbps float64     `json:"goodputMbps"`
+	CpuMs       float64     `json:"cpuMs"`
+	Handshakes  int         `json:"handshakes"`
+	Handshake   perfLatency `json:"handshake"`
+	Latency     perfLatency `json:"latency"`
+}
+
+type perfLatency struct {
+	MinMs  float64 `json:"minMs"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	P999Ms float64 `json:"p999Ms"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+// perfOverhead compares the attested TLS run with the plain TLS baseline
+type perfOverhead struct {
+	GoodputRatio float64 `json:"goodputRatio"`
+	P50Ratio     float64 `json:"p50Ratio"`
+	P99Ratio     float64 `json:"p99Ratio"`
+	CpuRatio     float64 `json:"cpuRatio"`
+}
+
+type perfSummary struct {
+	Mode        string        `json:"mode"`
+	MessageSize int           `json:"messageSize"`
+	IntervalMs  int64         `json:"reattestIntervalMs,omitempty"`
+	Started     time.Time     `json:"started"`
+	Runs        []perfRun     `json:"runs"`
+	Overhead    *perfOverhead `json:"overhead,omitempty"`
+}
+
+// perfSession is the result of a connection on the listener side
+type perfSession struct {
+	Transport   string  `json:"transport"`
+	Remote      string  `json:"remote"`
+	Mode        string  `json:"mode"`
+	Bytes       int64   `json:"bytes"`
+	DurationMs  float64 `json:"durationMs"`
+	GoodputMbps float64 `json:"goodputMbps"`
+	CpuMs       float64 `json:"cpuMs"`
+}
+
+// connDialer establishes a connection of a perf run
+type connDialer func() (*tls.Conn, error)
+
+// perf pumps the configured volume over an attested TLS connection to the
+// perf server and, if a baseline address is configured, over a plain TLS
+// connection, and prints goodput, message latencies and CPU time
+func perf(c *config) error {
+
+	p, err := getPerfConfig(c)
+	if err != nil {
+		return err
+	}
+	api, ok := c.api.(benchApi)
+	if !ok {
+		return usageErrorf("API %v does not support the perf mode", c.Api)
+	}
+	if len(c.Addr) == 0 {
+		return usageErrorf("no address to dial specified")
+	}
+	addr := c.Addr[0]
+
+	tlsConf, err := dialTlsConfig(c, api.cmcApi(), nil)
+	if err != nil {
+		return err
+	}
+
+	s := &perfSummary{
+		Mode:        p.mode,
+		MessageSize: p.msgSize,
+		IntervalMs:  p.interval.Milliseconds(),
+		Started:     time.Now().UTC(),
+	}
+
+	log.Infof("Sending %v bytes in %v byte messages via attested TLS to %v", p.bytes, p.msgSize,
+		addr)
+	var result *ar.VerificationResult
+	run, err := runPerf(p, perfAtls, addr, func() (*tls.Conn, error) {
+		return atls.Dial("tcp", addr, tlsConf,
+			atls.WithCmcAddr(c.CmcAddr),
+			atls.WithCmcCa(c.ca),
+			atls.WithCmcPolicies(c.policies),
+			atls.WithCmcApi(api.cmcApi()),
+			atls.WithMtls(c.Mtls),
+			atls.WithAttest(c.Attest),
+			atls.WithCmcNetwork(c.Network),
+			atls.WithCertProfile(c.CertProfile),
+			atls.WithResultCb(func(r *ar.VerificationResult) {
+				result = r
+				r.PrintErr()
+			}))
+	})
+	if err != nil {
+		if result != nil && !result.Success {
+			return &opError{code: exitVerifyFailed, err: err}
+		}
+		return err
+	}
+	s.Runs = append(s.Runs, *run)
+
+	if c.PerfBaseline != "" {
+		log.Infof("Sending %v bytes in %v byte messages via plain TLS to %v", p.bytes, p.msgSize,
+			c.PerfBaseline)
+		run, err := runPerf(p, perfTls, c.PerfBaseline, func() (*tls.Conn, error) {
+			dialer := &net.Dialer{Timeout: timeoutSec * time.Second}
+			return tls.DialWithDialer(dialer, "tcp", c.PerfBaseline, tlsConf)
+		})
+		if err != nil {
+			return fmt.Errorf("baseline: %w", err)
+		}
+		s.Runs = append(s.Runs, *run)
+		s.Overhead = overhead(&s.Runs[0], &s.Runs[1])
+	}
+
+	return printPerfSummary(os.Stdout, c.Format, s)
+}
+
+func getPerfConfig(c *config) (*perfConfig, error) {
+	p := &perfConfig{
+		bytes:    c.PerfBytes,
+		msgSize:  c.PerfMsgSize,
+		mode:     strings.ToLower(c.PerfMode),
+		interval: c.interval,
+	}
+	if p.bytes <= 0 {
+		return nil, usageErrorf("invalid volume %v", c.PerfBytes)
+	}
+	if p.msgSize <= 0 || p.msgSize > maxPerfMsgSize {
+		return nil, usageErrorf("invalid message size %v (maximum %v)", c.PerfMsgSize,
+			maxPerfMsgSize)
+	}
+	if p.mode != perfEcho && p.mode != perfDiscard {
+		return nil, usageErrorf("invalid perf mode %v (%v, %v)", c.PerfMode, perfEcho, perfDiscard)
+	}
+	if p.interval < 0 {
+		p.interval = 0
+	}
+	return p, nil
+}
+
+// runPerf sends the configured volume in messages of the configured size. If
+// an interval is configured, the connection is re-established, i.e. the peer
+// is re-attested, when the interval elapsed
+func runPerf(p *perfConfig, transport, addr string, dial connDialer) (*perfRun, error) {
+
+	msg := make([]byte, p.msgSize)
+	if _, err := rand.Read(msg); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	echo := make([]byte, p.msgSize)
+
+	run := &perfRun{
+		Transport: transport,
+		Addr:      addr,
+	}
+	latencies := new(histogram)
+	handshakes := new(histogram)
+
+	var conn *tls.Conn
+	var connected time.Time
+	var sent int64
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	cpu := cpuTime()
+	start := time.Now()
+	for remaining := p.bytes; remaining > 0; {
+		msgStart := time.Now()
+
+		if conn == nil || (p.interval > 0 && msgStart.Sub(connected) >= p.interval) {
+			if conn != nil {
+				err := finishPerfConn(conn, p.mode, sent)
+				conn = nil
+				if err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			conn, err = dialPerfConn(dial, p.mode)
+			if err != nil {
+				return nil, err
+			}
+			sent = 0
+			connected = time.Now()
+			handshakes.record(connected.Sub(msgStart))
+			run.Handshakes++
+		}
+
+		n := int64(p.msgSize)
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := conn.Write(msg[:n]); err != nil {
+			return nil, fmt.Errorf("failed to write: %w", err)
+		}
+		if p.mode == perfEcho {
+			if _, err := io.ReadFull(conn, echo[:n]); err != nil {
+				return nil, fmt.Errorf("failed to read echo: %w", err)
+			}
+		}
+		latencies.record(time.Since(msgStart))
+		sent += n
+		remaining -= n
+		run.Messages++
+		run.Bytes += n
+	}
+	err := finishPerfConn(conn, p.mode, sent)
+	conn = nil
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	run.DurationMs = ms(elapsed)
+	run.CpuMs = ms(cpuTime() - cpu)
+	if elapsed > 0 {
+		run.GoodputMbps = float64(run.Bytes) * 8 / elapsed.Seconds() / 1e6
+	}
+	run.Latency = latency(latencies)
+	run.Handshake = latency(handshakes)
+
+	return run, nil
+}
+
+// dialPerfConn establishes a connection and requests the perf mode
+func dialPerfConn(dial connDialer, mode string) (*tls.Conn, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	b := byte(0)
+	if mode == perfEcho {
+		b = 1
+	}
+	if _, err := conn.Write([]byte{b}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send perf mode: %w", err)
+	}
+	return conn, nil
+}
+
+// finishPerfConn closes the sending side of the connection. In mode discard,
+// the listener acknowledges the number of received bytes, so that the goodput
+// is measured end-to-end
+func finishPerfConn(conn *tls.Conn, mode string, sent int64) error {
+	defer conn.Close()
+	if err := conn.CloseWrite(); err != nil {
+		return fmt.Errorf("failed to close connection: %w", err)
+	}
+	if mode != perfDiscard {
+		return nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeoutSec * time.Second))
+	var ack [8]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return fmt.Errorf("failed to read acknowledgement: %w", err)
+	}
+	if received := int64(binary.BigEndian.Uint64(ack[:])); received != sent {
+		return fmt.Errorf("listener received %v bytes, sent %v", received, sent)
+	}
+	return nil
+}
+
+// perfServer accepts attested TLS connections and, if a baseline address is
+// configured, plain TLS connections and echoes or discards the received data
+func perfServer(c *config) error {
+
+	api, ok := c.api.(benchApi)
+	if !ok {
+		return usageErrorf("API %v does not support the perf mode", c.Api)
+	}
+	tlsConf, err := listenTlsConfig(c, api.cmcApi(), nil)
+	if err != nil {
+		return err
+	}
+
+	addr := ""
+	if len(c.Addr) > 0 {
+		addr = c.Addr[0]
+	}
+	ln, err := atls.Listen("tcp", addr, tlsConf,
+		atls.WithCmcAddr(c.CmcAddr),
+		atls.WithCmcCa(c.ca),
+		atls.WithCmcPolicies(c.policies),
+		atls.WithCmcApi(api.cmcApi()),
+		atls.WithMtls(c.Mtls),
+		atls.WithAttest(c.Attest),
+		atls.WithCmcNetwork(c.Network),
+		atls.WithCertProfile(c.CertProfile),
+		atls.WithResultCb(func(r *ar.VerificationResult) {
+			r.PrintErr()
+		}))
+	if err != nil {
+		return fmt.Errorf("failed to listen for connections: %w", err)
+	}
+	defer ln.Close()
+
+	if c.PerfBaseline != "" {
+		bl, err := tls.Listen("tcp", c.PerfBaseline, tlsConf)
+		if err != nil {
+			return fmt.Errorf("failed to listen for baseline connections: %w", err)
+		}
+		defer bl.Close()
+		log.Infof("Serving plain TLS baseline under %v", c.PerfBaseline)
+		go servePerf(bl, perfTls, c.Format, os.Stdout)
+	}
+
+	log.Infof("Serving perf connections under %v", addr)
+	return servePerf(ln, perfAtls, c.Format, os.Stdout)
+}
+
+// servePerf handles the connections of the listener until it is closed
+func servePerf(ln net.Listener, transport, format string, w io.Writer) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Warnf("Failed to establish connection: %v", err)
+			continue
+		}
+		go func() {
+			s, err := handlePerf(conn, transport)
+			if err != nil {
+				log.Warnf("Perf connection from %v failed: %v", conn.RemoteAddr(), err)
+				return
+			}
+			if err := printPerfSession(w, format, s); err != nil {
+				log.Warnf("Failed to print perf session: %v", err)
+			}
+		}()
+	}
+}
+
+// handlePerf echoes or discards the data of a connection until the dialer
+// closes its sending side. The CPU time is the time of the process and thus
+// includes concurrent connections
+func handlePerf(conn net.Conn, transport string) (*perfSession, error) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Time{})
+
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, fmt.Errorf("failed to read perf mode: %w", err)
+	}
+	mode, ok := perfModes[b[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown perf mode %v", b[0])
+	}
+
+	s := &perfSession{
+		Transport: transport,
+		Remote:    conn.RemoteAddr().String(),
+		Mode:      mode,
+	}
+	cpu := cpuTime()
+	start := time.Now()
+
+	var err error
+	if mode == perfEcho {
+		s.Bytes, err = io.Copy(conn, conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to echo: %w", err)
+		}
+	} else {
+		s.Bytes, err = io.Copy(io.Discard, conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read: %w", err)
+		}
+		var ack [8]byte
+		binary.BigEndian.PutUint64(ack[:], uint64(s.Bytes))
+		if _, err := conn.Write(ack[:]); err != nil {
+			return nil, fmt.Errorf("failed to acknowledge: %w", err)
+		}
+	}
+
+	elapsed := time.Since(start)
+	s.DurationMs = ms(elapsed)
+	s.CpuMs = ms(cpuTime() - cpu)
+	if elapsed > 0 {
+		s.GoodputMbps = float64(s.Bytes) * 8 / elapsed.Seconds() / 1e6
+	}
+	return s, nil
+}
+
+// cpuTime returns the user and system CPU time consumed by the process
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		log.Warnf("Failed to get CPU time: %v", err)
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func latency(h *histogram) perfLatency {
+	return perfLatency{
+		MinMs:  ms(h.min),
+		MeanMs: ms(h.mean()),
+		P50Ms:  ms(h.quantile(0.5)),
+		P90Ms:  ms(h.quantile(0.9)),
+		P99Ms:  ms(h.quantile(0.99)),
+		P999Ms: ms(h.quantile(0.999)),
+		MaxMs:  ms(h.max),
+	}
+}
+
+func overhead(attested, baseline *perfRun) *perfOverhead {
+	ratio := func(a, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	}
+	return &perfOverhead{
+		GoodputRatio: ratio(attested.GoodputMbps, baseline.GoodputMbps),
+		P50Ratio:     ratio(attested.Latency.P50Ms, baseline.Latency.P50Ms),
+		P99Ratio:     ratio(attested.Latency.P99Ms, baseline.Latency.P99Ms),
+		CpuRatio:     ratio(attested.CpuMs, baseline.CpuMs),
+	}
+}
+
+func printPerfSummary(w io.Writer, format string, s *perfSummary) error {
+	if format == formatJson {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed to marshal perf summary: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	fmt.Fprintf(w, "Perf: mode %v, message size %v bytes, re-attestation interval %v\n",
+		s.Mode, s.MessageSize, time.Duration(s.IntervalMs)*time.Millisecond)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TRANSPORT\tBYTES\tDURATION\tGOODPUT\tCPU\tHANDSHAKES\tMIN\tMEAN\tP50\tP90\tP99\tP99.9\tMAX")
+	for _, r := range s.Runs {
+		l := r.Latency
+		fmt.Fprintf(tw, "%v\t%v\t%.0fms\t%.1fMbit/s\t%.0fms\t%v (%.2fms)\t%.3fms\t%.3fms\t%.3fms\t%.3fms\t%.3fms\t%.3fms\t%.3fms\n",
+			r.Transport, r.Bytes, r.DurationMs, r.GoodputMbps, r.CpuMs, r.Handshakes,
+			r.Handshake.MeanMs, l.MinMs, l.MeanMs, l.P50Ms, l.P90Ms, l.P99Ms, l.P999Ms, l.MaxMs)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if o := s.Overhead; o != nil {
+		fmt.Fprintf(w, "aTLS vs. TLS: goodput %.1f%%, p50 latency %.1f%%, p99 latency %.1f%%, CPU time %.1f%%\n",
+			o.GoodputRatio*100, o.P50Ratio*100, o.P99Ratio*100, o.CpuRatio*100)
+	}
+	return nil
+}
+
+func printPerfSession(w io.Writer, format string, s *perfSession) error {
+	if format == formatJson {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("failed to marshal perf session: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%v %v from %v: %v bytes in %.0fms, %.1fMbit/s, CPU time %.0fms\n",
+		s.Transport, s.Mode, s.Remote, s.Bytes, s.DurationMs, s.GoodputMbps, s.CpuMs)
+	return err
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || grpc
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	atls "github.com/Fraunhofer-AISEC/cmc/attestedtls"
+)
+
+// syncBuffer is a buffer safe for the concurrent perf sessions
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) sessions(t *testing.T) []perfSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var sessions []perfSession
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var s perfSession
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("failed to unmarshal perf session %v: %v", scanner.Text(), err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func createTlsConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: cert}},
+	}
+	client := &tls.Config{RootCAs: roots}
+	return server, client
+}
+
+// startPerfServer starts an attested TLS perf server without attestation and
+// a plain TLS baseline server
+func startPerfServer(t *testing.T, tlsConf *tls.Config) (string, string, *syncBuffer) {
+	t.Helper()
+	out := new(syncBuffer)
+	ln, err := atls.Listen("tcp", "127.0.0.1:0", tlsConf, atls.WithAttest("none"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go servePerf(ln, perfAtls, formatJson, out)
+
+	bl, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { bl.Close() })
+	go servePerf(bl, perfTls, formatJson, out)
+
+	return ln.Addr().String(), bl.Addr().String(), out
+}
+
+func TestPerf(t *testing.T) {
+	serverConf, clientConf := createTlsConfigs(t)
+
+	tests := []struct {
+		name           string
+		mode           string
+		bytes          int64
+		msgSize        int
+		interval       time.Duration
+		wantMessages   uint64
+		wantHandshakes int
+	}{
+		{"Echo", perfEcho, 1 << 20, 4096, 0, 256, 1},
+		{"Discard", perfDiscard, 1 << 20, 4096, 0, 256, 1},
+		{"Partial Message", perfEcho, 10000, 4096, 0, 3, 1},
+		// Every message re-establishes the connection
+		{"Re-Attestation", perfDiscard, 8 * 1024, 1024, time.Nanosecond, 8, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, baseline, out := startPerfServer(t, serverConf)
+			p, err := getPerfConfig(&config{
+				PerfBytes:   tt.bytes,
+				PerfMsgSize: tt.msgSize,
+				PerfMode:    tt.mode,
+				interval:    tt.interval,
+			})
+			if err != nil {
+				t.Fatalf("getPerfConfig() error = %v", err)
+			}
+
+			s := &perfSummary{Mode: p.mode, MessageSize: p.msgSize}
+			for transport, dial := range map[string]connDialer{
+				perfAtls: func() (*tls.Conn, error) {
+					return atls.Dial("tcp", addr, clientConf, atls.WithAttest("none"))
+				},
+				perfTls: func() (*tls.Conn, error) {
+					return tls.Dial("tcp", baseline, clientConf)
+				},
+			} {
+				run, err := runPerf(p, transport, addr, dial)
+				if err != nil {
+					t.Fatalf("runPerf() %v error = %v", transport, err)
+				}
+				if run.Bytes != tt.bytes || run.Messages != tt.wantMessages ||
+					run.Handshakes != tt.wantHandshakes {
+					t.Errorf("runPerf() %v = %v bytes, %v messages, %v handshakes, want %v, %v, %v",
+						transport, run.Bytes, run.Messages, run.Handshakes, tt.bytes,
+						tt.wantMessages, tt.wantHandshakes)
+				}
+				if run.GoodputMbps <= 0 || run.Latency.MaxMs <= 0 || run.Latency.P50Ms > run.Latency.MaxMs {
+					t.Errorf("runPerf() %v goodput %v, latency %+v", transport, run.GoodputMbps,
+						run.Latency)
+				}
+				s.Runs = append(s.Runs, *run)
+			}
+
+			// The listener reports the received bytes of all sessions
+			var received int64
+			deadline := time.Now().Add(5 * time.Second)
+			for received < 2*tt.bytes && time.Now().Before(deadline) {
+				received = 0
+				for _, session := range out.sessions(t) {
+					if session.Mode != tt.mode {
+						t.Errorf("session mode = %v, want %v", session.Mode, tt.mode)
+					}
+					received += session.Bytes
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if received != 2*tt.bytes {
+				t.Errorf("listener received %v bytes, want %v", received, 2*tt.bytes)
+			}
+
+			s.Overhead = overhead(&s.Runs[0], &s.Runs[1])
+			var text bytes.Buffer
+			if err := printPerfSummary(&text, formatText, s); err != nil {
+				t.Fatalf("printPerfSummary() error = %v", err)
+			}
+			if !strings.Contains(text.String(), "aTLS vs. TLS: goodput") {
+				t.Errorf("text summary misses the overhead: %v", text.String())
+			}
+			var js bytes.Buffer
+			if err := printPerfSummary(&js, formatJson, s); err != nil {
+				t.Fatalf("printPerfSummary() error = %v", err)
+			}
+			var parsed perfSummary
+			if err := json.Unmarshal(js.Bytes(), &parsed); err != nil || len(parsed.Runs) != 2 {
+				t.Errorf("JSON summary = %v (%v), want two runs", js.String(), err)
+			}
+		})
+	}
+}
+
+func Test_getPerfConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       config
+		wantErr bool
+	}{
+		{"Defaults", config{PerfBytes: defaultPerfBytes, PerfMsgSize: defaultPerfMsgSize,
+			PerfMode: perfEcho}, false},
+		{"Discard", config{PerfBytes: 1, PerfMsgSize: 1, PerfMode: "Discard"}, false},
+		{"No Bytes", config{PerfMsgSize: 1, PerfMode: perfEcho}, true},
+		{"Message Too Large", config{PerfBytes: 1, PerfMsgSize: maxPerfMsgSize + 1,
+			PerfMode: perfEcho}, true},
+		{"Unknown Mode", config{PerfBytes: 1, PerfMsgSize: 1, PerfMode: "sink"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getPerfConfig(&tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getPerfConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && exitCode(err) != exitUsage {
+				t.Errorf("exitCode() = %v, want %v", exitCode(err), exitUsage)
+			}
+		})
+	}
+}
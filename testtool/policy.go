@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	v "github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+const (
+	expectPass = "pass"
+	expectFail = "fail"
+)
+
+// policyCmds are the subcommands of the policy command, which helps authoring
+// custom policies by evaluating them without a cmcd or live attestation
+var policyCmds = map[string]func([]string) error{
+	"test": policyTest,
+}
+
+// policyOutput is the outcome of a policy test, printed as JSON document if
+// the output format is json
+type policyOutput struct {
+	Policy string `json:"policy"`
+	Engine string `json:"engine"`
+	Result string `json:"result"`
+	Expect string `json:"expect,omitempty"`
+	*v.PolicyDecision
+}
+
+// policyCmd runs the policy subcommand specified as first argument
+func policyCmd(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("policy subcommand missing. Possible: %v", maps.Keys(policyCmds))
+	}
+	cmd, ok := policyCmds[strings.ToLower(args[0])]
+	if !ok {
+		return usageErrorf("policy subcommand %v does not exist. Possible: %v", args[0],
+			maps.Keys(policyCmds))
+	}
+	return cmd(args[1:])
+}
+
+// policyTest evaluates the policies against a stored verification result and
+// prints the decision. With an expectation, the command fails if the decision
+// does not match, so that policy test suites can run in CI
+func policyTest(args []string) error {
+
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	policyFile := fs.String("policy", "", "Policy file to be tested")
+	engine := fs.String("engine", "js", fmt.Sprintf("Policy engine for the policy. Possible: %v",
+		maps.Keys(cmc.GetPolicyEngines())))
+	resultFile := fs.String("result", "", "Stored verification result or JSON output of the testtool")
+	expect := fs.String("expect", "", "Expected decision: pass or fail")
+	format := fs.String(formatFlag, formatText, "Output format: text or json")
+	logLevel := fs.String(logFlag, "warn", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse policy test flags: %w", err)
+	}
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+
+	if *policyFile == "" || *resultFile == "" {
+		return usageErrorf("policy and result must be specified")
+	}
+	if *expect != "" && *expect != expectPass && *expect != expectFail {
+		return usageErrorf("unknown expectation %v. Possible: [%v %v]", *expect, expectPass,
+			expectFail)
+	}
+	if *format != formatText && *format != formatJson {
+		return usageErrorf("unknown output format %v", *format)
+	}
+	polEng, ok := cmc.GetPolicyEngines()[strings.ToLower(*engine)]
+	if !ok || !v.PolicyEngineAvailable(polEng) {
+		engines := maps.Keys(cmc.GetPolicyEngines())
+		slices.Sort(engines)
+		return usageErrorf("policy engine %v not available. Possible: %v", *engine, engines)
+	}
+
+	policies, err := os.ReadFile(*policyFile)
+	if err != nil {
+		return usageErrorf("failed to read policy: %w", err)
+	}
+	data, err := os.ReadFile(*resultFile)
+	if err != nil {
+		return usageErrorf("failed to read result: %w", err)
+	}
+	result, err := loadResult(data)
+	if err != nil {
+		return usageErrorf("failed to load result %v: %w", *resultFile, err)
+	}
+
+	d, err := v.EvaluatePolicies(policies, *result, polEng)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate policy: %w", err)
+	}
+
+	o := &policyOutput{
+		Policy:         *policyFile,
+		Engine:         strings.ToLower(*engine),
+		Result:         *resultFile,
+		Expect:         *expect,
+		PolicyDecision: d,
+	}
+	if *format == formatJson {
+		out, err := json.Marshal(o)
+		if err != nil {
+			return fmt.Errorf("failed to marshal policy decision: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	} else {
+		o.print(os.Stdout)
+	}
+
+	return o.check()
+}
+
+// loadResult unmarshals a verification result, which is either stored as is
+// or embedded in the JSON output of an earlier verification
+func loadResult(data []byte) (*ar.VerificationResult, error) {
+	var o struct {
+		Result *ar.VerificationResult `json:"result"`
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	if o.Result != nil {
+		return o.Result, nil
+	}
+	result := new(ar.VerificationResult)
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	if result.Type != "Verification Result" {
+		return nil, fmt.Errorf("unexpected type %q, want verification result", result.Type)
+	}
+	return result, nil
+}
+
+// check returns an error if the decision does not match the expectation or,
+// without expectation, if the policy failed
+func (o *policyOutput) check() error {
+	var err error
+	switch {
+	case o.Expect == expectFail && o.Success:
+		err = fmt.Errorf("policy %v passed, expected to fail", o.Policy)
+	case o.Expect == expectFail:
+		return nil
+	case !o.Success:
+		err = fmt.Errorf("policy %v failed", o.Policy)
+	default:
+		return nil
+	}
+	return &opError{code: exitVerifyFailed, err: err}
+}
+
+func (o *policyOutput) print(w io.Writer) {
+	decision := "FAIL"
+	if o.Success {
+		decision = "PASS"
+	}
+	fmt.Fprintf(w, "Decision: %v (%v policy %v, result %v)\n", decision, o.Engine, o.Policy,
+		o.Result)
+	if len(o.Violations) > 0 {
+		fmt.Fprintln(w, "Violations:")
+		for _, s := range o.Violations {
+			fmt.Fprintf(w, "    %v\n", s)
+		}
+	}
+	if len(o.Trace) > 0 {
+		fmt.Fprintln(w, "Trace:")
+		for _, s := range o.Trace {
+			fmt.Fprintf(w, "    %v\n", s)
+		}
+	}
+	if o.Expect != "" {
+		fmt.Fprintf(w, "Expected: %v\n", o.Expect)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || jspolicies
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyTest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+		return file
+	}
+
+	policy := write("policy.js", `
+		var obj = JSON.parse(json);
+		console.log("prover", obj.prover);
+		if (obj.prover != "de.fhg.aisec.test") {
+			violation("unexpected prover " + obj.prover);
+		}
+		obj.prover == "de.fhg.aisec.test"
+	`)
+	broken := write("broken.js", "var x = ;")
+	pass := write("pass.json", `{"type":"Verification Result","prover":"de.fhg.aisec.test"}`)
+	fail := write("fail.json", `{"type":"Verification Result","prover":"unknown"}`)
+	output := write("output.json", `{"operation":"verify","success":true,`+
+		`"result":{"type":"Verification Result","prover":"de.fhg.aisec.test"}}`)
+	other := write("other.json", `{"type":"Attestation Report"}`)
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Pass", []string{"-policy", policy, "-result", pass}, exitSuccess},
+		{"Fail", []string{"-policy", policy, "-result", fail}, exitVerifyFailed},
+		{"Testtool Output", []string{"-policy", policy, "-result", output}, exitSuccess},
+		{"Expect Pass", []string{"-policy", policy, "-result", pass, "-expect", "pass"}, exitSuccess},
+		{"Expect Fail", []string{"-policy", policy, "-result", fail, "-expect", "fail"}, exitSuccess},
+		{"Expect Fail Passed", []string{"-policy", policy, "-result", pass, "-expect", "fail"},
+			exitVerifyFailed},
+		{"JSON Format", []string{"-policy", policy, "-result", fail, "-format", "json"},
+			exitVerifyFailed},
+		{"Unknown Engine", []string{"-policy", policy, "-result", pass, "-engine", "opa"}, exitUsage},
+		{"Unknown Expectation", []string{"-policy", policy, "-result", pass, "-expect", "maybe"},
+			exitUsage},
+		{"No Verification Result", []string{"-policy", policy, "-result", other}, exitUsage},
+		{"Missing Result", []string{"-policy", policy}, exitUsage},
+		{"Broken Policy", []string{"-policy", broken, "-result", pass}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(policyCmd(append([]string{"test"}, tt.args...))); got != tt.want {
+				t.Errorf("policy test exit code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
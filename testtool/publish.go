@@ -102,24 +102,32 @@ func publish(addr string, result []byte) error {
 	return nil
 }
 
-func saveResult(file, addr string, result []byte) error {
+// parseResult parses the verification result received from the cmcd
+func parseResult(data []byte) (*ar.VerificationResult, error) {
+	r := new(ar.VerificationResult)
+	if err := ar.DecodeJson(data, r); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal verification result: %w", err)
+	}
+	return r, nil
+}
 
-	// Convert to human readable
-	var out bytes.Buffer
-	json.Indent(&out, result, "", "    ")
+// saveResult logs, stores and publishes the verification result
+func saveResult(file, addr string, r *ar.VerificationResult) error {
 
 	// Log the result
-	r := new(ar.VerificationResult)
-	json.Unmarshal(result, r)
 	if r.Success {
 		log.Infof("SUCCESS: Verification for Prover %v (%v)", r.Prover, r.Created)
 	} else {
 		log.Infof("FAILED: Verification for Prover %v (%v)", r.Prover, r.Created)
 	}
 
-	// Save the Attestation Result to file
+	// Save the Attestation Result to file in human readable form
 	if file != "" {
-		os.WriteFile(file, out.Bytes(), 0644)
+		data, err := json.MarshalIndent(r, "", "    ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal verification result: %w", err)
+		}
+		os.WriteFile(file, data, 0644)
 		log.Debugf("Wrote file %v", file)
 	} else {
 		log.Debug("No config file specified: will not save attestation report")
@@ -127,7 +135,11 @@ func saveResult(file, addr string, result []byte) error {
 
 	// Publish the attestation result if publishing address was specified
 	if addr != "" {
-		err := publish(addr, result)
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal verification result: %w", err)
+		}
+		err = publish(addr, data)
 		if err != nil {
 			log.Warnf("failed to publish result: %v", err)
 		}
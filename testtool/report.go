@@ -0,0 +1,317 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cmc"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	v "github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+// reportCmds are the subcommands of the report command, which generates an
+// attestation report for a given nonce via the cmcd and verifies stored
+// attestation reports offline, e.g. in CI pipelines or for archived reports
+var reportCmds = map[string]func([]string) error{
+	"generate": reportGenerate,
+	"verify":   reportVerify,
+}
+
+// reportCmd runs the report subcommand specified as first argument
+func reportCmd(args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("report subcommand missing. Possible: %v", maps.Keys(reportCmds))
+	}
+	cmd, ok := reportCmds[strings.ToLower(args[0])]
+	if !ok {
+		return usageErrorf("report subcommand %v does not exist. Possible: %v", args[0],
+			maps.Keys(reportCmds))
+	}
+	return cmd(args[1:])
+}
+
+// reportGenerate retrieves an attestation report for the specified nonce from
+// the cmcd and stores it in the output file
+func reportGenerate(args []string) error {
+
+	fs := flag.NewFlagSet("report generate", flag.ContinueOnError)
+	nonceHex := fs.String(nonceFlag, "", "Hex encoded nonce to be included in the attestation report")
+	out := fs.String("out", "attestation-report", "Output file for the attestation report")
+	cmcAddr := fs.String(cmcFlag, "127.0.0.1:9955", "Address to connect to the cmcd API")
+	api := fs.String(apiFlag, "grpc", fmt.Sprintf("APIs for cmcd. Possible: %v", maps.Keys(apis)))
+	network := fs.String(networkFlag, "", "Network for socket API [unix tcp]")
+	serializer := fs.String(serializerFlag, "cbor", "Serializer to be used for socket API (JSON or CBOR)")
+	format := fs.String(formatFlag, formatText, "Output format: text or json")
+	logLevel := fs.String(logFlag, "info", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse report generate flags: %w", err)
+	}
+
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	nonce, err := parseNonce(*nonceHex)
+	if err != nil {
+		return err
+	}
+
+	c := &config{
+		Mode:       "generate",
+		CmcAddr:    *cmcAddr,
+		ReportFile: *out,
+		Api:        *api,
+		Network:    *network,
+		Serializer: *serializer,
+		Format:     strings.ToLower(*format),
+		nonce:      nonce,
+	}
+	if err := checkReportFormat(c.Format); err != nil {
+		return err
+	}
+	var ok bool
+	c.serializer, ok = serializers[strings.ToLower(c.Serializer)]
+	if !ok {
+		return usageErrorf("serializer %v is not implemented", c.Serializer)
+	}
+	if strings.EqualFold(c.Api, "libapi") {
+		return usageErrorf("API %v does not connect to a cmcd, use mode generate instead", c.Api)
+	}
+	c.api, ok = apis[strings.ToLower(c.Api)]
+	if !ok {
+		return usageErrorf("API %v is not implemented", c.Api)
+	}
+	pathsToAbs(c)
+
+	o := newOutput("report generate", c.CmcAddr)
+	o.Nonce = *nonceHex
+	report, err := c.api.generate(c)
+	o.ReportId = reportId(report)
+	return o.finish(c, err)
+}
+
+// reportVerify verifies a stored attestation report offline against the
+// specified nonce, CA and optional policies via the verifier library
+func reportVerify(args []string) error {
+
+	fs := flag.NewFlagSet("report verify", flag.ContinueOnError)
+	in := fs.String("in", "attestation-report", "Attestation report to be verified")
+	nonceHex := fs.String(nonceFlag, "", "Hex encoded nonce the attestation report must contain")
+	caFile := fs.String(caFlag, "", "Certificate Authorities to be trusted in PEM format")
+	policiesFile := fs.String(policiesFlag, "", "JSON policies file for custom verification")
+	policyEngine := fs.String("policyengine", "", fmt.Sprintf("Policy engine for the policies. Possible: %v",
+		maps.Keys(cmc.GetPolicyEngines())))
+	metadataDir := fs.String(metadataFlag, "", "Optional folder with the metadata the attestation report must contain")
+	cache := fs.String(cacheFlag, "", "Optional folder for caching hardware collateral")
+	atStr := fs.String("time", "", "Optional RFC3339 time at which certificates and validity periods are evaluated")
+	format := fs.String(formatFlag, formatText, "Output format: text or json")
+	logLevel := fs.String(logFlag, "info", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse report verify flags: %w", err)
+	}
+
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	c := &config{Format: strings.ToLower(*format)}
+	if err := checkReportFormat(c.Format); err != nil {
+		return err
+	}
+	nonce, err := parseNonce(*nonceHex)
+	if err != nil {
+		return err
+	}
+	if *caFile == "" {
+		return usageErrorf("path to read CA certificate file must be specified")
+	}
+	ca, err := os.ReadFile(*caFile)
+	if err != nil {
+		return usageErrorf("failed to read certificate file %v: %w", *caFile, err)
+	}
+	var policies []byte
+	if *policiesFile != "" {
+		policies, err = os.ReadFile(*policiesFile)
+		if err != nil {
+			return usageErrorf("failed to read policies file: %w", err)
+		}
+	}
+	polEng := v.PolicyEngineSelect_None
+	if *policyEngine != "" {
+		var ok bool
+		polEng, ok = cmc.GetPolicyEngines()[strings.ToLower(*policyEngine)]
+		if !ok {
+			return usageErrorf("policy engine %v does not exist", *policyEngine)
+		}
+		if !v.PolicyEngineAvailable(polEng) {
+			return usageErrorf("policy engine %v not compiled in", *policyEngine)
+		}
+	}
+	var at time.Time
+	if *atStr != "" {
+		at, err = time.Parse(time.RFC3339, *atStr)
+		if err != nil {
+			return usageErrorf("failed to parse verification time: %w", err)
+		}
+	}
+
+	o := newOutput("report verify", "")
+	report, err := os.ReadFile(*in)
+	if err != nil {
+		return o.finish(c, fmt.Errorf("failed to read file %v: %w", *in, err))
+	}
+	o.ReportId = reportId(report)
+
+	if at.IsZero() {
+		log.Debugf("Verifying %v", *in)
+	} else {
+		log.Debugf("Verifying %v at %v", *in, at)
+	}
+	result := v.VerifyAt(report, nonce, ca, policies, polEng, *cache, at)
+	o.Result = &result
+
+	if *metadataDir != "" && result.Success {
+		missing, err := checkMetadata(report, *metadataDir)
+		if err != nil {
+			return o.finish(c, err)
+		}
+		if len(missing) > 0 {
+			result.Success = false
+			err = &opError{code: exitVerifyFailed,
+				err: fmt.Errorf("metadata not contained in %v: %v", *metadataDir,
+					strings.Join(missing, ", "))}
+			printReportResult(c, &result)
+			return o.finish(c, err)
+		}
+	}
+
+	printReportResult(c, &result)
+	return o.finish(c, nil)
+}
+
+// checkMetadata returns the metadata items of the attestation report which are
+// not contained in the metadata folder. This pins the verification to a known
+// set of manifests and descriptions instead of accepting any metadata signed
+// by a trusted CA
+func checkMetadata(report []byte, dir string) ([]string, error) {
+
+	metadata, _, err := cmc.GetMetadata([]string{"file://" + filepath.Clean(dir)}, "")
+	if err != nil {
+		return nil, usageErrorf("failed to load metadata from %v: %w", dir, err)
+	}
+	known := map[[sha256.Size]byte]bool{}
+	for _, m := range metadata {
+		known[sha256.Sum256(m)] = true
+	}
+
+	s := detectSerializer(report)
+	payload, err := s.GetPayload(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attestation report payload: %w", err)
+	}
+	var r ar.AttestationReport
+	if err := s.Unmarshal(payload, &r); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attestation report: %w", err)
+	}
+
+	items := map[string][]byte{
+		"RTM manifest":        r.RtmManifest,
+		"OS manifest":         r.OsManifest,
+		"company description": r.CompanyDescription,
+		"device description":  r.DeviceDescription,
+	}
+	for i, m := range r.AppManifests {
+		items[fmt.Sprintf("app manifest %v", i)] = m
+	}
+
+	missing := []string{}
+	for kind, item := range items {
+		if len(item) == 0 || known[sha256.Sum256(item)] {
+			continue
+		}
+		name := kind
+		var info ar.MetaInfo
+		if p, err := s.GetPayload(item); err == nil && s.Unmarshal(p, &info) == nil && info.Name != "" {
+			name = fmt.Sprintf("%v %v", kind, info.Name)
+		}
+		missing = append(missing, name)
+	}
+	slices.Sort(missing)
+
+	return missing, nil
+}
+
+// printReportResult prints the verification result to stdout in output format
+// text. In output format json, the result is part of the output document
+func printReportResult(c *config, result *ar.VerificationResult) {
+	if c.Format != formatText {
+		return
+	}
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		log.Warnf("Failed to marshal verification result: %v", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+}
+
+func detectSerializer(data []byte) ar.Serializer {
+	if json.Valid(data) {
+		return ar.JsonSerializer{}
+	}
+	return ar.CborSerializer{}
+}
+
+func parseNonce(s string) ([]byte, error) {
+	if s == "" {
+		return nil, usageErrorf("hex encoded nonce must be specified")
+	}
+	nonce, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, usageErrorf("failed to decode nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+func checkReportFormat(format string) error {
+	if format != formatText && format != formatJson {
+		return usageErrorf("output format %v is not supported (%v, %v)", format, formatText,
+			formatJson)
+	}
+	return nil
+}
+
+func setLogLevel(level string) error {
+	l, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return usageErrorf("log level %v does not exist", level)
+	}
+	internal.SetLogLevel(l)
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !nodefaults || grpc
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	api "github.com/Fraunhofer-AISEC/cmc/grpcapi"
+)
+
+// reportServer is a fake cmcd generating attestation reports from the fixtures
+type reportServer struct {
+	api.UnimplementedCMCServiceServer
+	f *fixtures.Fixtures
+}
+
+func (s *reportServer) Attest(ctx context.Context, req *api.AttestationRequest,
+) (*api.AttestationResponse, error) {
+	signed, err := s.f.NewReport(req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AttestationResponse{Status: api.Status_OK, AttestationReport: signed}, nil
+}
+
+func startReportServer(t *testing.T, f *fixtures.Fixtures) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	api.RegisterCMCServiceServer(s, &reportServer{f: f})
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+	return ln.Addr().String()
+}
+
+func TestReport(t *testing.T) {
+
+	now := time.Now()
+	nonce := hex.EncodeToString([]byte{0x01, 0x02, 0x03, 0x04})
+
+	tests := []struct {
+		name       string
+		serializer ar.Serializer
+		notBefore  time.Time
+		notAfter   time.Time
+		args       []string
+		otherMeta  bool
+		want       int
+	}{
+		{"JSON", ar.JsonSerializer{}, now.Add(-time.Hour), now.Add(time.Hour), nil, false,
+			exitSuccess},
+		{"CBOR", ar.CborSerializer{}, now.Add(-time.Hour), now.Add(time.Hour), nil, false,
+			exitSuccess},
+		{"JSON Output", ar.CborSerializer{}, now.Add(-time.Hour), now.Add(time.Hour),
+			[]string{"-format", "json"}, false, exitSuccess},
+		{"Wrong Nonce", ar.JsonSerializer{}, now.Add(-time.Hour), now.Add(time.Hour),
+			[]string{"-nonce", "0102"}, false, exitVerifyFailed},
+		{"Expired", ar.JsonSerializer{}, now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), nil,
+			false, exitVerifyFailed},
+		{"Expired Time Override", ar.CborSerializer{}, now.Add(-48 * time.Hour),
+			now.Add(-24 * time.Hour),
+			[]string{"-time", now.Add(-36 * time.Hour).Format(time.RFC3339)}, false, exitSuccess},
+		{"Metadata Matches", ar.JsonSerializer{}, now.Add(-time.Hour), now.Add(time.Hour),
+			[]string{"-metadata", "meta"}, false, exitSuccess},
+		{"Metadata Mismatch", ar.JsonSerializer{}, now.Add(-time.Hour), now.Add(time.Hour),
+			[]string{"-metadata", "other"}, true, exitVerifyFailed},
+		{"Invalid Time", ar.JsonSerializer{}, now.Add(-time.Hour), now.Add(time.Hour),
+			[]string{"-time", "yesterday"}, false, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o := fixtures.Options{
+				Serializer: tt.serializer,
+				NotBefore:  tt.notBefore,
+				NotAfter:   tt.notAfter,
+			}
+			f, err := fixtures.Generate(o)
+			if err != nil {
+				t.Fatalf("failed to generate fixtures: %v", err)
+			}
+			if err := f.Write(filepath.Join(dir, "meta")); err != nil {
+				t.Fatalf("failed to write fixtures: %v", err)
+			}
+			if tt.otherMeta {
+				other, err := fixtures.Generate(o)
+				if err != nil {
+					t.Fatalf("failed to generate fixtures: %v", err)
+				}
+				if err := other.Write(filepath.Join(dir, "other")); err != nil {
+					t.Fatalf("failed to write fixtures: %v", err)
+				}
+			}
+			addr := startReportServer(t, f)
+
+			out := filepath.Join(dir, "report")
+			err = reportGenerate([]string{"-nonce", nonce, "-out", out, "-cmc", addr,
+				"-log", "warn"})
+			if err != nil {
+				t.Fatalf("report generate error = %v", err)
+			}
+
+			caFile := filepath.Join(dir, "meta", "ca.pem")
+			args := []string{"-in", out, "-nonce", nonce, "-ca", caFile, "-log", "warn"}
+			for i := 0; i < len(tt.args); i += 2 {
+				if tt.args[i] == "-metadata" {
+					args = append(args, tt.args[i], filepath.Join(dir, tt.args[i+1], "metadata"))
+				} else {
+					args = append(args, tt.args[i], tt.args[i+1])
+				}
+			}
+			err = reportVerify(args)
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("report verify exit code = %v, want %v (error %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestReportUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"No Subcommand", nil},
+		{"Unknown Subcommand", []string{"sign"}},
+		{"Missing Nonce", []string{"generate", "-out", "report"}},
+		{"Invalid Nonce", []string{"generate", "-nonce", "xyz"}},
+		{"Lib API", []string{"generate", "-nonce", "01", "-api", "libapi"}},
+		{"Unknown Flag", []string{"verify", "-foo"}},
+		{"Missing CA", []string{"verify", "-nonce", "01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(reportCmd(tt.args)); got != exitUsage {
+				t.Errorf("exit code = %v, want %v", got, exitUsage)
+			}
+		})
+	}
+}
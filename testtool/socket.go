@@ -19,9 +19,7 @@ package main
 
 // Install github packages with "go get [url]"
 import (
-	"crypto/rand"
 	"fmt"
-	"net"
 	"os"
 
 	// local modules
@@ -30,6 +28,7 @@ import (
 
 	"github.com/Fraunhofer-AISEC/cmc/api"
 	"github.com/Fraunhofer-AISEC/cmc/attestedtls"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 type SocketApi struct{}
@@ -38,81 +37,70 @@ func init() {
 	apis["socket"] = SocketApi{}
 }
 
-func (a SocketApi) generate(c *config) {
+func (a SocketApi) generate(c *config) ([]byte, error) {
 
-	log.Tracef("Connecting via %v socket to %v", c.Network, c.CmcAddr)
-
-	// Establish connection
-	conn, err := net.Dial(c.Network, c.CmcAddr)
+	// Use the configured nonce or generate a random nonce
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Error dialing: %v", err)
+		return nil, err
 	}
 
-	// Generate random nonce
-	nonce := make([]byte, 8)
-	_, err = rand.Read(nonce)
+	attestationResp, err := attestSocketRequest(c, &api.AttestationRequest{
+		Nonce:       nonce,
+		Compression: c.compression,
+	})
 	if err != nil {
-		log.Fatalf("Failed to read random bytes: %v", err)
-	}
-
-	// Generate attestation request
-	req := &api.AttestationRequest{
-		Nonce: nonce,
+		return nil, err
 	}
 
-	// Marshal payload
-	payload, err := c.serializer.Marshal(req)
+	// Save the attestation report for the verifier
+	err = os.WriteFile(c.ReportFile, attestationResp.AttestationReport, 0644)
 	if err != nil {
-		log.Fatalf("failed to marshal payload: %v", err)
+		return nil, fmt.Errorf("failed to save attestation report as %v: %w", c.ReportFile, err)
 	}
+	log.Infof("Wrote attestation report: %v", c.ReportFile)
 
-	// Send request
-	err = api.Send(conn, payload, api.TypeAttest)
-	if err != nil {
-		log.Fatalf("failed to send request: %v", err)
+	// Save the nonce for the verifier
+	if c.NonceFile != "" {
+		err = os.WriteFile(c.NonceFile, nonce, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save nonce as %v: %w", c.NonceFile, err)
+		}
+		log.Infof("Wrote nonce: %v", c.NonceFile)
 	}
 
-	// Read reply
-	payload, msgType, err := api.Receive(conn)
-	if err != nil {
-		log.Fatalf("failed to receive: %v", err)
-	}
-	checkError(msgType, payload, c.serializer)
+	return attestationResp.AttestationReport, nil
+}
 
-	// Unmarshal attestation response
-	var attestationResp api.AttestationResponse
-	err = c.serializer.Unmarshal(payload, &attestationResp)
-	if err != nil {
-		log.Fatalf("failed to unmarshal response")
-	}
+func (a SocketApi) dryrun(c *config) (*ar.DryRunSummary, error) {
 
-	// Save the attestation report for the verifier
-	err = os.WriteFile(c.ReportFile, attestationResp.AttestationReport, 0644)
+	nonce, err := getNonce(c)
 	if err != nil {
-		log.Fatalf("Failed to save attestation report as %v: %v", c.ReportFile, err)
+		return nil, err
 	}
-	log.Infof("Wrote attestation report: %v", c.ReportFile)
 
-	// Save the nonce for the verifier
-	os.WriteFile(c.NonceFile, nonce, 0644)
+	attestationResp, err := attestSocketRequest(c, &api.AttestationRequest{
+		Nonce:  nonce,
+		DryRun: true,
+	})
 	if err != nil {
-		log.Fatalf("Failed to save nonce as %v: %v", c.NonceFile, err)
+		return nil, err
 	}
-	log.Infof("Wrote nonce: %v", c.NonceFile)
 
+	return decodeDryRun(attestationResp.DryRunSummary)
 }
 
-func (a SocketApi) verify(c *config) {
+func (a SocketApi) verify(c *config) (*ar.VerificationResult, error) {
 
 	// Read the attestation report, CA and the nonce previously stored
 	data, err := os.ReadFile(c.ReportFile)
 	if err != nil {
-		log.Fatalf("Failed to read file %v: %v", c.ReportFile, err)
+		return nil, fmt.Errorf("failed to read file %v: %w", c.ReportFile, err)
 	}
 
 	nonce, err := os.ReadFile(c.NonceFile)
 	if err != nil {
-		log.Fatalf("Failed to read nonce: %v", err)
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
 	}
 
 	req := &api.VerificationRequest{
@@ -124,13 +112,10 @@ func (a SocketApi) verify(c *config) {
 
 	resp, err := verifySocketRequest(c, req)
 	if err != nil {
-		log.Fatalf("Failed to verify: %v", err)
+		return nil, fmt.Errorf("failed to verify: %w", err)
 	}
 
-	err = saveResult(c.ResultFile, c.Publish, resp.VerificationResult)
-	if err != nil {
-		log.Fatalf("Failed to save result: %v", err)
-	}
+	return parseResult(resp.VerificationResult)
 }
 
 func (a SocketApi) measure(c *config) {
@@ -164,12 +149,12 @@ func (a SocketApi) measure(c *config) {
 	log.Debugf("Recorded measurement. Result: %v", resp.Success)
 }
 
-func (a SocketApi) dial(c *config) {
-	dialInternal(c, attestedtls.CmcApi_Socket, nil)
+func (a SocketApi) dial(c *config) error {
+	return dialInternal(c, attestedtls.CmcApi_Socket, nil)
 }
 
-func (a SocketApi) listen(c *config) {
-	listenInternal(c, attestedtls.CmcApi_Socket, nil)
+func (a SocketApi) listen(c *config) error {
+	return listenInternal(c, attestedtls.CmcApi_Socket, nil)
 }
 
 func (a SocketApi) request(c *config) {
@@ -188,16 +173,61 @@ func (a SocketApi) iothub(c *config) {
 	log.Fatalf("IoT hub not implemented for sockets API")
 }
 
+func attestSocketRequest(c *config, req *api.AttestationRequest,
+) (*api.AttestationResponse, error) {
+
+	log.Tracef("Connecting via %v socket to %v", c.Network, c.CmcAddr)
+
+	// Establish connection
+	conn, err := internal.Dial(c.Network, c.CmcAddr, 0)
+	if err != nil {
+		return nil, unreachableErrorf("error dialing: %w", err)
+	}
+	defer conn.Close()
+
+	// Marshal payload
+	payload, err := c.serializer.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	// Send request
+	err = api.Send(conn, payload, api.TypeAttest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	// Read reply
+	payload, msgType, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive: %w", err)
+	}
+	err = checkError(msgType, version, payload, c.serializer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal attestation response
+	attestationResp := new(api.AttestationResponse)
+	err = c.serializer.Unmarshal(payload, attestationResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return attestationResp, nil
+}
+
 func verifySocketRequest(c *config, req *api.VerificationRequest,
 ) (*api.VerificationResponse, error) {
 
 	log.Tracef("Connecting via %v socket to %v", c.Network, c.CmcAddr)
 
 	// Establish connection
-	conn, err := net.Dial(c.Network, c.CmcAddr)
+	conn, err := internal.Dial(c.Network, c.CmcAddr, 0)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing: %v", err)
+		return nil, unreachableErrorf("error dialing: %w", err)
 	}
+	defer conn.Close()
 
 	// Marshal payload
 	payload, err := c.serializer.Marshal(req)
@@ -212,11 +242,14 @@ func verifySocketRequest(c *config, req *api.VerificationRequest,
 	}
 
 	// Read reply
-	payload, msgType, err := api.Receive(conn)
+	payload, msgType, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive: %w", err)
+	}
+	err = checkError(msgType, version, payload, c.serializer)
 	if err != nil {
-		log.Fatalf("failed to receive: %v", err)
+		return nil, err
 	}
-	checkError(msgType, payload, c.serializer)
 
 	// Unmarshal attestation response
 	verifyResp := new(api.VerificationResponse)
@@ -234,10 +267,11 @@ func measureSocketRequest(c *config, req *api.MeasureRequest,
 	log.Tracef("Connecting via %v socket to %v", c.Network, c.CmcAddr)
 
 	// Establish connection
-	conn, err := net.Dial(c.Network, c.CmcAddr)
+	conn, err := internal.Dial(c.Network, c.CmcAddr, 0)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing: %v", err)
 	}
+	defer conn.Close()
 
 	// Marshal payload
 	payload, err := c.serializer.Marshal(req)
@@ -252,11 +286,14 @@ func measureSocketRequest(c *config, req *api.MeasureRequest,
 	}
 
 	// Read reply
-	payload, msgType, err := api.Receive(conn)
+	payload, msgType, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive: %w", err)
+	}
+	err = checkError(msgType, version, payload, c.serializer)
 	if err != nil {
-		log.Fatalf("failed to receive: %v", err)
+		return nil, err
 	}
-	checkError(msgType, payload, c.serializer)
 
 	// Unmarshal attestation response
 	measureResp := new(api.MeasureResponse)
@@ -268,14 +305,54 @@ func measureSocketRequest(c *config, req *api.MeasureRequest,
 	return measureResp, nil
 }
 
-func checkError(t uint32, payload []byte, s ar.Serializer) {
+func (a SocketApi) cmcApi() attestedtls.CmcApiSelect {
+	return attestedtls.CmcApi_Socket
+}
+
+// socketBenchClient performs the benchmark operations via the socket API,
+// which establishes a new connection for every request
+type socketBenchClient struct {
+	c *config
+}
+
+func (a SocketApi) benchClient(c *config) (benchClient, error) {
+	return socketBenchClient{c: c}, nil
+}
+
+func (b socketBenchClient) attest(nonce []byte) ([]byte, error) {
+	resp, err := attestSocketRequest(b.c, &api.AttestationRequest{Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	return resp.AttestationReport, nil
+}
+
+func (b socketBenchClient) verify(report, nonce []byte) (*ar.VerificationResult, error) {
+	resp, err := verifySocketRequest(b.c, &api.VerificationRequest{
+		Nonce:             nonce,
+		AttestationReport: report,
+		Ca:                b.c.ca,
+		Policies:          b.c.policies,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseResult(resp.VerificationResult)
+}
+
+func (b socketBenchClient) close() {}
+
+func checkError(t uint32, v api.Version, payload []byte, s ar.Serializer) error {
+	if err := api.CheckVersion(v); err != nil {
+		return fmt.Errorf("cannot decode response: %w", err)
+	}
 	if t == api.TypeError {
 		resp := new(api.SocketError)
 		err := s.Unmarshal(payload, resp)
 		if err != nil {
-			log.Fatal("failed to unmarshal error response")
-		} else {
-			log.Fatalf("server responded with error: %v", resp.Msg)
+			return fmt.Errorf("failed to unmarshal error response: %w", err)
 		}
+		return fmt.Errorf("server responded with error: %w", api.ResponseError(resp, api.Version1))
 	}
+	return nil
 }
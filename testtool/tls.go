@@ -35,6 +35,14 @@ import (
 // Creates TLS connection between this client and a server and performs a remote
 // attestation of the server before exchanging few a exemplary messages with it
 func dialInternalAddr(c *config, api atls.CmcApiSelect, addr string, tlsConf *tls.Config, cmc *cmc.Cmc) error {
+	o := newOutput("dial", addr)
+	err := dialAddr(c, api, addr, tlsConf, cmc, o)
+	return o.finish(c, err)
+}
+
+func dialAddr(c *config, api atls.CmcApiSelect, addr string, tlsConf *tls.Config, cmc *cmc.Cmc,
+	o *output,
+) error {
 
 	conn, err := atls.Dial("tcp", addr, tlsConf,
 		atls.WithCmcAddr(c.CmcAddr),
@@ -44,7 +52,9 @@ func dialInternalAddr(c *config, api atls.CmcApiSelect, addr string, tlsConf *tl
 		atls.WithMtls(c.Mtls),
 		atls.WithAttest(c.Attest),
 		atls.WithCmcNetwork(c.Network),
+		atls.WithCertProfile(c.CertProfile),
 		atls.WithResultCb(func(result *ar.VerificationResult) {
+			o.Result = result
 			// Publish the attestation result asynchronously if publishing address was specified and
 			// and attestation was performed
 			if c.Publish != "" && (c.Attest == "mutual" || c.Attest == "server") {
@@ -82,39 +92,48 @@ func dialInternalAddr(c *config, api atls.CmcApiSelect, addr string, tlsConf *tl
 	return nil
 }
 
-// Wrapper for dialInternalAddr
-func dialInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
-	var tlsConf *tls.Config
+// dialTlsConfig creates the TLS client configuration with the root CA and,
+// for mutual TLS, the certificate retrieved from the cmcd
+func dialTlsConfig(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) (*tls.Config, error) {
 
 	// Add root CA
 	roots := x509.NewCertPool()
 	success := roots.AppendCertsFromPEM(c.ca)
 	if !success {
-		log.Fatal("Could not add cert to root CAs")
+		return nil, usageErrorf("could not add cert to root CAs")
 	}
 
-	if c.Mtls {
-		// Load own certificate
-		var cert tls.Certificate
-		cert, err := atls.GetCert(
-			atls.WithCmcAddr(c.CmcAddr),
-			atls.WithCmcApi(api),
-			atls.WithCmcNetwork(c.Network),
-			atls.WithCmc(cmc))
-		if err != nil {
-			log.Fatalf("failed to get TLS Certificate: %v", err)
-		}
-		// Create TLS config with root CA and own certificate
-		tlsConf = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      roots,
-		}
-	} else {
+	if !c.Mtls {
 		// Create TLS config with root CA only
-		tlsConf = &tls.Config{
+		return &tls.Config{
 			RootCAs:       roots,
 			Renegotiation: tls.RenegotiateNever,
-		}
+		}, nil
+	}
+
+	// Load own certificate
+	cert, err := atls.GetCert(
+		atls.WithCmcAddr(c.CmcAddr),
+		atls.WithCmcApi(api),
+		atls.WithCmcNetwork(c.Network),
+		atls.WithCertProfile(c.CertProfile),
+		atls.WithCmc(cmc))
+	if err != nil {
+		return nil, unreachableErrorf("failed to get TLS certificate from cmcd: %w", err)
+	}
+	// Create TLS config with root CA and own certificate
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+	}, nil
+}
+
+// Wrapper for dialInternalAddr
+func dialInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) error {
+
+	tlsConf, err := dialTlsConfig(c, api, cmc)
+	if err != nil {
+		return newOutput("dial", "").finish(c, err)
 	}
 
 	atls.WithAttest(c.Attest)
@@ -138,22 +157,30 @@ func dialInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 			}
 			<-ticker.C
 		}
-	} else {
-		for _, addr := range c.Addr {
-			err := dialInternalAddr(c, api, addr, tlsConf, cmc)
-			if err != nil {
-				log.Warnf(err.Error())
+	}
+
+	// Dial all addresses once and return the first error
+	var dialErr error
+	for _, addr := range c.Addr {
+		err := dialInternalAddr(c, api, addr, tlsConf, cmc)
+		if err != nil {
+			log.Warnf(err.Error())
+			if dialErr == nil {
+				dialErr = err
 			}
 		}
 	}
+	return dialErr
 }
 
-func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
+// listenTlsConfig creates the TLS server configuration with the root CA for
+// the client certificates and the certificate retrieved from the cmcd
+func listenTlsConfig(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) (*tls.Config, error) {
 	// Add root CA
 	roots := x509.NewCertPool()
 	success := roots.AppendCertsFromPEM(c.ca)
 	if !success {
-		log.Fatal("Could not add cert to root CAs")
+		return nil, usageErrorf("could not add cert to root CAs")
 	}
 
 	// Load certificate
@@ -161,9 +188,10 @@ func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 		atls.WithCmcAddr(c.CmcAddr),
 		atls.WithCmcApi(api),
 		atls.WithCmcNetwork(c.Network),
+		atls.WithCertProfile(c.CertProfile),
 		atls.WithCmc(cmc))
 	if err != nil {
-		log.Fatalf("failed to get TLS Certificate: %v", err)
+		return nil, unreachableErrorf("failed to get TLS certificate from cmcd: %w", err)
 	}
 
 	var clientAuth tls.ClientAuthType
@@ -176,11 +204,19 @@ func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 	}
 
 	// Create TLS config
-	tlsConf := &tls.Config{
+	return &tls.Config{
 		Certificates:  []tls.Certificate{cert},
 		ClientAuth:    clientAuth,
 		ClientCAs:     roots,
 		Renegotiation: tls.RenegotiateNever,
+	}, nil
+}
+
+func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) error {
+
+	tlsConf, err := listenTlsConfig(c, api, cmc)
+	if err != nil {
+		return newOutput("listen", "").finish(c, err)
 	}
 
 	internal.PrintTlsConfig(tlsConf, c.ca)
@@ -190,7 +226,9 @@ func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 		addr = c.Addr[0]
 	}
 
-	// Listen: TLS connection
+	// Listen: TLS connection. The result callback is invoked during the
+	// handshake within Accept, which is never called concurrently
+	var result *ar.VerificationResult
 	ln, err := atls.Listen("tcp", addr, tlsConf,
 		atls.WithCmcAddr(c.CmcAddr),
 		atls.WithCmcCa(c.ca),
@@ -199,26 +237,35 @@ func listenInternal(c *config, api atls.CmcApiSelect, cmc *cmc.Cmc) {
 		atls.WithMtls(c.Mtls),
 		atls.WithAttest(c.Attest),
 		atls.WithCmcNetwork(c.Network),
-		atls.WithResultCb(func(result *ar.VerificationResult) {
+		atls.WithCertProfile(c.CertProfile),
+		atls.WithResultCb(func(r *ar.VerificationResult) {
+			result = r
 			if c.Publish != "" && (c.Attest == "mutual" || c.Attest == "client") {
 				// Publish the attestation result if publishing address was specified
 				// and result is not empty
-				go publishResult(c.Publish, result)
+				go publishResult(c.Publish, r)
 			}
 			// Log errors if any
-			result.PrintErr()
+			r.PrintErr()
 		}),
 		atls.WithCmc(cmc))
 	if err != nil {
-		log.Fatalf("Failed to listen for connections: %v", err)
+		return newOutput("listen", addr).finish(c,
+			fmt.Errorf("failed to listen for connections: %w", err))
 	}
 	defer ln.Close()
 
 	for {
 		log.Infof("serving under %v", addr)
 		// Accept connection and perform remote attestation
+		result = nil
+		o := newOutput("listen", "")
 		conn, err := ln.Accept()
-		if err != nil {
+		o.Result = result
+		if conn != nil {
+			o.Addr = conn.RemoteAddr().String()
+		}
+		if err := o.finish(c, err); err != nil {
 			log.Warnf("Failed to establish connection: %v", err)
 			continue
 		}
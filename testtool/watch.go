@@ -0,0 +1,468 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Install github packages with "go get [url]"
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	// local modules
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// Kinds of changes between the results of consecutive watch rounds
+const (
+	changeVerification = "verification"
+	changePcr          = "pcr"
+	changeViolation    = "violation"
+	changeCertExpiry   = "certExpiry"
+	changeSwCertLevel  = "swCertLevel"
+)
+
+// certNotAfterLayout is the layout of the certificate expiry in the
+// verification result, see ar.ExtractX509Infos
+const certNotAfterLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+type watchChange struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// watchRound is the outcome of a single attestation and verification round,
+// which is appended to the output file as one JSON document per line
+type watchRound struct {
+	Round      int                    `json:"round"`
+	Started    time.Time              `json:"started"`
+	DurationMs float64                `json:"durationMs"`
+	Success    bool                   `json:"success"`
+	ExitCode   int                    `json:"exitCode"`
+	Error      string                 `json:"error,omitempty"`
+	ReportId   string                 `json:"reportId,omitempty"`
+	Violations int                    `json:"violations"`
+	CertExpiry *time.Time             `json:"certExpiry,omitempty"`
+	Changes    []watchChange          `json:"changes,omitempty"`
+	Result     *ar.VerificationResult `json:"result,omitempty"`
+
+	err error
+}
+
+type watcher struct {
+	client    benchClient
+	interval  time.Duration
+	rounds    int
+	keepGoing bool
+	threshold time.Duration
+	w         io.Writer
+	out       io.Writer
+	now       func() time.Time
+	sleep     func(time.Duration)
+}
+
+// watchCmd repeatedly attests and verifies the device via the cmcd, prints a
+// status line per round and highlights the changes between the rounds
+func watchCmd(args []string) error {
+
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration(intervalFlag, time.Minute, "Interval between the attestation rounds")
+	rounds := fs.Int("rounds", 0, "Number of rounds, 0 runs until interrupted")
+	keepGoing := fs.Bool("keep-going", false, "Continue after failed rounds instead of exiting")
+	threshold := fs.Duration("expiry", 30*24*time.Hour, "Highlight certificates expiring within this duration")
+	out := fs.String("out", "", "Optional JSONL file to append the results of all rounds to")
+	cmcAddr := fs.String(cmcFlag, "127.0.0.1:9955", "Address to connect to the cmcd API")
+	api := fs.String(apiFlag, "grpc", fmt.Sprintf("APIs for cmcd. Possible: %v", maps.Keys(apis)))
+	network := fs.String(networkFlag, "", "Network for socket API [unix tcp]")
+	serializer := fs.String(serializerFlag, "cbor", "Serializer to be used for socket API (JSON or CBOR)")
+	caFile := fs.String(caFlag, "", "Certificate Authorities to be trusted in PEM format")
+	policiesFile := fs.String(policiesFlag, "", "JSON policies file for custom verification")
+	logLevel := fs.String(logFlag, "info", fmt.Sprintf("Possible logging: %v", maps.Keys(logLevels)))
+	if err := fs.Parse(args); err != nil {
+		return usageErrorf("failed to parse watch flags: %w", err)
+	}
+
+	if err := setLogLevel(*logLevel); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return usageErrorf("invalid interval %v", *interval)
+	}
+	if *rounds < 0 {
+		return usageErrorf("invalid number of rounds %v", *rounds)
+	}
+
+	c := &config{
+		CmcAddr:    *cmcAddr,
+		Api:        *api,
+		Network:    *network,
+		Serializer: *serializer,
+	}
+	var ok bool
+	c.serializer, ok = serializers[strings.ToLower(c.Serializer)]
+	if !ok {
+		return usageErrorf("serializer %v is not implemented", c.Serializer)
+	}
+	c.api, ok = apis[strings.ToLower(c.Api)]
+	if !ok {
+		return usageErrorf("API %v is not implemented", c.Api)
+	}
+	b, ok := c.api.(benchApi)
+	if !ok {
+		return usageErrorf("API %v does not support the watch command", c.Api)
+	}
+	if *caFile == "" {
+		return usageErrorf("CA certificate file must be specified")
+	}
+	var err error
+	c.ca, err = os.ReadFile(*caFile)
+	if err != nil {
+		return usageErrorf("failed to read certificate file %v: %w", *caFile, err)
+	}
+	if *policiesFile != "" {
+		c.policies, err = os.ReadFile(*policiesFile)
+		if err != nil {
+			return usageErrorf("failed to read policies file: %w", err)
+		}
+	}
+	pathsToAbs(c)
+
+	client, err := b.benchClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	w := &watcher{
+		client:    client,
+		interval:  *interval,
+		rounds:    *rounds,
+		keepGoing: *keepGoing,
+		threshold: *threshold,
+		w:         os.Stdout,
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open output file: %w", err)
+		}
+		defer f.Close()
+		w.out = f
+	}
+
+	return w.run()
+}
+
+// run performs the rounds until the configured number of rounds is reached or,
+// unless keepGoing is set, a round failed. The error of the first failed round
+// is returned
+func (w *watcher) run() error {
+	var prev *ar.VerificationResult
+	var prevTime time.Time
+	var firstErr error
+	for i := 1; w.rounds == 0 || i <= w.rounds; i++ {
+		start := w.now()
+		r := w.round(i, prev, prevTime)
+		if err := printWatchRound(w.w, r); err != nil {
+			return err
+		}
+		if w.out != nil {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return fmt.Errorf("failed to marshal round: %w", err)
+			}
+			if _, err := w.out.Write(append(data, '\n')); err != nil {
+				return fmt.Errorf("failed to write round: %w", err)
+			}
+		}
+		if r.Result != nil {
+			prev = r.Result
+			prevTime = r.Started
+		}
+		if r.err != nil {
+			if !w.keepGoing {
+				return r.err
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+		if w.rounds != 0 && i == w.rounds {
+			break
+		}
+		if wait := w.interval - w.now().Sub(start); wait > 0 {
+			w.sleep(wait)
+		}
+	}
+	return firstErr
+}
+
+// round attests and verifies the device once and compares the result with
+// the result of the previous successful verification
+func (w *watcher) round(i int, prev *ar.VerificationResult, prevTime time.Time) *watchRound {
+	r := &watchRound{
+		Round:   i,
+		Started: w.now().UTC(),
+	}
+	defer func() {
+		r.DurationMs = ms(w.now().Sub(r.Started))
+		r.ExitCode = exitCode(r.err)
+		if r.err != nil {
+			r.Error = r.err.Error()
+		}
+	}()
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		r.err = fmt.Errorf("failed to read random bytes: %w", err)
+		return r
+	}
+	report, err := w.client.attest(nonce)
+	if err != nil {
+		r.err = fmt.Errorf("failed to attest: %w", err)
+		return r
+	}
+	r.ReportId = reportId(report)
+	result, err := w.client.verify(report, nonce)
+	if err != nil {
+		r.err = fmt.Errorf("failed to verify: %w", err)
+		return r
+	}
+
+	r.Result = result
+	r.Success = result.Success
+	r.Violations = len(violations(result))
+	if expiry, ok := earliestExpiry(result); ok {
+		r.CertExpiry = &expiry
+	}
+	if prev != nil {
+		r.Changes = diffResults(prev, result, prevTime, r.Started, w.threshold)
+	}
+	if !result.Success {
+		r.err = &opError{code: exitVerifyFailed, err: errors.New("verification failed")}
+	}
+	return r
+}
+
+// diffResults returns the changes between the verification results of two
+// consecutive rounds performed at prevTime and now. Certificates are reported
+// once they expire within the threshold, i.e. if they expired beyond the
+// threshold in the previous round or were not present
+func diffResults(prev, cur *ar.VerificationResult, prevTime, now time.Time,
+	threshold time.Duration,
+) []watchChange {
+	var changes []watchChange
+
+	if prev.Success != cur.Success {
+		changes = append(changes, watchChange{changeVerification,
+			fmt.Sprintf("verification %v", successString(cur.Success))})
+	}
+
+	if prev.SwCertLevel != cur.SwCertLevel {
+		changes = append(changes, watchChange{changeSwCertLevel,
+			fmt.Sprintf("software certification level changed from %v to %v", prev.SwCertLevel,
+				cur.SwCertLevel)})
+	}
+
+	prevPcrs, curPcrs := pcrValues(prev), pcrValues(cur)
+	keys := maps.Keys(curPcrs)
+	for k := range prevPcrs {
+		if _, ok := curPcrs[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		p, inPrev := prevPcrs[k]
+		c, inCur := curPcrs[k]
+		switch {
+		case !inPrev:
+			changes = append(changes, watchChange{changePcr, fmt.Sprintf("%v appeared: %v", k, c)})
+		case !inCur:
+			changes = append(changes, watchChange{changePcr, fmt.Sprintf("%v disappeared", k)})
+		case p != c:
+			changes = append(changes, watchChange{changePcr,
+				fmt.Sprintf("%v changed from %v to %v", k, p, c)})
+		}
+	}
+
+	prevViolations := violations(prev)
+	curViolations := violations(cur)
+	keys = maps.Keys(curViolations)
+	slices.Sort(keys)
+	for _, k := range keys {
+		if _, ok := prevViolations[k]; !ok {
+			changes = append(changes, watchChange{changeViolation,
+				fmt.Sprintf("new unknown measurement %v", k)})
+		}
+	}
+
+	prevCerts := certExpiries(prev)
+	curCerts := certExpiries(cur)
+	keys = maps.Keys(curCerts)
+	slices.Sort(keys)
+	for _, k := range keys {
+		notAfter := curCerts[k]
+		left := notAfter.Sub(now)
+		if left >= threshold {
+			continue
+		}
+		if prevNotAfter, ok := prevCerts[k]; ok && prevNotAfter.Sub(prevTime) < threshold {
+			continue
+		}
+		changes = append(changes, watchChange{changeCertExpiry,
+			fmt.Sprintf("certificate %v expires in %v (%v)", k, left.Round(time.Minute),
+				notAfter.UTC().Format(time.RFC3339))})
+	}
+
+	return changes
+}
+
+// pcrValues returns the measured PCR values of the TPM measurements
+func pcrValues(r *ar.VerificationResult) map[string]string {
+	pcrs := map[string]string{}
+	for _, m := range r.Measurements {
+		if m.TpmResult == nil {
+			continue
+		}
+		for _, p := range m.TpmResult.PcrMatch {
+			if p.Pcr == nil {
+				continue
+			}
+			// On mismatch, the description contains the measured value
+			value := p.Digest
+			if p.Description != "" {
+				value = p.Description
+			}
+			pcrs[fmt.Sprintf("PCR%v", *p.Pcr)] = value
+		}
+	}
+	return pcrs
+}
+
+// violations returns the measured artifacts without reference value, e.g.
+// IMA events of unknown binaries
+func violations(r *ar.VerificationResult) map[string]ar.DigestResult {
+	v := map[string]ar.DigestResult{}
+	for _, m := range r.Measurements {
+		for _, a := range m.Artifacts {
+			if a.Success || a.Type != "Measurement" {
+				continue
+			}
+			key := a.Name
+			if a.Pcr != nil {
+				key = fmt.Sprintf("PCR%v %v", *a.Pcr, a.Name)
+			}
+			v[fmt.Sprintf("%v (%v)", key, a.Digest)] = a
+		}
+	}
+	return v
+}
+
+// certExpiries returns the expiry of all validated certificates identified by
+// their subject and serial number
+func certExpiries(r *ar.VerificationResult) map[string]time.Time {
+	sigs := append([]ar.SignatureResult{}, r.ReportSignature...)
+	for _, m := range r.Measurements {
+		sigs = append(sigs, m.Signature)
+	}
+	sigs = append(sigs, r.RtmResult.SignatureCheck...)
+	sigs = append(sigs, r.OsResult.SignatureCheck...)
+	for _, a := range r.AppResults {
+		sigs = append(sigs, a.SignatureCheck...)
+	}
+	sigs = append(sigs, r.DevDescResult.SignatureCheck...)
+	if r.CompDescResult != nil {
+		sigs = append(sigs, r.CompDescResult.SignatureCheck...)
+	}
+
+	certs := map[string]time.Time{}
+	for _, s := range sigs {
+		for _, chain := range s.ValidatedCerts {
+			for _, cert := range chain {
+				notAfter, err := time.Parse(certNotAfterLayout, cert.Validity.NotAfter)
+				if err != nil {
+					log.Debugf("Failed to parse expiry of certificate %v: %v",
+						cert.Subject.CommonName, err)
+					continue
+				}
+				serial := ""
+				if cert.SerialNumber != nil {
+					serial = cert.SerialNumber.Text(16)
+				}
+				certs[fmt.Sprintf("%v (serial %v)", cert.Subject.CommonName, serial)] = notAfter
+			}
+		}
+	}
+	return certs
+}
+
+func earliestExpiry(r *ar.VerificationResult) (time.Time, bool) {
+	var earliest time.Time
+	for _, notAfter := range certExpiries(r) {
+		if earliest.IsZero() || notAfter.Before(earliest) {
+			earliest = notAfter
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+func successString(success bool) string {
+	if success {
+		return "succeeded"
+	}
+	return "failed"
+}
+
+func printWatchRound(w io.Writer, r *watchRound) error {
+	status := "OK"
+	switch {
+	case r.Result != nil && !r.Success:
+		status = "FAILED"
+	case r.err != nil:
+		status = "ERROR"
+	}
+	line := fmt.Sprintf("round %v %v %v %.0fms violations %v", r.Round,
+		r.Started.Format(time.RFC3339), status, r.DurationMs, r.Violations)
+	if r.CertExpiry != nil {
+		line += fmt.Sprintf(" cert expiry %v", r.CertExpiry.UTC().Format(time.RFC3339))
+	}
+	if len(r.Changes) > 0 {
+		line += fmt.Sprintf(" changes %v", len(r.Changes))
+	}
+	if r.Error != "" {
+		line += ": " + r.Error
+	}
+	if _, err := fmt.Fprintln(w, line); err != nil {
+		return err
+	}
+	for _, c := range r.Changes {
+		if _, err := fmt.Fprintf(w, "  ! %v: %v\n", c.Kind, c.Detail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+var watchNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func pcr(i int) *int {
+	return &i
+}
+
+func cert(cn string, serial int64, notAfter time.Time) ar.X509CertExtracted {
+	return ar.X509CertExtracted{
+		SerialNumber: big.NewInt(serial),
+		Subject:      ar.X509Name{CommonName: cn},
+		Validity: ar.Validity{
+			NotBefore: notAfter.Add(-365 * 24 * time.Hour).String(),
+			NotAfter:  notAfter.String(),
+		},
+	}
+}
+
+// tpmResult creates a synthetic verification result with the PCR values,
+// unknown measurements and the certificates of the report signature
+func tpmResult(success bool, pcrs map[int]string, unknown []ar.DigestResult,
+	certs ...ar.X509CertExtracted,
+) *ar.VerificationResult {
+	m := ar.MeasurementResult{
+		Type:      "TPM Result",
+		TpmResult: &ar.TpmResult{},
+		Artifacts: unknown,
+	}
+	for i := 0; i < 24; i++ {
+		if v, ok := pcrs[i]; ok {
+			m.TpmResult.PcrMatch = append(m.TpmResult.PcrMatch, ar.DigestResult{Pcr: pcr(i),
+				Digest: v, Success: true})
+		}
+	}
+	return &ar.VerificationResult{
+		Success:         success,
+		Measurements:    []ar.MeasurementResult{m},
+		ReportSignature: []ar.SignatureResult{{ValidatedCerts: [][]ar.X509CertExtracted{certs}}},
+	}
+}
+
+func Test_diffResults(t *testing.T) {
+	pcrs := map[int]string{0: "aa", 7: "bb", 10: "cc"}
+	ak := cert("AK", 1, watchNow.Add(90*24*time.Hour))
+	expiring := cert("AK", 2, watchNow.Add(10*24*time.Hour))
+	violation := ar.DigestResult{Type: "Measurement", Pcr: pcr(10), Name: "/usr/bin/evil",
+		Digest: "ff"}
+	known := ar.DigestResult{Pcr: pcr(10), Name: "/usr/bin/good", Digest: "ee", Success: true}
+
+	mismatch := tpmResult(false, pcrs, nil, ak)
+	mismatch.Measurements[0].TpmResult.PcrMatch[1].Description = "dd"
+	mismatch.Measurements[0].TpmResult.PcrMatch[1].Success = false
+
+	tests := []struct {
+		name string
+		prev *ar.VerificationResult
+		cur  *ar.VerificationResult
+		want []watchChange
+	}{
+		{"Unchanged", tpmResult(true, pcrs, nil, ak), tpmResult(true, pcrs, nil, ak), nil},
+		{"PCR Changed", tpmResult(true, pcrs, nil, ak),
+			tpmResult(true, map[int]string{0: "aa", 7: "bb", 10: "c1"}, nil, ak),
+			[]watchChange{{changePcr, "PCR10 changed from cc to c1"}}},
+		{"PCR Mismatch", tpmResult(true, pcrs, nil, ak), mismatch, []watchChange{
+			{changeVerification, "verification failed"},
+			{changePcr, "PCR7 changed from bb to dd"},
+		}},
+		{"PCR Appeared And Disappeared", tpmResult(true, map[int]string{0: "aa", 7: "bb"}, nil, ak),
+			tpmResult(true, map[int]string{0: "aa", 10: "cc"}, nil, ak),
+			[]watchChange{
+				{changePcr, "PCR10 appeared: cc"},
+				{changePcr, "PCR7 disappeared"},
+			}},
+		{"New Violation", tpmResult(true, pcrs, []ar.DigestResult{known}, ak),
+			tpmResult(false, pcrs, []ar.DigestResult{known, violation}, ak),
+			[]watchChange{
+				{changeVerification, "verification failed"},
+				{changeViolation, "new unknown measurement PCR10 /usr/bin/evil (ff)"},
+			}},
+		{"Known Violation", tpmResult(false, pcrs, []ar.DigestResult{violation}, ak),
+			tpmResult(false, pcrs, []ar.DigestResult{violation}, ak), nil},
+		{"Violation Resolved", tpmResult(false, pcrs, []ar.DigestResult{violation}, ak),
+			tpmResult(true, pcrs, nil, ak),
+			[]watchChange{{changeVerification, "verification succeeded"}}},
+		{"Certificate Renewed Expiring", tpmResult(true, pcrs, nil, ak),
+			tpmResult(true, pcrs, nil, expiring),
+			[]watchChange{{changeCertExpiry,
+				"certificate AK (serial 2) expires in 240h0m0s (2026-01-11T00:00:00Z)"}}},
+		{"Certificate Already Expiring", tpmResult(true, pcrs, nil, expiring),
+			tpmResult(true, pcrs, nil, expiring), nil},
+		{"SW Certification Level", &ar.VerificationResult{Success: true, SwCertLevel: 2},
+			&ar.VerificationResult{Success: true, SwCertLevel: 1},
+			[]watchChange{{changeSwCertLevel, "software certification level changed from 2 to 1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffResults(tt.prev, tt.cur, watchNow, watchNow, 30*24*time.Hour)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffResults() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_diffResultsCrossingThreshold(t *testing.T) {
+	ak := cert("AK", 1, watchNow.Add(31*24*time.Hour))
+	r := tpmResult(true, nil, nil, ak)
+
+	// The certificate is reported once when it crosses the threshold
+	if got := diffResults(r, r, watchNow, watchNow, 30*24*time.Hour); len(got) != 0 {
+		t.Errorf("diffResults() = %v, want no changes", got)
+	}
+	later := watchNow.Add(2 * 24 * time.Hour)
+	got := diffResults(r, r, watchNow, later, 30*24*time.Hour)
+	if len(got) != 1 || got[0].Kind != changeCertExpiry {
+		t.Errorf("diffResults() = %v, want expiry change", got)
+	}
+}
+
+// watchClient returns the configured verification results in order
+type watchClient struct {
+	results []*ar.VerificationResult
+	errs    []error
+	n       int
+}
+
+func (c *watchClient) attest(nonce []byte) ([]byte, error) {
+	return append([]byte("report-"), nonce...), nil
+}
+
+func (c *watchClient) verify(report, nonce []byte) (*ar.VerificationResult, error) {
+	i := c.n
+	c.n++
+	if c.errs[i] != nil {
+		return nil, c.errs[i]
+	}
+	return c.results[i], nil
+}
+
+func (c *watchClient) close() {}
+
+func TestWatch(t *testing.T) {
+	pcrs := map[int]string{0: "aa", 10: "cc"}
+	ok := tpmResult(true, pcrs, nil)
+	changed := tpmResult(true, map[int]string{0: "aa", 10: "c1"}, nil)
+	failed := tpmResult(false, pcrs, nil)
+	unreachable := unreachableErrorf("cmcd not reachable")
+
+	tests := []struct {
+		name      string
+		results   []*ar.VerificationResult
+		errs      []error
+		keepGoing bool
+		wantLines int
+		wantCode  int
+	}{
+		{"Success", []*ar.VerificationResult{ok, changed, changed}, []error{nil, nil, nil}, false,
+			3, exitSuccess},
+		{"Stop On Failure", []*ar.VerificationResult{ok, failed, ok}, []error{nil, nil, nil}, false,
+			2, exitVerifyFailed},
+		{"Keep Going", []*ar.VerificationResult{ok, nil, failed}, []error{nil, unreachable, nil}, true,
+			3, exitCmcUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status, out bytes.Buffer
+			var waits []time.Duration
+			w := &watcher{
+				client:    &watchClient{results: tt.results, errs: tt.errs},
+				interval:  time.Minute,
+				rounds:    3,
+				keepGoing: tt.keepGoing,
+				threshold: time.Hour,
+				w:         &status,
+				out:       &out,
+				now:       func() time.Time { return watchNow },
+				sleep:     func(d time.Duration) { waits = append(waits, d) },
+			}
+			err := w.run()
+			if code := exitCode(err); code != tt.wantCode {
+				t.Fatalf("run() = %v (exit code %v), want exit code %v", err, code, tt.wantCode)
+			}
+			if len(waits) != tt.wantLines-1 {
+				t.Errorf("waits = %v, want %v", waits, tt.wantLines-1)
+			}
+
+			var rounds []watchRound
+			scanner := bufio.NewScanner(&out)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				var r watchRound
+				if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					t.Fatalf("failed to unmarshal round: %v", err)
+				}
+				rounds = append(rounds, r)
+			}
+			if len(rounds) != tt.wantLines {
+				t.Fatalf("JSONL contains %v rounds, want %v", len(rounds), tt.wantLines)
+			}
+			if !strings.HasPrefix(status.String(), "round 1 2026-01-01T00:00:00Z OK") {
+				t.Errorf("status = %v", status.String())
+			}
+			for i, r := range rounds {
+				if r.Round != i+1 || r.ReportId == "" && tt.errs[i] == nil {
+					t.Errorf("round %v = %+v", i+1, r)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	var status bytes.Buffer
+	w := &watcher{
+		client: &watchClient{
+			results: []*ar.VerificationResult{
+				tpmResult(true, map[int]string{10: "cc"}, nil),
+				nil,
+				tpmResult(true, map[int]string{10: "c1"}, nil),
+			},
+			errs: []error{nil, errors.New("timeout"), nil},
+		},
+		interval:  time.Minute,
+		rounds:    3,
+		keepGoing: true,
+		w:         &status,
+		now:       func() time.Time { return watchNow },
+		sleep:     func(time.Duration) {},
+	}
+	if err := w.run(); err == nil {
+		t.Fatalf("run() succeeded, want error of failed round")
+	}
+	// Changes are computed against the last verified round
+	want := "round 3 2026-01-01T00:00:00Z OK 0ms violations 0 changes 1\n" +
+		"  ! pcr: PCR10 changed from cc to c1\n"
+	if !strings.HasSuffix(status.String(), want) {
+		t.Errorf("status = %v, want suffix %v", status.String(), want)
+	}
+	if !strings.Contains(status.String(), "round 2 2026-01-01T00:00:00Z ERROR") {
+		t.Errorf("status = %v, want failed round 2", status.String())
+	}
+}
@@ -17,27 +17,75 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	log "github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/pkcs11driver"
 )
 
 func main() {
-	log.SetLevel(log.TraceLevel)
+	internal.SetLogLevel(log.TraceLevel)
 
 	inputFile := flag.String("in", "", "Path to metadata as JSON or CBOR to be signed")
 	outputFile := flag.String("out", "", "Path to the output file to save signed metadata")
 	outForm := flag.String("outform", "", "Output format (JSON or CBOR)")
+	// Flags for converting and re-signing a folder of signed metadata
+	inDir := flag.String("indir", "", "Path to a folder with signed metadata to be verified, converted and re-signed")
+	outDir := flag.String("outdir", "", "Path to the output folder for the re-signed metadata")
+	caFile := flag.String("ca", "", "Path to the trusted CA certificate(s) in PEM format to verify the signed metadata")
+	keyFile := flag.String("key", "", "Path to the private key in PEM format for re-signing")
+	certFiles := flag.String("certs", "", "Paths to the PEM encoded certificate chain of the key, comma-separated, starting with the leaf certificate")
+	pkcs11Module := flag.String("pkcs11module", "", "Path to the PKCS#11 module for re-signing with a key on a PKCS#11 token")
+	pkcs11Token := flag.String("pkcs11token", "", "Label of the PKCS#11 token")
+	pkcs11Slot := flag.String("pkcs11slot", "", "Slot of the PKCS#11 token, if the token label is not unique")
+	pkcs11KeyLabel := flag.String("pkcs11keylabel", "", "Label of the key on the PKCS#11 token")
+	pkcs11KeyId := flag.String("pkcs11keyid", "", "Hex encoded ID of the key on the PKCS#11 token")
+	pkcs11Pin := flag.String("pkcs11pin", "", "Source of the PKCS#11 PIN: env:<VARIABLE>, file:<PATH> or prompt")
+	bumpVersion := flag.Bool("bumpversion", false, "Set the version of the re-signed metadata to the current time")
+	dryRun := flag.Bool("dryrun", false, "Only report what would be converted without writing any files")
 	flag.Parse()
 
+	if *inDir != "" {
+		c := &resignConfig{
+			InDir:       *inDir,
+			OutDir:      *outDir,
+			OutForm:     *outForm,
+			BumpVersion: *bumpVersion,
+			DryRun:      *dryRun,
+			now:         time.Now,
+		}
+		err := c.load(*caFile, *keyFile, *certFiles, pkcs11driver.SignerConfig{
+			Module:   *pkcs11Module,
+			Token:    *pkcs11Token,
+			Slot:     *pkcs11Slot,
+			KeyLabel: *pkcs11KeyLabel,
+			KeyId:    *pkcs11KeyId,
+			Pin:      *pkcs11Pin,
+		})
+		if err != nil {
+			log.Error(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		_, err = resignDir(c)
+		c.close()
+		if err != nil {
+			log.Fatalf("Failed to convert %v: %v", *inDir, err)
+		}
+		return
+	}
+
 	if *inputFile == "" {
 		log.Error("input file file not specified")
 		flag.Usage()
@@ -75,30 +123,50 @@ func main() {
 
 func convert(data []byte, outform string) ([]byte, error) {
 	// Initialize serializers: detect input format
-	var si ar.Serializer
+	si, err := detectSerializer(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize serializers: use specified output format
+	so, err := getSerializer(outform)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _, err := convertMetadata(data, si, so, "")
+	return raw, err
+}
+
+func detectSerializer(data []byte) (ar.Serializer, error) {
 	if json.Valid(data) {
-		si = ar.JsonSerializer{}
+		return ar.JsonSerializer{}, nil
 	} else if err := cbor.Valid(data); err == nil {
-		si = ar.CborSerializer{}
-	} else {
-		return nil, errors.New("failed to detect serialization (only JSON and CBOR are supported)")
+		return ar.CborSerializer{}, nil
 	}
+	return nil, errors.New("failed to detect serialization (only JSON and CBOR are supported)")
+}
 
-	// Initialize serializers: use specified output format
-	var so ar.Serializer
+func getSerializer(outform string) (ar.Serializer, error) {
 	if strings.EqualFold(outform, "json") {
-		so = ar.JsonSerializer{}
+		return ar.JsonSerializer{}, nil
 	} else if strings.EqualFold(outform, "cbor") {
-		so = ar.CborSerializer{}
-	} else {
-		return nil, fmt.Errorf("output format %v not supported (only JSON and CBOR are supported)",
-			outform)
+		return ar.CborSerializer{}, nil
 	}
+	return nil, fmt.Errorf("output format %v not supported (only JSON and CBOR are supported)",
+		outform)
+}
+
+// convertMetadata converts the metadata item into the output serialization
+// and returns the converted item and its original meta information. If the
+// version is not empty, the version of the item is set to it
+func convertMetadata(data []byte, si ar.Serializer, so ar.Serializer, version string,
+) ([]byte, *ar.MetaInfo, error) {
 
 	info := new(ar.MetaInfo)
 	err := si.Unmarshal(data, info)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+		return nil, nil, fmt.Errorf("failed to unmarshal: %w", err)
 	}
 
 	var raw []byte
@@ -106,65 +174,66 @@ func convert(data []byte, outform string) ([]byte, error) {
 	case "App Manifest":
 		log.Debug("Found App Manifest")
 		var m ar.AppManifest
-		raw, err = convertInternal(data, &m, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
+		raw, err = convertInternal(data, &m, &m.MetaInfo, si, so, version)
 	case "OS Manifest":
 		log.Debug("Found OS Manifest")
 		var m ar.OsManifest
-		raw, err = convertInternal(data, &m, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
-
+		raw, err = convertInternal(data, &m, &m.MetaInfo, si, so, version)
 	case "RTM Manifest":
 		log.Debug("Found RTM Manifest")
 		var m ar.RtmManifest
-		raw, err = convertInternal(data, &m, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
-
+		raw, err = convertInternal(data, &m, &m.MetaInfo, si, so, version)
 	case "Device Description":
 		log.Debug("Found Device Description")
 		var d ar.DeviceDescription
-		raw, err = convertInternal(data, &d, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
-
+		raw, err = convertInternal(data, &d, &d.MetaInfo, si, so, version)
 	case "Company Description":
 		log.Debug("Found Company Description")
 		var d ar.CompanyDescription
-		raw, err = convertInternal(data, &d, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
-
+		raw, err = convertInternal(data, &d, &d.MetaInfo, si, so, version)
 	case "Device Config":
 		log.Debug("Found Device Config")
 		var d ar.DeviceConfig
-		raw, err = convertInternal(data, &d, si, so)
-		if err != nil {
-			return nil, fmt.Errorf("failed to convert: %w", err)
-		}
-
+		raw, err = convertInternal(data, &d, &d.MetaInfo, si, so, version)
 	default:
-		return nil, fmt.Errorf("type %v not supported", info.Type)
+		return nil, nil, fmt.Errorf("type %v not supported", info.Type)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert: %w", err)
 	}
 
-	return raw, nil
+	return raw, info, nil
 }
 
-func convertInternal(data []byte, v any, si ar.Serializer, so ar.Serializer) ([]byte, error) {
-	err := si.Unmarshal(data, v)
+// convertInternal unmarshals the data into the typed structure and marshals it
+// with the output serializer. Unknown fields are rejected, as they would be
+// lost during the conversion
+func convertInternal(data []byte, v any, info *ar.MetaInfo, si ar.Serializer, so ar.Serializer,
+	version string,
+) ([]byte, error) {
+	err := unmarshalStrict(data, v, si)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal: %v", err)
 	}
+	if version != "" {
+		info.Version = version
+	}
 	raw, err := so.Marshal(v)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal: %v", err)
 	}
 	return raw, nil
 }
+
+func unmarshalStrict(data []byte, v any, s ar.Serializer) error {
+	if _, ok := s.(ar.JsonSerializer); ok {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	}
+	dm, err := cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode()
+	if err != nil {
+		return err
+	}
+	return dm.Unmarshal(data, v)
+}
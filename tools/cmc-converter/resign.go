@@ -0,0 +1,326 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/cmc/pkcs11driver"
+)
+
+// resignConfig configures the conversion of a folder of signed metadata. The
+// signer is not required for a dry run
+type resignConfig struct {
+	InDir       string
+	OutDir      string
+	OutForm     string
+	Cas         []*x509.Certificate
+	Signer      ar.Driver
+	BumpVersion bool
+	DryRun      bool
+	now         func() time.Time
+}
+
+// conversion is the outcome of the conversion of a single metadata item
+type conversion struct {
+	File       string
+	Out        string
+	Type       string
+	Name       string
+	Version    string
+	NewVersion string
+	Err        error
+}
+
+// keySigner provides the key and certificate chain for re-signing to the
+// serializers
+type keySigner struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+func (s *keySigner) Init(c *ar.DriverConfig) error {
+	return nil
+}
+
+func (s *keySigner) Measure(nonce []byte) (ar.Measurement, error) {
+	return ar.Measurement{}, errors.New("measurements not supported")
+}
+
+func (s *keySigner) Lock() error {
+	return nil
+}
+
+func (s *keySigner) Unlock() error {
+	return nil
+}
+
+func (s *keySigner) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return s.key, s.key.Public(), nil
+}
+
+func (s *keySigner) GetCertChain() ([]*x509.Certificate, error) {
+	return s.chain, nil
+}
+
+// load loads the CAs for verifying the signed metadata and the key for
+// re-signing, either from the key file or from the PKCS#11 token
+func (c *resignConfig) load(caFile, keyFile, certFiles string, p pkcs11driver.SignerConfig) error {
+
+	if c.OutForm == "" {
+		return errors.New("output format not specified")
+	}
+	if c.OutDir == "" && !c.DryRun {
+		return errors.New("output folder not specified")
+	}
+	if caFile == "" {
+		return errors.New("CA certificate file for verifying the metadata not specified")
+	}
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %w", err)
+	}
+	c.Cas, err = internal.ParseCertsPem(caPem)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA file: %w", err)
+	}
+
+	if keyFile == "" && p.Module == "" {
+		if c.DryRun {
+			return nil
+		}
+		return errors.New("neither key file nor PKCS#11 module specified")
+	}
+
+	var key crypto.Signer
+	var chain []*x509.Certificate
+	if p.Module != "" {
+		signer, err := pkcs11driver.OpenSigner(p)
+		if err != nil {
+			return err
+		}
+		key = signer
+		if certFiles == "" {
+			log.Debug("Reading certificate from PKCS#11 token")
+			cert, err := signer.Certificate()
+			if err != nil {
+				return err
+			}
+			chain = []*x509.Certificate{cert}
+		}
+	} else {
+		key, err = loadKey(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if chain == nil {
+		if certFiles == "" {
+			return errors.New("certificate chain of the key not specified")
+		}
+		for _, f := range strings.Split(certFiles, ",") {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("failed to read certificate file: %w", err)
+			}
+			cert, err := internal.ParseCert(data)
+			if err != nil {
+				return fmt.Errorf("failed to parse certificate %v: %w", f, err)
+			}
+			chain = append(chain, cert)
+		}
+	}
+
+	pub, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key.Public()) {
+		return fmt.Errorf("key does not match certificate %v", chain[0].Subject.CommonName)
+	}
+	c.Signer = &keySigner{key: key, chain: chain}
+
+	return nil
+}
+
+// close closes the PKCS#11 token, if used
+func (c *resignConfig) close() {
+	if s, ok := c.Signer.(*keySigner); ok {
+		if p, ok := s.key.(*pkcs11driver.Signer); ok {
+			p.Close()
+		}
+	}
+}
+
+func loadKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+	var key any
+	key, err = x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key of type %T cannot be used for signing", key)
+	}
+	return signer, nil
+}
+
+// resignDir verifies, converts and re-signs all metadata items in the input
+// folder. Items whose signatures cannot be verified with the CAs are not
+// converted. In a dry run, the conversions are only reported
+func resignDir(c *resignConfig) ([]conversion, error) {
+
+	so, err := getSerializer(c.OutForm)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(c.InDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata folder: %w", err)
+	}
+	if !c.DryRun {
+		if err := os.MkdirAll(c.OutDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output folder: %w", err)
+		}
+	}
+
+	conversions := make([]conversion, 0, len(entries))
+	failed := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		conv := conversion{
+			File: filepath.Join(c.InDir, e.Name()),
+			Out:  filepath.Join(c.OutDir, outName(e.Name(), c.OutForm)),
+		}
+
+		data, err := os.ReadFile(conv.File)
+		if err == nil {
+			var signed []byte
+			signed, err = resign(data, c, so, &conv)
+			if err == nil && !c.DryRun {
+				err = os.WriteFile(conv.Out, signed, 0644)
+			}
+		}
+		conv.Err = err
+
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("refused %v: %v\n", conv.File, err)
+		case c.DryRun:
+			fmt.Printf("would convert %v (%v %v, version %v -> %v) to %v\n", conv.File, conv.Type,
+				conv.Name, conv.Version, conv.NewVersion, conv.Out)
+		default:
+			fmt.Printf("converted %v (%v %v, version %v -> %v) to %v\n", conv.File, conv.Type,
+				conv.Name, conv.Version, conv.NewVersion, conv.Out)
+		}
+		conversions = append(conversions, conv)
+	}
+
+	if failed > 0 {
+		return conversions, fmt.Errorf("%v of %v metadata items could not be converted", failed,
+			len(conversions))
+	}
+	return conversions, nil
+}
+
+// resign verifies the signed metadata item, converts the payload and signs it
+// with the output serializer
+func resign(data []byte, c *resignConfig, so ar.Serializer, conv *conversion) ([]byte, error) {
+
+	si, err := detectSerializer(data)
+	if err != nil {
+		return nil, err
+	}
+	_, payload, ok := si.VerifyToken(data, c.Cas)
+	if !ok {
+		return nil, errors.New("failed to verify signature")
+	}
+
+	var info ar.MetaInfo
+	if err := si.Unmarshal(payload, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	version := ""
+	if c.BumpVersion {
+		version = bumpVersion(info.Version, c.now())
+	}
+
+	raw, _, err := convertMetadata(payload, si, so, version)
+	if err != nil {
+		return nil, err
+	}
+	conv.Type = info.Type
+	conv.Name = info.Name
+	conv.Version = info.Version
+	conv.NewVersion = info.Version
+	if version != "" {
+		conv.NewVersion = version
+	}
+
+	if c.DryRun {
+		return nil, nil
+	}
+	signed, err := so.Sign(raw, c.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return signed, nil
+}
+
+// bumpVersion returns the current time as version, which is always newer than
+// the old version, so that the converted items supersede the original items
+func bumpVersion(old string, now time.Time) string {
+	v := now.UTC().Truncate(time.Second)
+	if t, err := time.Parse(time.RFC3339, old); err == nil && !v.After(t) {
+		v = t.Add(time.Second)
+	}
+	return v.UTC().Format(time.RFC3339)
+}
+
+// outName replaces a .json or .cbor extension of the file with the extension
+// of the output format
+func outName(name, outform string) string {
+	ext := filepath.Ext(name)
+	if strings.EqualFold(ext, ".json") || strings.EqualFold(ext, ".cbor") {
+		return strings.TrimSuffix(name, ext) + "." + strings.ToLower(outform)
+	}
+	return name
+}
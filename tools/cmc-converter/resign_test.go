@@ -0,0 +1,290 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func createSigner(t *testing.T, name string) (*keySigner, *x509.Certificate) {
+	t.Helper()
+	caPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caPriv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return &keySigner{key: priv, chain: []*x509.Certificate{leaf, ca}}, ca
+}
+
+func testMetadata() map[string]any {
+	pcr := 7
+	return map[string]any{
+		"rtm.json": &ar.RtmManifest{
+			MetaInfo:      ar.MetaInfo{Type: "RTM Manifest", Name: "de.test.rtm", Version: "2023-04-10T20:00:00Z"},
+			DevCommonName: "Test Developer",
+			Validity:      ar.Validity{NotBefore: "2023-04-10T20:00:00Z", NotAfter: "2030-04-10T20:00:00Z"},
+			ReferenceValues: []ar.ReferenceValue{
+				{Type: "TPM Reference Value", Name: "kernel", Pcr: &pcr,
+					Sha256: []byte{0x01, 0x02, 0x03}, Sha1: []byte{0x04}},
+				{Type: "SNP Reference Value", Name: "snp", Sha384: []byte{0x05, 0x06}, Optional: true,
+					Snp: &ar.SnpDetails{Version: 2, CaFingerprint: "00ff"}},
+			},
+			CertificationLevel: 1,
+		},
+		"os.json": &ar.OsManifest{
+			MetaInfo:      ar.MetaInfo{Type: "OS Manifest", Name: "de.test.os", Version: "2023-04-10T20:00:00Z"},
+			DevCommonName: "Test Developer",
+			Validity:      ar.Validity{NotBefore: "2023-04-10T20:00:00Z", NotAfter: "2030-04-10T20:00:00Z"},
+			Rtms:          []string{"de.test.rtm"},
+		},
+		"device": &ar.DeviceDescription{
+			MetaInfo:    ar.MetaInfo{Type: "Device Description", Name: "test-device", Version: "2023-04-10T20:00:00Z"},
+			Location:    "Munich, Germany",
+			RtmManifest: "de.test.rtm",
+			OsManifest:  "de.test.os",
+		},
+	}
+}
+
+// writeSigned writes the signed metadata items into the folder
+func writeSigned(t *testing.T, dir string, items map[string]any, s ar.Serializer,
+	signer *keySigner,
+) {
+	t.Helper()
+	for name, item := range items {
+		data, err := s.Marshal(item)
+		if err != nil {
+			t.Fatalf("failed to marshal %v: %v", name, err)
+		}
+		signed, err := s.Sign(data, signer)
+		if err != nil {
+			t.Fatalf("failed to sign %v: %v", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), signed, 0644); err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+	}
+}
+
+// readSigned verifies the signed item and unmarshals it into a new value of
+// the type of want
+func readSigned(t *testing.T, file string, want any, ca *x509.Certificate) any {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read converted item: %v", err)
+	}
+	s, err := detectSerializer(data)
+	if err != nil {
+		t.Fatalf("failed to detect serializer of %v: %v", file, err)
+	}
+	_, payload, ok := s.VerifyToken(data, []*x509.Certificate{ca})
+	if !ok {
+		t.Fatalf("failed to verify converted item %v", file)
+	}
+	got := reflect.New(reflect.TypeOf(want).Elem()).Interface()
+	if err := s.Unmarshal(payload, got); err != nil {
+		t.Fatalf("failed to unmarshal converted item %v: %v", file, err)
+	}
+	return got
+}
+
+func TestResignRoundTrip(t *testing.T) {
+
+	oldSigner, oldCa := createSigner(t, "Old Signer")
+	newSigner, newCa := createSigner(t, "New Signer")
+	items := testMetadata()
+
+	in := t.TempDir()
+	writeSigned(t, in, items, ar.JsonSerializer{}, oldSigner)
+
+	// Convert JSON to CBOR and back to JSON, the items must be equal to the
+	// original items after each conversion
+	cborDir := filepath.Join(t.TempDir(), "cbor")
+	convs, err := resignDir(&resignConfig{InDir: in, OutDir: cborDir, OutForm: "cbor",
+		Cas: []*x509.Certificate{oldCa}, Signer: newSigner, now: time.Now})
+	if err != nil {
+		t.Fatalf("resignDir() to CBOR error = %v", err)
+	}
+	if len(convs) != len(items) {
+		t.Fatalf("%v conversions, want %v", len(convs), len(items))
+	}
+	jsonDir := filepath.Join(t.TempDir(), "json")
+	_, err = resignDir(&resignConfig{InDir: cborDir, OutDir: jsonDir, OutForm: "json",
+		Cas: []*x509.Certificate{newCa}, Signer: newSigner, now: time.Now})
+	if err != nil {
+		t.Fatalf("resignDir() to JSON error = %v", err)
+	}
+
+	for name, want := range items {
+		got := readSigned(t, filepath.Join(cborDir, outName(name, "cbor")), want, newCa)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("CBOR %v = %+v, want %+v", name, got, want)
+		}
+		got = readSigned(t, filepath.Join(jsonDir, outName(name, "json")), want, newCa)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("JSON %v = %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestResignDir(t *testing.T) {
+
+	signer, ca := createSigner(t, "Signer")
+	untrusted, _ := createSigner(t, "Untrusted")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		dryRun      bool
+		bump        bool
+		untrusted   bool
+		unknown     bool
+		wantVersion string
+		wantErr     bool
+	}{
+		{"Preserve Version", false, false, false, false, "2023-04-10T20:00:00Z", false},
+		{"Bump Version", false, true, false, false, "2025-01-01T00:00:00Z", false},
+		{"Dry Run", true, true, false, false, "2025-01-01T00:00:00Z", false},
+		{"Untrusted Signature", false, false, true, false, "2023-04-10T20:00:00Z", true},
+		{"Unknown Field", false, false, false, true, "2023-04-10T20:00:00Z", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := t.TempDir()
+			out := filepath.Join(t.TempDir(), "out")
+			writeSigned(t, in, testMetadata(), ar.JsonSerializer{}, signer)
+			if tt.untrusted {
+				writeSigned(t, in, map[string]any{"bad.json": &ar.AppManifest{
+					MetaInfo: ar.MetaInfo{Type: "App Manifest", Name: "bad"}}},
+					ar.JsonSerializer{}, untrusted)
+			}
+			if tt.unknown {
+				data := []byte(`{"type":"App Manifest","name":"app","version":"2023-04-10T20:00:00Z","unknown":1}`)
+				signed, err := ar.JsonSerializer{}.Sign(data, signer)
+				if err != nil {
+					t.Fatalf("failed to sign: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(in, "unknown.json"), signed, 0644); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+			}
+
+			c := &resignConfig{InDir: in, OutDir: out, OutForm: "cbor", Cas: []*x509.Certificate{ca},
+				Signer: signer, BumpVersion: tt.bump, DryRun: tt.dryRun,
+				now: func() time.Time { return now }}
+			if tt.dryRun {
+				c.Signer = nil
+			}
+			convs, err := resignDir(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resignDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, conv := range convs {
+				_, statErr := os.Stat(conv.Out)
+				switch {
+				case conv.Err != nil:
+					if filepath.Base(conv.File) != "bad.json" && filepath.Base(conv.File) != "unknown.json" {
+						t.Errorf("conversion of %v failed: %v", conv.File, conv.Err)
+					}
+					if statErr == nil {
+						t.Errorf("refused item %v was written", conv.File)
+					}
+				case tt.dryRun:
+					if statErr == nil {
+						t.Errorf("dry run wrote %v", conv.Out)
+					}
+				default:
+					if statErr != nil {
+						t.Errorf("converted item %v not written: %v", conv.Out, statErr)
+					}
+				}
+				if conv.Err == nil && conv.NewVersion != tt.wantVersion {
+					t.Errorf("version of %v = %v, want %v", conv.File, conv.NewVersion, tt.wantVersion)
+				}
+			}
+			if tt.dryRun {
+				if _, err := os.Stat(out); err == nil {
+					t.Errorf("dry run created output folder")
+				}
+				return
+			}
+
+			got := readSigned(t, filepath.Join(out, "os.cbor"), &ar.OsManifest{}, ca).(*ar.OsManifest)
+			if got.Version != tt.wantVersion {
+				t.Errorf("written version = %v, want %v", got.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func Test_bumpVersion(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name string
+		old  string
+		want string
+	}{
+		{"Older", "2023-04-10T20:00:00Z", "2025-01-01T00:00:00Z"},
+		{"Newer", "2026-04-10T20:00:00Z", "2026-04-10T20:00:01Z"},
+		{"Invalid", "v1", "2025-01-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bumpVersion(tt.old, now); got != tt.want {
+				t.Errorf("bumpVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Exit codes of cmcctl
+const (
+	exitOk         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+	exitPermission = 4
+)
+
+var (
+	errNotRunning = errors.New("cmcd not running")
+	errPermission = errors.New("permission denied on socket")
+	errUsage      = errors.New("usage error")
+)
+
+type config struct {
+	addr    string
+	network string
+	format  string
+	out     io.Writer
+}
+
+// daemonConfig contains the cmcd configuration values relevant for cmcctl
+type daemonConfig struct {
+	Addr    string `json:"addr"`
+	Api     string `json:"api"`
+	Network string `json:"network"`
+}
+
+const usage = `Usage: cmcctl [flags] <command>
+
+Commands:
+  status                  Show the driver, enrollment and metadata status
+  metadata list           List the loaded metadata items
+  metadata show <digest>  Print the signed metadata item with the digest
+  cache list              Show the usage and counters of the in-memory caches
+  cache flush <name|all>  Remove all entries of the cache or of all caches
+
+Flags:
+`
+
+// cmcctl queries the status of a running cmcd via its socket API
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
+
+func run(args []string, out io.Writer) int {
+	err := runCmd(args, out)
+	if err == nil {
+		return exitOk
+	}
+	log.Error(err)
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errNotRunning):
+		return exitNotRunning
+	case errors.Is(err, errPermission):
+		return exitPermission
+	default:
+		return exitError
+	}
+}
+
+func runCmd(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("cmcctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "cmcd configuration file to read the socket address from")
+	addr := fs.String("addr", "", "cmcd socket address (supersedes the configuration file)")
+	network := fs.String("network", "", "cmcd socket network [unix tcp vsock] (default unix)")
+	format := fs.String("format", "table", "Output format [table json]")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	c := &config{
+		network: "unix",
+		format:  *format,
+		out:     out,
+	}
+	if *configFile != "" {
+		dc, err := readDaemonConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		c.addr = dc.Addr
+		if dc.Network != "" {
+			c.network = dc.Network
+		}
+	}
+	if *addr != "" {
+		c.addr = *addr
+	}
+	if *network != "" {
+		c.network = *network
+	}
+	if c.addr == "" {
+		return fmt.Errorf("%w: neither socket address nor cmcd configuration specified", errUsage)
+	}
+	if c.format != "table" && c.format != "json" {
+		return fmt.Errorf("%w: unknown output format %v", errUsage, c.format)
+	}
+
+	cmd := fs.Args()
+	switch {
+	case len(cmd) == 1 && cmd[0] == "status":
+		return status(c)
+	case len(cmd) == 2 && cmd[0] == "metadata" && cmd[1] == "list":
+		return metadataList(c)
+	case len(cmd) == 3 && cmd[0] == "metadata" && cmd[1] == "show":
+		return metadataShow(c, cmd[2])
+	case len(cmd) == 2 && cmd[0] == "cache" && cmd[1] == "list":
+		return caches(c, "")
+	case len(cmd) == 3 && cmd[0] == "cache" && cmd[1] == "flush":
+		return caches(c, cmd[2])
+	case len(cmd) == 0:
+		return fmt.Errorf("%w: no command specified", errUsage)
+	default:
+		return fmt.Errorf("%w: unknown command %v", errUsage, strings.Join(cmd, " "))
+	}
+}
+
+func readDaemonConfig(file string) (*daemonConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cmcd config: %w", err)
+	}
+	dc := new(daemonConfig)
+	if err := json.Unmarshal(data, dc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cmcd config: %w", err)
+	}
+	if !strings.EqualFold(dc.Api, "socket") {
+		return nil, fmt.Errorf("%w: cmcd is configured for the %v API, cmcctl requires the socket API",
+			errUsage, dc.Api)
+	}
+	return dc, nil
+}
+
+func status(c *config) error {
+	resp := new(api.StatusResponse)
+	err := request(c, api.TypeStatus, &api.StatusRequest{Id: "cmcctl"}, resp)
+	if err != nil {
+		return err
+	}
+	if c.format == "json" {
+		return printJson(c.out, resp)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DRIVER\tSIGNER\tHEALTHY\tCERTIFICATES\tMEASUREMENTS")
+	for _, d := range resp.Drivers {
+		health := yesNo(d.Healthy)
+		if d.HealthError != "" {
+			health += " (" + d.HealthError + ")"
+		}
+		certs := make([]string, 0, len(d.Certificates))
+		for _, cert := range d.Certificates {
+			certs = append(certs, fmt.Sprintf("%v until %v", cert.Name,
+				cert.NotAfter.Format(time.RFC3339)))
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", d.Name, yesNo(d.Signer), health,
+			listOrNone(certs), listOrNone(d.MeasurementTypes))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out)
+	if resp.Enrollment != nil {
+		fmt.Fprintf(c.out, "Enrollment:     %v", resp.Enrollment.State)
+		if resp.Enrollment.LastError != "" {
+			fmt.Fprintf(c.out, " (%v failed attempts, last error: %v)", resp.Enrollment.Attempts,
+				resp.Enrollment.LastError)
+		}
+		fmt.Fprintln(c.out)
+	}
+	if resp.ConfigDigest != "" {
+		fmt.Fprintf(c.out, "Config digest:  %v\n", resp.ConfigDigest)
+	}
+	fmt.Fprintf(c.out, "Metadata items: %v\n", len(resp.Metadata))
+
+	return nil
+}
+
+func metadataList(c *config) error {
+	resp := new(api.MetadataResponse)
+	err := request(c, api.TypeMetadata, &api.MetadataRequest{Id: "cmcctl"}, resp)
+	if err != nil {
+		return err
+	}
+	if c.format == "json" {
+		return printJson(c.out, resp.Metadata)
+	}
+	return printMetadata(c.out, resp.Metadata)
+}
+
+func metadataShow(c *config, digest string) error {
+	resp := new(api.MetadataResponse)
+	err := request(c, api.TypeMetadata, &api.MetadataRequest{Id: "cmcctl", Digest: digest}, resp)
+	if err != nil {
+		return err
+	}
+	if c.format == "json" {
+		return printJson(c.out, resp)
+	}
+
+	// The signed item is printed as is, JSON metadata is indented
+	if json.Valid(resp.Item) {
+		var v interface{}
+		if err := json.Unmarshal(resp.Item, &v); err == nil {
+			return printJson(c.out, v)
+		}
+	}
+	_, err = c.out.Write(resp.Item)
+	return err
+}
+
+// caches prints the cache statistics after flushing the specified cache, if any
+func caches(c *config, flush string) error {
+	resp := new(api.CacheResponse)
+	err := request(c, api.TypeCache, &api.CacheRequest{Id: "cmcctl", Flush: flush}, resp)
+	if err != nil {
+		return err
+	}
+	if c.format == "json" {
+		return printJson(c.out, resp.Caches)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CACHE\tENTRIES\tBYTES\tTTL\tHITS\tMISSES\tEVICTIONS")
+	for _, s := range resp.Caches {
+		ttl := s.Ttl
+		if ttl == "" {
+			ttl = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Name,
+			limit(int64(s.Entries), int64(s.MaxEntries)), limit(s.Bytes, s.MaxBytes),
+			ttl, s.Hits, s.Misses, s.Evictions)
+	}
+	return w.Flush()
+}
+
+// limit formats the usage with its limit if the limit is set
+func limit(v, max int64) string {
+	if max == 0 {
+		return fmt.Sprintf("%v", v)
+	}
+	return fmt.Sprintf("%v/%v", v, max)
+}
+
+func printMetadata(out io.Writer, metadata []ar.MetadataStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tTYPE\tNAME\tVERSION\tSIZE")
+	for _, m := range metadata {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", m.Digest, m.Type, m.Name, m.Version, m.Size)
+	}
+	return w.Flush()
+}
+
+func printJson(out io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %w", err)
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+// request sends the request via the socket API and unmarshals the response
+func request(c *config, t uint32, req, resp interface{}) error {
+
+	log.Tracef("Connecting via %v socket to %v", c.network, c.addr)
+
+	conn, err := internal.Dial(c.network, c.addr, 10*time.Second)
+	if err != nil {
+		return dialError(c.addr, err)
+	}
+	defer conn.Close()
+
+	s := ar.JsonSerializer{}
+	payload, err := s.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	err = api.Send(conn, payload, t)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	payload, msgType, version, err := api.ReceiveVersion(conn, api.MaxChunkedMsgLen)
+	if err != nil {
+		return fmt.Errorf("failed to receive: %w", err)
+	}
+	if err := api.CheckVersion(version); err != nil {
+		return fmt.Errorf("cannot decode response: %w", err)
+	}
+	if msgType == api.TypeError {
+		e := new(api.SocketError)
+		if err := s.Unmarshal(payload, e); err != nil {
+			return fmt.Errorf("failed to unmarshal error response: %w", err)
+		}
+		return fmt.Errorf("cmcd responded with error: %w", api.ResponseError(e, api.Version1))
+	}
+	if msgType != t {
+		return fmt.Errorf("unexpected response type %v, expected %v", api.TypeToString(msgType),
+			api.TypeToString(t))
+	}
+
+	err = s.Unmarshal(payload, resp)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// dialError distinguishes a daemon which is not running, i.e. the socket does
+// not exist or nobody listens on it, from insufficient permissions to access
+// the socket
+func dialError(addr string, err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: cannot connect to %v: %v", errNotRunning, addr, err)
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Errorf("%w %v: %v", errPermission, addr, err)
+	default:
+		return fmt.Errorf("failed to connect to %v: %w", addr, err)
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func listOrNone(l []string) string {
+	if len(l) == 0 {
+		return "-"
+	}
+	return strings.Join(l, ", ")
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"golang.org/x/exp/slices"
+)
+
+var testMetadata = []ar.MetadataStatus{
+	{Digest: "1a2b3c", Type: "RTM Manifest", Name: "de.test.rtm", Version: "2023-04-10T20:00:00Z",
+		Size: 512},
+	{Digest: "4d5e6f", Type: "OS Manifest", Name: "de.test.os", Version: "2023-04-10T20:00:00Z",
+		Size: 256},
+}
+
+// startDaemon starts a fake cmcd serving status, metadata and cache requests on a
+// unix socket in a temporary directory
+func startDaemon(t *testing.T) string {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "cmcd.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := ar.JsonSerializer{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			payload, reqType, err := api.Receive(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			var resp interface{}
+			switch reqType {
+			case api.TypeStatus:
+				resp = &api.StatusResponse{
+					Drivers: []ar.DriverStatus{
+						{Name: "sw", Signer: true, Healthy: true, MeasurementTypes: []string{"SW Measurement"}},
+					},
+					Enrollment:   &ar.EnrollmentStatus{State: ar.EnrollmentEnrolled},
+					Metadata:     testMetadata,
+					ConfigDigest: "c0ffee",
+				}
+			case api.TypeMetadata:
+				req := new(api.MetadataRequest)
+				s.Unmarshal(payload, req)
+				if req.Digest != "" && req.Digest != "1a2b" {
+					reqType = api.TypeError
+					resp = &api.SocketError{Msg: "metadata item " + req.Digest + " not found"}
+					break
+				}
+				r := &api.MetadataResponse{Metadata: testMetadata}
+				if req.Digest != "" {
+					r.Item = []byte(`{"payload":"e30","signatures":[]}`)
+				}
+				resp = r
+			case api.TypeCache:
+				req := new(api.CacheRequest)
+				s.Unmarshal(payload, req)
+				if req.Flush != "" && req.Flush != "all" && req.Flush != "collateral" {
+					reqType = api.TypeError
+					resp = &api.SocketError{Msg: "unknown cache " + req.Flush}
+					break
+				}
+				stats := cache.Stats{Name: "collateral", Entries: 3, Bytes: 4096, MaxEntries: 1024,
+					Ttl: "24h0m0s", Hits: 7, Misses: 3, Evictions: 1}
+				if req.Flush != "" {
+					stats.Entries = 0
+				}
+				resp = &api.CacheResponse{Caches: []cache.Stats{stats}}
+			}
+			data, _ := s.Marshal(resp)
+			api.Send(conn, data, reqType)
+			conn.Close()
+		}
+	}()
+	return addr
+}
+
+func Test_run(t *testing.T) {
+	addr := startDaemon(t)
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+
+	dir := t.TempDir()
+	socketConf := filepath.Join(dir, "socket.json")
+	os.WriteFile(socketConf, []byte(`{"addr":"`+addr+`","api":"socket","network":"unix"}`), 0644)
+	grpcConf := filepath.Join(dir, "grpc.json")
+	os.WriteFile(grpcConf, []byte(`{"addr":"localhost:9955","api":"grpc"}`), 0644)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  []string
+	}{
+		{"Status", []string{"-addr", addr, "status"}, exitOk,
+			[]string{"sw", "SW Measurement", "enrolled", "c0ffee", "Metadata items: 2"}},
+		{"Status Config", []string{"-config", socketConf, "status"}, exitOk, []string{"c0ffee"}},
+		{"Status JSON", []string{"-addr", addr, "-format", "json", "status"}, exitOk,
+			[]string{`"configDigest": "c0ffee"`}},
+		{"Metadata List", []string{"-addr", addr, "metadata", "list"}, exitOk,
+			[]string{"DIGEST", "1a2b3c", "de.test.os"}},
+		{"Metadata List JSON", []string{"-addr", addr, "-format", "json", "metadata", "list"}, exitOk,
+			[]string{`"digest": "4d5e6f"`}},
+		{"Metadata Show", []string{"-addr", addr, "metadata", "show", "1a2b"}, exitOk,
+			[]string{`"payload": "e30"`}},
+		{"Metadata Show Unknown", []string{"-addr", addr, "metadata", "show", "ffff"}, exitError, nil},
+		{"Cache List", []string{"-addr", addr, "cache", "list"}, exitOk,
+			[]string{"CACHE", "collateral", "3/1024", "24h0m0s"}},
+		{"Cache List JSON", []string{"-addr", addr, "-format", "json", "cache", "list"}, exitOk,
+			[]string{`"hits": 7`}},
+		{"Cache Flush", []string{"-addr", addr, "cache", "flush", "collateral"}, exitOk,
+			[]string{"0/1024"}},
+		{"Cache Flush Unknown", []string{"-addr", addr, "cache", "flush", "foo"}, exitError, nil},
+		{"Not Running", []string{"-addr", missing, "status"}, exitNotRunning, nil},
+		{"No Command", []string{"-addr", addr}, exitUsage, nil},
+		{"Unknown Command", []string{"-addr", addr, "metadata", "delete"}, exitUsage, nil},
+		{"Unknown Format", []string{"-addr", addr, "-format", "yaml", "status"}, exitUsage, nil},
+		{"No Address", []string{"status"}, exitUsage, nil},
+		{"Non-Socket API", []string{"-config", grpcConf, "status"}, exitUsage, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			if code := run(tt.args, out); code != tt.wantCode {
+				t.Fatalf("run() = %v, want %v", code, tt.wantCode)
+			}
+			for _, w := range tt.wantOut {
+				if !strings.Contains(out.String(), w) {
+					t.Errorf("output does not contain %q:\n%v", w, out.String())
+				}
+			}
+			if slices.Contains(tt.args, "json") && tt.wantCode == exitOk {
+				if !json.Valid(out.Bytes()) {
+					t.Errorf("output is not valid JSON:\n%v", out.String())
+				}
+			}
+		})
+	}
+}
+
+func Test_dialError(t *testing.T) {
+	// Permission errors cannot be provoked with the socket as root, the dial
+	// errors are therefore created synthetically
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"No Socket", opErr(syscall.ENOENT), errNotRunning},
+		{"Refused", opErr(syscall.ECONNREFUSED), errNotRunning},
+		{"Access Denied", opErr(syscall.EACCES), errPermission},
+		{"Not Permitted", opErr(syscall.EPERM), errPermission},
+		{"Other", opErr(syscall.ETIMEDOUT), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dialError("/run/cmcd.sock", tt.err)
+			for _, e := range []error{errNotRunning, errPermission} {
+				if errors.Is(err, e) != (e == tt.want) {
+					t.Errorf("dialError() = %v, want %v", err, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright(c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the License); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Example measurement plugin for the cmcd plugin driver. The plugin measures
+// the SHA256 digest of a file and returns it together with the nonce
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/plugindriver"
+)
+
+const (
+	vendor          = "org.example"
+	measurementType = "File Measurement"
+	refValType      = "File Reference Value"
+)
+
+// FileEvidence is the evidence returned by the plugin. Integrity protection is
+// provided by the signature of the attestation report
+type FileEvidence struct {
+	Nonce  []byte `cbor:"0,keyasint"`
+	Sha256 []byte `cbor:"1,keyasint"`
+}
+
+type filePlugin struct {
+	file string
+}
+
+func main() {
+	log.SetLevel(log.InfoLevel)
+
+	socket := flag.String("socket", "/tmp/example-plugin.sock", "Unix domain socket to listen on")
+	file := flag.String("file", "", "File to measure")
+	flag.Parse()
+
+	if *file == "" {
+		log.Error("file not specified")
+		flag.Usage()
+		return
+	}
+
+	os.Remove(*socket)
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatalf("Failed to listen on %v: %v", *socket, err)
+	}
+	defer l.Close()
+
+	log.Infof("Serving example plugin on %v", *socket)
+
+	err = plugindriver.Serve(l, vendor, "example-plugin", &filePlugin{file: *file})
+	if err != nil {
+		log.Fatalf("Failed to serve plugin: %v", err)
+	}
+}
+
+// Measure implements the plugindriver Measurer interface
+func (p *filePlugin) Measure(nonce []byte) (string, []byte, [][]byte, error) {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to read %v: %w", p.file, err)
+	}
+	digest := sha256.Sum256(data)
+	evidence, err := ar.CborSerializer{}.Marshal(&FileEvidence{
+		Nonce:  nonce,
+		Sha256: digest[:],
+	})
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to marshal evidence: %w", err)
+	}
+	return measurementType, evidence, nil, nil
+}
+
+// verifyFileMeasurement is the verifier side of the example plugin, which can be
+// registered via verify.RegisterVerifier
+func verifyFileMeasurement(m ar.Measurement, nonce []byte, _ []*x509.Certificate,
+	referenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
+
+	result := &ar.MeasurementResult{
+		Type: vendor + "/File Result",
+	}
+
+	evidence := new(FileEvidence)
+	if err := (ar.CborSerializer{}).Unmarshal(m.Evidence, evidence); err != nil {
+		result.Summary.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+
+	ok := true
+	if bytes.Equal(evidence.Nonce, nonce) {
+		result.Freshness.Success = true
+	} else {
+		result.Freshness.Expected = hex.EncodeToString(nonce)
+		result.Freshness.Got = hex.EncodeToString(evidence.Nonce)
+		ok = false
+	}
+
+	found := false
+	for _, ref := range referenceValues {
+		if bytes.Equal(ref.Sha256, evidence.Sha256) {
+			found = true
+			result.Artifacts = append(result.Artifacts, ar.DigestResult{
+				Name:    ref.Name,
+				Digest:  hex.EncodeToString(ref.Sha256),
+				Success: true,
+			})
+		}
+	}
+	if !found {
+		result.Artifacts = append(result.Artifacts, ar.DigestResult{
+			Digest: hex.EncodeToString(evidence.Sha256),
+			Type:   "Measurement",
+		})
+		ok = false
+	}
+
+	result.Summary.Success = ok
+
+	return result, ok
+}
@@ -0,0 +1,88 @@
+// Copyright(c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the License); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an AS IS BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/plugindriver"
+	"github.com/Fraunhofer-AISEC/cmc/verify"
+)
+
+func Test_examplePlugin(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.txt")
+	if err := os.WriteFile(file, []byte("example configuration"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	digest := sha256.Sum256([]byte("example configuration"))
+
+	socket := filepath.Join(dir, "plugin.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go plugindriver.Serve(l, vendor, "example-plugin", &filePlugin{file: file})
+
+	err = verify.RegisterVerifier(vendor+"/"+measurementType, vendor+"/"+refValType,
+		verifyFileMeasurement)
+	if err != nil {
+		t.Fatalf("RegisterVerifier() error = %v", err)
+	}
+
+	p := &plugindriver.Plugin{}
+	if err := p.Init(&ar.DriverConfig{PluginSockets: []string{socket}}); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	nonce := []byte{0x01, 0x02, 0x03, 0x04}
+	measurements, err := p.MeasureAll(nonce)
+	if err != nil {
+		t.Fatalf("MeasureAll() error = %v", err)
+	}
+	if len(measurements) != 1 || measurements[0].Type != "org.example/File Measurement" {
+		t.Fatalf("MeasureAll() returned unexpected measurements %v", measurements)
+	}
+
+	tests := []struct {
+		name    string
+		nonce   []byte
+		refVals []ar.ReferenceValue
+		want    bool
+	}{
+		{"Valid", nonce, []ar.ReferenceValue{{Name: "config.txt", Sha256: digest[:]}}, true},
+		{"Invalid Nonce", []byte{0xff}, []ar.ReferenceValue{{Name: "config.txt",
+			Sha256: digest[:]}}, false},
+		{"Invalid Digest", nonce, []ar.ReferenceValue{{Name: "config.txt",
+			Sha256: make([]byte, 32)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := verifyFileMeasurement(measurements[0], tt.nonce, nil, tt.refVals)
+			if got != tt.want {
+				t.Errorf("verifyFileMeasurement() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
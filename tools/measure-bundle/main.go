@@ -23,6 +23,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
 )
 
@@ -38,7 +39,7 @@ func main() {
 		log.Fatalf("Failed to get config: %v", err)
 	}
 
-	logrus.SetLevel(c.logLevel)
+	internal.SetLogLevel(c.logLevel)
 	log.Debug("Running measure-bundle")
 
 	// Print
@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/swdriver"
+)
+
+// sw-key-migrate converts a plaintext PEM key of the SW driver into the
+// encrypted key format stored in the cmcd storage path
+func main() {
+
+	in := flag.String("in", "", "Path to the plaintext PEM key")
+	storage := flag.String("storage", "", "cmcd storage path to write the encrypted key to")
+	protection := flag.String("protection", "passphrase", "Key protection [passphrase tpm]")
+	passphrase := flag.String("passphrase", "prompt",
+		"Passphrase source [env:<VAR> file:<PATH> prompt]")
+	pcrs := flag.String("pcrs", "", "Comma separated list of PCRs to seal the key to (tpm only)")
+	remove := flag.Bool("remove", false, "Remove the plaintext key after successful migration")
+	flag.Parse()
+
+	if *in == "" || *storage == "" {
+		log.Error("input key or storage path not specified")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	c := &ar.DriverConfig{
+		StoragePath:     *storage,
+		SwKeyProtection: *protection,
+		SwKeyPassphrase: *passphrase,
+	}
+	if *pcrs != "" {
+		for _, s := range strings.Split(*pcrs, ",") {
+			pcr, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("Invalid PCR %q: %v", s, err)
+			}
+			c.SwKeyPcrs = append(c.SwKeyPcrs, pcr)
+		}
+	}
+
+	err := swdriver.MigrateKey(*in, c)
+	if err != nil {
+		log.Fatalf("Failed to migrate key: %v", err)
+	}
+
+	if *remove {
+		err = os.Remove(*in)
+		if err != nil {
+			log.Fatalf("Failed to remove plaintext key: %v", err)
+		}
+		log.Infof("Removed plaintext key %v", *in)
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+const (
+	ekCertIndex  = tpmutil.Handle(0x01c00002)
+	ekNonceIndex = tpmutil.Handle(0x01c00003)
+
+	// TPM2_ObjectChangeAuth is not provided by go-tpm
+	cmdObjectChangeAuth = tpmutil.Command(0x00000150)
+)
+
+var (
+	// srkTemplate and ekTemplate must match the go-attestation templates, so
+	// that go-attestation uses the SRK and EK created with the configured auth
+	srkTemplate = tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault | tpm2.FlagNoDA,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			ModulusRaw: make([]byte, 256),
+			KeyBits:    2048,
+		},
+	}
+
+	// Default RSA EK template of the TCG EK Credential Profile
+	ekTemplate = tpm2.Public{
+		Type:    tpm2.AlgRSA,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagAdminWithPolicy | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+		AuthPolicy: []byte{
+			0x83, 0x71, 0x97, 0x67, 0x44, 0x84,
+			0xB3, 0xF8, 0x1A, 0x90, 0xCC, 0x8D,
+			0x46, 0xA5, 0xD7, 0x24, 0xFD, 0x52,
+			0xD7, 0x6E, 0x06, 0x52, 0x0B, 0x64,
+			0xF2, 0xA1, 0xDA, 0x1B, 0x33, 0x14,
+			0x69, 0xAA,
+		},
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{
+				Alg:     tpm2.AlgAES,
+				KeyBits: 128,
+				Mode:    tpm2.AlgCFB,
+			},
+			KeyBits:    2048,
+			ModulusRaw: make([]byte, 256),
+		},
+	}
+)
+
+// tpmAuth contains the authorization values of the owner and endorsement
+// hierarchy and of the AK and IK. Empty values are used if not configured
+type tpmAuth struct {
+	owner       string
+	endorsement string
+	key         string
+}
+
+// authValues are the configured authorization values. go-attestation assumes
+// empty authorization values, therefore the commands requiring hierarchy
+// authorization are performed by the driver if values are configured
+var authValues tpmAuth
+
+// AuthError is returned if the TPM rejected the authorization value of an
+// entity, e.g. the owner hierarchy
+type AuthError struct {
+	Entity string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("TPM %v rejected the authorization value (check the configured auth): %v",
+		e.Entity, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// loadAuth reads the configured authorization values from their sources
+func loadAuth(c *ar.DriverConfig) (tpmAuth, error) {
+	var a tpmAuth
+	sources := []struct {
+		source      string
+		value       *string
+		description string
+	}{
+		{c.OwnerAuth, &a.owner, "TPM owner auth"},
+		{c.EndorsementAuth, &a.endorsement, "TPM endorsement auth"},
+		{c.KeyAuth, &a.key, "TPM key auth"},
+	}
+	for _, s := range sources {
+		if s.source == "" {
+			continue
+		}
+		// Do not include the source in the error, as it might be a plain auth value
+		if !strings.HasPrefix(s.source, "env:") && !strings.HasPrefix(s.source, "file:") &&
+			s.source != "prompt" {
+			return tpmAuth{}, fmt.Errorf("invalid %v source (must be env:<VAR>, file:<PATH> or prompt)",
+				s.description)
+		}
+		secret, err := internal.GetSecret(s.source, s.description)
+		if err != nil {
+			return tpmAuth{}, fmt.Errorf("failed to get %v: %w", s.description, err)
+		}
+		*s.value = string(secret)
+	}
+	return a, nil
+}
+
+// authError returns an AuthError for the entity if the TPM rejected the
+// authorization, otherwise the original error is returned
+func authError(err error, entity string) error {
+	if err == nil || !isBadAuth(err) {
+		return err
+	}
+	return &AuthError{Entity: entity, Err: err}
+}
+
+func isBadAuth(err error) bool {
+	var se tpm2.SessionError
+	if errors.As(err, &se) {
+		return se.Code == tpm2.RCBadAuth || se.Code == tpm2.RCAuthFail
+	}
+	return errors.Is(err, tpmdirect.TPMRCBadAuth) || errors.Is(err, tpmdirect.TPMRCAuthFail)
+}
+
+func passwordAuth(auth string) tpm2.AuthCommand {
+	return tpm2.AuthCommand{
+		Session:    tpm2.HandlePasswordSession,
+		Attributes: tpm2.AttrContinueSession,
+		Auth:       []byte(auth),
+	}
+}
+
+// ensureSrk creates the SRK with the configured owner auth if it does not exist
+func ensureSrk(rwc io.ReadWriter) error {
+	if _, _, _, err := tpm2.ReadPublic(rwc, srkHandle); err == nil {
+		return nil
+	}
+
+	log.Debug("Creating SRK")
+
+	hnd, _, err := tpm2.CreatePrimary(rwc, tpm2.HandleOwner, tpm2.PCRSelection{},
+		authValues.owner, "", srkTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to create SRK: %w", authError(err, "owner hierarchy"))
+	}
+	defer tpm2.FlushContext(rwc, hnd)
+
+	err = tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, hnd, srkHandle)
+	if err != nil {
+		return fmt.Errorf("failed to persist SRK: %w", authError(err, "owner hierarchy"))
+	}
+
+	return nil
+}
+
+// ensureEk creates the RSA EK with the configured endorsement auth and persists
+// it with the configured owner auth if it does not exist
+func ensureEk(rwc io.ReadWriter) (crypto.PublicKey, error) {
+	if pub, err := readPersistentKey(rwc, ekHandle); err == nil {
+		return pub, nil
+	}
+
+	log.Debug("Creating EK")
+
+	tmpl := ekTemplate
+	nonce, err := tpm2.NVReadEx(rwc, ekNonceIndex, tpm2.HandleOwner, authValues.owner, 0)
+	if err == nil {
+		tmpl.RSAParameters = &tpm2.RSAParams{
+			Symmetric:  ekTemplate.RSAParameters.Symmetric,
+			KeyBits:    ekTemplate.RSAParameters.KeyBits,
+			ModulusRaw: make([]byte, 256),
+		}
+		copy(tmpl.RSAParameters.ModulusRaw, nonce)
+	}
+
+	hnd, pub, err := tpm2.CreatePrimary(rwc, tpm2.HandleEndorsement, tpm2.PCRSelection{},
+		authValues.endorsement, "", tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create EK: %w", authError(err, "endorsement hierarchy"))
+	}
+	defer tpm2.FlushContext(rwc, hnd)
+
+	err = tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, hnd, ekHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to persist EK: %w", authError(err, "owner hierarchy"))
+	}
+
+	return pub, nil
+}
+
+// getEks returns the EK. If an endorsement auth is configured, the EK is created
+// by the driver, as go-attestation creates the EK with an empty auth
+func getEks(tpm *attest.TPM) ([]attest.EK, error) {
+
+	if authValues.endorsement == "" {
+		return tpm.EKs()
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ensureEk(rwc)
+	if err != nil {
+		return nil, err
+	}
+	ek := attest.EK{Public: pub}
+
+	data, err := tpm2.NVReadEx(rwc, ekCertIndex, ekCertIndex, "", 0)
+	if err == nil {
+		cert, err := attest.ParseEKCertificate(data)
+		if err != nil {
+			log.Warnf("Failed to parse EK certificate: %v", err)
+		} else {
+			ek.Certificate = cert
+		}
+	}
+
+	return []attest.EK{ek}, nil
+}
+
+// activateCredentialWithAuth performs the credential activation with the
+// configured endorsement auth, as go-attestation only supports empty auth
+func activateCredentialWithAuth(rwc io.ReadWriter, ak *attest.AK,
+	credential, secret []byte,
+) ([]byte, error) {
+
+	if len(credential) < 2 {
+		return nil, errors.New("malformed credential blob")
+	}
+	if len(secret) < 2 {
+		return nil, errors.New("malformed encrypted secret")
+	}
+
+	if _, err := ensureEk(rwc); err != nil {
+		return nil, err
+	}
+
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	var kb keyBlob
+	err = json.Unmarshal(akBytes, &kb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal AK blob: %w", err)
+	}
+	akHnd, _, err := tpm2.Load(rwc, srkHandle, "", kb.Public, kb.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+	defer tpm2.FlushContext(rwc, akHnd)
+
+	sess, _, err := tpm2.StartAuthSession(rwc, tpm2.HandleNull, tpm2.HandleNull,
+		make([]byte, 16), nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start policy session: %w", err)
+	}
+	defer tpm2.FlushContext(rwc, sess)
+
+	_, _, err = tpm2.PolicySecret(rwc, tpm2.HandleEndorsement, passwordAuth(authValues.endorsement),
+		sess, nil, nil, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to satisfy EK policy: %w",
+			authError(err, "endorsement hierarchy"))
+	}
+
+	cred, err := tpm2.ActivateCredentialUsingAuth(rwc, []tpm2.AuthCommand{
+		passwordAuth(""),
+		{Session: sess, Attributes: tpm2.AttrContinueSession},
+	}, akHnd, ekHandle, credential[2:], secret[2:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate credential: %w", authError(err, "AK"))
+	}
+
+	return cred, nil
+}
+
+// setKeyAuth sets the configured key auth on the AK and IK, which are created
+// by go-attestation with an empty auth. The keys are re-loaded from the updated
+// key blobs and the passed keys are closed
+func setKeyAuth(ak *attest.AK, ik *attest.Key) (*attest.AK, *attest.Key, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Debug("Setting AK and IK auth")
+
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	akBytes, err = changeKeyAuth(rwc, akBytes, "", authValues.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set AK auth: %w", authError(err, "AK"))
+	}
+	ikBytes, err := ik.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal IK: %w", err)
+	}
+	ikBytes, err = changeKeyAuth(rwc, ikBytes, "", authValues.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set IK auth: %w", authError(err, "IK"))
+	}
+
+	newAk, err := TPM.LoadAK(akBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+	newIk, err := TPM.LoadKey(ikBytes)
+	if err != nil {
+		newAk.Close(TPM)
+		return nil, nil, fmt.Errorf("failed to load IK: %w", err)
+	}
+
+	ak.Close(TPM)
+	ik.Close()
+
+	return newAk, newIk, nil
+}
+
+// changeKeyAuth changes the auth of the key contained in the go-attestation blob
+// and returns the blob with the new private area
+func changeKeyAuth(rwc io.ReadWriter, opaqueBlob []byte, oldAuth, newAuth string) ([]byte, error) {
+
+	var kb keyBlob
+	err := json.Unmarshal(opaqueBlob, &kb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key blob: %w", err)
+	}
+
+	hnd, _, err := tpm2.Load(rwc, srkHandle, "", kb.Public, kb.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %w", err)
+	}
+	defer tpm2.FlushContext(rwc, hnd)
+
+	priv, err := objectChangeAuth(rwc, hnd, srkHandle, oldAuth, newAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep all other fields of the go-attestation blob
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(opaqueBlob, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key blob: %w", err)
+	}
+	fields["KeyBlob"], err = json.Marshal(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private area: %w", err)
+	}
+
+	return json.Marshal(fields)
+}
+
+// objectChangeAuth executes TPM2_ObjectChangeAuth for the loaded object and
+// returns the new private area, which must be loaded to use the new auth
+func objectChangeAuth(rwc io.ReadWriter, object, parent tpmutil.Handle,
+	oldAuth, newAuth string,
+) ([]byte, error) {
+
+	handles, err := tpmutil.Pack(object, parent)
+	if err != nil {
+		return nil, err
+	}
+	a := passwordAuth(oldAuth)
+	authCmd, err := tpmutil.Pack(a.Session, tpmutil.U16Bytes(a.Nonce), a.Attributes,
+		tpmutil.U16Bytes(a.Auth))
+	if err != nil {
+		return nil, err
+	}
+	authArea, err := tpmutil.Pack(uint32(len(authCmd)), tpmutil.RawBytes(authCmd))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, code, err := tpmutil.RunCommand(rwc, tpm2.TagSessions, cmdObjectChangeAuth,
+		tpmutil.RawBytes(handles), tpmutil.RawBytes(authArea), tpmutil.U16Bytes(newAuth))
+	if err != nil {
+		return nil, fmt.Errorf("failed to change object auth: %w", err)
+	}
+	if code != tpmutil.RCSuccess {
+		return nil, fmt.Errorf("failed to change object auth: %w", tpmdirect.TPMRC(code))
+	}
+
+	var paramSize uint32
+	var outPrivate tpmutil.U16Bytes
+	if _, err := tpmutil.Unpack(resp, &paramSize, &outPrivate); err != nil {
+		return nil, fmt.Errorf("failed to decode object change auth response: %w", err)
+	}
+
+	return []byte(outPrivate), nil
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func TestLoadAuth(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "owner")
+	if err := os.WriteFile(file, []byte("owner-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CMC_TEST_KEY_AUTH", "key-secret")
+
+	tests := []struct {
+		name    string
+		c       ar.DriverConfig
+		want    tpmAuth
+		wantErr bool
+	}{
+		{"Empty", ar.DriverConfig{}, tpmAuth{}, false},
+		{"File And Env", ar.DriverConfig{OwnerAuth: "file:" + file, KeyAuth: "env:CMC_TEST_KEY_AUTH"},
+			tpmAuth{owner: "owner-secret", key: "key-secret"}, false},
+		{"Unset Env", ar.DriverConfig{EndorsementAuth: "env:CMC_TEST_UNSET_AUTH"}, tpmAuth{}, true},
+		{"Invalid Source", ar.DriverConfig{OwnerAuth: "owner-secret"}, tpmAuth{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadAuth(&tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("loadAuth() = %+v, want %+v", got, tt.want)
+			}
+			// The auth values must never be part of error messages
+			if err != nil && bytes.Contains([]byte(err.Error()), []byte("secret")) {
+				t.Errorf("loadAuth() error contains auth value: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"Legacy Bad Auth", tpm2.SessionError{Code: tpm2.RCBadAuth, Session: tpm2.RC1}, true},
+		{"Legacy Auth Fail", fmt.Errorf("wrapped: %w",
+			tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC2}), true},
+		{"Legacy Other", tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC1}, false},
+		{"Direct Bad Auth", tpmdirect.TPMRC(0x9a2), true},
+		{"Direct Other", tpmdirect.TPMRCHandle, false},
+		{"Other", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authError(tt.err, "owner hierarchy")
+			var authErr *AuthError
+			if got := errors.As(err, &authErr); got != tt.wantErr {
+				t.Fatalf("authError() = %v, want AuthError %v", err, tt.wantErr)
+			}
+			if tt.wantErr && authErr.Entity != "owner hierarchy" {
+				t.Errorf("AuthError.Entity = %v, want owner hierarchy", authErr.Entity)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("authError() does not wrap the original error")
+			}
+		})
+	}
+}
+
+// TestHierarchyAuth requires a TPM simulator, see TestPersistKey. It sets
+// non-empty owner and endorsement auth values and restores the empty values
+func TestHierarchyAuth(t *testing.T) {
+
+	const (
+		handle  = tpmutil.Handle(0x81000011)
+		nvIndex = tpmutil.Handle(0x01500100)
+	)
+
+	rwc := openSimulator(t)
+	defer rwc.Close()
+	createSrk(t, rwc)
+
+	setHierarchyAuth(t, rwc, tpm2.HandleOwner, "", "owner-auth")
+	defer setHierarchyAuth(t, rwc, tpm2.HandleOwner, "owner-auth", "")
+	setHierarchyAuth(t, rwc, tpm2.HandleEndorsement, "", "endorsement-auth")
+	defer setHierarchyAuth(t, rwc, tpm2.HandleEndorsement, "endorsement-auth", "")
+
+	defer func() { authValues = tpmAuth{} }()
+
+	// Empty auth values must be rejected with an error naming the hierarchy
+	authValues = tpmAuth{}
+	err := persistKey(rwc, createKeyBlob(t, rwc), handle, true, nil)
+	wantAuthError(t, err, "owner hierarchy")
+	err = writeNv(rwc, nvIndex, []byte("payload"), true)
+	wantAuthError(t, err, "owner hierarchy")
+
+	authValues = tpmAuth{owner: "owner-auth", endorsement: "wrong"}
+	tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, ekHandle, ekHandle)
+	_, err = ensureEk(rwc)
+	wantAuthError(t, err, "endorsement hierarchy")
+
+	// The configured auth values must be used for persistence, NV storage and
+	// the creation of the EK
+	authValues = tpmAuth{owner: "owner-auth", endorsement: "endorsement-auth"}
+	err = persistKey(rwc, createKeyBlob(t, rwc), handle, true, nil)
+	if err != nil {
+		t.Fatalf("persistKey() error = %v", err)
+	}
+	defer tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, handle, handle)
+
+	payload := []byte("payload")
+	err = writeNv(rwc, nvIndex, payload, true)
+	if err != nil {
+		t.Fatalf("writeNv() error = %v", err)
+	}
+	defer tpm2.NVUndefineSpace(rwc, authValues.owner, tpm2.HandleOwner, nvIndex)
+	got, err := readNv(rwc, nvIndex)
+	if err != nil {
+		t.Fatalf("readNv() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("readNv() = %q, want %q", got, payload)
+	}
+
+	_, err = ensureEk(rwc)
+	if err != nil {
+		t.Fatalf("ensureEk() error = %v", err)
+	}
+	tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, ekHandle, ekHandle)
+}
+
+// TestActivateCredentialWithAuth requires a TPM simulator, see TestPersistKey
+func TestActivateCredentialWithAuth(t *testing.T) {
+
+	rwc := openSimulator(t)
+	var err error
+	TPM, err = attest.OpenTPM(&attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &commandChannel{rwc},
+	})
+	if err != nil {
+		rwc.Close()
+		t.Fatalf("failed to open TPM: %v", err)
+	}
+	tpmConn = rwc
+	defer CloseTpm()
+	createSrk(t, rwc)
+
+	setHierarchyAuth(t, rwc, tpm2.HandleOwner, "", "owner-auth")
+	defer setHierarchyAuth(t, rwc, tpm2.HandleOwner, "owner-auth", "")
+	setHierarchyAuth(t, rwc, tpm2.HandleEndorsement, "", "endorsement-auth")
+	defer setHierarchyAuth(t, rwc, tpm2.HandleEndorsement, "endorsement-auth", "")
+
+	authValues = tpmAuth{owner: "owner-auth", endorsement: "endorsement-auth"}
+	defer func() { authValues = tpmAuth{} }()
+	tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, ekHandle, ekHandle)
+	defer tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, ekHandle, ekHandle)
+
+	eks, err := getEks(TPM)
+	if err != nil {
+		t.Fatalf("getEks() error = %v", err)
+	}
+	key, err := TPM.NewAK(nil)
+	if err != nil {
+		t.Fatalf("failed to create AK: %v", err)
+	}
+	defer key.Close(TPM)
+
+	params := attest.ActivationParameters{
+		TPMVersion: attest.TPMVersion20,
+		EK:         eks[0].Public,
+		AK:         key.AttestationParameters(),
+	}
+	secret, ec, err := params.Generate()
+	if err != nil {
+		t.Fatalf("failed to generate credential: %v", err)
+	}
+
+	got, err := ActivateCredential(TPM, key, ec.Credential, ec.Secret)
+	if err != nil {
+		t.Fatalf("ActivateCredential() error = %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("ActivateCredential() returned wrong secret")
+	}
+
+	authValues.endorsement = "wrong"
+	_, err = ActivateCredential(TPM, key, ec.Credential, ec.Secret)
+	wantAuthError(t, err, "endorsement hierarchy")
+}
+
+// TestKeyAuth requires a TPM simulator, see TestPersistKey
+func TestKeyAuth(t *testing.T) {
+
+	rwc := openSimulator(t)
+	defer rwc.Close()
+	createSrk(t, rwc)
+
+	blob, err := changeKeyAuth(rwc, createNoDaKeyBlob(t, rwc), "", "key-auth")
+	if err != nil {
+		t.Fatalf("changeKeyAuth() error = %v", err)
+	}
+
+	// The remaining fields of the key blob must be kept
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		t.Fatalf("failed to unmarshal key blob: %v", err)
+	}
+	if _, ok := fields["Public"]; !ok {
+		t.Errorf("changeKeyAuth() removed public area from key blob")
+	}
+
+	bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0}}
+	nonce := []byte("0123456789abcdef")
+	digest := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name       string
+		key        string
+		wantEntity string
+	}{
+		{"Configured Auth", "key-auth", ""},
+		{"Empty Auth", "", "AK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newTpmSessions(rwc, false, nil, tpmAuth{key: tt.key})
+			if err != nil {
+				t.Fatalf("newTpmSessions() error = %v", err)
+			}
+			defer s.close()
+			if err := s.loadKeys(blob, blob, 0, 0); err != nil {
+				t.Fatalf("loadKeys() error = %v", err)
+			}
+
+			_, err = s.quote(nonce, bank)
+			if tt.wantEntity != "" {
+				wantAuthError(t, err, tt.wantEntity)
+				return
+			}
+			if err != nil {
+				t.Fatalf("quote() error = %v", err)
+			}
+
+			signer, err := s.signer()
+			if err != nil {
+				t.Fatalf("signer() error = %v", err)
+			}
+			sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			if !ecdsa.VerifyASN1(signer.Public().(*ecdsa.PublicKey), digest[:], sig) {
+				t.Errorf("failed to verify signature")
+			}
+		})
+	}
+}
+
+// createNoDaKeyBlob creates a key not protected by the dictionary attack
+// lockout, so that tests with wrong auth values do not lock out the TPM
+func createNoDaKeyBlob(t testing.TB, rwc io.ReadWriter) []byte {
+	tmpl := tpm2.Public{
+		Type:    tpm2.AlgECC,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagUserWithAuth | tpm2.FlagSign | tpm2.FlagNoDA,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	priv, pub, _, _, _, err := tpm2.CreateKey(rwc, srkHandle, tpm2.PCRSelection{}, "", "", tmpl)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	data, err := json.Marshal(keyBlob{Public: pub, Blob: priv})
+	if err != nil {
+		t.Fatalf("failed to marshal key blob: %v", err)
+	}
+	return data
+}
+
+func setHierarchyAuth(t testing.TB, rwc io.ReadWriter, hierarchy tpmutil.Handle, old, new string) {
+	err := tpm2.HierarchyChangeAuth(rwc, hierarchy, passwordAuth(old), new)
+	if err != nil {
+		t.Fatalf("failed to change auth of hierarchy 0x%x: %v", uint32(hierarchy), err)
+	}
+}
+
+func wantAuthError(t *testing.T, err error, entity string) {
+	t.Helper()
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("error = %v, want AuthError for %v", err, entity)
+	}
+	if authErr.Entity != entity {
+		t.Errorf("AuthError.Entity = %v, want %v", authErr.Entity, entity)
+	}
+}
@@ -209,8 +209,8 @@ func parseBiosMeasurements(data []byte) ([]ar.ReferenceValue, error) {
 		parseEvent := true
 
 		//checks for locality
-		if pcrIndex > 24 {
-			log.Errorf("Invalid PCR: %v", pcrIndex)
+		if int(pcrIndex) >= len(initializedPCR) {
+			return nil, fmt.Errorf("invalid PCR %v", pcrIndex)
 		}
 		//pcr value has not been initialized
 		if !initializedPCR[pcrIndex] {
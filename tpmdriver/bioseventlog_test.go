@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
 )
 
@@ -36,7 +37,7 @@ func Test_parseBiosMeasurements(t *testing.T) {
 		{"Test parseBiosMeasurements", args{BinaryBiosMeasurements}, nil, false},
 	}
 
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 	logrus.Print("test")
 
 	for _, tt := range tests {
@@ -3794,3 +3795,22 @@ var (
 		0x33, 0x2d, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x69, 0x63, 0x00,
 	}
 )
+
+func FuzzParseBiosMeasurements(f *testing.F) {
+	f.Add(BinaryBiosMeasurements)
+	f.Add(BinaryBiosMeasurements[:100])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		refVals, err := parseBiosMeasurements(data)
+		if err != nil {
+			return
+		}
+		// Each event consists of at least 16 bytes and creates at most one
+		// reference value and one locality entry
+		if len(refVals) > 2*(len(data)/16+1) {
+			t.Errorf("parseBiosMeasurements() returned %v reference values for %v bytes",
+				len(refVals), len(data))
+		}
+	})
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// eccAkParams returns the curve and hash algorithm of the ECC AK configurations.
+// An empty configuration or RSA2048 selects the RSA AK created by go-attestation
+func eccAkParams(config string) (tpm2.TPMECCCurve, tpm2.TPMIAlgHash, bool) {
+	switch config {
+	case "EC256":
+		return tpm2.TPMECCNistP256, tpm2.TPMAlgSHA256, true
+	case "EC384":
+		return tpm2.TPMECCNistP384, tpm2.TPMAlgSHA384, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// eccAkTemplate returns the template of a restricted ECDSA signing key with
+// the same attributes as the go-attestation RSA AK
+func eccAkTemplate(curve tpm2.TPMECCCurve, hash tpm2.TPMIAlgHash) tpm2.TPMTPublic {
+	return tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgECC,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+			NoDA:                true,
+			Restricted:          true,
+			SignEncrypt:         true,
+		},
+		Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+			Symmetric: tpm2.TPMTSymDefObject{Algorithm: tpm2.TPMAlgNull},
+			Scheme: tpm2.TPMTECCScheme{
+				Scheme: tpm2.TPMAlgECDSA,
+				Details: tpm2.NewTPMUAsymScheme(tpm2.TPMAlgECDSA,
+					&tpm2.TPMSSigSchemeECDSA{HashAlg: hash}),
+			},
+			CurveID: curve,
+			KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+		}),
+		Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{}),
+	}
+}
+
+// createEccAk creates an ECC AK and loads it through go-attestation, which only
+// creates RSA AKs. As go-attestation, the creation is certified by the AK itself
+func createEccAk(tpm *attest.TPM, config string) (*attest.AK, error) {
+
+	curve, hash, ok := eccAkParams(config)
+	if !ok {
+		return nil, fmt.Errorf("unknown ECC AK configuration %v", config)
+	}
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := newEccAk(rwc, curve, hash)
+	if err != nil {
+		return nil, err
+	}
+	ak, err := tpm.LoadAK(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+
+	return ak, nil
+}
+
+// newEccAk creates the ECC AK and returns it as go-attestation blob
+func newEccAk(rwc io.ReadWriter, curve tpm2.TPMECCCurve, hash tpm2.TPMIAlgHash) ([]byte, error) {
+
+	t := transport.FromReadWriter(rwc)
+
+	parent, err := srkParent(t)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := tpm2.Create{
+		ParentHandle: parent,
+		InPublic:     tpm2.New2B(eccAkTemplate(curve, hash)),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AK: %w", err)
+	}
+
+	key, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    created.OutPrivate,
+		InPublic:     created.OutPublic,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: key.ObjectHandle}.Execute(t)
+
+	cert, err := tpm2.CertifyCreation{
+		SignHandle:     tpm2.AuthHandle{Handle: key.ObjectHandle, Name: key.Name, Auth: tpm2.PasswordAuth(nil)},
+		ObjectHandle:   tpm2.NamedHandle{Handle: key.ObjectHandle, Name: key.Name},
+		CreationHash:   created.CreationHash,
+		InScheme:       tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+		CreationTicket: created.CreationTicket,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to certify AK creation: %w", err)
+	}
+
+	return json.Marshal(attestKeyBlob{
+		Encoding:          keyEncodingEncrypted,
+		TPMVersion:        attest.TPMVersion20,
+		Public:            created.OutPublic.Bytes(),
+		CreateData:        created.CreationData.Bytes(),
+		CreateAttestation: cert.CertifyInfo.Bytes(),
+		CreateSignature:   tpm2.Marshal(cert.Signature),
+		Blob:              created.OutPrivate.Buffer,
+	})
+}
+
+// srkParent returns the SRK as parent for key creations and loads
+func srkParent(t transport.TPM) (tpm2.AuthHandle, error) {
+	srk, err := tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(srkHandle)}.Execute(t)
+	if err != nil {
+		return tpm2.AuthHandle{}, fmt.Errorf("failed to read SRK public: %w", err)
+	}
+	return tpm2.AuthHandle{
+		Handle: tpm2.TPMHandle(srkHandle),
+		Name:   srk.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, nil
+}
+
+// isEccAk returns true if the AK is an ECC key. go-attestation only supports
+// quotes, CSRs and IK certifications with RSA AKs, which are therefore
+// performed by the driver for ECC AKs
+func isEccAk(ak *attest.AK) bool {
+	pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](ak.AttestationParameters().Public)
+	if err != nil {
+		return false
+	}
+	return pub.Type == tpm2.TPMAlgECC
+}
+
+// akPublic returns the public key of the AK. go-attestation only provides the
+// public key of newly created AKs, but not of loaded AKs
+func akPublic(ak *attest.AK) (crypto.PublicKey, error) {
+	public, err := tpm2.Unmarshal[tpm2.TPMTPublic](ak.AttestationParameters().Public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode AK public area: %w", err)
+	}
+	return publicKey(public)
+}
+
+// loadAk loads the AK, which must be flushed with the returned function
+func loadAk(t transport.TPM, ak *attest.AK) (tpm2.NamedHandle, func(), error) {
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	var kb keyBlob
+	err = json.Unmarshal(akBytes, &kb)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("failed to unmarshal AK blob: %w", err)
+	}
+	parent, err := srkParent(t)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, err
+	}
+	rsp, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    tpm2.TPM2BPrivate{Buffer: kb.Blob},
+		InPublic:     tpm2.BytesAs2B[tpm2.TPMTPublic](kb.Public),
+	}.Execute(t)
+	if err != nil {
+		return tpm2.NamedHandle{}, nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+	flush := func() {
+		_, err := tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(t)
+		if err != nil {
+			log.Warnf("Failed to flush AK 0x%x: %v", uint32(rsp.ObjectHandle), err)
+		}
+	}
+	return tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name}, flush, nil
+}
+
+// eccAkQuote performs a quote over the selected PCRs with the ECC AK
+func eccAkQuote(ak *attest.AK, nonce []byte, bank PcrBank) (*Quote, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+	t := transport.FromReadWriter(rwc)
+
+	key, flush, err := loadAk(t, ak)
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+
+	rsp, err := quotePcrs(t, tpm2.AuthHandle{Handle: key.Handle, Name: key.Name,
+		Auth: tpm2.PasswordAuth(nil)}, nonce, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quote{}
+	q.Quote.Version = attest.TPMVersion20
+	q.Quote.Quote = rsp.Quoted.Bytes()
+	q.Quote.Signature = tpm2.Marshal(rsp.Signature)
+
+	return q, nil
+}
+
+// eccAkSigner implements crypto.Signer for the ECC AK. As a restricted key, the
+// AK only signs data hashed within the TPM, which does not start with
+// TPM_GENERATED_VALUE. Therefore, the data instead of the digest is passed
+type eccAkSigner struct {
+	ak  *attest.AK
+	pub crypto.PublicKey
+}
+
+func newEccAkSigner(ak *attest.AK) (*eccAkSigner, error) {
+	pub, err := akPublic(ak)
+	if err != nil {
+		return nil, err
+	}
+	return &eccAkSigner{ak: ak, pub: pub}, nil
+}
+
+func (s *eccAkSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *eccAkSigner) Sign(_ io.Reader, data []byte, opts crypto.SignerOpts) ([]byte, error) {
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("AK of type %T is not an ECC key", s.pub)
+	}
+	hash, err := hashAlg(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+	t := transport.FromReadWriter(rwc)
+
+	hashed, err := tpm2.Hash{
+		Data:      tpm2.TPM2BMaxBuffer{Buffer: data},
+		HashAlg:   hash,
+		Hierarchy: tpm2.TPMRHOwner,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash data within TPM: %w", err)
+	}
+
+	key, flush, err := loadAk(t, s.ak)
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+
+	rsp, err := tpm2.Sign{
+		KeyHandle:  tpm2.AuthHandle{Handle: key.Handle, Name: key.Name, Auth: tpm2.PasswordAuth(nil)},
+		Digest:     hashed.OutHash,
+		InScheme:   tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+		Validation: hashed.Validation,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", authError(err, "AK"))
+	}
+
+	sig, err := rsp.Signature.Signature.ECDSA()
+	if err != nil {
+		return nil, fmt.Errorf("expected ECDSA signature: %w", err)
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig.SignatureR.Buffer),
+		new(big.Int).SetBytes(sig.SignatureS.Buffer),
+	})
+}
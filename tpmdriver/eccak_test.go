@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+func TestEccAkParams(t *testing.T) {
+	tests := []struct {
+		config string
+		want   bool
+	}{
+		{"EC256", true},
+		{"EC384", true},
+		{"EC521", false},
+		{"RSA2048", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			curve, hash, ok := eccAkParams(tt.config)
+			if ok != tt.want {
+				t.Fatalf("eccAkParams() ok = %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			tmpl := eccAkTemplate(curve, hash)
+			if !tmpl.ObjectAttributes.Restricted || !tmpl.ObjectAttributes.FixedTPM ||
+				!tmpl.ObjectAttributes.FixedParent || !tmpl.ObjectAttributes.SignEncrypt {
+				t.Errorf("AK template is not a restricted signing key")
+			}
+		})
+	}
+}
+
+// TestEccAk requires a TPM simulator, see TestPersistKey
+func TestEccAk(t *testing.T) {
+
+	rwc := openSimulator(t)
+	var err error
+	TPM, err = attest.OpenTPM(&attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &commandChannel{rwc},
+	})
+	if err != nil {
+		rwc.Close()
+		t.Fatalf("failed to open TPM: %v", err)
+	}
+	tpmConn = rwc
+	defer CloseTpm()
+	createSrk(t, rwc)
+
+	tests := []struct {
+		config string
+		curve  elliptic.Curve
+	}{
+		{"EC256", elliptic.P256()},
+		{"EC384", elliptic.P384()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			_, ak, ik, err := createKeys(TPM, tt.config, "EC256")
+			if err != nil {
+				t.Fatalf("createKeys() error = %v", err)
+			}
+			defer ak.Close(TPM)
+			defer ik.Close()
+
+			if !isEccAk(ak) {
+				t.Fatalf("AK is not an ECC key")
+			}
+			pub, err := akPublic(ak)
+			if err != nil {
+				t.Fatalf("akPublic() error = %v", err)
+			}
+			akPub, ok := pub.(*ecdsa.PublicKey)
+			if !ok || akPub.Curve != tt.curve {
+				t.Fatalf("AK public key = %T, want %v", pub, tt.curve.Params().Name)
+			}
+
+			csr, err := createAkCsr(ak, ar.CsrParams{Subject: ar.Name{CommonName: "Test AK"}})
+			if err != nil {
+				t.Fatalf("createAkCsr() error = %v", err)
+			}
+			if !publicKeyEqual(csr.PublicKey, akPub) {
+				t.Errorf("CSR does not contain the AK")
+			}
+
+			nonce := []byte("0123456789abcdef")
+			bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 7}}
+			q, err := eccAkQuote(ak, nonce, bank)
+			if err != nil {
+				t.Fatalf("eccAkQuote() error = %v", err)
+			}
+			if err := checkQuoteSelection(q.Quote.Quote, bank); err != nil {
+				t.Errorf("checkQuoteSelection() error = %v", err)
+			}
+			sig, err := tpm2.DecodeSignature(bytes.NewBuffer(q.Quote.Signature))
+			if err != nil || sig.ECC == nil {
+				t.Fatalf("failed to decode ECDSA quote signature: %v", err)
+			}
+			hash, err := sig.ECC.HashAlg.Hash()
+			if err != nil {
+				t.Fatalf("unsupported hash algorithm: %v", err)
+			}
+			h := hash.New()
+			h.Write(q.Quote.Quote)
+			if !ecdsa.Verify(akPub, h.Sum(nil), sig.ECC.R, sig.ECC.S) {
+				t.Errorf("failed to verify quote signature")
+			}
+		})
+	}
+}
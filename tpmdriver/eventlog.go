@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// EventLogSource provides the measured boot event log
+type EventLogSource interface {
+	// ReadFrom returns the event log data starting at the specified offset,
+	// which is empty if the log did not grow
+	ReadFrom(offset int64) ([]byte, error)
+}
+
+// FileEventLog reads the event log from a file such as the securityfs
+// binary_bios_measurements
+type FileEventLog string
+
+// ErrEventLogUnavailable indicates that the event log is not provided by the
+// platform, e.g., within containers without securityfs
+var ErrEventLogUnavailable = errors.New("event log unavailable")
+
+// ReadFrom implements the EventLogSource interface. The size of securityfs
+// files is not reported, therefore the file is read from the offset to the end
+func (f FileEventLog) ReadFrom(offset int64) ([]byte, error) {
+	file, err := os.Open(string(f))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Distinguish a missing TPM log from an unmounted securityfs, whose
+		// mount point is empty, e.g., within containers
+		entries, err := os.ReadDir(filepath.Dir(filepath.Dir(string(f))))
+		if err != nil || len(entries) == 0 {
+			return nil, fmt.Errorf("%w: securityfs not mounted", ErrEventLogUnavailable)
+		}
+		return nil, fmt.Errorf("%w: %v not present", ErrEventLogUnavailable, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer file.Close()
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to seek event log: %w", err)
+		}
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %w", err)
+	}
+	return data, nil
+}
+
+// eventLog caches the raw and the parsed event log. The event log is
+// parsed once and only re-parsed if it grows, which indicates events
+// recorded during runtime
+type eventLog struct {
+	mu     sync.Mutex
+	source EventLogSource
+	raw    []byte
+	events []ar.ReferenceValue
+	err    error
+}
+
+func newEventLog(source EventLogSource) *eventLog {
+	return &eventLog{source: source}
+}
+
+// get returns the raw and the parsed event log. If the event log cannot be
+// read anymore, the error is returned and the cached log is discarded
+func (l *eventLog) get() ([]byte, []ar.ReferenceValue, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := l.source.ReadFrom(int64(len(l.raw)))
+	if err != nil {
+		l.raw, l.events, l.err = nil, nil, err
+		return nil, nil, err
+	}
+	if len(data) == 0 && l.raw != nil {
+		return l.raw, l.events, nil
+	}
+
+	// Copy the cached data, as the returned slices are shared with callers
+	raw := make([]byte, 0, len(l.raw)+len(data))
+	raw = append(append(raw, l.raw...), data...)
+	log.Tracef("Parsing event log of %v bytes (previously %v bytes)", len(raw), len(l.raw))
+	events, err := parseBiosMeasurements(raw)
+	if err != nil {
+		l.raw, l.events = nil, nil
+		l.err = fmt.Errorf("failed to parse event log: %w", err)
+		return nil, nil, l.err
+	}
+
+	l.raw, l.events, l.err = raw, events, nil
+	return raw, events, nil
+}
+
+// status returns the error of the last event log access
+func (l *eventLog) status() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
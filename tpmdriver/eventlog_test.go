@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+// testEventLogSource provides the event log from memory and counts the reads
+type testEventLogSource struct {
+	data  []byte
+	err   error
+	reads int
+}
+
+func (s *testEventLogSource) ReadFrom(offset int64) ([]byte, error) {
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.data[offset:], nil
+}
+
+// createTestEvent creates a crypto agile event log entry with a SHA256 digest
+func createTestEvent(pcr uint32, digest byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, pcr)
+	binary.Write(buf, binary.LittleEndian, uint32(0x0d)) // EV_IPL
+	binary.Write(buf, binary.LittleEndian, uint32(1))
+	binary.Write(buf, binary.LittleEndian, uint16(0x000b))
+	buf.Write(bytes.Repeat([]byte{digest}, 32))
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	return buf.Bytes()
+}
+
+func TestEventLog(t *testing.T) {
+
+	source := &testEventLogSource{data: BinaryBiosMeasurements}
+	l := newEventLog(source)
+
+	raw, events, err := l.get()
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if !bytes.Equal(raw, BinaryBiosMeasurements) || len(events) == 0 {
+		t.Fatalf("get() returned %v bytes and %v events", len(raw), len(events))
+	}
+	numEvents := len(events)
+
+	// An unchanged event log must be served from the cache
+	_, cached, err := l.get()
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if &cached[0] != &events[0] {
+		t.Errorf("get() re-parsed unchanged event log")
+	}
+
+	// A grown event log must be re-parsed
+	source.data = append(append([]byte{}, BinaryBiosMeasurements...), createTestEvent(8, 0xaa)...)
+	raw, events, err = l.get()
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if len(raw) != len(source.data) || len(events) <= numEvents {
+		t.Errorf("get() returned %v bytes and %v events after runtime event", len(raw), len(events))
+	}
+	if l.status() != nil {
+		t.Errorf("status() = %v, want nil", l.status())
+	}
+
+	// Errors must be reported in the status
+	source.err = ErrEventLogUnavailable
+	if _, _, err := l.get(); !errors.Is(err, ErrEventLogUnavailable) {
+		t.Errorf("get() error = %v, want %v", err, ErrEventLogUnavailable)
+	}
+	if !errors.Is(l.status(), ErrEventLogUnavailable) {
+		t.Errorf("status() = %v, want %v", l.status(), ErrEventLogUnavailable)
+	}
+}
+
+func TestFileEventLog(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, "security", "tpm0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(dir, "security", "tpm0", "binary_bios_measurements")
+	if err := os.WriteFile(file, BinaryBiosMeasurements, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		offset  int64
+		want    []byte
+		wantErr error
+	}{
+		{"Full", file, 0, BinaryBiosMeasurements, nil},
+		{"Offset", file, 16, BinaryBiosMeasurements[16:], nil},
+		{"End", file, int64(len(BinaryBiosMeasurements)), []byte{}, nil},
+		{"No TPM Log", path.Join(dir, "security", "tpm1", "binary_bios_measurements"), 0, nil,
+			ErrEventLogUnavailable},
+		{"No Securityfs", path.Join(dir, "empty", "tpm0", "binary_bios_measurements"), 0, nil,
+			ErrEventLogUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FileEventLog(tt.file).ReadFrom(tt.offset)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadFrom() error = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ReadFrom() returned %v bytes, want %v", len(got), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	nvMagic      = "CMC1"
+	nvHeaderSize = 4 + 4 + 2 + sha256.Size
+
+	// Maximum size of a single NV index. Larger data is spread over
+	// consecutive indices
+	nvChunkSize = 1024
+	// Maximum number of consecutive indices used for storing the data
+	nvMaxIndices = 16
+
+	// Owner hierarchy NV index range, excluding the TCG reserved range
+	// for EK certificates and templates (TCG Handle Registry)
+	nvIndexFirst = tpmutil.Handle(0x01000000)
+	nvIndexLast  = tpmutil.Handle(0x01BFFFFF)
+
+	nvAttributes = tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrNoDA
+)
+
+var (
+	// ErrNvIndexAttributes is returned if a configured NV index already exists
+	// with attributes differing from the attributes required by the driver
+	ErrNvIndexAttributes = errors.New("NV index exists with wrong attributes")
+
+	// ErrNvEmpty is returned if the configured NV indices contain no credentials
+	ErrNvEmpty = errors.New("no credentials stored in NV indices")
+)
+
+// nvCredentials is the provisioning state stored in the TPM NV indices. The
+// AK and IK blobs are encrypted by the SRK, the CA certificates are shared
+// by the AK and IK certificate chains
+type nvCredentials struct {
+	AkCert      []byte    `cbor:"0,keyasint"`
+	IkCert      []byte    `cbor:"1,keyasint"`
+	CaCerts     [][]byte  `cbor:"2,keyasint"`
+	Ak          []byte    `cbor:"3,keyasint"`
+	Ik          []byte    `cbor:"4,keyasint"`
+	Provisioned time.Time `cbor:"5,keyasint"`
+}
+
+// ParseNvIndex parses the base NV index in hexadecimal or decimal notation,
+// e.g. "0x01500000". An empty string returns zero, which means that NV storage
+// is not used
+func ParseNvIndex(s string) (tpmutil.Handle, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse NV index %v: %w", s, err)
+	}
+	h := tpmutil.Handle(v)
+	if h < nvIndexFirst || h+nvMaxIndices-1 > nvIndexLast {
+		return 0, fmt.Errorf("NV index %v and the following %v indices are not in the range 0x%x-0x%x",
+			s, nvMaxIndices-1, uint32(nvIndexFirst), uint32(nvIndexLast))
+	}
+	return h, nil
+}
+
+// newNvCredentials creates the NV provisioning state from the keys and chains
+func newNvCredentials(akBlob, ikBlob []byte, akchain, ikchain []*x509.Certificate,
+) (*nvCredentials, error) {
+	if len(akchain) == 0 || len(ikchain) == 0 {
+		return nil, errors.New("certificate chains are empty")
+	}
+	if len(akchain) != len(ikchain) {
+		return nil, errors.New("AK and IK certificate chains have different CAs")
+	}
+	creds := &nvCredentials{
+		AkCert:      akchain[0].Raw,
+		IkCert:      ikchain[0].Raw,
+		Ak:          akBlob,
+		Ik:          ikBlob,
+		Provisioned: time.Now().UTC(),
+	}
+	for i := 1; i < len(akchain); i++ {
+		if !bytes.Equal(akchain[i].Raw, ikchain[i].Raw) {
+			return nil, errors.New("AK and IK certificate chains have different CAs")
+		}
+		creds.CaCerts = append(creds.CaCerts, akchain[i].Raw)
+	}
+	return creds, nil
+}
+
+// chains returns the AK and IK certificate chains of the stored credentials
+func (c *nvCredentials) chains() ([]*x509.Certificate, []*x509.Certificate, error) {
+	akCert, err := x509.ParseCertificate(c.AkCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse AK certificate: %w", err)
+	}
+	ikCert, err := x509.ParseCertificate(c.IkCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IK certificate: %w", err)
+	}
+	akchain := []*x509.Certificate{akCert}
+	ikchain := []*x509.Certificate{ikCert}
+	for _, der := range c.CaCerts {
+		ca, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		akchain = append(akchain, ca)
+		ikchain = append(ikchain, ca)
+	}
+	return akchain, ikchain, nil
+}
+
+// encodeNv prepends the header containing magic, length, number of used indices
+// and the SHA256 of the payload, to detect incomplete writes
+func encodeNv(payload []byte) ([]byte, error) {
+	size := nvHeaderSize + len(payload)
+	count := (size + nvChunkSize - 1) / nvChunkSize
+	if count > nvMaxIndices {
+		return nil, fmt.Errorf("data size %v exceeds maximum NV storage size %v",
+			size, nvMaxIndices*nvChunkSize)
+	}
+	digest := sha256.Sum256(payload)
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, nvMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(count))
+	buf = append(buf, digest[:]...)
+	buf = append(buf, payload...)
+
+	return buf, nil
+}
+
+// decodeNvHeader returns the payload length and the number of used indices
+func decodeNvHeader(data []byte) (int, int, error) {
+	if len(data) < nvHeaderSize || string(data[:4]) != nvMagic {
+		return 0, 0, ErrNvEmpty
+	}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	count := int(binary.BigEndian.Uint16(data[8:10]))
+	if count == 0 || count > nvMaxIndices ||
+		(nvHeaderSize+length+nvChunkSize-1)/nvChunkSize != count {
+		return 0, 0, fmt.Errorf("invalid NV header (length %v, indices %v)", length, count)
+	}
+	return length, count, nil
+}
+
+// decodeNv verifies the header and returns the payload
+func decodeNv(data []byte) ([]byte, error) {
+	length, _, err := decodeNvHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < nvHeaderSize+length {
+		return nil, fmt.Errorf("NV data truncated (%v of %v bytes)", len(data)-nvHeaderSize, length)
+	}
+	payload := data[nvHeaderSize : nvHeaderSize+length]
+	digest := sha256.Sum256(payload)
+	if !bytes.Equal(digest[:], data[10:nvHeaderSize]) {
+		return nil, errors.New("NV data digest mismatch")
+	}
+	return payload, nil
+}
+
+// loadNvKeys loads the AK and IK from the NV indices starting at base and
+// returns the stored certificate chains
+func loadNvKeys(base tpmutil.Handle) ([]*x509.Certificate, []*x509.Certificate, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Debugf("Loading TPM credentials from NV index 0x%x..", uint32(base))
+
+	creds, err := loadNvCredentials(rwc, base)
+	if err != nil {
+		return nil, nil, err
+	}
+	akchain, ikchain, err := creds.chains()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ak, err = TPM.LoadAK(creds.Ak)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadAK failed: %w", err)
+	}
+	ik, err = TPM.LoadKey(creds.Ik)
+	if err != nil {
+		closeKeys()
+		return nil, nil, fmt.Errorf("failed to load key: %w", err)
+	}
+
+	log.Debugf("Loaded credentials provisioned at %v", creds.Provisioned)
+
+	return akchain, ikchain, nil
+}
+
+// saveNvKeys stores the current AK and IK together with the certificate chains
+// in the NV indices starting at base
+func saveNvKeys(base tpmutil.Handle, akchain, ikchain []*x509.Certificate, redefine bool) error {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	ikBytes, err := ik.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal IK: %w", err)
+	}
+	creds, err := newNvCredentials(akBytes, ikBytes, akchain, ikchain)
+	if err != nil {
+		return err
+	}
+
+	return saveNvCredentials(rwc, base, creds, redefine)
+}
+
+// saveNvCredentials stores the credentials in the NV indices starting at base
+func saveNvCredentials(rwc io.ReadWriter, base tpmutil.Handle, creds *nvCredentials, redefine bool) error {
+	payload, err := cbor.Marshal(creds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal NV credentials: %w", err)
+	}
+	err = writeNv(rwc, base, payload, redefine)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Stored %v bytes of credentials in NV indices starting at 0x%x", len(payload),
+		uint32(base))
+	return nil
+}
+
+// loadNvCredentials reads the credentials from the NV indices starting at base
+func loadNvCredentials(rwc io.ReadWriter, base tpmutil.Handle) (*nvCredentials, error) {
+	payload, err := readNv(rwc, base)
+	if err != nil {
+		return nil, err
+	}
+	creds := new(nvCredentials)
+	err = cbor.Unmarshal(payload, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal NV credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// writeNv writes the data to consecutive NV indices starting at base. Existing
+// indices with the wrong size are re-defined. Existing indices with the wrong
+// attributes are only re-defined if redefine is set, otherwise
+// ErrNvIndexAttributes is returned. Indices used by a previous larger write
+// are undefined
+func writeNv(rwc io.ReadWriter, base tpmutil.Handle, payload []byte, redefine bool) error {
+
+	data, err := encodeNv(payload)
+	if err != nil {
+		return err
+	}
+
+	// Check all indices before writing anything
+	count := (len(data) + nvChunkSize - 1) / nvChunkSize
+	for i := 0; i < count; i++ {
+		err = checkNvIndex(rwc, base+tpmutil.Handle(i), redefine)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Determine the number of indices used by the previous write
+	oldCount := 0
+	if hdr, err := tpm2.NVReadEx(rwc, base, tpm2.HandleOwner, authValues.owner, 0); err == nil {
+		if _, c, err := decodeNvHeader(hdr); err == nil {
+			oldCount = c
+		}
+	}
+
+	writeSize, err := getNvBufferSize(rwc)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		index := base + tpmutil.Handle(i)
+		end := (i + 1) * nvChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*nvChunkSize : end]
+
+		err = defineNvIndex(rwc, index, len(chunk))
+		if err != nil {
+			return err
+		}
+		for off := 0; off < len(chunk); off += writeSize {
+			n := writeSize
+			if off+n > len(chunk) {
+				n = len(chunk) - off
+			}
+			err = tpm2.NVWrite(rwc, tpm2.HandleOwner, index, authValues.owner, chunk[off:off+n],
+				uint16(off))
+			if err != nil {
+				return fmt.Errorf("failed to write NV index 0x%x: %w", uint32(index),
+					authError(err, "owner hierarchy"))
+			}
+		}
+	}
+
+	for i := count; i < oldCount; i++ {
+		index := base + tpmutil.Handle(i)
+		log.Tracef("Undefining unused NV index 0x%x", uint32(index))
+		err = tpm2.NVUndefineSpace(rwc, authValues.owner, tpm2.HandleOwner, index)
+		if err != nil {
+			log.Warnf("Failed to undefine unused NV index 0x%x: %v", uint32(index), err)
+		}
+	}
+
+	return nil
+}
+
+// readNv reads and verifies the data stored in the NV indices starting at base
+func readNv(rwc io.ReadWriter, base tpmutil.Handle) ([]byte, error) {
+
+	pub, err := tpm2.NVReadPublic(rwc, base)
+	if err != nil {
+		return nil, ErrNvEmpty
+	}
+	if pub.Attributes&^tpm2.AttrWritten != nvAttributes {
+		return nil, fmt.Errorf("NV index 0x%x: %w (0x%x)", uint32(base), ErrNvIndexAttributes,
+			uint32(pub.Attributes))
+	}
+	if pub.Attributes&tpm2.AttrWritten == 0 {
+		return nil, ErrNvEmpty
+	}
+
+	data, err := tpm2.NVReadEx(rwc, base, tpm2.HandleOwner, authValues.owner, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NV index 0x%x: %w", uint32(base),
+			authError(err, "owner hierarchy"))
+	}
+	_, count, err := decodeNvHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < count; i++ {
+		index := base + tpmutil.Handle(i)
+		chunk, err := tpm2.NVReadEx(rwc, index, tpm2.HandleOwner, authValues.owner, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NV index 0x%x: %w", uint32(index),
+				authError(err, "owner hierarchy"))
+		}
+		data = append(data, chunk...)
+	}
+
+	return decodeNv(data)
+}
+
+// checkNvIndex checks whether an existing NV index has the required attributes.
+// If not, the index is undefined if redefine is set
+func checkNvIndex(rwc io.ReadWriter, index tpmutil.Handle, redefine bool) error {
+	pub, err := tpm2.NVReadPublic(rwc, index)
+	if err != nil {
+		// Index does not exist
+		return nil
+	}
+	if pub.Attributes&^tpm2.AttrWritten == nvAttributes {
+		return nil
+	}
+	if !redefine {
+		return fmt.Errorf("NV index 0x%x: %w (0x%x)", uint32(index), ErrNvIndexAttributes,
+			uint32(pub.Attributes))
+	}
+	log.Warnf("Undefining NV index 0x%x with wrong attributes 0x%x", uint32(index),
+		uint32(pub.Attributes))
+	err = tpm2.NVUndefineSpace(rwc, authValues.owner, tpm2.HandleOwner, index)
+	if err != nil {
+		return fmt.Errorf("failed to undefine NV index 0x%x: %w", uint32(index),
+			authError(err, "owner hierarchy"))
+	}
+	return nil
+}
+
+// defineNvIndex defines the NV index with the specified size. An existing index
+// with a different size is re-defined
+func defineNvIndex(rwc io.ReadWriter, index tpmutil.Handle, size int) error {
+	pub, err := tpm2.NVReadPublic(rwc, index)
+	if err == nil {
+		if int(pub.DataSize) == size {
+			return nil
+		}
+		err = tpm2.NVUndefineSpace(rwc, authValues.owner, tpm2.HandleOwner, index)
+		if err != nil {
+			return fmt.Errorf("failed to undefine NV index 0x%x: %w", uint32(index),
+				authError(err, "owner hierarchy"))
+		}
+	}
+	nvPub := tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: nvAttributes,
+		DataSize:   uint16(size),
+	}
+	err = tpm2.NVDefineSpaceEx(rwc, tpm2.HandleOwner, "", nvPub, passwordAuth(authValues.owner))
+	if err != nil {
+		return fmt.Errorf("failed to define NV index 0x%x: %w", uint32(index),
+			authError(err, "owner hierarchy"))
+	}
+	return nil
+}
+
+// getNvBufferSize returns the maximum size of a single NV write
+func getNvBufferSize(rwc io.ReadWriter) (int, error) {
+	caps, _, err := tpm2.GetCapability(rwc, tpm2.CapabilityTPMProperties, 1,
+		uint32(tpm2.NVMaxBufferSize))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get NV buffer size: %w", err)
+	}
+	if len(caps) != 1 {
+		return 0, errors.New("failed to get NV buffer size")
+	}
+	prop, ok := caps[0].(tpm2.TaggedProperty)
+	if !ok || prop.Value == 0 {
+		return 0, fmt.Errorf("unexpected NV buffer size capability %v", caps[0])
+	}
+	return int(prop.Value), nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestParseNvIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    tpmutil.Handle
+		wantErr bool
+	}{
+		{"Empty", "", 0, false},
+		{"Hex", "0x01500000", 0x01500000, false},
+		{"Decimal", "22020096", 0x01500000, false},
+		{"EK Certificate", "0x01C00002", 0, true},
+		{"Range End", "0x01BFFFFA", 0, true},
+		{"Persistent", "0x81000002", 0, true},
+		{"Invalid", "index", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNvIndex(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseNvIndex() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseNvIndex() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeNv(t *testing.T) {
+	payload := make([]byte, 3000)
+	rand.Read(payload)
+
+	data, err := encodeNv(payload)
+	if err != nil {
+		t.Fatalf("encodeNv() error = %v", err)
+	}
+	_, count, err := decodeNvHeader(data)
+	if err != nil {
+		t.Fatalf("decodeNvHeader() error = %v", err)
+	}
+	if count != 3 {
+		t.Errorf("decodeNvHeader() count = %v, want 3", count)
+	}
+
+	got, err := decodeNv(data)
+	if err != nil {
+		t.Fatalf("decodeNv() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("decodeNv() returned different payload")
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := decodeNv(corrupt); err == nil {
+		t.Errorf("decodeNv() of corrupted data succeeded")
+	}
+	if _, err := decodeNv(data[:2000]); err == nil {
+		t.Errorf("decodeNv() of truncated data succeeded")
+	}
+	if _, err := decodeNv(make([]byte, 1024)); !errors.Is(err, ErrNvEmpty) {
+		t.Errorf("decodeNv() of empty data error = %v, want %v", err, ErrNvEmpty)
+	}
+	if _, err := encodeNv(make([]byte, nvMaxIndices*nvChunkSize)); err == nil {
+		t.Errorf("encodeNv() of oversized data succeeded")
+	}
+}
+
+// TestNvStorage requires a TPM simulator, see TestPersistKey
+func TestNvStorage(t *testing.T) {
+
+	const base = tpmutil.Handle(0x01500100)
+
+	rwc := openSimulator(t)
+	defer rwc.Close()
+	for i := 0; i < nvMaxIndices; i++ {
+		tpm2.NVUndefineSpace(rwc, "", tpm2.HandleOwner, base+tpmutil.Handle(i))
+	}
+
+	if _, err := readNv(rwc, base); !errors.Is(err, ErrNvEmpty) {
+		t.Fatalf("readNv() of undefined index error = %v, want %v", err, ErrNvEmpty)
+	}
+
+	large := make([]byte, 5000)
+	rand.Read(large)
+	err := writeNv(rwc, base, large, false)
+	if err != nil {
+		t.Fatalf("writeNv() error = %v", err)
+	}
+	got, err := readNv(rwc, base)
+	if err != nil {
+		t.Fatalf("readNv() error = %v", err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Fatalf("readNv() returned different data")
+	}
+
+	// Overwriting with smaller data must undefine the unused indices
+	small := []byte("small provisioning state")
+	err = writeNv(rwc, base, small, false)
+	if err != nil {
+		t.Fatalf("writeNv() of smaller data error = %v", err)
+	}
+	got, err = readNv(rwc, base)
+	if err != nil {
+		t.Fatalf("readNv() error = %v", err)
+	}
+	if !bytes.Equal(got, small) {
+		t.Fatalf("readNv() returned different data")
+	}
+	if _, err := tpm2.NVReadPublic(rwc, base+1); err == nil {
+		t.Errorf("unused NV index 0x%x still defined", uint32(base+1))
+	}
+
+	// An existing index with wrong attributes must only be re-defined if requested
+	tpm2.NVUndefineSpace(rwc, "", tpm2.HandleOwner, base)
+	err = tpm2.NVDefineSpace(rwc, tpm2.HandleOwner, base, "", "", nil,
+		tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead|tpm2.AttrAuthRead, 64)
+	if err != nil {
+		t.Fatalf("failed to define NV index: %v", err)
+	}
+	if _, err := readNv(rwc, base); !errors.Is(err, ErrNvIndexAttributes) {
+		t.Errorf("readNv() error = %v, want %v", err, ErrNvIndexAttributes)
+	}
+	err = writeNv(rwc, base, small, false)
+	if !errors.Is(err, ErrNvIndexAttributes) {
+		t.Fatalf("writeNv() error = %v, want %v", err, ErrNvIndexAttributes)
+	}
+	err = writeNv(rwc, base, small, true)
+	if err != nil {
+		t.Fatalf("writeNv() with redefine error = %v", err)
+	}
+	got, err = readNv(rwc, base)
+	if err != nil {
+		t.Fatalf("readNv() error = %v", err)
+	}
+	if !bytes.Equal(got, small) {
+		t.Fatalf("readNv() returned different data")
+	}
+
+	tpm2.NVUndefineSpace(rwc, "", tpm2.HandleOwner, base)
+}
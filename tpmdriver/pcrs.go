@@ -0,0 +1,216 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"golang.org/x/exp/maps"
+)
+
+const numPcrs = 24
+
+// PcrBank is a PCR bank together with the PCRs of this bank to be quoted
+type PcrBank struct {
+	Alg  attest.HashAlg
+	Pcrs []int
+}
+
+// pcrBanks contains the PCR banks supported for quoting
+var pcrBanks = map[string]attest.HashAlg{
+	"sha1":   attest.HashSHA1,
+	"sha256": attest.HashSHA256,
+}
+
+func (b PcrBank) String() string {
+	for name, alg := range pcrBanks {
+		if alg == b.Alg {
+			return name
+		}
+	}
+	return fmt.Sprintf("alg 0x%x", uint8(b.Alg))
+}
+
+// parsePcrSelection parses the configured PCR selection. The SHA256 bank is
+// always ordered first, the IMA and container PCRs are added to the SHA256
+// bank if the respective measurements are enabled
+func parsePcrSelection(selection map[string][]int, imaPcr, ctrPcr *int) ([]PcrBank, error) {
+
+	names := maps.Keys(selection)
+	sort.Slice(names, func(i, j int) bool {
+		if strings.EqualFold(names[i], "sha256") {
+			return true
+		}
+		if strings.EqualFold(names[j], "sha256") {
+			return false
+		}
+		return names[i] < names[j]
+	})
+
+	banks := make([]PcrBank, 0, len(names))
+	for _, name := range names {
+		alg, ok := pcrBanks[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported PCR bank %v (supported: %v)", name,
+				strings.Join(maps.Keys(pcrBanks), ","))
+		}
+
+		// Copy the configured PCRs, so that appending does not modify the config
+		pcrs := append([]int(nil), selection[name]...)
+		if alg == attest.HashSHA256 {
+			if imaPcr != nil {
+				pcrs = append(pcrs, *imaPcr)
+			}
+			if ctrPcr != nil {
+				pcrs = append(pcrs, *ctrPcr)
+			}
+		}
+
+		unique := make(map[int]bool)
+		for _, pcr := range pcrs {
+			if pcr < 0 || pcr >= numPcrs {
+				return nil, fmt.Errorf("invalid PCR %v in bank %v", pcr, name)
+			}
+			unique[pcr] = true
+		}
+		if len(unique) == 0 {
+			return nil, fmt.Errorf("no PCRs selected for bank %v", name)
+		}
+		pcrs = maps.Keys(unique)
+		sort.Ints(pcrs)
+
+		banks = append(banks, PcrBank{Alg: alg, Pcrs: pcrs})
+	}
+
+	if len(banks) > 0 && banks[0].Alg != attest.HashSHA256 && (imaPcr != nil || ctrPcr != nil) {
+		log.Warn("IMA or container measurements require the sha256 PCR bank to be selected")
+	}
+
+	return banks, nil
+}
+
+// SelectPcrBanks returns the PCR banks of the configured PCR selection for
+// drivers quoting with an AK provisioned by the platform, e.g., cloud vTPMs.
+// Without PCR selection, the default PCRs of the SHA256 bank are quoted. The
+// banks are validated against the TPM
+func SelectPcrBanks(rwc io.ReadWriter, selection map[string][]int, defaultPcrs []int,
+) ([]PcrBank, error) {
+
+	banks := []PcrBank{{Alg: attest.HashSHA256, Pcrs: defaultPcrs}}
+	if len(selection) > 0 {
+		var err error
+		banks, err = parsePcrSelection(selection, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR selection: %w", err)
+		}
+	}
+
+	err := validatePcrBanks(rwc, banks)
+	if err != nil {
+		return nil, err
+	}
+
+	return banks, nil
+}
+
+// readPcrs reads the PCRs of the bank one by one, as the TPM returns at most
+// 8 PCRs per command
+func readPcrs(rwc io.ReadWriter, bank PcrBank) (map[int][]byte, error) {
+	values := make(map[int][]byte, len(bank.Pcrs))
+	for _, pcr := range bank.Pcrs {
+		v, err := tpm2.ReadPCRs(rwc, tpm2.PCRSelection{Hash: tpm2.Algorithm(bank.Alg),
+			PCRs: []int{pcr}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PCR%v of bank %v: %w", pcr, bank, err)
+		}
+		values[pcr] = v[pcr]
+	}
+	return values, nil
+}
+
+// validatePcrBanks checks that the selected PCR banks are allocated on the TPM
+// and contain the selected PCRs
+func validatePcrBanks(rwc io.ReadWriter, banks []PcrBank) error {
+
+	caps, _, err := tpm2.GetCapability(rwc, tpm2.CapabilityPCRs, 1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get PCR capability: %w", err)
+	}
+
+	allocated := make(map[tpm2.Algorithm]map[int]bool)
+	for _, c := range caps {
+		sel, ok := c.(tpm2.PCRSelection)
+		if !ok {
+			return fmt.Errorf("unexpected PCR capability type %T", c)
+		}
+		if len(sel.PCRs) == 0 {
+			continue
+		}
+		allocated[sel.Hash] = make(map[int]bool)
+		for _, pcr := range sel.PCRs {
+			allocated[sel.Hash][pcr] = true
+		}
+	}
+
+	for _, bank := range banks {
+		pcrs, ok := allocated[tpm2.Algorithm(bank.Alg)]
+		if !ok {
+			available := make([]string, 0)
+			for alg := range allocated {
+				available = append(available, PcrBank{Alg: attest.HashAlg(alg)}.String())
+			}
+			sort.Strings(available)
+			return fmt.Errorf("PCR bank %v not allocated on TPM (available: %v)", bank,
+				strings.Join(available, ","))
+		}
+		for _, pcr := range bank.Pcrs {
+			if !pcrs[pcr] {
+				return fmt.Errorf("PCR%v not allocated in TPM PCR bank %v", pcr, bank)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkQuoteSelection checks that the quote covers exactly the requested PCRs
+// of the requested bank, so that the report reflects exactly what was quoted
+func checkQuoteSelection(quote []byte, bank PcrBank) error {
+	attestData, err := tpm2.DecodeAttestationData(quote)
+	if err != nil {
+		return fmt.Errorf("failed to decode quote: %w", err)
+	}
+	if attestData.AttestedQuoteInfo == nil {
+		return fmt.Errorf("attestation data does not contain quote info")
+	}
+	sel := attestData.AttestedQuoteInfo.PCRSelection
+	if sel.Hash != tpm2.Algorithm(bank.Alg) {
+		return fmt.Errorf("quoted bank %v does not match requested bank %v",
+			PcrBank{Alg: attest.HashAlg(sel.Hash)}, bank)
+	}
+	quoted := make([]int, len(sel.PCRs))
+	copy(quoted, sel.PCRs)
+	sort.Ints(quoted)
+	if fmt.Sprint(quoted) != fmt.Sprint(bank.Pcrs) {
+		return fmt.Errorf("quoted PCRs %v do not match requested PCRs %v", quoted, bank.Pcrs)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+)
+
+func Test_parsePcrSelection(t *testing.T) {
+	ima := 10
+	tests := []struct {
+		name      string
+		selection map[string][]int
+		imaPcr    *int
+		want      []PcrBank
+		wantErr   bool
+	}{
+		{
+			name:      "Single bank",
+			selection: map[string][]int{"sha256": {9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 11, 14}},
+			want: []PcrBank{
+				{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 14}},
+			},
+		},
+		{
+			name:      "Add IMA PCR",
+			selection: map[string][]int{"SHA256": {0, 1}},
+			imaPcr:    &ima,
+			want: []PcrBank{
+				{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 10}},
+			},
+		},
+		{
+			name:      "Multiple banks",
+			selection: map[string][]int{"sha1": {0, 0, 7}, "sha256": {0, 7}},
+			imaPcr:    &ima,
+			want: []PcrBank{
+				{Alg: attest.HashSHA256, Pcrs: []int{0, 7, 10}},
+				{Alg: attest.HashSHA1, Pcrs: []int{0, 7}},
+			},
+		},
+		{
+			name:      "Unsupported bank",
+			selection: map[string][]int{"sm3": {0}},
+			wantErr:   true,
+		},
+		{
+			name:      "Invalid PCR",
+			selection: map[string][]int{"sha256": {24}},
+			wantErr:   true,
+		},
+		{
+			name:      "Empty bank",
+			selection: map[string][]int{"sha1": {}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePcrSelection(tt.selection, tt.imaPcr, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePcrSelection() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePcrSelection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parsePcrSelectionKeepsConfig(t *testing.T) {
+	// The configured slice has spare capacity, which must not be written to
+	configured := make([]int, 2, 4)
+	configured[0], configured[1] = 0, 7
+	selection := map[string][]int{"sha256": configured}
+	ima, ctr := 10, 11
+
+	for i := 0; i < 2; i++ {
+		got, err := parsePcrSelection(selection, &ima, &ctr)
+		if err != nil {
+			t.Fatalf("parsePcrSelection() error = %v", err)
+		}
+		if want := []int{0, 7, 10, 11}; !reflect.DeepEqual(got[0].Pcrs, want) {
+			t.Errorf("parsePcrSelection() = %v, want %v", got[0].Pcrs, want)
+		}
+	}
+	if spare := configured[:4]; !reflect.DeepEqual(spare, []int{0, 7, 0, 0}) {
+		t.Errorf("configured PCRs modified to %v", spare)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	srkHandle = tpmutil.Handle(0x81000001)
+	ekHandle  = tpmutil.Handle(0x81010001)
+
+	// Owner hierarchy persistent handle range (TCG Handle Registry)
+	persistentFirst = tpmutil.Handle(0x81000000)
+	persistentLast  = tpmutil.Handle(0x817FFFFF)
+)
+
+// ErrHandleOccupied is returned if a configured persistent handle is already
+// in use by an object which is not the expected key
+var ErrHandleOccupied = errors.New("persistent handle occupied by a different object")
+
+// keyBlob contains the relevant fields of the go-attestation opaque key blob
+type keyBlob struct {
+	Public []byte `json:"Public"`
+	Blob   []byte `json:"KeyBlob"`
+}
+
+// ParseHandle parses a persistent handle in hexadecimal or decimal notation,
+// e.g. "0x81000002". An empty string returns the zero handle, which means
+// that the key shall not be persisted
+func ParseHandle(s string) (tpmutil.Handle, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse handle %v: %w", s, err)
+	}
+	h := tpmutil.Handle(v)
+	if h < persistentFirst || h > persistentLast {
+		return 0, fmt.Errorf("handle %v is not in the owner persistent range 0x%x-0x%x",
+			s, uint32(persistentFirst), uint32(persistentLast))
+	}
+	if h == srkHandle || h == ekHandle {
+		return 0, fmt.Errorf("handle %v is reserved for the SRK/EK", s)
+	}
+	return h, nil
+}
+
+// persistKey loads the key contained in the go-attestation blob under the SRK
+// and makes it persistent at the specified handle. If the handle already contains
+// the same key, nothing is done. If the handle is occupied by one of the stale
+// keys of a previous provisioning, the stale key is evicted. If the handle is
+// occupied by a different object, the object is evicted if evict is set,
+// otherwise ErrHandleOccupied is returned
+func persistKey(rwc io.ReadWriter, opaqueBlob []byte, handle tpmutil.Handle, evict bool,
+	stale []crypto.PublicKey,
+) error {
+
+	var kb keyBlob
+	err := json.Unmarshal(opaqueBlob, &kb)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal key blob: %w", err)
+	}
+	tpmPub, err := tpm2.DecodePublic(kb.Public)
+	if err != nil {
+		return fmt.Errorf("failed to decode public area: %w", err)
+	}
+	pub, err := tpmPub.Key()
+	if err != nil {
+		return fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	persistedPub, err := readPersistentKey(rwc, handle)
+	if err == nil {
+		if publicKeyEqual(pub, persistedPub) {
+			log.Debugf("Key already persisted at handle 0x%x", uint32(handle))
+			return nil
+		}
+		if containsPublicKey(stale, persistedPub) {
+			log.Debugf("Evicting stale key at persistent handle 0x%x", uint32(handle))
+		} else if evict {
+			log.Warnf("Evicting object at persistent handle 0x%x", uint32(handle))
+		} else {
+			return fmt.Errorf("failed to persist key at 0x%x: %w", uint32(handle), ErrHandleOccupied)
+		}
+		err = tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, handle, handle)
+		if err != nil {
+			return fmt.Errorf("failed to evict object at 0x%x: %w", uint32(handle),
+				authError(err, "owner hierarchy"))
+		}
+	}
+
+	hnd, _, err := tpm2.Load(rwc, srkHandle, "", kb.Public, kb.Blob)
+	if err != nil {
+		return fmt.Errorf("failed to load key: %w", err)
+	}
+	defer tpm2.FlushContext(rwc, hnd)
+
+	err = tpm2.EvictControl(rwc, authValues.owner, tpm2.HandleOwner, hnd, handle)
+	if err != nil {
+		return fmt.Errorf("failed to persist key at 0x%x: %w", uint32(handle),
+			authError(err, "owner hierarchy"))
+	}
+
+	log.Debugf("Persisted key at handle 0x%x", uint32(handle))
+
+	return nil
+}
+
+// readPersistentKey reads the public key of the object at the persistent handle
+func readPersistentKey(rwc io.ReadWriter, handle tpmutil.Handle) (crypto.PublicKey, error) {
+	tpmPub, _, _, err := tpm2.ReadPublic(rwc, handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public area of 0x%x: %w", uint32(handle), err)
+	}
+	pub, err := tpmPub.Key()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key of 0x%x: %w", uint32(handle), err)
+	}
+	return pub, nil
+}
+
+// checkPersistentHandle checks that a new key can be persisted at the handle,
+// i.e., that the handle is empty, contains one of the stale keys or evict is set
+func checkPersistentHandle(rwc io.ReadWriter, handle tpmutil.Handle, evict bool,
+	stale []crypto.PublicKey,
+) error {
+	persistedPub, err := readPersistentKey(rwc, handle)
+	if err != nil || evict || containsPublicKey(stale, persistedPub) {
+		return nil
+	}
+	return fmt.Errorf("failed to use handle 0x%x: %w", uint32(handle), ErrHandleOccupied)
+}
+
+// validatePersistentKey checks that the key at the persistent handle matches
+// the public key of the certificate
+func validatePersistentKey(rwc io.ReadWriter, handle tpmutil.Handle, cert *x509.Certificate) error {
+	pub, err := readPersistentKey(rwc, handle)
+	if err != nil {
+		return err
+	}
+	if !publicKeyEqual(pub, cert.PublicKey) {
+		return fmt.Errorf("key at 0x%x does not match certificate %v", uint32(handle),
+			cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// loadPersistentKey returns the key at the persistent handle, which must match
+// the public key, so that quotes and signatures are performed with the persisted
+// key instead of loading the key blob
+func loadPersistentKey(t transport.TPM, handle tpmutil.Handle, pub crypto.PublicKey,
+) (*sessionKey, error) {
+	rsp, err := tpmdirect.ReadPublic{ObjectHandle: tpmdirect.TPMHandle(handle)}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public area of 0x%x: %w", uint32(handle), err)
+	}
+	public, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public area of 0x%x: %w", uint32(handle), err)
+	}
+	persistedPub, err := publicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key of 0x%x: %w", uint32(handle), err)
+	}
+	if !publicKeyEqual(persistedPub, pub) {
+		return nil, fmt.Errorf("key at 0x%x does not match the loaded key", uint32(handle))
+	}
+	return &sessionKey{
+		handle:     tpmdirect.NamedHandle{Handle: tpmdirect.TPMHandle(handle), Name: rsp.Name},
+		public:     public,
+		pub:        persistedPub,
+		persistent: true,
+	}, nil
+}
+
+// persistentAkQuote performs a quote over the selected PCRs with the AK at the
+// persistent handle, which must match the loaded AK
+func persistentAkQuote(handle tpmutil.Handle, ak *attest.AK, nonce []byte, bank PcrBank,
+) (*Quote, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+	t := transport.FromReadWriter(rwc)
+
+	pub, err := akPublic(ak)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadPersistentKey(t, handle, pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use persisted AK: %w", err)
+	}
+
+	rsp, err := quotePcrs(t, tpmdirect.AuthHandle{Handle: key.handle.Handle, Name: key.handle.Name,
+		Auth: tpmdirect.PasswordAuth(nil)}, nonce, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quote{}
+	q.Quote.Version = attest.TPMVersion20
+	q.Quote.Quote = rsp.Quoted.Bytes()
+	q.Quote.Signature = tpmdirect.Marshal(rsp.Signature)
+
+	return q, nil
+}
+
+// QuoteHandle performs a quote over the PCRs of the bank with the AK at the
+// handle, which must match the public key, e.g., an AK provisioned by a cloud
+// provider into its vTPM. It returns the quote, the signature and the PCR
+// summary artifacts of the quoted PCRs
+func QuoteHandle(rwc io.ReadWriter, handle tpmutil.Handle, pub crypto.PublicKey, nonce []byte,
+	bank PcrBank,
+) ([]byte, []byte, []ar.Artifact, error) {
+
+	t := transport.FromReadWriter(rwc)
+	key, err := loadPersistentKey(t, handle, pub)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to use AK: %w", err)
+	}
+
+	rsp, err := quotePcrs(t, tpmdirect.AuthHandle{Handle: key.handle.Handle, Name: key.handle.Name,
+		Auth: tpmdirect.PasswordAuth(nil)}, nonce, bank)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	quote := rsp.Quoted.Bytes()
+	err = checkQuoteSelection(quote, bank)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid TPM quote: %w", err)
+	}
+
+	values, err := readPcrs(rwc, bank)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	artifacts := make([]ar.Artifact, 0, len(bank.Pcrs))
+	for _, pcr := range bank.Pcrs {
+		p := pcr
+		artifacts = append(artifacts, ar.Artifact{
+			Type:    "PCR Summary",
+			Pcr:     &p,
+			Summary: values[pcr],
+		})
+	}
+
+	return quote, tpmdirect.Marshal(rsp.Signature), artifacts, nil
+}
+
+// persistentSigner implements crypto.Signer for the IK at the persistent handle
+type persistentSigner struct {
+	tpm transport.TPM
+	key *sessionKey
+}
+
+// newPersistentSigner returns a signer for the IK at the persistent handle,
+// which must match the loaded IK
+func newPersistentSigner(handle tpmutil.Handle, ik *attest.Key) (*persistentSigner, error) {
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+	t := transport.FromReadWriter(rwc)
+	key, err := loadPersistentKey(t, handle, ik.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to use persisted IK: %w", err)
+	}
+	return &persistentSigner{tpm: t, key: key}, nil
+}
+
+func (s *persistentSigner) Public() crypto.PublicKey {
+	return s.key.pub
+}
+
+func (s *persistentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return signDigest(s.tpm, s.key, tpmdirect.PasswordAuth(nil), digest, opts)
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+	return k.Equal(b)
+}
+
+func containsPublicKey(keys []crypto.PublicKey, pub crypto.PublicKey) bool {
+	for _, k := range keys {
+		if publicKeyEqual(k, pub) {
+			return true
+		}
+	}
+	return false
+}
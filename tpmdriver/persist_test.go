@@ -0,0 +1,597 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+func TestParseHandle(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    tpmutil.Handle
+		wantErr bool
+	}{
+		{"Empty", "", 0, false},
+		{"Hex", "0x81000002", 0x81000002, false},
+		{"Decimal", "2164260866", 0x81000002, false},
+		{"SRK", "0x81000001", 0, true},
+		{"EK", "0x81010001", 0, true},
+		{"Transient", "0x80000000", 0, true},
+		{"Invalid", "handle", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHandle(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHandle() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseHandle() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicKeyEqual(t *testing.T) {
+	k1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	k2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if !publicKeyEqual(k1.Public(), &k1.PublicKey) {
+		t.Errorf("publicKeyEqual() = false for identical keys")
+	}
+	if publicKeyEqual(k1.Public(), k2.Public()) {
+		t.Errorf("publicKeyEqual() = true for different keys")
+	}
+	if publicKeyEqual(nil, k1.Public()) {
+		t.Errorf("publicKeyEqual() = true for nil key")
+	}
+}
+
+// TestPersistKey requires a TPM simulator such as swtpm started with a unix
+// socket, e.g. 'swtpm socket --tpm2 --server type=unixio,path=/tmp/swtpm.sock
+// --flags startup-clear', and TPM_SIMULATOR set to the socket path
+func TestPersistKey(t *testing.T) {
+
+	const handle = tpmutil.Handle(0x81000010)
+
+	rwc := openSimulator(t)
+	createSrk(t, rwc)
+	tpm2.EvictControl(rwc, "", tpm2.HandleOwner, handle, handle)
+
+	blob1 := createKeyBlob(t, rwc)
+	blob2 := createKeyBlob(t, rwc)
+
+	err := persistKey(rwc, blob1, handle, false, nil)
+	if err != nil {
+		t.Fatalf("persistKey() error = %v", err)
+	}
+
+	// Simulate a restart by re-opening the TPM
+	rwc.Close()
+	rwc = openSimulator(t)
+	defer rwc.Close()
+
+	err = persistKey(rwc, blob1, handle, false, nil)
+	if err != nil {
+		t.Fatalf("persistKey() of already persisted key error = %v", err)
+	}
+
+	err = persistKey(rwc, blob2, handle, false, nil)
+	if !errors.Is(err, ErrHandleOccupied) {
+		t.Fatalf("persistKey() error = %v, want %v", err, ErrHandleOccupied)
+	}
+
+	err = persistKey(rwc, blob2, handle, true, nil)
+	if err != nil {
+		t.Fatalf("persistKey() with eviction error = %v", err)
+	}
+
+	tpm2.EvictControl(rwc, "", tpm2.HandleOwner, handle, handle)
+}
+
+// TestLoadStoredKeys requires a TPM simulator and covers the restart of the
+// driver with missing, valid and corrupted stored keys
+func TestLoadStoredKeys(t *testing.T) {
+
+	const akHandle = tpmutil.Handle(0x81000011)
+	const ikHandle = tpmutil.Handle(0x81000012)
+
+	dir := t.TempDir()
+	rwc := openSimulator(t)
+	openTestTpm(t, rwc)
+	defer CloseTpm()
+	createSrk(t, rwc)
+	for _, h := range []tpmutil.Handle{akHandle, ikHandle} {
+		tpm2.EvictControl(rwc, "", tpm2.HandleOwner, h, h)
+		defer func(h tpmutil.Handle) {
+			tpm2.EvictControl(tpmConn, "", tpm2.HandleOwner, h, h)
+		}(h)
+	}
+
+	// Cold start
+	required, err := IsTpmProvisioningRequired(dir)
+	if err != nil || !required {
+		t.Fatalf("IsTpmProvisioningRequired() = %v, %v, want true", required, err)
+	}
+	if _, _, err := loadStoredKeys(dir); err == nil {
+		t.Fatalf("loadStoredKeys() succeeded without stored keys")
+	}
+
+	_, ak, ik, err = createKeys(TPM, "", "EC256")
+	if err != nil {
+		t.Fatalf("createKeys() error = %v", err)
+	}
+	akPub, err := akPublic(ak)
+	if err != nil {
+		t.Fatalf("akPublic() error = %v", err)
+	}
+	akchain := []*x509.Certificate{createTestCert(t, "Test AK", akPub)}
+	ikchain := []*x509.Certificate{createTestCert(t, "Test IK", ik.Public())}
+	if err := saveCerts(dir, akchain, ikchain); err != nil {
+		t.Fatalf("saveCerts() error = %v", err)
+	}
+	if err := saveKeys(dir, ak, ik); err != nil {
+		t.Fatalf("saveKeys() error = %v", err)
+	}
+	if err := persistKeys(akHandle, ikHandle, false, nil); err != nil {
+		t.Fatalf("persistKeys() error = %v", err)
+	}
+	closeKeys()
+
+	// Warm restart
+	CloseTpm()
+	openTestTpm(t, openSimulator(t))
+	gotAk, gotIk, err := loadStoredKeys(dir)
+	if err != nil {
+		t.Fatalf("loadStoredKeys() error = %v", err)
+	}
+	if err := validateKeys(gotAk, gotIk, akHandle, ikHandle); err != nil {
+		t.Fatalf("validateKeys() error = %v", err)
+	}
+	if !publicKeyEqual(ik.Public(), ikchain[0].PublicKey) {
+		t.Errorf("loaded IK does not match the enrolled certificate")
+	}
+
+	// Certificates of different keys must not be used
+	if err := validateKeys(gotIk, gotAk, 0, 0); err == nil {
+		t.Errorf("validateKeys() accepted swapped certificates")
+	}
+	closeKeys()
+
+	// Corrupted blobs are reported and no keys stay loaded
+	ikBytes, err := internal.LoadFile(path.Join(dir, ikFile))
+	if err != nil {
+		t.Fatalf("failed to read IK blob: %v", err)
+	}
+	var kb keyBlob
+	var fields map[string]interface{}
+	if err := json.Unmarshal(ikBytes, &kb); err != nil {
+		t.Fatalf("failed to unmarshal IK blob: %v", err)
+	}
+	if err := json.Unmarshal(ikBytes, &fields); err != nil {
+		t.Fatalf("failed to unmarshal IK blob: %v", err)
+	}
+	kb.Blob[len(kb.Blob)-1] ^= 0xff
+	fields["KeyBlob"] = kb.Blob
+	corruptedIk, _ := json.Marshal(fields)
+
+	tests := []struct {
+		name string
+		file string
+		data []byte
+	}{
+		{"Corrupted IK", ikFile, corruptedIk},
+		{"Truncated AK", akFile, []byte(`{"Version":1,`)},
+		{"Corrupted Cert Chain", akchainFile, []byte("not a certificate")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig, err := os.ReadFile(path.Join(dir, tt.file))
+			if err != nil {
+				t.Fatalf("failed to read %v: %v", tt.file, err)
+			}
+			defer os.WriteFile(path.Join(dir, tt.file), orig, 0644)
+			if err := os.WriteFile(path.Join(dir, tt.file), tt.data, 0644); err != nil {
+				t.Fatalf("failed to write %v: %v", tt.file, err)
+			}
+
+			_, _, err = loadStoredKeys(dir)
+			if err == nil {
+				t.Fatalf("loadStoredKeys() succeeded with corrupted %v", tt.file)
+			}
+			if ak != nil || ik != nil {
+				t.Errorf("keys still loaded after loadStoredKeys() failed")
+			}
+		})
+	}
+}
+
+// TestReprovisionPersistedKeys requires a TPM simulator and covers the
+// re-provisioning after the stored keys did not match, where the keys of the
+// previous provisioning still occupy the persistent handles
+func TestReprovisionPersistedKeys(t *testing.T) {
+
+	const akHandle = tpmutil.Handle(0x81000013)
+	const ikHandle = tpmutil.Handle(0x81000014)
+
+	rwc := openSimulator(t)
+	openTestTpm(t, rwc)
+	defer CloseTpm()
+	createSrk(t, rwc)
+	for _, h := range []tpmutil.Handle{akHandle, ikHandle} {
+		tpm2.EvictControl(rwc, "", tpm2.HandleOwner, h, h)
+		defer func(h tpmutil.Handle) {
+			tpm2.EvictControl(tpmConn, "", tpm2.HandleOwner, h, h)
+		}(h)
+	}
+
+	var err error
+	_, ak, ik, err = createKeys(TPM, "", "EC256")
+	if err != nil {
+		t.Fatalf("createKeys() error = %v", err)
+	}
+	akPub, err := akPublic(ak)
+	if err != nil {
+		t.Fatalf("akPublic() error = %v", err)
+	}
+	akchain := []*x509.Certificate{createTestCert(t, "Test AK", akPub)}
+	if err := persistKeys(akHandle, ikHandle, false, nil); err != nil {
+		t.Fatalf("persistKeys() error = %v", err)
+	}
+
+	// The IK certificate does not match the IK, which requires re-provisioning
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ikchain := []*x509.Certificate{createTestCert(t, "Test IK", otherKey.Public())}
+	if err := validateKeys(akchain, ikchain, akHandle, ikHandle); err == nil {
+		t.Fatalf("validateKeys() accepted non-matching IK certificate")
+	}
+	stale := staleKeys(akchain, ikchain)
+	closeKeys()
+
+	// Without eviction, only the stale keys may be replaced
+	err = checkPersistentHandles(akHandle, ikHandle, false, nil)
+	if !errors.Is(err, ErrHandleOccupied) {
+		t.Fatalf("checkPersistentHandles() error = %v, want %v", err, ErrHandleOccupied)
+	}
+	if err := checkPersistentHandles(akHandle, ikHandle, false, stale); err != nil {
+		t.Fatalf("checkPersistentHandles() with stale keys error = %v", err)
+	}
+
+	_, ak, ik, err = createKeys(TPM, "", "EC256")
+	if err != nil {
+		t.Fatalf("createKeys() error = %v", err)
+	}
+	defer closeKeys()
+	if err := persistKeys(akHandle, ikHandle, false, stale); err != nil {
+		t.Fatalf("persistKeys() after re-provisioning error = %v", err)
+	}
+
+	akPub, err = akPublic(ak)
+	if err != nil {
+		t.Fatalf("akPublic() error = %v", err)
+	}
+	akchain = []*x509.Certificate{createTestCert(t, "Test AK", akPub)}
+	ikchain = []*x509.Certificate{createTestCert(t, "Test IK", ik.Public())}
+	if err := validateKeys(akchain, ikchain, akHandle, ikHandle); err != nil {
+		t.Errorf("validateKeys() after re-provisioning error = %v", err)
+	}
+}
+
+// TestPersistentKeys requires a TPM simulator and covers the quotes and
+// signatures with the keys at the persistent handles
+func TestPersistentKeys(t *testing.T) {
+
+	const akHandle = tpmutil.Handle(0x81000015)
+	const ikHandle = tpmutil.Handle(0x81000016)
+
+	rwc := openSimulator(t)
+	openTestTpm(t, rwc)
+	defer CloseTpm()
+	createSrk(t, rwc)
+	for _, h := range []tpmutil.Handle{akHandle, ikHandle} {
+		tpm2.EvictControl(rwc, "", tpm2.HandleOwner, h, h)
+		defer func(h tpmutil.Handle) {
+			tpm2.EvictControl(tpmConn, "", tpm2.HandleOwner, h, h)
+		}(h)
+	}
+
+	var err error
+	_, ak, ik, err = createKeys(TPM, "", "EC256")
+	if err != nil {
+		t.Fatalf("createKeys() error = %v", err)
+	}
+	defer closeKeys()
+	if err := persistKeys(akHandle, ikHandle, false, nil); err != nil {
+		t.Fatalf("persistKeys() error = %v", err)
+	}
+
+	bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 7}}
+	nonce := []byte("0123456789abcdef")
+	akPub, err := attest.ParseAKPublic(attest.TPMVersion20, ak.AttestationParameters().Public)
+	if err != nil {
+		t.Fatalf("ParseAKPublic() error = %v", err)
+	}
+	allPcrs, err := TPM.PCRs(bank.Alg)
+	if err != nil {
+		t.Fatalf("PCRs() error = %v", err)
+	}
+	var pcrs []attest.PCR
+	for _, pcr := range allPcrs {
+		for _, i := range bank.Pcrs {
+			if pcr.Index == i {
+				pcrs = append(pcrs, pcr)
+			}
+		}
+	}
+
+	q, err := persistentAkQuote(akHandle, ak, nonce, bank)
+	if err != nil {
+		t.Fatalf("persistentAkQuote() error = %v", err)
+	}
+	if err := akPub.Verify(q.Quote, pcrs, nonce); err != nil {
+		t.Errorf("failed to verify quote of persisted AK: %v", err)
+	}
+
+	signer, err := newPersistentSigner(ikHandle, ik)
+	if err != nil {
+		t.Fatalf("newPersistentSigner() error = %v", err)
+	}
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if !ecdsa.VerifyASN1(ik.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Errorf("failed to verify signature of persisted IK")
+	}
+
+	// Through encrypted sessions, the persisted keys are used and not flushed
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal AK: %v", err)
+	}
+	ikBytes, err := ik.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal IK: %v", err)
+	}
+	s, err := newTpmSessions(rwc, false, nil, tpmAuth{})
+	if err != nil {
+		t.Fatalf("newTpmSessions() error = %v", err)
+	}
+	if err := s.loadKeys(akBytes, ikBytes, akHandle, ikHandle); err != nil {
+		t.Fatalf("loadKeys() error = %v", err)
+	}
+	if !s.ak.persistent || !s.ik.persistent {
+		t.Errorf("session keys persistent = %v, %v, want true", s.ak.persistent, s.ik.persistent)
+	}
+	q, err = s.quote(nonce, bank)
+	if err != nil {
+		t.Fatalf("quote() error = %v", err)
+	}
+	if err := akPub.Verify(q.Quote, pcrs, nonce); err != nil {
+		t.Errorf("failed to verify session quote of persisted AK: %v", err)
+	}
+	s.close()
+	for _, h := range []tpmutil.Handle{akHandle, ikHandle} {
+		if _, err := readPersistentKey(rwc, h); err != nil {
+			t.Errorf("persisted key flushed by session: %v", err)
+		}
+	}
+
+	// Keys at the handles not matching the loaded keys must not be used
+	if err := persistKey(rwc, createKeyBlob(t, rwc), ikHandle, true, nil); err != nil {
+		t.Fatalf("persistKey() error = %v", err)
+	}
+	if _, err := newPersistentSigner(ikHandle, ik); err == nil {
+		t.Errorf("newPersistentSigner() accepted non-matching persisted IK")
+	}
+	if _, err := persistentAkQuote(ikHandle, ak, nonce, bank); err == nil {
+		t.Errorf("persistentAkQuote() accepted non-matching persisted AK")
+	}
+}
+
+// TestQuoteHandle requires a TPM simulator and covers the quotes of all
+// selected PCR banks with a persisted AK, as provisioned by cloud providers
+func TestQuoteHandle(t *testing.T) {
+
+	const akHandle = tpmutil.Handle(0x81000017)
+
+	rwc := openSimulator(t)
+	openTestTpm(t, rwc)
+	defer CloseTpm()
+	createSrk(t, rwc)
+	tpm2.EvictControl(rwc, "", tpm2.HandleOwner, akHandle, akHandle)
+	defer tpm2.EvictControl(rwc, "", tpm2.HandleOwner, akHandle, akHandle)
+
+	var err error
+	_, ak, ik, err = createKeys(TPM, "", "EC256")
+	if err != nil {
+		t.Fatalf("createKeys() error = %v", err)
+	}
+	defer closeKeys()
+	if err := persistKeys(akHandle, 0, false, nil); err != nil {
+		t.Fatalf("persistKeys() error = %v", err)
+	}
+	pub, err := akPublic(ak)
+	if err != nil {
+		t.Fatalf("akPublic() error = %v", err)
+	}
+	akPub, err := attest.ParseAKPublic(attest.TPMVersion20, ak.AttestationParameters().Public)
+	if err != nil {
+		t.Fatalf("ParseAKPublic() error = %v", err)
+	}
+
+	defaultPcrs := []int{0, 1, 2}
+	banks, err := SelectPcrBanks(rwc, nil, defaultPcrs)
+	if err != nil || len(banks) != 1 || banks[0].Alg != attest.HashSHA256 {
+		t.Fatalf("SelectPcrBanks() = %v, %v, want default sha256 bank", banks, err)
+	}
+	banks, err = SelectPcrBanks(rwc, map[string][]int{"sha1": {0, 7}, "sha256": {0, 1}},
+		defaultPcrs)
+	if err != nil || len(banks) != 2 {
+		t.Fatalf("SelectPcrBanks() = %v, %v, want two banks", banks, err)
+	}
+	if _, err := SelectPcrBanks(rwc, map[string][]int{"sha256": {24}}, defaultPcrs); err == nil {
+		t.Errorf("SelectPcrBanks() accepted invalid PCR")
+	}
+
+	nonce := []byte("0123456789abcdef")
+	for _, bank := range banks {
+		quote, sig, artifacts, err := QuoteHandle(rwc, akHandle, pub, nonce, bank)
+		if err != nil {
+			t.Fatalf("QuoteHandle() of bank %v error = %v", bank, err)
+		}
+		digestAlg := crypto.SHA256
+		if bank.Alg == attest.HashSHA1 {
+			digestAlg = crypto.SHA1
+		}
+		pcrs := make([]attest.PCR, 0, len(artifacts))
+		for _, a := range artifacts {
+			pcrs = append(pcrs, attest.PCR{Index: *a.Pcr, Digest: a.Summary, DigestAlg: digestAlg})
+		}
+		q := attest.Quote{Version: attest.TPMVersion20, Quote: quote, Signature: sig}
+		if err := akPub.Verify(q, pcrs, nonce); err != nil {
+			t.Errorf("failed to verify quote of bank %v: %v", bank, err)
+		}
+	}
+
+	// The AK at the handle must match the expected public key
+	if _, _, _, err := QuoteHandle(rwc, akHandle, ik.Public(), nonce, banks[0]); err == nil {
+		t.Errorf("QuoteHandle() accepted non-matching AK")
+	}
+}
+
+// openTestTpm opens go-attestation on the simulator connection
+func openTestTpm(t testing.TB, rwc io.ReadWriteCloser) {
+	var err error
+	TPM, err = attest.OpenTPM(&attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &commandChannel{rwc},
+	})
+	if err != nil {
+		rwc.Close()
+		t.Fatalf("failed to open TPM: %v", err)
+	}
+	tpmConn = rwc
+}
+
+func createTestCert(t testing.TB, cn string, pub crypto.PublicKey) *x509.Certificate {
+	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, caPriv)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+// openSimulator opens the TPM simulator specified by the TPM_SIMULATOR
+// environment variable and skips the test if not set
+func openSimulator(t testing.TB) io.ReadWriteCloser {
+	sock := os.Getenv("TPM_SIMULATOR")
+	if sock == "" {
+		t.Skip("TPM_SIMULATOR not set")
+	}
+	rwc, err := tpm2.OpenTPM(sock)
+	if err != nil {
+		t.Fatalf("failed to open TPM simulator: %v", err)
+	}
+	return rwc
+}
+
+func createSrk(t testing.TB, rwc io.ReadWriter) {
+	if _, _, _, err := tpm2.ReadPublic(rwc, srkHandle); err == nil {
+		return
+	}
+	tmpl := tpm2.Public{
+		Type:    tpm2.AlgECC,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagNoDA,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	hnd, _, err := tpm2.CreatePrimary(rwc, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tmpl)
+	if err != nil {
+		t.Fatalf("failed to create SRK: %v", err)
+	}
+	defer tpm2.FlushContext(rwc, hnd)
+	err = tpm2.EvictControl(rwc, "", tpm2.HandleOwner, hnd, srkHandle)
+	if err != nil {
+		t.Fatalf("failed to persist SRK: %v", err)
+	}
+}
+
+func createKeyBlob(t testing.TB, rwc io.ReadWriter) []byte {
+	tmpl := tpm2.Public{
+		Type:    tpm2.AlgECC,
+		NameAlg: tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin |
+			tpm2.FlagUserWithAuth | tpm2.FlagSign,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	priv, pub, _, _, _, err := tpm2.CreateKey(rwc, srkHandle, tpm2.PCRSelection{}, "", "", tmpl)
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	data, err := json.Marshal(keyBlob{Public: pub, Blob: priv})
+	if err != nil {
+		t.Fatalf("failed to marshal key blob: %v", err)
+	}
+	return data
+}
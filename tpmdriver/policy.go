@@ -0,0 +1,410 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// go-attestation encoding of keys encrypted by the SRK
+const keyEncodingEncrypted = 2
+
+// ErrIkPolicy is returned if the TPM rejected the IK authorization policy,
+// e.g., because an OS or firmware update changed the PCRs the IK is bound to
+var ErrIkPolicy = errors.New("TPM rejected the IK authorization policy " +
+	"(PCRs changed since provisioning?), restart the cmcd to re-provision the IK")
+
+// keyPolicy is the authorization policy of the IK. If configured, the IK can
+// only sign within a policy session satisfying the policy, so that a copied
+// key blob cannot be used in a different boot state or without the key auth
+type keyPolicy struct {
+	pcrs      []int
+	authValue bool
+}
+
+// ikPolicy is the configured IK authorization policy
+var ikPolicy keyPolicy
+
+// attestKeyBlob is the go-attestation storage format of TPM 2.0 keys, so that
+// keys created by the driver can be loaded through go-attestation
+type attestKeyBlob struct {
+	Encoding          uint8 `json:"KeyEncoding"`
+	TPMVersion        attest.TPMVersion
+	Public            []byte
+	CreateData        []byte
+	CreateAttestation []byte
+	CreateSignature   []byte
+	Blob              []byte `json:"KeyBlob"`
+}
+
+func newKeyPolicy(pcrs []int, authValue bool) (keyPolicy, error) {
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= numPcrs {
+			return keyPolicy{}, fmt.Errorf("invalid IK policy PCR %v", pcr)
+		}
+	}
+	return keyPolicy{pcrs: pcrs, authValue: authValue}, nil
+}
+
+func (p keyPolicy) enabled() bool {
+	return len(p.pcrs) > 0 || p.authValue
+}
+
+// execute executes the policy commands within the policy or trial session.
+// TPM2_PolicyPCR binds the session to the current values of the PCRs of the
+// SHA256 bank, TPM2_PolicyAuthValue additionally requires the key auth
+func (p keyPolicy) execute(t transport.TPM, session tpm2.TPMHandle) error {
+	if len(p.pcrs) > 0 {
+		_, err := tpm2.PolicyPCR{
+			PolicySession: session,
+			Pcrs: tpm2.TPMLPCRSelection{
+				PCRSelections: []tpm2.TPMSPCRSelection{{
+					Hash:      tpm2.TPMAlgSHA256,
+					PCRSelect: pcrBitmap(p.pcrs),
+				}},
+			},
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("failed to execute PCR policy: %w", err)
+		}
+	}
+	if p.authValue {
+		err := policyAuthValue(t, session)
+		if err != nil {
+			return fmt.Errorf("failed to execute auth value policy: %w", err)
+		}
+	}
+	return nil
+}
+
+// digest calculates the policy digest over the current PCR values with a
+// trial session. An empty digest is returned if no policy is configured
+func (p keyPolicy) digest(t transport.TPM) ([]byte, error) {
+	if !p.enabled() {
+		return nil, nil
+	}
+
+	trial, closeTrial, err := tpm2.PolicySession(t, tpm2.TPMAlgSHA256, sessionNonceSize, tpm2.Trial())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start trial session: %w", err)
+	}
+	defer closeTrial()
+
+	err = p.execute(t, trial.Handle())
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := tpm2.PolicyGetDigest{PolicySession: trial.Handle()}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy digest: %w", err)
+	}
+
+	return rsp.PolicyDigest.Buffer, nil
+}
+
+// policyAuthValue executes TPM2_PolicyAuthValue, which is not provided by go-tpm
+func policyAuthValue(t transport.TPM, session tpm2.TPMHandle) error {
+	// Command header (tag, size, command code) and policy session handle
+	cmd, err := tpmutil.Pack(tpm2.TPMSTNoSessions, uint32(14), tpm2.TPMCCPolicyAuthValue, session)
+	if err != nil {
+		return err
+	}
+	rsp, err := t.Send(cmd)
+	if err != nil {
+		return err
+	}
+	var tag uint16
+	var size, code uint32
+	if _, err := tpmutil.Unpack(rsp, &tag, &size, &code); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if code != 0 {
+		return tpm2.TPMRC(code)
+	}
+	return nil
+}
+
+// policyError returns an error wrapping ErrIkPolicy if the TPM rejected the
+// policy session, otherwise the original error is returned
+func policyError(err error) error {
+	if errors.Is(err, tpm2.TPMRCPolicyFail) || errors.Is(err, tpm2.TPMRCPCRChanged) {
+		return fmt.Errorf("%w: %v", ErrIkPolicy, err)
+	}
+	return err
+}
+
+// checkIkPolicy checks that the current IK was created with the configured
+// policy over the current PCR values. Otherwise, the IK cannot be used and
+// must be re-provisioned
+func checkIkPolicy() error {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+
+	want, err := ikPolicy.digest(transport.FromReadWriter(rwc))
+	if err != nil {
+		return fmt.Errorf("failed to calculate IK policy: %w", err)
+	}
+
+	pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](ik.CertificationParameters().Public)
+	if err != nil {
+		return fmt.Errorf("failed to decode IK public area: %w", err)
+	}
+	if !bytes.Equal(pub.AuthPolicy.Buffer, want) {
+		if ikPolicy.enabled() {
+			return fmt.Errorf("IK policy does not match the configured policy over the current PCRs: %w",
+				ErrIkPolicy)
+		}
+		return errors.New("IK has an authorization policy, but no IK policy is configured")
+	}
+
+	return nil
+}
+
+// newPolicyIk creates an IK restricted by the policy over the current PCR values
+// and certifies it with the AK. go-attestation does not support key policies,
+// therefore the key is created by the driver and returned as go-attestation blob
+func newPolicyIk(rwc io.ReadWriter, akBlob []byte, config *attest.KeyConfig, p keyPolicy) ([]byte, error) {
+
+	t := transport.FromReadWriter(rwc)
+
+	policy, err := p.digest(t)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := policyKeyTemplate(config, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := srkParent(t)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := tpm2.Create{
+		ParentHandle: parent,
+		InPublic:     tpm2.New2B(tmpl),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IK: %w", err)
+	}
+
+	key, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    created.OutPrivate,
+		InPublic:     created.OutPublic,
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load IK: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: key.ObjectHandle}.Execute(t)
+
+	var kb keyBlob
+	err = json.Unmarshal(akBlob, &kb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal AK blob: %w", err)
+	}
+	akKey, err := tpm2.Load{
+		ParentHandle: parent,
+		InPrivate:    tpm2.TPM2BPrivate{Buffer: kb.Blob},
+		InPublic:     tpm2.BytesAs2B[tpm2.TPMTPublic](kb.Public),
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AK: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: akKey.ObjectHandle}.Execute(t)
+
+	// The certification requires the admin role, which is authorized with the
+	// still empty key auth, as only the user role is restricted by the policy
+	cert, err := tpm2.Certify{
+		ObjectHandle: tpm2.AuthHandle{Handle: key.ObjectHandle, Name: key.Name, Auth: tpm2.PasswordAuth(nil)},
+		SignHandle:   tpm2.AuthHandle{Handle: akKey.ObjectHandle, Name: akKey.Name, Auth: tpm2.PasswordAuth(nil)},
+		InScheme:     tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to certify IK: %w", err)
+	}
+
+	return json.Marshal(attestKeyBlob{
+		Encoding:          keyEncodingEncrypted,
+		TPMVersion:        attest.TPMVersion20,
+		Public:            created.OutPublic.Bytes(),
+		CreateData:        created.CreationData.Bytes(),
+		CreateAttestation: cert.CertifyInfo.Bytes(),
+		CreateSignature:   tpm2.Marshal(cert.Signature),
+		Blob:              created.OutPrivate.Buffer,
+	})
+}
+
+// policyKeyTemplate returns the template of the go-attestation signing keys
+// with the policy as authorization policy. The user role, i.e. signing, can
+// only be authorized through the policy. Without policy, the key is authorized
+// with the key auth as go-attestation keys. The name algorithm is always
+// SHA256, as the policy digest is calculated with SHA256 sessions
+func policyKeyTemplate(config *attest.KeyConfig, policy []byte) (tpm2.TPMTPublic, error) {
+
+	tmpl := tpm2.TPMTPublic{
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        len(policy) == 0,
+			AdminWithPolicy:     false,
+			SignEncrypt:         true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{Buffer: policy},
+	}
+
+	switch config.Algorithm {
+	case attest.RSA:
+		tmpl.Type = tpm2.TPMAlgRSA
+		tmpl.Parameters = tpm2.NewTPMUPublicParms(tpm2.TPMAlgRSA, &tpm2.TPMSRSAParms{
+			Symmetric: tpm2.TPMTSymDefObject{Algorithm: tpm2.TPMAlgNull},
+			Scheme:    tpm2.TPMTRSAScheme{Scheme: tpm2.TPMAlgNull},
+			KeyBits:   tpm2.TPMKeyBits(config.Size),
+		})
+		tmpl.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgRSA, &tpm2.TPM2BPublicKeyRSA{})
+	case attest.ECDSA:
+		var curve tpm2.TPMECCCurve
+		var hash crypto.Hash
+		switch config.Size {
+		case 256:
+			curve, hash = tpm2.TPMECCNistP256, crypto.SHA256
+		case 384:
+			curve, hash = tpm2.TPMECCNistP384, crypto.SHA384
+		case 521:
+			curve, hash = tpm2.TPMECCNistP521, crypto.SHA512
+		default:
+			return tpm2.TPMTPublic{}, fmt.Errorf("unsupported key size: %v", config.Size)
+		}
+		hashAlg, err := hashAlg(hash)
+		if err != nil {
+			return tpm2.TPMTPublic{}, err
+		}
+		tmpl.Type = tpm2.TPMAlgECC
+		tmpl.Parameters = tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+			Symmetric: tpm2.TPMTSymDefObject{Algorithm: tpm2.TPMAlgNull},
+			Scheme: tpm2.TPMTECCScheme{
+				Scheme: tpm2.TPMAlgECDSA,
+				Details: tpm2.NewTPMUAsymScheme(tpm2.TPMAlgECDSA,
+					&tpm2.TPMSSigSchemeECDSA{HashAlg: hashAlg}),
+			},
+			CurveID: curve,
+			KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+		})
+		tmpl.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{})
+	default:
+		return tpm2.TPMTPublic{}, fmt.Errorf("unsupported key algorithm: %v", config.Algorithm)
+	}
+
+	return tmpl, nil
+}
+
+// ikCsrSigner returns the signer for the IK CSR. An IK with an authorization
+// policy can only sign within a policy session, therefore the IK is loaded
+// through temporary sessions, which must be closed with the returned function
+func ikCsrSigner(ak *attest.AK, ik *attest.Key) (crypto.Signer, func(), error) {
+
+	if !ikPolicy.enabled() {
+		priv, err := ik.Private(ik.Public())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to retrieve IK private key: %w", err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("IK private key of type %T is not a signer", priv)
+		}
+		return signer, func() {}, nil
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	ikBytes, err := ik.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal IK: %w", err)
+	}
+
+	// The key auth is only set after enrollment
+	s, err := newTpmSessions(rwc, false, nil, tpmAuth{endorsement: authValues.endorsement})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.policy = ikPolicy
+	// The new keys are not persisted before enrollment
+	err = s.loadKeys(akBytes, ikBytes, 0, 0)
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+	signer, err := s.signer()
+	if err != nil {
+		s.close()
+		return nil, nil, err
+	}
+
+	return signer, s.close, nil
+}
+
+// createPolicyIk creates the IK with the configured policy and loads it
+// through go-attestation. It is also used to create IKs without policy for
+// ECC AKs, as go-attestation certifies IKs with an RSA signature scheme
+func createPolicyIk(tpm *attest.TPM, ak *attest.AK, config *attest.KeyConfig) (*attest.Key, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal AK: %w", err)
+	}
+
+	blob, err := newPolicyIk(rwc, akBytes, config, ikPolicy)
+	if err != nil {
+		return nil, err
+	}
+	ik, err := tpm.LoadKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load IK: %w", err)
+	}
+
+	if ikPolicy.enabled() {
+		log.Debugf("Created IK with policy over PCRs %v (auth value: %v)", ikPolicy.pcrs,
+			ikPolicy.authValue)
+	}
+
+	return ik, nil
+}
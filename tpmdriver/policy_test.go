@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// Resettable PCR used for the tests, so that the tests can change the
+// PCR value and restore the original state
+const testPolicyPcr = 16
+
+func TestPolicyKeyTemplate(t *testing.T) {
+	policy := bytes.Repeat([]byte{0x01}, 32)
+	tests := []struct {
+		name    string
+		config  attest.KeyConfig
+		wantErr bool
+	}{
+		{"EC256", attest.KeyConfig{Algorithm: attest.ECDSA, Size: 256}, false},
+		{"EC521", attest.KeyConfig{Algorithm: attest.ECDSA, Size: 521}, false},
+		{"RSA2048", attest.KeyConfig{Algorithm: attest.RSA, Size: 2048}, false},
+		{"Invalid EC Size", attest.KeyConfig{Algorithm: attest.ECDSA, Size: 224}, true},
+		{"Invalid Algorithm", attest.KeyConfig{Algorithm: "DSA", Size: 2048}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := policyKeyTemplate(&tt.config, policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("policyKeyTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tmpl.ObjectAttributes.UserWithAuth {
+				t.Errorf("policy key can be used with the key auth only")
+			}
+			if !bytes.Equal(tmpl.AuthPolicy.Buffer, policy) {
+				t.Errorf("AuthPolicy = %x, want %x", tmpl.AuthPolicy.Buffer, policy)
+			}
+		})
+	}
+}
+
+func TestNewKeyPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		pcrs        []int
+		authValue   bool
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{"Disabled", nil, false, false, false},
+		{"PCRs", []int{0, 1, 7}, false, true, false},
+		{"Auth Value", nil, true, true, false},
+		{"Invalid PCR", []int{24}, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newKeyPolicy(tt.pcrs, tt.authValue)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newKeyPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if p.enabled() != tt.wantEnabled {
+				t.Errorf("enabled() = %v, want %v", p.enabled(), tt.wantEnabled)
+			}
+		})
+	}
+}
+
+// TestIkPolicy requires a TPM simulator, see TestPersistKey
+func TestIkPolicy(t *testing.T) {
+
+	rwc := openSimulator(t)
+	defer rwc.Close()
+	createSrk(t, rwc)
+	defer tpm2.PCRReset(rwc, testPolicyPcr)
+
+	digest := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name   string
+		policy keyPolicy
+		key    string
+	}{
+		{"PCR", keyPolicy{pcrs: []int{0, testPolicyPcr}}, ""},
+		{"PCR and Auth Value", keyPolicy{pcrs: []int{testPolicyPcr}, authValue: true}, "key-auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tpm2.PCRReset(rwc, testPolicyPcr)
+			if err != nil {
+				t.Fatalf("failed to reset PCR: %v", err)
+			}
+
+			akBlob := createKeyBlob(t, rwc)
+			blob := createPolicyKeyBlob(t, rwc, akBlob, tt.policy)
+			if tt.key != "" {
+				blob, err = changeKeyAuth(rwc, blob, "", tt.key)
+				if err != nil {
+					t.Fatalf("changeKeyAuth() error = %v", err)
+				}
+			}
+
+			s, err := newTpmSessions(rwc, false, nil, tpmAuth{key: tt.key})
+			if err != nil {
+				t.Fatalf("newTpmSessions() error = %v", err)
+			}
+			defer s.close()
+			if err := s.loadKeys(akBlob, blob, 0, 0); err != nil {
+				t.Fatalf("loadKeys() error = %v", err)
+			}
+
+			// The IK must not be usable without the policy session
+			if _, err := s.sign(digest[:], crypto.SHA256); err == nil {
+				t.Errorf("sign() without policy session succeeded")
+			}
+
+			s.policy = tt.policy
+			sig, err := s.sign(digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("sign() error = %v", err)
+			}
+			if !ecdsa.VerifyASN1(s.ik.pub.(*ecdsa.PublicKey), digest[:], sig) {
+				t.Errorf("failed to verify signature")
+			}
+
+			// A changed boot state must be reported as policy failure
+			err = tpm2.PCRExtend(rwc, testPolicyPcr, tpm2.AlgSHA256, digest[:], "")
+			if err != nil {
+				t.Fatalf("failed to extend PCR: %v", err)
+			}
+			_, err = s.sign(digest[:], crypto.SHA256)
+			if !errors.Is(err, ErrIkPolicy) {
+				t.Errorf("sign() error = %v, want %v", err, ErrIkPolicy)
+			}
+		})
+	}
+}
+
+// BenchmarkSessionSign compares the latency of signatures within the reusable
+// encrypted session and within a new policy session per signature. Requires a
+// TPM simulator or TPM, see TestPersistKey
+func BenchmarkSessionSign(b *testing.B) {
+
+	rwc := openSimulator(b)
+	defer rwc.Close()
+	createSrk(b, rwc)
+
+	digest := sha256.Sum256([]byte("data"))
+	akBlob := createKeyBlob(b, rwc)
+	policy := keyPolicy{pcrs: []int{0, 1, 2, 3, 4, 5, 6, 7}}
+
+	tests := []struct {
+		name   string
+		blob   []byte
+		policy keyPolicy
+	}{
+		{"Encrypted", createKeyBlob(b, rwc), keyPolicy{}},
+		{"Policy", createPolicyKeyBlob(b, rwc, akBlob, policy), policy},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			s, err := newTpmSessions(rwc, false, nil, tpmAuth{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.close()
+			s.policy = tt.policy
+			if err := s.loadKeys(akBlob, tt.blob, 0, 0); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.sign(digest[:], crypto.SHA256); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func createPolicyKeyBlob(t testing.TB, rwc io.ReadWriter, akBlob []byte, p keyPolicy) []byte {
+	blob, err := newPolicyIk(rwc, akBlob, &attest.KeyConfig{Algorithm: attest.ECDSA, Size: 256}, p)
+	if err != nil {
+		t.Fatalf("newPolicyIk() error = %v", err)
+	}
+	return blob
+}
@@ -0,0 +1,588 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	sessionNonceSize = 16
+	sessionKeyBits   = 128
+)
+
+// ErrSessionKeysNotLoaded is returned if a session operation is performed
+// before the keys were loaded through the encrypted session
+var ErrSessionKeysNotLoaded = errors.New("keys not loaded through encrypted session")
+
+// tpmSessions executes the TPM commands for key loads, quotes and signatures
+// within salted HMAC sessions with AES-CFB parameter encryption instead of
+// plaintext password sessions, so that an interposer on the TPM bus can neither
+// read nor undetectably modify the command and response parameters. All errors
+// are returned, there is no fallback to plaintext sessions
+type tpmSessions struct {
+	mu    sync.Mutex
+	tpm   transport.TPM
+	audit bool
+	srk   tpm2.NamedHandle
+	// Reusable session encrypting the first command parameter
+	sessIn     tpm2.Session
+	closeIn    func() error
+	sessInOut  tpm2.Session
+	closeInOut func() error
+	// Sessions for the AK and IK, which differ from the above sessions only
+	// if a key auth is configured
+	keyIn       tpm2.Session
+	keyInOut    tpm2.Session
+	closeKeys   []func() error
+	endorsement []byte
+	saltHandle  tpm2.TPMHandle
+	saltPub     tpm2.TPMTPublic
+	// If the IK policy is configured, every signature is authorized within
+	// a new policy session satisfying the policy
+	policy  keyPolicy
+	keyAuth []byte
+	ak      *sessionKey
+	ik      *sessionKey
+}
+
+// sessionKey is a key loaded through an encrypted session or a key at a
+// persistent handle, which is not flushed
+type sessionKey struct {
+	handle     tpm2.NamedHandle
+	public     *tpm2.TPMTPublic
+	pub        crypto.PublicKey
+	persistent bool
+}
+
+// newTpmSessions starts the reusable encrypted sessions salted with the SRK. If
+// srkName is specified, it must match the name of the SRK read from the TPM, so
+// that the salt cannot be encrypted to a key provided by an interposer. The
+// key and endorsement auth of the passed auth values are used for the AK and IK
+// and the session audit digest
+func newTpmSessions(rwc io.ReadWriter, audit bool, srkName []byte, a tpmAuth) (*tpmSessions, error) {
+
+	t := transport.FromReadWriter(rwc)
+
+	rsp, err := tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(srkHandle)}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SRK public: %w", err)
+	}
+	if srkName != nil && !bytes.Equal(rsp.Name.Buffer, srkName) {
+		return nil, fmt.Errorf("SRK name %x does not match AK parent name %x",
+			rsp.Name.Buffer, srkName)
+	}
+	srkPub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SRK public: %w", err)
+	}
+
+	s := &tpmSessions{
+		tpm:         t,
+		audit:       audit,
+		srk:         tpm2.NamedHandle{Handle: tpm2.TPMHandle(srkHandle), Name: rsp.Name},
+		saltHandle:  tpm2.TPMHandle(srkHandle),
+		saltPub:     *srkPub,
+		endorsement: []byte(a.endorsement),
+		keyAuth:     []byte(a.key),
+	}
+
+	s.sessIn, s.closeIn, err = s.startSession(tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptIn))
+	if err != nil {
+		return nil, err
+	}
+	s.sessInOut, s.closeInOut, err = s.startSession(tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptInOut))
+	if err != nil {
+		s.closeIn()
+		return nil, err
+	}
+
+	s.keyIn, s.keyInOut = s.sessIn, s.sessInOut
+	if a.key != "" {
+		auth := tpm2.Auth([]byte(a.key))
+		var closeIn, closeInOut func() error
+		s.keyIn, closeIn, err = s.startSession(
+			tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptIn), auth)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.closeKeys = append(s.closeKeys, closeIn)
+		s.keyInOut, closeInOut, err = s.startSession(
+			tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptInOut), auth)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.closeKeys = append(s.closeKeys, closeInOut)
+	}
+
+	log.Debugf("Started salted TPM sessions with parameter encryption (audit: %v)", audit)
+
+	return s, nil
+}
+
+func (s *tpmSessions) startSession(opts ...tpm2.AuthOption) (tpm2.Session, func() error, error) {
+	opts = append(opts, tpm2.Salted(s.saltHandle, s.saltPub))
+	sess, close, err := tpm2.HMACSession(s.tpm, tpm2.TPMAlgSHA256, sessionNonceSize, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start TPM session: %w", err)
+	}
+	return sess, close, nil
+}
+
+// close flushes the loaded keys and the sessions
+func (s *tpmSessions) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushKeys()
+	if s.closeIn != nil {
+		s.closeIn()
+	}
+	if s.closeInOut != nil {
+		s.closeInOut()
+	}
+	for _, close := range s.closeKeys {
+		close()
+	}
+}
+
+// loadKeys loads the go-attestation AK and IK blobs under the SRK through the
+// encrypted session. If a persistent handle is specified, the key persisted at
+// the handle is used instead of loading the blob. Previously loaded keys are
+// flushed
+func (s *tpmSessions) loadKeys(akBlob, ikBlob []byte, akHandle, ikHandle tpmutil.Handle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ak, err := s.loadKey(akBlob, akHandle)
+	if err != nil {
+		return fmt.Errorf("failed to load AK: %w", err)
+	}
+	ik, err := s.loadKey(ikBlob, ikHandle)
+	if err != nil {
+		s.flush(ak)
+		return fmt.Errorf("failed to load IK: %w", err)
+	}
+
+	s.flushKeys()
+	s.ak, s.ik = ak, ik
+
+	return nil
+}
+
+func (s *tpmSessions) loadKey(opaqueBlob []byte, handle tpmutil.Handle) (*sessionKey, error) {
+	var kb keyBlob
+	err := json.Unmarshal(opaqueBlob, &kb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key blob: %w", err)
+	}
+
+	inPublic := tpm2.BytesAs2B[tpm2.TPMTPublic](kb.Public)
+	public, err := inPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public area: %w", err)
+	}
+	pub, err := publicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	if handle != 0 {
+		return loadPersistentKey(s.tpm, handle, pub)
+	}
+
+	rsp, err := tpm2.Load{
+		ParentHandle: tpm2.AuthHandle{Handle: s.srk.Handle, Name: s.srk.Name, Auth: s.sessInOut},
+		InPrivate:    tpm2.TPM2BPrivate{Buffer: kb.Blob},
+		InPublic:     inPublic,
+	}.Execute(s.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %w", err)
+	}
+
+	return &sessionKey{
+		handle: tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name},
+		public: public,
+		pub:    pub,
+	}, nil
+}
+
+func (s *tpmSessions) flushKeys() {
+	s.flush(s.ak)
+	s.flush(s.ik)
+	s.ak, s.ik = nil, nil
+}
+
+func (s *tpmSessions) flush(k *sessionKey) {
+	if k == nil || k.persistent {
+		return
+	}
+	_, err := tpm2.FlushContext{FlushHandle: k.handle.Handle}.Execute(s.tpm)
+	if err != nil {
+		log.Warnf("Failed to flush key 0x%x: %v", uint32(k.handle.Handle), err)
+	}
+}
+
+// quote performs a quote over the selected PCRs with the AK. If audit is
+// configured, the quote is authorized within an audit session and the session
+// audit digest signed by the AK is returned additionally. The audit session
+// does not encrypt the parameters, as the verifier must recalculate the audit
+// digest from the plaintext nonce and quote. Their integrity is still protected
+// by the session HMAC and the quote signature
+func (s *tpmSessions) quote(nonce []byte, bank PcrBank) (*Quote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ak == nil {
+		return nil, ErrSessionKeysNotLoaded
+	}
+
+	auth := s.keyInOut
+	if s.audit {
+		opts := []tpm2.AuthOption{tpm2.Audit()}
+		if len(s.keyAuth) > 0 {
+			opts = append(opts, tpm2.Auth(s.keyAuth))
+		}
+		var closeAudit func() error
+		var err error
+		auth, closeAudit, err = s.startSession(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start audit session: %w", err)
+		}
+		defer closeAudit()
+	}
+
+	rsp, err := quotePcrs(s.tpm, tpm2.AuthHandle{Handle: s.ak.handle.Handle, Name: s.ak.handle.Name,
+		Auth: auth}, nonce, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quote{}
+	q.Quote.Version = attest.TPMVersion20
+	q.Quote.Quote = rsp.Quoted.Bytes()
+	q.Quote.Signature = tpm2.Marshal(rsp.Signature)
+
+	if s.audit {
+		arsp, err := tpm2.GetSessionAuditDigest{
+			PrivacyAdminHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMRHEndorsement,
+				Auth:   tpm2.PasswordAuth(s.endorsement),
+			},
+			SignHandle:     tpm2.AuthHandle{Handle: s.ak.handle.Handle, Name: s.ak.handle.Name, Auth: s.keyInOut},
+			SessionHandle:  auth.Handle(),
+			QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+			InScheme:       tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+		}.Execute(s.tpm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get session audit digest: %w", auditAuthError(err))
+		}
+		q.AuditInfo = arsp.AuditInfo.Bytes()
+		q.AuditSignature = tpm2.Marshal(arsp.Signature)
+		q.AuditSigner = tpm2.Marshal(s.ak.public)
+	}
+
+	return q, nil
+}
+
+// auditAuthError returns an AuthError naming the entity whose authorization
+// failed for TPM2_GetSessionAuditDigest, authorized by the endorsement
+// hierarchy in the first and the AK in the second session
+func auditAuthError(err error) error {
+	var fmt1 tpm2.TPMFmt1Error
+	if errors.As(err, &fmt1) {
+		if isSession, idx := fmt1.Session(); isSession && idx == 1 {
+			return authError(err, "endorsement hierarchy")
+		}
+	}
+	return authError(err, "AK")
+}
+
+// sign signs the digest with the IK
+func (s *tpmSessions) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ik == nil {
+		return nil, ErrSessionKeysNotLoaded
+	}
+
+	auth := s.keyIn
+	if s.policy.enabled() {
+		sess, closeSess, err := s.startPolicySession()
+		if err != nil {
+			return nil, err
+		}
+		defer closeSess()
+		auth = sess
+	}
+
+	return signDigest(s.tpm, s.ik, auth, digest, opts)
+}
+
+// quotePcrs performs a quote over the selected PCRs of the bank with the key
+func quotePcrs(t transport.TPM, key tpm2.AuthHandle, nonce []byte, bank PcrBank,
+) (*tpm2.QuoteResponse, error) {
+	rsp, err := tpm2.Quote{
+		SignHandle:     key,
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme:       tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+		PCRSelect: tpm2.TPMLPCRSelection{
+			PCRSelections: []tpm2.TPMSPCRSelection{{
+				Hash:      tpm2.TPMIAlgHash(bank.Alg),
+				PCRSelect: pcrBitmap(bank.Pcrs),
+			}},
+		},
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to quote: %w", authError(err, "AK"))
+	}
+	return rsp, nil
+}
+
+// signDigest signs the digest with the key authorized by the session and
+// returns the signature in the encoding of the crypto.Signer interface
+func signDigest(t transport.TPM, key *sessionKey, auth tpm2.Session, digest []byte,
+	opts crypto.SignerOpts,
+) ([]byte, error) {
+
+	hash, err := hashAlg(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+	scheme := tpm2.TPMTSigScheme{}
+	switch key.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme.Scheme = tpm2.TPMAlgRSAPSS
+			scheme.Details = tpm2.NewTPMUSigScheme(tpm2.TPMAlgRSAPSS, &tpm2.TPMSSchemeHash{HashAlg: hash})
+		} else {
+			scheme.Scheme = tpm2.TPMAlgRSASSA
+			scheme.Details = tpm2.NewTPMUSigScheme(tpm2.TPMAlgRSASSA, &tpm2.TPMSSchemeHash{HashAlg: hash})
+		}
+	default:
+		scheme.Scheme = tpm2.TPMAlgECDSA
+		scheme.Details = tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: hash})
+	}
+
+	// The response parameter of TPM2_Sign is not a sized buffer and can therefore
+	// not be encrypted, only the digest is encrypted
+	rsp, err := tpm2.Sign{
+		KeyHandle: tpm2.AuthHandle{Handle: key.handle.Handle, Name: key.handle.Name, Auth: auth},
+		Digest:    tpm2.TPM2BDigest{Buffer: digest},
+		InScheme:  scheme,
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag:       tpm2.TPMSTHashCheck,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", authError(policyError(err), "IK"))
+	}
+
+	switch rsp.Signature.SigAlg {
+	case tpm2.TPMAlgRSASSA:
+		sig, err := rsp.Signature.Signature.RSASSA()
+		if err != nil {
+			return nil, err
+		}
+		return sig.Sig.Buffer, nil
+	case tpm2.TPMAlgRSAPSS:
+		sig, err := rsp.Signature.Signature.RSAPSS()
+		if err != nil {
+			return nil, err
+		}
+		return sig.Sig.Buffer, nil
+	case tpm2.TPMAlgECDSA:
+		sig, err := rsp.Signature.Signature.ECDSA()
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig.SignatureR.Buffer),
+			new(big.Int).SetBytes(sig.SignatureS.Buffer),
+		})
+	default:
+		return nil, fmt.Errorf("unexpected signature algorithm 0x%x", uint16(rsp.Signature.SigAlg))
+	}
+}
+
+// startPolicySession starts a salted policy session with parameter encryption
+// and executes the IK policy. The TPM resets policy sessions after every use,
+// therefore a new session is required per signature
+func (s *tpmSessions) startPolicySession() (tpm2.Session, func() error, error) {
+	opts := []tpm2.AuthOption{
+		tpm2.AESEncryption(sessionKeyBits, tpm2.EncryptIn),
+		tpm2.Salted(s.saltHandle, s.saltPub),
+	}
+	// The key auth is only included in the session HMAC with TPM2_PolicyAuthValue
+	if s.policy.authValue {
+		opts = append(opts, tpm2.Auth(s.keyAuth))
+	}
+	sess, close, err := tpm2.PolicySession(s.tpm, tpm2.TPMAlgSHA256, sessionNonceSize, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start policy session: %w", err)
+	}
+	err = s.policy.execute(s.tpm, sess.Handle())
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return sess, close, nil
+}
+
+// signer returns a crypto.Signer signing with the IK through the encrypted session
+func (s *tpmSessions) signer() (crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ik == nil {
+		return nil, ErrSessionKeysNotLoaded
+	}
+	return &sessionSigner{s: s, pub: s.ik.pub}, nil
+}
+
+// sessionSigner implements crypto.Signer for the IK loaded through the session
+type sessionSigner struct {
+	s   *tpmSessions
+	pub crypto.PublicKey
+}
+
+func (s *sessionSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *sessionSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.s.sign(digest, opts)
+}
+
+func publicKey(public *tpm2.TPMTPublic) (crypto.PublicKey, error) {
+	switch public.Type {
+	case tpm2.TPMAlgRSA:
+		parms, err := public.Parameters.RSADetail()
+		if err != nil {
+			return nil, err
+		}
+		unique, err := public.Unique.RSA()
+		if err != nil {
+			return nil, err
+		}
+		return tpm2.RSAPub(parms, unique)
+	case tpm2.TPMAlgECC:
+		parms, err := public.Parameters.ECCDetail()
+		if err != nil {
+			return nil, err
+		}
+		unique, err := public.Unique.ECC()
+		if err != nil {
+			return nil, err
+		}
+		pub, err := tpm2.ECCPub(parms, unique)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type 0x%x", uint16(public.Type))
+	}
+}
+
+func hashAlg(h crypto.Hash) (tpm2.TPMIAlgHash, error) {
+	switch h {
+	case crypto.SHA1:
+		return tpm2.TPMAlgSHA1, nil
+	case crypto.SHA256:
+		return tpm2.TPMAlgSHA256, nil
+	case crypto.SHA384:
+		return tpm2.TPMAlgSHA384, nil
+	case crypto.SHA512:
+		return tpm2.TPMAlgSHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported hash algorithm %v", h)
+	}
+}
+
+// pcrBitmap returns the TPMS_PCR_SELECTION bitmap of the PCRs
+func pcrBitmap(pcrs []int) []byte {
+	bitmap := make([]byte, numPcrs/8)
+	for _, pcr := range pcrs {
+		bitmap[pcr/8] |= 1 << (pcr % 8)
+	}
+	return bitmap
+}
+
+// startSessions starts the encrypted sessions and loads the current AK and IK
+// through them, or uses the keys at the persistent handles if configured. The
+// SRK must match the parent name in the AK creation data
+func startSessions(audit bool, akHandle, ikHandle tpmutil.Handle) (*tpmSessions, error) {
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+
+	createData, err := tpm2.Unmarshal[tpm2.TPMSCreationData](ak.AttestationParameters().CreateData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode AK creation data: %w", err)
+	}
+
+	s, err := newTpmSessions(rwc, audit, createData.ParentName.Buffer, authValues)
+	if err != nil {
+		return nil, err
+	}
+	s.policy = ikPolicy
+
+	err = loadSessionKeys(s, akHandle, ikHandle)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadSessionKeys loads the current AK and IK through the encrypted session,
+// see tpmSessions.loadKeys
+func loadSessionKeys(s *tpmSessions, akHandle, ikHandle tpmutil.Handle) error {
+	akBytes, err := ak.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal AK: %w", err)
+	}
+	ikBytes, err := ik.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal IK: %w", err)
+	}
+	timer := metrics.Start("tpm", metrics.OpKeyLoad)
+	err = s.loadKeys(akBytes, ikBytes, akHandle, ikHandle)
+	timer.Done(err)
+	return err
+}
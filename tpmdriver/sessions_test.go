@@ -0,0 +1,185 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+func TestPcrBitmap(t *testing.T) {
+	tests := []struct {
+		name string
+		pcrs []int
+		want []byte
+	}{
+		{"Empty", nil, []byte{0x00, 0x00, 0x00}},
+		{"SRTM", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, []byte{0xff, 0xff, 0x00}},
+		{"DRTM", []int{17, 18, 19, 20, 21, 22}, []byte{0x00, 0x00, 0x7e}},
+		{"Sparse", []int{0, 7, 23}, []byte{0x81, 0x00, 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pcrBitmap(tt.pcrs); !bytes.Equal(got, tt.want) {
+				t.Errorf("pcrBitmap() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSessions requires a TPM simulator, see TestPersistKey
+func TestSessions(t *testing.T) {
+
+	rwc := openSimulator(t)
+	defer rwc.Close()
+	createSrk(t, rwc)
+
+	// Sessions must not be salted with an SRK not matching the AK parent
+	_, err := newTpmSessions(rwc, false, make([]byte, 34), tpmAuth{})
+	if err == nil {
+		t.Fatalf("newTpmSessions() with wrong SRK name succeeded")
+	}
+
+	for _, audit := range []bool{false, true} {
+		s, err := newTpmSessions(rwc, audit, nil, tpmAuth{})
+		if err != nil {
+			t.Fatalf("newTpmSessions() error = %v", err)
+		}
+
+		bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 7}}
+		nonce := []byte("0123456789abcdef")
+
+		if _, err := s.quote(nonce, bank); err != ErrSessionKeysNotLoaded {
+			t.Errorf("quote() error = %v, want %v", err, ErrSessionKeysNotLoaded)
+		}
+
+		err = s.loadKeys(createKeyBlob(t, rwc), createKeyBlob(t, rwc), 0, 0)
+		if err != nil {
+			t.Fatalf("loadKeys() error = %v", err)
+		}
+
+		q, err := s.quote(nonce, bank)
+		if err != nil {
+			t.Fatalf("quote() error = %v", err)
+		}
+		err = checkQuoteSelection(q.Quote.Quote, bank)
+		if err != nil {
+			t.Errorf("checkQuoteSelection() error = %v", err)
+		}
+		if audit != (len(q.AuditInfo) > 0) {
+			t.Errorf("audit info present = %v, want %v", len(q.AuditInfo) > 0, audit)
+		}
+		if audit != (len(q.AuditSigner) > 0) {
+			t.Errorf("audit signer present = %v, want %v", len(q.AuditSigner) > 0, audit)
+		}
+
+		signer, err := s.signer()
+		if err != nil {
+			t.Fatalf("signer() error = %v", err)
+		}
+		digest := sha256.Sum256([]byte("data"))
+		sig, err := signer.Sign(nil, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		if !ecdsa.VerifyASN1(signer.Public().(*ecdsa.PublicKey), digest[:], sig) {
+			t.Errorf("failed to verify signature")
+		}
+
+		s.close()
+	}
+}
+
+// BenchmarkSessionQuote compares the latency of quotes with plaintext password
+// sessions, encrypted sessions and encrypted and audited sessions. Requires a
+// TPM simulator or TPM, see TestPersistKey
+func BenchmarkSessionQuote(b *testing.B) {
+
+	rwc := openSimulator(b)
+	defer rwc.Close()
+	createSrk(b, rwc)
+
+	bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0, 1, 2, 3, 4, 5, 6, 7}}
+	nonce := []byte("0123456789abcdef")
+	blob := createKeyBlob(b, rwc)
+
+	b.Run("Password", func(b *testing.B) {
+		t := transport.FromReadWriter(rwc)
+		var kb keyBlob
+		if err := json.Unmarshal(blob, &kb); err != nil {
+			b.Fatal(err)
+		}
+		rsp, err := tpm2.Load{
+			ParentHandle: tpm2.AuthHandle{Handle: tpm2.TPMHandle(srkHandle), Auth: tpm2.PasswordAuth(nil)},
+			InPrivate:    tpm2.TPM2BPrivate{Buffer: kb.Blob},
+			InPublic:     tpm2.BytesAs2B[tpm2.TPMTPublic](kb.Public),
+		}.Execute(t)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer tpm2.FlushContext{FlushHandle: rsp.ObjectHandle}.Execute(t)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := tpm2.Quote{
+				SignHandle:     tpm2.AuthHandle{Handle: rsp.ObjectHandle, Name: rsp.Name, Auth: tpm2.PasswordAuth(nil)},
+				QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+				InScheme:       tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+				PCRSelect: tpm2.TPMLPCRSelection{
+					PCRSelections: []tpm2.TPMSPCRSelection{{
+						Hash:      tpm2.TPMAlgSHA256,
+						PCRSelect: pcrBitmap(bank.Pcrs),
+					}},
+				},
+			}.Execute(t)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	for _, audit := range []bool{false, true} {
+		name := "Encrypted"
+		if audit {
+			name = "EncryptedAudit"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, err := newTpmSessions(rwc, audit, nil, tpmAuth{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.close()
+			if err := s.loadKeys(blob, blob, 0, 0); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.quote(nonce, bank); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -18,7 +18,9 @@ package tpmdriver
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -26,17 +28,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Fraunhofer-AISEC/go-attestation/attest"
-	"go.mozilla.org/pkcs7"
 
 	"github.com/google/go-tpm/legacy/tpm2"
 	"github.com/google/go-tpm/tpmutil"
-	"github.com/sirupsen/logrus"
 
 	// local modules
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
@@ -44,22 +46,54 @@ import (
 	"github.com/Fraunhofer-AISEC/cmc/ima"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	m "github.com/Fraunhofer-AISEC/cmc/measure"
+	"github.com/Fraunhofer-AISEC/cmc/metrics"
 )
 
 // Tpm is a structure that implements the Measure method
 // of the attestation report Measurer interface
 type Tpm struct {
 	Mu             sync.Mutex
-	Pcrs           []int
+	Banks          []PcrBank
 	SigningCerts   []*x509.Certificate
 	MeasuringCerts []*x509.Certificate
 	UseIma         bool
 	ImaPcr         int
 	MeasurementLog bool
+	RawEventLog    bool
 	UseCtr         bool
 	CtrPcr         int
 	CtrLog         string
 	Serializer     ar.Serializer
+
+	// certMu protects the keys and certificates, which can be replaced
+	// during runtime through certificate renewal
+	certMu   sync.RWMutex
+	conf     *ar.DriverConfig
+	akHandle tpmutil.Handle
+	ikHandle tpmutil.Handle
+	nvIndex  tpmutil.Handle
+	version  string
+	signer   *tpmSigner
+
+	// imaWatcher is only set if IMA is used
+	imaWatcher *ima.Watcher
+	// imaRedactor is only set if the IMA file paths are redacted
+	imaRedactor *ima.Redactor
+
+	// sessions is only set if encrypted sessions are configured
+	sessions *tpmSessions
+
+	// eventLog is only set if the measurement log or the raw event log is used
+	eventLog *eventLog
+}
+
+// Quote is a TPM quote together with the session audit attestation, which
+// is only present if audit sessions are configured
+type Quote struct {
+	attest.Quote
+	AuditInfo      []byte
+	AuditSignature []byte
+	AuditSigner    []byte
 }
 
 const (
@@ -67,6 +101,8 @@ const (
 	ikchainFile = "ikchain.pem"
 	akFile      = "ak_encrypted.json"
 	ikFile      = "ik_encrypted.json"
+
+	biosMeasurementsFile = "/sys/kernel/security/tpm0/binary_bios_measurements"
 )
 
 var (
@@ -74,9 +110,24 @@ var (
 	ak  *attest.AK  = nil
 	ik  *attest.Key = nil
 	ek  []attest.EK
+
+	// tpmConn is the connection to the TPM shared by go-attestation and the
+	// low-level go-tpm operations not provided by go-attestation, as /dev/tpm0
+	// can only be opened once
+	tpmConn io.ReadWriteCloser
 )
 
-var log = logrus.WithField("service", "tpmdriver")
+// commandChannel provides the TPM connection to go-attestation
+type commandChannel struct {
+	io.ReadWriteCloser
+}
+
+// MeasurementLog implements the go-attestation CommandChannelTPM20 interface
+func (c *commandChannel) MeasurementLog() ([]byte, error) {
+	return os.ReadFile(biosMeasurementsFile)
+}
+
+var log = internal.NewLogger(internal.SubsystemDrivers, "tpmdriver")
 
 // Init opens and initializes a TPM object, checks if provosioning is
 // required and if so, provisions the TPM
@@ -94,6 +145,30 @@ func (t *Tpm) Init(c *ar.DriverConfig) error {
 		return fmt.Errorf("serializer not initialized in driver config")
 	}
 
+	// The key auth can only be used through the encrypted sessions, as
+	// go-attestation performs quotes and signatures with an empty auth
+	if c.KeyAuth != "" && !c.EncryptSessions {
+		return errors.New("key auth requires encrypted sessions")
+	}
+	var err error
+	authValues, err = loadAuth(c)
+	if err != nil {
+		return fmt.Errorf("failed to load TPM auth values: %w", err)
+	}
+
+	// The IK policy is satisfied within policy sessions, which are only
+	// provided by the encrypted sessions
+	ikPolicy, err = newKeyPolicy(c.IkPolicyPcrs, c.IkPolicyAuthValue)
+	if err != nil {
+		return err
+	}
+	if ikPolicy.enabled() && !c.EncryptSessions {
+		return errors.New("IK policy requires encrypted sessions")
+	}
+	if ikPolicy.authValue && c.KeyAuth == "" {
+		return errors.New("IK auth value policy requires key auth")
+	}
+
 	// Create storage folder for storage of internal data if not existing
 	if c.StoragePath != "" {
 		if _, err := os.Stat(c.StoragePath); err != nil {
@@ -115,12 +190,87 @@ func (t *Tpm) Init(c *ar.DriverConfig) error {
 		return fmt.Errorf("failed to open TPM: %w", err)
 	}
 
+	info, err := GetTpmInfo()
+	if err != nil {
+		log.Warnf("Failed to get TPM info: %v", err)
+	} else {
+		t.version = fmt.Sprintf("%v %v.%v", info.Manufacturer.String(),
+			info.FirmwareVersionMajor, info.FirmwareVersionMinor)
+	}
+
+	akHandle, err := ParseHandle(c.AkHandle)
+	if err != nil {
+		return fmt.Errorf("invalid AK handle: %w", err)
+	}
+	ikHandle, err := ParseHandle(c.IkHandle)
+	if err != nil {
+		return fmt.Errorf("invalid IK handle: %w", err)
+	}
+
+	nvIndex, err := ParseNvIndex(c.NvIndex)
+	if err != nil {
+		return fmt.Errorf("invalid NV index: %w", err)
+	}
+
+	// If configured, load the keys and certificates from the TPM NV indices
+	// first and only fall back to the storage path
 	var akchain []*x509.Certificate
 	var ikchain []*x509.Certificate
+	loadedNv := false
+	if nvIndex != 0 {
+		akchain, ikchain, err = loadNvKeys(nvIndex)
+		if err == nil {
+			loadedNv = true
+			provisioningRequired = false
+		} else if errors.Is(err, ErrNvEmpty) {
+			log.Info("No TPM credentials stored in NV indices")
+		} else {
+			log.Warnf("Failed to load TPM credentials from NV indices: %v", err)
+		}
+	}
+
+	// Corrupted or unreadable key blobs and certificates are not fatal, the
+	// keys are then re-created and re-enrolled. The keys of the previous
+	// provisioning are replaced at the persistent handles
+	var stale []crypto.PublicKey
+	if !provisioningRequired && !loadedNv {
+		akchain, ikchain, err = loadStoredKeys(c.StoragePath)
+		if err != nil {
+			log.Warnf("Failed to load stored keys: %v. Re-provisioning TPM", err)
+			// The certificates may still identify the keys at the persistent handles
+			if akchain, ikchain, err := loadTpmCerts(c.StoragePath); err == nil {
+				stale = staleKeys(akchain, ikchain)
+			}
+			provisioningRequired = true
+		}
+	}
+
+	if !provisioningRequired {
+		// Only use the stored keys if they match the stored certificates and
+		// the persisted keys, otherwise re-create and re-enroll the keys
+		err = validateKeys(akchain, ikchain, akHandle, ikHandle)
+		if err == nil {
+			// Keys bound to a previous boot state are re-created
+			err = checkIkPolicy()
+		}
+		if err != nil {
+			log.Warnf("Failed to validate stored keys: %v. Re-provisioning TPM", err)
+			stale = staleKeys(akchain, ikchain)
+			closeKeys()
+			provisioningRequired = true
+		}
+	}
+
 	if provisioningRequired {
 
+		// Do not enroll keys which cannot be persisted afterwards
+		err = checkPersistentHandles(akHandle, ikHandle, c.EvictHandles, stale)
+		if err != nil {
+			return fmt.Errorf("failed to provision TPM: %w", err)
+		}
+
 		log.Info("Provisioning TPM (might take a while)..")
-		ek, ak, ik, err = createKeys(TPM, c.KeyConfig)
+		ek, ak, ik, err = createKeys(TPM, c.AkKeyConfig, c.KeyConfig)
 		if err != nil {
 			return fmt.Errorf("activate credential failed: createKeys returned %w", err)
 		}
@@ -134,104 +284,231 @@ func (t *Tpm) Init(c *ar.DriverConfig) error {
 		log.Tracef("Created AK CSR: %v", akCsr.Subject.CommonName)
 		log.Tracef("Created IK CSR: %v", ikCsr.Subject.CommonName)
 
-		akchain, ikchain, err = provisionTpm(c.ServerAddr, akCsr, ikCsr)
+		akchain, ikchain, err = provisionTpm(c.ServerAddr, c.BootstrapToken, ek, ak, ik, akCsr, ikCsr)
 		if err != nil {
 			return fmt.Errorf("failed to provision TPM: %w", err)
 		}
 
+		// The key auth is set after enrollment, as the CSRs and the credential
+		// activation are performed by go-attestation with an empty key auth
+		if authValues.key != "" {
+			ak, ik, err = setKeyAuth(ak, ik)
+			if err != nil {
+				return fmt.Errorf("failed to set key auth: %w", err)
+			}
+		}
+
 		if c.StoragePath != "" {
 			err = saveCerts(c.StoragePath, akchain, ikchain)
 			if err != nil {
 				return fmt.Errorf("failed to save TPM data: %w", err)
 			}
 
-			err = saveKeys(c.StoragePath)
+			err = saveKeys(c.StoragePath, ak, ik)
 			if err != nil {
 				return fmt.Errorf("failed to save keys: %w", err)
 			}
 		}
+	}
 
-	} else {
-		err = loadTpmKeys(c.StoragePath)
-		if err != nil {
-			return fmt.Errorf("failed to load TPM keys: %w", err)
-		}
-		akchain, ikchain, err = loadTpmCerts(c.StoragePath)
+	// Store the credentials in NV if they were not loaded from there, which
+	// also migrates credentials from the storage path
+	if nvIndex != 0 && (provisioningRequired || !loadedNv) {
+		err = saveNvKeys(nvIndex, akchain, ikchain, c.EvictHandles)
 		if err != nil {
-			return fmt.Errorf("failed to load TPM certificates: %w", err)
+			return fmt.Errorf("failed to store TPM credentials in NV: %w", err)
 		}
 	}
 
+	err = persistKeys(akHandle, ikHandle, c.EvictHandles, stale)
+	if err != nil {
+		return fmt.Errorf("failed to persist TPM keys: %w", err)
+	}
+
 	name, err := GetAkQualifiedName()
 	if err != nil {
 		return fmt.Errorf("failed to get AK qualified name: %w", err)
 	}
 	log.Debugf("Using AK with qualified name: %v", hex.EncodeToString(name))
 
-	// Determine if the system is an SRTM or DRTM system to include the
-	// respective PCRs into the TPM quote
-	pcrs, err := getQuotePcrs(t)
+	if c.AuditSessions && !c.EncryptSessions {
+		return errors.New("audit sessions require encrypted sessions")
+	}
+	if c.EncryptSessions {
+		t.sessions, err = startSessions(c.AuditSessions, akHandle, ikHandle)
+		if err != nil {
+			return fmt.Errorf("failed to start encrypted TPM sessions: %w", err)
+		}
+	}
+
+	banks, err := getPcrBanks(t, c)
 	if err != nil {
-		return fmt.Errorf("failed to determine TPM Quote CRs: %w", err)
+		return fmt.Errorf("failed to determine TPM quote PCRs: %w", err)
+	}
+
+	if c.UseIma {
+		if c.ImaRedaction != nil {
+			t.imaRedactor, err = ima.NewRedactor(c.ImaRedaction)
+			if err != nil {
+				return fmt.Errorf("failed to configure IMA redaction: %w", err)
+			}
+		}
+		t.imaWatcher, err = newImaWatcher(c)
+		if err != nil {
+			return fmt.Errorf("failed to create IMA watcher: %w", err)
+		}
+		t.imaWatcher.Start()
 	}
 
-	t.Pcrs = pcrs
+	t.Banks = banks
 	t.UseIma = c.UseIma
 	t.ImaPcr = c.ImaPcr
 	t.SigningCerts = ikchain
 	t.MeasuringCerts = akchain
 	t.MeasurementLog = c.MeasurementLog
+	t.RawEventLog = c.RawEventLog
 	t.Serializer = c.Serializer
 	t.UseCtr = c.UseCtr && strings.EqualFold(c.CtrDriver, "tpm")
 	t.CtrLog = c.CtrLog
 	t.CtrPcr = c.CtrPcr
+	t.conf = c
+	t.akHandle = akHandle
+	t.ikHandle = ikHandle
+	t.nvIndex = nvIndex
+
+	// Parse the event log once on startup. Platforms without event log are
+	// reported in the driver status, the measurements then contain the final
+	// PCR values
+	if t.MeasurementLog || t.RawEventLog {
+		t.eventLog = newEventLog(FileEventLog(biosMeasurementsFile))
+		if _, events, err := t.eventLog.get(); err != nil {
+			log.Warnf("Failed to read event log: %v. Using final PCR values as measurements", err)
+		} else {
+			log.Debugf("Parsed event log with %v events", len(events))
+		}
+	}
 
 	return nil
 }
 
 // Measure implements the attestation reports generic Measure interface to be called
-// as a plugin during attestation report generation
+// as a plugin during attestation report generation. Only the first configured
+// PCR bank is quoted, MeasureAll provides quotes for all configured banks
 func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 
-	log.Trace("Collecting TPM measurements")
-
 	if t == nil {
 		return ar.Measurement{}, fmt.Errorf("internal error: tpm object not initialized")
 	}
-	if len(t.Pcrs) == 0 {
+	if len(t.Banks) == 0 {
+		return ar.Measurement{}, fmt.Errorf("internal error: no PCR banks configured")
+	}
+
+	return t.measureBank(nonce, t.Banks[0], true, false)
+}
+
+// MeasureAll implements the attestation report MultiMeasurer interface and
+// returns one TPM measurement per configured PCR bank
+func (t *Tpm) MeasureAll(nonce []byte) ([]ar.Measurement, error) {
+
+	if t == nil {
+		return nil, fmt.Errorf("internal error: tpm object not initialized")
+	}
+
+	measurements := make([]ar.Measurement, 0, len(t.Banks))
+	for i, bank := range t.Banks {
+		// The raw event log contains the events of all banks and is only
+		// included once
+		m, err := t.measureBank(nonce, bank, i == 0, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure PCR bank %v: %w", bank, err)
+		}
+		measurements = append(measurements, m)
+	}
+
+	return measurements, nil
+}
+
+// MeasureDryRun implements the attestation report DryRunMeasurer interface. It
+// collects the PCRs and event logs of all configured banks like MeasureAll, but
+// substitutes the quotes with zero quotes of the same size, so that no quote
+// is requested from the TPM
+func (t *Tpm) MeasureDryRun(nonce []byte) ([]ar.Measurement, error) {
+
+	if t == nil {
+		return nil, fmt.Errorf("internal error: tpm object not initialized")
+	}
+
+	measurements := make([]ar.Measurement, 0, len(t.Banks))
+	for i, bank := range t.Banks {
+		m, err := t.measureBank(nonce, bank, i == 0, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure PCR bank %v: %w", bank, err)
+		}
+		measurements = append(measurements, m)
+	}
+
+	return measurements, nil
+}
+
+func (t *Tpm) measureBank(nonce []byte, bank PcrBank, rawLog, dryRun bool) (ar.Measurement, error) {
+
+	log.Tracef("Collecting TPM measurements for PCR bank %v", bank)
+
+	if len(bank.Pcrs) == 0 {
 		log.Warn("TPM measurement based on reference values does not contain any PCRs")
 	}
 
 	log.Tracef("Collecting TPM Quote for PCRs %v",
-		strings.Trim(strings.Join(strings.Fields(fmt.Sprint(t.Pcrs)), ","), "[]"))
+		strings.Trim(strings.Join(strings.Fields(fmt.Sprint(bank.Pcrs)), ","), "[]"))
 
-	pcrValues, quote, err := GetMeasurement(t, nonce, t.Pcrs)
+	var pcrValues []attest.PCR
+	var quote *Quote
+	var err error
+	if dryRun {
+		pcrValues, err = getPcrs(t, bank)
+		t.certMu.RLock()
+		quote = zeroQuote(nonce, t.MeasuringCerts)
+		t.certMu.RUnlock()
+	} else {
+		pcrValues, quote, err = GetMeasurement(t, nonce, bank)
+	}
 	if err != nil {
 		return ar.Measurement{}, fmt.Errorf("failed to get TPM Measurement: %w", err)
 	}
 
-	// For a more detailed measurement, try to read the kernel binary bios measurements
-	// and use these values, which represent the software artifacts that have been
-	// extended. Use the final PCR values only as a fallback, if the file cannot be read
+	// Detailed measurements are only available for the SHA256 bank
+	detailed := bank.Alg == attest.HashSHA256
+
+	// For a more detailed measurement, use the cached kernel binary bios measurements,
+	// which represent the software artifacts that have been extended. Use the final
+	// PCR values only as a fallback, if the event log is not available
+	var rawEventLog []byte
 	var biosMeasurements []ar.ReferenceValue
-	if t.MeasurementLog {
+	measurementLog := t.MeasurementLog && detailed
+	rawLog = rawLog && t.RawEventLog
+	if t.eventLog != nil && (measurementLog || rawLog) {
 		log.Trace("Collecting binary bios measurements")
-		biosMeasurements, err = GetBiosMeasurements("/sys/kernel/security/tpm0/binary_bios_measurements")
+		rawEventLog, biosMeasurements, err = t.eventLog.get()
 		if err != nil {
-			t.MeasurementLog = false
+			measurementLog = false
 			log.Warnf("failed to read binary bios measurements: %v. Using final PCR values as measurements",
 				err)
 		}
 		log.Tracef("Collected %v binary bios measurements", len(biosMeasurements))
+	} else {
+		measurementLog = false
+	}
+	if !rawLog {
+		rawEventLog = nil
 	}
 
-	hashChain := make([]ar.Artifact, len(t.Pcrs))
-	for i, num := range t.Pcrs {
+	hashChain := make([]ar.Artifact, len(bank.Pcrs))
+	for i, num := range bank.Pcrs {
 
 		events := make([]ar.MeasureEvent, 0)
 
 		// Collect detailed measurements from event logs if specified
-		if t.MeasurementLog {
+		if measurementLog {
 			for _, digest := range biosMeasurements {
 				if num == *digest.Pcr {
 					event := ar.MeasureEvent{
@@ -252,7 +529,7 @@ func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 		pcrMeasurement.Pcr = new(int)
 		*pcrMeasurement.Pcr = num
 
-		if t.MeasurementLog {
+		if measurementLog {
 			pcrMeasurement.Type = "PCR Eventlog"
 			pcrMeasurement.Events = events
 		} else {
@@ -263,14 +540,27 @@ func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 		hashChain[i] = pcrMeasurement
 	}
 
-	if t.UseIma {
+	if t.UseIma && detailed {
 		// If the IMA is used, not the final PCR value is sent but instead
 		// a list of the kernel modules which are extended during verification
 		// to result in the final value
-		imaEvents, err := ima.GetImaRuntimeDigests()
+		var imaEvents []ar.MeasureEvent
+		var err error
+		if t.imaWatcher != nil {
+			imaEvents, err = t.imaWatcher.Events()
+		} else {
+			imaEvents, err = ima.GetImaRuntimeDigests()
+		}
 		if err != nil {
 			log.Warnf("failed to get IMA runtime digests: %v", err)
 		}
+		var redaction *ar.Redaction
+		if t.imaRedactor != nil {
+			imaEvents, redaction, err = t.imaRedactor.Redact(imaEvents)
+			if err != nil {
+				return ar.Measurement{}, fmt.Errorf("failed to redact IMA events: %w", err)
+			}
+		}
 
 		// Find the IMA PCR in the TPM Measurement
 		for i := range hashChain {
@@ -281,17 +571,18 @@ func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 				log.Tracef("Adding %v IMA events to PCR%v measurement", len(imaEvents),
 					*hashChain[i].Pcr)
 				hashChain[i].Events = imaEvents
+				hashChain[i].Redaction = redaction
 				hashChain[i].Summary = nil
 				hashChain[i].Type = "PCR Eventlog"
 			}
 		}
 	}
 
-	if t.UseCtr {
+	if t.UseCtr && detailed {
 		log.Tracef("Reading container measurements")
 		if _, err := os.Stat(t.CtrLog); err == nil {
 			// If CMC container measurements are used, add the list of executed containers
-			data, err := os.ReadFile(t.CtrLog)
+			data, err := internal.LoadFile(t.CtrLog)
 			if err != nil {
 				return ar.Measurement{}, fmt.Errorf("failed to read container measurements: %w", err)
 			}
@@ -319,6 +610,7 @@ func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 							CtrData: &ar.CtrData{
 								ConfigSha256: ml.ConfigSha256,
 								RootfsSha256: ml.RootfsSha256,
+								Restored:     ml.Restored,
 							},
 						}
 						hashChain[i].Events = append(hashChain[i].Events, event)
@@ -332,12 +624,20 @@ func (t *Tpm) Measure(nonce []byte) (ar.Measurement, error) {
 		log.Trace("TPM PCR Container measurements omitted: not configured")
 	}
 
+	t.certMu.RLock()
+	certs := internal.WriteCertsDer(t.MeasuringCerts)
+	t.certMu.RUnlock()
+
 	tm := ar.Measurement{
-		Type:      "TPM Measurement",
-		Evidence:  quote.Quote,
-		Signature: quote.Signature,
-		Certs:     internal.WriteCertsDer(t.MeasuringCerts),
-		Artifacts: hashChain,
+		Type:           "TPM Measurement",
+		Evidence:       quote.Quote.Quote,
+		Signature:      quote.Signature,
+		Certs:          certs,
+		Artifacts:      hashChain,
+		AuditEvidence:  quote.AuditInfo,
+		AuditSignature: quote.AuditSignature,
+		AuditSigner:    quote.AuditSigner,
+		EventLog:       rawEventLog,
 	}
 
 	for _, elem := range tm.Artifacts {
@@ -376,31 +676,330 @@ func (t *Tpm) Unlock() error {
 }
 
 // GetSigningKeys returns the IK private and public key as a generic
-// crypto interface
+// crypto interface. If an IK handle is configured, the IK persisted at the
+// handle signs. The IK signer is loaded once and cached until the IK is
+// replaced through certificate renewal
 func (t *Tpm) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
 
 	if t == nil {
 		return nil, nil, errors.New("internal error: TPM object is nil")
 	}
+
+	t.certMu.RLock()
+	signer := t.signer
+	t.certMu.RUnlock()
+	if signer != nil {
+		return signer, signer.Public(), nil
+	}
+
+	t.certMu.Lock()
+	defer t.certMu.Unlock()
+	if t.signer != nil {
+		return t.signer, t.signer.Public(), nil
+	}
 	if ik == nil {
 		return nil, nil, fmt.Errorf("failed to get IK Signer: not initialized")
 	}
-	priv, err := ik.Private(ik.Public())
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get IK Private")
+
+	var priv crypto.Signer
+	if t.sessions != nil {
+		var err error
+		priv, err = t.sessions.signer()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get IK session signer: %w", err)
+		}
+	} else if t.ikHandle != 0 {
+		var err error
+		priv, err = newPersistentSigner(t.ikHandle, ik)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get IK signer: %w", err)
+		}
+	} else {
+		key, err := ik.Private(ik.Public())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get IK Private")
+		}
+		var ok bool
+		priv, ok = key.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("IK private key of type %T is not a signer", key)
+		}
 	}
+	t.signer = &tpmSigner{t: t, signer: priv, pub: ik.Public()}
+
+	return t.signer, t.signer.Public(), nil
+}
+
+// tpmSigner serializes the signing operations with the IK with all other
+// operations on the TPM
+type tpmSigner struct {
+	t      *Tpm
+	signer crypto.Signer
+	pub    crypto.PublicKey
+}
 
-	return priv, ik.Public(), nil
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *tpmSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.t.Lock()
+	defer s.t.Unlock()
+	timer := metrics.Start("tpm", metrics.OpSign)
+	sig, err := s.signer.Sign(rand, digest, opts)
+	timer.Done(err)
+	return sig, err
 }
 
 func (t *Tpm) GetCertChain() ([]*x509.Certificate, error) {
 	if t == nil {
 		return nil, errors.New("internal error: TPM object is nil")
 	}
+	t.certMu.RLock()
+	defer t.certMu.RUnlock()
 	log.Tracef("Returning %v certificates", len(t.SigningCerts))
 	return t.SigningCerts, nil
 }
 
+// Expiry implements the attestation report Renewer interface and returns the
+// earliest expiry of the AK and IK certificates
+func (t *Tpm) Expiry() (time.Time, error) {
+	if t == nil {
+		return time.Time{}, errors.New("internal error: TPM object is nil")
+	}
+	t.certMu.RLock()
+	defer t.certMu.RUnlock()
+	if len(t.SigningCerts) == 0 || len(t.MeasuringCerts) == 0 {
+		return time.Time{}, errors.New("no certificates present")
+	}
+	expiry := t.SigningCerts[0].NotAfter
+	if t.MeasuringCerts[0].NotAfter.Before(expiry) {
+		expiry = t.MeasuringCerts[0].NotAfter
+	}
+	return expiry, nil
+}
+
+// Status implements the attestation report StatusProvider interface and
+// reports the TPM version, the PCR banks and the AK and IK certificates
+func (t *Tpm) Status() ar.DriverStatus {
+	s := ar.DriverStatus{
+		MeasurementTypes: []string{"TPM Measurement"},
+	}
+	if t == nil {
+		return s
+	}
+	s.Version = t.version
+	for _, bank := range t.Banks {
+		s.PcrBanks = append(s.PcrBanks, bank.String())
+	}
+
+	t.certMu.RLock()
+	defer t.certMu.RUnlock()
+	for _, c := range []struct {
+		name  string
+		chain []*x509.Certificate
+	}{
+		{"AK", t.MeasuringCerts},
+		{"IK", t.SigningCerts},
+	} {
+		if len(c.chain) > 0 {
+			s.Certificates = append(s.Certificates, ar.CertStatus{
+				Name:     c.name,
+				Subject:  c.chain[0].Subject.CommonName,
+				NotAfter: c.chain[0].NotAfter,
+			})
+		}
+	}
+
+	if t.eventLog != nil {
+		if err := t.eventLog.status(); err != nil {
+			s.Warnings = append(s.Warnings, err.Error())
+		}
+	}
+
+	return s
+}
+
+// CheckHealth implements the attestation report HealthChecker interface by
+// reading a TPM property. The TPM lock is acquired, so that the check also
+// fails if a pending TPM operation does not return
+func (t *Tpm) CheckHealth() error {
+	if t == nil {
+		return errors.New("internal error: TPM object is nil")
+	}
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+	_, _, err = tpm2.GetCapability(rwc, tpm2.CapabilityTPMProperties, 1,
+		uint32(tpm2.Manufacturer))
+	if err != nil {
+		return fmt.Errorf("TPM not responding: %w", err)
+	}
+	return nil
+}
+
+// Close implements io.Closer. It stops the IMA watcher, flushes the loaded
+// keys and sessions and closes the TPM. Without a resource manager, transient
+// objects remain loaded after the process exits, so that repeatedly started
+// short-lived processes would exhaust the TPM object memory
+func (t *Tpm) Close() error {
+	if t == nil {
+		return errors.New("internal error: TPM object is nil")
+	}
+	if t.imaWatcher != nil {
+		t.imaWatcher.Stop()
+	}
+
+	// Wait for operations in progress
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	if TPM == nil {
+		return nil
+	}
+	if t.sessions != nil {
+		t.sessions.close()
+	}
+	if ak != nil {
+		if err := ak.Close(TPM); err != nil {
+			log.Warnf("Failed to flush AK: %v", err)
+		}
+		ak = nil
+	}
+	if ik != nil {
+		if err := ik.Close(); err != nil {
+			log.Warnf("Failed to flush IK: %v", err)
+		}
+		ik = nil
+	}
+	return CloseTpm()
+}
+
+// Renew implements the attestation report Renewer interface. It re-enrolls the AK
+// and IK at the provisioning server, either with the existing keys or with newly
+// created keys if rotateKeys is set, and replaces the stored and in-memory certificates
+func (t *Tpm) Renew(rotateKeys bool) error {
+
+	if t == nil || t.conf == nil {
+		return errors.New("internal error: TPM object not initialized")
+	}
+
+	// Block measurements and signing operations during renewal
+	t.Lock()
+	defer t.Unlock()
+
+	// The CSRs cannot be signed with keys protected by the key auth through
+	// go-attestation, therefore new keys are always created. With an IK
+	// policy, the new IK is bound to the current PCR values
+	if authValues.key != "" && !rotateKeys {
+		log.Info("Rotating keys during renewal as key auth is configured")
+		rotateKeys = true
+	}
+	if ikPolicy.enabled() && !rotateKeys {
+		log.Info("Rotating keys during renewal as IK policy is configured")
+		rotateKeys = true
+	}
+
+	log.Infof("Renewing TPM certificates (rotate keys: %v)", rotateKeys)
+
+	var err error
+	newEk := ek
+	newAk := ak
+	newIk := ik
+	if rotateKeys {
+		newEk, newAk, newIk, err = createKeys(TPM, t.conf.AkKeyConfig, t.conf.KeyConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create keys: %w", err)
+		}
+	} else if len(newEk) == 0 {
+		newEk, err = getEks(TPM)
+		if err != nil {
+			return fmt.Errorf("failed to load EKs: %w", err)
+		}
+	}
+
+	akCsr, ikCsr, err := createCsrs(t.conf, newAk, newIk)
+	if err != nil {
+		return fmt.Errorf("failed to create CSRs: %w", err)
+	}
+
+	akchain, ikchain, err := provisionTpm(t.conf.ServerAddr, t.conf.BootstrapToken, newEk, newAk, newIk,
+		akCsr, ikCsr)
+	if err != nil {
+		return fmt.Errorf("failed to re-enroll keys: %w", err)
+	}
+
+	if authValues.key != "" {
+		newAk, newIk, err = setKeyAuth(newAk, newIk)
+		if err != nil {
+			return fmt.Errorf("failed to set key auth: %w", err)
+		}
+	}
+
+	if t.conf.StoragePath != "" {
+		if rotateKeys {
+			err = saveKeys(t.conf.StoragePath, newAk, newIk)
+			if err != nil {
+				return fmt.Errorf("failed to save keys: %w", err)
+			}
+		}
+		err = saveCerts(t.conf.StoragePath, akchain, ikchain)
+		if err != nil {
+			return fmt.Errorf("failed to save certificates: %w", err)
+		}
+	}
+
+	t.certMu.Lock()
+	oldEk, oldAk, oldIk := ek, ak, ik
+	ek, ak, ik = newEk, newAk, newIk
+	if rotateKeys {
+		// The persisted keys are replaced by the rotated keys before they are
+		// used for quotes and signatures
+		err = persistKeys(t.akHandle, t.ikHandle, true, nil)
+		if err != nil {
+			ek, ak, ik = oldEk, oldAk, oldIk
+			t.certMu.Unlock()
+			return fmt.Errorf("failed to persist rotated keys: %w", err)
+		}
+	}
+	if rotateKeys && t.sessions != nil {
+		err = loadSessionKeys(t.sessions, t.akHandle, t.ikHandle)
+		if err != nil {
+			ek, ak, ik = oldEk, oldAk, oldIk
+			t.certMu.Unlock()
+			return fmt.Errorf("failed to load rotated keys through encrypted session: %w", err)
+		}
+	}
+	t.SigningCerts = ikchain
+	t.MeasuringCerts = akchain
+	// The cached signer must not be used with a rotated IK
+	if rotateKeys {
+		t.signer = nil
+	}
+	t.certMu.Unlock()
+
+	if rotateKeys {
+		oldAk.Close(TPM)
+		oldIk.Close()
+	}
+
+	if t.nvIndex != 0 {
+		err = saveNvKeys(t.nvIndex, akchain, ikchain, t.conf.EvictHandles)
+		if err != nil {
+			return fmt.Errorf("failed to store renewed credentials in NV: %w", err)
+		}
+	}
+
+	log.Infof("Renewed TPM certificates, new expiry AK: %v, IK: %v",
+		akchain[0].NotAfter, ikchain[0].NotAfter)
+
+	return nil
+}
+
 // IsTpmProvisioningRequired checks if the Storage Root Key (SRK) is persisted
 // at 0x810000001 and the encrypted AK blob is present, which is used as an
 // indicator that the TPM is provisioned and the AK can directly be loaded.
@@ -442,7 +1041,6 @@ func IsTpmProvisioningRequired(storagePath string) (bool, error) {
 		return true, fmt.Errorf("failed to open TPM%v: %w", addr, err)
 	}
 	defer rwc.Close()
-	srkHandle := tpmutil.Handle(0x81000001)
 	_, _, _, err = tpm2.ReadPublic(rwc, srkHandle)
 	if err == nil {
 		log.Info("TPM Provisioning (Credential Activation) NOT REQUIRED")
@@ -472,13 +1070,26 @@ func OpenTpm() error {
 		return fmt.Errorf("failed to open TPM - already open")
 	}
 
-	var err error
-	config := &attest.OpenConfig{}
+	addr, err := getTpmAddr()
+	if err != nil {
+		return fmt.Errorf("failed to find TPM device: %w", err)
+	}
+	rwc, err := tpm2.OpenTPM(addr)
+	if err != nil {
+		return fmt.Errorf("failed to open TPM %v: %w", addr, err)
+	}
+
+	config := &attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &commandChannel{rwc},
+	}
 	TPM, err = attest.OpenTPM(config)
 	if err != nil {
+		rwc.Close()
 		TPM = nil
 		return fmt.Errorf("activate credential failed: OpenTPM returned %w", err)
 	}
+	tpmConn = rwc
 
 	return nil
 }
@@ -490,6 +1101,7 @@ func CloseTpm() error {
 	}
 	TPM.Close()
 	TPM = nil
+	tpmConn = nil
 	return nil
 }
 
@@ -570,9 +1182,9 @@ func GetAkQualifiedName() ([]byte, error) {
 	return qualifiedName, nil
 }
 
-// GetMeasurement retrieves the specified PCRs as well as a Quote over the PCRs
-// and returns the TPM quote as well as the single PCR values
-func GetMeasurement(t *Tpm, nonce []byte, pcrs []int) ([]attest.PCR, *attest.Quote, error) {
+// GetMeasurement retrieves the PCRs of the specified bank as well as a Quote over
+// the selected PCRs of this bank and returns the TPM quote as well as the single PCR values
+func GetMeasurement(t *Tpm, nonce []byte, bank PcrBank) ([]attest.PCR, *Quote, error) {
 
 	if TPM == nil {
 		return nil, nil, fmt.Errorf("TPM is not opened")
@@ -586,24 +1198,100 @@ func GetMeasurement(t *Tpm, nonce []byte, pcrs []int) ([]attest.PCR, *attest.Quo
 	t.Lock()
 	defer t.Unlock()
 
-	pcrValues, err := TPM.PCRs(attest.HashSHA256)
+	pcrValues, err := TPM.PCRs(bank.Alg)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get TPM PCRs: %w", err)
 	}
 	log.Trace("Finished reading PCRs from TPM")
 
 	// Retrieve quote and store quote data and signature in TPM measurement object
-	quote, err := ak.QuotePCRs(TPM, nonce, attest.HashSHA256, pcrs)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get TPM quote - %w", err)
+	var quote *Quote
+	timer := metrics.Start("tpm", metrics.OpQuote)
+	if t.sessions != nil {
+		quote, err = t.sessions.quote(nonce, bank)
+		timer.Done(err)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get TPM quote through encrypted session: %w", err)
+		}
+	} else if t.akHandle != 0 {
+		quote, err = persistentAkQuote(t.akHandle, ak, nonce, bank)
+		timer.Done(err)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get TPM quote - %w", err)
+		}
+	} else if isEccAk(ak) {
+		quote, err = eccAkQuote(ak, nonce, bank)
+		timer.Done(err)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get TPM quote - %w", err)
+		}
+	} else {
+		q, err := ak.QuotePCRs(TPM, nonce, bank.Alg, bank.Pcrs)
+		timer.Done(err)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get TPM quote - %w", err)
+		}
+		quote = &Quote{Quote: *q}
 	}
 	log.Trace("Finished getting Quote from TPM")
 
+	err = checkQuoteSelection(quote.Quote.Quote, bank)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid TPM quote: %w", err)
+	}
+
 	return pcrValues, quote, nil
 }
 
+// getPcrs reads the PCRs of the bank without quoting them
+func getPcrs(t *Tpm, bank PcrBank) ([]attest.PCR, error) {
+
+	if TPM == nil {
+		return nil, fmt.Errorf("TPM is not opened")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	pcrValues, err := TPM.PCRs(bank.Alg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get TPM PCRs: %w", err)
+	}
+	return pcrValues, nil
+}
+
+// zeroQuote returns a quote with zero contents, but the size of a quote of a
+// single PCR selection signed by the AK, for report generation dry-runs
+func zeroQuote(nonce []byte, akChain []*x509.Certificate) *Quote {
+
+	// TPMS_ATTEST with magic, type, qualified signer name, extra data, clock
+	// info, firmware version, PCR selection and PCR digest
+	size := 4 + 2 + (2 + 2 + sha256.Size) + (2 + len(nonce)) + 17 + 8 + (4 + 6) +
+		(2 + sha256.Size)
+
+	// TPMT_SIGNATURE with signature and hash algorithm
+	sigSize := 4 + 2 + 256
+	if len(akChain) > 0 {
+		switch pub := akChain[0].PublicKey.(type) {
+		case *rsa.PublicKey:
+			sigSize = 4 + 2 + pub.Size()
+		case *ecdsa.PublicKey:
+			sigSize = 4 + 2*(2+(pub.Curve.Params().BitSize+7)/8)
+		}
+	}
+
+	return &Quote{
+		Quote: attest.Quote{
+			Version:   attest.TPMVersion20,
+			Quote:     make([]byte, size),
+			Signature: make([]byte, sigSize),
+		},
+	}
+}
+
 func provisionTpm(
-	provServerURL string, akCsr, ikCsr *x509.CertificateRequest,
+	provServerURL, tokenSource string, ek []attest.EK, ak *attest.AK, ik *attest.Key,
+	akCsr, ikCsr *x509.CertificateRequest,
 ) ([]*x509.Certificate, []*x509.Certificate, error) {
 	log.Debug("Performing TPM credential activation..")
 
@@ -624,6 +1312,9 @@ func provisionTpm(
 	// different CAs for metadata and the EST server authentication
 	log.Warn("Creating new EST client without server authentication")
 	client := est.NewClient(nil)
+	if err := client.SetTokenSource(tokenSource); err != nil {
+		return nil, nil, fmt.Errorf("failed to set bootstrap token: %w", err)
+	}
 
 	log.Info("Retrieving CA certs")
 	caCerts, err := client.CaCerts(provServerURL)
@@ -657,8 +1348,8 @@ func provisionTpm(
 		log.Tracef("EK not present. Using EK URL %v", ek[0].CertificateURL)
 	}
 
-	log.Info("Performing TPM AK Enroll")
-	encCredential, encSecret, pkcs7Cert, err := client.TpmActivateEnroll(
+	log.Info("Performing TPM credential activation")
+	id, encCredential, encSecret, err := client.TpmActivate(
 		provServerURL, tpmInfo.Manufacturer.String(), ek[0].CertificateURL,
 		tpmInfo.FirmwareVersionMajor, tpmInfo.FirmwareVersionMinor,
 		akCsr,
@@ -666,7 +1357,7 @@ func provisionTpm(
 		ekPub, ekRaw,
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to enroll AK: %w", err)
+		return nil, nil, fmt.Errorf("failed to request credential activation: %w", err)
 	}
 
 	secret, err := ActivateCredential(TPM, ak, encCredential, encSecret)
@@ -674,20 +1365,11 @@ func provisionTpm(
 		return nil, nil, fmt.Errorf("request activate credential failed: %w", err)
 	}
 
-	encryptedCert, err := pkcs7.Parse(pkcs7Cert)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse PKCS7 CMS EnvelopedData: %w", err)
-	}
-
-	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256GCM
-	certDer, err := encryptedCert.DecryptUsingPSK(secret)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to decrypt PKCS7 encrypted cert: %w", err)
-	}
-
-	akCert, err := x509.ParseCertificate(certDer)
+	// The server only issues the AK certificate after verifying the secret
+	log.Info("Performing TPM AK Enroll")
+	akCert, err := client.TpmActivateEnroll(provServerURL, id, secret)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, nil, fmt.Errorf("failed to enroll AK: %w", err)
 	}
 
 	log.Tracef("Created new AK Cert: %v", akCert.Subject.CommonName)
@@ -715,35 +1397,27 @@ func provisionTpm(
 
 func saveCerts(storagePath string, akchain, ikchain []*x509.Certificate) error {
 
-	akchainPem := make([]byte, 0)
-	for _, cert := range akchain {
-		c := internal.WriteCertPem(cert)
-		akchainPem = append(akchainPem, c...)
-	}
-	if err := os.WriteFile(path.Join(storagePath, akchainFile), akchainPem, 0644); err != nil {
+	akchainPem := internal.WriteCertChainPem(akchain)
+	if err := internal.StoreFile(path.Join(storagePath, akchainFile), akchainPem, 0644); err != nil {
 		return fmt.Errorf("failed to write  %v: %w", path.Join(storagePath, akchainFile), err)
 	}
 
-	ikchainPem := make([]byte, 0)
-	for _, cert := range ikchain {
-		c := internal.WriteCertPem(cert)
-		ikchainPem = append(ikchainPem, c...)
-	}
-	if err := os.WriteFile(path.Join(storagePath, ikchainFile), ikchainPem, 0644); err != nil {
+	ikchainPem := internal.WriteCertChainPem(ikchain)
+	if err := internal.StoreFile(path.Join(storagePath, ikchainFile), ikchainPem, 0644); err != nil {
 		return fmt.Errorf("failed to write  %v: %w", path.Join(storagePath, ikchainFile), err)
 	}
 
 	return nil
 }
 
-func saveKeys(storagePath string) error {
+func saveKeys(storagePath string, ak *attest.AK, ik *attest.Key) error {
 	// Store the encrypted AK blob on disk
 	akBytes, err := ak.Marshal()
 	if err != nil {
 		return fmt.Errorf("activate credential failed: Marshal AK returned %w", err)
 	}
 	akPath := path.Join(storagePath, akFile)
-	if err := os.WriteFile(akPath, akBytes, 0644); err != nil {
+	if err := internal.StoreFile(akPath, akBytes, 0644); err != nil {
 		return fmt.Errorf("failed to write file %v: %w", akPath, err)
 	}
 
@@ -753,23 +1427,26 @@ func saveKeys(storagePath string) error {
 		return fmt.Errorf("activate credential failed: Marshal IK returned %w", err)
 	}
 	ikPath := path.Join(storagePath, ikFile)
-	if err := os.WriteFile(ikPath, ikBytes, 0644); err != nil {
+	if err := internal.StoreFile(ikPath, ikBytes, 0644); err != nil {
 		return fmt.Errorf("failed to write file %v: %w", ikPath, err)
 	}
 
 	return nil
 }
 
-func loadTpmKeys(storagePath string) error {
+func loadTpmKeys(storagePath string) (err error) {
 
 	if TPM == nil {
 		return errors.New("tpm is not opened")
 	}
 
+	timer := metrics.Start("tpm", metrics.OpKeyLoad)
+	defer func() { timer.Done(err) }()
+
 	log.Debug("Loading TPM keys..")
 
 	akPath := path.Join(storagePath, akFile)
-	akBytes, err := os.ReadFile(akPath)
+	akBytes, err := internal.LoadFile(akPath)
 	if err != nil {
 		return fmt.Errorf("failed to read file %v: %w", akPath, err)
 	}
@@ -781,7 +1458,7 @@ func loadTpmKeys(storagePath string) error {
 	log.Debug("Loaded AK")
 
 	ikPath := path.Join(storagePath, ikFile)
-	ikBytes, err := os.ReadFile(ikPath)
+	ikBytes, err := internal.LoadFile(ikPath)
 	if err != nil {
 		return fmt.Errorf("failed to read file %v: %w", ikPath, err)
 	}
@@ -795,9 +1472,37 @@ func loadTpmKeys(storagePath string) error {
 	return nil
 }
 
+// loadStoredKeys loads the AK and IK blobs and the certificate chains from the
+// storage path. On failure, the already loaded keys are closed
+func loadStoredKeys(storagePath string) ([]*x509.Certificate, []*x509.Certificate, error) {
+	err := loadTpmKeys(storagePath)
+	if err != nil {
+		closeKeys()
+		return nil, nil, fmt.Errorf("failed to load TPM keys: %w", err)
+	}
+	akchain, ikchain, err := loadTpmCerts(storagePath)
+	if err != nil {
+		closeKeys()
+		return nil, nil, fmt.Errorf("failed to load TPM certificates: %w", err)
+	}
+	return akchain, ikchain, nil
+}
+
+// closeKeys flushes the loaded AK and IK from the TPM
+func closeKeys() {
+	if ak != nil {
+		ak.Close(TPM)
+		ak = nil
+	}
+	if ik != nil {
+		ik.Close()
+		ik = nil
+	}
+}
+
 func loadTpmCerts(storagePath string) ([]*x509.Certificate, []*x509.Certificate, error) {
 
-	data, err := os.ReadFile(path.Join(storagePath, akchainFile))
+	data, err := internal.LoadFile(path.Join(storagePath, akchainFile))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read AK chain from %v: %w", storagePath, err)
 	}
@@ -807,7 +1512,7 @@ func loadTpmCerts(storagePath string) ([]*x509.Certificate, []*x509.Certificate,
 	}
 	log.Tracef("Parsed stored AK chain of length %v", len(akchain))
 
-	data, err = os.ReadFile(path.Join(storagePath, ikchainFile))
+	data, err = internal.LoadFile(path.Join(storagePath, ikchainFile))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read IK chain from %v: %w", storagePath, err)
 	}
@@ -820,19 +1525,196 @@ func loadTpmCerts(storagePath string) ([]*x509.Certificate, []*x509.Certificate,
 	return akchain, ikchain, nil
 }
 
-func createKeys(tpm *attest.TPM, keyConfig string) ([]attest.EK, *attest.AK, *attest.Key, error) {
+// validateKeys checks that the loaded AK and IK match the public keys of the
+// stored certificates and, if configured, the keys at the persistent handles
+func validateKeys(akchain, ikchain []*x509.Certificate, akHandle, ikHandle tpmutil.Handle) error {
+
+	if len(akchain) == 0 || len(ikchain) == 0 {
+		return errors.New("stored certificate chains are empty")
+	}
+	akPub, err := akPublic(ak)
+	if err != nil {
+		return err
+	}
+	if !publicKeyEqual(akPub, akchain[0].PublicKey) {
+		return errors.New("AK does not match AK certificate")
+	}
+	if !publicKeyEqual(ik.Public(), ikchain[0].PublicKey) {
+		return errors.New("IK does not match IK certificate")
+	}
+
+	if akHandle == 0 && ikHandle == 0 {
+		return nil
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+
+	// Handles which are not populated yet are persisted afterwards, only
+	// populated handles with differing keys require re-provisioning
+	if akHandle != 0 {
+		if _, err := readPersistentKey(rwc, akHandle); err == nil {
+			err = validatePersistentKey(rwc, akHandle, akchain[0])
+			if err != nil {
+				return fmt.Errorf("failed to validate persisted AK: %w", err)
+			}
+		}
+	}
+	if ikHandle != 0 {
+		if _, err := readPersistentKey(rwc, ikHandle); err == nil {
+			err = validatePersistentKey(rwc, ikHandle, ikchain[0])
+			if err != nil {
+				return fmt.Errorf("failed to validate persisted IK: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// staleKeys returns the public keys of the loaded AK and IK and of the
+// certificate chains, which are replaced when re-provisioning
+func staleKeys(akchain, ikchain []*x509.Certificate) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	if ak != nil {
+		if pub, err := akPublic(ak); err == nil {
+			keys = append(keys, pub)
+		}
+	}
+	if ik != nil {
+		keys = append(keys, ik.Public())
+	}
+	for _, chain := range [][]*x509.Certificate{akchain, ikchain} {
+		if len(chain) > 0 {
+			keys = append(keys, chain[0].PublicKey)
+		}
+	}
+	return keys
+}
+
+// checkPersistentHandles checks that new keys can be persisted at the AK and IK
+// handles, see checkPersistentHandle
+func checkPersistentHandles(akHandle, ikHandle tpmutil.Handle, evict bool,
+	stale []crypto.PublicKey,
+) error {
+
+	if akHandle == 0 && ikHandle == 0 {
+		return nil
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+
+	for _, h := range []tpmutil.Handle{akHandle, ikHandle} {
+		if h == 0 {
+			continue
+		}
+		err = checkPersistentHandle(rwc, h, evict, stale)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// persistKeys makes the AK and IK persistent at the specified handles. A zero
+// handle means that the respective key is not persisted. Stale keys of a
+// previous provisioning at the handles are evicted
+func persistKeys(akHandle, ikHandle tpmutil.Handle, evict bool, stale []crypto.PublicKey) error {
+
+	if akHandle == 0 && ikHandle == 0 {
+		return nil
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return err
+	}
+
+	if akHandle != 0 {
+		log.Debugf("Persisting AK at handle 0x%x", uint32(akHandle))
+		akBytes, err := ak.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal AK: %w", err)
+		}
+		err = persistKey(rwc, akBytes, akHandle, evict, stale)
+		if err != nil {
+			return fmt.Errorf("failed to persist AK: %w", err)
+		}
+	}
+	if ikHandle != 0 {
+		log.Debugf("Persisting IK at handle 0x%x", uint32(ikHandle))
+		ikBytes, err := ik.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal IK: %w", err)
+		}
+		err = persistKey(rwc, ikBytes, ikHandle, evict, stale)
+		if err != nil {
+			return fmt.Errorf("failed to persist IK: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func newImaWatcher(c *ar.DriverConfig) (*ima.Watcher, error) {
+	var interval time.Duration
+	if c.ImaPollInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.ImaPollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IMA poll interval: %w", err)
+		}
+	}
+	return ima.NewWatcher(ima.WatcherConfig{
+		PollInterval: interval,
+		Watchlist:    c.ImaWatchlist,
+	})
+}
+
+// getTpmConn returns the shared TPM connection for low-level go-tpm operations
+// not supported by go-attestation
+func getTpmConn() (io.ReadWriter, error) {
+	if tpmConn == nil {
+		return nil, errors.New("TPM is not opened")
+	}
+	return tpmConn, nil
+}
+
+func createKeys(tpm *attest.TPM, akKeyConfig, keyConfig string) ([]attest.EK, *attest.AK, *attest.Key, error) {
 
 	log.Debug("Loading EKs")
 
-	eks, err := tpm.EKs()
+	eks, err := getEks(tpm)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to load EKs - %w", err)
 	}
 	log.Tracef("Found %v EK(s)", len(eks))
 
+	// go-attestation creates the SRK with an empty owner auth if not present
+	if authValues.owner != "" {
+		rwc, err := getTpmConn()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = ensureSrk(rwc)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
 	log.Debug("Creating new AK")
-	akConfig := &attest.AKConfig{}
-	ak, err := tpm.NewAK(akConfig)
+	var ak *attest.AK
+	if _, _, ok := eccAkParams(akKeyConfig); ok {
+		ak, err = createEccAk(tpm, akKeyConfig)
+	} else {
+		ak, err = tpm.NewAK(&attest.AKConfig{})
+	}
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to create new AK - %w", err)
 	}
@@ -862,6 +1744,14 @@ func createKeys(tpm *attest.TPM, keyConfig string) ([]attest.EK, *attest.AK, *at
 			"failed to create new IK Key, unknown key configuration: %v", keyConfig)
 	}
 
+	if ikPolicy.enabled() || isEccAk(ak) {
+		ik, err := createPolicyIk(tpm, ak, ikConfig)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create new IK key with policy - %w", err)
+		}
+		return eks, ak, ik, nil
+	}
+
 	ik, err := tpm.NewKey(ak, ikConfig)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to create new IK key - %w", err)
@@ -882,6 +1772,15 @@ func ActivateCredential(
 		return nil, errors.New("did not receive encrypted secret from server")
 	}
 
+	// go-attestation performs the activation with empty hierarchy auth values
+	if authValues.owner != "" || authValues.endorsement != "" {
+		rwc, err := getTpmConn()
+		if err != nil {
+			return nil, err
+		}
+		return activateCredentialWithAuth(rwc, ak, activationCredential, activationSecret)
+	}
+
 	encryptedCredential := attest.EncryptedCredential{
 		Credential: activationCredential,
 		Secret:     activationSecret,
@@ -895,6 +1794,50 @@ func ActivateCredential(
 	return secret, nil
 }
 
+// getPcrBanks returns the PCR banks and PCRs to be quoted. If no PCR selection
+// is configured, the SHA256 PCRs are determined based on whether the system
+// is an SRTM or DRTM system. The selected banks are validated against the TPM
+func getPcrBanks(t *Tpm, c *ar.DriverConfig) ([]PcrBank, error) {
+
+	var banks []PcrBank
+	if len(c.PcrSelection) == 0 {
+		pcrs, err := getQuotePcrs(t)
+		if err != nil {
+			return nil, err
+		}
+		banks = []PcrBank{{Alg: attest.HashSHA256, Pcrs: pcrs}}
+	} else {
+		var imaPcr, ctrPcr *int
+		if c.UseIma {
+			imaPcr = &c.ImaPcr
+		}
+		if c.UseCtr && strings.EqualFold(c.CtrDriver, "tpm") {
+			ctrPcr = &c.CtrPcr
+		}
+		var err error
+		banks, err = parsePcrSelection(c.PcrSelection, imaPcr, ctrPcr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR selection: %w", err)
+		}
+	}
+
+	rwc, err := getTpmConn()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePcrBanks(rwc, banks)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bank := range banks {
+		log.Debugf("Quoting PCR bank %v PCRs %v", bank, bank.Pcrs)
+	}
+
+	return banks, nil
+}
+
 func getQuotePcrs(t *Tpm) ([]int, error) {
 
 	if TPM == nil {
@@ -971,7 +1914,12 @@ func createCsrs(c *ar.DriverConfig, ak *attest.AK, ik *attest.Key,
 			if err != nil {
 				return nil, nil, fmt.Errorf("failed to create AK CSR: %w", err)
 			}
-			ikCsr, err = createIkCsr(ik, deviceConfig.IkCsr)
+			signer, closeSigner, err := ikCsrSigner(ak, ik)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to get IK signer: %w", err)
+			}
+			ikCsr, err = createIkCsr(signer, deviceConfig.IkCsr)
+			closeSigner()
 			if err != nil {
 				return nil, nil, fmt.Errorf("failed to create IK CSR: %w", err)
 			}
@@ -999,7 +1947,17 @@ func createAkCsr(ak *attest.AK, params ar.CsrParams) (*x509.CertificateRequest,
 		},
 	}
 
-	der, err := CreateCertificateRequest(rand.Reader, &tmpl, ak.Private())
+	// go-attestation only signs with RSA AKs
+	var priv crypto.PrivateKey = ak.Private()
+	if isEccAk(ak) {
+		var err error
+		priv, err = newEccAkSigner(ak)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get AK signer: %w", err)
+		}
+	}
+
+	der, err := CreateCertificateRequest(rand.Reader, &tmpl, priv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate request: %w", err)
 	}
@@ -1016,7 +1974,7 @@ func createAkCsr(ak *attest.AK, params ar.CsrParams) (*x509.CertificateRequest,
 	return csr, nil
 }
 
-func createIkCsr(ik *attest.Key, params ar.CsrParams) (*x509.CertificateRequest, error) {
+func createIkCsr(priv crypto.Signer, params ar.CsrParams) (*x509.CertificateRequest, error) {
 
 	log.Tracef("Creating IK CSR..")
 
@@ -1034,11 +1992,6 @@ func createIkCsr(ik *attest.Key, params ar.CsrParams) (*x509.CertificateRequest,
 		DNSNames: params.SANs,
 	}
 
-	priv, err := ik.Private(ik.Public())
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve IK private key: %w", err)
-	}
-
 	der, err := x509.CreateCertificateRequest(rand.Reader, &tmpl, priv)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate request: %w", err)
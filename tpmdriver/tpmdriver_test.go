@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpmdriver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"testing"
+
+	"github.com/Fraunhofer-AISEC/go-attestation/attest"
+)
+
+// TestConcurrentSigning must be run with -race and requires a TPM simulator,
+// see TestPersistKey. It signs with the IK from many goroutines while quotes
+// are performed on the same TPM connection
+func TestConcurrentSigning(t *testing.T) {
+
+	const goroutines = 32
+	const iterations = 10
+
+	rwc := openSimulator(t)
+	var err error
+	TPM, err = attest.OpenTPM(&attest.OpenConfig{
+		TPMVersion:     attest.TPMVersion20,
+		CommandChannel: &commandChannel{rwc},
+	})
+	if err != nil {
+		rwc.Close()
+		t.Fatalf("failed to open TPM: %v", err)
+	}
+	tpmConn = rwc
+	defer CloseTpm()
+
+	ak, err = TPM.NewAK(nil)
+	if err != nil {
+		t.Fatalf("failed to create AK: %v", err)
+	}
+	defer ak.Close(TPM)
+	ik, err = TPM.NewKey(ak, &attest.KeyConfig{Algorithm: attest.ECDSA, Size: 256})
+	if err != nil {
+		t.Fatalf("failed to create IK: %v", err)
+	}
+	defer ik.Close()
+
+	tpm := &Tpm{}
+	first, _, err := tpm.GetSigningKeys()
+	if err != nil {
+		t.Fatalf("GetSigningKeys() error = %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("data"))
+	bank := PcrBank{Alg: attest.HashSHA256, Pcrs: []int{0}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				priv, pub, err := tpm.GetSigningKeys()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if priv != first {
+					t.Errorf("GetSigningKeys() did not return the cached signer")
+				}
+				sig, err := priv.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+					t.Errorf("signature does not match the IK public key")
+				}
+				if _, err := tpm.GetCertChain(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, _, err := GetMeasurement(tpm, []byte("0123456789abcdef"), bank); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent TPM operation failed: %v", err)
+	}
+}
+
+func Test_zeroQuote(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		nonce     []byte
+		chain     []*x509.Certificate
+		wantQuote int
+		wantSig   int
+	}{
+		{"RSA", make([]byte, 32), []*x509.Certificate{{PublicKey: &rsaKey.PublicKey}}, 145, 262},
+		{"ECDSA", make([]byte, 8), []*x509.Certificate{{PublicKey: &ecKey.PublicKey}}, 121, 72},
+		{"No Certificate", nil, nil, 113, 262},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := zeroQuote(tt.nonce, tt.chain)
+			if len(q.Quote.Quote) != tt.wantQuote || len(q.Signature) != tt.wantSig {
+				t.Errorf("zeroQuote() sizes = %v, %v, want %v, %v", len(q.Quote.Quote),
+					len(q.Signature), tt.wantQuote, tt.wantSig)
+			}
+			for _, b := range append(q.Quote.Quote, q.Signature...) {
+				if b != 0 {
+					t.Fatalf("zeroQuote() contains non-zero bytes")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"golang.org/x/exp/slices"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// Enforcement is the mode a rule of the appraisal baseline is enforced with
+type Enforcement string
+
+const (
+	// EnforceReject fails the verification on violations of the rule
+	EnforceReject Enforcement = "reject"
+	// EnforceWarn only reports violations of the rule as warnings, e.g. to
+	// start the transition to a stricter baseline
+	EnforceWarn Enforcement = "warn"
+)
+
+// AlgorithmRule specifies the allowed algorithms. Empty fields select the
+// defaults
+type AlgorithmRule struct {
+	Allowed []string    `json:"allowed,omitempty"`
+	Mode    Enforcement `json:"mode,omitempty"`
+}
+
+// KeySizeRule specifies the minimum key size. Zero values select the defaults
+type KeySizeRule struct {
+	MinBits int         `json:"minBits,omitempty"`
+	Mode    Enforcement `json:"mode,omitempty"`
+}
+
+// Appraisal is the baseline for the algorithms and key sizes of the evidence,
+// which is checked before the measurements are verified. The key rules apply
+// to the keys signing the report, the metadata and the TPM quotes. The hash
+// algorithms are named as "SHA-1", "SHA-256", "SHA-384" and "SHA-512", the
+// curves as "P-256", "P-384" and "P-521"
+type Appraisal struct {
+	RsaKeySize     KeySizeRule   `json:"rsaKeySize"`
+	EcdsaCurves    AlgorithmRule `json:"ecdsaCurves"`
+	ReportHashes   AlgorithmRule `json:"reportHashes"`
+	MetadataHashes AlgorithmRule `json:"metadataHashes"`
+	QuoteHashes    AlgorithmRule `json:"quoteHashes"`
+	EventLogHashes AlgorithmRule `json:"eventLogHashes"`
+}
+
+var defaultHashes = []string{"SHA-256", "SHA-384", "SHA-512"}
+
+// DefaultAppraisal is the baseline applied if no baseline is configured. It
+// rejects SHA-1, RSA keys below 2048 bits and curves other than the NIST
+// curves of at least 256 bits
+var DefaultAppraisal = Appraisal{
+	RsaKeySize:     KeySizeRule{MinBits: 2048, Mode: EnforceReject},
+	EcdsaCurves:    AlgorithmRule{Allowed: []string{"P-256", "P-384", "P-521"}, Mode: EnforceReject},
+	ReportHashes:   AlgorithmRule{Allowed: defaultHashes, Mode: EnforceReject},
+	MetadataHashes: AlgorithmRule{Allowed: defaultHashes, Mode: EnforceReject},
+	QuoteHashes:    AlgorithmRule{Allowed: defaultHashes, Mode: EnforceReject},
+	EventLogHashes: AlgorithmRule{Allowed: defaultHashes, Mode: EnforceReject},
+}
+
+var (
+	appraisalMu sync.RWMutex
+	appraisal   = DefaultAppraisal
+)
+
+// SetAppraisal configures the baseline all attestation reports are appraised
+// against. Empty rules and fields are replaced by the defaults
+func SetAppraisal(a Appraisal) error {
+	a, err := a.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	appraisalMu.Lock()
+	defer appraisalMu.Unlock()
+	appraisal = a
+	return nil
+}
+
+// Validate checks the modes and key sizes of the rules
+func (a Appraisal) Validate() error {
+	_, err := a.withDefaults()
+	return err
+}
+
+func (a Appraisal) withDefaults() (Appraisal, error) {
+	var err error
+	if a.RsaKeySize, err = a.RsaKeySize.withDefaults(DefaultAppraisal.RsaKeySize); err != nil {
+		return a, fmt.Errorf("invalid rule rsaKeySize: %w", err)
+	}
+	rules := []struct {
+		name string
+		rule *AlgorithmRule
+		def  AlgorithmRule
+	}{
+		{"ecdsaCurves", &a.EcdsaCurves, DefaultAppraisal.EcdsaCurves},
+		{"reportHashes", &a.ReportHashes, DefaultAppraisal.ReportHashes},
+		{"metadataHashes", &a.MetadataHashes, DefaultAppraisal.MetadataHashes},
+		{"quoteHashes", &a.QuoteHashes, DefaultAppraisal.QuoteHashes},
+		{"eventLogHashes", &a.EventLogHashes, DefaultAppraisal.EventLogHashes},
+	}
+	for _, r := range rules {
+		if *r.rule, err = r.rule.withDefaults(r.def); err != nil {
+			return a, fmt.Errorf("invalid rule %v: %w", r.name, err)
+		}
+	}
+	return a, nil
+}
+
+// GetAppraisal returns the configured appraisal baseline
+func GetAppraisal() Appraisal {
+	appraisalMu.RLock()
+	defer appraisalMu.RUnlock()
+	return appraisal
+}
+
+func checkMode(m Enforcement) error {
+	if m != EnforceReject && m != EnforceWarn {
+		return fmt.Errorf("unknown mode %q (expected %v or %v)", m, EnforceReject, EnforceWarn)
+	}
+	return nil
+}
+
+func (r KeySizeRule) withDefaults(def KeySizeRule) (KeySizeRule, error) {
+	if r.MinBits == 0 {
+		r.MinBits = def.MinBits
+	}
+	if r.Mode == "" {
+		r.Mode = def.Mode
+	}
+	if r.MinBits < 0 {
+		return r, fmt.Errorf("negative key size %v", r.MinBits)
+	}
+	return r, checkMode(r.Mode)
+}
+
+func (r AlgorithmRule) withDefaults(def AlgorithmRule) (AlgorithmRule, error) {
+	if len(r.Allowed) == 0 {
+		r.Allowed = def.Allowed
+	}
+	if r.Mode == "" {
+		r.Mode = def.Mode
+	}
+	return r, checkMode(r.Mode)
+}
+
+// appraiser collects the findings of the appraisal of an attestation report
+type appraiser struct {
+	Appraisal
+	findings []ar.Finding
+	success  bool
+}
+
+func newAppraiser() *appraiser {
+	return &appraiser{Appraisal: GetAppraisal(), success: true}
+}
+
+func (a *appraiser) add(rule string, mode Enforcement, code ar.ErrorCode, desc, got,
+	expected string,
+) {
+	f := ar.Finding{
+		Severity:    ar.SeverityError,
+		ErrorCode:   code,
+		Rule:        rule,
+		Description: desc,
+		Got:         got,
+		Expected:    expected,
+	}
+	if mode == EnforceWarn {
+		f.Severity = ar.SeverityWarning
+	} else {
+		a.success = false
+	}
+	log.Tracef("Appraisal %v: %v %v not allowed (expected %v)", f.Severity, desc, got, expected)
+	a.findings = append(a.findings, f)
+}
+
+// algorithm checks that the algorithm is allowed by the rule
+func (a *appraiser) algorithm(rule string, r AlgorithmRule, desc, alg string) {
+	if !slices.Contains(r.Allowed, alg) {
+		a.add(rule, r.Mode, ar.AlgorithmNotAllowed, desc, alg, strings.Join(r.Allowed, ", "))
+	}
+}
+
+// key checks the RSA key size or the ECDSA curve of the key
+func (a *appraiser) key(desc string, pub crypto.PublicKey) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if bits := k.N.BitLen(); bits < a.RsaKeySize.MinBits {
+			a.add("rsaKeySize", a.RsaKeySize.Mode, ar.KeySizeTooSmall, desc,
+				fmt.Sprintf("%v bits", bits), fmt.Sprintf("%v bits", a.RsaKeySize.MinBits))
+		}
+	case *ecdsa.PublicKey:
+		a.algorithm("ecdsaCurves", a.EcdsaCurves, desc, k.Curve.Params().Name)
+	}
+}
+
+// tokens appraises the signature algorithms and the signing keys of JWS or COSE
+// tokens. Only signatures with validated certificate chains are appraised
+func (a *appraiser) tokens(rule string, r AlgorithmRule, desc string,
+	sigs []ar.SignatureResult,
+) {
+	for _, s := range sigs {
+		if len(s.ValidatedCerts) == 0 || len(s.ValidatedCerts[0]) == 0 {
+			continue
+		}
+		a.algorithm(rule, r, desc+" signature", signatureHash(s.Algorithm))
+
+		block, _ := pem.Decode([]byte(s.ValidatedCerts[0][0].PublicKey))
+		if block == nil {
+			log.Tracef("Failed to decode %v signing key", desc)
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			log.Tracef("Failed to parse %v signing key: %v", desc, err)
+			continue
+		}
+		a.key(desc+" signing key", pub)
+	}
+}
+
+// report appraises the attestation report and metadata signatures and the
+// TPM measurements. The findings are added to the result, which fails if a
+// rejecting rule is violated
+func (a *appraiser) report(report *ar.AttestationReport, tr ar.TokenResult,
+	mr *ar.MetadataResult, result *ar.VerificationResult,
+) bool {
+	a.tokens("reportHashes", a.ReportHashes, "Attestation report", tr.SignatureCheck)
+	a.metadata(mr)
+	for _, m := range report.Measurements {
+		if m.Type == "TPM Measurement" {
+			a.tpm(m)
+		}
+	}
+	return a.finish(result)
+}
+
+// finish adds the findings to the result, which fails if a rejecting rule is
+// violated
+func (a *appraiser) finish(result *ar.VerificationResult) bool {
+	result.Findings = a.findings
+	if !a.success {
+		result.Success = false
+		for _, f := range a.findings {
+			if f.Severity == ar.SeverityError {
+				result.ErrorCode = f.ErrorCode
+				break
+			}
+		}
+	}
+	return a.success
+}
+
+// metadata appraises the signatures of all metadata
+func (a *appraiser) metadata(mr *ar.MetadataResult) {
+	a.tokens("metadataHashes", a.MetadataHashes, "RTM manifest", mr.RtmResult.SignatureCheck)
+	a.tokens("metadataHashes", a.MetadataHashes, "OS manifest", mr.OsResult.SignatureCheck)
+	for _, app := range mr.AppResults {
+		a.tokens("metadataHashes", a.MetadataHashes, "App manifest", app.SignatureCheck)
+	}
+	if mr.CompDescResult != nil {
+		a.tokens("metadataHashes", a.MetadataHashes, "Company description",
+			mr.CompDescResult.SignatureCheck)
+	}
+	a.tokens("metadataHashes", a.MetadataHashes, "Device description",
+		mr.DevDescResult.SignatureCheck)
+}
+
+// tpm appraises the quote signature, the PCR bank, the event log digests and
+// the attestation key of a TPM measurement. Malformed quotes are left to the
+// verification of the measurement
+func (a *appraiser) tpm(m ar.Measurement) {
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(m.Signature))
+	if err == nil {
+		var alg tpm2.Algorithm
+		switch {
+		case sig.RSA != nil:
+			alg = sig.RSA.HashAlg
+		case sig.ECC != nil:
+			alg = sig.ECC.HashAlg
+		}
+		a.algorithm("quoteHashes", a.QuoteHashes, "TPM quote signature", tpmHash(alg))
+	}
+
+	if attest, err := tpm2.DecodeAttestationData(m.Evidence); err == nil &&
+		attest.AttestedQuoteInfo != nil {
+		a.algorithm("eventLogHashes", a.EventLogHashes, "TPM PCR bank",
+			tpmHash(attest.AttestedQuoteInfo.PCRSelection.Hash))
+	}
+
+	lengths := map[int]bool{}
+	for _, artifact := range m.Artifacts {
+		for _, e := range artifact.Events {
+			if l := len(e.Sha256); l > 0 && !lengths[l] {
+				lengths[l] = true
+				a.algorithm("eventLogHashes", a.EventLogHashes, "TPM event log digest",
+					digestHash(l))
+			}
+		}
+	}
+
+	if len(m.Certs) > 0 {
+		if cert, err := x509.ParseCertificate(m.Certs[0]); err == nil {
+			a.key("TPM attestation key", cert.PublicKey)
+		}
+	}
+}
+
+// signatureHash returns the hash algorithm of the JWS or COSE signature
+// algorithm
+func signatureHash(alg string) string {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256.String()
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384.String()
+	case "RS512", "PS512", "ES512", "EdDSA":
+		return crypto.SHA512.String()
+	default:
+		return fmt.Sprintf("unknown (%v)", alg)
+	}
+}
+
+// tpmHash returns the name of the TPM hash algorithm
+func tpmHash(alg tpm2.Algorithm) string {
+	h, err := alg.Hash()
+	if err != nil {
+		return fmt.Sprintf("unknown (0x%x)", uint16(alg))
+	}
+	return h.String()
+}
+
+// digestHash returns the hash algorithm of a digest of the length
+func digestHash(length int) string {
+	switch length {
+	case crypto.SHA1.Size():
+		return crypto.SHA1.String()
+	case crypto.SHA256.Size():
+		return crypto.SHA256.String()
+	case crypto.SHA384.Size():
+		return crypto.SHA384.String()
+	case crypto.SHA512.Size():
+		return crypto.SHA512.String()
+	default:
+		return fmt.Sprintf("unknown (%v bytes)", length)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+func setAppraisal(t *testing.T, a Appraisal) {
+	if err := SetAppraisal(a); err != nil {
+		t.Fatalf("SetAppraisal() error = %v", err)
+	}
+	t.Cleanup(func() { SetAppraisal(DefaultAppraisal) })
+}
+
+func TestAppraisal(t *testing.T) {
+	sha384 := []string{"SHA-384"}
+	tests := []struct {
+		name      string
+		appraisal Appraisal
+		wantRule  string
+		wantCode  ar.ErrorCode
+	}{
+		{"Default", Appraisal{}, "", ar.NotSet},
+		{"RSA Key Size", Appraisal{RsaKeySize: KeySizeRule{MinBits: 3072}},
+			"rsaKeySize", ar.KeySizeTooSmall},
+		{"ECDSA Curves", Appraisal{EcdsaCurves: AlgorithmRule{Allowed: []string{"P-384"}}},
+			"ecdsaCurves", ar.AlgorithmNotAllowed},
+		{"Report Hashes", Appraisal{ReportHashes: AlgorithmRule{Allowed: sha384}},
+			"reportHashes", ar.AlgorithmNotAllowed},
+		{"Metadata Hashes", Appraisal{MetadataHashes: AlgorithmRule{Allowed: sha384}},
+			"metadataHashes", ar.AlgorithmNotAllowed},
+		{"Quote Hashes", Appraisal{QuoteHashes: AlgorithmRule{Allowed: sha384}},
+			"quoteHashes", ar.AlgorithmNotAllowed},
+		{"Event Log Hashes", Appraisal{EventLogHashes: AlgorithmRule{Allowed: sha384}},
+			"eventLogHashes", ar.AlgorithmNotAllowed},
+	}
+	for _, s := range fixtures.Serializers {
+		f, err := fixtures.Generate(fixtures.Options{Serializer: s})
+		if err != nil {
+			t.Fatalf("failed to generate fixtures: %v", err)
+		}
+		for _, tt := range tests {
+			for _, mode := range []Enforcement{EnforceReject, EnforceWarn} {
+				t.Run(f.Name()+" "+tt.name+" "+string(mode), func(t *testing.T) {
+					a := tt.appraisal
+					a.RsaKeySize.Mode = mode
+					a.EcdsaCurves.Mode = mode
+					a.ReportHashes.Mode = mode
+					a.MetadataHashes.Mode = mode
+					a.QuoteHashes.Mode = mode
+					a.EventLogHashes.Mode = mode
+					setAppraisal(t, a)
+
+					result := Verify(f.Report, f.Nonce, f.CaPem(), nil, 0, "")
+
+					reject := tt.wantRule != "" && mode == EnforceReject
+					if result.Success == reject {
+						t.Fatalf("Verify() success = %v, want %v", result.Success, !reject)
+					}
+					if reject && result.ErrorCode != tt.wantCode {
+						t.Errorf("error code = %v, want %v", result.ErrorCode, tt.wantCode)
+					}
+					if tt.wantRule == "" {
+						if len(result.Findings) != 0 {
+							t.Errorf("findings = %v, want none", result.Findings)
+						}
+						return
+					}
+					if len(result.Findings) == 0 {
+						t.Fatalf("no findings, want rule %v", tt.wantRule)
+					}
+					want := ar.SeverityWarning
+					if reject {
+						want = ar.SeverityError
+					}
+					for _, finding := range result.Findings {
+						if finding.Rule != tt.wantRule || finding.Severity != want ||
+							finding.ErrorCode != tt.wantCode {
+							t.Errorf("finding = %+v, want rule %v with severity %v", finding,
+								tt.wantRule, want)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestAppraisalSha1 checks that the defaults reject TPM quotes over the SHA-1
+// PCR bank, signed with SHA-1, and SHA-1 event log digests
+func TestAppraisalSha1(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	m, err := f.Measure(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to measure: %v", err)
+	}
+
+	attest, err := tpm2.DecodeAttestationData(m.Evidence)
+	if err != nil {
+		t.Fatalf("failed to decode quote: %v", err)
+	}
+	attest.AttestedQuoteInfo.PCRSelection.Hash = tpm2.AlgSHA1
+	if m.Evidence, err = attest.Encode(); err != nil {
+		t.Fatalf("failed to encode quote: %v", err)
+	}
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(m.Signature))
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	sig.RSA.HashAlg = tpm2.AlgSHA1
+	if m.Signature, err = sig.Encode(); err != nil {
+		t.Fatalf("failed to encode signature: %v", err)
+	}
+	// The events are shared with the fixtures and must be copied
+	for i := range m.Artifacts {
+		events := make([]ar.MeasureEvent, len(m.Artifacts[i].Events))
+		for j, e := range m.Artifacts[i].Events {
+			e.Sha256 = e.Sha256[:20]
+			events[j] = e
+		}
+		m.Artifacts[i].Events = events
+	}
+
+	tests := []struct {
+		name    string
+		m       ar.Measurement
+		want    map[string]int
+		success bool
+	}{
+		{"SHA-256", mustMeasure(t, f), map[string]int{}, true},
+		{"SHA-1", m, map[string]int{"quoteHashes": 1, "eventLogHashes": 2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAppraiser()
+			a.tpm(tt.m)
+			if a.success != tt.success {
+				t.Errorf("success = %v, want %v", a.success, tt.success)
+			}
+			got := map[string]int{}
+			for _, finding := range a.findings {
+				got[finding.Rule]++
+				if finding.Got != "SHA-1" {
+					t.Errorf("finding got = %v, want SHA-1", finding.Got)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("findings = %v, want %v", a.findings, tt.want)
+			}
+			for rule, n := range tt.want {
+				if got[rule] != n {
+					t.Errorf("%v findings for rule %v, want %v", got[rule], rule, n)
+				}
+			}
+		})
+	}
+}
+
+func mustMeasure(t *testing.T, f *fixtures.Fixtures) ar.Measurement {
+	m, err := f.Measure(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to measure: %v", err)
+	}
+	return m
+}
+
+func TestSetAppraisal(t *testing.T) {
+	tests := []struct {
+		name      string
+		appraisal Appraisal
+		wantErr   bool
+	}{
+		{"Defaults", Appraisal{}, false},
+		{"Warn", Appraisal{RsaKeySize: KeySizeRule{MinBits: 3072, Mode: EnforceWarn}}, false},
+		{"Negative Key Size", Appraisal{RsaKeySize: KeySizeRule{MinBits: -1}}, true},
+		{"Unknown Mode", Appraisal{QuoteHashes: AlgorithmRule{Mode: "ignore"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { SetAppraisal(DefaultAppraisal) })
+			err := SetAppraisal(tt.appraisal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetAppraisal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			a := GetAppraisal()
+			if len(a.EventLogHashes.Allowed) == 0 || a.EcdsaCurves.Mode != EnforceReject {
+				t.Errorf("defaults not applied: %+v", a)
+			}
+			if tt.appraisal.RsaKeySize.MinBits != 0 && a.RsaKeySize != tt.appraisal.RsaKeySize {
+				t.Errorf("rsaKeySize = %+v, want %+v", a.RsaKeySize, tt.appraisal.RsaKeySize)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	hclSignature     = 0x414c4348 // "HCLA"
+	hclSnpReportSize = 1184
+	hclReportTypeSnp = 2
+
+	hclHashSha256 = 1
+	hclHashSha384 = 2
+	hclHashSha512 = 3
+
+	hclAkKid = "HCLAkPub"
+)
+
+// hclHeader is the header of the Azure CVM HCL report
+type hclHeader struct {
+	Signature   uint32
+	Version     uint32
+	ReportSize  uint32
+	RequestType uint32
+	Status      uint32
+	Reserved    [3]uint32
+}
+
+// hclRuntimeDataHeader precedes the runtime data (variable data) of the HCL report
+type hclRuntimeDataHeader struct {
+	DataSize         uint32
+	Version          uint32
+	ReportType       uint32
+	HashType         uint32
+	VariableDataSize uint32
+}
+
+type hclRuntimeData struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// HclReport is the report of the Azure CVM paravisor (HCL), which contains the
+// hardware SNP attestation report and the runtime data. The SNP report data
+// contains the hash of the runtime data, which in turn contains the vTPM AK
+type HclReport struct {
+	SnpReport   []byte
+	RuntimeData []byte
+	HashType    uint32
+}
+
+// ParseHclReport parses the Azure CVM HCL report as read from the vTPM NV index
+func ParseHclReport(data []byte) (*HclReport, error) {
+
+	b := bytes.NewBuffer(data)
+
+	var header hclHeader
+	if err := binary.Read(b, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to decode HCL report header: %w", err)
+	}
+	if header.Signature != hclSignature {
+		return nil, fmt.Errorf("invalid HCL report signature 0x%x", header.Signature)
+	}
+
+	snpReport := b.Next(hclSnpReportSize)
+	if len(snpReport) != hclSnpReportSize {
+		return nil, fmt.Errorf("HCL report too short for SNP report")
+	}
+
+	var rtHeader hclRuntimeDataHeader
+	if err := binary.Read(b, binary.LittleEndian, &rtHeader); err != nil {
+		return nil, fmt.Errorf("failed to decode HCL runtime data header: %w", err)
+	}
+	if rtHeader.ReportType != hclReportTypeSnp {
+		return nil, fmt.Errorf("unsupported HCL report type %v", rtHeader.ReportType)
+	}
+	if int(rtHeader.VariableDataSize) > b.Len() {
+		return nil, fmt.Errorf("HCL runtime data size %v exceeds report length",
+			rtHeader.VariableDataSize)
+	}
+
+	return &HclReport{
+		SnpReport:   snpReport,
+		RuntimeData: b.Next(int(rtHeader.VariableDataSize)),
+		HashType:    rtHeader.HashType,
+	}, nil
+}
+
+// ReportData returns the expected SNP report data, i.e., the hash of the
+// runtime data padded to 64 bytes
+func (r *HclReport) ReportData() ([]byte, error) {
+	var digest []byte
+	switch r.HashType {
+	case hclHashSha256:
+		h := sha256.Sum256(r.RuntimeData)
+		digest = h[:]
+	case hclHashSha384:
+		h := sha512.Sum384(r.RuntimeData)
+		digest = h[:]
+	case hclHashSha512:
+		h := sha512.Sum512(r.RuntimeData)
+		digest = h[:]
+	default:
+		return nil, fmt.Errorf("unsupported HCL runtime data hash type %v", r.HashType)
+	}
+	reportData := make([]byte, 64)
+	copy(reportData, digest)
+	return reportData, nil
+}
+
+// AkPub returns the vTPM attestation key from the runtime data
+func (r *HclReport) AkPub() (*rsa.PublicKey, error) {
+
+	var rt hclRuntimeData
+	if err := ar.DecodeJson(r.RuntimeData, &rt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal HCL runtime data: %w", err)
+	}
+
+	for _, key := range rt.Keys {
+		if key.Kid != hclAkKid {
+			continue
+		}
+		if key.Kty != "RSA" {
+			return nil, fmt.Errorf("unsupported HCL AK key type %v", key.Kty)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode HCL AK modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode HCL AK exponent: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid HCL AK exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exp.Int64()),
+		}, nil
+	}
+
+	return nil, errors.New("HCL runtime data does not contain AK")
+}
+
+// verifyAzureMeasurements verifies the measurements of an Azure confidential
+// VM. The SNP report embedded in the HCL report is verified against the SNP
+// reference values and must contain the hash of the runtime data. The vTPM
+// quote must be signed by the AK from the runtime data and contain the nonce.
+// The quoted PCRs are verified against the TPM reference values
+func verifyAzureMeasurements(azureM ar.Measurement, nonce []byte, cache string,
+	snpReferenceValues, tpmReferenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying Azure measurements")
+
+	result := &ar.MeasurementResult{
+		Type:        "Azure Result",
+		AzureResult: &ar.AzureResult{},
+	}
+
+	hcl, err := ParseHclReport(azureM.HclReport)
+	if err != nil {
+		log.Tracef("Failed to parse HCL report: %v", err)
+		result.Summary.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+
+	reportData, err := hcl.ReportData()
+	if err != nil {
+		log.Tracef("Failed to calculate HCL report data: %v", err)
+		result.Summary.SetErr(ar.UnsupportedAlgorithm)
+		return result, false
+	}
+
+	akPub, err := hcl.AkPub()
+	if err != nil {
+		log.Tracef("Failed to get AK from HCL runtime data: %v", err)
+		result.Summary.SetErr(ar.ExtractPubKey)
+		return result, false
+	}
+
+	// Verify the SNP report, which binds the runtime data including the AK
+	snpM := ar.Measurement{
+		Type:     "SNP Measurement",
+		Evidence: hcl.SnpReport,
+		Certs:    azureM.Certs,
+	}
+	snpResult, snpOk := verifySnpReport(snpM, reportData, cache, snpReferenceValues)
+
+	// Verify the vTPM quote, which binds the nonce and is signed with the AK
+	tpmM := ar.Measurement{
+		Type:      "TPM Measurement",
+		Evidence:  azureM.Evidence,
+		Signature: azureM.Signature,
+		Artifacts: azureM.Artifacts,
+	}
+	tpmResult, tpmOk := verifyTpmQuote(tpmM, nonce, akPub, tpmReferenceValues)
+
+	result.Freshness = tpmResult.Freshness
+	result.Signature = snpResult.Signature
+	result.Artifacts = append(snpResult.Artifacts, tpmResult.Artifacts...)
+	result.SnpResult = snpResult.SnpResult
+	result.TpmResult = tpmResult.TpmResult
+	result.AzureResult.RuntimeDataMatch = snpResult.Freshness
+	result.AzureResult.AkQuoteSignature = tpmResult.Signature.SignCheck
+
+	ok := snpOk && tpmOk
+	if snpResult.Summary.ErrorCode != ar.NotSet {
+		result.Summary.SetErr(snpResult.Summary.ErrorCode)
+	} else if tpmResult.Summary.ErrorCode != ar.NotSet {
+		result.Summary.SetErr(tpmResult.Summary.ErrorCode)
+	} else {
+		result.Summary.Success = ok
+	}
+
+	return result, ok
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+// azureFixture contains an Azure CVM measurement created with a test AMD
+// certificate chain and a test vTPM AK, as the generation requires hardware
+type azureFixture struct {
+	measurement ar.Measurement
+	nonce       []byte
+	snpRefVals  []ar.ReferenceValue
+	tpmRefVals  []ar.ReferenceValue
+
+	vcekKey     *ecdsa.PrivateKey
+	akKey       *rsa.PrivateKey
+	snpReport   snpreport
+	runtimeData []byte
+}
+
+var (
+	azureTcb = ar.SnpTcb{Bl: 3, Tee: 0, Snp: 8, Ucode: 115}
+	azureFw  = ar.SnpFw{Build: 5, Major: 1, Minor: 55}
+)
+
+func createTestCert(t *testing.T, tmpl, parent *x509.Certificate, pub crypto.PublicKey,
+	priv crypto.PrivateKey,
+) *x509.Certificate {
+	cert, err := fixtures.CreateCert(tmpl, parent, pub, priv)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return cert
+}
+
+func createAmdTestChain(t *testing.T, chipId [64]byte, tcb uint64,
+) (*ecdsa.PrivateKey, []*x509.Certificate) {
+
+	arkKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	askKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	vcekKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	arkTmpl := fixtures.CaTemplate(1, "ARK-Test", notBefore, notAfter)
+	ark := createTestCert(t, arkTmpl, arkTmpl, &arkKey.PublicKey, arkKey)
+	ask := createTestCert(t, fixtures.CaTemplate(2, "SEV-Test", notBefore, notAfter), ark,
+		&askKey.PublicKey, arkKey)
+
+	ext := func(oid string, v uint8) pkix.Extension {
+		var id asn1.ObjectIdentifier
+		for _, s := range strings.Split(oid, ".") {
+			n, _ := strconv.Atoi(s)
+			id = append(id, n)
+		}
+		return pkix.Extension{Id: id, Value: []byte{0x02, 0x01, v}}
+	}
+	chipIdExt := ext(oidChipId, 0)
+	chipIdExt.Value = chipId[:]
+	vcekTmpl := fixtures.LeafTemplate(3, "SEV-VCEK", notBefore, notAfter)
+	vcekTmpl.ExtraExtensions = []pkix.Extension{
+		ext(oidBl, uint8(tcb)),
+		ext(oidTee, uint8(tcb>>8)),
+		ext(oidSnp, uint8(tcb>>48)),
+		ext(oidUcode, uint8(tcb>>56)),
+		chipIdExt,
+	}
+	vcek := createTestCert(t, vcekTmpl, ask, &vcekKey.PublicKey, askKey)
+
+	return vcekKey, []*x509.Certificate{vcek, ask, ark}
+}
+
+func signSnpReport(t *testing.T, s *snpreport, key *ecdsa.PrivateKey) []byte {
+	s.SignatureR = [72]byte{}
+	s.SignatureS = [72]byte{}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
+		t.Fatalf("failed to encode SNP report: %v", err)
+	}
+	digest := sha512.Sum384(buf.Bytes()[:signature_offset])
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign SNP report: %v", err)
+	}
+	// SNP signature values are little endian
+	le := func(v *big.Int, out []byte) {
+		b := v.Bytes()
+		for i := range b {
+			out[i] = b[len(b)-1-i]
+		}
+	}
+	le(r, s.SignatureR[:])
+	le(sig, s.SignatureS[:])
+
+	buf.Reset()
+	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
+		t.Fatalf("failed to encode SNP report: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func createHclReport(t *testing.T, snpReport, runtimeData []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, hclHeader{
+		Signature:   hclSignature,
+		Version:     1,
+		ReportSize:  uint32(hclSnpReportSize),
+		RequestType: 2,
+	})
+	buf.Write(snpReport)
+	binary.Write(buf, binary.LittleEndian, hclRuntimeDataHeader{
+		DataSize:         uint32(20 + len(runtimeData)),
+		Version:          1,
+		ReportType:       hclReportTypeSnp,
+		HashType:         hclHashSha256,
+		VariableDataSize: uint32(len(runtimeData)),
+	})
+	buf.Write(runtimeData)
+	return buf.Bytes()
+}
+
+func createRuntimeData(ak *rsa.PublicKey, userData string) []byte {
+	e := big.NewInt(int64(ak.E)).Bytes()
+	return []byte(fmt.Sprintf(`{"keys":[{"kid":"HCLAkPub","key_ops":["sign"],"kty":"RSA",`+
+		`"e":"%v","n":"%v"}],"vm-configuration":{"secure-boot":true,"tpm-enabled":true},`+
+		`"user-data":"%v"}`,
+		base64.RawURLEncoding.EncodeToString(e),
+		base64.RawURLEncoding.EncodeToString(ak.N.Bytes()), userData))
+}
+
+func createVtpmQuote(t *testing.T, key *rsa.PrivateKey, nonce []byte) *fixtures.VtpmQuote {
+	q, err := fixtures.NewVtpmQuote(key, nonce)
+	if err != nil {
+		t.Fatalf("failed to create quote: %v", err)
+	}
+	return q
+}
+
+func createAzureFixture(t *testing.T) *azureFixture {
+
+	f := &azureFixture{
+		nonce: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+	}
+
+	var chipId [64]byte
+	rand.Read(chipId[:])
+	tcb := uint64(azureTcb.Bl) | uint64(azureTcb.Tee)<<8 | uint64(azureTcb.Snp)<<48 |
+		uint64(azureTcb.Ucode)<<56
+
+	var chain []*x509.Certificate
+	f.vcekKey, chain = createAmdTestChain(t, chipId, tcb)
+
+	var err error
+	f.akKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate AK: %v", err)
+	}
+	f.runtimeData = createRuntimeData(&f.akKey.PublicKey, "")
+
+	var measurement [48]byte
+	rand.Read(measurement[:])
+	f.snpReport = snpreport{
+		Version:        2,
+		Policy:         1<<16 | 1<<17,
+		SignatureAlgo:  ecdsa384_with_sha384,
+		CurrentTcb:     tcb,
+		ReportedTcb:    tcb,
+		CommittedTcb:   tcb,
+		LaunchTcb:      tcb,
+		Measurement:    measurement,
+		ChipId:         chipId,
+		CurrentBuild:   azureFw.Build,
+		CurrentMajor:   azureFw.Major,
+		CurrentMinor:   azureFw.Minor,
+		CommittedBuild: azureFw.Build,
+		CommittedMajor: azureFw.Major,
+		CommittedMinor: azureFw.Minor,
+	}
+	runtimeHash := sha256.Sum256(f.runtimeData)
+	copy(f.snpReport.ReportData[:], runtimeHash[:])
+	snpRaw := signSnpReport(t, &f.snpReport, f.vcekKey)
+
+	q := createVtpmQuote(t, f.akKey, f.nonce)
+
+	certs := make([][]byte, 0, len(chain))
+	for _, c := range chain {
+		certs = append(certs, c.Raw)
+	}
+	f.measurement = ar.Measurement{
+		Type:      "Azure Measurement",
+		Evidence:  q.Quote,
+		Signature: q.Signature,
+		Certs:     certs,
+		Artifacts: q.Artifacts,
+		HclReport: createHclReport(t, snpRaw, f.runtimeData),
+	}
+
+	caFingerprint := sha256.Sum256(chain[2].Raw)
+	f.snpRefVals = []ar.ReferenceValue{{
+		Type:   "SNP Reference Value",
+		Name:   "Azure CVM",
+		Sha384: measurement[:],
+		Snp: &ar.SnpDetails{
+			Version:       2,
+			CaFingerprint: hex.EncodeToString(caFingerprint[:]),
+			Policy:        ar.SnpPolicy{Type: "SNP Policy", Smt: true},
+			Fw:            azureFw,
+			Tcb:           azureTcb,
+		},
+	}}
+	f.tpmRefVals = q.ReferenceValues
+
+	return f
+}
+
+func Test_verifyAzureMeasurements(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, f *azureFixture)
+		want   bool
+		check  func(t *testing.T, r *ar.MeasurementResult)
+	}{
+		{
+			name:   "Valid",
+			modify: func(t *testing.T, f *azureFixture) {},
+			want:   true,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if !r.AzureResult.RuntimeDataMatch.Success || !r.AzureResult.AkQuoteSignature.Success {
+					t.Errorf("binding checks failed: %+v", r.AzureResult)
+				}
+				if r.SnpResult.CertSource != SnpCertSourceReport {
+					t.Errorf("unexpected cert source %v", r.SnpResult.CertSource)
+				}
+			},
+		},
+		{
+			name: "Invalid Nonce",
+			modify: func(t *testing.T, f *azureFixture) {
+				f.nonce = []byte{0xff}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Freshness.Success {
+					t.Error("freshness check succeeded")
+				}
+			},
+		},
+		{
+			name: "Runtime Data Not Bound",
+			modify: func(t *testing.T, f *azureFixture) {
+				// Replace the runtime data without updating the SNP report data
+				rt := createRuntimeData(&f.akKey.PublicKey, "00")
+				hcl, _ := ParseHclReport(f.measurement.HclReport)
+				f.measurement.HclReport = createHclReport(t, hcl.SnpReport, rt)
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.AzureResult.RuntimeDataMatch.Success {
+					t.Error("runtime data match succeeded")
+				}
+			},
+		},
+		{
+			name: "Quote Signed With Other Key",
+			modify: func(t *testing.T, f *azureFixture) {
+				other, _ := rsa.GenerateKey(rand.Reader, 2048)
+				q := createVtpmQuote(t, other, f.nonce)
+				f.measurement.Evidence, f.measurement.Signature = q.Quote, q.Signature
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.AzureResult.AkQuoteSignature.Success {
+					t.Error("AK quote signature check succeeded")
+				}
+			},
+		},
+		{
+			name: "Invalid SNP Signature",
+			modify: func(t *testing.T, f *azureFixture) {
+				hcl, _ := ParseHclReport(f.measurement.HclReport)
+				hcl.SnpReport[0x90] ^= 0xff
+				f.measurement.HclReport = createHclReport(t, hcl.SnpReport, hcl.RuntimeData)
+			},
+			want: false,
+		},
+		{
+			name: "Invalid PCR",
+			modify: func(t *testing.T, f *azureFixture) {
+				f.tpmRefVals[1].Sha256 = make([]byte, 32)
+			},
+			want: false,
+		},
+		{
+			name: "Invalid HCL Report",
+			modify: func(t *testing.T, f *azureFixture) {
+				f.measurement.HclReport[0] ^= 0xff
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Summary.ErrorCode != ar.ParseEvidence {
+					t.Errorf("unexpected error code %v", r.Summary.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Missing SNP Reference Value",
+			modify: func(t *testing.T, f *azureFixture) {
+				f.snpRefVals = nil
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createAzureFixture(t)
+			tt.modify(t, f)
+			r, got := verifyAzureMeasurements(f.measurement, f.nonce, "", f.snpRefVals, f.tpmRefVals)
+			if got != tt.want {
+				t.Errorf("verifyAzureMeasurements() = %v, want %v", got, tt.want)
+			}
+			if got != r.Summary.Success {
+				t.Errorf("verifyAzureMeasurements() summary = %v, want %v", r.Summary.Success, got)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
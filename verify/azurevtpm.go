@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"go.mozilla.org/pkcs7"
+)
+
+// Time format of the timestamps of the attested document
+const imdsTimeFormat = "01/02/06 15:04:05 -0700"
+
+// imdsDocument is the signed content of the attested document of the Azure
+// instance metadata service (IMDS)
+type imdsDocument struct {
+	LicenseType string `json:"licenseType"`
+	Nonce       string `json:"nonce"`
+	Plan        struct {
+		Name      string `json:"name"`
+		Product   string `json:"product"`
+		Publisher string `json:"publisher"`
+	} `json:"plan"`
+	Sku            string `json:"sku"`
+	SubscriptionId string `json:"subscriptionId"`
+	TimeStamp      struct {
+		CreatedOn string `json:"createdOn"`
+		ExpiresOn string `json:"expiresOn"`
+	} `json:"timeStamp"`
+	VmId string `json:"vmId"`
+}
+
+// AzureImdsNonce returns the nonce of the attested document for the nonce of
+// the attestation report. The instance metadata service only accepts decimal
+// nonces of up to 10 digits, which are therefore derived from the hash of the
+// nonce
+func AzureImdsNonce(nonce []byte) string {
+	h := sha256.Sum256(nonce)
+	return fmt.Sprintf("%010d", binary.BigEndian.Uint64(h[:8])%10000000000)
+}
+
+// parseCaFingerprints returns the decoded SHA256 CA fingerprints
+func parseCaFingerprints(fingerprints []string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(fingerprints))
+	for _, f := range fingerprints {
+		fingerprint, err := hex.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse CA fingerprint %v: %w", f, err)
+		}
+		decoded = append(decoded, fingerprint)
+	}
+	return decoded, nil
+}
+
+// verifyPinnedChain orders the certificate chain and verifies it at the given
+// time up to its root CA, which must match one of the SHA256 fingerprints
+func verifyPinnedChain(certs []*x509.Certificate, fingerprints [][]byte, at time.Time,
+) ([][]*x509.Certificate, ar.Result) {
+
+	certs, err := internal.OrderChain(certs)
+	if err != nil {
+		log.Tracef("Invalid certificate chain: %v", err)
+		return nil, ar.Result{ErrorCode: ar.VerifyCertChain}
+	}
+	if len(certs) < 2 {
+		log.Tracef("Certificate chain does not contain root CA")
+		return nil, ar.Result{ErrorCode: ar.VerifyCertChain}
+	}
+	ca := certs[len(certs)-1]
+
+	caFingerprint := sha256.Sum256(ca.Raw)
+	found := false
+	for _, f := range fingerprints {
+		if bytes.Equal(f, caFingerprint[:]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Tracef("Root CA fingerprint %v does not match any configured fingerprint",
+			hex.EncodeToString(caFingerprint[:]))
+		return nil, ar.Result{ErrorCode: ar.CaFingerprint, Got: hex.EncodeToString(caFingerprint[:])}
+	}
+
+	x509Chains, err := internal.VerifyCertChainAt(certs[:len(certs)-1], []*x509.Certificate{ca}, at)
+	if err != nil {
+		log.Tracef("Failed to verify certificate chain: %v", err)
+		return nil, ar.Result{ErrorCode: ar.VerifyCertChain}
+	}
+
+	return x509Chains, ar.Result{Success: true}
+}
+
+func extractChains(x509Chains [][]*x509.Certificate) [][]ar.X509CertExtracted {
+	chains := make([][]ar.X509CertExtracted, 0, len(x509Chains))
+	for _, chain := range x509Chains {
+		chainExtracted := []ar.X509CertExtracted{}
+		for _, cert := range chain {
+			chainExtracted = append(chainExtracted, ar.ExtractX509Infos(cert))
+		}
+		chains = append(chains, chainExtracted)
+	}
+	return chains
+}
+
+// verifyAttestedDocument verifies the PKCS#7 signature of the attested
+// document, the certificate chain of its signer, the nonce and the validity
+// period, and returns the VM identity
+func verifyAttestedDocument(doc []byte, docCerts [][]byte, nonce []byte, fingerprints [][]byte,
+	at time.Time,
+) *ar.AzureVtpmResult {
+
+	result := &ar.AzureVtpmResult{}
+
+	p7, err := pkcs7.Parse(doc)
+	if err != nil {
+		log.Tracef("Failed to parse attested document: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.ParseEvidence)
+		return result
+	}
+	if err := p7.Verify(); err != nil {
+		log.Tracef("Failed to verify attested document signature: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.VerifySignature)
+		return result
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		log.Tracef("Attested document does not contain exactly one signer")
+		result.AttestedDocumentCheck.SetErr(ar.VerifySignature)
+		return result
+	}
+
+	certs, err := internal.ParseCertsDer(docCerts)
+	if err != nil {
+		log.Tracef("Failed to parse attested document certificates: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.ParseCert)
+		return result
+	}
+	x509Chains, r := verifyPinnedChain(append([]*x509.Certificate{signer}, certs...),
+		fingerprints, at)
+	if !r.Success {
+		result.AttestedDocumentCheck = r
+		return result
+	}
+	result.DocumentCerts = extractChains(x509Chains)
+
+	var d imdsDocument
+	if err := ar.DecodeJson(p7.Content, &d); err != nil {
+		log.Tracef("Failed to unmarshal attested document: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.ParseEvidence)
+		return result
+	}
+	result.VmId = d.VmId
+	result.SubscriptionId = d.SubscriptionId
+	result.Sku = d.Sku
+	result.LicenseType = d.LicenseType
+	result.PlanName = d.Plan.Name
+	result.PlanProduct = d.Plan.Product
+	result.PlanPublisher = d.Plan.Publisher
+
+	if expected := AzureImdsNonce(nonce); d.Nonce != expected {
+		log.Tracef("Attested document nonce %v does not match expected %v", d.Nonce, expected)
+		result.AttestedDocumentCheck = ar.Result{
+			ErrorCode:     ar.NonceMismatch,
+			Got:           d.Nonce,
+			ExpectedOneOf: []string{expected},
+		}
+		return result
+	}
+
+	result.CreatedOn, err = time.Parse(imdsTimeFormat, d.TimeStamp.CreatedOn)
+	if err != nil {
+		log.Tracef("Failed to parse attested document creation time: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.ParseEvidence)
+		return result
+	}
+	result.ExpiresOn, err = time.Parse(imdsTimeFormat, d.TimeStamp.ExpiresOn)
+	if err != nil {
+		log.Tracef("Failed to parse attested document expiration time: %v", err)
+		result.AttestedDocumentCheck.SetErr(ar.ParseEvidence)
+		return result
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	between := []string{result.CreatedOn.UTC().Format(time.RFC3339),
+		result.ExpiresOn.UTC().Format(time.RFC3339)}
+	if !at.Before(result.ExpiresOn) {
+		log.Tracef("Attested document expired at %v", result.ExpiresOn)
+		result.AttestedDocumentCheck = ar.Result{ErrorCode: ar.Expired,
+			Got: at.UTC().Format(time.RFC3339), ExpectedBetween: between}
+		return result
+	}
+	if at.Before(result.CreatedOn) {
+		log.Tracef("Attested document created in the future at %v", result.CreatedOn)
+		result.AttestedDocumentCheck = ar.Result{ErrorCode: ar.NotYetValid,
+			Got: at.UTC().Format(time.RFC3339), ExpectedBetween: between}
+		return result
+	}
+
+	result.AttestedDocumentCheck.Success = true
+	return result
+}
+
+// verifyAzureVtpmMeasurements verifies the measurements of an Azure VM with
+// a platform vTPM, e.g., a Trusted Launch VM. The vTPM AK certificate chain
+// must chain up to one of the Azure root CAs of the Azure vTPM reference
+// values instead of the CA of the verification request. The vTPM quote must
+// be signed by the certified AK and contain the nonce, the quoted PCRs are
+// verified against the TPM reference values. The attested document of the
+// instance metadata service must be signed by a certificate chaining up to one
+// of the configured IMDS root CAs, contain the nonce and be valid at the
+// verification time. The VM identity is reported in the measurement result
+func verifyAzureVtpmMeasurements(azureM ar.Measurement, nonce []byte,
+	azureReferenceValues, tpmReferenceValues []ar.ReferenceValue, at time.Time,
+) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying Azure vTPM measurements")
+
+	result := &ar.MeasurementResult{
+		Type:            "Azure vTPM Result",
+		AzureVtpmResult: &ar.AzureVtpmResult{},
+	}
+
+	if len(azureReferenceValues) == 0 {
+		log.Tracef("Could not find Azure vTPM Reference Value")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	akFingerprints := make([][]byte, 0)
+	imdsFingerprints := make([][]byte, 0)
+	for _, ref := range azureReferenceValues {
+		if ref.Type != "Azure vTPM Reference Value" {
+			log.Tracef("Azure vTPM Reference Value invalid type %v", ref.Type)
+			result.Summary.SetErr(ar.RefValType)
+			return result, false
+		}
+		if ref.AzureVtpm == nil {
+			continue
+		}
+		f, err := parseCaFingerprints(ref.AzureVtpm.AkCaFingerprints)
+		if err == nil {
+			akFingerprints = append(akFingerprints, f...)
+			f, err = parseCaFingerprints(ref.AzureVtpm.ImdsCaFingerprints)
+			imdsFingerprints = append(imdsFingerprints, f...)
+		}
+		if err != nil {
+			log.Tracef("Invalid Azure vTPM Reference Value: %v", err)
+			result.Signature.CertChainCheck.SetErr(ar.ParseCAFingerprint)
+			return result, false
+		}
+	}
+	if len(akFingerprints) == 0 || len(imdsFingerprints) == 0 {
+		log.Tracef("No AK or IMDS CA fingerprint set in Azure vTPM Reference Values")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	certs, err := internal.ParseCertsDer(azureM.Certs)
+	if err != nil || len(certs) == 0 {
+		log.Tracef("Failed to parse Azure vTPM AK certificates: %v", err)
+		result.Signature.CertChainCheck.SetErr(ar.ParseCert)
+		return result, false
+	}
+	x509Chains, r := verifyPinnedChain(certs, akFingerprints, at)
+	result.Signature.CertChainCheck = r
+	if !r.Success {
+		return result, false
+	}
+	result.Signature.AddValidatedChains(x509Chains)
+	akCert := x509Chains[0][0]
+
+	result.AzureVtpmResult = verifyAttestedDocument(azureM.AttestedDocument,
+		azureM.AttestedDocumentCerts, nonce, imdsFingerprints, at)
+
+	// Verify the vTPM quote, which binds the nonce and is signed with the AK
+	tpmM := ar.Measurement{
+		Type:      "TPM Measurement",
+		Evidence:  azureM.Evidence,
+		Signature: azureM.Signature,
+		Artifacts: azureM.Artifacts,
+	}
+	tpmResult, tpmOk := verifyTpmQuote(tpmM, nonce, akCert.PublicKey, tpmReferenceValues)
+
+	result.Freshness = tpmResult.Freshness
+	result.Signature.SignCheck = tpmResult.Signature.SignCheck
+	result.Artifacts = tpmResult.Artifacts
+	result.TpmResult = tpmResult.TpmResult
+
+	docCheck := result.AzureVtpmResult.AttestedDocumentCheck
+	ok := tpmOk && docCheck.Success
+	if tpmResult.Summary.ErrorCode != ar.NotSet {
+		result.Summary.SetErr(tpmResult.Summary.ErrorCode)
+	} else if !docCheck.Success {
+		code := docCheck.ErrorCode
+		if code == ar.NotSet {
+			code = ar.AttestedDocument
+		}
+		result.Summary.SetErr(code)
+	} else {
+		result.Summary.Success = ok
+	}
+
+	return result, ok
+}
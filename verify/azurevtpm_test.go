@@ -0,0 +1,352 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"go.mozilla.org/pkcs7"
+)
+
+// azureVtpmFixture contains an Azure vTPM measurement created with test Azure
+// certificate chains and a test vTPM AK, as the generation requires an Azure
+// VM. The attested document follows the format recorded from the instance
+// metadata service
+type azureVtpmFixture struct {
+	measurement  ar.Measurement
+	nonce        []byte
+	at           time.Time
+	azureRefVals []ar.ReferenceValue
+	tpmRefVals   []ar.ReferenceValue
+
+	akKey    *rsa.PrivateKey
+	akCa     *x509.Certificate
+	akCaKey  *rsa.PrivateKey
+	imdsCert *x509.Certificate
+	imdsKey  *rsa.PrivateKey
+}
+
+// Attested document as returned by the instance metadata service
+const azureVtpmTestDocument = `{"licenseType":"","nonce":"%v","plan":{"name":"","product":"",` +
+	`"publisher":""},"sku":"22_04-lts-gen2","subscriptionId":` +
+	`"8d10da13-8125-4ba9-a717-bf7490507b3d","timeStamp":{"createdOn":"10/14/26 08:00:00 -0000",` +
+	`"expiresOn":"10/14/26 14:00:00 -0000"},"vmId":"02aab8a4-74ef-476e-8182-f6d2ba4166a6"}`
+
+var azureVtpmTestTime = time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+
+func createAzureVtpmCa(t *testing.T, serial int64, cn string, parent *x509.Certificate,
+	parentKey *rsa.PrivateKey,
+) (*x509.Certificate, *rsa.PrivateKey) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tmpl := fixtures.CaTemplate(serial, cn, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2048, 1, 1, 0, 0, 0, 0, time.UTC))
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	return createTestCert(t, tmpl, parent, &key.PublicKey, parentKey), key
+}
+
+func createAzureVtpmLeaf(t *testing.T, cn string, pub *rsa.PublicKey, ca *x509.Certificate,
+	caKey *rsa.PrivateKey,
+) *x509.Certificate {
+	tmpl := fixtures.LeafTemplate(10, cn, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC))
+	return createTestCert(t, tmpl, ca, pub, caKey)
+}
+
+// createAttestedDocument creates the PKCS#7 signed attested document. As the
+// instance metadata service, only the signer certificate is embedded
+func createAttestedDocument(t *testing.T, content string, cert *x509.Certificate,
+	key *rsa.PrivateKey,
+) []byte {
+	sd, err := pkcs7.NewSignedData([]byte(content))
+	if err != nil {
+		t.Fatalf("failed to create signed data: %v", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("failed to add signer: %v", err)
+	}
+	doc, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("failed to sign attested document: %v", err)
+	}
+	return doc
+}
+
+func createAzureVtpmFixture(t *testing.T) *azureVtpmFixture {
+
+	f := &azureVtpmFixture{
+		nonce: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		at:    azureVtpmTestTime,
+	}
+
+	var err error
+	f.akKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate AK: %v", err)
+	}
+	akRoot, akRootKey := createAzureVtpmCa(t, 1, "Azure Virtual TPM Root Test", nil, nil)
+	f.akCa, f.akCaKey = createAzureVtpmCa(t, 2, "Global Virtual TPM CA Test", akRoot, akRootKey)
+	ak := createAzureVtpmLeaf(t, "02aab8a4-74ef-476e-8182-f6d2ba4166a6", &f.akKey.PublicKey,
+		f.akCa, f.akCaKey)
+
+	imdsRoot, imdsRootKey := createAzureVtpmCa(t, 3, "IMDS Root Test", nil, nil)
+	imdsCa, imdsCaKey := createAzureVtpmCa(t, 4, "IMDS Issuing CA Test", imdsRoot, imdsRootKey)
+	f.imdsKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	f.imdsCert = createAzureVtpmLeaf(t, "metadata.azure.com", &f.imdsKey.PublicKey, imdsCa,
+		imdsCaKey)
+
+	q := createVtpmQuote(t, f.akKey, f.nonce)
+
+	f.measurement = ar.Measurement{
+		Type:      "Azure vTPM Measurement",
+		Evidence:  q.Quote,
+		Signature: q.Signature,
+		Certs:     [][]byte{ak.Raw, f.akCa.Raw, akRoot.Raw},
+		Artifacts: q.Artifacts,
+		AttestedDocument: createAttestedDocument(t,
+			fmt.Sprintf(azureVtpmTestDocument, AzureImdsNonce(f.nonce)), f.imdsCert, f.imdsKey),
+		AttestedDocumentCerts: [][]byte{imdsRoot.Raw, imdsCa.Raw},
+	}
+
+	akFingerprint := sha256.Sum256(akRoot.Raw)
+	imdsFingerprint := sha256.Sum256(imdsRoot.Raw)
+	f.azureRefVals = []ar.ReferenceValue{{
+		Type: "Azure vTPM Reference Value",
+		Name: "Azure Roots",
+		AzureVtpm: &ar.AzureVtpmDetails{
+			AkCaFingerprints:   []string{hex.EncodeToString(akFingerprint[:])},
+			ImdsCaFingerprints: []string{hex.EncodeToString(imdsFingerprint[:])},
+		},
+	}}
+	f.tpmRefVals = q.ReferenceValues
+
+	return f
+}
+
+func Test_AzureImdsNonce(t *testing.T) {
+	a := AzureImdsNonce([]byte{0x01, 0x02})
+	if len(a) != 10 {
+		t.Errorf("AzureImdsNonce() = %v, want 10 digits", a)
+	}
+	for _, c := range a {
+		if c < '0' || c > '9' {
+			t.Errorf("AzureImdsNonce() = %v contains non-decimal digit", a)
+		}
+	}
+	if a != AzureImdsNonce([]byte{0x01, 0x02}) || a == AzureImdsNonce([]byte{0x01, 0x03}) {
+		t.Errorf("AzureImdsNonce() not derived from nonce")
+	}
+}
+
+func Test_verifyAzureVtpmMeasurements(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		modify  func(t *testing.T, f *azureVtpmFixture)
+		want    bool
+		wantErr ar.ErrorCode
+		check   func(t *testing.T, r *ar.MeasurementResult)
+	}{
+		{
+			name:   "Valid",
+			modify: func(t *testing.T, f *azureVtpmFixture) {},
+			want:   true,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				d := r.AzureVtpmResult
+				if !d.AttestedDocumentCheck.Success {
+					t.Errorf("attested document check failed")
+				}
+				if d.VmId != "02aab8a4-74ef-476e-8182-f6d2ba4166a6" ||
+					d.SubscriptionId != "8d10da13-8125-4ba9-a717-bf7490507b3d" ||
+					d.Sku != "22_04-lts-gen2" {
+					t.Errorf("unexpected VM identity %+v", d)
+				}
+				if !d.ExpiresOn.Equal(time.Date(2026, 10, 14, 14, 0, 0, 0, time.UTC)) {
+					t.Errorf("ExpiresOn = %v", d.ExpiresOn)
+				}
+				if len(r.Signature.ValidatedCerts) != 1 || len(r.Signature.ValidatedCerts[0]) != 3 {
+					t.Errorf("unexpected validated certs %v", r.Signature.ValidatedCerts)
+				}
+				if len(d.DocumentCerts) != 1 || len(d.DocumentCerts[0]) != 3 {
+					t.Errorf("unexpected document certs %v", d.DocumentCerts)
+				}
+			},
+		},
+		{
+			name: "Invalid Nonce",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.nonce = []byte{0xff}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Freshness.Success {
+					t.Error("freshness check succeeded")
+				}
+				if r.AzureVtpmResult.AttestedDocumentCheck.ErrorCode != ar.NonceMismatch {
+					t.Errorf("unexpected error code %v",
+						r.AzureVtpmResult.AttestedDocumentCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Document Of Other Request",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.measurement.AttestedDocument = createAttestedDocument(t,
+					fmt.Sprintf(azureVtpmTestDocument, "0123456789"), f.imdsCert, f.imdsKey)
+			},
+			want:    false,
+			wantErr: ar.NonceMismatch,
+		},
+		{
+			name: "Expired Document",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.at = time.Date(2026, 10, 14, 14, 0, 0, 0, time.UTC)
+			},
+			want:    false,
+			wantErr: ar.Expired,
+		},
+		{
+			name: "Document Not Yet Valid",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.at = time.Date(2026, 10, 14, 7, 0, 0, 0, time.UTC)
+			},
+			want:    false,
+			wantErr: ar.NotYetValid,
+		},
+		{
+			name: "Invalid Document Signature",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				other, _ := rsa.GenerateKey(rand.Reader, 2048)
+				f.measurement.AttestedDocument = createAttestedDocument(t,
+					fmt.Sprintf(azureVtpmTestDocument, AzureImdsNonce(f.nonce)), f.imdsCert, other)
+			},
+			want:    false,
+			wantErr: ar.VerifySignature,
+		},
+		{
+			name: "Missing Document",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.measurement.AttestedDocument = nil
+			},
+			want:    false,
+			wantErr: ar.ParseEvidence,
+		},
+		{
+			name: "IMDS CA Fingerprint Mismatch",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.azureRefVals[0].AzureVtpm.ImdsCaFingerprints = f.azureRefVals[0].AzureVtpm.AkCaFingerprints
+			},
+			want:    false,
+			wantErr: ar.CaFingerprint,
+		},
+		{
+			name: "AK CA Fingerprint Mismatch",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.azureRefVals[0].AzureVtpm.AkCaFingerprints = f.azureRefVals[0].AzureVtpm.ImdsCaFingerprints
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.CaFingerprint {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "AK Not Issued By Azure CA",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				root, rootKey := createAzureVtpmCa(t, 1, "Device CA", nil, nil)
+				ak := createAzureVtpmLeaf(t, "device", &f.akKey.PublicKey, root, rootKey)
+				f.measurement.Certs = [][]byte{ak.Raw, root.Raw}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.CaFingerprint {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Quote Signed With Other Key",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				other, _ := rsa.GenerateKey(rand.Reader, 2048)
+				q := createVtpmQuote(t, other, f.nonce)
+				f.measurement.Evidence, f.measurement.Signature = q.Quote, q.Signature
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.SignCheck.Success {
+					t.Error("quote signature check succeeded")
+				}
+			},
+		},
+		{
+			name: "Invalid PCR",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.tpmRefVals[1].Sha256 = make([]byte, 32)
+			},
+			want: false,
+		},
+		{
+			name: "Missing Azure vTPM Reference Value",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.azureRefVals = nil
+			},
+			want:    false,
+			wantErr: ar.RefValNotPresent,
+		},
+		{
+			name: "Missing IMDS CA Fingerprint",
+			modify: func(t *testing.T, f *azureVtpmFixture) {
+				f.azureRefVals[0].AzureVtpm.ImdsCaFingerprints = nil
+			},
+			want:    false,
+			wantErr: ar.RefValNotPresent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createAzureVtpmFixture(t)
+			tt.modify(t, f)
+
+			r, got := verifyAzureVtpmMeasurements(f.measurement, f.nonce, f.azureRefVals,
+				f.tpmRefVals, f.at)
+			if got != tt.want {
+				t.Errorf("verifyAzureVtpmMeasurements() = %v, want %v (summary %+v)", got,
+					tt.want, r.Summary)
+			}
+			if r.Summary.Success != tt.want {
+				t.Errorf("summary success = %v, want %v", r.Summary.Success, tt.want)
+			}
+			if tt.wantErr != ar.NotSet && r.Summary.ErrorCode != tt.wantErr {
+				t.Errorf("summary error code = %v, want %v", r.Summary.ErrorCode, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
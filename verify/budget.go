@@ -0,0 +1,221 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// reportCostFactor estimates the memory required for verifying a report as a
+	// multiple of its size: the decoded payload and the unpacked measurements and
+	// event logs. CBOR reports with huge IMA logs require about six times their
+	// size, JSON reports less due to the base64 and text encoding
+	reportCostFactor = 6
+	// DefaultSpoolThreshold is the default size beyond which reports read through
+	// a budget are spooled to temporary files
+	DefaultSpoolThreshold = 16 * 1024 * 1024
+
+	spoolPattern = "cmc-report-*"
+)
+
+// BudgetConfig configures the memory budget of the verifier
+type BudgetConfig struct {
+	// Memory is the estimated memory in bytes all concurrent verifications may
+	// use. Verifications exceeding the budget are queued
+	Memory int64
+	// SpoolThreshold is the size in bytes beyond which reports are spooled to
+	// temporary files (default DefaultSpoolThreshold)
+	SpoolThreshold int64
+	// SpoolDir is the folder for the temporary files (default os.TempDir)
+	SpoolDir string
+}
+
+// Budget admits concurrent verifications against a global memory budget. The
+// memory of a verification is estimated from the size of the report. If the
+// budget is exhausted, verifications are queued in arrival order until enough
+// memory is released. A report exceeding the whole budget is verified once all
+// other verifications have finished. A nil budget admits all verifications
+// immediately
+type Budget struct {
+	sem       *semaphore.Weighted
+	memory    int64
+	threshold int64
+	dir       string
+}
+
+// NewBudget creates a memory budget for verifications
+func NewBudget(c BudgetConfig) (*Budget, error) {
+	if c.Memory <= 0 {
+		return nil, fmt.Errorf("invalid verification memory budget %v", c.Memory)
+	}
+	if c.SpoolThreshold < 0 {
+		return nil, fmt.Errorf("invalid spool threshold %v", c.SpoolThreshold)
+	}
+	b := &Budget{
+		sem:       semaphore.NewWeighted(c.Memory),
+		memory:    c.Memory,
+		threshold: c.SpoolThreshold,
+		dir:       c.SpoolDir,
+	}
+	if b.threshold == 0 {
+		b.threshold = DefaultSpoolThreshold
+	}
+	return b, nil
+}
+
+// cost returns the estimated memory for verifying a report of the given size
+func (b *Budget) cost(size int64) int64 {
+	cost := size * reportCostFactor
+	if cost > b.memory {
+		return b.memory
+	}
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
+// acquire waits until the estimated memory is available and returns the
+// function releasing it
+func (b *Budget) acquire(ctx context.Context, cost int64) (func(), error) {
+	if !b.sem.TryAcquire(cost) {
+		log.Debugf("Queueing verification of %v bytes until memory budget is available", cost)
+		if err := b.sem.Acquire(ctx, cost); err != nil {
+			return nil, fmt.Errorf("failed to wait for verification memory budget: %w", err)
+		}
+	}
+	return func() { b.sem.Release(cost) }, nil
+}
+
+// Verify verifies the attestation report like Verify, once the estimated memory
+// is available within the budget. An error is returned if the context is done
+// before
+func (b *Budget) Verify(ctx context.Context, arRaw, nonce, casPem, policies []byte,
+	polEng PolicyEngineSelect, cache string,
+) (ar.VerificationResult, error) {
+	if b == nil {
+		return Verify(arRaw, nonce, casPem, policies, polEng, cache), nil
+	}
+
+	release, err := b.acquire(ctx, b.cost(int64(len(arRaw))))
+	if err != nil {
+		return ar.VerificationResult{}, err
+	}
+	defer release()
+
+	return Verify(arRaw, nonce, casPem, policies, polEng, cache), nil
+}
+
+// VerifyReader reads the attestation report from r and verifies it like
+// Verify within the budget. Reports exceeding the spool threshold are not
+// buffered in memory, but spooled to a temporary file, which is mapped for
+// the verification and removed afterwards, also if the verification panics
+func (b *Budget) VerifyReader(ctx context.Context, r io.Reader, nonce, casPem, policies []byte,
+	polEng PolicyEngineSelect, cache string,
+) (ar.VerificationResult, error) {
+	threshold := int64(DefaultSpoolThreshold)
+	var dir string
+	if b != nil {
+		threshold = b.threshold
+		dir = b.dir
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := io.ReadAll(io.LimitReader(br, threshold+1))
+	if err != nil {
+		return ar.VerificationResult{}, fmt.Errorf("failed to read attestation report: %w", err)
+	}
+	if int64(len(head)) <= threshold {
+		return b.Verify(ctx, head, nonce, casPem, policies, polEng, cache)
+	}
+
+	f, err := spool(dir, head, br)
+	head = nil
+	if err != nil {
+		return ar.VerificationResult{}, err
+	}
+	defer func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			log.Warnf("Failed to remove spooled attestation report: %v", err)
+		}
+	}()
+
+	return b.verifyFile(ctx, f, nonce, casPem, policies, polEng, cache)
+}
+
+// VerifyFile verifies the attestation report stored in the file like Verify
+// within the budget. The file is mapped instead of read into memory
+func (b *Budget) VerifyFile(ctx context.Context, path string, nonce, casPem, policies []byte,
+	polEng PolicyEngineSelect, cache string,
+) (ar.VerificationResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ar.VerificationResult{}, fmt.Errorf("failed to open attestation report: %w", err)
+	}
+	defer f.Close()
+
+	return b.verifyFile(ctx, f, nonce, casPem, policies, polEng, cache)
+}
+
+func (b *Budget) verifyFile(ctx context.Context, f *os.File, nonce, casPem, policies []byte,
+	polEng PolicyEngineSelect, cache string,
+) (ar.VerificationResult, error) {
+	data, unmap, err := mapFile(f)
+	if err != nil {
+		return ar.VerificationResult{}, fmt.Errorf("failed to map attestation report: %w", err)
+	}
+	defer unmap()
+
+	if b != nil {
+		release, err := b.acquire(ctx, b.cost(int64(len(data))))
+		if err != nil {
+			return ar.VerificationResult{}, err
+		}
+		defer release()
+	}
+
+	return Verify(data, nonce, casPem, policies, polEng, cache), nil
+}
+
+// spool writes the already read head and the remainder of the report to a
+// temporary file. The file is removed on failure
+func spool(dir string, head []byte, r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp(dir, spoolPattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	log.Debugf("Spooling attestation report to %v", f.Name())
+
+	_, err = f.Write(head)
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to spool attestation report: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+const policyEngineSelect_Panic PolicyEngineSelect = 0xff
+
+type panicValidator struct{}
+
+func (panicValidator) Validate(policies []byte, result ar.VerificationResult) bool {
+	panic("policy engine failure")
+}
+
+type failingReader struct{ r io.Reader }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func spooledFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read spool folder: %v", err)
+	}
+	return len(entries)
+}
+
+func TestBudgetVerifyReader(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{}})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	report, err := f.NewReport(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+
+	policyEngines[policyEngineSelect_Panic] = panicValidator{}
+	defer delete(policyEngines, policyEngineSelect_Panic)
+
+	tests := []struct {
+		name      string
+		threshold int64
+		reader    func() io.Reader
+		polEng    PolicyEngineSelect
+		want      bool
+		wantErr   bool
+		wantPanic bool
+	}{
+		{"In Memory", int64(len(report)), func() io.Reader { return bytes.NewReader(report) },
+			PolicyEngineSelect_None, true, false, false},
+		{"Spooled", int64(len(report)) / 4, func() io.Reader { return bytes.NewReader(report) },
+			PolicyEngineSelect_None, true, false, false},
+		{"Spooled Read Error", int64(len(report)) / 4,
+			func() io.Reader { return &failingReader{bytes.NewReader(report)} },
+			PolicyEngineSelect_None, false, true, false},
+		{"Spooled Invalid Report", 16,
+			func() io.Reader { return strings.NewReader(strings.Repeat("x", 1024)) },
+			PolicyEngineSelect_None, false, false, false},
+		{"Spooled Panic", int64(len(report)) / 4, func() io.Reader { return bytes.NewReader(report) },
+			policyEngineSelect_Panic, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b, err := NewBudget(BudgetConfig{Memory: 1 << 30, SpoolThreshold: tt.threshold,
+				SpoolDir: dir})
+			if err != nil {
+				t.Fatalf("NewBudget() error = %v", err)
+			}
+
+			var policies []byte
+			if tt.polEng != PolicyEngineSelect_None {
+				policies = []byte("policies")
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); (r != nil) != tt.wantPanic {
+						t.Errorf("VerifyReader() panic = %v, wantPanic %v", r, tt.wantPanic)
+					}
+				}()
+				got, err := b.VerifyReader(context.Background(), tt.reader(), f.Nonce, f.CaPem(),
+					policies, tt.polEng, "")
+				if (err != nil) != tt.wantErr {
+					t.Errorf("VerifyReader() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got.Success != tt.want {
+					t.Errorf("Result.Success = %v, want %v", got.Success, tt.want)
+				}
+			}()
+
+			if n := spooledFiles(t, dir); n != 0 {
+				t.Errorf("%v spooled files left", n)
+			}
+		})
+	}
+}
+
+func TestBudgetAdmission(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	report, err := f.NewReport(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+
+	// The budget is smaller than the cost of the report, which is therefore
+	// only admitted if no other verification is running
+	b, err := NewBudget(BudgetConfig{Memory: int64(len(report))})
+	if err != nil {
+		t.Fatalf("NewBudget() error = %v", err)
+	}
+	release, err := b.acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Verify(ctx, report, f.Nonce, f.CaPem(), nil, 0, ""); err == nil {
+		t.Fatalf("Verify() succeeded with exhausted budget")
+	}
+
+	done := make(chan ar.VerificationResult)
+	go func() {
+		result, err := b.Verify(context.Background(), report, f.Nonce, f.CaPem(), nil, 0, "")
+		if err != nil {
+			t.Errorf("Verify() error = %v", err)
+		}
+		done <- result
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Verify() not queued with exhausted budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if result := <-done; !result.Success {
+		t.Errorf("Result.Success = false after release of budget")
+	}
+
+	if _, err := NewBudget(BudgetConfig{}); err == nil {
+		t.Errorf("NewBudget() succeeded without memory budget")
+	}
+}
+
+// rss returns the resident set size of the process
+func rss(t *testing.T) int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		t.Skipf("resident set size not available: %v", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				t.Fatalf("failed to parse resident set size: %v", err)
+			}
+			return kb * 1024
+		}
+	}
+	t.Skip("resident set size not available")
+	return 0
+}
+
+func TestBudgetRssBound(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping verification of huge reports in short mode")
+	}
+
+	const (
+		workers  = 8
+		rssBound = 256 * 1024 * 1024
+	)
+
+	limits := ar.GetDecodeLimits()
+	defer ar.SetDecodeLimits(limits)
+	if err := ar.SetDecodeLimits(ar.DecodeLimits{MaxSize: 1 << 30,
+		MaxArrayElements: 1 << 22}); err != nil {
+		t.Fatalf("SetDecodeLimits() error = %v", err)
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(25))
+
+	// An artificially huge IMA-like log of ~100k events, which requires about
+	// 100 MB to verify. Unbounded, the concurrent verifications would exceed the
+	// RSS bound several times
+	f, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{},
+		AppEvents: 50000})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	report, err := f.NewReport(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+	file := t.TempDir() + "/report.cbor"
+	if err := os.WriteFile(file, report, 0600); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	report = nil
+
+	dir := t.TempDir()
+	b, err := NewBudget(BudgetConfig{Memory: 128 * 1024 * 1024, SpoolThreshold: 1024 * 1024,
+		SpoolDir: dir})
+	if err != nil {
+		t.Fatalf("NewBudget() error = %v", err)
+	}
+
+	runtime.GC()
+	debug.FreeOSMemory()
+	base := rss(t)
+
+	var peak int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			if r := rss(t); r > peak {
+				peak = r
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := os.Open(file)
+			if err != nil {
+				t.Errorf("failed to open report: %v", err)
+				return
+			}
+			defer r.Close()
+			result, err := b.VerifyReader(context.Background(), r, f.Nonce, f.CaPem(), nil, 0, "")
+			if err != nil {
+				t.Errorf("VerifyReader() error = %v", err)
+			}
+			if !result.Success {
+				t.Errorf("Result.Success = false")
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-sampled
+
+	t.Logf("RSS grew by %v MB", (peak-base)/(1024*1024))
+	if peak-base > rssBound {
+		t.Errorf("RSS grew by %v MB, exceeding bound of %v MB", (peak-base)/(1024*1024),
+			rssBound/(1024*1024))
+	}
+	if n := spooledFiles(t, dir); n != 0 {
+		t.Errorf("%v spooled files left", n)
+	}
+}
@@ -0,0 +1,648 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+)
+
+// CBOR tags of the CBOR Web Token (CWT) and the COSE_Sign1 message
+const (
+	cwtTag   = 61
+	sign1Tag = 18
+)
+
+// Claim keys of the Entity Attestation Token (RFC 9711) and the PSA
+// attestation token profile mapped to the measurement results
+const (
+	eatNonceClaim        = 10
+	eatUeidClaim         = 256
+	eatProfileClaim      = 265
+	eatSwNameClaim       = 270
+	eatMeasurementsClaim = 273
+	psaSwComponentsClaim = 2399
+)
+
+// CoAP content format of CoSWID tags (RFC 9393) in the measurements claim
+const contentFormatCoswid = 258
+
+var (
+	eatMetadataMu sync.RWMutex
+	eatMetadata   *ar.AttestationReport
+	eatSerializer ar.Serializer
+)
+
+// SetEatMetadata configures the signed metadata with the reference values for
+// Entity Attestation Tokens (EAT) of attesters other than the CMC. As these
+// tokens do not contain the metadata of the attester, the manifests and the
+// device description are configured on the verifier side
+func SetEatMetadata(metadata [][]byte) error {
+	report := &ar.AttestationReport{}
+	var s ar.Serializer
+	for i, m := range metadata {
+		var ms ar.Serializer
+		if json.Valid(m) {
+			ms = ar.JsonSerializer{}
+		} else if err := cbor.Valid(m); err == nil {
+			ms = ar.CborSerializer{}
+		} else {
+			return fmt.Errorf("failed to detect serialization of EAT metadata object %v", i)
+		}
+		if s != nil && fmt.Sprintf("%T", s) != fmt.Sprintf("%T", ms) {
+			return fmt.Errorf("EAT metadata object %v has different serialization %T", i, ms)
+		}
+		s = ms
+
+		payload, err := s.GetPayload(m)
+		if err != nil {
+			return fmt.Errorf("failed to parse EAT metadata object %v: %w", i, err)
+		}
+		info := new(ar.MetaInfo)
+		if err := s.Unmarshal(payload, info); err != nil {
+			return fmt.Errorf("failed to unmarshal EAT metadata object %v: %w", i, err)
+		}
+		switch info.Type {
+		case "App Manifest":
+			report.AppManifests = append(report.AppManifests, m)
+		case "OS Manifest":
+			report.OsManifest = m
+		case "RTM Manifest":
+			report.RtmManifest = m
+		case "Device Description":
+			report.DeviceDescription = m
+		case "Company Description":
+			report.CompanyDescription = m
+		default:
+			return fmt.Errorf("unsupported EAT metadata type %v", info.Type)
+		}
+	}
+
+	eatMetadataMu.Lock()
+	defer eatMetadataMu.Unlock()
+	if len(metadata) == 0 {
+		eatMetadata, eatSerializer = nil, nil
+	} else {
+		eatMetadata, eatSerializer = report, s
+	}
+	return nil
+}
+
+func getEatMetadata() (*ar.AttestationReport, ar.Serializer) {
+	eatMetadataMu.RLock()
+	defer eatMetadataMu.RUnlock()
+	return eatMetadata, eatSerializer
+}
+
+// isEat returns whether the data is a COSE_Sign1 message, optionally wrapped
+// as CWT, as used for Entity Attestation Tokens. Attestation reports of the
+// CMC are COSE_Sign messages
+func isEat(data []byte) bool {
+	_, ok := unwrapCwt(data)
+	return ok
+}
+
+// unwrapCwt returns the tagged COSE_Sign1 message of a token
+func unwrapCwt(data []byte) ([]byte, bool) {
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(data, &tag); err != nil {
+		return nil, false
+	}
+	if tag.Number == cwtTag {
+		data = tag.Content
+		if err := cbor.Unmarshal(data, &tag); err != nil {
+			return nil, false
+		}
+	}
+	return data, tag.Number == sign1Tag
+}
+
+// eatComponent is a software component measured by the attester, taken from
+// the PSA software components or the CoSWID tags of the measurements claim
+type eatComponent struct {
+	name        string
+	description string
+	digest      []byte
+}
+
+// eatClaims are the claims of an EAT mapped to the measurement results
+type eatClaims struct {
+	nonces     [][]byte
+	ueid       []byte
+	profile    string
+	components []eatComponent
+	other      map[string]interface{}
+}
+
+// verifyEat verifies an Entity Attestation Token of an attester other than the
+// CMC against the nonce like an attestation report: the COSE signature is
+// verified against the CAs, the measured software components are compared to
+// the EAT reference values of the configured metadata and the descriptions and
+// policies are verified. Claims which are not mapped are passed through to the
+// policies
+func verifyEat(result ar.VerificationResult, data, nonce []byte, cas []*x509.Certificate,
+	policies []byte, polEng PolicyEngineSelect, at time.Time,
+) ar.VerificationResult {
+
+	log.Trace("Detected Entity Attestation Token")
+
+	mr := ar.MeasurementResult{
+		Type:      "EAT Result",
+		EatResult: &ar.EatResult{},
+	}
+
+	msg, sig, payload, ok := verifyEatSignature(data, cas, at)
+	result.ReportSignature = []ar.SignatureResult{sig}
+	if msg == nil {
+		result.Success = false
+		result.ErrorCode = ar.ParseEvidence
+		return result
+	}
+	mr.Signature = sig
+	if !ok {
+		log.Trace("EAT signature verification failed")
+		result.Success = false
+		result.ErrorCode = ar.VerifySignature
+		return result
+	}
+
+	claims, err := parseEatClaims(payload)
+	if err != nil {
+		log.Tracef("Failed to parse EAT claims: %v", err)
+		result.Success = false
+		result.ErrorCode = ar.ParseEvidence
+		return result
+	}
+	mr.EatResult.Profile = claims.profile
+	mr.EatResult.Ueid = hex.EncodeToString(claims.ueid)
+	mr.EatResult.Claims = claims.other
+	result.Prover = mr.EatResult.Ueid
+
+	// The reference values are taken from the configured metadata, which is
+	// verified like the metadata of attestation reports
+	report, s := getEatMetadata()
+	metadata := &ar.Metadata{}
+	if report != nil {
+		var mres *ar.MetadataResult
+		metadata, mres, ok = verifyMetadata(report, cas, s, at)
+		if !ok {
+			result.Success = false
+		}
+		result.MetadataResult = *mres
+	} else {
+		log.Trace("No EAT metadata configured")
+		result.Success = false
+	}
+
+	a := newAppraiser()
+	a.tokens("reportHashes", a.ReportHashes, "EAT", result.ReportSignature)
+	a.metadata(&result.MetadataResult)
+	if !a.finish(&result) {
+		log.Trace("EAT violates the appraisal baseline")
+		return result
+	}
+
+	refVals, err := collectReferenceValues(metadata)
+	if err != nil {
+		log.Tracef("Failed to collect reference values: %v", err)
+		result.Success = false
+		result.ErrorCode = ar.RefValTypeNotSupported
+	}
+
+	if !verifyEatClaims(&mr, claims, nonce, refVals["EAT Reference Value"]) {
+		result.Success = false
+	}
+	result.Measurements = append(result.Measurements, mr)
+
+	return verifyDescriptions(result, metadata, true, policies, polEng)
+}
+
+// verifyEatSignature verifies the COSE_Sign1 signature of the token. If the
+// token contains an x5chain header, the chain must be valid up to one of the
+// CAs. Otherwise, the token must be signed with the key of one of the CAs,
+// which allows configuring the attestation keys of attesters without PKI as
+// (self-signed) trust anchors
+func verifyEatSignature(data []byte, cas []*x509.Certificate, at time.Time,
+) (*cose.Sign1Message, ar.SignatureResult, []byte, bool) {
+
+	result := ar.SignatureResult{}
+
+	raw, _ := unwrapCwt(data)
+	msg := &cose.Sign1Message{}
+	if err := msg.UnmarshalCBOR(raw); err != nil {
+		log.Tracef("Failed to unmarshal COSE_Sign1 message: %v", err)
+		result.SignCheck.SetErr(ar.ParseEvidence)
+		return nil, result, nil, false
+	}
+
+	alg, err := msg.Headers.Protected.Algorithm()
+	if err != nil {
+		log.Tracef("Failed to get COSE algorithm: %v", err)
+		result.SignCheck.SetErr(ar.UnsupportedAlgorithm)
+		return msg, result, nil, false
+	}
+	result.Algorithm = alg.String()
+
+	certs, err := eatCertChain(msg)
+	if err != nil {
+		log.Tracef("Failed to parse EAT certificate chain: %v", err)
+		result.CertChainCheck.SetErr(ar.ParseCert)
+		return msg, result, nil, false
+	}
+
+	var keys []crypto.PublicKey
+	var anchors []*x509.Certificate
+	if len(certs) > 0 {
+		chains, err := internal.VerifyCertChainAt(certs, cas, at)
+		if err != nil {
+			log.Tracef("Failed to verify EAT certificate chain: %v", err)
+			result.CertChainCheck.SetErr(ar.VerifyCertChain)
+			return msg, result, nil, false
+		}
+		result.CertChainCheck.Success = true
+		result.AddValidatedChains(chains)
+		keys = append(keys, certs[0].PublicKey)
+	} else {
+		for _, ca := range cas {
+			keys = append(keys, ca.PublicKey)
+			anchors = append(anchors, ca)
+		}
+	}
+
+	for i, key := range keys {
+		verifier, err := cose.NewVerifier(alg, key)
+		if err != nil {
+			log.Tracef("Failed to create verifier: %v", err)
+			continue
+		}
+		if err := msg.Verify(nil, verifier); err != nil {
+			continue
+		}
+		if len(anchors) > 0 {
+			result.CertChainCheck.Success = true
+			result.AddValidatedChains([][]*x509.Certificate{{anchors[i]}})
+		}
+		result.SignCheck.Success = true
+		return msg, result, msg.Payload, true
+	}
+
+	log.Trace("EAT is not signed by a trusted key")
+	result.SignCheck.SetErr(ar.VerifySignature)
+	return msg, result, nil, false
+}
+
+// eatCertChain returns the certificates of the x5chain header, which contains
+// a single certificate or an array of certificates starting with the leaf
+func eatCertChain(msg *cose.Sign1Message) ([]*x509.Certificate, error) {
+	value, ok := msg.Headers.Protected[cose.HeaderLabelX5Chain]
+	if !ok {
+		value, ok = msg.Headers.Unprotected[cose.HeaderLabelX5Chain]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var ders [][]byte
+	switch v := value.(type) {
+	case []byte:
+		ders = [][]byte{v}
+	case []interface{}:
+		for _, elem := range v {
+			der, ok := elem.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("unexpected x5chain element type %T", elem)
+			}
+			ders = append(ders, der)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected x5chain type %T", value)
+	}
+	return internal.ParseCertsDer(ders)
+}
+
+// parseEatClaims maps the nonce, the UEID, the profile and the software
+// components of the PSA software components and the CoSWID measurements
+// claims. All other claims are returned for the policies
+func parseEatClaims(payload []byte) (*eatClaims, error) {
+	var raw map[interface{}]cbor.RawMessage
+	if err := cbor.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal claims: %w", err)
+	}
+
+	claims := &eatClaims{other: map[string]interface{}{}}
+	for k, v := range raw {
+		key, isInt := claimKey(k)
+		var err error
+		switch {
+		case isInt && key == eatNonceClaim:
+			claims.nonces, err = oneOrMoreBytes(v)
+		case isInt && key == eatUeidClaim:
+			err = cbor.Unmarshal(v, &claims.ueid)
+		case isInt && key == eatProfileClaim:
+			// The profile is either a URI or an OID
+			var oid []byte
+			if cbor.Unmarshal(v, &claims.profile) != nil {
+				if err = cbor.Unmarshal(v, &oid); err == nil {
+					claims.profile = hex.EncodeToString(oid)
+				}
+			}
+		case isInt && key == psaSwComponentsClaim:
+			var swcs []SwComponent
+			if err = cbor.Unmarshal(v, &swcs); err == nil {
+				for _, swc := range swcs {
+					claims.components = append(claims.components, eatComponent{
+						name:        swc.MeasurementType,
+						description: swc.MeasurementDescription,
+						digest:      swc.MeasurementValue,
+					})
+				}
+			}
+		case isInt && key == eatMeasurementsClaim:
+			var components []eatComponent
+			var unmapped []interface{}
+			components, unmapped, err = parseEatMeasurements(v)
+			claims.components = append(claims.components, components...)
+			if len(unmapped) > 0 {
+				claims.other[strconv.FormatInt(key, 10)] = unmapped
+			}
+		default:
+			var value interface{}
+			if err = cbor.Unmarshal(v, &value); err == nil {
+				claims.other[fmt.Sprint(k)] = claimValue(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal claim %v: %w", k, err)
+		}
+	}
+
+	if len(claims.nonces) == 0 {
+		return nil, errors.New("token does not contain a nonce")
+	}
+	if len(claims.other) == 0 {
+		claims.other = nil
+	}
+	return claims, nil
+}
+
+// claimKey returns the integer value of integer claim keys
+func claimKey(k interface{}) (int64, bool) {
+	switch v := k.(type) {
+	case int64:
+		return v, true
+	case uint64:
+		if v <= uint64(1<<63-1) {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// oneOrMoreBytes unmarshals a byte string or an array of byte strings
+func oneOrMoreBytes(data []byte) ([][]byte, error) {
+	var single []byte
+	if err := cbor.Unmarshal(data, &single); err == nil {
+		return [][]byte{single}, nil
+	}
+	var multiple [][]byte
+	if err := cbor.Unmarshal(data, &multiple); err != nil {
+		return nil, err
+	}
+	return multiple, nil
+}
+
+type eatMeasurement struct {
+	_             struct{} `cbor:",toarray"`
+	ContentFormat uint64
+	Content       []byte
+}
+
+// parseEatMeasurements returns the files of the evidence and payload of the
+// CoSWID tags in the measurements claim. Measurements of other content formats
+// are returned unmapped
+func parseEatMeasurements(data []byte) ([]eatComponent, []interface{}, error) {
+	var measurements []eatMeasurement
+	if err := cbor.Unmarshal(data, &measurements); err != nil {
+		return nil, nil, err
+	}
+
+	var components []eatComponent
+	var unmapped []interface{}
+	for _, m := range measurements {
+		if m.ContentFormat != contentFormatCoswid {
+			unmapped = append(unmapped, map[string]interface{}{
+				"contentFormat": m.ContentFormat,
+				"content":       hex.EncodeToString(m.Content),
+			})
+			continue
+		}
+		c, err := parseCoswid(m.Content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CoSWID: %w", err)
+		}
+		components = append(components, c...)
+	}
+	return components, unmapped, nil
+}
+
+// coswidTag contains the fields of a CoSWID tag (RFC 9393) required for
+// mapping the measured files. Files are measured with a hash entry consisting
+// of the named information hash algorithm and the digest
+type coswidTag struct {
+	SoftwareName    string          `cbor:"1,keyasint"`
+	Evidence        cbor.RawMessage `cbor:"3,keyasint,omitempty"`
+	Payload         cbor.RawMessage `cbor:"6,keyasint,omitempty"`
+	SoftwareVersion string          `cbor:"13,keyasint,omitempty"`
+}
+
+type coswidResources struct {
+	File cbor.RawMessage `cbor:"17,keyasint,omitempty"`
+}
+
+type coswidFile struct {
+	Hash   coswidHashEntry `cbor:"7,keyasint"`
+	FsName string          `cbor:"24,keyasint"`
+}
+
+type coswidHashEntry struct {
+	_     struct{} `cbor:",toarray"`
+	AlgId int
+	Value []byte
+}
+
+// parseCoswid returns the measured files of the evidence and the payload of
+// the CoSWID tag
+func parseCoswid(data []byte) ([]eatComponent, error) {
+	var tag coswidTag
+	if err := cbor.Unmarshal(data, &tag); err != nil {
+		return nil, err
+	}
+
+	var components []eatComponent
+	for _, resources := range []cbor.RawMessage{tag.Evidence, tag.Payload} {
+		if len(resources) == 0 {
+			continue
+		}
+		var r coswidResources
+		if err := cbor.Unmarshal(resources, &r); err != nil {
+			return nil, err
+		}
+		if len(r.File) == 0 {
+			continue
+		}
+		var files []coswidFile
+		if err := cbor.Unmarshal(r.File, &files); err != nil {
+			var file coswidFile
+			if err := cbor.Unmarshal(r.File, &file); err != nil {
+				return nil, err
+			}
+			files = []coswidFile{file}
+		}
+		for _, f := range files {
+			components = append(components, eatComponent{
+				name:        f.FsName,
+				description: tag.SoftwareName,
+				digest:      f.Hash.Value,
+			})
+		}
+	}
+	return components, nil
+}
+
+// claimValue converts a decoded CBOR value for the JSON serialization of the
+// result: maps are keyed by strings and byte strings hex encoded
+func claimValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return hex.EncodeToString(t)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = claimValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = claimValue(e)
+		}
+		return l
+	case cbor.Tag:
+		return map[string]interface{}{"tag": t.Number, "value": claimValue(t.Content)}
+	case big.Int:
+		return t.String()
+	default:
+		return v
+	}
+}
+
+// verifyEatClaims verifies the nonce and compares the software components to
+// the reference values. For PSA tokens, the nonce may be the PSA challenge of
+// the nonce
+func verifyEatClaims(result *ar.MeasurementResult, claims *eatClaims, nonce []byte,
+	referenceValues []ar.ReferenceValue,
+) bool {
+	ok := true
+
+	challenge := PsaChallenge(nonce)
+	for _, n := range claims.nonces {
+		if bytes.Equal(n, nonce) || bytes.Equal(n, challenge) {
+			result.Freshness.Success = true
+		}
+	}
+	if !result.Freshness.Success {
+		log.Tracef("Nonces mismatch: supplied nonce %v not contained in EAT",
+			hex.EncodeToString(nonce))
+		result.Freshness.Expected = hex.EncodeToString(nonce)
+		result.Freshness.Got = hex.EncodeToString(claims.nonces[0])
+		ok = false
+	}
+
+	if len(referenceValues) == 0 {
+		log.Trace("Could not find EAT Reference Value")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return false
+	}
+
+	// Verify that every reference value has a corresponding measurement
+	for _, ref := range referenceValues {
+		digest := ref.Sha256
+		if len(digest) == 0 {
+			digest = ref.Sha384
+		}
+		found := false
+		for _, c := range claims.components {
+			if bytes.Equal(ref.Sha256, c.digest) || bytes.Equal(ref.Sha384, c.digest) {
+				found = true
+				break
+			}
+		}
+		r := ar.DigestResult{
+			Name:        ref.Name,
+			Digest:      hex.EncodeToString(digest),
+			Description: ref.Description,
+			Success:     found,
+		}
+		if !found {
+			if ref.Optional {
+				continue
+			}
+			log.Tracef("No measurement for reference value %v", ref.Name)
+			r.Type = "Reference Value"
+			ok = false
+		}
+		result.Artifacts = append(result.Artifacts, r)
+	}
+
+	// Verify that every measurement has a corresponding reference value
+	for _, c := range claims.components {
+		found := false
+		for _, ref := range referenceValues {
+			if bytes.Equal(ref.Sha256, c.digest) || bytes.Equal(ref.Sha384, c.digest) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Tracef("No reference value for measurement %v", c.name)
+			result.Artifacts = append(result.Artifacts, ar.DigestResult{
+				Name:        c.name,
+				Digest:      hex.EncodeToString(c.digest),
+				Description: c.description,
+				Success:     false,
+				Type:        "Measurement",
+			})
+			ok = false
+		}
+	}
+
+	result.Summary.Success = ok
+	return ok
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/go-cose"
+)
+
+var (
+	eatBootloader = sha256.Sum256([]byte("partner bootloader"))
+	eatFirmware   = sha256.Sum256([]byte("partner firmware"))
+	eatUnknown    = sha256.Sum256([]byte("unknown firmware"))
+	eatOther      = sha256.Sum256([]byte("other firmware"))
+)
+
+// eatOptions configure the token created by newEat
+type eatOptions struct {
+	nonce   []byte
+	key     *ecdsa.PrivateKey
+	chain   []*x509.Certificate
+	cwt     bool
+	claims  map[interface{}]interface{}
+	coswid  bool
+	digests [][]byte
+}
+
+// newEat creates a token of a partner attester, signed with go-cose like a
+// token of an external EAT library
+func newEat(t *testing.T, o eatOptions) []byte {
+	claims := map[interface{}]interface{}{
+		eatNonceClaim:   o.nonce,
+		eatUeidClaim:    []byte{0x01, 0xde, 0xad, 0xbe, 0xef},
+		eatProfileClaim: "tag:example.com,2026:partner-device",
+	}
+	if o.coswid {
+		var files []interface{}
+		for i, d := range o.digests {
+			files = append(files, map[int]interface{}{
+				7:  []interface{}{1, d},
+				24: []string{"bootloader.bin", "firmware.bin", "other.bin"}[i],
+			})
+		}
+		tag, err := cbor.Marshal(map[int]interface{}{
+			0: "partner-firmware-tag",
+			1: "Partner Firmware",
+			3: map[int]interface{}{17: files},
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal CoSWID: %v", err)
+		}
+		claims[eatMeasurementsClaim] = []interface{}{
+			[]interface{}{contentFormatCoswid, tag},
+			[]interface{}{60, []byte{0xa0}},
+		}
+	} else {
+		var swcs []SwComponent
+		for i, d := range o.digests {
+			swcs = append(swcs, SwComponent{
+				MeasurementType:        []string{"BL", "PRoT", "ARoT"}[i],
+				MeasurementValue:       d,
+				MeasurementDescription: "sha-256",
+			})
+		}
+		claims[psaSwComponentsClaim] = swcs
+	}
+	for k, v := range o.claims {
+		claims[k] = v
+	}
+	payload, err := cbor.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+
+	signer, err := cose.NewSigner(cose.AlgorithmES256, o.key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	msg := cose.NewSign1Message()
+	msg.Headers.Protected.SetAlgorithm(cose.AlgorithmES256)
+	if len(o.chain) > 0 {
+		var ders []interface{}
+		for _, c := range o.chain {
+			ders = append(ders, c.Raw)
+		}
+		msg.Headers.Unprotected[cose.HeaderLabelX5Chain] = ders
+	}
+	msg.Payload = payload
+	if err := msg.Sign(rand.Reader, nil, signer); err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	data, err := msg.MarshalCBOR()
+	if err != nil {
+		t.Fatalf("failed to marshal token: %v", err)
+	}
+	if o.cwt {
+		data, err = cbor.Marshal(cbor.RawTag{Number: cwtTag, Content: data})
+		if err != nil {
+			t.Fatalf("failed to marshal CWT: %v", err)
+		}
+	}
+	return data
+}
+
+func newEatCert(t *testing.T, key *ecdsa.PrivateKey, issuer *fixtures.Key,
+) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(4711),
+		Subject:      pkix.Name{CommonName: "Partner Attester"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := tmpl, interface{}(key)
+	if issuer != nil {
+		parent, signer = issuer.Chain[0], issuer.Priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
+
+func newEatMetadata(t *testing.T, s ar.Serializer) *fixtures.Fixtures {
+	f, err := fixtures.Generate(fixtures.Options{Serializer: s, Apps: 1})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	f.RtmManifest.ReferenceValues = []ar.ReferenceValue{
+		{Type: "EAT Reference Value", Name: "Partner Bootloader", Sha256: eatBootloader[:]},
+	}
+	f.OsManifest.ReferenceValues = []ar.ReferenceValue{
+		{Type: "EAT Reference Value", Name: "Partner Firmware", Sha256: eatFirmware[:]},
+	}
+	f.AppManifests[0].ReferenceValues = []ar.ReferenceValue{
+		{Type: "EAT Reference Value", Name: "Partner Extension", Sha256: eatUnknown[:],
+			Optional: true},
+	}
+	if err := f.SignMetadata(); err != nil {
+		t.Fatalf("failed to sign metadata: %v", err)
+	}
+	return f
+}
+
+func TestVerifyEat(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	nonce := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	digests := [][]byte{eatBootloader[:], eatFirmware[:]}
+	policy := []byte(`
+		var obj = JSON.parse(json);
+		obj.measurements[0].eatResult.claims["-70000"] == "partner-claim"
+	`)
+
+	for _, s := range []ar.Serializer{ar.JsonSerializer{}, ar.CborSerializer{}} {
+		f := newEatMetadata(t, s)
+		leaf := newEatCert(t, key, f.DeviceCa)
+		anchor := newEatCert(t, key, nil)
+		cas := append(f.CaPem(), internal.WriteCertPem(anchor)...)
+
+		tests := []struct {
+			name     string
+			opts     eatOptions
+			metadata bool
+			policies []byte
+			want     bool
+			wantCode ar.ErrorCode
+		}{
+			{"PSA Components", eatOptions{nonce: nonce, key: key, digests: digests,
+				chain: []*x509.Certificate{leaf, f.DeviceCa.Chain[0]}}, true, nil, true, ar.NotSet},
+			{"CoSWID CWT Trust Anchor Key", eatOptions{nonce: nonce, key: key, cwt: true,
+				coswid: true, digests: digests}, true, nil, true, ar.NotSet},
+			{"PSA Challenge", eatOptions{nonce: PsaChallenge(nonce), key: key, digests: digests},
+				true, nil, true, ar.NotSet},
+			{"Unknown Claims Policy", eatOptions{nonce: nonce, key: key, digests: digests,
+				claims: map[interface{}]interface{}{-70000: "partner-claim",
+					"partner": map[int][]byte{1: {0xff}}}}, true, policy, true, ar.NotSet},
+			{"Policy Without Claim", eatOptions{nonce: nonce, key: key, digests: digests}, true,
+				policy, false, ar.VerifyPolicies},
+			{"Nonce Mismatch", eatOptions{nonce: []byte{0xff}, key: key, digests: digests}, true,
+				nil, false, ar.NotSet},
+			{"Missing Measurement", eatOptions{nonce: nonce, key: key, digests: digests[:1]},
+				true, nil, false, ar.NotSet},
+			{"Unknown Measurement", eatOptions{nonce: nonce, key: key,
+				digests: append(digests, eatOther[:])}, true, nil, false, ar.NotSet},
+			{"Untrusted Key", eatOptions{nonce: nonce, key: other, digests: digests}, true, nil,
+				false, ar.VerifySignature},
+			{"Untrusted Chain", eatOptions{nonce: nonce, key: other, digests: digests,
+				chain: []*x509.Certificate{newEatCert(t, other, nil)}}, true, nil, false,
+				ar.VerifySignature},
+			{"No Metadata", eatOptions{nonce: nonce, key: key, digests: digests}, false, nil,
+				false, ar.NotSet},
+		}
+		for _, tt := range tests {
+			t.Run(f.Name()+" "+tt.name, func(t *testing.T) {
+				metadata := f.Metadata
+				if !tt.metadata {
+					metadata = nil
+				}
+				if err := SetEatMetadata(metadata); err != nil {
+					t.Fatalf("SetEatMetadata() error = %v", err)
+				}
+				defer SetEatMetadata(nil)
+
+				token := newEat(t, tt.opts)
+				r := Verify(token, nonce, cas, tt.policies, PolicyEngineSelect_JS, "")
+				if r.Success != tt.want {
+					t.Fatalf("Verify() success = %v, want %v: %+v", r.Success, tt.want, r)
+				}
+				if tt.wantCode != ar.NotSet && r.ErrorCode != tt.wantCode {
+					t.Errorf("Verify() error code = %v, want %v", r.ErrorCode, tt.wantCode)
+				}
+				if !tt.want {
+					return
+				}
+				if r.Prover != fixtures.DeviceDescriptionName {
+					t.Errorf("prover = %v, want %v", r.Prover, fixtures.DeviceDescriptionName)
+				}
+				m := r.Measurements[0]
+				if m.Type != "EAT Result" || m.EatResult.Ueid != "01deadbeef" ||
+					m.EatResult.Profile != "tag:example.com,2026:partner-device" {
+					t.Errorf("measurement = %+v, want EAT result", m)
+				}
+				if len(m.Artifacts) != 2 {
+					t.Errorf("artifacts = %+v, want bootloader and firmware", m.Artifacts)
+				}
+				if !r.ReportSignature[0].CertChainCheck.Success ||
+					r.ReportSignature[0].Algorithm != "ES256" {
+					t.Errorf("signature = %+v, want ES256 with validated chain",
+						r.ReportSignature[0])
+				}
+			})
+		}
+	}
+}
+
+func Test_parseEatClaims(t *testing.T) {
+	payload, _ := cbor.Marshal(map[interface{}]interface{}{
+		eatNonceClaim: [][]byte{{0x01}, {0x02}},
+		eatMeasurementsClaim: []interface{}{
+			[]interface{}{60, []byte{0xa0}},
+		},
+		266:   map[string]interface{}{"tee": map[int]interface{}{eatUeidClaim: []byte{0xab}}},
+		"iss": "partner",
+	})
+	claims, err := parseEatClaims(payload)
+	if err != nil {
+		t.Fatalf("parseEatClaims() error = %v", err)
+	}
+	if len(claims.nonces) != 2 {
+		t.Errorf("nonces = %v, want 2", claims.nonces)
+	}
+	if claims.other["iss"] != "partner" {
+		t.Errorf("claim iss = %v, want partner", claims.other["iss"])
+	}
+	submods, ok := claims.other["266"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("submods = %v, want map", claims.other["266"])
+	}
+	if tee := submods["tee"].(map[string]interface{}); tee["256"] != "ab" {
+		t.Errorf("submodule ueid = %v, want ab", tee["256"])
+	}
+	if m, ok := claims.other["273"].([]interface{}); !ok || len(m) != 1 {
+		t.Errorf("unmapped measurements = %v, want one", claims.other["273"])
+	}
+
+	noNonce, _ := cbor.Marshal(map[int]interface{}{eatUeidClaim: []byte{0x01}})
+	if _, err := parseEatClaims(noNonce); err == nil {
+		t.Errorf("parseEatClaims() accepted token without nonce")
+	}
+}
+
+func Test_isEat(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{}})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if isEat(f.Report) {
+		t.Errorf("isEat() detected CMC report as EAT")
+	}
+	if !isEat(newEat(t, eatOptions{nonce: []byte{1}, key: key})) {
+		t.Errorf("isEat() did not detect COSE_Sign1 token")
+	}
+	if !isEat(newEat(t, eatOptions{nonce: []byte{1}, key: key, cwt: true})) {
+		t.Errorf("isEat() did not detect CWT")
+	}
+}
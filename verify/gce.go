@@ -0,0 +1,239 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Extension of the GCE vTPM AK certificate containing the instance identity
+var oidGceInstanceInfo = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 21}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+type gceSecurityProperties struct {
+	SecurityVersion *big.Int `asn1:"explicit,tag:0,optional"`
+	IsProduction    bool     `asn1:"explicit,tag:1,optional"`
+}
+
+// gceInstanceInfo is the ASN.1 structure of the GCE instance info extension
+type gceInstanceInfo struct {
+	Zone               string `asn1:"utf8"`
+	ProjectNumber      *big.Int
+	ProjectId          string `asn1:"utf8"`
+	InstanceId         *big.Int
+	InstanceName       string                `asn1:"utf8"`
+	SecurityProperties gceSecurityProperties `asn1:"explicit,optional"`
+}
+
+// parseGceInstanceInfo parses the instance identity Google embeds into the
+// vTPM AK certificate of a GCE VM
+func parseGceInstanceInfo(cert *x509.Certificate) (*ar.GceResult, error) {
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidGceInstanceInfo) {
+			continue
+		}
+		var info gceInstanceInfo
+		rest, err := asn1.Unmarshal(ext.Value, &info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal GCE instance info: %w", err)
+		}
+		if len(rest) != 0 {
+			return nil, errors.New("trailing data after GCE instance info")
+		}
+		if info.ProjectNumber == nil || info.InstanceId == nil {
+			return nil, errors.New("GCE instance info does not contain project number or instance ID")
+		}
+		result := &ar.GceResult{
+			Zone:          info.Zone,
+			ProjectNumber: info.ProjectNumber.String(),
+			ProjectId:     info.ProjectId,
+			InstanceId:    info.InstanceId.String(),
+			InstanceName:  info.InstanceName,
+			IsProduction:  info.SecurityProperties.IsProduction,
+		}
+		if v := info.SecurityProperties.SecurityVersion; v != nil {
+			if !v.IsInt64() {
+				return nil, fmt.Errorf("invalid GCE security version %v", v)
+			}
+			result.SecurityVersion = v.Int64()
+		}
+		result.InstanceInfoCheck.Success = true
+		return result, nil
+	}
+
+	return nil, errors.New("AK certificate does not contain GCE instance info")
+}
+
+// removeUnhandledExtension marks the critical extension with the given OID as
+// handled by the caller
+func removeUnhandledExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) {
+	unhandled := make([]asn1.ObjectIdentifier, 0, len(cert.UnhandledCriticalExtensions))
+	for _, ext := range cert.UnhandledCriticalExtensions {
+		if !ext.Equal(oid) {
+			unhandled = append(unhandled, ext)
+		}
+	}
+	cert.UnhandledCriticalExtensions = unhandled
+}
+
+// verifyGceMeasurements verifies the measurements of a GCE Shielded or
+// Confidential VM. The vTPM AK certificate chain must chain up to one of the
+// Google root CAs from the GCE reference values, the instance identity is
+// extracted from the AK certificate. The vTPM quote must be signed by the
+// certified AK and contain the nonce. The quoted PCRs are verified against
+// the TPM reference values
+func verifyGceMeasurements(gceM ar.Measurement, nonce []byte,
+	gceReferenceValues, tpmReferenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying GCE measurements")
+
+	result := &ar.MeasurementResult{
+		Type:      "GCE Result",
+		GceResult: &ar.GceResult{},
+	}
+	ok := true
+
+	if len(gceReferenceValues) == 0 {
+		log.Tracef("Could not find GCE Reference Value")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	fingerprints := make([][]byte, 0)
+	for _, ref := range gceReferenceValues {
+		if ref.Type != "GCE Reference Value" {
+			log.Tracef("GCE Reference Value invalid type %v", ref.Type)
+			result.Summary.SetErr(ar.RefValType)
+			return result, false
+		}
+		if ref.Gce == nil {
+			continue
+		}
+		for _, f := range ref.Gce.CaFingerprints {
+			fingerprint, err := hex.DecodeString(f)
+			if err != nil {
+				log.Tracef("Could not parse GCE CA fingerprint %v: %v", f, err)
+				result.Signature.CertChainCheck.SetErr(ar.ParseCAFingerprint)
+				return result, false
+			}
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	if len(fingerprints) == 0 {
+		log.Tracef("No CA fingerprint set in GCE Reference Values")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	// The certificates are ordered to start with the AK certificate and end
+	// with the root CA
+	certs, err := internal.ParseCertsDer(gceM.Certs)
+	if err != nil {
+		log.Tracef("Failed to parse GCE AK certificates: %v", err)
+		result.Signature.CertChainCheck.SetErr(ar.ParseCert)
+		return result, false
+	}
+	certs, err = internal.OrderChain(certs)
+	if err != nil {
+		log.Tracef("Invalid GCE AK certificate chain: %v", err)
+		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+		return result, false
+	}
+	if len(certs) < 2 {
+		log.Tracef("GCE AK certificate chain does not contain root CA")
+		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+		return result, false
+	}
+	ca := certs[len(certs)-1]
+
+	caFingerprint := sha256.Sum256(ca.Raw)
+	found := false
+	for _, f := range fingerprints {
+		if bytes.Equal(f, caFingerprint[:]) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Tracef("Root CA fingerprint %v does not match any GCE CA fingerprint",
+			hex.EncodeToString(caFingerprint[:]))
+		result.Signature.CertChainCheck.Success = false
+		result.Signature.CertChainCheck.Got = hex.EncodeToString(caFingerprint[:])
+		result.Signature.CertChainCheck.ErrorCode = ar.CaFingerprint
+		return result, false
+	}
+
+	// The AK certificate has an empty subject and a critical subject alternative
+	// name with the TPM directory name, which the x509 package does not handle
+	removeUnhandledExtension(certs[0], oidSubjectAltName)
+
+	x509Chains, err := internal.VerifyCertChain(certs[:len(certs)-1], []*x509.Certificate{ca})
+	if err != nil {
+		log.Tracef("Failed to verify GCE AK certificate chain: %v", err)
+		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+		return result, false
+	}
+	result.Signature.CertChainCheck.Success = true
+
+	result.Signature.AddValidatedChains(x509Chains)
+
+	info, err := parseGceInstanceInfo(certs[0])
+	if err != nil {
+		log.Tracef("Failed to parse GCE instance info: %v", err)
+		result.GceResult.InstanceInfoCheck.SetErr(ar.GceInstanceInfo)
+		ok = false
+	} else {
+		result.GceResult = info
+	}
+
+	// Verify the vTPM quote, which binds the nonce and is signed with the AK
+	tpmM := ar.Measurement{
+		Type:      "TPM Measurement",
+		Evidence:  gceM.Evidence,
+		Signature: gceM.Signature,
+		Artifacts: gceM.Artifacts,
+	}
+	tpmResult, tpmOk := verifyTpmQuote(tpmM, nonce, certs[0].PublicKey, tpmReferenceValues)
+
+	result.Freshness = tpmResult.Freshness
+	result.Signature.SignCheck = tpmResult.Signature.SignCheck
+	result.Artifacts = tpmResult.Artifacts
+	result.TpmResult = tpmResult.TpmResult
+
+	ok = ok && tpmOk
+	if tpmResult.Summary.ErrorCode != ar.NotSet {
+		result.Summary.SetErr(tpmResult.Summary.ErrorCode)
+	} else if !result.GceResult.InstanceInfoCheck.Success {
+		result.Summary.SetErr(ar.GceInstanceInfo)
+	} else {
+		result.Summary.Success = ok
+	}
+
+	return result, ok
+}
@@ -0,0 +1,416 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+// gceFixture contains a GCE vTPM measurement created with a test Google
+// certificate chain and a test vTPM AK, as the generation requires a GCE VM
+type gceFixture struct {
+	measurement ar.Measurement
+	nonce       []byte
+	gceRefVals  []ar.ReferenceValue
+	tpmRefVals  []ar.ReferenceValue
+
+	akKey *rsa.PrivateKey
+	root  *x509.Certificate
+	ca    *x509.Certificate
+	caKey *rsa.PrivateKey
+}
+
+// Instance ID exceeding the int64 range to verify it is not truncated
+var gceTestInstanceId, _ = new(big.Int).SetString("18446744073709551557", 10)
+
+func createGceInstanceInfoExt(t *testing.T, info gceInstanceInfo) pkix.Extension {
+	val, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to marshal GCE instance info: %v", err)
+	}
+	return pkix.Extension{Id: oidGceInstanceInfo, Value: val}
+}
+
+func createGceAkCert(t *testing.T, f *gceFixture, ext []pkix.Extension) *x509.Certificate {
+	tmpl := fixtures.LeafTemplate(3, "test-instance", time.Now().Add(-time.Hour),
+		time.Now().Add(time.Hour))
+	tmpl.ExtraExtensions = ext
+	return createTestCert(t, tmpl, f.ca, &f.akKey.PublicKey, f.caKey)
+}
+
+func createGceFixture(t *testing.T) *gceFixture {
+
+	f := &gceFixture{
+		nonce: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+	}
+
+	rootKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.caKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	var err error
+	f.akKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate AK: %v", err)
+	}
+
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	rootTmpl := fixtures.CaTemplate(1, "EK/AK CA Root Test", notBefore, notAfter)
+	f.root = createTestCert(t, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	f.ca = createTestCert(t, fixtures.CaTemplate(2, "EK/AK CA Intermediate Test", notBefore,
+		notAfter), f.root, &f.caKey.PublicKey, rootKey)
+
+	ak := createGceAkCert(t, f, []pkix.Extension{createGceInstanceInfoExt(t, gceInstanceInfo{
+		Zone:          "europe-west3-a",
+		ProjectNumber: big.NewInt(123456789012),
+		ProjectId:     "test-project",
+		InstanceId:    gceTestInstanceId,
+		InstanceName:  "test-instance",
+		SecurityProperties: gceSecurityProperties{
+			SecurityVersion: big.NewInt(1),
+			IsProduction:    true,
+		},
+	})})
+
+	q := createVtpmQuote(t, f.akKey, f.nonce)
+
+	f.measurement = ar.Measurement{
+		Type:      "GCE Measurement",
+		Evidence:  q.Quote,
+		Signature: q.Signature,
+		Certs:     [][]byte{ak.Raw, f.ca.Raw, f.root.Raw},
+		Artifacts: q.Artifacts,
+	}
+
+	rootFingerprint := sha256.Sum256(f.root.Raw)
+	f.gceRefVals = []ar.ReferenceValue{{
+		Type: "GCE Reference Value",
+		Name: "Google EK/AK CA",
+		Gce: &ar.GceDetails{
+			CaFingerprints: []string{
+				"0000000000000000000000000000000000000000000000000000000000000000",
+				hex.EncodeToString(rootFingerprint[:]),
+			},
+		},
+	}}
+	f.tpmRefVals = q.ReferenceValues
+
+	return f
+}
+
+func Test_verifyGceMeasurements(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, f *gceFixture)
+		want   bool
+		check  func(t *testing.T, r *ar.MeasurementResult)
+	}{
+		{
+			name:   "Valid",
+			modify: func(t *testing.T, f *gceFixture) {},
+			want:   true,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				want := ar.GceResult{
+					InstanceInfoCheck: ar.Result{Success: true},
+					Zone:              "europe-west3-a",
+					ProjectNumber:     "123456789012",
+					ProjectId:         "test-project",
+					InstanceId:        gceTestInstanceId.String(),
+					InstanceName:      "test-instance",
+					SecurityVersion:   1,
+					IsProduction:      true,
+				}
+				if !reflect.DeepEqual(*r.GceResult, want) {
+					t.Errorf("GceResult = %+v, want %+v", *r.GceResult, want)
+				}
+				if len(r.Signature.ValidatedCerts) != 1 || len(r.Signature.ValidatedCerts[0]) != 3 {
+					t.Errorf("unexpected validated certs %v", r.Signature.ValidatedCerts)
+				}
+			},
+		},
+		{
+			name: "Invalid Nonce",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.nonce = []byte{0xff}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Freshness.Success {
+					t.Error("freshness check succeeded")
+				}
+			},
+		},
+		{
+			name: "CA Fingerprint Mismatch",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.gceRefVals[0].Gce.CaFingerprints = f.gceRefVals[0].Gce.CaFingerprints[:1]
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.CaFingerprint {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Missing Intermediate",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.measurement.Certs = [][]byte{f.measurement.Certs[0], f.root.Raw}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.VerifyCertChain {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Missing Instance Info",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.measurement.Certs[0] = createGceAkCert(t, f, nil).Raw
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.GceResult.InstanceInfoCheck.ErrorCode != ar.GceInstanceInfo {
+					t.Errorf("unexpected error code %v", r.GceResult.InstanceInfoCheck.ErrorCode)
+				}
+				if !r.Signature.SignCheck.Success {
+					t.Error("quote signature check failed")
+				}
+			},
+		},
+		{
+			name: "Invalid Instance Info",
+			modify: func(t *testing.T, f *gceFixture) {
+				ext := pkix.Extension{Id: oidGceInstanceInfo, Value: []byte{0x30, 0x01, 0x00}}
+				f.measurement.Certs[0] = createGceAkCert(t, f, []pkix.Extension{ext}).Raw
+			},
+			want: false,
+		},
+		{
+			name: "Quote Signed With Other Key",
+			modify: func(t *testing.T, f *gceFixture) {
+				other, _ := rsa.GenerateKey(rand.Reader, 2048)
+				q := createVtpmQuote(t, other, f.nonce)
+				f.measurement.Evidence, f.measurement.Signature = q.Quote, q.Signature
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.SignCheck.Success {
+					t.Error("quote signature check succeeded")
+				}
+			},
+		},
+		{
+			name: "Invalid PCR",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.tpmRefVals[1].Sha256 = make([]byte, 32)
+			},
+			want: false,
+		},
+		{
+			name: "Invalid CA Fingerprint",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.gceRefVals[0].Gce.CaFingerprints = []string{"xyz"}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.ParseCAFingerprint {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Missing GCE Reference Value",
+			modify: func(t *testing.T, f *gceFixture) {
+				f.gceRefVals = nil
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Summary.ErrorCode != ar.RefValNotPresent {
+					t.Errorf("unexpected error code %v", r.Summary.ErrorCode)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createGceFixture(t)
+			tt.modify(t, f)
+
+			r, got := verifyGceMeasurements(f.measurement, f.nonce, f.gceRefVals, f.tpmRefVals)
+			if got != tt.want {
+				t.Errorf("verifyGceMeasurements() = %v, want %v (summary %+v)", got, tt.want, r.Summary)
+			}
+			if r.Summary.Success != tt.want {
+				t.Errorf("summary success = %v, want %v", r.Summary.Success, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
+
+// gceRecordedRootFingerprint is the SHA-256 fingerprint of the Google
+// tpm_ek_root_1 CA the recorded AK certificate chains up to
+const gceRecordedRootFingerprint = "9bd5285f8fb18502a7947e621ffd470266f49fcd3b73e19a190f690ad32a7caf"
+
+// loadGceRecording loads an attestation recorded on a GCE COS 85 VM with the
+// nonce 0x9009 (taken from the go-tpm-tools test attestations) together with
+// the Google EK/AK intermediate and root CA. The recorded PCR values are used
+// as the TPM reference values
+func loadGceRecording(t *testing.T) *gceFixture {
+	t.Helper()
+
+	load := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join("testdata", "gce", name))
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", name, err)
+		}
+		return data
+	}
+
+	var pcrs map[string]string
+	if err := json.Unmarshal(load("pcrs.json"), &pcrs); err != nil {
+		t.Fatalf("failed to unmarshal recorded PCRs: %v", err)
+	}
+
+	f := &gceFixture{
+		nonce: []byte{0x90, 0x09},
+		gceRefVals: []ar.ReferenceValue{{
+			Type: "GCE Reference Value",
+			Name: "Google EK/AK CA",
+			Gce:  &ar.GceDetails{CaFingerprints: []string{gceRecordedRootFingerprint}},
+		}},
+	}
+	for i := 0; i < len(pcrs); i++ {
+		val, err := hex.DecodeString(pcrs[strconv.Itoa(i)])
+		if err != nil || len(val) != sha256.Size {
+			t.Fatalf("invalid recorded PCR%v", i)
+		}
+		pcr := i
+		f.measurement.Artifacts = append(f.measurement.Artifacts,
+			ar.Artifact{Type: "PCR Summary", Pcr: &pcr, Summary: val})
+		f.tpmRefVals = append(f.tpmRefVals, ar.ReferenceValue{
+			Type: "TPM Reference Value", Name: "TPM_PCR_INIT_VALUE", Pcr: &pcr, Sha256: val,
+		})
+	}
+	f.measurement.Type = "GCE Measurement"
+	f.measurement.Evidence = load("quote.bin")
+	f.measurement.Signature = load("signature.bin")
+	f.measurement.Certs = [][]byte{load("ak.der"), load("intermediate.der"), load("root.der")}
+
+	return f
+}
+
+func Test_verifyGceMeasurementsRecorded(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(f *gceFixture)
+		want   bool
+		check  func(t *testing.T, r *ar.MeasurementResult)
+	}{
+		{
+			name:   "Valid",
+			modify: func(f *gceFixture) {},
+			want:   true,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.GceResult.Zone != "us-central1-a" || r.GceResult.ProjectId != "google.com:wuale-gcp-testing" ||
+					r.GceResult.InstanceName != "cos-test" {
+					t.Errorf("unexpected GCE result %+v", *r.GceResult)
+				}
+				if len(r.Signature.ValidatedCerts) != 1 || len(r.Signature.ValidatedCerts[0]) != 3 {
+					t.Errorf("unexpected validated certs %v", r.Signature.ValidatedCerts)
+				}
+			},
+		},
+		{
+			name: "Invalid Nonce",
+			modify: func(f *gceFixture) {
+				f.nonce = []byte{0x90, 0x0a}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Freshness.Success {
+					t.Error("freshness check succeeded")
+				}
+			},
+		},
+		{
+			name: "Invalid PCR",
+			modify: func(f *gceFixture) {
+				f.tpmRefVals[0].Sha256 = make([]byte, sha256.Size)
+			},
+			want: false,
+		},
+		{
+			name: "Modified Quote",
+			modify: func(f *gceFixture) {
+				f.measurement.Evidence[len(f.measurement.Evidence)-1] ^= 0xff
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.SignCheck.Success {
+					t.Error("quote signature check succeeded")
+				}
+			},
+		},
+		{
+			name: "Other Root CA",
+			modify: func(f *gceFixture) {
+				f.gceRefVals[0].Gce.CaFingerprints = []string{nitroRootFingerprint}
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.CaFingerprint {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := loadGceRecording(t)
+			tt.modify(f)
+
+			r, got := verifyGceMeasurements(f.measurement, f.nonce, f.gceRefVals, f.tpmRefVals)
+			if got != tt.want {
+				t.Errorf("verifyGceMeasurements() = %v, want %v (summary %+v)", got, tt.want, r.Summary)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
@@ -17,9 +17,12 @@ package verify
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
@@ -34,22 +37,76 @@ type SwComponent struct {
 	MeasurementDescription string `cbor:"6,keyasint"`
 }
 
+// Iat is the PSA initial attestation token. Both the legacy PSA IoT profile 1
+// claims and the claims of the EAT based PSA attestation token profile are
+// supported. Unknown claims are ignored
 type Iat struct {
-	ProfileDefinition string        `cbor:"-75000,keyasint"`
-	ClientId          int           `cbor:"-75001,keyasint"`
-	LifeCycle         uint16        `cbor:"-75002,keyasint"`
-	ImplementationId  [32]byte      `cbor:"-75003,keyasint"`
-	BootSeed          [32]byte      `cbor:"-75004,keyasint"`
-	HwVersion         string        `cbor:"-75005,keyasint"`
-	SwComponents      []SwComponent `cbor:"-75006,keyasint"`
-	NoSwMeasurements  int           `cbor:"-75007,keyasint"`
-	AuthChallenge     []byte        `cbor:"-75008,keyasint"`
-	InstanceId        [33]byte      `cbor:"-75009,keyasint"`
+	// PSA IoT profile 1 claims
+	ProfileDefinition string        `cbor:"-75000,keyasint,omitempty"`
+	ClientId          int           `cbor:"-75001,keyasint,omitempty"`
+	LifeCycle         uint16        `cbor:"-75002,keyasint,omitempty"`
+	ImplementationId  []byte        `cbor:"-75003,keyasint,omitempty"`
+	BootSeed          []byte        `cbor:"-75004,keyasint,omitempty"`
+	HwVersion         string        `cbor:"-75005,keyasint,omitempty"`
+	SwComponents      []SwComponent `cbor:"-75006,keyasint,omitempty"`
+	NoSwMeasurements  int           `cbor:"-75007,keyasint,omitempty"`
+	AuthChallenge     []byte        `cbor:"-75008,keyasint,omitempty"`
+	InstanceId        []byte        `cbor:"-75009,keyasint,omitempty"`
 	Vsi               string        `cbor:"-75010,keyasint,omitempty"`
+
+	// PSA attestation token profile claims
+	Profile             string        `cbor:"265,keyasint,omitempty"`
+	Nonce               []byte        `cbor:"10,keyasint,omitempty"`
+	Ueid                []byte        `cbor:"256,keyasint,omitempty"`
+	PsaBootSeed         []byte        `cbor:"268,keyasint,omitempty"`
+	PsaClientId         int           `cbor:"2394,keyasint,omitempty"`
+	PsaLifeCycle        uint16        `cbor:"2395,keyasint,omitempty"`
+	PsaImplementationId []byte        `cbor:"2396,keyasint,omitempty"`
+	PsaCertificationRef string        `cbor:"2398,keyasint,omitempty"`
+	PsaSwComponents     []SwComponent `cbor:"2399,keyasint,omitempty"`
+	PsaVsi              string        `cbor:"2400,keyasint,omitempty"`
+
+	// Optional CWT validity claims as seconds since the epoch
+	Expiration int64 `cbor:"4,keyasint,omitempty"`
+	NotBefore  int64 `cbor:"5,keyasint,omitempty"`
+	IssuedAt   int64 `cbor:"6,keyasint,omitempty"`
+}
+
+func (iat *Iat) getNonce() []byte {
+	if len(iat.Nonce) > 0 {
+		return iat.Nonce
+	}
+	return iat.AuthChallenge
+}
+
+func (iat *Iat) getImplementationId() []byte {
+	if len(iat.PsaImplementationId) > 0 {
+		return iat.PsaImplementationId
+	}
+	return iat.ImplementationId
+}
+
+func (iat *Iat) getSwComponents() []SwComponent {
+	if len(iat.PsaSwComponents) > 0 {
+		return iat.PsaSwComponents
+	}
+	return iat.SwComponents
+}
+
+// PsaChallenge returns the PSA attestation challenge for a nonce. PSA only
+// allows challenges of 32, 48 or 64 bytes, other nonces are hashed
+func PsaChallenge(nonce []byte) []byte {
+	switch len(nonce) {
+	case 32, 48, 64:
+		return nonce
+	default:
+		h := sha256.Sum256(nonce)
+		return h[:]
+	}
 }
 
 func verifyIasMeasurements(iasM ar.Measurement, nonce []byte, cas []*x509.Certificate,
-	referenceValues []ar.ReferenceValue,
+	referenceValues []ar.ReferenceValue, at time.Time,
 ) (*ar.MeasurementResult, bool) {
 
 	result := &ar.MeasurementResult{
@@ -57,35 +114,103 @@ func verifyIasMeasurements(iasM ar.Measurement, nonce []byte, cas []*x509.Certif
 	}
 	ok := true
 
-	log.Tracef("Parsing %v certificates", len(iasM.Certs))
-	certs, err := internal.ParseCertsDer(iasM.Certs)
-	if err != nil {
-		log.Tracef("failed to parse IAS certificates: %v", err)
-		result.Summary.SetErr(ar.ParseEvidence)
-		return result, false
-	}
-
 	if len(referenceValues) == 0 {
 		log.Tracef("Could not find IAS Reference Value")
 		result.Summary.SetErr(ar.RefValNotPresent)
 		return result, false
 	}
-	s := ar.CborSerializer{}
+
+	// Separate the platform reference values from the software component
+	// reference values
+	swReferenceValues := make([]ar.ReferenceValue, 0, len(referenceValues))
+	endorsementKeys := make([]crypto.PublicKey, 0)
+	var implementationIds [][]byte
+	for _, ref := range referenceValues {
+		if ref.Type != "IAS Reference Value" {
+			log.Tracef("IAS Reference Value invalid type %v", ref.Type)
+			result.Summary.SetErr(ar.RefValType)
+			return result, false
+		}
+		if ref.Psa == nil {
+			swReferenceValues = append(swReferenceValues, ref)
+			continue
+		}
+		for _, k := range ref.Psa.EndorsementKeys {
+			key, err := x509.ParsePKIXPublicKey(k)
+			if err != nil {
+				log.Tracef("Failed to parse PSA endorsement key of %v: %v", ref.Name, err)
+				result.Summary.SetErr(ar.ExtractPubKey)
+				return result, false
+			}
+			endorsementKeys = append(endorsementKeys, key)
+		}
+		if len(ref.Psa.ImplementationId) > 0 {
+			implementationIds = append(implementationIds, ref.Psa.ImplementationId)
+		}
+		if len(ref.Sha256) > 0 {
+			swReferenceValues = append(swReferenceValues, ref)
+		}
+	}
+
+	// If endorsement keys are provisioned, the token must be signed by one of the
+	// keys. Otherwise, the key is taken from the verified certificate chain
+	endorsed := len(endorsementKeys) > 0
+	if !endorsed {
+		log.Tracef("Parsing %v certificates", len(iasM.Certs))
+		certs, err := internal.ParseCertsDer(iasM.Certs)
+		if err != nil || len(certs) == 0 {
+			log.Tracef("failed to parse IAS certificates: %v", err)
+			result.Summary.SetErr(ar.ParseEvidence)
+			return result, false
+		}
+
+		log.Trace("Verifying certificate chain")
+
+		x509Chains, err := internal.VerifyCertChainAt(certs, cas, at)
+		if err != nil {
+			log.Tracef("Failed to verify certificate chain: %v", err)
+			result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+			ok = false
+		} else {
+			result.Signature.CertChainCheck.Success = true
+		}
+
+		//Store details from (all) validated certificate chain(s) in the report
+		result.Signature.AddValidatedChains(x509Chains)
+
+		endorsementKeys = append(endorsementKeys, certs[0].PublicKey)
+	} else {
+		log.Tracef("Using %v provisioned PSA endorsement keys", len(endorsementKeys))
+	}
 
 	log.Trace("Verifying CBOR IAT")
 
-	iatresult, payload, ok := verifyIat(iasM.Evidence, certs[0])
-	if !ok {
+	iatresult, payload, sigOk := verifyIat(iasM.Evidence, endorsementKeys)
+	if !sigOk {
 		log.Tracef("IAS signature verification failed")
+		if endorsed {
+			result.Signature.CertChainCheck.SetErr(ar.VerifySignature)
+		}
 		result.Summary.SetErr(ar.VerifySignature)
 		return result, false
 	}
 	result.Signature.SignCheck = iatresult
 
+	// With provisioned endorsement keys, the trust is anchored in the key
+	// instead of a certificate chain, which is successfully checked once the
+	// token was verified with one of the keys
+	if endorsed {
+		result.Signature.CertChainCheck = ar.Result{
+			Success: true,
+			Got:     "provisioned PSA endorsement key",
+		}
+	}
+
 	log.Trace("Unmarshalling CBOR IAT")
 
+	s := ar.CborSerializer{}
 	iat := &Iat{}
-	err = s.Unmarshal(payload, iat)
+	err := s.Unmarshal(payload, iat)
 	if err != nil {
 		log.Tracef("Failed to unmarshal IAT: %v", err)
 		result.Summary.SetErr(ar.ParseEvidence)
@@ -95,51 +220,56 @@ func verifyIasMeasurements(iasM ar.Measurement, nonce []byte, cas []*x509.Certif
 	log.Trace("Verifying nonce")
 
 	// Verify nonce
-	if bytes.Equal(nonce, iat.AuthChallenge) {
+	challenge := PsaChallenge(nonce)
+	if bytes.Equal(challenge, iat.getNonce()) {
 		result.Freshness.Success = true
 	} else {
-		log.Tracef("Nonces mismatch: Supplied Nonce = %v, IAT Nonce = %v)", hex.EncodeToString(nonce), hex.EncodeToString(iat.AuthChallenge))
+		log.Tracef("Nonces mismatch: Supplied Nonce = %v, IAT Nonce = %v)",
+			hex.EncodeToString(challenge), hex.EncodeToString(iat.getNonce()))
 		result.Freshness.Success = false
-		result.Freshness.Expected = hex.EncodeToString(nonce)
-		result.Freshness.Got = hex.EncodeToString(iat.AuthChallenge)
+		result.Freshness.Expected = hex.EncodeToString(challenge)
+		result.Freshness.Got = hex.EncodeToString(iat.getNonce())
+		result.Freshness.SetErr(ar.NonceMismatch)
+		result.Summary.SetErr(ar.NonceMismatch)
 		ok = false
 	}
 
-	log.Trace("Verifying certificate chain")
-
-	// Verify certificate chain
-	x509Chains, err := internal.VerifyCertChain(certs, cas)
-	if err != nil {
-		log.Tracef("Failed to verify certificate chain: %v", err)
-		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+	// Verify the optional validity claims of the token
+	if r := checkIatValidity(iat, at); !r.Success {
+		result.Summary.SetErr(r.ErrorCode)
+		result.Summary.Got = r.Got
+		result.Summary.ExpectedBetween = r.ExpectedBetween
 		ok = false
-	} else {
-		result.Signature.CertChainCheck.Success = true
 	}
 
-	//Store details from (all) validated certificate chain(s) in the report
-	for _, chain := range x509Chains {
-		chainExtracted := []ar.X509CertExtracted{}
-		for _, cert := range chain {
-			chainExtracted = append(chainExtracted, ar.ExtractX509Infos(cert))
+	// Verify the implementation ID if specified
+	if len(implementationIds) > 0 {
+		found := false
+		expected := make([]string, 0, len(implementationIds))
+		for _, id := range implementationIds {
+			expected = append(expected, hex.EncodeToString(id))
+			if bytes.Equal(id, iat.getImplementationId()) {
+				found = true
+			}
+		}
+		if !found {
+			log.Tracef("IAT implementation ID %v does not match reference values",
+				hex.EncodeToString(iat.getImplementationId()))
+			result.Summary.Got = hex.EncodeToString(iat.getImplementationId())
+			result.Summary.ExpectedOneOf = expected
+			ok = false
 		}
-		result.Signature.ValidatedCerts = append(result.Signature.ValidatedCerts, chainExtracted)
 	}
 
-	result.Summary.Success = ok
-
 	log.Trace("Verifying measurements")
 
+	swComponents := iat.getSwComponents()
+
 	// Verify that every reference value has a corresponding measurement
-	for _, ver := range referenceValues {
+	for _, ver := range swReferenceValues {
 		log.Tracef("Found reference value %v: %v", ver.Name, hex.EncodeToString(ver.Sha256))
-		if ver.Type != "IAS Reference Value" {
-			log.Tracef("IAS Reference Value invalid type %v", ver.Type)
-			result.Summary.SetErr(ar.RefValType)
-			return result, false
-		}
 		found := false
-		for _, swc := range iat.SwComponents {
+		for _, swc := range swComponents {
 			if bytes.Equal(ver.Sha256, swc.MeasurementValue) {
 				result.Artifacts = append(result.Artifacts,
 					ar.DigestResult{
@@ -163,17 +293,12 @@ func verifyIasMeasurements(iasM ar.Measurement, nonce []byte, cas []*x509.Certif
 	}
 
 	// Verify that every measurement has a corresponding reference value
-	for _, swc := range iat.SwComponents {
+	for _, swc := range swComponents {
 		log.Tracef("Found measurement %v: %v", swc.MeasurementDescription,
 			hex.EncodeToString(swc.MeasurementValue))
 		found := false
-		for _, ver := range referenceValues {
+		for _, ver := range swReferenceValues {
 			if bytes.Equal(ver.Sha256, swc.MeasurementValue) {
-				result.Artifacts = append(result.Artifacts, ar.DigestResult{
-					Name:    ver.Name,
-					Digest:  hex.EncodeToString(swc.MeasurementValue),
-					Success: true,
-				})
 				found = true
 			}
 		}
@@ -188,10 +313,37 @@ func verifyIasMeasurements(iasM ar.Measurement, nonce []byte, cas []*x509.Certif
 		}
 	}
 
+	result.Summary.Success = ok
+
 	return result, ok
 }
 
-func verifyIat(data []byte, cert *x509.Certificate) (ar.Result, []byte, bool) {
+// checkIatValidity checks the optional expiration and not before claims of the
+// token against the verification time, which defaults to the current time
+func checkIatValidity(iat *Iat, at time.Time) ar.Result {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	notBefore := time.Unix(iat.NotBefore, 0).UTC()
+	expiration := time.Unix(iat.Expiration, 0).UTC()
+	between := []string{notBefore.Format(time.RFC3339), expiration.Format(time.RFC3339)}
+
+	if iat.Expiration != 0 && !at.Before(expiration) {
+		log.Tracef("IAT expired at %v", expiration)
+		return ar.Result{ErrorCode: ar.Expired, Got: at.UTC().Format(time.RFC3339),
+			ExpectedBetween: between}
+	}
+	if iat.NotBefore != 0 && at.Before(notBefore) {
+		log.Tracef("IAT not valid before %v", notBefore)
+		return ar.Result{ErrorCode: ar.NotYetValid, Got: at.UTC().Format(time.RFC3339),
+			ExpectedBetween: between}
+	}
+	return ar.Result{Success: true}
+}
+
+// verifyIat verifies the COSE_Sign1 signature of the IAT with one of the
+// provided keys, using the algorithm specified in the protected header
+func verifyIat(data []byte, keys []crypto.PublicKey) (ar.Result, []byte, bool) {
 
 	// create a Sign1Message from a raw COSE_Sign payload
 	var msgToVerify cose.Sign1Message
@@ -201,24 +353,34 @@ func verifyIat(data []byte, cert *x509.Certificate) (ar.Result, []byte, bool) {
 		return ar.Result{Success: false, ErrorCode: ar.ParseEvidence}, nil, false
 	}
 
-	publicKey, okKey := cert.PublicKey.(*ecdsa.PublicKey)
-	if !okKey {
-		log.Tracef("Failed to extract public key from certificate: %v", err)
-		return ar.Result{Success: false, ErrorCode: ar.ExtractPubKey}, nil, false
-	}
-
-	// create a verifier from a trusted private key
-	verifier, err := cose.NewVerifier(cose.AlgorithmES256, publicKey)
+	alg, err := msgToVerify.Headers.Protected.Algorithm()
 	if err != nil {
-		log.Tracef("Failed to create verifier: %v", err)
-		return ar.Result{Success: false, ErrorCode: ar.Internal}, nil, false
+		log.Tracef("Failed to get COSE algorithm: %v", err)
+		return ar.Result{Success: false, ErrorCode: ar.UnsupportedAlgorithm}, nil, false
 	}
 
-	err = msgToVerify.Verify(nil, verifier)
-	if err != nil {
-		log.Tracef("Failed to verify COSE token: %v", err)
-		return ar.Result{Success: false, ErrorCode: ar.VerifySignature}, nil, false
+	for _, key := range keys {
+		publicKey, okKey := key.(*ecdsa.PublicKey)
+		if !okKey {
+			log.Tracef("Unsupported IAT public key type %T", key)
+			continue
+		}
+
+		// create a verifier from a trusted public key
+		verifier, err := cose.NewVerifier(alg, publicKey)
+		if err != nil {
+			log.Tracef("Failed to create verifier: %v", err)
+			continue
+		}
+
+		err = msgToVerify.Verify(nil, verifier)
+		if err != nil {
+			log.Tracef("Failed to verify COSE token: %v", err)
+			continue
+		}
+
+		return ar.Result{Success: true}, msgToVerify.Payload, true
 	}
 
-	return ar.Result{Success: true}, msgToVerify.Payload, true
+	return ar.Result{Success: false, ErrorCode: ar.VerifySignature}, nil, false
 }
@@ -16,13 +16,20 @@
 package verify
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
 	"reflect"
 	"testing"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
+	"github.com/veraison/go-cose"
 )
 
 func Test_verifyIasMeasurements(t *testing.T) {
@@ -140,11 +147,11 @@ func Test_verifyIasMeasurements(t *testing.T) {
 			want: false,
 		},
 	}
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, got := verifyIasMeasurements(*tt.args.IasM, tt.args.nonce, []*x509.Certificate{tt.args.ca}, tt.args.referenceValues)
+			_, got := verifyIasMeasurements(*tt.args.IasM, tt.args.nonce, []*x509.Certificate{tt.args.ca}, tt.args.referenceValues, time.Time{})
 			if got != tt.want {
 				t.Errorf("verifyIasMeasurements() error = %v, wantErr %v", got, tt.want)
 				return
@@ -197,3 +204,220 @@ var (
 		Sha256: validNspeMeasurement,
 	}
 )
+
+// createPsaToken creates a COSE_Sign1 PSA token with the PSA attestation token
+// profile claims, as the generation requires a PSA device
+func createPsaToken(t *testing.T, key *ecdsa.PrivateKey, claims map[int]any) []byte {
+	payload, err := ar.CborSerializer{}.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal PSA token claims: %v", err)
+	}
+	signer, err := cose.NewSigner(cose.AlgorithmES256, key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	headers := cose.Headers{
+		Protected: cose.ProtectedHeader{
+			cose.HeaderLabelAlgorithm: cose.AlgorithmES256,
+		},
+	}
+	token, err := cose.Sign1(rand.Reader, signer, headers, payload, nil)
+	if err != nil {
+		t.Fatalf("failed to sign PSA token: %v", err)
+	}
+	return token
+}
+
+func Test_verifyIasMeasurementsPsaProfile(t *testing.T) {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	otherPub, _ := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+
+	nonce := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	implementationId := bytes.Repeat([]byte{0xaa}, 32)
+
+	claims := func() map[int]any {
+		return map[int]any{
+			265:  "tag:psacertified.org,2023:psa#tfm",
+			10:   PsaChallenge(nonce),
+			256:  append([]byte{0x01}, bytes.Repeat([]byte{0xbb}, 32)...),
+			2394: 1,
+			2395: 12288,
+			2396: implementationId,
+			2399: []map[int]any{
+				{1: "BL", 2: validSpeMeasurement, 5: bytes.Repeat([]byte{0xcc}, 32)},
+				{1: "NSPE", 2: validNspeMeasurement, 5: bytes.Repeat([]byte{0xcc}, 32)},
+			},
+			// Unknown claims must be ignored
+			-80000: "unknown",
+		}
+	}
+	platform := func(keys ...[]byte) ar.ReferenceValue {
+		hk := make([]ar.HexByte, 0, len(keys))
+		for _, k := range keys {
+			hk = append(hk, k)
+		}
+		return ar.ReferenceValue{
+			Type: "IAS Reference Value",
+			Name: "PSA Platform",
+			Psa: &ar.PsaDetails{
+				ImplementationId: implementationId,
+				EndorsementKeys:  hk,
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		claims  func(c map[int]any)
+		signer  *ecdsa.PrivateKey
+		refVals []ar.ReferenceValue
+		want    bool
+		wantErr ar.ErrorCode
+	}{
+		{
+			name:    "Valid",
+			refVals: []ar.ReferenceValue{platform(otherPub, pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    true,
+		},
+		{
+			name:    "Unknown Endorsement Key",
+			signer:  otherKey,
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+		},
+		{
+			name:    "Invalid Nonce",
+			claims:  func(c map[int]any) { c[10] = bytes.Repeat([]byte{0xff}, 32) },
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+			wantErr: ar.NonceMismatch,
+		},
+		{
+			name: "Valid Period",
+			claims: func(c map[int]any) {
+				c[5] = time.Now().Add(-time.Hour).Unix()
+				c[4] = time.Now().Add(time.Hour).Unix()
+			},
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    true,
+		},
+		{
+			name:    "Expired",
+			claims:  func(c map[int]any) { c[4] = time.Now().Add(-time.Hour).Unix() },
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+			wantErr: ar.Expired,
+		},
+		{
+			name:    "Not Yet Valid",
+			claims:  func(c map[int]any) { c[5] = time.Now().Add(time.Hour).Unix() },
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+			wantErr: ar.NotYetValid,
+		},
+		{
+			name:    "Invalid Implementation ID",
+			claims:  func(c map[int]any) { c[2396] = bytes.Repeat([]byte{0xee}, 32) },
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+		},
+		{
+			name:    "Missing Reference Value",
+			refVals: []ar.ReferenceValue{platform(pub), validSpeReferenceValue},
+			want:    false,
+		},
+		{
+			name:    "Invalid Reference Value",
+			refVals: []ar.ReferenceValue{platform(pub), invalidSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+		},
+		{
+			name:    "No Endorsement Key And No Certificate",
+			refVals: []ar.ReferenceValue{validSpeReferenceValue, validNspeReferenceValue},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims()
+			if tt.claims != nil {
+				tt.claims(c)
+			}
+			signer := key
+			if tt.signer != nil {
+				signer = tt.signer
+			}
+			m := ar.Measurement{
+				Type:     "IAS Measurement",
+				Evidence: createPsaToken(t, signer, c),
+			}
+			r, got := verifyIasMeasurements(m, nonce, nil, tt.refVals, time.Time{})
+			if got != tt.want {
+				t.Errorf("verifyIasMeasurements() = %v, want %v", got, tt.want)
+			}
+			if r.Summary.Success != got {
+				t.Errorf("verifyIasMeasurements() summary = %v, want %v", r.Summary.Success, got)
+			}
+			if tt.wantErr != ar.NotSet && r.Summary.ErrorCode != tt.wantErr {
+				t.Errorf("verifyIasMeasurements() error code = %v, want %v",
+					r.Summary.ErrorCode, tt.wantErr)
+			}
+			// The chain check reflects whether the token was signed by one of the
+			// provisioned endorsement keys, even if other checks fail
+			if wantChain := tt.signer == nil; tt.refVals[0].Psa != nil &&
+				r.Signature.CertChainCheck.Success != wantChain {
+				t.Errorf("verifyIasMeasurements() cert chain check = %v, want %v",
+					r.Signature.CertChainCheck.Success, wantChain)
+			}
+		})
+	}
+}
+
+func Test_decodeIatSwComponents(t *testing.T) {
+
+	components := []map[int]any{
+		{1: "BL", 2: []byte{0x01}, 4: "1.0.0", 5: []byte{0x11}, 6: "sha-256"},
+		{1: "PRoT", 2: []byte{0x02}, 4: "1.2.0", 5: []byte{0x22}},
+		{1: "ARoT", 2: []byte{0x03}, 5: []byte{0x33}},
+		{1: "NSPE", 2: []byte{0x04}, 5: []byte{0x44}},
+	}
+
+	tests := []struct {
+		name  string
+		label int
+	}{
+		{"PSA Attestation Token Profile", 2399},
+		{"PSA IoT Profile 1", -75006},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ar.CborSerializer{}.Marshal(map[int]any{tt.label: components})
+			if err != nil {
+				t.Fatalf("failed to marshal claims: %v", err)
+			}
+			var iat Iat
+			if err := (ar.CborSerializer{}).Unmarshal(data, &iat); err != nil {
+				t.Fatalf("failed to unmarshal IAT: %v", err)
+			}
+			got := iat.getSwComponents()
+			if len(got) != len(components) {
+				t.Fatalf("getSwComponents() returned %v components, want %v", len(got),
+					len(components))
+			}
+			for i, c := range components {
+				if got[i].MeasurementType != c[1] {
+					t.Errorf("component %v type = %v, want %v", i, got[i].MeasurementType, c[1])
+				}
+				if !bytes.Equal(got[i].MeasurementValue, c[2].([]byte)) {
+					t.Errorf("component %v value = %x, want %x", i, got[i].MeasurementValue, c[2])
+				}
+				if !bytes.Equal(got[i].SignerId, c[5].([]byte)) {
+					t.Errorf("component %v signer ID = %x, want %x", i, got[i].SignerId, c[5])
+				}
+			}
+		})
+	}
+}
@@ -25,7 +25,6 @@ import (
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math/big"
@@ -36,6 +35,7 @@ import (
 	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
@@ -363,7 +363,7 @@ func getTCBCompByIndex(tcb TCB, index int) TCBComp {
 // expects enclave Identity structure in JSON format
 func parseQEIdentity(qeIdentityJson []byte) (QEIdentity, error) {
 	var qe_identity QEIdentity
-	err := json.Unmarshal(qeIdentityJson, &qe_identity)
+	err := ar.DecodeJson(qeIdentityJson, &qe_identity)
 	if err != nil {
 		return QEIdentity{}, fmt.Errorf("failed to decode Enclave Identity %v", err)
 	}
@@ -373,7 +373,7 @@ func parseQEIdentity(qeIdentityJson []byte) (QEIdentity, error) {
 // expects tcb Info in JSON format
 func parseTcbInfo(tcbInfoJson []byte) (TcbInfo, error) {
 	var tcbInfo TcbInfo
-	err := json.Unmarshal(tcbInfoJson, &tcbInfo)
+	err := ar.DecodeJson(tcbInfoJson, &tcbInfo)
 	if err != nil {
 		return TcbInfo{}, fmt.Errorf("failed to decode TcbInfo %v", err)
 	}
@@ -638,13 +638,7 @@ func VerifyIntelQuoteSignature(reportRaw []byte, quoteSignature any,
 	result.CertChainCheck.Success = true
 
 	// Step 6: Store details from (all) validated certificate chain(s) in the report
-	for _, chain := range x509Chains {
-		chainExtracted := []ar.X509CertExtracted{}
-		for _, cert := range chain {
-			chainExtracted = append(chainExtracted, ar.ExtractX509Infos(cert))
-		}
-		result.ValidatedCerts = append(result.ValidatedCerts, chainExtracted)
-	}
+	result.AddValidatedChains(x509Chains)
 
 	return result, true
 }
@@ -719,11 +713,15 @@ func verifyTcbInfo(tcbInfo *TcbInfo, tcbInfoBodyRaw string, tcbKeyCert *x509.Cer
 			continue
 		}
 
-		// Stop here for SGX
+		// Stop here for SGX, fail if Status == REVOKED
 		if quoteType == SGX_QUOTE_TYPE {
-			result.Summary.Success = true
 			result.TcbLevelDate = tcbLevel.TcbDate
 			result.TcbLevelStatus = tcbLevel.TcbStatus
+			if tcbLevel.TcbStatus == string(Revoked) {
+				result.Summary.SetErr(ar.TcbLevelRevoked)
+				return result
+			}
+			result.Summary.Success = true
 			return result
 		}
 
@@ -946,7 +944,7 @@ func CrlCheck(crl *x509.RevocationList, cert *x509.Certificate, parentCert *x509
 
 	// Check if certificate has been revoked
 	for _, revokedCert := range crl.RevokedCertificates {
-		if cert.SerialNumber == revokedCert.SerialNumber {
+		if cert.SerialNumber.Cmp(revokedCert.SerialNumber) == 0 {
 			return false, fmt.Errorf("certificate has been revoked since: %v", revokedCert.RevocationTime)
 		}
 	}
@@ -954,8 +952,23 @@ func CrlCheck(crl *x509.RevocationList, cert *x509.Certificate, parentCert *x509
 	return true, nil
 }
 
-// fetch the CRL either from local cache or download it from PCS
+// crlCache keeps the Intel CRLs in memory for the update interval of the CRLs
+// in the cache folder
+var crlCache = cache.New("crl", cache.Limits{
+	MaxEntries: 64,
+	MaxBytes:   16 * 1024 * 1024,
+	Ttl:        24 * time.Hour,
+}, func(crl *x509.RevocationList) int64 { return int64(len(crl.Raw)) })
+
+// fetch the CRL either from memory, the local cache or download it from PCS
 func fetchCRL(uri string, name string, ca string, cache string) (*x509.RevocationList, error) {
+	return crlCache.GetOrFill(cache+"|"+uri, func() (*x509.RevocationList, error) {
+		return loadCRL(uri, name, ca, cache)
+	})
+}
+
+// loadCRL loads the CRL either from local cache or downloads it from PCS
+func loadCRL(uri string, name string, ca string, cache string) (*x509.RevocationList, error) {
 	// No cache
 	if cache == "" {
 		crl, err := downloadCRL(uri)
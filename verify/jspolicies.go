@@ -19,6 +19,7 @@ package verify
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/Fraunhofer-AISEC/cmc/attestationpolicies/jspolicies"
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
@@ -31,11 +32,27 @@ func init() {
 }
 
 func (p JsPolicyEngine) Validate(policies []byte, result ar.VerificationResult) bool {
-	vr, err := json.Marshal(result)
+	d, err := p.Evaluate(policies, result)
 	if err != nil {
-		log.Errorf("Failed to marshal verification result: %v", err)
+		log.Errorf("%v", err)
 		return false
 	}
-	engine := jspolicies.NewJsPolicyEngine(policies)
-	return engine.Validate(vr)
+	return d.Success
+}
+
+func (p JsPolicyEngine) Evaluate(policies []byte, result ar.VerificationResult,
+) (*PolicyDecision, error) {
+	vr, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal verification result: %w", err)
+	}
+	d, err := jspolicies.NewJsPolicyEngine(policies).Evaluate(vr)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyDecision{
+		Success:    d.Success,
+		Violations: d.Violations,
+		Trace:      d.Trace,
+	}, nil
 }
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+)
+
+// MetadataResolver returns the signed metadata item with the hex encoded
+// SHA-256 digest, if it is held by the verifier
+type MetadataResolver func(digest string) ([]byte, bool)
+
+// peerMetadataCache keeps the metadata items of successfully verified reports,
+// so that provers can omit them from subsequent reports
+var peerMetadataCache = cache.New("peerMetadata", cache.Limits{
+	MaxEntries: 1024,
+	MaxBytes:   64 * 1024 * 1024,
+	Ttl:        24 * time.Hour,
+}, func(b []byte) int64 { return int64(len(b)) })
+
+// CachedMetadata returns the digests the verifier holds the metadata items
+// of, in the order of the requested digests
+func CachedMetadata(digests []string) []string {
+	cached := make([]string, 0, len(digests))
+	for _, d := range digests {
+		if _, ok := peerMetadataCache.Get(d); ok {
+			cached = append(cached, d)
+		}
+	}
+	return cached
+}
+
+// ResolveCachedMetadata is the resolver of the metadata items of previously
+// verified reports
+func ResolveCachedMetadata(digest string) ([]byte, bool) {
+	return peerMetadataCache.Get(digest)
+}
+
+// MetadataDigests returns the digests of the metadata items of the serialized
+// attestation report, including the digests of the cached items omitted from
+// the report. The signature of the report is not verified
+func MetadataDigests(arRaw []byte) ([]string, error) {
+	s, err := ar.DetectSerializer(arRaw)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := s.GetPayload(arRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get report payload: %w", err)
+	}
+	report := new(ar.AttestationReport)
+	if err := s.Unmarshal(payload, report); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal report: %w", err)
+	}
+	items := reportMetadata(report)
+	digests := make([]string, 0, len(items)+len(report.CachedMetadata))
+	for _, item := range items {
+		digests = append(digests, metadataDigest(item))
+	}
+	return append(digests, report.CachedMetadata...), nil
+}
+
+// resolveMetadata adds the cached metadata items referenced by the report. The
+// digests of the items which could not be resolved are returned
+func resolveMetadata(report *ar.AttestationReport, s ar.Serializer, resolve MetadataResolver,
+) []string {
+	var missing []string
+	for _, d := range report.CachedMetadata {
+		var item []byte
+		ok := false
+		if resolve != nil {
+			item, ok = resolve(d)
+		}
+		if !ok || metadataDigest(item) != d {
+			missing = append(missing, d)
+			continue
+		}
+		// The type is taken from the unverified payload, the item is verified
+		// with the other metadata afterwards
+		payload, err := s.GetPayload(item)
+		info := new(ar.MetaInfo)
+		if err == nil {
+			err = s.Unmarshal(payload, info)
+		}
+		if err != nil || !report.AddMetadata(info.Type, item) {
+			log.Tracef("Failed to add cached metadata item %v", d)
+			missing = append(missing, d)
+		}
+	}
+	return missing
+}
+
+// cacheMetadata stores the metadata items of the verified report
+func cacheMetadata(report *ar.AttestationReport) {
+	for _, item := range reportMetadata(report) {
+		peerMetadataCache.Set(metadataDigest(item), item)
+	}
+}
+
+func reportMetadata(report *ar.AttestationReport) [][]byte {
+	items := make([][]byte, 0, 4+len(report.AppManifests))
+	for _, item := range append([][]byte{report.RtmManifest, report.OsManifest,
+		report.DeviceDescription, report.CompanyDescription}, report.AppManifests...) {
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func metadataDigest(item []byte) string {
+	digest := sha256.Sum256(item)
+	return hex.EncodeToString(digest[:])
+}
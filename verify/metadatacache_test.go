@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+	"golang.org/x/exp/slices"
+)
+
+func TestVerifyResolved(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{Apps: 1})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	digests := make([]string, 0, len(f.Metadata))
+	items := map[string][]byte{}
+	for _, item := range f.Metadata {
+		d := metadataDigest(item)
+		digests = append(digests, d)
+		items[d] = item
+	}
+	unknown := metadataDigest([]byte("unknown"))
+
+	holding := func(held []string) MetadataResolver {
+		return func(digest string) ([]byte, bool) {
+			if !slices.Contains(held, digest) {
+				return nil, false
+			}
+			return items[digest], true
+		}
+	}
+	corrupted := func(digest string) ([]byte, bool) {
+		return []byte("corrupted"), true
+	}
+
+	tests := []struct {
+		name        string
+		cached      []string
+		resolve     MetadataResolver
+		wantOmitted int
+		wantMissing []string
+	}{
+		{"Full Report", nil, holding(nil), 0, nil},
+		{"Cache Hit", digests, holding(digests), len(digests), nil},
+		{"Partial Hit", digests[:2], holding(digests[:2]), 2, nil},
+		{"Unknown Digest", []string{unknown}, holding(nil), 0, nil},
+		{"Stale Cache", digests, holding(digests[:1]), len(digests), digests[1:]},
+		{"No Resolver", digests[:1], nil, 1, digests[:1]},
+		{"Corrupted Entry", digests[:1], corrupted, 1, digests[:1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := generate.GenerateCached(f.Nonce, f.Metadata, []ar.Driver{f},
+				f.Serializer, tt.cached)
+			if err != nil {
+				t.Fatalf("GenerateCached() error = %v", err)
+			}
+			signed, err := generate.Sign(report, f, f.Serializer)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			// The digests of the report include the omitted items
+			got, err := MetadataDigests(signed)
+			if err != nil {
+				t.Fatalf("MetadataDigests() error = %v", err)
+			}
+			if !containsAll(got, digests) || len(got) != len(digests) {
+				t.Errorf("MetadataDigests() = %v, want %v", got, digests)
+			}
+			if len(signed) >= len(f.Report) && tt.wantOmitted > 0 {
+				t.Errorf("report with %v omitted items not smaller than full report",
+					tt.wantOmitted)
+			}
+
+			r := VerifyResolved(signed, f.Nonce, f.CaPem(), nil, PolicyEngineSelect_None, "",
+				tt.resolve)
+			if r.Success != (tt.wantMissing == nil) {
+				t.Fatalf("VerifyResolved() success = %v, want %v (%v)", r.Success,
+					tt.wantMissing == nil, r.ErrorCode)
+			}
+			if tt.wantMissing != nil && r.ErrorCode != ar.MissingCacheEntry {
+				t.Errorf("VerifyResolved() error code = %v, want %v", r.ErrorCode,
+					ar.MissingCacheEntry)
+			}
+			if !slices.Equal(r.MissingMetadata, tt.wantMissing) {
+				t.Errorf("VerifyResolved() missing = %v, want %v", r.MissingMetadata,
+					tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestCachedMetadata(t *testing.T) {
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	peerMetadataCache.Flush()
+	t.Cleanup(peerMetadataCache.Flush)
+
+	digests := make([]string, 0, len(f.Metadata))
+	for _, item := range f.Metadata {
+		digests = append(digests, metadataDigest(item))
+	}
+	if got := CachedMetadata(digests); len(got) != 0 {
+		t.Fatalf("CachedMetadata() of empty cache = %v", got)
+	}
+
+	// Successfully verified reports are cached, so that subsequent reports
+	// can omit the metadata
+	if r := Verify(f.Report, f.Nonce, f.CaPem(), nil, PolicyEngineSelect_None, ""); !r.Success {
+		t.Fatalf("Verify() failed: %v", r.ErrorCode)
+	}
+	if got := CachedMetadata(digests); !slices.Equal(got, digests) {
+		t.Fatalf("CachedMetadata() = %v, want %v", got, digests)
+	}
+
+	report, err := generate.GenerateCached(f.Nonce, f.Metadata, []ar.Driver{f}, f.Serializer,
+		digests)
+	if err != nil {
+		t.Fatalf("GenerateCached() error = %v", err)
+	}
+	signed, err := generate.Sign(report, f, f.Serializer)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if r := Verify(signed, f.Nonce, f.CaPem(), nil, PolicyEngineSelect_None, ""); !r.Success {
+		t.Fatalf("Verify() of cached report failed: %v", r.ErrorCode)
+	}
+}
+
+func containsAll(s, items []string) bool {
+	for _, item := range items {
+		if !slices.Contains(s, item) {
+			return false
+		}
+	}
+	return true
+}
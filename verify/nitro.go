@@ -0,0 +1,286 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+	"github.com/veraison/go-cose"
+)
+
+const (
+	// SHA256 fingerprint of the AWS Nitro Enclaves Root-G1 certificate, see
+	// https://docs.aws.amazon.com/enclaves/latest/user/verify-root.html
+	nitroRootFingerprint = "641a0321a3e244efe456463195d606317ed7cdcc3c1756e09893f3c68f79bb5b"
+
+	// Nitro Enclaves provide PCR0 to PCR8, PCR0 contains the enclave image
+	nitroMaxPcr = 8
+
+	coseSign1Tag = 0xd2
+)
+
+// NitroDocument is the payload of the COSE_Sign1 signed Nitro Enclaves
+// attestation document
+type NitroDocument struct {
+	ModuleId    string         `cbor:"module_id"`
+	Digest      string         `cbor:"digest"`
+	Timestamp   uint64         `cbor:"timestamp"`
+	Pcrs        map[int][]byte `cbor:"pcrs"`
+	Certificate []byte         `cbor:"certificate"`
+	CaBundle    [][]byte       `cbor:"cabundle"`
+	PublicKey   []byte         `cbor:"public_key"`
+	UserData    []byte         `cbor:"user_data"`
+	Nonce       []byte         `cbor:"nonce"`
+}
+
+// verifyNitroMeasurements verifies an AWS Nitro Enclaves attestation document.
+// The nonce must be provided as user data, the document must be signed by the
+// certificate chain embedded in the document and the PCRs must match the
+// reference values. A reference value for PCR0 (enclave image) is required.
+// The certificate chain is verified at the given time, the zero time refers to
+// the current time
+func verifyNitroMeasurements(nitroM ar.Measurement, nonce []byte,
+	referenceValues []ar.ReferenceValue, at time.Time,
+) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying Nitro measurements")
+
+	result := &ar.MeasurementResult{
+		Type: "Nitro Result",
+	}
+	ok := true
+
+	if len(referenceValues) == 0 {
+		log.Tracef("Could not find Nitro Reference Value")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	fingerprint := nitroRootFingerprint
+	for _, ref := range referenceValues {
+		if ref.Type != "Nitro Reference Value" {
+			log.Tracef("Nitro Reference Value invalid type %v", ref.Type)
+			result.Summary.SetErr(ar.RefValType)
+			return result, false
+		}
+		if ref.Pcr == nil {
+			log.Tracef("No PCR set in Nitro Reference Value %v", ref.Name)
+			result.Summary.SetErr(ar.PcrNotSpecified)
+			return result, false
+		}
+		if ref.Nitro != nil && ref.Nitro.CaFingerprint != "" {
+			fingerprint = ref.Nitro.CaFingerprint
+		}
+	}
+
+	doc, err := parseNitroDocument(nitroM.Evidence)
+	if err != nil {
+		log.Tracef("Failed to parse Nitro attestation document: %v", err)
+		result.Summary.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+	if !strings.EqualFold(doc.Digest, "SHA384") {
+		log.Tracef("Unsupported Nitro attestation document digest %v", doc.Digest)
+		result.Summary.SetErr(ar.UnsupportedAlgorithm)
+		return result, false
+	}
+
+	// Verify nonce
+	if bytes.Equal(doc.UserData, nonce) {
+		result.Freshness.Success = true
+	} else {
+		log.Tracef("Nonces mismatch: Supplied Nonce = %v, Nitro Nonce = %v)",
+			hex.EncodeToString(nonce), hex.EncodeToString(doc.UserData))
+		result.Freshness.Success = false
+		result.Freshness.Expected = hex.EncodeToString(nonce)
+		result.Freshness.Got = hex.EncodeToString(doc.UserData)
+		ok = false
+	}
+
+	// Verify certificate chain and signature
+	var sigOk bool
+	result.Signature, sigOk = verifyNitroSignature(nitroM.Evidence, doc, fingerprint, at)
+	if !sigOk {
+		ok = false
+	}
+
+	// Verify that every reference value has a matching PCR
+	pcr0 := false
+	for _, ref := range referenceValues {
+		pcr := *ref.Pcr
+		if pcr == 0 {
+			pcr0 = true
+		}
+		measured, found := doc.Pcrs[pcr]
+		r := ar.DigestResult{
+			Pcr:    ref.Pcr,
+			Name:   ref.Name,
+			Digest: hex.EncodeToString(ref.Sha384),
+		}
+		if pcr < 0 || pcr > nitroMaxPcr || !found {
+			log.Tracef("Nitro PCR%v not present in attestation document", pcr)
+			r.Type = "Reference Value"
+			ok = false
+		} else if !bytes.Equal(measured, ref.Sha384) {
+			log.Tracef("Nitro PCR%v mismatch: %v, expected %v", pcr,
+				hex.EncodeToString(measured), hex.EncodeToString(ref.Sha384))
+			r.Description = hex.EncodeToString(measured)
+			r.Type = "Reference Value"
+			ok = false
+		} else {
+			r.Success = true
+		}
+		result.Artifacts = append(result.Artifacts, r)
+	}
+	if !pcr0 {
+		log.Tracef("No Nitro Reference Value for PCR0 (enclave image) present")
+		result.Summary.SetErr(ar.RefValNotPresent)
+		return result, false
+	}
+
+	result.Summary.Success = ok
+
+	return result, ok
+}
+
+// parseNitroDocument parses the tagged or untagged COSE_Sign1 attestation
+// document and returns the unmarshalled payload
+func parseNitroDocument(data []byte) (*NitroDocument, error) {
+
+	msg, err := unmarshalNitroSign1(data)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &NitroDocument{}
+	s := ar.CborSerializer{}
+	if err := s.Unmarshal(msg.Payload, doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attestation document: %w", err)
+	}
+
+	return doc, nil
+}
+
+func unmarshalNitroSign1(data []byte) (*cose.Sign1Message, error) {
+	// The NSM returns untagged messages, allow both encodings
+	if len(data) > 0 && data[0] == coseSign1Tag {
+		var msg cose.Sign1Message
+		if err := msg.UnmarshalCBOR(data); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal COSE_Sign1: %w", err)
+		}
+		return &msg, nil
+	}
+	var msg cose.UntaggedSign1Message
+	if err := msg.UnmarshalCBOR(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal COSE_Sign1: %w", err)
+	}
+	return (*cose.Sign1Message)(&msg), nil
+}
+
+func verifyNitroSignature(data []byte, doc *NitroDocument, fingerprint string, at time.Time,
+) (ar.SignatureResult, bool) {
+
+	result := ar.SignatureResult{}
+
+	if len(doc.CaBundle) == 0 {
+		log.Tracef("Nitro attestation document does not contain CA bundle")
+		result.CertChainCheck.SetErr(ar.ParseCert)
+		return result, false
+	}
+
+	// The CA bundle starts with the root CA, followed by the intermediates
+	certsRaw := [][]byte{doc.Certificate}
+	for i := len(doc.CaBundle) - 1; i > 0; i-- {
+		certsRaw = append(certsRaw, doc.CaBundle[i])
+	}
+	certs, err := internal.ParseCertsDer(certsRaw)
+	if err != nil {
+		log.Tracef("Failed to parse Nitro certificates: %v", err)
+		result.CertChainCheck.SetErr(ar.ParseCert)
+		return result, false
+	}
+	ca, err := x509.ParseCertificate(doc.CaBundle[0])
+	if err != nil {
+		log.Tracef("Failed to parse Nitro root CA: %v", err)
+		result.CertChainCheck.SetErr(ar.ParseCA)
+		return result, false
+	}
+
+	// Verify the root CA against the AWS Nitro root fingerprint
+	refFingerprint, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		log.Tracef("Could not parse Nitro CA fingerprint %v: %v", fingerprint, err)
+		result.CertChainCheck.SetErr(ar.ParseCAFingerprint)
+		return result, false
+	}
+	caFingerprint := sha256.Sum256(ca.Raw)
+	if !bytes.Equal(refFingerprint, caFingerprint[:]) {
+		log.Tracef("Root CA fingerprint mismatch. Expected: %v, Got: %v",
+			fingerprint, hex.EncodeToString(caFingerprint[:]))
+		result.CertChainCheck.Success = false
+		result.CertChainCheck.Expected = fingerprint
+		result.CertChainCheck.Got = hex.EncodeToString(caFingerprint[:])
+		result.CertChainCheck.ErrorCode = ar.CaFingerprint
+		return result, false
+	}
+
+	x509Chains, err := internal.VerifyCertChainAt(certs, []*x509.Certificate{ca}, at)
+	if err != nil {
+		log.Tracef("Failed to verify Nitro certificate chain: %v", err)
+		result.CertChainCheck.SetErr(ar.VerifyCertChain)
+		return result, false
+	}
+	result.CertChainCheck.Success = true
+
+	result.AddValidatedChains(x509Chains)
+
+	// Verify the COSE signature with the leaf certificate
+	pub, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		log.Tracef("Unsupported Nitro certificate public key type %T", certs[0].PublicKey)
+		result.SignCheck.SetErr(ar.ExtractPubKey)
+		return result, false
+	}
+	verifier, err := cose.NewVerifier(cose.AlgorithmES384, pub)
+	if err != nil {
+		log.Tracef("Failed to create verifier: %v", err)
+		result.SignCheck.SetErr(ar.Internal)
+		return result, false
+	}
+	msg, err := unmarshalNitroSign1(data)
+	if err != nil {
+		log.Tracef("Failed to unmarshal Nitro attestation document: %v", err)
+		result.SignCheck.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+	if err := msg.Verify(nil, verifier); err != nil {
+		log.Tracef("Failed to verify Nitro attestation document signature: %v", err)
+		result.SignCheck.SetErr(ar.VerifySignature)
+		return result, false
+	}
+	result.SignCheck.Success = true
+
+	return result, true
+}
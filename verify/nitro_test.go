@@ -0,0 +1,281 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/veraison/go-cose"
+)
+
+// nitroFixture contains a Nitro attestation document created with a test
+// certificate chain in the format of the NSM, as the generation requires an
+// enclave
+type nitroFixture struct {
+	doc       NitroDocument
+	leafKey   *ecdsa.PrivateKey
+	nonce     []byte
+	refVals   []ar.ReferenceValue
+	evidence  []byte
+	caPrint   string
+	untrusted bool
+	at        time.Time
+}
+
+// Verification time of the Nitro fixtures. As the leaf certificates of the NSM,
+// the test leaf certificate is only valid for three hours
+var nitroTestTime = time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+
+func createNitroFixture(t *testing.T) *nitroFixture {
+
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	intKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	rootTmpl := fixtures.CaTemplate(1, "aws.nitro-enclaves",
+		time.Date(2019, 10, 28, 0, 0, 0, 0, time.UTC), time.Date(2049, 10, 28, 0, 0, 0, 0, time.UTC))
+	root := createTestCert(t, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	intermediate := createTestCert(t, fixtures.CaTemplate(2, "eu-central-1.aws.nitro-enclaves",
+		nitroTestTime.AddDate(0, 0, -1), nitroTestTime.AddDate(0, 0, 29)), root,
+		&intKey.PublicKey, rootKey)
+	leaf := createTestCert(t, fixtures.LeafTemplate(3, "i-0123456789abcdef0-enc0123456789abcdef",
+		nitroTestTime.Add(-time.Hour), nitroTestTime.Add(2*time.Hour)), intermediate,
+		&leafKey.PublicKey, intKey)
+
+	f := &nitroFixture{
+		leafKey: leafKey,
+		nonce:   []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		at:      nitroTestTime,
+	}
+
+	pcrs := make(map[int][]byte)
+	for i := 0; i <= nitroMaxPcr; i++ {
+		pcrs[i] = make([]byte, 48)
+	}
+	image := sha512.Sum384([]byte("enclave image"))
+	kernel := sha512.Sum384([]byte("kernel"))
+	pcrs[0] = image[:]
+	pcrs[1] = kernel[:]
+
+	f.doc = NitroDocument{
+		ModuleId:    "i-0123456789abcdef0-enc0123456789abcdef",
+		Digest:      "SHA384",
+		Timestamp:   uint64(nitroTestTime.UnixMilli()),
+		Pcrs:        pcrs,
+		Certificate: leaf.Raw,
+		CaBundle:    [][]byte{root.Raw, intermediate.Raw},
+		UserData:    f.nonce,
+	}
+
+	fingerprint := sha256.Sum256(root.Raw)
+	f.caPrint = hex.EncodeToString(fingerprint[:])
+
+	p0, p1 := 0, 1
+	f.refVals = []ar.ReferenceValue{
+		{
+			Type:   "Nitro Reference Value",
+			Name:   "Enclave Image",
+			Pcr:    &p0,
+			Sha384: image[:],
+		},
+		{
+			Type:   "Nitro Reference Value",
+			Name:   "Kernel",
+			Pcr:    &p1,
+			Sha384: kernel[:],
+		},
+	}
+
+	return f
+}
+
+// sign creates the COSE_Sign1 attestation document from the fixture
+func (f *nitroFixture) sign(t *testing.T, tagged bool) []byte {
+	payload, err := ar.CborSerializer{}.Marshal(f.doc)
+	if err != nil {
+		t.Fatalf("failed to marshal attestation document: %v", err)
+	}
+	signer, err := cose.NewSigner(cose.AlgorithmES384, f.leafKey)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	headers := cose.Headers{
+		Protected: cose.ProtectedHeader{
+			cose.HeaderLabelAlgorithm: cose.AlgorithmES384,
+		},
+	}
+	var doc []byte
+	if tagged {
+		doc, err = cose.Sign1(rand.Reader, signer, headers, payload, nil)
+	} else {
+		doc, err = cose.Sign1Untagged(rand.Reader, signer, headers, payload, nil)
+	}
+	if err != nil {
+		t.Fatalf("failed to sign attestation document: %v", err)
+	}
+	return doc
+}
+
+func Test_verifyNitroMeasurements(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		modify  func(t *testing.T, f *nitroFixture)
+		tagged  bool
+		want    bool
+		errCode ar.ErrorCode
+		check   func(t *testing.T, r *ar.MeasurementResult)
+	}{
+		{
+			name:   "Valid",
+			modify: func(t *testing.T, f *nitroFixture) {},
+			want:   true,
+		},
+		{
+			name:   "Valid Tagged",
+			modify: func(t *testing.T, f *nitroFixture) {},
+			tagged: true,
+			want:   true,
+		},
+		{
+			name: "Invalid Nonce",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.doc.UserData = []byte{0xff}
+			},
+			want: false,
+		},
+		{
+			name: "Invalid PCR",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.doc.Pcrs[1] = make([]byte, 48)
+			},
+			want: false,
+		},
+		{
+			name: "Missing PCR0 Reference Value",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.refVals = f.refVals[1:]
+			},
+			want:    false,
+			errCode: ar.RefValNotPresent,
+		},
+		{
+			name: "Missing PCR",
+			modify: func(t *testing.T, f *nitroFixture) {
+				delete(f.doc.Pcrs, 1)
+			},
+			want: false,
+		},
+		{
+			name: "Untrusted Root",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.untrusted = true
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				// Without a fingerprint in the reference values, the AWS root is required
+				c := r.Signature.CertChainCheck
+				if c.ErrorCode != ar.CaFingerprint || c.Expected != nitroRootFingerprint {
+					t.Errorf("unexpected cert chain check %+v", c)
+				}
+			},
+		},
+		{
+			name: "Leaf Certificate Expired",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.at = nitroTestTime.Add(3 * time.Hour)
+			},
+			want: false,
+			check: func(t *testing.T, r *ar.MeasurementResult) {
+				if r.Signature.CertChainCheck.ErrorCode != ar.VerifyCertChain {
+					t.Errorf("unexpected error code %v", r.Signature.CertChainCheck.ErrorCode)
+				}
+			},
+		},
+		{
+			name: "Signed With Other Key",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.leafKey, _ = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+			},
+			want: false,
+		},
+		{
+			name: "Invalid Digest",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.doc.Digest = "SHA256"
+			},
+			want:    false,
+			errCode: ar.UnsupportedAlgorithm,
+		},
+		{
+			name: "Invalid Reference Value Type",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.refVals[0].Type = "TPM Reference Value"
+			},
+			want:    false,
+			errCode: ar.RefValType,
+		},
+		{
+			name: "Invalid Document",
+			modify: func(t *testing.T, f *nitroFixture) {
+				f.evidence = []byte{0x84, 0x40, 0xa0}
+			},
+			want:    false,
+			errCode: ar.ParseEvidence,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := createNitroFixture(t)
+			tt.modify(t, f)
+			if f.evidence == nil {
+				f.evidence = f.sign(t, tt.tagged)
+			}
+			if !f.untrusted {
+				// Trust the test root instead of the AWS Nitro root
+				f.refVals[0].Nitro = &ar.NitroDetails{CaFingerprint: f.caPrint}
+			}
+
+			m := ar.Measurement{
+				Type:     "Nitro Measurement",
+				Evidence: f.evidence,
+			}
+			r, got := verifyNitroMeasurements(m, f.nonce, f.refVals, f.at)
+			if got != tt.want {
+				t.Errorf("verifyNitroMeasurements() = %v, want %v", got, tt.want)
+			}
+			if r.Summary.Success != got {
+				t.Errorf("verifyNitroMeasurements() summary = %v, want %v", r.Summary.Success, got)
+			}
+			if tt.errCode != ar.NotSet && r.Summary.ErrorCode != tt.errCode {
+				t.Errorf("verifyNitroMeasurements() error code = %v, want %v",
+					r.Summary.ErrorCode, tt.errCode)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
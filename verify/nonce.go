@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	// DefaultNonceTtl is the default time a prover has to answer a nonce
+	DefaultNonceTtl = 5 * time.Minute
+	// DefaultNonceSkew is the default tolerated clock skew between verifier
+	// instances sharing a nonce key
+	DefaultNonceSkew = 30 * time.Second
+	// DefaultMaxNonces is the default maximum number of pending nonces of a store
+	DefaultMaxNonces = 4096
+
+	// Nonces are limited to 32 bytes: the issuance time, a random value and the
+	// HMAC truncated to 128 bits
+	nonceTimeLength   = 8
+	nonceRandomLength = 8
+	nonceMacLength    = 16
+	nonceKeyLength    = 32
+)
+
+var (
+	// ErrNonceUnknown indicates that a nonce was not issued by the verifier or
+	// was already used
+	ErrNonceUnknown = errors.New("nonce not issued by verifier")
+	// ErrNonceExpired indicates that a nonce was answered after its expiry
+	ErrNonceExpired = errors.New("nonce expired")
+)
+
+// NonceChecker checks that a nonce answered by a report was issued by the
+// verifier and has not expired. It returns an error wrapping ErrNonceUnknown or
+// ErrNonceExpired otherwise
+type NonceChecker interface {
+	CheckNonce(nonce []byte) error
+}
+
+// NonceKey issues stateless nonces, which embed the issuance time and are
+// authenticated with an HMAC. Verifier instances sharing the key accept the
+// nonces of each other. Only the clocks of the verifiers are relevant, not the
+// clock of the prover. As the nonces are not recorded, they cannot be single-use
+type NonceKey struct {
+	key  []byte
+	ttl  time.Duration
+	skew time.Duration
+	now  func() time.Time
+}
+
+// NewNonceKey creates a nonce key with the nonce TTL and the tolerated clock
+// skew between the verifier instances sharing the key. Zero values select the
+// defaults
+func NewNonceKey(key []byte, ttl, skew time.Duration) (*NonceKey, error) {
+	if len(key) < nonceKeyLength {
+		return nil, fmt.Errorf("nonce key length %v below minimum %v", len(key), nonceKeyLength)
+	}
+	if ttl < 0 || skew < 0 {
+		return nil, fmt.Errorf("invalid nonce TTL %v or clock skew %v", ttl, skew)
+	}
+	if ttl == 0 {
+		ttl = DefaultNonceTtl
+	}
+	if skew == 0 {
+		skew = DefaultNonceSkew
+	}
+	return &NonceKey{
+		key:  append([]byte(nil), key...),
+		ttl:  ttl,
+		skew: skew,
+		now:  time.Now,
+	}, nil
+}
+
+// Issue creates a new nonce consisting of the issuance time, a random value and
+// the HMAC over both
+func (k *NonceKey) Issue() ([]byte, error) {
+	nonce := make([]byte, nonceTimeLength+nonceRandomLength,
+		nonceTimeLength+nonceRandomLength+nonceMacLength)
+	binary.BigEndian.PutUint64(nonce, uint64(k.now().UnixNano()))
+	if _, err := rand.Read(nonce[nonceTimeLength:]); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	return append(nonce, k.mac(nonce)...), nil
+}
+
+// CheckNonce checks the HMAC and the age of the nonce. Nonces issued in the
+// future beyond the tolerated clock skew are rejected as expired, as their age
+// cannot be determined
+func (k *NonceKey) CheckNonce(nonce []byte) error {
+	if len(nonce) != nonceTimeLength+nonceRandomLength+nonceMacLength {
+		return fmt.Errorf("%w: invalid length %v", ErrNonceUnknown, len(nonce))
+	}
+	data, mac := nonce[:nonceTimeLength+nonceRandomLength], nonce[nonceTimeLength+nonceRandomLength:]
+	if !hmac.Equal(mac, k.mac(data)) {
+		return fmt.Errorf("%w: invalid HMAC", ErrNonceUnknown)
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	age := k.now().Sub(issued)
+	if age < -k.skew {
+		return fmt.Errorf("%w: issued %v in the future", ErrNonceExpired, -age)
+	}
+	if age > k.ttl {
+		return fmt.Errorf("%w: issued %v ago, TTL %v", ErrNonceExpired, age, k.ttl)
+	}
+	return nil
+}
+
+func (k *NonceKey) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, k.key)
+	h.Write(data)
+	return h.Sum(nil)[:nonceMacLength]
+}
+
+// NonceStore records issued nonces until they are used or expire. The nonces
+// are single-use. The expiry is based on the monotonic clock, so that changes of
+// the wall clock, e.g. by NTP, do not extend or shorten the lifetime of nonces
+type NonceStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	nonces map[string]time.Time
+	now    func() time.Time
+}
+
+// NewNonceStore creates a nonce store with the nonce TTL and the maximum number
+// of pending nonces. Zero values select the defaults
+func NewNonceStore(ttl time.Duration, max int) *NonceStore {
+	if ttl <= 0 {
+		ttl = DefaultNonceTtl
+	}
+	if max <= 0 {
+		max = DefaultMaxNonces
+	}
+	return &NonceStore{
+		ttl:    ttl,
+		max:    max,
+		nonces: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Issue creates and records a new random nonce
+func (s *NonceStore) Issue() ([]byte, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	if err := s.Add(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Add records a nonce derived by the verifier, e.g. from the channel bindings
+// of a TLS connection. The expired nonces are only swept once the store is
+// full, so that issuing nonces under load does not scan the store each time
+func (s *NonceStore) Add(nonce []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if len(s.nonces) >= s.max {
+		for n, expires := range s.nonces {
+			if now.After(expires) {
+				delete(s.nonces, n)
+			}
+		}
+	}
+	if len(s.nonces) >= s.max {
+		return errors.New("too many pending nonces")
+	}
+	s.nonces[string(nonce)] = now.Add(s.ttl)
+	return nil
+}
+
+// Ttl returns the time an issued nonce is accepted
+func (s *NonceStore) Ttl() time.Duration {
+	return s.ttl
+}
+
+// Pending returns the number of recorded nonces, including expired nonces not
+// swept yet
+func (s *NonceStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.nonces)
+}
+
+// CheckNonce removes the nonce and returns an error if it was not recorded or
+// has expired
+func (s *NonceStore) CheckNonce(nonce []byte) error {
+	s.mu.Lock()
+	expires, ok := s.nonces[string(nonce)]
+	delete(s.nonces, string(nonce))
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrNonceUnknown
+	}
+	if d := s.now().Sub(expires); d > 0 {
+		return fmt.Errorf("%w: expired %v ago", ErrNonceExpired, d)
+	}
+	return nil
+}
+
+// NonceFailure returns the failed verification result for a nonce rejected by
+// a NonceChecker
+func NonceFailure(err error) ar.VerificationResult {
+	result := ar.VerificationResult{
+		Type:    "Verification Result",
+		Success: false,
+	}
+	if errors.Is(err, ErrNonceExpired) {
+		result.ErrorCode = ar.NonceExpired
+	} else {
+		result.ErrorCode = ar.NonceUnknown
+	}
+	result.Summarize()
+	return result
+}
+
+// VerifyFresh verifies an attestation report like Verify, if the checker
+// accepts the nonce as issued by the verifier and not expired. Otherwise, the
+// report is rejected with the error code NonceUnknown or NonceExpired
+func VerifyFresh(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect,
+	cache string, nonces NonceChecker,
+) ar.VerificationResult {
+	if err := nonces.CheckNonce(nonce); err != nil {
+		log.Tracef("Rejecting report: %v", err)
+		return NonceFailure(err)
+	}
+	return Verify(arRaw, nonce, casPem, policies, polEng, cache)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+var testNonceKey = bytes.Repeat([]byte{0x42}, 32)
+
+func TestNonceKey(t *testing.T) {
+	issued := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// Clock of the issuing verifier relative to the checking verifier
+		skew time.Duration
+		// Time between issuance and check
+		elapsed time.Duration
+		modify  func(nonce []byte) []byte
+		wantErr error
+	}{
+		{"Fresh", 0, time.Minute, nil, nil},
+		{"Expired", 0, 6 * time.Minute, nil, ErrNonceExpired},
+		{"Issuer Clock Ahead Within Skew", 20 * time.Second, 0, nil, nil},
+		{"Issuer Clock Ahead Beyond Skew", 10 * time.Minute, 0, nil, ErrNonceExpired},
+		{"Issuer Clock Behind", -time.Minute, 3 * time.Minute, nil, nil},
+		{"Issuer Clock Behind Expired", -3 * time.Minute, 3 * time.Minute, nil, ErrNonceExpired},
+		{"Modified Time", 0, 0, func(n []byte) []byte { n[7] ^= 1; return n }, ErrNonceUnknown},
+		{"Truncated", 0, 0, func(n []byte) []byte { return n[:24] }, ErrNonceUnknown},
+		{"Other Key", 0, 0, func(n []byte) []byte {
+			k, _ := NewNonceKey(bytes.Repeat([]byte{0x43}, 32), 0, 0)
+			n, _ = k.Issue()
+			return n
+		}, ErrNonceUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := NewNonceKey(testNonceKey, 0, 0)
+			if err != nil {
+				t.Fatalf("NewNonceKey() error = %v", err)
+			}
+			issuer.now = func() time.Time { return issued.Add(tt.skew) }
+			nonce, err := issuer.Issue()
+			if err != nil {
+				t.Fatalf("Issue() error = %v", err)
+			}
+			if tt.modify != nil {
+				nonce = tt.modify(nonce)
+			}
+
+			checker, _ := NewNonceKey(testNonceKey, 0, 0)
+			checker.now = func() time.Time { return issued.Add(tt.elapsed) }
+			err = checker.CheckNonce(nonce)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("CheckNonce() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewNonceKey(testNonceKey[:16], 0, 0); err == nil {
+		t.Errorf("NewNonceKey() succeeded with short key")
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	s := NewNonceStore(time.Minute, 2)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	fresh, err := s.Issue()
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	expired, _ := s.Issue()
+	if _, err := s.Issue(); err == nil {
+		t.Fatalf("Issue() succeeded with %v pending nonces", s.max)
+	}
+
+	if err := s.CheckNonce(fresh); err != nil {
+		t.Errorf("CheckNonce() error = %v", err)
+	}
+	if err := s.CheckNonce(fresh); !errors.Is(err, ErrNonceUnknown) {
+		t.Errorf("CheckNonce() of used nonce error = %v, want %v", err, ErrNonceUnknown)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := s.CheckNonce(expired); !errors.Is(err, ErrNonceExpired) {
+		t.Errorf("CheckNonce() of expired nonce error = %v, want %v", err, ErrNonceExpired)
+	}
+
+	// Expired nonces are purged and do not count towards the maximum
+	s.Issue()
+	now = now.Add(2 * time.Minute)
+	if _, err := s.Issue(); err != nil {
+		t.Errorf("Issue() error = %v", err)
+	}
+}
+
+func TestNonceStoreWallClockChange(t *testing.T) {
+	// The expiry is based on the monotonic clock, so that setting the wall
+	// clock forward or back does not change the lifetime of the nonce
+	s := NewNonceStore(time.Minute, 0)
+	wall := time.Hour
+	s.now = func() time.Time { return time.Now().Add(wall) }
+
+	nonce, err := s.Issue()
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	wall = -time.Hour
+	if err := s.CheckNonce(nonce); err != nil {
+		t.Errorf("CheckNonce() after setting the clock back error = %v", err)
+	}
+
+	nonce, _ = s.Issue()
+	wall = 2 * time.Hour
+	if err := s.CheckNonce(nonce); !errors.Is(err, ErrNonceExpired) {
+		t.Errorf("CheckNonce() after advancing the clock error = %v, want %v", err,
+			ErrNonceExpired)
+	}
+}
+
+func TestVerifyFresh(t *testing.T) {
+	key, err := NewNonceKey(testNonceKey, time.Minute, 0)
+	if err != nil {
+		t.Fatalf("NewNonceKey() error = %v", err)
+	}
+	issued := time.Now()
+
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		forge    bool
+		want     bool
+		wantCode ar.ErrorCode
+	}{
+		{"Fresh", 0, false, true, ar.NotSet},
+		{"Expired", 2 * time.Minute, false, false, ar.NonceExpired},
+		{"Not Issued", 0, true, false, ar.NonceUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key.now = func() time.Time { return issued }
+			nonce, err := key.Issue()
+			if err != nil {
+				t.Fatalf("Issue() error = %v", err)
+			}
+			if tt.forge {
+				nonce[len(nonce)-1] ^= 1
+			}
+			f, err := fixtures.Generate(fixtures.Options{Nonce: nonce})
+			if err != nil {
+				t.Fatalf("failed to generate fixtures: %v", err)
+			}
+			report, err := f.NewReport(nonce)
+			if err != nil {
+				t.Fatalf("failed to create report: %v", err)
+			}
+
+			key.now = func() time.Time { return issued.Add(tt.elapsed) }
+			got := VerifyFresh(report, nonce, f.CaPem(), nil, 0, "", key)
+			if got.Success != tt.want || got.ErrorCode != tt.wantCode {
+				t.Errorf("Result = %v (%v), want %v (%v)", got.Success, got.ErrorCode, tt.want,
+					tt.wantCode)
+			}
+		})
+	}
+}
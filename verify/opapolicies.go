@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build opapolicies
+
+package verify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Fraunhofer-AISEC/cmc/attestationpolicies/opapolicies"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+type OpaPolicyEngine struct{}
+
+func init() {
+	policyEngines[PolicyEngineSelect_Opa] = OpaPolicyEngine{}
+}
+
+func (p OpaPolicyEngine) Validate(policies []byte, result ar.VerificationResult) bool {
+	d, err := p.Evaluate(policies, result)
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return d.Success
+}
+
+func (p OpaPolicyEngine) Evaluate(policies []byte, result ar.VerificationResult,
+) (*PolicyDecision, error) {
+	vr, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal verification result: %w", err)
+	}
+	d, err := opapolicies.NewOpaPolicyEngine(policies, getPolicyTimeout()).Evaluate(vr)
+	if err != nil {
+		return nil, &PolicyError{Code: opaErrorCode(err), Err: err}
+	}
+	return &PolicyDecision{
+		Success:    d.Success,
+		Violations: d.Violations,
+		Trace:      d.Trace,
+	}, nil
+}
+
+func opaErrorCode(err error) ar.ErrorCode {
+	switch {
+	case errors.Is(err, opapolicies.ErrCompile):
+		return ar.PolicyCompile
+	case errors.Is(err, opapolicies.ErrTimeout):
+		return ar.PolicyTimeout
+	case errors.Is(err, opapolicies.ErrUndefined):
+		return ar.PolicyUndefined
+	default:
+		return ar.VerifyPolicies
+	}
+}
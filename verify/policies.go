@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+const (
+	// DefaultPolicyTimeout is the time the evaluation of the custom policies
+	// may take by default, if the policy engine supports timeouts
+	DefaultPolicyTimeout = 10 * time.Second
+	// DefaultPolicyMemoryLimit is the memory in bytes sandboxed policies may
+	// use by default
+	DefaultPolicyMemoryLimit = 64 * 1024 * 1024
+)
+
+var (
+	policyLimitsMu    sync.RWMutex
+	policyTimeout     = DefaultPolicyTimeout
+	policyMemoryLimit = int64(DefaultPolicyMemoryLimit)
+)
+
+// PolicyError is returned by policy engines which can distinguish why the
+// policies could not be evaluated. The code is reported in the policy result
+type PolicyError struct {
+	Code ar.ErrorCode
+	Err  error
+}
+
+func (e *PolicyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// SetPolicyTimeout configures the time the evaluation of the custom policies
+// may take, after which the policies fail with a PolicyTimeout error
+func SetPolicyTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid policy timeout %v", timeout)
+	}
+	policyLimitsMu.Lock()
+	defer policyLimitsMu.Unlock()
+	policyTimeout = timeout
+	return nil
+}
+
+// SetPolicyMemoryLimit configures the memory in bytes sandboxed policies may
+// use, after which the policies fail with a PolicyMemoryLimit error
+func SetPolicyMemoryLimit(limit int64) error {
+	if limit <= 0 {
+		return fmt.Errorf("invalid policy memory limit %v", limit)
+	}
+	policyLimitsMu.Lock()
+	defer policyLimitsMu.Unlock()
+	policyMemoryLimit = limit
+	return nil
+}
+
+func getPolicyTimeout() time.Duration {
+	policyLimitsMu.RLock()
+	defer policyLimitsMu.RUnlock()
+	return policyTimeout
+}
+
+func getPolicyMemoryLimit() int64 {
+	policyLimitsMu.RLock()
+	defer policyLimitsMu.RUnlock()
+	return policyMemoryLimit
+}
+
+func (p PolicyEngineSelect) String() string {
+	switch p {
+	case PolicyEngineSelect_None:
+		return "none"
+	case PolicyEngineSelect_JS:
+		return "js"
+	case PolicyEngineSelect_DukTape:
+		return "duktape"
+	case PolicyEngineSelect_Opa:
+		return "opa"
+	case PolicyEngineSelect_Wasm:
+		return "wasm"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint32(p))
+	}
+}
+
+// verifyPolicies evaluates the custom policies with the selected engine and
+// folds the decision into the result
+func verifyPolicies(result *ar.VerificationResult, policies []byte, polEng PolicyEngineSelect) {
+
+	pr := &ar.PolicyResult{Engine: polEng.String()}
+
+	if _, ok := policyEngines[polEng]; !ok {
+		log.Tracef("Internal error: policy engine %v not implemented", polEng)
+		pr.ErrorCode = ar.PolicyEngineNotImplemented
+		pr.Error = fmt.Sprintf("policy engine %v not implemented", polEng)
+	} else {
+		d, err := EvaluatePolicies(policies, *result, polEng)
+		if err != nil {
+			pr.ErrorCode = ar.VerifyPolicies
+			var pe *PolicyError
+			if errors.As(err, &pe) && pe.Code != ar.NotSet {
+				pr.ErrorCode = pe.Code
+			}
+			pr.Error = err.Error()
+		}
+		if d != nil {
+			pr.Success = err == nil && d.Success
+			pr.Reasons = d.Violations
+		}
+		if !pr.Success && pr.ErrorCode == ar.NotSet {
+			pr.ErrorCode = ar.VerifyPolicies
+		}
+		if !pr.Success {
+			log.Tracef("Custom policy validation failed: %v", policyFailure(d, err))
+		}
+	}
+
+	result.PolicyResult = pr
+	result.PolicySuccess = pr.Success
+	if !pr.Success {
+		result.Success = false
+		result.ErrorCode = pr.ErrorCode
+	}
+}
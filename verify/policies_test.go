@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+)
+
+// fakePolicyEngine returns a preset decision, e.g. to test the handling of
+// errors of engines which are not compiled in
+type fakePolicyEngine struct {
+	d   *PolicyDecision
+	err error
+}
+
+func (p fakePolicyEngine) Validate(policies []byte, result ar.VerificationResult) bool {
+	return p.err == nil && p.d.Success
+}
+
+func (p fakePolicyEngine) Evaluate(policies []byte, result ar.VerificationResult,
+) (*PolicyDecision, error) {
+	return p.d, p.err
+}
+
+func Test_verifyPolicies(t *testing.T) {
+	const fake PolicyEngineSelect = 100
+	t.Cleanup(func() { delete(policyEngines, fake) })
+
+	compile := &PolicyError{Code: ar.PolicyCompile, Err: errors.New("1 error occurred")}
+
+	tests := []struct {
+		name   string
+		polEng PolicyEngineSelect
+		engine PolicyValidator
+		want   ar.PolicyResult
+	}{
+		{"Allow", fake, fakePolicyEngine{d: &PolicyDecision{Success: true}},
+			ar.PolicyResult{Success: true}},
+		{"Deny", fake, fakePolicyEngine{d: &PolicyDecision{Violations: []string{"PCR 7"}}},
+			ar.PolicyResult{Reasons: []string{"PCR 7"}, ErrorCode: ar.VerifyPolicies}},
+		{"Compile Error", fake, fakePolicyEngine{err: compile},
+			ar.PolicyResult{Error: "1 error occurred", ErrorCode: ar.PolicyCompile}},
+		{"Timeout", fake, fakePolicyEngine{err: &PolicyError{Code: ar.PolicyTimeout,
+			Err: errors.New("timeout")}},
+			ar.PolicyResult{Error: "timeout", ErrorCode: ar.PolicyTimeout}},
+		{"Undefined", fake, fakePolicyEngine{err: &PolicyError{Code: ar.PolicyUndefined,
+			Err: errors.New("undefined")}},
+			ar.PolicyResult{Error: "undefined", ErrorCode: ar.PolicyUndefined}},
+		{"Other Error", fake, fakePolicyEngine{err: errors.New("failed")},
+			ar.PolicyResult{Error: "failed", ErrorCode: ar.VerifyPolicies}},
+		{"Not Implemented", fake + 1, nil, ar.PolicyResult{
+			Error:     "policy engine unknown (101) not implemented",
+			ErrorCode: ar.PolicyEngineNotImplemented}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.engine != nil {
+				policyEngines[tt.polEng] = tt.engine
+			}
+			result := ar.VerificationResult{Success: true}
+			verifyPolicies(&result, []byte("policies"), tt.polEng)
+
+			tt.want.Engine = tt.polEng.String()
+			if result.PolicyResult == nil || !reflect.DeepEqual(*result.PolicyResult, tt.want) {
+				t.Fatalf("PolicyResult = %+v, want %+v", result.PolicyResult, tt.want)
+			}
+			if result.Success != tt.want.Success || result.PolicySuccess != tt.want.Success {
+				t.Errorf("Success = %v, PolicySuccess = %v, want %v", result.Success,
+					result.PolicySuccess, tt.want.Success)
+			}
+			if !tt.want.Success && result.ErrorCode != tt.want.ErrorCode {
+				t.Errorf("ErrorCode = %v, want %v", result.ErrorCode, tt.want.ErrorCode)
+			}
+		})
+	}
+}
+
+func TestVerifyPolicyResult(t *testing.T) {
+	const fake PolicyEngineSelect = 100
+	policyEngines[fake] = fakePolicyEngine{err: &PolicyError{Code: ar.PolicyCompile,
+		Err: errors.New("rego_parse_error")}}
+	t.Cleanup(func() { delete(policyEngines, fake) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+
+	got := Verify(f.Report, f.Nonce, f.CaPem(), []byte("package cmc"), fake, "")
+	if got.Success {
+		t.Fatalf("verification succeeded with invalid policies")
+	}
+	if got.PolicyResult == nil || got.PolicyResult.ErrorCode != ar.PolicyCompile {
+		t.Fatalf("PolicyResult = %+v, want %v", got.PolicyResult, ar.PolicyCompile)
+	}
+	if !hasFailedCheck(got, ar.PolicyCompile) {
+		t.Errorf("Result.Checks = %+v, want failed check with code %v", got.Checks,
+			ar.PolicyCompile.Name())
+	}
+}
+
+func TestSetPolicyTimeout(t *testing.T) {
+	t.Cleanup(func() { SetPolicyTimeout(DefaultPolicyTimeout) })
+
+	if err := SetPolicyTimeout(0); err == nil {
+		t.Errorf("SetPolicyTimeout() succeeded with zero timeout")
+	}
+	if err := SetPolicyTimeout(time.Second); err != nil {
+		t.Fatalf("SetPolicyTimeout() error = %v", err)
+	}
+	if got := getPolicyTimeout(); got != time.Second {
+		t.Errorf("getPolicyTimeout() = %v, want %v", got, time.Second)
+	}
+}
+
+func TestSetPolicyMemoryLimit(t *testing.T) {
+	t.Cleanup(func() { SetPolicyMemoryLimit(DefaultPolicyMemoryLimit) })
+
+	if err := SetPolicyMemoryLimit(-1); err == nil {
+		t.Errorf("SetPolicyMemoryLimit() succeeded with negative limit")
+	}
+	if err := SetPolicyMemoryLimit(1 << 20); err != nil {
+		t.Fatalf("SetPolicyMemoryLimit() error = %v", err)
+	}
+	if got := getPolicyMemoryLimit(); got != 1<<20 {
+		t.Errorf("getPolicyMemoryLimit() = %v, want %v", got, 1<<20)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+var (
+	redactionMu    sync.RWMutex
+	redactionSalts = map[string][]byte{}
+)
+
+// SetRedactionSalts configures the salts of redacted event names the verifier
+// is authorized for, which are withheld from the attestation reports
+func SetRedactionSalts(salts [][]byte) {
+	m := make(map[string][]byte, len(salts))
+	for _, salt := range salts {
+		m[string(ar.SaltId(salt))] = salt
+	}
+	redactionMu.Lock()
+	defer redactionMu.Unlock()
+	redactionSalts = m
+}
+
+// redactionSalt returns the salt of the redaction, either disclosed in the
+// report or configured, and whether it was disclosed
+func redactionSalt(r *ar.Redaction) ([]byte, bool) {
+	if len(r.Salt) > 0 {
+		if !bytes.Equal(ar.SaltId(r.Salt), r.SaltId) {
+			log.Tracef("Disclosed redaction salt does not match salt ID %v",
+				hex.EncodeToString(r.SaltId))
+			return nil, true
+		}
+		return r.Salt, true
+	}
+	redactionMu.RLock()
+	defer redactionMu.RUnlock()
+	return redactionSalts[string(r.SaltId)], false
+}
+
+// nameResolver resolves the redacted event names of an artifact to the names of
+// the reference values of the PCR
+type nameResolver struct {
+	result ar.RedactionResult
+	names  map[string]string
+}
+
+// newNameResolver creates a resolver for the PCR event log. Events with redacted
+// names in an artifact without redaction cannot be resolved
+func newNameResolver(pcr int, a ar.Artifact, refs []ar.ReferenceValue) *nameResolver {
+	r := &nameResolver{
+		result: ar.RedactionResult{Pcr: pcr},
+		names:  map[string]string{},
+	}
+	if a.Redaction == nil {
+		log.Tracef("PCR%v contains redacted event names without redaction", pcr)
+		return r
+	}
+	salt, disclosed := redactionSalt(a.Redaction)
+	r.result.Prefixes = a.Redaction.Prefixes
+	r.result.SaltDisclosed = disclosed
+	r.result.SaltKnown = salt != nil
+	if salt == nil {
+		log.Tracef("Redaction salt of PCR%v unknown, cannot resolve event names", pcr)
+		return r
+	}
+	for _, ref := range refs {
+		if ref.Pcr != nil && *ref.Pcr == pcr && ref.Name != "" {
+			r.names[string(ar.RedactName(salt, ref.Name))] = ref.Name
+		}
+	}
+	return r
+}
+
+// resolve returns the name of the reference value matching the redacted name
+// or the hex encoded digest, if the name cannot be resolved
+func (r *nameResolver) resolve(digest []byte) string {
+	r.result.Redacted++
+	if name, ok := r.names[string(digest)]; ok {
+		r.result.Resolved++
+		return name
+	}
+	return "redacted:" + hex.EncodeToString(digest)
+}
+
+// done returns the result of the resolution. The assurance is reduced if not
+// all redacted names could be resolved
+func (r *nameResolver) done() ar.RedactionResult {
+	r.result.ReducedAssurance = r.result.Resolved < r.result.Redacted
+	return r.result
+}
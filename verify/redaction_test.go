@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/ima"
+)
+
+func Test_recalculatePcrsRedacted(t *testing.T) {
+	pcr := 10
+	salt := []byte("0123456789abcdef")
+	events := []ar.MeasureEvent{
+		{Sha256: dummyDigest(1), EventName: "/usr/bin/bash"},
+		{Sha256: dummyDigest(2), EventName: "/home/user/tool"},
+		{Sha256: dummyDigest(3), EventName: "/home/user/unknown"},
+	}
+	refs := []ar.ReferenceValue{
+		{Type: "TPM Reference Value", Pcr: &pcr, Sha256: dummyDigest(1), Name: "/usr/bin/bash"},
+		{Type: "TPM Reference Value", Pcr: &pcr, Sha256: dummyDigest(2), Name: "/home/user/tool"},
+		{Type: "TPM Reference Value", Pcr: &pcr, Sha256: dummyDigest(3), Name: "unknown"},
+	}
+
+	tests := []struct {
+		name         string
+		conf         *ar.RedactionConfig
+		verifierSalt bool
+		wantName     string
+		want         ar.RedactionResult
+	}{
+		{
+			name: "Disclosed Salt",
+			conf: &ar.RedactionConfig{Prefixes: []string{"/home/"}, DiscloseSalt: true},
+			want: ar.RedactionResult{Pcr: pcr, Prefixes: []string{"/home/"}, SaltDisclosed: true,
+				SaltKnown: true, Redacted: 2, Resolved: 1, ReducedAssurance: true},
+			wantName: "/home/user/tool",
+		},
+		{
+			name: "Withheld Salt Known",
+			conf: &ar.RedactionConfig{Prefixes: []string{"/home/user/tool"},
+				Salt: "env:CMC_TEST_SALT"},
+			verifierSalt: true,
+			want: ar.RedactionResult{Pcr: pcr, Prefixes: []string{"/home/user/tool"},
+				SaltKnown: true, Redacted: 1, Resolved: 1},
+			wantName: "/home/user/tool",
+		},
+		{
+			name: "Withheld Salt Unknown",
+			conf: &ar.RedactionConfig{Prefixes: []string{"/home/user/tool"}, Salt: "env:CMC_TEST_SALT"},
+			want: ar.RedactionResult{Pcr: pcr, Prefixes: []string{"/home/user/tool"},
+				Redacted: 1, ReducedAssurance: true},
+			wantName: "/home/user/tool: redacted:" +
+				hex.EncodeToString(ar.RedactName(salt, "/home/user/tool")),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CMC_TEST_SALT", string(salt))
+			if tt.verifierSalt {
+				SetRedactionSalts([][]byte{salt})
+			} else {
+				SetRedactionSalts(nil)
+			}
+			defer SetRedactionSalts(nil)
+
+			// Redact the events on the prover and verify them on the verifier
+			r, err := ima.NewRedactor(tt.conf)
+			if err != nil {
+				t.Fatalf("NewRedactor() error = %v", err)
+			}
+			redacted, redaction, err := r.Redact(events)
+			if err != nil {
+				t.Fatalf("Redact() error = %v", err)
+			}
+			m := ar.Measurement{Artifacts: []ar.Artifact{
+				{Type: "PCR Eventlog", Pcr: &pcr, Events: redacted, Redaction: redaction},
+			}}
+
+			_, pcrResults, details, redactions, ok := recalculatePcrs(m, refs, tpm2.AlgSHA256)
+			if !ok || len(pcrResults) != 1 || !pcrResults[0].Success {
+				t.Fatalf("recalculatePcrs() failed to replay redacted event log: %v", pcrResults)
+			}
+			if len(redactions) != 1 || !reflect.DeepEqual(redactions[0], tt.want) {
+				t.Errorf("redactions = %+v, want %+v", redactions, tt.want)
+			}
+			if details[0].Redacted || details[0].Name != "/usr/bin/bash" {
+				t.Errorf("unredacted result = %+v", details[0])
+			}
+			if !details[1].Redacted || details[1].Name != tt.wantName {
+				t.Errorf("redacted result name = %v, want %v", details[1].Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func dummyDigest(b byte) []byte {
+	d := make([]byte, 32)
+	d[0] = b
+	return d
+}
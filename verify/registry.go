@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Fraunhofer-AISEC/cmc/api"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// MeasurementVerifier verifies a measurement of a vendor specific type, e.g.
+// provided by a plugin, against the reference values of the registered
+// reference value type
+type MeasurementVerifier func(m ar.Measurement, nonce []byte, cas []*x509.Certificate,
+	referenceValues []ar.ReferenceValue) (*ar.MeasurementResult, bool)
+
+type vendorVerifier struct {
+	refValType string
+	verify     MeasurementVerifier
+}
+
+var (
+	vendorMu        sync.RWMutex
+	vendorVerifiers = map[string]vendorVerifier{}
+	vendorRefVals   = map[string]bool{}
+)
+
+// RegisterVerifier registers the verification logic for a vendor namespaced
+// measurement type, e.g. "com.example/Sensor Measurement", and the matching
+// reference value type, e.g. "com.example/Sensor Reference Value". Both types
+// must belong to the same vendor namespace. Vendor measurements are not
+// considered as hardware trust anchor
+func RegisterVerifier(measurementType, refValType string, f MeasurementVerifier) error {
+
+	if f == nil {
+		return errors.New("no verifier specified")
+	}
+	mVendor, _, err := api.SplitVendorType(measurementType)
+	if err != nil {
+		return fmt.Errorf("invalid measurement type: %w", err)
+	}
+	rVendor, _, err := api.SplitVendorType(refValType)
+	if err != nil {
+		return fmt.Errorf("invalid reference value type: %w", err)
+	}
+	if mVendor != rVendor {
+		return fmt.Errorf("vendor namespaces of %v and %v do not match", measurementType,
+			refValType)
+	}
+
+	vendorMu.Lock()
+	defer vendorMu.Unlock()
+
+	if _, ok := vendorVerifiers[measurementType]; ok {
+		return fmt.Errorf("verifier for %v already registered", measurementType)
+	}
+	vendorVerifiers[measurementType] = vendorVerifier{
+		refValType: refValType,
+		verify:     f,
+	}
+	vendorRefVals[refValType] = true
+
+	return nil
+}
+
+func getVendorVerifier(measurementType string) (vendorVerifier, bool) {
+	vendorMu.RLock()
+	defer vendorMu.RUnlock()
+	v, ok := vendorVerifiers[measurementType]
+	return v, ok
+}
+
+func isVendorRefValType(refValType string) bool {
+	vendorMu.RLock()
+	defer vendorMu.RUnlock()
+	return vendorRefVals[refValType]
+}
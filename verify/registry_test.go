@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
+	"github.com/Fraunhofer-AISEC/cmc/generate"
+)
+
+func verifyTestVendorMeasurement(m ar.Measurement, nonce []byte, _ []*x509.Certificate,
+	referenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
+	result := &ar.MeasurementResult{Type: "com.example/Test Result"}
+	ok := bytes.Equal(m.Evidence, nonce) && len(referenceValues) == 1
+	result.Summary.Success = ok
+	return result, ok
+}
+
+func Test_RegisterVerifier(t *testing.T) {
+	tests := []struct {
+		name            string
+		measurementType string
+		refValType      string
+		f               MeasurementVerifier
+		wantErr         bool
+	}{
+		{"Valid", "com.example/Register Measurement", "com.example/Register Reference Value",
+			verifyTestVendorMeasurement, false},
+		{"Already Registered", "com.example/Register Measurement",
+			"com.example/Register Reference Value", verifyTestVendorMeasurement, true},
+		{"Not Namespaced", "Register Measurement", "com.example/Register Reference Value",
+			verifyTestVendorMeasurement, true},
+		{"Builtin Type", "TPM Measurement", "TPM Reference Value",
+			verifyTestVendorMeasurement, true},
+		{"Different Vendors", "com.example/Other Measurement",
+			"org.example/Other Reference Value", verifyTestVendorMeasurement, true},
+		{"Invalid Vendor", "Example/Other Measurement", "Example/Other Reference Value",
+			verifyTestVendorMeasurement, true},
+		{"No Verifier", "com.example/Nil Measurement", "com.example/Nil Reference Value",
+			nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterVerifier(tt.measurementType, tt.refValType, tt.f)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RegisterVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyVendorMeasurement(t *testing.T) {
+
+	err := RegisterVerifier("com.example/Test Measurement", "com.example/Test Reference Value",
+		verifyTestVendorMeasurement)
+	if err != nil {
+		t.Fatalf("RegisterVerifier() error = %v", err)
+	}
+
+	nonce := []byte{0x01, 0x02, 0x03}
+
+	// The vendor measurement is no hardware measurement, which limits the
+	// certification level to 1
+	f, err := fixtures.Generate(fixtures.Options{Nonce: nonce})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	f.RtmManifest.CertificationLevel = 1
+	f.OsManifest.CertificationLevel = 1
+	f.OsManifest.ReferenceValues = []ar.ReferenceValue{
+		{Type: "com.example/Test Reference Value", Name: "Test"},
+	}
+	f.AppManifests = nil
+	f.DeviceDescription.AppDescriptions = nil
+	if err := f.SignMetadata(); err != nil {
+		t.Fatalf("failed to sign metadata: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		mType    string
+		evidence []byte
+		want     bool
+	}{
+		{"Valid", "com.example/Test Measurement", nonce, true},
+		{"Invalid Nonce", "com.example/Test Measurement", []byte{0xff}, false},
+		{"Unregistered Type", "com.example/Unknown Measurement", nonce, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := ar.AttestationReport{
+				Type: "Attestation Report",
+				Measurements: []ar.Measurement{
+					{Type: tt.mType, Evidence: tt.evidence},
+				},
+				RtmManifest:       f.Metadata[0],
+				OsManifest:        f.Metadata[1],
+				DeviceDescription: f.Metadata[2],
+			}
+
+			data, err := f.Serializer.Marshal(report)
+			if err != nil {
+				t.Fatalf("failed to marshal the Attestation Report: %v", err)
+			}
+			arSigned, err := generate.Sign(data, f.Ik, f.Serializer)
+			if err != nil {
+				t.Fatalf("failed to sign Attestion Report: %v", err)
+			}
+
+			got := Verify(arSigned, nonce, f.CaPem(), nil, 0, "")
+			if got.Success != tt.want {
+				t.Errorf("Verify() = %v, want %v", got.Success, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+// runtimeDigestSizes are the digest sizes of the hash algorithms supported for
+// runtime measurements
+var runtimeDigestSizes = map[string]int{
+	"SHA-256": 32,
+	"SHA-384": 48,
+	"SHA-512": 64,
+}
+
+// verifyRuntimeMeasurements verifies the freshness and the consistency of the
+// measurements recorded at runtime via the measure API of the prover. There
+// are no reference values for runtime measurements, they are passed to the
+// policies in the order they were recorded. As the measurements are not
+// anchored in hardware, they are only protected by the report signature
+func verifyRuntimeMeasurements(m ar.Measurement, nonce []byte) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying runtime measurements")
+
+	result := &ar.MeasurementResult{
+		Type:          "Runtime Result",
+		RuntimeResult: &ar.RuntimeResult{Events: m.RuntimeEvents},
+	}
+	ok := true
+
+	// The evidence of runtime measurements is just the nonce
+	if !bytes.Equal(m.Evidence, nonce) {
+		log.Tracef("Nonces mismatch: supplied nonce: %v, report nonce = %v",
+			hex.EncodeToString(nonce), hex.EncodeToString(m.Evidence))
+		ok = false
+		result.Freshness.Success = false
+		result.Freshness.Expected = hex.EncodeToString(m.Evidence)
+		result.Freshness.Got = hex.EncodeToString(nonce)
+	} else {
+		result.Freshness.Success = true
+	}
+
+	if len(m.RuntimeEvents) == 0 {
+		log.Tracef("Runtime measurement does not contain any events")
+		result.Summary.SetErr(ar.DetailsNotPresent)
+		return result, false
+	}
+
+	for i, e := range m.RuntimeEvents {
+		r := ar.DigestResult{
+			Name:        e.Name,
+			Digest:      hex.EncodeToString(e.Digest),
+			Description: e.HashAlg,
+			Success:     true,
+		}
+		size, known := runtimeDigestSizes[e.HashAlg]
+		switch {
+		case !known:
+			log.Tracef("Unsupported hash algorithm %v of runtime measurement %v", e.HashAlg, i)
+			result.Summary.SetErr(ar.UnsupportedAlgorithm)
+			r.Success = false
+		case len(e.Digest) != size:
+			log.Tracef("Invalid %v digest length %v of runtime measurement %v", e.HashAlg,
+				len(e.Digest), i)
+			result.Summary.SetErr(ar.EvidenceLength)
+			r.Success = false
+		case e.Index != i:
+			log.Tracef("Runtime measurement %v has index %v", i, e.Index)
+			result.Summary.SetErr(ar.ParseEvidence)
+			r.Success = false
+		}
+		if !r.Success {
+			r.Type = "Measurement"
+			ok = false
+		}
+		result.Artifacts = append(result.Artifacts, r)
+	}
+
+	if ok {
+		result.Summary.Success = true
+	}
+
+	return result, ok
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"testing"
+
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+func Test_verifyRuntimeMeasurements(t *testing.T) {
+	nonce := []byte{0x1, 0x2, 0x3}
+	event := func(i int, alg string, size int) ar.RuntimeEvent {
+		return ar.RuntimeEvent{Index: i, Name: "app", HashAlg: alg, Digest: make([]byte, size)}
+	}
+
+	tests := []struct {
+		name     string
+		evidence []byte
+		events   []ar.RuntimeEvent
+		want     bool
+		wantCode ar.ErrorCode
+	}{
+		{"Success", nonce, []ar.RuntimeEvent{event(0, "SHA-256", 32), event(1, "SHA-384", 48)},
+			true, ar.NotSet},
+		{"Nonce Mismatch", []byte{0x4}, []ar.RuntimeEvent{event(0, "SHA-256", 32)}, false,
+			ar.NotSet},
+		{"No Events", nonce, nil, false, ar.DetailsNotPresent},
+		{"Unsupported Algorithm", nonce, []ar.RuntimeEvent{event(0, "SHA-1", 20)}, false,
+			ar.UnsupportedAlgorithm},
+		{"Digest Length", nonce, []ar.RuntimeEvent{event(0, "SHA-256", 48)}, false,
+			ar.EvidenceLength},
+		{"Index Gap", nonce, []ar.RuntimeEvent{event(0, "SHA-256", 32), event(2, "SHA-256", 32)},
+			false, ar.ParseEvidence},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := ar.Measurement{
+				Type:          "Runtime Measurement",
+				Evidence:      tt.evidence,
+				RuntimeEvents: tt.events,
+			}
+			r, ok := verifyRuntimeMeasurements(m, nonce)
+			if ok != tt.want {
+				t.Fatalf("verifyRuntimeMeasurements() = %v, want %v", ok, tt.want)
+			}
+			if r.Summary.ErrorCode != tt.wantCode {
+				t.Errorf("error code = %v, want %v", r.Summary.ErrorCode, tt.wantCode)
+			}
+			if r.RuntimeResult == nil || len(r.RuntimeResult.Events) != len(tt.events) {
+				t.Errorf("runtime result does not contain the events")
+			}
+		})
+	}
+}
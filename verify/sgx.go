@@ -132,6 +132,7 @@ func verifySgxMeasurements(sgxM ar.Measurement, nonce []byte, intelCache string,
 		}
 	} else {
 		log.Tracef("Unknown quote type (tee_type: %X)\n", quoteType)
+		result.Summary.SetErr(ar.ParseEvidence)
 		return result, false
 	}
 
@@ -155,8 +156,8 @@ func verifySgxMeasurements(sgxM ar.Measurement, nonce []byte, intelCache string,
 
 	// Parse certificate chain
 	referenceCerts, err := parseCertificates(sgxM.Certs, true)
-	if err != nil {
-		log.Tracef("Failed to parse reference certificates: %v", err)
+	if err != nil || referenceCerts.TCBSigningCert == nil || referenceCerts.RootCACert == nil {
+		log.Tracef("Failed to parse reference certificates (TCBSigningCert + IntelRootCACert): %v", err)
 		result.Summary.SetErr(ar.ParseCert)
 		return result, false
 	}
@@ -182,6 +183,11 @@ func verifySgxMeasurements(sgxM ar.Measurement, nonce []byte, intelCache string,
 		result.Summary.SetErr(ar.ParseCA)
 		return result, false
 	}
+	if quoteCerts.PCKCert == nil || len(quoteCerts.PCKCert.Extensions) <= SGX_EXTENSION_INDEX {
+		log.Tracef("PCK cert or its SGX extensions missing")
+		result.Summary.SetErr(ar.ParseCert)
+		return result, false
+	}
 
 	// Check root public key
 	quotePublicKeyBytes, err := x509.MarshalPKIXPublicKey(quoteCerts.RootCACert.PublicKey)
@@ -220,8 +226,13 @@ func verifySgxMeasurements(sgxM ar.Measurement, nonce []byte, intelCache string,
 		string(sgxReferenceValue.Sgx.Collateral.TcbInfo),
 		referenceCerts.TCBSigningCert, sgxExtensions, [16]byte{}, SGX_QUOTE_TYPE)
 	if !result.SgxResult.TcbInfoCheck.Summary.Success {
-		log.Tracef("Failed to verify TCB info structure: %v", err)
-		result.Summary.SetErr(ar.VerifyTcbInfo)
+		log.Tracef("Failed to verify TCB info structure: %v",
+			result.SgxResult.TcbInfoCheck.Summary.ErrorCode)
+		if result.SgxResult.TcbInfoCheck.Summary.ErrorCode == ar.TcbLevelRevoked {
+			result.Summary.SetErr(ar.TcbLevelRevoked)
+		} else {
+			result.Summary.SetErr(ar.VerifyTcbInfo)
+		}
 		return result, false
 	}
 
@@ -235,12 +246,16 @@ func verifySgxMeasurements(sgxM ar.Measurement, nonce []byte, intelCache string,
 
 	qeIdentityResult, err := VerifyQEIdentity(&sgxQuote.QuoteSignatureData.QEReport, &qeIdentity,
 		string(sgxReferenceValue.Sgx.Collateral.QeIdentity), referenceCerts.TCBSigningCert, SGX_QUOTE_TYPE)
-	if err != nil {
+	result.SgxResult.QeIdentityCheck = qeIdentityResult
+	if err != nil || !qeIdentityResult.Summary.Success {
 		log.Tracef("Failed to verify QE Identity structure: %v", err)
-		result.Summary.SetErr(ar.VerifyQEIdentityErr)
+		if qeIdentityResult.TcbLevelStatus == string(Revoked) {
+			result.Summary.SetErr(ar.TcbLevelRevoked)
+		} else {
+			result.Summary.SetErr(ar.VerifyQEIdentityErr)
+		}
 		return result, false
 	}
-	result.SgxResult.QeIdentityCheck = qeIdentityResult
 
 	// Verify Quote Signature
 	sig, ret := VerifyIntelQuoteSignature(sgxM.Evidence, sgxQuote.QuoteSignatureData,
@@ -16,14 +16,23 @@
 package verify
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 func Test_verifySgxMeasurements(t *testing.T) {
@@ -371,7 +380,7 @@ func Test_verifySgxMeasurements(t *testing.T) {
 			want: false,
 		},
 	}
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	log.Trace("Fetching TcbInfo")
 	tcbInfoSgx, err := fetchLatestTcbInfo(false, fmspc_sgx)
@@ -405,6 +414,141 @@ func Test_verifySgxMeasurements(t *testing.T) {
 	}
 }
 
+// createTcbInfo creates a TCB info with a single TCB level for the SVNs signed
+// with the key as returned by the Intel PCS
+func createTcbInfo(t *testing.T, key *ecdsa.PrivateKey, svn byte, status string,
+	nextUpdate time.Time) (*TcbInfo, string) {
+
+	level := TcbLevel{TcbStatus: status, TcbDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for i := 0; i < 16; i++ {
+		level.Tcb.SgxTcbComponents = append(level.Tcb.SgxTcbComponents, TcbComponent{Svn: svn})
+	}
+	level.Tcb.PceSvn = 13
+
+	tcbInfo := &TcbInfo{
+		TcbInfo: TcbInfoBody{
+			Id:         "SGX",
+			Version:    3,
+			IssueDate:  time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+			NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+			Fmspc:      []byte{0x00, 0x70, 0x6a, 0x10, 0x00, 0x00},
+			PceId:      []byte{0x00, 0x00},
+			TcbLevels:  []TcbLevel{level},
+		},
+	}
+	body, err := json.Marshal(tcbInfo.TcbInfo)
+	if err != nil {
+		t.Fatalf("failed to marshal TCB info: %v", err)
+	}
+	digest := sha256.Sum256(body)
+	r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign TCB info: %v", err)
+	}
+	tcbInfo.Signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+
+	raw := fmt.Sprintf(`{"tcbInfo":%s,"signature":"%s"}`, body,
+		hex.EncodeToString(tcbInfo.Signature))
+	return tcbInfo, raw
+}
+
+func Test_verifyTcbInfoSgx(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	cert := &x509.Certificate{PublicKey: &key.PublicKey}
+
+	var ext SGXExtensionsValue
+	ext.Fmspc.Value = []byte{0x00, 0x70, 0x6a, 0x10, 0x00, 0x00}
+	ext.PceId.Value = []byte{0x00, 0x00}
+	ext.Tcb.Value.PceSvn.Value = 13
+	ext.Tcb.Value.Comp_01.Value = 7
+	ext.Tcb.Value.Comp_02.Value = 7
+
+	valid := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		key        *ecdsa.PrivateKey
+		svn        byte
+		status     string
+		nextUpdate time.Time
+		want       ar.ErrorCode
+		wantStatus string
+	}{
+		{"Up To Date", key, 0, "UpToDate", valid, ar.NotSet, "UpToDate"},
+		{"Out Of Date", key, 0, "OutOfDate", valid, ar.NotSet, "OutOfDate"},
+		{"Revoked", key, 0, string(Revoked), valid, ar.TcbLevelRevoked, string(Revoked)},
+		{"Unsupported TCB", key, 8, "UpToDate", valid, ar.TcbLevelUnsupported, ""},
+		{"Expired", key, 0, "UpToDate", time.Now().Add(-time.Hour), ar.TcbInfoExpired, ""},
+		{"Invalid Signature", other, 0, "UpToDate", valid, ar.VerifyTcbInfo, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcbInfo, raw := createTcbInfo(t, tt.key, tt.svn, tt.status, tt.nextUpdate)
+			got := verifyTcbInfo(tcbInfo, raw, cert, ext, [16]byte{}, SGX_QUOTE_TYPE)
+			if got.Summary.Success != (tt.want == ar.NotSet) || got.Summary.ErrorCode != tt.want {
+				t.Errorf("verifyTcbInfo() = %v (%v), want error code %v", got.Summary.Success,
+					got.Summary.ErrorCode, tt.want)
+			}
+			if got.TcbLevelStatus != tt.wantStatus {
+				t.Errorf("verifyTcbInfo() status = %v, want %v", got.TcbLevelStatus, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_verifySgxMeasurementsMalformed(t *testing.T) {
+
+	refVal := ar.ReferenceValue{
+		Type:   "SGX Reference Value",
+		Sha256: validSGXMeasurement,
+		Sgx: &ar.SGXDetails{
+			Collateral: ar.IntelCollateral{TeeType: tee_type_sgx},
+		},
+	}
+	truncated := validSGXQuote[:SGX_QUOTE_MIN_SIZE+16]
+	garbage := bytes.Repeat([]byte{0xff}, SGX_QUOTE_MIN_SIZE+16)
+	unknownTee := refVal
+	unknownTee.Sgx = &ar.SGXDetails{Collateral: ar.IntelCollateral{TeeType: 0x81}}
+
+	tests := []struct {
+		name     string
+		evidence []byte
+		refVals  []ar.ReferenceValue
+		want     ar.ErrorCode
+	}{
+		{"Short Quote", validSGXQuote[:100], []ar.ReferenceValue{refVal}, ar.ParseEvidence},
+		{"Truncated Quote", truncated, []ar.ReferenceValue{refVal}, ar.ParseEvidence},
+		{"Garbage Quote", garbage, []ar.ReferenceValue{refVal}, ar.ParseEvidence},
+		{"Unknown Quote Type", validSGXQuote, []ar.ReferenceValue{unknownTee}, ar.ParseEvidence},
+		{"Missing Reference Value", validSGXQuote, nil, ar.RefValNotPresent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := ar.Measurement{
+				Type:     "SGX Measurement",
+				Evidence: tt.evidence,
+				Certs:    internal.WriteCertsPem([]*x509.Certificate{TCBSigningCert, SGXRootCaCert}),
+			}
+			res, ok := verifySgxMeasurements(m, validSGXNonce, "", tt.refVals)
+			if ok {
+				t.Fatalf("verifySgxMeasurements() succeeded for malformed quote")
+			}
+			if res.Summary.ErrorCode != tt.want {
+				t.Errorf("verifySgxMeasurements() error code = %v, want %v",
+					res.Summary.ErrorCode, tt.want)
+			}
+		})
+	}
+}
+
 func TestParseSGXExtensions(t *testing.T) {
 	type args struct {
 		extensions []byte
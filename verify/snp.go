@@ -23,6 +23,7 @@ import (
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	"strconv"
@@ -88,11 +89,25 @@ const (
 	VLEK
 )
 
-func verifySnpMeasurements(snpM ar.Measurement, nonce []byte, referenceValues []ar.ReferenceValue,
+func verifySnpMeasurements(snpM ar.Measurement, nonce []byte, cache string,
+	referenceValues []ar.ReferenceValue,
 ) (*ar.MeasurementResult, bool) {
 
 	log.Trace("Verifying SNP measurements")
 
+	// The nonce is directly embedded as report data
+	nonce64 := make([]byte, 64)
+	copy(nonce64, nonce)
+
+	return verifySnpReport(snpM, nonce64, cache, referenceValues)
+}
+
+// verifySnpReport verifies the SNP attestation report of the measurement,
+// which must contain the specified report data, against the reference values
+func verifySnpReport(snpM ar.Measurement, reportData []byte, cache string,
+	referenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
+
 	result := &ar.MeasurementResult{
 		Type:      "SNP Result",
 		SnpResult: &ar.SnpResult{},
@@ -129,27 +144,27 @@ func verifySnpMeasurements(snpM ar.Measurement, nonce []byte, referenceValues []
 		result.Summary.SetErr(ar.ParseEvidence)
 		return result, false
 	}
+	result.SnpResult.ChipId = hex.EncodeToString(s.ChipId[:])
 
 	// Compare nonce for freshness (called report data in the SNP attestation report structure)
-	nonce64 := make([]byte, 64)
-	copy(nonce64, nonce)
-	if cmp := bytes.Compare(s.ReportData[:], nonce64); cmp != 0 {
+	if cmp := bytes.Compare(s.ReportData[:], reportData); cmp != 0 {
 		log.Tracef("Nonces mismatch: Supplied Nonce = %v, Nonce in SNP Report = %v)",
-			hex.EncodeToString(nonce), hex.EncodeToString(s.ReportData[:]))
+			hex.EncodeToString(reportData), hex.EncodeToString(s.ReportData[:]))
 		result.Freshness.Success = false
-		result.Freshness.Expected = hex.EncodeToString(nonce)
+		result.Freshness.Expected = hex.EncodeToString(reportData)
 		result.Freshness.Got = hex.EncodeToString(s.ReportData[:])
 		ok = false
 	} else {
 		result.Freshness.Success = true
 	}
 
-	certs, err := internal.ParseCertsDer(snpM.Certs)
+	certs, source, err := getSnpCertChain(snpM.Certs, &s, cache)
 	if err != nil {
-		log.Tracef("Failed to parse certificates: %v", err)
+		log.Tracef("Failed to get SNP certificate chain: %v", err)
 		result.Summary.SetErr(ar.ParseCert)
 		return result, false
 	}
+	result.SnpResult.CertSource = source
 
 	// Verify Signature, created with SNP VCEK private key
 	sig, ret := verifySnpSignature(snpM.Evidence, s, certs, snpReferenceValue.Snp.CaFingerprint)
@@ -199,6 +214,13 @@ func verifySnpMeasurements(snpM ar.Measurement, nonce []byte, referenceValues []
 	if !ret {
 		ok = false
 	}
+	// Verify the ID block and ID authentication information if specified
+	if snpReferenceValue.Snp.IdBlock != nil {
+		result.SnpResult.IdBlockCheck, ret = verifySnpIdBlock(s, snpReferenceValue.Snp.IdBlock)
+		if !ret {
+			ok = false
+		}
+	}
 	// Verify the SNP firmware version
 	result.SnpResult.FwCheck, ret = verifySnpFw(s, snpReferenceValue.Snp.Fw)
 	if !ret {
@@ -220,6 +242,56 @@ func verifySnpMeasurements(snpM ar.Measurement, nonce []byte, referenceValues []
 	return result, ok
 }
 
+// getSnpCertChain returns the SNP certificate chain for the report and the
+// source of the chain. Certificates embedded in the measurement are preferred.
+// If only the VCEK or VLEK is embedded, the CA chain is completed from the
+// cache or the AMD KDS. If no certificates are embedded, the VCEK chain for the
+// chip ID and reported TCB is fetched from the cache or the AMD KDS
+func getSnpCertChain(certsRaw [][]byte, s *snpreport, cache string,
+) ([]*x509.Certificate, string, error) {
+
+	if len(certsRaw) == 0 {
+		akType, err := GetAkType(s.KeySelection)
+		if err != nil {
+			return nil, "", err
+		}
+		if akType != VCEK {
+			return nil, "", errors.New("VLEK certificate chain must be embedded in the measurement")
+		}
+		log.Trace("No embedded SNP certificates, fetching VCEK chain")
+		return GetSnpVcekChain(s.ChipId, s.ReportedTcb, cache)
+	}
+
+	certs, err := internal.ParseCertsDer(certsRaw)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse certificates: %w", err)
+	}
+
+	if len(certs) == 1 {
+		akType, err := GetAkType(s.KeySelection)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Trace("Embedded SNP certificates contain only the signing certificate, fetching CA chain")
+		ca, err := GetSnpCaChain(akType, cache)
+		if err != nil {
+			return nil, "", err
+		}
+		certs = append(certs, ca...)
+	}
+
+	// The embedded certificates may be in any order, the verification expects
+	// the VCEK or VLEK first and the ARK last. Certificates, which do not form
+	// a chain, are kept as they are and fail the certificate chain verification
+	if ordered, err := internal.OrderChain(certs); err == nil {
+		certs = ordered
+	} else {
+		log.Tracef("Failed to order SNP certificate chain: %v", err)
+	}
+
+	return certs, SnpCertSourceReport, nil
+}
+
 func verifySnpVersion(expected, got uint32) (ar.Result, bool) {
 	r := ar.Result{}
 	ok := expected == got
@@ -285,6 +357,97 @@ func verifySnpPolicy(policy uint64, v ar.SnpPolicy) (ar.PolicyCheck, bool) {
 	return r, ok
 }
 
+// verifySnpIdBlock compares the digest of the ID key, which signed the ID
+// block, and optionally the digest of the author key, which signed the ID key,
+// as well as the family and image ID from the ID block to the reference values
+func verifySnpIdBlock(s snpreport, v *ar.SnpIdBlock) (*ar.IdBlockCheck, bool) {
+
+	r := &ar.IdBlockCheck{}
+
+	if !snpIdBlockPresent(s) {
+		log.Trace("SNP guest was launched without ID block")
+		r.IdKeyDigest.Expected = hex.EncodeToString(v.IdKeyDigest)
+		r.Summary.SetErr(ar.IdBlockNotPresent)
+		return r, false
+	}
+
+	r.IdKeyDigest = compareSnpValue(s.IdKeyDigest[:], v.IdKeyDigest)
+	ok := r.IdKeyDigest.Success
+
+	if len(v.AuthorKeyDigest) > 0 {
+		var got []byte
+		if snpAuthorKeyPresent(s) {
+			got = s.AuthorKeyDigest[:]
+		}
+		res := compareSnpValue(got, v.AuthorKeyDigest)
+		r.AuthorKeyDigest = &res
+		ok = ok && res.Success
+	}
+	if len(v.FamilyId) > 0 {
+		res := compareSnpValue(s.FamilyId[:], v.FamilyId)
+		r.FamilyId = &res
+		ok = ok && res.Success
+	}
+	if len(v.ImageId) > 0 {
+		res := compareSnpValue(s.ImageId[:], v.ImageId)
+		r.ImageId = &res
+		ok = ok && res.Success
+	}
+
+	if !ok {
+		log.Trace("SNP ID block does not match the reference values")
+	}
+	r.Summary.Success = ok
+
+	return r, ok
+}
+
+func compareSnpValue(got, expected []byte) ar.Result {
+	if bytes.Equal(got, expected) {
+		return ar.Result{Success: true}
+	}
+	return ar.Result{
+		Success:  false,
+		Expected: hex.EncodeToString(expected),
+		Got:      hex.EncodeToString(got),
+	}
+}
+
+// snpIdBlockPresent returns whether the guest was launched with an ID block,
+// otherwise the ID key digest is zero
+func snpIdBlockPresent(s snpreport) bool {
+	return s.IdKeyDigest != [48]byte{}
+}
+
+// snpAuthorKeyPresent returns whether the ID authentication information
+// contained an author key (AUTHOR_KEY_EN)
+func snpAuthorKeyPresent(s snpreport) bool {
+	return s.KeySelection&0x1 != 0
+}
+
+// GetSnpLaunch returns the guest policy and the ID block information of the
+// SNP report
+func GetSnpLaunch(report []byte) (*ar.SnpLaunch, error) {
+	s, err := DecodeSnpReport(report)
+	if err != nil {
+		return nil, err
+	}
+	l := &ar.SnpLaunch{
+		Policy:    s.Policy,
+		IdBlock:   snpIdBlockPresent(s),
+		AuthorKey: snpAuthorKeyPresent(s),
+	}
+	if l.IdBlock {
+		l.IdKeyDigest = s.IdKeyDigest[:]
+		l.FamilyId = s.FamilyId[:]
+		l.ImageId = s.ImageId[:]
+	}
+	if l.AuthorKey {
+		l.AuthorKeyDigest = s.AuthorKeyDigest[:]
+	}
+	return l, nil
+}
+
 func verifySnpFw(s snpreport, v ar.SnpFw) (ar.VersionCheck, bool) {
 
 	build := min([]uint8{s.CurrentBuild, s.CommittedBuild})
@@ -423,8 +586,14 @@ func verifySnpSignature(
 	log.Trace("Successfully verified SNP report signature")
 	result.SignCheck.Success = true
 
-	// Verify the SNP certificate chain
+	// Verify the SNP certificate chain. The root CA must be the self-signed AMD
+	// root key (ARK), which is pinned via the reference value fingerprint
 	ca := certs[len(certs)-1]
+	if err := ca.CheckSignatureFrom(ca); err != nil {
+		log.Tracef("SNP root CA is not self-signed: %v", err)
+		result.CertChainCheck.SetErr(ar.VerifyCertChain)
+		return result, false
+	}
 	x509Chains, err := internal.VerifyCertChain(certs[:len(certs)-1], []*x509.Certificate{ca})
 	if err != nil {
 		log.Tracef("Failed to verify certificate chain: %v", err)
@@ -455,13 +624,7 @@ func verifySnpSignature(
 	result.CertChainCheck.Success = true
 
 	//Store details from (all) validated certificate chain(s) in the report
-	for _, chain := range x509Chains {
-		chainExtracted := []ar.X509CertExtracted{}
-		for _, cert := range chain {
-			chainExtracted = append(chainExtracted, ar.ExtractX509Infos(cert))
-		}
-		result.ValidatedCerts = append(result.ValidatedCerts, chainExtracted)
-	}
+	result.AddValidatedChains(x509Chains)
 
 	return result, true
 }
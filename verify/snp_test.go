@@ -16,17 +16,24 @@
 package verify
 
 import (
+	"bytes"
 	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 func Test_verifySnpMeasurements(t *testing.T) {
 
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	type args struct {
 		snpM  *ar.Measurement
@@ -346,13 +353,255 @@ func Test_verifySnpMeasurements(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if _, got := verifySnpMeasurements(*tt.args.snpM, tt.args.nonce, tt.args.snpV); got != tt.want {
+			if _, got := verifySnpMeasurements(*tt.args.snpM, tt.args.nonce, "", tt.args.snpV); got != tt.want {
 				t.Errorf("verifySnpMeasurements() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func Test_getSnpCertChain(t *testing.T) {
+
+	s, err := DecodeSnpReport(validReport)
+	if err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+
+	// Serve the VCEK and the CA chain as AMD KDS
+	caChain := append(internal.WriteCertPem(askMilan), internal.WriteCertPem(arkMilan)...)
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/cert_chain"):
+			w.Write(caChain)
+		case strings.HasPrefix(r.URL.Path, "/vcek/v1/Milan/"+hex.EncodeToString(s.ChipId[:])):
+			w.Write(validVcek.Raw)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	kdsUrl := snpKdsUrl
+	snpKdsUrl = srv.URL
+	defer func() { snpKdsUrl = kdsUrl }()
+	snpCollateralCache.Flush()
+	defer snpCollateralCache.Flush()
+
+	cache := t.TempDir()
+
+	tests := []struct {
+		name         string
+		certs        [][]byte
+		cache        string
+		wantSource   string
+		wantRequests int
+		wantErr      bool
+	}{
+		{
+			name:         "Embedded Chain",
+			certs:        validCertChain,
+			wantSource:   SnpCertSourceReport,
+			wantRequests: 0,
+		},
+		{
+			name:         "Embedded VCEK",
+			certs:        [][]byte{validVcek.Raw},
+			wantSource:   SnpCertSourceReport,
+			wantRequests: 1,
+		},
+		{
+			name:         "KDS",
+			cache:        cache,
+			wantSource:   SnpCertSourceKds,
+			wantRequests: 2,
+		},
+		{
+			name:         "Cache",
+			cache:        cache,
+			wantSource:   SnpCertSourceCache,
+			wantRequests: 0,
+		},
+		{
+			name:         "Shuffled Embedded Chain",
+			certs:        [][]byte{arkMilan.Raw, validVcek.Raw, askMilan.Raw},
+			wantSource:   SnpCertSourceReport,
+			wantRequests: 0,
+		},
+		{
+			name:    "Invalid Embedded Certificate",
+			certs:   [][]byte{{0x30, 0x01}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			certs, source, err := getSnpCertChain(tt.certs, &s, tt.cache)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getSnpCertChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if source != tt.wantSource {
+				t.Errorf("getSnpCertChain() source = %v, want %v", source, tt.wantSource)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("getSnpCertChain() KDS requests = %v, want %v", requests, tt.wantRequests)
+			}
+			if len(certs) != 3 || !certs[0].Equal(validVcek) || !certs[2].Equal(arkMilan) {
+				t.Errorf("getSnpCertChain() returned unexpected chain of length %v", len(certs))
+			}
+		})
+	}
+}
+
+func Test_getSnpCaChainConcurrent(t *testing.T) {
+
+	// Serve the CA chain as AMD KDS, counting the requests
+	caChain := append(internal.WriteCertPem(askMilan), internal.WriteCertPem(arkMilan)...)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(caChain)
+	}))
+	defer srv.Close()
+	kdsUrl := snpKdsUrl
+	snpKdsUrl = srv.URL
+	defer func() { snpKdsUrl = kdsUrl }()
+	snpCollateralCache.Flush()
+	defer snpCollateralCache.Flush()
+
+	// Concurrent verifications without cache folder share a single request
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ca, err := GetSnpCaChain(VCEK, ""); err != nil || !ca[1].Equal(arkMilan) {
+				t.Errorf("GetSnpCaChain() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests != 1 {
+		t.Errorf("KDS requests = %v, want 1", requests)
+	}
+
+	// After a flush, the chain is fetched again
+	snpCollateralCache.Flush()
+	if _, err := GetSnpCaChain(VCEK, ""); err != nil {
+		t.Fatalf("GetSnpCaChain() error = %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("KDS requests after flush = %v, want 2", requests)
+	}
+}
+
+func Test_verifySnpIdBlock(t *testing.T) {
+
+	idKey := bytes.Repeat([]byte{0x11}, 48)
+	authorKey := bytes.Repeat([]byte{0x22}, 48)
+	familyId := bytes.Repeat([]byte{0x33}, 16)
+	imageId := bytes.Repeat([]byte{0x44}, 16)
+
+	report := snpreport{KeySelection: 1}
+	copy(report.IdKeyDigest[:], idKey)
+	copy(report.AuthorKeyDigest[:], authorKey)
+	copy(report.FamilyId[:], familyId)
+	copy(report.ImageId[:], imageId)
+
+	noAuthorKey := report
+	noAuthorKey.KeySelection = 0
+
+	tests := []struct {
+		name        string
+		report      snpreport
+		ref         ar.SnpIdBlock
+		want        bool
+		wantErrCode ar.ErrorCode
+	}{
+		{"Valid ID Key Only", report, ar.SnpIdBlock{IdKeyDigest: idKey}, true, ar.NotSet},
+		{"Valid All", report, ar.SnpIdBlock{IdKeyDigest: idKey, AuthorKeyDigest: authorKey,
+			FamilyId: familyId, ImageId: imageId}, true, ar.NotSet},
+		{"No ID Block", snpreport{}, ar.SnpIdBlock{IdKeyDigest: idKey}, false,
+			ar.IdBlockNotPresent},
+		{"Invalid ID Key", report, ar.SnpIdBlock{IdKeyDigest: authorKey}, false, ar.NotSet},
+		{"Author Key Not Enabled", noAuthorKey, ar.SnpIdBlock{IdKeyDigest: idKey,
+			AuthorKeyDigest: authorKey}, false, ar.NotSet},
+		{"Invalid Image ID", report, ar.SnpIdBlock{IdKeyDigest: idKey, ImageId: familyId},
+			false, ar.NotSet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := verifySnpIdBlock(tt.report, &tt.ref)
+			if ok != tt.want || got.Summary.Success != tt.want {
+				t.Errorf("verifySnpIdBlock() = %v, want %v", ok, tt.want)
+			}
+			if got.Summary.ErrorCode != tt.wantErrCode {
+				t.Errorf("verifySnpIdBlock() error code = %v, want %v", got.Summary.ErrorCode,
+					tt.wantErrCode)
+			}
+		})
+	}
+}
+
+func Test_GetSnpLaunch(t *testing.T) {
+	launch, err := GetSnpLaunch(validReport)
+	if err != nil {
+		t.Fatalf("GetSnpLaunch() error = %v", err)
+	}
+	s, _ := DecodeSnpReport(validReport)
+	if launch.Policy != s.Policy {
+		t.Errorf("GetSnpLaunch() policy = 0x%x, want 0x%x", launch.Policy, s.Policy)
+	}
+	if launch.IdBlock != snpIdBlockPresent(s) {
+		t.Errorf("GetSnpLaunch() ID block = %v, want %v", launch.IdBlock, snpIdBlockPresent(s))
+	}
+}
+
+func Test_DecodeSnpReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		report    []byte
+		wantNonce []byte
+		wantErr   bool
+	}{
+		{"Valid Report", validReport, validNonce, false},
+		{"Invalid Signature", invalidReportSignature, validNonce, false},
+		{"Truncated Report", validReport[:signature_offset], nil, true},
+		{"Empty Report", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := DecodeSnpReport(tt.report)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeSnpReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if s.Version != validVersion {
+				t.Errorf("version = %v, want %v", s.Version, validVersion)
+			}
+			if s.SignatureAlgo != ecdsa384_with_sha384 {
+				t.Errorf("signature algorithm = %v, want %v", s.SignatureAlgo,
+					ecdsa384_with_sha384)
+			}
+			if !bytes.Equal(s.Measurement[:], validMeasurement) {
+				t.Errorf("measurement = %x, want %x", s.Measurement, validMeasurement)
+			}
+			if tt.wantNonce != nil && !bytes.Equal(s.ReportData[:], tt.wantNonce) {
+				t.Errorf("report data = %x, want %x", s.ReportData, tt.wantNonce)
+			}
+			if s.CurrentBuild != validFw.Build {
+				t.Errorf("firmware build = %v, want %v", s.CurrentBuild, validFw.Build)
+			}
+		})
+	}
+}
+
 func Test_checkMinVersion(t *testing.T) {
 	type args struct {
 		version []uint8
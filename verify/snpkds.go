@@ -0,0 +1,210 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Fraunhofer-AISEC/cmc/cache"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
+)
+
+// Sources of the SNP certificate chain used for verification
+const (
+	SnpCertSourceReport = "report"
+	SnpCertSourceCache  = "cache"
+	SnpCertSourceKds    = "kds"
+)
+
+var (
+	snpKdsUrl        = "https://kdsintf.amd.com"
+	snpKdsProduct    = "Milan"
+	snpKdsMaxRetries = 3
+	// The AMD KDS accepts only one request per 10 seconds
+	snpKdsRetryDelay = 11 * time.Second
+
+	// Allow only one request to the AMD KDS in parallel
+	snpKdsMutex sync.Mutex
+
+	// snpCollateralCache keeps the VCEKs and CA chains in memory, so that
+	// concurrent verifications share a single request to the cache folder or
+	// the AMD KDS
+	snpCollateralCache = cache.New("collateral", cache.Limits{
+		MaxEntries: 1024,
+		MaxBytes:   16 * 1024 * 1024,
+		Ttl:        24 * time.Hour,
+	}, func(b []byte) int64 { return int64(len(b)) })
+)
+
+// GetSnpVcekChain returns the VCEK certificate chain (VCEK, ASK, ARK) for the
+// specified chip ID and TCB. The certificates are taken from the cache folder
+// if present, otherwise they are fetched from the AMD KDS and stored in the
+// cache folder. The source of the VCEK is returned as well
+func GetSnpVcekChain(chipId [64]byte, tcb uint64, cache string) ([]*x509.Certificate, string, error) {
+
+	source := SnpCertSourceCache
+
+	file := fmt.Sprintf("%v_%x.der", hex.EncodeToString(chipId[:]), tcb)
+	der, err := getSnpCollateral(cache, file, func() ([]byte, error) {
+		url := fmt.Sprintf("%v/vcek/v1/%v/%v?blSPL=%v&teeSPL=%v&snpSPL=%v&ucodeSPL=%v",
+			snpKdsUrl, snpKdsProduct, hex.EncodeToString(chipId[:]),
+			tcb&0xFF, (tcb>>8)&0xFF, (tcb>>48)&0xFF, (tcb>>56)&0xFF)
+		der, err := downloadKds(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch VCEK: %w", err)
+		}
+		source = SnpCertSourceKds
+		return der, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	vcek, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse VCEK: %w", err)
+	}
+
+	ca, err := GetSnpCaChain(VCEK, cache)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append([]*x509.Certificate{vcek}, ca...), source, nil
+}
+
+// GetSnpCaChain returns the intermediate CA (ASK or ASVK) and the AMD root
+// CA (ARK) for the specified attestation key type from the cache folder or
+// the AMD KDS
+func GetSnpCaChain(akType AkType, cache string) ([]*x509.Certificate, error) {
+
+	var keyType string
+	switch akType {
+	case VCEK:
+		keyType = "vcek"
+	case VLEK:
+		keyType = "vlek"
+	default:
+		return nil, fmt.Errorf("unknown SNP attestation key type %v", akType)
+	}
+
+	file := fmt.Sprintf("%v_%v_cert_chain.pem", keyType, snpKdsProduct)
+	data, err := getSnpCollateral(cache, file, func() ([]byte, error) {
+		data, err := downloadKds(fmt.Sprintf("%v/%v/v1/%v/cert_chain", snpKdsUrl, keyType,
+			snpKdsProduct))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch SNP CA chain: %w", err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := internal.ParseCertsPem(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SNP CA chain: %w", err)
+	}
+	if len(ca) != 2 {
+		return nil, fmt.Errorf("unexpected SNP CA chain length %v, expected 2", len(ca))
+	}
+
+	return ca, nil
+}
+
+// getSnpCollateral returns the file from the in-memory cache, the cache folder
+// or, if not present, downloads it and stores it in the cache folder
+func getSnpCollateral(cache, file string, download func() ([]byte, error)) ([]byte, error) {
+	return snpCollateralCache.GetOrFill(path.Join(cache, file), func() ([]byte, error) {
+		if data, ok := readSnpCache(cache, file); ok {
+			return data, nil
+		}
+		data, err := download()
+		if err != nil {
+			return nil, err
+		}
+		writeSnpCache(cache, file, data)
+		return data, nil
+	})
+}
+
+func readSnpCache(cache, file string) ([]byte, bool) {
+	if cache == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(path.Join(cache, file))
+	if err != nil {
+		log.Tracef("%v not present in cache, will be downloaded", file)
+		return nil, false
+	}
+	log.Tracef("Using cached %v", file)
+	return data, true
+}
+
+func writeSnpCache(cache, file string, data []byte) {
+	if cache == "" {
+		return
+	}
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		log.Warnf("Failed to create SNP cache folder: %v", err)
+		return
+	}
+	if err := os.WriteFile(path.Join(cache, file), data, 0644); err != nil {
+		log.Warnf("Failed to cache %v: %v", file, err)
+		return
+	}
+	log.Tracef("Cached %v", file)
+}
+
+func downloadKds(url string) ([]byte, error) {
+
+	snpKdsMutex.Lock()
+	defer snpKdsMutex.Unlock()
+
+	for i := 0; i < snpKdsMaxRetries; i++ {
+		log.Tracef("Requesting %v", url)
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("error HTTP GET: %w", err)
+		}
+		content, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HTTP body: %w", err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return content, nil
+		case http.StatusTooManyRequests:
+			log.Warnf("AMD KDS blocked request (HTTP 429 - Too many requests). Trying again in %v",
+				snpKdsRetryDelay)
+			time.Sleep(snpKdsRetryDelay)
+		default:
+			return nil, fmt.Errorf("HTTP Response Status: %v (%v)", resp.StatusCode, resp.Status)
+		}
+	}
+
+	return nil, fmt.Errorf("AMD KDS request failed after %v retries", snpKdsMaxRetries)
+}
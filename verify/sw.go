@@ -20,12 +20,13 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"strings"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 )
 
 func verifySwMeasurements(swMeasurement ar.Measurement, nonce []byte, cas []*x509.Certificate,
-	s ar.Serializer, refVals []ar.ReferenceValue) (*ar.MeasurementResult, bool,
+	s ar.Serializer, refVals []ar.ReferenceValue, at time.Time) (*ar.MeasurementResult, bool,
 ) {
 
 	log.Trace("Verifying SW measurements")
@@ -36,7 +37,7 @@ func verifySwMeasurements(swMeasurement ar.Measurement, nonce []byte, cas []*x50
 	ok := true
 
 	// Verify signature and extract evidence, which is just the nonce for the sw driver
-	tr, evidenceNonce, ok := s.VerifyToken(swMeasurement.Evidence, cas)
+	tr, evidenceNonce, ok := s.VerifyTokenAt(swMeasurement.Evidence, cas, at)
 	if !ok {
 		log.Tracef("Failed to verify sw evidence")
 		result.Summary.SetErr(ar.ParseEvidence)
@@ -19,6 +19,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"testing"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 )
@@ -119,7 +120,8 @@ func Test_verifySwMeasurements(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, got := verifySwMeasurements(tt.args.swMeasurement, tt.args.nonce, tt.args.cas, tt.args.s, tt.args.refVals)
+			_, got := verifySwMeasurements(tt.args.swMeasurement, tt.args.nonce, tt.args.cas, tt.args.s, tt.args.refVals,
+				time.Time{})
 			if got != tt.want {
 				t.Errorf("verifySwMeasurements() got = %v, want %v", got, tt.want)
 			}
@@ -17,8 +17,10 @@ package verify
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
@@ -113,6 +115,20 @@ func decodeTdxReportV4(report []byte) (TdxReportV4, error) {
 	return reportStruct, nil
 }
 
+// GetTdxPckCert returns the PCK certificate embedded in the certification data
+// of the TDX quote, which is required to fetch the collateral for the platform
+func GetTdxPckCert(quote []byte) (*x509.Certificate, error) {
+	tdxQuote, err := decodeTdxReportV4(quote)
+	if err != nil {
+		return nil, err
+	}
+	pck := tdxQuote.QuoteSignatureData.QECertData.QECertData.PCKCert
+	if pck == nil {
+		return nil, errors.New("quote does not contain PCK certificate")
+	}
+	return pck, nil
+}
+
 // parse the full quote signature data structure (V4) from buf to sig
 func parseECDSASignatureV4(buf *bytes.Buffer, sig *ECDSA256QuoteSignatureDataStructureV4) error {
 
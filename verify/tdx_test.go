@@ -25,6 +25,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 func fetchLatestTcbInfo(tdx bool, fmspc string) ([]byte, error) {
@@ -535,7 +536,7 @@ func Test_verifyTdxMeasurements(t *testing.T) {
 		},
 	}
 
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	log.Trace("Fetching TcbInfo")
 	tcbInfoTdx, err := fetchLatestTcbInfo(true, fmspc_tdx)
@@ -571,6 +572,35 @@ func Test_verifyTdxMeasurements(t *testing.T) {
 
 }
 
+func Test_GetTdxPckCert(t *testing.T) {
+	tests := []struct {
+		name    string
+		quote   []byte
+		wantErr bool
+	}{
+		{"Valid Quote", tdxQuote, false},
+		{"Truncated Quote", tdxQuote[:600], true},
+		{"Empty Quote", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetTdxPckCert(tt.quote)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetTdxPckCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Subject.CommonName != "Intel SGX PCK Certificate" {
+				t.Errorf("GetTdxPckCert() = %v, want PCK certificate", got.Subject.CommonName)
+			}
+			if _, err := ParseSGXExtensions(got.Extensions[SGX_EXTENSION_INDEX].Value[4:]); err != nil {
+				t.Errorf("failed to parse SGX extensions of PCK certificate: %v", err)
+			}
+		})
+	}
+}
+
 var (
 	tdxQuote = []byte{
 		0x04, 0x00, 0x02, 0x00, 0x81, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
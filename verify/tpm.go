@@ -17,45 +17,113 @@ package verify
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
 	"sort"
 	"strings"
+	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
 )
 
-func verifyTpmMeasurements(tpmM ar.Measurement, nonce []byte, cas []*x509.Certificate, referenceValues []ar.ReferenceValue) (*ar.MeasurementResult, bool) {
+func verifyTpmMeasurements(tpmM ar.Measurement, nonce []byte, cas []*x509.Certificate,
+	referenceValues []ar.ReferenceValue, at time.Time,
+) (*ar.MeasurementResult, bool) {
+
+	log.Trace("Verifying TPM measurements")
+
+	mCerts, err := internal.ParseCertsDer(tpmM.Certs)
+	if err != nil || len(mCerts) == 0 {
+		log.Tracef("Failed to parse measurement certs: %v", err)
+		result := &ar.MeasurementResult{
+			Type:      "TPM Result",
+			TpmResult: &ar.TpmResult{},
+		}
+		result.Signature.CertChainCheck.SetErr(ar.ParseCert)
+		result.Summary.Success = false
+		return result, false
+	}
+
+	result, ok := verifyTpmQuote(tpmM, nonce, mCerts[0].PublicKey, referenceValues)
+	if result.TpmResult == nil {
+		return result, false
+	}
+
+	x509Chains, err := internal.VerifyCertChainAt(mCerts, cas, at)
+	if err != nil {
+		log.Tracef("Failed to verify certificate chain: %v", err)
+		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
+		ok = false
+	} else {
+		result.Signature.CertChainCheck.Success = true
+	}
+	log.Trace("Successfully verified TPM certificate chain")
+
+	//Store details from (all) validated certificate chain(s) in the report
+	result.Signature.AddValidatedChains(x509Chains)
+
+	result.Summary.Success = ok
+
+	return result, ok
+}
+
+// verifyTpmQuote verifies the TPM quote of the measurement, signed with the
+// specified public key, against the nonce and the reference values. The
+// public key is not verified
+func verifyTpmQuote(tpmM ar.Measurement, nonce []byte, pub crypto.PublicKey,
+	referenceValues []ar.ReferenceValue,
+) (*ar.MeasurementResult, bool) {
 
 	result := &ar.MeasurementResult{
 		Type:      "TPM Result",
 		TpmResult: &ar.TpmResult{},
 	}
 
-	log.Trace("Verifying TPM measurements")
+	// Extract TPM Quote (TPMS ATTEST) and signature
+	tpmsAttest, err := tpm2.DecodeAttestationData(tpmM.Evidence)
+	if err != nil {
+		log.Tracef("Failed to decode TPM attestation data: %v", err)
+		result.Summary.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+	if tpmsAttest.AttestedQuoteInfo == nil {
+		log.Tracef("TPM attestation data does not contain a quote")
+		result.Summary.SetErr(ar.ParseEvidence)
+		return result, false
+	}
+	sel := tpmsAttest.AttestedQuoteInfo.PCRSelection
+
+	// The PCRs provided in the measurement must exactly match the quoted PCRs
+	if !checkPcrSelection(sel, tpmM.Artifacts) {
+		result.Summary.SetErr(ar.PcrSelectionMismatch)
+		return result, false
+	}
 
 	// Extend the reference values to re-calculate the PCR value and evaluate it against the measured
 	// PCR value. In case of a measurement list, also extend the measured values to re-calculate
 	// the measured PCR value
-	calculatedPcrs, pcrResult, artifacts, ok := recalculatePcrs(tpmM, referenceValues)
+	calculatedPcrs, pcrResult, artifacts, redactions, ok := recalculatePcrs(tpmM,
+		referenceValues, sel.Hash)
 	if !ok {
 		log.Trace("failed to recalculate PCRs")
 	}
 	result.TpmResult.PcrMatch = pcrResult
+	result.TpmResult.Redactions = redactions
 	result.Artifacts = artifacts
 
-	// Extract TPM Quote (TPMS ATTEST) and signature
-	tpmsAttest, err := tpm2.DecodeAttestationData(tpmM.Evidence)
-	if err != nil {
-		log.Tracef("Failed to decode TPM attestation data: %v", err)
-		result.Summary.SetErr(ar.ParseEvidence)
-		return result, false
-	}
-
 	// Verify nonce with nonce from TPM Quote
 	if bytes.Equal(nonce, tpmsAttest.ExtraData) {
 		result.Freshness.Success = true
@@ -70,19 +138,12 @@ func verifyTpmMeasurements(tpmM ar.Measurement, nonce []byte, cas []*x509.Certif
 	log.Tracef("Successfully verified nonce %v", hex.EncodeToString(nonce))
 
 	// Verify aggregated PCR against TPM Quote PCRDigest: Hash all reference values
-	// together then compare
+	// together in ascending PCR order as done by the TPM, then compare
+	pcrs := make([]int, len(sel.PCRs))
+	copy(pcrs, sel.PCRs)
+	sort.Ints(pcrs)
 	sum := make([]byte, 0)
-	for i := range tpmM.Artifacts {
-		if tpmM.Artifacts[i].Pcr == nil {
-			log.Tracef("PCR not specified")
-			result.Summary.SetErr(ar.PcrNotSpecified)
-			return result, false
-		}
-		pcr := *tpmM.Artifacts[i].Pcr
-		_, ok := calculatedPcrs[pcr]
-		if !ok {
-			continue
-		}
+	for _, pcr := range pcrs {
 		sum = append(sum, calculatedPcrs[pcr]...)
 	}
 	verPcr := sha256.Sum256(sum)
@@ -99,37 +160,19 @@ func verifyTpmMeasurements(tpmM ar.Measurement, nonce []byte, cas []*x509.Certif
 		ok = false
 	}
 
-	mCerts, err := internal.ParseCertsDer(tpmM.Certs)
-	if err != nil {
-		log.Tracef("Failed to parse measurement certs: %v", err)
-		result.Signature.CertChainCheck.SetErr(ar.ParseCert)
-		result.Summary.Success = false
-		return result, false
-	}
-
-	result.Signature.SignCheck = verifyTpmQuoteSignature(tpmM.Evidence, tpmM.Signature, mCerts[0])
+	result.Signature.SignCheck = verifyTpmQuoteSignature(tpmM.Evidence, tpmM.Signature, pub)
 	if !result.Signature.SignCheck.Success {
 		ok = false
 	}
 	log.Trace("Successfully verified TPM quote signature")
 
-	x509Chains, err := internal.VerifyCertChain(mCerts, cas)
-	if err != nil {
-		log.Tracef("Failed to verify certificate chain: %v", err)
-		result.Signature.CertChainCheck.SetErr(ar.VerifyCertChain)
-		ok = false
-	} else {
-		result.Signature.CertChainCheck.Success = true
-	}
-	log.Trace("Successfully verified TPM certificate chain")
-
-	//Store details from (all) validated certificate chain(s) in the report
-	for _, chain := range x509Chains {
-		chainExtracted := []ar.X509CertExtracted{}
-		for _, cert := range chain {
-			chainExtracted = append(chainExtracted, ar.ExtractX509Infos(cert))
+	// Verify the optional session audit attestation of the quote
+	if len(tpmM.AuditEvidence) > 0 {
+		auditResult := verifyTpmSessionAudit(tpmM, nonce, tpmsAttest.QualifiedSigner, pub)
+		result.TpmResult.SessionAudit = &auditResult
+		if !auditResult.Success {
+			ok = false
 		}
-		result.Signature.ValidatedCerts = append(result.Signature.ValidatedCerts, chainExtracted)
 	}
 
 	result.Summary.Success = ok
@@ -137,12 +180,60 @@ func verifyTpmMeasurements(tpmM ar.Measurement, nonce []byte, cas []*x509.Certif
 	return result, ok
 }
 
-func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceValue) (map[int][]byte, []ar.DigestResult, []ar.DigestResult, bool) {
+// checkPcrSelection checks that the artifacts contain exactly the PCRs of the quote
+// PCR selection
+func checkPcrSelection(sel tpm2.PCRSelection, artifacts []ar.Artifact) bool {
+
+	quoted := make(map[int]bool)
+	for _, pcr := range sel.PCRs {
+		quoted[pcr] = true
+	}
+
+	measured := make(map[int]bool)
+	for _, a := range artifacts {
+		if a.Pcr == nil {
+			log.Tracef("PCR not specified")
+			return false
+		}
+		if measured[*a.Pcr] {
+			log.Tracef("PCR%v present multiple times in measurement", *a.Pcr)
+			return false
+		}
+		if !quoted[*a.Pcr] {
+			log.Tracef("PCR%v present in measurement but not quoted", *a.Pcr)
+			return false
+		}
+		measured[*a.Pcr] = true
+	}
+
+	for pcr := range quoted {
+		if !measured[pcr] {
+			log.Tracef("PCR%v quoted but not present in measurement", pcr)
+			return false
+		}
+	}
+
+	return true
+}
+
+func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceValue, bank tpm2.Algorithm) (map[int][]byte, []ar.DigestResult, []ar.DigestResult, []ar.RedactionResult, bool) {
 	ok := true
 	pcrResults := make([]ar.DigestResult, 0)
 	detailedResults := make([]ar.DigestResult, 0)
+	var redactions []ar.RedactionResult
 	calculatedPcrs := make(map[int][]byte)
 
+	// Index the reference values and the events of the event logs, as event
+	// logs, e.g. IMA logs, may contain many thousand events
+	refIndex := newReferenceIndex(referenceValues)
+	eventSets := make([]map[string]struct{}, len(measurement.Artifacts))
+	for i, a := range measurement.Artifacts {
+		eventSets[i] = make(map[string]struct{}, len(a.Events))
+		for _, event := range a.Events {
+			eventSets[i][string(event.Sha256)] = struct{}{}
+		}
+	}
+
 	// Iterate over the provided measurement
 	for _, measuredPcr := range measurement.Artifacts {
 
@@ -162,13 +253,18 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 		// Initialize calculated PCR if not yet initialized, afterwards extend
 		// reference values
 		if _, ok := calculatedPcrs[pcr]; !ok {
-			calculatedPcrs[pcr] = make([]byte, 32)
+			calculatedPcrs[pcr] = make([]byte, pcrSize(bank))
 		}
 
-		if measuredPcr.Type == "PCR Eventlog" {
+		if measuredPcr.Type == "PCR Eventlog" && bank != tpm2.AlgSHA256 {
+			ok = false
+			pcrResult.Success = false
+			log.Tracef("PCR event logs are only supported for the SHA256 bank")
+		} else if measuredPcr.Type == "PCR Eventlog" {
 			// measurement contains a detailed measurement list (e.g. retrieved from bios
 			// measurement logs or ima runtime measurement logs)
 			measuredSummary := make([]byte, 32)
+			var resolver *nameResolver
 			for _, event := range measuredPcr.Events {
 				//first event could be a TPM_PCR_INIT_VALUE ()
 				if event.EventName == "TPM_PCR_INIT_VALUE" {
@@ -177,24 +273,35 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 					continue
 				}
 
+				// Redacted names are resolved if the salt is known
+				name := event.EventName
+				redacted := len(event.NameSha256) > 0
+				if redacted {
+					if resolver == nil {
+						resolver = newNameResolver(pcr, measuredPcr, referenceValues)
+					}
+					name = resolver.resolve(event.NameSha256)
+				}
+
 				// Extend measurement summary unconditionally...
 				measuredSummary = extendSha256(measuredSummary, event.Sha256)
 
 				// Check for every event that a corresponding reference value exists
-				ref := getReferenceValue(event.Sha256, pcr, referenceValues)
+				ref := refIndex.get(event.Sha256, pcr)
 				if ref == nil {
 					measResult := ar.DigestResult{
 						Type:      "Measurement",
 						Pcr:       &pcr,
 						Digest:    hex.EncodeToString(event.Sha256),
 						Success:   false,
-						Name:      event.EventName,
+						Name:      name,
 						EventData: event.EventData,
 						CtrData:   event.CtrData,
+						Redacted:  redacted,
 					}
 					detailedResults = append(detailedResults, measResult)
 					log.Tracef("Failed to find PCR%v measurement %v: %v in reference values",
-						*measuredPcr.Pcr, event.EventName, hex.EncodeToString(event.Sha256))
+						*measuredPcr.Pcr, name, hex.EncodeToString(event.Sha256))
 					ok = false
 					pcrResult.Success = false
 					continue
@@ -205,8 +312,8 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 					event.Sha256)
 
 				nameInfo := ref.Name
-				if event.EventName != "" && !strings.EqualFold(ref.Name, event.EventName) {
-					nameInfo += ": " + event.EventName
+				if name != "" && !strings.EqualFold(ref.Name, name) {
+					nameInfo += ": " + name
 				}
 
 				measResult := ar.DigestResult{
@@ -215,9 +322,13 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 					Success:     true,
 					Name:        nameInfo,
 					Description: ref.Description,
+					Redacted:    redacted,
 				}
 				detailedResults = append(detailedResults, measResult)
 			}
+			if resolver != nil {
+				redactions = append(redactions, resolver.done())
+			}
 			pcrResult.Digest = hex.EncodeToString(calculatedPcrs[pcr])
 			if !bytes.Equal(measuredSummary, calculatedPcrs[pcr]) {
 				pcrResult.Description = hex.EncodeToString(measuredSummary)
@@ -233,17 +344,18 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 					continue
 				}
 				if *ref.Pcr == pcr {
+					digest := refDigest(ref, bank)
 					if ref.Name == "TPM_PCR_INIT_VALUE" {
-						calculatedPcrs[pcr] = ref.Sha256 //the Sha256 should contain the init value
-						continue                         //break the loop iteration and continue with the next event
+						calculatedPcrs[pcr] = digest //the digest should contain the init value
+						continue                     //break the loop iteration and continue with the next event
 					}
-					calculatedPcrs[pcr] = extendSha256(calculatedPcrs[pcr], ref.Sha256)
+					calculatedPcrs[pcr] = extendPcr(bank, calculatedPcrs[pcr], digest)
 
 					// As we only have the PCR summary, we will later  set all reference values
 					// to true/false depending on whether the calculation matches the PCR summary
 					measResult := ar.DigestResult{
 						Pcr:         &pcr,
-						Digest:      hex.EncodeToString(ref.Sha256),
+						Digest:      hex.EncodeToString(digest),
 						Name:        ref.Name,
 						Description: ref.Description,
 					}
@@ -310,7 +422,7 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 
 		// Check if measurement contains the reference value PCR
 		foundPcr := false
-		for _, measuredPcr := range measurement.Artifacts {
+		for i, measuredPcr := range measurement.Artifacts {
 
 			if measuredPcr.Pcr == nil {
 				log.Trace("PCR not specified")
@@ -328,13 +440,7 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 			// measurement logs were provided. In case of summary, every reference value was
 			// extended anyway)
 			if measuredPcr.Type != "PCR Summary" && !ref.Optional {
-				foundEvent := false
-				for _, event := range measuredPcr.Events {
-					if bytes.Equal(event.Sha256, ref.Sha256) {
-						foundEvent = true
-					}
-				}
-				if !foundEvent {
+				if _, foundEvent := eventSets[i][string(ref.Sha256)]; !foundEvent {
 					result := ar.DigestResult{
 						Type:        "Reference Value",
 						Pcr:         ref.Pcr,
@@ -366,10 +472,10 @@ func recalculatePcrs(measurement ar.Measurement, referenceValues []ar.ReferenceV
 		}
 	}
 
-	return calculatedPcrs, pcrResults, detailedResults, ok
+	return calculatedPcrs, pcrResults, detailedResults, redactions, ok
 }
 
-func verifyTpmQuoteSignature(quote, sig []byte, cert *x509.Certificate) ar.Result {
+func verifyTpmQuoteSignature(quote, sig []byte, pub crypto.PublicKey) ar.Result {
 
 	buf := new(bytes.Buffer)
 	buf.Write((sig))
@@ -379,39 +485,277 @@ func verifyTpmQuoteSignature(quote, sig []byte, cert *x509.Certificate) ar.Resul
 		return ar.Result{Success: false, ErrorCode: ar.Parse}
 	}
 
-	if tpmtSig.Alg != tpm2.AlgRSASSA {
-		log.Tracef("Hash algorithm %v not supported", tpmtSig.Alg)
+	switch tpmtSig.Alg {
+	case tpm2.AlgRSASSA:
+		pubKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			log.Tracef("Failed to extract RSA public key")
+			return ar.Result{Success: false, ErrorCode: ar.ExtractPubKey}
+		}
+		hashAlg, err := tpmtSig.RSA.HashAlg.Hash()
+		if err != nil {
+			log.Tracef("Hash algorithm not supported")
+			return ar.Result{Success: false, ErrorCode: ar.UnsupportedAlgorithm}
+		}
+
+		// Hash the quote and Verify the TPM Quote signature
+		h := hashAlg.New()
+		h.Write(quote)
+		err = rsa.VerifyPKCS1v15(pubKey, hashAlg, h.Sum(nil), tpmtSig.RSA.Signature)
+		if err != nil {
+			log.Tracef("Failed to verify TPM quote signature: %v", err)
+			return ar.Result{Success: false, ErrorCode: ar.VerifySignature}
+		}
+	case tpm2.AlgECDSA:
+		pubKey, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			log.Tracef("Failed to extract ECDSA public key")
+			return ar.Result{Success: false, ErrorCode: ar.ExtractPubKey}
+		}
+		hashAlg, err := tpmtSig.ECC.HashAlg.Hash()
+		if err != nil {
+			log.Tracef("Hash algorithm not supported")
+			return ar.Result{Success: false, ErrorCode: ar.UnsupportedAlgorithm}
+		}
+
+		h := hashAlg.New()
+		h.Write(quote)
+		if !ecdsa.Verify(pubKey, h.Sum(nil), tpmtSig.ECC.R, tpmtSig.ECC.S) {
+			log.Tracef("Failed to verify TPM quote signature")
+			return ar.Result{Success: false, ErrorCode: ar.VerifySignature}
+		}
+	default:
+		log.Tracef("Signature algorithm %v not supported", tpmtSig.Alg)
 		return ar.Result{Success: false, ErrorCode: ar.UnsupportedAlgorithm}
 	}
+	return ar.Result{Success: true}
+}
 
-	// Extract public key from x509 certificate
-	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
-	if !ok {
-		log.Tracef("Failed to extract public key from certificate")
-		return ar.Result{Success: false, ErrorCode: ar.ExtractPubKey}
-	}
-	hashAlg, err := tpmtSig.RSA.HashAlg.Hash()
+// verifyTpmSessionAudit verifies that the session audit attestation was signed
+// by the quote signing key, contains the nonce and that the session audit digest
+// was calculated over exactly the TPM2_Quote command and response of the measurement
+func verifyTpmSessionAudit(tpmM ar.Measurement, nonce []byte, signer tpm2.Name,
+	pub crypto.PublicKey,
+) ar.Result {
+
+	attest, err := tpmdirect.Unmarshal[tpmdirect.TPMSAttest](tpmM.AuditEvidence)
 	if err != nil {
-		log.Tracef("Hash algorithm not supported")
-		return ar.Result{Success: false, ErrorCode: ar.UnsupportedAlgorithm}
+		log.Tracef("Failed to decode TPM session audit: %v", err)
+		return ar.Result{Success: false, ErrorCode: ar.ParseEvidence}
+	}
+	if attest.Type != tpmdirect.TPMSTAttestSessionAudit {
+		log.Tracef("Unexpected TPM session audit attestation type 0x%x", uint16(attest.Type))
+		return ar.Result{Success: false, ErrorCode: ar.EvidenceType}
+	}
+	if !bytes.Equal(attest.ExtraData.Buffer, nonce) {
+		log.Tracef("Session audit nonce mismatch: %v vs. %v", hex.EncodeToString(nonce),
+			hex.EncodeToString(attest.ExtraData.Buffer))
+		return ar.Result{
+			Success:   false,
+			ErrorCode: ar.SessionAuditMismatch,
+			Expected:  hex.EncodeToString(nonce),
+			Got:       hex.EncodeToString(attest.ExtraData.Buffer),
+		}
+	}
+	if signer.Digest != nil {
+		qn := append([]byte{byte(signer.Digest.Alg >> 8), byte(signer.Digest.Alg)},
+			signer.Digest.Value...)
+		if !bytes.Equal(attest.QualifiedSigner.Buffer, qn) {
+			log.Tracef("Session audit signer does not match quote signer")
+			return ar.Result{Success: false, ErrorCode: ar.SessionAuditMismatch}
+		}
 	}
 
-	// Hash the quote and Verify the TPM Quote signature
-	hashed := sha256.Sum256(quote)
-	err = rsa.VerifyPKCS1v15(pubKey, hashAlg, hashed[:], tpmtSig.RSA.Signature)
+	result := verifyTpmQuoteSignature(tpmM.AuditEvidence, tpmM.AuditSignature, pub)
+	if !result.Success {
+		return result
+	}
+
+	info, err := attest.Attested.SessionAudit()
+	if err != nil {
+		log.Tracef("Failed to decode TPM session audit info: %v", err)
+		return ar.Result{Success: false, ErrorCode: ar.ParseEvidence}
+	}
+	digest := info.SessionDigest.Buffer
+	expected, err := calculateQuoteAuditDigest(tpmM, nonce, pub, len(digest))
 	if err != nil {
-		log.Tracef("Failed to verify TPM quote signature: %v", err)
-		return ar.Result{Success: false, ErrorCode: ar.VerifySignature}
+		log.Tracef("Failed to calculate session audit digest: %v", err)
+		return ar.Result{Success: false, ErrorCode: ar.ParseEvidence}
+	}
+	if !bytes.Equal(digest, expected) {
+		log.Tracef("Session audit digest does not match quote: %v vs. %v",
+			hex.EncodeToString(expected), hex.EncodeToString(digest))
+		return ar.Result{
+			Success:   false,
+			ErrorCode: ar.SessionAuditMismatch,
+			Expected:  hex.EncodeToString(expected),
+			Got:       hex.EncodeToString(digest),
+		}
 	}
+
 	return ar.Result{Success: true}
 }
 
+// calculateQuoteAuditDigest calculates the digest of an audit session, which was
+// only used for the TPM2_Quote command with a null signature scheme, as
+// H(zeros || cpHash || rpHash). The hash algorithm of the session is derived from
+// the digest size. The name of the quote signing key in the cpHash is calculated
+// from the public area of the audit signer, which must contain the quote key
+func calculateQuoteAuditDigest(tpmM ar.Measurement, nonce []byte, pub crypto.PublicKey,
+	size int,
+) ([]byte, error) {
+
+	var newHash func() hash.Hash
+	switch size {
+	case sha1.Size:
+		newHash = sha1.New
+	case sha256.Size:
+		newHash = sha256.New
+	case sha512.Size384:
+		newHash = sha512.New384
+	default:
+		return nil, fmt.Errorf("unsupported session digest size %v", size)
+	}
+
+	signerPub, err := tpmdirect.Unmarshal[tpmdirect.TPMTPublic](tpmM.AuditSigner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode audit signer: %w", err)
+	}
+	if !tpmPublicKeyEqual(signerPub, pub) {
+		return nil, fmt.Errorf("audit signer does not match the quote key")
+	}
+	name, err := tpmdirect.ObjectName(signerPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate audit signer name: %w", err)
+	}
+	quote, err := tpmdirect.Unmarshal[tpmdirect.TPMSAttest](tpmM.Evidence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode quote: %w", err)
+	}
+	quoteInfo, err := quote.Attested.Quote()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode quote info: %w", err)
+	}
+
+	cc := make([]byte, 4)
+	binary.BigEndian.PutUint32(cc, uint32(tpmdirect.TPMCCQuote))
+
+	// cpHash = H(CC || signHandle name || qualifyingData || inScheme || PCRselect)
+	h := newHash()
+	h.Write(cc)
+	h.Write(name.Buffer)
+	h.Write(tpmdirect.Marshal(tpmdirect.TPM2BData{Buffer: nonce}))
+	h.Write(tpmdirect.Marshal(tpmdirect.TPMTSigScheme{Scheme: tpmdirect.TPMAlgNull}))
+	h.Write(tpmdirect.Marshal(quoteInfo.PCRSelect))
+	cpHash := h.Sum(nil)
+
+	// rpHash = H(RC || CC || quoted || signature)
+	h = newHash()
+	h.Write(make([]byte, 4))
+	h.Write(cc)
+	h.Write(tpmdirect.Marshal(tpmdirect.BytesAs2B[tpmdirect.TPMSAttest](tpmM.Evidence)))
+	h.Write(tpmM.Signature)
+	rpHash := h.Sum(nil)
+
+	h = newHash()
+	h.Write(make([]byte, size))
+	h.Write(cpHash)
+	h.Write(rpHash)
+
+	return h.Sum(nil), nil
+}
+
+// tpmPublicKeyEqual returns true if the TPM public area contains the public key
+func tpmPublicKeyEqual(public *tpmdirect.TPMTPublic, pub crypto.PublicKey) bool {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		parms, err := public.Parameters.RSADetail()
+		if err != nil {
+			return false
+		}
+		unique, err := public.Unique.RSA()
+		if err != nil {
+			return false
+		}
+		rsaPub, err := tpmdirect.RSAPub(parms, unique)
+		if err != nil {
+			return false
+		}
+		return key.Equal(rsaPub)
+	case *ecdsa.PublicKey:
+		unique, err := public.Unique.ECC()
+		if err != nil {
+			return false
+		}
+		return key.X.Cmp(new(big.Int).SetBytes(unique.X.Buffer)) == 0 &&
+			key.Y.Cmp(new(big.Int).SetBytes(unique.Y.Buffer)) == 0
+	default:
+		return false
+	}
+}
+
+// pcrSize returns the size of a PCR of the specified bank
+func pcrSize(bank tpm2.Algorithm) int {
+	switch bank {
+	case tpm2.AlgSHA1:
+		return sha1.Size
+	case tpm2.AlgSHA384:
+		return sha512.Size384
+	default:
+		return sha256.Size
+	}
+}
+
+// extendPcr extends the PCR value with the digest using the hash algorithm of the bank
+func extendPcr(bank tpm2.Algorithm, pcr []byte, digest []byte) []byte {
+	switch bank {
+	case tpm2.AlgSHA1:
+		h := sha1.Sum(append(pcr, digest...))
+		return h[:]
+	case tpm2.AlgSHA384:
+		return extendSha384(pcr, digest)
+	default:
+		return extendSha256(pcr, digest)
+	}
+}
+
+// refDigest returns the digest of the reference value for the specified bank
+func refDigest(ref ar.ReferenceValue, bank tpm2.Algorithm) []byte {
+	switch bank {
+	case tpm2.AlgSHA1:
+		return ref.Sha1
+	case tpm2.AlgSHA384:
+		return ref.Sha384
+	default:
+		return ref.Sha256
+	}
+}
+
 // Searches for a specific hash value in the reference values for RTM and OS
-func getReferenceValue(hash []byte, pcr int, refVals []ar.ReferenceValue) *ar.ReferenceValue {
-	for _, ref := range refVals {
-		if *ref.Pcr == pcr && bytes.Equal(ref.Sha256, hash) {
-			return &ref
+type referenceKey struct {
+	pcr    int
+	digest string
+}
+
+// referenceIndex maps the PCRs and SHA256 digests to the first matching
+// reference value
+type referenceIndex map[referenceKey]*ar.ReferenceValue
+
+func newReferenceIndex(refVals []ar.ReferenceValue) referenceIndex {
+	index := make(referenceIndex, len(refVals))
+	for i := range refVals {
+		ref := &refVals[i]
+		if ref.Pcr == nil {
+			continue
+		}
+		key := referenceKey{*ref.Pcr, string(ref.Sha256)}
+		if _, ok := index[key]; !ok {
+			index[key] = ref
 		}
 	}
-	return nil
+	return index
+}
+
+func (index referenceIndex) get(hash []byte, pcr int) *ar.ReferenceValue {
+	return index[referenceKey{pcr, string(hash)}]
 }
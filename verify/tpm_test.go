@@ -16,16 +16,26 @@
 package verify
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
 	"github.com/sirupsen/logrus"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/internal"
 )
 
 func Test_verifyTpmMeasurements(t *testing.T) {
@@ -143,6 +153,23 @@ func Test_verifyTpmMeasurements(t *testing.T) {
 			want:  nil,
 			want1: false,
 		},
+		{
+			name: "PCR Selection Mismatch",
+			args: args{
+				tpmM: &ar.Measurement{
+					Type:      "TPM Measurement",
+					Evidence:  validQuote,
+					Signature: validSignature,
+					Certs:     validTpmCertChain,
+					Artifacts: validSummaryHashChain[:1],
+				},
+				nonce:           validTpmNonce,
+				referenceValues: validReferenceValues,
+				cas:             []*x509.Certificate{validCa},
+			},
+			want:  nil,
+			want1: false,
+		},
 		{
 			name: "Invalid Reference Values",
 			args: args{
@@ -196,11 +223,11 @@ func Test_verifyTpmMeasurements(t *testing.T) {
 		},
 	}
 
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1 := verifyTpmMeasurements(*tt.args.tpmM, tt.args.nonce, tt.args.cas, tt.args.referenceValues)
+			got, got1 := verifyTpmMeasurements(*tt.args.tpmM, tt.args.nonce, tt.args.cas, tt.args.referenceValues, time.Time{})
 			if got1 != tt.want1 {
 				t.Errorf("verifyTpmMeasurements() --GOT1-- = %v, --WANT1-- %v", got1, tt.want1)
 			}
@@ -219,6 +246,160 @@ func Test_verifyTpmMeasurements(t *testing.T) {
 	}
 }
 
+func Test_verifyTpmSessionAudit(t *testing.T) {
+
+	akPub, err := tpmdirect.Unmarshal[tpmdirect.TPMTPublic](auditAkPub)
+	if err != nil {
+		t.Fatalf("failed to decode AK public: %v", err)
+	}
+	unique, err := akPub.Unique.ECC()
+	if err != nil {
+		t.Fatalf("failed to decode AK public key: %v", err)
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(unique.X.Buffer),
+		Y:     new(big.Int).SetBytes(unique.Y.Buffer),
+	}
+	quote, err := tpm2.DecodeAttestationData(auditQuote)
+	if err != nil {
+		t.Fatalf("failed to decode quote: %v", err)
+	}
+	signer := quote.QualifiedSigner
+	nonce := []byte("0123456789abcdef")
+
+	m := func(audit, auditSig, quoteSig, auditSigner []byte) ar.Measurement {
+		return ar.Measurement{
+			Type:           "TPM Measurement",
+			Evidence:       auditQuote,
+			Signature:      quoteSig,
+			AuditEvidence:  audit,
+			AuditSignature: auditSig,
+			AuditSigner:    auditSigner,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		m      ar.Measurement
+		nonce  []byte
+		signer tpm2.Name
+		want   ar.ErrorCode
+	}{
+		{"Valid", m(auditQuoteAudit, auditQuoteAuditSig, auditQuoteSig, auditAkPub), nonce,
+			signer, ar.NotSet},
+		{"Invalid Signature", m(auditQuoteAudit, auditOtherAuditSig, auditQuoteSig, auditAkPub),
+			nonce, signer, ar.VerifySignature},
+		{"Nonce Mismatch", m(auditQuoteAudit, auditQuoteAuditSig, auditQuoteSig, auditAkPub),
+			[]byte("fedcba9876543210"), signer, ar.SessionAuditMismatch},
+		{"Signer Mismatch", m(auditQuoteAudit, auditQuoteAuditSig, auditQuoteSig, auditAkPub),
+			nonce, tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, 32)}},
+			ar.SessionAuditMismatch},
+		{"Audit Of Other Command", m(auditOtherAudit, auditOtherAuditSig, auditQuoteSig,
+			auditAkPub), nonce, signer, ar.SessionAuditMismatch},
+		{"Other Quote Signature", m(auditQuoteAudit, auditQuoteAuditSig, auditOtherAuditSig,
+			auditAkPub), nonce, signer, ar.SessionAuditMismatch},
+		{"Missing Audit Signer", m(auditQuoteAudit, auditQuoteAuditSig, auditQuoteSig, nil),
+			nonce, signer, ar.ParseEvidence},
+		{"Parse Error", m(auditQuoteAudit[:10], auditQuoteAuditSig, auditQuoteSig, auditAkPub),
+			nonce, signer, ar.ParseEvidence},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifyTpmSessionAudit(tt.m, tt.nonce, tt.signer, pub)
+			if got.Success != (tt.want == ar.NotSet) {
+				t.Errorf("verifyTpmSessionAudit() success = %v, want %v", got.Success,
+					tt.want == ar.NotSet)
+			}
+			if got.ErrorCode != tt.want {
+				t.Errorf("verifyTpmSessionAudit() error = %v, want %v", got.ErrorCode, tt.want)
+			}
+		})
+	}
+}
+
+func Test_verifyTpmQuoteSignature(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	quote := []byte("TPMS_ATTEST")
+	signRsa := func(key *rsa.PrivateKey) []byte {
+		digest := sha256.Sum256(quote)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return tpmdirect.Marshal(tpmdirect.TPMTSignature{
+			SigAlg: tpmdirect.TPMAlgRSASSA,
+			Signature: tpmdirect.NewTPMUSignature(tpmdirect.TPMAlgRSASSA,
+				&tpmdirect.TPMSSignatureRSA{
+					Hash: tpmdirect.TPMAlgSHA256,
+					Sig:  tpmdirect.TPM2BPublicKeyRSA{Buffer: sig},
+				}),
+		})
+	}
+	signEcdsa := func(key *ecdsa.PrivateKey, hash crypto.Hash, alg tpmdirect.TPMIAlgHash) []byte {
+		h := hash.New()
+		h.Write(quote)
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return tpmdirect.Marshal(tpmdirect.TPMTSignature{
+			SigAlg: tpmdirect.TPMAlgECDSA,
+			Signature: tpmdirect.NewTPMUSignature(tpmdirect.TPMAlgECDSA,
+				&tpmdirect.TPMSSignatureECC{
+					Hash:       alg,
+					SignatureR: tpmdirect.TPM2BECCParameter{Buffer: r.Bytes()},
+					SignatureS: tpmdirect.TPM2BECCParameter{Buffer: s.Bytes()},
+				}),
+		})
+	}
+
+	tests := []struct {
+		name string
+		sig  []byte
+		pub  crypto.PublicKey
+		want ar.ErrorCode
+	}{
+		{"RSA", signRsa(rsaKey), &rsaKey.PublicKey, ar.NotSet},
+		{"ECDSA P-256", signEcdsa(p256, crypto.SHA256, tpmdirect.TPMAlgSHA256), &p256.PublicKey,
+			ar.NotSet},
+		{"ECDSA P-384", signEcdsa(p384, crypto.SHA384, tpmdirect.TPMAlgSHA384), &p384.PublicKey,
+			ar.NotSet},
+		{"ECDSA Wrong Key", signEcdsa(p256, crypto.SHA256, tpmdirect.TPMAlgSHA256),
+			&p384.PublicKey, ar.VerifySignature},
+		{"ECDSA Wrong Hash", signEcdsa(p384, crypto.SHA256, tpmdirect.TPMAlgSHA384),
+			&p384.PublicKey, ar.VerifySignature},
+		{"ECDSA Signature RSA Key", signEcdsa(p256, crypto.SHA256, tpmdirect.TPMAlgSHA256),
+			&rsaKey.PublicKey, ar.ExtractPubKey},
+		{"RSA Signature ECDSA Key", signRsa(rsaKey), &p256.PublicKey, ar.ExtractPubKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := verifyTpmQuoteSignature(quote, tt.sig, tt.pub)
+			if got.Success != (tt.want == ar.NotSet) {
+				t.Errorf("verifyTpmQuoteSignature() success = %v, want %v", got.Success,
+					tt.want == ar.NotSet)
+			}
+			if got.ErrorCode != tt.want {
+				t.Errorf("verifyTpmQuoteSignature() error = %v, want %v", got.ErrorCode, tt.want)
+			}
+		})
+	}
+}
+
 func dec(s string) []byte {
 	b, err := hex.DecodeString(s)
 	if err != nil {
@@ -675,3 +856,32 @@ var (
 		},
 	}
 )
+
+// Session audit test vectors recorded with the go-tpm-tools TPM simulator
+var (
+	// Public area of the simulator AK
+	auditAkPub = dec("0023000b00040072000000100018000b00030010002008da1b0ef2b44fafc096948ea7f1" +
+		"cf08a2fdb0356fc6d90b0f4dec17680888250020b192d10a0405d1507cd7dc32a4373928" +
+		"d6aed17021317c4937b1a98aa6d4b57c")
+	// Quote over PCRs 0, 1 and 7 with the nonce "0123456789abcdef" within an audit session
+	auditQuote = dec("ff54434780180022000baa3741e0a1177506773a44a73d0a3e2ce5c16b4613c777575e9c" +
+		"aa60f3fef8000010303132333435363738396162636465660000000000000a0f8f6bb8a2" +
+		"5f6dd91401be24d1df8e0cb03100000001000b0383000000202ea9ab9198d1638007400c" +
+		"d2c3bef1cc745b864b76011a0e1bc52180ac6452d4")
+	auditQuoteSig = dec("0018000b0020d4e580f532d711b21c6db2e9cc88e88684d0819560326aed21eebad89a1f" +
+		"fca1002096ae83d7669ec5d46e3fd68676e96ab64e5a49250966a9a7da498bbc15b1d5f6")
+	// Session audit attestation of the quote and its signature
+	auditQuoteAudit = dec("ff54434780160022000baa3741e0a1177506773a44a73d0a3e2ce5c16b4613c777575e9c" +
+		"aa60f3fef8000010303132333435363738396162636465660000000000000a0f8f6bb8a2" +
+		"5f6dd91401be24d1df8e0cb031010020d43f92ee09ca965cfb3b65905157edd251062cfb" +
+		"088bf17f54a54643319c9c9e")
+	auditQuoteAuditSig = dec("0018000b00201103cd6d0ac326147f0aa13a6531ce5e1cecfae2c7949a2c5ef8e16b1edf" +
+		"ccfe0020fb5ffbf7a70fcc8ff2d5f8e2c661f918c694bd16d117ff46f638829dcf159fc9")
+	// Session audit attestation of a TPM2_GetRandom command with the same nonce
+	auditOtherAudit = dec("ff54434780160022000baa3741e0a1177506773a44a73d0a3e2ce5c16b4613c777575e9c" +
+		"aa60f3fef8000010303132333435363738396162636465660000000000000a118f6bb8a2" +
+		"5f6dd91401be24d1df8e0cb0310100205c801ab6bc51ceb44fe2e69a39f520aa6b326b19" +
+		"75846c2c7fe15694ecb9aa40")
+	auditOtherAuditSig = dec("0018000b002028c1f5b0678ac8ca72b1fe55a07ea956310670f46aed08c8c168cc96704f" +
+		"1cb80020f94dd275d0df0cb0cc5473ccfd4ae17e63d9fda66074a53eb932302a2085702a")
+)
@@ -24,11 +24,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/fxamacker/cbor/v2"
-	"github.com/sirupsen/logrus"
 
 	"time"
 )
@@ -39,14 +39,29 @@ const (
 	PolicyEngineSelect_None    PolicyEngineSelect = 0
 	PolicyEngineSelect_JS      PolicyEngineSelect = 1
 	PolicyEngineSelect_DukTape PolicyEngineSelect = 2
+	PolicyEngineSelect_Opa     PolicyEngineSelect = 3
+	PolicyEngineSelect_Wasm    PolicyEngineSelect = 4
 )
 
 type PolicyValidator interface {
 	Validate(policies []byte, result ar.VerificationResult) bool
 }
 
+// PolicyDecision is the detailed outcome of a custom policy evaluation
+type PolicyDecision struct {
+	Success    bool     `json:"success"`
+	Violations []string `json:"violations,omitempty"`
+	Trace      []string `json:"trace,omitempty"`
+}
+
+// PolicyEvaluator is optionally implemented by policy engines, which can report
+// the violations and the trace of the policy evaluation
+type PolicyEvaluator interface {
+	Evaluate(policies []byte, result ar.VerificationResult) (*PolicyDecision, error)
+}
+
 var (
-	log = logrus.WithField("service", "ar")
+	log = internal.NewLogger(internal.SubsystemAttestationReport, "ar")
 
 	policyEngines = map[PolicyEngineSelect]PolicyValidator{}
 )
@@ -54,14 +69,58 @@ var (
 // Verify verifies an attestation report in full serialized JWS
 // format against the supplied nonce and CA certificate. Verifies the certificate
 // chains of all attestation report elements as well as the measurements against
-// the reference values and the compatibility of software artefacts.
-func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect, intelCache string) ar.VerificationResult {
+// the reference values and the compatibility of software artefacts. The optional
+// cache folder is used for caching Intel collateral and AMD KDS certificates.
+func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect, cache string) ar.VerificationResult {
+	return VerifyAt(arRaw, nonce, casPem, policies, polEng, cache, time.Time{})
+}
+
+// VerifyAt verifies an attestation report like Verify, but evaluates the
+// certificate chains and validity periods of the attestation report, the
+// metadata and the TPM, Nitro and SW measurements at the given time. This allows
+// verifying archived reports as of their creation time. The zero time refers
+// to the current time. Hardware specific collateral, such as the Intel TCB info
+// or the AMD KDS certificates, is always evaluated at the current time
+func VerifyAt(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect, cache string,
+	at time.Time,
+) ar.VerificationResult {
+	return verifyAt(arRaw, nonce, casPem, policies, polEng, cache, at, ResolveCachedMetadata)
+}
+
+// VerifyResolved verifies an attestation report like Verify, but resolves the
+// cached metadata items the prover omitted from the report with the resolver
+// instead of the metadata of the previously verified reports. If items cannot
+// be resolved, the verification fails with MissingCacheEntry and the digests
+// of the items, so that the report can be requested again without cache
+func VerifyResolved(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect,
+	cache string, resolve MetadataResolver,
+) ar.VerificationResult {
+	return verifyAt(arRaw, nonce, casPem, policies, polEng, cache, time.Time{}, resolve)
+}
+
+// verifyAt verifies the attestation report and derives the success from the
+// checks of all verified artifacts
+func verifyAt(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect, cache string,
+	at time.Time, resolve MetadataResolver,
+) ar.VerificationResult {
+	result := verifyReport(arRaw, nonce, casPem, policies, polEng, cache, at, resolve)
+	result.Summarize()
+	return result
+}
+
+func verifyReport(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSelect,
+	cache string, at time.Time, resolve MetadataResolver,
+) ar.VerificationResult {
 	result := ar.VerificationResult{
 		Type:        "Verification Result",
 		Success:     true,
 		SwCertLevel: 0}
+	if len(arRaw) > 0 {
+		digest := sha256.Sum256(arRaw)
+		result.ReportId = hex.EncodeToString(digest[:])
+	}
 
-	cas, err := internal.ParseCertsPem(casPem)
+	cas, err := internal.ParseRoots(casPem)
 	if err != nil {
 		log.Tracef("Failed to parse specified CA certificate(s): %v", err)
 		result.Success = false
@@ -69,6 +128,12 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 		return result
 	}
 
+	// Entity Attestation Tokens of other attesters are verified against the
+	// configured EAT metadata
+	if isEat(arRaw) {
+		return verifyEat(result, arRaw, nonce, cas, policies, polEng, at)
+	}
+
 	// Detect serialization format
 	var s ar.Serializer
 	if json.Valid(arRaw) {
@@ -84,8 +149,17 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 		return result
 	}
 
+	// If a serializer is pinned, reports in the other format are rejected
+	// instead of being verified with the detected serializer
+	if err := ar.CheckSerializer(s); err != nil {
+		log.Tracef("Attestation report: %v", err)
+		result.Success = false
+		result.ErrorCode = ar.SerializerNotAllowed
+		return result
+	}
+
 	// Verify and unpack attestation report
-	report, tr, code := verifyAr(arRaw, cas, s)
+	report, tr, code := verifyAr(arRaw, cas, s, at)
 	result.ReportSignature = tr.SignatureCheck
 	if code != ar.NotSet {
 		result.ErrorCode = code
@@ -93,13 +167,31 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 		return result
 	}
 
+	// Add the cached metadata items the prover omitted from the report
+	if missing := resolveMetadata(report, s, resolve); len(missing) > 0 {
+		log.Tracef("Failed to resolve cached metadata items %v", missing)
+		result.Success = false
+		result.ErrorCode = ar.MissingCacheEntry
+		result.MissingMetadata = missing
+		return result
+	}
+
 	// Verify and unpack metadata from attestation report
-	metadata, mr, ok := verifyMetadata(report, cas, s)
+	metadata, mr, ok := verifyMetadata(report, cas, s, at)
 	if !ok {
 		result.Success = false
+	} else {
+		cacheMetadata(report)
 	}
 	result.MetadataResult = *mr
 
+	// Appraise the algorithms and key sizes of the evidence against the
+	// baseline before verifying the measurements
+	if !newAppraiser().report(report, tr, mr, &result) {
+		log.Trace("Attestation report violates the appraisal baseline")
+		return result
+	}
+
 	refVals, err := collectReferenceValues(metadata)
 	if err != nil {
 		log.Tracef("Failed to collect reference values: %v", err)
@@ -113,7 +205,7 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 		switch mtype := m.Type; mtype {
 
 		case "TPM Measurement":
-			r, ok := verifyTpmMeasurements(m, nonce, cas, refVals["TPM Reference Value"])
+			r, ok := verifyTpmMeasurements(m, nonce, cas, refVals["TPM Reference Value"], at)
 			if !ok {
 				result.Success = false
 			}
@@ -121,7 +213,42 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 			hwAttest = true
 
 		case "SNP Measurement":
-			r, ok := verifySnpMeasurements(m, nonce, refVals["SNP Reference Value"])
+			r, ok := verifySnpMeasurements(m, nonce, cache, refVals["SNP Reference Value"])
+			if !ok {
+				result.Success = false
+			}
+			result.Measurements = append(result.Measurements, *r)
+			hwAttest = true
+
+		case "Azure Measurement":
+			r, ok := verifyAzureMeasurements(m, nonce, cache, refVals["SNP Reference Value"],
+				refVals["TPM Reference Value"])
+			if !ok {
+				result.Success = false
+			}
+			result.Measurements = append(result.Measurements, *r)
+			hwAttest = true
+
+		case "GCE Measurement":
+			r, ok := verifyGceMeasurements(m, nonce, refVals["GCE Reference Value"],
+				refVals["TPM Reference Value"])
+			if !ok {
+				result.Success = false
+			}
+			result.Measurements = append(result.Measurements, *r)
+			hwAttest = true
+
+		case "Azure vTPM Measurement":
+			r, ok := verifyAzureVtpmMeasurements(m, nonce, refVals["Azure vTPM Reference Value"],
+				refVals["TPM Reference Value"], at)
+			if !ok {
+				result.Success = false
+			}
+			result.Measurements = append(result.Measurements, *r)
+			hwAttest = true
+
+		case "Nitro Measurement":
+			r, ok := verifyNitroMeasurements(m, nonce, refVals["Nitro Reference Value"], at)
 			if !ok {
 				result.Success = false
 			}
@@ -129,7 +256,7 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 			hwAttest = true
 
 		case "TDX Measurement":
-			r, ok := verifyTdxMeasurements(m, nonce, intelCache, refVals["TDX Reference Value"])
+			r, ok := verifyTdxMeasurements(m, nonce, cache, refVals["TDX Reference Value"])
 			if !ok {
 				result.Success = false
 			}
@@ -137,7 +264,7 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 			hwAttest = true
 
 		case "SGX Measurement":
-			r, ok := verifySgxMeasurements(m, nonce, intelCache, refVals["SGX Reference Value"])
+			r, ok := verifySgxMeasurements(m, nonce, cache, refVals["SGX Reference Value"])
 			if !ok {
 				result.Success = false
 			}
@@ -145,7 +272,7 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 			hwAttest = true
 
 		case "IAS Measurement":
-			r, ok := verifyIasMeasurements(m, nonce, cas, refVals["IAS Reference Value"])
+			r, ok := verifyIasMeasurements(m, nonce, cas, refVals["IAS Reference Value"], at)
 			if !ok {
 				result.Success = false
 			}
@@ -153,19 +280,48 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 			hwAttest = true
 
 		case "SW Measurement":
-			r, ok := verifySwMeasurements(m, nonce, cas, s, refVals["SW Reference Value"])
+			r, ok := verifySwMeasurements(m, nonce, cas, s, refVals["SW Reference Value"], at)
+			if !ok {
+				result.Success = false
+			}
+			result.Measurements = append(result.Measurements, *r)
+
+		case "Runtime Measurement":
+			r, ok := verifyRuntimeMeasurements(m, nonce)
 			if !ok {
 				result.Success = false
 			}
 			result.Measurements = append(result.Measurements, *r)
 
 		default:
-			log.Tracef("Unsupported measurement type '%v'", mtype)
-			result.Success = false
-			result.ErrorCode = ar.MeasurementTypeNotSupported
+			v, ok := getVendorVerifier(mtype)
+			if !ok {
+				log.Tracef("Unsupported measurement type '%v'", mtype)
+				result.Success = false
+				result.ErrorCode = ar.MeasurementTypeNotSupported
+				break
+			}
+			r, ok := v.verify(m, nonce, cas, refVals[v.refValType])
+			if !ok {
+				result.Success = false
+			}
+			if r != nil {
+				result.Measurements = append(result.Measurements, *r)
+			}
 		}
 	}
 
+	return verifyDescriptions(result, metadata, hwAttest, policies, polEng)
+}
+
+// verifyDescriptions determines the certification level of the software stack
+// and verifies the compatibility of the manifests and descriptions of the
+// metadata as well as the custom policies. The result is completed with the
+// prover and the time of the verification
+func verifyDescriptions(result ar.VerificationResult, metadata *ar.Metadata, hwAttest bool,
+	policies []byte, polEng PolicyEngineSelect,
+) ar.VerificationResult {
+
 	// The lowest certification level of all components determines the certification
 	// level for the device's software stack
 	levels := make([]int, 0)
@@ -299,27 +455,16 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 	// Validate policies if specified
 	result.PolicySuccess = true
 	if policies != nil {
-		p, ok := policyEngines[polEng]
-		if !ok {
-			log.Tracef("Internal error: policy engine %v not implemented", polEng)
-			result.Success = false
-			result.ErrorCode = ar.PolicyEngineNotImplemented
-			result.PolicySuccess = false
-		} else {
-			ok = p.Validate(policies, result)
-			if !ok {
-				log.Trace("Custom policy validation failed")
-				result.Success = false
-				result.ErrorCode = ar.VerifyPolicies
-				result.PolicySuccess = false
-			}
-		}
+		verifyPolicies(&result, policies, polEng)
 	} else {
 		log.Tracef("No custom policies specified")
 	}
 
-	// Add additional information
-	result.Prover = metadata.DeviceDescription.Name
+	// Add additional information. The device description takes precedence over
+	// a prover identity taken from the evidence
+	if metadata.DeviceDescription.Name != "" {
+		result.Prover = metadata.DeviceDescription.Name
+	}
 	if result.Prover == "" {
 		result.Prover = "Unknown"
 	}
@@ -334,6 +479,35 @@ func Verify(arRaw, nonce, casPem []byte, policies []byte, polEng PolicyEngineSel
 	return result
 }
 
+// PolicyEngineAvailable returns whether the policy engine is compiled in
+func PolicyEngineAvailable(polEng PolicyEngineSelect) bool {
+	_, ok := policyEngines[polEng]
+	return ok
+}
+
+// EvaluatePolicies evaluates the custom policies against a verification result
+// with the selected policy engine independent of the report verification,
+// e.g. to test policies against stored results. Engines which do not report
+// details only provide the success of the validation
+func EvaluatePolicies(policies []byte, result ar.VerificationResult, polEng PolicyEngineSelect,
+) (*PolicyDecision, error) {
+	p, ok := policyEngines[polEng]
+	if !ok {
+		return nil, fmt.Errorf("policy engine %v not implemented", polEng)
+	}
+	if e, ok := p.(PolicyEvaluator); ok {
+		return e.Evaluate(policies, result)
+	}
+	return &PolicyDecision{Success: p.Validate(policies, result)}, nil
+}
+
+func policyFailure(d *PolicyDecision, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return strings.Join(d.Violations, ", ")
+}
+
 func extendSha256(hash []byte, data []byte) []byte {
 	concat := append(hash, data...)
 	h := sha256.Sum256(concat)
@@ -350,13 +524,13 @@ func extendSha384(hash []byte, data []byte) []byte {
 	return ret
 }
 
-func verifyAr(attestationReport []byte, cas []*x509.Certificate, s ar.Serializer,
+func verifyAr(attestationReport []byte, cas []*x509.Certificate, s ar.Serializer, at time.Time,
 ) (*ar.AttestationReport, ar.TokenResult, ar.ErrorCode) {
 
 	report := ar.AttestationReport{}
 
 	//Validate Attestation Report signature
-	result, payload, ok := s.VerifyToken(attestationReport, cas)
+	result, payload, ok := s.VerifyTokenAt(attestationReport, cas, at)
 	if !ok {
 		log.Trace("Validation of Attestation Report failed")
 		return nil, result, ar.VerifyAR
@@ -372,6 +546,7 @@ func verifyAr(attestationReport []byte, cas []*x509.Certificate, s ar.Serializer
 }
 
 func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.Serializer,
+	at time.Time,
 ) (*ar.Metadata, *ar.MetadataResult, bool) {
 
 	metadata := &ar.Metadata{}
@@ -379,7 +554,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 	success := true
 
 	// Validate and unpack Rtm Manifest
-	tokenRes, payload, ok := s.VerifyToken(report.RtmManifest, cas)
+	tokenRes, payload, ok := verifyToken(s, report.RtmManifest, cas, at)
 	result.RtmResult.Summary = tokenRes.Summary
 	result.RtmResult.SignatureCheck = tokenRes.SignatureCheck
 	if !ok {
@@ -394,7 +569,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 			success = false
 		} else {
 			result.RtmResult.MetaInfo = metadata.RtmManifest.MetaInfo
-			result.RtmResult.ValidityCheck = checkValidity(metadata.RtmManifest.Validity)
+			result.RtmResult.ValidityCheck = checkValidity(metadata.RtmManifest.Validity, at)
 			result.RtmResult.Details = metadata.RtmManifest.Details
 			if !result.RtmResult.ValidityCheck.Success {
 				result.RtmResult.Summary.Success = false
@@ -404,7 +579,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 	}
 
 	// Validate and unpack OS Manifest
-	tokenRes, payload, ok = s.VerifyToken(report.OsManifest, cas)
+	tokenRes, payload, ok = verifyToken(s, report.OsManifest, cas, at)
 	result.OsResult.Summary = tokenRes.Summary
 	result.OsResult.SignatureCheck = tokenRes.SignatureCheck
 	if !ok {
@@ -419,7 +594,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 			success = false
 		} else {
 			result.OsResult.MetaInfo = metadata.OsManifest.MetaInfo
-			result.OsResult.ValidityCheck = checkValidity(metadata.OsManifest.Validity)
+			result.OsResult.ValidityCheck = checkValidity(metadata.OsManifest.Validity, at)
 			result.OsResult.Details = metadata.OsManifest.Details
 			if !result.OsResult.ValidityCheck.Success {
 				result.OsResult.Summary.Success = false
@@ -432,7 +607,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 	for i, amSigned := range report.AppManifests {
 		result.AppResults = append(result.AppResults, ar.ManifestResult{})
 
-		tokenRes, payload, ok = s.VerifyToken(amSigned, cas)
+		tokenRes, payload, ok = verifyToken(s, amSigned, cas, at)
 		result.AppResults[i].Summary = tokenRes.Summary
 		result.AppResults[i].SignatureCheck = tokenRes.SignatureCheck
 		if !ok {
@@ -449,7 +624,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 			} else {
 				metadata.AppManifests = append(metadata.AppManifests, am)
 				result.AppResults[i].MetaInfo = am.MetaInfo
-				result.AppResults[i].ValidityCheck = checkValidity(am.Validity)
+				result.AppResults[i].ValidityCheck = checkValidity(am.Validity, at)
 				if !result.AppResults[i].ValidityCheck.Success {
 					log.Tracef("App Manifest %v validity check failed", am.Name)
 					result.AppResults[i].Summary.Success = false
@@ -462,7 +637,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 
 	// Validate and unpack Company Description if present
 	if report.CompanyDescription != nil {
-		tokenRes, payload, ok = s.VerifyToken(report.CompanyDescription, cas)
+		tokenRes, payload, ok = verifyToken(s, report.CompanyDescription, cas, at)
 		result.CompDescResult = &ar.CompDescResult{}
 		result.CompDescResult.Summary = tokenRes.Summary
 		result.CompDescResult.SignatureCheck = tokenRes.SignatureCheck
@@ -480,7 +655,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 				result.CompDescResult.MetaInfo = metadata.CompanyDescription.MetaInfo
 				result.CompDescResult.CompCertLevel = metadata.CompanyDescription.CertificationLevel
 
-				result.CompDescResult.ValidityCheck = checkValidity(metadata.CompanyDescription.Validity)
+				result.CompDescResult.ValidityCheck = checkValidity(metadata.CompanyDescription.Validity, at)
 				if !result.CompDescResult.ValidityCheck.Success {
 					log.Trace("Company Description invalid")
 					result.CompDescResult.Summary.Success = false
@@ -491,7 +666,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 	}
 
 	// Validate and unpack Device Description
-	tokenRes, payload, ok = s.VerifyToken(report.DeviceDescription, cas)
+	tokenRes, payload, ok = verifyToken(s, report.DeviceDescription, cas, at)
 	result.DevDescResult.Summary = tokenRes.Summary
 	result.DevDescResult.SignatureCheck = tokenRes.SignatureCheck
 	if !ok {
@@ -508,6 +683,7 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 			result.DevDescResult.MetaInfo = metadata.DeviceDescription.MetaInfo
 			result.DevDescResult.Description = metadata.DeviceDescription.Description
 			result.DevDescResult.Location = metadata.DeviceDescription.Location
+			result.DevDescResult.Roles = metadata.DeviceDescription.Roles
 		}
 		for _, appDesc := range metadata.DeviceDescription.AppDescriptions {
 			appResult := ar.AppDescResult{
@@ -524,7 +700,25 @@ func verifyMetadata(report *ar.AttestationReport, cas []*x509.Certificate, s ar.
 	return metadata, result, success
 }
 
-func checkValidity(val ar.Validity) ar.Result {
+// verifyToken verifies a metadata token of the report. If a serializer is
+// pinned, tokens in the other format are rejected with a dedicated error code
+// instead of failing to parse
+func verifyToken(s ar.Serializer, data []byte, cas []*x509.Certificate, at time.Time,
+) (ar.TokenResult, []byte, bool) {
+	if ar.GetSerializerPin() != "" {
+		if ds, err := ar.DetectSerializer(data); err == nil {
+			if err := ar.CheckSerializer(ds); err != nil {
+				log.Tracef("Metadata: %v", err)
+				return ar.TokenResult{
+					Summary: ar.Result{Success: false, ErrorCode: ar.SerializerNotAllowed},
+				}, nil, false
+			}
+		}
+	}
+	return s.VerifyTokenAt(data, cas, at)
+}
+
+func checkValidity(val ar.Validity, at time.Time) ar.Result {
 	result := ar.Result{}
 	result.Success = true
 
@@ -542,7 +736,10 @@ func checkValidity(val ar.Validity) ar.Result {
 		result.ErrorCode = ar.ParseTime
 		return result
 	}
-	currentTime := time.Now()
+	currentTime := at
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
 
 	if notBefore.After(currentTime) {
 		log.Trace("Validity check failed: Artifact is not valid yet")
@@ -561,41 +758,65 @@ func checkValidity(val ar.Validity) ar.Result {
 
 func collectReferenceValues(metadata *ar.Metadata) (map[string][]ar.ReferenceValue, error) {
 
-	// Add a reference to the corresponding manifest to each reference value
-	for i := range metadata.RtmManifest.ReferenceValues {
-		metadata.RtmManifest.ReferenceValues[i].SetManifest(metadata.RtmManifest)
-	}
-	for i := range metadata.OsManifest.ReferenceValues {
-		metadata.OsManifest.ReferenceValues[i].SetManifest(metadata.OsManifest)
-	}
+	// Add a reference to the corresponding manifest to each reference value. The
+	// manifests are converted once, as each conversion copies the manifest
+	setManifest(metadata.RtmManifest.ReferenceValues, metadata.RtmManifest)
+	setManifest(metadata.OsManifest.ReferenceValues, metadata.OsManifest)
 	for i := range metadata.AppManifests {
-		for j := range metadata.AppManifests[i].ReferenceValues {
-			metadata.AppManifests[i].ReferenceValues[j].SetManifest(metadata.AppManifests[i])
-		}
+		setManifest(metadata.AppManifests[i].ReferenceValues, metadata.AppManifests[i])
 	}
 
 	// Gather a list of all reference values independent of the type
-	refvals := append(metadata.RtmManifest.ReferenceValues, metadata.OsManifest.ReferenceValues...)
+	refvals := [][]ar.ReferenceValue{
+		metadata.RtmManifest.ReferenceValues,
+		metadata.OsManifest.ReferenceValues,
+	}
 	for _, appManifest := range metadata.AppManifests {
-		refvals = append(refvals, appManifest.ReferenceValues...)
+		refvals = append(refvals, appManifest.ReferenceValues)
 	}
 
-	refmap := make(map[string][]ar.ReferenceValue)
+	// Count the reference values per type to allocate them only once, as
+	// TPM manifests may contain thousands of reference values
+	counts := make(map[string]int)
+	for _, rs := range refvals {
+		for i := range rs {
+			counts[rs[i].Type]++
+		}
+	}
+
+	refmap := make(map[string][]ar.ReferenceValue, len(counts))
 
 	// Iterate through the reference values and sort them into the different types
-	for _, r := range refvals {
-		if r.Type != "SNP Reference Value" &&
-			r.Type != "SW Reference Value" &&
-			r.Type != "TPM Reference Value" &&
-			r.Type != "TDX Reference Value" &&
-			r.Type != "SGX Reference Value" {
-			return nil, fmt.Errorf("reference value of type %v is not supported", r.Type)
+	for _, rs := range refvals {
+		for _, r := range rs {
+			if r.Type != "SNP Reference Value" &&
+				r.Type != "SW Reference Value" &&
+				r.Type != "TPM Reference Value" &&
+				r.Type != "TDX Reference Value" &&
+				r.Type != "SGX Reference Value" &&
+				r.Type != "IAS Reference Value" &&
+				r.Type != "Nitro Reference Value" &&
+				r.Type != "GCE Reference Value" &&
+				r.Type != "Azure vTPM Reference Value" &&
+				r.Type != "EAT Reference Value" &&
+				!isVendorRefValType(r.Type) {
+				return nil, fmt.Errorf("reference value of type %v is not supported", r.Type)
+			}
+			if refmap[r.Type] == nil {
+				refmap[r.Type] = make([]ar.ReferenceValue, 0, counts[r.Type])
+			}
+			refmap[r.Type] = append(refmap[r.Type], r)
 		}
-		refmap[r.Type] = append(refmap[r.Type], r)
 	}
 	return refmap, nil
 }
 
+func setManifest(refvals []ar.ReferenceValue, m ar.Manifest) {
+	for i := range refvals {
+		refvals[i].SetManifest(m)
+	}
+}
+
 func checkExtensionUint8(cert *x509.Certificate, oid string, value uint8) (ar.Result, bool) {
 
 	for _, ext := range cert.Extensions {
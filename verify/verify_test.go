@@ -16,18 +16,14 @@
 package verify
 
 import (
-	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"fmt"
-	"math/big"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
 	"testing"
 	"time"
 
 	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+	"github.com/Fraunhofer-AISEC/cmc/fixtures"
 	"github.com/Fraunhofer-AISEC/cmc/generate"
 	"github.com/Fraunhofer-AISEC/cmc/internal"
 	"github.com/sirupsen/logrus"
@@ -68,176 +64,6 @@ var (
 	}
 )
 
-// variables for TestVerify
-var (
-	validRtmManifest = ar.RtmManifest{
-		MetaInfo: ar.MetaInfo{
-			Type:    "RTM Manifest",
-			Name:    "de.test.rtm",
-			Version: "2023-04-10T20:00:00Z",
-		},
-		DevCommonName: "Test Developer",
-		Validity: ar.Validity{
-			NotBefore: "2023-04-10T20:00:00Z",
-			NotAfter:  "2030-04-10T20:00:00Z",
-		},
-		Description:        "de.test.rtm",
-		CertificationLevel: 1,
-	}
-
-	validOsManifest = ar.OsManifest{
-		MetaInfo: ar.MetaInfo{
-			Type:    "OS Manifest",
-			Name:    "de.test.os",
-			Version: "2023-04-10T20:00:00Z",
-		},
-		DevCommonName: "Test Developer",
-		Validity: ar.Validity{
-			NotBefore: "2023-04-10T20:00:00Z",
-			NotAfter:  "2030-04-10T20:00:00Z",
-		},
-		Description:        "PoC Fraunhofer AISEC Sample Report",
-		CertificationLevel: 1,
-		Rtms: []string{
-			"de.test.rtm",
-		},
-	}
-
-	incompatibleOsManifest = ar.OsManifest{
-		MetaInfo: ar.MetaInfo{
-			Type:    "OS Manifest",
-			Name:    "de.test.os",
-			Version: "2023-04-10T20:00:00Z",
-		},
-		DevCommonName: "Test Developer",
-		Validity: ar.Validity{
-			NotBefore: "2023-04-10T20:00:00Z",
-			NotAfter:  "2030-04-10T20:00:00Z",
-		},
-		Description:        "PoC Fraunhofer AISEC Sample Report",
-		CertificationLevel: 1,
-		Rtms: []string{
-			"INVALID",
-		},
-	}
-
-	validDeviceDescription = ar.DeviceDescription{
-		MetaInfo: ar.MetaInfo{
-			Type:    "Device Description",
-			Name:    "test-device.test.de",
-			Version: "2023-04-10T20:00:00Z",
-		},
-		Location:    "Munich, Germany",
-		RtmManifest: "de.test.rtm",
-		OsManifest:  "de.test.os",
-	}
-
-	invalidDeviceDescription = ar.DeviceDescription{
-		MetaInfo: ar.MetaInfo{
-			Type:    "Device Description",
-			Name:    "test-device.test.de",
-			Version: "2023-04-10T20:00:00Z",
-		},
-		Location:    "Munich, Germany",
-		RtmManifest: "INVALID",
-		OsManifest:  "INVALID",
-	}
-
-	nonce = []byte{0x01, 0x02, 0x03}
-)
-
-type SwSigner struct {
-	certChain []*x509.Certificate
-	priv      crypto.PrivateKey
-}
-
-func (s *SwSigner) Init(c *ar.DriverConfig) error {
-	return nil
-}
-
-func (s *SwSigner) Measure(nonce []byte) (ar.Measurement, error) {
-	return ar.Measurement{}, nil
-}
-
-func (s *SwSigner) Lock() error {
-	return nil
-}
-
-func (s *SwSigner) Unlock() error {
-	return nil
-}
-
-func (s *SwSigner) GetSigningKeys() (crypto.PrivateKey, crypto.PublicKey, error) {
-	return s.priv, &s.priv.(*ecdsa.PrivateKey).PublicKey, nil
-}
-
-func (s *SwSigner) GetCertChain() ([]*x509.Certificate, error) {
-	return s.certChain, nil
-}
-
-func createCertsAndKeys() (*ecdsa.PrivateKey, []*x509.Certificate, error) {
-
-	// Generate private key and public key for test CA
-	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
-	}
-
-	caTmpl := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName:   "Test CA Cert",
-			Country:      []string{"DE"},
-			Province:     []string{"BY"},
-			Locality:     []string{"Munich"},
-			Organization: []string{"Test Company"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 180),
-		KeyUsage:              x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-
-	der, err := x509.CreateCertificate(rand.Reader, &caTmpl, &caTmpl, &caPriv.PublicKey, caPriv)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create certificate: %w", err)
-	}
-	ca, err := x509.ParseCertificate(der)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to parse certificate: %w", err)
-	}
-
-	// Generate private key and certificate for test prover, signed by test CA
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-
-	tmpl := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName:   "Test Key Cert",
-			Country:      []string{"DE"},
-			Province:     []string{"BY"},
-			Locality:     []string{"Munich"},
-			Organization: []string{"Test Company"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(time.Hour * 24 * 180),
-		KeyUsage:              x509.KeyUsageDigitalSignature,
-		BasicConstraintsValid: true,
-	}
-
-	der, err = x509.CreateCertificate(rand.Reader, &tmpl, &caTmpl, &priv.PublicKey, caPriv)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create certificate: %v", err)
-	}
-	leaf, err := x509.ParseCertificate(der)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to parse certificate: %w", err)
-	}
-
-	return priv, []*x509.Certificate{leaf, ca}, nil
-}
-
 func Test_collectReferenceValues(t *testing.T) {
 	type args struct {
 		metadata *ar.Metadata
@@ -286,179 +112,453 @@ func Test_collectReferenceValues(t *testing.T) {
 }
 
 func TestVerify(t *testing.T) {
-	logrus.SetLevel(logrus.TraceLevel)
+	internal.SetLogLevel(logrus.TraceLevel)
 
-	type args struct {
-		serializer        ar.Serializer
-		rtmManifest       ar.RtmManifest
-		osManifest        ar.OsManifest
-		deviceDescription ar.DeviceDescription
-		nonce             []byte
+	nonce := []byte{0x01, 0x02, 0x03}
+
+	tests := []struct {
+		name       string
+		serializer ar.Serializer
+		keyType    fixtures.KeyType
+		modify     func(f *fixtures.Fixtures)
+		noTpm      bool
+		nonce      []byte
+		want       bool
+		wantCode   ar.ErrorCode
+	}{
+		{"Valid Report JSON", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa, nil, false, nonce, true,
+			ar.NotSet},
+		{"Valid Report CBOR", ar.CborSerializer{}, fixtures.KeyTypeEcdsa, nil, false, nonce, true,
+			ar.NotSet},
+		{"Valid Report JSON Ed25519", ar.JsonSerializer{}, fixtures.KeyTypeEd25519, nil, false,
+			nonce, true, ar.NotSet},
+		{"Valid Report CBOR Ed25519", ar.CborSerializer{}, fixtures.KeyTypeEd25519, nil, false,
+			nonce, true, ar.NotSet},
+		{"Invalid Nonce", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa, nil, false, []byte{0xff},
+			false, ar.NonceMismatch},
+		// The aggregated certification level of the manifests is 3, but without
+		// hardware measurement, the maximum level is 1
+		{"Invalid Certification Level", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa, nil, true,
+			nonce, false, ar.InvalidCertificationLevel},
+		{"Invalid Device Description", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa,
+			func(f *fixtures.Fixtures) {
+				f.DeviceDescription.RtmManifest = "INVALID"
+				f.DeviceDescription.OsManifest = "INVALID"
+			}, false, nonce, false, ar.VerifyDeviceDescription},
+		{"Incompatible RTM/OS Manifests", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa,
+			func(f *fixtures.Fixtures) {
+				f.OsManifest.Rtms = []string{"INVALID"}
+			}, false, nonce, false, ar.VerifyDeviceDescription},
+		{"Missing Reference Value", ar.CborSerializer{}, fixtures.KeyTypeEcdsa,
+			func(f *fixtures.Fixtures) {
+				f.OsManifest.ReferenceValues = f.OsManifest.ReferenceValues[1:]
+			}, false, nonce, false, ar.PcrNoMatch},
+		{"Expired Manifest", ar.JsonSerializer{}, fixtures.KeyTypeEcdsa,
+			func(f *fixtures.Fixtures) {
+				f.RtmManifest.Validity.NotAfter = f.NotBefore.UTC().Format(time.RFC3339)
+			}, false, nonce, false, ar.Expired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := fixtures.Generate(fixtures.Options{
+				Serializer: tt.serializer,
+				KeyType:    tt.keyType,
+				Nonce:      nonce,
+			})
+			if err != nil {
+				t.Fatalf("failed to generate fixtures: %v", err)
+			}
+			if tt.modify != nil {
+				tt.modify(f)
+				if err := f.SignMetadata(); err != nil {
+					t.Fatalf("failed to sign metadata: %v", err)
+				}
+			}
+
+			var report []byte
+			if tt.noTpm {
+				data, err := generate.Generate(nonce, f.Metadata, nil, f.Serializer)
+				if err != nil {
+					t.Fatalf("failed to generate report: %v", err)
+				}
+				report, err = generate.Sign(data, f.Ik, f.Serializer)
+				if err != nil {
+					t.Fatalf("failed to sign report: %v", err)
+				}
+			} else {
+				report, err = f.NewReport(nonce)
+				if err != nil {
+					t.Fatalf("failed to create report: %v", err)
+				}
+			}
+
+			got := Verify(report, tt.nonce, f.CaPem(), nil, 0, "")
+			if got.Success != tt.want {
+				t.Errorf("Result.Success = %v, want %v", got.Success, tt.want)
+			}
+			if len(got.Checks) == 0 || got.Version != ar.ResultVersion {
+				t.Fatalf("Result contains %v checks with version %v", len(got.Checks),
+					got.Version)
+			}
+			if tt.wantCode != ar.NotSet && !hasFailedCheck(got, tt.wantCode) {
+				t.Errorf("Result.Checks = %+v, want failed check with code %v", got.Checks,
+					tt.wantCode.Name())
+			}
+		})
+	}
+}
+
+func TestVerifyMultipleCas(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	f, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
+	}
+	// A second PKI, e.g. the previous generation during a CA rotation
+	other, err := fixtures.Generate(fixtures.Options{})
+	if err != nil {
+		t.Fatalf("failed to generate fixtures: %v", err)
 	}
+	report, err := f.NewReport(f.Nonce)
+	if err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+	fingerprint := sha256.Sum256(f.Ca.Cert().Raw)
+	root := hex.EncodeToString(fingerprint[:])
+
 	tests := []struct {
 		name string
-		args args
-		want ar.VerificationResult
+		cas  []byte
+		want bool
 	}{
-		{
-			name: "Valid Report JSON",
-			args: args{
-				serializer:        ar.JsonSerializer{},
-				rtmManifest:       validRtmManifest,
-				osManifest:        validOsManifest,
-				deviceDescription: validDeviceDescription,
-				nonce:             nonce,
-			},
-			want: ar.VerificationResult{Success: true},
-		},
-		{
-			name: "Valid Report CBOR",
-			args: args{
-				serializer:        ar.CborSerializer{},
-				rtmManifest:       validRtmManifest,
-				osManifest:        validOsManifest,
-				deviceDescription: validDeviceDescription,
-				nonce:             nonce,
-			},
-			want: ar.VerificationResult{Success: true},
-		},
-		{
-			// expected aggregated CertificationLevel in Manifests for
-			// empty measurement is max. 1 (here CertificationLevel = 3)
-			name: "Invalid Certification Level",
-			args: args{
-				serializer: ar.JsonSerializer{},
-				rtmManifest: ar.RtmManifest{
-					MetaInfo: ar.MetaInfo{
-						Type:    "RTM Manifest",
-						Name:    "de.test.rtm",
-						Version: "2023-04-10T20:00:00Z",
-					},
-					DevCommonName: "Test Developer",
-					Validity: ar.Validity{
-						NotBefore: "2023-04-10T20:00:00Z",
-						NotAfter:  "2026-04-10T20:00:00Z",
-					},
-					Description:        "de.test.rtm",
-					CertificationLevel: 3,
-					ReferenceValues:    []ar.ReferenceValue{},
-				},
-				osManifest: ar.OsManifest{
-					MetaInfo: ar.MetaInfo{
-						Type:    "OS Manifest",
-						Name:    "de.test.os",
-						Version: "2023-04-10T20:00:00Z",
-					},
-					DevCommonName: "Test Developer",
-					Validity: ar.Validity{
-						NotBefore: "2023-04-10T20:00:00Z",
-						NotAfter:  "2026-04-10T20:00:00Z",
-					},
-					Description:        "PoC Fraunhofer AISEC Sample Report",
-					CertificationLevel: 3,
-					Rtms: []string{
-						"de.test.rtm",
-					},
-				},
-				deviceDescription: validDeviceDescription,
-				nonce:             nonce,
-			},
-			want: ar.VerificationResult{Success: false},
-		},
-		{
-			name: "Invalid Device Description",
-			args: args{
-				serializer:        ar.JsonSerializer{},
-				rtmManifest:       validRtmManifest,
-				osManifest:        validOsManifest,
-				deviceDescription: invalidDeviceDescription,
-				nonce:             nonce,
-			},
-			want: ar.VerificationResult{Success: false},
-		},
-		{
-			name: "Incompatible RTM/OS Manifests",
-			args: args{
-				serializer:        ar.JsonSerializer{},
-				rtmManifest:       validRtmManifest,
-				osManifest:        incompatibleOsManifest,
-				deviceDescription: validDeviceDescription,
-				nonce:             nonce,
-			},
-			want: ar.VerificationResult{Success: false},
-		},
+		{"Single Root", f.CaPem(), true},
+		{"Second Root", append(other.CaPem(), f.CaPem()...), true},
+		{"DER Root", f.Ca.Cert().Raw, true},
+		{"No Matching Root", other.CaPem(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Verify(report, f.Nonce, tt.cas, nil, 0, "")
+			if got.Success != tt.want {
+				t.Fatalf("Result.Success = %v, want %v", got.Success, tt.want)
+			}
+			if !tt.want {
+				if !hasFailedCheck(got, ar.VerifyCertChain) {
+					t.Errorf("Result.Checks = %+v, want failed check with code %v", got.Checks,
+						ar.VerifyCertChain.Name())
+				}
+				return
+			}
+			if len(got.ReportSignature) == 0 {
+				t.Fatalf("Result contains no report signature")
+			}
+			for _, s := range got.ReportSignature {
+				if len(s.Roots) != 1 || s.Roots[0] != root {
+					t.Errorf("roots = %v, want [%v]", s.Roots, root)
+				}
+			}
+		})
+	}
+}
+
+// hasFailedCheck returns whether the result contains a failed check with the
+// error code
+func hasFailedCheck(r ar.VerificationResult, code ar.ErrorCode) bool {
+	for _, c := range r.Checks {
+		if !c.Success && c.ErrorCode == code {
+			return true
+		}
 	}
+	return false
+}
 
-	// Setup Test Keys and Certificates
-	log.Trace("Creating Keys and Certificates")
-	key, certchain, err := createCertsAndKeys()
-	if err != nil {
-		log.Errorf("Internal Error: Failed to create testing certs and keys: %v", err)
-		return
+func TestVerifyPeerIdentity(t *testing.T) {
+	internal.SetLogLevel(logrus.ErrorLevel)
+	t.Cleanup(func() { internal.SetLogLevel(logrus.InfoLevel) })
+
+	for _, s := range fixtures.Serializers {
+		for _, k := range fixtures.KeyTypes {
+			f, err := fixtures.Generate(fixtures.Options{Serializer: s, KeyType: k})
+			if err != nil {
+				t.Fatalf("failed to generate fixtures: %v", err)
+			}
+			t.Run(f.Name(), func(t *testing.T) {
+				f.DeviceDescription.Roles = []string{"gateway"}
+				if err := f.SignMetadata(); err != nil {
+					t.Fatalf("failed to sign metadata: %v", err)
+				}
+				report, err := f.NewReport(f.Nonce)
+				if err != nil {
+					t.Fatalf("failed to create report: %v", err)
+				}
+
+				result := Verify(report, f.Nonce, f.CaPem(), nil, 0, "")
+				if !result.Success {
+					t.Fatalf("verification failed")
+				}
+				id, err := ar.PeerIdentity(&result)
+				if err != nil {
+					t.Fatalf("PeerIdentity() error = %v", err)
+				}
+
+				digest := sha256.Sum256(report)
+				if id.ReportId != hex.EncodeToString(digest[:]) {
+					t.Errorf("report ID = %v, want digest of report", id.ReportId)
+				}
+				v := id.Verified
+				if v.Subject == nil || v.Subject.CommonName != f.Ik.Cert().Subject.CommonName {
+					t.Errorf("verified subject = %v, want %v", v.Subject,
+						f.Ik.Cert().Subject.CommonName)
+				}
+				if v.DeviceName != fixtures.DeviceDescriptionName {
+					t.Errorf("verified device name = %v, want %v", v.DeviceName,
+						fixtures.DeviceDescriptionName)
+				}
+				if len(v.Roles) != 1 || v.Roles[0] != "gateway" {
+					t.Errorf("verified roles = %v, want [gateway]", v.Roles)
+				}
+				if !reflect.DeepEqual(id.Asserted, ar.IdentityFields{}) {
+					t.Errorf("asserted = %+v, want none", id.Asserted)
+				}
+			})
+		}
 	}
+}
 
-	swSigner := &SwSigner{
-		priv:      key,
-		certChain: certchain,
+func FuzzVerify(f *testing.F) {
+	internal.SetLogLevel(logrus.PanicLevel)
+	nonce := []byte{0x01, 0x02, 0x03}
+
+	var ca []byte
+	for _, s := range fixtures.Serializers {
+		fix, err := fixtures.Generate(fixtures.Options{Serializer: s, Nonce: nonce})
+		if err != nil {
+			f.Fatalf("failed to generate fixtures: %v", err)
+		}
+		report, err := fix.NewReport(nonce)
+		if err != nil {
+			f.Fatalf("failed to create report: %v", err)
+		}
+		f.Add(report)
+		ca = fix.CaPem()
 	}
 
+	f.Fuzz(func(t *testing.T, report []byte) {
+		Verify(report, nonce, ca, nil, 0, "")
+	})
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	policy := []byte(`
+		var obj = JSON.parse(json);
+		if (obj.prover != "de.fhg.aisec.test") {
+			violation("unexpected prover " + obj.prover);
+		}
+		obj.prover == "de.fhg.aisec.test"
+	`)
+	tests := []struct {
+		name           string
+		prover         string
+		polEng         PolicyEngineSelect
+		wantSuccess    bool
+		wantViolations int
+		wantErr        bool
+	}{
+		{"JS Success", "de.fhg.aisec.test", PolicyEngineSelect_JS, true, 0, false},
+		{"JS Violation", "unknown", PolicyEngineSelect_JS, false, 1, false},
+		{"Engine Not Implemented", "de.fhg.aisec.test", PolicyEngineSelect(99), false, 0, true},
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := tt.args.serializer
+			got, err := EvaluatePolicies(policy, ar.VerificationResult{Prover: tt.prover}, tt.polEng)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EvaluatePolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Success != tt.wantSuccess || len(got.Violations) != tt.wantViolations {
+				t.Errorf("EvaluatePolicies() = %+v, want success %v with %v violations", got,
+					tt.wantSuccess, tt.wantViolations)
+			}
+		})
+	}
+}
 
-			// Preparation: Generate a Sample Report
-			log.Trace("Generating a Sample Report")
+func BenchmarkVerify(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
 
-			ar := ar.AttestationReport{
-				Type: "Attestation Report",
+	tests := []struct {
+		name string
+		opts fixtures.Options
+	}{
+		{"JSON", fixtures.Options{}},
+		{"CBOR", fixtures.Options{Serializer: ar.CborSerializer{}}},
+		{"JSON Large Log", fixtures.Options{AppEvents: 5000}},
+		{"CBOR Large Log", fixtures.Options{Serializer: ar.CborSerializer{}, AppEvents: 5000}},
+	}
+	for _, tt := range tests {
+		f, err := fixtures.Generate(tt.opts)
+		if err != nil {
+			b.Fatalf("failed to generate fixtures: %v", err)
+		}
+		ca := f.CaPem()
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if r := Verify(f.Report, f.Nonce, ca, nil, 0, ""); !r.Success {
+					b.Fatalf("verification failed")
+				}
 			}
+		})
+	}
+}
+
+func BenchmarkVerifyPolicies(b *testing.B) {
+	internal.SetLogLevel(logrus.WarnLevel)
+	policies := []byte(`var obj = JSON.parse(json); obj.type == "Verification Result"`)
+	f, err := fixtures.Generate(fixtures.Options{Serializer: ar.CborSerializer{}, AppEvents: 5000})
+	if err != nil {
+		b.Fatalf("failed to generate fixtures: %v", err)
+	}
+	ca := f.CaPem()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r := Verify(f.Report, f.Nonce, ca, policies, PolicyEngineSelect_JS, ""); !r.Success {
+			b.Fatalf("verification failed")
+		}
+	}
+}
 
-			// Preparation: create signed manifests and deviceDescription
-			rtmManifest, err := s.Marshal(tt.args.rtmManifest)
+// TestVerifyBudget enforces coarse allocation and latency budgets, which are
+// several times above the measured values to only catch severe regressions
+// such as quadratic matching of the measurements
+func TestVerifyBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping budget test in short mode")
+	}
+	internal.SetLogLevel(logrus.WarnLevel)
+
+	tests := []struct {
+		name      string
+		opts      fixtures.Options
+		maxAllocs float64
+		maxTime   time.Duration
+	}{
+		{"JSON", fixtures.Options{}, 15000, 100 * time.Millisecond},
+		{"CBOR", fixtures.Options{Serializer: ar.CborSerializer{}}, 10000, 100 * time.Millisecond},
+		{"CBOR Large Log", fixtures.Options{Serializer: ar.CborSerializer{}, AppEvents: 5000},
+			500000, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := fixtures.Generate(tt.opts)
 			if err != nil {
-				t.Errorf("failed to marshal the RtmManifest: %v", err)
+				t.Fatalf("failed to generate fixtures: %v", err)
 			}
-			osManifest, err := s.Marshal(tt.args.osManifest)
-			if err != nil {
-				t.Errorf("failed to marshal the OsManifest: %v", err)
+			ca := f.CaPem()
+			verify := func() {
+				if r := Verify(f.Report, f.Nonce, ca, nil, 0, ""); !r.Success {
+					t.Fatalf("verification failed")
+				}
 			}
-			deviceDescription, err := s.Marshal(tt.args.deviceDescription)
-			if err != nil {
-				t.Errorf("failed to marshal the DeviceDescription: %v", err)
+
+			if allocs := testing.AllocsPerRun(3, verify); allocs > tt.maxAllocs {
+				t.Errorf("verification allocations = %v, budget %v", allocs, tt.maxAllocs)
 			}
-			ar.RtmManifest, err = generate.Sign(rtmManifest, swSigner, s)
-			if err != nil {
-				t.Errorf("failed to sign the RtmManifest: %v", err)
+			start := time.Now()
+			verify()
+			if d := time.Since(start); d > tt.maxTime {
+				t.Errorf("verification took %v, budget %v", d, tt.maxTime)
 			}
-			ar.OsManifest, err = generate.Sign(osManifest, swSigner, s)
+		})
+	}
+}
+
+func TestVerifySerializerPin(t *testing.T) {
+	nonce := []byte{0x01, 0x02, 0x03}
+	t.Cleanup(func() { ar.SetSerializerPin("") })
+
+	// mixed returns a JSON report with an RTM manifest serialized as CBOR
+	mixed := func(f *fixtures.Fixtures) ([]byte, error) {
+		data, err := generate.Generate(nonce, f.Metadata, []ar.Driver{f}, f.Serializer)
+		if err != nil {
+			return nil, err
+		}
+		var report ar.AttestationReport
+		if err := f.Serializer.Unmarshal(data, &report); err != nil {
+			return nil, err
+		}
+		rtm, err := ar.CborSerializer{}.Marshal(f.RtmManifest)
+		if err != nil {
+			return nil, err
+		}
+		report.RtmManifest, err = generate.Sign(rtm, f.Developer, ar.CborSerializer{})
+		if err != nil {
+			return nil, err
+		}
+		data, err = f.Serializer.Marshal(report)
+		if err != nil {
+			return nil, err
+		}
+		return generate.Sign(data, f, f.Serializer)
+	}
+
+	tests := []struct {
+		name       string
+		pin        string
+		serializer ar.Serializer
+		mixed      bool
+		want       bool
+		wantCode   ar.ErrorCode
+		wantRtm    ar.ErrorCode
+	}{
+		{"No Pin JSON", "", ar.JsonSerializer{}, false, true, ar.NotSet, ar.NotSet},
+		{"No Pin CBOR", "", ar.CborSerializer{}, false, true, ar.NotSet, ar.NotSet},
+		{"Pinned JSON", "json", ar.JsonSerializer{}, false, true, ar.NotSet, ar.NotSet},
+		{"Pinned CBOR", "cbor", ar.CborSerializer{}, false, true, ar.NotSet, ar.NotSet},
+		{"JSON Report Pinned CBOR", "cbor", ar.JsonSerializer{}, false, false,
+			ar.SerializerNotAllowed, ar.NotSet},
+		{"CBOR Report Pinned JSON", "json", ar.CborSerializer{}, false, false,
+			ar.SerializerNotAllowed, ar.NotSet},
+		{"CBOR Manifest Pinned JSON", "json", ar.JsonSerializer{}, true, false, ar.NotSet,
+			ar.SerializerNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := fixtures.Generate(fixtures.Options{Serializer: tt.serializer, Nonce: nonce})
 			if err != nil {
-				t.Errorf("failed to sign the OsManifest: %v", err)
+				t.Fatalf("failed to generate fixtures: %v", err)
 			}
-			ar.DeviceDescription, err = generate.Sign(deviceDescription, swSigner, s)
-			if err != nil {
-				t.Errorf("failed to sign the DeviceDescription: %v", err)
+			var report []byte
+			if tt.mixed {
+				report, err = mixed(f)
+			} else {
+				report, err = f.NewReport(nonce)
 			}
-
-			report, err := s.Marshal(ar)
 			if err != nil {
-				t.Errorf("failed to marshal the Attestation Report: %v", err)
+				t.Fatalf("failed to create report: %v", err)
 			}
 
-			// Preparation: Sign the report
-			arSigned, err := generate.Sign(report, swSigner, s)
-			if err != nil {
-				t.Errorf("Internal Error: Failed to sign Attestion Report: %v", err)
+			if err := ar.SetSerializerPin(tt.pin); err != nil {
+				t.Fatalf("SetSerializerPin() error = %v", err)
 			}
+			defer ar.SetSerializerPin("")
 
-			// Run FUT
-			got := Verify(
-				arSigned, nonce,
-				internal.WriteCertPem(certchain[len(certchain)-1]),
-				nil, 0, "")
-			if got.Success != tt.want.Success {
-				t.Errorf("Result.Success = %v, want %v", got.Success, tt.want.Success)
+			got := Verify(report, nonce, f.CaPem(), nil, 0, "")
+			if got.Success != tt.want {
+				t.Errorf("Result.Success = %v, want %v", got.Success, tt.want)
+			}
+			if got.ErrorCode != tt.wantCode {
+				t.Errorf("Result.ErrorCode = %v, want %v", got.ErrorCode, tt.wantCode)
+			}
+			if code := got.MetadataResult.RtmResult.Summary.ErrorCode; code != tt.wantRtm {
+				t.Errorf("RTM Manifest ErrorCode = %v, want %v", code, tt.wantRtm)
 			}
-			fmt.Println(got)
 		})
 	}
 }
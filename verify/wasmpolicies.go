@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Fraunhofer AISEC
+// Fraunhofer-Gesellschaft zur Foerderung der angewandten Forschung e.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build wasmpolicies
+
+package verify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Fraunhofer-AISEC/cmc/attestationpolicies/wasmpolicies"
+	ar "github.com/Fraunhofer-AISEC/cmc/attestationreport"
+)
+
+type WasmPolicyEngine struct{}
+
+func init() {
+	policyEngines[PolicyEngineSelect_Wasm] = WasmPolicyEngine{}
+}
+
+func (p WasmPolicyEngine) Validate(policies []byte, result ar.VerificationResult) bool {
+	d, err := p.Evaluate(policies, result)
+	if err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return d.Success
+}
+
+func (p WasmPolicyEngine) Evaluate(policies []byte, result ar.VerificationResult,
+) (*PolicyDecision, error) {
+	vr, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal verification result: %w", err)
+	}
+	d, err := wasmpolicies.NewWasmPolicyEngine(policies, getPolicyTimeout(),
+		getPolicyMemoryLimit()).Evaluate(vr)
+	if err != nil {
+		return nil, &PolicyError{Code: wasmErrorCode(err), Err: err}
+	}
+	return &PolicyDecision{
+		Success:    d.Success,
+		Violations: d.Violations,
+		Trace:      d.Trace,
+	}, nil
+}
+
+func wasmErrorCode(err error) ar.ErrorCode {
+	switch {
+	case errors.Is(err, wasmpolicies.ErrCompile):
+		return ar.PolicyCompile
+	case errors.Is(err, wasmpolicies.ErrTimeout):
+		return ar.PolicyTimeout
+	case errors.Is(err, wasmpolicies.ErrTrap):
+		return ar.PolicyTrap
+	case errors.Is(err, wasmpolicies.ErrMemoryLimit):
+		return ar.PolicyMemoryLimit
+	case errors.Is(err, wasmpolicies.ErrUndefined):
+		return ar.PolicyUndefined
+	default:
+		return ar.VerifyPolicies
+	}
+}